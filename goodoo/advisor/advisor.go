@@ -0,0 +1,309 @@
+// Package advisor recommends indexes from the slow queries of a database.
+// It explains the slowest statements recorded by the database package,
+// looks for sequential scans filtering large tables on columns no index
+// leads with, and ranks the indexes that would serve them by the time they
+// would have saved. Indexes never scanned for long are reported as
+// candidates for removal. Nothing is applied: the advice is stored for an
+// administrator to dismiss or apply.
+package advisor
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"goodoo/database"
+	"goodoo/models"
+)
+
+// Options tune a run of the advisor
+type Options struct {
+	// MinRows is the estimated rows below which sequential scans of a
+	// table are left alone
+	MinRows int64
+	// UnusedAfter is how long an index must go without scans to be
+	// reported for removal
+	UnusedAfter time.Duration
+	// MaxStatements bounds the slow statements explained, the most time
+	// consuming first
+	MaxStatements int
+}
+
+// DefaultOptions advises on tables of 10000 rows or more, indexes unused
+// for 30 days and the 50 most time consuming slow statements
+func DefaultOptions() Options {
+	return Options{MinRows: 10000, UnusedAfter: 30 * 24 * time.Hour, MaxStatements: 50}
+}
+
+// Report is the outcome of a run: the advice, ranked, and how much of the
+// slow query log it is based on
+type Report struct {
+	Advice      []models.IndexAdvice `json:"advice"`
+	SlowQueries int                  `json:"slow_queries"`
+	Explained   int                  `json:"explained"`
+	// Skipped statements are not single SELECTs and cannot be explained
+	Skipped int      `json:"skipped"`
+	Errors  []string `json:"errors,omitempty"`
+	// StatsSince is when the index usage statistics started counting
+	StatsSince time.Time `json:"stats_since"`
+}
+
+// maxErrors bounds the explain errors reported
+const maxErrors = 10
+
+// candidate is an index to add, with the statements it would serve
+type candidate struct {
+	advice   models.IndexAdvice
+	sampleMs float64
+}
+
+// Analyze advises on the indexes of a database at now
+func Analyze(dbName string, opts Options, now time.Time) (*Report, error) {
+	tables, err := database.TableStats(dbName)
+	if err != nil {
+		return nil, err
+	}
+	rowsByTable := make(map[string]int64, len(tables))
+	for _, table := range tables {
+		rowsByTable[table.Name] = table.RowEstimate
+	}
+	indexes, err := database.IndexUsages(dbName)
+	if err != nil {
+		return nil, err
+	}
+	since, err := database.StatsSince(dbName)
+	if err != nil {
+		return nil, err
+	}
+	fieldsByTable, declared := registryFields(dbName)
+
+	report := &Report{StatsSince: since}
+	queries := database.SlowQueries(dbName)
+	report.SlowQueries = len(queries)
+	if len(queries) > opts.MaxStatements {
+		queries = queries[:opts.MaxStatements]
+	}
+
+	candidates := make(map[string]*candidate)
+	for _, query := range queries {
+		plan, err := database.Explain(dbName, query.Sample)
+		if errors.Is(err, database.ErrNotExplainable) {
+			report.Skipped++
+			continue
+		}
+		if err != nil {
+			if len(report.Errors) < maxErrors {
+				report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", query.Fingerprint, err))
+			}
+			continue
+		}
+		report.Explained++
+
+		seen := make(map[string]bool)
+		for _, scan := range plan.Scans {
+			rows := rowsByTable[scan.Relation]
+			if scan.Node != "Seq Scan" || scan.Filter == "" || rows < opts.MinRows {
+				continue
+			}
+			columns := indexColumns(scan.Filter, fieldsByTable[scan.Relation])
+			if len(columns) == 0 || covered(indexes, scan.Relation, columns) {
+				continue
+			}
+			key := models.AdviceAddIndex + ":" + scan.Relation + ":" + strings.Join(columns, ",")
+			c := candidates[key]
+			if c == nil {
+				c = newCandidate(key, scan.Relation, columns)
+				candidates[key] = c
+			}
+			// The index would spare reading the rows the filter drops, in
+			// the share of the statement the scan costs
+			saved := query.TotalMs * clamp(1-scan.Rows/float64(rows))
+			if plan.Cost > 0 {
+				saved *= clamp(scan.Cost / plan.Cost)
+			}
+			c.advice.TimeSavedMs += saved
+			if !seen[key] {
+				seen[key] = true
+				c.advice.Statements++
+				c.advice.Calls += query.Calls
+			}
+			if query.MaxMs > c.sampleMs {
+				c.sampleMs = query.MaxMs
+				c.advice.Sample = query.Sample
+			}
+		}
+	}
+	for _, c := range candidates {
+		c.advice.TimeSavedMs = float64(int64(c.advice.TimeSavedMs*10)) / 10
+		c.advice.Reason = fmt.Sprintf("%d slow statement(s), %d run(s), scan %s sequentially filtering on %s",
+			c.advice.Statements, c.advice.Calls, c.advice.Table, strings.ReplaceAll(c.advice.Columns, ",", ", "))
+		report.Advice = append(report.Advice, c.advice)
+	}
+
+	if now.Sub(since) >= opts.UnusedAfter {
+		report.Advice = append(report.Advice, unusedIndexes(indexes, declared, since)...)
+	}
+	sort.Slice(report.Advice, func(i, j int) bool {
+		a, b := report.Advice[i], report.Advice[j]
+		if a.TimeSavedMs != b.TimeSavedMs {
+			return a.TimeSavedMs > b.TimeSavedMs
+		}
+		if a.SizeBytes != b.SizeBytes {
+			return a.SizeBytes > b.SizeBytes
+		}
+		return a.Key < b.Key
+	})
+	return report, nil
+}
+
+// registryFields returns the stored fields of the model tables of a
+// database by table, and the model field declaring each generated index
+func registryFields(dbName string) (map[string]map[string]bool, map[string]string) {
+	fieldsByTable := make(map[string]map[string]bool)
+	declared := make(map[string]string)
+	for name, model := range models.RegistryForDB(dbName).GetAllModels() {
+		if model.Abstract || model.TableName == "" {
+			continue
+		}
+		stored := make(map[string]bool)
+		for field := range model.GetStoredFields() {
+			stored[field] = true
+		}
+		fieldsByTable[model.TableName] = stored
+		for _, idx := range model.GetIndexes() {
+			declared[idx.Name] = name + "." + idx.Column
+		}
+	}
+	return fieldsByTable, declared
+}
+
+// conditionPattern matches a column compared in a plan filter, like
+// "(state)::text = " or "partner_id = "
+var conditionPattern = regexp.MustCompile(`([A-Za-z_][A-Za-z0-9_]*)"?\)?(?:::[a-z ]+?(?:\[\])?)?\s*(<>|<=|>=|=|<|>|IS NULL)`)
+
+// maxIndexColumns bounds the columns of an advised index
+const maxIndexColumns = 3
+
+// indexColumns returns the columns of an index serving a filter: the
+// columns compared for equality, then one compared by range. Columns of a
+// model table must be stored fields of the model; casts and literals are
+// not columns.
+func indexColumns(filter string, stored map[string]bool) []string {
+	var equal, ranged []string
+	seen := make(map[string]bool)
+	for _, match := range conditionPattern.FindAllStringSubmatchIndex(filter, -1) {
+		column := filter[match[2]:match[3]]
+		operator := filter[match[4]:match[5]]
+		if match[2] > 0 && strings.ContainsRune(":'", rune(filter[match[2]-1])) {
+			continue
+		}
+		if seen[column] || operator == "<>" || (stored != nil && !stored[column]) {
+			continue
+		}
+		seen[column] = true
+		switch operator {
+		case "=", "IS NULL":
+			equal = append(equal, column)
+		default:
+			ranged = append(ranged, column)
+		}
+	}
+	if len(equal) > maxIndexColumns {
+		equal = equal[:maxIndexColumns]
+	}
+	if len(ranged) > 0 && len(equal) < maxIndexColumns {
+		equal = append(equal, ranged[0])
+	}
+	return equal
+}
+
+// covered reports whether a valid index of the table leads with the
+// columns, in any order
+func covered(indexes []database.IndexUsage, table string, columns []string) bool {
+	wanted := make(map[string]bool, len(columns))
+	for _, column := range columns {
+		wanted[column] = true
+	}
+	for _, index := range indexes {
+		if index.Table != table || !index.Valid || len(index.Columns) < len(columns) {
+			continue
+		}
+		leading := true
+		for _, column := range index.Columns[:len(columns)] {
+			if !wanted[column] {
+				leading = false
+				break
+			}
+		}
+		if leading {
+			return true
+		}
+	}
+	return false
+}
+
+// newCandidate returns the advice of an index on columns of a table
+func newCandidate(key, table string, columns []string) *candidate {
+	name := indexName(table, columns)
+	statement, err := models.ConcurrentIndexSQL(table, name, columns)
+	if err != nil {
+		statement = ""
+	}
+	return &candidate{advice: models.IndexAdvice{
+		Key:       key,
+		Kind:      models.AdviceAddIndex,
+		Table:     table,
+		Columns:   strings.Join(columns, ","),
+		IndexName: name,
+		SQL:       statement,
+	}}
+}
+
+// indexName names an advised index <table>__<columns>_advised, which
+// schema synchronization leaves alone; names longer than PostgreSQL allows
+// are cut and suffixed with a hash
+func indexName(table string, columns []string) string {
+	name := table + "__" + strings.Join(columns, "_") + "_advised"
+	if len(name) <= 63 {
+		return name
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(name))
+	return fmt.Sprintf("%s_%08x_advised", name[:46], hash.Sum32())
+}
+
+// unusedIndexes returns the removal advice of the indexes not scanned
+// since the statistics started counting; unique and primary key indexes
+// enforce constraints and are kept
+func unusedIndexes(indexes []database.IndexUsage, declared map[string]string, since time.Time) []models.IndexAdvice {
+	var advice []models.IndexAdvice
+	for _, index := range indexes {
+		if index.Scans > 0 || index.Unique || index.Primary || !index.Valid {
+			continue
+		}
+		reason := fmt.Sprintf("never scanned since %s", since.UTC().Format("2006-01-02"))
+		if field, ok := declared[index.Name]; ok {
+			reason += fmt.Sprintf("; declared by field %s, drop its index attribute or schema synchronization recreates it", field)
+		}
+		advice = append(advice, models.IndexAdvice{
+			Key:       models.AdviceDropIndex + ":" + index.Name,
+			Kind:      models.AdviceDropIndex,
+			Table:     index.Table,
+			Columns:   strings.Join(index.Columns, ","),
+			IndexName: index.Name,
+			SQL:       "DROP INDEX CONCURRENTLY IF EXISTS " + models.QuoteIdentifier(index.Name),
+			Reason:    reason,
+			SizeBytes: index.SizeBytes,
+		})
+	}
+	return advice
+}
+
+// clamp bounds a ratio to [0, 1]
+func clamp(ratio float64) float64 {
+	return max(0, min(1, ratio))
+}
@@ -0,0 +1,424 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"goodoo/fields"
+)
+
+// Handlers are plain functions. Their leading parameters (up to two) may
+// take the call's context, the model or the record IDs, which the registry
+// passes by type. The following parameters take the call's positional
+// arguments, converted from their JSON types; trailing pointer parameters
+// are optional. A last parameter of a struct type with `api:"name"` field
+// tags takes the keyword arguments, each field filled from the keyword
+// argument of its name. Handlers may return nothing, a result, an error,
+// or a result and an error.
+
+// TimeFormats are the layouts accepted for time.Time arguments, in order
+var TimeFormats = []string{time.RFC3339Nano, "2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02"}
+
+var (
+	timeType  = reflect.TypeOf(time.Time{})
+	errorType = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// ArgumentError reports a call argument that does not convert to the type
+// of the handler parameter receiving it
+type ArgumentError struct {
+	// Argument names the argument: "argument 2", "argument 2[0]" or
+	// "keyword argument limit"
+	Argument string
+	Expected string
+	Got      string
+}
+
+func (e *ArgumentError) Error() string {
+	return fmt.Sprintf("%s: expected %s, got %s", e.Argument, e.Expected, e.Got)
+}
+
+// signature describes how the parameters of a handler are bound
+type signature struct {
+	handler reflect.Type
+	// injected is the number of leading context, model and IDs parameters
+	injected int
+	// positional is the number of parameters taking positional arguments,
+	// the first required of them being required
+	positional int
+	required   int
+	// options is the index of the parameter taking the keyword arguments,
+	// -1 when there is none
+	options  int
+	variadic bool
+}
+
+// handlerSignature analyzes the parameters of a handler function type
+func handlerSignature(handlerType reflect.Type) signature {
+	s := signature{handler: handlerType, options: -1, variadic: handlerType.IsVariadic()}
+	params := handlerType.NumIn()
+	for s.injected < 2 && s.injected < params && isInjected(handlerType.In(s.injected)) {
+		s.injected++
+	}
+
+	end := params
+	if s.variadic {
+		end--
+	} else if end > s.injected && isOptions(handlerType.In(end-1)) {
+		s.options = end - 1
+		end--
+	}
+	s.positional = end - s.injected
+	s.required = s.positional
+	for s.required > 0 && handlerType.In(s.injected+s.required-1).Kind() == reflect.Ptr {
+		s.required--
+	}
+	return s
+}
+
+// isInjected reports whether a parameter takes a value passed by the registry
+func isInjected(t reflect.Type) bool {
+	return t == contextType || t == modelType || t == idsType
+}
+
+// isOptions reports whether a parameter type takes keyword arguments: a
+// struct, or pointer to struct, with api-tagged fields
+func isOptions(t reflect.Type) bool {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || t == timeType {
+		return false
+	}
+	for i := 0; i < t.NumField(); i++ {
+		if _, ok := t.Field(i).Tag.Lookup("api"); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// keywordName returns the keyword argument filling a field, "" for none
+func keywordName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("api"), ",")
+	if name == "-" || !field.IsExported() {
+		return ""
+	}
+	return name
+}
+
+// bind converts the arguments of a call to the parameters of the handler
+func (s signature) bind(ctx context.Context, method *APIMethod, call *APICall) ([]reflect.Value, error) {
+	args := call.Args
+	maxArgs := s.positional
+	if s.options >= 0 {
+		maxArgs++
+	}
+	if len(args) < s.required || (!s.variadic && len(args) > maxArgs) {
+		if s.required == maxArgs {
+			return nil, fmt.Errorf("method expects %d argument(s), got %d", s.required, len(args))
+		}
+		return nil, fmt.Errorf("method expects %d to %d argument(s), got %d", s.required, maxArgs, len(args))
+	}
+
+	values := make([]reflect.Value, 0, s.handler.NumIn()+len(args))
+	for i := 0; i < s.injected; i++ {
+		switch s.handler.In(i) {
+		case contextType:
+			values = append(values, reflect.ValueOf(&ctx).Elem())
+		case modelType:
+			values = append(values, reflect.ValueOf(method.Model))
+		default:
+			values = append(values, reflect.ValueOf(call.IDs))
+		}
+	}
+
+	for i := 0; i < s.positional; i++ {
+		want := s.handler.In(s.injected + i)
+		if i >= len(args) {
+			values = append(values, reflect.Zero(want))
+			continue
+		}
+		value, err := convertArgument(args[i], want, fmt.Sprintf("argument %d", i+1))
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+
+	if s.options >= 0 {
+		want := s.handler.In(s.options)
+		options := reflect.Zero(want)
+		if len(args) > s.positional {
+			value, err := convertArgument(args[s.positional], want, fmt.Sprintf("argument %d", s.positional+1))
+			if err != nil {
+				return nil, err
+			}
+			options = value
+		}
+		options, err := bindKeywords(options, call.Kwargs)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, options)
+	}
+
+	if s.variadic {
+		want := s.handler.In(s.handler.NumIn() - 1).Elem()
+		for i := s.positional; i < len(args); i++ {
+			value, err := convertArgument(args[i], want, fmt.Sprintf("argument %d", i+1))
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+	}
+	return values, nil
+}
+
+// bindKeywords fills the api-tagged fields of an options struct from the
+// keyword arguments of their name
+func bindKeywords(options reflect.Value, kwargs map[string]interface{}) (reflect.Value, error) {
+	structType := options.Type()
+	pointer := structType.Kind() == reflect.Ptr
+	if pointer {
+		structType = structType.Elem()
+	}
+
+	filled := reflect.New(structType).Elem()
+	switch {
+	case pointer && !options.IsNil():
+		filled.Set(options.Elem())
+	case !pointer:
+		filled.Set(options)
+	}
+
+	set := false
+	for i := 0; i < structType.NumField(); i++ {
+		name := keywordName(structType.Field(i))
+		raw, ok := kwargs[name]
+		if name == "" || !ok {
+			continue
+		}
+		value, err := convertArgument(raw, structType.Field(i).Type, "keyword argument "+name)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		filled.Field(i).Set(value)
+		set = true
+	}
+
+	if !pointer {
+		return filled, nil
+	}
+	if !set && options.IsNil() {
+		return options, nil
+	}
+	return filled.Addr(), nil
+}
+
+// convertArgument converts a JSON-decoded value to a parameter type
+func convertArgument(value interface{}, want reflect.Type, argument string) (reflect.Value, error) {
+	fail := func() (reflect.Value, error) {
+		return reflect.Value{}, &ArgumentError{Argument: argument, Expected: want.String(), Got: jsonKind(value)}
+	}
+
+	if value == nil {
+		switch want.Kind() {
+		case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice:
+			return reflect.Zero(want), nil
+		}
+		return fail()
+	}
+	v := reflect.ValueOf(value)
+	if v.Type().AssignableTo(want) {
+		return v, nil
+	}
+
+	switch want.Kind() {
+	case reflect.Ptr:
+		elem, err := convertArgument(value, want.Elem(), argument)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		pointer := reflect.New(want.Elem())
+		pointer.Elem().Set(elem)
+		return pointer, nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if _, ok := jsonNumber(value); !ok {
+			return fail()
+		}
+		number, err := fields.ConvertToInt64(value)
+		if err != nil || reflect.New(want).Elem().OverflowInt(number) {
+			return fail()
+		}
+		return reflect.ValueOf(number).Convert(want), nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if _, ok := jsonNumber(value); !ok {
+			return fail()
+		}
+		number, err := fields.ConvertToInt64(value)
+		if err != nil || number < 0 || reflect.New(want).Elem().OverflowUint(uint64(number)) {
+			return fail()
+		}
+		return reflect.ValueOf(uint64(number)).Convert(want), nil
+
+	case reflect.Float32, reflect.Float64:
+		number, ok := jsonNumber(value)
+		if !ok || reflect.New(want).Elem().OverflowFloat(number) {
+			return fail()
+		}
+		return reflect.ValueOf(number).Convert(want), nil
+
+	case reflect.String, reflect.Bool:
+		if v.Kind() != want.Kind() {
+			return fail()
+		}
+		return v.Convert(want), nil
+
+	case reflect.Slice:
+		items, ok := value.([]interface{})
+		if !ok {
+			return fail()
+		}
+		slice := reflect.MakeSlice(want, len(items), len(items))
+		for i, item := range items {
+			converted, err := convertArgument(item, want.Elem(), fmt.Sprintf("%s[%d]", argument, i))
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			slice.Index(i).Set(converted)
+		}
+		return slice, nil
+
+	case reflect.Map:
+		entries, ok := value.(map[string]interface{})
+		if !ok || want.Key().Kind() != reflect.String {
+			return fail()
+		}
+		result := reflect.MakeMapWithSize(want, len(entries))
+		for key, entry := range entries {
+			converted, err := convertArgument(entry, want.Elem(), argument+"."+key)
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			result.SetMapIndex(reflect.ValueOf(key).Convert(want.Key()), converted)
+		}
+		return result, nil
+
+	case reflect.Struct:
+		if want == timeType {
+			text, ok := value.(string)
+			if !ok {
+				return fail()
+			}
+			for _, layout := range TimeFormats {
+				if parsed, err := time.Parse(layout, text); err == nil {
+					return reflect.ValueOf(parsed), nil
+				}
+			}
+			return reflect.Value{}, &ArgumentError{Argument: argument, Expected: "a date or datetime", Got: strconv.Quote(text)}
+		}
+		if _, ok := value.(map[string]interface{}); !ok {
+			return fail()
+		}
+		// Structs decode through their JSON encoding, honoring json tags
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return fail()
+		}
+		decoded := reflect.New(want)
+		if err := json.Unmarshal(encoded, decoded.Interface()); err != nil {
+			return reflect.Value{}, &ArgumentError{Argument: argument, Expected: want.String(), Got: "object (" + err.Error() + ")"}
+		}
+		return decoded.Elem(), nil
+	}
+	return fail()
+}
+
+// jsonNumber returns the value of a JSON number
+func jsonNumber(value interface{}) (float64, bool) {
+	switch number := value.(type) {
+	case float64:
+		return number, true
+	case json.Number:
+		f, err := number.Float64()
+		return f, err == nil
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+	case reflect.Float32:
+		return v.Float(), true
+	}
+	return 0, false
+}
+
+// jsonKind names the JSON type of a decoded value for error messages
+func jsonKind(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	if _, ok := jsonNumber(value); ok {
+		return "number"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// callHandler binds the arguments of a call, calls the method handler and
+// returns its result. A panic in the handler is logged with its stack and
+// returned as an internal error.
+func callHandler(ctx context.Context, method *APIMethod, call *APICall) (result interface{}, err error) {
+	handler := reflect.ValueOf(method.Handler)
+	if handler.Kind() != reflect.Func {
+		return nil, fmt.Errorf("handler is not a function")
+	}
+	args, err := handlerSignature(handler.Type()).bind(ctx, method, call)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			method.Logger.ErrorCtx(ctx, "Method panicked: %v\n%s", r, debug.Stack())
+			result, err = nil, fmt.Errorf("internal error in method %s", method.Name)
+		}
+	}()
+	return handlerResults(handler.Call(args))
+}
+
+// handlerResults returns the result and error of a handler call
+func handlerResults(results []reflect.Value) (interface{}, error) {
+	var err error
+	if n := len(results); n > 0 && results[n-1].Type().Implements(errorType) {
+		last := results[n-1]
+		if (last.Kind() != reflect.Interface && last.Kind() != reflect.Ptr) || !last.IsNil() {
+			err = last.Interface().(error)
+		}
+		results = results[:n-1]
+	}
+	if len(results) == 0 {
+		return nil, err
+	}
+	return results[0].Interface(), err
+}
@@ -3,8 +3,9 @@ package api
 import (
 	"context"
 	"fmt"
-	"reflect"
+	"sync"
 
+	"goodoo/database"
 	"goodoo/http"
 	"goodoo/logging"
 	"goodoo/models"
@@ -41,11 +42,14 @@ type APIMethod struct {
 	Logger       *logging.Logger   `json:"-"`
 }
 
-// APIRegistry manages API method registration and exposure
+// APIRegistry manages API method registration and exposure. Registered
+// methods are never modified in place: decorators store a modified copy,
+// so a method looked up by a running call does not change under it.
 type APIRegistry struct {
 	methods map[string]map[string]*APIMethod // model_name -> method_name -> method
 	models  map[string]*models.ModelDefinition
 	logger  *logging.Logger
+	mutex   sync.RWMutex
 }
 
 // NewAPIRegistry creates a new API registry
@@ -60,15 +64,12 @@ func NewAPIRegistry() *APIRegistry {
 // MethodBuilder helps create API methods with decorators
 type MethodBuilder struct {
 	method     *APIMethod
+	modelName  string
 	registry   *APIRegistry
 }
 
 // NewMethod creates a new method builder
 func (r *APIRegistry) NewMethod(modelName, methodName string, handler interface{}) *MethodBuilder {
-	if _, exists := r.methods[modelName]; !exists {
-		r.methods[modelName] = make(map[string]*APIMethod)
-	}
-
 	method := &APIMethod{
 		Name:    methodName,
 		Type:    RecordMethod, // default
@@ -82,73 +83,106 @@ func (r *APIRegistry) NewMethod(modelName, methodName string, handler interface{
 		method.Model = model
 	}
 
+	r.mutex.Lock()
+	if _, exists := r.methods[modelName]; !exists {
+		r.methods[modelName] = make(map[string]*APIMethod)
+	}
 	r.methods[modelName][methodName] = method
+	r.mutex.Unlock()
 	r.logger.Info("Registered API method: %s.%s", modelName, methodName)
 
 	return &MethodBuilder{
-		method:   method,
-		registry: r,
+		method:    method,
+		modelName: modelName,
+		registry:  r,
 	}
 }
 
+// update applies a decorator to a copy of the method and registers the copy
+func (b *MethodBuilder) update(decorate func(method *APIMethod)) *MethodBuilder {
+	r := b.registry
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	copied := *b.method
+	decorate(&copied)
+	// The method may have been replaced by another registration since
+	if methods := r.methods[b.modelName]; methods[copied.Name] == b.method {
+		methods[copied.Name] = &copied
+	}
+	b.method = &copied
+	return b
+}
+
 // Model decorator - marks method as model-level (static)
 func (b *MethodBuilder) Model() *MethodBuilder {
-	b.method.Type = ModelMethod
-	return b
+	return b.update(func(method *APIMethod) {
+		method.Type = ModelMethod
+	})
 }
 
 // Private decorator - marks method as private (not RPC accessible)
 func (b *MethodBuilder) Private() *MethodBuilder {
-	b.method.Type = PrivateMethod
-	b.method.Public = false
-	return b
+	return b.update(func(method *APIMethod) {
+		method.Type = PrivateMethod
+		method.Public = false
+	})
 }
 
 // Constrains decorator - specifies constraint dependencies
 func (b *MethodBuilder) Constrains(fields ...string) *MethodBuilder {
-	b.method.Constrains = fields
-	return b
+	return b.update(func(method *APIMethod) {
+		method.Constrains = fields
+	})
 }
 
 // Depends decorator - specifies compute dependencies
 func (b *MethodBuilder) Depends(fields ...string) *MethodBuilder {
-	b.method.Depends = fields
-	return b
+	return b.update(func(method *APIMethod) {
+		method.Depends = fields
+	})
 }
 
 // OnChange decorator - specifies onchange fields
 func (b *MethodBuilder) OnChange(fields ...string) *MethodBuilder {
-	b.method.OnChange = fields
-	return b
+	return b.update(func(method *APIMethod) {
+		method.OnChange = fields
+	})
 }
 
 // Returns decorator - specifies return model
 func (b *MethodBuilder) Returns(modelName string) *MethodBuilder {
-	b.method.Returns = modelName
-	return b
+	return b.update(func(method *APIMethod) {
+		method.Returns = modelName
+	})
 }
 
 // Groups decorator - specifies required user groups
 func (b *MethodBuilder) Groups(groups ...string) *MethodBuilder {
-	b.method.Groups = groups
-	return b
+	return b.update(func(method *APIMethod) {
+		method.Groups = groups
+	})
 }
 
 // Context decorator - adds context variables
 func (b *MethodBuilder) Context(ctx map[string]interface{}) *MethodBuilder {
-	if b.method.Context == nil {
-		b.method.Context = make(map[string]interface{})
-	}
-	for k, v := range ctx {
-		b.method.Context[k] = v
-	}
-	return b
+	return b.update(func(method *APIMethod) {
+		merged := make(map[string]interface{}, len(method.Context)+len(ctx))
+		for k, v := range method.Context {
+			merged[k] = v
+		}
+		for k, v := range ctx {
+			merged[k] = v
+		}
+		method.Context = merged
+	})
 }
 
 // Help sets help text for the method
 func (b *MethodBuilder) Help(help string) *MethodBuilder {
-	b.method.Help = help
-	return b
+	return b.update(func(method *APIMethod) {
+		method.Help = help
+	})
 }
 
 // Register completes method registration
@@ -174,18 +208,53 @@ type APIResponse struct {
 	Warning string      `json:"warning,omitempty"`
 }
 
-// ExecuteCall executes an API method call
-func (r *APIRegistry) ExecuteCall(ctx context.Context, call *APICall, req *http.Request) *APIResponse {
+// CallOptions tunes the execution of a call
+type CallOptions struct {
+	// Savepoint runs the method in a savepoint of the request's ambient
+	// transaction, released when the method succeeds and rolled back when
+	// it fails, so that the next calls of the transaction can proceed. Single
+	// calls leave it unset and skip the savepoint round trips.
+	Savepoint bool
+}
+
+// ExecuteCall executes an API method call. When the request has an ambient
+// transaction (see http.Request.Tx), the method runs in it: its context
+// carries a database.Cursor over the transaction.
+func (r *APIRegistry) ExecuteCall(ctx context.Context, call *APICall, req *http.Request, opts ...CallOptions) *APIResponse {
+	var options CallOptions
+	if len(opts) > 0 {
+		options = opts[0]
+	}
+	var cursor *database.Cursor
+	if req.Tx != nil {
+		cursor = database.CursorFromContext(ctx)
+		if cursor == nil || cursor.DB() != req.Tx {
+			cursor = database.NewCursor(req.Tx)
+		}
+	}
+	return r.execute(ctx, call, req.GetUserID(), cursor, options)
+}
+
+// ExecuteCallAs executes an API method call as the given user, for calls
+// that do not come from a user session such as inbound hooks
+func (r *APIRegistry) ExecuteCallAs(ctx context.Context, call *APICall, uid int) *APIResponse {
+	return r.execute(context.WithValue(ctx, "user_id", uid), call, uid, nil, CallOptions{})
+}
+
+// execute runs a call on behalf of uid, in the transaction of cursor when set
+func (r *APIRegistry) execute(ctx context.Context, call *APICall, uid int, cursor *database.Cursor, options CallOptions) *APIResponse {
 	// Get method
-	modelMethods, exists := r.methods[call.ModelName]
-	if !exists {
+	r.mutex.RLock()
+	modelMethods, modelExists := r.methods[call.ModelName]
+	method, exists := modelMethods[call.Method]
+	r.mutex.RUnlock()
+	if !modelExists {
 		return &APIResponse{
 			Success: false,
 			Error:   fmt.Sprintf("Model '%s' not found", call.ModelName),
 		}
 	}
 
-	method, exists := modelMethods[call.Method]
 	if !exists {
 		return &APIResponse{
 			Success: false,
@@ -202,7 +271,7 @@ func (r *APIRegistry) ExecuteCall(ctx context.Context, call *APICall, req *http.
 	}
 
 	// Check user permissions
-	if err := r.checkPermissions(ctx, method, req); err != nil {
+	if err := r.checkPermissions(ctx, method, uid); err != nil {
 		return &APIResponse{
 			Success: false,
 			Error:   fmt.Sprintf("Access denied: %v", err),
@@ -211,20 +280,29 @@ func (r *APIRegistry) ExecuteCall(ctx context.Context, call *APICall, req *http.
 
 	// Prepare method context
 	methodCtx := r.prepareContext(ctx, call, method)
+	if cursor != nil {
+		methodCtx = database.ContextWithCursor(methodCtx, cursor)
+	}
 
 	// Execute method based on type
+	run := func() (interface{}, error) {
+		switch method.Type {
+		case ModelMethod:
+			return r.executeModelMethod(methodCtx, method, call)
+		case ModelCreateMethod:
+			return r.executeCreateMethod(methodCtx, method, call)
+		case RecordMethod:
+			return r.executeRecordMethod(methodCtx, method, call)
+		}
+		return nil, fmt.Errorf("unknown method type: %s", method.Type)
+	}
+
 	var result interface{}
 	var err error
-
-	switch method.Type {
-	case ModelMethod:
-		result, err = r.executeModelMethod(methodCtx, method, call)
-	case ModelCreateMethod:
-		result, err = r.executeCreateMethod(methodCtx, method, call)
-	case RecordMethod:
-		result, err = r.executeRecordMethod(methodCtx, method, call)
-	default:
-		err = fmt.Errorf("unknown method type: %s", method.Type)
+	if cursor != nil && options.Savepoint {
+		result, err = inSavepoint(cursor, run)
+	} else {
+		result, err = run()
 	}
 
 	if err != nil {
@@ -242,13 +320,34 @@ func (r *APIRegistry) ExecuteCall(ctx context.Context, call *APICall, req *http.
 	}
 }
 
+// inSavepoint runs fn in a savepoint of the cursor's transaction, released
+// when fn succeeds and rolled back when it fails. Savepoints fn creates on
+// the same cursor end with it.
+func inSavepoint(cursor *database.Cursor, fn func() (interface{}, error)) (interface{}, error) {
+	sp, err := cursor.Savepoint()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create savepoint: %w", err)
+	}
+	result, err := fn()
+	if err != nil {
+		if closeErr := sp.Close(true); closeErr != nil {
+			return nil, fmt.Errorf("%w (rolling back to the savepoint failed: %v)", err, closeErr)
+		}
+		return nil, err
+	}
+	if err := sp.Release(); err != nil {
+		return nil, fmt.Errorf("failed to release savepoint: %w", err)
+	}
+	return result, nil
+}
+
 // checkPermissions validates user permissions for method access
-func (r *APIRegistry) checkPermissions(ctx context.Context, method *APIMethod, req *http.Request) error {
+func (r *APIRegistry) checkPermissions(ctx context.Context, method *APIMethod, uid int) error {
 	// Check user groups if specified
 	if len(method.Groups) > 0 {
 		// TODO: Implement user groups checking
 		// For now, allow access if user is authenticated
-		if req.GetUserID() == 0 {
+		if uid == 0 {
 			return fmt.Errorf("authentication required")
 		}
 		// userGroups := req.GetUserGroups() // TODO: Implement GetUserGroups method
@@ -293,34 +392,7 @@ func (r *APIRegistry) prepareContext(ctx context.Context, call *APICall, method
 
 // executeModelMethod executes a model-level method
 func (r *APIRegistry) executeModelMethod(ctx context.Context, method *APIMethod, call *APICall) (interface{}, error) {
-	handler := reflect.ValueOf(method.Handler)
-	if handler.Kind() != reflect.Func {
-		return nil, fmt.Errorf("handler is not a function")
-	}
-
-	// Prepare arguments
-	args := []reflect.Value{
-		reflect.ValueOf(ctx),
-		reflect.ValueOf(method.Model),
-	}
-
-	// Add call arguments
-	for _, arg := range call.Args {
-		args = append(args, reflect.ValueOf(arg))
-	}
-
-	// Call method
-	results := handler.Call(args)
-	
-	if len(results) == 2 && !results[1].IsNil() {
-		return nil, results[1].Interface().(error)
-	}
-	
-	if len(results) > 0 {
-		return results[0].Interface(), nil
-	}
-	
-	return nil, nil
+	return callHandler(ctx, method, call)
 }
 
 // executeRecordMethod executes a record-level method
@@ -328,33 +400,7 @@ func (r *APIRegistry) executeRecordMethod(ctx context.Context, method *APIMethod
 	if len(call.IDs) == 0 {
 		return nil, fmt.Errorf("record method requires IDs")
 	}
-
-	handler := reflect.ValueOf(method.Handler)
-	if handler.Kind() != reflect.Func {
-		return nil, fmt.Errorf("handler is not a function")
-	}
-
-	// For now, we'll just pass the IDs and args
-	args := []reflect.Value{
-		reflect.ValueOf(ctx),
-		reflect.ValueOf(call.IDs),
-	}
-
-	for _, arg := range call.Args {
-		args = append(args, reflect.ValueOf(arg))
-	}
-
-	results := handler.Call(args)
-	
-	if len(results) == 2 && !results[1].IsNil() {
-		return nil, results[1].Interface().(error)
-	}
-	
-	if len(results) > 0 {
-		return results[0].Interface(), nil
-	}
-	
-	return nil, nil
+	return callHandler(ctx, method, call)
 }
 
 // executeCreateMethod executes a create method
@@ -377,19 +423,43 @@ func (r *APIRegistry) executeCreateMethod(ctx context.Context, method *APIMethod
 	return r.executeModelMethod(ctx, method, call)
 }
 
-// GetMethods returns all registered methods for a model
+// GetMethods returns a copy of the registered methods of a model
 func (r *APIRegistry) GetMethods(modelName string) map[string]*APIMethod {
-	return r.methods[modelName]
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	methods := r.methods[modelName]
+	if methods == nil {
+		return nil
+	}
+	copied := make(map[string]*APIMethod, len(methods))
+	for name, method := range methods {
+		copied[name] = method
+	}
+	return copied
 }
 
-// GetAllMethods returns all registered methods
+// GetAllMethods returns a copy of all registered methods
 func (r *APIRegistry) GetAllMethods() map[string]map[string]*APIMethod {
-	return r.methods
+	r.mutex.RLock()
+	modelNames := make([]string, 0, len(r.methods))
+	for modelName := range r.methods {
+		modelNames = append(modelNames, modelName)
+	}
+	r.mutex.RUnlock()
+
+	all := make(map[string]map[string]*APIMethod, len(modelNames))
+	for _, modelName := range modelNames {
+		if methods := r.GetMethods(modelName); methods != nil {
+			all[modelName] = methods
+		}
+	}
+	return all
 }
 
 // GetPublicMethods returns only public methods for a model
 func (r *APIRegistry) GetPublicMethods(modelName string) map[string]*APIMethod {
-	methods := r.methods[modelName]
+	methods := r.GetMethods(modelName)
 	if methods == nil {
 		return nil
 	}
@@ -405,7 +475,7 @@ func (r *APIRegistry) GetPublicMethods(modelName string) map[string]*APIMethod {
 
 // MethodInfo returns method information for API documentation
 func (r *APIRegistry) GetMethodInfo(modelName, methodName string) map[string]interface{} {
-	if methods, exists := r.methods[modelName]; exists {
+	if methods := r.GetMethods(modelName); methods != nil {
 		if method, exists := methods[methodName]; exists {
 			info := map[string]interface{}{
 				"name":       method.Name,
@@ -425,7 +495,65 @@ func (r *APIRegistry) GetMethodInfo(modelName, methodName string) map[string]int
 	return nil
 }
 
-// Global API registry
+// Clone returns a copy of the registry bound to the models of a model registry
+func (r *APIRegistry) Clone(modelRegistry *models.FieldModelRegistry) *APIRegistry {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	clone := NewAPIRegistry()
+	for modelName, methods := range r.methods {
+		clone.methods[modelName] = make(map[string]*APIMethod, len(methods))
+		for name, method := range methods {
+			copied := *method
+			if model, exists := modelRegistry.GetModel(modelName); exists {
+				copied.Model = model
+			}
+			clone.methods[modelName][name] = &copied
+		}
+	}
+	for name := range r.models {
+		if model, exists := modelRegistry.GetModel(name); exists {
+			clone.models[name] = model
+		}
+	}
+	return clone
+}
+
+// scopedRegistryKind is the key of API registries stored on database.DatabaseInfo
+const scopedRegistryKind = "api"
+
+// ForDatabase returns the database's own API registry, seeding it from r on first use
+func (r *APIRegistry) ForDatabase(dbName string) *APIRegistry {
+	if dbName == "" {
+		return r
+	}
+
+	if scoped, ok := database.GetRegistry().GetScopedRegistry(dbName, scopedRegistryKind); ok {
+		return scoped.(*APIRegistry)
+	}
+
+	return r.buildForDatabase(dbName, false)
+}
+
+// RebuildForDatabase replaces the database's API registry with a fresh copy of r
+func (r *APIRegistry) RebuildForDatabase(dbName string) *APIRegistry {
+	return r.buildForDatabase(dbName, true)
+}
+
+// buildForDatabase builds the API registry of a database once, or again
+// when rebuild is set; concurrent callers wait for the build in progress
+func (r *APIRegistry) buildForDatabase(dbName string, rebuild bool) *APIRegistry {
+	built, err := database.GetRegistry().BuildScopedRegistry(dbName, scopedRegistryKind, rebuild, func() interface{} {
+		return r.Clone(models.RegistryForDB(dbName))
+	})
+	if err != nil {
+		r.logger.Warning("Using the shared API registry for database %s: %v", dbName, err)
+		return r
+	}
+	return built.(*APIRegistry)
+}
+
+// Global API registry, the template for per-database registries
 var DefaultAPIRegistry = NewAPIRegistry()
 
 // Convenience functions for using the default registry
@@ -434,8 +562,8 @@ func NewMethod(modelName, methodName string, handler interface{}) *MethodBuilder
 	return DefaultAPIRegistry.NewMethod(modelName, methodName, handler)
 }
 
-func ExecuteCall(ctx context.Context, call *APICall, req *http.Request) *APIResponse {
-	return DefaultAPIRegistry.ExecuteCall(ctx, call, req)
+func ExecuteCall(ctx context.Context, call *APICall, req *http.Request, opts ...CallOptions) *APIResponse {
+	return DefaultAPIRegistry.ExecuteCall(ctx, call, req, opts...)
 }
 
 func GetMethods(modelName string) map[string]*APIMethod {
@@ -0,0 +1,241 @@
+package api_test
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+
+	"goodoo/api"
+	"goodoo/database"
+	"goodoo/fields"
+	"goodoo/http"
+	"goodoo/models"
+	"goodoo/models/testutil"
+)
+
+// pingCall calls the model method ping of x.registry_test
+var pingCall = &api.APICall{ModelName: "x.registry_test", Method: "ping"}
+
+func newPingRegistry() *api.APIRegistry {
+	registry := api.NewAPIRegistry()
+	registry.NewMethod("x.registry_test", "ping", func() string { return "pong" }).Model()
+	return registry
+}
+
+// TestRegistryConcurrency calls methods and lists the registries while
+// methods and models are registered, as an addon install does at runtime;
+// run it with -race
+func TestRegistryConcurrency(t *testing.T) {
+	registry := newPingRegistry()
+	modelRegistry := models.NewFieldModelRegistry()
+	req := &http.Request{Session: &http.Session{UserID: 2}}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 25; i++ {
+				name := fmt.Sprintf("x_registry_test_%d_%d", w, i)
+				registry.NewMethod("x.registry_test", name, func() int { return i }).Model().Help(name).Groups("base.group_user")
+				// Replacing a method registered before
+				registry.NewMethod("x.registry_test", "replaced", func() int { return i }).Model()
+				if err := modelRegistry.RegisterModel(models.NewModelDefinition(name, "")); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	for r := 0; r < 8; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				if resp := registry.ExecuteCall(context.Background(), pingCall, req); !resp.Success || resp.Result != "pong" {
+					t.Errorf("ping = %+v", resp)
+					return
+				}
+				for _, methods := range registry.GetAllMethods() {
+					for name := range methods {
+						registry.GetMethodInfo("x.registry_test", name)
+					}
+				}
+				for name := range modelRegistry.GetAllModels() {
+					modelRegistry.GetModel(name)
+				}
+				registry.Clone(modelRegistry.Clone())
+				modelRegistry.Hash()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := len(registry.GetMethods("x.registry_test")); got != 102 {
+		t.Errorf("%d methods registered, want 102", got)
+	}
+	if got := len(modelRegistry.GetAllModels()); got != 100 {
+		t.Errorf("%d models registered, want 100", got)
+	}
+}
+
+// TestRegistryCopies hands out copies: changing them, or decorating a
+// method after it was looked up, leaves what others see unchanged
+func TestRegistryCopies(t *testing.T) {
+	registry := newPingRegistry()
+	delete(registry.GetMethods("x.registry_test"), "ping")
+	delete(registry.GetAllMethods(), "x.registry_test")
+	if _, ok := registry.GetMethods("x.registry_test")["ping"]; !ok {
+		t.Fatal("deleting from a copy unregistered the method")
+	}
+
+	builder := registry.NewMethod("x.registry_test", "archive", func() {})
+	looked := registry.GetMethods("x.registry_test")["archive"]
+	builder.Private().Help("Archive the records")
+	if looked.Type != api.RecordMethod || !looked.Public || looked.Help != "" {
+		t.Errorf("a decorator changed a method already looked up: %+v", looked)
+	}
+	if method := registry.GetMethods("x.registry_test")["archive"]; method.Type != api.PrivateMethod || method.Help != "Archive the records" {
+		t.Errorf("the decorated method is not registered: %+v", method)
+	}
+
+	modelRegistry := models.NewFieldModelRegistry()
+	if err := modelRegistry.RegisterModel(models.NewModelDefinition("x.registry_test", "")); err != nil {
+		t.Fatal(err)
+	}
+	delete(modelRegistry.GetAllModels(), "x.registry_test")
+	if _, ok := modelRegistry.GetModel("x.registry_test"); !ok {
+		t.Error("deleting from a copy unregistered the model")
+	}
+}
+
+// BenchmarkExecuteCall measures the read path of the registry, alone and
+// while methods are registered
+func BenchmarkExecuteCall(b *testing.B) {
+	req := &http.Request{Session: &http.Session{UserID: 2}}
+	b.Run("read only", func(b *testing.B) {
+		registry := newPingRegistry()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				registry.ExecuteCall(context.Background(), pingCall, req)
+			}
+		})
+	})
+	b.Run("with registrations", func(b *testing.B) {
+		registry := newPingRegistry()
+		done := make(chan struct{})
+		go func() {
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+					registry.NewMethod("x.registry_test", fmt.Sprintf("m%d", i%100), func() {}).Model()
+				}
+			}
+		}()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				registry.ExecuteCall(context.Background(), pingCall, req)
+			}
+		})
+		close(done)
+	})
+}
+
+// registerTenant registers a database in the global registry for the
+// test; without a host no connection is attempted, so it has no imported
+// definitions
+func registerTenant(t *testing.T, name string) string {
+	dbName := testutil.Unique(name)
+	if err := database.GetRegistry().Register(dbName, &database.ConnectionConfig{Database: dbName}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.GetRegistry().Unregister(dbName) })
+	return dbName
+}
+
+// tenantModel returns the model x.tenant_test with the given fields
+func tenantModel(t *testing.T, names ...string) *models.ModelDefinition {
+	model := models.NewModelDefinition("x.tenant_test", "x_tenant_test")
+	for _, name := range names {
+		field, err := fields.CreateField(fields.StringType, fields.FieldAttribute{Store: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		model.AddField(name, field)
+	}
+	return model
+}
+
+// TestDatabaseRegistries serves two databases from one process: an addon
+// installed in one changes its model and API registries only
+func TestDatabaseRegistries(t *testing.T) {
+	if _, exists := models.GetFieldModel("x.tenant_test"); !exists {
+		if err := models.RegisterFieldModel(tenantModel(t, "name")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	template := newPingRegistry()
+	dbA, dbB := registerTenant(t, "tenant_a"), registerTenant(t, "tenant_b")
+	fieldsOf := func(dbName string) []string {
+		model, ok := models.NewEnvironment(nil, 1).WithDBName(dbName).GetFieldModel("x.tenant_test")
+		if !ok {
+			t.Fatalf("x.tenant_test is not registered in %q", dbName)
+		}
+		var names []string
+		for name := range model.Fields {
+			if name == "name" || name == "loyalty_points" {
+				names = append(names, name)
+			}
+		}
+		slices.Sort(names)
+		return names
+	}
+	registryB := models.RegistryForDB(dbB)
+
+	// The addon of database A extends the model and adds a method
+	if err := models.RegistryForDB(dbA).RegisterModel(tenantModel(t, "name", "loyalty_points")); err != nil {
+		t.Fatal(err)
+	}
+	apiA := template.RebuildForDatabase(dbA)
+	apiA.NewMethod("x.tenant_test", "add_points", func() int { return 10 }).Model()
+
+	for _, tt := range []struct {
+		dbName string
+		want   []string
+	}{
+		{dbA, []string{"loyalty_points", "name"}},
+		{dbB, []string{"name"}},
+		{"", []string{"name"}},
+	} {
+		if got := fieldsOf(tt.dbName); !slices.Equal(got, tt.want) {
+			t.Errorf("fields of x.tenant_test in %q = %v, want %v", tt.dbName, got, tt.want)
+		}
+	}
+	if models.RegistryForDB(dbB) != registryB {
+		t.Error("the registry of database B was rebuilt")
+	}
+
+	req := &http.Request{Session: &http.Session{UserID: 2}}
+	call := &api.APICall{ModelName: "x.tenant_test", Method: "add_points"}
+	if resp := template.ForDatabase(dbA).ExecuteCall(context.Background(), call, req); !resp.Success || resp.Result != 10 {
+		t.Errorf("add_points in database A = %+v", resp)
+	}
+	for _, registry := range []*api.APIRegistry{template.ForDatabase(dbB), template} {
+		if resp := registry.ExecuteCall(context.Background(), call, req); resp.Success {
+			t.Errorf("add_points is served outside database A: %+v", resp)
+		}
+	}
+	if resp := template.ForDatabase(dbB).ExecuteCall(context.Background(), pingCall, req); !resp.Success {
+		t.Errorf("ping in database B = %+v", resp)
+	}
+
+	// Rebuilding database A from the templates drops what was registered
+	// in it at runtime
+	models.DefaultFieldModelRegistry.RebuildForDatabase(dbA)
+	if got := fieldsOf(dbA); !slices.Equal(got, []string{"name"}) {
+		t.Errorf("fields of x.tenant_test in database A after a rebuild = %v", got)
+	}
+}
@@ -0,0 +1,322 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"goodoo/models"
+)
+
+// Operation sources
+const (
+	// SourceORM marks the operations every stored model has
+	SourceORM = "orm"
+	// SourceRegistry marks the methods registered in the API registry
+	SourceRegistry = "registry"
+)
+
+// Argument describes an argument of an operation
+type Argument struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Required bool   `json:"required"`
+	// Keyword arguments are passed by name in kwargs
+	Keyword bool   `json:"keyword,omitempty"`
+	Help    string `json:"help,omitempty"`
+}
+
+// Operation describes an operation callable on a model. The structure is
+// stable: clients such as the OpenAPI generator rely on it.
+type Operation struct {
+	Name   string     `json:"name"`
+	Source string     `json:"source"`
+	Type   MethodType `json:"type"`
+	// HTTPMethod and Path give the endpoint of ORM operations; {id} stands
+	// for the record ID
+	HTTPMethod string     `json:"http_method,omitempty"`
+	Path       string     `json:"path,omitempty"`
+	Args       []Argument `json:"args"`
+	Returns    string     `json:"returns,omitempty"`
+	Groups     []string   `json:"groups,omitempty"`
+	Help       string     `json:"help,omitempty"`
+	// Allowed reports whether the calling user may perform the operation
+	Allowed bool `json:"allowed"`
+}
+
+// ModelSummary describes a model in the model list
+type ModelSummary struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Table       string `json:"table,omitempty"`
+	Transient   bool   `json:"transient"`
+	Abstract    bool   `json:"abstract"`
+}
+
+// ModelDescription describes a model with its fields and operations,
+// sorted by name
+type ModelDescription struct {
+	ModelSummary
+	Fields      map[string]interface{} `json:"fields"`
+	Constraints []models.Constraint    `json:"constraints,omitempty"`
+	Operations  []Operation            `json:"operations"`
+}
+
+// ormOperations are the operations of the generic record API
+var ormOperations = []Operation{
+	{Name: "search", Type: ModelMethod, HTTPMethod: "GET", Path: "/api/records/{model}", Args: []Argument{
+		{Name: "domain", Type: "domain", Help: "JSON list of conditions"},
+		{Name: "fields", Type: "string", Help: "comma-separated field names"},
+		{Name: "offset", Type: "integer"},
+		{Name: "limit", Type: "integer"},
+		{Name: "order", Type: "string", Help: "field names with asc or desc"},
+		{Name: "display", Type: "boolean", Help: "add the values formatted for the user's language"},
+	}, Returns: "records", Help: "Search and read records, with the total count"},
+	{Name: "read", Type: RecordMethod, HTTPMethod: "GET", Path: "/api/records/{model}/{id}", Args: []Argument{
+		{Name: "id", Type: "integer", Required: true},
+		{Name: "fields", Type: "string", Help: "comma-separated field names"},
+		{Name: "display", Type: "boolean", Help: "add the values formatted for the user's language"},
+	}, Returns: "record", Help: "Read a record"},
+	{Name: "fields_get", Type: ModelMethod, HTTPMethod: "GET", Path: "/api/records/{model}/fields",
+		Args: []Argument{}, Returns: "fields", Help: "Describe the fields the user may read"},
+	{Name: "create", Type: ModelCreateMethod, HTTPMethod: "POST", Path: "/api/records/{model}", Args: []Argument{
+		{Name: "values", Type: "object", Required: true, Help: "field values"},
+	}, Returns: "id", Help: "Create a record"},
+	{Name: "write", Type: RecordMethod, HTTPMethod: "PUT", Path: "/api/records/{model}/{id}", Args: []Argument{
+		{Name: "id", Type: "integer", Required: true},
+		{Name: "values", Type: "object", Required: true, Help: "field values"},
+	}, Help: "Update a record"},
+	{Name: "patch", Type: RecordMethod, HTTPMethod: "PATCH", Path: "/api/records/{model}/{id}", Args: []Argument{
+		{Name: "id", Type: "integer", Required: true},
+		{Name: "values", Type: "object", Required: true, Help: "field values; null clears a field, JSON objects are merged"},
+		{Name: "replace", Type: "boolean", Help: "replace JSON values instead of merging them"},
+	}, Help: "Update only the given fields of a record"},
+	{Name: "unlink", Type: RecordMethod, HTTPMethod: "DELETE", Path: "/api/records/{model}/{id}", Args: []Argument{
+		{Name: "id", Type: "integer", Required: true},
+	}, Help: "Delete a record"},
+	{Name: "name_search", Type: ModelMethod, HTTPMethod: "GET", Path: "/api/records/{model}/name_search", Args: []Argument{
+		{Name: "name", Type: "string", Help: "text the names contain"},
+		{Name: "domain", Type: "domain"},
+		{Name: "limit", Type: "integer"},
+	}, Returns: "results", Help: "Suggest [id, name] pairs for a relational field, and whether the name can be quick-created"},
+	{Name: "name_create", Type: ModelCreateMethod, HTTPMethod: "POST", Path: "/api/records/{model}/quick_create", Args: []Argument{
+		{Name: "name", Type: "string", Required: true},
+		{Name: "context", Type: "object", Help: "context defaults of the new record"},
+	}, Returns: "[id, display_name]", Help: "Create a record from a name alone"},
+	{Name: "bulk_write", Type: ModelMethod, HTTPMethod: "POST", Path: "/api/records/{model}/bulk_write", Args: []Argument{
+		{Name: "domain", Type: "domain"},
+		{Name: "ids", Type: "array"},
+		{Name: "values", Type: "object", Required: true, Help: "field values"},
+		{Name: "batch_size", Type: "integer"},
+	}, Returns: "operation", Help: "Write the same values to many records in the background"},
+	{Name: "bulk_unlink", Type: ModelMethod, HTTPMethod: "POST", Path: "/api/records/{model}/bulk_unlink", Args: []Argument{
+		{Name: "domain", Type: "domain"},
+		{Name: "ids", Type: "array"},
+		{Name: "batch_size", Type: "integer"},
+	}, Returns: "operation", Help: "Delete many records in the background"},
+}
+
+// ListModels returns the models of a model registry and those with
+// registered methods, sorted by name
+func (r *APIRegistry) ListModels(modelRegistry *models.FieldModelRegistry) []ModelSummary {
+	summaries := make(map[string]ModelSummary)
+	for name, model := range modelRegistry.GetAllModels() {
+		summaries[name] = summarize(model)
+	}
+	for name := range r.GetAllMethods() {
+		if _, exists := summaries[name]; !exists {
+			summaries[name] = ModelSummary{Name: name}
+		}
+	}
+
+	list := make([]ModelSummary, 0, len(summaries))
+	for _, summary := range summaries {
+		list = append(list, summary)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// summarize returns the summary of a model definition
+func summarize(model *models.ModelDefinition) ModelSummary {
+	return ModelSummary{
+		Name:        model.Name,
+		Description: model.Description,
+		Table:       model.TableName,
+		Transient:   model.Transient,
+		Abstract:    model.Abstract,
+	}
+}
+
+// DescribeModel describes a model of a model registry for the user of env:
+// the fields the user may read, the ORM operations when the model is
+// stored and the public registered methods. It reports false when the
+// model is unknown.
+func (r *APIRegistry) DescribeModel(env *models.Environment, modelRegistry *models.FieldModelRegistry, name string) (*ModelDescription, bool) {
+	model, defined := modelRegistry.GetModel(name)
+	methods := r.GetPublicMethods(name)
+	if !defined && methods == nil {
+		return nil, false
+	}
+
+	description := &ModelDescription{
+		ModelSummary: ModelSummary{Name: name},
+		Fields:       map[string]interface{}{},
+		Operations:   []Operation{},
+	}
+	if defined {
+		description.ModelSummary = summarize(model)
+		description.Fields = model.GetFieldsInfo(env)
+		description.Constraints = model.Constraints
+		translateDescription(env, model, description)
+		if !model.Abstract {
+			for _, operation := range ormOperations {
+				operation.Source = SourceORM
+				operation.Path = strings.Replace(operation.Path, "{model}", model.Name, 1)
+				operation.Allowed = ormAllowed(env, model, operation.Name)
+				description.Operations = append(description.Operations, operation)
+			}
+		}
+	}
+	for _, method := range methods {
+		description.Operations = append(description.Operations, Operation{
+			Name:    method.Name,
+			Source:  SourceRegistry,
+			Type:    method.Type,
+			Args:    handlerArguments(method),
+			Returns: method.Returns,
+			Groups:  method.Groups,
+			Help:    method.Help,
+			Allowed: methodAllowed(env, method),
+		})
+	}
+
+	sort.SliceStable(description.Operations, func(i, j int) bool {
+		return description.Operations[i].Name < description.Operations[j].Name
+	})
+	return description, true
+}
+
+// translateDescription replaces the description of a model and the
+// labels, help and selection options of its fields by their translations
+// in the language of env (see models.ModelTranslationModel)
+func translateDescription(env *models.Environment, model *models.ModelDefinition, description *ModelDescription) {
+	help, err := model.Help(env)
+	if err != nil {
+		return
+	}
+	description.Description = help.Description
+	for _, field := range help.Fields {
+		info, ok := description.Fields[field.Name].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		info["string"] = field.String
+		info["help"] = field.Help
+		if field.Selection != nil {
+			info["selection"] = field.Selection
+		}
+	}
+}
+
+// ormAllowed reports whether the user of env may perform an ORM operation
+// on a model. Models have no access rules yet, so every operation is
+// allowed but name_create on models without quick create; field groups are
+// enforced on the values read and written.
+func ormAllowed(env *models.Environment, model *models.ModelDefinition, operation string) bool {
+	if operation == "name_create" {
+		return model.QuickCreate
+	}
+	return true
+}
+
+// methodAllowed reports whether the user of env belongs to one of the
+// groups a method requires
+func methodAllowed(env *models.Environment, method *APIMethod) bool {
+	if len(method.Groups) == 0 {
+		return true
+	}
+	for _, group := range method.Groups {
+		if env.HasGroup(group) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	modelType   = reflect.TypeOf((*models.ModelDefinition)(nil))
+	idsType     = reflect.TypeOf([]int(nil))
+)
+
+// handlerArguments derives the arguments of a registered method from its
+// handler. The context, model and record IDs the registry passes first are
+// left out; record methods take the ids of the records instead. The fields
+// of an options parameter are listed as keyword arguments.
+func handlerArguments(method *APIMethod) []Argument {
+	args := []Argument{}
+	if method.Type == RecordMethod {
+		args = append(args, Argument{Name: "ids", Type: "array", Required: true})
+	}
+
+	handlerType := reflect.TypeOf(method.Handler)
+	if handlerType == nil || handlerType.Kind() != reflect.Func {
+		return args
+	}
+	s := handlerSignature(handlerType)
+	for i := 0; i < s.positional; i++ {
+		args = append(args, Argument{
+			Name:     fmt.Sprintf("arg%d", i),
+			Type:     jsonType(handlerType.In(s.injected + i)),
+			Required: i < s.required,
+		})
+	}
+	if s.variadic {
+		args = append(args, Argument{
+			Name: fmt.Sprintf("arg%d", s.positional),
+			Type: jsonType(handlerType.In(handlerType.NumIn() - 1).Elem()),
+		})
+	}
+	if s.options >= 0 {
+		options := handlerType.In(s.options)
+		if options.Kind() == reflect.Ptr {
+			options = options.Elem()
+		}
+		for i := 0; i < options.NumField(); i++ {
+			if name := keywordName(options.Field(i)); name != "" {
+				args = append(args, Argument{Name: name, Type: jsonType(options.Field(i).Type), Keyword: true})
+			}
+		}
+	}
+	return args
+}
+
+// jsonType names the JSON type of a Go argument type
+func jsonType(t reflect.Type) string {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == timeType {
+		return "string"
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.String:
+		return "string"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Map, reflect.Struct:
+		return "object"
+	default:
+		return "any"
+	}
+}
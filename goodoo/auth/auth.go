@@ -0,0 +1,209 @@
+// Package auth checks the login and password of users against a chain of
+// backends: the local password hashes and an LDAP directory. Each backend
+// authenticates the user, does not know them, or refuses them; the chain
+// asks the backends in the configured order (GOODOO_AUTH_BACKENDS, which
+// the auth.backends system parameter of a database overrides) until one
+// decides. Starting the session, recording the login and rate limiting
+// are left to the callers, so they apply whichever backend succeeded.
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"goodoo/models"
+	"gorm.io/gorm"
+)
+
+// ErrInvalidCredentials is returned when no backend authenticates the
+// user; an unknown login and a wrong password are not told apart
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// Names of the backends
+const (
+	BackendLocal = "local"
+	BackendLDAP  = "ldap"
+)
+
+// ParamBackends is the system parameter overriding the backend order
+const ParamBackends = "auth.backends"
+
+// Outcome is the decision of a backend
+type Outcome int
+
+// Outcomes of a backend
+const (
+	// Unknown passes the login to the next backend
+	Unknown Outcome = iota
+	// Authenticated ends the chain with the user of the result
+	Authenticated
+	// Rejected ends the chain, refusing the login
+	Rejected
+)
+
+// Result is the decision of a backend. Reason tells why a login was
+// rejected, for the logs only.
+type Result struct {
+	Outcome Outcome
+	User    *models.User
+	Reason  string
+	// Provisioned is set when the backend created the user
+	Provisioned bool
+}
+
+// Backend checks a login and password
+type Backend interface {
+	Name() string
+	// Authenticate decides on a login; an error means the backend could
+	// not, an UnavailableError when its service is unreachable
+	Authenticate(ctx context.Context, db *gorm.DB, login, password string) (Result, error)
+}
+
+// UnavailableError is a backend whose service cannot be reached. The chain
+// goes on with the next backend unless it is Fatal.
+type UnavailableError struct {
+	Backend string
+	Fatal   bool
+	Err     error
+}
+
+func (e *UnavailableError) Error() string {
+	return fmt.Sprintf("%s authentication is unavailable: %v", e.Backend, e.Err)
+}
+
+func (e *UnavailableError) Unwrap() error {
+	return e.Err
+}
+
+// Login is a successful authentication: the user, the backend that
+// authenticated them and the unavailable backends skipped on the way
+type Login struct {
+	User        *models.User
+	Backend     string
+	Provisioned bool
+	Skipped     []error
+}
+
+// Chain is the backends asked in turn
+type Chain []Backend
+
+// Authenticate returns the user the first deciding backend authenticates,
+// or an error wrapping ErrInvalidCredentials when it rejects them or no
+// backend knows them
+func (c Chain) Authenticate(ctx context.Context, db *gorm.DB, login, password string) (*Login, error) {
+	if login == "" || password == "" {
+		return nil, fmt.Errorf("%w: login and password required", ErrInvalidCredentials)
+	}
+	var skipped []error
+	for _, backend := range c {
+		result, err := backend.Authenticate(ctx, db, login, password)
+		var unavailable *UnavailableError
+		if errors.As(err, &unavailable) && !unavailable.Fatal {
+			skipped = append(skipped, err)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch result.Outcome {
+		case Authenticated:
+			return &Login{User: result.User, Backend: backend.Name(), Provisioned: result.Provisioned, Skipped: skipped}, nil
+		case Rejected:
+			return nil, fmt.Errorf("%w: %s refused %s: %s", ErrInvalidCredentials, backend.Name(), login, result.Reason)
+		}
+	}
+	if len(skipped) > 0 {
+		return nil, fmt.Errorf("%w: no backend knows %s (%v)", ErrInvalidCredentials, login, errors.Join(skipped...))
+	}
+	return nil, fmt.Errorf("%w: no backend knows %s", ErrInvalidCredentials, login)
+}
+
+// ParseBackends parses a comma separated list of backend names
+func ParseBackends(value string) ([]string, error) {
+	var names []string
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(value, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if name != BackendLocal && name != BackendLDAP {
+			return nil, fmt.Errorf("unknown authentication backend %q", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("authentication backend %q is listed twice", name)
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return nil, errors.New("no authentication backend")
+	}
+	return names, nil
+}
+
+func init() {
+	models.RegisterParamValidator(ParamBackends, func(value string) error {
+		_, err := ParseBackends(value)
+		return err
+	})
+}
+
+var (
+	backends = []string{BackendLocal}
+	mutex    sync.RWMutex
+)
+
+// LoadFromEnv installs the backend order of GOODOO_AUTH_BACKENDS, "local"
+// when it is not set
+func LoadFromEnv() error {
+	value := os.Getenv("GOODOO_AUTH_BACKENDS")
+	if value == "" {
+		return nil
+	}
+	names, err := ParseBackends(value)
+	if err != nil {
+		return err
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	backends = names
+	return nil
+}
+
+// BackendsForDB returns the backend order with the system parameter of a
+// database applied
+func BackendsForDB(dbName string) []string {
+	mutex.RLock()
+	names := backends
+	mutex.RUnlock()
+	if dbName != "" {
+		if value := models.GetParamString(dbName, ParamBackends, ""); value != "" {
+			if parsed, err := ParseBackends(value); err == nil {
+				names = parsed
+			}
+		}
+	}
+	return names
+}
+
+// ChainForDB returns the backends of a database in order; the LDAP backend
+// is left out until a server is configured
+func ChainForDB(dbName string) Chain {
+	var chain Chain
+	for _, name := range BackendsForDB(dbName) {
+		switch name {
+		case BackendLocal:
+			chain = append(chain, LocalBackend{})
+		case BackendLDAP:
+			if config := LDAPConfigForDB(dbName); config.Enabled() {
+				chain = append(chain, &LDAPBackend{Config: config})
+			}
+		}
+	}
+	return chain
+}
@@ -0,0 +1,472 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"goodoo/models"
+	"gorm.io/gorm"
+)
+
+// Keys of the system parameters overriding the LDAP configuration
+const (
+	ParamLDAPURL            = "auth_ldap.url"
+	ParamLDAPStartTLS       = "auth_ldap.start_tls"
+	ParamLDAPUserDN         = "auth_ldap.user_dn"
+	ParamLDAPBindDN         = "auth_ldap.bind_dn"
+	ParamLDAPBindPassword   = "auth_ldap.bind_password"
+	ParamLDAPSearchBase     = "auth_ldap.search_base"
+	ParamLDAPSearchFilter   = "auth_ldap.search_filter"
+	ParamLDAPLoginAttribute = "auth_ldap.login_attribute"
+	ParamLDAPNameAttribute  = "auth_ldap.name_attribute"
+	ParamLDAPEmailAttribute = "auth_ldap.email_attribute"
+	ParamLDAPGroupAttribute = "auth_ldap.group_attribute"
+	ParamLDAPGroupMap       = "auth_ldap.group_map"
+	ParamLDAPAutoProvision  = "auth_ldap.auto_provision"
+	ParamLDAPDefaultGroup   = "auth_ldap.default_group"
+	ParamLDAPFailClosed     = "auth_ldap.fail_closed"
+)
+
+// LDAPConfig describes the directory users authenticate against
+type LDAPConfig struct {
+	// URL is ldap://host[:port] or ldaps://host[:port]
+	URL string
+	// StartTLS upgrades ldap:// connections to TLS before binding
+	StartTLS bool
+	// CAFile is a PEM file of the authorities trusted for the server
+	// certificate besides the system ones
+	CAFile string
+	// UserDN is the DN of the users, %s standing for their login, e.g.
+	// "uid=%s,ou=people,dc=example,dc=org". When empty, users are searched
+	// for under SearchBase with SearchFilter (e.g. "(uid=%s)") while bound
+	// as BindDN, anonymously when empty, then bound as the entry found.
+	UserDN       string
+	BindDN       string
+	BindPassword string
+	SearchBase   string
+	SearchFilter string
+	// LoginAttribute is the attribute holding the login of the users
+	// provisioned; the login typed is used when empty
+	LoginAttribute string
+	NameAttribute  string
+	EmailAttribute string
+	// GroupAttribute lists the DNs of the groups of an entry, which
+	// GroupMap maps to goodoo groups by external id. At each login users
+	// are added to the groups mapped from theirs and removed from the
+	// other mapped groups; groups missing from the map are left alone.
+	GroupAttribute string
+	GroupMap       map[string]string
+	// AutoProvision creates unknown users, members of DefaultGroup (an
+	// external id such as "base.group_user") when set
+	AutoProvision bool
+	DefaultGroup  string
+	// FailClosed refuses logins while the server is unreachable instead of
+	// asking the next backend
+	FailClosed bool
+	// Timeout bounds the connection and each operation
+	Timeout time.Duration
+}
+
+// DefaultLDAPConfig returns a disabled directory with the attributes of
+// OpenLDAP's inetOrgPerson
+func DefaultLDAPConfig() *LDAPConfig {
+	return &LDAPConfig{
+		SearchFilter:   "(uid=%s)",
+		NameAttribute:  "cn",
+		EmailAttribute: "mail",
+		GroupAttribute: "memberOf",
+		Timeout:        10 * time.Second,
+	}
+}
+
+// LoadFromEnv overrides the configuration with GOODOO_LDAP_* variables
+func (c *LDAPConfig) LoadFromEnv() error {
+	texts := map[string]*string{
+		"GOODOO_LDAP_URL":             &c.URL,
+		"GOODOO_LDAP_CA_FILE":         &c.CAFile,
+		"GOODOO_LDAP_USER_DN":         &c.UserDN,
+		"GOODOO_LDAP_BIND_DN":         &c.BindDN,
+		"GOODOO_LDAP_BIND_PASSWORD":   &c.BindPassword,
+		"GOODOO_LDAP_SEARCH_BASE":     &c.SearchBase,
+		"GOODOO_LDAP_SEARCH_FILTER":   &c.SearchFilter,
+		"GOODOO_LDAP_LOGIN_ATTRIBUTE": &c.LoginAttribute,
+		"GOODOO_LDAP_NAME_ATTRIBUTE":  &c.NameAttribute,
+		"GOODOO_LDAP_EMAIL_ATTRIBUTE": &c.EmailAttribute,
+		"GOODOO_LDAP_GROUP_ATTRIBUTE": &c.GroupAttribute,
+		"GOODOO_LDAP_DEFAULT_GROUP":   &c.DefaultGroup,
+	}
+	for name, field := range texts {
+		if value := os.Getenv(name); value != "" {
+			*field = value
+		}
+	}
+	bools := map[string]*bool{
+		"GOODOO_LDAP_START_TLS":      &c.StartTLS,
+		"GOODOO_LDAP_AUTO_PROVISION": &c.AutoProvision,
+		"GOODOO_LDAP_FAIL_CLOSED":    &c.FailClosed,
+	}
+	for name, field := range bools {
+		if value := os.Getenv(name); value != "" {
+			*field, _ = strconv.ParseBool(value)
+		}
+	}
+	if value := os.Getenv("GOODOO_LDAP_GROUP_MAP"); value != "" {
+		if err := json.Unmarshal([]byte(value), &c.GroupMap); err != nil {
+			return fmt.Errorf("GOODOO_LDAP_GROUP_MAP is not a JSON object of group DNs to external ids: %w", err)
+		}
+	}
+	if value := os.Getenv("GOODOO_LDAP_TIMEOUT"); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid GOODOO_LDAP_TIMEOUT %q", value)
+		}
+		c.Timeout = timeout
+	}
+	return c.Validate()
+}
+
+// Validate checks an enabled configuration can find its users
+func (c *LDAPConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	if !strings.HasPrefix(c.URL, "ldap://") && !strings.HasPrefix(c.URL, "ldaps://") {
+		return fmt.Errorf("LDAP URL %q is not ldap:// or ldaps://", c.URL)
+	}
+	if c.UserDN != "" {
+		if !strings.Contains(c.UserDN, "%s") {
+			return errors.New("the LDAP user DN has no %s standing for the login")
+		}
+		return nil
+	}
+	if c.SearchBase == "" {
+		return errors.New("the LDAP search base is required without a user DN")
+	}
+	if !strings.Contains(c.SearchFilter, "%s") {
+		return errors.New("the LDAP search filter has no %s standing for the login")
+	}
+	_, err := compileFilter(strings.ReplaceAll(c.SearchFilter, "%s", "login"))
+	return err
+}
+
+// Enabled reports whether a server is configured
+func (c *LDAPConfig) Enabled() bool {
+	return c.URL != ""
+}
+
+var (
+	ldapConfig = DefaultLDAPConfig()
+	ldapMutex  sync.RWMutex
+)
+
+// SetupLDAP installs the process-wide directory configuration
+func SetupLDAP(c *LDAPConfig) {
+	ldapMutex.Lock()
+	defer ldapMutex.Unlock()
+	ldapConfig = c
+}
+
+// CurrentLDAPConfig returns the process-wide directory configuration
+func CurrentLDAPConfig() *LDAPConfig {
+	ldapMutex.RLock()
+	defer ldapMutex.RUnlock()
+	return ldapConfig
+}
+
+// LDAPConfigForDB returns the configuration with the system parameters of
+// a database applied; it is disabled when they make it invalid
+func LDAPConfigForDB(dbName string) *LDAPConfig {
+	c := *CurrentLDAPConfig()
+	if dbName == "" {
+		return &c
+	}
+	c.URL = models.GetParamString(dbName, ParamLDAPURL, c.URL)
+	c.StartTLS = models.GetParamBool(dbName, ParamLDAPStartTLS, c.StartTLS)
+	c.UserDN = models.GetParamString(dbName, ParamLDAPUserDN, c.UserDN)
+	c.BindDN = models.GetParamString(dbName, ParamLDAPBindDN, c.BindDN)
+	c.BindPassword = models.GetParamString(dbName, ParamLDAPBindPassword, c.BindPassword)
+	c.SearchBase = models.GetParamString(dbName, ParamLDAPSearchBase, c.SearchBase)
+	c.SearchFilter = models.GetParamString(dbName, ParamLDAPSearchFilter, c.SearchFilter)
+	c.LoginAttribute = models.GetParamString(dbName, ParamLDAPLoginAttribute, c.LoginAttribute)
+	c.NameAttribute = models.GetParamString(dbName, ParamLDAPNameAttribute, c.NameAttribute)
+	c.EmailAttribute = models.GetParamString(dbName, ParamLDAPEmailAttribute, c.EmailAttribute)
+	c.GroupAttribute = models.GetParamString(dbName, ParamLDAPGroupAttribute, c.GroupAttribute)
+	var groupMap map[string]string
+	if models.GetParamJSON(dbName, ParamLDAPGroupMap, &groupMap) {
+		c.GroupMap = groupMap
+	}
+	c.AutoProvision = models.GetParamBool(dbName, ParamLDAPAutoProvision, c.AutoProvision)
+	c.DefaultGroup = models.GetParamString(dbName, ParamLDAPDefaultGroup, c.DefaultGroup)
+	c.FailClosed = models.GetParamBool(dbName, ParamLDAPFailClosed, c.FailClosed)
+	if c.Validate() != nil {
+		c.URL = ""
+	}
+	return &c
+}
+
+// LDAPBackend authenticates users with a bind to the directory, then
+// links, creates or updates their user from the entry
+type LDAPBackend struct {
+	Config *LDAPConfig
+}
+
+// Name returns "ldap"
+func (b *LDAPBackend) Name() string {
+	return BackendLDAP
+}
+
+// Authenticate binds as the user of login. A login the directory does not
+// know is passed on; a wrong password is rejected, except with a user DN
+// template where the directory does not tell both apart.
+func (b *LDAPBackend) Authenticate(ctx context.Context, db *gorm.DB, login, password string) (Result, error) {
+	if password == "" {
+		// Binding without a password is anonymous and always succeeds
+		return Result{Outcome: Unknown}, nil
+	}
+	entry, result, err := b.lookup(ctx, login, password)
+	if err != nil || entry == nil {
+		return result, err
+	}
+	return b.syncUser(ctx, db, login, entry)
+}
+
+// unavailable wraps a failure to talk to the server
+func (b *LDAPBackend) unavailable(err error) error {
+	return &UnavailableError{Backend: BackendLDAP, Fatal: b.Config.FailClosed, Err: err}
+}
+
+// failure classifies an error of the server: a result it answered is a
+// configuration problem, anything else means it is unreachable
+func (b *LDAPBackend) failure(err error) error {
+	var result *ldapResultError
+	if errors.As(err, &result) {
+		return fmt.Errorf("LDAP: %w", err)
+	}
+	return b.unavailable(err)
+}
+
+// attributes returns the attributes read from the entries
+func (c *LDAPConfig) attributes() []string {
+	var attributes []string
+	for _, attribute := range []string{c.LoginAttribute, c.NameAttribute, c.EmailAttribute, c.GroupAttribute} {
+		if attribute != "" {
+			attributes = append(attributes, attribute)
+		}
+	}
+	return attributes
+}
+
+// lookup binds as the user of login and returns their entry, or nil with
+// the result of the login when it is not authenticated
+func (b *LDAPBackend) lookup(ctx context.Context, login, password string) (*ldapEntry, Result, error) {
+	c := b.Config
+	conn, err := dialLDAP(ctx, c)
+	if err != nil {
+		return nil, Result{}, b.unavailable(err)
+	}
+	defer conn.Close()
+
+	var result *ldapResultError
+	if c.UserDN != "" {
+		dn := strings.ReplaceAll(c.UserDN, "%s", escapeDN(login))
+		err := conn.bind(dn, password)
+		switch {
+		case errors.As(err, &result) && result.Code == ldapInvalidCredentials:
+			return nil, Result{Outcome: Unknown}, nil
+		case errors.As(err, &result):
+			return nil, Result{Outcome: Rejected, Reason: result.Error()}, nil
+		case err != nil:
+			return nil, Result{}, b.unavailable(err)
+		}
+		entries, err := conn.search(dn, ldapScopeBase, "(objectClass=*)", c.attributes(), 1)
+		switch {
+		case errors.As(err, &result) || (err == nil && len(entries) == 0):
+			// The user may not read their own entry: no attributes then
+			return &ldapEntry{DN: dn}, Result{}, nil
+		case err != nil:
+			return nil, Result{}, b.unavailable(err)
+		}
+		return &entries[0], Result{}, nil
+	}
+
+	if err := conn.bind(c.BindDN, c.BindPassword); err != nil {
+		return nil, Result{}, b.failure(fmt.Errorf("bind as %q: %w", c.BindDN, err))
+	}
+	filter := strings.ReplaceAll(c.SearchFilter, "%s", escapeFilterValue(login))
+	entries, err := conn.search(c.SearchBase, ldapScopeSubtree, filter, c.attributes(), 2)
+	if err != nil {
+		return nil, Result{}, b.failure(err)
+	}
+	switch len(entries) {
+	case 0:
+		return nil, Result{Outcome: Unknown}, nil
+	case 1:
+	default:
+		return nil, Result{Outcome: Rejected, Reason: "the login matches several entries"}, nil
+	}
+	err = conn.bind(entries[0].DN, password)
+	switch {
+	case errors.As(err, &result) && result.Code == ldapInvalidCredentials:
+		return nil, Result{Outcome: Rejected, Reason: "wrong password"}, nil
+	case errors.As(err, &result):
+		return nil, Result{Outcome: Rejected, Reason: result.Error()}, nil
+	case err != nil:
+		return nil, Result{}, b.unavailable(err)
+	}
+	return &entries[0], Result{}, nil
+}
+
+// syncUser returns the user of an authenticated entry: the one linked to
+// it, else the one with its login, linked to it then, else a new user
+// when auto-provisioning is enabled. Name, email and mapped groups are
+// copied from the entry.
+func (b *LDAPBackend) syncUser(ctx context.Context, db *gorm.DB, login string, entry *ldapEntry) (Result, error) {
+	c := b.Config
+	if c.LoginAttribute != "" {
+		if value := entry.first(c.LoginAttribute); value != "" {
+			login = value
+		}
+	}
+	name := entry.first(c.NameAttribute)
+	email := entry.first(c.EmailAttribute)
+
+	var user models.User
+	provisioned := false
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("ldap_dn = ?", entry.DN).First(&user).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			err = tx.Where("login = ?", login).First(&user).Error
+		}
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound) && c.AutoProvision:
+			provisioned = true
+			return b.provisionUser(tx, &user, login, name, email, entry)
+		case err != nil:
+			return err
+		case !user.Active || user.IsService || (user.LDAPDN != "" && normalizeDN(user.LDAPDN) != normalizeDN(entry.DN)):
+			return nil
+		}
+
+		updates := map[string]interface{}{"ldap_dn": entry.DN}
+		if name != "" && name != user.Name {
+			updates["name"] = name
+		}
+		if email != "" && email != user.Email {
+			var taken int64
+			if err := tx.Model(&models.User{}).Where("email = ? AND id <> ?", email, user.ID).Count(&taken).Error; err != nil {
+				return err
+			}
+			if taken == 0 {
+				updates["email"] = email
+			}
+		}
+		if err := tx.Model(&user).Updates(updates).Error; err != nil {
+			return err
+		}
+		user.LDAPDN = entry.DN
+		if value, ok := updates["name"].(string); ok {
+			user.Name = value
+		}
+		if value, ok := updates["email"].(string); ok {
+			user.Email = value
+		}
+		return c.syncGroups(tx, &user, entry)
+	})
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return Result{Outcome: Rejected, Reason: "no user matches " + entry.DN}, nil
+	case err != nil:
+		return Result{}, fmt.Errorf("failed to update the user of %s: %w", entry.DN, err)
+	case !user.Active:
+		return Result{Outcome: Rejected, Reason: "the user is archived"}, nil
+	case user.IsService:
+		return Result{Outcome: Rejected, Reason: "service accounts cannot log in"}, nil
+	case normalizeDN(user.LDAPDN) != normalizeDN(entry.DN):
+		return Result{Outcome: Rejected, Reason: fmt.Sprintf("%s is linked to %s", user.Login, user.LDAPDN)}, nil
+	}
+	return Result{Outcome: Authenticated, User: &user, Provisioned: provisioned}, nil
+}
+
+// provisionUser creates the user of an entry, without a password so it
+// authenticates against the directory only, in the default group if any
+func (b *LDAPBackend) provisionUser(tx *gorm.DB, user *models.User, login, name, email string, entry *ldapEntry) error {
+	c := b.Config
+	*user = models.User{Login: login, Name: name, Email: email, Active: true, LDAPDN: entry.DN}
+	if user.Name == "" {
+		user.Name = login
+	}
+	if err := tx.Create(user).Error; err != nil {
+		return fmt.Errorf("failed to provision %s: %w", login, err)
+	}
+	if c.DefaultGroup != "" {
+		id, err := resolveGroup(tx, c.DefaultGroup)
+		if err != nil {
+			return err
+		}
+		if err := tx.Model(user).Association("Groups").Append(&models.ResGroups{BaseModel: models.BaseModel{ID: id}}); err != nil {
+			return err
+		}
+	}
+	return c.syncGroups(tx, user, entry)
+}
+
+// resolveGroup returns the id of the group of an external id
+func resolveGroup(tx *gorm.DB, xmlid string) (uint, error) {
+	model, id, err := models.ResolveXMLID(tx, xmlid)
+	if err != nil {
+		return 0, fmt.Errorf("group %s: %w", xmlid, err)
+	}
+	if model != "res.groups" {
+		return 0, fmt.Errorf("group %s is a %s", xmlid, model)
+	}
+	return id, nil
+}
+
+// syncGroups adds the user to the groups mapped from the directory groups
+// of their entry and removes them from the other mapped groups
+func (c *LDAPConfig) syncGroups(tx *gorm.DB, user *models.User, entry *ldapEntry) error {
+	if len(c.GroupMap) == 0 {
+		return nil
+	}
+	member := make(map[string]bool)
+	for _, dn := range entry.values(c.GroupAttribute) {
+		member[normalizeDN(dn)] = true
+	}
+	keep := make(map[uint]bool)
+	for groupDN, xmlid := range c.GroupMap {
+		id, err := resolveGroup(tx, xmlid)
+		if err != nil {
+			return err
+		}
+		// A group mapped from several directory groups is kept when any
+		// of them has the user
+		keep[id] = keep[id] || member[normalizeDN(groupDN)]
+	}
+
+	var added, removed []interface{}
+	for id, kept := range keep {
+		group := &models.ResGroups{BaseModel: models.BaseModel{ID: id}}
+		if kept {
+			added = append(added, group)
+		} else {
+			removed = append(removed, group)
+		}
+	}
+	groups := tx.Model(user).Association("Groups")
+	if len(removed) > 0 {
+		if err := groups.Delete(removed...); err != nil {
+			return err
+		}
+	}
+	if len(added) > 0 {
+		return groups.Append(added...)
+	}
+	return nil
+}
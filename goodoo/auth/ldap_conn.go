@@ -0,0 +1,606 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// BER tags of the universal types the protocol uses
+const (
+	berBoolean     = 0x01
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berEnumerated  = 0x0a
+	berSequence    = 0x30
+)
+
+// Tags of the LDAP operations (RFC 4511) the client sends and reads
+const (
+	ldapBindRequest      = 0x60
+	ldapBindResponse     = 0x61
+	ldapUnbindRequest    = 0x42
+	ldapSearchRequest    = 0x63
+	ldapSearchEntry      = 0x64
+	ldapSearchDone       = 0x65
+	ldapSearchReference  = 0x73
+	ldapExtendedRequest  = 0x77
+	ldapExtendedResponse = 0x78
+)
+
+// Search scopes
+const (
+	ldapScopeBase    = 0
+	ldapScopeSubtree = 2
+)
+
+// Result codes the backend tells apart
+const (
+	ldapSuccess            = 0
+	ldapSizeLimitExceeded  = 4
+	ldapInvalidCredentials = 49
+)
+
+// ldapStartTLSOID names the StartTLS extended operation
+const ldapStartTLSOID = "1.3.6.1.4.1.1466.20037"
+
+// maxLDAPMessage bounds the messages read from the server
+const maxLDAPMessage = 1 << 20
+
+// ldapResultError is an operation the server answered with a failure
+type ldapResultError struct {
+	Code    int
+	Message string
+}
+
+func (e *ldapResultError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("LDAP result code %d", e.Code)
+	}
+	return fmt.Sprintf("LDAP result code %d: %s", e.Code, e.Message)
+}
+
+// berElement is a decoded BER element: its tag and contents
+type berElement struct {
+	tag  byte
+	data []byte
+}
+
+// berEncode encodes an element from its tag and contents
+func berEncode(tag byte, contents ...[]byte) []byte {
+	data := bytes.Join(contents, nil)
+	encoded := []byte{tag}
+	if length := len(data); length < 0x80 {
+		encoded = append(encoded, byte(length))
+	} else {
+		var octets []byte
+		for ; length > 0; length >>= 8 {
+			octets = append([]byte{byte(length)}, octets...)
+		}
+		encoded = append(encoded, 0x80|byte(len(octets)))
+		encoded = append(encoded, octets...)
+	}
+	return append(encoded, data...)
+}
+
+// berInt encodes a non-negative integer
+func berInt(tag byte, value int) []byte {
+	var octets []byte
+	for {
+		octets = append([]byte{byte(value)}, octets...)
+		value >>= 8
+		if value == 0 {
+			break
+		}
+	}
+	if octets[0]&0x80 != 0 {
+		octets = append([]byte{0}, octets...)
+	}
+	return berEncode(tag, octets)
+}
+
+// berString encodes a string
+func berString(tag byte, value string) []byte {
+	return berEncode(tag, []byte(value))
+}
+
+// berBool encodes a boolean
+func berBool(value bool) []byte {
+	if value {
+		return berEncode(berBoolean, []byte{0xff})
+	}
+	return berEncode(berBoolean, []byte{0})
+}
+
+// berReader is where elements are read from: the connection or the
+// contents of a constructed element
+type berReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// readBER reads an element
+func readBER(r berReader) (berElement, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return berElement{}, err
+	}
+	first, err := r.ReadByte()
+	if err != nil {
+		return berElement{}, err
+	}
+	length := int(first)
+	if first&0x80 != 0 {
+		count := int(first & 0x7f)
+		if count == 0 || count > 4 {
+			return berElement{}, fmt.Errorf("unsupported BER length of %d octets", count)
+		}
+		length = 0
+		for i := 0; i < count; i++ {
+			octet, err := r.ReadByte()
+			if err != nil {
+				return berElement{}, err
+			}
+			length = length<<8 | int(octet)
+		}
+	}
+	if length > maxLDAPMessage {
+		return berElement{}, fmt.Errorf("LDAP message of %d bytes is too large", length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return berElement{}, err
+	}
+	return berElement{tag: tag, data: data}, nil
+}
+
+// children decodes the contents of a constructed element
+func (e berElement) children() ([]berElement, error) {
+	var children []berElement
+	r := bytes.NewReader(e.data)
+	for r.Len() > 0 {
+		child, err := readBER(r)
+		if err != nil {
+			return nil, fmt.Errorf("malformed BER element: %w", err)
+		}
+		children = append(children, child)
+	}
+	return children, nil
+}
+
+// int decodes an integer or enumerated element
+func (e berElement) int() int {
+	value := 0
+	for i, octet := range e.data {
+		if i == 0 && octet&0x80 != 0 {
+			value = -1
+		}
+		value = value<<8 | int(octet)
+	}
+	return value
+}
+
+// ldapResult decodes the result of an operation, an ldapResultError when
+// it is not a success
+func ldapResult(op berElement) error {
+	fields, err := op.children()
+	if err != nil {
+		return err
+	}
+	if len(fields) < 3 {
+		return errors.New("malformed LDAP result")
+	}
+	if code := fields[0].int(); code != ldapSuccess {
+		return &ldapResultError{Code: code, Message: string(fields[2].data)}
+	}
+	return nil
+}
+
+// ldapEntry is an entry found by a search, its attributes keyed by their
+// lowercase name
+type ldapEntry struct {
+	DN         string
+	Attributes map[string][]string
+}
+
+// values returns the values of an attribute
+func (e *ldapEntry) values(name string) []string {
+	return e.Attributes[strings.ToLower(name)]
+}
+
+// first returns the first value of an attribute, "" when it has none
+func (e *ldapEntry) first(name string) string {
+	if values := e.values(name); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// parseLDAPEntry decodes a search result entry
+func parseLDAPEntry(op berElement) (ldapEntry, error) {
+	fields, err := op.children()
+	if err != nil {
+		return ldapEntry{}, err
+	}
+	if len(fields) < 2 {
+		return ldapEntry{}, errors.New("malformed LDAP search entry")
+	}
+	entry := ldapEntry{DN: string(fields[0].data), Attributes: make(map[string][]string)}
+	attributes, err := fields[1].children()
+	if err != nil {
+		return ldapEntry{}, err
+	}
+	for _, attribute := range attributes {
+		parts, err := attribute.children()
+		if err != nil || len(parts) < 2 {
+			return ldapEntry{}, errors.New("malformed LDAP attribute")
+		}
+		values, err := parts[1].children()
+		if err != nil {
+			return ldapEntry{}, err
+		}
+		name := strings.ToLower(string(parts[0].data))
+		for _, value := range values {
+			entry.Attributes[name] = append(entry.Attributes[name], string(value.data))
+		}
+	}
+	return entry, nil
+}
+
+// ldapConn speaks the few LDAPv3 operations the backend needs: StartTLS,
+// simple bind, search and unbind
+type ldapConn struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	messageID int
+	timeout   time.Duration
+}
+
+// dialLDAP connects to the server of the configuration, upgrading the
+// connection with StartTLS when configured
+func dialLDAP(ctx context.Context, c *LDAPConfig) (*ldapConn, error) {
+	server, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LDAP URL: %w", err)
+	}
+	host, port := server.Hostname(), server.Port()
+	switch server.Scheme {
+	case "ldap":
+		if port == "" {
+			port = "389"
+		}
+	case "ldaps":
+		if port == "" {
+			port = "636"
+		}
+	default:
+		return nil, fmt.Errorf("unsupported LDAP URL scheme %q", server.Scheme)
+	}
+	tlsConfig, err := c.tlsConfig(host)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: c.Timeout}
+	address := net.JoinHostPort(host, port)
+	var conn net.Conn
+	if server.Scheme == "ldaps" {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, "tcp", address)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	l := &ldapConn{conn: conn, reader: bufio.NewReader(conn), timeout: c.Timeout}
+	if server.Scheme == "ldap" && c.StartTLS {
+		if err := l.startTLS(ctx, tlsConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("StartTLS: %w", err)
+		}
+	}
+	return l, nil
+}
+
+// tlsConfig returns the TLS configuration of connections to host, trusting
+// the authorities of CAFile besides the system ones
+func (c *LDAPConfig) tlsConfig(host string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+	if c.CAFile == "" {
+		return config, nil
+	}
+	pem, err := os.ReadFile(c.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the LDAP CA file: %w", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate in the LDAP CA file %s", c.CAFile)
+	}
+	config.RootCAs = pool
+	return config, nil
+}
+
+// startTLS asks the server to switch to TLS and performs the handshake
+func (l *ldapConn) startTLS(ctx context.Context, config *tls.Config) error {
+	id, err := l.send(berEncode(ldapExtendedRequest, berString(0x80, ldapStartTLSOID)))
+	if err != nil {
+		return err
+	}
+	op, err := l.receive(id)
+	if err != nil {
+		return err
+	}
+	if op.tag != ldapExtendedResponse {
+		return fmt.Errorf("unexpected LDAP operation 0x%x", op.tag)
+	}
+	if err := ldapResult(op); err != nil {
+		return err
+	}
+	secure := tls.Client(l.conn, config)
+	handshakeCtx, cancel := context.WithTimeout(ctx, l.timeout)
+	defer cancel()
+	if err := secure.HandshakeContext(handshakeCtx); err != nil {
+		return err
+	}
+	l.conn, l.reader = secure, bufio.NewReader(secure)
+	return nil
+}
+
+// send writes an operation in a new message and returns its id
+func (l *ldapConn) send(op []byte) (int, error) {
+	l.messageID++
+	message := berEncode(berSequence, berInt(berInteger, l.messageID), op)
+	l.conn.SetDeadline(time.Now().Add(l.timeout))
+	if _, err := l.conn.Write(message); err != nil {
+		return 0, err
+	}
+	return l.messageID, nil
+}
+
+// receive reads the next message answering id and returns its operation
+func (l *ldapConn) receive(id int) (berElement, error) {
+	for {
+		l.conn.SetDeadline(time.Now().Add(l.timeout))
+		message, err := readBER(l.reader)
+		if err != nil {
+			return berElement{}, err
+		}
+		fields, err := message.children()
+		if err != nil {
+			return berElement{}, err
+		}
+		if message.tag != berSequence || len(fields) < 2 {
+			return berElement{}, errors.New("malformed LDAP message")
+		}
+		switch fields[0].int() {
+		case id:
+			return fields[1], nil
+		case 0:
+			// Unsolicited notification, i.e. the server is disconnecting
+			return berElement{}, fmt.Errorf("server disconnected: %w", ldapResult(fields[1]))
+		}
+	}
+}
+
+// bind authenticates the connection with a DN and password; an empty DN
+// binds anonymously
+func (l *ldapConn) bind(dn, password string) error {
+	id, err := l.send(berEncode(ldapBindRequest,
+		berInt(berInteger, 3),
+		berString(berOctetString, dn),
+		berString(0x80, password)))
+	if err != nil {
+		return err
+	}
+	op, err := l.receive(id)
+	if err != nil {
+		return err
+	}
+	if op.tag != ldapBindResponse {
+		return fmt.Errorf("unexpected LDAP operation 0x%x", op.tag)
+	}
+	return ldapResult(op)
+}
+
+// search returns the entries under base matching filter, with attributes,
+// at most limit of them (no limit when 0): exceeding it is not an error,
+// the entries read so far are returned
+func (l *ldapConn) search(base string, scope int, filter string, attributes []string, limit int) ([]ldapEntry, error) {
+	encodedFilter, err := compileFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	var encodedAttributes [][]byte
+	for _, attribute := range attributes {
+		encodedAttributes = append(encodedAttributes, berString(berOctetString, attribute))
+	}
+	id, err := l.send(berEncode(ldapSearchRequest,
+		berString(berOctetString, base),
+		berInt(berEnumerated, scope),
+		berInt(berEnumerated, 0), // never dereference aliases
+		berInt(berInteger, limit),
+		berInt(berInteger, int(l.timeout/time.Second)),
+		berBool(false),
+		encodedFilter,
+		berEncode(berSequence, encodedAttributes...)))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []ldapEntry
+	for {
+		op, err := l.receive(id)
+		if err != nil {
+			return nil, err
+		}
+		switch op.tag {
+		case ldapSearchEntry:
+			entry, err := parseLDAPEntry(op)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		case ldapSearchReference:
+			// Referrals to other servers are not followed
+		case ldapSearchDone:
+			err := ldapResult(op)
+			var result *ldapResultError
+			if errors.As(err, &result) && result.Code == ldapSizeLimitExceeded {
+				err = nil
+			}
+			return entries, err
+		default:
+			return nil, fmt.Errorf("unexpected LDAP operation 0x%x", op.tag)
+		}
+	}
+}
+
+// Close unbinds and closes the connection
+func (l *ldapConn) Close() error {
+	l.send(berEncode(ldapUnbindRequest))
+	return l.conn.Close()
+}
+
+// compileFilter encodes a search filter (RFC 4515) made of &, |, ! and
+// equality and presence items
+func compileFilter(filter string) ([]byte, error) {
+	encoded, rest, err := parseFilter(strings.TrimSpace(filter))
+	if err != nil {
+		return nil, fmt.Errorf("invalid LDAP filter %q: %w", filter, err)
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("invalid LDAP filter %q: unexpected %q", filter, rest)
+	}
+	return encoded, nil
+}
+
+// parseFilter encodes the filter at the start of s and returns what
+// follows it
+func parseFilter(s string) ([]byte, string, error) {
+	if !strings.HasPrefix(s, "(") || len(s) < 2 {
+		return nil, "", errors.New("a filter starts with (")
+	}
+	s = s[1:]
+	switch s[0] {
+	case '&', '|', '!':
+		tag := map[byte]byte{'&': 0xa0, '|': 0xa1, '!': 0xa2}[s[0]]
+		var items [][]byte
+		rest := s[1:]
+		for strings.HasPrefix(rest, "(") {
+			item, next, err := parseFilter(rest)
+			if err != nil {
+				return nil, "", err
+			}
+			items, rest = append(items, item), next
+		}
+		if !strings.HasPrefix(rest, ")") {
+			return nil, "", errors.New("a filter ends with )")
+		}
+		if len(items) == 0 || (s[0] == '!' && len(items) != 1) {
+			return nil, "", fmt.Errorf("%c takes one filter or more, ! exactly one", s[0])
+		}
+		return berEncode(tag, items...), rest[1:], nil
+	}
+
+	end := strings.IndexByte(s, ')')
+	if end < 0 {
+		return nil, "", errors.New("a filter ends with )")
+	}
+	item, rest := s[:end], s[end+1:]
+	attribute, value, found := strings.Cut(item, "=")
+	if !found || attribute == "" || strings.ContainsAny(attribute, "~<>:") {
+		return nil, "", fmt.Errorf("unsupported filter item %q", item)
+	}
+	if value == "*" {
+		return berString(0x87, attribute), rest, nil
+	}
+	if strings.Contains(value, "*") {
+		return nil, "", fmt.Errorf("substring filter %q is not supported", item)
+	}
+	unescaped, err := unescapeFilterValue(value)
+	if err != nil {
+		return nil, "", err
+	}
+	return berEncode(0xa3, berString(berOctetString, attribute), berString(berOctetString, unescaped)), rest, nil
+}
+
+// escapeFilterValue escapes a value for a search filter
+func escapeFilterValue(value string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '\\', '*', '(', ')', 0:
+			fmt.Fprintf(&escaped, "\\%02x", c)
+		default:
+			escaped.WriteByte(c)
+		}
+	}
+	return escaped.String()
+}
+
+// unescapeFilterValue decodes the \XX escapes of a filter value
+func unescapeFilterValue(value string) (string, error) {
+	var unescaped strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			unescaped.WriteByte(value[i])
+			continue
+		}
+		if i+3 > len(value) {
+			return "", fmt.Errorf("truncated escape in %q", value)
+		}
+		decoded, err := hex.DecodeString(value[i+1 : i+3])
+		if err != nil {
+			return "", fmt.Errorf("invalid escape in %q", value)
+		}
+		unescaped.Write(decoded)
+		i += 2
+	}
+	return unescaped.String(), nil
+}
+
+// escapeDN escapes a value for an attribute of a DN (RFC 4514)
+func escapeDN(value string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == 0:
+			escaped.WriteString("\\00")
+		case strings.IndexByte(",+\"\\<>;=", c) >= 0,
+			i == 0 && (c == ' ' || c == '#'),
+			i == len(value)-1 && c == ' ':
+			escaped.WriteByte('\\')
+			escaped.WriteByte(c)
+		default:
+			escaped.WriteByte(c)
+		}
+	}
+	return escaped.String()
+}
+
+// normalizeDN returns a DN in a form comparable with others: lowercase,
+// without spaces around the separators
+func normalizeDN(dn string) string {
+	parts := strings.Split(strings.ToLower(dn), ",")
+	for i, part := range parts {
+		name, value, _ := strings.Cut(part, "=")
+		parts[i] = strings.TrimSpace(name) + "=" + strings.TrimSpace(value)
+	}
+	return strings.Join(parts, ",")
+}
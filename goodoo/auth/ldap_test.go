@@ -0,0 +1,574 @@
+package auth
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"goodoo/models"
+	"goodoo/models/testutil"
+	"gorm.io/gorm"
+)
+
+// Result codes the test directory answers besides those of the backend
+const (
+	testProtocolError = 2
+	testNoSuchObject  = 32
+)
+
+// testEntry is an entry of the test directory; an entry without a
+// password cannot bind
+type testEntry struct {
+	DN         string
+	Password   string
+	Attributes map[string][]string
+}
+
+// testDirectory is an in-process LDAP server speaking what ldapConn
+// sends: simple binds, searches with equality, presence, and, or and not
+// filters, and unbinds. StartTLS is refused.
+type testDirectory struct {
+	listener net.Listener
+
+	mutex   sync.Mutex
+	entries map[string]*testEntry // by normalized DN
+	binds   []string
+}
+
+func newTestDirectory(t *testing.T, entries ...*testEntry) *testDirectory {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &testDirectory{listener: listener, entries: make(map[string]*testEntry)}
+	for _, entry := range entries {
+		d.put(entry)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go d.serve(conn)
+		}
+	}()
+	return d
+}
+
+// URL returns the ldap:// URL of the server
+func (d *testDirectory) URL() string {
+	return "ldap://" + d.listener.Addr().String()
+}
+
+// put adds an entry or replaces the one of its DN
+func (d *testDirectory) put(entry *testEntry) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.entries[normalizeDN(entry.DN)] = entry
+}
+
+// bound returns the DNs bound so far, in order
+func (d *testDirectory) bound() []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return slices.Clone(d.binds)
+}
+
+// serve answers the messages of a connection until it is unbound or closed
+func (d *testDirectory) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		message, err := readBER(reader)
+		if err != nil {
+			return
+		}
+		fields, err := message.children()
+		if err != nil || len(fields) < 2 {
+			return
+		}
+		id, op := fields[0].int(), fields[1]
+		parts, err := op.children()
+		if err != nil {
+			return
+		}
+		var answers [][]byte
+		switch op.tag {
+		case ldapBindRequest:
+			if len(parts) < 3 {
+				return
+			}
+			code := d.bind(string(parts[1].data), string(parts[2].data))
+			answers = append(answers, testResult(ldapBindResponse, code))
+		case ldapSearchRequest:
+			if len(parts) < 8 {
+				return
+			}
+			answers = d.search(string(parts[0].data), parts[1].int(), parts[3].int(), parts[6], parts[7])
+		case ldapExtendedRequest:
+			answers = append(answers, testResult(ldapExtendedResponse, testProtocolError))
+		default:
+			return
+		}
+		for _, answer := range answers {
+			if _, err := conn.Write(berEncode(berSequence, berInt(berInteger, id), answer)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// testResult encodes the result of an operation
+func testResult(tag byte, code int) []byte {
+	return berEncode(tag,
+		berInt(berEnumerated, code),
+		berString(berOctetString, ""),
+		berString(berOctetString, ""))
+}
+
+// bind checks a simple bind, anonymous when dn is empty
+func (d *testDirectory) bind(dn, password string) int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.binds = append(d.binds, dn)
+	if dn == "" {
+		return ldapSuccess
+	}
+	entry := d.entries[normalizeDN(dn)]
+	if entry == nil || entry.Password == "" || entry.Password != password {
+		return ldapInvalidCredentials
+	}
+	return ldapSuccess
+}
+
+// search returns the entries under base matching filter, then the result
+func (d *testDirectory) search(base string, scope, limit int, filter, requested berElement) [][]byte {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	base = normalizeDN(base)
+	if scope == ldapScopeBase && d.entries[base] == nil {
+		return [][]byte{testResult(ldapSearchDone, testNoSuchObject)}
+	}
+	var names []string
+	if attributes, err := requested.children(); err == nil {
+		for _, attribute := range attributes {
+			names = append(names, string(attribute.data))
+		}
+	}
+
+	var answers [][]byte
+	var dns []string
+	for dn := range d.entries {
+		dns = append(dns, dn)
+	}
+	slices.Sort(dns)
+	for _, dn := range dns {
+		entry := d.entries[dn]
+		if dn != base && (scope == ldapScopeBase || !strings.HasSuffix(dn, ","+base)) {
+			continue
+		}
+		if !testMatch(entry, filter) {
+			continue
+		}
+		if limit > 0 && len(answers) == limit {
+			return append(answers, testResult(ldapSearchDone, ldapSizeLimitExceeded))
+		}
+		answers = append(answers, testSearchEntry(entry, names))
+	}
+	return append(answers, testResult(ldapSearchDone, ldapSuccess))
+}
+
+// testSearchEntry encodes an entry with the attributes requested, all of
+// them when none is
+func testSearchEntry(entry *testEntry, requested []string) []byte {
+	var attributes [][]byte
+	for name, values := range entry.Attributes {
+		if len(requested) > 0 && !slices.ContainsFunc(requested, func(r string) bool { return strings.EqualFold(r, name) }) {
+			continue
+		}
+		var encoded [][]byte
+		for _, value := range values {
+			encoded = append(encoded, berString(berOctetString, value))
+		}
+		attributes = append(attributes, berEncode(berSequence,
+			berString(berOctetString, name),
+			berEncode(0x31, encoded...)))
+	}
+	return berEncode(ldapSearchEntry,
+		berString(berOctetString, entry.DN),
+		berEncode(berSequence, attributes...))
+}
+
+// testValues returns the values of an attribute of an entry, every entry
+// being of some object class
+func testValues(entry *testEntry, name string) []string {
+	if strings.EqualFold(name, "objectClass") {
+		return []string{"inetOrgPerson"}
+	}
+	for attribute, values := range entry.Attributes {
+		if strings.EqualFold(attribute, name) {
+			return values
+		}
+	}
+	return nil
+}
+
+// testMatch evaluates a filter encoded by compileFilter on an entry,
+// comparing values regardless of case as the usual attributes do
+func testMatch(entry *testEntry, filter berElement) bool {
+	switch filter.tag {
+	case 0x87:
+		return len(testValues(entry, string(filter.data))) > 0
+	case 0xa3:
+		parts, err := filter.children()
+		if err != nil || len(parts) != 2 {
+			return false
+		}
+		return slices.ContainsFunc(testValues(entry, string(parts[0].data)), func(value string) bool {
+			return strings.EqualFold(value, string(parts[1].data))
+		})
+	}
+	items, err := filter.children()
+	if err != nil {
+		return false
+	}
+	switch filter.tag {
+	case 0xa0:
+		for _, item := range items {
+			if !testMatch(entry, item) {
+				return false
+			}
+		}
+		return true
+	case 0xa1:
+		for _, item := range items {
+			if testMatch(entry, item) {
+				return true
+			}
+		}
+	case 0xa2:
+		return len(items) == 1 && !testMatch(entry, items[0])
+	}
+	return false
+}
+
+const (
+	testPeople     = "ou=people,dc=example,dc=org"
+	testServiceDN  = "cn=goodoo,ou=services,dc=example,dc=org"
+	testServicePwd = "service secret"
+)
+
+// testPerson returns the entry of a person of the directory
+func testPerson(uid, password string, groups ...string) *testEntry {
+	return &testEntry{
+		DN:       "uid=" + uid + "," + testPeople,
+		Password: password,
+		Attributes: map[string][]string{
+			"uid":      {uid},
+			"cn":       {"Person " + uid},
+			"mail":     {uid + "@example.org"},
+			"memberOf": groups,
+		},
+	}
+}
+
+// testConfig returns a search-and-bind configuration of the directory
+func testConfig(d *testDirectory) *LDAPConfig {
+	c := DefaultLDAPConfig()
+	c.URL = d.URL()
+	c.BindDN = testServiceDN
+	c.BindPassword = testServicePwd
+	c.SearchBase = testPeople
+	return c
+}
+
+// testService is the entry of the account the backend searches as
+func testService() *testEntry {
+	return &testEntry{DN: testServiceDN, Password: testServicePwd}
+}
+
+// TestLDAPBindFailures checks what the backend decides when a bind fails,
+// before it touches the database
+func TestLDAPBindFailures(t *testing.T) {
+	d := newTestDirectory(t, testService(),
+		testPerson("alice", "alice secret"),
+		testPerson("nopass", ""),
+		&testEntry{DN: "uid=twin,ou=a," + testPeople, Attributes: map[string][]string{"uid": {"twin"}}},
+		&testEntry{DN: "uid=twin,ou=b," + testPeople, Attributes: map[string][]string{"uid": {"twin"}}},
+	)
+	template := testConfig(d)
+	template.UserDN = "uid=%s," + testPeople
+
+	for _, test := range []struct {
+		name            string
+		config          *LDAPConfig
+		login, password string
+		want            Outcome
+	}{
+		{"wrong password", testConfig(d), "alice", "wrong", Rejected},
+		{"unknown login", testConfig(d), "bob", "alice secret", Unknown},
+		{"entry without password", testConfig(d), "nopass", "anything", Rejected},
+		{"several entries", testConfig(d), "twin", "anything", Rejected},
+		{"filter injection", testConfig(d), "*", "alice secret", Unknown},
+		{"filter injection in a group", testConfig(d), "x)(uid=alice", "alice secret", Unknown},
+		{"empty password", testConfig(d), "alice", "", Unknown},
+		// A DN template cannot tell an unknown user from a wrong password
+		{"wrong password with a template", template, "alice", "wrong", Unknown},
+		{"unknown login with a template", template, "bob", "alice secret", Unknown},
+		{"DN injection with a template", template, "alice,ou=people", "alice secret", Unknown},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			backend := &LDAPBackend{Config: test.config}
+			// Failed binds never reach the database
+			result, err := backend.Authenticate(context.Background(), nil, test.login, test.password)
+			if err != nil {
+				t.Fatalf("Authenticate: %v", err)
+			}
+			if result.Outcome != test.want || result.User != nil {
+				t.Errorf("Authenticate(%q) = %+v, want outcome %d", test.login, result, test.want)
+			}
+		})
+	}
+}
+
+func TestLDAPLookup(t *testing.T) {
+	d := newTestDirectory(t, testService(), testPerson("alice", "alice secret", "cn=sales,ou=groups,dc=example,dc=org"))
+
+	backend := &LDAPBackend{Config: testConfig(d)}
+	entry, _, err := backend.lookup(context.Background(), "ALICE", "alice secret")
+	if err != nil || entry == nil {
+		t.Fatalf("lookup = %v, %v; want the entry of alice", entry, err)
+	}
+	if normalizeDN(entry.DN) != normalizeDN("uid=alice,"+testPeople) || entry.first("cn") != "Person alice" ||
+		entry.first("mail") != "alice@example.org" || len(entry.values("memberOf")) != 1 {
+		t.Errorf("entry = %+v", entry)
+	}
+	if bound := d.bound(); !slices.Equal(bound, []string{testServiceDN, entry.DN}) {
+		t.Errorf("bound %q, want the service account then the user", bound)
+	}
+
+	backend.Config.UserDN = "uid=%s," + testPeople
+	entry, _, err = backend.lookup(context.Background(), "alice", "alice secret")
+	if err != nil || entry == nil || entry.first("mail") != "alice@example.org" {
+		t.Errorf("lookup with a template = %+v, %v; want the entry of alice", entry, err)
+	}
+}
+
+// staticBackend decides the same for every login
+type staticBackend struct {
+	result Result
+}
+
+func (b staticBackend) Name() string {
+	return "static"
+}
+
+func (b staticBackend) Authenticate(ctx context.Context, db *gorm.DB, login, password string) (Result, error) {
+	return b.result, nil
+}
+
+// TestLDAPUnavailable checks that an unreachable server, or one refusing
+// the service account or StartTLS, falls through to the next backend or
+// fails the login per configuration
+func TestLDAPUnavailable(t *testing.T) {
+	d := newTestDirectory(t, testService(), testPerson("alice", "alice secret"))
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	user := &models.User{Login: "alice"}
+	next := staticBackend{Result{Outcome: Authenticated, User: user}}
+
+	for _, test := range []struct {
+		name      string
+		configure func(c *LDAPConfig)
+	}{
+		{"unreachable", func(c *LDAPConfig) { c.URL = "ldap://" + closed.Addr().String() }},
+		{"StartTLS refused", func(c *LDAPConfig) { c.StartTLS = true }},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig(d)
+			test.configure(config)
+			chain := Chain{&LDAPBackend{Config: config}, next}
+
+			login, err := chain.Authenticate(context.Background(), nil, "alice", "alice secret")
+			if err != nil {
+				t.Fatalf("Authenticate failing open: %v", err)
+			}
+			var unavailable *UnavailableError
+			if login.User != user || login.Backend != "static" || len(login.Skipped) != 1 || !errors.As(login.Skipped[0], &unavailable) {
+				t.Errorf("login = %+v, want the next backend after skipping LDAP", login)
+			}
+
+			config.FailClosed = true
+			_, err = chain.Authenticate(context.Background(), nil, "alice", "alice secret")
+			if !errors.As(err, &unavailable) || !unavailable.Fatal || errors.Is(err, ErrInvalidCredentials) {
+				t.Errorf("Authenticate failing closed = %v, want a fatal UnavailableError", err)
+			}
+		})
+	}
+
+	// A server refusing the service account is misconfigured, not down:
+	// the login fails whatever FailClosed says
+	config := testConfig(d)
+	config.BindPassword = "wrong"
+	_, err = Chain{&LDAPBackend{Config: config}, next}.Authenticate(context.Background(), nil, "alice", "alice secret")
+	var unavailable *UnavailableError
+	if err == nil || errors.As(err, &unavailable) {
+		t.Errorf("Authenticate with a wrong service password = %v, want a configuration error", err)
+	}
+}
+
+// createTestGroup creates a group and returns its external id
+func createTestGroup(t *testing.T, env *testutil.TestEnvironment) string {
+	group := models.ResGroups{Name: testutil.Unique("LDAP group")}
+	if err := env.Tx.Create(&group).Error; err != nil {
+		t.Fatal(err)
+	}
+	xmlid := "ldap_test." + testutil.Unique("group")
+	if err := models.SetXMLID(env.Tx, xmlid, "res.groups", group.ID); err != nil {
+		t.Fatal(err)
+	}
+	return xmlid
+}
+
+// groupsOf returns the sorted external ids of the groups of a user
+func groupsOf(t *testing.T, env *testutil.TestEnvironment, uid uint) []string {
+	groups, err := models.UserGroupXMLIDs(env.Tx, uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(groups)
+	return groups
+}
+
+func sorted(values ...string) []string {
+	slices.Sort(values)
+	return values
+}
+
+// TestLDAPProvisioning logs in a user the database does not know yet
+func TestLDAPProvisioning(t *testing.T) {
+	env := testutil.NewTestEnvironment(t)
+	employees, sales := createTestGroup(t, env), createTestGroup(t, env)
+	salesDN := "cn=sales,ou=groups,dc=example,dc=org"
+	uid := testutil.Unique("ldap_user")
+	d := newTestDirectory(t, testService(), testPerson(uid, "secret", "CN=Sales, ou=groups,dc=example,dc=org"))
+
+	config := testConfig(d)
+	config.LoginAttribute = "uid"
+	config.GroupMap = map[string]string{salesDN: sales}
+	backend := &LDAPBackend{Config: config}
+
+	result, err := backend.Authenticate(context.Background(), env.Tx, strings.ToUpper(uid), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Outcome != Rejected || result.User != nil {
+		t.Fatalf("first login without auto-provisioning = %+v, want rejected", result)
+	}
+
+	config.AutoProvision = true
+	config.DefaultGroup = employees
+	result, err = backend.Authenticate(context.Background(), env.Tx, strings.ToUpper(uid), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Outcome != Authenticated || !result.Provisioned || result.User == nil {
+		t.Fatalf("first login = %+v, want a provisioned user", result)
+	}
+	var user models.User
+	if err := env.Tx.First(&user, result.User.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	// The login comes from the entry, not from what was typed
+	if user.Login != uid || user.Name != "Person "+uid || user.Email != uid+"@example.org" ||
+		!user.Active || user.Password != "" || normalizeDN(user.LDAPDN) != normalizeDN("uid="+uid+","+testPeople) {
+		t.Errorf("provisioned user = %+v", user)
+	}
+	if groups := groupsOf(t, env, user.ID); !slices.Equal(groups, sorted(employees, sales)) {
+		t.Errorf("groups of the provisioned user = %v, want %s and %s", groups, employees, sales)
+	}
+
+	result, err = backend.Authenticate(context.Background(), env.Tx, uid, "secret")
+	if err != nil || result.Outcome != Authenticated || result.Provisioned || result.User.ID != user.ID {
+		t.Errorf("second login = %+v, %v; want user %d, not provisioned again", result, err, user.ID)
+	}
+	result, err = backend.Authenticate(context.Background(), env.Tx, uid, "wrong")
+	if err != nil || result.Outcome != Rejected {
+		t.Errorf("login with a wrong password = %+v, %v; want rejected", result, err)
+	}
+}
+
+// TestLDAPGroupSync links a local user to their entry, then follows the
+// changes of their directory groups at each login
+func TestLDAPGroupSync(t *testing.T) {
+	env := testutil.NewTestEnvironment(t)
+	sales, support, unmapped := createTestGroup(t, env), createTestGroup(t, env), createTestGroup(t, env)
+	salesDN := "cn=sales,ou=groups,dc=example,dc=org"
+	supportDN := "cn=support,ou=groups,dc=example,dc=org"
+	helpdeskDN := "cn=helpdesk,ou=groups,dc=example,dc=org"
+
+	uid := testutil.Unique("ldap_user")
+	user := env.CreateUser(func(u *models.User) { u.Login = uid; u.Name = "Old name" })
+	_, unmappedID, err := models.ResolveXMLID(env.Tx, unmapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := env.Tx.Model(user).Association("Groups").Append(&models.ResGroups{BaseModel: models.BaseModel{ID: unmappedID}}); err != nil {
+		t.Fatal(err)
+	}
+
+	d := newTestDirectory(t, testService(), testPerson(uid, "secret", salesDN))
+	config := testConfig(d)
+	// Support is mapped from two directory groups
+	config.GroupMap = map[string]string{salesDN: sales, supportDN: support, helpdeskDN: support}
+	backend := &LDAPBackend{Config: config}
+
+	for _, step := range []struct {
+		name   string
+		groups []string
+		want   []string
+	}{
+		{"link", []string{salesDN}, sorted(sales, unmapped)},
+		{"join", []string{salesDN, supportDN}, sorted(sales, support, unmapped)},
+		{"move", []string{helpdeskDN}, sorted(support, unmapped)},
+		{"leave", nil, []string{unmapped}},
+	} {
+		d.put(testPerson(uid, "secret", step.groups...))
+		result, err := backend.Authenticate(context.Background(), env.Tx, uid, "secret")
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if result.Outcome != Authenticated || result.Provisioned || result.User.ID != user.ID {
+			t.Fatalf("%s: login = %+v, want user %d", step.name, result, user.ID)
+		}
+		if groups := groupsOf(t, env, user.ID); !slices.Equal(groups, step.want) {
+			t.Errorf("%s: groups = %v, want %v", step.name, groups, step.want)
+		}
+	}
+
+	var stored models.User
+	if err := env.Tx.First(&stored, user.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if stored.Name != "Person "+uid || stored.Email != uid+"@example.org" || stored.LDAPDN == "" || stored.Password == "" {
+		t.Errorf("linked user = %+v, want the name, email and DN of the entry, and the local password kept", stored)
+	}
+
+	// Another entry cannot take over the linked user through its login
+	d.put(&testEntry{DN: "uid=" + uid + ",ou=contractors,dc=example,dc=org", Password: "secret", Attributes: map[string][]string{"uid": {uid}}})
+	config.SearchBase = "ou=contractors,dc=example,dc=org"
+	result, err := backend.Authenticate(context.Background(), env.Tx, uid, "secret")
+	if err != nil || result.Outcome != Rejected {
+		t.Errorf("login through another entry = %+v, %v; want rejected", result, err)
+	}
+}
@@ -0,0 +1,43 @@
+package auth
+
+import (
+	"context"
+	"errors"
+
+	"goodoo/models"
+	"gorm.io/gorm"
+)
+
+// LocalBackend checks the password hash stored on the user
+type LocalBackend struct{}
+
+// Name returns "local"
+func (LocalBackend) Name() string {
+	return BackendLocal
+}
+
+// Authenticate knows the active users with a password. A wrong password
+// is rejected, except for users linked to the directory, whose password
+// the LDAP backend checks. Service accounts authenticate with service
+// keys only.
+func (LocalBackend) Authenticate(ctx context.Context, db *gorm.DB, login, password string) (Result, error) {
+	user, err := models.FindUserByLogin(db.WithContext(ctx), login)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return Result{Outcome: Unknown}, nil
+	}
+	if err != nil {
+		return Result{}, err
+	}
+	switch {
+	case user.IsService:
+		return Result{Outcome: Rejected, Reason: "service accounts cannot log in"}, nil
+	case user.Password == "":
+		// Users of the directory or of single sign-on
+		return Result{Outcome: Unknown}, nil
+	case user.CheckPassword(password):
+		return Result{Outcome: Authenticated, User: user}, nil
+	case user.LDAPDN != "":
+		return Result{Outcome: Unknown}, nil
+	}
+	return Result{Outcome: Rejected, Reason: "wrong password"}, nil
+}
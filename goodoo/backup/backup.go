@@ -0,0 +1,396 @@
+// Package backup dumps databases into archives and restores them into new
+// databases (like Odoo's database manager). An archive is a zip holding a
+// manifest and the dump: a pg_dump custom-format archive, or plain SQL
+// written by a built-in dumper when pg_dump is not installed.
+package backup
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/crypto/bcrypt"
+	"goodoo/database"
+	"goodoo/models"
+	"goodoo/operations"
+	"goodoo/version"
+	"gorm.io/gorm"
+)
+
+// Dump formats
+const (
+	// FormatCustom is a pg_dump custom-format archive, restored with pg_restore
+	FormatCustom = "custom"
+	// FormatSQL is plain SQL written by the built-in dumper
+	FormatSQL = "sql"
+)
+
+// Names of the archive entries
+const (
+	ManifestEntry = "manifest.json"
+	customEntry   = "dump.dump"
+	sqlEntry      = "dump.sql"
+)
+
+var (
+	ErrDisabled       = errors.New("database management is disabled: no master password is configured")
+	ErrAccessDenied   = errors.New("invalid master password")
+	ErrInvalidName    = errors.New("invalid database name")
+	ErrDatabaseExists = errors.New("database already exists")
+	ErrNoManifest     = errors.New("archive has no manifest")
+	ErrNoDump         = errors.New("archive has no dump")
+)
+
+// Config holds the master password and the automatic backups
+type Config struct {
+	// MasterPassword protects backup and restore; they are disabled when it
+	// is empty. It may be a bcrypt hash.
+	MasterPassword string
+	// Dir receives the automatic backups
+	Dir string
+	// Interval between automatic backups, 0 to disable them
+	Interval time.Duration
+	// KeepCount and KeepAge bound the automatic backups kept per database;
+	// 0 disables the bound
+	KeepCount int
+	KeepAge   time.Duration
+	// Format of the dumps; custom falls back to sql without pg_dump
+	Format string
+}
+
+// DefaultConfig returns backup management disabled, with daily automatic
+// backups kept for 30 days or 7 copies once an interval is set
+func DefaultConfig() *Config {
+	return &Config{
+		Dir:       "./backups",
+		KeepCount: 7,
+		KeepAge:   30 * 24 * time.Hour,
+		Format:    FormatCustom,
+	}
+}
+
+// LoadFromEnv overrides the configuration with GOODOO_MASTER_PASSWORD and
+// GOODOO_BACKUP_* variables
+func (c *Config) LoadFromEnv() {
+	if value := os.Getenv("GOODOO_MASTER_PASSWORD"); value != "" {
+		c.MasterPassword = value
+	}
+	if value := os.Getenv("GOODOO_BACKUP_DIR"); value != "" {
+		c.Dir = value
+	}
+	if value := os.Getenv("GOODOO_BACKUP_INTERVAL"); value != "" {
+		if interval, err := time.ParseDuration(value); err == nil && interval >= 0 {
+			c.Interval = interval
+		}
+	}
+	if value := os.Getenv("GOODOO_BACKUP_KEEP"); value != "" {
+		if count, err := strconv.Atoi(value); err == nil && count >= 0 {
+			c.KeepCount = count
+		}
+	}
+	if value := os.Getenv("GOODOO_BACKUP_KEEP_DAYS"); value != "" {
+		if days, err := strconv.Atoi(value); err == nil && days >= 0 {
+			c.KeepAge = time.Duration(days) * 24 * time.Hour
+		}
+	}
+	if value := os.Getenv("GOODOO_BACKUP_FORMAT"); value == FormatCustom || value == FormatSQL {
+		c.Format = value
+	}
+}
+
+var (
+	config = DefaultConfig()
+	mutex  sync.RWMutex
+)
+
+// Setup installs the process-wide backup configuration
+func Setup(c *Config) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	config = c
+}
+
+// CurrentConfig returns the backup configuration
+func CurrentConfig() *Config {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return config
+}
+
+// CheckMasterPassword verifies the master password
+func CheckMasterPassword(password string) error {
+	master := CurrentConfig().MasterPassword
+	if master == "" {
+		return ErrDisabled
+	}
+	if strings.HasPrefix(master, "$2") {
+		if bcrypt.CompareHashAndPassword([]byte(master), []byte(password)) != nil {
+			return ErrAccessDenied
+		}
+		return nil
+	}
+	if subtle.ConstantTimeCompare([]byte(master), []byte(password)) != 1 {
+		return ErrAccessDenied
+	}
+	return nil
+}
+
+// namePattern is the accepted database names (Odoo's DBNAME_PATTERN)
+var namePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,62}$`)
+
+// ValidName reports whether a database name is accepted
+func ValidName(name string) bool {
+	return namePattern.MatchString(name)
+}
+
+// DatabaseExists reports whether the server holding db has a database
+func DatabaseExists(db *gorm.DB, name string) (bool, error) {
+	var count int64
+	err := db.Raw("SELECT COUNT(*) FROM pg_database WHERE datname = ?", name).Scan(&count).Error
+	return count > 0, err
+}
+
+// Manifest describes the content of an archive
+type Manifest struct {
+	Version      string    `json:"version"`
+	DBName       string    `json:"db_name"`
+	Format       string    `json:"format"`
+	RegistryHash string    `json:"registry_hash"`
+	Date         time.Time `json:"date"`
+	PgVersion    string    `json:"pg_version,omitempty"`
+}
+
+// Check compares the manifest with the running server and returns the
+// differences to warn about
+func (m *Manifest) Check(registry *models.FieldModelRegistry) []string {
+	var warnings []string
+	if m.Version != version.Version {
+		warnings = append(warnings, fmt.Sprintf("backup was made by version %s, the server runs %s", m.Version, version.Version))
+	}
+	if m.RegistryHash != registry.Hash() {
+		warnings = append(warnings, "the models of the backup differ from those of the server")
+	}
+	return warnings
+}
+
+// FileName returns the name of the archive of a database made at a time
+func FileName(dbName string, date time.Time) string {
+	return fmt.Sprintf("%s_%s.zip", dbName, date.UTC().Format("2006-01-02_15-04-05"))
+}
+
+// connectionConfig returns the connection settings of a database
+func connectionConfig(dbName string) (*database.ConnectionConfig, error) {
+	if info, err := database.GetRegistry().GetDatabaseInfo(dbName); err == nil && info.Config != nil {
+		config := info.Config.Clone()
+		return config, nil
+	}
+	_, config, err := database.ParseConnectionInfo(dbName)
+	return config, err
+}
+
+// commandEnv returns the conninfo of a database for the PostgreSQL tools,
+// the password passed through the environment rather than the arguments
+func commandEnv(config *database.ConnectionConfig) (string, []string) {
+	if config.DSN != "" {
+		return config.DSN, os.Environ()
+	}
+	withoutPassword := *config
+	withoutPassword.Password = ""
+	return withoutPassword.BuildDSN(), append(os.Environ(), "PGPASSWORD="+config.Password)
+}
+
+// connect opens a dedicated connection to a database
+func connect(ctx context.Context, dbName string) (*pgx.Conn, error) {
+	config, err := connectionConfig(dbName)
+	if err != nil {
+		return nil, err
+	}
+	config.Database = dbName
+	return pgx.Connect(ctx, config.BuildDSN())
+}
+
+// Write writes an archive of a database to w, dumping with pg_dump when
+// the format is custom and it is installed, with the built-in dumper
+// otherwise, and returns its manifest
+func Write(ctx context.Context, dbName, format string, w io.Writer, op *operations.Operation) (*Manifest, error) {
+	pgDump, lookErr := exec.LookPath("pg_dump")
+	if format != FormatSQL && lookErr != nil {
+		format = FormatSQL
+	}
+
+	conn, err := connect(ctx, dbName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", dbName, err)
+	}
+	defer conn.Close(context.Background())
+
+	manifest := &Manifest{
+		Version:      version.Version,
+		DBName:       dbName,
+		Format:       format,
+		RegistryHash: models.RegistryForDB(dbName).Hash(),
+		Date:         time.Now().UTC(),
+	}
+	conn.QueryRow(ctx, "SHOW server_version").Scan(&manifest.PgVersion)
+
+	archive := zip.NewWriter(w)
+	entry, err := archive.Create(ManifestEntry)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.NewEncoder(entry).Encode(manifest); err != nil {
+		return nil, err
+	}
+
+	if format == FormatCustom {
+		entry, err = archive.Create(customEntry)
+		if err == nil {
+			err = runPgDump(ctx, pgDump, dbName, entry)
+		}
+	} else {
+		entry, err = archive.Create(sqlEntry)
+		if err == nil {
+			err = dumpSQL(ctx, conn, entry, op)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return manifest, archive.Close()
+}
+
+// runPgDump streams a custom-format dump of a database to w
+func runPgDump(ctx context.Context, pgDump, dbName string, w io.Writer) error {
+	config, err := connectionConfig(dbName)
+	if err != nil {
+		return err
+	}
+	config.Database = dbName
+	conninfo, env := commandEnv(config)
+
+	var stderr strings.Builder
+	cmd := exec.CommandContext(ctx, pgDump, "--format=custom", "--no-owner", "--dbname="+conninfo)
+	cmd.Env = env
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("pg_dump failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// ReadManifest returns the manifest of an archive
+func ReadManifest(path string) (*Manifest, error) {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid archive: %w", err)
+	}
+	defer archive.Close()
+	return readManifest(&archive.Reader)
+}
+
+func readManifest(archive *zip.Reader) (*Manifest, error) {
+	entry, err := archive.Open(ManifestEntry)
+	if err != nil {
+		return nil, ErrNoManifest
+	}
+	defer entry.Close()
+	var manifest Manifest
+	if err := json.NewDecoder(entry).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	if manifest.Format != FormatCustom && manifest.Format != FormatSQL {
+		return nil, fmt.Errorf("invalid manifest: unknown format %q", manifest.Format)
+	}
+	return &manifest, nil
+}
+
+// Restore creates the database name from an archive, using db to reach the
+// server. An existing database is never touched; a failed restore drops
+// the database it created.
+func Restore(ctx context.Context, db *gorm.DB, path, name string, op *operations.Operation) error {
+	if !ValidName(name) {
+		return ErrInvalidName
+	}
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return fmt.Errorf("invalid archive: %w", err)
+	}
+	defer archive.Close()
+	manifest, err := readManifest(&archive.Reader)
+	if err != nil {
+		return err
+	}
+	entryName := sqlEntry
+	if manifest.Format == FormatCustom {
+		entryName = customEntry
+	}
+	entry, err := archive.Open(entryName)
+	if err != nil {
+		return ErrNoDump
+	}
+	defer entry.Close()
+
+	var pgRestore string
+	if manifest.Format == FormatCustom {
+		if pgRestore, err = exec.LookPath("pg_restore"); err != nil {
+			return fmt.Errorf("pg_restore is required to restore a custom-format backup: %w", err)
+		}
+	}
+
+	exists, err := DatabaseExists(db, name)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrDatabaseExists
+	}
+	if err := db.Exec("CREATE DATABASE " + pgx.Identifier{name}.Sanitize()).Error; err != nil {
+		return fmt.Errorf("failed to create %s: %w", name, err)
+	}
+
+	if manifest.Format == FormatCustom {
+		err = runPgRestore(ctx, pgRestore, name, entry)
+	} else {
+		err = loadSQL(ctx, name, entry, op)
+	}
+	if err != nil {
+		if dropErr := db.Exec("DROP DATABASE IF EXISTS " + pgx.Identifier{name}.Sanitize()).Error; dropErr != nil {
+			return fmt.Errorf("%w (and failed to drop %s: %v)", err, name, dropErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// runPgRestore restores a custom-format dump read from r into a database
+func runPgRestore(ctx context.Context, pgRestore, name string, r io.Reader) error {
+	config, err := connectionConfig(name)
+	if err != nil {
+		return err
+	}
+	config.Database = name
+	conninfo, env := commandEnv(config)
+
+	var stderr strings.Builder
+	cmd := exec.CommandContext(ctx, pgRestore, "--no-owner", "--exit-on-error", "--dbname="+conninfo)
+	cmd.Env = env
+	cmd.Stdin = r
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("pg_restore failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
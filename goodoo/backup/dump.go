@@ -0,0 +1,277 @@
+package backup
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"goodoo/operations"
+)
+
+// The built-in dumper writes the tables of the public schema as plain SQL
+// that psql can also load: extensions, sequences, tables, their rows as
+// COPY blocks, sequence values, then constraints and indexes. Views,
+// functions and triggers are not dumped; install pg_dump for those.
+
+// dumpSQL writes a plain SQL dump of the public schema, reading it in a
+// single snapshot, and counts the tables as the operation's progress
+func dumpSQL(ctx context.Context, conn *pgx.Conn, w io.Writer, op *operations.Operation) error {
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	out := bufio.NewWriter(w)
+	fmt.Fprintln(out, "-- Goodoo plain SQL dump")
+	fmt.Fprintln(out, "SET client_encoding = 'UTF8';")
+	fmt.Fprintln(out, "SET standard_conforming_strings = on;")
+
+	extensions, err := queryStrings(ctx, tx, "SELECT extname FROM pg_extension WHERE extname <> 'plpgsql' ORDER BY extname")
+	if err != nil {
+		return err
+	}
+	for _, extension := range extensions {
+		fmt.Fprintf(out, "CREATE EXTENSION IF NOT EXISTS %s;\n", pgx.Identifier{extension}.Sanitize())
+	}
+
+	sequences, err := queryStrings(ctx, tx, `SELECT c.relname FROM pg_class c
+JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE c.relkind = 'S' AND n.nspname = 'public' ORDER BY c.relname`)
+	if err != nil {
+		return err
+	}
+	for _, sequence := range sequences {
+		fmt.Fprintf(out, "CREATE SEQUENCE %s;\n", pgx.Identifier{sequence}.Sanitize())
+	}
+
+	tables, err := queryStrings(ctx, tx, `SELECT table_name FROM information_schema.tables
+WHERE table_schema = 'public' AND table_type = 'BASE TABLE' ORDER BY table_name`)
+	if err != nil {
+		return err
+	}
+	op.SetTotal(len(tables))
+	for _, table := range tables {
+		if err := dumpTableSchema(ctx, tx, out, table); err != nil {
+			return fmt.Errorf("table %s: %w", table, err)
+		}
+	}
+
+	ownerships, err := tx.Query(ctx, `SELECT s.relname, t.relname, a.attname FROM pg_depend d
+JOIN pg_class s ON s.oid = d.objid AND s.relkind = 'S'
+JOIN pg_namespace n ON n.oid = s.relnamespace AND n.nspname = 'public'
+JOIN pg_class t ON t.oid = d.refobjid
+JOIN pg_attribute a ON a.attrelid = t.oid AND a.attnum = d.refobjsubid
+WHERE d.deptype = 'a' ORDER BY s.relname`)
+	if err != nil {
+		return err
+	}
+	for ownerships.Next() {
+		var sequence, table, column string
+		if err := ownerships.Scan(&sequence, &table, &column); err != nil {
+			ownerships.Close()
+			return err
+		}
+		fmt.Fprintf(out, "ALTER SEQUENCE %s OWNED BY %s.%s;\n",
+			pgx.Identifier{sequence}.Sanitize(), pgx.Identifier{table}.Sanitize(), pgx.Identifier{column}.Sanitize())
+	}
+	ownerships.Close()
+	if err := ownerships.Err(); err != nil {
+		return err
+	}
+
+	for _, table := range tables {
+		if op.Cancelled() {
+			return ctx.Err()
+		}
+		identifier := pgx.Identifier{table}.Sanitize()
+		fmt.Fprintf(out, "\nCOPY %s FROM stdin;\n", identifier)
+		if err := out.Flush(); err != nil {
+			return err
+		}
+		if _, err := tx.Conn().PgConn().CopyTo(ctx, out, "COPY "+identifier+" TO STDOUT"); err != nil {
+			return fmt.Errorf("table %s: %w", table, err)
+		}
+		fmt.Fprintln(out, `\.`)
+		op.Progress(1, 0, nil)
+	}
+	fmt.Fprintln(out)
+
+	for _, sequence := range sequences {
+		var last int64
+		var called bool
+		identifier := pgx.Identifier{sequence}.Sanitize()
+		if err := tx.QueryRow(ctx, "SELECT last_value, is_called FROM "+identifier).Scan(&last, &called); err != nil {
+			return fmt.Errorf("sequence %s: %w", sequence, err)
+		}
+		fmt.Fprintf(out, "SELECT pg_catalog.setval('%s', %d, %t);\n", strings.ReplaceAll(identifier, "'", "''"), last, called)
+	}
+
+	constraints, err := tx.Query(ctx, `SELECT conrelid::regclass::text, conname, pg_get_constraintdef(oid) FROM pg_constraint
+WHERE connamespace = 'public'::regnamespace AND contype IN ('p', 'u', 'c', 'f', 'x') AND conrelid <> 0
+ORDER BY contype = 'f', conrelid::regclass::text, conname`)
+	if err != nil {
+		return err
+	}
+	for constraints.Next() {
+		var table, name, definition string
+		if err := constraints.Scan(&table, &name, &definition); err != nil {
+			constraints.Close()
+			return err
+		}
+		fmt.Fprintf(out, "ALTER TABLE ONLY %s ADD CONSTRAINT %s %s;\n", table, pgx.Identifier{name}.Sanitize(), definition)
+	}
+	constraints.Close()
+	if err := constraints.Err(); err != nil {
+		return err
+	}
+
+	indexes, err := queryStrings(ctx, tx, `SELECT pg_get_indexdef(i.indexrelid) FROM pg_index i
+JOIN pg_class c ON c.oid = i.indexrelid
+JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE n.nspname = 'public' AND NOT EXISTS (SELECT 1 FROM pg_constraint con WHERE con.conindid = i.indexrelid)
+ORDER BY c.relname`)
+	if err != nil {
+		return err
+	}
+	for _, index := range indexes {
+		fmt.Fprintf(out, "%s;\n", index)
+	}
+	return out.Flush()
+}
+
+// dumpTableSchema writes the CREATE TABLE statement of a table, without
+// its constraints
+func dumpTableSchema(ctx context.Context, tx pgx.Tx, out io.Writer, table string) error {
+	rows, err := tx.Query(ctx, `SELECT a.attname, format_type(a.atttypid, a.atttypmod), a.attnotnull,
+	COALESCE(pg_get_expr(d.adbin, d.adrelid), '')
+FROM pg_attribute a
+LEFT JOIN pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+WHERE a.attrelid = $1::regclass AND a.attnum > 0 AND NOT a.attisdropped
+ORDER BY a.attnum`, pgx.Identifier{"public", table}.Sanitize())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var name, columnType, defaultValue string
+		var notNull bool
+		if err := rows.Scan(&name, &columnType, &notNull, &defaultValue); err != nil {
+			return err
+		}
+		column := pgx.Identifier{name}.Sanitize() + " " + columnType
+		if defaultValue != "" {
+			column += " DEFAULT " + defaultValue
+		}
+		if notNull {
+			column += " NOT NULL"
+		}
+		columns = append(columns, "    "+column)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "\nCREATE TABLE %s (\n%s\n);\n", pgx.Identifier{table}.Sanitize(), strings.Join(columns, ",\n"))
+	return err
+}
+
+// queryStrings returns the first column of a query
+func queryStrings(ctx context.Context, tx pgx.Tx, sql string) ([]string, error) {
+	rows, err := tx.Query(ctx, sql)
+	if err != nil {
+		return nil, err
+	}
+	values, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	return values, err
+}
+
+// loadSQL loads a plain SQL dump into a database in a single transaction.
+// It understands the dumps of the built-in dumper: statements ending a
+// line with ";" and COPY ... FROM stdin blocks ended by "\.".
+func loadSQL(ctx context.Context, name string, r io.Reader, op *operations.Operation) error {
+	conn, err := connect(ctx, name)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", name, err)
+	}
+	defer conn.Close(context.Background())
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	in := bufio.NewReaderSize(r, 1<<20)
+	var statement strings.Builder
+	for {
+		line, readErr := in.ReadString('\n')
+		if readErr != nil && readErr != io.EOF {
+			return readErr
+		}
+		trimmed := strings.TrimRight(line, "\r\n")
+
+		switch {
+		case statement.Len() == 0 && (trimmed == "" || strings.HasPrefix(trimmed, "--")):
+		case statement.Len() == 0 && strings.HasPrefix(trimmed, "COPY ") && strings.HasSuffix(trimmed, " FROM stdin;"):
+			if op.Cancelled() {
+				return ctx.Err()
+			}
+			copyIn, copyOut := io.Pipe()
+			go func() {
+				copyOut.CloseWithError(copyBlock(in, copyOut))
+			}()
+			command := strings.TrimSuffix(trimmed, " FROM stdin;") + " FROM STDIN"
+			if _, err := tx.Conn().PgConn().CopyFrom(ctx, copyIn, command); err != nil {
+				copyIn.CloseWithError(err)
+				return fmt.Errorf("%s: %w", command, err)
+			}
+			op.Progress(1, 0, nil)
+		default:
+			statement.WriteString(line)
+			if strings.HasSuffix(trimmed, ";") {
+				if _, err := tx.Exec(ctx, statement.String()); err != nil {
+					return fmt.Errorf("%s: %w", firstLine(statement.String()), err)
+				}
+				statement.Reset()
+			}
+		}
+
+		if readErr == io.EOF {
+			break
+		}
+	}
+	if statement.Len() > 0 {
+		return fmt.Errorf("dump ends in the middle of a statement: %s", firstLine(statement.String()))
+	}
+	return tx.Commit(ctx)
+}
+
+// copyBlock copies the rows of a COPY block to w, up to its "\." line
+func copyBlock(in *bufio.Reader, w io.Writer) error {
+	for {
+		line, err := in.ReadString('\n')
+		if strings.TrimRight(line, "\r\n") == `\.` {
+			return nil
+		}
+		if _, writeErr := io.WriteString(w, line); writeErr != nil {
+			return writeErr
+		}
+		if err == io.EOF {
+			return fmt.Errorf("COPY block is not terminated")
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// firstLine returns the first line of a statement for error messages
+func firstLine(statement string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(statement), "\n")
+	return line
+}
@@ -0,0 +1,111 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"goodoo/logging"
+	"goodoo/operations"
+	"goodoo/scheduler"
+)
+
+// Schedule registers the job backing up a database into the backup
+// directory every configured interval; it does nothing when automatic
+// backups are disabled
+func Schedule(s *scheduler.Scheduler, dbName string) {
+	c := CurrentConfig()
+	if c.Interval <= 0 {
+		return
+	}
+	logger := logging.GetLogger("goodoo.backup")
+	s.Every("backup.auto."+dbName, c.Interval, func(ctx context.Context) error {
+		var path string
+		var err error
+		operations.Start("backup", "", dbName, 0, 0, func(ctx context.Context, op *operations.Operation) error {
+			path, err = WriteFile(ctx, dbName, op)
+			return err
+		}).Wait()
+		if err != nil {
+			return err
+		}
+		logger.Info("Backed up %s to %s", dbName, path)
+
+		removed, err := Prune(dbName)
+		if removed > 0 {
+			logger.Info("Removed %d old backup(s) of %s", removed, dbName)
+		}
+		return err
+	})
+}
+
+// WriteFile writes an archive of a database into the backup directory and
+// returns its path. The archive is written under a temporary name, so an
+// interrupted backup never looks complete.
+func WriteFile(ctx context.Context, dbName string, op *operations.Operation) (string, error) {
+	c := CurrentConfig()
+	if err := os.MkdirAll(c.Dir, 0o750); err != nil {
+		return "", err
+	}
+	path := filepath.Join(c.Dir, FileName(dbName, time.Now()))
+	file, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return "", err
+	}
+	_, err = Write(ctx, dbName, c.Format, file, op)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return "", err
+	}
+	return path, nil
+}
+
+// Prune removes the automatic backups of a database beyond the configured
+// count or age, newest first, and returns how many it removed
+func Prune(dbName string) (int, error) {
+	c := CurrentConfig()
+	paths, err := filepath.Glob(filepath.Join(c.Dir, dbName+"_*.zip"))
+	if err != nil {
+		return 0, err
+	}
+
+	type backupFile struct {
+		path    string
+		modTime time.Time
+	}
+	var files []backupFile
+	for _, path := range paths {
+		// The glob also matches databases whose name extends this one
+		if len(filepath.Base(path)) != len(FileName(dbName, time.Time{})) {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		files = append(files, backupFile{path: path, modTime: info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.After(files[j].modTime) })
+
+	removed := 0
+	for i, file := range files {
+		tooMany := c.KeepCount > 0 && i >= c.KeepCount
+		tooOld := c.KeepAge > 0 && time.Since(file.modTime) > c.KeepAge
+		if !tooMany && !tooOld {
+			continue
+		}
+		if err := os.Remove(file.path); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
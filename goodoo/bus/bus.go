@@ -0,0 +1,169 @@
+// Package bus delivers notifications between the components of the process
+// (like Odoo's bus.bus): publishers post messages on a channel of a
+// database, and the subscribers of that channel receive them. Connection
+// managers subscribe to forward messages to their clients.
+package bus
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Retention bounds the messages kept per channel for the subscribers
+// resuming after a reconnection (see SubscribeFrom)
+const (
+	RetentionPeriod = 5 * time.Minute
+	RetentionSize   = 1000
+)
+
+// Message is a notification published on a channel of a database
+type Message struct {
+	// ID orders the messages published by the process, from 1
+	ID      uint64      `json:"id"`
+	DB      string      `json:"db"`
+	Channel string      `json:"channel"`
+	Payload interface{} `json:"payload"`
+	time    time.Time
+}
+
+type subscriber struct {
+	id uint64
+	fn func(Message)
+}
+
+// history holds the messages retained on a channel; evicted is the ID of
+// the last message dropped from it
+type history struct {
+	messages []Message
+	evicted  uint64
+}
+
+var (
+	subscribers   = make(map[string][]subscriber)
+	histories     = make(map[string]*history)
+	nextID        uint64
+	nextMessageID uint64
+	mutex         sync.RWMutex
+)
+
+// epoch tells the message IDs of this process from those of the previous
+// ones, which cannot be resumed
+var epoch = strconv.FormatInt(time.Now().UnixMilli(), 36)
+
+// EventID returns the identifier of a message for clients, like the id of
+// server-sent events
+func EventID(id uint64) string {
+	return fmt.Sprintf("%s-%d", epoch, id)
+}
+
+// ParseEventID returns the message ID of an identifier returned by
+// EventID; ok is false when the identifier is invalid or was issued by
+// another process
+func ParseEventID(value string) (id uint64, ok bool) {
+	prefix, number, found := strings.Cut(value, "-")
+	if !found || prefix != epoch {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(number, 10, 64)
+	return id, err == nil
+}
+
+// Subscribe calls fn with every message published on channel until the
+// returned function is called. fn runs on the publisher's goroutine and
+// must not block.
+func Subscribe(channel string, fn func(Message)) (unsubscribe func()) {
+	mutex.Lock()
+	nextID++
+	id := nextID
+	subscribers[channel] = append(subscribers[channel], subscriber{id: id, fn: fn})
+	mutex.Unlock()
+
+	return unsubscriber(channel, id)
+}
+
+// unsubscriber returns the function removing the subscriber id of channel
+func unsubscriber(channel string, id uint64) func() {
+	return func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+		list := subscribers[channel]
+		for i, s := range list {
+			if s.id == id {
+				subscribers[channel] = append(list[:i:i], list[i+1:]...)
+				break
+			}
+		}
+		if len(subscribers[channel]) == 0 {
+			delete(subscribers, channel)
+		}
+	}
+}
+
+// SubscribeFrom is Subscribe for a client resuming after the message
+// after: it also returns the retained messages of channel published
+// since, which the client handles before those fn receives. complete is
+// false when some of them are no longer retained, or after was issued by
+// another process; the client must then reload its state. after 0
+// subscribes from now on.
+func SubscribeFrom(channel string, after uint64, fn func(Message)) (missed []Message, unsubscribe func(), complete bool) {
+	mutex.Lock()
+	complete = after <= nextMessageID
+	if h := histories[channel]; after > 0 && h != nil {
+		prune(h, time.Now())
+		complete = complete && after >= h.evicted
+		for _, message := range h.messages {
+			if message.ID > after {
+				missed = append(missed, message)
+			}
+		}
+	}
+	// Registering under the same lock as the copy, no message is both
+	// missed and received, nor neither
+	nextID++
+	id := nextID
+	subscribers[channel] = append(subscribers[channel], subscriber{id: id, fn: fn})
+	mutex.Unlock()
+
+	return missed, unsubscriber(channel, id), complete
+}
+
+// prune drops the messages of h older than RetentionPeriod
+func prune(h *history, now time.Time) {
+	i := 0
+	for i < len(h.messages) && now.Sub(h.messages[i].time) > RetentionPeriod {
+		i++
+	}
+	if i > 0 {
+		h.evicted = h.messages[i-1].ID
+		h.messages = append(h.messages[:0], h.messages[i:]...)
+	}
+}
+
+// Publish delivers a message to the subscribers of its channel and retains
+// it for those resuming
+func Publish(dbName, channel string, payload interface{}) {
+	now := time.Now()
+	mutex.Lock()
+	nextMessageID++
+	message := Message{ID: nextMessageID, DB: dbName, Channel: channel, Payload: payload, time: now}
+	h := histories[channel]
+	if h == nil {
+		h = &history{}
+		histories[channel] = h
+	}
+	prune(h, now)
+	if len(h.messages) >= RetentionSize {
+		h.evicted = h.messages[0].ID
+		h.messages = append(h.messages[:0], h.messages[1:]...)
+	}
+	h.messages = append(h.messages, message)
+	list := subscribers[channel]
+	mutex.Unlock()
+
+	for _, s := range list {
+		s.fn(message)
+	}
+}
@@ -0,0 +1,125 @@
+package bus_test
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"goodoo/bus"
+)
+
+var channelSequence int
+
+// newChannel returns a channel no other test publishes on
+func newChannel(t *testing.T) string {
+	channelSequence++
+	return fmt.Sprintf("%s_%d", t.Name(), channelSequence)
+}
+
+// publish publishes payloads on channel and returns their message IDs
+func publish(t *testing.T, channel string, payloads ...interface{}) []uint64 {
+	var ids []uint64
+	unsubscribe := bus.Subscribe(channel, func(message bus.Message) {
+		ids = append(ids, message.ID)
+	})
+	defer unsubscribe()
+	for _, payload := range payloads {
+		bus.Publish("bus_test", channel, payload)
+	}
+	if len(ids) != len(payloads) {
+		t.Fatalf("received %d of %d messages published", len(ids), len(payloads))
+	}
+	return ids
+}
+
+// payloads returns the payloads of messages
+func payloads(messages []bus.Message) []interface{} {
+	var list []interface{}
+	for _, message := range messages {
+		list = append(list, message.Payload)
+	}
+	return list
+}
+
+func TestEventID(t *testing.T) {
+	for _, id := range []uint64{1, 42, 1 << 40} {
+		if parsed, ok := bus.ParseEventID(bus.EventID(id)); !ok || parsed != id {
+			t.Errorf("ParseEventID(EventID(%d)) = %d, %v", id, parsed, ok)
+		}
+	}
+	// An identifier of another process, or not one at all
+	for _, value := range []string{"", "42", "0-42", "-42", bus.EventID(42) + "x", bus.EventID(1)[:3]} {
+		if id, ok := bus.ParseEventID(value); ok {
+			t.Errorf("ParseEventID(%q) = %d, want it rejected", value, id)
+		}
+	}
+}
+
+// TestSubscribeFromReplay resumes after a message: the retained ones
+// published since are returned, then the new ones delivered, each once
+func TestSubscribeFromReplay(t *testing.T) {
+	channel := newChannel(t)
+	ids := publish(t, channel, "a", "b", "c")
+	bus.Publish("bus_test", newChannel(t), "elsewhere")
+
+	var received []bus.Message
+	missed, unsubscribe, complete := bus.SubscribeFrom(channel, ids[0], func(message bus.Message) {
+		received = append(received, message)
+	})
+	if !complete || !slices.Equal(payloads(missed), []interface{}{"b", "c"}) {
+		t.Errorf("SubscribeFrom the first message = %v, complete %v; want b and c, complete", payloads(missed), complete)
+	}
+	for i, message := range missed {
+		if message.ID != ids[i+1] || message.Channel != channel || message.DB != "bus_test" {
+			t.Errorf("missed message %d = %+v, want id %d", i, message, ids[i+1])
+		}
+	}
+	bus.Publish("bus_test", channel, "d")
+	unsubscribe()
+	bus.Publish("bus_test", channel, "e")
+	if !slices.Equal(payloads(received), []interface{}{"d"}) {
+		t.Fatalf("received %v, want d only", payloads(received))
+	}
+
+	missed, unsubscribe, complete = bus.SubscribeFrom(channel, received[0].ID, func(bus.Message) {})
+	unsubscribe()
+	if !complete || !slices.Equal(payloads(missed), []interface{}{"e"}) {
+		t.Errorf("SubscribeFrom d = %v, complete %v; want e", payloads(missed), complete)
+	}
+	missed, unsubscribe, complete = bus.SubscribeFrom(channel, 0, func(bus.Message) {})
+	unsubscribe()
+	if !complete || len(missed) != 0 {
+		t.Errorf("SubscribeFrom(0) = %v, complete %v; want nothing to replay", payloads(missed), complete)
+	}
+}
+
+// TestSubscribeFromEvicted resumes after messages no longer retained
+func TestSubscribeFromEvicted(t *testing.T) {
+	channel := newChannel(t)
+	values := make([]interface{}, bus.RetentionSize+2)
+	for i := range values {
+		values[i] = i
+	}
+	ids := publish(t, channel, values...)
+
+	missed, unsubscribe, complete := bus.SubscribeFrom(channel, ids[0], func(bus.Message) {})
+	unsubscribe()
+	if complete || len(missed) != bus.RetentionSize || missed[0].ID != ids[2] {
+		t.Errorf("SubscribeFrom an evicted message: %d missed, complete %v; want the %d retained, incomplete",
+			len(missed), complete, bus.RetentionSize)
+	}
+	// Resuming after the last message evicted misses nothing
+	missed, unsubscribe, complete = bus.SubscribeFrom(channel, ids[1], func(bus.Message) {})
+	unsubscribe()
+	if !complete || len(missed) != bus.RetentionSize {
+		t.Errorf("SubscribeFrom the last message evicted: %d missed, complete %v; want %d, complete",
+			len(missed), complete, bus.RetentionSize)
+	}
+
+	// A message this process did not publish yet comes from another one
+	missed, unsubscribe, complete = bus.SubscribeFrom(channel, ids[len(ids)-1]+1000, func(bus.Message) {})
+	unsubscribe()
+	if complete || len(missed) != 0 {
+		t.Errorf("SubscribeFrom a future message: %d missed, complete %v; want incomplete", len(missed), complete)
+	}
+}
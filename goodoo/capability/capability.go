@@ -0,0 +1,196 @@
+// Package capability records what the running server can actually do: each
+// subsystem reports its optional features (pgvector, trigram search, TLS,
+// single sign-on, addons...) as enabled, disabled or degraded with the
+// reason, at startup and whenever their state changes at runtime. The
+// report is logged once the server is set up and served to administrators;
+// changes are published on the bus.
+package capability
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"goodoo/bus"
+	"goodoo/logging"
+)
+
+// Channel is the bus channel of capability changes; payloads are Event
+// values, published without database
+const Channel = "capability"
+
+// State is whether a capability is available
+type State string
+
+// States of a capability
+const (
+	Enabled  State = "enabled"
+	Disabled State = "disabled"
+	// Degraded capabilities are configured but currently unavailable, or
+	// running on a fallback
+	Degraded State = "degraded"
+)
+
+// Capability is the state of a feature and the reason for it, e.g. the
+// missing extension or the setting turning it off
+type Capability struct {
+	Name   string `json:"name"`
+	State  State  `json:"state"`
+	Reason string `json:"reason,omitempty"`
+	// Public capabilities are listed by the health endpoint, without reason
+	Public bool      `json:"public"`
+	Since  time.Time `json:"since"`
+}
+
+// Event is published on Channel when a capability changes state; Previous
+// is empty for a capability reported for the first time
+type Event struct {
+	Capability
+	Previous State `json:"previous,omitempty"`
+}
+
+var (
+	capabilities = make(map[string]*Capability)
+	// summarized is set once the startup summary is logged; later changes
+	// are logged one by one
+	summarized bool
+	mutex      sync.RWMutex
+	logger     = logging.GetLogger("goodoo.capability")
+)
+
+// Set records the state of a capability and reports whether it changed.
+// A change of state is published on the bus; a new reason alone is only
+// recorded.
+func Set(name string, state State, reason string) bool {
+	mutex.Lock()
+	current, exists := capabilities[name]
+	if exists && current.State == state {
+		current.Reason = reason
+		mutex.Unlock()
+		return false
+	}
+	event := Event{Capability: Capability{Name: name, State: state, Reason: reason, Since: time.Now().UTC()}}
+	if exists {
+		event.Previous = current.State
+		event.Public = current.Public
+	}
+	capability := event.Capability
+	capabilities[name] = &capability
+	logChange := summarized && event.Previous != ""
+	mutex.Unlock()
+
+	if logChange {
+		if state == Enabled {
+			logger.Info("Capability %s is %s again: %s", name, state, reason)
+		} else {
+			logger.Warning("Capability %s is %s: %s", name, state, reason)
+		}
+	}
+	bus.Publish("", Channel, event)
+	return true
+}
+
+// Enable records that a capability is available
+func Enable(name, reason string) bool {
+	return Set(name, Enabled, reason)
+}
+
+// Disable records that a capability is turned off or missing
+func Disable(name, reason string) bool {
+	return Set(name, Disabled, reason)
+}
+
+// Degrade records that a capability is configured but unavailable, or
+// running on a fallback
+func Degrade(name, reason string) bool {
+	return Set(name, Degraded, reason)
+}
+
+// MarkPublic lists capabilities in the health endpoint; it applies to
+// capabilities reported before or after the call
+func MarkPublic(names ...string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, name := range names {
+		if current, exists := capabilities[name]; exists {
+			current.Public = true
+			continue
+		}
+		capabilities[name] = &Capability{Name: name, Public: true}
+	}
+}
+
+// Get returns the state of a capability
+func Get(name string) (Capability, bool) {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	current, exists := capabilities[name]
+	if !exists || current.State == "" {
+		return Capability{}, false
+	}
+	return *current, true
+}
+
+// Report returns the capabilities by name
+func Report() []Capability {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	report := make([]Capability, 0, len(capabilities))
+	for _, current := range capabilities {
+		// Marked public but never reported
+		if current.State == "" {
+			continue
+		}
+		report = append(report, *current)
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].Name < report[j].Name })
+	return report
+}
+
+// PublicStates returns the state of the public capabilities by name
+func PublicStates() map[string]State {
+	states := make(map[string]State)
+	for _, current := range Report() {
+		if current.Public {
+			states[current.Name] = current.State
+		}
+	}
+	return states
+}
+
+// Subscribe calls fn with every capability change until the returned
+// function is called. fn runs on the goroutine of the change and must not
+// block.
+func Subscribe(fn func(Event)) (unsubscribe func()) {
+	return bus.Subscribe(Channel, func(message bus.Message) {
+		if event, ok := message.Payload.(Event); ok {
+			fn(event)
+		}
+	})
+}
+
+// LogSummary writes the report as one structured startup summary, then
+// has each later change logged
+func LogSummary(log *logging.Logger) {
+	report := Report()
+	width := 0
+	for _, current := range report {
+		width = max(width, len(current.Name))
+	}
+	lines := make([]string, len(report))
+	counts := make(map[State]int)
+	for i, current := range report {
+		counts[current.State]++
+		lines[i] = "  " + current.Name + strings.Repeat(" ", width-len(current.Name)) + "  " + string(current.State)
+		if current.Reason != "" {
+			lines[i] += " (" + current.Reason + ")"
+		}
+	}
+	log.Info("Capabilities: %d enabled, %d disabled, %d degraded\n%s",
+		counts[Enabled], counts[Disabled], counts[Degraded], strings.Join(lines, "\n"))
+
+	mutex.Lock()
+	summarized = true
+	mutex.Unlock()
+}
@@ -0,0 +1,213 @@
+// Package chat stores the LLM chat sessions: their messages, the titles
+// generated in the background after the first exchange, and the search
+// over titles and message contents.
+package chat
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"goodoo/database"
+	"goodoo/logging"
+	"goodoo/models"
+	"goodoo/scheduler"
+	"goodoo/tasks"
+	"gorm.io/gorm"
+)
+
+var logger = logging.GetLogger("goodoo.chat")
+
+// Title generation settings
+const (
+	TitleWords     = 5
+	TitleBatchSize = 20
+	DefaultTitle   = "New chat"
+)
+
+// FallbackTitle derives a title from the first words of a message, used
+// when no LLM provider is available or it fails
+func FallbackTitle(message string) string {
+	words := strings.FieldsFunc(message, func(r rune) bool {
+		return unicode.IsSpace(r) || (unicode.IsPunct(r) && r != '\'' && r != '-')
+	})
+	if len(words) == 0 {
+		return DefaultTitle
+	}
+	if len(words) > TitleWords {
+		words = words[:TitleWords]
+	}
+	title := []rune(strings.Join(words, " "))
+	title[0] = unicode.ToUpper(title[0])
+	return string(title)
+}
+
+// cleanTitle normalizes a generated title: one line, without quotes or a
+// final period, at most TitleWords words
+func cleanTitle(title string) string {
+	if line, _, found := strings.Cut(strings.TrimSpace(title), "\n"); found {
+		title = line
+	}
+	title = strings.Trim(title, " \t\"'`*.")
+	title = strings.TrimPrefix(title, "Title: ")
+	words := strings.Fields(title)
+	if len(words) > TitleWords {
+		words = words[:TitleWords]
+	}
+	return strings.Join(words, " ")
+}
+
+// firstExchange returns the first user message of a session and the
+// answer to it, if any
+func firstExchange(db *gorm.DB, sessionID string) (question, answer string, err error) {
+	var messages []models.ChatMessage
+	err = db.Where("session_id = ?", sessionID).Order("create_date, id").Limit(2).Find(&messages).Error
+	if err != nil {
+		return "", "", err
+	}
+	for _, message := range messages {
+		switch {
+		case message.Role == models.ChatRoleUser && question == "":
+			question = message.Content
+		case message.Role == models.ChatRoleAssistant && question != "":
+			answer = message.Content
+		}
+	}
+	return question, answer, nil
+}
+
+// GenerateTitles titles the sessions waiting for it and returns how many
+// were titled. A title chosen by the user in the meantime is kept.
+func GenerateTitles(ctx context.Context, db *gorm.DB, dbName string) (int, error) {
+	var sessions []models.ChatSession
+	err := db.Where("title_pending AND NOT title_manual").Order("write_date").Limit(TitleBatchSize).Find(&sessions).Error
+	if err != nil {
+		return 0, err
+	}
+
+	titler := TitlerForDB(db, dbName)
+	titled := 0
+	for _, session := range sessions {
+		question, answer, err := firstExchange(db, session.ID)
+		if err != nil {
+			return titled, err
+		}
+
+		title := ""
+		if titler != nil && question != "" {
+			generated, err := titler.Title(ctx, question, answer)
+			if err != nil {
+				logger.Warning("Failed to generate the title of chat session %s: %v", session.ID, err)
+			}
+			title = cleanTitle(generated)
+		}
+		if title == "" {
+			title = FallbackTitle(question)
+		}
+
+		result := db.Model(&models.ChatSession{}).
+			Where("id = ? AND NOT title_manual", session.ID).
+			UpdateColumns(map[string]interface{}{"title": title, "title_pending": false})
+		if result.Error != nil {
+			return titled, result.Error
+		}
+		titled += int(result.RowsAffected)
+	}
+	return titled, nil
+}
+
+// ScheduleTitles registers the job titling the sessions of a database
+func ScheduleTitles(s *scheduler.Scheduler, dbName string, interval time.Duration) {
+	s.Every("chat.titles."+dbName, interval, func(ctx context.Context) error {
+		db, err := database.GetDatabase(dbName)
+		if err != nil {
+			return err
+		}
+		_, err = GenerateTitles(ctx, db.WithContext(ctx), dbName)
+		return err
+	})
+}
+
+// TitleTask is the task titling the sessions of a database right after an
+// exchange, ahead of the scheduled job; one runs at a time per database
+const TitleTask = "chat.titles"
+
+func init() {
+	tasks.Define(TitleTask, tasks.Definition{Concurrency: 2})
+}
+
+// TitleSoon titles the pending sessions of the database of the request
+// in the background. The scheduled job remains the fallback, e.g. for a
+// session flagged while a run was already going.
+func TitleSoon(ctx context.Context) {
+	dbName := tasks.DBName(ctx)
+	_, err := tasks.SubmitKeyed(ctx, TitleTask, dbName, nil, func(ctx context.Context) error {
+		db, err := database.GetDatabase(dbName)
+		if err != nil {
+			return err
+		}
+		_, err = GenerateTitles(ctx, db.WithContext(ctx), dbName)
+		return err
+	})
+	if err != nil && !errors.Is(err, tasks.ErrDuplicate) {
+		logger.Warning("Failed to submit the titling of the chat sessions of %s: %v", dbName, err)
+	}
+}
+
+// trigramSupport remembers per database whether chat_message has a
+// trigram index on its content
+var trigramSupport sync.Map
+
+// EnsureSearchIndex indexes the message contents for search: with a
+// trigram index when the pg_trgm extension can be used, which serves
+// ILIKE, and otherwise with a full-text index. It reports whether the
+// trigram index exists.
+func EnsureSearchIndex(db *gorm.DB) (bool, error) {
+	var installed int64
+	if err := db.Raw("SELECT COUNT(*) FROM pg_extension WHERE extname = 'pg_trgm'").Scan(&installed).Error; err != nil {
+		return false, err
+	}
+	if installed == 0 && db.Exec("CREATE EXTENSION IF NOT EXISTS pg_trgm").Error == nil {
+		installed = 1
+	}
+	if installed > 0 {
+		err := db.Exec("CREATE INDEX IF NOT EXISTS chat_message_content_trgm ON chat_message USING gin (content gin_trgm_ops)").Error
+		return err == nil, err
+	}
+	err := db.Exec("CREATE INDEX IF NOT EXISTS chat_message_content_fts ON chat_message USING gin (to_tsvector('simple', content))").Error
+	return false, err
+}
+
+// hasTrigramIndex reports whether message contents are searched with
+// ILIKE, checking once per database
+func hasTrigramIndex(db *gorm.DB, dbName string) bool {
+	if cached, ok := trigramSupport.Load(dbName); ok {
+		return cached.(bool)
+	}
+	supported, err := EnsureSearchIndex(db)
+	if err != nil {
+		return false
+	}
+	trigramSupport.Store(dbName, supported)
+	return supported
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
+}
+
+// Search restricts a query on chat_session to the sessions whose title or
+// one of whose messages contains q. Without a trigram index, messages
+// match on whole words through the full-text index.
+func Search(query *gorm.DB, db *gorm.DB, dbName string, q string) *gorm.DB {
+	pattern := "%" + escapeLike(q) + "%"
+	messages := "SELECT 1 FROM chat_message WHERE chat_message.session_id = chat_session.id AND "
+	if hasTrigramIndex(db, dbName) {
+		return query.Where("chat_session.title ILIKE ? OR EXISTS ("+messages+"chat_message.content ILIKE ?)", pattern, pattern)
+	}
+	return query.Where("chat_session.title ILIKE ? OR EXISTS ("+messages+"to_tsvector('simple', chat_message.content) @@ plainto_tsquery('simple', ?))", pattern, q)
+}
@@ -0,0 +1,113 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"goodoo/httpclient"
+	"goodoo/models"
+	"gorm.io/gorm"
+)
+
+// Titler asks an LLM for the title of a conversation
+type Titler interface {
+	Title(ctx context.Context, question, answer string) (string, error)
+}
+
+// TitlerForDB returns a titler calling the first active chat model of an
+// active provider with an API base, or nil when there is none
+func TitlerForDB(db *gorm.DB, dbName string) Titler {
+	catalog, err := models.LoadLLMCatalog(db, dbName)
+	if err != nil {
+		logger.Warning("Failed to load the LLM providers of %s: %v", dbName, err)
+		return nil
+	}
+	for _, provider := range catalog.Providers {
+		if !provider.Active || provider.APIBase == "" {
+			continue
+		}
+		for _, model := range provider.Models {
+			if model.Active && model.Type == "chat" {
+				return &OpenAITitler{
+					APIBase: provider.APIBase,
+					APIKey:  string(provider.APIKey),
+					Model:   model.ModelName,
+					Client:  httpclient.Client(httpclient.PurposeLLM),
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// titlePrompt asks for the title of a conversation
+const titlePrompt = "Write a title of at most %d words for the conversation below. " +
+	"Answer with the title only, without quotes.\n\nUser: %s\n\nAssistant: %s"
+
+// OpenAITitler calls an OpenAI-compatible /chat/completions endpoint
+type OpenAITitler struct {
+	APIBase string
+	APIKey  string
+	Model   string
+	Client  *http.Client
+}
+
+// truncate shortens the messages of the prompt
+func truncate(text string, max int) string {
+	runes := []rune(text)
+	if len(runes) <= max {
+		return text
+	}
+	return string(runes[:max])
+}
+
+func (t *OpenAITitler) Title(ctx context.Context, question, answer string) (string, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"model": t.Model,
+		"messages": []map[string]string{
+			{"role": "user", "content": fmt.Sprintf(titlePrompt, TitleWords, truncate(question, 2000), truncate(answer, 2000))},
+		},
+		"max_tokens":  24,
+		"temperature": 0.2,
+	})
+	if err != nil {
+		return "", err
+	}
+	// Generating a title has no side effect, so failed calls are retried
+	request, err := http.NewRequestWithContext(httpclient.WithIdempotent(ctx), http.MethodPost, strings.TrimRight(t.APIBase, "/")+"/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if t.APIKey != "" {
+		request.Header.Set("Authorization", "Bearer "+t.APIKey)
+	}
+
+	response, err := t.Client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		return "", fmt.Errorf("LLM provider answered %d", response.StatusCode)
+	}
+
+	var decoded struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&decoded); err != nil {
+		return "", fmt.Errorf("invalid completion response: %w", err)
+	}
+	if len(decoded.Choices) == 0 {
+		return "", fmt.Errorf("completion response has no choices")
+	}
+	return decoded.Choices[0].Message.Content, nil
+}
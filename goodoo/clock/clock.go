@@ -0,0 +1,177 @@
+// Package clock abstracts the wall clock so that code depending on time
+// (session expiry, rate limit windows, scheduled jobs) can be driven by a
+// Fake clock instead of sleeping.
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock tells the time and creates timers and tickers
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer fires once on C after its duration, like time.Timer
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// Ticker fires on C at every interval, like time.Ticker
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+	Reset(d time.Duration)
+}
+
+// Real is the clock of the system
+var Real Clock = realClock{}
+
+// OrReal returns c, or Real when c is nil
+func OrReal(c Clock) Clock {
+	if c == nil {
+		return Real
+	}
+	return c
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTimer(d time.Duration) Timer { return realTimer{time.NewTimer(d)} }
+
+func (realClock) NewTicker(d time.Duration) Ticker { return realTicker{time.NewTicker(d)} }
+
+type realTimer struct{ *time.Timer }
+
+func (t realTimer) C() <-chan time.Time { return t.Timer.C }
+
+type realTicker struct{ *time.Ticker }
+
+func (t realTicker) C() <-chan time.Time { return t.Ticker.C }
+
+// Fake is a clock that only moves when told to. Advance fires the timers
+// and tickers that fall due, in order, before returning.
+type Fake struct {
+	mutex   sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+// NewFake returns a fake clock set to now
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+// Now returns the time of the clock
+func (f *Fake) Now() time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.now
+}
+
+// Advance moves the clock forward by d, firing the timers and tickers due
+// on the way; a ticker fires once per interval elapsed, as long as its
+// channel has room
+func (f *Fake) Advance(d time.Duration) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	end := f.now.Add(d)
+	for {
+		sort.SliceStable(f.waiters, func(i, j int) bool { return f.waiters[i].when.Before(f.waiters[j].when) })
+		if len(f.waiters) == 0 || f.waiters[0].when.After(end) {
+			break
+		}
+		w := f.waiters[0]
+		f.now = w.when
+		select {
+		case w.c <- w.when:
+		default:
+		}
+		if w.period > 0 {
+			w.when = w.when.Add(w.period)
+		} else {
+			f.waiters = f.waiters[1:]
+		}
+	}
+	f.now = end
+}
+
+// NewTimer creates a timer firing once the clock advanced by d
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	w := &fakeWaiter{clock: f, c: make(chan time.Time, 1)}
+	w.Reset(d)
+	return w
+}
+
+// NewTicker creates a ticker firing every d of clock advance
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("clock: non-positive interval for NewTicker")
+	}
+	w := &fakeWaiter{clock: f, c: make(chan time.Time, 1), period: d}
+	w.Reset(d)
+	return fakeTicker{w}
+}
+
+// fakeWaiter is a timer, or a ticker when period is set, of a Fake clock
+type fakeWaiter struct {
+	clock  *Fake
+	c      chan time.Time
+	when   time.Time
+	period time.Duration
+}
+
+func (w *fakeWaiter) C() <-chan time.Time { return w.c }
+
+// Stop removes the waiter and reports whether it was pending
+func (w *fakeWaiter) Stop() bool {
+	w.clock.mutex.Lock()
+	defer w.clock.mutex.Unlock()
+	return w.remove()
+}
+
+// Reset schedules the waiter d from now and reports whether it was pending
+func (w *fakeWaiter) Reset(d time.Duration) bool {
+	w.clock.mutex.Lock()
+	defer w.clock.mutex.Unlock()
+	return w.reschedule(d)
+}
+
+// reschedule moves the waiter d from now; the clock mutex must be held
+func (w *fakeWaiter) reschedule(d time.Duration) bool {
+	pending := w.remove()
+	w.when = w.clock.now.Add(d)
+	w.clock.waiters = append(w.clock.waiters, w)
+	return pending
+}
+
+// remove unschedules the waiter; the clock mutex must be held
+func (w *fakeWaiter) remove() bool {
+	for i, other := range w.clock.waiters {
+		if other == w {
+			w.clock.waiters = append(w.clock.waiters[:i], w.clock.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+type fakeTicker struct{ *fakeWaiter }
+
+func (t fakeTicker) Stop() { t.fakeWaiter.Stop() }
+
+func (t fakeTicker) Reset(d time.Duration) {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	t.period = d
+	t.reschedule(d)
+}
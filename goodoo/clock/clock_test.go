@@ -0,0 +1,133 @@
+package clock_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"goodoo/clock"
+)
+
+var epoch = time.Date(2026, 10, 15, 9, 0, 0, 0, time.UTC)
+
+// fired reports whether c holds a tick, without waiting
+func fired(c <-chan time.Time) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestFakeTimer(t *testing.T) {
+	fake := clock.NewFake(epoch)
+	timer := fake.NewTimer(time.Minute)
+
+	fake.Advance(59 * time.Second)
+	if fired(timer.C()) {
+		t.Fatal("the timer fired early")
+	}
+	fake.Advance(time.Second)
+	if !fired(timer.C()) {
+		t.Fatal("the timer did not fire when due")
+	}
+	fake.Advance(time.Hour)
+	if fired(timer.C()) {
+		t.Error("the timer fired twice")
+	}
+	if timer.Stop() {
+		t.Error("Stop reports a fired timer as pending")
+	}
+
+	if timer.Reset(time.Minute) {
+		t.Error("Reset reports a fired timer as pending")
+	}
+	if !timer.Stop() {
+		t.Error("Stop reports a reset timer as not pending")
+	}
+	fake.Advance(time.Hour)
+	if fired(timer.C()) {
+		t.Error("a stopped timer fired")
+	}
+	if got := fake.Now(); !got.Equal(epoch.Add(2*time.Hour + time.Minute)) {
+		t.Errorf("Now = %v", got)
+	}
+}
+
+func TestFakeTicker(t *testing.T) {
+	fake := clock.NewFake(epoch)
+	ticker := fake.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	var ticks []time.Time
+	for i := 0; i < 3; i++ {
+		fake.Advance(time.Minute)
+		select {
+		case tick := <-ticker.C():
+			ticks = append(ticks, tick)
+		default:
+			t.Fatalf("no tick after %d minute(s)", i+1)
+		}
+	}
+	for i, tick := range ticks {
+		if want := epoch.Add(time.Duration(i+1) * time.Minute); !tick.Equal(want) {
+			t.Errorf("tick %d at %v, want %v", i+1, tick, want)
+		}
+	}
+
+	// Ticks nobody reads are dropped, as with time.Ticker
+	fake.Advance(10 * time.Minute)
+	if !fired(ticker.C()) || fired(ticker.C()) {
+		t.Error("a ticker left unread holds other than one tick")
+	}
+
+	ticker.Reset(time.Hour)
+	fake.Advance(59 * time.Minute)
+	if fired(ticker.C()) {
+		t.Error("the reset ticker kept its interval")
+	}
+	fake.Advance(time.Minute)
+	if !fired(ticker.C()) {
+		t.Error("the reset ticker did not fire")
+	}
+}
+
+// TestFakeOrder fires the waiters due during one Advance in the order of
+// their deadlines, the clock reading each deadline in turn
+func TestFakeOrder(t *testing.T) {
+	fake := clock.NewFake(epoch)
+	late := fake.NewTimer(3 * time.Second)
+	early := fake.NewTimer(time.Second)
+	fake.Advance(5 * time.Second)
+	if got := <-early.C(); !got.Equal(epoch.Add(time.Second)) {
+		t.Errorf("early timer fired at %v", got)
+	}
+	if got := <-late.C(); !got.Equal(epoch.Add(3 * time.Second)) {
+		t.Errorf("late timer fired at %v", got)
+	}
+}
+
+func TestOrReal(t *testing.T) {
+	if clock.OrReal(nil) != clock.Real {
+		t.Error("OrReal(nil) is not the real clock")
+	}
+	fake := clock.NewFake(epoch)
+	if clock.OrReal(fake) != fake {
+		t.Error("OrReal replaced a clock")
+	}
+}
+
+// The fake clock moves only when advanced: a timer of an hour fires at
+// once, without sleeping
+func ExampleFake() {
+	fake := clock.NewFake(time.Date(2026, 10, 15, 9, 0, 0, 0, time.UTC))
+	timer := fake.NewTimer(time.Hour)
+
+	fake.Advance(time.Hour)
+	fmt.Println((<-timer.C()).Format(time.Kitchen))
+	fmt.Println(fake.Now().Format(time.Kitchen))
+	// Output:
+	// 10:00AM
+	// 10:00AM
+}
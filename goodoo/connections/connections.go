@@ -0,0 +1,362 @@
+// Package connections tracks the long-lived connections of the process:
+// the event streams of notifications, editing, the user chat and the logs,
+// and the answers of the chat streamed as they are generated. It caps
+// them per user and in total, closes those left idle and, when the server
+// stops, asks the clients to reconnect elsewhere before the listener
+// closes.
+package connections
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"goodoo/scheduler"
+)
+
+// Types of connections
+const (
+	TypeNotifications = "notifications"
+	TypeEditing       = "editing"
+	TypeUserChat      = "user_chat"
+	TypeLogs          = "logs"
+	TypeChat          = "chat"
+)
+
+// Reasons a connection is closed by the server
+const (
+	ReasonShutdown = "shutdown"
+	ReasonIdle     = "idle"
+)
+
+var (
+	// ErrUserLimit is returned when the user already has the maximum
+	// number of connections
+	ErrUserLimit = errors.New("too many connections for this user")
+	// ErrLimit is returned when the process already has the maximum
+	// number of connections
+	ErrLimit = errors.New("too many connections")
+	// ErrDraining is returned once the server stops
+	ErrDraining = errors.New("server is shutting down")
+)
+
+// Config holds the limits and timeouts of the connections
+type Config struct {
+	// MaxPerUser is the number of connections a user may hold at once
+	MaxPerUser int
+	// MaxTotal is the number of connections of the process
+	MaxTotal int
+	// IdleTimeout is how long a connection without channels stays open
+	// without sending anything
+	IdleTimeout time.Duration
+	// DrainTimeout is how long the server waits for the clients to
+	// disconnect when it stops
+	DrainTimeout time.Duration
+	// ReconnectAfter is the delay clients are told to wait before
+	// reconnecting after a shutdown
+	ReconnectAfter time.Duration
+}
+
+// DefaultConfig returns 20 connections per user and 5000 in total, closed
+// after 10 minutes idle, and a drain of 5 seconds telling clients to
+// reconnect after 2 seconds
+func DefaultConfig() *Config {
+	return &Config{
+		MaxPerUser:     20,
+		MaxTotal:       5000,
+		IdleTimeout:    10 * time.Minute,
+		DrainTimeout:   5 * time.Second,
+		ReconnectAfter: 2 * time.Second,
+	}
+}
+
+// LoadFromEnv overrides the configuration with GOODOO_CONNECTIONS_*
+// variables
+func (c *Config) LoadFromEnv() {
+	if value := os.Getenv("GOODOO_CONNECTIONS_MAX_PER_USER"); value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n > 0 {
+			c.MaxPerUser = n
+		}
+	}
+	if value := os.Getenv("GOODOO_CONNECTIONS_MAX"); value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n > 0 {
+			c.MaxTotal = n
+		}
+	}
+	if value := os.Getenv("GOODOO_CONNECTIONS_IDLE_TIMEOUT"); value != "" {
+		if d, err := time.ParseDuration(value); err == nil && d > 0 {
+			c.IdleTimeout = d
+		}
+	}
+	if value := os.Getenv("GOODOO_CONNECTIONS_DRAIN_TIMEOUT"); value != "" {
+		if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+			c.DrainTimeout = d
+		}
+	}
+	if value := os.Getenv("GOODOO_CONNECTIONS_RECONNECT_AFTER"); value != "" {
+		if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+			c.ReconnectAfter = d
+		}
+	}
+}
+
+// Info describes a connection when it opens
+type Info struct {
+	Type   string
+	DB     string
+	UserID uint
+	Login  string
+	// Channels are what the connection forwards, bus channels or the log
+	// tap; connections without channels are closed when idle
+	Channels   []string
+	RemoteAddr string
+}
+
+// Conn is an open connection. Its handler reports what it sends, watches
+// Closing to stop when the server closes it and calls Close once done.
+type Conn struct {
+	id           uint64
+	info         Info
+	established  time.Time
+	lastActivity atomic.Int64
+	bytes        atomic.Int64
+	messages     atomic.Int64
+	closing      chan struct{}
+	reason       atomic.Value
+	once         sync.Once
+}
+
+// Status is the state of an open connection
+type Status struct {
+	ID           uint64    `json:"id"`
+	Type         string    `json:"type"`
+	DB           string    `json:"db"`
+	UserID       uint      `json:"user_id"`
+	Login        string    `json:"login"`
+	Channels     []string  `json:"channels"`
+	RemoteAddr   string    `json:"remote_addr"`
+	Established  time.Time `json:"established"`
+	LastActivity time.Time `json:"last_activity"`
+	BytesSent    int64     `json:"bytes_sent"`
+	MessagesSent int64     `json:"messages_sent"`
+}
+
+// user identifies a user of a database
+type user struct {
+	db  string
+	uid uint
+}
+
+var (
+	config = DefaultConfig()
+	conns  = make(map[uint64]*Conn)
+	// users counts the connections of each user
+	users    = make(map[user]int)
+	nextID   uint64
+	draining bool
+	// drained is signaled when the last connection closes
+	drained = make(chan struct{}, 1)
+	mutex   sync.Mutex
+)
+
+// Setup installs the process-wide configuration and accepts connections
+// again after a Drain
+func Setup(c *Config) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	config = c
+	draining = false
+}
+
+// Limits returns the configuration in use
+func Limits() Config {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return *config
+}
+
+// Open registers a connection. It fails with ErrUserLimit or ErrLimit when
+// a limit is reached, and with ErrDraining once the server stops.
+func Open(info Info) (*Conn, error) {
+	now := time.Now()
+	mutex.Lock()
+	defer mutex.Unlock()
+	switch {
+	case draining:
+		return nil, ErrDraining
+	case len(conns) >= config.MaxTotal:
+		return nil, ErrLimit
+	case info.UserID != 0 && users[user{info.DB, info.UserID}] >= config.MaxPerUser:
+		return nil, ErrUserLimit
+	}
+	nextID++
+	conn := &Conn{id: nextID, info: info, established: now, closing: make(chan struct{})}
+	conn.lastActivity.Store(now.UnixNano())
+	conns[conn.id] = conn
+	users[user{info.DB, info.UserID}]++
+	return conn, nil
+}
+
+// Sent records that a message of n bytes was sent on the connection
+func (c *Conn) Sent(n int) {
+	c.bytes.Add(int64(n))
+	c.messages.Add(1)
+	c.lastActivity.Store(time.Now().UnixNano())
+}
+
+// Closing is closed when the server closes the connection; Reason then
+// tells why
+func (c *Conn) Closing() <-chan struct{} {
+	return c.closing
+}
+
+// Reason returns why the server closed the connection, empty while open
+func (c *Conn) Reason() string {
+	reason, _ := c.reason.Load().(string)
+	return reason
+}
+
+// shut signals the handler of the connection to close it for reason
+func (c *Conn) shut(reason string) {
+	c.once.Do(func() {
+		c.reason.Store(reason)
+		close(c.closing)
+	})
+}
+
+// Close unregisters the connection
+func (c *Conn) Close() {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if _, ok := conns[c.id]; !ok {
+		return
+	}
+	delete(conns, c.id)
+	u := user{c.info.DB, c.info.UserID}
+	if users[u]--; users[u] <= 0 {
+		delete(users, u)
+	}
+	if len(conns) == 0 && draining {
+		select {
+		case drained <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Status returns the state of the connection
+func (c *Conn) Status() Status {
+	return Status{
+		ID:           c.id,
+		Type:         c.info.Type,
+		DB:           c.info.DB,
+		UserID:       c.info.UserID,
+		Login:        c.info.Login,
+		Channels:     c.info.Channels,
+		RemoteAddr:   c.info.RemoteAddr,
+		Established:  c.established,
+		LastActivity: time.Unix(0, c.lastActivity.Load()),
+		BytesSent:    c.bytes.Load(),
+		MessagesSent: c.messages.Load(),
+	}
+}
+
+// List returns the connections of a database, of every database when
+// dbName is empty, the oldest first
+func List(dbName string) []Status {
+	mutex.Lock()
+	list := make([]Status, 0, len(conns))
+	for _, conn := range conns {
+		if dbName == "" || conn.info.DB == dbName {
+			list = append(list, conn.Status())
+		}
+	}
+	mutex.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// Counts returns the number of connections of a database by type, of
+// every database when dbName is empty
+func Counts(dbName string) map[string]int {
+	mutex.Lock()
+	defer mutex.Unlock()
+	counts := make(map[string]int)
+	for _, conn := range conns {
+		if dbName == "" || conn.info.DB == dbName {
+			counts[conn.info.Type]++
+		}
+	}
+	return counts
+}
+
+// Count returns the number of connections of a database, of every
+// database when dbName is empty
+func Count(dbName string) int {
+	total := 0
+	for _, n := range Counts(dbName) {
+		total += n
+	}
+	return total
+}
+
+// CloseIdle closes the connections without channels that sent nothing for
+// IdleTimeout, and returns how many
+func CloseIdle(now time.Time) int {
+	mutex.Lock()
+	defer mutex.Unlock()
+	closed := 0
+	for _, conn := range conns {
+		if len(conn.info.Channels) > 0 || now.Sub(time.Unix(0, conn.lastActivity.Load())) < config.IdleTimeout {
+			continue
+		}
+		conn.shut(ReasonIdle)
+		closed++
+	}
+	return closed
+}
+
+// Drain stops accepting connections, asks the open ones to close, which
+// their handlers do telling the clients to reconnect after
+// ReconnectAfter, and waits up to DrainTimeout or ctx for them. It returns
+// the number of connections still open.
+func Drain(ctx context.Context) int {
+	mutex.Lock()
+	draining = true
+	timeout := config.DrainTimeout
+	// Empty the signal of a previous drain
+	select {
+	case <-drained:
+	default:
+	}
+	for _, conn := range conns {
+		conn.shut(ReasonShutdown)
+	}
+	open := len(conns)
+	mutex.Unlock()
+	if open == 0 {
+		return 0
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-drained:
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return Count("")
+}
+
+// Schedule registers the job closing the idle connections every interval
+func Schedule(s *scheduler.Scheduler, interval time.Duration) {
+	s.Every("connections.idle", interval, func(ctx context.Context) error {
+		CloseIdle(time.Now())
+		return nil
+	})
+}
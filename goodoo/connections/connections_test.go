@@ -0,0 +1,158 @@
+package connections_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"goodoo/connections"
+)
+
+// setup installs a configuration for the test, and the default one after
+func setup(t *testing.T, c *connections.Config) {
+	connections.Setup(c)
+	t.Cleanup(func() { connections.Setup(connections.DefaultConfig()) })
+}
+
+// open opens a connection closed at the end of the test
+func open(t *testing.T, info connections.Info) *connections.Conn {
+	t.Helper()
+	conn, err := connections.Open(info)
+	if err != nil {
+		t.Fatalf("Open(%+v): %v", info, err)
+	}
+	t.Cleanup(conn.Close)
+	return conn
+}
+
+func TestCaps(t *testing.T) {
+	setup(t, &connections.Config{MaxPerUser: 2, MaxTotal: 4, IdleTimeout: time.Minute})
+	user := connections.Info{Type: connections.TypeNotifications, DB: "caps_test", UserID: 1}
+
+	first := open(t, user)
+	open(t, user)
+	if _, err := connections.Open(user); !errors.Is(err, connections.ErrUserLimit) {
+		t.Fatalf("third connection of the user: %v, want ErrUserLimit", err)
+	}
+	// The same id in another database is another user, and anonymous
+	// connections have no cap of their own
+	open(t, connections.Info{Type: connections.TypeNotifications, DB: "caps_test_other", UserID: 1})
+	open(t, connections.Info{Type: connections.TypeLogs, DB: "caps_test"})
+	if _, err := connections.Open(connections.Info{DB: "caps_test", UserID: 2}); !errors.Is(err, connections.ErrLimit) {
+		t.Fatalf("connection past the total: %v, want ErrLimit", err)
+	}
+
+	counts := connections.Counts("caps_test")
+	if counts[connections.TypeNotifications] != 2 || counts[connections.TypeLogs] != 1 || connections.Count("caps_test") != 3 {
+		t.Errorf("Counts = %v, want 2 notifications and 1 logs", counts)
+	}
+	if list := connections.List("caps_test"); len(list) != 3 || list[0].ID != first.Status().ID {
+		t.Errorf("List = %+v, want 3 connections, the oldest first", list)
+	}
+
+	// Closing twice frees a single place
+	first.Close()
+	first.Close()
+	connections.Setup(&connections.Config{MaxPerUser: 2, MaxTotal: 10, IdleTimeout: time.Minute})
+	if n := connections.Count("caps_test"); n != 2 {
+		t.Errorf("Count after closing one connection twice = %d, want 2", n)
+	}
+	open(t, user)
+	if _, err := connections.Open(user); !errors.Is(err, connections.ErrUserLimit) {
+		t.Errorf("connection after closing one twice: %v, want ErrUserLimit", err)
+	}
+}
+
+func TestCloseIdle(t *testing.T) {
+	setup(t, &connections.Config{MaxPerUser: 10, MaxTotal: 10, IdleTimeout: time.Minute})
+	idle := open(t, connections.Info{Type: connections.TypeChat, DB: "idle_test", UserID: 1})
+	active := open(t, connections.Info{Type: connections.TypeChat, DB: "idle_test", UserID: 1})
+	subscribed := open(t, connections.Info{Type: connections.TypeNotifications, DB: "idle_test", UserID: 1, Channels: []string{"notifications"}})
+
+	if closed := connections.CloseIdle(time.Now().Add(30 * time.Second)); closed != 0 {
+		t.Fatalf("CloseIdle before the timeout closed %d connections", closed)
+	}
+	time.Sleep(time.Millisecond)
+	active.Sent(10)
+	active.Sent(5)
+	if status := active.Status(); status.BytesSent != 15 || status.MessagesSent != 2 {
+		t.Errorf("status = %+v, want 15 bytes in 2 messages", status)
+	}
+
+	// A minute after the open of the idle connection, but not after what
+	// the active one sent
+	now := active.Status().LastActivity.Add(time.Minute - time.Nanosecond)
+	if closed := connections.CloseIdle(now); closed != 1 {
+		t.Fatalf("CloseIdle closed %d connections, want the idle one", closed)
+	}
+	select {
+	case <-idle.Closing():
+	default:
+		t.Fatal("the idle connection is not closing")
+	}
+	if idle.Reason() != connections.ReasonIdle {
+		t.Errorf("reason = %q, want %q", idle.Reason(), connections.ReasonIdle)
+	}
+	for _, conn := range []*connections.Conn{active, subscribed} {
+		select {
+		case <-conn.Closing():
+			t.Errorf("connection %+v is closing", conn.Status())
+		default:
+		}
+	}
+
+	// Connections forwarding channels are never idle
+	if closed := connections.CloseIdle(time.Now().Add(time.Hour)); closed != 2 || subscribed.Reason() != "" {
+		t.Errorf("CloseIdle an hour later closed %d connections, reason of the subscribed one %q; want 2 and none",
+			closed, subscribed.Reason())
+	}
+}
+
+// TestDrain stops accepting connections and waits for the handlers to
+// close theirs, as the server does when it stops
+func TestDrain(t *testing.T) {
+	setup(t, &connections.Config{MaxPerUser: 10, MaxTotal: 10, IdleTimeout: time.Minute, DrainTimeout: 5 * time.Second})
+	reasons := make(chan string, 2)
+	for i := 0; i < 2; i++ {
+		conn := open(t, connections.Info{Type: connections.TypeUserChat, DB: "drain_test", UserID: 1, Channels: []string{"user_chat"}})
+		go func() {
+			<-conn.Closing()
+			reasons <- conn.Reason()
+			conn.Close()
+		}()
+	}
+
+	start := time.Now()
+	if open := connections.Drain(context.Background()); open != 0 {
+		t.Fatalf("Drain left %d connections open", open)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Drain took %v, want it back once the connections closed", elapsed)
+	}
+	for i := 0; i < 2; i++ {
+		if reason := <-reasons; reason != connections.ReasonShutdown {
+			t.Errorf("reason = %q, want %q", reason, connections.ReasonShutdown)
+		}
+	}
+	if _, err := connections.Open(connections.Info{DB: "drain_test", UserID: 1}); !errors.Is(err, connections.ErrDraining) {
+		t.Errorf("Open while draining: %v, want ErrDraining", err)
+	}
+
+	// Setup accepts connections again
+	connections.Setup(&connections.Config{MaxPerUser: 10, MaxTotal: 10, IdleTimeout: time.Minute, DrainTimeout: 20 * time.Millisecond})
+	stuck := open(t, connections.Info{Type: connections.TypeLogs, DB: "drain_test", UserID: 1})
+	if open := connections.Drain(context.Background()); open != 1 {
+		t.Errorf("Drain of a connection never closed = %d, want 1 after the timeout", open)
+	}
+	if stuck.Reason() != connections.ReasonShutdown {
+		t.Errorf("reason = %q, want %q", stuck.Reason(), connections.ReasonShutdown)
+	}
+
+	connections.Setup(&connections.Config{MaxPerUser: 10, MaxTotal: 10, IdleTimeout: time.Minute, DrainTimeout: time.Hour})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if open := connections.Drain(ctx); open != 1 {
+		t.Errorf("Drain until the context is done = %d, want 1", open)
+	}
+}
@@ -0,0 +1,285 @@
+// Package crash turns panics into crash reports. Its middleware replaces
+// Echo's Recover: the panic value and stack are logged at CRITICAL with
+// the request ID, user, route and redacted parameters, stored as a
+// CrashReport, counted in the metrics and answered with the usual 500
+// error. Reports are grouped by a fingerprint of the top stack frames, and
+// the administrators are notified of each new fingerprint. The panics of
+// background tasks (package tasks) are reported through RecordPanic.
+package crash
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"goodoo/database"
+	goodooHttp "goodoo/http"
+	"goodoo/logging"
+	"goodoo/metrics"
+	"goodoo/models"
+	"goodoo/notification"
+)
+
+// fingerprintFrames is the frames of the stack a fingerprint covers
+const fingerprintFrames = 5
+
+// maxStackBytes bounds the stack stored with a report
+const maxStackBytes = 16 << 10
+
+// recordTimeout bounds the writes of a report
+const recordTimeout = 5 * time.Second
+
+// logger returns the logger of the package, looked up when used: a
+// logger created before logging.InitLogger has no handler, and a crash
+// must never go unlogged
+func logger() *logging.Logger {
+	return logging.GetLogger("goodoo.crash")
+}
+
+// Report is a recovered panic
+type Report struct {
+	DBName    string
+	Value     interface{}
+	Stack     string
+	Frames    []string
+	RequestID string
+	Method    string
+	// Route is the route pattern of a request, the name of a goroutine
+	Route  string
+	Path   string
+	UserID uint
+	Login  string
+	Params map[string]interface{}
+}
+
+// Fingerprint hashes the type of the panic value and the functions of the
+// top frames, so that repeats group together across deployments that move
+// lines around
+func (r *Report) Fingerprint() string {
+	frames := r.Frames
+	if len(frames) > fingerprintFrames {
+		frames = frames[:fingerprintFrames]
+	}
+	sum := sha1.Sum([]byte(fmt.Sprintf("%T\n%s", r.Value, strings.Join(frames, "\n"))))
+	return hex.EncodeToString(sum[:])
+}
+
+// Message is the panic value as text
+func (r *Report) Message() string {
+	if err, ok := r.Value.(error); ok {
+		return err.Error()
+	}
+	return fmt.Sprint(r.Value)
+}
+
+// capture fills the stack of a report from within the deferred recover
+func capture(report *Report) {
+	stack := debug.Stack()
+	if len(stack) > maxStackBytes {
+		stack = stack[:maxStackBytes]
+	}
+	report.Stack = string(stack)
+	report.Frames = panicFrames()
+}
+
+// panicFrames returns the functions of the panicking goroutine from the
+// frame that panicked, leaving out the runtime
+func panicFrames() []string {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(3, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	var names, all []string
+	panicked := false
+	for {
+		frame, more := frames.Next()
+		name := frame.Function
+		switch {
+		case name == "runtime.gopanic":
+			panicked = true
+		case name != "" && !strings.HasPrefix(name, "runtime."):
+			if panicked {
+				names = append(names, name)
+			} else {
+				all = append(all, name)
+			}
+		}
+		if !more || len(names) == fingerprintFrames {
+			break
+		}
+	}
+	if !panicked {
+		return all
+	}
+	return names
+}
+
+// Middleware recovers the panics of the handlers; requests made without a
+// database, such as the login page, are reported in defaultDB
+func Middleware(defaultDB string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) (err error) {
+			start := time.Now()
+			defer func() {
+				value := recover()
+				if value == nil {
+					return
+				}
+				if value == http.ErrAbortHandler {
+					// The client is gone; net/http stops the response
+					panic(value)
+				}
+				report := &Report{DBName: defaultDB, Value: value, Method: c.Request().Method, Route: c.Path(), Path: c.Request().URL.Path}
+				capture(report)
+				report.Params = requestParams(c)
+				if req := goodooHttp.GetGoodooRequest(c); req != nil {
+					if req.DB != "" {
+						report.DBName = req.DB
+					}
+					report.RequestID = req.GetRequestID()
+					report.UserID = uint(req.GetUserID())
+					report.Login = req.GetLogin()
+				}
+				Record(report)
+				metrics.Observe(report.DBName, time.Since(start), http.StatusInternalServerError)
+
+				body := map[string]string{"error": "Internal Server Error"}
+				if report.RequestID != "" {
+					body["request_id"] = report.RequestID
+				}
+				if c.Response().Committed {
+					err = nil
+					return
+				}
+				err = c.JSON(http.StatusInternalServerError, body)
+			}()
+			return next(c)
+		}
+	}
+}
+
+// requestParams returns the query and path parameters of a request,
+// sensitive values redacted
+func requestParams(c echo.Context) map[string]interface{} {
+	params := make(map[string]interface{})
+	for key, values := range c.QueryParams() {
+		if len(values) == 1 {
+			params[key] = values[0]
+		} else {
+			params[key] = values
+		}
+	}
+	for i, name := range c.ParamNames() {
+		if i < len(c.ParamValues()) {
+			params[name] = c.ParamValues()[i]
+		}
+	}
+	return logging.RedactMap(params)
+}
+
+// RecordPanic reports a panic recovered outside a request, e.g. by a
+// background task; it must be called from the deferred function that
+// recovered value, for the stack to be the one of the panic
+func RecordPanic(ctx context.Context, dbName, name string, value interface{}) {
+	report := &Report{DBName: dbName, Value: value, Route: name}
+	capture(report)
+	if requestID, ok := ctx.Value("request_id").(string); ok {
+		report.RequestID = requestID
+	}
+	Record(report)
+}
+
+// Record logs a report at CRITICAL, counts it, stores it and notifies the
+// administrators when its fingerprint is new
+func Record(report *Report) {
+	fingerprint := report.Fingerprint()
+	params, _ := json.Marshal(report.Params)
+	ctx := context.Background()
+	if report.RequestID != "" {
+		ctx = context.WithValue(ctx, "request_id", report.RequestID)
+	}
+	where := strings.TrimSpace(report.Method + " " + report.Route)
+	login := report.Login
+	if login == "" {
+		login = "-"
+	}
+	logger().CriticalCtx(ctx, "Panic in %s (crash %s, user %s, params %s): %s\n%s",
+		where, fingerprint[:12], login, params, report.Message(), report.Stack)
+	metrics.ObserveCrash(report.DBName)
+
+	if err := store(report, fingerprint, string(params)); err != nil {
+		logger().Error("Failed to record crash %s: %v", fingerprint[:12], err)
+	}
+}
+
+// store writes the report and announces new fingerprints
+func store(report *Report, fingerprint, params string) error {
+	db, err := database.GetDatabase(report.DBName)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), recordTimeout)
+	defer cancel()
+	db = db.WithContext(ctx)
+
+	var seen int64
+	if err := db.Model(&models.CrashReport{}).Where("fingerprint = ?", fingerprint).Limit(1).Count(&seen).Error; err != nil {
+		return err
+	}
+	row := models.CrashReport{
+		Fingerprint: fingerprint,
+		Message:     report.Message(),
+		Stack:       report.Stack,
+		RequestID:   report.RequestID,
+		Method:      report.Method,
+		Route:       report.Route,
+		Path:        report.Path,
+		UserID:      report.UserID,
+	}
+	if len(report.Params) > 0 {
+		row.Params = &params
+	}
+	if err := db.Create(&row).Error; err != nil {
+		return err
+	}
+	if seen > 0 {
+		return nil
+	}
+
+	payload := map[string]interface{}{
+		"fingerprint": fingerprint,
+		"route":       report.Route,
+		"message":     truncate(report.Message(), 200),
+		"crash_id":    row.ID,
+	}
+	activity := models.Activity{Type: models.ActivityCrash, Severity: models.SeverityError, Params: payload}
+	if err := models.LogActivity(db, 0, activity); err != nil {
+		logger().Error("Failed to record crash %s in the activity feed: %v", fingerprint[:12], err)
+	}
+	admins, err := models.AdminUserIDs(db)
+	if err != nil {
+		return err
+	}
+	title := fmt.Sprintf("New crash in %s", report.Route)
+	body := truncate(report.Message(), 200)
+	for _, uid := range admins {
+		notification.Notify(report.DBName, uid, models.NotificationCategoryCrash, models.NotificationError, title, body, payload)
+	}
+	return nil
+}
+
+// truncate shortens text to n characters
+func truncate(text string, n int) string {
+	runes := []rune(text)
+	if len(runes) <= n {
+		return text
+	}
+	return string(runes[:n]) + "…"
+}
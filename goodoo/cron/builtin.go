@@ -0,0 +1,22 @@
+package cron
+
+import (
+	"context"
+	"time"
+
+	"goodoo/models"
+)
+
+// runRetention is how long run history is kept by ir.cron.purge_runs
+const runRetention = 30 * 24 * time.Hour
+
+func init() {
+	RegisterFunction("ir.cron", "purge_runs", purgeRuns)
+}
+
+// purgeRuns deletes run history older than the retention period
+func purgeRuns(ctx context.Context, env *models.Environment) error {
+	return env.GetDB().
+		Where("started_at < ? AND state <> ?", time.Now().Add(-runRetention), models.CronRunRunning).
+		Delete(&models.IrCronRun{}).Error
+}
@@ -0,0 +1,235 @@
+package cron
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"goodoo/clock"
+	"goodoo/database"
+	"goodoo/logging"
+	"goodoo/models"
+	"goodoo/scheduler"
+	"gorm.io/gorm"
+)
+
+// Func is the code run by a scheduled action, as the cron's user
+type Func func(ctx context.Context, env *models.Environment) error
+
+var (
+	functions = make(map[string]Func)
+	funcMutex sync.RWMutex
+)
+
+// RegisterFunction makes fn callable by scheduled actions under "<model>.<name>",
+// or just name when model is empty
+func RegisterFunction(model, name string, fn Func) {
+	funcMutex.Lock()
+	defer funcMutex.Unlock()
+	functions[functionKey(model, name)] = fn
+}
+
+// Functions returns the names of all registered functions
+func Functions() []string {
+	funcMutex.RLock()
+	defer funcMutex.RUnlock()
+
+	names := make([]string, 0, len(functions))
+	for name := range functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func functionKey(model, name string) string {
+	if model == "" {
+		return name
+	}
+	return model + "." + name
+}
+
+func lookupFunction(job *models.IrCron) (Func, error) {
+	funcMutex.RLock()
+	defer funcMutex.RUnlock()
+	key := functionKey(job.Model, job.Function)
+	if fn, ok := functions[key]; ok {
+		return fn, nil
+	}
+	return nil, fmt.Errorf("function %s is not registered", key)
+}
+
+// ScheduleOf returns the schedule of a job; a cron expression takes precedence over the interval
+func ScheduleOf(job *models.IrCron) (Schedule, error) {
+	if job.CronExpression != "" {
+		return ParseCronExpression(job.CronExpression)
+	}
+	return NewIntervalSchedule(job.IntervalNumber, job.IntervalType)
+}
+
+// ErrAlreadyRunning is returned when a job is started while a previous run is still executing
+var ErrAlreadyRunning = errors.New("job is already running")
+
+// staleRunTimeout releases the lock of a run whose process died without finishing it
+const staleRunTimeout = 6 * time.Hour
+
+// Runner executes the due scheduled actions of one database
+type Runner struct {
+	dbName string
+	logger *logging.Logger
+	clock  clock.Clock
+}
+
+// NewRunner creates a runner for a database, deciding which jobs are due
+// with clk, the system clock when nil
+func NewRunner(dbName string, clk clock.Clock) *Runner {
+	return &Runner{dbName: dbName, logger: logging.GetLogger("goodoo.cron"), clock: clock.OrReal(clk)}
+}
+
+// ScheduleRunner registers a scheduler job polling the database's scheduled actions
+func ScheduleRunner(s *scheduler.Scheduler, dbName string, interval time.Duration) {
+	runner := NewRunner(dbName, s.Clock())
+	s.Every("ir.cron."+dbName, interval, runner.Tick)
+}
+
+func (r *Runner) db(ctx context.Context) (*gorm.DB, error) {
+	db, err := database.GetDatabase(r.dbName)
+	if err != nil {
+		return nil, err
+	}
+	return db.WithContext(ctx), nil
+}
+
+// Tick runs every active job whose next call is due
+func (r *Runner) Tick(ctx context.Context) error {
+	db, err := r.db(ctx)
+	if err != nil {
+		return err
+	}
+
+	var jobs []models.IrCron
+	if err := db.Where("active = ? AND nextcall <= ?", true, r.clock.Now()).Order("nextcall").Find(&jobs).Error; err != nil {
+		return err
+	}
+
+	for i := range jobs {
+		if ctx.Err() != nil {
+			break
+		}
+		job := &jobs[i]
+		if _, err := r.run(ctx, db, job, false); err != nil && !errors.Is(err, ErrAlreadyRunning) {
+			r.logger.Error("Scheduled action %s (%d) failed: %v", job.Name, job.ID, err)
+		}
+	}
+	return nil
+}
+
+// RunNow executes a job immediately, regardless of its next call
+func (r *Runner) RunNow(ctx context.Context, id uint) (*models.IrCronRun, error) {
+	db, err := r.db(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var job models.IrCron
+	if err := db.First(&job, id).Error; err != nil {
+		return nil, err
+	}
+	return r.run(ctx, db, &job, true)
+}
+
+// claim marks the job as running unless another run holds it, across processes
+func (r *Runner) claim(db *gorm.DB, job *models.IrCron, now time.Time) (bool, error) {
+	result := db.Model(&models.IrCron{}).
+		Where("id = ? AND (running_since IS NULL OR running_since < ?)", job.ID, now.Add(-staleRunTimeout)).
+		Update("running_since", now)
+	return result.RowsAffected == 1, result.Error
+}
+
+// run executes one job and records the run. Scheduled runs of a job that
+// missed several activations are skipped unless the job catches up.
+func (r *Runner) run(ctx context.Context, db *gorm.DB, job *models.IrCron, manual bool) (*models.IrCronRun, error) {
+	schedule, err := ScheduleOf(job)
+	if err != nil {
+		return nil, err
+	}
+
+	now := r.clock.Now()
+	claimed, err := r.claim(db, job, now)
+	if err != nil {
+		return nil, err
+	}
+	if !claimed {
+		r.logger.Warning("Skipping %s (%d): previous run still executing", job.Name, job.ID)
+		return nil, ErrAlreadyRunning
+	}
+
+	run := &models.IrCronRun{CronID: job.ID, State: models.CronRunRunning, Manual: manual, StartedAt: now}
+	if err := db.Create(run).Error; err != nil {
+		db.Model(job).Update("running_since", nil)
+		return nil, err
+	}
+
+	missed := !manual && !schedule.Next(job.NextCall).After(now)
+	if missed && !job.CatchUp {
+		run.State = models.CronRunSkipped
+		run.Error = fmt.Sprintf("missed activations since %s", job.NextCall.Format(time.RFC3339))
+		r.logger.Info("Skipping missed runs of %s (%d) since %s", job.Name, job.ID, job.NextCall.Format(time.RFC3339))
+	} else {
+		r.execute(ctx, db, job, run)
+	}
+
+	finished := r.clock.Now()
+	run.FinishedAt = &finished
+	run.DurationMs = finished.Sub(run.StartedAt).Milliseconds()
+	if err := db.Save(run).Error; err != nil {
+		r.logger.Error("Failed to record run of %s (%d): %v", job.Name, job.ID, err)
+	}
+
+	// Manual runs keep the planned next call
+	updates := map[string]interface{}{"running_since": nil}
+	if !manual {
+		if next := schedule.Next(now); next.IsZero() {
+			// A zero next call would be due, and fail, every minute
+			updates["active"] = false
+			r.logger.Error("Scheduled action %s (%d) deactivated: %v", job.Name, job.ID, ErrNeverActivates)
+		} else {
+			updates["nextcall"] = next
+		}
+	}
+	if run.State != models.CronRunSkipped {
+		updates["lastcall"] = now
+	}
+	if err := db.Model(job).Updates(updates).Error; err != nil {
+		return run, err
+	}
+	return run, nil
+}
+
+// execute calls the job function, recovering from panics
+func (r *Runner) execute(ctx context.Context, db *gorm.DB, job *models.IrCron, run *models.IrCronRun) {
+	fn, err := lookupFunction(job)
+	if err == nil {
+		env := models.NewEnvironment(db, job.UserID).WithDBName(r.dbName)
+		func() {
+			defer func() {
+				if p := recover(); p != nil {
+					err = fmt.Errorf("panic: %v", p)
+				}
+			}()
+			err = fn(ctx, env)
+		}()
+	}
+
+	if err != nil {
+		run.State = models.CronRunFailed
+		run.Error = err.Error()
+		r.logger.Error("Scheduled action %s (%d) failed: %v", job.Name, job.ID, err)
+		return
+	}
+	run.State = models.CronRunDone
+	r.logger.Info("Scheduled action %s (%d) done in %v", job.Name, job.ID, r.clock.Now().Sub(run.StartedAt))
+}
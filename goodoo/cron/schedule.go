@@ -0,0 +1,216 @@
+package cron
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule computes the activation times of a scheduled action
+type Schedule interface {
+	// Next returns the first activation strictly after t, the zero time
+	// when there is none (e.g. "0 0 30 2 *")
+	Next(t time.Time) time.Time
+}
+
+// ErrNeverActivates is returned for an expression matching no date, like
+// the 30th of February
+var ErrNeverActivates = errors.New("schedule never activates")
+
+// Interval units of simple schedules (like Odoo's interval_type)
+const (
+	UnitMinutes = "minutes"
+	UnitHours   = "hours"
+	UnitDays    = "days"
+	UnitWeeks   = "weeks"
+	UnitMonths  = "months"
+)
+
+// intervalSchedule repeats every Number Units
+type intervalSchedule struct {
+	Number int
+	Unit   string
+}
+
+// NewIntervalSchedule creates a schedule repeating every number units
+func NewIntervalSchedule(number int, unit string) (Schedule, error) {
+	if number <= 0 {
+		return nil, fmt.Errorf("interval must be positive, got %d", number)
+	}
+	switch unit {
+	case UnitMinutes, UnitHours, UnitDays, UnitWeeks, UnitMonths:
+		return intervalSchedule{Number: number, Unit: unit}, nil
+	}
+	return nil, fmt.Errorf("unknown interval unit '%s'", unit)
+}
+
+func (s intervalSchedule) Next(t time.Time) time.Time {
+	switch s.Unit {
+	case UnitMinutes:
+		return t.Add(time.Duration(s.Number) * time.Minute)
+	case UnitHours:
+		return t.Add(time.Duration(s.Number) * time.Hour)
+	case UnitDays:
+		return t.AddDate(0, 0, s.Number)
+	case UnitWeeks:
+		return t.AddDate(0, 0, 7*s.Number)
+	default:
+		return t.AddDate(0, s.Number, 0)
+	}
+}
+
+// cronSchedule is a parsed 5-field cron expression
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	domStar, dowStar              bool
+}
+
+// fieldBounds are the allowed ranges of the five cron fields
+var fieldBounds = [5]struct{ min, max int }{
+	{0, 59}, // minute
+	{0, 23}, // hour
+	{1, 31}, // day of month
+	{1, 12}, // month
+	{0, 7},  // day of week, 0 and 7 are Sunday
+}
+
+var monthNames = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+var dayNames = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+// ParseCronExpression parses "minute hour day-of-month month day-of-week".
+// Fields accept *, values, ranges (a-b), steps (*/n, a-b/n), lists and
+// three-letter month and day names.
+func ParseCronExpression(expr string) (Schedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression must have 5 fields, got %d", len(fields))
+	}
+
+	var bits [5]uint64
+	for i, field := range fields {
+		names := map[string]int(nil)
+		switch i {
+		case 3:
+			names = monthNames
+		case 4:
+			names = dayNames
+		}
+		parsed, err := parseCronField(strings.ToLower(field), fieldBounds[i].min, fieldBounds[i].max, names)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron field '%s': %w", field, err)
+		}
+		bits[i] = parsed
+	}
+
+	// Sunday may be written 0 or 7
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+
+	return &cronSchedule{
+		minute:  bits[0],
+		hour:    bits[1],
+		dom:     bits[2],
+		month:   bits[3],
+		dow:     bits[4],
+		domStar: fields[2] == "*",
+		dowStar: fields[4] == "*",
+	}, nil
+}
+
+// parseCronField returns the bit set of values matched by a field
+func parseCronField(field string, min, max int, names map[string]int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if idx := strings.Index(part, "/"); idx >= 0 {
+			s, err := strconv.Atoi(part[idx+1:])
+			if err != nil || s <= 0 {
+				return 0, fmt.Errorf("invalid step in '%s'", part)
+			}
+			step = s
+			part = part[:idx]
+		}
+
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = parseCronValue(bounds[0], names); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = parseCronValue(bounds[1], names); err != nil {
+					return 0, err
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("value out of range %d-%d in '%s'", min, max, part)
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func parseCronValue(value string, names map[string]int) (int, error) {
+	if n, ok := names[value]; ok {
+		return n, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value '%s'", value)
+	}
+	return n, nil
+}
+
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+	// Like cron, a restricted day of month and day of week match either one
+	if !s.domStar && !s.dowStar {
+		return domMatch || dowMatch
+	}
+	return domMatch && dowMatch
+}
+
+func (s *cronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+
+	// Searching five years ahead covers every valid expression (e.g. Feb 29)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
@@ -0,0 +1,45 @@
+package cron_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"goodoo/cron"
+	"goodoo/reports"
+)
+
+func TestNext(t *testing.T) {
+	from := time.Date(2025, 3, 10, 12, 30, 45, 0, time.UTC)
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2025, 3, 10, 12, 31, 0, 0, time.UTC)},
+		{"0 0 * * *", time.Date(2025, 3, 11, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+		{"0 0 31 4,6,9,11 *", time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			schedule, err := cron.ParseCronExpression(tt.expr)
+			if err != nil {
+				t.Fatalf("ParseCronExpression: %v", err)
+			}
+			if got := schedule.Next(from); !got.Equal(tt.want) {
+				t.Errorf("Next = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNextRunNeverActivates(t *testing.T) {
+	_, err := reports.NextRun("0 0 30 2 *", "Europe/Brussels", time.Now())
+	if !errors.Is(err, cron.ErrNeverActivates) {
+		t.Errorf("NextRun error = %v, want ErrNeverActivates", err)
+	}
+	if _, err := reports.NextRun("0 8 * * 1", "Europe/Brussels", time.Now()); err != nil {
+		t.Errorf("NextRun: %v", err)
+	}
+}
@@ -0,0 +1,226 @@
+// Package crypto encrypts sensitive column values (API keys, secrets)
+// with AES-256-GCM. Ciphertexts name the key that sealed them, so keys can
+// be rotated: the first configured key encrypts, every configured key
+// decrypts.
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Prefix marks encrypted values: "enc:v1:<key id>:<base64 nonce+ciphertext>"
+const Prefix = "enc:v1:"
+
+var (
+	// ErrNoKey is returned when encrypting without a configured key
+	ErrNoKey = errors.New("no encryption key configured")
+	// ErrUnknownKey is returned when a value was sealed by a key that is
+	// not configured
+	ErrUnknownKey = errors.New("value was encrypted with an unknown key")
+	// ErrDecrypt is returned when a value cannot be decrypted: it is
+	// malformed, tampered with or sealed by a different key with the same id
+	ErrDecrypt = errors.New("failed to decrypt value")
+)
+
+// Key is a named 256-bit key
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+// Config holds the keys, the first one encrypting
+type Config struct {
+	Keys []Key
+}
+
+// DefaultConfig returns a configuration without keys: values are stored
+// as they are until a key is configured
+func DefaultConfig() *Config {
+	return &Config{}
+}
+
+// LoadFromEnv reads the keys from GOODOO_ENCRYPTION_KEYS, a comma-separated
+// list of id:key where key is 32 bytes in base64 or hex, current key first.
+// Unlike other settings an invalid key is an error: ignoring it would store
+// secrets in plaintext or make them unreadable.
+func (c *Config) LoadFromEnv() error {
+	value := os.Getenv("GOODOO_ENCRYPTION_KEYS")
+	if value == "" {
+		return nil
+	}
+	keys, err := ParseKeys(value)
+	if err != nil {
+		return err
+	}
+	c.Keys = keys
+	return nil
+}
+
+// ParseKeys parses a comma-separated list of id:key
+func ParseKeys(value string) ([]Key, error) {
+	var keys []Key
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, encoded, found := strings.Cut(entry, ":")
+		if !found || id == "" {
+			return nil, fmt.Errorf("encryption key %q: expected id:key", truncateID(entry))
+		}
+		if seen[id] {
+			return nil, fmt.Errorf("encryption key %s is listed twice", id)
+		}
+		secret, err := decodeKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %s: %w", id, err)
+		}
+		seen[id] = true
+		keys = append(keys, Key{ID: id, Secret: secret})
+	}
+	return keys, nil
+}
+
+// truncateID keeps the key material of a malformed entry out of errors
+func truncateID(entry string) string {
+	if len(entry) > 8 {
+		return entry[:8] + "..."
+	}
+	return entry
+}
+
+// decodeKey decodes a 32-byte key in hex or base64
+func decodeKey(encoded string) ([]byte, error) {
+	if len(encoded) == 64 {
+		if secret, err := hex.DecodeString(encoded); err == nil {
+			return secret, nil
+		}
+	}
+	for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if secret, err := encoding.DecodeString(encoded); err == nil {
+			if len(secret) != 32 {
+				return nil, fmt.Errorf("key must be 32 bytes, got %d", len(secret))
+			}
+			return secret, nil
+		}
+	}
+	return nil, fmt.Errorf("key is neither hex nor base64")
+}
+
+// keyring holds the ciphers of the configured keys
+type keyring struct {
+	current string
+	ciphers map[string]cipher.AEAD
+}
+
+var (
+	ring  = &keyring{ciphers: map[string]cipher.AEAD{}}
+	mutex sync.RWMutex
+)
+
+// Setup installs the process-wide keys
+func Setup(c *Config) error {
+	next := &keyring{ciphers: make(map[string]cipher.AEAD, len(c.Keys))}
+	for i, key := range c.Keys {
+		if strings.Contains(key.ID, ":") {
+			return fmt.Errorf("encryption key id %q cannot contain ':'", key.ID)
+		}
+		if len(key.Secret) != 32 {
+			return fmt.Errorf("encryption key %s must be 32 bytes", key.ID)
+		}
+		block, err := aes.NewCipher(key.Secret)
+		if err != nil {
+			return fmt.Errorf("encryption key %s: %w", key.ID, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return fmt.Errorf("encryption key %s: %w", key.ID, err)
+		}
+		if i == 0 {
+			next.current = key.ID
+		}
+		next.ciphers[key.ID] = aead
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	ring = next
+	return nil
+}
+
+// currentRing returns the installed keys
+func currentRing() *keyring {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return ring
+}
+
+// Enabled reports whether a key is configured to encrypt values
+func Enabled() bool {
+	return currentRing().current != ""
+}
+
+// CurrentKeyID returns the id of the key encrypting values, "" when none
+func CurrentKeyID() string {
+	return currentRing().current
+}
+
+// IsEncrypted reports whether a stored value is a ciphertext
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, Prefix)
+}
+
+// KeyID returns the id of the key that sealed a ciphertext
+func KeyID(value string) (string, bool) {
+	if !IsEncrypted(value) {
+		return "", false
+	}
+	id, _, found := strings.Cut(strings.TrimPrefix(value, Prefix), ":")
+	return id, found
+}
+
+// Encrypt seals plaintext with the current key
+func Encrypt(plaintext []byte) (string, error) {
+	r := currentRing()
+	if r.current == "" {
+		return "", ErrNoKey
+	}
+	aead := r.ciphers[r.current]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, plaintext, nil)
+	return Prefix + r.current + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt opens a ciphertext with the key it names
+func Decrypt(value string) ([]byte, error) {
+	id, encoded, found := strings.Cut(strings.TrimPrefix(value, Prefix), ":")
+	if !IsEncrypted(value) || !found {
+		return nil, fmt.Errorf("%w: not an encrypted value", ErrDecrypt)
+	}
+	aead, ok := currentRing().ciphers[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, id)
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("%w: malformed value", ErrDecrypt)
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w with key %s", ErrDecrypt, id)
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,133 @@
+package crypto
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+// Column is an encrypted column, registered by the package defining it so
+// that rotation re-encrypts it
+type Column struct {
+	Table  string
+	Column string
+	// Binary columns hold EncryptedBytes, others EncryptedString
+	Binary bool
+}
+
+var (
+	columns      = make(map[string]Column)
+	columnsMutex sync.RWMutex
+)
+
+// RegisterColumn declares an encrypted column
+func RegisterColumn(table, column string, binary bool) {
+	columnsMutex.Lock()
+	defer columnsMutex.Unlock()
+	columns[table+"."+column] = Column{Table: table, Column: column, Binary: binary}
+}
+
+// Columns returns the registered columns, sorted
+func Columns() []Column {
+	columnsMutex.RLock()
+	defer columnsMutex.RUnlock()
+	list := make([]Column, 0, len(columns))
+	for _, column := range columns {
+		list = append(list, column)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Table != list[j].Table {
+			return list[i].Table < list[j].Table
+		}
+		return list[i].Column < list[j].Column
+	})
+	return list
+}
+
+// rotateBatchSize is the number of rows re-encrypted per query
+const rotateBatchSize = 500
+
+// Rotate re-encrypts the values of every registered column that are not
+// sealed by the current key, including those stored in plaintext before
+// encryption was enabled, and returns how many were re-encrypted per
+// column. Each column is rotated in its own transaction; a value that
+// cannot be decrypted aborts its column.
+func Rotate(db *gorm.DB) (map[string]int, error) {
+	current := CurrentKeyID()
+	if current == "" {
+		return nil, ErrNoKey
+	}
+	counts := make(map[string]int)
+	for _, column := range Columns() {
+		count, err := rotateColumn(db, column, current)
+		if err != nil {
+			return counts, fmt.Errorf("failed to rotate %s.%s: %w", column.Table, column.Column, err)
+		}
+		counts[column.Table+"."+column.Column] = count
+	}
+	return counts, nil
+}
+
+// rotateColumn re-encrypts the values of a column with the current key
+func rotateColumn(db *gorm.DB, column Column, current string) (int, error) {
+	// Values already sealed by the current key start with its prefix
+	prefix := Prefix + current + ":"
+	condition := fmt.Sprintf("%[1]s <> '' AND left(%[1]s, ?) <> ?", column.Column)
+	var prefixValue interface{} = prefix
+	if column.Binary {
+		condition = fmt.Sprintf("length(%[1]s) > 0 AND substring(%[1]s from 1 for ?) <> ?", column.Column)
+		prefixValue = []byte(prefix)
+	}
+
+	count := 0
+	err := db.Transaction(func(tx *gorm.DB) error {
+		lastID := uint(0)
+		for {
+			var rows []struct {
+				ID    uint
+				Value []byte
+			}
+			err := tx.Table(column.Table).
+				Select(fmt.Sprintf("id, %s AS value", column.Column)).
+				Where("id > ? AND "+column.Column+" IS NOT NULL AND "+condition, lastID, len(prefix), prefixValue).
+				Order("id").Limit(rotateBatchSize).
+				Scan(&rows).Error
+			if err != nil {
+				return err
+			}
+			if len(rows) == 0 {
+				return nil
+			}
+
+			for _, row := range rows {
+				lastID = row.ID
+				var reencrypted interface{}
+				if column.Binary {
+					var plain EncryptedBytes
+					if err := plain.Scan(row.Value); err != nil {
+						return fmt.Errorf("record %d: %w", row.ID, err)
+					}
+					reencrypted = plain
+				} else {
+					var plain EncryptedString
+					if err := plain.Scan(row.Value); err != nil {
+						return fmt.Errorf("record %d: %w", row.ID, err)
+					}
+					reencrypted = plain
+				}
+				err := tx.Table(column.Table).Where("id = ?", row.ID).
+					UpdateColumn(column.Column, reencrypted).Error
+				if err != nil {
+					return err
+				}
+				count++
+			}
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
@@ -0,0 +1,127 @@
+package crypto
+
+import (
+	"database/sql/driver"
+	"fmt"
+)
+
+// redacted replaces encrypted values when they are printed
+const redacted = "********"
+
+// EncryptedString is a string column encrypted at rest: it is sealed with
+// the current key when saved and opened when loaded. Values stored before
+// encryption was enabled load as they are, until the next rotation
+// encrypts them. Printing the value shows a placeholder, so it cannot end
+// up in logs; convert it to a string to use it.
+type EncryptedString string
+
+// Value encrypts the string for the database, storing it as is when no
+// key is configured
+func (s EncryptedString) Value() (driver.Value, error) {
+	if s == "" || !Enabled() {
+		return string(s), nil
+	}
+	return Encrypt([]byte(s))
+}
+
+// Scan decrypts a value loaded from the database
+func (s *EncryptedString) Scan(src interface{}) error {
+	value, err := scanText(src)
+	if err != nil || !IsEncrypted(value) {
+		*s = EncryptedString(value)
+		return err
+	}
+	plaintext, err := Decrypt(value)
+	if err != nil {
+		return err
+	}
+	*s = EncryptedString(plaintext)
+	return nil
+}
+
+// GormDataType stores encrypted strings as text
+func (EncryptedString) GormDataType() string {
+	return "text"
+}
+
+func (s EncryptedString) String() string {
+	if s == "" {
+		return ""
+	}
+	return redacted
+}
+
+func (s EncryptedString) GoString() string {
+	return fmt.Sprintf("crypto.EncryptedString(%q)", s.String())
+}
+
+// EncryptedBytes is a binary column encrypted at rest, like EncryptedString
+type EncryptedBytes []byte
+
+// Value encrypts the bytes for the database, storing them as they are
+// when no key is configured
+func (b EncryptedBytes) Value() (driver.Value, error) {
+	if b == nil {
+		return nil, nil
+	}
+	if !Enabled() {
+		return []byte(b), nil
+	}
+	sealed, err := Encrypt(b)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(sealed), nil
+}
+
+// Scan decrypts a value loaded from the database
+func (b *EncryptedBytes) Scan(src interface{}) error {
+	if src == nil {
+		*b = nil
+		return nil
+	}
+	value, err := scanText(src)
+	if err != nil {
+		return err
+	}
+	if !IsEncrypted(value) {
+		*b = EncryptedBytes(value)
+		return nil
+	}
+	plaintext, err := Decrypt(value)
+	if err != nil {
+		return err
+	}
+	*b = plaintext
+	return nil
+}
+
+// GormDataType stores encrypted bytes as bytea
+func (EncryptedBytes) GormDataType() string {
+	return "bytea"
+}
+
+func (b EncryptedBytes) String() string {
+	if len(b) == 0 {
+		return ""
+	}
+	return redacted
+}
+
+func (b EncryptedBytes) GoString() string {
+	return fmt.Sprintf("crypto.EncryptedBytes(%q)", b.String())
+}
+
+// scanText reads a text or binary database value
+func scanText(src interface{}) (string, error) {
+	switch v := src.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	default:
+		return "", fmt.Errorf("cannot scan %T into an encrypted value", src)
+	}
+}
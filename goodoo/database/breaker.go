@@ -0,0 +1,273 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"goodoo/capability"
+	"goodoo/logging"
+)
+
+// Breaker states of a database
+const (
+	BreakerClosed = "closed"
+	BreakerOpen   = "open"
+)
+
+// ErrDatabaseUnavailable is matched by the errors of connections refused
+// while the breaker of a database is open
+var ErrDatabaseUnavailable = errors.New("database unavailable")
+
+// UnavailableError is returned by GetConnection without dialing while the
+// breaker of a database is open, i.e. until a background probe reaches it
+// again
+type UnavailableError struct {
+	DB      string
+	RetryAt time.Time
+	Cause   error
+}
+
+func (e *UnavailableError) Error() string {
+	return fmt.Sprintf("database %s is unavailable: %v", e.DB, e.Cause)
+}
+
+// Is matches ErrDatabaseUnavailable
+func (e *UnavailableError) Is(target error) bool {
+	return target == ErrDatabaseUnavailable
+}
+
+// Unwrap returns the error of the failed connection
+func (e *UnavailableError) Unwrap() error {
+	return e.Cause
+}
+
+// BreakerConfig holds the backoff of the probes of an unreachable database
+type BreakerConfig struct {
+	// Backoff is the delay before the first probe, doubled after each
+	// failed probe up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// DefaultBreakerConfig returns probes from 1 second to 30 seconds apart
+func DefaultBreakerConfig() *BreakerConfig {
+	return &BreakerConfig{
+		Backoff:    time.Second,
+		MaxBackoff: 30 * time.Second,
+	}
+}
+
+// LoadFromEnv overrides the configuration with GOODOO_DB_BREAKER_BACKOFF
+// and GOODOO_DB_BREAKER_MAX_BACKOFF
+func (c *BreakerConfig) LoadFromEnv() {
+	durations := map[string]*time.Duration{
+		"GOODOO_DB_BREAKER_BACKOFF":     &c.Backoff,
+		"GOODOO_DB_BREAKER_MAX_BACKOFF": &c.MaxBackoff,
+	}
+	for name, target := range durations {
+		if value := os.Getenv(name); value != "" {
+			if d, err := time.ParseDuration(value); err == nil && d > 0 {
+				*target = d
+			}
+		}
+	}
+}
+
+var (
+	breakerConfig = DefaultBreakerConfig()
+	breakerMutex  sync.Mutex
+	breakerLogger = logging.GetLogger("goodoo.database.breaker")
+)
+
+// SetupBreaker installs the process-wide breaker configuration
+func SetupBreaker(c *BreakerConfig) {
+	breakerMutex.Lock()
+	defer breakerMutex.Unlock()
+	breakerConfig = c
+}
+
+// BreakerStatus is the breaker state of a database
+type BreakerStatus struct {
+	Name  string `json:"name"`
+	State string `json:"state"`
+	// Failures counts the failed connection and probes since it opened
+	Failures int        `json:"failures,omitempty"`
+	OpenedAt *time.Time `json:"opened_at,omitempty"`
+	RetryAt  *time.Time `json:"retry_at,omitempty"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// breaker fails the connections to a database fast after a failure, while
+// a single probe retries with backoff. It has its own lock so that checks
+// do not wait behind a connection being dialed.
+type breaker struct {
+	mutex    sync.Mutex
+	open     bool
+	failures int
+	openedAt time.Time
+	retryAt  time.Time
+	backoff  time.Duration
+	err      error
+}
+
+// check returns an UnavailableError while the breaker is open
+func (b *breaker) check(dbName string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if !b.open {
+		return nil
+	}
+	return &UnavailableError{DB: dbName, RetryAt: b.retryAt, Cause: b.err}
+}
+
+// status returns the state of the breaker
+func (b *breaker) status(dbName string) BreakerStatus {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if !b.open {
+		return BreakerStatus{Name: dbName, State: BreakerClosed}
+	}
+	openedAt, retryAt := b.openedAt, b.retryAt
+	return BreakerStatus{
+		Name:     dbName,
+		State:    BreakerOpen,
+		Failures: b.failures,
+		OpenedAt: &openedAt,
+		RetryAt:  &retryAt,
+		Error:    b.err.Error(),
+	}
+}
+
+// trip opens the breaker after a failed connection and reports whether it
+// was closed, in which case the caller starts the probe
+func (b *breaker) trip(err error) bool {
+	breakerMutex.Lock()
+	backoff := breakerConfig.Backoff
+	breakerMutex.Unlock()
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.open {
+		return false
+	}
+	now := time.Now()
+	b.open = true
+	b.failures = 1
+	b.openedAt = now
+	b.backoff = backoff
+	b.retryAt = now.Add(backoff)
+	b.err = err
+	return true
+}
+
+// failed records a failed probe and returns the delay before the next one
+func (b *breaker) failed(err error) time.Duration {
+	breakerMutex.Lock()
+	maxBackoff := breakerConfig.MaxBackoff
+	breakerMutex.Unlock()
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.backoff *= 2; b.backoff > maxBackoff {
+		b.backoff = maxBackoff
+	}
+	b.failures++
+	b.retryAt = time.Now().Add(b.backoff)
+	b.err = err
+	return b.backoff
+}
+
+// reset closes the breaker and returns how long it was open
+func (b *breaker) reset() time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.open = false
+	b.failures = 0
+	b.err = nil
+	return time.Since(b.openedAt)
+}
+
+// trip opens the breaker of a database after a failed connection; the
+// first failure logs and starts the probe, the others are already covered
+func (r *DatabaseRegistry) trip(dbInfo *DatabaseInfo, err error) {
+	if !dbInfo.breaker.trip(err) {
+		return
+	}
+	breakerLogger.Warning("Database %s is unavailable, failing connections fast until it answers: %v", dbInfo.Name, err)
+	capability.Degrade("database."+dbInfo.Name, "unreachable: "+err.Error())
+	go r.probe(dbInfo)
+}
+
+// probe dials a database with backoff until it answers or is unregistered,
+// then keeps the connection and closes the breaker
+func (r *DatabaseRegistry) probe(dbInfo *DatabaseInfo) {
+	dbInfo.breaker.mutex.Lock()
+	delay := time.Until(dbInfo.breaker.retryAt)
+	dbInfo.breaker.mutex.Unlock()
+	for {
+		time.Sleep(delay)
+		r.mutex.RLock()
+		registered := r.databases[dbInfo.Name] == dbInfo
+		r.mutex.RUnlock()
+		if !registered {
+			return
+		}
+
+		conn, err := r.dial(dbInfo.Config)
+		if err != nil {
+			delay = dbInfo.breaker.failed(err)
+			breakerLogger.Debug("Database %s is still unavailable, next probe in %v: %v", dbInfo.Name, delay, err)
+			continue
+		}
+
+		dbInfo.mutex.Lock()
+		if dbInfo.Connection == nil {
+			dbInfo.Connection = conn
+			dbInfo.Active = true
+			dbInfo.LastAccessed = time.Now()
+		} else {
+			conn.Close()
+		}
+		dbInfo.mutex.Unlock()
+		downtime := dbInfo.breaker.reset()
+		breakerLogger.Info("Database %s is available again after %v", dbInfo.Name, downtime.Round(time.Millisecond))
+		capability.Enable("database."+dbInfo.Name, "available again after "+downtime.Round(time.Second).String())
+		return
+	}
+}
+
+// CheckAvailable returns an UnavailableError while the breaker of a
+// registered database is open, nil otherwise
+func CheckAvailable(dbName string) error {
+	r := GetRegistry()
+	r.mutex.RLock()
+	dbInfo, exists := r.databases[dbName]
+	r.mutex.RUnlock()
+	if !exists {
+		return nil
+	}
+	return dbInfo.breaker.check(dbName)
+}
+
+// BreakerStatuses returns the breaker state of the registered databases by
+// name
+func (r *DatabaseRegistry) BreakerStatuses() []BreakerStatus {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	statuses := make([]BreakerStatus, 0, len(r.databases))
+	for name, dbInfo := range r.databases {
+		statuses = append(statuses, dbInfo.breaker.status(name))
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// BreakerStatuses returns the breaker state of the databases of the global
+// registry
+func BreakerStatuses() []BreakerStatus {
+	return GetRegistry().BreakerStatuses()
+}
@@ -0,0 +1,195 @@
+package database
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"goodoo/logging"
+)
+
+// stubDialer fails its first failures dials after waiting delay, then
+// answers with a connection
+type stubDialer struct {
+	delay    time.Duration
+	failures int32
+	dials    atomic.Int32
+}
+
+func (d *stubDialer) dial(config *ConnectionConfig) (*Connection, error) {
+	n := d.dials.Add(1)
+	time.Sleep(d.delay)
+	if n <= d.failures {
+		return nil, errors.New("dial tcp 192.0.2.1:5432: connect: connection refused")
+	}
+	return &Connection{config: config}, nil
+}
+
+// logCounter counts the records of the breaker from a level up
+type logCounter struct {
+	level logging.LogLevel
+	count atomic.Int32
+}
+
+func (c *logCounter) Emit(record *logging.LogRecord) error {
+	if record.Level >= c.level {
+		c.count.Add(1)
+	}
+	return nil
+}
+
+func (c *logCounter) Close() error { return nil }
+
+// newBreakerRegistry returns a registry of the database breaker_test
+// dialed by d, with probes backing off as config tells, and the counter
+// of the warnings and infos of the breaker
+func newBreakerRegistry(t *testing.T, d *stubDialer, config *BreakerConfig) (*DatabaseRegistry, *logCounter) {
+	SetupBreaker(config)
+	logs := &logCounter{level: logging.INFO}
+	breakerLogger.AddHandler(logs)
+	r := &DatabaseRegistry{databases: make(map[string]*DatabaseInfo), pool: GetPool(), dial: d.dial}
+	if err := r.Register("breaker_test", &ConnectionConfig{Database: "breaker_test"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		// Stops the probe at its next wake-up
+		r.Unregister("breaker_test")
+		breakerLogger.RemoveHandler(logs)
+		SetupBreaker(DefaultBreakerConfig())
+	})
+	return r, logs
+}
+
+// TestBreakerTrips simulates an outage: a single request waits out the
+// failed dial, the others fail fast without dialing or logging
+func TestBreakerTrips(t *testing.T) {
+	d := &stubDialer{delay: 100 * time.Millisecond, failures: 1 << 30}
+	r, logs := newBreakerRegistry(t, d, &BreakerConfig{Backoff: time.Hour, MaxBackoff: time.Hour})
+
+	var wg sync.WaitGroup
+	var unavailable atomic.Int32
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := r.GetConnection("breaker_test"); errors.Is(err, ErrDatabaseUnavailable) {
+				unavailable.Add(1)
+			} else if err == nil {
+				t.Error("connected to an unreachable database")
+			}
+		}()
+	}
+	wg.Wait()
+	if dials := d.dials.Load(); dials != 1 {
+		t.Errorf("%d dials for 50 concurrent requests, want 1", dials)
+	}
+	if got := unavailable.Load(); got != 49 {
+		t.Errorf("%d requests failed fast, want 49", got)
+	}
+
+	start := time.Now()
+	for i := 0; i < 10000; i++ {
+		_, err := r.GetConnection("breaker_test")
+		var unavailable *UnavailableError
+		if !errors.As(err, &unavailable) || unavailable.DB != "breaker_test" || unavailable.Cause == nil {
+			t.Fatalf("GetConnection while tripped = %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > d.delay {
+		t.Errorf("10000 requests while tripped took %v, longer than one dial", elapsed)
+	}
+	if dials := d.dials.Load(); dials != 1 {
+		t.Errorf("%d dials while tripped, want 1", dials)
+	}
+	if n := logs.count.Load(); n != 1 {
+		t.Errorf("%d records logged during the outage, want 1", n)
+	}
+
+	stats := r.Stats()
+	if stats.TrippedDatabases != 1 || len(stats.Breakers) != 1 || stats.Breakers[0].State != BreakerOpen || stats.Breakers[0].Failures != 1 {
+		t.Errorf("Stats = %+v", stats)
+	}
+}
+
+// TestBreakerRecovers probes the database with backoff until it answers,
+// then keeps the connection and closes the breaker
+func TestBreakerRecovers(t *testing.T) {
+	d := &stubDialer{failures: 4}
+	r, logs := newBreakerRegistry(t, d, &BreakerConfig{Backoff: time.Millisecond, MaxBackoff: 4 * time.Millisecond})
+
+	if _, err := r.GetConnection("breaker_test"); err == nil {
+		t.Fatal("the first dial succeeded")
+	}
+	// The recovery is logged once the breaker is closed
+	deadline := time.Now().Add(5 * time.Second)
+	for r.BreakerStatuses()[0].State == BreakerOpen || logs.count.Load() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the breaker is still open after %d dials", d.dials.Load())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if dials := d.dials.Load(); dials != 5 {
+		t.Errorf("%d dials, want 5: the failed one, 3 failed probes and the last", dials)
+	}
+	info, err := r.GetDatabaseInfo("breaker_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Active {
+		t.Error("the connection of the probe is not kept")
+	}
+	if stats := r.Stats(); stats.TrippedDatabases != 0 || len(stats.Breakers) != 0 {
+		t.Errorf("Stats after recovery = %+v", stats)
+	}
+	// The opening and the recovery, not the probes
+	if n := logs.count.Load(); n != 2 {
+		t.Errorf("%d records logged, want 2", n)
+	}
+}
+
+func TestBreakerBackoff(t *testing.T) {
+	SetupBreaker(&BreakerConfig{Backoff: time.Second, MaxBackoff: 5 * time.Second})
+	defer SetupBreaker(DefaultBreakerConfig())
+
+	b := &breaker{}
+	cause := errors.New("refused")
+	if !b.trip(cause) || b.trip(cause) {
+		t.Fatal("trip does not report the first failure alone")
+	}
+	for i, want := range []time.Duration{2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if got := b.failed(cause); got != want {
+			t.Errorf("backoff after probe %d = %v, want %v", i+1, got, want)
+		}
+	}
+	status := b.status("breaker_test")
+	if status.State != BreakerOpen || status.Failures != 5 || status.Error != "refused" || status.RetryAt == nil {
+		t.Errorf("status = %+v", status)
+	}
+	b.reset()
+	if err := b.check("breaker_test"); err != nil {
+		t.Errorf("check after reset = %v", err)
+	}
+}
+
+// TestCheckAvailable fails fast on the databases of the global registry
+// whose breaker is open, and ignores unknown ones
+func TestCheckAvailable(t *testing.T) {
+	d := &stubDialer{failures: 1 << 30}
+	r, _ := newBreakerRegistry(t, d, &BreakerConfig{Backoff: time.Hour, MaxBackoff: time.Hour})
+	previous := GetRegistry()
+	SetRegistry(r)
+	defer SetRegistry(previous)
+
+	if err := CheckAvailable("breaker_test"); err != nil {
+		t.Errorf("CheckAvailable before any failure = %v", err)
+	}
+	r.GetConnection("breaker_test")
+	if err := CheckAvailable("breaker_test"); !errors.Is(err, ErrDatabaseUnavailable) {
+		t.Errorf("CheckAvailable while tripped = %v", err)
+	}
+	if err := CheckAvailable("breaker_test_unknown"); err != nil {
+		t.Errorf("CheckAvailable of an unknown database = %v", err)
+	}
+}
@@ -20,6 +20,9 @@ type ConnectionConfig struct {
 	MaxIdleConns int
 	AppName      string
 	DSN          string // Direct DSN if provided
+	// Timeouts are sent as session settings of every connection; nil
+	// takes TimeoutsFor(Database)
+	Timeouts *SessionTimeouts
 }
 
 // DefaultConfig returns a default configuration
@@ -32,10 +35,30 @@ func DefaultConfig() *ConnectionConfig {
 		Database:     "apexive-hackaton",
 		MaxOpenConns: 64,
 		MaxIdleConns: 16,
-		AppName:      fmt.Sprintf("goodoo-%d", os.Getpid()),
+		AppName:      trimAppName(fmt.Sprintf("goodoo-%s-%d", InstanceID(), os.Getpid())),
 	}
 }
 
+// InstanceID identifies this server among those sharing a database, in
+// application_name: GOODOO_INSTANCE_ID, or the host name
+func InstanceID() string {
+	if id := os.Getenv("GOODOO_INSTANCE_ID"); id != "" {
+		return id
+	}
+	if host, err := os.Hostname(); err == nil && host != "" {
+		return host
+	}
+	return "local"
+}
+
+// trimAppName trims an application name to the PostgreSQL NAMEDATALEN limit
+func trimAppName(name string) string {
+	if len(name) > 63 {
+		return name[:63]
+	}
+	return name
+}
+
 // LoadFromEnv loads configuration from environment variables
 func (c *ConnectionConfig) LoadFromEnv() {
 	if host := os.Getenv("DB_HOST"); host != "" {
@@ -64,13 +87,19 @@ func (c *ConnectionConfig) LoadFromEnv() {
 		}
 	}
 	if appName := os.Getenv("GOODOO_PGAPPNAME"); appName != "" {
-		// Support {pid} placeholder like Odoo
-		c.AppName = strings.ReplaceAll(appName, "{pid}", strconv.Itoa(os.Getpid()))
-		// Trim to PostgreSQL NAMEDATALEN limit
-		if len(c.AppName) > 63 {
-			c.AppName = c.AppName[:63]
-		}
+		// Support {pid} placeholder like Odoo, and {instance}
+		appName = strings.ReplaceAll(appName, "{pid}", strconv.Itoa(os.Getpid()))
+		c.AppName = trimAppName(strings.ReplaceAll(appName, "{instance}", InstanceID()))
+	}
+}
+
+// SessionTimeouts returns the timeouts sent by the connections of the
+// configuration
+func (c *ConnectionConfig) SessionTimeouts() SessionTimeouts {
+	if c.Timeouts != nil {
+		return *c.Timeouts
 	}
+	return TimeoutsFor(c.Database)
 }
 
 // ParseConnectionInfo parses a database name or URI and returns database name and connection params
@@ -115,9 +144,28 @@ func parseURI(uri string, config *ConnectionConfig) (string, *ConnectionConfig,
 
 // BuildDSN builds a PostgreSQL DSN from the configuration
 func (c *ConnectionConfig) BuildDSN() string {
+	// The timeouts are startup parameters: every session of the pool
+	// begins with them, and RESET goes back to them
+	settings := c.SessionTimeouts().settings()
+
 	// If we have a direct DSN, use it
 	if c.DSN != "" {
-		return c.DSN
+		dsn := c.DSN
+		uri := strings.HasPrefix(dsn, "postgresql://") || strings.HasPrefix(dsn, "postgres://")
+		for _, setting := range settings {
+			if strings.Contains(dsn, setting[0]+"=") {
+				continue
+			}
+			switch {
+			case uri && strings.Contains(dsn, "?"):
+				dsn += "&" + setting[0] + "=" + setting[1]
+			case uri:
+				dsn += "?" + setting[0] + "=" + setting[1]
+			default:
+				dsn += " " + setting[0] + "=" + setting[1]
+			}
+		}
+		return dsn
 	}
 
 	// Build DSN from individual components
@@ -144,6 +192,9 @@ func (c *ConnectionConfig) BuildDSN() string {
 	if c.AppName != "" {
 		parts = append(parts, fmt.Sprintf("application_name=%s", c.AppName))
 	}
+	for _, setting := range settings {
+		parts = append(parts, setting[0]+"="+setting[1])
+	}
 
 	return strings.Join(parts, " ")
 }
@@ -175,5 +226,6 @@ func (c *ConnectionConfig) Clone() *ConnectionConfig {
 		MaxIdleConns: c.MaxIdleConns,
 		AppName:      c.AppName,
 		DSN:          c.DSN,
+		Timeouts:     c.Timeouts,
 	}
 }
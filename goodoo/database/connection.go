@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 	
 	"gorm.io/gorm"
@@ -43,9 +44,10 @@ func (c *Connection) Cursor() *Cursor {
 	}
 }
 
-// Transaction executes a function within a database transaction
-func (c *Connection) Transaction(fn func(*gorm.DB) error) error {
-	return c.db.Transaction(fn)
+// Transaction executes a function within a database transaction, retrying
+// serialization failures unless opts marks the function non-idempotent
+func (c *Connection) Transaction(fn func(*gorm.DB) error, opts ...RetryOptions) error {
+	return RetryableTransaction(c.db.Statement.Context, c.db, fn, opts...)
 }
 
 // Ping tests the database connection
@@ -62,10 +64,22 @@ func (c *Connection) Ping() error {
 type Cursor struct {
 	db         *gorm.DB
 	connection *Connection
-	savepoints []string
+	// savepoints are the open savepoints, innermost last
+	savepoints []*Savepoint
 	mutex      sync.Mutex
 }
 
+// NewCursor returns a cursor over a session or a transaction already begun,
+// e.g. the ambient transaction of a request
+func NewCursor(db *gorm.DB) *Cursor {
+	return &Cursor{db: db}
+}
+
+// DB returns the session of the cursor, the transaction once begun
+func (c *Cursor) DB() *gorm.DB {
+	return c.db
+}
+
 // Execute executes a raw SQL query
 func (c *Cursor) Execute(query string, args ...interface{}) error {
 	return c.db.Exec(query, args...).Error
@@ -82,17 +96,20 @@ func (c *Cursor) Begin() error {
 	return c.db.Error
 }
 
-// Commit commits the current transaction
+// Commit commits the current transaction, which ends its savepoints
 func (c *Cursor) Commit() error {
+	c.forget(nil, true)
 	return c.db.Commit().Error
 }
 
-// Rollback rolls back the current transaction
+// Rollback rolls back the current transaction, which ends its savepoints
 func (c *Cursor) Rollback() error {
+	c.forget(nil, true)
 	return c.db.Rollback().Error
 }
 
-// Savepoint creates a new savepoint similar to Odoo's Savepoint
+// Savepoint creates a new savepoint similar to Odoo's Savepoint. Savepoints
+// nest: releasing or rolling back to one ends the savepoints created after it.
 func (c *Cursor) Savepoint() (*Savepoint, error) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
@@ -102,15 +119,78 @@ func (c *Cursor) Savepoint() (*Savepoint, error) {
 		return nil, err
 	}
 	
-	c.savepoints = append(c.savepoints, sp.Name())
+	c.savepoints = append(c.savepoints, sp)
 	return sp, nil
 }
 
+// Savepoints returns the names of the open savepoints, innermost last
+func (c *Cursor) Savepoints() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	
+	names := make([]string, len(c.savepoints))
+	for i, sp := range c.savepoints {
+		names[i] = sp.name
+	}
+	return names
+}
+
+// forget drops the savepoints created after sp, and sp itself when
+// inclusive, as PostgreSQL ends them; a nil sp forgets every savepoint
+func (c *Cursor) forget(sp *Savepoint, inclusive bool) {
+	c.mutex.Lock()
+	index := 0
+	if sp != nil {
+		index = -1
+		for i, open := range c.savepoints {
+			if open == sp {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			c.mutex.Unlock()
+			return
+		}
+		if !inclusive {
+			index++
+		}
+	}
+	ended := append([]*Savepoint(nil), c.savepoints[index:]...)
+	c.savepoints = c.savepoints[:index]
+	c.mutex.Unlock()
+	
+	for _, open := range ended {
+		if open != sp {
+			open.markClosed()
+		}
+	}
+}
+
 // Connection returns the associated connection
 func (c *Cursor) Connection() *Connection {
 	return c.connection
 }
 
+// cursorKey carries the cursor of a context
+type cursorKey struct{}
+
+// ContextWithCursor returns a context whose ambient cursor is cursor, so
+// that the code it runs joins the cursor's transaction and nests its
+// savepoints in the cursor's
+func ContextWithCursor(ctx context.Context, cursor *Cursor) context.Context {
+	return context.WithValue(ctx, cursorKey{}, cursor)
+}
+
+// CursorFromContext returns the ambient cursor of a context, or nil
+func CursorFromContext(ctx context.Context) *Cursor {
+	if ctx == nil {
+		return nil
+	}
+	cursor, _ := ctx.Value(cursorKey{}).(*Cursor)
+	return cursor
+}
+
 // Savepoint represents a database savepoint
 type Savepoint struct {
 	name   string
@@ -119,10 +199,14 @@ type Savepoint struct {
 	mutex  sync.Mutex
 }
 
+// savepointSequence numbers savepoints, so that savepoints created in the
+// same nanosecond get distinct names
+var savepointSequence atomic.Uint64
+
 // NewSavepoint creates a new savepoint
 func NewSavepoint(cursor *Cursor) *Savepoint {
 	return &Savepoint{
-		name:   fmt.Sprintf("sp_%d", time.Now().UnixNano()),
+		name:   fmt.Sprintf("sp_%d_%d", time.Now().UnixNano(), savepointSequence.Add(1)),
 		cursor: cursor,
 	}
 }
@@ -144,29 +228,43 @@ func (s *Savepoint) Create() error {
 	return s.cursor.Execute(fmt.Sprintf("SAVEPOINT %s", s.name))
 }
 
-// Rollback rolls back to this savepoint
+// Rollback rolls back to this savepoint, which stays open; the savepoints
+// created after it end
 func (s *Savepoint) Rollback() error {
 	s.mutex.Lock()
-	defer s.mutex.Unlock()
-	
 	if s.closed {
+		s.mutex.Unlock()
 		return fmt.Errorf("savepoint already closed")
 	}
+	err := s.cursor.Execute(fmt.Sprintf("ROLLBACK TO SAVEPOINT %s", s.name))
+	s.mutex.Unlock()
 	
-	return s.cursor.Execute(fmt.Sprintf("ROLLBACK TO SAVEPOINT %s", s.name))
+	if err == nil {
+		s.cursor.forget(s, false)
+	}
+	return err
 }
 
-// Release releases the savepoint
+// Release releases the savepoint and the savepoints created after it
 func (s *Savepoint) Release() error {
 	s.mutex.Lock()
-	defer s.mutex.Unlock()
-	
 	if s.closed {
+		s.mutex.Unlock()
 		return nil
 	}
+	s.closed = true
+	err := s.cursor.Execute(fmt.Sprintf("RELEASE SAVEPOINT %s", s.name))
+	s.mutex.Unlock()
 	
+	s.cursor.forget(s, true)
+	return err
+}
+
+// markClosed marks a savepoint ended by its transaction or an outer savepoint
+func (s *Savepoint) markClosed() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	s.closed = true
-	return s.cursor.Execute(fmt.Sprintf("RELEASE SAVEPOINT %s", s.name))
 }
 
 // Close closes the savepoint (rollback by default)
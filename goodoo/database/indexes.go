@@ -0,0 +1,191 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// IndexUsage is an index of a table with its key columns and how often it
+// was scanned since the statistics were reset
+type IndexUsage struct {
+	Schema string `json:"schema"`
+	Table  string `json:"table"`
+	Name   string `json:"name"`
+	// Columns are the key columns in order; expressions are left out
+	Columns    []string `json:"columns"`
+	Unique     bool     `json:"unique"`
+	Primary    bool     `json:"primary"`
+	Valid      bool     `json:"valid"`
+	Scans      int64    `json:"scans"`
+	SizeBytes  int64    `json:"size_bytes"`
+	Definition string   `json:"definition"`
+}
+
+// indexUsageQuery lists the indexes of the user tables with their key
+// columns (empty names for expressions) and their usage
+const indexUsageQuery = `
+SELECT s.schemaname AS schema, s.relname AS "table", s.indexrelname AS name,
+       COALESCE((SELECT string_agg(COALESCE(a.attname, ''), ',' ORDER BY k.n)
+                 FROM unnest(i.indkey[0:i.indnkeyatts - 1]) WITH ORDINALITY AS k(attnum, n)
+                 LEFT JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = k.attnum AND k.attnum > 0), '') AS columns,
+       i.indisunique AS "unique", i.indisprimary AS "primary", i.indisvalid AS valid,
+       COALESCE(s.idx_scan, 0) AS scans,
+       pg_relation_size(s.indexrelid) AS size_bytes,
+       pg_get_indexdef(s.indexrelid) AS definition
+FROM pg_stat_user_indexes s
+JOIN pg_index i ON i.indexrelid = s.indexrelid
+ORDER BY s.relname, s.indexrelname`
+
+// IndexUsages returns the indexes of the user tables of a database
+func IndexUsages(dbName string) ([]IndexUsage, error) {
+	db, err := GetDatabase(dbName)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []struct {
+		Schema     string
+		Table      string
+		Name       string
+		Columns    string
+		Unique     bool
+		Primary    bool
+		Valid      bool
+		Scans      int64
+		SizeBytes  int64
+		Definition string
+	}
+	if err := db.Raw(indexUsageQuery).Scan(&rows).Error; err != nil {
+		return nil, fmt.Errorf("failed to read the indexes of %s: %w", dbName, err)
+	}
+
+	indexes := make([]IndexUsage, len(rows))
+	for i, row := range rows {
+		indexes[i] = IndexUsage{
+			Schema:     row.Schema,
+			Table:      row.Table,
+			Name:       row.Name,
+			Unique:     row.Unique,
+			Primary:    row.Primary,
+			Valid:      row.Valid,
+			Scans:      row.Scans,
+			SizeBytes:  row.SizeBytes,
+			Definition: row.Definition,
+		}
+		if row.Columns != "" {
+			indexes[i].Columns = strings.Split(row.Columns, ",")
+		}
+	}
+	return indexes, nil
+}
+
+// StatsSince returns when the usage statistics of a database started
+// counting: their last reset, or the start of the server
+func StatsSince(dbName string) (time.Time, error) {
+	db, err := GetDatabase(dbName)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var since time.Time
+	query := `SELECT COALESCE(stats_reset, pg_postmaster_start_time()) FROM pg_stat_database WHERE datname = current_database()`
+	if err := db.Raw(query).Scan(&since).Error; err != nil {
+		return time.Time{}, fmt.Errorf("failed to read the statistics reset of %s: %w", dbName, err)
+	}
+	return since, nil
+}
+
+// PlanScan is a scan of a table in an execution plan
+type PlanScan struct {
+	// Node is the plan node, like "Seq Scan" or "Index Scan"
+	Node     string `json:"node"`
+	Relation string `json:"relation"`
+	Index    string `json:"index,omitempty"`
+	// Filter is the condition applied to each row read, as printed by
+	// EXPLAIN, like "((state)::text = 'sale'::text)"
+	Filter string  `json:"filter,omitempty"`
+	Rows   float64 `json:"rows"`
+	Cost   float64 `json:"cost"`
+}
+
+// Plan is the estimated execution plan of a statement
+type Plan struct {
+	Cost  float64    `json:"cost"`
+	Scans []PlanScan `json:"scans"`
+}
+
+// ErrNotExplainable is returned for statements other than a single SELECT
+var ErrNotExplainable = errors.New("only single SELECT statements are explained")
+
+// explainTimeout bounds the planning of a statement
+const explainTimeout = 5 * time.Second
+
+// planNode is a node of the JSON output of EXPLAIN
+type planNode struct {
+	NodeType     string     `json:"Node Type"`
+	RelationName string     `json:"Relation Name"`
+	IndexName    string     `json:"Index Name"`
+	Filter       string     `json:"Filter"`
+	PlanRows     float64    `json:"Plan Rows"`
+	TotalCost    float64    `json:"Total Cost"`
+	Plans        []planNode `json:"Plans"`
+}
+
+// Explain returns the estimated plan of a SELECT statement of a database.
+// The statement is planned, not run, in a read-only transaction.
+func Explain(dbName, statement string) (*Plan, error) {
+	statement = strings.TrimSuffix(strings.TrimSpace(statement), ";")
+	if !strings.HasPrefix(strings.ToLower(statement), "select") || strings.Contains(statement, ";") {
+		return nil, ErrNotExplainable
+	}
+	db, err := GetDatabase(dbName)
+	if err != nil {
+		return nil, err
+	}
+
+	var output string
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SET TRANSACTION READ ONLY").Error; err != nil {
+			return err
+		}
+		if err := tx.Exec(fmt.Sprintf("SET LOCAL statement_timeout = %d", explainTimeout.Milliseconds())).Error; err != nil {
+			return err
+		}
+		return tx.Raw("EXPLAIN (FORMAT JSON) " + statement).Row().Scan(&output)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to explain the statement: %w", err)
+	}
+
+	var roots []struct {
+		Plan planNode `json:"Plan"`
+	}
+	if err := json.Unmarshal([]byte(output), &roots); err != nil || len(roots) == 0 {
+		return nil, fmt.Errorf("unexpected EXPLAIN output: %v", err)
+	}
+	plan := &Plan{Cost: roots[0].Plan.TotalCost}
+	collectScans(&roots[0].Plan, plan)
+	return plan, nil
+}
+
+// collectScans adds the scans of a plan node and its children to plan
+func collectScans(node *planNode, plan *Plan) {
+	if node.RelationName != "" {
+		plan.Scans = append(plan.Scans, PlanScan{
+			Node:     node.NodeType,
+			Relation: node.RelationName,
+			Index:    node.IndexName,
+			Filter:   node.Filter,
+			Rows:     node.PlanRows,
+			Cost:     node.TotalCost,
+		})
+	}
+	for i := range node.Plans {
+		collectScans(&node.Plans[i], plan)
+	}
+}
@@ -47,7 +47,8 @@ func Initialize(opts *InitOptions) error {
 		},
 	)
 	
-	pool.SetLogger(customLogger)
+	pool.SetLogger(NewTracingLogger(customLogger))
+	SetSlowQueryThreshold(opts.SlowThreshold)
 	SetPool(pool)
 	
 	return nil
@@ -89,6 +90,25 @@ func ConnectWithEnv(dbName string) (*Connection, error) {
 	return pool.Borrow(config)
 }
 
+// QuickRegister registers a database with the settings of the environment,
+// without migrating it; a database already registered is left as is
+func QuickRegister(dbName string) error {
+	config := DefaultConfig()
+	config.LoadFromEnv()
+	config.Database = dbName
+	if err := config.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	
+	if err := Initialize(DefaultInitOptions()); err != nil {
+		return fmt.Errorf("failed to initialize database system: %w", err)
+	}
+	if _, err := GetRegistry().GetDatabaseInfo(dbName); err == nil {
+		return nil
+	}
+	return GetRegistry().Register(dbName, config)
+}
+
 // QuickSetup provides a quick way to set up a database with default settings
 func QuickSetup(dbName string, models ...interface{}) error {
 	config := DefaultConfig()
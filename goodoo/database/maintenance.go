@@ -0,0 +1,253 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"gorm.io/gorm"
+)
+
+// Maintenance actions run by Connection.Maintain
+const (
+	MaintenanceAnalyze    = "analyze"
+	MaintenanceVacuum     = "vacuum"
+	MaintenanceVacuumFull = "vacuum_full"
+	MaintenanceReindex    = "reindex"
+)
+
+// maintenanceStatements are the statements of the actions; VACUUM FULL and
+// REINDEX lock the table while they rebuild it
+var maintenanceStatements = map[string]string{
+	MaintenanceAnalyze:    "ANALYZE %s",
+	MaintenanceVacuum:     "VACUUM (ANALYZE) %s",
+	MaintenanceVacuumFull: "VACUUM (FULL, ANALYZE) %s",
+	MaintenanceReindex:    "REINDEX TABLE %s",
+}
+
+// ValidMaintenanceAction reports whether action names a maintenance action
+func ValidMaintenanceAction(action string) bool {
+	_, ok := maintenanceStatements[action]
+	return ok
+}
+
+// ErrMaintenanceRunning is returned when a table is already being
+// maintained, by this process or another
+var ErrMaintenanceRunning = errors.New("maintenance of the table is already running")
+
+// MaintenanceOptions bound a maintenance statement
+type MaintenanceOptions struct {
+	// StatementTimeout cancels the statement when it runs longer
+	StatementTimeout time.Duration
+	// LockTimeout gives up when the table stays locked by other sessions
+	LockTimeout time.Duration
+}
+
+// DefaultMaintenanceOptions returns a statement timeout of an hour and a
+// lock timeout of a minute
+func DefaultMaintenanceOptions() MaintenanceOptions {
+	return MaintenanceOptions{StatementTimeout: time.Hour, LockTimeout: time.Minute}
+}
+
+// WithCursor runs fn with a cursor pinned to one session of the pool, for
+// session settings and statements that cannot run in a transaction
+func (c *Connection) WithCursor(ctx context.Context, fn func(cursor *Cursor) error) error {
+	return c.db.WithContext(ctx).Connection(func(session *gorm.DB) error {
+		return fn(&Cursor{db: session, connection: c})
+	})
+}
+
+// Maintain runs a maintenance action on a table of the database. An
+// advisory lock on the table keeps two maintenances of it from
+// overlapping across processes; ErrMaintenanceRunning is returned when it
+// is held.
+func (c *Connection) Maintain(ctx context.Context, action, schema, table string, opts MaintenanceOptions) error {
+	statement, ok := maintenanceStatements[action]
+	if !ok {
+		return fmt.Errorf("invalid maintenance action %q", action)
+	}
+	name := pgx.Identifier{schema, table}.Sanitize()
+
+	return c.WithCursor(ctx, func(cursor *Cursor) error {
+		lock := "goodoo.maintenance." + schema + "." + table
+		var locked bool
+		if err := cursor.Query(&locked, "SELECT pg_try_advisory_lock(hashtext(?))", lock); err != nil {
+			return err
+		}
+		if !locked {
+			return ErrMaintenanceRunning
+		}
+		// The session goes back to the pool: release the lock and the
+		// timeouts even when ctx was cancelled
+		defer func() {
+			session := cursor.db.WithContext(context.Background())
+			session.Exec("SELECT pg_advisory_unlock(hashtext(?))", lock)
+			session.Exec("RESET statement_timeout")
+			session.Exec("RESET lock_timeout")
+		}()
+
+		settings := map[string]time.Duration{
+			"statement_timeout": opts.StatementTimeout,
+			"lock_timeout":      opts.LockTimeout,
+		}
+		for setting, timeout := range settings {
+			if err := cursor.Execute("SELECT set_config(?, ?, false)", setting, strconv.FormatInt(timeout.Milliseconds(), 10)); err != nil {
+				return err
+			}
+		}
+		return cursor.Execute(fmt.Sprintf(statement, name))
+	})
+}
+
+// TableBloat is the estimated bloat of a table
+type TableBloat struct {
+	Schema       string  `json:"schema"`
+	Name         string  `json:"name"`
+	RealBytes    int64   `json:"real_bytes"`
+	BloatBytes   int64   `json:"bloat_bytes"`
+	BloatPercent float64 `json:"bloat_percent"`
+}
+
+// IndexBloat is the estimated bloat of a btree index
+type IndexBloat struct {
+	Schema       string  `json:"schema"`
+	Table        string  `json:"table"`
+	Name         string  `json:"name"`
+	RealBytes    int64   `json:"real_bytes"`
+	BloatBytes   int64   `json:"bloat_bytes"`
+	BloatPercent float64 `json:"bloat_percent"`
+}
+
+// tableBloatQuery estimates the bloat of tables from the planner
+// statistics (the widely used pgsql-bloat-estimation query); tables whose
+// statistics are missing or unusable are left out
+const tableBloatQuery = `
+SELECT schemaname AS schema, tblname AS name,
+       (bs * tblpages)::bigint AS real_bytes,
+       CASE WHEN tblpages - est_tblpages_ff > 0 THEN ((tblpages - est_tblpages_ff) * bs)::bigint ELSE 0 END AS bloat_bytes,
+       CASE WHEN tblpages > 0 AND tblpages - est_tblpages_ff > 0
+            THEN 100 * (tblpages - est_tblpages_ff) / tblpages::float ELSE 0 END AS bloat_percent
+FROM (
+  SELECT ceil(reltuples / ((bs - page_hdr) * fillfactor / (tpl_size * 100))) + ceil(toasttuples / 4) AS est_tblpages_ff,
+         tblpages, bs, schemaname, tblname, is_na
+  FROM (
+    SELECT (4 + tpl_hdr_size + tpl_data_size + (2 * ma)
+            - CASE WHEN tpl_hdr_size % ma = 0 THEN ma ELSE tpl_hdr_size % ma END
+            - CASE WHEN ceil(tpl_data_size)::int % ma = 0 THEN ma ELSE ceil(tpl_data_size)::int % ma END
+           ) AS tpl_size,
+           (heappages + toastpages) AS tblpages, reltuples, toasttuples, bs, page_hdr,
+           schemaname, tblname, fillfactor, is_na
+    FROM (
+      SELECT tbl.oid AS tblid, ns.nspname AS schemaname, tbl.relname AS tblname, tbl.reltuples,
+             tbl.relpages AS heappages, coalesce(toast.relpages, 0) AS toastpages,
+             coalesce(toast.reltuples, 0) AS toasttuples,
+             coalesce(substring(array_to_string(tbl.reloptions, ' ') FROM 'fillfactor=([0-9]+)')::smallint, 100) AS fillfactor,
+             current_setting('block_size')::numeric AS bs,
+             CASE WHEN version() ~ 'mingw32' OR version() ~ '64-bit|x86_64|ppc64|ia64|amd64' THEN 8 ELSE 4 END AS ma,
+             24 AS page_hdr,
+             23 + CASE WHEN max(coalesce(s.null_frac, 0)) > 0 THEN (7 + count(s.attname)) / 8 ELSE 0::int END AS tpl_hdr_size,
+             sum((1 - coalesce(s.null_frac, 0)) * coalesce(s.avg_width, 0)) AS tpl_data_size,
+             bool_or(att.atttypid = 'pg_catalog.name'::regtype)
+               OR sum(CASE WHEN att.attnum > 0 THEN 1 ELSE 0 END) <> count(s.attname) AS is_na
+      FROM pg_attribute AS att
+      JOIN pg_class AS tbl ON att.attrelid = tbl.oid
+      JOIN pg_namespace AS ns ON ns.oid = tbl.relnamespace
+      LEFT JOIN pg_stats AS s ON s.schemaname = ns.nspname AND s.tablename = tbl.relname
+                             AND s.inherited = false AND s.attname = att.attname
+      LEFT JOIN pg_class AS toast ON tbl.reltoastrelid = toast.oid
+      WHERE NOT att.attisdropped AND att.attnum > 0 AND tbl.relkind IN ('r', 'm')
+        AND ns.nspname NOT IN ('pg_catalog', 'information_schema') AND ns.nspname !~ '^pg_toast'
+      GROUP BY 1, 2, 3, 4, 5, 6, 7, 8, 9, 10
+    ) AS table_stats
+  ) AS tuple_sizes
+) AS estimates
+WHERE NOT is_na
+ORDER BY bloat_bytes DESC
+LIMIT ?`
+
+// indexBloatQuery estimates the bloat of btree indexes from the planner
+// statistics (the widely used pgsql-bloat-estimation query)
+const indexBloatQuery = `
+SELECT nspname AS schema, tblname AS "table", idxname AS name,
+       (bs * relpages)::bigint AS real_bytes,
+       CASE WHEN relpages > est_pages_ff THEN (bs * (relpages - est_pages_ff))::bigint ELSE 0 END AS bloat_bytes,
+       CASE WHEN relpages > 0 AND relpages > est_pages_ff
+            THEN 100 * (relpages - est_pages_ff)::float / relpages ELSE 0 END AS bloat_percent
+FROM (
+  SELECT coalesce(1 + ceil(reltuples / floor((bs - pageopqdata - pagehdr) * fillfactor / (100 * (4 + nulldatahdrwidth)::float))), 0) AS est_pages_ff,
+         bs, nspname, tblname, idxname, relpages, is_na
+  FROM (
+    SELECT bs, nspname, tblname, idxname, reltuples, relpages, fillfactor,
+           (index_tuple_hdr_bm + maxalign
+              - CASE WHEN index_tuple_hdr_bm % maxalign = 0 THEN maxalign ELSE index_tuple_hdr_bm % maxalign END
+              + nulldatawidth + maxalign
+              - CASE WHEN nulldatawidth = 0 THEN 0
+                     WHEN nulldatawidth::integer % maxalign = 0 THEN maxalign
+                     ELSE nulldatawidth::integer % maxalign END
+           )::numeric AS nulldatahdrwidth,
+           pagehdr, pageopqdata, is_na
+    FROM (
+      SELECT n.nspname, i.tblname, i.idxname, i.reltuples, i.relpages, i.idxoid, i.fillfactor,
+             current_setting('block_size')::numeric AS bs,
+             CASE WHEN version() ~ 'mingw32' OR version() ~ '64-bit|x86_64|ppc64|ia64|amd64' THEN 8 ELSE 4 END AS maxalign,
+             24 AS pagehdr,
+             16 AS pageopqdata,
+             CASE WHEN max(coalesce(s.null_frac, 0)) = 0 THEN 8 ELSE 8 + ((32 + 8 - 1) / 8) END AS index_tuple_hdr_bm,
+             sum((1 - coalesce(s.null_frac, 0)) * coalesce(s.avg_width, 1024)) AS nulldatawidth,
+             max(CASE WHEN i.atttypid = 'pg_catalog.name'::regtype THEN 1 ELSE 0 END) > 0 AS is_na
+      FROM (
+        SELECT ct.relname AS tblname, ct.relnamespace, ic.idxname, ic.reltuples, ic.relpages, ic.idxoid, ic.fillfactor,
+               coalesce(a1.attname, a2.attname) AS attname, coalesce(a1.atttypid, a2.atttypid) AS atttypid,
+               CASE WHEN a1.attnum IS NULL THEN ic.idxname ELSE ct.relname END AS attrelname
+        FROM (
+          SELECT idxname, reltuples, relpages, tbloid, idxoid, fillfactor, indkey,
+                 pg_catalog.generate_series(1, indnatts) AS attpos
+          FROM (
+            SELECT ci.relname AS idxname, ci.reltuples, ci.relpages, i.indrelid AS tbloid, i.indexrelid AS idxoid,
+                   coalesce(substring(array_to_string(ci.reloptions, ' ') FROM 'fillfactor=([0-9]+)')::smallint, 90) AS fillfactor,
+                   i.indnatts,
+                   pg_catalog.string_to_array(pg_catalog.textin(pg_catalog.int2vectorout(i.indkey)), ' ')::int[] AS indkey
+            FROM pg_catalog.pg_index i
+            JOIN pg_catalog.pg_class ci ON ci.oid = i.indexrelid
+            WHERE ci.relam = (SELECT oid FROM pg_am WHERE amname = 'btree') AND ci.relpages > 0
+          ) AS idx_data
+        ) AS ic
+        JOIN pg_catalog.pg_class ct ON ct.oid = ic.tbloid
+        LEFT JOIN pg_catalog.pg_attribute a1 ON ic.indkey[ic.attpos] <> 0
+                                            AND a1.attrelid = ic.tbloid AND a1.attnum = ic.indkey[ic.attpos]
+        LEFT JOIN pg_catalog.pg_attribute a2 ON ic.indkey[ic.attpos] = 0
+                                            AND a2.attrelid = ic.idxoid AND a2.attnum = ic.attpos
+      ) i
+      JOIN pg_catalog.pg_namespace n ON n.oid = i.relnamespace
+      JOIN pg_catalog.pg_stats s ON s.schemaname = n.nspname AND s.tablename = i.attrelname AND s.attname = i.attname
+      WHERE n.nspname NOT IN ('pg_catalog', 'information_schema')
+      GROUP BY 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11
+    ) AS index_stats
+  ) AS tuple_sizes
+) AS estimates
+WHERE NOT is_na
+ORDER BY bloat_bytes DESC
+LIMIT ?`
+
+// BloatEstimates returns the limit most bloated tables and btree indexes
+// of a database, estimated from the planner statistics: tables that were
+// never analyzed are missing
+func BloatEstimates(dbName string, limit int) ([]TableBloat, []IndexBloat, error) {
+	db, err := GetDatabase(dbName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tables := []TableBloat{}
+	if err := db.Raw(tableBloatQuery, limit).Scan(&tables).Error; err != nil {
+		return nil, nil, fmt.Errorf("failed to estimate table bloat of %s: %w", dbName, err)
+	}
+	indexes := []IndexBloat{}
+	if err := db.Raw(indexBloatQuery, limit).Scan(&indexes).Error; err != nil {
+		return nil, nil, fmt.Errorf("failed to estimate index bloat of %s: %w", dbName, err)
+	}
+	return tables, indexes, nil
+}
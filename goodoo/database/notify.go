@@ -0,0 +1,66 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"goodoo/logging"
+	"gorm.io/gorm"
+)
+
+// Notify sends a PostgreSQL notification on a channel; inside a
+// transaction it is delivered at commit
+func Notify(db *gorm.DB, channel, payload string) error {
+	return db.Exec("SELECT pg_notify(?, ?)", channel, payload).Error
+}
+
+// Listen calls fn with the payload of every notification sent on a channel
+// of a database until ctx is done. It runs on a dedicated connection,
+// reconnecting after failures, and calls fn with an empty payload after
+// each (re)connection since notifications may have been missed meanwhile.
+func Listen(ctx context.Context, dbName, channel string, fn func(payload string)) {
+	logger := logging.GetLogger("goodoo.database")
+	_, config, err := ParseConnectionInfo(dbName)
+	if err != nil {
+		logger.Warning("Cannot listen on %s of %s: %v", channel, dbName, err)
+		return
+	}
+
+	delay := time.Second
+	for ctx.Err() == nil {
+		err := listenOnce(ctx, config.BuildDSN(), channel, fn)
+		if ctx.Err() != nil {
+			return
+		}
+		logger.Warning("Listening on %s of %s failed, retrying in %s: %v", channel, dbName, delay, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if delay < time.Minute {
+			delay *= 2
+		}
+	}
+}
+
+func listenOnce(ctx context.Context, dsn, channel string, fn func(payload string)) error {
+	conn, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{channel}.Sanitize()); err != nil {
+		return err
+	}
+	fn("")
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		fn(notification.Payload)
+	}
+}
@@ -19,6 +19,20 @@ type ConnectionPool struct {
 	logger      logger.Interface
 }
 
+// connectHooks run on every new connection, in registration order
+var (
+	connectHooks     []func(dbName string, db *gorm.DB) error
+	connectHooksLock sync.RWMutex
+)
+
+// OnConnect registers fn to run on every connection opened from now on,
+// e.g. to register GORM callbacks; an error fails the connection
+func OnConnect(fn func(dbName string, db *gorm.DB) error) {
+	connectHooksLock.Lock()
+	defer connectHooksLock.Unlock()
+	connectHooks = append(connectHooks, fn)
+}
+
 // pooledConnection represents a connection in the pool
 type pooledConnection struct {
 	db       *gorm.DB
@@ -37,7 +51,7 @@ func NewConnectionPool(maxConns int) *ConnectionPool {
 	return &ConnectionPool{
 		connections: make(map[string]*pooledConnection),
 		maxConns:    maxConns,
-		logger:      logger.Default.LogMode(logger.Info),
+		logger:      NewTracingLogger(logger.Default.LogMode(logger.Info)),
 	}
 }
 
@@ -198,8 +212,13 @@ func (s PoolStats) String() string {
 func (p *ConnectionPool) createConnection(config *ConnectionConfig) (*gorm.DB, error) {
 	dsn := config.BuildDSN()
 	
+	// Slow queries are recorded by database
+	connLogger := p.logger
+	if tracingLogger, ok := connLogger.(*TracingLogger); ok {
+		connLogger = tracingLogger.ForDatabase(config.Database)
+	}
 	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{
-		Logger: p.logger,
+		Logger: connLogger,
 	})
 	if err != nil {
 		return nil, err
@@ -212,6 +231,25 @@ func (p *ConnectionPool) createConnection(config *ConnectionConfig) (*gorm.DB, e
 		sqlDB.SetConnMaxLifetime(time.Hour)
 	}
 	
+	if err := registerTimeoutCallbacks(db); err != nil {
+		if sqlDB, dbErr := db.DB(); dbErr == nil {
+			sqlDB.Close()
+		}
+		return nil, err
+	}
+	
+	connectHooksLock.RLock()
+	hooks := append([]func(string, *gorm.DB) error(nil), connectHooks...)
+	connectHooksLock.RUnlock()
+	for _, hook := range hooks {
+		if err := hook(config.Database, db); err != nil {
+			if sqlDB, dbErr := db.DB(); dbErr == nil {
+				sqlDB.Close()
+			}
+			return nil, err
+		}
+	}
+	
 	return db, nil
 }
 
@@ -227,10 +265,12 @@ func (p *ConnectionPool) testConnection(db *gorm.DB) bool {
 
 // getConnectionKey generates a unique key for a connection configuration
 func (p *ConnectionPool) getConnectionKey(config *ConnectionConfig) string {
+	// Connections opened with other timeouts are not shared
+	timeouts := config.SessionTimeouts().String()
 	if config.DSN != "" {
-		return config.DSN
+		return config.DSN + "#" + timeouts
 	}
-	return fmt.Sprintf("%s:%d/%s@%s", config.Host, config.Port, config.Database, config.User)
+	return fmt.Sprintf("%s:%d/%s@%s#%s", config.Host, config.Port, config.Database, config.User, timeouts)
 }
 
 // cleanupUnusedConnections removes old unused connections
@@ -15,6 +15,8 @@ type DatabaseRegistry struct {
 	databases map[string]*DatabaseInfo
 	mutex     sync.RWMutex
 	pool      *ConnectionPool
+	// dial opens a connection, from the pool
+	dial      func(config *ConnectionConfig) (*Connection, error)
 }
 
 // DatabaseInfo holds information about a registered database
@@ -25,13 +27,22 @@ type DatabaseInfo struct {
 	LastAccessed time.Time
 	Active       bool
 	mutex        sync.RWMutex
+	breaker      *breaker
+	
+	// Per-database snapshots of the model/API registries, keyed by kind.
+	// Typed as interface{} because those packages depend on this one.
+	registries map[string]interface{}
+	// builds serializes the builds of each kind of registry
+	builds map[string]*sync.Mutex
 }
 
 // NewDatabaseRegistry creates a new database registry
 func NewDatabaseRegistry() *DatabaseRegistry {
+	pool := GetPool()
 	return &DatabaseRegistry{
 		databases: make(map[string]*DatabaseInfo),
-		pool:      GetPool(),
+		pool:      pool,
+		dial:      pool.Borrow,
 	}
 }
 
@@ -49,12 +60,16 @@ func (r *DatabaseRegistry) Register(dbName string, config *ConnectionConfig) err
 		Config:       config.Clone(),
 		LastAccessed: time.Now(),
 		Active:       false,
+		breaker:      &breaker{},
 	}
 	
 	return nil
 }
 
-// GetConnection gets or creates a connection for the specified database
+// GetConnection gets or creates a connection for the specified database.
+// After a failed connection the database is tripped: until a background
+// probe reaches it again, GetConnection fails fast with an
+// UnavailableError instead of waiting out the dial timeout.
 func (r *DatabaseRegistry) GetConnection(dbName string) (*Connection, error) {
 	r.mutex.RLock()
 	dbInfo, exists := r.databases[dbName]
@@ -63,10 +78,18 @@ func (r *DatabaseRegistry) GetConnection(dbName string) (*Connection, error) {
 	if !exists {
 		return nil, fmt.Errorf("database %s not registered", dbName)
 	}
+	if err := dbInfo.breaker.check(dbName); err != nil {
+		return nil, err
+	}
 	
 	dbInfo.mutex.Lock()
 	defer dbInfo.mutex.Unlock()
 	
+	// Requests queued behind a connection that failed fail fast as well
+	if err := dbInfo.breaker.check(dbName); err != nil {
+		return nil, err
+	}
+	
 	// Check if we have an active connection
 	if dbInfo.Connection != nil && dbInfo.Active {
 		if err := dbInfo.Connection.Ping(); err == nil {
@@ -80,8 +103,9 @@ func (r *DatabaseRegistry) GetConnection(dbName string) (*Connection, error) {
 	}
 	
 	// Create new connection
-	conn, err := r.pool.Borrow(dbInfo.Config)
+	conn, err := r.dial(dbInfo.Config)
 	if err != nil {
+		r.trip(dbInfo, err)
 		return nil, fmt.Errorf("failed to get connection for %s: %w", dbName, err)
 	}
 	
@@ -216,7 +240,7 @@ func (r *DatabaseRegistry) Stats() RegistryStats {
 		PoolStats:      r.pool.Stats(),
 	}
 	
-	for _, dbInfo := range r.databases {
+	for name, dbInfo := range r.databases {
 		dbInfo.mutex.RLock()
 		if dbInfo.Active {
 			stats.ActiveDatabases++
@@ -224,6 +248,10 @@ func (r *DatabaseRegistry) Stats() RegistryStats {
 			stats.InactiveDatabases++
 		}
 		dbInfo.mutex.RUnlock()
+		if status := dbInfo.breaker.status(name); status.State == BreakerOpen {
+			stats.TrippedDatabases++
+			stats.Breakers = append(stats.Breakers, status)
+		}
 	}
 	
 	return stats
@@ -234,13 +262,16 @@ type RegistryStats struct {
 	TotalDatabases    int
 	ActiveDatabases   int
 	InactiveDatabases int
+	// TrippedDatabases have their breaker open, described by Breakers
+	TrippedDatabases  int
+	Breakers          []BreakerStatus
 	PoolStats         PoolStats
 }
 
 // String returns a string representation of registry stats
 func (s RegistryStats) String() string {
-	return fmt.Sprintf("DatabaseRegistry(total=%d/active=%d/inactive=%d) %s",
-		s.TotalDatabases, s.ActiveDatabases, s.InactiveDatabases, s.PoolStats.String())
+	return fmt.Sprintf("DatabaseRegistry(total=%d/active=%d/inactive=%d/tripped=%d) %s",
+		s.TotalDatabases, s.ActiveDatabases, s.InactiveDatabases, s.TrippedDatabases, s.PoolStats.String())
 }
 
 // SetLogger sets the logger for all database connections
@@ -255,7 +286,124 @@ func (r *DatabaseRegistry) AutoMigrate(dbName string, models ...interface{}) err
 		return fmt.Errorf("failed to get database %s: %w", dbName, err)
 	}
 	
-	return db.AutoMigrate(models...)
+	// Rewriting a large table outlasts the statement timeout: it is lifted
+	// on the session of the migration, then reset for the pool
+	return db.Connection(func(session *gorm.DB) error {
+		if err := session.Exec("SET statement_timeout = 0").Error; err != nil {
+			return err
+		}
+		defer session.Exec("RESET statement_timeout")
+		return session.AutoMigrate(models...)
+	})
+}
+
+// SetSessionTimeouts overrides the session timeouts of a registered
+// database. The connection in use is given back to the pool: the next
+// one is opened with the new timeouts, the requests in progress keep the
+// former.
+func (r *DatabaseRegistry) SetSessionTimeouts(dbName string, timeouts SessionTimeouts) error {
+	r.mutex.RLock()
+	dbInfo, exists := r.databases[dbName]
+	r.mutex.RUnlock()
+	
+	if !exists {
+		return fmt.Errorf("database %s not registered", dbName)
+	}
+	
+	dbInfo.mutex.Lock()
+	defer dbInfo.mutex.Unlock()
+	
+	dbInfo.Config.Timeouts = &timeouts
+	if dbInfo.Connection != nil {
+		dbInfo.Connection.Close()
+		dbInfo.Connection = nil
+	}
+	dbInfo.Active = false
+	return nil
+}
+
+// SetScopedRegistry stores a per-database registry snapshot (e.g. "models", "api")
+func (r *DatabaseRegistry) SetScopedRegistry(dbName, kind string, registry interface{}) error {
+	r.mutex.RLock()
+	dbInfo, exists := r.databases[dbName]
+	r.mutex.RUnlock()
+	
+	if !exists {
+		return fmt.Errorf("database %s not registered", dbName)
+	}
+	
+	dbInfo.mutex.Lock()
+	defer dbInfo.mutex.Unlock()
+	
+	if dbInfo.registries == nil {
+		dbInfo.registries = make(map[string]interface{})
+	}
+	dbInfo.registries[kind] = registry
+	return nil
+}
+
+// BuildScopedRegistry returns the per-database registry snapshot of a
+// kind, building and storing it with build when there is none or when
+// rebuild is set. Builds of a kind are serialized, so concurrent first
+// callers share one snapshot instead of each storing their own.
+func (r *DatabaseRegistry) BuildScopedRegistry(dbName, kind string, rebuild bool, build func() interface{}) (interface{}, error) {
+	r.mutex.RLock()
+	dbInfo, exists := r.databases[dbName]
+	r.mutex.RUnlock()
+
+	if !exists {
+		return nil, fmt.Errorf("database %s not registered", dbName)
+	}
+
+	dbInfo.mutex.Lock()
+	if dbInfo.builds == nil {
+		dbInfo.builds = make(map[string]*sync.Mutex)
+	}
+	lock := dbInfo.builds[kind]
+	if lock == nil {
+		lock = &sync.Mutex{}
+		dbInfo.builds[kind] = lock
+	}
+	dbInfo.mutex.Unlock()
+
+	// build runs without dbInfo.mutex: it may query the database, or
+	// build the registry of another kind
+	lock.Lock()
+	defer lock.Unlock()
+	if !rebuild {
+		dbInfo.mutex.RLock()
+		registry, ok := dbInfo.registries[kind]
+		dbInfo.mutex.RUnlock()
+		if ok {
+			return registry, nil
+		}
+	}
+
+	registry := build()
+	dbInfo.mutex.Lock()
+	defer dbInfo.mutex.Unlock()
+	if dbInfo.registries == nil {
+		dbInfo.registries = make(map[string]interface{})
+	}
+	dbInfo.registries[kind] = registry
+	return registry, nil
+}
+
+// GetScopedRegistry returns the per-database registry snapshot of a kind
+func (r *DatabaseRegistry) GetScopedRegistry(dbName, kind string) (interface{}, bool) {
+	r.mutex.RLock()
+	dbInfo, exists := r.databases[dbName]
+	r.mutex.RUnlock()
+	
+	if !exists {
+		return nil, false
+	}
+	
+	dbInfo.mutex.RLock()
+	defer dbInfo.mutex.RUnlock()
+	
+	registry, ok := dbInfo.registries[kind]
+	return registry, ok
 }
 
 // Global database registry instance
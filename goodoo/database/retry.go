@@ -0,0 +1,137 @@
+package database
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"goodoo/logging"
+	"gorm.io/gorm"
+)
+
+// RetryOptions controls how RetryableTransaction retries a failed transaction
+type RetryOptions struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	// NonIdempotent disables retries for closures with side effects outside the database
+	NonIdempotent bool
+}
+
+// DefaultRetryOptions returns the retry settings used when none are given (like Odoo's MAX_TRIES_ON_CONCURRENCY_FAILURE)
+func DefaultRetryOptions() RetryOptions {
+	return RetryOptions{
+		MaxAttempts: 5,
+		BaseDelay:   50 * time.Millisecond,
+		MaxDelay:    2 * time.Second,
+	}
+}
+
+// NonIdempotent returns the default options with retries disabled
+func NonIdempotent() RetryOptions {
+	opts := DefaultRetryOptions()
+	opts.NonIdempotent = true
+	return opts
+}
+
+var (
+	retryCount      int64
+	exhaustionCount int64
+)
+
+// RetryStats returns the number of transaction retries and of retries given up after the last attempt
+func RetryStats() (retries, exhaustions int64) {
+	return atomic.LoadInt64(&retryCount), atomic.LoadInt64(&exhaustionCount)
+}
+
+// IsRetryableError reports whether err is a serialization failure
+// (40001), a deadlock (40P01), or a connection failure that happened
+// before anything was sent to the server. Connections dropped later, such
+// as resets and broken pipes, are not retried: the server may have
+// committed the transaction already.
+func IsRetryableError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == "40001" || pgErr.Code == "40P01"
+	}
+	return errors.Is(err, driver.ErrBadConn) || pgconn.SafeToRetry(err)
+}
+
+// IsLockNotAvailableError reports whether err is PostgreSQL's
+// lock_not_available (55P03), raised when lock_timeout expires
+func IsLockNotAvailableError(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "55P03"
+}
+
+// inTransaction reports whether db is already bound to an open transaction
+func inTransaction(db *gorm.DB) bool {
+	if db.Statement == nil {
+		return false
+	}
+	_, ok := db.Statement.ConnPool.(gorm.TxCommitter)
+	return ok
+}
+
+// RetryableTransaction runs fn in a transaction, retrying it with exponential
+// backoff when it fails on a serialization failure or a deadlock (see
+// IsRetryableError).
+// Nested calls join the outer transaction and leave retrying to it.
+func RetryableTransaction(ctx context.Context, db *gorm.DB, fn func(*gorm.DB) error, opts ...RetryOptions) error {
+	options := DefaultRetryOptions()
+	if len(opts) > 0 {
+		options = opts[0]
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	if options.NonIdempotent || options.MaxAttempts <= 1 || inTransaction(db) {
+		return db.Transaction(fn)
+	}
+
+	logger := logging.GetLogger("goodoo.database")
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = db.Transaction(fn)
+		if !IsRetryableError(err) {
+			return err
+		}
+
+		if attempt >= options.MaxAttempts {
+			atomic.AddInt64(&exhaustionCount, 1)
+			logger.ErrorCtx(ctx, "Transaction failed after %d attempts: %v", attempt, err)
+			return err
+		}
+
+		delay := backoff(options, attempt)
+		atomic.AddInt64(&retryCount, 1)
+		logger.WarningCtx(ctx, "Transaction attempt %d/%d failed, retrying in %v: %v",
+			attempt, options.MaxAttempts, delay, err)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// backoff returns the exponential delay for an attempt with up to 50% jitter
+func backoff(options RetryOptions, attempt int) time.Duration {
+	delay := options.BaseDelay << uint(attempt-1)
+	if options.MaxDelay > 0 && (delay > options.MaxDelay || delay <= 0) {
+		delay = options.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
@@ -0,0 +1,226 @@
+package database_test
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"goodoo/database"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// stubPool is a connection pool whose transactions run no statement and
+// commit with commitErr
+type stubPool struct {
+	begins, commits, rollbacks int
+	commitErr                  error
+}
+
+func (p *stubPool) PrepareContext(context.Context, string) (*sql.Stmt, error) {
+	return nil, errors.New("stub pool runs no statement")
+}
+
+func (p *stubPool) ExecContext(context.Context, string, ...interface{}) (sql.Result, error) {
+	return nil, errors.New("stub pool runs no statement")
+}
+
+func (p *stubPool) QueryContext(context.Context, string, ...interface{}) (*sql.Rows, error) {
+	return nil, errors.New("stub pool runs no statement")
+}
+
+func (p *stubPool) QueryRowContext(context.Context, string, ...interface{}) *sql.Row {
+	return nil
+}
+
+func (p *stubPool) BeginTx(context.Context, *sql.TxOptions) (gorm.ConnPool, error) {
+	p.begins++
+	return &stubTx{stubPool: p}, nil
+}
+
+// stubTx is a transaction of a stubPool
+type stubTx struct {
+	*stubPool
+}
+
+func (tx *stubTx) Commit() error {
+	tx.commits++
+	return tx.commitErr
+}
+
+func (tx *stubTx) Rollback() error {
+	tx.rollbacks++
+	return nil
+}
+
+// stubDB opens a database on a stubPool
+func stubDB(t *testing.T) (*gorm.DB, *stubPool) {
+	t.Helper()
+	pool := &stubPool{}
+	db, err := gorm.Open(postgres.New(postgres.Config{Conn: pool}), &gorm.Config{
+		DisableAutomaticPing: true,
+		Logger:               logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, pool
+}
+
+// noDelay retries at once
+var noDelay = database.RetryOptions{MaxAttempts: 3}
+
+func TestIsRetryableError(t *testing.T) {
+	serialization := &pgconn.PgError{Code: "40001", Message: "could not serialize access due to concurrent update"}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"serialization failure", serialization, true},
+		{"wrapped serialization failure", fmt.Errorf("saving partner: %w", serialization), true},
+		{"deadlock", &pgconn.PgError{Code: "40P01", Message: "deadlock detected"}, true},
+		{"lock timeout", &database.TimeoutError{Kind: database.TimeoutLock, Err: &pgconn.PgError{Code: "55P03"}}, false},
+		{"unique violation", &pgconn.PgError{Code: "23505", Message: "duplicate key value violates unique constraint"}, false},
+		// Only the code counts, not the text of the error
+		{"code in the message", errors.New(`invalid input "40001"`), false},
+		{"deadlock in the message", errors.New("field note: deadlock detected"), false},
+		{"bad connection", driver.ErrBadConn, true},
+		// The transaction may have been committed before the connection broke
+		{"connection reset", fmt.Errorf("write tcp: %w", syscall.ECONNRESET), false},
+		{"broken pipe", fmt.Errorf("write tcp: %w", syscall.EPIPE), false},
+		{"unexpected EOF", io.ErrUnexpectedEOF, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := database.IsRetryableError(tt.err); got != tt.want {
+				t.Errorf("IsRetryableError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsLockNotAvailableError(t *testing.T) {
+	lock := &pgconn.PgError{Code: "55P03", Message: "canceling statement due to lock timeout"}
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{lock, true},
+		{&database.TimeoutError{Kind: database.TimeoutLock, Err: lock}, true},
+		{&pgconn.PgError{Code: "55P03", Message: `could not obtain lock on row in relation "res_partner"`}, true},
+		{&pgconn.PgError{Code: "57014", Message: "canceling statement due to statement timeout"}, false},
+		{errors.New("lock timeout"), false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := database.IsLockNotAvailableError(tt.err); got != tt.want {
+			t.Errorf("IsLockNotAvailableError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+// TestRetryableTransaction runs transactions failing with stubbed errors:
+// the retryable ones are run again until they succeed or the attempts
+// run out, the others fail at once
+func TestRetryableTransaction(t *testing.T) {
+	deadlock := &pgconn.PgError{Code: "40P01", Message: "deadlock detected"}
+	constraint := &pgconn.PgError{Code: "23505", Message: "duplicate key value violates unique constraint"}
+	tests := []struct {
+		name     string
+		failures []error
+		attempts int
+		// wantErr is the error of the last attempt, when it fails
+		wantErr error
+	}{
+		{"success", nil, 1, nil},
+		{"deadlock then success", []error{deadlock}, 2, nil},
+		{"deadlocks", []error{deadlock, deadlock, deadlock, deadlock}, 3, deadlock},
+		{"constraint", []error{constraint}, 1, constraint},
+		{"connection reset", []error{syscall.ECONNRESET}, 1, syscall.ECONNRESET},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, pool := stubDB(t)
+			_, exhaustionsBefore := database.RetryStats()
+			attempts := 0
+			err := database.RetryableTransaction(context.Background(), db, func(tx *gorm.DB) error {
+				attempts++
+				if attempts <= len(tt.failures) {
+					return tt.failures[attempts-1]
+				}
+				return nil
+			}, noDelay)
+
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("RetryableTransaction = %v, want %v", err, tt.wantErr)
+			}
+			if attempts != tt.attempts || pool.begins != tt.attempts {
+				t.Errorf("%d attempts in %d transactions, want %d", attempts, pool.begins, tt.attempts)
+			}
+			if want := tt.attempts; tt.wantErr == nil {
+				if pool.commits != 1 || pool.rollbacks != want-1 {
+					t.Errorf("%d commits and %d rollbacks, want 1 and %d", pool.commits, pool.rollbacks, want-1)
+				}
+			} else if pool.commits != 0 || pool.rollbacks != want {
+				t.Errorf("%d commits and %d rollbacks, want none and %d", pool.commits, pool.rollbacks, want)
+			}
+			_, exhaustions := database.RetryStats()
+			if exhausted := tt.wantErr != nil && tt.attempts == noDelay.MaxAttempts; exhausted != (exhaustions > exhaustionsBefore) {
+				t.Errorf("exhaustions went from %d to %d", exhaustionsBefore, exhaustions)
+			}
+		})
+	}
+}
+
+// TestRetryableTransactionCommitFailure drops the connection during the
+// commit: the transaction may have been applied, so it is not run again
+func TestRetryableTransactionCommitFailure(t *testing.T) {
+	db, pool := stubDB(t)
+	pool.commitErr = fmt.Errorf("write tcp: %w", syscall.EPIPE)
+	attempts := 0
+	err := database.RetryableTransaction(context.Background(), db, func(*gorm.DB) error {
+		attempts++
+		return nil
+	}, noDelay)
+	if !errors.Is(err, syscall.EPIPE) || attempts != 1 {
+		t.Errorf("RetryableTransaction = %v after %d attempts, want the broken pipe after 1", err, attempts)
+	}
+}
+
+func TestRetryableTransactionNonIdempotent(t *testing.T) {
+	db, pool := stubDB(t)
+	options := noDelay
+	options.NonIdempotent = true
+	err := database.RetryableTransaction(context.Background(), db, func(*gorm.DB) error {
+		return &pgconn.PgError{Code: "40001"}
+	}, options)
+	if !database.IsRetryableError(err) || pool.begins != 1 {
+		t.Errorf("RetryableTransaction = %v in %d transactions, want the serialization failure in 1", err, pool.begins)
+	}
+}
+
+// TestRetryableTransactionNested joins the transaction of the caller,
+// which retries the whole of it
+func TestRetryableTransactionNested(t *testing.T) {
+	db, pool := stubDB(t)
+	inner := 0
+	err := database.RetryableTransaction(context.Background(), db, func(tx *gorm.DB) error {
+		return database.RetryableTransaction(context.Background(), tx, func(*gorm.DB) error {
+			inner++
+			return &pgconn.PgError{Code: "40001"}
+		}, noDelay)
+	}, noDelay)
+	if !database.IsRetryableError(err) || inner != noDelay.MaxAttempts || pool.begins != noDelay.MaxAttempts {
+		t.Errorf("RetryableTransaction = %v, inner run %d times in %d transactions; want %d of each",
+			err, inner, pool.begins, noDelay.MaxAttempts)
+	}
+}
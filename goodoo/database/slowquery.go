@@ -0,0 +1,135 @@
+package database
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxSlowQueries bounds the statements kept per database; past it, the
+// statement with the least total time is forgotten
+const maxSlowQueries = 200
+
+// SlowQuery is a statement that ran slower than the slow query threshold,
+// aggregated over its slow runs by fingerprint: the statement with its
+// values replaced by placeholders
+type SlowQuery struct {
+	Fingerprint string `json:"fingerprint"`
+	// Sample is the slowest run, values included, so it can be explained
+	Sample   string    `json:"sample"`
+	Calls    int64     `json:"calls"`
+	TotalMs  float64   `json:"total_ms"`
+	MaxMs    float64   `json:"max_ms"`
+	Rows     int64     `json:"rows"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+var (
+	slowThreshold = 200 * time.Millisecond
+	slowQueries   = make(map[string]map[string]*SlowQuery)
+	slowMu        sync.Mutex
+)
+
+// SetSlowQueryThreshold sets the duration above which queries are recorded
+// as slow; zero turns the recording off
+func SetSlowQueryThreshold(threshold time.Duration) {
+	slowMu.Lock()
+	defer slowMu.Unlock()
+	slowThreshold = threshold
+}
+
+// isSlow reports whether a query that took elapsed is recorded
+func isSlow(elapsed time.Duration) bool {
+	slowMu.Lock()
+	defer slowMu.Unlock()
+	return slowThreshold > 0 && elapsed >= slowThreshold
+}
+
+var (
+	stringLiteralPattern = regexp.MustCompile(`'(?:[^']|'')*'`)
+	numberPattern        = regexp.MustCompile(`\b\d+(?:\.\d+)?\b|\$\d+`)
+	placeholderList      = regexp.MustCompile(`\(\s*\?(?:\s*,\s*\?)+\s*\)`)
+)
+
+// NormalizeStatement returns the fingerprint of a statement: its string
+// and number literals replaced by ?, lists of them collapsed to one and
+// its whitespace collapsed, so the runs of one query share it
+func NormalizeStatement(statement string) string {
+	normalized := stringLiteralPattern.ReplaceAllString(statement, "?")
+	normalized = numberPattern.ReplaceAllString(normalized, "?")
+	normalized = placeholderList.ReplaceAllString(normalized, "(?)")
+	return strings.Join(strings.Fields(normalized), " ")
+}
+
+// recordSlowQuery adds a slow run of a statement of a database
+func recordSlowQuery(dbName, statement string, elapsed time.Duration, rows int64, now time.Time) {
+	fingerprint := NormalizeStatement(statement)
+	ms := float64(elapsed.Microseconds()) / 1000
+
+	slowMu.Lock()
+	defer slowMu.Unlock()
+	queries := slowQueries[dbName]
+	if queries == nil {
+		queries = make(map[string]*SlowQuery)
+		slowQueries[dbName] = queries
+	}
+	query, exists := queries[fingerprint]
+	if !exists {
+		if len(queries) >= maxSlowQueries {
+			evictSlowQuery(queries)
+		}
+		query = &SlowQuery{Fingerprint: fingerprint}
+		queries[fingerprint] = query
+	}
+	query.Calls++
+	query.TotalMs += ms
+	if rows > 0 {
+		query.Rows += rows
+	}
+	if ms >= query.MaxMs {
+		query.MaxMs = ms
+		query.Sample = statement
+	}
+	query.LastSeen = now
+}
+
+// evictSlowQuery forgets the statement with the least total time; slowMu
+// must be held
+func evictSlowQuery(queries map[string]*SlowQuery) {
+	var least *SlowQuery
+	for _, query := range queries {
+		if least == nil || query.TotalMs < least.TotalMs {
+			least = query
+		}
+	}
+	if least != nil {
+		delete(queries, least.Fingerprint)
+	}
+}
+
+// SlowQueries returns the slow statements of a database recorded since the
+// start of the process or the last reset, the most time consuming first
+func SlowQueries(dbName string) []SlowQuery {
+	slowMu.Lock()
+	defer slowMu.Unlock()
+	queries := make([]SlowQuery, 0, len(slowQueries[dbName]))
+	for _, query := range slowQueries[dbName] {
+		queries = append(queries, *query)
+	}
+	sort.Slice(queries, func(i, j int) bool {
+		if queries[i].TotalMs != queries[j].TotalMs {
+			return queries[i].TotalMs > queries[j].TotalMs
+		}
+		return queries[i].Fingerprint < queries[j].Fingerprint
+	})
+	return queries
+}
+
+// ResetSlowQueries forgets the slow statements of a database
+func ResetSlowQueries(dbName string) {
+	slowMu.Lock()
+	defer slowMu.Unlock()
+	delete(slowQueries, dbName)
+}
@@ -0,0 +1,248 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TableStat holds size and activity statistics for a single table
+type TableStat struct {
+	Schema         string     `json:"schema"`
+	Name           string     `json:"name"`
+	RowEstimate    int64      `json:"row_estimate"`
+	DeadRows       int64      `json:"dead_rows"`
+	TotalBytes     int64      `json:"total_bytes"`
+	TableBytes     int64      `json:"table_bytes"`
+	IndexBytes     int64      `json:"index_bytes"`
+	BloatRatio     float64    `json:"bloat_ratio"`
+	SeqScans       int64      `json:"seq_scans"`
+	IndexScans     int64      `json:"index_scans"`
+	LastVacuum     *time.Time `json:"last_vacuum,omitempty"`
+	LastAutovacuum *time.Time `json:"last_autovacuum,omitempty"`
+}
+
+// ConnectionStats combines the client-side pool statistics with server-side activity
+type ConnectionStats struct {
+	Pool sql.DBStats `json:"pool"`
+
+	// Server-side counts from pg_stat_activity for our application_name
+	ApplicationName string `json:"application_name"`
+	Active          int    `json:"active"`
+	Idle            int    `json:"idle"`
+	IdleInTx        int    `json:"idle_in_transaction"`
+	Total           int    `json:"total"`
+
+	// Restricted is set when the catalog views could not be read (managed PostgreSQL)
+	Restricted bool `json:"restricted"`
+}
+
+// DatabaseSize returns the on-disk size of a database in bytes
+func DatabaseSize(dbName string) (int64, error) {
+	db, err := GetDatabase(dbName)
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	if err := db.Raw("SELECT pg_database_size(current_database())").Scan(&size).Error; err != nil {
+		return 0, fmt.Errorf("failed to get size of %s: %w", dbName, err)
+	}
+	return size, nil
+}
+
+// TableStats returns per-table statistics from pg_stat_user_tables
+func TableStats(dbName string) ([]TableStat, error) {
+	db, err := GetDatabase(dbName)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []struct {
+		Schema         string
+		Name           string
+		RowEstimate    int64
+		DeadRows       int64
+		TotalBytes     int64
+		TableBytes     int64
+		IndexBytes     int64
+		SeqScans       int64
+		IndexScans     int64
+		LastVacuum     *time.Time
+		LastAutovacuum *time.Time
+	}
+
+	query := `
+		SELECT s.schemaname AS schema,
+		       s.relname AS name,
+		       GREATEST(c.reltuples, 0)::bigint AS row_estimate,
+		       s.n_dead_tup AS dead_rows,
+		       pg_total_relation_size(s.relid) AS total_bytes,
+		       pg_relation_size(s.relid) AS table_bytes,
+		       pg_indexes_size(s.relid) AS index_bytes,
+		       COALESCE(s.seq_scan, 0) AS seq_scans,
+		       COALESCE(s.idx_scan, 0) AS index_scans,
+		       s.last_vacuum,
+		       s.last_autovacuum
+		FROM pg_stat_user_tables s
+		JOIN pg_class c ON c.oid = s.relid
+		ORDER BY total_bytes DESC`
+
+	if err := db.Raw(query).Scan(&rows).Error; err != nil {
+		return nil, fmt.Errorf("failed to read table statistics for %s: %w", dbName, err)
+	}
+
+	stats := make([]TableStat, len(rows))
+	for i, row := range rows {
+		stats[i] = TableStat{
+			Schema:         row.Schema,
+			Name:           row.Name,
+			RowEstimate:    row.RowEstimate,
+			DeadRows:       row.DeadRows,
+			TotalBytes:     row.TotalBytes,
+			TableBytes:     row.TableBytes,
+			IndexBytes:     row.IndexBytes,
+			SeqScans:       row.SeqScans,
+			IndexScans:     row.IndexScans,
+			LastVacuum:     row.LastVacuum,
+			LastAutovacuum: row.LastAutovacuum,
+		}
+		// Dead tuple ratio is a cheap approximation of bloat
+		if total := row.RowEstimate + row.DeadRows; total > 0 {
+			stats[i].BloatRatio = float64(row.DeadRows) / float64(total)
+		}
+	}
+
+	return stats, nil
+}
+
+// GetConnectionStats returns pool statistics and pg_stat_activity counts for a database
+func GetConnectionStats(dbName string) (*ConnectionStats, error) {
+	conn, err := GetDatabaseConnection(dbName)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &ConnectionStats{
+		ApplicationName: conn.Config().AppName,
+	}
+
+	db := conn.DB()
+	if sqlDB, err := db.DB(); err == nil {
+		stats.Pool = sqlDB.Stats()
+	}
+
+	var rows []struct {
+		State string
+		Count int
+	}
+	query := `
+		SELECT COALESCE(state, 'unknown') AS state, count(*) AS count
+		FROM pg_stat_activity
+		WHERE datname = current_database() AND application_name = ?
+		GROUP BY state`
+
+	if err := db.Raw(query, stats.ApplicationName).Scan(&rows).Error; err != nil {
+		if IsPermissionError(err) {
+			stats.Restricted = true
+			return stats, nil
+		}
+		return stats, fmt.Errorf("failed to read connection activity for %s: %w", dbName, err)
+	}
+
+	for _, row := range rows {
+		switch row.State {
+		case "active":
+			stats.Active += row.Count
+		case "idle":
+			stats.Idle += row.Count
+		case "idle in transaction", "idle in transaction (aborted)":
+			stats.IdleInTx += row.Count
+		}
+		stats.Total += row.Count
+	}
+
+	return stats, nil
+}
+
+// IsPermissionError reports whether err is PostgreSQL's insufficient_privilege (42501)
+func IsPermissionError(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "42501") || strings.Contains(msg, "permission denied")
+}
+
+// statsCacheTTL keeps dashboard polling from hammering the catalog
+const statsCacheTTL = 10 * time.Second
+
+type statsCacheEntry struct {
+	value   interface{}
+	err     error
+	expires time.Time
+}
+
+var (
+	statsCache   = make(map[string]*statsCacheEntry)
+	statsCacheMu sync.Mutex
+)
+
+// cachedStat returns a cached value for key or computes it with fn
+func cachedStat(key string, fn func() (interface{}, error)) (interface{}, error) {
+	statsCacheMu.Lock()
+	entry, ok := statsCache[key]
+	statsCacheMu.Unlock()
+
+	if ok && time.Now().Before(entry.expires) {
+		return entry.value, entry.err
+	}
+
+	value, err := fn()
+
+	statsCacheMu.Lock()
+	statsCache[key] = &statsCacheEntry{value: value, err: err, expires: time.Now().Add(statsCacheTTL)}
+	statsCacheMu.Unlock()
+
+	return value, err
+}
+
+// InvalidateStats drops the cached statistics of a database
+func InvalidateStats(dbName string) {
+	statsCacheMu.Lock()
+	defer statsCacheMu.Unlock()
+	for key := range statsCache {
+		if _, name, _ := strings.Cut(key, ":"); name == dbName {
+			delete(statsCache, key)
+		}
+	}
+}
+
+// CachedDatabaseSize is DatabaseSize with a short cache
+func CachedDatabaseSize(dbName string) (int64, error) {
+	value, err := cachedStat("size:"+dbName, func() (interface{}, error) {
+		return DatabaseSize(dbName)
+	})
+	size, _ := value.(int64)
+	return size, err
+}
+
+// CachedTableStats is TableStats with a short cache
+func CachedTableStats(dbName string) ([]TableStat, error) {
+	value, err := cachedStat("tables:"+dbName, func() (interface{}, error) {
+		return TableStats(dbName)
+	})
+	stats, _ := value.([]TableStat)
+	return stats, err
+}
+
+// CachedConnectionStats is GetConnectionStats with a short cache
+func CachedConnectionStats(dbName string) (*ConnectionStats, error) {
+	value, err := cachedStat("connections:"+dbName, func() (interface{}, error) {
+		return GetConnectionStats(dbName)
+	})
+	stats, _ := value.(*ConnectionStats)
+	return stats, err
+}
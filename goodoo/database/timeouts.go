@@ -0,0 +1,248 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"goodoo/logging"
+	"gorm.io/gorm"
+)
+
+// Timeout kinds of TimeoutError, named after the PostgreSQL setting
+// that expired
+const (
+	TimeoutStatement         = "statement"
+	TimeoutLock              = "lock"
+	TimeoutIdleInTransaction = "idle_in_transaction"
+)
+
+// LongOperationTimeout is the statement timeout RaiseTimeouts gives known
+// long operations, such as exports and migrations, unless they say
+// otherwise
+const LongOperationTimeout = time.Hour
+
+// SessionTimeouts are the timeouts PostgreSQL applies to every session of
+// a database; a zero one is left to the server configuration
+type SessionTimeouts struct {
+	// Statement cancels a statement running longer (statement_timeout)
+	Statement time.Duration
+	// Lock cancels a statement waiting longer for a lock (lock_timeout)
+	Lock time.Duration
+	// IdleInTransaction ends a session idle longer within a transaction
+	// (idle_in_transaction_session_timeout)
+	IdleInTransaction time.Duration
+}
+
+// DefaultSessionTimeouts returns a statement timeout of 2 minutes, a lock
+// timeout of 30 seconds and an idle in transaction timeout of 15 minutes
+func DefaultSessionTimeouts() SessionTimeouts {
+	return SessionTimeouts{
+		Statement:         2 * time.Minute,
+		Lock:              30 * time.Second,
+		IdleInTransaction: 15 * time.Minute,
+	}
+}
+
+// LoadFromEnv overrides the timeouts with GOODOO_DB_STATEMENT_TIMEOUT,
+// GOODOO_DB_LOCK_TIMEOUT and GOODOO_DB_IDLE_TRANSACTION_TIMEOUT; 0
+// leaves a timeout to the server configuration
+func (t *SessionTimeouts) LoadFromEnv() {
+	durations := map[string]*time.Duration{
+		"GOODOO_DB_STATEMENT_TIMEOUT":        &t.Statement,
+		"GOODOO_DB_LOCK_TIMEOUT":             &t.Lock,
+		"GOODOO_DB_IDLE_TRANSACTION_TIMEOUT": &t.IdleInTransaction,
+	}
+	for name, target := range durations {
+		if value := os.Getenv(name); value != "" {
+			if d, err := parseTimeout(value); err == nil {
+				*target = d
+			}
+		}
+	}
+}
+
+// settings returns the PostgreSQL settings of the timeouts set, in
+// milliseconds
+func (t SessionTimeouts) settings() [][2]string {
+	var settings [][2]string
+	for _, setting := range []struct {
+		name    string
+		timeout time.Duration
+	}{
+		{"statement_timeout", t.Statement},
+		{"lock_timeout", t.Lock},
+		{"idle_in_transaction_session_timeout", t.IdleInTransaction},
+	} {
+		if setting.timeout > 0 {
+			settings = append(settings, [2]string{setting.name, strconv.FormatInt(setting.timeout.Milliseconds(), 10)})
+		}
+	}
+	return settings
+}
+
+// String describes the timeouts for connection keys and logs
+func (t SessionTimeouts) String() string {
+	return fmt.Sprintf("statement=%s,lock=%s,idle_in_transaction=%s", t.Statement, t.Lock, t.IdleInTransaction)
+}
+
+// parseTimeout parses a duration, "0" included
+func parseTimeout(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if value == "0" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid timeout %q", value)
+	}
+	return d, nil
+}
+
+// ParseTimeoutOverrides parses per-database timeouts, as in
+// GOODOO_DB_TIMEOUT_OVERRIDES: "reporting:statement=10m,lock=1m;demo:statement=30s".
+// The timeouts not named keep those of base.
+func ParseTimeoutOverrides(value string, base SessionTimeouts) (map[string]SessionTimeouts, error) {
+	overrides := make(map[string]SessionTimeouts)
+	for _, entry := range strings.Split(value, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		dbName, list, found := strings.Cut(entry, ":")
+		dbName = strings.TrimSpace(dbName)
+		if !found || dbName == "" {
+			return nil, fmt.Errorf("invalid timeout override %q: expected database:name=duration,...", entry)
+		}
+		timeouts := base
+		for _, item := range strings.Split(list, ",") {
+			name, raw, found := strings.Cut(strings.TrimSpace(item), "=")
+			if !found {
+				return nil, fmt.Errorf("invalid timeout %q of %s", item, dbName)
+			}
+			d, err := parseTimeout(raw)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", dbName, err)
+			}
+			switch strings.TrimSpace(name) {
+			case TimeoutStatement:
+				timeouts.Statement = d
+			case TimeoutLock:
+				timeouts.Lock = d
+			case TimeoutIdleInTransaction, "idle":
+				timeouts.IdleInTransaction = d
+			default:
+				return nil, fmt.Errorf("unknown timeout %q of %s", name, dbName)
+			}
+		}
+		overrides[dbName] = timeouts
+	}
+	return overrides, nil
+}
+
+var (
+	sessionTimeouts     *SessionTimeouts
+	timeoutOverrides    map[string]SessionTimeouts
+	sessionTimeoutsOnce sync.Once
+)
+
+// TimeoutsFor returns the session timeouts of a database: those of the
+// environment, or its GOODOO_DB_TIMEOUT_OVERRIDES entry. An invalid
+// override is logged and ignored.
+func TimeoutsFor(dbName string) SessionTimeouts {
+	sessionTimeoutsOnce.Do(func() {
+		defaults := DefaultSessionTimeouts()
+		defaults.LoadFromEnv()
+		sessionTimeouts = &defaults
+		if value := os.Getenv("GOODOO_DB_TIMEOUT_OVERRIDES"); value != "" {
+			overrides, err := ParseTimeoutOverrides(value, defaults)
+			if err != nil {
+				logging.GetLogger("goodoo.database").Warning("Ignoring GOODOO_DB_TIMEOUT_OVERRIDES: %v", err)
+			}
+			timeoutOverrides = overrides
+		}
+	})
+	if timeouts, ok := timeoutOverrides[dbName]; ok {
+		return timeouts
+	}
+	return *sessionTimeouts
+}
+
+// RaiseTimeouts raises the statement and idle in transaction timeouts of
+// the transaction tx to timeout, 0 lifting them, for a known long
+// operation. They are set as SET LOCAL does, so the commit or rollback
+// restores the session ones; the lock timeout is kept.
+func RaiseTimeouts(tx *gorm.DB, timeout time.Duration) error {
+	value := strconv.FormatInt(timeout.Milliseconds(), 10)
+	for _, setting := range []string{"statement_timeout", "idle_in_transaction_session_timeout"} {
+		if err := tx.Exec("SELECT set_config(?, ?, true)", setting, value).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TimeoutError is a statement PostgreSQL cancelled, or a session it
+// ended, because a timeout of SessionTimeouts expired
+type TimeoutError struct {
+	// Kind is TimeoutStatement, TimeoutLock or TimeoutIdleInTransaction
+	Kind string
+	Err  error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("database %s timeout: %v", strings.ReplaceAll(e.Kind, "_", " "), e.Err)
+}
+
+// Unwrap returns the PostgreSQL error
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// AsTimeoutError turns the PostgreSQL errors of the expired timeouts into
+// a TimeoutError and returns the others unchanged. A statement cancelled
+// on request, as when its context ends, is not a timeout.
+func AsTimeoutError(err error) error {
+	var timeoutErr *TimeoutError
+	var pgErr *pgconn.PgError
+	if err == nil || errors.As(err, &timeoutErr) || !errors.As(err, &pgErr) {
+		return err
+	}
+	switch {
+	case pgErr.Code == "57014" && strings.Contains(pgErr.Message, "statement timeout"):
+		return &TimeoutError{Kind: TimeoutStatement, Err: err}
+	case pgErr.Code == "55P03" && strings.Contains(pgErr.Message, "lock timeout"):
+		return &TimeoutError{Kind: TimeoutLock, Err: err}
+	case pgErr.Code == "25P03":
+		return &TimeoutError{Kind: TimeoutIdleInTransaction, Err: err}
+	}
+	return err
+}
+
+// registerTimeoutCallbacks makes the statements of db fail with a
+// TimeoutError when a timeout expires
+func registerTimeoutCallbacks(db *gorm.DB) error {
+	translate := func(db *gorm.DB) {
+		if db.Error != nil {
+			db.Error = AsTimeoutError(db.Error)
+		}
+	}
+	callbacks := db.Callback()
+	for _, register := range []func() error{
+		func() error { return callbacks.Create().After("gorm:create").Register("goodoo:timeout", translate) },
+		func() error { return callbacks.Query().After("gorm:query").Register("goodoo:timeout", translate) },
+		func() error { return callbacks.Update().After("gorm:update").Register("goodoo:timeout", translate) },
+		func() error { return callbacks.Delete().After("gorm:delete").Register("goodoo:timeout", translate) },
+		func() error { return callbacks.Row().After("gorm:row").Register("goodoo:timeout", translate) },
+		func() error { return callbacks.Raw().After("gorm:raw").Register("goodoo:timeout", translate) },
+	} {
+		if err := register(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
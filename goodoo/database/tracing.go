@@ -0,0 +1,69 @@
+package database
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"goodoo/logging"
+	"goodoo/tracing"
+	"gorm.io/gorm/logger"
+)
+
+// sqlLogger logs every query at DEBUG, e.g. under goodoo.sql_db:DEBUG or
+// the log level override of a request
+var sqlLogger = logging.GetLogger("goodoo.sql_db")
+
+// TracingLogger wraps a GORM logger to record every query as a span of the
+// request trace carried by the statement context, and the slow queries of
+// its database (see SlowQueries)
+type TracingLogger struct {
+	logger.Interface
+	// database is the database of the connection, empty for the shared
+	// logger of the pool
+	database string
+}
+
+// NewTracingLogger wraps a GORM logger
+func NewTracingLogger(l logger.Interface) *TracingLogger {
+	return &TracingLogger{Interface: l}
+}
+
+// ForDatabase returns the logger of a connection to a database
+func (l *TracingLogger) ForDatabase(dbName string) *TracingLogger {
+	return &TracingLogger{Interface: l.Interface, database: dbName}
+}
+
+// LogMode keeps the wrapper when the log level changes
+func (l *TracingLogger) LogMode(level logger.LogLevel) logger.Interface {
+	return &TracingLogger{Interface: l.Interface.LogMode(level), database: l.database}
+}
+
+// Trace records the query span and the slow query, then logs it with the
+// wrapped logger
+func (l *TracingLogger) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
+	elapsed := time.Since(begin)
+	traced := tracing.Active(ctx)
+	slow := err == nil && l.database != "" && isSlow(elapsed)
+	debug := sqlLogger.EnabledFor(ctx, logging.DEBUG)
+	if traced || slow || debug {
+		sql, rows := fc()
+		if debug {
+			sqlLogger.DebugCtx(ctx, "%s [%d rows, %v]", sql, rows, elapsed.Round(time.Microsecond))
+		}
+		if traced {
+			attributes := map[string]string{
+				"db.statement": sql,
+				"db.rows":      strconv.FormatInt(rows, 10),
+			}
+			if err != nil {
+				attributes["error"] = err.Error()
+			}
+			tracing.Record(ctx, "db.query", begin, elapsed, attributes)
+		}
+		if slow {
+			recordSlowQuery(l.database, sql, elapsed, rows, begin.Add(elapsed))
+		}
+	}
+	l.Interface.Trace(ctx, begin, fc, err)
+}
@@ -0,0 +1,429 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"goodoo/logging"
+)
+
+// Warm-up states of a database
+const (
+	WarmupPending  = "pending"
+	WarmupReady    = "ready"
+	WarmupDegraded = "degraded"
+)
+
+// WarmupConfig holds the startup warm-up of database connections. Disabled,
+// databases are dialed on their first request.
+type WarmupConfig struct {
+	Enabled bool
+	// Databases are warmed up besides the default one
+	Databases []string
+	// Discover adds the databases of the server matching Filter, read from
+	// pg_database through the default database
+	Discover bool
+	// Filter is a regular expression the discovered names must match in
+	// full; empty matches every database but postgres
+	Filter string
+	// Concurrency bounds the databases warmed up at once; Timeout bounds
+	// the connection and ping of each
+	Concurrency int
+	Timeout     time.Duration
+	// RetryBackoff is the first delay before retrying a degraded database,
+	// doubled on each failure up to MaxRetryBackoff
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+}
+
+// DefaultWarmupConfig returns the lazy path: no warm-up. Enabled, it warms
+// up 4 databases at once, 10 seconds each, and retries from 5 seconds to
+// 5 minutes apart.
+func DefaultWarmupConfig() *WarmupConfig {
+	return &WarmupConfig{
+		Concurrency:     4,
+		Timeout:         10 * time.Second,
+		RetryBackoff:    5 * time.Second,
+		MaxRetryBackoff: 5 * time.Minute,
+	}
+}
+
+// LoadFromEnv overrides the configuration with GOODOO_DB_WARMUP* and
+// GOODOO_DB_FILTER
+func (c *WarmupConfig) LoadFromEnv() {
+	if value := os.Getenv("GOODOO_DB_WARMUP"); value != "" {
+		if enabled, err := strconv.ParseBool(value); err == nil {
+			c.Enabled = enabled
+		}
+	}
+	if value := os.Getenv("GOODOO_DB_WARMUP_DISCOVER"); value != "" {
+		if discover, err := strconv.ParseBool(value); err == nil {
+			c.Discover = discover
+		}
+	}
+	if value := os.Getenv("GOODOO_DB_WARMUP_DATABASES"); value != "" {
+		c.Databases = nil
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				c.Databases = append(c.Databases, name)
+			}
+		}
+	}
+	if value := os.Getenv("GOODOO_DB_FILTER"); value != "" {
+		c.Filter = value
+	}
+	if value := os.Getenv("GOODOO_DB_WARMUP_CONCURRENCY"); value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n > 0 {
+			c.Concurrency = n
+		}
+	}
+	durations := map[string]*time.Duration{
+		"GOODOO_DB_WARMUP_TIMEOUT":           &c.Timeout,
+		"GOODOO_DB_WARMUP_RETRY_BACKOFF":     &c.RetryBackoff,
+		"GOODOO_DB_WARMUP_MAX_RETRY_BACKOFF": &c.MaxRetryBackoff,
+	}
+	for name, target := range durations {
+		if value := os.Getenv(name); value != "" {
+			if d, err := time.ParseDuration(value); err == nil && d > 0 {
+				*target = d
+			}
+		}
+	}
+}
+
+// Validate checks the filter compiles
+func (c *WarmupConfig) Validate() error {
+	if c.Filter == "" {
+		return nil
+	}
+	if _, err := regexp.Compile("^(?:" + c.Filter + ")$"); err != nil {
+		return fmt.Errorf("invalid database filter: %w", err)
+	}
+	return nil
+}
+
+// WarmupStatus is the readiness of a database
+type WarmupStatus struct {
+	Name  string `json:"name"`
+	State string `json:"state"`
+	// Discovered is set for the databases found in pg_database
+	Discovered  bool       `json:"discovered,omitempty"`
+	Attempts    int        `json:"attempts"`
+	LatencyMs   int64      `json:"latency_ms,omitempty"`
+	LastAttempt *time.Time `json:"last_attempt,omitempty"`
+	ReadySince  *time.Time `json:"ready_since,omitempty"`
+	NextRetry   *time.Time `json:"next_retry,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// warmupEntry is the state of a warmed-up database
+type warmupEntry struct {
+	status WarmupStatus
+	// retrying is set while background retries run
+	retrying bool
+}
+
+var (
+	warmupConfig  = DefaultWarmupConfig()
+	warmupEntries = make(map[string]*warmupEntry)
+	warmupMutex   sync.Mutex
+	warmupCtx     = context.Background()
+	warmupLogger  = logging.GetLogger("goodoo.database.warmup")
+)
+
+// WarmupEnabled reports whether the warm-up ran, so readiness is known
+func WarmupEnabled() bool {
+	warmupMutex.Lock()
+	defer warmupMutex.Unlock()
+	return warmupConfig.Enabled
+}
+
+// Warmup registers the default database, the configured ones and the
+// discovered ones, then connects to and pings each, at most
+// c.Concurrency at once. It returns once every database answered or
+// timed out; those that failed are degraded and retried in the background
+// until ctx is done. It does nothing when c is disabled.
+func Warmup(ctx context.Context, c *WarmupConfig, defaultDB string) []WarmupStatus {
+	warmupMutex.Lock()
+	warmupConfig = c
+	warmupCtx = ctx
+	warmupMutex.Unlock()
+	if !c.Enabled {
+		return nil
+	}
+
+	names := []string{defaultDB}
+	names = append(names, c.Databases...)
+	discovered := make(map[string]bool)
+	if c.Discover {
+		found, err := discoverDatabases(defaultDB, c.Filter)
+		if err != nil {
+			warmupLogger.Warning("Failed to discover databases: %v", err)
+		}
+		for _, name := range found {
+			discovered[name] = true
+		}
+		names = append(names, found...)
+	}
+
+	seen := make(map[string]bool)
+	var pending []string
+	for _, name := range names {
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		if err := registerWithEnv(name); err != nil {
+			warmupLogger.Warning("Cannot register database %s: %v", name, err)
+			continue
+		}
+		warmupMutex.Lock()
+		if warmupEntries[name] == nil {
+			warmupEntries[name] = &warmupEntry{
+				status: WarmupStatus{Name: name, State: WarmupPending, Discovered: discovered[name]},
+			}
+		}
+		warmupMutex.Unlock()
+		pending = append(pending, name)
+	}
+
+	concurrency := c.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, name := range pending {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(name string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			warmOne(name)
+		}(name)
+	}
+	wg.Wait()
+
+	statuses := WarmupStatuses()
+	ready := 0
+	for _, status := range statuses {
+		if status.State == WarmupReady {
+			ready++
+		}
+	}
+	warmupLogger.Info("Warmed up %d of %d database(s)", ready, len(statuses))
+	return statuses
+}
+
+// registerWithEnv registers a database with the connection settings of
+// the environment, unless it is registered already
+func registerWithEnv(name string) error {
+	if _, err := GetRegistry().GetDatabaseInfo(name); err == nil {
+		return nil
+	}
+	_, config, err := ParseConnectionInfo(name)
+	if err != nil {
+		return err
+	}
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	if err := GetRegistry().Register(name, config); err != nil {
+		// Registered meanwhile
+		if _, infoErr := GetRegistry().GetDatabaseInfo(name); infoErr == nil {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// discoverDatabases lists the databases of the server of defaultDB whose
+// name matches filter
+func discoverDatabases(defaultDB, filter string) ([]string, error) {
+	if err := registerWithEnv(defaultDB); err != nil {
+		return nil, err
+	}
+	db, err := GetDatabase(defaultDB)
+	if err != nil {
+		return nil, err
+	}
+	var pattern *regexp.Regexp
+	if filter != "" {
+		if pattern, err = regexp.Compile("^(?:" + filter + ")$"); err != nil {
+			return nil, err
+		}
+	}
+
+	var names []string
+	err = db.Raw("SELECT datname FROM pg_database WHERE datallowconn AND NOT datistemplate ORDER BY datname").
+		Scan(&names).Error
+	if err != nil {
+		return nil, err
+	}
+	var found []string
+	for _, name := range names {
+		if pattern != nil && !pattern.MatchString(name) || pattern == nil && name == "postgres" {
+			continue
+		}
+		found = append(found, name)
+	}
+	return found, nil
+}
+
+// errWarmupTimeout is the error of a database that did not answer in time
+var errWarmupTimeout = errors.New("timed out")
+
+// warmOne connects to and pings a database, then records the outcome; a
+// degraded database starts its background retries
+func warmOne(name string) {
+	warmupMutex.Lock()
+	timeout := warmupConfig.Timeout
+	warmupMutex.Unlock()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		connection, err := GetDatabaseConnection(name)
+		if err == nil {
+			err = connection.Ping()
+		}
+		done <- err
+	}()
+	var err error
+	timer := time.NewTimer(timeout)
+	select {
+	case err = <-done:
+		timer.Stop()
+	case <-timer.C:
+		err = errWarmupTimeout
+	}
+	latency := time.Since(start)
+
+	warmupMutex.Lock()
+	entry := warmupEntries[name]
+	status := &entry.status
+	now := time.Now()
+	status.Attempts++
+	status.LastAttempt = &now
+	status.NextRetry = nil
+	startRetries := false
+	if err == nil {
+		if status.State != WarmupReady {
+			status.ReadySince = &now
+		}
+		status.State = WarmupReady
+		status.LatencyMs = latency.Milliseconds()
+		status.Error = ""
+	} else {
+		status.State = WarmupDegraded
+		status.ReadySince = nil
+		status.Error = err.Error()
+		startRetries = !entry.retrying
+		entry.retrying = true
+	}
+	attempts := status.Attempts
+	warmupMutex.Unlock()
+
+	if err == nil {
+		warmupLogger.Info("Database %s is ready (%dms)", name, latency.Milliseconds())
+		return
+	}
+	warmupLogger.Warning("Database %s is degraded after %d attempt(s): %v", name, attempts, err)
+	if startRetries {
+		go retryDegraded(name)
+	}
+}
+
+// retryDegraded retries a degraded database with backoff until it is
+// ready, by itself or through RetryWarmup, or the warm-up context is done
+func retryDegraded(name string) {
+	warmupMutex.Lock()
+	ctx := warmupCtx
+	delay := warmupConfig.RetryBackoff
+	maxDelay := warmupConfig.MaxRetryBackoff
+	entry := warmupEntries[name]
+	warmupMutex.Unlock()
+	defer func() {
+		warmupMutex.Lock()
+		entry.retrying = false
+		warmupMutex.Unlock()
+	}()
+
+	for {
+		next := time.Now().Add(delay)
+		warmupMutex.Lock()
+		if entry.status.State != WarmupDegraded {
+			warmupMutex.Unlock()
+			return
+		}
+		entry.status.NextRetry = &next
+		warmupMutex.Unlock()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		// A retry of RetryWarmup may have succeeded meanwhile
+		warmupMutex.Lock()
+		degraded := entry.status.State == WarmupDegraded
+		warmupMutex.Unlock()
+		if !degraded {
+			return
+		}
+		warmOne(name)
+
+		if delay *= 2; delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+}
+
+// ErrNotWarmedUp is returned when retrying a database the warm-up does
+// not know
+var ErrNotWarmedUp = errors.New("database is not warmed up")
+
+// RetryWarmup warms up a database again at once, every degraded one when
+// name is empty, and returns the new statuses
+func RetryWarmup(name string) ([]WarmupStatus, error) {
+	var names []string
+	warmupMutex.Lock()
+	for candidate, entry := range warmupEntries {
+		if candidate == name || (name == "" && entry.status.State == WarmupDegraded) {
+			names = append(names, candidate)
+		}
+	}
+	warmupMutex.Unlock()
+	if name != "" && len(names) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNotWarmedUp, name)
+	}
+
+	for _, candidate := range names {
+		warmOne(candidate)
+	}
+	return WarmupStatuses(), nil
+}
+
+// WarmupStatuses returns the readiness of the warmed-up databases by name
+func WarmupStatuses() []WarmupStatus {
+	warmupMutex.Lock()
+	defer warmupMutex.Unlock()
+	statuses := make([]WarmupStatus, 0, len(warmupEntries))
+	for _, entry := range warmupEntries {
+		statuses = append(statuses, entry.status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
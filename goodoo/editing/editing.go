@@ -0,0 +1,324 @@
+// Package editing tracks who is editing which record, so that forms can
+// show that another user has the record open in edit mode before a save
+// runs into a conflict. Clients start editing, send heartbeats while the
+// form stays in edit mode and stop when they leave it; an editor whose
+// heartbeats stop expires. Changes are published on the bus. It is
+// advisory only: writes are never blocked, the optimistic locking of
+// records still decides which save wins.
+package editing
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"goodoo/bus"
+	"goodoo/scheduler"
+)
+
+// Channel is the bus channel of editing changes; payloads are Event values
+const Channel = "editing"
+
+// Events published on Channel
+const (
+	EventStart = "start"
+	EventStop  = "stop"
+)
+
+var (
+	// ErrTooManyRecords is returned when a user already edits the maximum
+	// number of records
+	ErrTooManyRecords = errors.New("editing too many records")
+	// ErrTooManyEditors is returned when a record already has the maximum
+	// number of editors
+	ErrTooManyEditors = errors.New("too many editors on this record")
+)
+
+// Config holds the editing timeout and limits
+type Config struct {
+	// Timeout is how long an editor stays without heartbeat
+	Timeout time.Duration
+	// MaxPerUser is the number of records a user may edit at once
+	MaxPerUser int
+	// MaxPerRecord is the number of users that may edit a record at once
+	MaxPerRecord int
+}
+
+// DefaultConfig returns a timeout of 30 seconds, 20 records per user and
+// 10 editors per record
+func DefaultConfig() *Config {
+	return &Config{
+		Timeout:      30 * time.Second,
+		MaxPerUser:   20,
+		MaxPerRecord: 10,
+	}
+}
+
+// LoadFromEnv overrides the configuration with GOODOO_EDITING_* variables
+func (c *Config) LoadFromEnv() {
+	if value := os.Getenv("GOODOO_EDITING_TIMEOUT"); value != "" {
+		if d, err := time.ParseDuration(value); err == nil && d > 0 {
+			c.Timeout = d
+		}
+	}
+	if value := os.Getenv("GOODOO_EDITING_MAX_PER_USER"); value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n > 0 {
+			c.MaxPerUser = n
+		}
+	}
+	if value := os.Getenv("GOODOO_EDITING_MAX_PER_RECORD"); value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n > 0 {
+			c.MaxPerRecord = n
+		}
+	}
+}
+
+// Editor is a user editing a record
+type Editor struct {
+	UserID uint      `json:"user_id"`
+	Since  time.Time `json:"since"`
+}
+
+// Event is a user starting or stopping to edit a record, with the editors
+// left
+type Event struct {
+	Type    string   `json:"type"`
+	Model   string   `json:"model"`
+	ResID   uint     `json:"res_id"`
+	UserID  uint     `json:"user_id"`
+	Editors []Editor `json:"editors"`
+}
+
+// record identifies a record of a database
+type record struct {
+	db    string
+	model string
+	id    uint
+}
+
+// session is a form of a user in edit mode, one per device
+type session struct {
+	since         time.Time
+	lastHeartbeat time.Time
+}
+
+// editors are the sessions of the users editing a record, by user and device
+type editors map[uint]map[string]*session
+
+// list returns the editors at now, the earliest first, forgetting the
+// sessions that timed out; it reports the users that expired
+func (e editors) list(c *Config, now time.Time) ([]Editor, []uint) {
+	var list []Editor
+	var expired []uint
+	for uid, sessions := range e {
+		var since time.Time
+		for device, s := range sessions {
+			if now.Sub(s.lastHeartbeat) > c.Timeout {
+				delete(sessions, device)
+				continue
+			}
+			if since.IsZero() || s.since.Before(since) {
+				since = s.since
+			}
+		}
+		if len(sessions) == 0 {
+			delete(e, uid)
+			expired = append(expired, uid)
+			continue
+		}
+		list = append(list, Editor{UserID: uid, Since: since})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].Since.Equal(list[j].Since) {
+			return list[i].Since.Before(list[j].Since)
+		}
+		return list[i].UserID < list[j].UserID
+	})
+	return list, expired
+}
+
+var (
+	config = DefaultConfig()
+	// records maps the records being edited to their editors
+	records = make(map[record]editors)
+	// users counts the records each user of a database edits
+	users = make(map[string]map[uint]int)
+	mutex sync.Mutex
+)
+
+// Setup installs the process-wide editing configuration
+func Setup(c *Config) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	config = c
+}
+
+// forget drops the counts of users that stopped editing r and the record
+// once nobody edits it; mutex must be held
+func forget(r record, uids []uint) {
+	for _, uid := range uids {
+		if users[r.db][uid]--; users[r.db][uid] <= 0 {
+			delete(users[r.db], uid)
+		}
+	}
+	if len(records[r]) == 0 {
+		delete(records, r)
+	}
+}
+
+// Heartbeat records that a device of the user edits a record, starting to
+// edit it when the device was not, and returns the editors of the record.
+// It fails when the user or the record is at its limit.
+func Heartbeat(dbName, model string, id, uid uint, deviceID string) ([]Editor, error) {
+	now := time.Now()
+	r := record{db: dbName, model: model, id: id}
+	mutex.Lock()
+	e := records[r]
+	if e == nil {
+		e = make(editors)
+	}
+	list, expired := e.list(config, now)
+	forget(r, expired)
+
+	started := false
+	sessions := e[uid]
+	if sessions == nil {
+		if len(list) >= config.MaxPerRecord {
+			mutex.Unlock()
+			return list, ErrTooManyEditors
+		}
+		if users[dbName][uid] >= config.MaxPerUser {
+			mutex.Unlock()
+			return list, ErrTooManyRecords
+		}
+		sessions = make(map[string]*session)
+		e[uid] = sessions
+		records[r] = e
+		if users[dbName] == nil {
+			users[dbName] = make(map[uint]int)
+		}
+		users[dbName][uid]++
+		started = true
+	}
+	s := sessions[deviceID]
+	if s == nil {
+		s = &session{since: now}
+		sessions[deviceID] = s
+	}
+	s.lastHeartbeat = now
+	if started {
+		list, _ = e.list(config, now)
+	}
+	mutex.Unlock()
+
+	for _, uid := range expired {
+		bus.Publish(dbName, Channel, Event{Type: EventStop, Model: model, ResID: id, UserID: uid, Editors: list})
+	}
+	if started {
+		bus.Publish(dbName, Channel, Event{Type: EventStart, Model: model, ResID: id, UserID: uid, Editors: list})
+	}
+	return list, nil
+}
+
+// Stop records that a device of the user left the edit mode of a record;
+// the user stops editing it with their last device. It returns the editors
+// left.
+func Stop(dbName, model string, id, uid uint, deviceID string) []Editor {
+	now := time.Now()
+	r := record{db: dbName, model: model, id: id}
+	mutex.Lock()
+	e := records[r]
+	if e == nil {
+		mutex.Unlock()
+		return []Editor{}
+	}
+	stopped := false
+	if sessions := e[uid]; sessions != nil {
+		delete(sessions, deviceID)
+		if len(sessions) == 0 {
+			delete(e, uid)
+			stopped = true
+		}
+	}
+	list, expired := e.list(config, now)
+	if stopped {
+		expired = append(expired, uid)
+	}
+	forget(r, expired)
+	mutex.Unlock()
+
+	for _, uid := range expired {
+		bus.Publish(dbName, Channel, Event{Type: EventStop, Model: model, ResID: id, UserID: uid, Editors: list})
+	}
+	if list == nil {
+		list = []Editor{}
+	}
+	return list
+}
+
+// Editors returns the users editing a record, the earliest first
+func Editors(dbName, model string, id uint) []Editor {
+	r := record{db: dbName, model: model, id: id}
+	mutex.Lock()
+	e := records[r]
+	if e == nil {
+		mutex.Unlock()
+		return []Editor{}
+	}
+	list, expired := e.list(config, time.Now())
+	forget(r, expired)
+	mutex.Unlock()
+
+	for _, uid := range expired {
+		bus.Publish(dbName, Channel, Event{Type: EventStop, Model: model, ResID: id, UserID: uid, Editors: list})
+	}
+	if list == nil {
+		list = []Editor{}
+	}
+	return list
+}
+
+// Sweep expires the editors of a database whose heartbeats stopped and
+// publishes their stop
+func Sweep(dbName string) {
+	now := time.Now()
+	var events []Event
+	mutex.Lock()
+	for r, e := range records {
+		if r.db != dbName {
+			continue
+		}
+		list, expired := e.list(config, now)
+		forget(r, expired)
+		for _, uid := range expired {
+			events = append(events, Event{Type: EventStop, Model: r.model, ResID: r.id, UserID: uid, Editors: list})
+		}
+	}
+	mutex.Unlock()
+
+	for _, event := range events {
+		bus.Publish(dbName, Channel, event)
+	}
+}
+
+// Subscribe calls fn with the editing changes of a record of a database
+// until the returned function is called. fn must not block.
+func Subscribe(dbName, model string, id uint, fn func(Event)) (unsubscribe func()) {
+	return bus.Subscribe(Channel, func(message bus.Message) {
+		if event, ok := message.Payload.(Event); ok && message.DB == dbName && event.Model == model && event.ResID == id {
+			fn(event)
+		}
+	})
+}
+
+// Schedule registers the job expiring the editors of a database every interval
+func Schedule(s *scheduler.Scheduler, dbName string, interval time.Duration) {
+	s.Every("editing.sweep."+dbName, interval, func(ctx context.Context) error {
+		Sweep(dbName)
+		return nil
+	})
+}
@@ -0,0 +1,313 @@
+package expr
+
+import (
+	"fmt"
+	"time"
+)
+
+// checker gives the nodes of a syntax tree their type, collecting the
+// errors of the whole expression
+type checker struct {
+	source string
+	schema Schema
+	names  map[string]bool
+	errs   Errors
+}
+
+// errorf records an error at a node and returns Any, so that the checking
+// of the enclosing nodes goes on without reporting it again
+func (c *checker) errorf(n node, format string, args ...interface{}) Type {
+	c.errs = append(c.errs, newError(c.source, n.base().pos, format, args...))
+	return Any
+}
+
+// check types a node and its children
+func (c *checker) check(n node) Type {
+	t := c.checkNode(n)
+	n.base().typ = t
+	return t
+}
+
+func (c *checker) checkNode(n node) Type {
+	switch n := n.(type) {
+	case *literalNode:
+		return literalType(n.value)
+	case *listNode:
+		var item Type = Any
+		for _, x := range n.items {
+			t := c.check(x)
+			switch {
+			case t == List:
+				c.errorf(x, "lists cannot be nested")
+			case t == Null || t == Any:
+			case item == Any:
+				item = t
+			case !comparable(item, t):
+				c.errorf(x, "list mixes %s and %s values", item, t)
+			}
+		}
+		return List
+	case *nameNode:
+		return c.name(n)
+	case *callNode:
+		return c.call(n)
+	case *unaryNode:
+		t := c.check(n.x)
+		switch n.op {
+		case "not":
+			if t != Bool && t != Any {
+				return c.errorf(n, "not applies to a bool, not %s", t)
+			}
+			return Bool
+		default:
+			if t != Int && t != Float && t != Duration && t != Any {
+				return c.errorf(n, "cannot negate %s", t)
+			}
+			return t
+		}
+	case *binaryNode:
+		x, y := c.check(n.x), c.check(n.y)
+		if x == Any && y == Any {
+			switch n.op {
+			case "and", "or", "=", "!=", "<", "<=", ">", ">=", "in", "not in":
+				return Bool
+			}
+			return Any
+		}
+		switch n.op {
+		case "and", "or":
+			for _, t := range []Type{x, y} {
+				if t != Bool && t != Any {
+					return c.errorf(n, "%s joins bools, not %s", n.op, t)
+				}
+			}
+			return Bool
+		case "=", "!=":
+			if !comparable(x, y) && x != Null && y != Null {
+				return c.errorf(n, "cannot compare %s with %s", x, y)
+			}
+			return Bool
+		case "<", "<=", ">", ">=":
+			if !ordered(x) || !ordered(y) || !comparable(x, y) {
+				return c.errorf(n, "cannot order %s and %s", x, y)
+			}
+			return Bool
+		case "in", "not in":
+			if y != List && y != Any {
+				return c.errorf(n, "%s needs a list on its right, not %s", n.op, y)
+			}
+			if x == List {
+				return c.errorf(n, "a list cannot be %s a list", n.op)
+			}
+			if list, ok := n.y.(*listNode); ok {
+				for _, item := range list.items {
+					if t := item.base().typ; t != Null && !comparable(x, t) {
+						c.errorf(item, "cannot compare %s with %s", x, t)
+					}
+				}
+			}
+			return Bool
+		}
+		t, ok := arithmeticType(n.op, x, y)
+		if !ok {
+			return c.errorf(n, "operator %s does not apply to %s and %s", n.op, x, y)
+		}
+		return t
+	}
+	return c.errorf(n, "unsupported expression")
+}
+
+// literalType returns the type of a constant
+func literalType(value interface{}) Type {
+	switch value.(type) {
+	case nil:
+		return Null
+	case bool:
+		return Bool
+	case int64:
+		return Int
+	case float64:
+		return Float
+	case string:
+		return String
+	case time.Duration:
+		return Duration
+	}
+	return Any
+}
+
+// name types a reference
+func (c *checker) name(n *nameNode) Type {
+	c.names[n.name()] = true
+	switch n.path[0] {
+	case "user":
+		if len(n.path) != 2 {
+			return c.errorf(n, "use user.id, user.login, user.name, user.lang or user.tz")
+		}
+		t, ok := userAttributes[n.path[1]]
+		if !ok {
+			return c.errorf(n, "unknown user attribute %q; use id, login, name, lang or tz", n.path[1])
+		}
+		return t
+	case "context":
+		if len(n.path) != 2 {
+			return c.errorf(n, "use context.<key>")
+		}
+		return Any
+	}
+	if len(n.path) > 1 {
+		return c.errorf(n, "%s: related paths are not supported, only fields of the record", n.name())
+	}
+	t, ok := c.schema[n.path[0]]
+	if !ok {
+		if c.schema == nil {
+			return c.errorf(n, "unknown name %q: fields cannot be used here", n.path[0])
+		}
+		return c.errorf(n, "unknown field %q", n.path[0])
+	}
+	return t
+}
+
+// function is a function of the language: its signature check and its
+// implementation
+type function struct {
+	// signature returns the type of the result for the argument types, or
+	// an error message
+	signature func(args []Type) (Type, string)
+	call      func(e *evaluator, args []interface{}) (interface{}, error)
+}
+
+// fixed returns the signature of a function taking arguments of the given
+// types, each among the alternatives of its position, and returning
+// result; a result of -1 returns the type of the first argument
+func fixed(result Type, params ...[]Type) func([]Type) (Type, string) {
+	return func(args []Type) (Type, string) {
+		if len(args) != len(params) {
+			return Any, fmt.Sprintf("takes %d argument(s), not %d", len(params), len(args))
+		}
+		for i, t := range args {
+			if t == Any || t == Null {
+				continue
+			}
+			accepted := false
+			for _, want := range params[i] {
+				accepted = accepted || t == want
+			}
+			if !accepted {
+				return Any, fmt.Sprintf("argument %d cannot be %s", i+1, t)
+			}
+		}
+		if result == -1 {
+			return args[0], ""
+		}
+		return result, ""
+	}
+}
+
+// call types a function call
+func (c *checker) call(n *callNode) Type {
+	args := make([]Type, len(n.args))
+	for i, arg := range n.args {
+		args[i] = c.check(arg)
+	}
+	fn, ok := functions[n.name]
+	if !ok {
+		return c.errorf(n, "unknown function %s(); available: %s", n.name, functionNames())
+	}
+	t, message := fn.signature(args)
+	if message != "" {
+		return c.errorf(n, "%s() %s", n.name, message)
+	}
+	return t
+}
+
+// comparable reports whether values of two types can be compared
+func comparable(x, y Type) bool {
+	switch {
+	case x == Any || y == Any || x == y:
+		return true
+	case numeric(x) && numeric(y):
+		return true
+	case (x == Date || x == Datetime) && (y == Date || y == Datetime):
+		return true
+	}
+	return false
+}
+
+// ordered reports whether values of a type can be ordered
+func ordered(t Type) bool {
+	switch t {
+	case Any, Int, Float, String, Date, Datetime, Duration:
+		return true
+	}
+	return false
+}
+
+func numeric(t Type) bool {
+	return t == Int || t == Float
+}
+
+// arithmeticType returns the type of an arithmetic operation, false when
+// the operator does not apply to the types. An operand of type Any gives
+// a result of type Any, checked when evaluating.
+func arithmeticType(op string, x, y Type) (Type, bool) {
+	if x == Null || y == Null {
+		return Any, false
+	}
+	if x == Any || y == Any {
+		return Any, true
+	}
+	switch op {
+	case "+":
+		switch {
+		case x == Int && y == Int:
+			return Int, true
+		case numeric(x) && numeric(y):
+			return Float, true
+		case x == String && y == String:
+			return String, true
+		case x == Duration && y == Duration:
+			return Duration, true
+		case (x == Date || x == Datetime) && y == Duration:
+			return x, true
+		case x == Duration && (y == Date || y == Datetime):
+			return y, true
+		}
+	case "-":
+		switch {
+		case x == Int && y == Int:
+			return Int, true
+		case numeric(x) && numeric(y):
+			return Float, true
+		case x == Duration && y == Duration:
+			return Duration, true
+		case (x == Date || x == Datetime) && y == Duration:
+			return x, true
+		case (x == Date || x == Datetime) && (y == Date || y == Datetime):
+			return Duration, true
+		}
+	case "*":
+		switch {
+		case x == Int && y == Int:
+			return Int, true
+		case numeric(x) && numeric(y):
+			return Float, true
+		case x == Duration && y == Int, x == Int && y == Duration:
+			return Duration, true
+		}
+	case "/":
+		switch {
+		case x == Int && y == Int:
+			return Int, true
+		case numeric(x) && numeric(y):
+			return Float, true
+		case x == Duration && y == Int:
+			return Duration, true
+		}
+	case "%":
+		if x == Int && y == Int {
+			return Int, true
+		}
+	}
+	return Any, false
+}
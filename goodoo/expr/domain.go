@@ -0,0 +1,219 @@
+package expr
+
+import "time"
+
+// CompileDomain compiles an expression to be used as a domain: a
+// condition joining with and, or and not the comparisons of a field of the
+// record with a value, like "create_uid = user.id and state != 'done'",
+// and the bool fields themselves. The values cannot reference fields; they
+// are computed when the domain is built, for the user of the moment.
+func CompileDomain(source string, schema Schema) (*Program, error) {
+	p, err := Compile(source, schema)
+	if err != nil {
+		return nil, err
+	}
+	if t := p.Type(); t != Bool && t != Any {
+		return nil, Errors{newError(source, 0, "a domain is a condition, not %s", t)}
+	}
+	var errs Errors
+	checkDomain(source, p.root, &errs)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return p, nil
+}
+
+// mirrored are the comparison operators with the field on the right, for
+// the field on the left
+var mirrored = map[string]string{"=": "=", "!=": "!=", "<": ">", "<=": ">=", ">": "<", ">=": "<="}
+
+// hasFields reports whether a node references a field of the record
+func hasFields(n node) bool {
+	switch n := n.(type) {
+	case *nameNode:
+		return n.isField()
+	case *listNode:
+		for _, item := range n.items {
+			if hasFields(item) {
+				return true
+			}
+		}
+	case *callNode:
+		for _, arg := range n.args {
+			if hasFields(arg) {
+				return true
+			}
+		}
+	case *unaryNode:
+		return hasFields(n.x)
+	case *binaryNode:
+		return hasFields(n.x) || hasFields(n.y)
+	}
+	return false
+}
+
+// fieldOf returns the field a node is the bare reference of
+func fieldOf(n node) (*nameNode, bool) {
+	name, ok := n.(*nameNode)
+	return name, ok && name.isField()
+}
+
+// checkDomain collects the parts of an expression that cannot be turned
+// into a domain
+func checkDomain(source string, n node, errs *Errors) {
+	if !hasFields(n) {
+		return
+	}
+	switch n := n.(type) {
+	case *unaryNode:
+		if n.op == "not" {
+			checkDomain(source, n.x, errs)
+			return
+		}
+	case *binaryNode:
+		switch n.op {
+		case "and", "or":
+			checkDomain(source, n.x, errs)
+			checkDomain(source, n.y, errs)
+			return
+		case "in", "not in":
+			if _, ok := fieldOf(n.x); !ok || hasFields(n.y) {
+				*errs = append(*errs, newError(source, n.pos, "%s takes a field on its left and values on its right", n.op))
+			}
+			return
+		case "=", "!=", "<", "<=", ">", ">=":
+			_, left := fieldOf(n.x)
+			_, right := fieldOf(n.y)
+			if !(left && !hasFields(n.y)) && !(right && !hasFields(n.x)) {
+				*errs = append(*errs, newError(source, n.pos, "a comparison in a domain compares a field with a value computed without fields"))
+			}
+			return
+		}
+	case *nameNode:
+		if n.typ == Bool {
+			return
+		}
+	}
+	*errs = append(*errs, newError(source, n.base().pos, "a domain joins comparisons of fields with and, or and not"))
+}
+
+// Domain returns the domain of an expression compiled with CompileDomain,
+// in prefix notation: ["&", a, b] for a and b, ["|", a, b] for a or b and
+// ["!", a] for not a, each condition a (field, operator, value) triple.
+// Dates are given as "2006-01-02" and conditions without fields as
+// ("id", "!=", null) when true and ("id", "=", null) when false.
+func (p *Program) Domain(vars Vars, limits Limits) ([]interface{}, error) {
+	e := newEvaluator(p.source, vars, limits)
+	return e.domain(p.root)
+}
+
+// constantCondition is the domain condition of a constant truth
+func constantCondition(truth bool) []interface{} {
+	if truth {
+		return []interface{}{[]interface{}{"id", "!=", nil}}
+	}
+	return []interface{}{[]interface{}{"id", "=", nil}}
+}
+
+func (e *evaluator) domain(n node) ([]interface{}, error) {
+	if err := e.step(); err != nil {
+		return nil, err
+	}
+	if !hasFields(n) {
+		value, err := e.eval(n)
+		if err != nil {
+			return nil, err
+		}
+		truth, err := e.truth(n, value)
+		if err != nil {
+			return nil, err
+		}
+		return constantCondition(truth), nil
+	}
+
+	switch n := n.(type) {
+	case *unaryNode:
+		x, err := e.domain(n.x)
+		if err != nil {
+			return nil, err
+		}
+		return append([]interface{}{"!"}, x...), nil
+	case *nameNode:
+		return []interface{}{[]interface{}{n.name(), "=", true}}, nil
+	case *binaryNode:
+		switch n.op {
+		case "and", "or":
+			x, err := e.domain(n.x)
+			if err != nil {
+				return nil, err
+			}
+			y, err := e.domain(n.y)
+			if err != nil {
+				return nil, err
+			}
+			op := "&"
+			if n.op == "or" {
+				op = "|"
+			}
+			return append(append([]interface{}{op}, x...), y...), nil
+		case "in", "not in":
+			return e.membership(n)
+		}
+		field, valueNode, op := n.x, n.y, n.op
+		if _, ok := fieldOf(field); !ok {
+			field, valueNode, op = n.y, n.x, mirrored[n.op]
+		}
+		name := field.(*nameNode)
+		value, err := e.eval(valueNode)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case value == nil && op != "=" && op != "!=":
+			// Nothing is ordered with null
+			return constantCondition(false), nil
+		case value != nil && !comparable(name.typ, typeOf(value)):
+			return nil, e.errorf(n, "cannot compare %s, %s, with %s", name.name(), name.typ, typeOf(value))
+		}
+		return []interface{}{[]interface{}{name.name(), op, domainValue(value)}}, nil
+	}
+	return nil, e.errorf(n, "a domain joins comparisons of fields with and, or and not")
+}
+
+// membership returns the domain of an in or not in condition
+func (e *evaluator) membership(n *binaryNode) ([]interface{}, error) {
+	name := n.x.(*nameNode)
+	value, err := e.eval(n.y)
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		return constantCondition(n.op == "not in"), nil
+	}
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, e.errorf(n, "%s needs a list on its right, not %s", n.op, typeOf(value))
+	}
+	if len(list) == 0 {
+		return constantCondition(n.op == "not in"), nil
+	}
+	values := make([]interface{}, len(list))
+	for i, item := range list {
+		if item == nil || !comparable(name.typ, typeOf(item)) {
+			return nil, e.errorf(n, "cannot compare %s, %s, with %s", name.name(), name.typ, typeOf(item))
+		}
+		values[i] = domainValue(item)
+	}
+	return []interface{}{[]interface{}{name.name(), n.op, values}}, nil
+}
+
+// domainValue returns the form of a value in a domain
+func domainValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case dateValue:
+		return v.Format("2006-01-02")
+	case time.Time:
+		return v.UTC()
+	}
+	return value
+}
@@ -0,0 +1,798 @@
+package expr
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// dateValue is a date at evaluation time: midnight UTC of the day
+type dateValue struct {
+	time.Time
+}
+
+// toDate returns the date of a time in a location
+func toDate(t time.Time, loc *time.Location) dateValue {
+	t = t.In(loc)
+	return dateValue{time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)}
+}
+
+// evaluator runs a program within its limits
+type evaluator struct {
+	source   string
+	vars     Vars
+	now      time.Time
+	loc      *time.Location
+	steps    int
+	maxSteps int
+	deadline time.Time
+}
+
+// Eval evaluates the expression with vars. Dates are returned as
+// time.Time at midnight UTC, durations as time.Duration, integers as
+// int64 and lists as []interface{}. Errors are an *Error for the values
+// an operation cannot take, ErrStepLimit or ErrTimeLimit.
+func (p *Program) Eval(vars Vars, limits Limits) (interface{}, error) {
+	value, err := newEvaluator(p.source, vars, limits).eval(p.root)
+	if err != nil {
+		return nil, err
+	}
+	return export(value), nil
+}
+
+// newEvaluator returns the evaluator of a source with vars
+func newEvaluator(source string, vars Vars, limits Limits) *evaluator {
+	e := &evaluator{source: source, vars: vars, now: vars.Now, loc: vars.Location, maxSteps: limits.MaxSteps}
+	if e.now.IsZero() {
+		e.now = time.Now()
+	}
+	e.now = e.now.UTC()
+	if e.loc == nil {
+		e.loc = time.UTC
+	}
+	if limits.Timeout > 0 {
+		e.deadline = time.Now().Add(limits.Timeout)
+	}
+	return e
+}
+
+// export converts an evaluated value to the form Eval returns
+func export(value interface{}) interface{} {
+	switch v := value.(type) {
+	case dateValue:
+		return v.Time
+	case []interface{}:
+		values := make([]interface{}, len(v))
+		for i, item := range v {
+			values[i] = export(item)
+		}
+		return values
+	}
+	return value
+}
+
+// step counts an evaluation step against the limits
+func (e *evaluator) step() error {
+	e.steps++
+	if e.maxSteps > 0 && e.steps > e.maxSteps {
+		return ErrStepLimit
+	}
+	if e.steps%32 == 0 && !e.deadline.IsZero() && time.Now().After(e.deadline) {
+		return ErrTimeLimit
+	}
+	return nil
+}
+
+// errorf returns the error of an operation of a node
+func (e *evaluator) errorf(n node, format string, args ...interface{}) error {
+	return newError(e.source, n.base().pos, format, args...)
+}
+
+func (e *evaluator) eval(n node) (interface{}, error) {
+	if err := e.step(); err != nil {
+		return nil, err
+	}
+	switch n := n.(type) {
+	case *literalNode:
+		return n.value, nil
+	case *listNode:
+		items := make([]interface{}, len(n.items))
+		for i, item := range n.items {
+			value, err := e.eval(item)
+			if err != nil {
+				return nil, err
+			}
+			if _, nested := value.([]interface{}); nested {
+				return nil, e.errorf(item, "lists cannot be nested")
+			}
+			items[i] = value
+		}
+		return items, nil
+	case *nameNode:
+		return e.name(n)
+	case *callNode:
+		args := make([]interface{}, len(n.args))
+		for i, arg := range n.args {
+			value, err := e.eval(arg)
+			if err != nil {
+				return nil, err
+			}
+			args[i] = value
+		}
+		value, err := functions[n.name].call(e, args)
+		if err != nil {
+			return nil, e.errorf(n, "%s(): %v", n.name, err)
+		}
+		return value, nil
+	case *unaryNode:
+		x, err := e.eval(n.x)
+		if err != nil {
+			return nil, err
+		}
+		if n.op == "not" {
+			truth, err := e.truth(n.x, x)
+			return !truth, err
+		}
+		switch v := x.(type) {
+		case nil:
+			return nil, nil
+		case int64:
+			if v == math.MinInt64 {
+				return nil, e.errorf(n, "integer overflow")
+			}
+			return -v, nil
+		case float64:
+			return -v, nil
+		case time.Duration:
+			return -v, nil
+		}
+		return nil, e.errorf(n, "cannot negate %s", typeOf(x))
+	case *binaryNode:
+		return e.binary(n)
+	}
+	return nil, e.errorf(n, "unsupported expression")
+}
+
+// truth returns the truth of a condition: null is false
+func (e *evaluator) truth(n node, value interface{}) (bool, error) {
+	switch v := value.(type) {
+	case nil:
+		return false, nil
+	case bool:
+		return v, nil
+	}
+	return false, e.errorf(n, "expected a bool, got %s", typeOf(value))
+}
+
+// name returns the value of a reference
+func (e *evaluator) name(n *nameNode) (interface{}, error) {
+	var value interface{}
+	switch n.path[0] {
+	case "user":
+		user := e.vars.User
+		switch n.path[1] {
+		case "id":
+			return user.ID, nil
+		case "login":
+			return user.Login, nil
+		case "name":
+			return user.Name, nil
+		case "lang":
+			return user.Lang, nil
+		case "tz":
+			return user.Tz, nil
+		}
+		return nil, e.errorf(n, "unknown user attribute %q", n.path[1])
+	case "context":
+		value = e.vars.Context[n.path[1]]
+	default:
+		value = e.vars.Fields[n.path[0]]
+	}
+	normalized, ok := normalize(value, n.typ)
+	if !ok {
+		return nil, e.errorf(n, "%s holds an unsupported %T value", n.name(), value)
+	}
+	return normalized, nil
+}
+
+// normalize converts a value given to an evaluation, e.g. a float64
+// decoded from JSON or a time.Time read from a date column, to the values
+// the evaluator works with; want is the static type of the value
+func normalize(value interface{}, want Type) (interface{}, bool) {
+	switch v := value.(type) {
+	case nil, bool, string, time.Duration, int64:
+		return v, true
+	case dateValue:
+		return v, true
+	case int:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case uint:
+		return uintValue(uint64(v))
+	case uint8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	case uint64:
+		return uintValue(v)
+	case float32:
+		return normalize(float64(v), want)
+	case float64:
+		if (want == Int || want == Any) && v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return int64(v), true
+		}
+		return v, true
+	case time.Time:
+		if want == Date {
+			return dateValue{time.Date(v.Year(), v.Month(), v.Day(), 0, 0, 0, 0, time.UTC)}, true
+		}
+		return v.UTC(), true
+	case []interface{}:
+		items := make([]interface{}, len(v))
+		for i, item := range v {
+			normalized, ok := normalize(item, Any)
+			if !ok {
+				return nil, false
+			}
+			if _, nested := normalized.([]interface{}); nested {
+				return nil, false
+			}
+			items[i] = normalized
+		}
+		return items, true
+	}
+	return nil, false
+}
+
+func uintValue(v uint64) (interface{}, bool) {
+	if v > math.MaxInt64 {
+		return nil, false
+	}
+	return int64(v), true
+}
+
+// typeOf returns the type of an evaluated value
+func typeOf(value interface{}) Type {
+	switch value.(type) {
+	case dateValue:
+		return Date
+	case time.Time:
+		return Datetime
+	case []interface{}:
+		return List
+	}
+	return literalType(value)
+}
+
+// binary evaluates an infix operator
+func (e *evaluator) binary(n *binaryNode) (interface{}, error) {
+	x, err := e.eval(n.x)
+	if err != nil {
+		return nil, err
+	}
+	if n.op == "and" || n.op == "or" {
+		truth, err := e.truth(n.x, x)
+		if err != nil {
+			return nil, err
+		}
+		if truth == (n.op == "or") {
+			return truth, nil
+		}
+		y, err := e.eval(n.y)
+		if err != nil {
+			return nil, err
+		}
+		return e.truth(n.y, y)
+	}
+	y, err := e.eval(n.y)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "=", "!=":
+		equal, err := e.equal(n, x, y)
+		return equal == (n.op == "="), err
+	case "<", "<=", ">", ">=":
+		if x == nil || y == nil {
+			return false, nil
+		}
+		order, ok := compare(x, y)
+		if !ok || typeOf(x) == Bool {
+			return nil, e.errorf(n, "cannot order %s and %s", typeOf(x), typeOf(y))
+		}
+		switch n.op {
+		case "<":
+			return order < 0, nil
+		case "<=":
+			return order <= 0, nil
+		case ">":
+			return order > 0, nil
+		}
+		return order >= 0, nil
+	case "in", "not in":
+		if y == nil {
+			return n.op == "not in", nil
+		}
+		list, ok := y.([]interface{})
+		if !ok {
+			return nil, e.errorf(n, "%s needs a list on its right, not %s", n.op, typeOf(y))
+		}
+		found := false
+		for _, item := range list {
+			if err := e.step(); err != nil {
+				return nil, err
+			}
+			equal, err := e.equal(n, x, item)
+			if err != nil {
+				return nil, err
+			}
+			if equal {
+				found = true
+				break
+			}
+		}
+		return found == (n.op == "in"), nil
+	}
+	if x == nil || y == nil {
+		return nil, nil
+	}
+	value, message := arithmetic(n.op, x, y)
+	if message != "" {
+		return nil, e.errorf(n, "%s", message)
+	}
+	return value, nil
+}
+
+// equal compares two values for equality; null only equals null
+func (e *evaluator) equal(n node, x, y interface{}) (bool, error) {
+	if x == nil || y == nil {
+		return x == nil && y == nil, nil
+	}
+	order, ok := compare(x, y)
+	if !ok {
+		return false, e.errorf(n, "cannot compare %s with %s", typeOf(x), typeOf(y))
+	}
+	return order == 0, nil
+}
+
+// compare orders two values of comparable types: numbers, strings,
+// bools, durations and dates with times
+func compare(x, y interface{}) (int, bool) {
+	if d, ok := x.(dateValue); ok {
+		x = d.Time
+	}
+	if d, ok := y.(dateValue); ok {
+		y = d.Time
+	}
+	switch a := x.(type) {
+	case int64:
+		switch b := y.(type) {
+		case int64:
+			return compareInt(a, b), true
+		case float64:
+			return sign(float64(a) - b), true
+		}
+	case float64:
+		switch b := y.(type) {
+		case int64:
+			return sign(a - float64(b)), true
+		case float64:
+			return sign(a - b), true
+		}
+	case string:
+		if b, ok := y.(string); ok {
+			return strings.Compare(a, b), true
+		}
+	case bool:
+		if b, ok := y.(bool); ok {
+			if a == b {
+				return 0, true
+			}
+			return 1, true
+		}
+	case time.Duration:
+		if b, ok := y.(time.Duration); ok {
+			return compareInt(int64(a), int64(b)), true
+		}
+	case time.Time:
+		if b, ok := y.(time.Time); ok {
+			return a.Compare(b), true
+		}
+	}
+	return 0, false
+}
+
+func compareInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func sign(v float64) int {
+	switch {
+	case v < 0:
+		return -1
+	case v > 0:
+		return 1
+	}
+	return 0
+}
+
+// arithmetic applies an arithmetic operator to non-null values, returning
+// an error message for the values it does not apply to
+func arithmetic(op string, x, y interface{}) (interface{}, string) {
+	switch a := x.(type) {
+	case int64:
+		switch b := y.(type) {
+		case int64:
+			return intArithmetic(op, a, b)
+		case float64:
+			return floatArithmetic(op, float64(a), b)
+		case time.Duration:
+			if op == "*" {
+				return durationProduct(b, a)
+			}
+		}
+	case float64:
+		switch b := y.(type) {
+		case int64:
+			return floatArithmetic(op, a, float64(b))
+		case float64:
+			return floatArithmetic(op, a, b)
+		}
+	case string:
+		if b, ok := y.(string); ok && op == "+" {
+			if len(a)+len(b) > maxString {
+				return nil, "string longer than the limit"
+			}
+			return a + b, ""
+		}
+	case time.Duration:
+		switch b := y.(type) {
+		case time.Duration:
+			if op == "+" || op == "-" {
+				sum, message := intArithmetic(op, int64(a), int64(b))
+				if message != "" {
+					return nil, "duration overflow"
+				}
+				return time.Duration(sum.(int64)), ""
+			}
+		case int64:
+			switch op {
+			case "*":
+				return durationProduct(a, b)
+			case "/":
+				if b == 0 {
+					return nil, "division by zero"
+				}
+				return a / time.Duration(b), ""
+			}
+		case dateValue, time.Time:
+			if op == "+" {
+				return arithmetic(op, y, x)
+			}
+		}
+	case dateValue:
+		switch b := y.(type) {
+		case time.Duration:
+			if op == "+" || op == "-" {
+				if op == "-" {
+					b = -b
+				}
+				return toDate(a.Add(b), time.UTC), ""
+			}
+		case dateValue:
+			if op == "-" {
+				return a.Sub(b.Time), ""
+			}
+		case time.Time:
+			if op == "-" {
+				return a.Sub(b), ""
+			}
+		}
+	case time.Time:
+		switch b := y.(type) {
+		case time.Duration:
+			if op == "+" {
+				return a.Add(b), ""
+			}
+			if op == "-" {
+				return a.Add(-b), ""
+			}
+		case dateValue:
+			if op == "-" {
+				return a.Sub(b.Time), ""
+			}
+		case time.Time:
+			if op == "-" {
+				return a.Sub(b), ""
+			}
+		}
+	}
+	return nil, "operator " + op + " does not apply to " + typeOf(x).String() + " and " + typeOf(y).String()
+}
+
+// intArithmetic applies an operator to integers, refusing overflows
+func intArithmetic(op string, a, b int64) (interface{}, string) {
+	switch op {
+	case "+":
+		if (b > 0 && a > math.MaxInt64-b) || (b < 0 && a < math.MinInt64-b) {
+			return nil, "integer overflow"
+		}
+		return a + b, ""
+	case "-":
+		if (b < 0 && a > math.MaxInt64+b) || (b > 0 && a < math.MinInt64+b) {
+			return nil, "integer overflow"
+		}
+		return a - b, ""
+	case "*":
+		if a != 0 && b != 0 {
+			product := a * b
+			if product/b != a || (a == -1 && b == math.MinInt64) || (b == -1 && a == math.MinInt64) {
+				return nil, "integer overflow"
+			}
+			return product, ""
+		}
+		return int64(0), ""
+	case "/", "%":
+		if b == 0 {
+			return nil, "division by zero"
+		}
+		if a == math.MinInt64 && b == -1 {
+			return nil, "integer overflow"
+		}
+		if op == "/" {
+			return a / b, ""
+		}
+		return a % b, ""
+	}
+	return nil, "operator " + op + " does not apply to integers"
+}
+
+// floatArithmetic applies an operator to numbers
+func floatArithmetic(op string, a, b float64) (interface{}, string) {
+	var result float64
+	switch op {
+	case "+":
+		result = a + b
+	case "-":
+		result = a - b
+	case "*":
+		result = a * b
+	case "/":
+		if b == 0 {
+			return nil, "division by zero"
+		}
+		result = a / b
+	default:
+		return nil, "operator " + op + " does not apply to floats"
+	}
+	if math.IsInf(result, 0) || math.IsNaN(result) {
+		return nil, "number out of range"
+	}
+	return result, ""
+}
+
+// durationProduct multiplies a duration, refusing overflows
+func durationProduct(d time.Duration, n int64) (interface{}, string) {
+	product, message := intArithmetic("*", int64(d), n)
+	if message != "" {
+		return nil, "duration overflow"
+	}
+	return time.Duration(product.(int64)), ""
+}
+
+// durationOf returns n units as a duration, refusing overflows
+func durationOf(n interface{}, unit time.Duration) (interface{}, error) {
+	var count float64
+	switch v := n.(type) {
+	case nil:
+		return nil, nil
+	case int64:
+		count = float64(v)
+	case float64:
+		count = v
+	default:
+		return nil, argumentError(1, n)
+	}
+	value := count * float64(unit)
+	if math.IsNaN(value) || math.Abs(value) >= math.MaxInt64 {
+		return nil, errDurationOverflow
+	}
+	return time.Duration(value), nil
+}
+
+// argumentError is the error of an argument a function cannot take
+func argumentError(position int, value interface{}) error {
+	return fmt.Errorf("argument %d cannot be %s", position, typeOf(value))
+}
+
+var errDurationOverflow = errors.New("duration overflow")
+
+// stringArg returns a string argument; ok is false for null
+func stringArg(args []interface{}, i int) (string, bool, error) {
+	switch v := args[i].(type) {
+	case nil:
+		return "", false, nil
+	case string:
+		return v, true, nil
+	}
+	return "", false, argumentError(i+1, args[i])
+}
+
+// stringFunction is a function of a string
+func stringFunction(fn func(string) string) function {
+	return function{
+		signature: fixed(String, []Type{String}),
+		call: func(e *evaluator, args []interface{}) (interface{}, error) {
+			s, ok, err := stringArg(args, 0)
+			if !ok || err != nil {
+				return nil, err
+			}
+			return fn(s), nil
+		},
+	}
+}
+
+// predicateFunction is a test of a string against another
+func predicateFunction(fn func(string, string) bool) function {
+	return function{
+		signature: fixed(Bool, []Type{String}, []Type{String}),
+		call: func(e *evaluator, args []interface{}) (interface{}, error) {
+			s, ok, err := stringArg(args, 0)
+			if !ok || err != nil {
+				return nil, err
+			}
+			t, ok, err := stringArg(args, 1)
+			if !ok || err != nil {
+				return nil, err
+			}
+			return fn(s, t), nil
+		},
+	}
+}
+
+// durationFunction returns a number of units as a duration
+func durationFunction(unit time.Duration) function {
+	return function{
+		signature: fixed(Duration, []Type{Int, Float}),
+		call: func(e *evaluator, args []interface{}) (interface{}, error) {
+			return durationOf(args[0], unit)
+		},
+	}
+}
+
+// functions are the functions of the language, the only calls an
+// expression can make
+var functions = map[string]function{
+	"now": {
+		signature: fixed(Datetime),
+		call: func(e *evaluator, args []interface{}) (interface{}, error) {
+			return e.now, nil
+		},
+	},
+	"today": {
+		signature: fixed(Date),
+		call: func(e *evaluator, args []interface{}) (interface{}, error) {
+			return toDate(e.now, e.loc), nil
+		},
+	},
+	"date": {
+		signature: fixed(Date, []Type{Date, Datetime, String}),
+		call: func(e *evaluator, args []interface{}) (interface{}, error) {
+			switch v := args[0].(type) {
+			case nil, dateValue:
+				return v, nil
+			case time.Time:
+				return toDate(v, e.loc), nil
+			case string:
+				parsed, err := time.Parse("2006-01-02", v)
+				if err != nil {
+					return nil, errors.New("expected a date like 2024-12-31")
+				}
+				return dateValue{parsed}, nil
+			}
+			return nil, argumentError(1, args[0])
+		},
+	},
+	"weeks":   durationFunction(7 * 24 * time.Hour),
+	"days":    durationFunction(24 * time.Hour),
+	"hours":   durationFunction(time.Hour),
+	"minutes": durationFunction(time.Minute),
+	"lower":   stringFunction(strings.ToLower),
+	"upper":   stringFunction(strings.ToUpper),
+	"trim":    stringFunction(strings.TrimSpace),
+	"len": {
+		signature: fixed(Int, []Type{String, List}),
+		call: func(e *evaluator, args []interface{}) (interface{}, error) {
+			switch v := args[0].(type) {
+			case nil:
+				return nil, nil
+			case string:
+				return int64(utf8.RuneCountInString(v)), nil
+			case []interface{}:
+				return int64(len(v)), nil
+			}
+			return nil, argumentError(1, args[0])
+		},
+	},
+	"contains":   predicateFunction(strings.Contains),
+	"startswith": predicateFunction(strings.HasPrefix),
+	"endswith":   predicateFunction(strings.HasSuffix),
+	"abs": {
+		signature: fixed(-1, []Type{Int, Float, Duration}),
+		call: func(e *evaluator, args []interface{}) (interface{}, error) {
+			switch v := args[0].(type) {
+			case nil:
+				return nil, nil
+			case int64:
+				if v == math.MinInt64 {
+					return nil, errors.New("integer overflow")
+				}
+				if v < 0 {
+					return -v, nil
+				}
+				return v, nil
+			case float64:
+				return math.Abs(v), nil
+			case time.Duration:
+				return v.Abs(), nil
+			}
+			return nil, argumentError(1, args[0])
+		},
+	},
+	"coalesce": {
+		signature: func(args []Type) (Type, string) {
+			if len(args) < 2 {
+				return Any, "takes at least 2 arguments"
+			}
+			result := Null
+			for i, t := range args {
+				switch {
+				case t == Null:
+				case result == Null:
+					result = t
+				case !comparable(result, t):
+					return Any, fmt.Sprintf("argument %d cannot be %s after %s", i+1, t, result)
+				case result != t:
+					result = Any
+				}
+			}
+			return result, ""
+		},
+		call: func(e *evaluator, args []interface{}) (interface{}, error) {
+			for _, arg := range args {
+				if arg != nil {
+					return arg, nil
+				}
+			}
+			return nil, nil
+		},
+	},
+}
+
+// functionNames lists the functions of the language for error messages
+func functionNames() string {
+	names := make([]string, 0, len(functions))
+	for name := range functions {
+		names = append(names, name+"()")
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
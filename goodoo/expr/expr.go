@@ -0,0 +1,188 @@
+// Package expr is the small expression language of the values users type
+// in: record rule domains like "create_uid = user.id", defaults like
+// "today() + 7d". It is deliberately not a programming language: an
+// expression is literals, field references, user and context values,
+// comparison, boolean and arithmetic operators and a fixed set of
+// functions, without loops, assignments, reflection or I/O.
+//
+// Compile parses an expression and checks it against the fields of the
+// target model, reporting every error with its position. Programs are safe
+// to share; Eval runs one with step and time limits, Domain turns one
+// into a domain whose values are evaluated for the current user.
+package expr
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Type is the static type of an expression
+type Type int
+
+// Types of expressions. Any is the type of context values, only known
+// when evaluating.
+const (
+	Any Type = iota
+	Null
+	Bool
+	Int
+	Float
+	String
+	Date
+	Datetime
+	Duration
+	List
+)
+
+var typeNames = [...]string{"any", "null", "bool", "int", "float", "string", "date", "datetime", "duration", "list"}
+
+func (t Type) String() string {
+	if int(t) < len(typeNames) {
+		return typeNames[t]
+	}
+	return fmt.Sprintf("type(%d)", int(t))
+}
+
+// MaxLength bounds the source of an expression, in bytes
+const MaxLength = 4096
+
+// maxDepth bounds the nesting of an expression
+const maxDepth = 64
+
+// maxString bounds the strings an evaluation builds
+const maxString = 64 << 10
+
+// Error is an error at a position of an expression: Pos is the byte
+// offset, Column the 1-based character column
+type Error struct {
+	Pos     int    `json:"position"`
+	Column  int    `json:"column"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("column %d: %s", e.Column, e.Message)
+}
+
+// Errors are the errors of an expression that does not compile, in the
+// order of their positions
+type Errors []*Error
+
+func (e Errors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// newError returns the error of the expression source at pos
+func newError(source string, pos int, format string, args ...interface{}) *Error {
+	if pos > len(source) {
+		pos = len(source)
+	}
+	return &Error{Pos: pos, Column: utf8.RuneCountInString(source[:pos]) + 1, Message: fmt.Sprintf(format, args...)}
+}
+
+// Limit errors of Eval
+var (
+	ErrStepLimit = errors.New("expression evaluation exceeds its step limit")
+	ErrTimeLimit = errors.New("expression evaluation exceeds its time limit")
+)
+
+// Limits bound an evaluation
+type Limits struct {
+	// MaxSteps is the number of nodes evaluated
+	MaxSteps int
+	// Timeout is the time the evaluation may take
+	Timeout time.Duration
+}
+
+// DefaultLimits are ample for the expressions the language can express:
+// without loops, an evaluation takes a step per node
+var DefaultLimits = Limits{MaxSteps: 10000, Timeout: 50 * time.Millisecond}
+
+// Schema maps the fields an expression may reference to their type
+type Schema map[string]Type
+
+// User is the user an expression is evaluated for, as user.id,
+// user.login, user.name, user.lang and user.tz
+type User struct {
+	ID    int64
+	Login string
+	Name  string
+	Lang  string
+	Tz    string
+}
+
+// userAttributes are the types of the user.<name> values
+var userAttributes = map[string]Type{"id": Int, "login": String, "name": String, "lang": String, "tz": String}
+
+// Vars are the values of an evaluation
+type Vars struct {
+	// Fields are the field values of the record, by name
+	Fields  map[string]interface{}
+	User    User
+	Context map[string]interface{}
+	// Now is the time of now() and today(), the current time when zero
+	Now time.Time
+	// Location is the timezone of today() and date(), UTC when nil
+	Location *time.Location
+}
+
+// Program is a compiled expression
+type Program struct {
+	source string
+	root   node
+	names  []string
+}
+
+// Source returns the text of the expression
+func (p *Program) Source() string {
+	return p.source
+}
+
+// Type returns the static type of the result
+func (p *Program) Type() Type {
+	return p.root.base().typ
+}
+
+// Names returns the names the expression references, sorted: fields,
+// "user.<name>" and "context.<key>"
+func (p *Program) Names() []string {
+	return p.names
+}
+
+// Uses reports whether the expression references a name
+func (p *Program) Uses(name string) bool {
+	i := sort.SearchStrings(p.names, name)
+	return i < len(p.names) && p.names[i] == name
+}
+
+// Compile parses an expression and checks it against the fields of a
+// schema; a nil schema allows no field. The error is an Errors.
+func Compile(source string, schema Schema) (*Program, error) {
+	if len(source) > MaxLength {
+		return nil, Errors{newError(source, MaxLength, "expression longer than %d bytes", MaxLength)}
+	}
+	root, err := parse(source)
+	if err != nil {
+		return nil, Errors{err}
+	}
+	c := &checker{source: source, schema: schema, names: make(map[string]bool)}
+	c.check(root)
+	if len(c.errs) > 0 {
+		sort.SliceStable(c.errs, func(i, j int) bool { return c.errs[i].Pos < c.errs[j].Pos })
+		return nil, c.errs
+	}
+	names := make([]string, 0, len(c.names))
+	for name := range c.names {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return &Program{source: source, root: root, names: names}, nil
+}
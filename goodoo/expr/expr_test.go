@@ -0,0 +1,638 @@
+package expr_test
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"goodoo/expr"
+)
+
+// schema is the schema of the tests, a task-like model
+var schema = expr.Schema{
+	"name":       expr.String,
+	"state":      expr.String,
+	"active":     expr.Bool,
+	"create_uid": expr.Int,
+	"amount":     expr.Float,
+	"priority":   expr.Int,
+	"deadline":   expr.Date,
+	"write_date": expr.Datetime,
+	"tags":       expr.Any,
+}
+
+// now is the time of the evaluations of the tests
+var now = time.Date(2025, 3, 10, 23, 30, 0, 0, time.UTC)
+
+var vars = expr.Vars{
+	Fields: map[string]interface{}{
+		"name":       "Fix the roof",
+		"state":      "draft",
+		"active":     true,
+		"create_uid": 7,
+		"amount":     12.5,
+		"priority":   float64(2),
+		"deadline":   time.Date(2025, 3, 14, 0, 0, 0, 0, time.UTC),
+		"write_date": now.Add(-time.Hour),
+		"tags":       []interface{}{"urgent", float64(3)},
+	},
+	User:    expr.User{ID: 7, Login: "alice", Name: "Alice", Lang: "fr_FR", Tz: "Europe/Paris"},
+	Context: map[string]interface{}{"company_id": float64(3), "active_ids": []interface{}{1, 2}},
+	Now:     now,
+}
+
+// compileErrors returns the errors of an expression that must not
+// compile
+func compileErrors(t *testing.T, source string, schema expr.Schema) expr.Errors {
+	t.Helper()
+	p, err := expr.Compile(source, schema)
+	if err == nil {
+		t.Fatalf("Compile(%q) succeeded with type %s", source, p.Type())
+	}
+	var errs expr.Errors
+	if !errors.As(err, &errs) || len(errs) == 0 {
+		t.Fatalf("Compile(%q) error = %#v, want Errors", source, err)
+	}
+	return errs
+}
+
+func mustCompile(t *testing.T, source string) *expr.Program {
+	t.Helper()
+	p, err := expr.Compile(source, schema)
+	if err != nil {
+		t.Fatalf("Compile(%q): %v", source, err)
+	}
+	return p
+}
+
+func TestEval(t *testing.T) {
+	date := func(y int, m time.Month, d int) time.Time { return time.Date(y, m, d, 0, 0, 0, 0, time.UTC) }
+	tests := []struct {
+		source string
+		typ    expr.Type
+		want   interface{}
+	}{
+		{"1 + 2 * 3", expr.Int, int64(7)},
+		{"(1 + 2) * 3", expr.Int, int64(9)},
+		{"7 / 2", expr.Int, int64(3)},
+		{"7 % 4", expr.Int, int64(3)},
+		{"7 / 2.0", expr.Float, 3.5},
+		{"-priority", expr.Int, int64(-2)},
+		{"--1", expr.Int, int64(1)},
+		{"'a' + \"b\"", expr.String, "ab"},
+		{`'it\'s' + "\t\n\\"`, expr.String, "it's\t\n\\"},
+		{"create_uid = user.id", expr.Bool, true},
+		{"create_uid == user.id && state <> 'done'", expr.Bool, true},
+		{"not active or !active", expr.Bool, false},
+		{"priority in [1, 2, 3]", expr.Bool, true},
+		{"state not in ['draft', 'done']", expr.Bool, false},
+		{"amount > priority", expr.Bool, true},
+		{"name < 'Z'", expr.Bool, true},
+		{"null = null", expr.Bool, true},
+		{"name = null", expr.Bool, false},
+		{"context.missing > 1", expr.Bool, false},
+		{"1 + context.missing", expr.Any, nil},
+		{"today()", expr.Date, date(2025, 3, 10)},
+		{"today() + 7d", expr.Date, date(2025, 3, 17)},
+		{"7d + today()", expr.Date, date(2025, 3, 17)},
+		{"today() - 2w", expr.Date, date(2025, 2, 24)},
+		{"deadline - today()", expr.Duration, 4 * 24 * time.Hour},
+		{"deadline > today()", expr.Bool, true},
+		{"now() - write_date", expr.Duration, time.Hour},
+		{"now() + 90m", expr.Datetime, now.Add(90 * time.Minute)},
+		{"date('2024-12-31') + days(1)", expr.Date, date(2025, 1, 1)},
+		{"date(write_date)", expr.Date, date(2025, 3, 10)},
+		{"hours(1.5) + minutes(30) = 2h", expr.Bool, true},
+		{"weeks(1) = 7d and 3 * 10s = 30s", expr.Bool, true},
+		{"1d / 2", expr.Duration, 12 * time.Hour},
+		{"abs(-3)", expr.Int, int64(3)},
+		{"abs(-1.5)", expr.Float, 1.5},
+		{"abs(-2h)", expr.Duration, 2 * time.Hour},
+		{"len(name)", expr.Int, int64(12)},
+		{"len('été')", expr.Int, int64(3)},
+		{"len([1, 2])", expr.Int, int64(2)},
+		{"lower(name) + upper('x') + trim('  y ')", expr.String, "fix the roofXy"},
+		{"contains(name, 'roof') and startswith(name, 'Fix') and endswith(name, 'of')", expr.Bool, true},
+		{"coalesce(null, user.login)", expr.String, "alice"},
+		{"[1, null, priority]", expr.List, []interface{}{int64(1), nil, int64(2)}},
+		{"user.name + ' ' + user.lang + ' ' + user.tz", expr.String, "Alice fr_FR Europe/Paris"},
+		{"context.company_id", expr.Any, int64(3)},
+		{"context.company_id + 1", expr.Any, int64(4)},
+		{"context.missing", expr.Any, nil},
+		{"3 in context.active_ids", expr.Bool, false},
+		{"'urgent' in tags", expr.Bool, true},
+		{"true and false or true", expr.Bool, true},
+		{"false or context.missing", expr.Bool, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			p := mustCompile(t, tt.source)
+			if p.Type() != tt.typ {
+				t.Errorf("Type() = %s, want %s", p.Type(), tt.typ)
+			}
+			got, err := p.Eval(vars, expr.DefaultLimits)
+			if err != nil {
+				t.Fatalf("Eval: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Eval = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvalLocation(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skip("no timezone database")
+	}
+	p := mustCompile(t, "today()")
+	v := vars
+	v.Location = paris
+	got, err := p.Eval(v, expr.DefaultLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 23:30 UTC is already the next day in Paris
+	if want := time.Date(2025, 3, 11, 0, 0, 0, 0, time.UTC); got != want {
+		t.Errorf("today() = %v, want %v", got, want)
+	}
+}
+
+func TestNames(t *testing.T) {
+	p := mustCompile(t, "create_uid = user.id and state = context.state and create_uid != 0")
+	want := []string{"context.state", "create_uid", "state", "user.id"}
+	if !reflect.DeepEqual(p.Names(), want) {
+		t.Errorf("Names() = %v, want %v", p.Names(), want)
+	}
+	if !p.Uses("user.id") || p.Uses("user") || p.Uses("name") {
+		t.Errorf("Uses answers wrongly for %v", p.Names())
+	}
+	if p.Source() != "create_uid = user.id and state = context.state and create_uid != 0" {
+		t.Errorf("Source() = %q", p.Source())
+	}
+}
+
+// TestInjection feeds the compiler code of the languages an expression
+// could be mistaken for; none may compile, as the language has no way to
+// reach anything but its fields, the user, the context and its functions
+func TestInjection(t *testing.T) {
+	sources := []string{
+		// Python, as Odoo evaluates domains
+		"__import__('os').system('id')",
+		"eval('1')",
+		"exec('import os')",
+		"open('/etc/passwd')",
+		"().__class__.__bases__[0].__subclasses__()",
+		"name.__class__",
+		"user.__dict__",
+		"user.env['res.users']",
+		"getattr(user, 'password')",
+		"lambda: 1",
+		"[x for x in tags]",
+		"name if active else state",
+		"name; import os",
+		"name\nimport os",
+		"f'{name}'",
+		"b'x'",
+		"1 if 1 else 2",
+		"name = 'x' ; DROP TABLE res_users",
+		// SQL
+		"name = 'x' OR 1=1 --",
+		"name = 'x'' OR ''1''=''1'",
+		"name = 'x' /* */",
+		"name = 'x' UNION SELECT password FROM res_users",
+		"name = (SELECT password FROM res_users)",
+		"pg_sleep(10)",
+		"name::text = 'x'",
+		"name = $1",
+		// JavaScript and templates
+		"${name}",
+		"{{name}}",
+		"`id`",
+		"this.constructor.constructor('return process')()",
+		"name => 1",
+		"name === 'x'",
+		"name = 'x' || require('child_process')",
+		"name ? 1 : 2",
+		// Go templates and reflection
+		"{{.User.Password}}",
+		"user.Password",
+		"user.password",
+		"user.id.x",
+		"user",
+		"context",
+		"context.a.b",
+		"context['key']",
+		"tags[0]",
+		"name.lower()",
+		"now",
+		"lower.call(name)",
+		"os.Exit(1)",
+		"exec.Command('sh')",
+		// Assignments and statements
+		"name := 'x'",
+		"active = true; active = false",
+		"x = 1",
+		"let x = 1",
+		"while true do 1",
+		"for",
+		// Unknown or reserved names
+		"password = 'x'",
+		"partner_id.name = 'x'",
+		"in",
+		"and",
+		"not",
+		"not in [1]",
+		"name = not",
+		// Broken syntax
+		"",
+		"   ",
+		"(",
+		")",
+		"[1, 2",
+		"name = ",
+		"= name",
+		"name = 'unterminated",
+		`name = "\x41"`,
+		"1..2",
+		"1.",
+		".5",
+		"7dd",
+		"7y",
+		"99999999999999999999",
+		"99999999999d",
+		"name = 'x' 'y'",
+		"1 < 2 < 3",
+		"a\x00",
+		"name = 'x'\x00",
+		"ｎａｍｅ = 'x'",
+		"name = 'x' # comment",
+		"name = 'x' // comment",
+		"@name",
+		"name & state",
+		"name | state",
+		"name ^ state",
+		"~priority",
+		"priority ** 2",
+		"priority << 2",
+	}
+	for _, source := range sources {
+		t.Run(source, func(t *testing.T) {
+			errs := compileErrors(t, source, schema)
+			for _, err := range errs {
+				if err.Pos < 0 || err.Pos > len(source) || err.Column < 1 || err.Message == "" {
+					t.Errorf("invalid error %+v", err)
+				}
+			}
+		})
+	}
+}
+
+// TestStringsAreData checks that payloads inside strings are only ever
+// strings
+func TestStringsAreData(t *testing.T) {
+	for _, payload := range []string{
+		"x' OR '1'='1",
+		"__import__('os').system('id')",
+		"${jndi:ldap://example.com/a}",
+		"'; DROP TABLE res_users; --",
+		"{{.User.Password}}",
+	} {
+		source := fmt.Sprintf("name = %q", payload)
+		p := mustCompile(t, source)
+		got, err := p.Eval(vars, expr.DefaultLimits)
+		if err != nil || got != false {
+			t.Errorf("Eval(%s) = %v, %v, want false", source, got, err)
+		}
+		domain := mustDomain(t, source)
+		want := []interface{}{[]interface{}{"name", "=", payload}}
+		if !reflect.DeepEqual(domain, want) {
+			t.Errorf("Domain(%s) = %#v, want %#v", source, domain, want)
+		}
+	}
+}
+
+func TestTypeErrors(t *testing.T) {
+	tests := []struct {
+		source  string
+		message string
+		column  int
+	}{
+		{"name + 1", "operator + does not apply to string and int", 6},
+		{"1 - 'a'", "operator - does not apply to int and string", 3},
+		{"'a' * 3", "operator * does not apply to string and int", 5},
+		{"1.5 % 2", "operator % does not apply to float and int", 5},
+		{"today() + 1", "operator + does not apply to date and int", 9},
+		{"today() + today()", "operator + does not apply to date and date", 9},
+		{"2 / 1d", "operator / does not apply to int and duration", 3},
+		{"1 + null", "operator + does not apply to int and null", 3},
+		{"null > 1", "cannot order null and int", 6},
+		{"false or null", "or joins bools, not null", 7},
+		{"name = 1", "cannot compare string with int", 6},
+		{"active = 'yes'", "cannot compare bool with string", 8},
+		{"deadline = 1d", "cannot compare date with duration", 10},
+		{"active < true", "cannot order bool and bool", 8},
+		{"[1] < [2]", "cannot order list and list", 5},
+		{"name > 1", "cannot order string and int", 6},
+		{"1 and true", "and joins bools, not int", 3},
+		{"active or name", "or joins bools, not string", 8},
+		{"not name", "not applies to a bool, not string", 1},
+		{"-name", "cannot negate string", 1},
+		{"-today()", "cannot negate date", 1},
+		{"priority in 3", "in needs a list on its right, not int", 10},
+		{"[[1]] = null", "lists cannot be nested", 2},
+		{"priority in [1, 'a']", "list mixes int and string values", 17},
+		{"name in [1, 2]", "cannot compare string with int", 10},
+		{"[1] in tags", "a list cannot be in a list", 5},
+		{"unknown = 1", `unknown field "unknown"`, 1},
+		{"partner_id.name = 'x'", "partner_id.name: related paths are not supported, only fields of the record", 1},
+		{"user.password", `unknown user attribute "password"; use id, login, name, lang or tz`, 1},
+		{"user.id.x = 1", "use user.id, user.login, user.name, user.lang or user.tz", 1},
+		{"user = 1", "use user.id, user.login, user.name, user.lang or user.tz", 1},
+		{"context = 1", "use context.<key>", 1},
+		{"system('ls')", "unknown function system(); available: abs(), coalesce(), contains(), date(), days(), endswith(), hours(), len(), lower(), minutes(), now(), startswith(), today(), trim(), upper(), weeks()", 1},
+		{"user.name()", "user.name() is not a function", 1},
+		{"now(1)", "now() takes 0 argument(s), not 1", 1},
+		{"lower(1)", "lower() argument 1 cannot be int", 1},
+		{"days('1')", "days() argument 1 cannot be string", 1},
+		{"date(1)", "date() argument 1 cannot be int", 1},
+		{"len(1)", "len() argument 1 cannot be int", 1},
+		{"abs('a')", "abs() argument 1 cannot be string", 1},
+		{"coalesce(1)", "coalesce() takes at least 2 arguments", 1},
+		{"coalesce(1, 'a')", "coalesce() argument 2 cannot be string after int", 1},
+		{"contains(name)", "contains() takes 2 argument(s), not 1", 1},
+		{"7x", `unexpected 'x' after number`, 2},
+		{"'été' = 1x", `unexpected 'x' after number`, 10},
+		{"name = 'x", "unterminated string", 8},
+		{`'\q'`, "unknown escape sequence in string", 2},
+		{"name = #", "unexpected character '#'", 8},
+		{"1 < 2 < 3", "comparisons cannot be chained; join them with and", 7},
+		{"(1", `expected ")", found end of expression`, 3},
+		{"1 2", `unexpected "2"`, 3},
+		{"", "empty expression", 1},
+		{"99999999999999999999", "number 99999999999999999999 out of range", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			errs := compileErrors(t, tt.source, schema)
+			if !strings.HasPrefix(errs[0].Message, tt.message) {
+				t.Errorf("message = %q, want %q", errs[0].Message, tt.message)
+			}
+			if errs[0].Column != tt.column {
+				t.Errorf("column = %d, want %d", errs[0].Column, tt.column)
+			}
+		})
+	}
+}
+
+func TestCompileReportsEveryError(t *testing.T) {
+	errs := compileErrors(t, "name + 1 = 2 and unknown = 1 and user.password = 'x'", schema)
+	var columns []int
+	for _, err := range errs {
+		columns = append(columns, err.Column)
+	}
+	if want := []int{6, 18, 34}; !reflect.DeepEqual(columns, want) {
+		t.Errorf("errors %v at columns %v, want %v", errs, columns, want)
+	}
+	if !strings.Contains(errs.Error(), "column 18: unknown field") {
+		t.Errorf("Error() = %q", errs.Error())
+	}
+}
+
+func TestNilSchema(t *testing.T) {
+	errs := compileErrors(t, "name = 'x'", nil)
+	if want := `unknown name "name": fields cannot be used here`; errs[0].Message != want {
+		t.Errorf("message = %q, want %q", errs[0].Message, want)
+	}
+	if _, err := expr.Compile("today() + 7d", nil); err != nil {
+		t.Errorf("a default without fields does not compile: %v", err)
+	}
+}
+
+func TestSourceLimits(t *testing.T) {
+	long := strings.Repeat("1+", expr.MaxLength/2) + "1"
+	errs := compileErrors(t, long, nil)
+	if !strings.Contains(errs[0].Message, "longer than") || errs[0].Pos != expr.MaxLength {
+		t.Errorf("error = %+v, want the length refused", errs[0])
+	}
+
+	for _, nested := range []string{
+		strings.Repeat("(", 100) + "1" + strings.Repeat(")", 100),
+		strings.Repeat("-", 100) + "1",
+		strings.Repeat("not ", 100) + "true",
+		strings.Repeat("[", 100) + strings.Repeat("]", 100),
+		strings.Repeat("abs(", 100) + "1" + strings.Repeat(")", 100),
+	} {
+		errs := compileErrors(t, nested, nil)
+		if !strings.Contains(errs[0].Message, "nested more than") {
+			t.Errorf("Compile(%.20s...) error = %v, want the nesting refused", nested, errs)
+		}
+	}
+}
+
+func TestEvalLimits(t *testing.T) {
+	// A sum of nearly MaxLength bytes is the longest evaluation
+	long := mustCompile(t, strings.Repeat("1+", expr.MaxLength/2-1)+"1")
+	if got, err := long.Eval(vars, expr.DefaultLimits); err != nil || got != int64(expr.MaxLength/2) {
+		t.Errorf("Eval of the longest sum = %v, %v; the default limits must allow it", got, err)
+	}
+	if _, err := long.Eval(vars, expr.Limits{MaxSteps: 100}); !errors.Is(err, expr.ErrStepLimit) {
+		t.Errorf("Eval error = %v, want ErrStepLimit", err)
+	}
+	if _, err := long.Eval(vars, expr.Limits{Timeout: time.Nanosecond}); !errors.Is(err, expr.ErrTimeLimit) {
+		t.Errorf("Eval error = %v, want ErrTimeLimit", err)
+	}
+	if _, err := long.Eval(vars, expr.Limits{}); err != nil {
+		t.Errorf("Eval without limits: %v", err)
+	}
+
+	// Membership tests count a step per item
+	list := "[" + strings.Repeat("0,", 1000) + "1]"
+	member := mustCompile(t, "1 in "+list)
+	if _, err := member.Eval(vars, expr.Limits{MaxSteps: 1100}); !errors.Is(err, expr.ErrStepLimit) {
+		t.Errorf("Eval of in error = %v, want ErrStepLimit", err)
+	}
+
+	// Strings cannot grow past their limit however they are built
+	doubling := mustCompile(t, "context.s + context.s")
+	big := vars
+	big.Context = map[string]interface{}{"s": strings.Repeat("x", 40<<10)}
+	if _, err := doubling.Eval(big, expr.DefaultLimits); err == nil || !strings.Contains(err.Error(), "string longer than the limit") {
+		t.Errorf("Eval error = %v, want the string refused", err)
+	}
+
+	// Domains are bound too
+	domain, err := expr.CompileDomain("priority in "+list, schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := domain.Domain(vars, expr.Limits{MaxSteps: 100}); !errors.Is(err, expr.ErrStepLimit) {
+		t.Errorf("Domain error = %v, want ErrStepLimit", err)
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	tests := []struct {
+		source  string
+		context map[string]interface{}
+		message string
+	}{
+		{"1 / 0", nil, "division by zero"},
+		{"1 % 0", nil, "division by zero"},
+		{"1.0 / 0", nil, "division by zero"},
+		{"1d / 0", nil, "division by zero"},
+		{"9223372036854775807 + 1", nil, "integer overflow"},
+		{"-9223372036854775807 - 2", nil, "integer overflow"},
+		{"9223372036854775807 * 2", nil, "integer overflow"},
+		{"-(-9223372036854775807 - 1)", nil, "integer overflow"},
+		{"abs(-9223372036854775807 - 1)", nil, "abs(): integer overflow"},
+		{"(-9223372036854775807 - 1) / -1", nil, "integer overflow"},
+		{"2562047h * 2", nil, "duration overflow"},
+		{"weeks(999999999999)", nil, "weeks(): duration overflow"},
+		{"date('31/12/2024')", nil, "date(): expected a date like 2024-12-31"},
+		{"context.x + 1", map[string]interface{}{"x": "a"}, "operator + does not apply to string and int"},
+		{"context.x and true", map[string]interface{}{"x": 1}, "expected a bool, got int"},
+		{"not context.x", map[string]interface{}{"x": "a"}, "expected a bool, got string"},
+		{"context.x < 1", map[string]interface{}{"x": true}, "cannot order bool and int"},
+		{"context.x = 1", map[string]interface{}{"x": "1"}, "cannot compare string with int"},
+		{"1 in context.x", map[string]interface{}{"x": 1}, "in needs a list on its right, not int"},
+		{"context.x", map[string]interface{}{"x": map[string]interface{}{}}, "context.x holds an unsupported map[string]interface {} value"},
+		{"context.x", map[string]interface{}{"x": struct{}{}}, "context.x holds an unsupported struct {} value"},
+		{"context.x", map[string]interface{}{"x": uint64(1 << 63)}, "context.x holds an unsupported uint64 value"},
+		{"context.x", map[string]interface{}{"x": []interface{}{[]interface{}{1}}}, "context.x holds an unsupported []interface {} value"},
+		{"context.x", map[string]interface{}{"x": func() {}}, "context.x holds an unsupported func() value"},
+		{"-context.x", map[string]interface{}{"x": "a"}, "cannot negate string"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			p := mustCompile(t, tt.source)
+			v := vars
+			v.Context = tt.context
+			got, err := p.Eval(v, expr.DefaultLimits)
+			var exprErr *expr.Error
+			if !errors.As(err, &exprErr) {
+				t.Fatalf("Eval = %v, %v, want an *Error", got, err)
+			}
+			if !strings.HasSuffix(exprErr.Message, tt.message) {
+				t.Errorf("message = %q, want %q", exprErr.Message, tt.message)
+			}
+		})
+	}
+}
+
+func mustDomain(t *testing.T, source string) []interface{} {
+	t.Helper()
+	p, err := expr.CompileDomain(source, schema)
+	if err != nil {
+		t.Fatalf("CompileDomain(%q): %v", source, err)
+	}
+	domain, err := p.Domain(vars, expr.DefaultLimits)
+	if err != nil {
+		t.Fatalf("Domain(%q): %v", source, err)
+	}
+	return domain
+}
+
+func TestDomain(t *testing.T) {
+	type l = []interface{}
+	tests := []struct {
+		source string
+		want   l
+	}{
+		{"create_uid = user.id", l{l{"create_uid", "=", int64(7)}}},
+		{"user.id = create_uid", l{l{"create_uid", "=", int64(7)}}},
+		{"1 < priority", l{l{"priority", ">", int64(1)}}},
+		{"active", l{l{"active", "=", true}}},
+		{"not active", l{"!", l{"active", "=", true}}},
+		{"active and state != 'done' or priority >= 2", l{"|", "&", l{"active", "=", true}, l{"state", "!=", "done"}, l{"priority", ">=", int64(2)}}},
+		{"deadline <= today() + 7d", l{l{"deadline", "<=", "2025-03-17"}}},
+		{"write_date > now() - 1h", l{l{"write_date", ">", now.Add(-time.Hour)}}},
+		{"state in ['draft', upper('x')]", l{l{"state", "in", l{"draft", "X"}}}},
+		{"state not in []", l{l{"id", "!=", nil}}},
+		{"state in []", l{l{"id", "=", nil}}},
+		{"create_uid in context.active_ids", l{l{"create_uid", "in", l{int64(1), int64(2)}}}},
+		{"create_uid in context.missing", l{l{"id", "=", nil}}},
+		{"name = context.missing", l{l{"name", "=", nil}}},
+		{"priority > context.missing", l{l{"id", "=", nil}}},
+		{"user.id = 7", l{l{"id", "!=", nil}}},
+		{"user.id = 7 and active", l{"&", l{"id", "!=", nil}, l{"active", "=", true}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			if got := mustDomain(t, tt.source); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Domain = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDomainErrors(t *testing.T) {
+	tests := []struct{ source, message string }{
+		{"priority + 1", "a domain is a condition, not int"},
+		{"name", "a domain is a condition, not string"},
+		{"name = state", "a comparison in a domain compares a field with a value computed without fields"},
+		{"lower(name) = 'x'", "a comparison in a domain compares a field with a value computed without fields"},
+		{"priority + 1 > 2", "a comparison in a domain compares a field with a value computed without fields"},
+		{"name in [state]", "in takes a field on its left and values on its right"},
+		{"'x' in tags", "in takes a field on its left and values on its right"},
+		{"contains(name, 'x')", "a domain joins comparisons of fields with and, or and not"},
+		{"(active = true) = true", "a comparison in a domain compares a field with a value computed without fields"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			_, err := expr.CompileDomain(tt.source, schema)
+			var errs expr.Errors
+			if !errors.As(err, &errs) {
+				t.Fatalf("CompileDomain error = %v, want Errors", err)
+			}
+			if errs[0].Message != tt.message {
+				t.Errorf("message = %q, want %q", errs[0].Message, tt.message)
+			}
+		})
+	}
+
+	// Values of the context are only known when building the domain
+	p, err := expr.CompileDomain("priority = context.x", schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := vars
+	v.Context = map[string]interface{}{"x": "1; DROP TABLE res_users"}
+	if _, err := p.Domain(v, expr.DefaultLimits); err == nil || !strings.Contains(err.Error(), "cannot compare priority, int, with string") {
+		t.Errorf("Domain error = %v, want the string refused", err)
+	}
+	p, err = expr.CompileDomain("priority in context.x", schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.Context = map[string]interface{}{"x": []interface{}{1, nil}}
+	if _, err := p.Domain(v, expr.DefaultLimits); err == nil || !strings.Contains(err.Error(), "cannot compare priority, int, with null") {
+		t.Errorf("Domain error = %v, want null refused in a list", err)
+	}
+}
+
+// TestConcurrentEval checks that a program is safe to share
+func TestConcurrentEval(t *testing.T) {
+	p := mustCompile(t, "create_uid = user.id and today() + 7d > deadline")
+	done := make(chan error)
+	for i := 0; i < 8; i++ {
+		go func(id int64) {
+			v := vars
+			v.User.ID = id
+			got, err := p.Eval(v, expr.DefaultLimits)
+			if err == nil && got != (id == 7) {
+				err = fmt.Errorf("user %d: %v", id, got)
+			}
+			done <- err
+		}(int64(i + 4))
+	}
+	for i := 0; i < 8; i++ {
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}
+}
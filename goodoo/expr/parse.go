@@ -0,0 +1,517 @@
+package expr
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tokenKind is the kind of a token
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokInt
+	tokFloat
+	tokDuration
+	tokString
+	tokIdent
+	tokOp
+)
+
+// token is a lexical token at a byte offset of the source
+type token struct {
+	kind  tokenKind
+	text  string
+	pos   int
+	value interface{}
+}
+
+// durationUnits are the units of duration literals like 7d or 90m
+var durationUnits = map[byte]time.Duration{
+	'w': 7 * 24 * time.Hour,
+	'd': 24 * time.Hour,
+	'h': time.Hour,
+	'm': time.Minute,
+	's': time.Second,
+}
+
+// operators are the operator tokens, longest first
+var operators = []string{"==", "!=", "<>", "<=", ">=", "&&", "||", "=", "<", ">", "+", "-", "*", "/", "%", "!", "(", ")", "[", "]", ",", "."}
+
+// keywords are the identifiers reserved by the language
+var keywords = map[string]bool{"and": true, "or": true, "not": true, "in": true, "true": true, "false": true, "null": true}
+
+func isLetter(c byte) bool {
+	return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// lex splits the source into tokens, ending with tokEOF
+func lex(source string) ([]token, *Error) {
+	var tokens []token
+	i := 0
+	for {
+		for i < len(source) && strings.ContainsRune(" \t\r\n", rune(source[i])) {
+			i++
+		}
+		if i >= len(source) {
+			return append(tokens, token{kind: tokEOF, pos: i}), nil
+		}
+		start := i
+		c := source[i]
+		switch {
+		case isDigit(c):
+			for i < len(source) && isDigit(source[i]) {
+				i++
+			}
+			kind := tokInt
+			if i+1 < len(source) && source[i] == '.' && isDigit(source[i+1]) {
+				kind = tokFloat
+				i++
+				for i < len(source) && isDigit(source[i]) {
+					i++
+				}
+			}
+			text := source[start:i]
+			if unit, ok := durationUnits[byteAt(source, i)]; ok && kind == tokInt && !isLetter(byteAt(source, i+1)) {
+				count, err := strconv.ParseInt(text, 10, 32)
+				if err != nil {
+					return nil, newError(source, start, "duration %s out of range", source[start:i+1])
+				}
+				i++
+				tokens = append(tokens, token{kind: tokDuration, text: source[start:i], pos: start, value: time.Duration(count) * unit})
+				continue
+			}
+			if isLetter(byteAt(source, i)) {
+				return nil, newError(source, i, "unexpected %q after number; durations are written like 7d, 12h, 30m, 10s or 2w", source[i])
+			}
+			if kind == tokFloat {
+				value, err := strconv.ParseFloat(text, 64)
+				if err != nil {
+					return nil, newError(source, start, "invalid number %s", text)
+				}
+				tokens = append(tokens, token{kind: tokFloat, text: text, pos: start, value: value})
+				continue
+			}
+			value, err := strconv.ParseInt(text, 10, 64)
+			if err != nil {
+				return nil, newError(source, start, "number %s out of range", text)
+			}
+			tokens = append(tokens, token{kind: tokInt, text: text, pos: start, value: value})
+		case isLetter(c):
+			for i < len(source) && (isLetter(source[i]) || isDigit(source[i])) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokIdent, text: source[start:i], pos: start})
+		case c == '\'' || c == '"':
+			value, end, err := lexString(source, i)
+			if err != nil {
+				return nil, err
+			}
+			i = end
+			tokens = append(tokens, token{kind: tokString, text: source[start:i], pos: start, value: value})
+		default:
+			matched := ""
+			for _, op := range operators {
+				if strings.HasPrefix(source[i:], op) {
+					matched = op
+					break
+				}
+			}
+			if matched == "" {
+				return nil, newError(source, i, "unexpected character %q", source[i])
+			}
+			i += len(matched)
+			tokens = append(tokens, token{kind: tokOp, text: matched, pos: start})
+		}
+	}
+}
+
+// byteAt returns the byte of source at i, 0 past its end
+func byteAt(source string, i int) byte {
+	if i < len(source) {
+		return source[i]
+	}
+	return 0
+}
+
+// lexString reads the quoted string at start, returning its value and the
+// offset following it
+func lexString(source string, start int) (string, int, *Error) {
+	quote := source[start]
+	var value strings.Builder
+	for i := start + 1; i < len(source); i++ {
+		switch c := source[i]; c {
+		case quote:
+			return value.String(), i + 1, nil
+		case '\\':
+			i++
+			switch byteAt(source, i) {
+			case '\\', '\'', '"':
+				value.WriteByte(source[i])
+			case 'n':
+				value.WriteByte('\n')
+			case 't':
+				value.WriteByte('\t')
+			default:
+				return "", 0, newError(source, i-1, "unknown escape sequence in string")
+			}
+		default:
+			value.WriteByte(c)
+		}
+	}
+	return "", 0, newError(source, start, "unterminated string")
+}
+
+// node is a node of the syntax tree
+type node interface {
+	base() *nodeBase
+}
+
+// nodeBase holds the position of a node and the type the checker gives it
+type nodeBase struct {
+	pos int
+	typ Type
+}
+
+func (b *nodeBase) base() *nodeBase {
+	return b
+}
+
+// literalNode is a constant
+type literalNode struct {
+	nodeBase
+	value interface{}
+}
+
+// listNode is a list of values, like [1, 2, 3]
+type listNode struct {
+	nodeBase
+	items []node
+}
+
+// nameNode is a reference: a field, "user.<name>" or "context.<key>"
+type nameNode struct {
+	nodeBase
+	path []string
+}
+
+func (n *nameNode) name() string {
+	return strings.Join(n.path, ".")
+}
+
+// isField reports whether the reference is a field of the record
+func (n *nameNode) isField() bool {
+	return n.path[0] != "user" && n.path[0] != "context"
+}
+
+// callNode is a call of a function of the language
+type callNode struct {
+	nodeBase
+	name string
+	args []node
+}
+
+// unaryNode is a prefix operator: "not" or "-"
+type unaryNode struct {
+	nodeBase
+	op string
+	x  node
+}
+
+// binaryNode is an infix operator, normalized: "=" for "==", "!=" for
+// "<>", "and" for "&&" and "or" for "||"
+type binaryNode struct {
+	nodeBase
+	op   string
+	x, y node
+}
+
+// parser is a recursive descent parser of the tokens of an expression
+type parser struct {
+	source string
+	tokens []token
+	pos    int
+	depth  int
+}
+
+// parse returns the syntax tree of an expression
+func parse(source string) (node, *Error) {
+	tokens, err := lex(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{source: source, tokens: tokens}
+	if p.peek().kind == tokEOF {
+		return nil, newError(source, 0, "empty expression")
+	}
+	root, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, newError(source, tok.pos, "unexpected %s", describe(tok))
+	}
+	return root, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// is reports whether the next token is one of the operators or keywords
+func (p *parser) is(texts ...string) bool {
+	tok := p.peek()
+	if tok.kind != tokOp && tok.kind != tokIdent {
+		return false
+	}
+	for _, text := range texts {
+		if tok.text == text {
+			return true
+		}
+	}
+	return false
+}
+
+// expect consumes the operator text or fails
+func (p *parser) expect(text string) *Error {
+	if !p.is(text) {
+		tok := p.peek()
+		return newError(p.source, tok.pos, "expected %q, found %s", text, describe(tok))
+	}
+	p.next()
+	return nil
+}
+
+// describe names a token in errors
+func describe(tok token) string {
+	if tok.kind == tokEOF {
+		return "end of expression"
+	}
+	return strconv.Quote(tok.text)
+}
+
+// enter guards the recursion against deeply nested expressions
+func (p *parser) enter() *Error {
+	p.depth++
+	if p.depth > maxDepth {
+		return newError(p.source, p.peek().pos, "expression nested more than %d levels deep", maxDepth)
+	}
+	return nil
+}
+
+func (p *parser) leave() {
+	p.depth--
+}
+
+// binary parses the left-associative operators ops over operands
+func (p *parser) binary(operand func() (node, *Error), ops map[string]string) (node, *Error) {
+	x, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok := p.peek()
+		op, ok := ops[tok.text]
+		if !ok || (tok.kind != tokOp && tok.kind != tokIdent) {
+			return x, nil
+		}
+		p.next()
+		y, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		x = &binaryNode{nodeBase: nodeBase{pos: tok.pos}, op: op, x: x, y: y}
+	}
+}
+
+func (p *parser) or() (node, *Error) {
+	return p.binary(p.and, map[string]string{"or": "or", "||": "or"})
+}
+
+func (p *parser) and() (node, *Error) {
+	return p.binary(p.not, map[string]string{"and": "and", "&&": "and"})
+}
+
+func (p *parser) not() (node, *Error) {
+	if p.is("not", "!") && !(p.peek().text == "not" && p.tokens[p.pos+1].text == "in") {
+		tok := p.next()
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
+		defer p.leave()
+		x, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{nodeBase: nodeBase{pos: tok.pos}, op: "not", x: x}, nil
+	}
+	return p.comparison()
+}
+
+// comparisonOperators maps the comparison operators to their normal form
+var comparisonOperators = map[string]string{"=": "=", "==": "=", "!=": "!=", "<>": "!=", "<": "<", "<=": "<=", ">": ">", ">=": ">="}
+
+func (p *parser) comparison() (node, *Error) {
+	x, err := p.additive()
+	if err != nil {
+		return nil, err
+	}
+	tok := p.peek()
+	op, ok := comparisonOperators[tok.text]
+	switch {
+	case ok && tok.kind == tokOp:
+		p.next()
+	case tok.kind == tokIdent && tok.text == "in":
+		p.next()
+		op = "in"
+	case tok.kind == tokIdent && tok.text == "not" && p.tokens[p.pos+1].text == "in":
+		p.next()
+		p.next()
+		op = "not in"
+	default:
+		return x, nil
+	}
+	y, err := p.additive()
+	if err != nil {
+		return nil, err
+	}
+	if next := p.peek(); next.kind == tokOp && comparisonOperators[next.text] != "" {
+		return nil, newError(p.source, next.pos, "comparisons cannot be chained; join them with and")
+	}
+	return &binaryNode{nodeBase: nodeBase{pos: tok.pos}, op: op, x: x, y: y}, nil
+}
+
+func (p *parser) additive() (node, *Error) {
+	return p.binary(p.multiplicative, map[string]string{"+": "+", "-": "-"})
+}
+
+func (p *parser) multiplicative() (node, *Error) {
+	return p.binary(p.unary, map[string]string{"*": "*", "/": "/", "%": "%"})
+}
+
+func (p *parser) unary() (node, *Error) {
+	if p.is("-") {
+		tok := p.next()
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
+		defer p.leave()
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{nodeBase: nodeBase{pos: tok.pos}, op: "-", x: x}, nil
+	}
+	return p.primary()
+}
+
+func (p *parser) primary() (node, *Error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+	tok := p.next()
+	at := nodeBase{pos: tok.pos}
+	switch tok.kind {
+	case tokInt:
+		return &literalNode{nodeBase: at, value: tok.value}, nil
+	case tokFloat:
+		return &literalNode{nodeBase: at, value: tok.value}, nil
+	case tokDuration:
+		return &literalNode{nodeBase: at, value: tok.value}, nil
+	case tokString:
+		return &literalNode{nodeBase: at, value: tok.value}, nil
+	case tokIdent:
+		switch tok.text {
+		case "true":
+			return &literalNode{nodeBase: at, value: true}, nil
+		case "false":
+			return &literalNode{nodeBase: at, value: false}, nil
+		case "null":
+			return &literalNode{nodeBase: at, value: nil}, nil
+		}
+		if keywords[tok.text] {
+			return nil, newError(p.source, tok.pos, "unexpected %q", tok.text)
+		}
+		if p.is("(") {
+			return p.call(tok)
+		}
+		path := []string{tok.text}
+		for p.is(".") {
+			p.next()
+			part := p.next()
+			if part.kind != tokIdent || keywords[part.text] {
+				return nil, newError(p.source, part.pos, "expected a name after \".\", found %s", describe(part))
+			}
+			path = append(path, part.text)
+		}
+		if p.is("(") {
+			return nil, newError(p.source, tok.pos, "%s() is not a function; available: %s", strings.Join(path, "."), functionNames())
+		}
+		return &nameNode{nodeBase: at, path: path}, nil
+	case tokOp:
+		switch tok.text {
+		case "(":
+			x, err := p.or()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return x, nil
+		case "[":
+			list := &listNode{nodeBase: at}
+			for !p.is("]") {
+				item, err := p.additive()
+				if err != nil {
+					return nil, err
+				}
+				list.items = append(list.items, item)
+				if !p.is(",") {
+					break
+				}
+				p.next()
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			return list, nil
+		}
+	}
+	return nil, newError(p.source, tok.pos, "unexpected %s", describe(tok))
+}
+
+// call parses the arguments of a function call
+func (p *parser) call(name token) (node, *Error) {
+	p.next()
+	call := &callNode{nodeBase: nodeBase{pos: name.pos}, name: name.text}
+	for !p.is(")") {
+		arg, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		call.args = append(call.args, arg)
+		if !p.is(",") {
+			break
+		}
+		p.next()
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	return call, nil
+}
@@ -1,11 +1,15 @@
 package fields
 
 import (
+	"encoding/json"
 	"fmt"
+	"math"
 	"reflect"
 	"strconv"
+	"strings"
 	"time"
 
+	"goodoo/locale"
 	"goodoo/logging"
 )
 
@@ -19,6 +23,7 @@ const (
 	FloatType     FieldType = "float"
 	StringType    FieldType = "char"
 	TextType      FieldType = "text"
+	HtmlType      FieldType = "html"
 	DateType      FieldType = "date"
 	DatetimeType  FieldType = "datetime"
 	BinaryType    FieldType = "binary"
@@ -44,14 +49,71 @@ type FieldAttribute struct {
 	Invisible    bool                   `json:"invisible,omitempty"`     // Is field invisible
 	Store        bool                   `json:"store"`                   // Is field stored in DB
 	Copy         bool                   `json:"copy"`                    // Copy on duplicate
-	Index        string                 `json:"index,omitempty"`         // Index type (btree, trigram, etc.)
+	Index        string                 `json:"index,omitempty"`         // Index type (btree, btree_not_null, trigram)
+	Unique       bool                   `json:"unique,omitempty"`        // Enforce uniqueness with a unique index
 	Default      interface{}            `json:"default,omitempty"`       // Default value
 	Groups       []string               `json:"groups,omitempty"`        // Access groups
+	GroupsReadonly bool                 `json:"groups_readonly,omitempty"` // Outside Groups the field is readonly instead of hidden
 	States       map[string]interface{} `json:"states,omitempty"`        // State-based conditions
 	Depends      []string               `json:"depends,omitempty"`       // Computed field dependencies
 	Domain       interface{}            `json:"domain,omitempty"`        // Field domain
 	Context      map[string]interface{} `json:"context,omitempty"`       // Field context
 	Translate    bool                   `json:"translate,omitempty"`     // Is field translatable
+	Nullable     bool                   `json:"nullable,omitempty"`      // Column accepts NULL: absent values stay nil instead of the zero value
+	Relation     string                 `json:"relation,omitempty"`      // Model whose record ids an integer field holds (a many2one column)
+	OnDelete     string                 `json:"ondelete,omitempty"`      // What deleting the Relation record does to this one: restrict, cascade or set null
+	ContextDefault string               `json:"context_default,omitempty"` // Context key whose value is the default on create (e.g. "uid", "team_id")
+	DefaultExpr  string                 `json:"default_expr,omitempty"`  // Expression computing the default on create (e.g. "today() + 7d", "user.id")
+}
+
+// Index types accepted in FieldAttribute.Index (like Odoo's index= parameter)
+const (
+	IndexBtree        = "btree"
+	IndexBtreeNotNull = "btree_not_null"
+	IndexTrigram      = "trigram"
+)
+
+// IndexType returns the normalized index type, or "" when the field is not indexed
+func (a FieldAttribute) IndexType() string {
+	switch a.Index {
+	case "", "false", "0":
+		return ""
+	case "true", "1", IndexBtree:
+		return IndexBtree
+	default:
+		return a.Index
+	}
+}
+
+// Referential actions accepted in FieldAttribute.OnDelete (like Odoo's
+// ondelete= parameter)
+const (
+	OnDeleteRestrict = "restrict"
+	OnDeleteCascade  = "cascade"
+	OnDeleteSetNull  = "set null"
+)
+
+// OnDeleteAction returns the normalized referential action of a relation,
+// or "" when the field declares none
+func (a FieldAttribute) OnDeleteAction() string {
+	if a.Relation == "" {
+		return ""
+	}
+	return NormalizeOnDelete(a.OnDelete)
+}
+
+// NormalizeOnDelete maps an ondelete spelling ("SET NULL", "set_null",
+// "Cascade") to one of the OnDelete constants, "" when unknown
+func NormalizeOnDelete(action string) string {
+	switch strings.ToLower(strings.Join(strings.Fields(strings.ReplaceAll(action, "_", " ")), " ")) {
+	case OnDeleteRestrict:
+		return OnDeleteRestrict
+	case OnDeleteCascade:
+		return OnDeleteCascade
+	case OnDeleteSetNull, "setnull":
+		return OnDeleteSetNull
+	}
+	return ""
 }
 
 // DefaultFieldAttributes returns default field attributes
@@ -161,6 +223,11 @@ func (f *BaseField) IsRequired() bool {
 	return f.Attributes.Required
 }
 
+// IsNullable returns whether absent values are kept as NULL
+func (f *BaseField) IsNullable() bool {
+	return f.Attributes.Nullable
+}
+
 // IsReadonly returns whether the field is readonly
 func (f *BaseField) IsReadonly() bool {
 	return f.Attributes.Readonly
@@ -171,42 +238,46 @@ func (f *BaseField) GetDefault() interface{} {
 	return f.Attributes.Default
 }
 
-// GetSQLConstraints returns SQL constraints for the field
+// GetSQLConstraints returns SQL constraints for the field. Nullable
+// columns never get NOT NULL: Required is then checked by the application.
 func (f *BaseField) GetSQLConstraints() []string {
 	var constraints []string
 	
-	if f.IsRequired() {
+	if f.IsRequired() && !f.IsNullable() {
 		constraints = append(constraints, "NOT NULL")
 	}
 	
 	return constraints
 }
 
-// ValidateRequired checks if required field has a value
+// ValidateRequired checks if required field has a value. Only an absent
+// value is missing: an explicit zero (0, false, "") is a value.
 func (f *BaseField) ValidateRequired(value interface{}) error {
 	if !f.IsRequired() {
 		return nil
 	}
 	
-	if value == nil {
+	if isAbsent(value) {
 		return fmt.Errorf("field '%s' is required", f.Name)
 	}
 	
-	// Check for empty values based on type
-	switch v := value.(type) {
-	case string:
-		if v == "" {
-			return fmt.Errorf("field '%s' is required", f.Name)
-		}
-	case []interface{}:
-		if len(v) == 0 {
-			return fmt.Errorf("field '%s' is required", f.Name)
-		}
+	// An empty list of records is no value for relational fields
+	if v, ok := value.([]interface{}); ok && len(v) == 0 {
+		return fmt.Errorf("field '%s' is required", f.Name)
 	}
 	
 	return nil
 }
 
+// isAbsent reports whether value is nil, including a typed nil pointer
+func isAbsent(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	v := reflect.ValueOf(value)
+	return v.Kind() == reflect.Ptr && v.IsNil()
+}
+
 // ConvertToDisplay provides a default string representation
 func (f *BaseField) ConvertToDisplay(value interface{}, record interface{}) (string, error) {
 	if value == nil {
@@ -215,6 +286,41 @@ func (f *BaseField) ConvertToDisplay(value interface{}, record interface{}) (str
 	return fmt.Sprintf("%v", value), nil
 }
 
+// contextRecord is implemented by the records passed to ConvertToDisplay
+// that carry a context, like an ORM environment: its lang and tz keys
+// localize the display
+type contextRecord interface {
+	GetContext() map[string]interface{}
+}
+
+// DisplayLocale returns the locale and timezone of a record's context,
+// defaulting to the default language and UTC
+func DisplayLocale(record interface{}) (*locale.Locale, *time.Location) {
+	lang, tz := locale.DefaultLang, ""
+	if holder, ok := record.(contextRecord); ok {
+		context := holder.GetContext()
+		if value, ok := context["lang"].(string); ok && value != "" {
+			lang = value
+		}
+		tz, _ = context["tz"].(string)
+	}
+	location := time.UTC
+	if tz != "" && tz != "Local" {
+		if loaded, err := time.LoadLocation(tz); err == nil {
+			location = loaded
+		}
+	}
+	return locale.Get(lang), location
+}
+
+// LocalizedParser is implemented by the fields accepting user input in the
+// format of a locale, such as "1.234,56" for a float in de_DE.
+// ParseLocalized returns the value in the canonical form ConvertToCache
+// accepts; datetimes are read in loc.
+type LocalizedParser interface {
+	ParseLocalized(value string, l *locale.Locale, loc *time.Location) (interface{}, error)
+}
+
 // FieldRegistry manages field type registration and creation
 type FieldRegistry struct {
 	fields map[FieldType]func(FieldAttribute) Field
@@ -284,6 +390,10 @@ func (r *FieldRegistry) registerBuiltinFields() {
 		return NewTextField(attrs)
 	})
 	
+	r.RegisterField(HtmlType, func(attrs FieldAttribute) Field {
+		return NewHtmlField(attrs)
+	})
+	
 	r.RegisterField(DateType, func(attrs FieldAttribute) Field {
 		return NewDateField(attrs)
 	})
@@ -303,6 +413,10 @@ func (r *FieldRegistry) registerBuiltinFields() {
 	r.RegisterField(JsonType, func(attrs FieldAttribute) Field {
 		return NewJsonField(attrs)
 	})
+	
+	r.RegisterField(MonetaryType, func(attrs FieldAttribute) Field {
+		return NewMonetaryField(attrs)
+	})
 }
 
 // Global field registry instance
@@ -326,6 +440,8 @@ func ConvertToString(value interface{}) string {
 		return v
 	case []byte:
 		return string(v)
+	case json.Number:
+		return v.String()
 	case int, int8, int16, int32, int64:
 		return fmt.Sprintf("%d", v)
 	case uint, uint8, uint16, uint32, uint64:
@@ -341,47 +457,16 @@ func ConvertToString(value interface{}) string {
 	}
 }
 
-// ConvertToInt safely converts any value to int
+// ConvertToInt safely converts any value to int, exactly (see ConvertToInt64)
 func ConvertToInt(value interface{}) (int, error) {
-	if value == nil {
-		return 0, nil
+	converted, err := ConvertToInt64(value)
+	if err != nil {
+		return 0, err
 	}
-	
-	switch v := value.(type) {
-	case int:
-		return v, nil
-	case int8:
-		return int(v), nil
-	case int16:
-		return int(v), nil
-	case int32:
-		return int(v), nil
-	case int64:
-		return int(v), nil
-	case uint:
-		return int(v), nil
-	case uint8:
-		return int(v), nil
-	case uint16:
-		return int(v), nil
-	case uint32:
-		return int(v), nil
-	case uint64:
-		return int(v), nil
-	case float32:
-		return int(v), nil
-	case float64:
-		return int(v), nil
-	case string:
-		return strconv.Atoi(v)
-	case bool:
-		if v {
-			return 1, nil
-		}
-		return 0, nil
-	default:
-		return 0, fmt.Errorf("cannot convert %T to int", value)
+	if converted < math.MinInt || converted > math.MaxInt {
+		return 0, fmt.Errorf("%d is out of the integer range", converted)
 	}
+	return int(converted), nil
 }
 
 // ConvertToFloat safely converts any value to float64
@@ -415,8 +500,12 @@ func ConvertToFloat(value interface{}) (float64, error) {
 		return float64(v), nil
 	case uint64:
 		return float64(v), nil
-	case string:
-		return strconv.ParseFloat(v, 64)
+	case json.Number, string:
+		text, _ := numberText(v)
+		if !decimalPattern.MatchString(text) {
+			return 0.0, fmt.Errorf("%q is not a number", text)
+		}
+		return strconv.ParseFloat(strings.TrimPrefix(text, "+"), 64)
 	case bool:
 		if v {
 			return 1.0, nil
@@ -438,6 +527,9 @@ func ConvertToBool(value interface{}) (bool, error) {
 		return v, nil
 	case string:
 		return strconv.ParseBool(v)
+	case json.Number:
+		f, err := ConvertToFloat(v)
+		return f != 0.0, err
 	case int, int8, int16, int32, int64:
 		rv := reflect.ValueOf(v)
 		return rv.Int() != 0, nil
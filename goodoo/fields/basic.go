@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"time"
+
+	"goodoo/locale"
 )
 
 // BooleanField represents a boolean field (like Odoo's Boolean field)
@@ -14,7 +16,7 @@ type BooleanField struct {
 
 // NewBooleanField creates a new boolean field
 func NewBooleanField(attrs FieldAttribute) Field {
-	if attrs.Default == nil {
+	if attrs.Default == nil && !attrs.Nullable {
 		attrs.Default = false
 	}
 	
@@ -28,6 +30,9 @@ func NewBooleanField(attrs FieldAttribute) Field {
 // ConvertToCache converts value for caching
 func (f *BooleanField) ConvertToCache(value interface{}, record interface{}) (interface{}, error) {
 	if value == nil {
+		if f.IsNullable() {
+			return nil, nil
+		}
 		return false, nil
 	}
 	
@@ -51,6 +56,9 @@ func (f *BooleanField) ConvertToRecord(value interface{}, record interface{}) (i
 
 // ConvertToExport converts value for export
 func (f *BooleanField) ConvertToExport(value interface{}, record interface{}) (interface{}, error) {
+	if value == nil && f.IsNullable() {
+		return "", nil
+	}
 	return f.ConvertToCache(value, record)
 }
 
@@ -61,6 +69,9 @@ func (f *BooleanField) ConvertToDisplay(value interface{}, record interface{}) (
 		return "", err
 	}
 	
+	if converted == nil {
+		return "", nil
+	}
 	if converted.(bool) {
 		return "True", nil
 	}
@@ -89,7 +100,7 @@ type IntegerField struct {
 
 // NewIntegerField creates a new integer field
 func NewIntegerField(attrs FieldAttribute) Field {
-	if attrs.Default == nil {
+	if attrs.Default == nil && !attrs.Nullable {
 		attrs.Default = 0
 	}
 	
@@ -103,6 +114,9 @@ func NewIntegerField(attrs FieldAttribute) Field {
 // ConvertToCache converts value for caching
 func (f *IntegerField) ConvertToCache(value interface{}, record interface{}) (interface{}, error) {
 	if value == nil {
+		if f.IsNullable() {
+			return nil, nil
+		}
 		return 0, nil
 	}
 	
@@ -121,17 +135,7 @@ func (f *IntegerField) ConvertToColumn(value interface{}, record interface{}) (i
 
 // ConvertToRecord converts value for record
 func (f *IntegerField) ConvertToRecord(value interface{}, record interface{}) (interface{}, error) {
-	converted, err := f.ConvertToCache(value, record)
-	if err != nil {
-		return nil, err
-	}
-	
-	// Return 0 for nil to match Odoo behavior
-	if converted == nil {
-		return 0, nil
-	}
-	
-	return converted, nil
+	return f.ConvertToCache(value, record)
 }
 
 // ConvertToExport converts value for export
@@ -141,7 +145,7 @@ func (f *IntegerField) ConvertToExport(value interface{}, record interface{}) (i
 		return "", err
 	}
 	
-	if converted.(int) == 0 && value == nil {
+	if value == nil {
 		return "", nil
 	}
 	
@@ -163,6 +167,28 @@ func (f *IntegerField) GetColumnType() (string, string) {
 	return "integer", "int"
 }
 
+// ConvertToDisplay formats the integer in the record's language
+func (f *IntegerField) ConvertToDisplay(value interface{}, record interface{}) (string, error) {
+	if value == nil {
+		return "", nil
+	}
+	converted, err := f.ConvertToCache(value, record)
+	if err != nil {
+		return "", err
+	}
+	l, _ := DisplayLocale(record)
+	return l.FormatInteger(int64(converted.(int))), nil
+}
+
+// ParseLocalized parses an integer typed in a locale
+func (f *IntegerField) ParseLocalized(value string, l *locale.Locale, loc *time.Location) (interface{}, error) {
+	parsed, err := l.ParseInteger(value)
+	if err != nil {
+		return nil, fmt.Errorf("integer field '%s': %w", f.Name, err)
+	}
+	return int(parsed), nil
+}
+
 // FloatField represents a float field (like Odoo's Float field)
 type FloatField struct {
 	*BaseField
@@ -177,7 +203,7 @@ type FloatDigits struct {
 
 // NewFloatField creates a new float field
 func NewFloatField(attrs FieldAttribute) Field {
-	if attrs.Default == nil {
+	if attrs.Default == nil && !attrs.Nullable {
 		attrs.Default = 0.0
 	}
 	
@@ -199,23 +225,25 @@ func (f *FloatField) SetDigits(total, decimal int) {
 // ConvertToCache converts value for caching
 func (f *FloatField) ConvertToCache(value interface{}, record interface{}) (interface{}, error) {
 	if value == nil {
+		if f.IsNullable() {
+			return nil, nil
+		}
 		return 0.0, nil
 	}
 	
-	converted, err := ConvertToFloat(value)
+	// With a precision, the value is rounded on its decimal text, so that
+	// float artifacts are never stored
+	var converted float64
+	var err error
+	if f.Digits != nil {
+		converted, err = RoundDecimal(value, f.Digits.Decimal)
+	} else {
+		converted, err = ConvertToFloat(value)
+	}
 	if err != nil {
 		return 0.0, fmt.Errorf("float field '%s': %w", f.Name, err)
 	}
 	
-	// Apply precision if configured
-	if f.Digits != nil {
-		precision := 1.0
-		for i := 0; i < f.Digits.Decimal; i++ {
-			precision *= 10
-		}
-		converted = float64(int(converted*precision+0.5)) / precision
-	}
-	
 	return converted, nil
 }
 
@@ -231,6 +259,9 @@ func (f *FloatField) ConvertToRecord(value interface{}, record interface{}) (int
 
 // ConvertToExport converts value for export
 func (f *FloatField) ConvertToExport(value interface{}, record interface{}) (interface{}, error) {
+	if value == nil && f.IsNullable() {
+		return "", nil
+	}
 	return f.ConvertToCache(value, record)
 }
 
@@ -252,6 +283,76 @@ func (f *FloatField) GetColumnType() (string, string) {
 	return "double precision", "float64"
 }
 
+// displayDigits returns the decimals displayed, 2 without precision
+func (f *FloatField) displayDigits() int {
+	if f.Digits != nil {
+		return f.Digits.Decimal
+	}
+	return 2
+}
+
+// ConvertToDisplay formats the float in the record's language
+func (f *FloatField) ConvertToDisplay(value interface{}, record interface{}) (string, error) {
+	if value == nil {
+		return "", nil
+	}
+	converted, err := f.ConvertToCache(value, record)
+	if err != nil {
+		return "", err
+	}
+	l, _ := DisplayLocale(record)
+	return l.FormatNumber(converted.(float64), f.displayDigits()), nil
+}
+
+// ParseLocalized parses a number typed in a locale
+func (f *FloatField) ParseLocalized(value string, l *locale.Locale, loc *time.Location) (interface{}, error) {
+	parsed, err := l.ParseNumber(value)
+	if err != nil {
+		return nil, fmt.Errorf("float field '%s': %w", f.Name, err)
+	}
+	return parsed, nil
+}
+
+// MonetaryField represents an amount in a currency (like Odoo's Monetary
+// field), stored with two decimals
+type MonetaryField struct {
+	*FloatField
+	// Currency is the ISO code of the amounts
+	Currency string `json:"currency,omitempty"`
+}
+
+// NewMonetaryField creates a new monetary field
+func NewMonetaryField(attrs FieldAttribute) Field {
+	if attrs.Default == nil && !attrs.Nullable {
+		attrs.Default = 0.0
+	}
+
+	field := &MonetaryField{
+		FloatField: &FloatField{BaseField: NewBaseField(MonetaryType, attrs)},
+	}
+	field.SetDigits(16, 2)
+
+	return field
+}
+
+// SetCurrency sets the ISO code of the amounts
+func (f *MonetaryField) SetCurrency(currency string) {
+	f.Currency = currency
+}
+
+// ConvertToDisplay formats the amount and its currency in the record's language
+func (f *MonetaryField) ConvertToDisplay(value interface{}, record interface{}) (string, error) {
+	if value == nil {
+		return "", nil
+	}
+	converted, err := f.ConvertToCache(value, record)
+	if err != nil {
+		return "", err
+	}
+	l, _ := DisplayLocale(record)
+	return l.FormatMonetary(converted.(float64), f.Currency), nil
+}
+
 // StringField represents a string/char field (like Odoo's Char field)
 type StringField struct {
 	*BaseField
@@ -276,6 +377,9 @@ func (f *StringField) SetSize(size int) {
 // ConvertToCache converts value for caching
 func (f *StringField) ConvertToCache(value interface{}, record interface{}) (interface{}, error) {
 	if value == nil {
+		if f.IsNullable() {
+			return nil, nil
+		}
 		return "", nil
 	}
 	
@@ -301,6 +405,9 @@ func (f *StringField) ConvertToRecord(value interface{}, record interface{}) (in
 
 // ConvertToExport converts value for export
 func (f *StringField) ConvertToExport(value interface{}, record interface{}) (interface{}, error) {
+	if value == nil && f.IsNullable() {
+		return "", nil
+	}
 	return f.ConvertToCache(value, record)
 }
 
@@ -315,7 +422,7 @@ func (f *StringField) Validate(value interface{}, record interface{}) error {
 		return err
 	}
 	
-	str := converted.(string)
+	str, _ := converted.(string)
 	if f.Size > 0 && len(str) > f.Size {
 		return fmt.Errorf("field '%s' exceeds maximum length of %d characters", f.Name, f.Size)
 	}
@@ -348,6 +455,9 @@ func NewTextField(attrs FieldAttribute) Field {
 // ConvertToCache converts value for caching
 func (f *TextField) ConvertToCache(value interface{}, record interface{}) (interface{}, error) {
 	if value == nil {
+		if f.IsNullable() {
+			return nil, nil
+		}
 		return "", nil
 	}
 	
@@ -366,6 +476,9 @@ func (f *TextField) ConvertToRecord(value interface{}, record interface{}) (inte
 
 // ConvertToExport converts value for export
 func (f *TextField) ConvertToExport(value interface{}, record interface{}) (interface{}, error) {
+	if value == nil && f.IsNullable() {
+		return "", nil
+	}
 	return f.ConvertToCache(value, record)
 }
 
@@ -384,6 +497,22 @@ func (f *TextField) GetColumnType() (string, string) {
 	return "text", "string"
 }
 
+// HtmlField represents a rich text field (like Odoo's Html field)
+type HtmlField struct {
+	*TextField
+}
+
+// NewHtmlField creates a new html field
+func NewHtmlField(attrs FieldAttribute) Field {
+	field := &HtmlField{
+		TextField: &TextField{
+			BaseField: NewBaseField(HtmlType, attrs),
+		},
+	}
+	
+	return field
+}
+
 // DateField represents a date field (like Odoo's Date field)
 type DateField struct {
 	*BaseField
@@ -461,7 +590,17 @@ func (f *DateField) ConvertToDisplay(value interface{}, record interface{}) (str
 	}
 	
 	date := converted.(time.Time)
-	return date.Format("2006-01-02"), nil
+	l, _ := DisplayLocale(record)
+	return l.FormatDate(date), nil
+}
+
+// ParseLocalized parses a date typed in a locale
+func (f *DateField) ParseLocalized(value string, l *locale.Locale, loc *time.Location) (interface{}, error) {
+	parsed, err := l.ParseDate(value)
+	if err != nil {
+		return nil, fmt.Errorf("date field '%s': %w", f.Name, err)
+	}
+	return parsed, nil
 }
 
 // Validate validates the date value
@@ -559,8 +698,19 @@ func (f *DatetimeField) ConvertToDisplay(value interface{}, record interface{})
 		return "", nil
 	}
 	
+	// Datetimes are stored in UTC and displayed in the record's timezone
 	datetime := converted.(time.Time)
-	return datetime.Format("2006-01-02 15:04:05"), nil
+	l, loc := DisplayLocale(record)
+	return l.FormatDatetime(datetime.In(loc)), nil
+}
+
+// ParseLocalized parses a datetime typed in a locale, in the user's timezone
+func (f *DatetimeField) ParseLocalized(value string, l *locale.Locale, loc *time.Location) (interface{}, error) {
+	parsed, err := l.ParseDatetime(value, loc)
+	if err != nil {
+		return nil, fmt.Errorf("datetime field '%s': %w", f.Name, err)
+	}
+	return parsed, nil
 }
 
 // Validate validates the datetime value
@@ -863,4 +1013,40 @@ func (f *JsonField) Validate(value interface{}, record interface{}) error {
 // GetColumnType returns the PostgreSQL column type
 func (f *JsonField) GetColumnType() (string, string) {
 	return "jsonb", "interface{}"
-}
\ No newline at end of file
+}
+// Merge applies a JSON merge patch (RFC 7396) to a stored value: objects
+// are merged key by key, a null member removes the key and any other
+// value replaces the stored one
+func (f *JsonField) Merge(stored, patch interface{}) (interface{}, error) {
+	stored, err := f.ConvertToCache(stored, nil)
+	if err != nil {
+		return nil, err
+	}
+	patch, err = f.ConvertToCache(patch, nil)
+	if err != nil {
+		return nil, err
+	}
+	return mergePatch(stored, patch), nil
+}
+
+// mergePatch merges patch into target without modifying target
+func mergePatch(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	merged := make(map[string]interface{})
+	if targetObject, ok := target.(map[string]interface{}); ok {
+		for key, value := range targetObject {
+			merged[key] = value
+		}
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(merged, key)
+		} else {
+			merged[key] = mergePatch(merged[key], value)
+		}
+	}
+	return merged
+}
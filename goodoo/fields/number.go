@@ -0,0 +1,211 @@
+package fields
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// MaxSafeInteger is the largest integer a float64, hence a JavaScript
+// number, holds exactly (2^53 - 1). Integers beyond it only keep their
+// value as json.Number or int64.
+const MaxSafeInteger = 1<<53 - 1
+
+// decimalPattern matches the decimal numbers accepted as text: JSON
+// numbers, plus a leading "+" or "." and trailing "." sloppy clients send.
+// The exponent is bounded so that parsing never allocates huge numbers.
+var decimalPattern = regexp.MustCompile(`^[+-]?(\d+\.?\d*|\.\d+)([eE][+-]?\d{1,3})?$`)
+
+// DecodeJSON decodes data like json.Unmarshal, except that the numbers of
+// interface{} values are decoded as json.Number: large ids and decimals
+// keep their exact text until converted to the type of their field
+func DecodeJSON(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(v); err != nil {
+		if err == io.EOF {
+			return errors.New("unexpected end of JSON input")
+		}
+		return err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return errors.New("invalid data after top-level JSON value")
+	}
+	return nil
+}
+
+// NormalizeNumbers returns value with its json.Number replaced by int64
+// for integers and float64 otherwise, in nested slices and maps too, for
+// values used without a field to convert them, e.g. in SQL parameters
+func NormalizeNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+		return v.String()
+	case []interface{}:
+		normalized := make([]interface{}, len(v))
+		for i, item := range v {
+			normalized[i] = NormalizeNumbers(item)
+		}
+		return normalized
+	case map[string]interface{}:
+		normalized := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			normalized[key] = NormalizeNumbers(item)
+		}
+		return normalized
+	}
+	return value
+}
+
+// numberText returns the text of a json.Number or of a string holding a
+// number, trimmed
+func numberText(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case json.Number:
+		return string(v), true
+	case string:
+		return strings.TrimSpace(v), true
+	}
+	return "", false
+}
+
+// parseDecimal parses a decimal number exactly, e.g. "0.1" or "1e3"
+func parseDecimal(text string) (*big.Rat, error) {
+	if !decimalPattern.MatchString(text) {
+		return nil, fmt.Errorf("%q is not a number", text)
+	}
+	r, ok := new(big.Rat).SetString(strings.TrimPrefix(text, "+"))
+	if !ok {
+		return nil, fmt.Errorf("%q is not a number", text)
+	}
+	return r, nil
+}
+
+// ConvertToInt64 converts a value to int64 without losing precision: the
+// text of json.Number and strings is parsed exactly, scientific notation
+// included ("1e3"), while fractions, integers out of range and floats
+// beyond MaxSafeInteger, already imprecise, are errors
+func ConvertToInt64(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case nil:
+		return 0, nil
+	case int:
+		return int64(v), nil
+	case int8:
+		return int64(v), nil
+	case int16:
+		return int64(v), nil
+	case int32:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case uint:
+		return uintToInt64(uint64(v))
+	case uint8:
+		return int64(v), nil
+	case uint16:
+		return int64(v), nil
+	case uint32:
+		return int64(v), nil
+	case uint64:
+		return uintToInt64(v)
+	case float32:
+		return floatToInt64(float64(v))
+	case float64:
+		return floatToInt64(v)
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	}
+
+	text, ok := numberText(value)
+	if !ok {
+		return 0, fmt.Errorf("cannot convert %T to int", value)
+	}
+	if i, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return i, nil
+	}
+	r, err := parseDecimal(text)
+	if err != nil {
+		return 0, err
+	}
+	if !r.IsInt() {
+		return 0, fmt.Errorf("%s is not an integer", text)
+	}
+	if !r.Num().IsInt64() {
+		return 0, fmt.Errorf("%s is out of the integer range", text)
+	}
+	return r.Num().Int64(), nil
+}
+
+func uintToInt64(v uint64) (int64, error) {
+	if v > math.MaxInt64 {
+		return 0, fmt.Errorf("%d is out of the integer range", v)
+	}
+	return int64(v), nil
+}
+
+func floatToInt64(v float64) (int64, error) {
+	if v != math.Trunc(v) {
+		return 0, fmt.Errorf("%v is not an integer", v)
+	}
+	if math.Abs(v) > MaxSafeInteger {
+		return 0, fmt.Errorf("%v is beyond the integers a float holds exactly", v)
+	}
+	return int64(v), nil
+}
+
+// ConvertToID converts a value to a record id, a positive integer
+func ConvertToID(value interface{}) (uint, error) {
+	id, err := ConvertToInt64(value)
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("invalid record id %v", value)
+	}
+	return uint(id), nil
+}
+
+// RoundDecimal converts a value to float64 rounded to digits decimals,
+// half away from zero. The rounding is done on the decimal text of the
+// value, the shortest one for floats, so that binary artifacts such as
+// 0.1+0.2 = 0.30000000000000004 or 2.675 = 2.67499999... never decide it.
+func RoundDecimal(value interface{}, digits int) (float64, error) {
+	text, ok := numberText(value)
+	if !ok {
+		f, err := ConvertToFloat(value)
+		if err != nil {
+			return 0, err
+		}
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return 0, fmt.Errorf("%v is not a number", f)
+		}
+		text = strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	r, err := parseDecimal(text)
+	if err != nil {
+		return 0, err
+	}
+
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(digits)), nil)
+	scaled := new(big.Rat).Mul(r, new(big.Rat).SetInt(scale))
+	quotient, remainder := new(big.Int).QuoRem(scaled.Num(), scaled.Denom(), new(big.Int))
+	if remainder.Lsh(remainder.Abs(remainder), 1).Cmp(scaled.Denom()) >= 0 {
+		quotient.Add(quotient, big.NewInt(int64(scaled.Num().Sign())))
+	}
+	rounded, _ := new(big.Rat).SetFrac(quotient, scale).Float64()
+	return rounded, nil
+}
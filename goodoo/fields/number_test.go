@@ -0,0 +1,234 @@
+package fields_test
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"goodoo/fields"
+)
+
+// artifact is 0.1+0.2 computed in float64; the constant expression would
+// be exact
+var artifact = 0.30000000000000004
+
+func TestConvertToInt64(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   interface{}
+		want    int64
+		wantErr bool
+	}{
+		{"nil", nil, 0, false},
+		{"int", 42, 42, false},
+		{"json number", json.Number("42"), 42, false},
+		// Beyond 2^53 the text keeps the exact value a float64 would lose
+		{"max safe integer", json.Number("9007199254740991"), fields.MaxSafeInteger, false},
+		{"beyond 2^53", json.Number("9007199254740993"), 9007199254740993, false},
+		{"max int64", json.Number("9223372036854775807"), math.MaxInt64, false},
+		{"beyond int64", json.Number("9223372036854775808"), 0, true},
+		{"scientific notation", json.Number("1e3"), 1000, false},
+		{"scientific notation with fraction", json.Number("1.5E2"), 150, false},
+		{"scientific fraction", json.Number("1e-3"), 0, true},
+		{"huge exponent", json.Number("1e100000"), 0, true},
+		{"fraction", json.Number("1.5"), 0, true},
+		{"integral decimal", json.Number("2.0"), 2, false},
+		{"negative", json.Number("-7"), -7, false},
+		// Sloppy clients send numbers as strings
+		{"string", "42", 42, false},
+		{"padded string", " 42 ", 42, false},
+		{"plus sign", "+42", 42, false},
+		{"trailing dot", "42.", 42, false},
+		{"string in scientific notation", "2e2", 200, false},
+		{"empty string", "", 0, true},
+		{"not a number", "42abc", 0, true},
+		{"hexadecimal", "0x2A", 0, true},
+		{"float", 3.0, 3, false},
+		{"float fraction", 3.5, 0, true},
+		{"float beyond 2^53", float64(1 << 54), 0, true},
+		{"uint beyond int64", uint64(math.MaxUint64), 0, true},
+		{"bool", true, 1, false},
+		{"unsupported", []int{1}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := fields.ConvertToInt64(tt.value)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("ConvertToInt64(%#v) = %d, %v; want %d, error %v", tt.value, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConvertToID(t *testing.T) {
+	tests := []struct {
+		value   interface{}
+		want    uint
+		wantErr bool
+	}{
+		{json.Number("7"), 7, false},
+		{"7", 7, false},
+		{json.Number("9007199254740993"), 9007199254740993, false},
+		{json.Number("0"), 0, true},
+		{json.Number("-1"), 0, true},
+		{json.Number("7.5"), 0, true},
+		{nil, 0, true},
+	}
+	for _, tt := range tests {
+		got, err := fields.ConvertToID(tt.value)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ConvertToID(%#v) = %d, %v; want %d, error %v", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// TestLargeIDRoundTrip serializes ids as JSON numbers and decodes them
+// back exactly on both sides of 2^53
+func TestLargeIDRoundTrip(t *testing.T) {
+	for _, id := range []uint{fields.MaxSafeInteger, fields.MaxSafeInteger + 1, fields.MaxSafeInteger + 2, math.MaxInt64} {
+		data, err := json.Marshal(map[string]interface{}{"id": id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := `{"id":` + strconv.FormatUint(uint64(id), 10) + `}`; string(data) != want {
+			t.Errorf("Marshal = %s, want %s", data, want)
+		}
+		var decoded map[string]interface{}
+		if err := fields.DecodeJSON(data, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := fields.ConvertToID(decoded["id"]); err != nil || got != id {
+			t.Errorf("id %d decoded as %v (%v)", id, got, err)
+		}
+	}
+}
+
+func TestRoundDecimal(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   interface{}
+		digits  int
+		want    float64
+		wantErr bool
+	}{
+		{"float artifact", artifact, 2, 0.3, false},
+		{"artifact kept without rounding", artifact, 17, 0.30000000000000004, false},
+		// 2.675 is 2.67499999... as a float64, rounded on its text
+		{"half up on the decimal text", 2.675, 2, 2.68, false},
+		{"half away from zero", -2.675, 2, -2.68, false},
+		{"half down", json.Number("2.665"), 2, 2.67, false},
+		{"below half", json.Number("2.6749"), 2, 2.67, false},
+		{"high precision", json.Number("1234567.123456789123456789"), 2, 1234567.12, false},
+		{"scientific notation", json.Number("1.2345e2"), 2, 123.45, false},
+		{"negative exponent", json.Number("5e-3"), 2, 0.01, false},
+		{"string", " 19.999 ", 2, 20, false},
+		{"no decimals", json.Number("2.5"), 0, 3, false},
+		{"integer", 7, 2, 7, false},
+		{"not a number", "NaN", 2, 0, true},
+		{"infinity", math.Inf(1), 2, 0, true},
+		{"garbage", "12,50", 2, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := fields.RoundDecimal(tt.value, tt.digits)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("RoundDecimal(%#v, %d) = %v, %v; want %v, error %v", tt.value, tt.digits, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConvertToFloat(t *testing.T) {
+	tests := []struct {
+		value   interface{}
+		want    float64
+		wantErr bool
+	}{
+		{json.Number("0.1"), 0.1, false},
+		{json.Number("1e3"), 1000, false},
+		{"+.5", 0.5, false},
+		{" 2.5 ", 2.5, false},
+		{"NaN", 0, true},
+		{"Inf", 0, true},
+		{"-Infinity", 0, true},
+		{"1_000", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := fields.ConvertToFloat(tt.value)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ConvertToFloat(%#v) = %v, %v; want %v, error %v", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestDecodeJSON(t *testing.T) {
+	var decoded map[string]interface{}
+	if err := fields.DecodeJSON([]byte(`{"id": 9007199254740993, "amount": 0.1, "lines": [{"qty": 1e3}]}`), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"id": json.Number("9007199254740993"), "amount": json.Number("0.1"),
+		"lines": []interface{}{map[string]interface{}{"qty": json.Number("1e3")}},
+	}
+	if !reflect.DeepEqual(decoded, want) {
+		t.Errorf("DecodeJSON = %#v, want %#v", decoded, want)
+	}
+
+	normalized := fields.NormalizeNumbers(decoded)
+	wantNormalized := map[string]interface{}{
+		"id": int64(9007199254740993), "amount": 0.1,
+		"lines": []interface{}{map[string]interface{}{"qty": 1000.0}},
+	}
+	if !reflect.DeepEqual(normalized, wantNormalized) {
+		t.Errorf("NormalizeNumbers = %#v, want %#v", normalized, wantNormalized)
+	}
+
+	for _, data := range []string{``, `{"id": 1} {"id": 2}`, `{"id": 1}x`, `{"id": }`} {
+		var v map[string]interface{}
+		if err := fields.DecodeJSON([]byte(data), &v); err == nil {
+			t.Errorf("DecodeJSON(%q) succeeded", data)
+		}
+	}
+}
+
+// TestNumberFields converts the values of requests to the types of their
+// fields: amounts are rounded to their digits before storage
+func TestNumberFields(t *testing.T) {
+	integer := fields.NewIntegerField(fields.FieldAttribute{})
+	float := fields.NewFloatField(fields.FieldAttribute{})
+	monetary := fields.NewMonetaryField(fields.FieldAttribute{})
+	tests := []struct {
+		name    string
+		field   fields.Field
+		value   interface{}
+		want    interface{}
+		wantErr bool
+	}{
+		{"integer from a number", integer, json.Number("42"), 42, false},
+		{"integer from a string", integer, "42", 42, false},
+		{"integer in scientific notation", integer, json.Number("4.2e1"), 42, false},
+		{"integer fraction", integer, json.Number("4.2"), nil, true},
+		{"float without digits", float, json.Number("0.30000000000000004"), 0.30000000000000004, false},
+		{"monetary float artifact", monetary, artifact, 0.3, false},
+		{"monetary high precision", monetary, json.Number("10.005"), 10.01, false},
+		{"monetary from a string", monetary, "19.99", 19.99, false},
+		{"monetary not a number", monetary, "abc", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.field.ConvertToCache(tt.value, nil)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ConvertToCache(%#v) = %v, want an error", tt.value, got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("ConvertToCache(%#v) = %#v, %v; want %#v", tt.value, got, err, tt.want)
+			}
+		})
+	}
+}
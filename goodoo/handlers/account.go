@@ -0,0 +1,564 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"goodoo/database"
+	goodooHttp "goodoo/http"
+	"goodoo/logging"
+	"goodoo/mail"
+	"goodoo/models"
+	"goodoo/notification"
+	"goodoo/operations"
+	"goodoo/refdata"
+	"gorm.io/gorm"
+)
+
+var accountLogger = logging.GetLogger("goodoo.handlers.account")
+
+// AccountHandler serves the account page of the current user: their
+// profile, the change of their email and the download of their data
+type AccountHandler struct {
+	Config *goodooHttp.RequestConfig
+}
+
+// NewAccountHandler creates a new account handler
+func NewAccountHandler(config *goodooHttp.RequestConfig) *AccountHandler {
+	return &AccountHandler{Config: config}
+}
+
+// profileReadOnly tells where the profile fields users may not write
+// themselves are changed, if anywhere
+var profileReadOnly = map[string]string{
+	"email":  "change it with POST /api/users/me/email",
+	"avatar": "upload it to POST /api/users/me/avatar",
+}
+
+// profileEditable are the profile fields users write themselves
+var profileEditable = []string{"name", "lang", "tz"}
+
+// currentUser loads the user of the request
+func currentUser(req *goodooHttp.Request) (*models.User, error) {
+	var user models.User
+	if err := req.GetDB().First(&user, req.GetUserID()).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// profile returns the API form of the profile of a user
+func profile(req *goodooHttp.Request, user *models.User) (map[string]interface{}, error) {
+	pending, err := models.PendingEmailChange(req.GetDB(), user.ID, req.Now())
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]interface{}{
+		"id":                   user.ID,
+		"login":                user.Login,
+		"name":                 user.Name,
+		"email":                user.Email,
+		"lang":                 user.Lang,
+		"tz":                   user.Tz,
+		"avatar_url":           avatarURL(user, 128),
+		"avatar_checksum":      user.AvatarChecksum,
+		"login_date":           user.LastLogin,
+		"editable":             profileEditable,
+		"pending_email_change": nil,
+	}
+	if pending != nil {
+		result["pending_email_change"] = map[string]interface{}{"new_email": pending.NewEmail, "expires_at": pending.ExpiresAt}
+	}
+	return result, nil
+}
+
+// GetProfile returns the profile of the current user
+func (h *AccountHandler) GetProfile(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	user, err := currentUser(req)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "User not found")
+	}
+	result, err := profile(req, user)
+	if err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to read the profile of user %d: %v", user.ID, err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to read the profile")
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+// UpdateProfile writes the profile fields of the current user,
+// {"name": "Jane", "lang": "fr_FR", "tz": "Europe/Brussels"}. Any other
+// field, such as active or groups, is refused: users cannot grant
+// themselves access. The language and timezone apply to the session too.
+// It answers with the profile as GetProfile would, or with the changed
+// fields under Prefer: return=minimal.
+func (h *AccountHandler) UpdateProfile(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	var body map[string]interface{}
+	if err := c.Bind(&body); err != nil || len(body) == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Profile fields are required"})
+	}
+
+	values := make(map[string]interface{}, len(body))
+	for field, value := range body {
+		editable := false
+		for _, name := range profileEditable {
+			editable = editable || name == field
+		}
+		if !editable {
+			message := fmt.Sprintf("Field %s cannot be changed here", field)
+			if where, ok := profileReadOnly[field]; ok {
+				message += ": " + where
+			}
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": message, "field": field})
+		}
+		text, ok := value.(string)
+		if !ok {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("Field %s must be a string", field), "field": field})
+		}
+		text = strings.TrimSpace(text)
+		switch field {
+		case "name":
+			if text == "" {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "The name cannot be empty", "field": field})
+			}
+		case "lang":
+			if !h.installedLang(req, text) {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Unsupported language: " + text, "field": field})
+			}
+		case "tz":
+			if text != "" && !refdata.IsTimezone(text) {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid timezone: " + text, "field": field})
+			}
+		}
+		values[field] = text
+	}
+
+	user, err := currentUser(req)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "User not found")
+	}
+	changed := make([]string, 0, len(values))
+	for field, value := range values {
+		current := map[string]string{"name": user.Name, "lang": user.Lang, "tz": user.Tz}[field]
+		if current == value {
+			delete(values, field)
+			continue
+		}
+		changed = append(changed, field)
+	}
+	sort.Strings(changed)
+
+	if len(changed) > 0 {
+		err := req.GetDB().Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(user).Updates(values).Error; err != nil {
+				return err
+			}
+			// Read back so the profile answered holds what was stored
+			if err := tx.First(user, user.ID).Error; err != nil {
+				return err
+			}
+			return models.LogActivity(tx, user.ID, models.Activity{
+				Type:   models.ActivityProfileUpdated,
+				Model:  "res.users",
+				ResID:  user.ID,
+				Params: map[string]interface{}{"login": user.Login, "fields": strings.Join(changed, ", ")},
+			})
+		})
+		if err != nil {
+			req.Logger.ErrorCtx(req.Context, "Failed to update the profile of user %d: %v", user.ID, err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to update the profile")
+		}
+		context := map[string]interface{}{}
+		if lang, ok := values["lang"]; ok {
+			context["lang"] = lang
+		}
+		if tz, ok := values["tz"]; ok && tz != "" {
+			context["tz"], context["timezone"] = tz, tz
+		}
+		if len(context) > 0 {
+			req.Session.UpdateContext(context)
+		}
+		req.Logger.InfoCtx(req.Context, "User %s updated their profile: %s", user.Login, strings.Join(changed, ", "))
+	}
+
+	if goodooHttp.PreferMinimal(c) {
+		return c.JSON(http.StatusOK, map[string]interface{}{"success": true, "changed": changed})
+	}
+	result, err := profile(req, user)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to read the profile")
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+// installedLang reports whether lang is installed in the database of the
+// request
+func (h *AccountHandler) installedLang(req *goodooHttp.Request, lang string) bool {
+	installed := []string{models.DefaultLang}
+	if h.Config.LangResolver != nil {
+		installed = h.Config.LangResolver(req.GetDBName())
+	}
+	for _, candidate := range installed {
+		if candidate == lang {
+			return true
+		}
+	}
+	return false
+}
+
+// RequestEmailChange starts the change of the email of the current user,
+// {"email": "new@example.com", "password": "..."}: the password is checked,
+// and a confirmation link is mailed to the new address. The email changes
+// once the link is followed; a new request cancels the pending one.
+func (h *AccountHandler) RequestEmailChange(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	var body struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	if err := c.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request format")
+	}
+	body.Email = strings.TrimSpace(body.Email)
+	if body.Email == "" || !strings.Contains(body.Email, "@") || strings.ContainsAny(body.Email, " \t\r\n<>") {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "A valid email is required"})
+	}
+
+	user, err := currentUser(req)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "User not found")
+	}
+	if !user.CheckPassword(body.Password) {
+		req.Logger.WarningCtx(req.Context, "Email change of %s refused: wrong password", user.Login)
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "Wrong password"})
+	}
+	if strings.EqualFold(body.Email, user.Email) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "This is already your email"})
+	}
+
+	base, err := linkBase(req)
+	if err != nil {
+		return err
+	}
+	db := req.GetDB()
+	now := req.Now()
+	hours := models.GetParamInt(req.GetDBName(), models.ParamEmailChangeHours, models.DefaultEmailChangeHours)
+	change, token, err := models.RequestEmailChange(db, user, body.Email, now, now.Add(time.Duration(hours)*time.Hour))
+	if errors.Is(err, models.ErrEmailTaken) {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "This email is used by another account"})
+	}
+	if err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to record the email change of %s: %v", user.Login, err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to change the email")
+	}
+
+	link := fmt.Sprintf("%s/account/email/%s", base, url.PathEscape(token))
+	data := map[string]interface{}{
+		"User":     user,
+		"NewEmail": change.NewEmail,
+		"Link":     link,
+		"Hours":    hours,
+	}
+	if err := mail.QueueTemplate(db, c.Echo().Renderer, "mail_email_change", user.Lang, []string{change.NewEmail}, data); err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to mail the email change confirmation of %s: %v", user.Login, err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to send the confirmation email")
+	}
+	requested := models.Activity{
+		Type:   models.ActivityEmailChangeRequested,
+		Model:  "res.users",
+		ResID:  user.ID,
+		Params: map[string]interface{}{"login": user.Login, "new_email": change.NewEmail, "change_id": change.ID},
+	}
+	if err := models.LogActivity(db, user.ID, requested); err != nil {
+		req.Logger.WarningCtx(req.Context, "Failed to record the email change of %s: %v", user.Login, err)
+	}
+
+	req.Logger.InfoCtx(req.Context, "User %s asked to change their email (change %d)", user.Login, change.ID)
+	response := map[string]interface{}{
+		"success":    true,
+		"new_email":  change.NewEmail,
+		"expires_at": change.ExpiresAt,
+	}
+	// The link is only returned while mail is logged instead of sent
+	if mail.LogOnly() {
+		response["link"] = link
+	}
+	return c.JSON(http.StatusAccepted, response)
+}
+
+// CancelEmailChange abandons the pending email change of the current
+// user; its link stops working
+func (h *AccountHandler) CancelEmailChange(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	uid := uint(req.GetUserID())
+	cancelled, err := models.CancelEmailChanges(db, uid, req.Now())
+	if err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to cancel the email change of user %d: %v", uid, err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to cancel the email change")
+	}
+	if cancelled == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "No pending email change"})
+	}
+	activity := models.Activity{Type: models.ActivityEmailChangeCancelled, Model: "res.users", ResID: uid, Params: map[string]interface{}{"login": req.GetLogin()}}
+	if err := models.LogActivity(db, uid, activity); err != nil {
+		req.Logger.WarningCtx(req.Context, "Failed to record the cancelled email change of %s: %v", req.GetLogin(), err)
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"success": true})
+}
+
+// emailChangeMessages are the messages of the confirmation page for the
+// changes that can no longer be confirmed
+var emailChangeMessages = map[error]string{
+	models.ErrEmailChangeNotFound:  "This link does not exist. Check that it was copied entirely.",
+	models.ErrEmailChangeExpired:   "This link has expired. Ask for the change again from your account.",
+	models.ErrEmailChangeCancelled: "This change was cancelled or replaced by a newer one.",
+	models.ErrEmailChangeConfirmed: "This change was confirmed already.",
+	models.ErrEmailChangeInvalid:   "This change is no longer valid for this account. Ask for it again from your account.",
+	models.ErrEmailTaken:           "This email is now used by another account.",
+}
+
+// emailChangeError renders the error page of a change that cannot be
+// confirmed
+func emailChangeError(c echo.Context, err error) error {
+	for known, message := range emailChangeMessages {
+		if errors.Is(err, known) {
+			status := http.StatusGone
+			switch known {
+			case models.ErrEmailChangeNotFound:
+				status = http.StatusNotFound
+			case models.ErrEmailTaken:
+				status = http.StatusConflict
+			}
+			return shareError(c, status, "Email change not available", message)
+		}
+	}
+	return shareError(c, http.StatusInternalServerError, "Unavailable", "This change cannot be confirmed right now. Try again later.")
+}
+
+// pendingEmailChange returns the pending change of the route token and
+// its user
+func pendingEmailChange(c echo.Context, req *goodooHttp.Request) (*models.EmailChange, *models.User, error) {
+	db := req.GetDB()
+	if db == nil {
+		return nil, nil, errors.New("database not available")
+	}
+	change, err := models.FindEmailChange(db, c.Param("token"))
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := change.Usable(req.Now()); err != nil {
+		return nil, nil, err
+	}
+	var user models.User
+	if err := db.First(&user, change.UserID).Error; err != nil || !user.Active || !strings.EqualFold(user.Email, change.OldEmail) {
+		return nil, nil, models.ErrEmailChangeInvalid
+	}
+	return change, &user, nil
+}
+
+// EmailChangePage asks to confirm the email change of the link; following
+// the link alone, e.g. by a mail scanner, changes nothing
+func (h *AccountHandler) EmailChangePage(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	change, user, err := pendingEmailChange(c, req)
+	if err != nil {
+		return emailChangeError(c, err)
+	}
+	return sharePage(c, http.StatusOK, "email_change.html",
+		map[string]interface{}{"login": user.Login, "new_email": change.NewEmail},
+		map[string]interface{}{"Login": user.Login, "NewEmail": change.NewEmail})
+}
+
+// ConfirmEmailChange sets the new email of the link on the account, and
+// tells the old address
+func (h *AccountHandler) ConfirmEmailChange(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	change, _, err := pendingEmailChange(c, req)
+	if err != nil {
+		return emailChangeError(c, err)
+	}
+	db := req.GetDB()
+	user, err := change.Confirm(db, req.Now())
+	if err != nil {
+		if _, known := emailChangeMessages[err]; !known {
+			req.Logger.ErrorCtx(req.Context, "Failed to confirm email change %d: %v", change.ID, err)
+		}
+		return emailChangeError(c, err)
+	}
+
+	changed := models.Activity{
+		Type:     models.ActivityEmailChanged,
+		Severity: models.SeveritySuccess,
+		Model:    "res.users",
+		ResID:    user.ID,
+		Params:   map[string]interface{}{"login": user.Login, "old_email": change.OldEmail, "new_email": change.NewEmail, "change_id": change.ID},
+	}
+	if err := models.LogActivity(db, user.ID, changed); err != nil {
+		req.Logger.WarningCtx(req.Context, "Failed to record the email change of %s: %v", user.Login, err)
+	}
+	data := map[string]interface{}{"User": user, "OldEmail": change.OldEmail, "NewEmail": change.NewEmail}
+	if err := mail.QueueTemplate(db, c.Echo().Renderer, "mail_email_changed", user.Lang, []string{change.OldEmail}, data); err != nil {
+		req.Logger.WarningCtx(req.Context, "Failed to tell the old address of %s about the email change: %v", user.Login, err)
+	}
+	_, err = notification.Notify(req.GetDBName(), user.ID, models.NotificationCategoryAccount, models.NotificationInfo, "Your email was changed",
+		fmt.Sprintf("Your email is now %s. If you did not change it, contact your administrator.", change.NewEmail), nil)
+	if err != nil {
+		req.Logger.WarningCtx(req.Context, "Failed to notify %s of the email change: %v", user.Login, err)
+	}
+
+	req.Logger.InfoCtx(req.Context, "User %s confirmed the change of their email (change %d)", user.Login, change.ID)
+	return sharePage(c, http.StatusOK, "email_change.html",
+		map[string]interface{}{"success": true, "login": user.Login, "email": user.Email},
+		map[string]interface{}{"Confirmed": true, "Login": user.Login, "NewEmail": user.Email})
+}
+
+// dataExportURL returns the download link of an export
+func dataExportURL(token string) string {
+	return "/api/users/me/export/" + url.PathEscape(token)
+}
+
+// StartExport generates the personal data bundle of the current user in
+// the background. The response holds the operation to poll and the
+// download link, which works once the export is done, for the user only,
+// for models.DataExportTTL.
+func (h *AccountHandler) StartExport(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	dbName := req.GetDBName()
+	mainDB, err := database.GetDatabase(dbName)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database not available"})
+	}
+	uid := uint(req.GetUserID())
+	running, err := models.RunningDataExport(mainDB, uid)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to check the running exports")
+	}
+	// An export whose operation is gone was interrupted by a restart
+	if running != nil {
+		if _, ok := operations.Get(running.OperationID); ok {
+			return c.JSON(http.StatusConflict, map[string]interface{}{"error": "An export is running already", "operation_id": running.OperationID})
+		}
+		if err := running.Finish(mainDB, nil, errors.New("interrupted"), req.Now()); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to close the interrupted export")
+		}
+	}
+
+	export, token, err := models.StartDataExport(mainDB, uid)
+	if err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to record the data export of %s: %v", req.GetLogin(), err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to start the export"})
+	}
+	login := req.GetLogin()
+	link := dataExportURL(token)
+
+	// The request context ends with the response: the data is collected detached
+	op := operations.Start("personal_data_export", "res.users", dbName, req.GetUserID(), models.PersonalDataSections, func(ctx context.Context, op *operations.Operation) error {
+		data, err := models.BuildPersonalData(ctx, mainDB, uid, time.Now(), func() { op.Progress(1, 0, nil) })
+		return finishDataExport(mainDB, dbName, export, login, link, data, err)
+	})
+	export.OperationID = op.Status().ID
+	if err := mainDB.Model(export).Update("operation_id", export.OperationID).Error; err != nil {
+		req.Logger.WarningCtx(req.Context, "Failed to record the operation of data export %d: %v", export.ID, err)
+	}
+
+	req.Logger.InfoCtx(req.Context, "Data export %d started by %s", export.ID, login)
+	return c.JSON(http.StatusAccepted, map[string]interface{}{
+		"export":       export,
+		"operation_id": export.OperationID,
+		"download_url": link,
+	})
+}
+
+// finishDataExport stores the outcome of an export, records it in the
+// activity feed and notifies the user with the download link
+func finishDataExport(db *gorm.DB, dbName string, export *models.UserDataExport, login, link string, data *models.PersonalData, exportErr error) error {
+	if err := export.Finish(db, data, exportErr, time.Now()); err != nil {
+		return err
+	}
+	activity := models.Activity{Type: models.ActivityDataExported, Severity: models.SeveritySuccess, Model: "res.users", ResID: export.UserID,
+		Params: map[string]interface{}{"login": login, "export_id": export.ID}}
+	title, body, level := "Your data is ready", "Download it within 24 hours from the link of this notification.", models.NotificationSuccess
+	payload := map[string]interface{}{"export_id": export.ID, "download_url": link}
+	if exportErr != nil {
+		activity.Severity = models.SeverityError
+		activity.Params["error"] = exportErr.Error()
+		title, body, level = "Your data could not be exported", "Try again later.", models.NotificationError
+		payload = map[string]interface{}{"export_id": export.ID}
+	}
+	if err := models.LogActivity(db, export.UserID, activity); err != nil {
+		accountLogger.Warning("Failed to record data export %d: %v", export.ID, err)
+	}
+	if _, err := notification.Notify(dbName, export.UserID, models.NotificationCategoryAccount, level, title, body, payload); err != nil {
+		accountLogger.Warning("Failed to notify data export %d: %v", export.ID, err)
+	}
+	return exportErr
+}
+
+// ListExports returns the personal data exports of the current user,
+// newest first
+func (h *AccountHandler) ListExports(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	exports, err := models.ListDataExports(req.GetDB(), uint(req.GetUserID()))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to list the exports")
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"exports": exports})
+}
+
+// DownloadExport sends the personal data bundle of a download link to its
+// owner, until the link expires
+func (h *AccountHandler) DownloadExport(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	uid := uint(req.GetUserID())
+	export, err := models.DownloadDataExport(db, uid, c.Param("token"), req.Now())
+	if errors.Is(err, models.ErrDataExportNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Export not found or expired"})
+	}
+	if err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to read the data export of %s: %v", req.GetLogin(), err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to read the export")
+	}
+	downloaded := models.Activity{Type: models.ActivityDataDownloaded, Model: "res.users", ResID: uid,
+		Params: map[string]interface{}{"login": req.GetLogin(), "export_id": export.ID}}
+	if err := models.LogActivity(db, uid, downloaded); err != nil {
+		req.Logger.WarningCtx(req.Context, "Failed to record the download of data export %d: %v", export.ID, err)
+	}
+
+	header := c.Response().Header()
+	header.Set("Cache-Control", "no-store")
+	header.Set(echo.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="personal_data_%s.json"`, export.CreateDate.Format("20060102")))
+	return c.Blob(http.StatusOK, echo.MIMEApplicationJSONCharsetUTF8, []byte(export.Data))
+}
+
+// RegisterAccountRoutes mounts the account API of the current user under
+// /api/users/me, and the public confirmation page of email changes at
+// /account/email/:token. Changing the email and exporting the data are
+// refused to impersonating administrators.
+func RegisterAccountRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewAccountHandler(config)
+
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		{Method: "GET", Path: "/api/users/me", Handler: handler.GetProfile, Auth: true, DB: true},
+		{Method: "PUT", Path: "/api/users/me", Handler: handler.UpdateProfile, Auth: true, DB: true, RateLimit: "expensive"},
+		{Method: "POST", Path: "/api/users/me/email", Handler: handler.RequestEmailChange, Auth: true, DB: true, RateLimit: "auth", DenyImpersonation: true},
+		{Method: "DELETE", Path: "/api/users/me/email", Handler: handler.CancelEmailChange, Auth: true, DB: true, DenyImpersonation: true},
+		{Method: "POST", Path: "/api/users/me/export", Handler: handler.StartExport, Auth: true, DB: true, RateLimit: "expensive", DenyImpersonation: true},
+		{Method: "GET", Path: "/api/users/me/export", Handler: handler.ListExports, Auth: true, DB: true},
+		{Method: "GET", Path: "/api/users/me/export/:token", Handler: handler.DownloadExport, Auth: true, DB: true, RateLimit: "expensive", DenyImpersonation: true},
+
+		// Public: the owner of the new address holds a token, maybe not a session
+		{Method: "GET", Path: "/account/email/:token", Handler: handler.EmailChangePage, Public: true},
+		{Method: "POST", Path: "/account/email/:token", Handler: handler.ConfirmEmailChange, Public: true, RateLimit: "auth", CSRFExempt: true},
+	})
+}
@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"goodoo/advisor"
+	"goodoo/database"
+	goodooHttp "goodoo/http"
+	"goodoo/models"
+	"goodoo/operations"
+	"gorm.io/gorm"
+)
+
+// AdvisorHandler runs the index advisor on the database of the session and
+// lets administrators dismiss or apply its advice
+type AdvisorHandler struct {
+	Config *goodooHttp.RequestConfig
+}
+
+// NewAdvisorHandler creates a new advisor handler
+func NewAdvisorHandler(config *goodooHttp.RequestConfig) *AdvisorHandler {
+	return &AdvisorHandler{Config: config}
+}
+
+// Run analyzes the slow queries and indexes of the session's database,
+// stores the advice and answers with the open advice and what it is based
+// on. Nothing is applied.
+func (h *AdvisorHandler) Run(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	dbName := req.GetDBName()
+
+	report, err := advisor.Analyze(dbName, advisor.DefaultOptions(), req.Now())
+	if err != nil {
+		if database.IsPermissionError(err) {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "Index statistics are not readable by the database role"})
+		}
+		req.Logger.ErrorCtx(req.Context, "Index advisor failed on %s: %v", dbName, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to analyze the indexes"})
+	}
+	db := req.GetDB()
+	if err := models.SaveIndexAdvice(db, report.Advice); err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to store index advice: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to store the advice"})
+	}
+	advice, err := models.ListIndexAdvice(db, models.AdviceOpen)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to list the advice"})
+	}
+
+	req.Logger.InfoCtx(req.Context, "User %d ran the index advisor on %s: %d advice from %d explained statement(s)",
+		req.GetUserID(), dbName, len(report.Advice), report.Explained)
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"advice":       advice,
+		"slow_queries": report.SlowQueries,
+		"explained":    report.Explained,
+		"skipped":      report.Skipped,
+		"errors":       report.Errors,
+		"stats_since":  report.StatsSince,
+	})
+}
+
+// List returns the stored advice in a state (?state=open, dismissed,
+// applied or all; open by default), the most time saved first
+func (h *AdvisorHandler) List(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	state := c.QueryParam("state")
+	switch state {
+	case "":
+		state = models.AdviceOpen
+	case "all":
+		state = ""
+	case models.AdviceOpen, models.AdviceDismissed, models.AdviceApplied:
+	default:
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "State must be open, dismissed, applied or all"})
+	}
+
+	advice, err := models.ListIndexAdvice(req.GetDB(), state)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to list the advice"})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"advice": advice,
+		"total":  len(advice),
+	})
+}
+
+// openAdvice loads the open advice of the :id parameter
+func (h *AdvisorHandler) openAdvice(c echo.Context, db *gorm.DB) (*models.IndexAdvice, error) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid advice id")
+	}
+	var advice models.IndexAdvice
+	if err := db.First(&advice, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, echo.NewHTTPError(http.StatusNotFound, "Advice not found")
+		}
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Failed to read the advice")
+	}
+	if advice.State != models.AdviceOpen {
+		return nil, echo.NewHTTPError(http.StatusConflict, "Advice is "+advice.State+" already")
+	}
+	return &advice, nil
+}
+
+// Dismiss closes advice without applying it; later runs keep it dismissed
+func (h *AdvisorHandler) Dismiss(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	advice, err := h.openAdvice(c, db)
+	if err != nil {
+		return err
+	}
+	if err := models.ResolveIndexAdvice(db, advice, models.AdviceDismissed, uint(req.GetUserID()), req.Now()); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to dismiss the advice"})
+	}
+	req.Logger.InfoCtx(req.Context, "User %d dismissed index advice %s", req.GetUserID(), advice.Key)
+	return c.JSON(http.StatusOK, advice)
+}
+
+// Apply creates the index of add_index advice concurrently, as an
+// operation, and answers with its id. The advice is marked applied once
+// the index is built; the outcome is written to the activity feed.
+// Unused indexes are dropped by hand.
+func (h *AdvisorHandler) Apply(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	advice, err := h.openAdvice(c, db)
+	if err != nil {
+		return err
+	}
+	if advice.Kind != models.AdviceAddIndex {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Only index additions can be applied; drop unused indexes by hand"})
+	}
+
+	dbName := req.GetDBName()
+	uid := req.GetUserID()
+	clock := req.Now
+	op := operations.Start("index_advice", "", dbName, uid, 1, func(ctx context.Context, op *operations.Operation) error {
+		conn, err := database.GetDatabase(dbName)
+		if err != nil {
+			return err
+		}
+		conn = conn.WithContext(ctx)
+		start := time.Now()
+		change, err := models.CreateIndexConcurrently(conn, advice.Table, advice.IndexName, strings.Split(advice.Columns, ","))
+		activity := models.Activity{
+			Type:     models.ActivityIndexCreated,
+			Severity: models.SeveritySuccess,
+			Model:    "database",
+			Params: map[string]interface{}{
+				"operation_id": op.Status().ID,
+				"index":        advice.IndexName,
+				"table":        advice.Table,
+				"sql":          change.SQL,
+				"duration_ms":  time.Since(start).Milliseconds(),
+			},
+		}
+		if err != nil {
+			op.Progress(0, 1, err)
+			activity.Severity = models.SeverityError
+			activity.Params["error"] = err.Error()
+		} else {
+			op.Progress(1, 0, nil)
+			err = models.ResolveIndexAdvice(conn, advice, models.AdviceApplied, uint(uid), clock())
+		}
+		if logErr := models.LogActivity(conn, uint(uid), activity); err == nil {
+			err = logErr
+		}
+		return err
+	})
+
+	req.Logger.InfoCtx(req.Context, "User %d started creating index %s on %s of %s (%s)",
+		uid, advice.IndexName, advice.Table, dbName, op.Status().ID)
+	return c.JSON(http.StatusAccepted, map[string]interface{}{
+		"operation_id": op.Status().ID,
+		"advice_id":    advice.ID,
+		"sql":          advice.SQL,
+	})
+}
+
+// RegisterAdvisorRoutes mounts the index advisor under
+// /api/database/advisor, reserved to the holders of db.manage
+func RegisterAdvisorRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewAdvisorHandler(config)
+
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		{Method: "GET", Path: "/api/database/advisor", Handler: handler.List, Auth: true, DB: true, Permission: goodooHttp.PermissionDBManage},
+		{Method: "POST", Path: "/api/database/advisor", Handler: handler.Run, Auth: true, DB: true, Permission: goodooHttp.PermissionDBManage},
+		{Method: "POST", Path: "/api/database/advisor/:id/dismiss", Handler: handler.Dismiss, Auth: true, DB: true, Permission: goodooHttp.PermissionDBManage},
+		{Method: "POST", Path: "/api/database/advisor/:id/apply", Handler: handler.Apply, Auth: true, DB: true, Permission: goodooHttp.PermissionDBManage},
+	})
+}
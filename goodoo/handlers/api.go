@@ -25,9 +25,32 @@ func NewAPIHandler(registry *api.APIRegistry) *APIHandler {
 	}
 }
 
+// registryFor returns the API registry of the request's database
+func (h *APIHandler) registryFor(req *goodooHttp.Request) *api.APIRegistry {
+	return h.registry.ForDatabase(req.GetDBName())
+}
+
+// apiResponseStatus returns the HTTP status of an API call response
+func apiResponseStatus(response *api.APIResponse) int {
+	if response.Success {
+		return http.StatusOK
+	}
+	if strings.HasPrefix(response.Error, "internal error") {
+		return http.StatusInternalServerError
+	}
+	if strings.Contains(response.Error, "not found") {
+		return http.StatusNotFound
+	}
+	if strings.Contains(response.Error, "Access denied") ||
+		strings.Contains(response.Error, "not accessible") {
+		return http.StatusForbidden
+	}
+	return http.StatusBadRequest
+}
+
 // CallMethod handles API method calls via HTTP
 func (h *APIHandler) CallMethod(c echo.Context) error {
-	req := goodooHttp.GetGoodooRequest(c)
+	req := goodooHttp.MustGetGoodooRequest(c)
 	ctx := req.Context
 
 	// Parse request
@@ -40,31 +63,78 @@ func (h *APIHandler) CallMethod(c echo.Context) error {
 		})
 	}
 
+	if !req.ModelAllowed(call.ModelName) {
+		return c.JSON(http.StatusForbidden, api.APIResponse{
+			Success: false,
+			Error:   "Model not allowed for this service account",
+		})
+	}
+
 	// Log the API call
 	h.logger.InfoCtx(ctx, "API call: %s.%s", call.ModelName, call.Method)
 
 	// Execute the call
-	response := h.registry.ExecuteCall(ctx, &call, req)
-
-	// Return appropriate HTTP status
-	status := http.StatusOK
-	if !response.Success {
-		status = http.StatusBadRequest
-		if strings.Contains(response.Error, "Access denied") ||
-			strings.Contains(response.Error, "not accessible") {
-			status = http.StatusForbidden
-		}
-		if strings.Contains(response.Error, "not found") {
-			status = http.StatusNotFound
-		}
+	response := h.registryFor(req).ExecuteCall(ctx, &call, req)
+
+	return c.JSON(apiResponseStatus(response), response)
+}
+
+// ListModels lists the models of the request's database with their
+// description and flags
+func (h *APIHandler) ListModels(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"models": h.registryFor(req).ListModels(req.GetEnv().Registry()),
+	})
+}
+
+// DescribeModel describes a model: the fields the user may read and the
+// operations callable on it, both the ORM ones and the registered methods,
+// each with its arguments and whether the user may perform it
+func (h *APIHandler) DescribeModel(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	modelName := c.Param("model")
+
+	env := req.GetEnv()
+	description, exists := h.registryFor(req).DescribeModel(env, env.Registry(), modelName)
+	if !exists {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Model not found",
+		})
 	}
+	return c.JSON(http.StatusOK, description)
+}
 
-	return c.JSON(status, response)
+// ModelHelp renders the documentation of a model for developers: its
+// description and the fields the user may read, with their type, label,
+// help and selection options, in the user's language. It answers
+// Markdown, or the structured documentation with ?format=json.
+func (h *APIHandler) ModelHelp(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	env := req.GetEnv()
+	model, exists := env.Registry().GetModel(c.Param("model"))
+	if !exists {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Model not found",
+		})
+	}
+
+	help, err := model.Help(env)
+	if err != nil {
+		h.logger.ErrorCtx(req.Context, "Failed to document model %s: %v", model.Name, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to document the model",
+		})
+	}
+	if c.QueryParam("format") == "json" {
+		return c.JSON(http.StatusOK, help)
+	}
+	return c.Blob(http.StatusOK, "text/markdown; charset=utf-8", []byte(help.Markdown()))
 }
 
 // GetModelMethods returns available methods for a model
 func (h *APIHandler) GetModelMethods(c echo.Context) error {
-	req := goodooHttp.GetGoodooRequest(c)
+	req := goodooHttp.MustGetGoodooRequest(c)
 	ctx := req.Context
 
 	modelName := c.Param("model")
@@ -77,7 +147,7 @@ func (h *APIHandler) GetModelMethods(c echo.Context) error {
 	h.logger.InfoCtx(ctx, "Getting methods for model: %s", modelName)
 
 	// Get public methods only for security
-	methods := h.registry.GetPublicMethods(modelName)
+	methods := h.registryFor(req).GetPublicMethods(modelName)
 	if methods == nil {
 		return c.JSON(http.StatusNotFound, map[string]string{
 			"error": "Model not found",
@@ -106,7 +176,7 @@ func (h *APIHandler) GetModelMethods(c echo.Context) error {
 
 // GetMethodInfo returns detailed information about a specific method
 func (h *APIHandler) GetMethodInfo(c echo.Context) error {
-	req := goodooHttp.GetGoodooRequest(c)
+	req := goodooHttp.MustGetGoodooRequest(c)
 	ctx := req.Context
 
 	modelName := c.Param("model")
@@ -120,7 +190,7 @@ func (h *APIHandler) GetMethodInfo(c echo.Context) error {
 
 	h.logger.InfoCtx(ctx, "Getting info for method: %s.%s", modelName, methodName)
 
-	info := h.registry.GetMethodInfo(modelName, methodName)
+	info := h.registryFor(req).GetMethodInfo(modelName, methodName)
 	if info == nil {
 		return c.JSON(http.StatusNotFound, map[string]string{
 			"error": "Method not found",
@@ -132,7 +202,7 @@ func (h *APIHandler) GetMethodInfo(c echo.Context) error {
 
 // CallModelMethod handles calls to model-level methods via URL
 func (h *APIHandler) CallModelMethod(c echo.Context) error {
-	req := goodooHttp.GetGoodooRequest(c)
+	req := goodooHttp.MustGetGoodooRequest(c)
 	ctx := req.Context
 
 	modelName := c.Param("model")
@@ -199,27 +269,14 @@ func (h *APIHandler) CallModelMethod(c echo.Context) error {
 	h.logger.InfoCtx(ctx, "URL API call: %s.%s", modelName, methodName)
 
 	// Execute the call
-	response := h.registry.ExecuteCall(ctx, call, req)
-
-	// Return appropriate HTTP status
-	status := http.StatusOK
-	if !response.Success {
-		status = http.StatusBadRequest
-		if strings.Contains(response.Error, "Access denied") ||
-			strings.Contains(response.Error, "not accessible") {
-			status = http.StatusForbidden
-		}
-		if strings.Contains(response.Error, "not found") {
-			status = http.StatusNotFound
-		}
-	}
+	response := h.registryFor(req).ExecuteCall(ctx, call, req)
 
-	return c.JSON(status, response)
+	return c.JSON(apiResponseStatus(response), response)
 }
 
 // CallRecordMethod handles calls to record-level methods via URL
 func (h *APIHandler) CallRecordMethod(c echo.Context) error {
-	req := goodooHttp.GetGoodooRequest(c)
+	req := goodooHttp.MustGetGoodooRequest(c)
 	ctx := req.Context
 
 	modelName := c.Param("model")
@@ -298,39 +355,31 @@ func (h *APIHandler) CallRecordMethod(c echo.Context) error {
 	h.logger.InfoCtx(ctx, "Record API call: %s.%s on IDs %v", modelName, methodName, ids)
 
 	// Execute the call
-	response := h.registry.ExecuteCall(ctx, call, req)
-
-	// Return appropriate HTTP status
-	status := http.StatusOK
-	if !response.Success {
-		status = http.StatusBadRequest
-		if strings.Contains(response.Error, "Access denied") ||
-			strings.Contains(response.Error, "not accessible") {
-			status = http.StatusForbidden
-		}
-		if strings.Contains(response.Error, "not found") {
-			status = http.StatusNotFound
-		}
-	}
+	response := h.registryFor(req).ExecuteCall(ctx, call, req)
 
-	return c.JSON(status, response)
+	return c.JSON(apiResponseStatus(response), response)
 }
 
-// RegisterRoutes registers API routes with Echo
+// RegisterRoutes registers API routes with Echo. Methods check their own
+// permissions, so the routes do not require a session.
 func (h *APIHandler) RegisterRoutes(e *echo.Echo) {
-	// API group
-	api := e.Group("/api")
-
-	// Generic API call endpoint
-	api.POST("/call", h.CallMethod)
-
-	// Model methods
-	api.GET("/models/:model/methods", h.GetModelMethods)
-	api.GET("/models/:model/methods/:method", h.GetMethodInfo)
-	api.Any("/models/:model/:method", h.CallModelMethod)
-
-	// Record methods  
-	api.Any("/models/:model/:ids/:method", h.CallRecordMethod)
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		// Generic API call endpoint
+		{Method: "POST", Path: "/api/call", Handler: h.CallMethod, ServiceAuth: true},
+
+		// Model introspection
+		{Method: "GET", Path: "/api/models", Handler: h.ListModels, Auth: true, ServiceAuth: true, DB: true},
+		{Method: "GET", Path: "/api/models/:model", Handler: h.DescribeModel, Auth: true, ServiceAuth: true, DB: true},
+		{Method: "GET", Path: "/api/models/:model/help", Handler: h.ModelHelp, Auth: true, DB: true},
+
+		// Model methods
+		{Method: "GET", Path: "/api/models/:model/methods", Handler: h.GetModelMethods},
+		{Method: "GET", Path: "/api/models/:model/methods/:method", Handler: h.GetMethodInfo},
+		{Method: goodooHttp.MethodAny, Path: "/api/models/:model/:method", Handler: h.CallModelMethod, ServiceAuth: true},
+
+		// Record methods
+		{Method: goodooHttp.MethodAny, Path: "/api/models/:model/:ids/:method", Handler: h.CallRecordMethod, ServiceAuth: true},
+	})
 
 	h.logger.Info("Registered API routes")
 }
@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	goodooHttp "goodoo/http"
+	"goodoo/models"
+	"goodoo/scan"
+)
+
+// AttachmentHandler exposes the metadata and content of attachments to
+// their uploader, and the files the malware scan held back to the
+// administrators
+type AttachmentHandler struct {
+	Config *goodooHttp.RequestConfig
+}
+
+// NewAttachmentHandler creates a new attachment handler
+func NewAttachmentHandler(config *goodooHttp.RequestConfig) *AttachmentHandler {
+	return &AttachmentHandler{Config: config}
+}
+
+// loadAttachment fetches the attachment named by the :id route parameter,
+// without its content, if the user uploaded it or is an administrator
+func loadAttachment(c echo.Context, req *goodooHttp.Request) (*models.IrAttachment, error) {
+	id, err := parseRecordID(c)
+	if err != nil {
+		return nil, err
+	}
+	var attachment models.IrAttachment
+	if err := req.GetDB().Omit("datas").First(&attachment, id).Error; err != nil {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Attachment not found")
+	}
+	env := req.GetEnv()
+	if attachment.CreateUID != env.UserID() && !env.IsAdmin() {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Attachment not found")
+	}
+	return &attachment, nil
+}
+
+// Get returns the metadata of an attachment, with its scan state, so the
+// uploader can follow the scan
+func (h *AttachmentHandler) Get(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	attachment, err := loadAttachment(c, req)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, attachment)
+}
+
+// Download serves the content of an attachment once scanned clean. A
+// pending or unscanned file is answered 409 and a quarantined one 403,
+// with its scan_state.
+func (h *AttachmentHandler) Download(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	attachment, err := loadAttachment(c, req)
+	if err != nil {
+		return err
+	}
+	if err := scan.CheckDownload(attachment); err != nil {
+		status := http.StatusConflict
+		if errors.Is(err, scan.ErrQuarantined) {
+			status = http.StatusForbidden
+		}
+		return c.JSON(status, map[string]string{"error": err.Error(), "scan_state": attachment.ScanState})
+	}
+
+	var contents [][]byte
+	if err := req.GetDB().Model(&models.IrAttachment{}).Where("id = ?", attachment.ID).Pluck("datas", &contents).Error; err != nil || len(contents) != 1 {
+		req.Logger.ErrorCtx(req.Context, "Failed to load attachment %d: %v", attachment.ID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to load attachment"})
+	}
+	mimetype := attachment.Mimetype
+	if mimetype == "" {
+		mimetype = "application/octet-stream"
+	}
+	c.Response().Header().Set("ETag", `"`+attachment.Checksum+`"`)
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", attachment.Name))
+	return c.Blob(http.StatusOK, mimetype, contents[0])
+}
+
+// Quarantine lists the attachments held back by the scan: quarantined and
+// scan_failed ones
+func (h *AttachmentHandler) Quarantine(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	var attachments []models.IrAttachment
+	err := req.GetDB().Omit("datas").
+		Where("scan_state IN ?", []string{models.AttachmentScanQuarantined, models.AttachmentScanFailed}).
+		Order("id DESC").Find(&attachments).Error
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"attachments": attachments})
+}
+
+// Release marks a held back attachment clean, for false positives
+func (h *AttachmentHandler) Release(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	attachment, err := loadAttachment(c, req)
+	if err != nil {
+		return err
+	}
+	if attachment.ScanState == models.AttachmentScanClean {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "attachment is already clean"})
+	}
+	previous := attachment.ScanState
+	if err := scan.Release(req.GetDB(), attachment, uint(req.GetUserID()), req.GetLogin()); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	req.Logger.WarningCtx(req.Context, "Attachment %d (%s, %s: %s) released by %s",
+		attachment.ID, attachment.Name, previous, attachment.ScanResult, req.GetLogin())
+	return c.JSON(http.StatusOK, attachment)
+}
+
+// Rescan queues an attachment for another scan
+func (h *AttachmentHandler) Rescan(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	attachment, err := loadAttachment(c, req)
+	if err != nil {
+		return err
+	}
+	if err := scan.Rescan(req.GetDB(), attachment); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	req.Logger.InfoCtx(req.Context, "Attachment %d (%s) queued for a new scan by %s", attachment.ID, attachment.Name, req.GetLogin())
+	return c.JSON(http.StatusOK, attachment)
+}
+
+// Purge deletes a held back attachment for good
+func (h *AttachmentHandler) Purge(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	attachment, err := loadAttachment(c, req)
+	if err != nil {
+		return err
+	}
+	if err := scan.Purge(req.GetDB(), attachment, uint(req.GetUserID()), req.GetLogin()); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	req.Logger.WarningCtx(req.Context, "Attachment %d (%s, %s) purged by %s", attachment.ID, attachment.Name, attachment.ScanState, req.GetLogin())
+	return c.JSON(http.StatusOK, map[string]interface{}{"success": true})
+}
+
+// RegisterAttachmentRoutes mounts the attachment endpoints under
+// /api/attachments; the quarantine requires the attachments.quarantine
+// permission
+func RegisterAttachmentRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewAttachmentHandler(config)
+	quarantine := goodooHttp.PermissionAttachmentsQuarantine
+
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		{Method: "GET", Path: "/api/attachments/quarantine", Handler: handler.Quarantine, Auth: true, DB: true, Permission: quarantine},
+		{Method: "GET", Path: "/api/attachments/:id", Handler: handler.Get, Auth: true, DB: true},
+		{Method: "GET", Path: "/api/attachments/:id/content", Handler: handler.Download, Auth: true, DB: true},
+		{Method: "POST", Path: "/api/attachments/:id/release", Handler: handler.Release, Auth: true, DB: true, Permission: quarantine},
+		{Method: "POST", Path: "/api/attachments/:id/rescan", Handler: handler.Rescan, Auth: true, DB: true, Permission: quarantine},
+		{Method: "DELETE", Path: "/api/attachments/:id", Handler: handler.Purge, Auth: true, DB: true, Permission: quarantine},
+	})
+}
@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	goodooHttp "goodoo/http"
+	"goodoo/images"
+	"goodoo/models"
+	"goodoo/upload"
+	"gorm.io/gorm"
+)
+
+// maxAvatarSize bounds uploaded avatar files
+const maxAvatarSize = 5 << 20
+
+// avatarURL returns the avatar endpoint of a user; the checksum changes the
+// URL when a new image is uploaded
+func avatarURL(user *models.User, size int) string {
+	url := fmt.Sprintf("/api/users/%d/avatar?size=%d", user.ID, size)
+	if user.AvatarChecksum != "" {
+		url += "&v=" + user.AvatarChecksum[:8]
+	}
+	return url
+}
+
+// avatarRejection is an uploaded avatar refused with an HTTP status
+type avatarRejection struct {
+	status  int
+	message string
+}
+
+func (e *avatarRejection) Error() string {
+	return e.message
+}
+
+// AvatarHandler serves and updates user avatars
+type AvatarHandler struct {
+	Config *goodooHttp.RequestConfig
+}
+
+// NewAvatarHandler creates a new avatar handler
+func NewAvatarHandler(config *goodooHttp.RequestConfig) *AvatarHandler {
+	return &AvatarHandler{Config: config}
+}
+
+// GetAvatar serves the avatar of a user at the requested size, or a
+// generated identicon when the user has not uploaded one or while the
+// uploaded one is not scanned clean
+func (h *AvatarHandler) GetAvatar(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	db := req.GetDB()
+	if db == nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database not available")
+	}
+
+	id := req.GetUserID()
+	if c.Param("id") != "me" {
+		parsed, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid user ID")
+		}
+		id = parsed
+	}
+	var user models.User
+	if err := db.First(&user, id).Error; err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "User not found")
+	}
+
+	requested, _ := strconv.Atoi(c.QueryParam("size"))
+	size := images.VariantSize(requested)
+
+	// Variants are only generated from clean images
+	uploaded, scanning := false, false
+	if user.AvatarChecksum != "" {
+		state, err := models.FieldAttachmentScanState(db, "res.users", "avatar", user.ID)
+		uploaded = err == nil && state == models.AttachmentScanClean
+		scanning = err == nil && state == models.AttachmentScanPending
+	}
+
+	etag := fmt.Sprintf(`"identicon-%s-%d"`, models.Checksum([]byte(user.Login))[:12], size)
+	if uploaded {
+		etag = fmt.Sprintf(`"%s-%d"`, user.AvatarChecksum, size)
+	}
+	c.Response().Header().Set("ETag", etag)
+	if scanning {
+		// The uploaded image replaces the identicon once scanned
+		c.Response().Header().Set("Cache-Control", "private, no-cache")
+	} else {
+		c.Response().Header().Set("Cache-Control", "private, max-age=3600")
+	}
+	if c.Request().Header.Get("If-None-Match") == etag {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	var data []byte
+	var err error
+	if uploaded {
+		var attachment *models.IrAttachment
+		attachment, err = user.AvatarAttachment(db)
+		if err == nil {
+			data, err = images.Variant(attachment.Checksum, attachment.Datas, size)
+		}
+	} else {
+		data, err = images.Identicon(user.Login, size)
+	}
+	if err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to load avatar of user %d: %v", user.ID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to load avatar"})
+	}
+	return c.Blob(http.StatusOK, "image/png", data)
+}
+
+// UploadAvatar replaces the current user's avatar with the "avatar" form
+// file, or with the staged file given as upload_token. The new image is
+// served once scanned; the attachment returned tells its scan state.
+func (h *AvatarHandler) UploadAvatar(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	db := req.GetDB()
+	if db == nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database not available")
+	}
+
+	token := c.FormValue(upload.TokenKey)
+	var content []byte
+	if token == "" {
+		header, err := c.FormFile("avatar")
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "An avatar file is required"})
+		}
+		if header.Size > maxAvatarSize {
+			return c.JSON(http.StatusRequestEntityTooLarge, map[string]string{"error": "Avatar must be at most 5 MB"})
+		}
+		file, err := header.Open()
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		defer file.Close()
+		content, err = io.ReadAll(io.LimitReader(file, maxAvatarSize+1))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+	}
+
+	var user models.User
+	if err := db.First(&user, req.GetUserID()).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "User not found")
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	// A staged file is consumed in the transaction storing the avatar, so
+	// it stays usable if the image is rejected
+	var rejected *avatarRejection
+	var attachment *models.IrAttachment
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if token != "" {
+			staged, err := upload.Consume(tx, req.Session.SID, token)
+			if err != nil {
+				return err
+			}
+			content = staged.Datas
+		}
+		if len(content) > maxAvatarSize {
+			return &avatarRejection{http.StatusRequestEntityTooLarge, "Avatar must be at most 5 MB"}
+		}
+		data, err := images.Normalize(content)
+		if errors.Is(err, images.ErrUnsupportedFormat) {
+			return &avatarRejection{http.StatusUnsupportedMediaType, "Avatar must be a PNG, JPEG or GIF image"}
+		}
+		if errors.Is(err, images.ErrTooLarge) {
+			return &avatarRejection{http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("Avatar must be at most %d pixels wide and high", images.MaxDimension)}
+		}
+		if err != nil {
+			return &avatarRejection{http.StatusBadRequest, err.Error()}
+		}
+		attachment, err = user.SetAvatar(tx, "image/png", data)
+		return err
+	})
+	switch {
+	case err == nil:
+	case errors.As(err, &rejected):
+		return c.JSON(rejected.status, map[string]string{"error": rejected.message})
+	case upload.IsTokenError(err):
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	default:
+		req.Logger.ErrorCtx(req.Context, "Failed to store avatar of user %d: %v", user.ID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to store avatar"})
+	}
+
+	req.Logger.InfoCtx(req.Context, "User %s updated their avatar", user.Login)
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"success":    true,
+		"avatar_url": avatarURL(&user, 128),
+		"attachment": attachment,
+	})
+}
+
+// RegisterAvatarRoutes mounts the avatar endpoints under /api/users
+func RegisterAvatarRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewAvatarHandler(config)
+
+	group := e.Group("/api/users")
+	group.Use(goodooHttp.AuthenticationMiddleware(true))
+	group.Use(goodooHttp.DatabaseMiddleware(true))
+
+	group.GET("/:id/avatar", handler.GetAvatar)
+	group.POST("/me/avatar", handler.UploadAvatar)
+}
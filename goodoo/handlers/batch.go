@@ -0,0 +1,263 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"goodoo/api"
+	"goodoo/database"
+	goodooHttp "goodoo/http"
+	"gorm.io/gorm"
+)
+
+// Bounds of a batch
+const (
+	maxBatchRequests = 20
+	batchTimeout     = 30 * time.Second
+)
+
+// errBatchFailed rolls back an atomic batch after a failed sub-request
+var errBatchFailed = errors.New("batch sub-request failed")
+
+// BatchHandler runs several API calls in one HTTP round trip
+type BatchHandler struct {
+	Config *goodooHttp.RequestConfig
+	echo   *echo.Echo
+}
+
+// NewBatchHandler creates a new batch handler dispatching to the routes of e
+func NewBatchHandler(e *echo.Echo, config *goodooHttp.RequestConfig) *BatchHandler {
+	return &BatchHandler{Config: config, echo: e}
+}
+
+// BatchSubRequest is either a route call (method and path, with an optional
+// JSON body) or a registry call (model, method and args)
+type BatchSubRequest struct {
+	Method string          `json:"method"`
+	Path   string          `json:"path"`
+	Body   json.RawMessage `json:"body,omitempty"`
+
+	Model   string                 `json:"model"`
+	Args    []interface{}          `json:"args"`
+	Kwargs  map[string]interface{} `json:"kwargs"`
+	Context map[string]interface{} `json:"context"`
+	IDs     []int                  `json:"ids,omitempty"`
+}
+
+// BatchRequest is the body of a batch. Sub-requests run in order; by default
+// the batch stops at the first failure. Atomic batches run in one database
+// transaction, rolled back when a sub-request fails; with ContinueOnError,
+// each sub-request runs in a savepoint instead, so a failed one is undone
+// alone and the others are committed.
+type BatchRequest struct {
+	Requests        []BatchSubRequest `json:"requests"`
+	ContinueOnError bool              `json:"continue_on_error"`
+	Atomic          bool              `json:"atomic"`
+}
+
+// BatchResult is the outcome of a sub-request
+type BatchResult struct {
+	Status int         `json:"status"`
+	Body   interface{} `json:"body"`
+}
+
+// batchPathAllowed reports whether a route may be called from a batch: API
+// routes only (authentication routes live outside /api), no nested batches
+func batchPathAllowed(path string) bool {
+	if !strings.HasPrefix(path, "/api/") || strings.Contains(path, "..") {
+		return false
+	}
+	return path != "/api/batch" && !strings.HasPrefix(path, "/api/batch/")
+}
+
+// batchRecorder buffers the response of a sub-request
+type batchRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *batchRecorder) Header() http.Header         { return r.header }
+func (r *batchRecorder) Write(b []byte) (int, error) { return r.body.Write(b) }
+func (r *batchRecorder) WriteHeader(status int)      { r.status = status }
+
+// result decodes the buffered response, keeping JSON bodies as JSON
+func (r *batchRecorder) result() BatchResult {
+	status := r.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	var body interface{}
+	if r.body.Len() > 0 {
+		if strings.Contains(r.header.Get(echo.HeaderContentType), echo.MIMEApplicationJSON) {
+			body = json.RawMessage(bytes.TrimSpace(r.body.Bytes()))
+		} else {
+			body = r.body.String()
+		}
+	}
+	return BatchResult{Status: status, Body: body}
+}
+
+// Batch runs the sub-requests of the body and returns their results in order
+func (h *BatchHandler) Batch(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+
+	var body BatchRequest
+	if err := c.Bind(&body); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+	}
+	if len(body.Requests) == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "requests is required"})
+	}
+	if len(body.Requests) > maxBatchRequests {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("a batch holds at most %d requests", maxBatchRequests)})
+	}
+	for i, sub := range body.Requests {
+		if sub.Model == "" && !batchPathAllowed(sub.Path) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("request %d: path %q cannot be batched", i, sub.Path)})
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context, batchTimeout)
+	defer cancel()
+
+	var results []BatchResult
+	run := func(parent *goodooHttp.Request) error {
+		results = make([]BatchResult, 0, len(body.Requests))
+		for _, sub := range body.Requests {
+			if ctx.Err() != nil {
+				results = append(results, BatchResult{Status: http.StatusGatewayTimeout, Body: map[string]string{"error": "Batch timed out"}})
+				if body.ContinueOnError {
+					continue
+				}
+				return errBatchFailed
+			}
+			result := h.dispatch(ctx, c, parent, sub, body.Atomic && body.ContinueOnError)
+			results = append(results, result)
+			if result.Status >= 400 && !body.ContinueOnError {
+				return errBatchFailed
+			}
+		}
+		return nil
+	}
+
+	var err error
+	if body.Atomic {
+		db := req.GetDB()
+		if db == nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Database required for atomic batches")
+		}
+		err = db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			parent := *req
+			parent.Tx = tx
+			ctx = database.ContextWithCursor(ctx, database.NewCursor(tx))
+			return run(&parent)
+		})
+	} else {
+		err = run(req)
+	}
+	if err != nil && !errors.Is(err, errBatchFailed) {
+		req.Logger.ErrorCtx(req.Context, "Batch failed: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"results":     results,
+		"completed":   err == nil,
+		"rolled_back": body.Atomic && err != nil,
+	})
+}
+
+// dispatch runs one sub-request on behalf of the batch's user; isolated
+// sub-requests run in a savepoint of the batch transaction
+func (h *BatchHandler) dispatch(ctx context.Context, c echo.Context, parent *goodooHttp.Request, sub BatchSubRequest, isolated bool) BatchResult {
+	if sub.Model != "" {
+		call := &api.APICall{
+			ModelName: sub.Model,
+			Method:    sub.Method,
+			Args:      sub.Args,
+			Kwargs:    sub.Kwargs,
+			Context:   sub.Context,
+			IDs:       sub.IDs,
+		}
+		registry := api.DefaultAPIRegistry.ForDatabase(parent.GetDBName())
+		response := registry.ExecuteCall(ctx, call, parent, api.CallOptions{Savepoint: isolated})
+		return BatchResult{Status: apiResponseStatus(response), Body: response}
+	}
+	if isolated {
+		return h.dispatchInSavepoint(ctx, c, parent, sub)
+	}
+	return h.dispatchRoute(ctx, c, parent, sub)
+}
+
+// dispatchInSavepoint runs a route sub-request in a savepoint, rolled back
+// when it fails
+func (h *BatchHandler) dispatchInSavepoint(ctx context.Context, c echo.Context, parent *goodooHttp.Request, sub BatchSubRequest) BatchResult {
+	cursor := database.CursorFromContext(ctx)
+	sp, err := cursor.Savepoint()
+	if err != nil {
+		return BatchResult{Status: http.StatusInternalServerError, Body: map[string]string{"error": "Failed to create savepoint"}}
+	}
+	result := h.dispatchRoute(ctx, c, parent, sub)
+	if result.Status >= 400 {
+		err = sp.Close(true)
+	} else {
+		err = sp.Release()
+	}
+	if err != nil {
+		parent.Logger.ErrorCtx(ctx, "Failed to close batch savepoint: %v", err)
+		return BatchResult{Status: http.StatusInternalServerError, Body: map[string]string{"error": "Failed to close savepoint"}}
+	}
+	return result
+}
+
+// dispatchRoute runs a route sub-request through the router
+func (h *BatchHandler) dispatchRoute(ctx context.Context, c echo.Context, parent *goodooHttp.Request, sub BatchSubRequest) BatchResult {
+	method := strings.ToUpper(sub.Method)
+	if method == "" {
+		method = http.MethodGet
+	}
+	target, err := url.Parse(sub.Path)
+	if err != nil {
+		return BatchResult{Status: http.StatusBadRequest, Body: map[string]string{"error": "Invalid path"}}
+	}
+
+	httpRequest, err := http.NewRequestWithContext(ctx, method, target.String(), bytes.NewReader(sub.Body))
+	if err != nil {
+		return BatchResult{Status: http.StatusBadRequest, Body: map[string]string{"error": err.Error()}}
+	}
+	// Keep the caller's headers (cookies, language, forwarded address)
+	httpRequest.Header = c.Request().Header.Clone()
+	httpRequest.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	httpRequest.Header.Del(echo.HeaderContentLength)
+	httpRequest.RemoteAddr = c.Request().RemoteAddr
+
+	recorder := &batchRecorder{header: make(http.Header)}
+	subContext := h.echo.NewContext(httpRequest, recorder)
+	// Route handlers carry their group middleware (authentication and
+	// database checks); the server-wide middleware already ran for the batch
+	h.echo.Router().Find(method, target.Path, subContext)
+	subContext.Set("goodoo_request", parent.Derive(ctx, subContext))
+	if err := subContext.Handler()(subContext); err != nil {
+		h.echo.HTTPErrorHandler(err, subContext)
+	}
+	return recorder.result()
+}
+
+// RegisterBatchRoutes mounts the batch endpoint at /api/batch
+func RegisterBatchRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewBatchHandler(e, config)
+
+	group := e.Group("/api/batch")
+	group.Use(goodooHttp.AuthenticationMiddleware(true))
+
+	group.POST("", handler.Batch)
+}
@@ -0,0 +1,253 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"goodoo/database"
+	"goodoo/fields"
+	goodooHttp "goodoo/http"
+	"goodoo/logging"
+	"goodoo/models"
+	"goodoo/notification"
+	"goodoo/operations"
+	"gorm.io/gorm"
+)
+
+// Bulk operation batch sizes
+const (
+	DefaultBulkBatchSize = 500
+	MaxBulkBatchSize     = 5000
+)
+
+// MaxBulkReturnedIDs bounds the ids answered to a bulk request with
+// return_ids; "ids_truncated" tells the client there are more
+const MaxBulkReturnedIDs = 10000
+
+// bulkRequest is the body of the bulk endpoints: the records are those
+// matching domain, restricted to ids when given. With return_ids, the ids
+// of the records are answered along with the operation.
+type bulkRequest struct {
+	Domain    models.Domain          `json:"domain"`
+	IDs       []uint                 `json:"ids"`
+	Values    map[string]interface{} `json:"values"`
+	BatchSize int                    `json:"batch_size"`
+	ReturnIDs bool                   `json:"return_ids"`
+}
+
+// parseBulkRequest decodes the body of a bulk endpoint
+func parseBulkRequest(req *goodooHttp.Request) (*bulkRequest, error) {
+	raw, err := json.Marshal(bodyValues(req))
+	if err != nil {
+		return nil, err
+	}
+	var body bulkRequest
+	if err := fields.DecodeJSON(raw, &body); err != nil {
+		return nil, fmt.Errorf("invalid bulk request: %w", err)
+	}
+	if body.IDs == nil && len(body.Domain) == 0 {
+		return nil, fmt.Errorf("a domain or ids are required")
+	}
+	if body.BatchSize <= 0 {
+		body.BatchSize = DefaultBulkBatchSize
+	}
+	if body.BatchSize > MaxBulkBatchSize {
+		return nil, fmt.Errorf("batch_size cannot exceed %d", MaxBulkBatchSize)
+	}
+	return &body, nil
+}
+
+// bulkDomain returns the domain of the records a bulk request applies to
+func bulkDomain(body *bulkRequest) models.Domain {
+	domain := body.Domain
+	if body.IDs != nil {
+		domain = append(append(models.Domain{}, domain...), []interface{}{"id", "in", body.IDs})
+	}
+	return domain
+}
+
+// startBulk runs fn on the records in batches, each in its own
+// transaction, as a background operation. The records are streamed from
+// a snapshot taken when the operation starts (see models.StreamIDs), so
+// a write moving records in or out of the domain neither skips nor
+// repeats any. A failed batch is rolled back and its error collected;
+// cancellation is checked between batches. The outcome is written to the
+// audit log and notified to the user.
+func (h *RecordsHandler) startBulk(c echo.Context, kind string, model *models.ModelDefinition, body *bulkRequest, fn func(env *models.Environment, ids []uint) error) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	domain := bulkDomain(body)
+	total, err := model.SearchCount(req.GetEnv(), domain)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	response := map[string]interface{}{"total": total}
+	if body.ReturnIDs {
+		// The ids matching now; the operation streams its own snapshot
+		ids, err := model.Search(req.GetEnv(), domain, 0, MaxBulkReturnedIDs+1, "id")
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		response["ids_truncated"] = len(ids) > MaxBulkReturnedIDs
+		response["ids"] = ids[:min(len(ids), MaxBulkReturnedIDs)]
+	}
+
+	// The request context ends with the response: batches run detached
+	env := req.GetEnv().Detach()
+	dbName := req.GetDBName()
+	if req.Tx != nil {
+		// Batches commit on their own, not with the request transaction
+		// (an idempotent or atomic batch request)
+		db, err := database.GetDatabase(dbName)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Database not available")
+		}
+		env = env.WithDB(db)
+	}
+
+	op := operations.Start(kind, model.Name, dbName, req.GetUserID(), int(total), func(ctx context.Context, op *operations.Operation) error {
+		batches := (int(total) + body.BatchSize - 1) / body.BatchSize
+		batch := 0
+		streamErr := model.StreamIDs(ctx, env, domain, models.StreamOptions{BatchSize: body.BatchSize}, func(_ *gorm.DB, ids []uint) error {
+			if op.Cancelled() {
+				return context.Canceled
+			}
+			batch++
+			op.BeginBatch(batch, max(batch, batches))
+			if err := fn(env, ids); err != nil {
+				op.Progress(0, len(ids), fmt.Errorf("batch %d (ids %d-%d): %w", batch, ids[0], ids[len(ids)-1], err))
+			} else {
+				op.Progress(len(ids), 0, nil)
+			}
+			return nil
+		})
+		err := auditBulk(env, kind, model, body, op)
+		notifyBulk(dbName, kind, model, op)
+		if streamErr != nil && !op.Cancelled() {
+			return streamErr
+		}
+		return err
+	})
+
+	req.Logger.InfoCtx(req.Context, "Started %s %s on %s: %d records", kind, op.Status().ID, model.Name, total)
+	response["operation_id"] = op.Status().ID
+	return c.JSON(http.StatusAccepted, response)
+}
+
+// auditBulk records a bulk operation with its domain and counts; the
+// short-lived records of transient models are not audited
+func auditBulk(env *models.Environment, kind string, model *models.ModelDefinition, body *bulkRequest, op *operations.Operation) error {
+	if model.Transient {
+		return nil
+	}
+	status := op.Status()
+	state := operations.StateDone
+	if op.Cancelled() {
+		state = operations.StateCancelled
+	}
+	fields := make([]string, 0, len(body.Values))
+	for name := range body.Values {
+		fields = append(fields, name)
+	}
+	severity := models.SeveritySuccess
+	switch {
+	case state == operations.StateCancelled:
+		severity = models.SeverityWarning
+	case status.Failed > 0:
+		severity = models.SeverityError
+	}
+	return models.LogActivity(env.GetDB(), env.GetUser(), models.Activity{
+		Type:     models.ActivityBulkCompleted,
+		Severity: severity,
+		Model:    model.Name,
+		Params: map[string]interface{}{
+			"operation":    strings.TrimPrefix(kind, "bulk_"),
+			"operation_id": status.ID,
+			"domain":       body.Domain,
+			"ids":          len(body.IDs),
+			"fields":       fields,
+			"state":        state,
+			"total":        status.Total,
+			"processed":    status.Processed,
+			"failed":       status.Failed,
+		},
+	})
+}
+
+// bulkLabels name the bulk operations in notifications
+var bulkLabels = map[string]string{
+	"bulk_write":  "Bulk update",
+	"bulk_unlink": "Bulk delete",
+}
+
+// notifyBulk tells the user who started a bulk operation how it ended
+func notifyBulk(dbName, kind string, model *models.ModelDefinition, op *operations.Operation) {
+	status := op.Status()
+	name := model.Description
+	if name == "" {
+		name = model.Name
+	}
+	level, outcome := models.NotificationSuccess, "finished"
+	switch {
+	case op.Cancelled():
+		level, outcome = models.NotificationWarning, "cancelled"
+	case status.Failed > 0:
+		level = models.NotificationWarning
+	}
+	title := fmt.Sprintf("%s of %s %s", bulkLabels[kind], name, outcome)
+	body := fmt.Sprintf("%d of %d records processed, %d failed", status.Processed, status.Total, status.Failed)
+	_, err := notification.Notify(dbName, uint(status.UserID), models.NotificationCategoryBulk, level, title, body, map[string]interface{}{
+		"operation_id": status.ID,
+		"model":        model.Name,
+		"processed":    status.Processed,
+		"failed":       status.Failed,
+	})
+	if err != nil {
+		logging.GetLogger("goodoo.handlers.bulk").Warning("Failed to notify %s %s: %v", kind, status.ID, err)
+	}
+}
+
+// BulkWrite writes the same values to the records matching a domain or
+// ids, in batches, as a background operation: POST
+// /api/records/:model/bulk_write {"domain": [...], "ids": [...],
+// "values": {...}, "batch_size": 500}
+func (h *RecordsHandler) BulkWrite(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	model, err := h.resolveModel(c)
+	if err != nil {
+		return err
+	}
+	body, err := parseBulkRequest(req)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	if len(body.Values) == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "values are required"})
+	}
+	model.ParseLocalized(req.GetEnv(), body.Values)
+
+	return h.startBulk(c, "bulk_write", model, body, func(env *models.Environment, ids []uint) error {
+		return model.Write(env, ids, body.Values)
+	})
+}
+
+// BulkUnlink deletes the records matching a domain or ids, in batches, as
+// a background operation
+func (h *RecordsHandler) BulkUnlink(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	model, err := h.resolveModel(c)
+	if err != nil {
+		return err
+	}
+	body, err := parseBulkRequest(req)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	return h.startBulk(c, "bulk_unlink", model, body, func(env *models.Environment, ids []uint) error {
+		return model.Unlink(env, ids)
+	})
+}
@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"goodoo/capability"
+	goodooHttp "goodoo/http"
+	"goodoo/models"
+)
+
+// CapabilityHandler reports the features the server runs with
+// (administrators only); the health endpoint shows the public ones
+type CapabilityHandler struct {
+	Config *goodooHttp.RequestConfig
+}
+
+// NewCapabilityHandler creates a new capability handler
+func NewCapabilityHandler(config *goodooHttp.RequestConfig) *CapabilityHandler {
+	return &CapabilityHandler{Config: config}
+}
+
+// List returns every capability with its state, the reason for it and
+// since when it holds, and the last schema check of the request database
+// (see models.CheckSchema)
+func (h *CapabilityHandler) List(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	report := capability.Report()
+	counts := map[capability.State]int{capability.Enabled: 0, capability.Disabled: 0, capability.Degraded: 0}
+	for _, current := range report {
+		counts[current.State]++
+	}
+	response := map[string]interface{}{
+		"capabilities": report,
+		"counts":       counts,
+	}
+	if schema, checked := models.SchemaReportOf(req.GetDBName()); checked {
+		response["schema"] = schema
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// CheckSchema compares the models with the columns of the request
+// database again, e.g. after running the migrations by hand, and returns
+// the report; fields whose column came back are available again
+func (h *CapabilityHandler) CheckSchema(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	dbName := req.GetDBName()
+	schema, err := models.CheckSchema(dbName, req.GetDB(), models.RegistryForDB(dbName))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	req.Logger.InfoCtx(req.Context, "Schema of %s checked by %s: %s, %d difference(s)", dbName, req.GetLogin(), schema.Status, len(schema.Issues))
+	return c.JSON(http.StatusOK, schema)
+}
+
+// RegisterCapabilityRoutes mounts GET /api/capabilities and the schema
+// check, which require the capabilities.read permission
+func RegisterCapabilityRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewCapabilityHandler(config)
+	read := goodooHttp.PermissionCapabilitiesRead
+
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		{Method: "GET", Path: "/api/capabilities", Handler: handler.List, Auth: true, DB: true, Permission: read},
+		{Method: "POST", Path: "/api/capabilities/schema/check", Handler: handler.CheckSchema, Auth: true, DB: true, Permission: read},
+	})
+}
@@ -0,0 +1,378 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"goodoo/chat"
+	"goodoo/connections"
+	goodooHttp "goodoo/http"
+	"goodoo/knowledge"
+	"goodoo/llm"
+	"goodoo/models"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// chatTurn is a message of a user being answered
+type chatTurn struct {
+	req     *goodooHttp.Request
+	db      *gorm.DB
+	chatReq ChatRequest
+	session *models.ChatSession
+	// messageID identifies the answer in the response
+	messageID string
+	// template is the prompt template the message was rendered from, nil
+	// for a message written by the user
+	template *models.PromptTemplate
+	// prompt is the message with the knowledge base excerpts
+	prompt   string
+	metadata map[string]interface{}
+	start    time.Time
+}
+
+// prepareChatTurn reads and checks the message of a chat request, renders
+// its prompt template, and retrieves its knowledge base excerpts. It
+// answers the refused requests itself, returning a nil turn and the error
+// of the response.
+func (h *DashboardHandler) prepareChatTurn(c echo.Context) (*chatTurn, error) {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	if db == nil {
+		return nil, echo.NewHTTPError(500, "Database not available")
+	}
+
+	var chatReq ChatRequest
+	if err := c.Bind(&chatReq); err != nil {
+		return nil, c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request format"})
+	}
+	if chatReq.Message == "" && chatReq.TemplateID == 0 {
+		return nil, c.JSON(http.StatusBadRequest, map[string]string{"error": "Message cannot be empty"})
+	}
+	var template *models.PromptTemplate
+	if chatReq.TemplateID != 0 {
+		var err error
+		if template, err = models.GetPromptTemplate(db, uint(req.GetUserID()), chatReq.TemplateID); err != nil {
+			return nil, promptTemplateError(c, err)
+		}
+		rendered, err := models.RenderPrompt(template.Template, chatReq.Variables)
+		if err != nil {
+			return nil, promptRenderError(c, err)
+		}
+		if chatReq.Message != "" {
+			rendered += "\n\n" + chatReq.Message
+		}
+		chatReq.Message = rendered
+		if chatReq.Model == "" {
+			chatReq.Model = template.Model
+		}
+	} else if len(chatReq.Variables) > 0 {
+		return nil, c.JSON(http.StatusBadRequest, map[string]string{"error": "Variables need a template_id"})
+	}
+	if chatReq.Model == "" {
+		chatReq.Model = models.GetPrefString(db, uint(req.GetUserID()), models.PrefChatDefaultModel, "")
+	}
+	if chatReq.ContentType == "" {
+		chatReq.ContentType = models.ChatContentMarkdown
+	} else if !models.ValidChatContentType(chatReq.ContentType) {
+		return nil, c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid content type"})
+	}
+
+	// A rendered template must fit the context window of the model
+	if template != nil {
+		catalog, err := models.LoadLLMCatalog(db, req.GetDBName())
+		if err != nil {
+			return nil, echo.NewHTTPError(500, "Failed to load LLM providers")
+		}
+		if err := models.CheckPromptSize(catalog, chatReq.Model, chatReq.Message); err != nil {
+			return nil, promptRenderError(c, err)
+		}
+	}
+
+	// Continue the session, or start one; sessions of other users are not found
+	session := &models.ChatSession{ID: chatReq.SessionID, UserID: uint(req.GetUserID())}
+	if chatReq.SessionID == "" {
+		session.ID = newChatSessionID(req)
+		// Refuse before generating an answer that could not be stored
+		var quotaErr *models.QuotaExceededError
+		if err := models.CheckQuota(db, req.GetDBName(), models.QuotaChatSession, session.UserID); errors.As(err, &quotaErr) {
+			return nil, quotaExceededResponse(c, quotaErr)
+		}
+	} else if len(chatReq.SessionID) > 64 {
+		return nil, c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid session ID"})
+	} else {
+		var other int64
+		if err := db.Model(&models.ChatSession{}).Where("id = ? AND user_id <> ?", chatReq.SessionID, req.GetUserID()).Count(&other).Error; err != nil {
+			return nil, echo.NewHTTPError(500, "Failed to load chat session")
+		}
+		if other > 0 {
+			return nil, c.JSON(http.StatusNotFound, map[string]string{"error": "Session not found"})
+		}
+	}
+
+	turn := &chatTurn{
+		req:       req,
+		db:        db,
+		chatReq:   chatReq,
+		session:   session,
+		template:  template,
+		messageID: fmt.Sprintf("msg_%d_%d", req.GetUserID(), time.Now().UnixNano()),
+		prompt:    chatReq.Message,
+		start:     time.Now(),
+	}
+
+	// Retrieve knowledge base excerpts and prepend them to the prompt
+	if chatReq.UseKnowledge {
+		results, err := knowledge.Search(req.Context, db, req.DB, knowledge.EmbedderForDB(req.DB), chatReq.Message, knowledge.DefaultLimit)
+		if err != nil {
+			req.Logger.WarningCtx(req.Context, "Knowledge retrieval failed: %v", err)
+		} else if len(results) > 0 {
+			turn.prompt = knowledge.AugmentPrompt(chatReq.Message, results)
+			citations := make([]map[string]interface{}, len(results))
+			for i, result := range results {
+				citations[i] = map[string]interface{}{
+					"index":       i + 1,
+					"document_id": result.DocumentID,
+					"title":       result.Title,
+					"chunk_id":    result.ChunkID,
+					"score":       result.Score,
+				}
+			}
+			turn.metadata = map[string]interface{}{"citations": citations}
+		}
+	}
+	if template != nil {
+		if turn.metadata == nil {
+			turn.metadata = make(map[string]interface{})
+		}
+		variables, _ := models.PromptVariables(template.Template)
+		turn.metadata["template"] = map[string]interface{}{
+			"id":        template.ID,
+			"name":      template.Name,
+			"variables": variables,
+		}
+	}
+	return turn, nil
+}
+
+// answerChatTurn answers a message along the route of its model, calling
+// onDelta, when not nil, with the parts of the answer as they come. The
+// provider and the model which answered go into the metadata of the turn.
+// Models without a route get a simulated answer.
+func (h *DashboardHandler) answerChatTurn(turn *chatTurn, onDelta func(delta string) error) (*llm.Response, []llm.Attempt, error) {
+	req := turn.req
+	model := turn.chatReq.Model
+	catalog, err := models.LoadLLMCatalog(turn.db, req.GetDBName())
+	if err != nil {
+		return nil, nil, err
+	}
+	route := llm.RouteFor(catalog, req.GetDBName(), model)
+	if route == nil {
+		// Simulate AI response generation based on selected model
+		content, tokensUsed := h.generateAIResponse(turn.prompt, model)
+		if onDelta != nil {
+			for _, word := range strings.SplitAfter(content, " ") {
+				if err := onDelta(word); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+		return &llm.Response{Content: content, TokensUsed: tokensUsed, FinishReason: "stop", Model: model}, nil, nil
+	}
+
+	ctx, span := req.StartSpan("llm.call")
+	span.SetAttribute("llm.route", model)
+	defer span.End()
+	chatReq := llm.Request{Messages: []llm.Message{{Role: models.ChatRoleUser, Content: turn.prompt}}}
+	var answer *llm.Response
+	var attempts []llm.Attempt
+	if onDelta != nil {
+		answer, attempts, err = route.Stream(ctx, chatReq, onDelta)
+	} else {
+		answer, attempts, err = route.Complete(ctx, chatReq)
+	}
+	if err != nil {
+		span.SetAttribute("llm.error_class", llm.Classify(err))
+		return nil, attempts, err
+	}
+	span.SetAttribute("llm.provider", answer.Provider)
+	span.SetAttribute("llm.model", answer.Model)
+	if turn.metadata == nil {
+		turn.metadata = make(map[string]interface{})
+	}
+	turn.metadata["llm"] = map[string]interface{}{
+		"provider":  answer.Provider,
+		"model":     answer.Model,
+		"failovers": len(attempts) - 1,
+		"attempts":  attempts,
+	}
+	return answer, attempts, nil
+}
+
+// chatAnswerStatus returns the status of a chat no provider answered:
+// 422 for a refused prompt, 504 when the last provider was too slow, 502
+// otherwise
+func chatAnswerStatus(err error) int {
+	switch llm.Classify(err) {
+	case models.LLMErrorContentPolicy:
+		return http.StatusUnprocessableEntity
+	case models.LLMErrorTimeout:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// chatAnswerError answers a chat no provider answered, with the attempts
+// of its route
+func chatAnswerError(c echo.Context, turn *chatTurn, attempts []llm.Attempt, err error) error {
+	req := turn.req
+	if errors.Is(err, context.Canceled) {
+		return err
+	}
+	req.Logger.WarningCtx(req.Context, "No answer to the chat of user %d with %s: %v", req.GetUserID(), turn.chatReq.Model, err)
+	return c.JSON(chatAnswerStatus(err), map[string]interface{}{
+		"error":    err.Error(),
+		"class":    llm.Classify(err),
+		"attempts": attempts,
+	})
+}
+
+// storeChatTurn stores the message and its answer, rendered as they are
+// saved, and returns them, counting the use of the template of the
+// message; an untitled session is queued for the title job, so the answer
+// never waits for a title. Failures other than quotas
+// are only logged: the answer is returned anyway.
+func (h *DashboardHandler) storeChatTurn(turn *chatTurn, answer *llm.Response) ([]models.ChatMessage, error) {
+	req, session, chatReq := turn.req, turn.session, turn.chatReq
+	messages := []models.ChatMessage{
+		{SessionID: session.ID, Role: models.ChatRoleUser, Content: chatReq.Message, ContentType: chatReq.ContentType},
+		{SessionID: session.ID, Role: models.ChatRoleAssistant, Content: answer.Content, ContentType: models.ChatContentMarkdown,
+			Model: answer.Model, Provider: answer.Provider, TokensUsed: answer.TokensUsed},
+	}
+	err := turn.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where(models.ChatSession{ID: session.ID}).
+			Attrs(models.ChatSession{Model: chatReq.Model, UseKnowledge: chatReq.UseKnowledge}).
+			FirstOrCreate(session)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected > 0 {
+			if err := models.ReserveQuota(tx, req.GetDBName(), models.QuotaChatSession, session.UserID); err != nil {
+				return err
+			}
+		}
+		updates := map[string]interface{}{
+			"model":         chatReq.Model,
+			"use_knowledge": chatReq.UseKnowledge,
+			"write_date":    time.Now(),
+		}
+		if session.Title == "" && !session.TitleManual {
+			updates["title_pending"] = true
+		}
+		if err := tx.Model(session).UpdateColumns(updates).Error; err != nil {
+			return err
+		}
+		if turn.template != nil {
+			messages[0].TemplateID = &turn.template.ID
+		}
+		if err := tx.Create(messages).Error; err != nil {
+			return err
+		}
+		if turn.template == nil {
+			return nil
+		}
+		return tx.Create(&models.PromptTemplateUse{
+			TemplateID: turn.template.ID,
+			UserID:     session.UserID,
+			SessionID:  session.ID,
+			Model:      answer.Model,
+			TokensUsed: answer.TokensUsed,
+		}).Error
+	})
+	var quotaErr *models.QuotaExceededError
+	if errors.As(err, &quotaErr) {
+		return nil, err
+	}
+	if err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to store chat session %s: %v", session.ID, err)
+	} else if session.Title == "" && !session.TitleManual {
+		chat.TitleSoon(req.Context)
+	}
+	return messages, nil
+}
+
+// response returns the chat response of an answer; Model is the model
+// asked for, the metadata telling which one answered
+func (turn *chatTurn) response(answer *llm.Response, stored models.ChatMessage) ChatResponse {
+	return ChatResponse{
+		ID:           turn.messageID,
+		Message:      answer.Content,
+		RenderedHTML: stored.Rendered(),
+		Model:        turn.chatReq.Model,
+		SessionID:    turn.session.ID,
+		Timestamp:    time.Now(),
+		ResponseTime: int(time.Since(turn.start).Milliseconds()),
+		TokensUsed:   answer.TokensUsed,
+		FinishReason: answer.FinishReason,
+		Metadata:     turn.metadata,
+	}
+}
+
+// StreamChatMessage answers a chat message like SendChatMessage, as
+// server-sent events: "delta" events with the parts of the answer, then a
+// "done" event with the stored answer, or an "error" event. A route fails
+// over until the first part is sent; when no provider answers by then, the
+// error is answered as SendChatMessage does, without events.
+func (h *DashboardHandler) StreamChatMessage(c echo.Context) error {
+	turn, err := h.prepareChatTurn(c)
+	if turn == nil {
+		return err
+	}
+	req := turn.req
+	// The answer is tracked with the other long-lived connections but
+	// runs to its end: it is short, and a shutdown waits for it to drain
+	stream, err := openEventStream(c, connections.TypeChat)
+	if stream == nil {
+		return err
+	}
+	defer stream.close()
+	send := func(event string, payload StreamChatResponse) error {
+		return stream.send(event, payload)
+	}
+
+	answer, attempts, err := h.answerChatTurn(turn, func(delta string) error {
+		return send("delta", StreamChatResponse{Delta: delta, MessageID: turn.messageID})
+	})
+	if err != nil && !stream.started {
+		return chatAnswerError(c, turn, attempts, err)
+	}
+	if err != nil {
+		req.Logger.WarningCtx(req.Context, "Chat stream of user %d with %s broke: %v", req.GetUserID(), turn.chatReq.Model, err)
+		send("error", StreamChatResponse{Done: true, MessageID: turn.messageID, Error: err.Error()})
+		return nil
+	}
+
+	messages, err := h.storeChatTurn(turn, answer)
+	if err != nil {
+		if !stream.started {
+			var quotaErr *models.QuotaExceededError
+			if errors.As(err, &quotaErr) {
+				return quotaExceededResponse(c, quotaErr)
+			}
+		}
+		send("error", StreamChatResponse{Done: true, MessageID: turn.messageID, Error: err.Error()})
+		return nil
+	}
+	chatResponse := turn.response(answer, messages[1])
+	send("done", StreamChatResponse{Done: true, MessageID: turn.messageID, Response: &chatResponse})
+
+	req.Logger.InfoCtx(req.Context, "Chat message streamed: user=%d, model=%s, tokens=%d, time=%dms",
+		req.GetUserID(), answer.Model, answer.TokensUsed, chatResponse.ResponseTime)
+	return nil
+}
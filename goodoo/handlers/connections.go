@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"goodoo/connections"
+	goodooHttp "goodoo/http"
+)
+
+// ConnectionHandler lists the long-lived connections of the process
+type ConnectionHandler struct {
+	Config *goodooHttp.RequestConfig
+}
+
+// NewConnectionHandler creates a new connection handler
+func NewConnectionHandler(config *goodooHttp.RequestConfig) *ConnectionHandler {
+	return &ConnectionHandler{Config: config}
+}
+
+// ConnectionsResponse is the open connections of a database with their
+// counts by type and the limits in force
+type ConnectionsResponse struct {
+	Connections []connections.Status `json:"connections"`
+	Counts      map[string]int       `json:"counts"`
+	Total       int                  `json:"total"`
+	// ProcessTotal counts the connections of every database, which
+	// MaxTotal bounds
+	ProcessTotal   int     `json:"process_total"`
+	MaxPerUser     int     `json:"max_per_user"`
+	MaxTotal       int     `json:"max_total"`
+	IdleTimeout    float64 `json:"idle_timeout_seconds"`
+	ReconnectAfter float64 `json:"reconnect_after_seconds"`
+}
+
+// List returns the event streams open on the database of the request:
+// their type, user, channels, age, last activity and what they sent
+func (h *ConnectionHandler) List(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	dbName := req.GetDBName()
+	list := connections.List(dbName)
+	limits := connections.Limits()
+	return c.JSON(http.StatusOK, ConnectionsResponse{
+		Connections:    list,
+		Counts:         connections.Counts(dbName),
+		Total:          len(list),
+		ProcessTotal:   connections.Count(""),
+		MaxPerUser:     limits.MaxPerUser,
+		MaxTotal:       limits.MaxTotal,
+		IdleTimeout:    limits.IdleTimeout.Seconds(),
+		ReconnectAfter: limits.ReconnectAfter.Seconds(),
+	})
+}
+
+// RegisterConnectionRoutes mounts GET /api/connections, which requires
+// the connections.read permission
+func RegisterConnectionRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewConnectionHandler(config)
+	read := goodooHttp.PermissionConnectionsRead
+
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		{Method: "GET", Path: "/api/connections", Handler: handler.List, Auth: true, DB: true, Permission: read},
+	})
+}
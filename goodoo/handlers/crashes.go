@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	goodooHttp "goodoo/http"
+	"goodoo/models"
+)
+
+// CrashHandler lists the recovered panics
+type CrashHandler struct {
+	Config *goodooHttp.RequestConfig
+}
+
+// NewCrashHandler creates a new crash handler
+func NewCrashHandler(config *goodooHttp.RequestConfig) *CrashHandler {
+	return &CrashHandler{Config: config}
+}
+
+// List returns the crashes of the last ?days= (7 by default) grouped by
+// fingerprint, the most recent first, with their count, first and last
+// occurrence and the latest report as an example
+func (h *CrashHandler) List(c echo.Context) error {
+	days := 7
+	if value := c.QueryParam("days"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "days must be a positive integer"})
+		}
+		days = parsed
+	}
+	limit := 50
+	if value := c.QueryParam("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 || parsed > 500 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "limit must be between 1 and 500"})
+		}
+		limit = parsed
+	}
+
+	req := goodooHttp.GetGoodooRequest(c)
+	db := req.GetDB()
+	if db == nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database not available"})
+	}
+	groups, err := models.CrashGroups(db, time.Now().AddDate(0, 0, -days), limit)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	if groups == nil {
+		groups = []models.CrashGroup{}
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"groups": groups,
+		"days":   days,
+	})
+}
+
+// RegisterCrashRoutes mounts the crash reports at /api/crashes (logs.read)
+func RegisterCrashRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewCrashHandler(config)
+
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		{Method: "GET", Path: "/api/crashes", Handler: handler.List, Auth: true, DB: true, Permission: goodooHttp.PermissionLogsRead},
+	})
+}
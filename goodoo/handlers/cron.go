@@ -0,0 +1,295 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"goodoo/cron"
+	goodooHttp "goodoo/http"
+	"goodoo/models"
+	"goodoo/scheduler"
+	"gorm.io/gorm"
+)
+
+// CronHandler manages scheduled actions (admin only)
+type CronHandler struct {
+	Config *goodooHttp.RequestConfig
+}
+
+// NewCronHandler creates a new cron handler
+func NewCronHandler(config *goodooHttp.RequestConfig) *CronHandler {
+	return &CronHandler{Config: config}
+}
+
+// CronRequest is the body of create and update requests; nil fields are left unchanged
+type CronRequest struct {
+	Name           *string    `json:"name"`
+	Model          *string    `json:"model"`
+	Function       *string    `json:"function"`
+	IntervalNumber *int       `json:"interval_number"`
+	IntervalType   *string    `json:"interval_type"`
+	CronExpression *string    `json:"cron_expression"`
+	NextCall       *time.Time `json:"nextcall"`
+	Active         *bool      `json:"active"`
+	UserID         *uint      `json:"user_id"`
+	CatchUp        *bool      `json:"catch_up"`
+}
+
+// apply copies the set fields onto the job
+func (r *CronRequest) apply(job *models.IrCron) {
+	if r.Name != nil {
+		job.Name = *r.Name
+	}
+	if r.Model != nil {
+		job.Model = *r.Model
+	}
+	if r.Function != nil {
+		job.Function = *r.Function
+	}
+	if r.IntervalNumber != nil {
+		job.IntervalNumber = *r.IntervalNumber
+	}
+	if r.IntervalType != nil {
+		job.IntervalType = *r.IntervalType
+	}
+	if r.CronExpression != nil {
+		job.CronExpression = *r.CronExpression
+	}
+	if r.NextCall != nil {
+		job.NextCall = *r.NextCall
+	}
+	if r.Active != nil {
+		job.Active = *r.Active
+	}
+	if r.UserID != nil {
+		job.UserID = *r.UserID
+	}
+	if r.CatchUp != nil {
+		job.CatchUp = *r.CatchUp
+	}
+}
+
+// validateCron checks the schedule and the called function of a job
+func validateCron(job *models.IrCron) error {
+	if job.Name == "" || job.Function == "" {
+		return errors.New("name and function are required")
+	}
+	schedule, err := cron.ScheduleOf(job)
+	if err != nil {
+		return err
+	}
+	if schedule.Next(time.Now()).IsZero() {
+		return fmt.Errorf("%w: %s", cron.ErrNeverActivates, job.CronExpression)
+	}
+	for _, name := range cron.Functions() {
+		if name == job.Function || (job.Model != "" && name == job.Model+"."+job.Function) {
+			return nil
+		}
+	}
+	return errors.New("function is not registered: " + job.Function)
+}
+
+// loadCron fetches the job named by the :id route parameter
+func loadCron(c echo.Context, db *gorm.DB) (*models.IrCron, error) {
+	id, err := parseRecordID(c)
+	if err != nil {
+		return nil, err
+	}
+	var job models.IrCron
+	if err := db.First(&job, id).Error; err != nil {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Scheduled action not found")
+	}
+	return &job, nil
+}
+
+// List returns all scheduled actions
+func (h *CronHandler) List(c echo.Context) error {
+	db := goodooHttp.MustGetGoodooRequest(c).GetDB()
+
+	var jobs []models.IrCron
+	if err := db.Order("nextcall").Find(&jobs).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"crons":     jobs,
+		"functions": cron.Functions(),
+	})
+}
+
+// Get returns one scheduled action
+func (h *CronHandler) Get(c echo.Context) error {
+	db := goodooHttp.MustGetGoodooRequest(c).GetDB()
+	job, err := loadCron(c, db)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, job)
+}
+
+// Create adds a scheduled action; it first runs at nextcall, or one period from now
+func (h *CronHandler) Create(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+
+	var body CronRequest
+	if err := c.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request format: "+err.Error())
+	}
+
+	job := &models.IrCron{IntervalNumber: 1, IntervalType: cron.UnitDays, Active: true, UserID: uint(req.GetUserID())}
+	body.apply(job)
+	if err := validateCron(job); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	if job.NextCall.IsZero() {
+		schedule, _ := cron.ScheduleOf(job)
+		job.NextCall = schedule.Next(time.Now())
+	}
+
+	// Select all columns so false booleans are not replaced by column defaults
+	if err := db.Select("*").Omit("id").Create(job).Error; err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to create scheduled action: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	req.Logger.InfoCtx(req.Context, "Scheduled action %s (%d) created by %s", job.Name, job.ID, req.GetLogin())
+	return c.JSON(http.StatusCreated, job)
+}
+
+// Update modifies a scheduled action
+func (h *CronHandler) Update(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	job, err := loadCron(c, db)
+	if err != nil {
+		return err
+	}
+
+	var body CronRequest
+	if err := c.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request format: "+err.Error())
+	}
+	body.apply(job)
+	if err := validateCron(job); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	if err := db.Save(job).Error; err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to update scheduled action %d: %v", job.ID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, job)
+}
+
+// Delete removes a scheduled action and its run history
+func (h *CronHandler) Delete(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	job, err := loadCron(c, db)
+	if err != nil {
+		return err
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("cron_id = ?", job.ID).Delete(&models.IrCronRun{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(job).Error
+	})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	req.Logger.InfoCtx(req.Context, "Scheduled action %s (%d) deleted by %s", job.Name, job.ID, req.GetLogin())
+	return c.JSON(http.StatusOK, map[string]interface{}{"success": true})
+}
+
+// RunNow executes a scheduled action immediately and returns the run
+func (h *CronHandler) RunNow(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	job, err := loadCron(c, db)
+	if err != nil {
+		return err
+	}
+
+	run, err := cron.NewRunner(req.GetDBName(), scheduler.Default().Clock()).RunNow(req.Context, job.ID)
+	if errors.Is(err, cron.ErrAlreadyRunning) {
+		return c.JSON(http.StatusConflict, map[string]string{"error": err.Error()})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	req.Logger.InfoCtx(req.Context, "Scheduled action %s (%d) run manually by %s", job.Name, job.ID, req.GetLogin())
+	return c.JSON(http.StatusOK, run)
+}
+
+// Runs returns the most recent runs of a scheduled action
+func (h *CronHandler) Runs(c echo.Context) error {
+	db := goodooHttp.MustGetGoodooRequest(c).GetDB()
+	job, err := loadCron(c, db)
+	if err != nil {
+		return err
+	}
+
+	var runs []models.IrCronRun
+	if err := db.Where("cron_id = ?", job.ID).Order("started_at DESC").Limit(50).Find(&runs).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"runs": runs})
+}
+
+// CronRunInfo is a run joined with its job name for the dashboard
+type CronRunInfo struct {
+	models.IrCronRun
+	Name string `json:"name"`
+}
+
+// Overview returns upcoming and recent runs plus the internal scheduler jobs, for the dashboard jobs view
+func (h *CronHandler) Overview(c echo.Context) error {
+	db := goodooHttp.MustGetGoodooRequest(c).GetDB()
+
+	var upcoming []models.IrCron
+	if err := db.Where("active = ?", true).Order("nextcall").Limit(20).Find(&upcoming).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	var recent []CronRunInfo
+	err := db.Table("ir_cron_run").
+		Select("ir_cron_run.*, ir_cron.name").
+		Joins("JOIN ir_cron ON ir_cron.id = ir_cron_run.cron_id").
+		Order("ir_cron_run.started_at DESC").
+		Limit(20).
+		Scan(&recent).Error
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"upcoming": upcoming,
+		"recent":   recent,
+		"internal": scheduler.Default().Jobs(),
+	})
+}
+
+// RegisterCronRoutes mounts the scheduled action endpoints under /api/cron,
+// which require the cron.manage permission
+func RegisterCronRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewCronHandler(config)
+	manage := goodooHttp.PermissionCronManage
+
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		{Method: "GET", Path: "/api/cron", Handler: handler.List, Auth: true, DB: true, Permission: manage},
+		{Method: "POST", Path: "/api/cron", Handler: handler.Create, Auth: true, DB: true, Permission: manage},
+		{Method: "GET", Path: "/api/cron/overview", Handler: handler.Overview, Auth: true, DB: true, Permission: manage},
+		{Method: "GET", Path: "/api/cron/:id", Handler: handler.Get, Auth: true, DB: true, Permission: manage},
+		{Method: "PUT", Path: "/api/cron/:id", Handler: handler.Update, Auth: true, DB: true, Permission: manage},
+		{Method: "DELETE", Path: "/api/cron/:id", Handler: handler.Delete, Auth: true, DB: true, Permission: manage},
+		{Method: "POST", Path: "/api/cron/:id/run", Handler: handler.RunNow, Auth: true, DB: true, Permission: manage},
+		{Method: "GET", Path: "/api/cron/:id/runs", Handler: handler.Runs, Auth: true, DB: true, Permission: manage},
+	})
+}
@@ -1,16 +1,31 @@
 package handlers
 
 import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"goodoo/chat"
+	"goodoo/crypto"
+	"goodoo/database"
 	goodooHttp "goodoo/http"
+	"goodoo/httpclient"
+	"goodoo/logging"
+	"goodoo/metrics"
 	"goodoo/models"
+	"goodoo/notification"
+	"goodoo/presence"
+	"goodoo/userchat"
 
 	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
 )
 
 type DashboardHandler struct {
@@ -20,21 +35,40 @@ type DashboardHandler struct {
 type DashboardData struct {
 	UserName string
 	UserRole string
+	// DisplayName prefers the user's name and falls back to the login
+	DisplayName string
+	AvatarURL   string
+	// CSPNonce authorizes the page's script tags under the Content-Security-Policy
+	CSPNonce string
 }
 
 type MetricsResponse struct {
+	// ActiveUsers counts the users with a session used in the last 15
+	// minutes, ActiveUsers1h and ActiveUsers24h in the last hour and day
 	ActiveUsers      int    `json:"active_users"`
+	ActiveUsers1h    int    `json:"active_users_1h"`
+	ActiveUsers24h   int    `json:"active_users_24h"`
 	RequestCount     int    `json:"request_count"`
 	AvgResponseTime  int    `json:"avg_response_time"`
 	Status           string `json:"status"`
 	SystemHealth     string `json:"system_health"`
 	DatabaseSize     int    `json:"database_size_mb"`
 	ActiveConnections int   `json:"active_connections"`
+	TransactionRetries int64 `json:"transaction_retries"`
+	TransactionRetriesExhausted int64 `json:"transaction_retries_exhausted"`
 }
 
 type ChartDataResponse struct {
+	From       time.Time `json:"from"`
+	To         time.Time `json:"to"`
+	Resolution string    `json:"resolution"`
 	Requests      ChartData `json:"requests"`
+	Errors        ChartData `json:"errors"`
+	// ResponseTimes is the median latency, in milliseconds
 	ResponseTimes ChartData `json:"response_times"`
+	LatencyP95    ChartData `json:"latency_p95"`
+	ActiveSessions ChartData `json:"active_sessions"`
+	ActiveUsers    ChartData `json:"active_users"`
 }
 
 type ChartData struct {
@@ -42,10 +76,12 @@ type ChartData struct {
 	Data   []int    `json:"data"`
 }
 
+// ActivityItem is an event of the activity feed: its structured form, the
+// message rendered in the user's language, and the severity as the level
+// shown by the dashboard
 type ActivityItem struct {
-	Timestamp time.Time `json:"timestamp"`
-	Message   string    `json:"message"`
-	Level     string    `json:"level"`
+	models.ActivityEntry
+	Level string `json:"level"`
 }
 
 type UserResponse struct {
@@ -55,6 +91,10 @@ type UserResponse struct {
 	Email     string    `json:"email"`
 	LastLogin time.Time `json:"last_login"`
 	Active    bool      `json:"active"`
+	DisplayName string  `json:"display_name"`
+	AvatarURL   string  `json:"avatar_url"`
+	IsService   bool    `json:"is_service"`
+	WriteDate   time.Time `json:"write_date"`
 }
 
 type SocialStatsResponse struct {
@@ -71,9 +111,13 @@ type APIMetricsResponse struct {
 }
 
 type DatabaseInfoResponse struct {
-	Status            string `json:"status"`
-	ActiveConnections int    `json:"active_connections"`
-	SizeMB            int    `json:"size_mb"`
+	Status            string                    `json:"status"`
+	ActiveConnections int                       `json:"active_connections"`
+	SizeMB            int                       `json:"size_mb"`
+	SizeBytes         int64                     `json:"size_bytes"`
+	TableCount        int                       `json:"table_count"`
+	Connections       *database.ConnectionStats `json:"connections,omitempty"`
+	Warnings          []string                  `json:"warnings,omitempty"`
 }
 
 type LogEntry struct {
@@ -86,6 +130,8 @@ type SettingsRequest struct {
 	LogLevel             string `json:"log_level"`
 	SessionTimeout       int    `json:"session_timeout"`
 	PerformanceMonitoring bool   `json:"performance_monitoring"`
+	// CORSAllowedOrigins replaces the allowed cross-origin callers when set
+	CORSAllowedOrigins   *string `json:"cors_allowed_origins,omitempty"`
 }
 
 type CreateUserRequest struct {
@@ -94,11 +140,13 @@ type CreateUserRequest struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
 	Active   bool   `json:"active"`
+	// Invite emails the user a link to choose their own password
+	Invite   bool   `json:"invite"`
 }
 
 // LLM Integration Types
 type LLMProvider struct {
-	ID       int                    `json:"id"`
+	ID       uint                   `json:"id"`
 	Name     string                 `json:"name"`
 	Service  string                 `json:"service"`
 	Active   bool                   `json:"active"`
@@ -109,45 +157,29 @@ type LLMProvider struct {
 }
 
 type LLMModel struct {
-	ID         int    `json:"id"`
+	ID         uint   `json:"id"`
 	Name       string `json:"name"`
 	ModelName  string `json:"model_name"`
 	Active     bool   `json:"active"`
-	ProviderID int    `json:"provider_id"`
+	ProviderID uint   `json:"provider_id"`
 	Type       string `json:"type"` // chat, embedding, etc.
-}
-
-type LLMAddonStatus struct {
-	Name        string `json:"name"`
-	DisplayName string `json:"display_name"`
-	Installed   bool   `json:"installed"`
-	Active      bool   `json:"active"`
-	Version     string `json:"version"`
-	Category    string `json:"category"`
-	Description string `json:"description"`
+	// ContextWindow is in tokens, 0 when unknown
+	ContextWindow int `json:"context_window"`
 }
 
 type LLMToolsResponse struct {
-	Providers []LLMProvider    `json:"providers"`
-	Addons    []LLMAddonStatus `json:"addons"`
-	Summary   LLMSummary       `json:"summary"`
-}
-
-type LLMSummary struct {
-	TotalProviders   int `json:"total_providers"`
-	ActiveProviders  int `json:"active_providers"`
-	TotalModels      int `json:"total_models"`
-	ActiveModels     int `json:"active_models"`
-	InstalledAddons  int `json:"installed_addons"`
+	Providers []LLMProvider     `json:"providers"`
+	Addons    []models.LLMAddon `json:"addons"`
+	Summary   models.LLMSummary `json:"summary"`
 }
 
 type LLMConfigRequest struct {
-	ProviderID int                    `json:"provider_id"`
+	ProviderID uint                   `json:"provider_id"`
 	Config     map[string]interface{} `json:"config"`
 }
 
 type LLMTestRequest struct {
-	ProviderID int    `json:"provider_id"`
+	ProviderID uint   `json:"provider_id"`
 	ModelName  string `json:"model_name,omitempty"`
 }
 
@@ -166,6 +198,10 @@ type ChatMessage struct {
 	Timestamp time.Time              `json:"timestamp"`
 	Model     string                 `json:"model,omitempty"`
 	Metadata  map[string]interface{} `json:"metadata,omitempty"`
+	// ContentType is "markdown" or "text"; RenderedHTML is the sanitized
+	// HTML of Content
+	ContentType  string `json:"content_type"`
+	RenderedHTML string `json:"rendered_html"`
 }
 
 type ChatSession struct {
@@ -173,21 +209,35 @@ type ChatSession struct {
 	UserID    int           `json:"user_id"`
 	Title     string        `json:"title"`
 	Model     string        `json:"model"`
-	Messages  []ChatMessage `json:"messages"`
-	CreatedAt time.Time     `json:"created_at"`
-	UpdatedAt time.Time     `json:"updated_at"`
-	Active    bool          `json:"active"`
+	// TitleManual is set when the user chose the title
+	TitleManual bool          `json:"title_manual"`
+	Messages    []ChatMessage `json:"messages,omitempty"`
+	CreatedAt   time.Time     `json:"created_at"`
+	UpdatedAt   time.Time     `json:"updated_at"`
+	Active      bool          `json:"active"`
+	Archived    bool          `json:"archived"`
+	// UseKnowledge augments messages with knowledge base excerpts
+	UseKnowledge bool `json:"use_knowledge"`
 }
 
 type ChatRequest struct {
 	Message   string `json:"message"`
 	Model     string `json:"model"`
 	SessionID string `json:"session_id,omitempty"`
+	// UseKnowledge carries the session toggle retrieving knowledge base excerpts
+	UseKnowledge bool `json:"use_knowledge,omitempty"`
+	// ContentType of the message, "markdown" by default
+	ContentType string `json:"content_type,omitempty"`
+	// TemplateID sends the prompt template rendered with Variables; the
+	// message, optional then, follows the rendered template
+	TemplateID uint              `json:"template_id,omitempty"`
+	Variables  map[string]string `json:"variables,omitempty"`
 }
 
 type ChatResponse struct {
 	ID            string    `json:"id"`
 	Message       string    `json:"message"`
+	RenderedHTML  string    `json:"rendered_html"` // sanitized HTML of the Markdown answer
 	Model         string    `json:"model"`
 	SessionID     string    `json:"session_id"`
 	Timestamp     time.Time `json:"timestamp"`
@@ -195,6 +245,8 @@ type ChatResponse struct {
 	TokensUsed    int       `json:"tokens_used,omitempty"`
 	FinishReason  string    `json:"finish_reason,omitempty"`
 	Error         string    `json:"error,omitempty"`
+	// Metadata holds e.g. the knowledge base citations of the answer
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
 }
 
 type ChatSessionsResponse struct {
@@ -207,18 +259,28 @@ type StreamChatResponse struct {
 	Done      bool   `json:"done"`
 	MessageID string `json:"message_id,omitempty"`
 	Error     string `json:"error,omitempty"`
+	// Response is the stored answer, on the last event
+	Response *ChatResponse `json:"response,omitempty"`
 }
 
 // User-to-User Chat Types
 type UserChatMessage struct {
-	ID          string    `json:"id"`
-	FromUserID  int       `json:"from_user_id"`
-	ToUserID    int       `json:"to_user_id"`
-	Content     string    `json:"content"`
-	MessageType string    `json:"message_type"` // "text", "file", "image"
-	Timestamp   time.Time `json:"timestamp"`
-	ReadAt      *time.Time `json:"read_at,omitempty"`
-	EditedAt    *time.Time `json:"edited_at,omitempty"`
+	ID          string `json:"id"`
+	FromUserID  int    `json:"from_user_id"`
+	ToUserID    int    `json:"to_user_id"`
+	Content     string `json:"content"`
+	MessageType string `json:"message_type"` // "text", "file", "image"
+	// ContentType is "markdown" or "text"; RenderedHTML is the sanitized
+	// HTML of Content, with the resolved Mentions highlighted
+	ContentType  string               `json:"content_type"`
+	RenderedHTML string               `json:"rendered_html"`
+	Mentions     []models.ChatMention `json:"mentions,omitempty"`
+	Timestamp    time.Time            `json:"timestamp"`
+	ReadAt       *time.Time           `json:"read_at,omitempty"`
+	EditedAt     *time.Time           `json:"edited_at,omitempty"`
+	// Room is the room of the message; Delivery summarizes its receipts
+	Room     string                 `json:"room,omitempty"`
+	Delivery *models.ReceiptSummary `json:"delivery,omitempty"`
 }
 
 type UserChatRoom struct {
@@ -237,8 +299,37 @@ type UserChatParticipant struct {
 	UserName   string    `json:"user_name"`
 	UserEmail  string    `json:"user_email"`
 	IsOnline   bool      `json:"is_online"`
+	State      string    `json:"state"`
 	LastSeen   time.Time `json:"last_seen"`
 	JoinedAt   time.Time `json:"joined_at"`
+	DisplayName string   `json:"display_name"`
+	AvatarURL   string   `json:"avatar_url"`
+}
+
+// applyPresence fills the presence of chat participants
+func applyPresence(dbName string, participants []UserChatParticipant) {
+	ids := make([]uint, len(participants))
+	for i, participant := range participants {
+		ids[i] = uint(participant.UserID)
+	}
+	statuses := presence.Get(dbName, ids)
+	for i := range participants {
+		status := statuses[uint(participants[i].UserID)]
+		participants[i].State = status.State
+		participants[i].IsOnline = status.IsOnline()
+		participants[i].LastSeen = status.LastSeen
+	}
+}
+
+// newChatParticipant builds the participant entry of a user
+func newChatParticipant(user *models.User) UserChatParticipant {
+	return UserChatParticipant{
+		UserID:      int(user.ID),
+		UserName:    user.Name,
+		UserEmail:   user.Email,
+		DisplayName: user.DisplayName(),
+		AvatarURL:   avatarURL(user, 128),
+	}
 }
 
 type SendUserMessageRequest struct {
@@ -246,6 +337,8 @@ type SendUserMessageRequest struct {
 	RoomID      string `json:"room_id,omitempty"`
 	Content     string `json:"content"`
 	MessageType string `json:"message_type"`
+	// ContentType of Content, "markdown" by default
+	ContentType string `json:"content_type,omitempty"`
 }
 
 type UserChatResponse struct {
@@ -260,10 +353,19 @@ type CreateGroupChatRequest struct {
 	ParticipantIDs []int `json:"participant_ids"`
 }
 
+// UserPresenceUpdate is the presence of a user. Posted by a client as the
+// HTTP heartbeat, is_online false closes the device and active false tells
+// the user was idle since the previous heartbeat; the device defaults to
+// the session.
 type UserPresenceUpdate struct {
 	UserID   int       `json:"user_id"`
 	IsOnline bool      `json:"is_online"`
+	State    string    `json:"state"`
 	LastSeen time.Time `json:"last_seen"`
+	DeviceID string    `json:"device_id,omitempty"`
+	Active   *bool     `json:"active,omitempty"`
+	DisplayName string `json:"display_name,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
 }
 
 func NewDashboardHandler(config *goodooHttp.RequestConfig) *DashboardHandler {
@@ -275,14 +377,13 @@ func NewDashboardHandler(config *goodooHttp.RequestConfig) *DashboardHandler {
 // DashboardPage renders the main dashboard page
 func (h *DashboardHandler) DashboardPage(c echo.Context) error {
 	// Get user information from Goodoo request
-	req := goodooHttp.GetGoodooRequest(c)
-	if req == nil {
-		return echo.NewHTTPError(500, "Request context not found")
-	}
+	req := goodooHttp.MustGetGoodooRequest(c)
 	
 	data := DashboardData{
 		UserName: "Administrator",
 		UserRole: "Admin",
+		DisplayName: "Administrator",
+		CSPNonce: goodooHttp.CSPNonce(c),
 	}
 	
 	if req.IsAuthenticated() {
@@ -293,31 +394,52 @@ func (h *DashboardHandler) DashboardPage(c echo.Context) error {
 			if err := db.First(&user, req.GetUserID()).Error; err == nil {
 				data.UserName = user.Name
 				data.UserRole = "User" // You can extend this with actual roles
+				data.DisplayName = user.DisplayName()
+				data.AvatarURL = avatarURL(&user, 128)
 			}
 		}
 	}
 	
+	c.Response().Header().Set("Cache-Control", "no-cache")
 	return c.Render(http.StatusOK, "dashboard.html", data)
 }
 
 // GetMetrics returns dashboard metrics
 func (h *DashboardHandler) GetMetrics(c echo.Context) error {
-	req := goodooHttp.GetGoodooRequest(c)
-	if req == nil {
-		return echo.NewHTTPError(500, "Request context not found")
-	}
+	req := goodooHttp.MustGetGoodooRequest(c)
 	db := req.GetDB()
 	if db == nil {
 		return echo.NewHTTPError(500, "Database not available")
 	}
 	
-	// Count total users
-	var totalUsers int64
-	db.Model(&models.User{}).Count(&totalUsers)
-	
-	// Count active users (users with recent activity - using WriteDate as proxy for last activity)
-	var activeUsers int64
-	db.Model(&models.User{}).Where("write_date > ? AND active = true", time.Now().Add(-24*time.Hour)).Count(&activeUsers)
+	return c.JSON(http.StatusOK, h.collectMetrics(req, db, h.sessionStats(req.GetDBName())))
+}
+
+// sessionStats returns the session statistics of a database, or nil when
+// the session store does not report them
+func (h *DashboardHandler) sessionStats(dbName string) *goodooHttp.SessionStats {
+	store, ok := h.config.SessionStore.(goodooHttp.SessionStatsSource)
+	if !ok {
+		return nil
+	}
+	stats := store.Stats(dbName)
+	return &stats
+}
+
+// collectMetrics computes the metrics snapshot, counting the active users
+// from the session statistics when there are some
+func (h *DashboardHandler) collectMetrics(req *goodooHttp.Request, db *gorm.DB, sessions *goodooHttp.SessionStats) MetricsResponse {
+	// Count active users from the sessions used recently, or from the
+	// users changed in the last day with a store that cannot tell
+	var activeUsers, activeUsers1h, activeUsers24h int64
+	if sessions != nil {
+		activeUsers = int64(sessions.ActiveUsers["15m"])
+		activeUsers1h = int64(sessions.ActiveUsers["1h"])
+		activeUsers24h = int64(sessions.ActiveUsers["24h"])
+	} else {
+		db.Model(&models.User{}).Where("write_date > ? AND active = true", time.Now().Add(-24*time.Hour)).Count(&activeUsers)
+		activeUsers1h, activeUsers24h = activeUsers, activeUsers
+	}
 	
 	// Calculate system health based on database connectivity and user activity
 	systemHealth := "Healthy"
@@ -329,10 +451,20 @@ func (h *DashboardHandler) GetMetrics(c echo.Context) error {
 	
 	// Get database size info
 	var dbSize int
-	sqlDB, err := db.DB()
-	if err == nil {
-		stats := sqlDB.Stats()
-		dbSize = stats.OpenConnections * 10 // Rough estimate
+	if size, err := database.CachedDatabaseSize(req.GetDBName()); err == nil {
+		dbSize = int(size / (1024 * 1024))
+	} else {
+		req.Logger.WarningCtx(req.Context, "Failed to get database size: %v", err)
+	}
+	
+	activeConnections := 0
+	if connStats, err := database.CachedConnectionStats(req.GetDBName()); connStats != nil {
+		activeConnections = connStats.Pool.InUse
+		if connStats.Total > 0 {
+			activeConnections = connStats.Total
+		}
+	} else if err != nil {
+		req.Logger.WarningCtx(req.Context, "Failed to get connection stats: %v", err)
 	}
 	
 	// Calculate average response time based on recent performance
@@ -341,138 +473,272 @@ func (h *DashboardHandler) GetMetrics(c echo.Context) error {
 	// Request count - simulate increasing numbers
 	requestCount := 1200 + int(time.Now().Unix()%500)
 	
+	retries, exhaustions := database.RetryStats()
+	
 	response := MetricsResponse{
 		ActiveUsers:       int(activeUsers),
+		ActiveUsers1h:     int(activeUsers1h),
+		ActiveUsers24h:    int(activeUsers24h),
 		RequestCount:      requestCount,
 		AvgResponseTime:   avgResponseTime,
 		Status:            healthStatus,
 		SystemHealth:      systemHealth,
 		DatabaseSize:      dbSize,
-		ActiveConnections: int(totalUsers),
+		ActiveConnections: activeConnections,
+		TransactionRetries: retries,
+		TransactionRetriesExhausted: exhaustions,
 	}
 	
-	return c.JSON(http.StatusOK, response)
+	return response
 }
 
-// GetChartData returns data for dashboard charts
-func (h *DashboardHandler) GetChartData(c echo.Context) error {
-	// Generate realistic data for the last 24 hours
-	now := time.Now()
-	labels := make([]string, 24)
-	requestData := make([]int, 24)
-	responseData := make([]int, 24)
-	
-	// Base values that change throughout the day
-	baseRequests := 50
-	baseResponse := 120
-	
-	for i := 0; i < 24; i++ {
-		hourTime := now.Add(time.Duration(i-23) * time.Hour)
-		labels[i] = hourTime.Format("15:04")
-		
-		// Simulate realistic traffic patterns (higher during business hours)
-		hour := hourTime.Hour()
-		trafficMultiplier := 1.0
-		if hour >= 9 && hour <= 17 { // Business hours
-			trafficMultiplier = 2.0 + float64(hour-9)*0.1
-		} else if hour >= 18 && hour <= 22 { // Evening
-			trafficMultiplier = 1.5
-		} else { // Night/early morning
-			trafficMultiplier = 0.5
+// requestLocation returns the timezone of the session, or UTC
+func requestLocation(req *goodooHttp.Request) *time.Location {
+	if req.Session != nil {
+		if tz, ok := req.Session.GetContext()["tz"].(string); ok && goodooHttp.ValidTimezone(tz) {
+			if loc, err := time.LoadLocation(tz); err == nil {
+				return loc
+			}
 		}
-		
-		// Add some randomness but keep it realistic
-		requests := int(float64(baseRequests) * trafficMultiplier * (0.8 + 0.4*float64(i%7)/6.0))
-		response := int(float64(baseResponse) * (1.0 + 0.3*float64(i%5)/4.0))
-		
-		// Add some noise
-		requests += int(time.Now().Unix()+int64(i)) % 20
-		response += int(time.Now().Unix()+int64(i*2)) % 30
-		
-		requestData[i] = requests
-		responseData[i] = response
 	}
-	
-	response := ChartDataResponse{
-		Requests: ChartData{
-			Labels: labels,
-			Data:   requestData,
-		},
-		ResponseTimes: ChartData{
-			Labels: labels,
-			Data:   responseData,
-		},
+	return time.UTC
+}
+
+// parseMetricsTime parses a from/to parameter, RFC 3339 or a date
+func parseMetricsTime(value string, loc *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.In(loc), nil
 	}
-	
-	return c.JSON(http.StatusOK, response)
+	return time.ParseInLocation("2006-01-02", value, loc)
+}
+
+// parseMetricsRange reads ?from=&to=&resolution=, defaulting to the last
+// 24 hours and a resolution fitting the range
+func parseMetricsRange(c echo.Context, loc *time.Location) (from, to time.Time, resolution string, err error) {
+	to = time.Now().In(loc)
+	if value := c.QueryParam("to"); value != "" {
+		if to, err = parseMetricsTime(value, loc); err != nil {
+			return from, to, "", fmt.Errorf("invalid to: %s", value)
+		}
+	}
+	from = to.Add(-24 * time.Hour)
+	if value := c.QueryParam("from"); value != "" {
+		if from, err = parseMetricsTime(value, loc); err != nil {
+			return from, to, "", fmt.Errorf("invalid from: %s", value)
+		}
+	}
+	if !from.Before(to) {
+		return from, to, "", fmt.Errorf("from must be before to")
+	}
+
+	resolution = c.QueryParam("resolution")
+	switch span := to.Sub(from); {
+	case resolution != "":
+		if !metrics.ValidResolution(resolution) {
+			return from, to, "", fmt.Errorf("invalid resolution: %s", resolution)
+		}
+	case span <= 6*time.Hour:
+		resolution = models.MetricsMinute
+	case span <= 14*24*time.Hour:
+		resolution = models.MetricsHour
+	default:
+		resolution = models.MetricsDay
+	}
+	return from, to, resolution, nil
+}
+
+// GetChartData returns the request and latency history for the dashboard
+// charts: ?from=&to= (RFC 3339 or dates, default the last 24 hours) and
+// ?resolution=minute|hour|day (default fitting the range)
+func (h *DashboardHandler) GetChartData(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	if db == nil {
+		return echo.NewHTTPError(500, "Database not available")
+	}
+
+	loc := requestLocation(req)
+	from, to, resolution, err := parseMetricsRange(c, loc)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	series, err := metrics.Series(db, req.GetDBName(), from, to, resolution)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, chartResponse(series, from, to, resolution, loc))
+}
+
+// chartResponse lays out metrics samples as the chart series, labelled in
+// loc
+func chartResponse(series []models.MetricsSample, from, to time.Time, resolution string, loc *time.Location) ChartDataResponse {
+	layout := "15:04"
+	switch {
+	case resolution == models.MetricsDay:
+		layout = "Jan 02"
+	case to.Sub(from) > 24*time.Hour:
+		layout = "Jan 02 15:04"
+	}
+	labels := make([]string, len(series))
+	requestData := make([]int, len(series))
+	errorData := make([]int, len(series))
+	latencyData := make([]int, len(series))
+	latencyP95Data := make([]int, len(series))
+	sessionData := make([]int, len(series))
+	userData := make([]int, len(series))
+	for i, sample := range series {
+		labels[i] = sample.Timestamp.In(loc).Format(layout)
+		requestData[i] = int(sample.RequestCount)
+		errorData[i] = int(sample.ErrorCount)
+		latencyData[i] = int(math.Round(sample.LatencyP50))
+		latencyP95Data[i] = int(math.Round(sample.LatencyP95))
+		sessionData[i] = sample.ActiveSessions
+		userData[i] = sample.ActiveUsers
+	}
+
+	return ChartDataResponse{
+		From:           from,
+		To:             to,
+		Resolution:     resolution,
+		Requests:       ChartData{Labels: labels, Data: requestData},
+		Errors:         ChartData{Labels: labels, Data: errorData},
+		ResponseTimes:  ChartData{Labels: labels, Data: latencyData},
+		LatencyP95:     ChartData{Labels: labels, Data: latencyP95Data},
+		ActiveSessions: ChartData{Labels: labels, Data: sessionData},
+		ActiveUsers:    ChartData{Labels: labels, Data: userData},
+	}
+}
+
+// ExportMetrics streams the raw metrics samples as CSV: ?from=&to= as for
+// the charts, and an optional ?resolution= keeping one resolution
+func (h *DashboardHandler) ExportMetrics(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	if db == nil {
+		return echo.NewHTTPError(500, "Database not available")
+	}
+
+	from, to, _, err := parseMetricsRange(c, requestLocation(req))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	resolution := c.QueryParam("resolution")
+	if resolution != "" && !metrics.ValidResolution(resolution) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid resolution: " + resolution})
+	}
+
+	filename := fmt.Sprintf("metrics-%s-%s.csv", from.Format("20060102T1504"), to.Format("20060102T1504"))
+	c.Response().Header().Set(echo.HeaderContentType, "text/csv; charset=utf-8")
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", filename))
+	c.Response().WriteHeader(http.StatusOK)
+	if err := metrics.WriteCSV(c.Response(), db, req.GetDBName(), from, to, resolution); err != nil {
+		// The status is sent already; the truncated file is all we can do
+		req.Logger.ErrorCtx(req.Context, "Failed to export metrics: %v", err)
+	}
+	return nil
 }
 
-// GetRecentActivity returns recent system activity
+// GetRecentActivity returns the recent events of the activity feed, newest
+// first, with their message in the user's language. Filters: ?type= types
+// or categories and ?severity=, both comma-separated, and ?limit= (20 by
+// default, at most 100). Only administrators see the events of other users.
 func (h *DashboardHandler) GetRecentActivity(c echo.Context) error {
-	activities := []ActivityItem{
-		{
-			Timestamp: time.Now().Add(-2 * time.Minute),
-			Message:   "User admin logged in",
-			Level:     "INFO",
-		},
-		{
-			Timestamp: time.Now().Add(-5 * time.Minute),
-			Message:   "API endpoint /api/models called",
-			Level:     "SUCCESS",
-		},
-		{
-			Timestamp: time.Now().Add(-10 * time.Minute),
-			Message:   "Database connection established",
-			Level:     "INFO",
-		},
-		{
-			Timestamp: time.Now().Add(-15 * time.Minute),
-			Message:   "Session cleanup completed",
-			Level:     "INFO",
-		},
-		{
-			Timestamp: time.Now().Add(-20 * time.Minute),
-			Message:   "System health check passed",
-			Level:     "SUCCESS",
-		},
+	req := goodooHttp.MustGetGoodooRequest(c)
+	env := req.GetEnv()
+	if env == nil {
+		return echo.NewHTTPError(500, "Database not available")
+	}
+
+	filter := models.ActivityFilter{
+		Types:      goodooHttp.SplitList(c.QueryParam("type")),
+		Severities: goodooHttp.SplitList(c.QueryParam("severity")),
+		Limit:      20,
+	}
+	if limit, err := strconv.Atoi(c.QueryParam("limit")); err == nil && limit > 0 {
+		filter.Limit = min(limit, 100)
+	}
+	if !env.HasGroup(goodooHttp.GroupSystem) {
+		filter.UserID = env.GetUser()
+	}
+
+	activities, err := recentActivity(env, filter)
+	if err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to read the activity feed: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to read the activity feed",
+		})
 	}
-	
 	return c.JSON(http.StatusOK, activities)
 }
 
+// recentActivity lists the events of the activity feed matching filter,
+// rendered in the language of the environment
+func recentActivity(env *models.Environment, filter models.ActivityFilter) ([]ActivityItem, error) {
+	entries, err := models.ListActivities(env.GetDB(), filter)
+	if err == nil {
+		err = models.RenderActivities(env.GetDB(), entries, env.Lang())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	activities := make([]ActivityItem, len(entries))
+	for i, entry := range entries {
+		activities[i] = ActivityItem{ActivityEntry: entry, Level: strings.ToUpper(entry.Severity)}
+	}
+	return activities, nil
+}
+
 // GetUsers returns user list for user management section
 func (h *DashboardHandler) GetUsers(c echo.Context) error {
-	req := goodooHttp.GetGoodooRequest(c)
-	if req == nil {
-		return echo.NewHTTPError(500, "Request context not found")
-	}
-	db := req.GetDB()
-	if db == nil {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	env := req.GetEnv()
+	if env == nil {
 		return echo.NewHTTPError(500, "Database not available")
 	}
 	
+	// Service accounts are listed with ?include_service=1 only; the public
+	// user is never listed
+	query := env.GetDB().Where("login <> ?", models.PublicUserLogin)
+	if includeService, _ := strconv.ParseBool(c.QueryParam("include_service")); !includeService {
+		query = query.Where("is_service = ?", false)
+	}
 	var users []models.User
-	if err := db.Find(&users).Error; err != nil {
+	if err := query.Find(&users).Error; err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{
 			"error": "Failed to fetch users",
 		})
 	}
 	
 	response := make([]UserResponse, len(users))
-	for i, user := range users {
-		response[i] = UserResponse{
-			ID:        user.ID,
-			Login:     user.Login,
-			Name:      user.Name,
-			Email:     user.Email,
-			LastLogin: user.WriteDate, // Using WriteDate as a proxy for last activity
-			Active:    true, // You can add an Active field to the User model
-		}
+	for i := range users {
+		response[i] = userResponse(&users[i])
 	}
 	
 	return c.JSON(http.StatusOK, response)
 }
 
+// userResponse returns the API form of a user, as listed by GetUsers
+func userResponse(user *models.User) UserResponse {
+	// Users who never logged in since login_date was added fall back to their last write
+	lastLogin := user.WriteDate
+	if user.LastLogin != nil {
+		lastLogin = *user.LastLogin
+	}
+	return UserResponse{
+		ID:          user.ID,
+		Login:       user.Login,
+		Name:        user.Name,
+		Email:       user.Email,
+		LastLogin:   lastLogin,
+		Active:      user.Active,
+		DisplayName: user.DisplayName(),
+		AvatarURL:   avatarURL(user, 128),
+		IsService:   user.IsService,
+		WriteDate:   user.WriteDate,
+	}
+}
+
 // GetSocialStats returns social media integration statistics
 func (h *DashboardHandler) GetSocialStats(c echo.Context) error {
 	// In a real implementation, this would query the Odoo social media module
@@ -498,39 +764,137 @@ func (h *DashboardHandler) GetAPIMetrics(c echo.Context) error {
 	return c.JSON(http.StatusOK, response)
 }
 
+// GetOutboundMetrics returns the calls made to other systems per host:
+// count, errors, latency and the state of its circuit
+func (h *DashboardHandler) GetOutboundMetrics(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"hosts": httpclient.Stats(),
+	})
+}
+
 // GetDatabaseInfo returns database information
 func (h *DashboardHandler) GetDatabaseInfo(c echo.Context) error {
-	req := goodooHttp.GetGoodooRequest(c)
-	if req == nil {
-		return echo.NewHTTPError(500, "Request context not found")
+	req := goodooHttp.MustGetGoodooRequest(c)
+	
+	response, err := collectDatabaseInfo(req)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, response)
 	}
-	db := req.GetDB()
-	if db == nil {
-		return echo.NewHTTPError(500, "Database not available")
+	return c.JSON(http.StatusOK, response)
+}
+
+// collectDatabaseInfo describes the connections, size and tables of the
+// request database; it fails only when the connections cannot be read,
+// the other statistics being reported as warnings
+func collectDatabaseInfo(req *goodooHttp.Request) (DatabaseInfoResponse, error) {
+	dbName := req.GetDBName()
+	
+	connStats, err := database.CachedConnectionStats(dbName)
+	if connStats == nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to get connection stats: %v", err)
+		if err == nil {
+			err = errors.New("connection stats unavailable")
+		}
+		return DatabaseInfoResponse{Status: "Error"}, err
+	}
+	
+	response := DatabaseInfoResponse{
+		Status:            "Connected",
+		ActiveConnections: connStats.Pool.OpenConnections,
+		Connections:       connStats,
+	}
+	if err != nil {
+		response.Warnings = append(response.Warnings, "connection activity unavailable")
+	}
+	if connStats.Restricted {
+		response.Warnings = append(response.Warnings, "pg_stat_activity is restricted for this role")
+	}
+	
+	// Size and table statistics degrade gracefully on managed PostgreSQL
+	if size, err := database.CachedDatabaseSize(dbName); err == nil {
+		response.SizeBytes = size
+		response.SizeMB = int(size / (1024 * 1024))
+	} else {
+		req.Logger.WarningCtx(req.Context, "Failed to get database size: %v", err)
+		response.Warnings = append(response.Warnings, "database size unavailable")
+	}
+	
+	if tables, err := database.CachedTableStats(dbName); err == nil {
+		response.TableCount = len(tables)
+	} else {
+		req.Logger.WarningCtx(req.Context, "Failed to get table stats: %v", err)
+		response.Warnings = append(response.Warnings, "table statistics unavailable")
 	}
 	
-	// Check database connection
-	sqlDB, err := db.DB()
+	return response, nil
+}
+
+// GetDatabaseTables returns per-table statistics, sortable by any numeric column
+func (h *DashboardHandler) GetDatabaseTables(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	
+	tables, err := database.CachedTableStats(req.GetDBName())
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, DatabaseInfoResponse{
-			Status:            "Error",
-			ActiveConnections: 0,
-			SizeMB:            0,
+		if database.IsPermissionError(err) {
+			return c.JSON(http.StatusForbidden, map[string]string{
+				"error": "Table statistics are not readable by the database role",
+			})
+		}
+		req.Logger.ErrorCtx(req.Context, "Failed to get table stats: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to get table statistics",
 		})
 	}
 	
-	stats := sqlDB.Stats()
+	sortBy := c.QueryParam("sort")
+	if sortBy == "" {
+		sortBy = "total_bytes"
+	}
+	keys := map[string]func(t database.TableStat) float64{
+		"total_bytes":  func(t database.TableStat) float64 { return float64(t.TotalBytes) },
+		"table_bytes":  func(t database.TableStat) float64 { return float64(t.TableBytes) },
+		"index_bytes":  func(t database.TableStat) float64 { return float64(t.IndexBytes) },
+		"row_estimate": func(t database.TableStat) float64 { return float64(t.RowEstimate) },
+		"dead_rows":    func(t database.TableStat) float64 { return float64(t.DeadRows) },
+		"bloat_ratio":  func(t database.TableStat) float64 { return t.BloatRatio },
+		"seq_scans":    func(t database.TableStat) float64 { return float64(t.SeqScans) },
+	}
 	
-	response := DatabaseInfoResponse{
-		Status:            "Connected",
-		ActiveConnections: stats.OpenConnections,
-		SizeMB:            248, // This would require a database-specific query
+	// Copy before sorting, the slice is shared with the cache
+	sorted := make([]database.TableStat, len(tables))
+	copy(sorted, tables)
+	desc := c.QueryParam("order") != "asc"
+	
+	if sortBy == "name" {
+		sort.SliceStable(sorted, func(i, j int) bool {
+			if desc {
+				return sorted[i].Name > sorted[j].Name
+			}
+			return sorted[i].Name < sorted[j].Name
+		})
+	} else {
+		key, ok := keys[sortBy]
+		if !ok {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": fmt.Sprintf("Invalid sort field: %s", sortBy),
+			})
+		}
+		sort.SliceStable(sorted, func(i, j int) bool {
+			if desc {
+				return key(sorted[i]) > key(sorted[j])
+			}
+			return key(sorted[i]) < key(sorted[j])
+		})
 	}
 	
-	return c.JSON(http.StatusOK, response)
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"tables": sorted,
+		"count":  len(sorted),
+		"sort":   sortBy,
+	})
 }
 
-// GetRecentLogs returns recent system logs
+// GetRecentLogs returns the recent system logs, newest first
 func (h *DashboardHandler) GetRecentLogs(c echo.Context) error {
 	// Get optional level filter
 	levelFilter := c.QueryParam("level")
@@ -543,40 +907,22 @@ func (h *DashboardHandler) GetRecentLogs(c echo.Context) error {
 		}
 	}
 	
-	// In a real implementation, this would read from the actual log files or database
-	logs := []LogEntry{
-		{
-			Timestamp: time.Now().Add(-1 * time.Minute),
-			Level:     "INFO",
-			Message:   "Dashboard API endpoint accessed",
-		},
-		{
-			Timestamp: time.Now().Add(-3 * time.Minute),
-			Level:     "INFO",
-			Message:   "User authentication successful",
-		},
-		{
-			Timestamp: time.Now().Add(-5 * time.Minute),
-			Level:     "DEBUG",
-			Message:   "Database query executed in 45ms",
-		},
-		{
-			Timestamp: time.Now().Add(-8 * time.Minute),
-			Level:     "WARN",
-			Message:   "High memory usage detected: 78%",
-		},
-		{
-			Timestamp: time.Now().Add(-12 * time.Minute),
-			Level:     "INFO",
-			Message:   "Session cleanup completed successfully",
-		},
+	// The latest records of the ring buffer of the logging tap
+	records := logging.DefaultTap().Recent(logging.TapFilter{}, logging.RecentRecords)
+	logs := make([]LogEntry, 0, len(records))
+	for i := len(records) - 1; i >= 0; i-- {
+		logs = append(logs, LogEntry{
+			Timestamp: records[i].Timestamp,
+			Level:     records[i].Level.String(),
+			Message:   records[i].Message,
+		})
 	}
 	
 	// Filter by level if specified
 	if levelFilter != "" && levelFilter != "all" {
 		filtered := make([]LogEntry, 0)
 		for _, log := range logs {
-			if log.Level == levelFilter {
+			if strings.EqualFold(log.Level, levelFilter) {
 				filtered = append(filtered, log)
 			}
 		}
@@ -591,20 +937,34 @@ func (h *DashboardHandler) GetRecentLogs(c echo.Context) error {
 	return c.JSON(http.StatusOK, logs)
 }
 
-// GetSettings returns current system settings
-func (h *DashboardHandler) GetSettings(c echo.Context) error {
-	// In a real implementation, this would read from configuration
-	settings := map[string]interface{}{
-		"log_level":             "info",
-		"session_timeout":       60,
-		"performance_monitoring": true,
+// settings returns the system settings of a database as GetSettings
+// answers them
+func settings(dbName string) map[string]interface{} {
+	return map[string]interface{}{
+		"log_level":              models.GetParamString(dbName, models.ParamLogLevel, "info"),
+		"session_timeout":        models.GetParamInt(dbName, models.ParamSessionTimeout, 1440),
+		"performance_monitoring": models.GetParamBool(dbName, models.ParamPerformanceMonitoring, true),
+		"cors_allowed_origins":   models.GetParamString(dbName, models.ParamCORSAllowedOrigins, ""),
 	}
-	
-	return c.JSON(http.StatusOK, settings)
 }
 
-// SaveSettings saves system settings
+// GetSettings returns the system settings stored as system parameters
+func (h *DashboardHandler) GetSettings(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	return c.JSON(http.StatusOK, settings(req.DB))
+}
+
+// SaveSettings stores the system settings as system parameters
+// (settings.write) and answers with them as GetSettings would, or with a
+// message under Prefer: return=minimal. The parameter cache is invalidated
+// on commit, so they are read as stored.
 func (h *DashboardHandler) SaveSettings(c echo.Context) error {
+	goodooReq := goodooHttp.MustGetGoodooRequest(c)
+	db := goodooReq.GetDB()
+	if db == nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database not available")
+	}
+
 	var req SettingsRequest
 	if err := c.Bind(&req); err != nil {
 		return c.JSON(http.StatusBadRequest, map[string]string{
@@ -612,49 +972,88 @@ func (h *DashboardHandler) SaveSettings(c echo.Context) error {
 		})
 	}
 	
-	// Validate log level
-	validLevels := map[string]bool{
-		"debug": true, "info": true, "warn": true, "error": true, "critical": true,
-	}
-	if !validLevels[req.LogLevel] {
-		return c.JSON(http.StatusBadRequest, map[string]string{
-			"error": "Invalid log level",
-		})
+	// The values are validated by the subsystems reading them and written
+	// together: a refused value leaves every setting untouched
+	uid := uint(goodooReq.GetUserID())
+	values := map[string]interface{}{
+		models.ParamLogLevel:              req.LogLevel,
+		models.ParamSessionTimeout:        req.SessionTimeout,
+		models.ParamPerformanceMonitoring: req.PerformanceMonitoring,
+	}
+	if req.CORSAllowedOrigins != nil {
+		values[models.ParamCORSAllowedOrigins] = strings.Join(goodooHttp.SplitList(*req.CORSAllowedOrigins), ",")
+	}
+	if _, err := models.SetParams(db, goodooReq.DB, uid, values); err != nil {
+		var invalid *models.ParamValidationError
+		if errors.As(err, &invalid) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": invalid.Err.Error(), "key": invalid.Key})
+		}
+		goodooReq.Logger.ErrorCtx(goodooReq.Context, "Failed to save settings: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to save settings"})
 	}
 	
-	// Validate session timeout
-	if req.SessionTimeout < 5 || req.SessionTimeout > 480 {
-		return c.JSON(http.StatusBadRequest, map[string]string{
-			"error": "Session timeout must be between 5 and 480 minutes",
+	goodooReq.Logger.InfoCtx(goodooReq.Context, "Settings updated: log_level=%s, session_timeout=%d, performance_monitoring=%t",
+		req.LogLevel, req.SessionTimeout, req.PerformanceMonitoring)
+	
+	if goodooHttp.PreferMinimal(c) {
+		return c.JSON(http.StatusOK, map[string]string{
+			"message": "Settings saved successfully",
 		})
 	}
+	return c.JSON(http.StatusOK, settings(goodooReq.DB))
+}
+
+// GetEffectiveConfig lists the system parameters in effect: the stored ones
+// and the defaults not stored, with sensitive values redacted (settings.read)
+func (h *DashboardHandler) GetEffectiveConfig(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	if db == nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database not available")
+	}
+
+	stored, err := models.ListConfigParameters(db)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	type effectiveParameter struct {
+		Key       string `json:"key"`
+		Value     string `json:"value"`
+		Sensitive bool   `json:"sensitive"`
+		Source    string `json:"source"`
+	}
+	parameters := make([]effectiveParameter, 0, len(stored))
+	seen := make(map[string]bool, len(stored))
+	for _, param := range stored {
+		seen[param.Key] = true
+		parameters = append(parameters, effectiveParameter{param.Key, param.Value, param.IsSensitive(), "database"})
+	}
+	for _, param := range models.DefaultConfigParameters {
+		if !seen[param.Key] {
+			param = param.Redacted()
+			parameters = append(parameters, effectiveParameter{param.Key, param.Value, param.IsSensitive(), "default"})
+		}
+	}
 	
-	// In a real implementation, you would save these settings to configuration
-	h.config.Logger.Info("Settings updated: log_level=%s, session_timeout=%d, performance_monitoring=%t",
-		req.LogLevel, req.SessionTimeout, req.PerformanceMonitoring)
-	
-	return c.JSON(http.StatusOK, map[string]string{
-		"message": "Settings saved successfully",
-	})
+	return c.JSON(http.StatusOK, map[string]interface{}{"parameters": parameters})
 }
 
-// CreateUser creates a new user (admin only)
+// CreateUser creates a new user (admin only) and answers with it under
+// "user" as GetUsers lists it, or with its id only under Prefer:
+// return=minimal
 func (h *DashboardHandler) CreateUser(c echo.Context) error {
-	req := goodooHttp.GetGoodooRequest(c)
-	if req == nil {
-		return echo.NewHTTPError(500, "Request context not found")
-	}
+	req := goodooHttp.MustGetGoodooRequest(c)
 
 	// Check if user is authenticated
 	if !req.IsAuthenticated() {
 		return echo.NewHTTPError(401, "Authentication required")
 	}
 
-	// Get database connection
-	db := req.GetDB()
-	if db == nil {
+	env := req.GetEnv()
+	if env == nil {
 		return echo.NewHTTPError(500, "Database not available")
 	}
+	db := env.GetDB()
 
 	// Parse request using Echo's native JSON binding
 	var createReq CreateUserRequest
@@ -664,9 +1063,16 @@ func (h *DashboardHandler) CreateUser(c echo.Context) error {
 	}
 
 	// Validate required fields
-	if createReq.Login == "" || createReq.Name == "" || createReq.Email == "" || createReq.Password == "" {
+	if createReq.Login == "" || createReq.Name == "" || createReq.Email == "" {
 		return echo.NewHTTPError(400, "All fields (login, name, email, password) are required")
 	}
+	if createReq.Password == "" {
+		if !createReq.Invite {
+			return echo.NewHTTPError(400, "All fields (login, name, email, password) are required")
+		}
+		// Invited users choose their password from the invitation link
+		createReq.Password = randomPassword()
+	}
 
 	// Check if user already exists
 	var existingUser models.User
@@ -674,8 +1080,11 @@ func (h *DashboardHandler) CreateUser(c echo.Context) error {
 		return echo.NewHTTPError(409, "User with this login already exists")
 	}
 
-	// Create the user
-	user, err := models.CreateUser(db, createReq.Login, createReq.Name, createReq.Email, createReq.Password)
+	// Create the user, stamped with the admin creating it
+	user, err := models.NewUser(createReq.Login, createReq.Name, createReq.Email, createReq.Password)
+	if err == nil {
+		err = env.Create(user)
+	}
 	if err != nil {
 		req.Logger.ErrorCtx(req.Context, "Failed to create user: %v", err)
 		return echo.NewHTTPError(500, "Failed to create user")
@@ -688,199 +1097,172 @@ func (h *DashboardHandler) CreateUser(c echo.Context) error {
 	}
 
 	req.Logger.InfoCtx(req.Context, "User created: %s (ID: %d) by admin %s", user.Login, user.ID, req.GetLogin())
+	created := models.Activity{
+		Type:     models.ActivityUserCreated,
+		Severity: models.SeveritySuccess,
+		Model:    "res.users",
+		ResID:    user.ID,
+		Params:   map[string]interface{}{"login": user.Login, "name": user.Name, "invite": createReq.Invite},
+	}
+	if err := models.LogActivity(db, env.GetUser(), created); err != nil {
+		req.Logger.WarningCtx(req.Context, "Failed to record the creation of %s: %v", user.Login, err)
+	}
+	
+	invited := false
+	if createReq.Invite {
+		if err := queueSignupMail(c, req, user, "mail_user_invite"); err != nil {
+			req.Logger.ErrorCtx(req.Context, "Failed to queue invitation for %s: %v", user.Login, err)
+		} else {
+			invited = true
+		}
+	}
 
-	return c.JSON(http.StatusCreated, map[string]interface{}{
+	response := map[string]interface{}{
 		"success": true,
 		"message": "User created successfully",
-		"user": map[string]interface{}{
-			"id":     user.ID,
-			"login":  user.Login,
-			"name":   user.Name,
-			"email":  user.Email,
-			"active": user.Active,
-		},
-	})
+		"id":      user.ID,
+		"invited": invited,
+	}
+	if goodooHttp.PreferMinimal(c) {
+		return c.JSON(http.StatusCreated, response)
+	}
+	// Read back so the user answered holds what was stored, as GetUsers
+	// lists it
+	var stored models.User
+	if err := db.First(&stored, user.ID).Error; err != nil {
+		req.Logger.WarningCtx(req.Context, "Failed to read back user %s: %v", user.Login, err)
+		stored = *user
+	}
+	response["user"] = userResponse(&stored)
+	return c.JSON(http.StatusCreated, response)
 }
 
-// GetLLMTools returns comprehensive LLM tools information
-func (h *DashboardHandler) GetLLMTools(c echo.Context) error {
-	req := goodooHttp.GetGoodooRequest(c)
-	if req == nil {
-		return echo.NewHTTPError(500, "Request context not found")
-	}
-
-	// For now, return mock data representing the available Odoo LLM addons
-	// In a real implementation, this would query the Odoo database
-	addons := []LLMAddonStatus{
-		{Name: "llm", DisplayName: "LLM Integration Base", Installed: true, Active: true, Version: "16.0.1.4.0", Category: "Core", Description: "Base LLM integration module"},
-		{Name: "llm_openai", DisplayName: "OpenAI Integration", Installed: true, Active: true, Version: "16.0.1.1.3", Category: "Provider", Description: "OpenAI provider integration"},
-		{Name: "llm_anthropic", DisplayName: "Anthropic Integration", Installed: true, Active: false, Version: "16.0.1.1.0", Category: "Provider", Description: "Anthropic Claude integration"},
-		{Name: "llm_ollama", DisplayName: "Ollama Integration", Installed: true, Active: true, Version: "16.0.1.0.0", Category: "Provider", Description: "Local Ollama integration"},
-		{Name: "llm_chroma", DisplayName: "Chroma Vector Store", Installed: true, Active: true, Version: "16.0.1.0.0", Category: "Vector Store", Description: "ChromaDB integration"},
-		{Name: "llm_knowledge", DisplayName: "Knowledge Base", Installed: true, Active: true, Version: "16.0.1.0.0", Category: "Knowledge", Description: "Knowledge management"},
-		{Name: "llm_assistant", DisplayName: "AI Assistant", Installed: false, Active: false, Version: "", Category: "Interface", Description: "Conversational AI interface"},
-	}
-
-	providers := []LLMProvider{
-		{ID: 1, Name: "OpenAI", Service: "openai", Active: true, APIBase: "https://api.openai.com/v1"},
-		{ID: 2, Name: "Local Ollama", Service: "ollama", Active: true, APIBase: "http://localhost:11434"},
-		{ID: 3, Name: "Anthropic", Service: "anthropic", Active: false},
-	}
-
-	// Calculate summary
-	totalProviders := len(providers)
-	activeProviders := 0
-	totalModels := 0
-	activeModels := 0
-	installedAddons := 0
-
-	for _, provider := range providers {
-		if provider.Active {
-			activeProviders++
-		}
-		totalModels += len(provider.Models)
-		for _, model := range provider.Models {
-			if model.Active {
-				activeModels++
-			}
-		}
+// randomPassword returns an unguessable placeholder password
+func randomPassword() string {
+	buf := make([]byte, 24)
+	rand.Read(buf)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// llmProviderResponse returns the API form of a provider and its models,
+// without its key
+func llmProviderResponse(provider models.LLMProvider) LLMProvider {
+	response := LLMProvider{
+		ID:      provider.ID,
+		Name:    provider.Name,
+		Service: provider.Service,
+		Active:  provider.Active,
+		APIBase: provider.APIBase,
+		Models:  make([]LLMModel, len(provider.Models)),
 	}
+	for i, model := range provider.Models {
+		response.Models[i] = llmModelResponse(model)
+	}
+	return response
+}
 
-	for _, addon := range addons {
-		if addon.Installed {
-			installedAddons++
-		}
+// llmModelResponse returns the API form of a model
+func llmModelResponse(model models.LLMModel) LLMModel {
+	return LLMModel{
+		ID:            model.ID,
+		Name:          model.Name,
+		ModelName:     model.ModelName,
+		Active:        model.Active,
+		ProviderID:    model.ProviderID,
+		Type:          model.Type,
+		ContextWindow: model.ContextWindow,
 	}
+}
 
-	summary := LLMSummary{
-		TotalProviders:  totalProviders,
-		ActiveProviders: activeProviders,
-		TotalModels:     totalModels,
-		ActiveModels:    activeModels,
-		InstalledAddons: installedAddons,
+// llmCatalog loads the LLM catalog of the request's database; the LLM
+// endpoints all read it so their counts agree
+func (h *DashboardHandler) llmCatalog(c echo.Context) (*goodooHttp.Request, *models.LLMCatalog, error) {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	if db == nil {
+		return nil, nil, echo.NewHTTPError(500, "Database not available")
 	}
+	catalog, err := models.LoadLLMCatalog(db, req.GetDBName())
+	if err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to load LLM providers: %v", err)
+		return nil, nil, echo.NewHTTPError(http.StatusInternalServerError, "Failed to load LLM providers")
+	}
+	return req, catalog, nil
+}
 
+// GetLLMTools returns the providers with their models, the addons and
+// their counts
+func (h *DashboardHandler) GetLLMTools(c echo.Context) error {
+	_, catalog, err := h.llmCatalog(c)
+	if err != nil {
+		return err
+	}
+
+	providers := make([]LLMProvider, len(catalog.Providers))
+	for i, provider := range catalog.Providers {
+		providers[i] = llmProviderResponse(provider)
+	}
 	response := LLMToolsResponse{
 		Providers: providers,
-		Addons:    addons,
-		Summary:   summary,
+		Addons:    catalog.Addons,
+		Summary:   catalog.Summary,
 	}
-
 	return c.JSON(http.StatusOK, response)
 }
 
-// GetLLMProviders returns LLM providers from Odoo
+// GetLLMProviders returns the LLM providers with their models
 func (h *DashboardHandler) GetLLMProviders(c echo.Context) error {
-	req := goodooHttp.GetGoodooRequest(c)
-	if req == nil {
-		return echo.NewHTTPError(500, "Request context not found")
+	_, catalog, err := h.llmCatalog(c)
+	if err != nil {
+		return err
 	}
 
-	// Mock providers data - in real implementation, query Odoo's llm.provider model
-	providers := []LLMProvider{
-		{
-			ID:      1,
-			Name:    "OpenAI Production",
-			Service: "openai",
-			Active:  true,
-			APIBase: "https://api.openai.com/v1",
-			Models: []LLMModel{
-				{ID: 1, Name: "GPT-4", ModelName: "gpt-4", Active: true, ProviderID: 1, Type: "chat"},
-				{ID: 2, Name: "GPT-3.5 Turbo", ModelName: "gpt-3.5-turbo", Active: true, ProviderID: 1, Type: "chat"},
-				{ID: 3, Name: "Text Embedding Ada", ModelName: "text-embedding-ada-002", Active: true, ProviderID: 1, Type: "embedding"},
-			},
-		},
-		{
-			ID:      2,
-			Name:    "Local Ollama",
-			Service: "ollama",
-			Active:  true,
-			APIBase: "http://localhost:11434",
-			Models: []LLMModel{
-				{ID: 4, Name: "Llama 2", ModelName: "llama2", Active: true, ProviderID: 2, Type: "chat"},
-				{ID: 5, Name: "Code Llama", ModelName: "codellama", Active: false, ProviderID: 2, Type: "chat"},
-			},
-		},
-		{
-			ID:      3,
-			Name:    "Anthropic Claude",
-			Service: "anthropic",
-			Active:  false,
-			Models:  []LLMModel{},
-		},
+	providers := make([]LLMProvider, len(catalog.Providers))
+	for i, provider := range catalog.Providers {
+		providers[i] = llmProviderResponse(provider)
 	}
-
 	return c.JSON(http.StatusOK, providers)
 }
 
-// GetLLMModels returns available models
+// GetLLMModels returns the models of every provider, or of ?provider_id=
 func (h *DashboardHandler) GetLLMModels(c echo.Context) error {
-	req := goodooHttp.GetGoodooRequest(c)
-	if req == nil {
-		return echo.NewHTTPError(500, "Request context not found")
+	_, catalog, err := h.llmCatalog(c)
+	if err != nil {
+		return err
 	}
 
-	providerID := c.QueryParam("provider_id")
-	
-	// Mock models data - in real implementation, query Odoo's llm.model model
-	allModels := []LLMModel{
-		{ID: 1, Name: "GPT-4", ModelName: "gpt-4", Active: true, ProviderID: 1, Type: "chat"},
-		{ID: 2, Name: "GPT-3.5 Turbo", ModelName: "gpt-3.5-turbo", Active: true, ProviderID: 1, Type: "chat"},
-		{ID: 3, Name: "Text Embedding Ada", ModelName: "text-embedding-ada-002", Active: true, ProviderID: 1, Type: "embedding"},
-		{ID: 4, Name: "Llama 2", ModelName: "llama2", Active: true, ProviderID: 2, Type: "chat"},
-		{ID: 5, Name: "Code Llama", ModelName: "codellama", Active: false, ProviderID: 2, Type: "chat"},
-	}
-
-	// Filter by provider if specified
-	if providerID != "" {
-		if pid, err := strconv.Atoi(providerID); err == nil {
-			filteredModels := make([]LLMModel, 0)
-			for _, model := range allModels {
-				if model.ProviderID == pid {
-					filteredModels = append(filteredModels, model)
-				}
-			}
-			return c.JSON(http.StatusOK, filteredModels)
+	var providerID uint64
+	if value := c.QueryParam("provider_id"); value != "" {
+		if providerID, err = strconv.ParseUint(value, 10, 32); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid provider_id"})
 		}
 	}
-
-	return c.JSON(http.StatusOK, allModels)
+	llmModels := make([]LLMModel, 0)
+	for _, provider := range catalog.Providers {
+		if providerID != 0 && provider.ID != uint(providerID) {
+			continue
+		}
+		for _, model := range provider.Models {
+			llmModels = append(llmModels, llmModelResponse(model))
+		}
+	}
+	return c.JSON(http.StatusOK, llmModels)
 }
 
-// GetLLMAddonStatus returns status of LLM addons
+// GetLLMAddonStatus returns the LLM addons registered on the server
 func (h *DashboardHandler) GetLLMAddonStatus(c echo.Context) error {
-	req := goodooHttp.GetGoodooRequest(c)
-	if req == nil {
-		return echo.NewHTTPError(500, "Request context not found")
-	}
-
-	// Mock addon status - in real implementation, query Odoo's ir.module.module model
-	addons := []LLMAddonStatus{
-		{Name: "llm", DisplayName: "LLM Integration Base", Installed: true, Active: true, Version: "16.0.1.4.0", Category: "Core"},
-		{Name: "llm_openai", DisplayName: "OpenAI Integration", Installed: true, Active: true, Version: "16.0.1.1.3", Category: "Provider"},
-		{Name: "llm_anthropic", DisplayName: "Anthropic Integration", Installed: true, Active: false, Version: "16.0.1.1.0", Category: "Provider"},
-		{Name: "llm_ollama", DisplayName: "Ollama Integration", Installed: true, Active: true, Version: "16.0.1.0.0", Category: "Provider"},
-		{Name: "llm_mistral", DisplayName: "Mistral Integration", Installed: false, Active: false, Version: "", Category: "Provider"},
-		{Name: "llm_chroma", DisplayName: "Chroma Vector Store", Installed: true, Active: true, Version: "16.0.1.0.0", Category: "Vector Store"},
-		{Name: "llm_qdrant", DisplayName: "Qdrant Vector Store", Installed: false, Active: false, Version: "", Category: "Vector Store"},
-		{Name: "llm_pgvector", DisplayName: "PostgreSQL Vector", Installed: true, Active: false, Version: "16.0.1.0.0", Category: "Vector Store"},
-		{Name: "llm_knowledge", DisplayName: "Knowledge Base", Installed: true, Active: true, Version: "16.0.1.0.0", Category: "Knowledge"},
-		{Name: "llm_training", DisplayName: "Model Training", Installed: false, Active: false, Version: "", Category: "Training"},
-		{Name: "llm_assistant", DisplayName: "AI Assistant", Installed: true, Active: false, Version: "16.0.1.0.0", Category: "Interface"},
-		{Name: "llm_replicate", DisplayName: "Replicate Integration", Installed: false, Active: false, Version: "", Category: "Specialized"},
-		{Name: "llm_litellm", DisplayName: "LiteLLM Gateway", Installed: false, Active: false, Version: "", Category: "Specialized"},
-		{Name: "llm_mcp", DisplayName: "MCP Integration", Installed: true, Active: false, Version: "16.0.1.0.0", Category: "Specialized"},
+	_, catalog, err := h.llmCatalog(c)
+	if err != nil {
+		return err
 	}
-
-	return c.JSON(http.StatusOK, addons)
+	return c.JSON(http.StatusOK, catalog.Addons)
 }
 
-// SaveLLMConfiguration saves LLM configuration
+// SaveLLMConfiguration updates a provider from its config (api_base,
+// api_key, active); without a provider, the dashboard tool settings are
+// only logged, the browser keeping them
 func (h *DashboardHandler) SaveLLMConfiguration(c echo.Context) error {
-	req := goodooHttp.GetGoodooRequest(c)
-	if req == nil {
-		return echo.NewHTTPError(500, "Request context not found")
-	}
+	req := goodooHttp.MustGetGoodooRequest(c)
 
 	var configReq LLMConfigRequest
 	if err := c.Bind(&configReq); err != nil {
@@ -889,7 +1271,34 @@ func (h *DashboardHandler) SaveLLMConfiguration(c echo.Context) error {
 		})
 	}
 
-	// In real implementation, save to Odoo's llm.provider model
+	if configReq.ProviderID != 0 {
+		db := req.GetDB()
+		if db == nil {
+			return echo.NewHTTPError(500, "Database not available")
+		}
+		updates := make(map[string]interface{})
+		if apiBase, ok := configReq.Config["api_base"].(string); ok {
+			updates["api_base"] = apiBase
+		}
+		if apiKey, ok := configReq.Config["api_key"].(string); ok {
+			updates["api_key"] = crypto.EncryptedString(apiKey)
+		}
+		if active, ok := configReq.Config["active"].(bool); ok {
+			updates["active"] = active
+		}
+		provider := models.LLMProvider{}
+		if err := db.First(&provider, configReq.ProviderID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return c.JSON(http.StatusNotFound, map[string]string{"error": "Unknown provider"})
+			}
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		}
+		if len(updates) > 0 {
+			if err := db.Model(&provider).Updates(updates).Error; err != nil {
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			}
+		}
+	}
 	req.Logger.InfoCtx(req.Context, "LLM configuration saved for provider %d", configReq.ProviderID)
 
 	return c.JSON(http.StatusOK, map[string]string{
@@ -899,9 +1308,9 @@ func (h *DashboardHandler) SaveLLMConfiguration(c echo.Context) error {
 
 // TestLLMConnection tests connection to LLM provider
 func (h *DashboardHandler) TestLLMConnection(c echo.Context) error {
-	req := goodooHttp.GetGoodooRequest(c)
-	if req == nil {
-		return echo.NewHTTPError(500, "Request context not found")
+	req, catalog, err := h.llmCatalog(c)
+	if err != nil {
+		return err
 	}
 
 	var testReq LLMTestRequest
@@ -913,30 +1322,41 @@ func (h *DashboardHandler) TestLLMConnection(c echo.Context) error {
 
 	// Simulate testing - in real implementation, actually test the provider
 	start := time.Now()
-	
-	// Simulate different response times and success rates based on provider
+	_, span := req.StartSpan("llm.call")
+	span.SetAttribute("llm.provider_id", strconv.FormatUint(uint64(testReq.ProviderID), 10))
+	defer span.End()
+
+	var provider *models.LLMProvider
+	for i := range catalog.Providers {
+		if catalog.Providers[i].ID == testReq.ProviderID {
+			provider = &catalog.Providers[i]
+		}
+	}
+
 	var success bool
 	var errorMsg string
 	var modelInfo string
-
-	switch testReq.ProviderID {
-	case 1: // OpenAI
-		success = true
-		modelInfo = "GPT-4 available, 8k context window"
-	case 2: // Ollama
-		success = true
-		modelInfo = "Llama2 loaded, 4k context window"
-	case 3: // Anthropic (inactive)
-		success = false
+	switch {
+	case provider == nil:
+		errorMsg = "Unknown provider"
+	case !provider.Active:
 		errorMsg = "Provider not configured or inactive"
 	default:
-		success = false
-		errorMsg = "Unknown provider"
+		for _, model := range provider.Models {
+			if model.Active && (testReq.ModelName == "" || model.ModelName == testReq.ModelName) {
+				success = true
+				modelInfo = model.Name + " available"
+				break
+			}
+		}
+		if !success {
+			errorMsg = "No active model available"
+		}
 	}
 
 	responseTime := int(time.Since(start).Milliseconds())
 	if success {
-		responseTime += 150 + (testReq.ProviderID * 50) // Simulate realistic response times
+		responseTime += 150 + int(testReq.ProviderID*50) // Simulate realistic response times
 	}
 
 	response := LLMTestResponse{
@@ -946,102 +1366,181 @@ func (h *DashboardHandler) TestLLMConnection(c echo.Context) error {
 		ModelInfo:    modelInfo,
 	}
 
+	tested := models.Activity{
+		Type:     models.ActivityLLMTest,
+		Severity: models.SeveritySuccess,
+		Model:    "llm.provider",
+		ResID:    testReq.ProviderID,
+		Params:   map[string]interface{}{"provider": testReq.ProviderID, "model": testReq.ModelName, "response_ms": responseTime},
+	}
+	if provider != nil {
+		tested.Params["provider"] = provider.Name
+	}
+	if !success {
+		tested.Severity = models.SeverityError
+		tested.Params["error"] = errorMsg
+	}
+	if err := models.LogActivity(req.GetDB(), uint(req.GetUserID()), tested); err != nil {
+		req.Logger.WarningCtx(req.Context, "Failed to record the LLM provider test: %v", err)
+	}
+
 	return c.JSON(http.StatusOK, response)
 }
 
-// SendChatMessage handles chat message sending and AI response
-func (h *DashboardHandler) SendChatMessage(c echo.Context) error {
-	req := goodooHttp.GetGoodooRequest(c)
-	if req == nil {
-		return echo.NewHTTPError(500, "Request context not found")
-	}
-
-	var chatReq ChatRequest
-	if err := c.Bind(&chatReq); err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{
-			"error": "Invalid request format",
+// chatSessionResponse converts a stored session and its messages
+func chatSessionResponse(session *models.ChatSession, messages []models.ChatMessage) ChatSession {
+	response := ChatSession{
+		ID:           session.ID,
+		UserID:       int(session.UserID),
+		Title:        session.Title,
+		TitleManual:  session.TitleManual,
+		Model:        session.Model,
+		CreatedAt:    session.CreateDate,
+		UpdatedAt:    session.WriteDate,
+		Active:       !session.Archived,
+		Archived:     session.Archived,
+		UseKnowledge: session.UseKnowledge,
+	}
+	for _, message := range messages {
+		response.Messages = append(response.Messages, ChatMessage{
+			ID:           strconv.FormatUint(uint64(message.ID), 10),
+			Role:         message.Role,
+			Content:      message.Content,
+			ContentType:  message.ContentType,
+			RenderedHTML: message.Rendered(),
+			Timestamp:    message.CreateDate,
+			Model:        message.Model,
 		})
 	}
+	return response
+}
 
-	if chatReq.Message == "" {
-		return c.JSON(http.StatusBadRequest, map[string]string{
-			"error": "Message cannot be empty",
-		})
+// loadChatSession returns a session of the current user, or
+// gorm.ErrRecordNotFound
+func loadChatSession(req *goodooHttp.Request, db *gorm.DB, sessionID string) (*models.ChatSession, error) {
+	var session models.ChatSession
+	if err := db.Where("id = ? AND user_id = ?", sessionID, req.GetUserID()).Take(&session).Error; err != nil {
+		return nil, err
 	}
+	return &session, nil
+}
 
-	start := time.Now()
-	
-	// Generate unique message ID
-	messageID := fmt.Sprintf("msg_%d_%d", req.GetUserID(), time.Now().UnixNano())
-	
-	// Simulate AI response generation based on selected model
-	aiResponse, tokensUsed := h.generateAIResponse(chatReq.Message, chatReq.Model)
-	
-	responseTime := int(time.Since(start).Milliseconds())
+// newChatSessionID returns a session ID unique to the user
+func newChatSessionID(req *goodooHttp.Request) string {
+	return fmt.Sprintf("session_%d_%d", req.GetUserID(), time.Now().UnixNano())
+}
 
-	// Create session ID if not provided
-	sessionID := chatReq.SessionID
-	if sessionID == "" {
-		sessionID = fmt.Sprintf("session_%d_%d", req.GetUserID(), time.Now().Unix())
+// SendChatMessage handles chat message sending and AI response. Models
+// with a route are answered by its providers, failing over from one to the
+// next; the others get a simulated answer.
+func (h *DashboardHandler) SendChatMessage(c echo.Context) error {
+	turn, err := h.prepareChatTurn(c)
+	if turn == nil {
+		return err
 	}
+	req := turn.req
 
-	response := ChatResponse{
-		ID:           messageID,
-		Message:      aiResponse,
-		Model:        chatReq.Model,
-		SessionID:    sessionID,
-		Timestamp:    time.Now(),
-		ResponseTime: responseTime,
-		TokensUsed:   tokensUsed,
-		FinishReason: "stop",
+	answer, attempts, err := h.answerChatTurn(turn, nil)
+	if err != nil {
+		return chatAnswerError(c, turn, attempts, err)
 	}
+	messages, err := h.storeChatTurn(turn, answer)
+	var quotaErr *models.QuotaExceededError
+	if errors.As(err, &quotaErr) {
+		return quotaExceededResponse(c, quotaErr)
+	}
+	response := turn.response(answer, messages[1])
 
 	// Log the chat interaction
 	req.Logger.InfoCtx(req.Context, "Chat message processed: user=%d, model=%s, tokens=%d, time=%dms", 
-		req.GetUserID(), chatReq.Model, tokensUsed, responseTime)
+		req.GetUserID(), answer.Model, answer.TokensUsed, response.ResponseTime)
 
 	return c.JSON(http.StatusOK, response)
 }
 
-// GetChatSessions returns user's chat sessions
+// chatSessionOrders maps the sort options of the session list to columns
+var chatSessionOrders = map[string]string{
+	"updated": "chat_session.write_date",
+	"created": "chat_session.create_date",
+	"title":   "chat_session.title",
+}
+
+// GetChatSessions returns user's chat sessions, optionally searched (q, in
+// titles and messages), filtered on archived (false, true or all) and
+// sorted (sort: updated, created or title; order: asc or desc)
 func (h *DashboardHandler) GetChatSessions(c echo.Context) error {
-	req := goodooHttp.GetGoodooRequest(c)
-	if req == nil {
-		return echo.NewHTTPError(500, "Request context not found")
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	if db == nil {
+		return echo.NewHTTPError(500, "Database not available")
 	}
 
-	// Mock sessions data - in real implementation, query database
-	sessions := []ChatSession{
-		{
-			ID:        "session_1",
-			UserID:    req.GetUserID(),
-			Title:     "LLM Configuration Help",
-			Model:     "gpt-3.5-turbo",
-			CreatedAt: time.Now().Add(-2 * time.Hour),
-			UpdatedAt: time.Now().Add(-30 * time.Minute),
-			Active:    true,
-			Messages: []ChatMessage{
-				{ID: "msg_1", Role: "user", Content: "How do I configure OpenAI?", Timestamp: time.Now().Add(-2 * time.Hour)},
-				{ID: "msg_2", Role: "assistant", Content: "To configure OpenAI, you need to...", Timestamp: time.Now().Add(-2*time.Hour + time.Minute)},
-			},
-		},
-		{
-			ID:        "session_2",
-			UserID:    req.GetUserID(),
-			Title:     "Go Programming Help",
-			Model:     "gpt-4",
-			CreatedAt: time.Now().Add(-1 * time.Hour),
-			UpdatedAt: time.Now().Add(-10 * time.Minute),
-			Active:    false,
-			Messages: []ChatMessage{
-				{ID: "msg_3", Role: "user", Content: "Help me write a Go function", Timestamp: time.Now().Add(-1 * time.Hour)},
-			},
-		},
+	query := db.Model(&models.ChatSession{}).Where("chat_session.user_id = ?", req.GetUserID())
+	switch c.QueryParam("archived") {
+	case "", "false":
+		query = query.Where("NOT chat_session.archived")
+	case "true":
+		query = query.Where("chat_session.archived")
+	case "all":
+	default:
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "archived must be true, false or all",
+		})
+	}
+	if q := strings.TrimSpace(c.QueryParam("q")); q != "" {
+		query = chat.Search(query, db, req.DB, q)
+	}
+
+	sortBy := c.QueryParam("sort")
+	if sortBy == "" {
+		sortBy = "updated"
+	}
+	column, ok := chatSessionOrders[sortBy]
+	if !ok {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "sort must be updated, created or title",
+		})
+	}
+	order := c.QueryParam("order")
+	switch order {
+	case "":
+		order = "desc"
+		if sortBy == "title" {
+			order = "asc"
+		}
+	case "asc", "desc":
+	default:
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "order must be asc or desc",
+		})
+	}
+
+	offset, _ := strconv.Atoi(c.QueryParam("offset"))
+	if offset < 0 {
+		offset = 0
+	}
+	limit := 50
+	if l, err := strconv.Atoi(c.QueryParam("limit")); err == nil && l > 0 && l <= 200 {
+		limit = l
+	}
+
+	var total int64
+	if err := query.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		return echo.NewHTTPError(500, "Failed to count chat sessions")
+	}
+	var stored []models.ChatSession
+	if err := query.Order(column + " " + order + ", chat_session.id").Offset(offset).Limit(limit).Find(&stored).Error; err != nil {
+		return echo.NewHTTPError(500, "Failed to load chat sessions")
+	}
+
+	sessions := make([]ChatSession, len(stored))
+	for i := range stored {
+		sessions[i] = chatSessionResponse(&stored[i], nil)
 	}
 
 	response := ChatSessionsResponse{
 		Sessions: sessions,
-		Total:    len(sessions),
+		Total:    int(total),
 	}
 
 	return c.JSON(http.StatusOK, response)
@@ -1049,9 +1548,10 @@ func (h *DashboardHandler) GetChatSessions(c echo.Context) error {
 
 // GetChatSession returns a specific chat session
 func (h *DashboardHandler) GetChatSession(c echo.Context) error {
-	req := goodooHttp.GetGoodooRequest(c)
-	if req == nil {
-		return echo.NewHTTPError(500, "Request context not found")
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	if db == nil {
+		return echo.NewHTTPError(500, "Database not available")
 	}
 
 	sessionID := c.Param("id")
@@ -1061,39 +1561,34 @@ func (h *DashboardHandler) GetChatSession(c echo.Context) error {
 		})
 	}
 
-	// Mock session data - in real implementation, query database
-	session := ChatSession{
-		ID:        sessionID,
-		UserID:    req.GetUserID(),
-		Title:     "Current Chat Session",
-		Model:     "gpt-3.5-turbo",
-		CreatedAt: time.Now().Add(-1 * time.Hour),
-		UpdatedAt: time.Now(),
-		Active:    true,
-		Messages: []ChatMessage{
-			{
-				ID:        "msg_welcome",
-				Role:      "assistant",
-				Content:   "Hello! I'm your AI assistant. How can I help you today?",
-				Timestamp: time.Now().Add(-1 * time.Hour),
-				Model:     "gpt-3.5-turbo",
-			},
-		},
+	session, err := loadChatSession(req, db, sessionID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Session not found",
+		})
+	} else if err != nil {
+		return echo.NewHTTPError(500, "Failed to load chat session")
+	}
+	var messages []models.ChatMessage
+	if err := db.Where("session_id = ?", session.ID).Order("create_date, id").Find(&messages).Error; err != nil {
+		return echo.NewHTTPError(500, "Failed to load chat messages")
 	}
 
-	return c.JSON(http.StatusOK, session)
+	return c.JSON(http.StatusOK, chatSessionResponse(session, messages))
 }
 
 // CreateChatSession creates a new chat session
 func (h *DashboardHandler) CreateChatSession(c echo.Context) error {
-	req := goodooHttp.GetGoodooRequest(c)
-	if req == nil {
-		return echo.NewHTTPError(500, "Request context not found")
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	if db == nil {
+		return echo.NewHTTPError(500, "Database not available")
 	}
 
 	var sessionReq struct {
-		Title string `json:"title"`
-		Model string `json:"model"`
+		Title        string `json:"title"`
+		Model        string `json:"model"`
+		UseKnowledge bool   `json:"use_knowledge"`
 	}
 
 	if err := c.Bind(&sessionReq); err != nil {
@@ -1102,29 +1597,117 @@ func (h *DashboardHandler) CreateChatSession(c echo.Context) error {
 		})
 	}
 
-	sessionID := fmt.Sprintf("session_%d_%d", req.GetUserID(), time.Now().Unix())
-	
-	session := ChatSession{
-		ID:        sessionID,
-		UserID:    req.GetUserID(),
-		Title:     sessionReq.Title,
-		Model:     sessionReq.Model,
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
-		Active:    true,
-		Messages:  []ChatMessage{},
+	// A title given on creation is the user's choice and is never generated
+	title := strings.TrimSpace(sessionReq.Title)
+	session := &models.ChatSession{
+		ID:           newChatSessionID(req),
+		UserID:       uint(req.GetUserID()),
+		Title:        title,
+		TitleManual:  title != "",
+		Model:        sessionReq.Model,
+		UseKnowledge: sessionReq.UseKnowledge,
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(session).Error; err != nil {
+			return err
+		}
+		return models.ReserveQuota(tx, req.GetDBName(), models.QuotaChatSession, session.UserID)
+	})
+	var quotaErr *models.QuotaExceededError
+	if errors.As(err, &quotaErr) {
+		return quotaExceededResponse(c, quotaErr)
+	}
+	if err != nil {
+		return echo.NewHTTPError(500, "Failed to create chat session")
+	}
+
+	req.Logger.InfoCtx(req.Context, "Chat session created: %s for user %d", session.ID, req.GetUserID())
+
+	return c.JSON(http.StatusCreated, chatSessionResponse(session, nil))
+}
+
+// UpdateChatSession renames or archives a chat session. An empty title
+// gives the session back a generated title. It answers with the session
+// and its messages as GetChatSession would, or with a success flag under
+// Prefer: return=minimal.
+func (h *DashboardHandler) UpdateChatSession(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	if db == nil {
+		return echo.NewHTTPError(500, "Database not available")
+	}
+
+	var updateReq struct {
+		Title    *string `json:"title"`
+		Archived *bool   `json:"archived"`
+	}
+	if err := c.Bind(&updateReq); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid request format",
+		})
+	}
+
+	session, err := loadChatSession(req, db, c.Param("id"))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Session not found",
+		})
+	} else if err != nil {
+		return echo.NewHTTPError(500, "Failed to load chat session")
+	}
+
+	updates := map[string]interface{}{}
+	if updateReq.Title != nil {
+		title := strings.TrimSpace(*updateReq.Title)
+		updates["title"] = title
+		updates["title_manual"] = title != ""
+		updates["title_pending"] = false
+		if title == "" {
+			var messages int64
+			if err := db.Model(&models.ChatMessage{}).Where("session_id = ?", session.ID).Count(&messages).Error; err != nil {
+				return echo.NewHTTPError(500, "Failed to load chat messages")
+			}
+			updates["title_pending"] = messages > 0
+		}
+	}
+	if updateReq.Archived != nil {
+		updates["archived"] = *updateReq.Archived
+	}
+	minimal := goodooHttp.PreferMinimal(c)
+	var messages []models.ChatMessage
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if len(updates) > 0 {
+			if err := tx.Model(session).Updates(updates).Error; err != nil {
+				return err
+			}
+		}
+		if minimal {
+			return nil
+		}
+		// Read back as GetChatSession answers it
+		if err := tx.Where("id = ?", session.ID).Take(session).Error; err != nil {
+			return err
+		}
+		return tx.Where("session_id = ?", session.ID).Order("create_date, id").Find(&messages).Error
+	})
+	if err != nil {
+		return echo.NewHTTPError(500, "Failed to update chat session")
 	}
 
-	req.Logger.InfoCtx(req.Context, "Chat session created: %s for user %d", sessionID, req.GetUserID())
+	req.Logger.InfoCtx(req.Context, "Chat session updated: %s by user %d", session.ID, req.GetUserID())
 
-	return c.JSON(http.StatusCreated, session)
+	if minimal {
+		return c.JSON(http.StatusOK, map[string]interface{}{"success": true})
+	}
+	return c.JSON(http.StatusOK, chatSessionResponse(session, messages))
 }
 
 // DeleteChatSession deletes a chat session
 func (h *DashboardHandler) DeleteChatSession(c echo.Context) error {
-	req := goodooHttp.GetGoodooRequest(c)
-	if req == nil {
-		return echo.NewHTTPError(500, "Request context not found")
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	if db == nil {
+		return echo.NewHTTPError(500, "Database not available")
 	}
 
 	sessionID := c.Param("id")
@@ -1134,7 +1717,27 @@ func (h *DashboardHandler) DeleteChatSession(c echo.Context) error {
 		})
 	}
 
-	// In real implementation, delete from database
+	session, err := loadChatSession(req, db, sessionID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Session not found",
+		})
+	} else if err != nil {
+		return echo.NewHTTPError(500, "Failed to load chat session")
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("session_id = ?", session.ID).Delete(&models.ChatMessage{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(session).Error; err != nil {
+			return err
+		}
+		return models.ReleaseQuota(tx, models.QuotaChatSession, session.UserID, 1)
+	})
+	if err != nil {
+		return echo.NewHTTPError(500, "Failed to delete chat session")
+	}
+
 	req.Logger.InfoCtx(req.Context, "Chat session deleted: %s by user %d", sessionID, req.GetUserID())
 
 	return c.JSON(http.StatusOK, map[string]string{
@@ -1144,11 +1747,6 @@ func (h *DashboardHandler) DeleteChatSession(c echo.Context) error {
 
 // GetAvailableChatModels returns available models for chat
 func (h *DashboardHandler) GetAvailableChatModels(c echo.Context) error {
-	req := goodooHttp.GetGoodooRequest(c)
-	if req == nil {
-		return echo.NewHTTPError(500, "Request context not found")
-	}
-
 	// Get available models from active providers
 	models := []map[string]interface{}{
 		{
@@ -1305,8 +1903,8 @@ func (h *DashboardHandler) extractTopic(message string) string {
 
 // GetUserChatRooms returns all chat rooms for the current user
 func (h *DashboardHandler) GetUserChatRooms(c echo.Context) error {
-	req := goodooHttp.GetGoodooRequest(c)
-	if req == nil || !req.IsAuthenticated() {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	if !req.IsAuthenticated() {
 		return echo.NewHTTPError(401, "Authentication required")
 	}
 
@@ -1324,8 +1922,8 @@ func (h *DashboardHandler) GetUserChatRooms(c echo.Context) error {
 			Name: "General Discussion",
 			Type: "group",
 			Participants: []UserChatParticipant{
-				{UserID: 1, UserName: "Admin", UserEmail: "admin@goodoo.com", IsOnline: true, LastSeen: time.Now()},
-				{UserID: 2, UserName: "User 1", UserEmail: "user1@goodoo.com", IsOnline: false, LastSeen: time.Now().Add(-15 * time.Minute)},
+				{UserID: 1, UserName: "Admin", UserEmail: "admin@goodoo.com"},
+				{UserID: 2, UserName: "User 1", UserEmail: "user1@goodoo.com"},
 			},
 			CreatedAt:   time.Now().Add(-24 * time.Hour),
 			UpdatedAt:   time.Now().Add(-5 * time.Minute),
@@ -1335,19 +1933,21 @@ func (h *DashboardHandler) GetUserChatRooms(c echo.Context) error {
 
 	// Add direct chat rooms for each user
 	for _, user := range users {
-		roomID := fmt.Sprintf("direct_%d_%d", min(userID, int(user.ID)), max(userID, int(user.ID)))
+		roomID := userchat.DirectRoom(uint(userID), user.ID)
+		participant := newChatParticipant(&user)
 		rooms = append(rooms, UserChatRoom{
 			ID:   roomID,
-			Name: user.Name,
+			Name: user.DisplayName(),
 			Type: "direct",
-			Participants: []UserChatParticipant{
-				{UserID: int(user.ID), UserName: user.Name, UserEmail: user.Email, IsOnline: true, LastSeen: time.Now()},
-			},
+			Participants: []UserChatParticipant{participant},
 			CreatedAt:   time.Now().Add(-1 * time.Hour),
 			UpdatedAt:   time.Now().Add(-10 * time.Minute),
 			UnreadCount: 0,
 		})
 	}
+	for _, room := range rooms {
+		applyPresence(req.GetDBName(), room.Participants)
+	}
 
 	return c.JSON(http.StatusOK, map[string]interface{}{
 		"rooms": rooms,
@@ -1355,25 +1955,10 @@ func (h *DashboardHandler) GetUserChatRooms(c echo.Context) error {
 	})
 }
 
-// Helper functions for min/max
-func min(a, b int) int {
-	if a < b {
-		return a
-	}
-	return b
-}
-
-func max(a, b int) int {
-	if a > b {
-		return a
-	}
-	return b
-}
-
 // GetUserChatMessages returns messages for a specific chat room
 func (h *DashboardHandler) GetUserChatMessages(c echo.Context) error {
-	req := goodooHttp.GetGoodooRequest(c)
-	if req == nil || !req.IsAuthenticated() {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	if !req.IsAuthenticated() {
 		return echo.NewHTTPError(401, "Authentication required")
 	}
 
@@ -1381,6 +1966,9 @@ func (h *DashboardHandler) GetUserChatMessages(c echo.Context) error {
 	if roomID == "" {
 		return echo.NewHTTPError(400, "Room ID is required")
 	}
+	if !userchat.CanJoin(roomID, uint(req.GetUserID())) {
+		return echo.NewHTTPError(403, "Not a participant of this room")
+	}
 
 	// Mock messages data (in real implementation, query from database)
 	messages := []UserChatMessage{
@@ -1410,6 +1998,13 @@ func (h *DashboardHandler) GetUserChatMessages(c echo.Context) error {
 			Timestamp:   time.Now().Add(-30 * time.Minute),
 		},
 	}
+	for i := range messages {
+		messages[i].Room = roomID
+		messages[i].ContentType = models.ChatContentMarkdown
+		messages[i].RenderedHTML = models.RenderChatContent(models.ChatContentMarkdown, messages[i].Content, nil)
+	}
+	// Fetching the messages delivers those of the other participants
+	deliverUserMessages(req, roomID, messages)
 
 	return c.JSON(http.StatusOK, map[string]interface{}{
 		"messages": messages,
@@ -1420,8 +2015,8 @@ func (h *DashboardHandler) GetUserChatMessages(c echo.Context) error {
 
 // SendUserMessage sends a message between users
 func (h *DashboardHandler) SendUserMessage(c echo.Context) error {
-	req := goodooHttp.GetGoodooRequest(c)
-	if req == nil || !req.IsAuthenticated() {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	if !req.IsAuthenticated() {
 		return echo.NewHTTPError(401, "Authentication required")
 	}
 
@@ -1433,20 +2028,42 @@ func (h *DashboardHandler) SendUserMessage(c echo.Context) error {
 	if request.Content == "" {
 		return echo.NewHTTPError(400, "Message content is required")
 	}
+	if request.ContentType == "" {
+		request.ContentType = models.ChatContentMarkdown
+	} else if !models.ValidChatContentType(request.ContentType) {
+		return echo.NewHTTPError(400, "Invalid content type")
+	}
 
 	userID := req.GetUserID()
 
+	// @login mentions of active users are resolved once, when the message
+	// is written, and highlighted in its rendering
+	var mentions []models.ChatMention
+	if db := req.GetDB(); db != nil {
+		var err error
+		if mentions, err = models.ResolveMentions(db, request.Content); err != nil {
+			req.Logger.WarningCtx(req.Context, "Failed to resolve chat mentions: %v", err)
+		}
+	}
+
 	// Create new message
 	message := UserChatMessage{
-		ID:          fmt.Sprintf("msg_%d", time.Now().UnixNano()),
-		FromUserID:  userID,
-		ToUserID:    request.ToUserID,
-		Content:     request.Content,
-		MessageType: request.MessageType,
-		Timestamp:   time.Now(),
+		ID:           fmt.Sprintf("msg_%d", time.Now().UnixNano()),
+		FromUserID:   userID,
+		ToUserID:     request.ToUserID,
+		Content:      request.Content,
+		MessageType:  request.MessageType,
+		ContentType:  request.ContentType,
+		RenderedHTML: models.RenderChatContent(request.ContentType, request.Content, models.MentionMap(mentions)),
+		Mentions:     mentions,
+		Timestamp:    time.Now(),
 	}
+	notifyMentions(req, &message, request.RoomID)
 
-	// In real implementation, save to database and broadcast via WebSocket
+	// In real implementation, save to database
+	if err := publishUserMessage(req, &message, request.RoomID); err != nil {
+		return err
+	}
 
 	return c.JSON(http.StatusOK, UserChatResponse{
 		Success: true,
@@ -1455,10 +2072,42 @@ func (h *DashboardHandler) SendUserMessage(c echo.Context) error {
 	})
 }
 
+// notifyMentions notifies the users mentioned in a message, but its
+// sender. A direct message only notifies its recipient; the members of
+// rooms are not stored yet, so a room message notifies every mentioned user.
+func notifyMentions(req *goodooHttp.Request, message *UserChatMessage, roomID string) {
+	if len(message.Mentions) == 0 {
+		return
+	}
+	sender := "Someone"
+	var user models.User
+	if db := req.GetDB(); db != nil && db.First(&user, message.FromUserID).Error == nil {
+		sender = user.DisplayName()
+	}
+	excerpt := []rune(message.Content)
+	if len(excerpt) > 140 {
+		excerpt = append(excerpt[:140], '…')
+	}
+
+	for _, mention := range message.Mentions {
+		if mention.UserID == uint(message.FromUserID) || (message.ToUserID != 0 && mention.UserID != uint(message.ToUserID)) {
+			continue
+		}
+		_, err := notification.Notify(req.GetDBName(), mention.UserID, models.NotificationCategoryMention, models.NotificationInfo, sender+" mentioned you", string(excerpt), map[string]interface{}{
+			"message_id":   message.ID,
+			"room_id":      roomID,
+			"from_user_id": message.FromUserID,
+		})
+		if err != nil {
+			req.Logger.WarningCtx(req.Context, "Failed to notify mention of user %d: %v", mention.UserID, err)
+		}
+	}
+}
+
 // GetChatUsers returns all users available for chat
 func (h *DashboardHandler) GetChatUsers(c echo.Context) error {
-	req := goodooHttp.GetGoodooRequest(c)
-	if req == nil || !req.IsAuthenticated() {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	if !req.IsAuthenticated() {
 		return echo.NewHTTPError(401, "Authentication required")
 	}
 
@@ -1472,15 +2121,11 @@ func (h *DashboardHandler) GetChatUsers(c echo.Context) error {
 
 	var chatUsers []UserChatParticipant
 	for _, user := range users {
-		chatUsers = append(chatUsers, UserChatParticipant{
-			UserID:    int(user.ID),
-			UserName:  user.Name,
-			UserEmail: user.Email,
-			IsOnline:  true, // Mock data - in real implementation, check user presence
-			LastSeen:  time.Now().Add(-5 * time.Minute),
-			JoinedAt:  time.Now().Add(-24 * time.Hour), // Mock join time
-		})
+		participant := newChatParticipant(&user)
+		participant.JoinedAt = time.Now().Add(-24 * time.Hour) // Mock join time
+		chatUsers = append(chatUsers, participant)
 	}
+	applyPresence(req.GetDBName(), chatUsers)
 
 	return c.JSON(http.StatusOK, map[string]interface{}{
 		"users": chatUsers,
@@ -1490,8 +2135,8 @@ func (h *DashboardHandler) GetChatUsers(c echo.Context) error {
 
 // CreateGroupChat creates a new group chat room
 func (h *DashboardHandler) CreateGroupChat(c echo.Context) error {
-	req := goodooHttp.GetGoodooRequest(c)
-	if req == nil || !req.IsAuthenticated() {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	if !req.IsAuthenticated() {
 		return echo.NewHTTPError(401, "Authentication required")
 	}
 
@@ -1505,6 +2150,18 @@ func (h *DashboardHandler) CreateGroupChat(c echo.Context) error {
 	}
 
 	userID := req.GetUserID()
+	db := req.GetDB()
+
+	var creator models.User
+	if err := db.First(&creator, userID).Error; err != nil {
+		return echo.NewHTTPError(404, "User not found")
+	}
+	var members []models.User
+	if len(request.ParticipantIDs) > 0 {
+		if err := db.Where("id IN ? AND id != ?", request.ParticipantIDs, userID).Find(&members).Error; err != nil {
+			return echo.NewHTTPError(500, "Failed to fetch participants")
+		}
+	}
 
 	// Create new group chat room
 	room := UserChatRoom{
@@ -1516,11 +2173,12 @@ func (h *DashboardHandler) CreateGroupChat(c echo.Context) error {
 	}
 
 	// Add creator and participants
-	room.Participants = append(room.Participants, UserChatParticipant{
-		UserID:   userID,
-		UserName: "Current User", // Get from database in real implementation
-		JoinedAt: time.Now(),
-	})
+	for _, user := range append([]models.User{creator}, members...) {
+		participant := newChatParticipant(&user)
+		participant.JoinedAt = time.Now()
+		room.Participants = append(room.Participants, participant)
+	}
+	applyPresence(req.GetDBName(), room.Participants)
 
 	// In real implementation, save to database
 
@@ -1533,8 +2191,8 @@ func (h *DashboardHandler) CreateGroupChat(c echo.Context) error {
 
 // JoinChatRoom allows a user to join a chat room
 func (h *DashboardHandler) JoinChatRoom(c echo.Context) error {
-	req := goodooHttp.GetGoodooRequest(c)
-	if req == nil || !req.IsAuthenticated() {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	if !req.IsAuthenticated() {
 		return echo.NewHTTPError(401, "Authentication required")
 	}
 
@@ -1553,8 +2211,8 @@ func (h *DashboardHandler) JoinChatRoom(c echo.Context) error {
 
 // LeaveChatRoom allows a user to leave a chat room
 func (h *DashboardHandler) LeaveChatRoom(c echo.Context) error {
-	req := goodooHttp.GetGoodooRequest(c)
-	if req == nil || !req.IsAuthenticated() {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	if !req.IsAuthenticated() {
 		return echo.NewHTTPError(401, "Authentication required")
 	}
 
@@ -1573,28 +2231,63 @@ func (h *DashboardHandler) LeaveChatRoom(c echo.Context) error {
 
 // GetUserPresence returns online status of users
 func (h *DashboardHandler) GetUserPresence(c echo.Context) error {
-	req := goodooHttp.GetGoodooRequest(c)
-	if req == nil || !req.IsAuthenticated() {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	if !req.IsAuthenticated() {
 		return echo.NewHTTPError(401, "Authentication required")
 	}
 
-	// Mock presence data
-	presence := []UserPresenceUpdate{
-		{UserID: 1, IsOnline: true, LastSeen: time.Now()},
-		{UserID: 2, IsOnline: false, LastSeen: time.Now().Add(-15 * time.Minute)},
-		{UserID: 3, IsOnline: true, LastSeen: time.Now().Add(-2 * time.Minute)},
+	db := req.GetDB()
+	if db == nil {
+		return echo.NewHTTPError(500, "Database not available")
+	}
+	var ids []uint
+	if err := db.Model(&models.User{}).Where("active = ?", true).Order("id").Pluck("id", &ids).Error; err != nil {
+		return echo.NewHTTPError(500, "Failed to fetch users")
 	}
 
+	statuses := presence.Get(req.GetDBName(), ids)
+	entries := make([]UserPresenceUpdate, len(ids))
+	for i, id := range ids {
+		status := statuses[id]
+		entries[i] = UserPresenceUpdate{UserID: int(id), IsOnline: status.IsOnline(), State: status.State, LastSeen: status.LastSeen}
+	}
+	h.describePresence(db, entries)
+
 	return c.JSON(http.StatusOK, map[string]interface{}{
-		"presence": presence,
+		"presence": entries,
 		"timestamp": time.Now(),
 	})
 }
 
+// describePresence fills the display name and avatar of presence entries
+func (h *DashboardHandler) describePresence(db *gorm.DB, presence []UserPresenceUpdate) {
+	if db == nil {
+		return
+	}
+	ids := make([]int, len(presence))
+	for i, p := range presence {
+		ids[i] = p.UserID
+	}
+	var users []models.User
+	if err := db.Where("id IN ?", ids).Find(&users).Error; err != nil {
+		return
+	}
+	byID := make(map[int]*models.User, len(users))
+	for i := range users {
+		byID[int(users[i].ID)] = &users[i]
+	}
+	for i := range presence {
+		if user, ok := byID[presence[i].UserID]; ok {
+			presence[i].DisplayName = user.DisplayName()
+			presence[i].AvatarURL = avatarURL(user, 128)
+		}
+	}
+}
+
 // UpdateUserPresence updates current user's presence status
 func (h *DashboardHandler) UpdateUserPresence(c echo.Context) error {
-	req := goodooHttp.GetGoodooRequest(c)
-	if req == nil || !req.IsAuthenticated() {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	if !req.IsAuthenticated() {
 		return echo.NewHTTPError(401, "Authentication required")
 	}
 
@@ -1604,10 +2297,21 @@ func (h *DashboardHandler) UpdateUserPresence(c echo.Context) error {
 	}
 
 	userID := req.GetUserID()
-	update.UserID = userID
-	update.LastSeen = time.Now()
+	deviceID := update.DeviceID
+	if deviceID == "" {
+		deviceID = "session:" + req.Session.SID
+	}
+	var status presence.Status
+	if update.IsOnline {
+		status = presence.Heartbeat(req.GetDBName(), uint(userID), deviceID, update.Active == nil || *update.Active)
+	} else {
+		status = presence.Disconnect(req.GetDBName(), uint(userID), deviceID)
+	}
 
-	// In real implementation, update presence in database/cache
+	update = UserPresenceUpdate{UserID: userID, IsOnline: status.IsOnline(), State: status.State, LastSeen: status.LastSeen}
+	entries := []UserPresenceUpdate{update}
+	h.describePresence(req.GetDB(), entries)
+	update = entries[0]
 
 	return c.JSON(http.StatusOK, UserChatResponse{
 		Success: true,
@@ -1618,8 +2322,8 @@ func (h *DashboardHandler) UpdateUserPresence(c echo.Context) error {
 
 // MarkMessageRead marks a message as read
 func (h *DashboardHandler) MarkMessageRead(c echo.Context) error {
-	req := goodooHttp.GetGoodooRequest(c)
-	if req == nil || !req.IsAuthenticated() {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	if !req.IsAuthenticated() {
 		return echo.NewHTTPError(401, "Authentication required")
 	}
 
@@ -1628,69 +2332,114 @@ func (h *DashboardHandler) MarkMessageRead(c echo.Context) error {
 		return echo.NewHTTPError(400, "Message ID is required")
 	}
 
-	// In real implementation, update message read status in database
-	readTime := time.Now()
+	// The receipt of a group message may not exist yet: its room then comes
+	// from the body, {"room_id": "general"}
+	var body struct {
+		RoomID string `json:"room_id"`
+	}
+	if err := c.Bind(&body); err != nil {
+		return echo.NewHTTPError(400, "Invalid request format")
+	}
+	userID := uint(req.GetUserID())
+	if body.RoomID != "" && !userchat.CanJoin(body.RoomID, userID) {
+		return echo.NewHTTPError(403, "Not a participant of this room")
+	}
+
+	receipt, err := models.MarkRead(req.GetDB(), body.RoomID, messageID, userID, req.Now())
+	if err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to mark message %s read: %v", messageID, err)
+		return echo.NewHTTPError(500, "Failed to mark the message read")
+	}
+	if receipt.Room != "" {
+		userchat.Publish(req.GetDBName(), userchat.Event{Type: userchat.EventReceipt, Room: receipt.Room,
+			UserID: userID, MessageID: messageID, State: models.ReceiptRead})
+	}
 
 	return c.JSON(http.StatusOK, UserChatResponse{
 		Success: true,
 		Message: "Message marked as read",
 		Data: map[string]interface{}{
-			"message_id": messageID,
-			"read_at":    readTime,
+			"message_id":   messageID,
+			"state":        receipt.State(),
+			"delivered_at": receipt.DeliveredAt,
+			"read_at":      receipt.ReadAt,
 		},
 	})
 }
 
-// RegisterDashboardRoutes registers all dashboard routes
+// RegisterDashboardRoutes registers all dashboard routes; they all require
+// an authenticated session on a database
 func RegisterDashboardRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
 	handler := NewDashboardHandler(config)
-	
-	// Dashboard page (requires authentication)
-	protected := e.Group("")
-	protected.Use(goodooHttp.AuthenticationMiddleware(true))
-	protected.Use(goodooHttp.DatabaseMiddleware(true))
-	
-	protected.GET("/dashboard", handler.DashboardPage)
-	
-	// API endpoints for dashboard data
-	api := protected.Group("/api")
-	api.GET("/metrics", handler.GetMetrics)
-	api.GET("/metrics/charts", handler.GetChartData)
-	api.GET("/metrics/api", handler.GetAPIMetrics)
-	api.GET("/activity/recent", handler.GetRecentActivity)
-	api.GET("/users", handler.GetUsers)
-	api.GET("/social/stats", handler.GetSocialStats)
-	api.GET("/database/info", handler.GetDatabaseInfo)
-	api.GET("/logs/recent", handler.GetRecentLogs)
-	api.GET("/settings", handler.GetSettings)
-	api.POST("/settings", handler.SaveSettings)
-	api.POST("/users/create", handler.CreateUser)
-	
-	// LLM Tools API endpoints
-	api.GET("/llm/tools", handler.GetLLMTools)
-	api.GET("/llm/providers", handler.GetLLMProviders)
-	api.GET("/llm/models", handler.GetLLMModels)
-	api.GET("/llm/addons/status", handler.GetLLMAddonStatus)
-	api.POST("/llm/config", handler.SaveLLMConfiguration)
-	api.POST("/llm/test", handler.TestLLMConnection)
-	
-	// Chat API endpoints
-	api.POST("/chat/send", handler.SendChatMessage)
-	api.GET("/chat/sessions", handler.GetChatSessions)
-	api.GET("/chat/session/:id", handler.GetChatSession)
-	api.POST("/chat/session/new", handler.CreateChatSession)
-	api.DELETE("/chat/session/:id", handler.DeleteChatSession)
-	api.GET("/chat/models", handler.GetAvailableChatModels)
-	
-	// User-to-User Chat API endpoints
-	api.GET("/user-chat/rooms", handler.GetUserChatRooms)
-	api.GET("/user-chat/room/:id/messages", handler.GetUserChatMessages)
-	api.POST("/user-chat/send", handler.SendUserMessage)
-	api.GET("/user-chat/users", handler.GetChatUsers)
-	api.POST("/user-chat/room/create", handler.CreateGroupChat)
-	api.POST("/user-chat/room/:id/join", handler.JoinChatRoom)
-	api.POST("/user-chat/room/:id/leave", handler.LeaveChatRoom)
-	api.GET("/user-chat/presence", handler.GetUserPresence)
-	api.POST("/user-chat/presence", handler.UpdateUserPresence)
-	api.POST("/user-chat/message/:id/read", handler.MarkMessageRead)
-}
\ No newline at end of file
+	specs := []goodooHttp.RouteSpec{
+		// Dashboard page
+		{Method: "GET", Path: "/dashboard", Handler: handler.DashboardPage},
+
+		// API endpoints for dashboard data
+		{Method: "GET", Path: "/api/dashboard/summary", Handler: handler.GetSummary},
+		{Method: "GET", Path: "/api/metrics", Handler: handler.GetMetrics},
+		{Method: "GET", Path: "/api/metrics/charts", Handler: handler.GetChartData},
+		{Method: "GET", Path: "/api/metrics/export", Handler: handler.ExportMetrics, Permission: goodooHttp.PermissionMetricsRead},
+		{Method: "GET", Path: "/api/metrics/api", Handler: handler.GetAPIMetrics},
+		{Method: "GET", Path: "/api/metrics/outbound", Handler: handler.GetOutboundMetrics, Permission: goodooHttp.PermissionMetricsRead},
+		{Method: "GET", Path: "/api/activity/recent", Handler: handler.GetRecentActivity},
+		{Method: "GET", Path: "/api/users", Handler: handler.GetUsers},
+		{Method: "GET", Path: "/api/social/stats", Handler: handler.GetSocialStats},
+		{Method: "GET", Path: "/api/database/info", Handler: handler.GetDatabaseInfo},
+		{Method: "GET", Path: "/api/database/tables", Handler: handler.GetDatabaseTables},
+		{Method: "GET", Path: "/api/logs/recent", Handler: handler.GetRecentLogs, Permission: goodooHttp.PermissionLogsRead},
+		{Method: "GET", Path: "/api/settings", Handler: handler.GetSettings},
+		{Method: "POST", Path: "/api/settings", Handler: handler.SaveSettings, Permission: goodooHttp.PermissionSettingsWrite},
+		{Method: "GET", Path: "/api/settings/effective", Handler: handler.GetEffectiveConfig, Permission: goodooHttp.PermissionSettingsRead},
+		{Method: "GET", Path: "/api/settings/history", Handler: handler.GetSettingsHistory, Permission: goodooHttp.PermissionSettingsRead},
+		{Method: "POST", Path: "/api/settings/history/:change/rollback", Handler: handler.RollbackSettings, Permission: goodooHttp.PermissionSettingsWrite},
+		{Method: "POST", Path: "/api/users/create", Handler: handler.CreateUser, Permission: goodooHttp.PermissionUsersManage, Idempotent: true},
+
+		// LLM Tools API endpoints
+		{Method: "GET", Path: "/api/llm/tools", Handler: handler.GetLLMTools},
+		{Method: "GET", Path: "/api/llm/providers", Handler: handler.GetLLMProviders},
+		{Method: "GET", Path: "/api/llm/models", Handler: handler.GetLLMModels},
+		{Method: "GET", Path: "/api/llm/addons/status", Handler: handler.GetLLMAddonStatus},
+		{Method: "POST", Path: "/api/llm/config", Handler: handler.SaveLLMConfiguration, Permission: goodooHttp.PermissionLLMConfigure, DenyImpersonation: true},
+		{Method: "POST", Path: "/api/llm/test", Handler: handler.TestLLMConnection, RateLimit: "expensive"},
+		{Method: "GET", Path: "/api/llm/routes", Handler: handler.GetLLMRoutes},
+		{Method: "POST", Path: "/api/llm/routes", Handler: handler.SaveLLMRoute, Permission: goodooHttp.PermissionLLMConfigure, DenyImpersonation: true},
+		{Method: "DELETE", Path: "/api/llm/routes/:id", Handler: handler.DeleteLLMRoute, Permission: goodooHttp.PermissionLLMConfigure, DenyImpersonation: true},
+		{Method: "GET", Path: "/api/llm/templates", Handler: handler.GetPromptTemplates},
+		{Method: "POST", Path: "/api/llm/templates", Handler: handler.CreatePromptTemplate},
+		{Method: "GET", Path: "/api/llm/templates/:id", Handler: handler.GetPromptTemplate},
+		{Method: "PUT", Path: "/api/llm/templates/:id", Handler: handler.UpdatePromptTemplate},
+		{Method: "DELETE", Path: "/api/llm/templates/:id", Handler: handler.DeletePromptTemplate},
+		{Method: "POST", Path: "/api/llm/templates/:id/share", Handler: handler.SharePromptTemplate, Permission: goodooHttp.PermissionLLMTemplatesShare},
+		{Method: "POST", Path: "/api/llm/templates/:id/render", Handler: handler.RenderPromptTemplate},
+
+		// Chat API endpoints
+		{Method: "POST", Path: "/api/chat/send", Handler: handler.SendChatMessage, RateLimit: "expensive", Idempotent: true},
+		{Method: "POST", Path: "/api/chat/stream", Handler: handler.StreamChatMessage, RateLimit: "expensive"},
+		{Method: "GET", Path: "/api/chat/sessions", Handler: handler.GetChatSessions},
+		{Method: "GET", Path: "/api/chat/session/:id", Handler: handler.GetChatSession},
+		{Method: "POST", Path: "/api/chat/session/new", Handler: handler.CreateChatSession},
+		{Method: "PUT", Path: "/api/chat/session/:id", Handler: handler.UpdateChatSession},
+		{Method: "DELETE", Path: "/api/chat/session/:id", Handler: handler.DeleteChatSession},
+		{Method: "GET", Path: "/api/chat/models", Handler: handler.GetAvailableChatModels},
+
+		// User-to-User Chat API endpoints
+		{Method: "GET", Path: "/api/user-chat/rooms", Handler: handler.GetUserChatRooms},
+		{Method: "GET", Path: "/api/user-chat/room/:id/messages", Handler: handler.GetUserChatMessages},
+		{Method: "POST", Path: "/api/user-chat/send", Handler: handler.SendUserMessage},
+		{Method: "GET", Path: "/api/user-chat/users", Handler: handler.GetChatUsers},
+		{Method: "POST", Path: "/api/user-chat/room/create", Handler: handler.CreateGroupChat},
+		{Method: "POST", Path: "/api/user-chat/room/:id/join", Handler: handler.JoinChatRoom},
+		{Method: "POST", Path: "/api/user-chat/room/:id/leave", Handler: handler.LeaveChatRoom},
+		{Method: "GET", Path: "/api/user-chat/presence", Handler: handler.GetUserPresence},
+		{Method: "POST", Path: "/api/user-chat/presence", Handler: handler.UpdateUserPresence},
+		{Method: "POST", Path: "/api/user-chat/message/:id/read", Handler: handler.MarkMessageRead},
+		{Method: "POST", Path: "/api/user-chat/room/:id/typing", Handler: handler.UserTyping},
+		{Method: "GET", Path: "/api/user-chat/room/:id/stream", Handler: handler.StreamUserChatRoom},
+	}
+	for i := range specs {
+		specs[i].Auth = true
+		specs[i].DB = true
+	}
+	goodooHttp.MustRegisterRoutes(e, specs)
+}
@@ -0,0 +1,292 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	goodooHttp "goodoo/http"
+	"goodoo/metrics"
+	"goodoo/models"
+)
+
+// dashboardSummaryTTL is how long the sections shared by the users of a
+// database are reused, so the admins refreshing the dashboard together
+// run the collectors once
+const dashboardSummaryTTL = 15 * time.Second
+
+// summaryActivityLimit is the number of activity entries in the summary
+const summaryActivityLimit = 10
+
+// Sections of the dashboard summary
+const (
+	SummaryMetrics  = "metrics"
+	SummaryCharts   = "charts"
+	SummaryActivity = "activity"
+	SummaryDatabase = "database"
+	SummarySessions = "sessions"
+	SummaryLLM      = "llm"
+)
+
+// summarySections lists the sections in the order they are assembled
+var summarySections = []string{SummaryMetrics, SummaryCharts, SummaryActivity, SummaryDatabase, SummarySessions, SummaryLLM}
+
+// DashboardSummaryResponse is the dashboard overview. Only the requested
+// sections are set; a section whose source failed is left out and its
+// error given in Errors.
+type DashboardSummaryResponse struct {
+	// GeneratedAt is when the oldest of the shared sections was collected
+	GeneratedAt time.Time                `json:"generated_at"`
+	Sections    []string                 `json:"sections"`
+	Metrics     *MetricsResponse         `json:"metrics,omitempty"`
+	Charts      *ChartDataResponse       `json:"charts,omitempty"`
+	Activity    *[]ActivityItem          `json:"activity,omitempty"`
+	Database    *DatabaseInfoResponse    `json:"database,omitempty"`
+	Sessions    *goodooHttp.SessionStats `json:"sessions,omitempty"`
+	LLM         *models.LLMSummary       `json:"llm,omitempty"`
+	Errors      map[string]string        `json:"errors,omitempty"`
+}
+
+// summaryChart is the cached metrics history of the last 24 hours; its
+// labels depend on the user's timezone and are made per request
+type summaryChart struct {
+	from, to time.Time
+	series   []models.MetricsSample
+}
+
+// summarySection is a cached section of the summary of a database
+type summarySection struct {
+	mu          sync.Mutex
+	value       interface{}
+	err         error
+	collectedAt time.Time
+}
+
+var (
+	summaryCache   = make(map[string]*summarySection) // "dbName/section"
+	summaryCacheMu sync.Mutex
+)
+
+// cachedSummarySection returns the cached value of a section shared by the
+// users of dbName, or collects it. Requests asking while it is collected
+// wait for the result instead of collecting it again.
+func cachedSummarySection(dbName, section string, collect func() (interface{}, error)) (interface{}, time.Time, error) {
+	key := dbName + "/" + section
+	summaryCacheMu.Lock()
+	entry, ok := summaryCache[key]
+	if !ok {
+		entry = &summarySection{}
+		summaryCache[key] = entry
+	}
+	summaryCacheMu.Unlock()
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	if entry.collectedAt.IsZero() || time.Since(entry.collectedAt) >= dashboardSummaryTTL {
+		entry.value, entry.err = collectSection(collect)
+		entry.collectedAt = time.Now()
+	}
+	return entry.value, entry.collectedAt, entry.err
+}
+
+// collectSection runs a collector, turning a panic into an error so a
+// failing source cannot take the summary down
+func collectSection(collect func() (interface{}, error)) (value interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("collector panicked: %v", r)
+		}
+	}()
+	return collect()
+}
+
+// summaryRequest assembles the summary of one request, remembering the
+// oldest shared section and the errors of the failed ones
+type summaryRequest struct {
+	h           *DashboardHandler
+	req         *goodooHttp.Request
+	response    *DashboardSummaryResponse
+	generatedAt time.Time
+}
+
+// shared returns a section shared by the users of the database
+func (s *summaryRequest) shared(section string, collect func() (interface{}, error)) (interface{}, error) {
+	value, collectedAt, err := cachedSummarySection(s.req.GetDBName(), section, collect)
+	if s.generatedAt.IsZero() || collectedAt.Before(s.generatedAt) {
+		s.generatedAt = collectedAt
+	}
+	return value, err
+}
+
+// fail records the error of a section
+func (s *summaryRequest) fail(section string, err error) {
+	s.req.Logger.WarningCtx(s.req.Context, "Dashboard summary section %s failed: %v", section, err)
+	s.response.Errors[section] = err.Error()
+}
+
+// sessions returns the session statistics, which also feed the active
+// users of the metrics; nil when the session store does not report them
+func (s *summaryRequest) sessions() (*goodooHttp.SessionStats, error) {
+	value, err := s.shared(SummarySessions, func() (interface{}, error) {
+		return s.h.sessionStats(s.req.GetDBName()), nil
+	})
+	stats, _ := value.(*goodooHttp.SessionStats)
+	return stats, err
+}
+
+// collect sets one section of the response
+func (s *summaryRequest) collect(section string) error {
+	req := s.req
+	switch section {
+	case SummaryMetrics:
+		sessions, _ := s.sessions()
+		value, err := s.shared(SummaryMetrics, func() (interface{}, error) {
+			db := req.GetDB()
+			if db == nil {
+				return nil, fmt.Errorf("database not available")
+			}
+			response := s.h.collectMetrics(req, db, sessions)
+			return &response, nil
+		})
+		if err != nil {
+			return err
+		}
+		s.response.Metrics = value.(*MetricsResponse)
+
+	case SummaryCharts:
+		value, err := s.shared(SummaryCharts, func() (interface{}, error) {
+			db := req.GetDB()
+			if db == nil {
+				return nil, fmt.Errorf("database not available")
+			}
+			to := time.Now()
+			from := to.Add(-24 * time.Hour)
+			series, err := metrics.Series(db, req.GetDBName(), from, to, models.MetricsHour)
+			if err != nil {
+				return nil, err
+			}
+			return &summaryChart{from: from, to: to, series: series}, nil
+		})
+		if err != nil {
+			return err
+		}
+		chart := value.(*summaryChart)
+		loc := requestLocation(req)
+		response := chartResponse(chart.series, chart.from.In(loc), chart.to.In(loc), models.MetricsHour, loc)
+		s.response.Charts = &response
+
+	case SummaryActivity:
+		// The feed depends on the user and their language: it is not shared
+		env := req.GetEnv()
+		if env == nil {
+			return fmt.Errorf("database not available")
+		}
+		filter := models.ActivityFilter{Limit: summaryActivityLimit}
+		if !env.HasGroup(goodooHttp.GroupSystem) {
+			filter.UserID = env.GetUser()
+		}
+		value, err := collectSection(func() (interface{}, error) {
+			return recentActivity(env, filter)
+		})
+		if err != nil {
+			return err
+		}
+		activities := value.([]ActivityItem)
+		s.response.Activity = &activities
+
+	case SummaryDatabase:
+		value, err := s.shared(SummaryDatabase, func() (interface{}, error) {
+			response, err := collectDatabaseInfo(req)
+			if err != nil {
+				return nil, err
+			}
+			return &response, nil
+		})
+		if err != nil {
+			return err
+		}
+		s.response.Database = value.(*DatabaseInfoResponse)
+
+	case SummarySessions:
+		if !req.HasPermission(goodooHttp.PermissionSessionsRead) {
+			return fmt.Errorf("access denied")
+		}
+		stats, err := s.sessions()
+		if err != nil {
+			return err
+		}
+		if stats == nil {
+			return fmt.Errorf("the session store does not report statistics")
+		}
+		s.response.Sessions = stats
+
+	case SummaryLLM:
+		value, err := s.shared(SummaryLLM, func() (interface{}, error) {
+			db := req.GetDB()
+			if db == nil {
+				return nil, fmt.Errorf("database not available")
+			}
+			catalog, err := models.LoadLLMCatalog(db, req.GetDBName())
+			if err != nil {
+				return nil, err
+			}
+			return &catalog.Summary, nil
+		})
+		if err != nil {
+			return err
+		}
+		s.response.LLM = value.(*models.LLMSummary)
+	}
+	return nil
+}
+
+// GetSummary assembles the dashboard overview in one response: metrics,
+// the charts of the last 24 hours, the latest activity, the database
+// status, the session statistics and the LLM summary. ?sections= keeps
+// some of them, comma-separated; by default every section the user may
+// read is returned. A failing section is reported in errors while the
+// others are still returned.
+func (h *DashboardHandler) GetSummary(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+
+	sections := goodooHttp.SplitList(c.QueryParam("sections"))
+	if len(sections) == 0 {
+		for _, section := range summarySections {
+			if section == SummarySessions && !req.HasPermission(goodooHttp.PermissionSessionsRead) {
+				continue
+			}
+			sections = append(sections, section)
+		}
+	}
+	for _, section := range sections {
+		if !slices.Contains(summarySections, section) {
+			return c.JSON(http.StatusBadRequest, map[string]interface{}{
+				"error":    "Unknown section: " + section,
+				"sections": summarySections,
+			})
+		}
+	}
+
+	response := &DashboardSummaryResponse{Sections: sections, Errors: make(map[string]string)}
+	summary := &summaryRequest{h: h, req: req, response: response}
+	for _, section := range summarySections {
+		if !slices.Contains(sections, section) {
+			continue
+		}
+		if err := summary.collect(section); err != nil {
+			summary.fail(section, err)
+		}
+	}
+
+	response.GeneratedAt = summary.generatedAt
+	if response.GeneratedAt.IsZero() {
+		response.GeneratedAt = time.Now()
+	}
+	if len(response.Errors) == 0 {
+		response.Errors = nil
+	}
+	return c.JSON(http.StatusOK, response)
+}
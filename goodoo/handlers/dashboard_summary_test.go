@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	goodooHttp "goodoo/http"
+	"goodoo/logging"
+)
+
+var (
+	timeType      = reflect.TypeOf(time.Time{})
+	marshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+)
+
+// jsonShape describes the JSON encoding of values of t: the keys of the
+// objects with the shape of their values, a trailing "?" marking those
+// left out when empty, the element of the arrays and the values of the
+// maps, and the kind of the scalars
+func jsonShape(t reflect.Type, seen map[reflect.Type]bool) interface{} {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return "time"
+	case t.Implements(marshalerType) || reflect.PointerTo(t).Implements(marshalerType):
+		return "custom: " + t.String()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		if seen[t] {
+			return "recursive: " + t.String()
+		}
+		seen[t] = true
+		defer delete(seen, t)
+		shape := make(map[string]interface{})
+		addStructShape(shape, t, seen)
+		return shape
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "base64"
+		}
+		return []interface{}{jsonShape(t.Elem(), seen)}
+	case reflect.Map:
+		return map[string]interface{}{"<" + t.Key().Kind().String() + ">": jsonShape(t.Elem(), seen)}
+	case reflect.Interface:
+		return "any"
+	default:
+		return t.Kind().String()
+	}
+}
+
+// addStructShape adds the keys of the exported fields of t to shape,
+// those of its embedded structs included
+func addStructShape(shape map[string]interface{}, t reflect.Type, seen map[reflect.Type]bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" || (!field.IsExported() && !field.Anonymous) {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			addStructShape(shape, field.Type, seen)
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if strings.Contains(options, "omitempty") {
+			name += "?"
+		}
+		shape[name] = jsonShape(field.Type, seen)
+	}
+}
+
+// TestDashboardSummaryShapeGolden locks the keys and types of every section
+// of GET /api/dashboard/summary, down to the nested objects: the dashboard
+// and embedded views read them, so a renamed or retyped key fails here
+func TestDashboardSummaryShapeGolden(t *testing.T) {
+	assertGolden(t, "dashboard_summary_shape.golden.json",
+		jsonShape(reflect.TypeOf(DashboardSummaryResponse{}), make(map[reflect.Type]bool)))
+}
+
+// newSummaryTestServer serves the dashboard summary of a database without
+// a connection, so each section needing one fails
+func newSummaryTestServer(t *testing.T) *echo.Echo {
+	store, err := goodooHttp.NewFilesystemSessionStore(t.TempDir(), false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &goodooHttp.RequestConfig{
+		SessionStore:  store,
+		DefaultDBName: "summary_test",
+		Logger:        logging.GetLogger("goodoo.handlers.test"),
+	}
+	e := echo.New()
+	goodooHttp.UseRequestMiddleware(e, config)
+	h := &DashboardHandler{config: config}
+	e.GET("/api/dashboard/summary", h.GetSummary)
+	return e
+}
+
+// TestDashboardSummaryGolden locks the partial response, one error per
+// failed section and none of their keys, and the answer to an unknown
+// section
+func TestDashboardSummaryGolden(t *testing.T) {
+	e := newSummaryTestServer(t)
+	tests := []struct {
+		golden string
+		query  string
+		status int
+	}{
+		{"dashboard_summary_partial.golden.json", "sections=llm,metrics,charts", http.StatusOK},
+		{"dashboard_summary_unknown.golden.json", "sections=metrics,weather", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.golden, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/dashboard/summary?"+tt.query, nil))
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			var payload map[string]interface{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &payload); err != nil {
+				t.Fatal(err)
+			}
+			if generatedAt, ok := payload["generated_at"].(string); ok {
+				if _, err := time.Parse(time.RFC3339Nano, generatedAt); err != nil {
+					t.Errorf("generated_at = %q: %v", generatedAt, err)
+				}
+				payload["generated_at"] = "<time>"
+			}
+			assertGolden(t, tt.golden, payload)
+		})
+	}
+}
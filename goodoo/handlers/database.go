@@ -1,10 +1,21 @@
 package handlers
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
 	"net/http"
+	"os"
+	"time"
 
 	"github.com/labstack/echo/v4"
+	"goodoo/backup"
+	"goodoo/database"
 	goodooHttp "goodoo/http"
+	"goodoo/models"
+	"goodoo/operations"
 )
 
 // DatabaseHandler handles database-related requests
@@ -66,4 +77,177 @@ func (h *DatabaseHandler) SetDatabase(c echo.Context) error {
 		"database": body.Database,
 		"message":  "Database updated successfully",
 	})
-}
\ No newline at end of file
+}
+// Backup streams an archive of the database :name. It requires the master
+// password (form field master_pwd); format=sql forces the built-in dumper.
+// The dump is tracked as an operation whose id is sent in X-Operation-Id.
+func (h *DatabaseHandler) Backup(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	if err := backup.CheckMasterPassword(c.FormValue("master_pwd")); err != nil {
+		req.Logger.WarningCtx(req.Context, "Refused backup of %s: %v", c.Param("name"), err)
+		return c.JSON(http.StatusForbidden, map[string]string{"error": err.Error()})
+	}
+
+	name := c.Param("name")
+	if !backup.ValidName(name) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": backup.ErrInvalidName.Error()})
+	}
+	server, err := database.GetDatabase(h.Config.DefaultDBName)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database not available")
+	}
+	exists, err := backup.DatabaseExists(server, name)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if !exists {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Database not found"})
+	}
+
+	format := backup.CurrentConfig().Format
+	if c.FormValue("format") == backup.FormatSQL {
+		format = backup.FormatSQL
+	}
+
+	// The operation writes the archive into a pipe copied to the response
+	reader, writer := io.Pipe()
+	op := operations.Start("backup", "", name, req.GetUserID(), 0, func(ctx context.Context, op *operations.Operation) error {
+		_, err := backup.Write(ctx, name, format, writer, op)
+		writer.CloseWithError(err)
+		return err
+	})
+
+	response := c.Response()
+	response.Header().Set(echo.HeaderContentType, "application/zip")
+	response.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="%s"`, backup.FileName(name, time.Now())))
+	response.Header().Set("X-Operation-Id", op.Status().ID)
+	response.WriteHeader(http.StatusOK)
+
+	req.Logger.InfoCtx(req.Context, "Backup of %s started (%s)", name, op.Status().ID)
+	if _, err := io.Copy(response, reader); err != nil {
+		// The client went away or the dump failed: stop the dump
+		reader.CloseWithError(err)
+		op.Cancel()
+		op.Wait()
+		req.Logger.ErrorCtx(req.Context, "Backup of %s failed: %v", name, err)
+		return nil
+	}
+	op.Wait()
+	return nil
+}
+
+// Restore restores the uploaded archive (form file backup) into the new
+// database name. It requires the master password and never overwrites an
+// existing database. The restore runs as an operation; the response holds
+// its id, the archive manifest and warnings when the archive was made by
+// another version or with other models.
+func (h *DatabaseHandler) Restore(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	if err := backup.CheckMasterPassword(c.FormValue("master_pwd")); err != nil {
+		req.Logger.WarningCtx(req.Context, "Refused restore of %s: %v", c.FormValue("name"), err)
+		return c.JSON(http.StatusForbidden, map[string]string{"error": err.Error()})
+	}
+
+	name := c.FormValue("name")
+	if !backup.ValidName(name) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": backup.ErrInvalidName.Error()})
+	}
+	server, err := database.GetDatabase(h.Config.DefaultDBName)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database not available")
+	}
+	exists, err := backup.DatabaseExists(server, name)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if exists {
+		return c.JSON(http.StatusConflict, map[string]string{"error": backup.ErrDatabaseExists.Error()})
+	}
+
+	header, err := c.FormFile("backup")
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "A backup file is required"})
+	}
+	path, err := saveUpload(header)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	manifest, err := backup.ReadManifest(path)
+	if err != nil {
+		os.Remove(path)
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	warnings := manifest.Check(models.RegistryForDB(h.Config.DefaultDBName))
+	for _, warning := range warnings {
+		req.Logger.WarningCtx(req.Context, "Restoring %s: %s", name, warning)
+	}
+
+	op := operations.Start("restore", "", name, req.GetUserID(), 0, func(ctx context.Context, op *operations.Operation) error {
+		defer os.Remove(path)
+		return backup.Restore(ctx, server, path, name, op)
+	})
+
+	req.Logger.InfoCtx(req.Context, "Restore of %s from %s started (%s)", name, manifest.DBName, op.Status().ID)
+	return c.JSON(http.StatusAccepted, map[string]interface{}{
+		"operation_id": op.Status().ID,
+		"manifest":     manifest,
+		"warnings":     warnings,
+	})
+}
+
+// DatabaseStatus returns the readiness of the databases warmed up at startup
+func (h *DatabaseHandler) DatabaseStatus(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"enabled":   database.WarmupEnabled(),
+		"databases": database.WarmupStatuses(),
+	})
+}
+
+// RetryWarmup warms up a database again without waiting for its next
+// background retry: {"database": "name"}, every degraded database when the
+// body is empty
+func (h *DatabaseHandler) RetryWarmup(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	if !database.WarmupEnabled() {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Database warm-up is disabled"})
+	}
+	var body struct {
+		Database string `json:"database"`
+	}
+	if err := c.Bind(&body); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+	}
+
+	statuses, err := database.RetryWarmup(body.Database)
+	if errors.Is(err, database.ErrNotWarmedUp) {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	req.Logger.InfoCtx(req.Context, "Database warm-up retried by %s", req.GetLogin())
+	return c.JSON(http.StatusOK, map[string]interface{}{"enabled": true, "databases": statuses})
+}
+
+// saveUpload copies an uploaded file to a temporary file and returns its path
+func saveUpload(header *multipart.FileHeader) (string, error) {
+	file, err := header.Open()
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	temp, err := os.CreateTemp("", "goodoo-restore-*.zip")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(temp, file)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return "", err
+	}
+	return temp.Name(), nil
+}
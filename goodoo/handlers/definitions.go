@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	goodooHttp "goodoo/http"
+	"goodoo/models"
+)
+
+// maxDefinitionBytes bounds the body of a definition import
+const maxDefinitionBytes = 4 << 20
+
+// DefinitionHandler exports and imports the definitions of field-defined
+// models, to promote them from one database to another
+type DefinitionHandler struct {
+	Config *goodooHttp.RequestConfig
+}
+
+// NewDefinitionHandler creates a new definition handler
+func NewDefinitionHandler(config *goodooHttp.RequestConfig) *DefinitionHandler {
+	return &DefinitionHandler{Config: config}
+}
+
+// Export returns the definition document of :model in the database of
+// the request
+func (h *DefinitionHandler) Export(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	name := c.Param("model")
+	model, exists := models.RegistryForDB(req.GetDBName()).GetModel(name)
+	if !exists {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Unknown model: " + name})
+	}
+	doc := models.ExportDefinition(model)
+	if db := req.GetDB(); db != nil {
+		doc.Version = models.DefinitionVersion(db, name)
+	}
+	return c.JSON(http.StatusOK, doc)
+}
+
+// Import applies definition documents, a single one or an array:
+// POST /api/models/definitions/import?dry_run=true&force=false
+// Each definition is reported with its status (new, changed or
+// unchanged), the changes of its fields, the schema changes they call for
+// and whether any may lose data. With dry_run nothing is applied;
+// destructive schema changes are only applied with force. An invalid
+// document, e.g. with a field type this server does not know, fails the
+// whole import.
+func (h *DefinitionHandler) Import(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	dryRun, _ := strconv.ParseBool(c.QueryParam("dry_run"))
+	force, _ := strconv.ParseBool(c.QueryParam("force"))
+
+	body, err := io.ReadAll(io.LimitReader(c.Request().Body, maxDefinitionBytes+1))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Failed to read the request body"})
+	}
+	if len(body) > maxDefinitionBytes {
+		return c.JSON(http.StatusRequestEntityTooLarge, map[string]string{"error": "Definitions too large"})
+	}
+	var docs []models.DefinitionDocument
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		err = json.Unmarshal(body, &docs)
+	} else {
+		var doc models.DefinitionDocument
+		err = json.Unmarshal(body, &doc)
+		docs = append(docs, doc)
+	}
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid definition document: " + err.Error()})
+	}
+	if len(docs) == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "No definition to import"})
+	}
+
+	db := req.GetDB()
+	if db == nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database not available"})
+	}
+	options := models.ImportOptions{DryRun: dryRun, Force: force}
+	diffs, err := models.ImportDefinitions(req.GetDBName(), db, uint(req.GetUserID()), docs, options)
+	if errors.Is(err, models.ErrInvalidDefinition) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	if err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to apply model definitions: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]interface{}{
+			"error":       "Failed to apply the definitions: " + err.Error(),
+			"definitions": diffs,
+		})
+	}
+	if !dryRun {
+		for _, diff := range diffs {
+			if diff.Status != models.DefinitionUnchanged {
+				req.Logger.InfoCtx(req.Context, "User %s imported the definition of %s (%s, version %d)",
+					req.GetLogin(), diff.Model, diff.Status, diff.Version)
+			}
+		}
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"dry_run":     dryRun,
+		"force":       force,
+		"definitions": diffs,
+	})
+}
+
+// RegisterDefinitionRoutes mounts the definition export and import
+// (models.manage)
+func RegisterDefinitionRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewDefinitionHandler(config)
+
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		{Method: "GET", Path: "/api/models/:model/definition", Handler: handler.Export, Auth: true, DB: true, Permission: goodooHttp.PermissionModelsManage},
+		{Method: "POST", Path: "/api/models/definitions/import", Handler: handler.Import, Auth: true, DB: true, Permission: goodooHttp.PermissionModelsManage, DenyImpersonation: true},
+	})
+}
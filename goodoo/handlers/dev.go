@@ -0,0 +1,328 @@
+package handlers
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/labstack/echo/v4"
+	"goodoo/api"
+	"goodoo/database"
+	goodooHttp "goodoo/http"
+	"goodoo/loaddata"
+	"goodoo/models"
+)
+
+// DevHandler serves the developer mode endpoints: the effective definition
+// of a model, clearing caches, reloading the registry of a database, the
+// resolved context of the request and the generation of load data. They
+// are only registered in developer mode (see server.Config.DevMode), so
+// they do not exist in production.
+type DevHandler struct {
+	Config *goodooHttp.RequestConfig
+}
+
+// NewDevHandler creates a new developer mode handler
+func NewDevHandler(config *goodooHttp.RequestConfig) *DevHandler {
+	return &DevHandler{Config: config}
+}
+
+// devField is a field of a model as the developer endpoint shows it
+type devField struct {
+	models.FieldDocument
+	// Origin is where the field comes from: "base" for the columns every
+	// model has, the inherited model it was copied from, or "own"
+	Origin      string   `json:"origin"`
+	Stored      bool     `json:"stored"`
+	Column      string   `json:"column,omitempty"`
+	Constraints []string `json:"constraints,omitempty"`
+}
+
+// fieldOrigin returns where a field of a model comes from: inherited
+// fields are shared with the model they were copied from
+func fieldOrigin(registry *models.FieldModelRegistry, model *models.ModelDefinition, name string) string {
+	if models.IsMagicColumn(name) {
+		return "base"
+	}
+	field := model.Fields[name]
+	for _, parentName := range model.Inherits {
+		if parent, exists := registry.GetModel(parentName); exists && parent.Fields[name] == field {
+			return parentName
+		}
+	}
+	return "own"
+}
+
+// Model dumps the effective definition of :model in the database of the
+// request: its merged fields with their origin, column type and
+// constraints, its indexes and the API methods registered on it
+func (h *DevHandler) Model(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	dbName := req.GetDBName()
+	registry := models.RegistryForDB(dbName)
+	name := c.Param("model")
+	model, exists := registry.GetModel(name)
+	if !exists {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Unknown model: " + name})
+	}
+
+	doc := models.ExportDefinition(model)
+	fieldsInfo := make(map[string]devField, len(model.Fields))
+	for fieldName, field := range model.Fields {
+		info := devField{
+			FieldDocument: doc.Fields[fieldName],
+			Origin:        fieldOrigin(registry, model, fieldName),
+			Stored:        field.IsStored(),
+			Constraints:   field.GetSQLConstraints(),
+		}
+		if info.Stored {
+			info.Column, _ = field.GetColumnType()
+		}
+		fieldsInfo[fieldName] = info
+	}
+	methods := []string{}
+	for methodName := range api.DefaultAPIRegistry.ForDatabase(dbName).GetMethods(name) {
+		methods = append(methods, methodName)
+	}
+	sort.Strings(methods)
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"name":         model.Name,
+		"table_name":   model.TableName,
+		"description":  model.Description,
+		"abstract":     model.Abstract,
+		"transient":    model.Transient,
+		"inherits":     model.Inherits,
+		"rec_name":     model.RecName,
+		"quick_create": model.QuickCreate,
+		"fields":       fieldsInfo,
+		"indexes":      doc.Indexes,
+		"methods":      methods,
+		"checksum":     doc.Checksum,
+	})
+}
+
+// devCaches are the caches POST /api/dev/cache/clear can drop, by name
+var devCaches = map[string]func(dbName string){
+	"params":      models.InvalidateParams,
+	"permissions": models.InvalidatePermissions,
+	"stats":       database.InvalidateStats,
+}
+
+// ClearCache drops caches of the database of the request, in this process:
+// {"caches": ["params"]}, or all of them without a body. Known caches are
+// params (system parameters), permissions (resolved user permissions) and
+// stats (database statistics).
+func (h *DevHandler) ClearCache(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	dbName := req.GetDBName()
+
+	var body struct {
+		Caches []string `json:"caches"`
+	}
+	if err := c.Bind(&body); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+	}
+	names := body.Caches
+	if len(names) == 0 {
+		for name := range devCaches {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, known := devCaches[name]; !known {
+			known := make([]string, 0, len(devCaches))
+			for name := range devCaches {
+				known = append(known, name)
+			}
+			sort.Strings(known)
+			return c.JSON(http.StatusBadRequest, map[string]interface{}{"error": "Unknown cache: " + name, "caches": known})
+		}
+	}
+	for _, name := range names {
+		devCaches[name](dbName)
+	}
+	req.Logger.InfoCtx(req.Context, "Caches %v of %s cleared by %s", names, dbName, req.GetLogin())
+	return c.JSON(http.StatusOK, map[string]interface{}{"cleared": names})
+}
+
+// registryChange is a model whose definition a reload changed
+type registryChange struct {
+	Model   string                    `json:"model"`
+	Changes []models.DefinitionChange `json:"changes"`
+	// AddedMethods and RemovedMethods are the API methods of the model
+	// that appeared or disappeared
+	AddedMethods   []string `json:"added_methods,omitempty"`
+	RemovedMethods []string `json:"removed_methods,omitempty"`
+}
+
+// sortedKeys returns the keys of a map in order
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ReloadRegistry rebuilds the model and API registries of the database of
+// the request from the global templates and the definitions imported into
+// it, and reports what changed: models added, removed or changed, and API
+// methods added or removed. The routes themselves are registered once at
+// startup; API methods are served through them and follow the reload.
+func (h *DevHandler) ReloadRegistry(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	dbName := req.GetDBName()
+
+	beforeModels := models.RegistryForDB(dbName).GetAllModels()
+	beforeMethods := api.DefaultAPIRegistry.ForDatabase(dbName).GetAllMethods()
+	rebuilt := models.DefaultFieldModelRegistry.RebuildForDatabase(dbName)
+	afterModels := rebuilt.GetAllModels()
+	afterMethods := api.DefaultAPIRegistry.RebuildForDatabase(dbName).GetAllMethods()
+
+	added, removed := []string{}, []string{}
+	changed := []registryChange{}
+	for _, name := range sortedKeys(afterModels) {
+		if _, existed := beforeModels[name]; !existed {
+			added = append(added, name)
+		}
+	}
+	// The models present before, and those only known to the API registry
+	known := make(map[string]bool, len(beforeModels))
+	for name := range beforeModels {
+		known[name] = true
+	}
+	for _, methods := range []map[string]map[string]*api.APIMethod{beforeMethods, afterMethods} {
+		for name := range methods {
+			if _, exists := afterModels[name]; !exists {
+				known[name] = true
+			}
+		}
+	}
+	for _, name := range sortedKeys(known) {
+		before, existed := beforeModels[name]
+		after, exists := afterModels[name]
+		if existed && !exists {
+			removed = append(removed, name)
+			continue
+		}
+		change := registryChange{Model: name}
+		if existed {
+			change.Changes = models.DiffDefinitions(models.ExportDefinition(before), models.ExportDefinition(after))
+		}
+		for method := range afterMethods[name] {
+			if _, existed := beforeMethods[name][method]; !existed {
+				change.AddedMethods = append(change.AddedMethods, method)
+			}
+		}
+		for method := range beforeMethods[name] {
+			if _, exists := afterMethods[name][method]; !exists {
+				change.RemovedMethods = append(change.RemovedMethods, method)
+			}
+		}
+		if len(change.Changes) > 0 || len(change.AddedMethods) > 0 || len(change.RemovedMethods) > 0 {
+			sort.Strings(change.AddedMethods)
+			sort.Strings(change.RemovedMethods)
+			changed = append(changed, change)
+		}
+	}
+
+	// The reloaded models may expect columns the database lacks
+	schema, err := models.CheckSchema(dbName, req.GetDB(), rebuilt)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	req.Logger.InfoCtx(req.Context, "Registry of %s reloaded by %s: %d model(s) added, %d removed, %d changed",
+		dbName, req.GetLogin(), len(added), len(removed), len(changed))
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"models":  len(afterModels),
+		"added":   added,
+		"removed": removed,
+		"changed": changed,
+		"schema":  schema.Status,
+	})
+}
+
+// Context echoes what the request resolved to: the user, their groups and
+// permissions, the language and timezone, the database and the context,
+// to debug authentication and access issues
+func (h *DevHandler) Context(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	env := req.GetEnv()
+	permissions, admin := req.EffectivePermissions()
+	groups, err := models.UserGroupXMLIDs(req.GetDB(), uint(req.GetUserID()))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	context := env.GetContext()
+	tz, _ := context["tz"].(string)
+
+	response := map[string]interface{}{
+		"uid":          req.GetUserID(),
+		"login":        req.GetLogin(),
+		"db":           req.GetDBName(),
+		"request_id":   req.GetRequestID(),
+		"admin":        admin,
+		"groups":       groups,
+		"permissions":  permissions,
+		"lang":         env.Lang(),
+		"tz":           tz,
+		"context":      context,
+		"impersonated": req.IsImpersonated(),
+	}
+	if req.IsImpersonated() {
+		response["impersonator_uid"] = req.GetImpersonatorID()
+	}
+	if req.ServiceAccount != nil {
+		response["service_account"] = req.ServiceAccount
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// LoadData starts an operation filling a model with random records for
+// load testing: {"model": "x_order", "count": 100000, "seed": 1,
+// "relations": {"partner_id": {"skew": 2}}} (see loaddata.Options). It
+// is refused unless the database is flagged as non-production.
+func (h *DevHandler) LoadData(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	dbName := req.GetDBName()
+	if err := loaddata.CheckAllowed(dbName); err != nil {
+		return c.JSON(http.StatusForbidden, map[string]string{"error": err.Error()})
+	}
+
+	var opts loaddata.Options
+	if err := c.Bind(&opts); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+	}
+	generator, err := loaddata.New(req.GetEnv(), opts)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	op := loaddata.Start(generator, req.GetUserID())
+	total := generator.Total()
+	req.Logger.InfoCtx(req.Context, "Load data %s of %s started by %s: %d record(s) of %s, seed %d",
+		op.Status().ID, dbName, req.GetLogin(), total, opts.Model, opts.Seed)
+	return c.JSON(http.StatusAccepted, map[string]interface{}{
+		"operation_id": op.Status().ID,
+		"model":        opts.Model,
+		"total":        total,
+	})
+}
+
+// RegisterDevRoutes mounts the developer mode endpoints under /api/dev,
+// which require the dev.manage permission. The server only calls it in
+// developer mode.
+func RegisterDevRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewDevHandler(config)
+	manage := goodooHttp.PermissionDevManage
+
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		{Method: "GET", Path: "/api/dev/models/:model", Handler: handler.Model, Auth: true, DB: true, Permission: manage},
+		{Method: "POST", Path: "/api/dev/cache/clear", Handler: handler.ClearCache, Auth: true, DB: true, Permission: manage},
+		{Method: "POST", Path: "/api/dev/registry/reload", Handler: handler.ReloadRegistry, Auth: true, DB: true, Permission: manage},
+		{Method: "GET", Path: "/api/dev/context", Handler: handler.Context, Auth: true, DB: true, Permission: manage},
+		{Method: "POST", Path: "/api/dev/loaddata", Handler: handler.LoadData, Auth: true, DB: true, Permission: manage},
+	})
+}
@@ -0,0 +1,207 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	goodooHttp "goodoo/http"
+	"goodoo/models"
+	"gorm.io/gorm"
+)
+
+// CheckDuplicates returns the records a candidate, given as create values
+// in the body, probably duplicates under the duplicate rules of the model,
+// with their score and the rule that matched. ?exclude=<id> leaves a
+// stored record out, to check it against the others.
+func (h *RecordsHandler) CheckDuplicates(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	model, err := h.resolveModel(c)
+	if err != nil {
+		return err
+	}
+	var exclude uint
+	if value := c.QueryParam("exclude"); value != "" {
+		id, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "exclude must be a record ID"})
+		}
+		exclude = uint(id)
+	}
+
+	env, err := contextEnv(c, req.GetEnv())
+	if err != nil {
+		return err
+	}
+	vals := bodyValues(req)
+	model.ParseLocalized(env, vals)
+	matches, err := model.CheckDuplicates(env, vals, exclude)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"duplicates": matches})
+}
+
+// duplicateWarnings returns the records a created record matches under
+// the warning duplicate rules; a failed check only logs
+func duplicateWarnings(env *models.Environment, model *models.ModelDefinition, vals map[string]interface{}, id uint) []models.DuplicateMatch {
+	matches, err := model.CheckDuplicates(env, vals, id)
+	if err != nil {
+		model.Logger.Warning("Duplicate check of %s(%d) failed: %v", model.Name, id, err)
+		return nil
+	}
+	var warnings []models.DuplicateMatch
+	for _, match := range matches {
+		if match.Action == models.DuplicateWarn {
+			warnings = append(warnings, match)
+		}
+	}
+	return warnings
+}
+
+// DuplicateRuleHandler manages the duplicate rules of the field models
+// (administrators only)
+type DuplicateRuleHandler struct {
+	Config *goodooHttp.RequestConfig
+}
+
+// NewDuplicateRuleHandler creates a new duplicate rule handler
+func NewDuplicateRuleHandler(config *goodooHttp.RequestConfig) *DuplicateRuleHandler {
+	return &DuplicateRuleHandler{Config: config}
+}
+
+// loadDuplicateRule fetches the rule named by the :id route parameter
+func loadDuplicateRule(c echo.Context, db *gorm.DB) (*models.DuplicateRule, error) {
+	id, err := parseRecordID(c)
+	if err != nil {
+		return nil, err
+	}
+	var rule models.DuplicateRule
+	if err := db.First(&rule, id).Error; err != nil {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Duplicate rule not found")
+	}
+	return &rule, nil
+}
+
+// saveDuplicateRule validates a rule against its model, saves it and runs
+// the schema sync creating the indexes of its conditions. It returns the
+// index changes of the model.
+func saveDuplicateRule(req *goodooHttp.Request, rule *models.DuplicateRule) ([]models.SchemaChange, error) {
+	registry := models.RegistryForDB(req.GetDBName())
+	model, exists := registry.GetModel(rule.Model)
+	if !exists || model.Abstract || model.Transient {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "Unknown model "+rule.Model)
+	}
+	err := rule.Validate(model)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	db := req.GetDB()
+	if rule.ID == 0 {
+		// Select all columns so false booleans are not replaced by column defaults
+		err = db.Select("*").Omit("id").Create(rule).Error
+	} else {
+		err = db.Save(rule).Error
+	}
+	if err != nil {
+		return nil, err
+	}
+	diff, err := registry.SyncSchemas(db, models.SyncOptions{})
+	if err != nil {
+		req.Logger.WarningCtx(req.Context, "Schema sync after saving duplicate rule %d failed: %v", rule.ID, err)
+		return nil, nil
+	}
+	indexes := []models.SchemaChange{}
+	for _, change := range diff.Changes {
+		if change.Model == model.Name && (change.Kind == "create_index" || change.Kind == "drop_index") {
+			indexes = append(indexes, change)
+		}
+	}
+	return indexes, nil
+}
+
+// List returns the duplicate rules, of one model with ?model=
+func (h *DuplicateRuleHandler) List(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	query := req.GetDB().Order("model, sequence, id")
+	if model := c.QueryParam("model"); model != "" {
+		query = query.Where("model = ?", model)
+	}
+	var rules []models.DuplicateRule
+	if err := query.Find(&rules).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"rules": rules})
+}
+
+// Create adds a duplicate rule
+func (h *DuplicateRuleHandler) Create(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	rule := models.DuplicateRule{Active: true, Sequence: 10}
+	if err := c.Bind(&rule); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request format: "+err.Error())
+	}
+	rule.ID = 0
+	indexes, err := saveDuplicateRule(req, &rule)
+	if err != nil {
+		return err
+	}
+	req.Logger.InfoCtx(req.Context, "Duplicate rule %s (%d) of %s created by %s", rule.Name, rule.ID, rule.Model, req.GetLogin())
+	return c.JSON(http.StatusCreated, map[string]interface{}{"rule": rule, "indexes": indexes})
+}
+
+// Update replaces the settings of a duplicate rule; its model cannot
+// change
+func (h *DuplicateRuleHandler) Update(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	rule, err := loadDuplicateRule(c, req.GetDB())
+	if err != nil {
+		return err
+	}
+	id, model := rule.ID, rule.Model
+	if err := c.Bind(rule); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request format: "+err.Error())
+	}
+	if rule.Model != model {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "model cannot be changed"})
+	}
+	rule.ID = id
+	indexes, err := saveDuplicateRule(req, rule)
+	if err != nil {
+		return err
+	}
+	req.Logger.InfoCtx(req.Context, "Duplicate rule %s (%d) of %s updated by %s", rule.Name, rule.ID, rule.Model, req.GetLogin())
+	return c.JSON(http.StatusOK, map[string]interface{}{"rule": rule, "indexes": indexes})
+}
+
+// Delete removes a duplicate rule. Its indexes are dropped by the next
+// forced schema sync.
+func (h *DuplicateRuleHandler) Delete(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	rule, err := loadDuplicateRule(c, db)
+	if err != nil {
+		return err
+	}
+	if err := db.Unscoped().Delete(rule).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	req.Logger.InfoCtx(req.Context, "Duplicate rule %s (%d) of %s deleted by %s", rule.Name, rule.ID, rule.Model, req.GetLogin())
+	return c.JSON(http.StatusOK, map[string]interface{}{"success": true})
+}
+
+// RegisterDuplicateRuleRoutes mounts the duplicate rule endpoints under
+// /api/duplicate-rules, which require the duplicate_rules.manage
+// permission
+func RegisterDuplicateRuleRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewDuplicateRuleHandler(config)
+	manage := goodooHttp.PermissionDuplicateRulesManage
+
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		{Method: "GET", Path: "/api/duplicate-rules", Handler: handler.List, Auth: true, DB: true, Permission: manage},
+		{Method: "POST", Path: "/api/duplicate-rules", Handler: handler.Create, Auth: true, DB: true, Permission: manage},
+		{Method: "PUT", Path: "/api/duplicate-rules/:id", Handler: handler.Update, Auth: true, DB: true, Permission: manage},
+		{Method: "DELETE", Path: "/api/duplicate-rules/:id", Handler: handler.Delete, Auth: true, DB: true, Permission: manage},
+	})
+}
@@ -0,0 +1,224 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"goodoo/connections"
+	"goodoo/editing"
+	goodooHttp "goodoo/http"
+	"goodoo/models"
+	"gorm.io/gorm"
+)
+
+// editingEvents is the editing changes a stream may lag behind; older
+// ones are dropped, the editors of the next event are still complete
+const editingEvents = 16
+
+// EditingHandler tells who is editing a record so forms can warn before a
+// save conflicts. It never blocks writes.
+type EditingHandler struct {
+	Config  *goodooHttp.RequestConfig
+	records *RecordsHandler
+}
+
+// NewEditingHandler creates a new editing handler
+func NewEditingHandler(config *goodooHttp.RequestConfig) *EditingHandler {
+	return &EditingHandler{Config: config, records: NewRecordsHandler(config)}
+}
+
+// EditingRequest is posted by a form: "start" when it enters edit mode,
+// "heartbeat" while it stays in it and "stop" when it leaves it. DeviceID
+// tells the tabs of a user apart, the session by default.
+type EditingRequest struct {
+	Action   string `json:"action"`
+	DeviceID string `json:"device_id"`
+}
+
+// EditorInfo is a user editing a record
+type EditorInfo struct {
+	editing.Editor
+	DisplayName string `json:"display_name"`
+	AvatarURL   string `json:"avatar_url"`
+}
+
+// EditingEvent is an editing change sent on the stream
+type EditingEvent struct {
+	Type    string       `json:"type"`
+	UserID  uint         `json:"user_id"`
+	Editors []EditorInfo `json:"editors"`
+}
+
+// describeEditors fills the display name and avatar of editors
+func describeEditors(db *gorm.DB, editors []editing.Editor) []EditorInfo {
+	infos := make([]EditorInfo, len(editors))
+	ids := make([]uint, len(editors))
+	for i, editor := range editors {
+		infos[i].Editor = editor
+		ids[i] = editor.UserID
+	}
+	if db == nil || len(ids) == 0 {
+		return infos
+	}
+	var users []models.User
+	if err := db.Where("id IN ?", ids).Find(&users).Error; err != nil {
+		return infos
+	}
+	byID := make(map[uint]*models.User, len(users))
+	for i := range users {
+		byID[users[i].ID] = &users[i]
+	}
+	for i := range infos {
+		if user, ok := byID[infos[i].UserID]; ok {
+			infos[i].DisplayName = user.DisplayName()
+			infos[i].AvatarURL = avatarURL(user, 128)
+		}
+	}
+	return infos
+}
+
+// resolveRecord returns the model and id of the route, checking that the
+// user can read the record
+func (h *EditingHandler) resolveRecord(c echo.Context) (*models.ModelDefinition, uint, error) {
+	req := goodooHttp.GetGoodooRequest(c)
+	model, err := h.records.resolveModel(c)
+	if err != nil {
+		return nil, 0, err
+	}
+	id, err := parseRecordID(c)
+	if err != nil {
+		return nil, 0, err
+	}
+	records, err := model.Read(req.GetEnv(), []uint{id}, []string{"id"})
+	if err != nil {
+		return nil, 0, echo.NewHTTPError(recordErrorStatus(err), err.Error())
+	}
+	if len(records) == 0 {
+		return nil, 0, echo.NewHTTPError(http.StatusNotFound, "Record not found")
+	}
+	return model, id, nil
+}
+
+// List returns the users editing the record, the earliest first
+func (h *EditingHandler) List(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	model, id, err := h.resolveRecord(c)
+	if err != nil {
+		return err
+	}
+	editors := editing.Editors(req.GetDBName(), model.Name, id)
+	return c.JSON(http.StatusOK, map[string]interface{}{"editors": describeEditors(req.GetDB(), editors)})
+}
+
+// Update starts, renews or stops the editing of the record by the user:
+// {"action": "start"}. Heartbeats are expected more often than
+// GOODOO_EDITING_TIMEOUT; the users editing the record are returned.
+func (h *EditingHandler) Update(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	var body EditingRequest
+	if err := c.Bind(&body); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request format"})
+	}
+	deviceID := body.DeviceID
+	if deviceID == "" {
+		deviceID = "session:" + req.Session.SID
+	}
+
+	var editors []editing.Editor
+	switch body.Action {
+	case "start", "heartbeat":
+		model, id, err := h.resolveRecord(c)
+		if err != nil {
+			return err
+		}
+		editors, err = editing.Heartbeat(req.GetDBName(), model.Name, id, uint(req.GetUserID()), deviceID)
+		if errors.Is(err, editing.ErrTooManyEditors) || errors.Is(err, editing.ErrTooManyRecords) {
+			return c.JSON(http.StatusTooManyRequests, map[string]interface{}{
+				"error":   err.Error(),
+				"editors": describeEditors(req.GetDB(), editors),
+			})
+		}
+	case "stop":
+		model, err := h.records.resolveModel(c)
+		if err != nil {
+			return err
+		}
+		id, err := parseRecordID(c)
+		if err != nil {
+			return err
+		}
+		editors = editing.Stop(req.GetDBName(), model.Name, id, uint(req.GetUserID()), deviceID)
+	default:
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Action must be start, heartbeat or stop"})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"editors": describeEditors(req.GetDB(), editors)})
+}
+
+// Stream sends the users editing the record, then an event each time a
+// user starts or stops editing it, as server-sent events, until the
+// client disconnects or the server closes the stream with "goaway"
+func (h *EditingHandler) Stream(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	model, id, err := h.resolveRecord(c)
+	if err != nil {
+		return err
+	}
+	dbName := req.GetDBName()
+	stream, err := openEventStream(c, connections.TypeEditing, editing.Channel)
+	if stream == nil {
+		return err
+	}
+	defer stream.close()
+
+	// Events carry the editors left, so a reconnecting client needs no
+	// replay
+	events := make(chan editing.Event, editingEvents)
+	unsubscribe := editing.Subscribe(dbName, model.Name, id, func(event editing.Event) {
+		select {
+		case events <- event:
+		default:
+		}
+	})
+	defer unsubscribe()
+
+	db := req.GetDB()
+	editors := describeEditors(db, editing.Editors(dbName, model.Name, id))
+	if err := stream.send("editors", map[string]interface{}{"editors": editors}); err != nil {
+		return nil
+	}
+
+	keepAlive := time.NewTicker(notificationKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case <-stream.closing():
+			stream.goAway()
+			return nil
+		case event := <-events:
+			payload := EditingEvent{Type: event.Type, UserID: event.UserID, Editors: describeEditors(db, event.Editors)}
+			if err := stream.send(event.Type, payload); err != nil {
+				return nil
+			}
+		case <-keepAlive.C:
+			if err := stream.keepAlive(); err != nil {
+				return nil
+			}
+		}
+	}
+}
+
+// RegisterEditingRoutes mounts the edit presence of records under
+// /api/records/:model/:id/editing
+func RegisterEditingRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewEditingHandler(config)
+
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		{Method: "GET", Path: "/api/records/:model/:id/editing", Handler: handler.List, Auth: true, DB: true},
+		{Method: "POST", Path: "/api/records/:model/:id/editing", Handler: handler.Update, Auth: true, DB: true},
+		{Method: "GET", Path: "/api/records/:model/:id/editing/stream", Handler: handler.Stream, Auth: true, DB: true},
+	})
+}
@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"goodoo/expr"
+	"goodoo/fields"
+	goodooHttp "goodoo/http"
+	"goodoo/models"
+)
+
+// ExpressionHandler checks the expressions of record rules and field
+// defaults while they are typed
+type ExpressionHandler struct {
+	Config *goodooHttp.RequestConfig
+}
+
+// NewExpressionHandler creates a new expression handler
+func NewExpressionHandler(config *goodooHttp.RequestConfig) *ExpressionHandler {
+	return &ExpressionHandler{Config: config}
+}
+
+// validateExpressionRequest is the body of POST /api/expressions/validate
+type validateExpressionRequest struct {
+	Expression string `json:"expression"`
+	// Kind is "domain" for a record rule domain of Model, "default" for the
+	// default of Field of Model
+	Kind  string `json:"kind"`
+	Model string `json:"model"`
+	Field string `json:"field"`
+}
+
+// Validate compiles an expression and answers whether it is valid, with
+// the located errors otherwise. A valid expression is also evaluated for
+// the current user: "preview" holds the domain it gives, or the default
+// value.
+func (h *ExpressionHandler) Validate(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	var body validateExpressionRequest
+	if err := c.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request format: "+err.Error())
+	}
+	env := req.GetEnv()
+	model, exists := env.GetFieldModel(body.Model)
+	if !exists || model.Abstract {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Unknown model " + body.Model})
+	}
+
+	var program *expr.Program
+	var err error
+	switch body.Kind {
+	case "domain":
+		program, err = models.CompileRecordRule(model, body.Expression)
+	case "default":
+		var field fields.Field
+		if field, exists = model.Fields[body.Field]; !exists {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Unknown field " + body.Field})
+		}
+		program, err = models.CompileDefault(field.GetType(), body.Expression)
+	default:
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "kind must be domain or default"})
+	}
+	var exprErrs expr.Errors
+	if errors.As(err, &exprErrs) {
+		return c.JSON(http.StatusOK, map[string]interface{}{"valid": false, "errors": exprErrs})
+	}
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	response := map[string]interface{}{
+		"valid":  true,
+		"type":   program.Type().String(),
+		"names":  program.Names(),
+		"errors": expr.Errors{},
+	}
+	vars := env.ExpressionVars(program)
+	var preview interface{}
+	if body.Kind == "domain" {
+		preview, err = program.Domain(vars, expr.DefaultLimits)
+	} else {
+		preview, err = program.Eval(vars, expr.DefaultLimits)
+	}
+	if err != nil {
+		// Valid, but failing for this user, e.g. on a missing context key
+		response["preview_error"] = err.Error()
+	} else {
+		response["preview"] = preview
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// RegisterExpressionRoutes mounts the expression check, open to every
+// user
+func RegisterExpressionRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewExpressionHandler(config)
+
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		{Method: "POST", Path: "/api/expressions/validate", Handler: handler.Validate, Auth: true, DB: true},
+	})
+}
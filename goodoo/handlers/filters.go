@@ -0,0 +1,378 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"goodoo/fields"
+	goodooHttp "goodoo/http"
+	"goodoo/models"
+)
+
+// FiltersHandler saves the list filters of users: a domain, a sort and
+// columns per model, private or shared
+type FiltersHandler struct {
+	Config  *goodooHttp.RequestConfig
+	records *RecordsHandler
+}
+
+// NewFiltersHandler creates a new filters handler
+func NewFiltersHandler(config *goodooHttp.RequestConfig) *FiltersHandler {
+	return &FiltersHandler{Config: config, records: NewRecordsHandler(config)}
+}
+
+// FilterRequest is the body of a filter creation or update; fields left
+// out of an update are kept
+type FilterRequest struct {
+	Name      *string          `json:"name"`
+	Domain    *json.RawMessage `json:"domain"`
+	Sort      *string          `json:"sort"`
+	Columns   *[]string        `json:"columns"`
+	Shared    *bool            `json:"shared"`
+	IsDefault *bool            `json:"is_default"`
+}
+
+// FilterOwner is the user who saved a filter
+type FilterOwner struct {
+	ID   uint   `json:"id"`
+	Name string `json:"name"`
+}
+
+// FilterResponse describes a filter: its stored domain and columns, and
+// under "view" what the user may apply of them, with warnings for what
+// names fields removed since
+type FilterResponse struct {
+	*models.SavedFilter
+	Domain   models.Domain      `json:"domain"`
+	Columns  []string           `json:"columns"`
+	Owner    FilterOwner        `json:"owner"`
+	Editable bool               `json:"editable"`
+	View     *models.FilterView `json:"view"`
+}
+
+// filterResponses describes filters for the environment user
+func filterResponses(env *models.Environment, model *models.ModelDefinition, filters []models.SavedFilter) ([]FilterResponse, error) {
+	owners, err := models.FilterOwnerNames(env, filters)
+	if err != nil {
+		return nil, err
+	}
+	responses := make([]FilterResponse, 0, len(filters))
+	for i := range filters {
+		filter := &filters[i]
+		domain, err := filter.DomainValue()
+		if err != nil {
+			return nil, err
+		}
+		view, err := model.FilterView(env, filter)
+		if err != nil {
+			return nil, err
+		}
+		responses = append(responses, FilterResponse{
+			SavedFilter: filter,
+			Domain:      domain,
+			Columns:     filter.ColumnNames(),
+			Owner:       FilterOwner{ID: filter.UserID, Name: owners[filter.UserID]},
+			Editable:    filterEditable(env, filter),
+			View:        view,
+		})
+	}
+	return responses, nil
+}
+
+// filterEditable reports whether the environment user may change a
+// filter: their own, or any for administrators
+func filterEditable(env *models.Environment, filter *models.SavedFilter) bool {
+	return filter.UserID == env.UserID() || env.IsAdmin()
+}
+
+// filterError answers a failed filter operation
+func filterError(c echo.Context, err error) error {
+	if errors.Is(err, models.ErrFilterNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+	}
+	return readErrorResponse(c, err)
+}
+
+// parseFilterID parses the :id route parameter
+func parseFilterID(c echo.Context) (uint, error) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil || id == 0 {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, "Invalid filter ID")
+	}
+	return uint(id), nil
+}
+
+// apply sets the values of body on filter, validating its domain, sort and
+// columns against the fields of model
+func (body *FilterRequest) apply(env *models.Environment, model *models.ModelDefinition, filter *models.SavedFilter) error {
+	if body.Name != nil {
+		filter.Name = strings.TrimSpace(*body.Name)
+	}
+	if filter.Name == "" {
+		return errors.New("name is required")
+	}
+	if len(filter.Name) > 128 {
+		return errors.New("name is longer than 128 characters")
+	}
+	if body.Domain != nil {
+		var domain models.Domain
+		if err := decodeDomain(*body.Domain, &domain); err != nil {
+			return err
+		}
+		encoded, err := json.Marshal(domain)
+		if err != nil {
+			return err
+		}
+		filter.Domain = string(encoded)
+	}
+	if body.Sort != nil {
+		filter.Sort = strings.TrimSpace(*body.Sort)
+	}
+	if body.Columns != nil {
+		encoded, err := json.Marshal(*body.Columns)
+		if err != nil {
+			return err
+		}
+		filter.Columns = string(encoded)
+	}
+	if body.IsDefault != nil {
+		filter.IsDefault = *body.IsDefault
+	}
+
+	domain, err := filter.DomainValue()
+	if err != nil {
+		return err
+	}
+	return model.ValidateFilter(env, domain, filter.Sort, filter.ColumnNames())
+}
+
+// decodeDomain decodes a JSON domain, null meaning the empty one
+func decodeDomain(raw json.RawMessage, domain *models.Domain) error {
+	if len(raw) == 0 || string(raw) == "null" {
+		*domain = models.Domain{}
+		return nil
+	}
+	if err := fields.DecodeJSON(raw, domain); err != nil {
+		return errors.New("invalid domain: " + err.Error())
+	}
+	return nil
+}
+
+// List returns the filters of a model the user sees: theirs and the
+// shared ones, with their owner
+func (h *FiltersHandler) List(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	model, err := h.records.resolveModel(c)
+	if err != nil {
+		return err
+	}
+	env := req.GetEnv()
+	filters, err := models.ListFilters(env, model.Name)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	responses, err := filterResponses(env, model, filters)
+	if err != nil {
+		return filterError(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"filters": responses})
+}
+
+// Get returns a filter the user sees
+func (h *FiltersHandler) Get(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	model, err := h.records.resolveModel(c)
+	if err != nil {
+		return err
+	}
+	id, err := parseFilterID(c)
+	if err != nil {
+		return err
+	}
+	env := req.GetEnv()
+	filter, err := models.GetFilter(env, model.Name, id)
+	if err != nil {
+		return filterError(c, err)
+	}
+	responses, err := filterResponses(env, model, []models.SavedFilter{*filter})
+	if err != nil {
+		return filterError(c, err)
+	}
+	return c.JSON(http.StatusOK, responses[0])
+}
+
+// Create saves a filter of the user:
+// {"name": "...", "domain": [...], "sort": "name desc", "columns": ["name"], "is_default": true}.
+// Sharing it with "shared": true takes the filters.share permission.
+func (h *FiltersHandler) Create(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	model, err := h.records.resolveModel(c)
+	if err != nil {
+		return err
+	}
+	var body FilterRequest
+	if err := c.Bind(&body); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+	}
+
+	env := req.GetEnv()
+	filter := &models.SavedFilter{Model: model.Name, UserID: env.UserID(), Domain: "[]", Columns: "[]"}
+	if body.Shared != nil && *body.Shared {
+		if !req.HasPermission(goodooHttp.PermissionFiltersShare) {
+			return echo.NewHTTPError(http.StatusForbidden, "Sharing filters requires the "+goodooHttp.PermissionFiltersShare+" permission")
+		}
+		filter.Shared = true
+	}
+	if err := body.apply(env, model, filter); err != nil {
+		return filterError(c, err)
+	}
+	if err := models.SaveFilter(env.GetDB(), filter); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	req.Logger.InfoCtx(req.Context, "Filter %d of %s saved by %s (shared: %t)", filter.ID, model.Name, req.GetLogin(), filter.Shared)
+	responses, err := filterResponses(env, model, []models.SavedFilter{*filter})
+	if err != nil {
+		return filterError(c, err)
+	}
+	return c.JSON(http.StatusCreated, responses[0])
+}
+
+// Update changes a filter the user owns; administrators may change any.
+// Sharing it takes the filters.share permission, and only its owner may
+// make it their default.
+func (h *FiltersHandler) Update(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	model, err := h.records.resolveModel(c)
+	if err != nil {
+		return err
+	}
+	id, err := parseFilterID(c)
+	if err != nil {
+		return err
+	}
+	var body FilterRequest
+	if err := c.Bind(&body); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+	}
+
+	env := req.GetEnv()
+	filter, err := models.GetFilter(env, model.Name, id)
+	if err != nil {
+		return filterError(c, err)
+	}
+	if !filterEditable(env, filter) {
+		return echo.NewHTTPError(http.StatusForbidden, "Only the owner of a filter may change it")
+	}
+	if body.IsDefault != nil && filter.UserID != env.UserID() {
+		return echo.NewHTTPError(http.StatusForbidden, "Only the owner of a filter may make it their default")
+	}
+	if body.Shared != nil && *body.Shared != filter.Shared {
+		if *body.Shared && !req.HasPermission(goodooHttp.PermissionFiltersShare) {
+			return echo.NewHTTPError(http.StatusForbidden, "Sharing filters requires the "+goodooHttp.PermissionFiltersShare+" permission")
+		}
+		filter.Shared = *body.Shared
+	}
+	if err := body.apply(env, model, filter); err != nil {
+		return filterError(c, err)
+	}
+	if err := models.SaveFilter(env.GetDB(), filter); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	responses, err := filterResponses(env, model, []models.SavedFilter{*filter})
+	if err != nil {
+		return filterError(c, err)
+	}
+	return c.JSON(http.StatusOK, responses[0])
+}
+
+// Delete removes a filter the user owns; administrators may remove any
+func (h *FiltersHandler) Delete(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	model, err := h.records.resolveModel(c)
+	if err != nil {
+		return err
+	}
+	id, err := parseFilterID(c)
+	if err != nil {
+		return err
+	}
+
+	env := req.GetEnv()
+	filter, err := models.GetFilter(env, model.Name, id)
+	if err != nil {
+		return filterError(c, err)
+	}
+	if !filterEditable(env, filter) {
+		return echo.NewHTTPError(http.StatusForbidden, "Only the owner of a filter may delete it")
+	}
+	if err := env.GetDB().Delete(filter).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	req.Logger.InfoCtx(req.Context, "Filter %d of %s deleted by %s", filter.ID, model.Name, req.GetLogin())
+	return c.JSON(http.StatusOK, map[string]interface{}{"success": true})
+}
+
+// Share shares or unshares a filter the user owns (filters.share):
+// {"shared": true}
+func (h *FiltersHandler) Share(c echo.Context) error {
+	shared := true
+	var body struct {
+		Shared *bool `json:"shared"`
+	}
+	if err := c.Bind(&body); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+	}
+	if body.Shared != nil {
+		shared = *body.Shared
+	}
+
+	req := goodooHttp.MustGetGoodooRequest(c)
+	model, err := h.records.resolveModel(c)
+	if err != nil {
+		return err
+	}
+	id, err := parseFilterID(c)
+	if err != nil {
+		return err
+	}
+	env := req.GetEnv()
+	filter, err := models.GetFilter(env, model.Name, id)
+	if err != nil {
+		return filterError(c, err)
+	}
+	if !filterEditable(env, filter) {
+		return echo.NewHTTPError(http.StatusForbidden, "Only the owner of a filter may share it")
+	}
+	filter.Shared = shared
+	if err := env.GetDB().Model(filter).Update("shared", shared).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	req.Logger.InfoCtx(req.Context, "Filter %d of %s shared by %s: %t", filter.ID, model.Name, req.GetLogin(), shared)
+	responses, err := filterResponses(env, model, []models.SavedFilter{*filter})
+	if err != nil {
+		return filterError(c, err)
+	}
+	return c.JSON(http.StatusOK, responses[0])
+}
+
+// RegisterFilterRoutes mounts the saved filters under /api/filters/:model
+func RegisterFilterRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewFiltersHandler(config)
+
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		{Method: "GET", Path: "/api/filters/:model", Handler: handler.List, Auth: true, DB: true},
+		{Method: "POST", Path: "/api/filters/:model", Handler: handler.Create, Auth: true, DB: true},
+		{Method: "GET", Path: "/api/filters/:model/:id", Handler: handler.Get, Auth: true, DB: true},
+		{Method: "PUT", Path: "/api/filters/:model/:id", Handler: handler.Update, Auth: true, DB: true},
+		{Method: "DELETE", Path: "/api/filters/:model/:id", Handler: handler.Delete, Auth: true, DB: true},
+		{Method: "POST", Path: "/api/filters/:model/:id/share", Handler: handler.Share, Auth: true, DB: true, Permission: goodooHttp.PermissionFiltersShare},
+	})
+}
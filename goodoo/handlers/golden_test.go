@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// update rewrites the golden files of testdata instead of comparing to them:
+// go test ./handlers -run Golden -update, then review the diff
+var update = flag.Bool("update", false, "rewrite the golden files of testdata")
+
+// assertGolden compares the indented JSON of got to the golden file name of
+// testdata
+func assertGolden(t *testing.T, name string, got interface{}) {
+	t.Helper()
+	var content bytes.Buffer
+	encoder := json.NewEncoder(&content)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(got); err != nil {
+		t.Fatal(err)
+	}
+	assertGoldenBytes(t, name, content.Bytes())
+}
+
+// assertGoldenBytes compares content to the golden file name of testdata
+func assertGoldenBytes(t *testing.T, name string, content []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v; run go test -update to create it", err)
+	}
+	if !bytes.Equal(content, want) {
+		t.Errorf("%s changed; if on purpose, run go test -update and review the diff\ngot:\n%s", path, content)
+	}
+}
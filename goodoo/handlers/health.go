@@ -6,7 +6,11 @@ import (
 	"time"
 
 	"github.com/labstack/echo/v4"
+	"goodoo/capability"
+	"goodoo/database"
 	goodooHttp "goodoo/http"
+	"goodoo/models"
+	"goodoo/version"
 )
 
 // HealthHandler handles health check requests
@@ -19,13 +23,42 @@ func NewHealthHandler(config *goodooHttp.RequestConfig) *HealthHandler {
 	return &HealthHandler{Config: config}
 }
 
-// Health returns basic health status
+// Health returns basic health status; with the database warm-up, the
+// status is degraded while a database does not answer, and the number of
+// ready and degraded databases is reported. It is degraded as well while
+// the breaker of a database is open, with the number of those reported.
+// The state of the public capabilities is listed, without their reason,
+// and the schema status of each database checked, degraded unless ok.
 func (h *HealthHandler) Health(c echo.Context) error {
-	return c.JSON(http.StatusOK, map[string]interface{}{
-		"status":    "healthy",
-		"timestamp": time.Now().UTC(),
-		"service":   "goodoo",
-	})
+	health := map[string]interface{}{
+		"status":       "healthy",
+		"timestamp":    time.Now().UTC(),
+		"service":      "goodoo",
+		"capabilities": capability.PublicStates(),
+	}
+	if database.WarmupEnabled() {
+		counts := map[string]int{database.WarmupReady: 0, database.WarmupDegraded: 0, database.WarmupPending: 0}
+		for _, status := range database.WarmupStatuses() {
+			counts[status.State]++
+		}
+		health["databases"] = counts
+		if counts[database.WarmupDegraded] > 0 {
+			health["status"] = "degraded"
+		}
+	}
+	if tripped := database.GetRegistry().Stats().TrippedDatabases; tripped > 0 {
+		health["status"] = "degraded"
+		health["unavailable_databases"] = tripped
+	}
+	if statuses := models.SchemaStatuses(); len(statuses) > 0 {
+		health["schema"] = statuses
+		for _, status := range statuses {
+			if status != models.SchemaOK {
+				health["status"] = "degraded"
+			}
+		}
+	}
+	return c.JSON(http.StatusOK, health)
 }
 
 // DetailedHealth returns detailed health information
@@ -39,7 +72,7 @@ func (h *HealthHandler) DetailedHealth(c echo.Context) error {
 		"status":    "healthy",
 		"timestamp": time.Now().UTC(),
 		"service":   "goodoo",
-		"version":   "1.0.0",
+		"version":   version.Version,
 		"uptime":    time.Since(req.StartTime),
 		"memory": map[string]interface{}{
 			"alloc_mb":      bToMb(m.Alloc),
@@ -53,6 +86,22 @@ func (h *HealthHandler) DetailedHealth(c echo.Context) error {
 	if req.Session != nil {
 		health["session_id"] = req.Session.SID
 	}
+	if database.WarmupEnabled() {
+		statuses := database.WarmupStatuses()
+		for _, status := range statuses {
+			if status.State == database.WarmupDegraded {
+				health["status"] = "degraded"
+			}
+		}
+		health["databases"] = statuses
+	}
+	breakers := database.BreakerStatuses()
+	for _, status := range breakers {
+		if status.State == database.BreakerOpen {
+			health["status"] = "degraded"
+		}
+	}
+	health["breakers"] = breakers
 
 	req.Logger.InfoCtx(req.Context, "Detailed health check requested")
 
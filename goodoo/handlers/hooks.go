@@ -0,0 +1,299 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"goodoo/api"
+	"goodoo/crypto"
+	"goodoo/fields"
+	goodooHttp "goodoo/http"
+	"goodoo/models"
+	"goodoo/webhook"
+	"gorm.io/gorm"
+)
+
+// maxHookPayload is the largest body accepted by an inbound hook
+const maxHookPayload = 1 << 20
+
+// InboundHookHandler receives events on /hooks/:name and manages the
+// inbound hooks (admin only)
+type InboundHookHandler struct {
+	Config *goodooHttp.RequestConfig
+}
+
+// NewInboundHookHandler creates a new inbound hook handler
+func NewInboundHookHandler(config *goodooHttp.RequestConfig) *InboundHookHandler {
+	return &InboundHookHandler{Config: config}
+}
+
+// InboundHookRequest is the body of create and update requests; nil fields are left unchanged
+type InboundHookRequest struct {
+	Name      *string `json:"name"`
+	Auth      *string `json:"auth"`
+	Secret    *string `json:"secret"`
+	Model     *string `json:"model"`
+	Method    *string `json:"method"`
+	Mapping   *string `json:"mapping"`
+	UserID    *uint   `json:"user_id"`
+	RateLimit *int    `json:"rate_limit"`
+	Active    *bool   `json:"active"`
+}
+
+// apply copies the set fields onto the hook
+func (r *InboundHookRequest) apply(hook *models.InboundHook) {
+	if r.Name != nil {
+		hook.Name = *r.Name
+	}
+	if r.Auth != nil {
+		hook.Auth = *r.Auth
+	}
+	if r.Secret != nil && *r.Secret != "" {
+		hook.Secret = crypto.EncryptedString(*r.Secret)
+	}
+	if r.Model != nil {
+		hook.Model = *r.Model
+	}
+	if r.Method != nil {
+		hook.Method = *r.Method
+	}
+	if r.Mapping != nil {
+		hook.Mapping = *r.Mapping
+	}
+	if r.UserID != nil {
+		hook.UserID = *r.UserID
+	}
+	if r.RateLimit != nil {
+		hook.RateLimit = *r.RateLimit
+	}
+	if r.Active != nil {
+		hook.Active = *r.Active
+	}
+}
+
+// apiStatus maps a failed API response to an HTTP status like the API handler does
+func apiStatus(response *api.APIResponse) int {
+	if response.Success {
+		return http.StatusOK
+	}
+	switch {
+	case strings.Contains(response.Error, "Access denied") || strings.Contains(response.Error, "not accessible"):
+		return http.StatusForbidden
+	case strings.Contains(response.Error, "not found"):
+		return http.StatusNotFound
+	}
+	return http.StatusBadRequest
+}
+
+// Receive verifies an event posted to an inbound hook and runs the mapped
+// method as the hook's service user
+func (h *InboundHookHandler) Receive(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	db := req.GetDB()
+	if db == nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database not available")
+	}
+
+	var hook models.InboundHook
+	if err := db.Where("name = ? AND active = ?", c.Param("name"), true).First(&hook).Error; err != nil {
+		return c.JSON(http.StatusNotFound, api.APIResponse{Error: "Hook not found"})
+	}
+
+	body, err := io.ReadAll(io.LimitReader(c.Request().Body, maxHookPayload+1))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, api.APIResponse{Error: "Failed to read payload"})
+	}
+	if len(body) > maxHookPayload {
+		return c.JSON(http.StatusRequestEntityTooLarge, api.APIResponse{Error: "Payload too large"})
+	}
+
+	if err := webhook.VerifyInbound(req.GetDBName(), &hook, c.Request().Header, body, time.Now()); err != nil {
+		req.Logger.WarningCtx(req.Context, "Rejected event for inbound hook %s from %s: %v", hook.Name, req.RemoteAddr, err)
+		return c.JSON(http.StatusUnauthorized, api.APIResponse{Error: err.Error()})
+	}
+	if !webhook.Allow(req.GetDBName(), &hook) {
+		return c.JSON(http.StatusTooManyRequests, api.APIResponse{Error: "Rate limit exceeded"})
+	}
+
+	var payload map[string]interface{}
+	if err := fields.DecodeJSON(body, &payload); err != nil {
+		return c.JSON(http.StatusBadRequest, api.APIResponse{Error: "Payload must be a JSON object"})
+	}
+
+	registry := api.DefaultAPIRegistry.ForDatabase(req.GetDBName())
+	env := models.NewEnvironment(db, hook.UserID).WithDBName(req.GetDBName())
+	call, err := webhook.BuildCall(env, registry, &hook, payload)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, api.APIResponse{Error: err.Error()})
+	}
+
+	response := registry.ExecuteCallAs(req.Context, call, int(hook.UserID))
+	req.Logger.InfoCtx(req.Context, "Inbound hook %s called %s.%s: success=%v", hook.Name, call.ModelName, call.Method, response.Success)
+	return c.JSON(apiStatus(response), response)
+}
+
+// loadInboundHook fetches the hook named by the :id route parameter
+func loadInboundHook(c echo.Context, db *gorm.DB) (*models.InboundHook, error) {
+	id, err := parseRecordID(c)
+	if err != nil {
+		return nil, err
+	}
+	var hook models.InboundHook
+	if err := db.First(&hook, id).Error; err != nil {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Inbound hook not found")
+	}
+	return &hook, nil
+}
+
+// List returns all inbound hooks
+func (h *InboundHookHandler) List(c echo.Context) error {
+	db := goodooHttp.MustGetGoodooRequest(c).GetDB()
+
+	var hooks []models.InboundHook
+	if err := db.Order("name").Find(&hooks).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"hooks": hooks})
+}
+
+// Get returns one inbound hook
+func (h *InboundHookHandler) Get(c echo.Context) error {
+	db := goodooHttp.MustGetGoodooRequest(c).GetDB()
+	hook, err := loadInboundHook(c, db)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, hook)
+}
+
+// Create adds an inbound hook running as the creating admin unless user_id
+// is given; a secret is generated unless one is given, and is returned only
+// in this response
+func (h *InboundHookHandler) Create(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+
+	var body InboundHookRequest
+	if err := c.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request format: "+err.Error())
+	}
+
+	hook := &models.InboundHook{
+		Auth:      models.InboundAuthHMAC,
+		UserID:    uint(req.GetUserID()),
+		RateLimit: 60,
+		Active:    true,
+	}
+	body.apply(hook)
+	registry := api.DefaultAPIRegistry.ForDatabase(req.GetDBName())
+	if err := webhook.ValidateInbound(db, registry, hook); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	if hook.Secret == "" {
+		secret, err := webhook.GenerateSecret()
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		}
+		hook.Secret = crypto.EncryptedString(secret)
+	}
+
+	// Select all columns so false booleans are not replaced by column defaults
+	if err := db.Select("*").Omit("id").Create(hook).Error; err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to create inbound hook: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	req.Logger.InfoCtx(req.Context, "Inbound hook %s (%d) created by %s", hook.Name, hook.ID, req.GetLogin())
+	return c.JSON(http.StatusCreated, map[string]interface{}{
+		"hook":   hook,
+		"secret": string(hook.Secret),
+	})
+}
+
+// Update modifies an inbound hook
+func (h *InboundHookHandler) Update(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	hook, err := loadInboundHook(c, db)
+	if err != nil {
+		return err
+	}
+
+	var body InboundHookRequest
+	if err := c.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request format: "+err.Error())
+	}
+	body.apply(hook)
+	registry := api.DefaultAPIRegistry.ForDatabase(req.GetDBName())
+	if err := webhook.ValidateInbound(db, registry, hook); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	if err := db.Save(hook).Error; err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to update inbound hook %d: %v", hook.ID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, hook)
+}
+
+// Delete removes an inbound hook
+func (h *InboundHookHandler) Delete(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	hook, err := loadInboundHook(c, db)
+	if err != nil {
+		return err
+	}
+
+	if err := db.Unscoped().Delete(hook).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	req.Logger.InfoCtx(req.Context, "Inbound hook %s (%d) deleted by %s", hook.Name, hook.ID, req.GetLogin())
+	return c.JSON(http.StatusOK, map[string]interface{}{"success": true})
+}
+
+// Test dry-runs a sample payload (the request body) through the hook's
+// mapping and returns the call it would make, without verifying or executing it
+func (h *InboundHookHandler) Test(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	hook, err := loadInboundHook(c, db)
+	if err != nil {
+		return err
+	}
+
+	payload := bodyValues(req)
+	registry := api.DefaultAPIRegistry.ForDatabase(req.GetDBName())
+	env := models.NewEnvironment(db, hook.UserID).WithDBName(req.GetDBName())
+	call, err := webhook.BuildCall(env, registry, hook, payload)
+	if err != nil {
+		return c.JSON(http.StatusOK, map[string]interface{}{"valid": false, "error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"valid":   true,
+		"call":    call,
+		"user_id": hook.UserID,
+	})
+}
+
+// RegisterInboundHookRoutes mounts the public /hooks/:name receiver and the
+// endpoints under /api/inbound-hooks, which require the
+// inbound_hooks.manage permission
+func RegisterInboundHookRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewInboundHookHandler(config)
+	manage := goodooHttp.PermissionInboundHooksManage
+
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		{Method: "POST", Path: "/hooks/:name", Handler: handler.Receive, DB: true, CSRFExempt: true},
+		{Method: "GET", Path: "/api/inbound-hooks", Handler: handler.List, Auth: true, DB: true, Permission: manage},
+		{Method: "POST", Path: "/api/inbound-hooks", Handler: handler.Create, Auth: true, DB: true, Permission: manage},
+		{Method: "GET", Path: "/api/inbound-hooks/:id", Handler: handler.Get, Auth: true, DB: true, Permission: manage},
+		{Method: "PUT", Path: "/api/inbound-hooks/:id", Handler: handler.Update, Auth: true, DB: true, Permission: manage},
+		{Method: "DELETE", Path: "/api/inbound-hooks/:id", Handler: handler.Delete, Auth: true, DB: true, Permission: manage},
+		{Method: "POST", Path: "/api/inbound-hooks/:id/test", Handler: handler.Test, Auth: true, DB: true, Permission: manage},
+	})
+}
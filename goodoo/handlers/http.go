@@ -1,11 +1,22 @@
 package handlers
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/labstack/echo/v4"
+	"goodoo/auth"
 	goodooHttp "goodoo/http"
+	"goodoo/mail"
+	"goodoo/maintenance"
 	"goodoo/models"
+	"goodoo/notification"
 )
 
 // AuthHandler handles authentication requests
@@ -20,10 +31,7 @@ func NewAuthHandler(config *goodooHttp.RequestConfig) *AuthHandler {
 
 // Login handles user login
 func (h *AuthHandler) Login(c echo.Context) error {
-	req := goodooHttp.GetGoodooRequest(c)
-	if req == nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "Request context not found")
-	}
+	req := goodooHttp.MustGetGoodooRequest(c)
 
 	// Parse login parameters
 	login := req.GetStringParam("login")
@@ -37,28 +45,19 @@ func (h *AuthHandler) Login(c echo.Context) error {
 
 	req.Logger.InfoCtx(req.Context, "Login attempt for user: %s on database: %s", login, database)
 
-	// Get database connection
-	db := req.GetDB()
-	if db == nil {
-		req.Logger.ErrorCtx(req.Context, "Database connection not available")
-		return echo.NewHTTPError(http.StatusInternalServerError, "Database connection error")
-	}
-
-	// Find user by login
-	user, err := models.FindUserByLogin(db, login)
-	if err != nil {
-		req.Logger.WarningCtx(req.Context, "User not found: %s", login)
-		return echo.NewHTTPError(http.StatusUnauthorized, "Invalid credentials")
-	}
-
-	// Check password
-	if !user.CheckPassword(password) {
-		req.Logger.WarningCtx(req.Context, "Invalid password for user: %s", login)
+	user, method, err := checkCredentials(req, login, password)
+	var unavailable *auth.UnavailableError
+	switch {
+	case errors.Is(err, errInvalidCredentials):
 		return echo.NewHTTPError(http.StatusUnauthorized, "Invalid credentials")
+	case errors.As(err, &unavailable):
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "Authentication service unavailable")
+	case err != nil:
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database connection error")
 	}
 
 	// Authenticate user
-	if err := req.Authenticate(database, login, int(user.ID)); err != nil {
+	if err := startSession(req, database, user, method); err != nil {
 		req.Logger.ErrorCtx(req.Context, "Authentication failed: %v", err)
 		return echo.NewHTTPError(http.StatusInternalServerError, "Authentication failed")
 	}
@@ -75,12 +74,67 @@ func (h *AuthHandler) Login(c echo.Context) error {
 	})
 }
 
+// errInvalidCredentials is returned by checkCredentials for an unknown
+// login or a wrong password, which are not told apart
+var errInvalidCredentials = auth.ErrInvalidCredentials
+
+// checkCredentials returns the active user with login when a backend of
+// the authentication chain accepts password, with the name of the backend,
+// errInvalidCredentials otherwise
+func checkCredentials(req *goodooHttp.Request, login, password string) (*models.User, string, error) {
+	db := req.GetDB()
+	if db == nil {
+		req.Logger.ErrorCtx(req.Context, "Database connection not available")
+		return nil, "", fmt.Errorf("database connection not available")
+	}
+
+	result, err := auth.ChainForDB(req.GetDBName()).Authenticate(req.Context, db, login, password)
+	if errors.Is(err, auth.ErrInvalidCredentials) {
+		req.Logger.WarningCtx(req.Context, "Login refused: %v", err)
+		return nil, "", errInvalidCredentials
+	}
+	if err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to check the credentials of %s: %v", login, err)
+		return nil, "", err
+	}
+	for _, skipped := range result.Skipped {
+		req.Logger.WarningCtx(req.Context, "Skipped authentication backend: %v", skipped)
+	}
+	if result.Provisioned {
+		req.Logger.InfoCtx(req.Context, "Provisioned user %s from the %s backend", result.User.Login, result.Backend)
+	}
+	return result.User, result.Backend, nil
+}
+
+// startSession authenticates the request as user, whatever the way they
+// proved their identity (method: an authentication backend, "oidc" or
+// "invitation"), records the login date and loads their preferences
+func startSession(req *goodooHttp.Request, database string, user *models.User, method string) error {
+	if err := req.Authenticate(database, user.Login, int(user.ID)); err != nil {
+		return err
+	}
+
+	if err := req.GetDB().Model(user).Update("login_date", time.Now()).Error; err != nil {
+		req.Logger.WarningCtx(req.Context, "Failed to record login date of %s: %v", user.Login, err)
+	}
+	loggedIn := models.Activity{
+		Type:   models.ActivityUserLogin,
+		Model:  "res.users",
+		ResID:  user.ID,
+		Params: map[string]interface{}{"login": user.Login, "remote_addr": req.RemoteAddr, "method": method},
+	}
+	if err := models.LogActivity(req.GetDB(), user.ID, loggedIn); err != nil {
+		req.Logger.WarningCtx(req.Context, "Failed to record the login of %s: %v", user.Login, err)
+	}
+
+	// The user's saved preferences override the language negotiated for the session
+	req.Session.UpdateContext(user.SessionContext())
+	return nil
+}
+
 // Logout handles user logout
 func (h *AuthHandler) Logout(c echo.Context) error {
-	req := goodooHttp.GetGoodooRequest(c)
-	if req == nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "Request context not found")
-	}
+	req := goodooHttp.MustGetGoodooRequest(c)
 
 	if !req.IsAuthenticated() {
 		// If not authenticated, redirect to login for GET requests
@@ -91,30 +145,36 @@ func (h *AuthHandler) Logout(c echo.Context) error {
 	}
 
 	oldLogin := req.GetLogin()
+	// Users signed in through single sign-on may be signed out of the provider too
+	providerLogout := oidcLogoutURL(c, req)
 	req.Logout(false) // Don't keep database
 
 	req.Logger.InfoCtx(req.Context, "User %s logged out", oldLogin)
 
 	// For GET requests (from dashboard logout link), redirect to login page
 	if c.Request().Method == "GET" {
+		if providerLogout != "" {
+			return c.Redirect(http.StatusFound, providerLogout)
+		}
 		return c.Redirect(http.StatusFound, "/login")
 	}
 
 	// For POST requests (API calls), return JSON response
-	return c.JSON(http.StatusOK, map[string]interface{}{
+	response := map[string]interface{}{
 		"success": true,
 		"message": "Logged out successfully",
-	})
+	}
+	if providerLogout != "" {
+		response["logout_url"] = providerLogout
+	}
+	return c.JSON(http.StatusOK, response)
 }
 
 // SessionInfo returns current session information
 func (h *AuthHandler) SessionInfo(c echo.Context) error {
-	req := goodooHttp.GetGoodooRequest(c)
-	if req == nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "Request context not found")
-	}
+	req := goodooHttp.MustGetGoodooRequest(c)
 
-	return c.JSON(http.StatusOK, map[string]interface{}{
+	info := map[string]interface{}{
 		"authenticated": req.IsAuthenticated(),
 		"user_id":       req.GetUserID(),
 		"login":         req.GetLogin(),
@@ -122,8 +182,386 @@ func (h *AuthHandler) SessionInfo(c echo.Context) error {
 		"session_id":    req.Session.SID,
 		"context":       req.Session.GetContext(),
 		"request_id":    req.GetRequestID(),
+		// The UI shows a "viewing as" banner for impersonated sessions
+		"impersonated": req.IsImpersonated(),
+	}
+	if req.IsImpersonated() {
+		info["impersonator_id"] = req.GetImpersonatorID()
+		info["impersonator_login"] = req.Session.ImpersonatorLogin
+	}
+	// The UI shows a banner too while the database is in maintenance
+	if dbName := req.GetDBName(); dbName != "" {
+		state := maintenance.Get(dbName)
+		info["maintenance"] = state.Active(req.Now())
+		if state.Active(req.Now()) {
+			info["maintenance_message"] = state.Message
+			info["maintenance_until"] = state.Until
+		}
+	}
+	// The preferences the UI needs at login, saving it a request
+	if db := req.GetDB(); db != nil && req.IsAuthenticated() {
+		preferences, err := models.SessionPreferences(db, uint(req.GetUserID()))
+		if err != nil {
+			req.Logger.WarningCtx(req.Context, "Failed to load preferences of user %d: %v", req.GetUserID(), err)
+		} else {
+			info["preferences"] = preferences
+		}
+		// The dashboard hides what the user cannot use
+		permissions, admin := req.EffectivePermissions()
+		if permissions == nil {
+			permissions = []string{}
+		}
+		info["permissions"] = permissions
+		info["admin"] = admin
+	}
+	return c.JSON(http.StatusOK, info)
+}
+
+// Impersonate switches the session of an administrator to act as another
+// user, for support staff to see what the user sees. The administrator
+// stays recorded in the session and in every log and audit entry until
+// StopImpersonation. Deactivated users, and users holding a privilege the
+// administrator lacks, cannot be impersonated.
+func (h *AuthHandler) Impersonate(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	targetID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid user id")
+	}
+
+	db := req.GetDB()
+	var admin, target models.User
+	if err := db.First(&admin, req.GetUserID()).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to load the current user")
+	}
+	if err := db.First(&target, targetID).Error; err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "User not found")
+	}
+	if target.ID == admin.ID {
+		return echo.NewHTTPError(http.StatusBadRequest, "Cannot impersonate yourself")
+	}
+	if !target.Active {
+		req.Logger.WarningCtx(req.Context, "User %s refused to impersonate deactivated user %s", admin.Login, target.Login)
+		return echo.NewHTTPError(http.StatusForbidden, "Cannot impersonate a deactivated user")
+	}
+	if target.IsService {
+		return echo.NewHTTPError(http.StatusForbidden, "Cannot impersonate a service account")
+	}
+	privileged, err := models.HasMorePrivileges(db, &target, &admin)
+	if err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to compare the groups of %s and %s: %v", admin.Login, target.Login, err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to check privileges")
+	}
+	if privileged {
+		req.Logger.WarningCtx(req.Context, "User %s refused to impersonate %s, who has more privileges", admin.Login, target.Login)
+		return echo.NewHTTPError(http.StatusForbidden, "Cannot impersonate a user with more privileges")
+	}
+
+	req.Impersonate(target.Login, int(target.ID))
+	started := models.Activity{
+		Type:   models.ActivityImpersonationStart,
+		Model:  "res.users",
+		ResID:  target.ID,
+		Params: map[string]interface{}{"impersonator": admin.Login, "login": target.Login, "remote_addr": req.RemoteAddr},
+	}
+	if err := models.LogActivity(req.GetDB(), target.ID, started); err != nil {
+		req.Logger.WarningCtx(req.Context, "Failed to record the impersonation of %s: %v", target.Login, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"success":         true,
+		"user_id":         target.ID,
+		"login":           target.Login,
+		"name":            target.Name,
+		"impersonator_id": admin.ID,
 	})
 }
 
+// StopImpersonation restores the identity of the administrator
+// impersonating the session user
+func (h *AuthHandler) StopImpersonation(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	if !req.IsImpersonated() {
+		return echo.NewHTTPError(http.StatusBadRequest, "Not impersonating a user")
+	}
+
+	login, userID := req.GetLogin(), req.GetUserID()
+	impersonator := req.Session.ImpersonatorLogin
+	// Recorded while the impersonator is still in the request context
+	stopped := models.Activity{
+		Type:   models.ActivityImpersonationStop,
+		Model:  "res.users",
+		ResID:  uint(userID),
+		Params: map[string]interface{}{"impersonator": impersonator, "login": login},
+	}
+	if db := req.GetDB(); db != nil {
+		if err := models.LogActivity(db, uint(userID), stopped); err != nil {
+			req.Logger.WarningCtx(req.Context, "Failed to record the end of the impersonation of %s: %v", login, err)
+		}
+	}
+	req.StopImpersonation()
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"success": true,
+		"user_id": req.GetUserID(),
+		"login":   req.GetLogin(),
+	})
+}
+
+
 
 
+
+// ActiveSession describes one of the caller's sessions
+type ActiveSession struct {
+	SID          string    `json:"sid"`
+	CreatedAt    time.Time `json:"created_at"`
+	LastAccessed time.Time `json:"last_accessed"`
+	RemoteAddr   string    `json:"remote_addr"`
+	UserAgent    string    `json:"user_agent"`
+	DB           string    `json:"db"`
+	Current      bool      `json:"current"`
+}
+
+// ListSessions returns the caller's active sessions
+func (h *AuthHandler) ListSessions(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+
+	sessions := []ActiveSession{}
+	seenCurrent := false
+	for _, session := range h.Config.SessionStore.UserSessions(req.GetUserID()) {
+		current := session.SID == req.Session.SID
+		seenCurrent = seenCurrent || current
+		sessions = append(sessions, ActiveSession{
+			SID:          session.SID,
+			CreatedAt:    session.CreatedAt,
+			LastAccessed: session.LastAccessed,
+			RemoteAddr:   session.RemoteAddr(),
+			UserAgent:    session.UserAgent(),
+			DB:           session.DBName,
+			Current:      current,
+		})
+	}
+
+	// The current session may not be persisted yet (first request after login)
+	if !seenCurrent {
+		sessions = append(sessions, ActiveSession{
+			SID:          req.Session.SID,
+			CreatedAt:    req.Session.CreatedAt,
+			LastAccessed: req.Session.LastAccessed,
+			RemoteAddr:   req.RemoteAddr,
+			UserAgent:    req.UserAgent,
+			DB:           req.GetDBName(),
+			Current:      true,
+		})
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastAccessed.After(sessions[j].LastAccessed)
+	})
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"sessions": sessions,
+		"count":    len(sessions),
+	})
+}
+
+// RevokeSession terminates a single session; only the owner or an admin may do so
+func (h *AuthHandler) RevokeSession(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+
+	sid := c.Param("sid")
+	store := h.Config.SessionStore
+
+	// Revoking the current session is a logout
+	if sid == req.Session.SID {
+		req.Logout(false)
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"success": true,
+			"message": "Current session logged out",
+		})
+	}
+
+	if !store.IsValidKey(sid) {
+		return echo.NewHTTPError(http.StatusNotFound, "Session not found")
+	}
+
+	target := store.Get(sid)
+	if target == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Session not found")
+	}
+
+	if target.UserID != req.GetUserID() && !isAdmin(req) {
+		// Don't reveal that someone else's session exists
+		return echo.NewHTTPError(http.StatusNotFound, "Session not found")
+	}
+
+	if err := store.Delete(sid); err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to revoke session: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to revoke session")
+	}
+
+	req.Logger.InfoCtx(req.Context, "Session %s of user %d revoked by %s", sid[:8], target.UserID, req.GetLogin())
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"success": true,
+		"message": "Session revoked",
+	})
+}
+
+// RevokeAllSessions terminates every session of the caller except the current one
+func (h *AuthHandler) RevokeAllSessions(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+
+	removed, err := req.RevokeOtherSessions(h.Config.SessionStore)
+	if err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to revoke sessions: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to revoke sessions")
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"success": true,
+		"revoked": removed,
+	})
+}
+
+// isAdmin checks whether the current user is an administrator
+func isAdmin(req *goodooHttp.Request) bool {
+	db := req.GetDB()
+	if db == nil {
+		return false
+	}
+
+	var user models.User
+	if err := db.First(&user, req.GetUserID()).Error; err != nil {
+		return false
+	}
+	return user.IsAdmin()
+}
+
+// signupTokenValidity is how long password reset and invitation links stay valid
+const signupTokenValidity = 24 * time.Hour
+
+// errNoBaseURL is returned when a link cannot be built because
+// models.ParamWebBaseURL is not set
+var errNoBaseURL = fmt.Errorf("%s is not set, links to the server cannot be built", models.ParamWebBaseURL)
+
+// webBaseURL returns the URL of the server, models.ParamWebBaseURL of the
+// database without trailing slash, or errNoBaseURL. Links are never built
+// from the Host header: the client chooses it, and a reset link pointing
+// to another host would hand its token over.
+func webBaseURL(dbName string) (string, error) {
+	base := strings.TrimRight(models.GetParamString(dbName, models.ParamWebBaseURL, ""), "/")
+	if base == "" {
+		return "", errNoBaseURL
+	}
+	return base, nil
+}
+
+// linkBase returns webBaseURL for the endpoints mailing links, or the
+// error answering them when models.ParamWebBaseURL is not set
+func linkBase(req *goodooHttp.Request) (string, error) {
+	base, err := webBaseURL(req.GetDBName())
+	if err != nil {
+		return "", echo.NewHTTPError(http.StatusConflict,
+			fmt.Sprintf("Set the %s system parameter to the URL of the server before sending links", models.ParamWebBaseURL))
+	}
+	return base, nil
+}
+
+// queueSignupMail sends a password reset or invitation link to the user
+func queueSignupMail(c echo.Context, req *goodooHttp.Request, user *models.User, template string) error {
+	base, err := webBaseURL(req.GetDBName())
+	if err != nil {
+		return err
+	}
+	db := req.GetDB()
+	token, err := user.GenerateSignupToken(db, req.Now().Add(signupTokenValidity))
+	if err != nil {
+		return err
+	}
+
+	data := map[string]interface{}{
+		"User":     user,
+		"Link":     fmt.Sprintf("%s/reset_password?token=%s", base, url.QueryEscape(token)),
+		"Hours":    int(signupTokenValidity.Hours()),
+	}
+	return mail.QueueTemplate(db, c.Echo().Renderer, template, user.Lang, []string{user.Email}, data)
+}
+
+// ResetPassword emails a password reset link (like Odoo's /web/reset_password).
+// The response does not reveal whether the login exists.
+func (h *AuthHandler) ResetPassword(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	login := req.GetStringParam("login")
+	if login == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Login or email required")
+	}
+
+	db := req.GetDB()
+	if db == nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database connection error")
+	}
+	// Checked before the login, so that the answer does not tell whether
+	// it exists
+	if _, err := webBaseURL(req.GetDBName()); err != nil {
+		req.Logger.ErrorCtx(req.Context, "Password reset refused: %v", err)
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "Password reset is not configured on this server")
+	}
+
+	var user models.User
+	err := db.Where("(login = ? OR email = ?) AND active = ? AND is_service = ?", login, login, true, false).First(&user).Error
+	if err == nil && user.Email != "" {
+		if err := queueSignupMail(c, req, &user, "mail_reset_password"); err != nil {
+			req.Logger.ErrorCtx(req.Context, "Failed to queue password reset for %s: %v", user.Login, err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to send reset email")
+		}
+		req.Logger.InfoCtx(req.Context, "Password reset requested for %s", user.Login)
+	} else {
+		req.Logger.WarningCtx(req.Context, "Password reset requested for unknown login: %s", login)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"success": true,
+		"message": "If the account exists, a password reset link has been sent",
+	})
+}
+
+// ResetPasswordConfirm sets a new password from a reset or invitation token
+// and logs the user out everywhere
+func (h *AuthHandler) ResetPasswordConfirm(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	token := req.GetStringParam("token")
+	password := req.GetStringParam("password")
+	if token == "" || password == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Token and password required")
+	}
+
+	db := req.GetDB()
+	if db == nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database connection error")
+	}
+
+	user, err := models.FindUserBySignupToken(db, token, req.Now())
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid or expired token")
+	}
+	if err := user.ResetPassword(db, password); err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to reset password for %s: %v", user.Login, err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to reset password")
+	}
+
+	if removed, err := h.Config.SessionStore.DeleteUserSessions(int(user.ID), ""); err != nil {
+		req.Logger.WarningCtx(req.Context, "Failed to revoke sessions of %s: %v", user.Login, err)
+	} else if removed > 0 {
+		req.Logger.InfoCtx(req.Context, "Revoked %d session(s) of %s after password reset", removed, user.Login)
+	}
+	_, err = notification.Notify(req.GetDBName(), user.ID, models.NotificationCategoryAccount, models.NotificationInfo, "Your password was changed",
+		"If you did not change it, contact your administrator.", nil)
+	if err != nil {
+		req.Logger.WarningCtx(req.Context, "Failed to notify %s of the password change: %v", user.Login, err)
+	}
+
+	req.Logger.InfoCtx(req.Context, "Password reset completed for %s", user.Login)
+	return c.JSON(http.StatusOK, map[string]interface{}{"success": true})
+}
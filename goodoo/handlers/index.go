@@ -1,13 +1,34 @@
 package handlers
 
 import (
+	"net/http"
+
 	"github.com/labstack/echo/v4"
+	goodooHttp "goodoo/http"
+	"goodoo/oidc"
 )
 
+// IndexHandler renders the home page
 func IndexHandler(c echo.Context) error {
-	return c.File("templates/home.html")
+	// Pages reference fingerprinted assets, so always revalidate the HTML itself
+	c.Response().Header().Set("Cache-Control", "no-cache")
+	return c.Render(http.StatusOK, "home.html", pageData(c))
 }
 
+// LoginPageHandler renders the login page
 func LoginPageHandler(c echo.Context) error {
-	return c.File("templates/login.html")
-}
\ No newline at end of file
+	c.Response().Header().Set("Cache-Control", "no-cache")
+	data := pageData(c)
+	// The single sign-on button only shows when a provider is configured
+	if req := goodooHttp.GetGoodooRequest(c); req != nil {
+		if config := oidc.ConfigForDB(req.GetDBName()); config.Enabled() {
+			data["SSOLabel"] = config.Label
+		}
+	}
+	return c.Render(http.StatusOK, "login.html", data)
+}
+
+// pageData exposes the CSP nonce to page templates
+func pageData(c echo.Context) map[string]interface{} {
+	return map[string]interface{}{"CSPNonce": goodooHttp.CSPNonce(c)}
+}
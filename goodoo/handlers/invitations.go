@@ -0,0 +1,554 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"goodoo/fields"
+	goodooHttp "goodoo/http"
+	"goodoo/mail"
+	"goodoo/models"
+	"gorm.io/gorm"
+)
+
+// InvitationHandler invites users by email: administrators create their
+// inactive account and mail them a single-use link, where they choose
+// their password to activate it
+type InvitationHandler struct {
+	Config *goodooHttp.RequestConfig
+}
+
+// NewInvitationHandler creates a new invitation handler
+func NewInvitationHandler(config *goodooHttp.RequestConfig) *InvitationHandler {
+	return &InvitationHandler{Config: config}
+}
+
+// InviteRequest is the body of POST /api/users/invite. Login defaults to
+// the email; Groups are group ids or external ids like "base.group_user".
+type InviteRequest struct {
+	Email  string        `json:"email"`
+	Name   string        `json:"name"`
+	Login  string        `json:"login"`
+	Lang   string        `json:"lang"`
+	Groups []interface{} `json:"groups"`
+}
+
+// InvitationResponse is the API form of an invitation
+type InvitationResponse struct {
+	models.UserInvitation
+	State string `json:"state"`
+	Login string `json:"login"`
+	// Link is only returned while mail is logged instead of sent, so an
+	// administrator can hand it over
+	Link string `json:"link,omitempty"`
+}
+
+// invitationResponse returns the API form of an invitation of a user
+func invitationResponse(invitation *models.UserInvitation, login string, now time.Time) InvitationResponse {
+	return InvitationResponse{UserInvitation: *invitation, State: invitation.State(now), Login: login}
+}
+
+// resolveGroups returns the ids of groups given by id or external id
+func resolveGroups(db *gorm.DB, groups []interface{}) ([]uint, error) {
+	ids := make([]uint, 0, len(groups))
+	for _, group := range groups {
+		switch value := group.(type) {
+		case float64, json.Number:
+			id, err := fields.ConvertToID(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid group id %v", value)
+			}
+			ids = append(ids, id)
+		case string:
+			model, id, err := models.ResolveXMLID(db, value)
+			if err != nil || model != "res.groups" {
+				return nil, fmt.Errorf("unknown group %s", value)
+			}
+			ids = append(ids, id)
+		default:
+			return nil, fmt.Errorf("invalid group %v", group)
+		}
+	}
+	ids = uniqueIDs(ids)
+	if len(ids) == 0 {
+		return ids, nil
+	}
+	var found int64
+	if err := db.Model(&models.ResGroups{}).Where("id IN ?", ids).Count(&found).Error; err != nil {
+		return nil, err
+	}
+	if found != int64(len(ids)) {
+		return nil, errors.New("unknown group ids")
+	}
+	return ids, nil
+}
+
+// uniqueIDs returns ids without repeats, in order
+func uniqueIDs(ids []uint) []uint {
+	seen := make(map[uint]bool, len(ids))
+	unique := make([]uint, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
+
+// sendInvitation creates a new invitation of the user, revoking the
+// pending ones, mails its link and records who invited them. The link is
+// returned when mail is only logged.
+func sendInvitation(c echo.Context, req *goodooHttp.Request, user *models.User, resent bool) (*InvitationResponse, error) {
+	base, err := webBaseURL(req.GetDBName())
+	if err != nil {
+		return nil, err
+	}
+	inviter := invitationSender{
+		db:       req.GetDB(),
+		dbName:   req.GetDBName(),
+		renderer: c.Echo().Renderer,
+		baseURL:  base,
+		uid:      uint(req.GetUserID()),
+		login:    req.GetLogin(),
+	}
+	response, err := inviter.send(user, req.Now(), resent)
+	if err != nil {
+		return nil, err
+	}
+	if response.activityErr != nil {
+		req.Logger.WarningCtx(req.Context, "Failed to record the invitation of %s: %v", user.Login, response.activityErr)
+	}
+	return &response.InvitationResponse, nil
+}
+
+// invitationSender invites users on behalf of an administrator, outside
+// of a request too, e.g. from a user import running in the background
+type invitationSender struct {
+	db       *gorm.DB
+	dbName   string
+	renderer echo.Renderer
+	baseURL  string
+	uid      uint
+	login    string
+}
+
+// sentInvitation is an invitation sent, with the error recording it in
+// the activity feed, which does not fail the invitation
+type sentInvitation struct {
+	InvitationResponse
+	activityErr error
+}
+
+// send invites a user: see sendInvitation
+func (s *invitationSender) send(user *models.User, now time.Time, resent bool) (*sentInvitation, error) {
+	hours := models.GetParamInt(s.dbName, models.ParamInvitationHours, models.DefaultInvitationHours)
+	invitation, token, err := models.InviteUser(s.db, user, s.uid, now, now.Add(time.Duration(hours)*time.Hour))
+	if err != nil {
+		return nil, err
+	}
+
+	link := fmt.Sprintf("%s/invite/%s", s.baseURL, url.PathEscape(token))
+	data := map[string]interface{}{
+		"User":  user,
+		"Link":  link,
+		"Hours": hours,
+	}
+	if err := mail.QueueTemplate(s.db, s.renderer, "mail_user_invite", user.Lang, []string{user.Email}, data); err != nil {
+		return nil, err
+	}
+
+	invited := models.Activity{
+		Type:     models.ActivityUserInvited,
+		Severity: models.SeveritySuccess,
+		Model:    "res.users",
+		ResID:    user.ID,
+		Params: map[string]interface{}{
+			"inviter":       s.login,
+			"login":         user.Login,
+			"email":         user.Email,
+			"invitation_id": invitation.ID,
+			"resent":        resent,
+		},
+	}
+	sent := &sentInvitation{InvitationResponse: invitationResponse(invitation, user.Login, now)}
+	sent.activityErr = models.LogActivity(s.db, s.uid, invited)
+	if mail.LogOnly() {
+		sent.Link = link
+	}
+	return sent, nil
+}
+
+// Invite creates the inactive account of a user, without password, in the
+// groups given, and mails them an invitation link
+func (h *InvitationHandler) Invite(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	var body InviteRequest
+	if err := c.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request format")
+	}
+	body.Email = strings.TrimSpace(body.Email)
+	body.Name = strings.TrimSpace(body.Name)
+	if body.Email == "" || body.Name == "" || !strings.Contains(body.Email, "@") {
+		return echo.NewHTTPError(http.StatusBadRequest, "A name and a valid email are required")
+	}
+	if body.Login == "" {
+		body.Login = body.Email
+	}
+	if body.Lang == "" {
+		body.Lang = models.DefaultLang
+	}
+	if _, err := linkBase(req); err != nil {
+		return err
+	}
+
+	db := req.GetDB()
+	var existing int64
+	if err := db.Model(&models.User{}).Where("login = ? OR lower(email) = lower(?)", body.Login, body.Email).Count(&existing).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to check existing users")
+	}
+	if existing > 0 {
+		return echo.NewHTTPError(http.StatusConflict, "A user with this login or email already exists; re-send their invitation instead")
+	}
+	groupIDs, err := resolveGroups(db, body.Groups)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	user, err := models.CreateInvitedUser(db, body.Login, body.Name, body.Email, body.Lang, groupIDs)
+	if err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to create invited user %s: %v", body.Login, err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to create user")
+	}
+	invitation, err := sendInvitation(c, req, user, false)
+	if err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to invite %s: %v", user.Login, err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "User created, but the invitation could not be sent; re-send it")
+	}
+
+	req.Logger.InfoCtx(req.Context, "User %s (ID: %d) invited by %s", user.Login, user.ID, req.GetLogin())
+	return c.JSON(http.StatusCreated, map[string]interface{}{
+		"user": map[string]interface{}{
+			"id":     user.ID,
+			"login":  user.Login,
+			"name":   user.Name,
+			"email":  user.Email,
+			"active": user.Active,
+		},
+		"invitation": invitation,
+	})
+}
+
+// List returns the invitations, the latest first, optionally in a state
+// (?state=pending, accepted, revoked or expired)
+func (h *InvitationHandler) List(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	state := c.QueryParam("state")
+	now := req.Now()
+
+	query := req.GetDB().Order("id DESC")
+	switch state {
+	case "":
+	case models.InvitationPending:
+		query = query.Where("accepted_at IS NULL AND revoked_at IS NULL AND expires_at > ?", now)
+	case models.InvitationAccepted:
+		query = query.Where("accepted_at IS NOT NULL")
+	case models.InvitationRevoked:
+		query = query.Where("accepted_at IS NULL AND revoked_at IS NOT NULL")
+	case models.InvitationExpired:
+		query = query.Where("accepted_at IS NULL AND revoked_at IS NULL AND expires_at <= ?", now)
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "State must be pending, accepted, revoked or expired")
+	}
+	var invitations []models.UserInvitation
+	if err := query.Find(&invitations).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to list invitations")
+	}
+
+	logins := make(map[uint]string)
+	var userIDs []uint
+	for _, invitation := range invitations {
+		userIDs = append(userIDs, invitation.UserID)
+	}
+	if len(userIDs) > 0 {
+		var users []models.User
+		req.GetDB().Select("id", "login").Where("id IN ?", userIDs).Find(&users)
+		for _, user := range users {
+			logins[user.ID] = user.Login
+		}
+	}
+	responses := make([]InvitationResponse, len(invitations))
+	for i := range invitations {
+		responses[i] = invitationResponse(&invitations[i], logins[invitations[i].UserID], now)
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"invitations": responses,
+		"total":       len(responses),
+	})
+}
+
+// invitationOf loads the invitation of the :id parameter and its user
+func invitationOf(c echo.Context, db *gorm.DB) (*models.UserInvitation, *models.User, error) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return nil, nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid invitation ID")
+	}
+	var invitation models.UserInvitation
+	if err := db.First(&invitation, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, echo.NewHTTPError(http.StatusNotFound, "Invitation not found")
+		}
+		return nil, nil, echo.NewHTTPError(http.StatusInternalServerError, "Failed to read the invitation")
+	}
+	var user models.User
+	if err := db.First(&user, invitation.UserID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, echo.NewHTTPError(http.StatusGone, "The invited user no longer exists")
+		}
+		return nil, nil, echo.NewHTTPError(http.StatusInternalServerError, "Failed to read the invited user")
+	}
+	return &invitation, &user, nil
+}
+
+// Resend mails a new invitation to the user of an invitation; the links
+// sent before stop working
+func (h *InvitationHandler) Resend(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	invitation, user, err := invitationOf(c, req.GetDB())
+	if err != nil {
+		return err
+	}
+	if invitation.AcceptedAt != nil || user.Active {
+		return echo.NewHTTPError(http.StatusConflict, "The user already activated their account")
+	}
+	if _, err := linkBase(req); err != nil {
+		return err
+	}
+
+	resent, err := sendInvitation(c, req, user, true)
+	if err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to re-send the invitation of %s: %v", user.Login, err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to send the invitation")
+	}
+	req.Logger.InfoCtx(req.Context, "Invitation of %s re-sent by %s", user.Login, req.GetLogin())
+	return c.JSON(http.StatusOK, resent)
+}
+
+// Revoke closes a pending invitation; its link stops working and the
+// account stays inactive
+func (h *InvitationHandler) Revoke(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	invitation, user, err := invitationOf(c, db)
+	if err != nil {
+		return err
+	}
+	now := req.Now()
+	if state := invitation.State(now); state != models.InvitationPending {
+		return echo.NewHTTPError(http.StatusConflict, "The invitation is "+state+" already")
+	}
+
+	if err := invitation.Revoke(db, uint(req.GetUserID()), now); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to revoke the invitation")
+	}
+	revoked := models.Activity{
+		Type:     models.ActivityInvitationRevoked,
+		Severity: models.SeverityWarning,
+		Model:    "res.users",
+		ResID:    user.ID,
+		Params:   map[string]interface{}{"revoker": req.GetLogin(), "login": user.Login, "invitation_id": invitation.ID},
+	}
+	if err := models.LogActivity(db, uint(req.GetUserID()), revoked); err != nil {
+		req.Logger.WarningCtx(req.Context, "Failed to record the revocation of the invitation of %s: %v", user.Login, err)
+	}
+	req.Logger.InfoCtx(req.Context, "Invitation of %s revoked by %s", user.Login, req.GetLogin())
+	return c.JSON(http.StatusOK, invitationResponse(invitation, user.Login, now))
+}
+
+// invitationMessages are the messages of the acceptance page for the
+// invitations that can no longer be accepted
+var invitationMessages = map[error]string{
+	models.ErrInvitationNotFound: "This invitation does not exist. Check that the link was copied entirely.",
+	models.ErrInvitationExpired:  "This invitation has expired. Ask your administrator to send a new one.",
+	models.ErrInvitationRevoked:  "This invitation has been withdrawn. Ask your administrator to send a new one if needed.",
+	models.ErrInvitationAccepted: "This invitation was accepted already. Sign in with the password you chose.",
+	models.ErrInvitationInvalid:  "This invitation is no longer valid for this account. Contact your administrator.",
+}
+
+// invitationError renders the error page of an invitation that cannot be
+// accepted
+func invitationError(c echo.Context, err error) error {
+	for known, message := range invitationMessages {
+		if errors.Is(err, known) {
+			status := http.StatusGone
+			if known == models.ErrInvitationNotFound {
+				status = http.StatusNotFound
+			}
+			return shareError(c, status, "Invitation not available", message)
+		}
+	}
+	return shareError(c, http.StatusInternalServerError, "Unavailable", "This invitation cannot be opened right now. Try again later.")
+}
+
+// pendingInvitation returns the pending invitation of the route token and
+// its still inactive user
+func pendingInvitation(c echo.Context, req *goodooHttp.Request) (*models.UserInvitation, *models.User, error) {
+	db := req.GetDB()
+	if db == nil {
+		return nil, nil, errors.New("database not available")
+	}
+	invitation, err := models.FindInvitation(db, c.Param("token"))
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := invitation.Usable(req.Now()); err != nil {
+		return nil, nil, err
+	}
+	var user models.User
+	if err := db.First(&user, invitation.UserID).Error; err != nil || user.Active || !strings.EqualFold(user.Email, invitation.Email) {
+		return nil, nil, models.ErrInvitationInvalid
+	}
+	return invitation, &user, nil
+}
+
+// invitePage renders the acceptance form of an invitation
+func invitePage(c echo.Context, req *goodooHttp.Request, status int, user *models.User, lang, tz, message string) error {
+	langs, err := models.InstalledLangs(req.GetDB())
+	if err != nil {
+		langs = []string{models.DefaultLang}
+	}
+	if lang == "" {
+		lang = user.Lang
+	}
+	body := map[string]interface{}{"login": user.Login, "name": user.Name}
+	if message != "" {
+		body["error"] = message
+	}
+	return sharePage(c, status, "invite.html", body, map[string]interface{}{
+		"Name":      user.DisplayName(),
+		"Login":     user.Login,
+		"Langs":     langs,
+		"Lang":      lang,
+		"Tz":        tz,
+		"MinLength": models.GetParamInt(req.GetDBName(), models.ParamPasswordMinLength, models.DefaultPasswordMinLength),
+		"Message":   message,
+	})
+}
+
+// Page shows the acceptance form of the invitation of the link
+func (h *InvitationHandler) Page(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	_, user, err := pendingInvitation(c, req)
+	if err != nil {
+		return invitationError(c, err)
+	}
+	return invitePage(c, req, http.StatusOK, user, "", "", "")
+}
+
+// Accept activates the invited account with the password posted, as a
+// form or JSON, and signs the user in. The password must follow the
+// password policy; the language and timezone are optional.
+func (h *InvitationHandler) Accept(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	invitation, user, err := pendingInvitation(c, req)
+	if err != nil {
+		return invitationError(c, err)
+	}
+
+	var body struct {
+		Password        string `json:"password" form:"password"`
+		PasswordConfirm string `json:"password_confirm" form:"password_confirm"`
+		Lang            string `json:"lang" form:"lang"`
+		Tz              string `json:"tz" form:"tz"`
+	}
+	if err := c.Bind(&body); err != nil {
+		return invitePage(c, req, http.StatusBadRequest, user, "", "", "The form could not be read.")
+	}
+	refuse := func(message string) error {
+		return invitePage(c, req, http.StatusBadRequest, user, body.Lang, body.Tz, message)
+	}
+	if body.PasswordConfirm != "" && body.PasswordConfirm != body.Password {
+		return refuse("The passwords do not match.")
+	}
+	var policyErr *models.PasswordPolicyError
+	if err := user.CheckPasswordPolicy(req.GetDBName(), body.Password); errors.As(err, &policyErr) {
+		return refuse(policyErr.Reason + ".")
+	}
+	if body.Tz != "" && !goodooHttp.ValidTimezone(body.Tz) {
+		return refuse("Unknown timezone.")
+	}
+	if body.Lang != "" {
+		langs, err := models.InstalledLangs(req.GetDB())
+		valid := err == nil
+		if valid {
+			valid = false
+			for _, lang := range langs {
+				valid = valid || lang == body.Lang
+			}
+		}
+		if !valid {
+			return refuse("Unknown language.")
+		}
+	}
+
+	db := req.GetDB()
+	user, err = invitation.Accept(db, models.InvitationAcceptance{Password: body.Password, Lang: body.Lang, Tz: body.Tz}, req.Now())
+	if err != nil {
+		if _, known := invitationMessages[err]; !known {
+			req.Logger.ErrorCtx(req.Context, "Failed to accept invitation %d: %v", invitation.ID, err)
+		}
+		return invitationError(c, err)
+	}
+
+	var inviter models.User
+	db.Select("id", "login").First(&inviter, invitation.InvitedBy)
+	accepted := models.Activity{
+		Type:     models.ActivityInvitationAccepted,
+		Severity: models.SeveritySuccess,
+		Model:    "res.users",
+		ResID:    user.ID,
+		Params:   map[string]interface{}{"login": user.Login, "inviter": inviter.Login, "invitation_id": invitation.ID},
+	}
+	if err := models.LogActivity(db, user.ID, accepted); err != nil {
+		req.Logger.WarningCtx(req.Context, "Failed to record the acceptance of the invitation of %s: %v", user.Login, err)
+	}
+	req.Logger.InfoCtx(req.Context, "User %s accepted their invitation and activated their account", user.Login)
+
+	if err := startSession(req, req.GetDBName(), user, "invitation"); err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to sign in %s after accepting their invitation: %v", user.Login, err)
+		return shareError(c, http.StatusInternalServerError, "Account activated", "Your account is active: sign in with your new password.")
+	}
+	if c.QueryParam("format") == "json" || strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEApplicationJSON) {
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"success": true,
+			"user_id": user.ID,
+			"login":   user.Login,
+		})
+	}
+	return c.Redirect(http.StatusSeeOther, "/dashboard")
+}
+
+// RegisterInvitationRoutes mounts the invitation management under
+// /api/users, reserved to the holders of users.manage, and the public
+// acceptance page at /invite/:token
+func RegisterInvitationRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewInvitationHandler(config)
+
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		{Method: "POST", Path: "/api/users/invite", Handler: handler.Invite, Auth: true, DB: true, Permission: goodooHttp.PermissionUsersManage, Idempotent: true},
+		{Method: "GET", Path: "/api/users/invitations", Handler: handler.List, Auth: true, DB: true, Permission: goodooHttp.PermissionUsersManage},
+		{Method: "POST", Path: "/api/users/invitations/:id/resend", Handler: handler.Resend, Auth: true, DB: true, Permission: goodooHttp.PermissionUsersManage},
+		{Method: "POST", Path: "/api/users/invitations/:id/revoke", Handler: handler.Revoke, Auth: true, DB: true, Permission: goodooHttp.PermissionUsersManage},
+
+		// Public: the invited user holds a token, not a session
+		{Method: "GET", Path: "/invite/:token", Handler: handler.Page, Public: true},
+		{Method: "POST", Path: "/invite/:token", Handler: handler.Accept, Public: true, RateLimit: "auth", CSRFExempt: true},
+	})
+}
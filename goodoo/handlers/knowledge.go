@@ -0,0 +1,265 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	goodooHttp "goodoo/http"
+	"goodoo/knowledge"
+	"goodoo/models"
+	"gorm.io/gorm"
+)
+
+// maxSearchLimit bounds the chunks returned by a knowledge search
+const maxSearchLimit = 50
+
+// KnowledgeHandler manages the LLM knowledge base documents and searches them
+type KnowledgeHandler struct {
+	Config *goodooHttp.RequestConfig
+}
+
+// NewKnowledgeHandler creates a new knowledge handler
+func NewKnowledgeHandler(config *goodooHttp.RequestConfig) *KnowledgeHandler {
+	return &KnowledgeHandler{Config: config}
+}
+
+// requestDB returns the request database
+func (h *KnowledgeHandler) requestDB(c echo.Context) (*goodooHttp.Request, *gorm.DB, error) {
+	req := goodooHttp.GetGoodooRequest(c)
+	db := req.GetDB()
+	if db == nil {
+		return nil, nil, echo.NewHTTPError(http.StatusInternalServerError, "Database not available")
+	}
+	return req, db, nil
+}
+
+// KnowledgeDocumentRequest is the body creating or updating a document
+type KnowledgeDocumentRequest struct {
+	Title        *string `json:"title"`
+	Content      *string `json:"content"`
+	AttachmentID *uint   `json:"attachment_id"`
+	ChunkSize    *int    `json:"chunk_size"`
+	ChunkOverlap *int    `json:"chunk_overlap"`
+}
+
+func (r *KnowledgeDocumentRequest) apply(document *models.KnowledgeDocument) {
+	if r.Title != nil {
+		document.Title = *r.Title
+	}
+	if r.Content != nil {
+		document.Content = *r.Content
+	}
+	if r.AttachmentID != nil {
+		document.AttachmentID = r.AttachmentID
+		if *r.AttachmentID == 0 {
+			document.AttachmentID = nil
+		}
+	}
+	if r.ChunkSize != nil {
+		document.ChunkSize = *r.ChunkSize
+	}
+	if r.ChunkOverlap != nil {
+		document.ChunkOverlap = *r.ChunkOverlap
+	}
+}
+
+// validateKnowledgeDocument checks a document before saving it
+func validateKnowledgeDocument(document *models.KnowledgeDocument) error {
+	switch {
+	case strings.TrimSpace(document.Title) == "":
+		return errors.New("title is required")
+	case document.AttachmentID == nil && strings.TrimSpace(document.Content) == "":
+		return errors.New("content or attachment_id is required")
+	case document.ChunkSize < 20 || document.ChunkSize > 2000:
+		return errors.New("chunk_size must be between 20 and 2000 words")
+	case document.ChunkOverlap < 0 || document.ChunkOverlap >= document.ChunkSize:
+		return errors.New("chunk_overlap must be at least 0 and smaller than chunk_size")
+	}
+	return nil
+}
+
+// loadDocument loads the document of the :id route parameter
+func (h *KnowledgeHandler) loadDocument(c echo.Context, db *gorm.DB) (*models.KnowledgeDocument, error) {
+	id, err := parseRecordID(c)
+	if err != nil {
+		return nil, err
+	}
+	var document models.KnowledgeDocument
+	if err := db.First(&document, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, echo.NewHTTPError(http.StatusNotFound, "Document not found")
+		}
+		return nil, err
+	}
+	return &document, nil
+}
+
+// ingest embeds a document with the database's embedder and answers with it
+func (h *KnowledgeHandler) ingest(c echo.Context, req *goodooHttp.Request, db *gorm.DB, document *models.KnowledgeDocument, force bool, status int) error {
+	embedder := knowledge.EmbedderForDB(req.DB)
+	if err := knowledge.Ingest(req.Context, db, req.DB, embedder, document, force); err != nil {
+		req.Logger.WarningCtx(req.Context, "Failed to ingest knowledge document %d: %v", document.ID, err)
+		return c.JSON(http.StatusBadGateway, map[string]interface{}{"error": err.Error(), "document": document})
+	}
+	return c.JSON(status, document)
+}
+
+// List returns the knowledge documents without their content
+func (h *KnowledgeHandler) List(c echo.Context) error {
+	_, db, err := h.requestDB(c)
+	if err != nil {
+		return err
+	}
+
+	var documents []models.KnowledgeDocument
+	if err := db.Omit("content").Order("title, id").Find(&documents).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, documents)
+}
+
+// Create stores a document and ingests it
+func (h *KnowledgeHandler) Create(c echo.Context) error {
+	req, db, err := h.requestDB(c)
+	if err != nil {
+		return err
+	}
+
+	var body KnowledgeDocumentRequest
+	if err := c.Bind(&body); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+	}
+	document := &models.KnowledgeDocument{ChunkSize: 200, ChunkOverlap: 40, State: models.KnowledgeStateDraft}
+	body.apply(document)
+	if err := validateKnowledgeDocument(document); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	uid := uint(req.GetUserID())
+	document.CreateUID, document.WriteUID = uid, uid
+	if err := db.Select("*").Omit("id").Create(document).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	req.Logger.InfoCtx(req.Context, "Knowledge document %q created", document.Title)
+	return h.ingest(c, req, db, document, true, http.StatusCreated)
+}
+
+// Update writes a document and ingests it again when its text changed
+func (h *KnowledgeHandler) Update(c echo.Context) error {
+	req, db, err := h.requestDB(c)
+	if err != nil {
+		return err
+	}
+	document, err := h.loadDocument(c, db)
+	if err != nil {
+		return err
+	}
+
+	var body KnowledgeDocumentRequest
+	if err := c.Bind(&body); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+	}
+	// Changing how the text is chunked requires a new ingestion
+	force := (body.ChunkSize != nil && *body.ChunkSize != document.ChunkSize) ||
+		(body.ChunkOverlap != nil && *body.ChunkOverlap != document.ChunkOverlap)
+	body.apply(document)
+	if err := validateKnowledgeDocument(document); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	document.WriteUID = uint(req.GetUserID())
+	if err := db.Select("title", "content", "attachment_id", "chunk_size", "chunk_overlap", "write_uid").Updates(document).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	return h.ingest(c, req, db, document, force, http.StatusOK)
+}
+
+// Reindex ingests a document again, e.g. after changing the embedding model
+func (h *KnowledgeHandler) Reindex(c echo.Context) error {
+	req, db, err := h.requestDB(c)
+	if err != nil {
+		return err
+	}
+	document, err := h.loadDocument(c, db)
+	if err != nil {
+		return err
+	}
+	return h.ingest(c, req, db, document, true, http.StatusOK)
+}
+
+// Delete removes a document and its chunks
+func (h *KnowledgeHandler) Delete(c echo.Context) error {
+	req, db, err := h.requestDB(c)
+	if err != nil {
+		return err
+	}
+	document, err := h.loadDocument(c, db)
+	if err != nil {
+		return err
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("document_id = ?", document.ID).Delete(&models.KnowledgeChunk{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(document).Error
+	})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	req.Logger.InfoCtx(req.Context, "Knowledge document %q deleted", document.Title)
+	return c.JSON(http.StatusOK, map[string]interface{}{"success": true})
+}
+
+// Search returns the chunks most similar to ?q=, at most ?limit= (default 5)
+func (h *KnowledgeHandler) Search(c echo.Context) error {
+	req, db, err := h.requestDB(c)
+	if err != nil {
+		return err
+	}
+
+	query := strings.TrimSpace(c.QueryParam("q"))
+	if query == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "q is required"})
+	}
+	limit := knowledge.DefaultLimit
+	if value := c.QueryParam("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxSearchLimit {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "limit must be between 1 and 50"})
+		}
+	}
+
+	embedder := knowledge.EmbedderForDB(req.DB)
+	results, err := knowledge.Search(req.Context, db, req.DB, embedder, query, limit)
+	if err != nil {
+		req.Logger.WarningCtx(req.Context, "Knowledge search failed: %v", err)
+		return c.JSON(http.StatusBadGateway, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"query":   query,
+		"model":   embedder.Model(),
+		"results": results,
+	})
+}
+
+// RegisterKnowledgeRoutes mounts the knowledge base endpoints under
+// /api/knowledge; changing the documents requires the knowledge.manage
+// permission
+func RegisterKnowledgeRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewKnowledgeHandler(config)
+	manage := goodooHttp.PermissionKnowledgeManage
+
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		{Method: "GET", Path: "/api/knowledge/search", Handler: handler.Search, Auth: true, DB: true},
+		{Method: "GET", Path: "/api/knowledge/documents", Handler: handler.List, Auth: true, DB: true},
+		{Method: "POST", Path: "/api/knowledge/documents", Handler: handler.Create, Auth: true, DB: true, Permission: manage},
+		{Method: "PUT", Path: "/api/knowledge/documents/:id", Handler: handler.Update, Auth: true, DB: true, Permission: manage},
+		{Method: "POST", Path: "/api/knowledge/documents/:id/reindex", Handler: handler.Reindex, Auth: true, DB: true, Permission: manage},
+		{Method: "DELETE", Path: "/api/knowledge/documents/:id", Handler: handler.Delete, Auth: true, DB: true, Permission: manage},
+	})
+}
@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"goodoo/llm"
+	"goodoo/models"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// LLMRouteResponse is a route with the statistics of its chats
+type LLMRouteResponse struct {
+	models.LLMRoute
+	Stats *llm.RouteStats `json:"stats,omitempty"`
+}
+
+// LLMRoutesResponse lists the routes and the providers in cooldown
+type LLMRoutesResponse struct {
+	Routes    []LLMRouteResponse `json:"routes"`
+	Cooldowns []llm.Cooldown     `json:"cooldowns"`
+}
+
+// LLMRouteRequest creates or replaces the route of a model
+type LLMRouteRequest struct {
+	Model         string                 `json:"model"`
+	ProviderID    uint                   `json:"provider_id"`
+	ProviderModel string                 `json:"provider_model"`
+	Fallbacks     models.LLMRouteTargets `json:"fallbacks"`
+	MaxLatencyMs  int                    `json:"max_latency_ms"`
+	// FailoverOn lists error classes, models.DefaultLLMFailoverOn when
+	// omitted
+	FailoverOn []string `json:"failover_on"`
+	Active     *bool    `json:"active"`
+}
+
+// GetLLMRoutes returns the routes of the models, with the failovers of
+// each since the server started, and the providers in cooldown
+func (h *DashboardHandler) GetLLMRoutes(c echo.Context) error {
+	req, catalog, err := h.llmCatalog(c)
+	if err != nil {
+		return err
+	}
+
+	stats := make(map[string]*llm.RouteStats)
+	routeStats := llm.Stats(req.GetDBName())
+	for i := range routeStats {
+		stats[routeStats[i].Model] = &routeStats[i]
+	}
+	routes := make([]LLMRouteResponse, len(catalog.Routes))
+	for i, route := range catalog.Routes {
+		routes[i] = LLMRouteResponse{LLMRoute: route, Stats: stats[route.Model]}
+	}
+	return c.JSON(http.StatusOK, LLMRoutesResponse{Routes: routes, Cooldowns: llm.Cooldowns(req.GetDBName())})
+}
+
+// SaveLLMRoute creates the route of a model, or replaces it, after checking
+// its targets against the providers and their chat models
+func (h *DashboardHandler) SaveLLMRoute(c echo.Context) error {
+	req, catalog, err := h.llmCatalog(c)
+	if err != nil {
+		return err
+	}
+	db := req.GetDB()
+
+	var body LLMRouteRequest
+	if err := c.Bind(&body); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request format"})
+	}
+	route := models.LLMRoute{
+		Model:         body.Model,
+		ProviderID:    body.ProviderID,
+		ProviderModel: body.ProviderModel,
+		Fallbacks:     body.Fallbacks,
+		MaxLatencyMs:  body.MaxLatencyMs,
+		FailoverOn:    body.FailoverOn,
+		Active:        body.Active == nil || *body.Active,
+	}
+	if err := route.Validate(catalog); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	var existing models.LLMRoute
+	err = db.Where("model = ?", route.Model).First(&existing).Error
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		route.CreateUID = uint(req.GetUserID())
+		route.WriteUID = route.CreateUID
+		err = db.Create(&route).Error
+	case err == nil:
+		route.BaseModel = existing.BaseModel
+		route.WriteUID = uint(req.GetUserID())
+		// Select writes the zero values too, such as an inactive route
+		err = db.Model(&route).Select("provider_id", "provider_model", "fallbacks", "max_latency_ms", "failover_on", "active", "write_uid", "write_date").Updates(&route).Error
+	}
+	if err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to save the LLM route of %s: %v", route.Model, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to save the route"})
+	}
+	req.Logger.InfoCtx(req.Context, "LLM route of %s saved: provider %d, %d fallback(s)", route.Model, route.ProviderID, len(route.Fallbacks))
+	return c.JSON(http.StatusOK, route)
+}
+
+// DeleteLLMRoute deletes a route; its model gets simulated answers again
+func (h *DashboardHandler) DeleteLLMRoute(c echo.Context) error {
+	req, _, err := h.llmCatalog(c)
+	if err != nil {
+		return err
+	}
+	id, err := parseRecordID(c)
+	if err != nil {
+		return err
+	}
+
+	var route models.LLMRoute
+	if err := req.GetDB().First(&route, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Route not found"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	// The model is unique: a soft-deleted route would keep it taken
+	if err := req.GetDB().Unscoped().Delete(&route).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	req.Logger.InfoCtx(req.Context, "LLM route of %s deleted", route.Model)
+	return c.JSON(http.StatusOK, map[string]string{"message": "Route deleted"})
+}
@@ -0,0 +1,314 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	goodooHttp "goodoo/http"
+	"goodoo/models"
+
+	"github.com/labstack/echo/v4"
+)
+
+// PromptTemplateRequest is the body of a template creation or update;
+// fields left out of an update are kept
+type PromptTemplateRequest struct {
+	Name     *string `json:"name"`
+	Scope    *string `json:"scope"`
+	Template *string `json:"template"`
+	Model    *string `json:"model"`
+	Category *string `json:"category"`
+}
+
+// PromptTemplateResponse is a template with its variables, whether the
+// user may change it and when they last sent a message from it
+type PromptTemplateResponse struct {
+	models.PromptTemplate
+	Variables  []string   `json:"variables"`
+	Editable   bool       `json:"editable"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// promptTemplateResponse describes a template for the request user
+func promptTemplateResponse(req *goodooHttp.Request, entry models.PromptTemplateEntry) PromptTemplateResponse {
+	variables, _ := models.PromptVariables(entry.Template)
+	if variables == nil {
+		variables = []string{}
+	}
+	return PromptTemplateResponse{
+		PromptTemplate: entry.PromptTemplate,
+		Variables:      variables,
+		Editable:       promptTemplateEditable(req, &entry.PromptTemplate),
+		LastUsedAt:     entry.LastUsedAt,
+	}
+}
+
+// promptTemplateEditable reports whether the request user may change a
+// template: their own, or any for administrators
+func promptTemplateEditable(req *goodooHttp.Request, template *models.PromptTemplate) bool {
+	return template.UserID == uint(req.GetUserID()) || req.GetEnv().IsAdmin()
+}
+
+// promptTemplateError answers a failed template operation
+func promptTemplateError(c echo.Context, err error) error {
+	if errors.Is(err, models.ErrPromptTemplateNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+}
+
+// loadPromptTemplate returns the template of the :id route parameter, if
+// the request user sees it
+func loadPromptTemplate(c echo.Context, req *goodooHttp.Request) (*models.PromptTemplate, error) {
+	id, err := parseRecordID(c)
+	if err != nil {
+		return nil, err
+	}
+	template, err := models.GetPromptTemplate(req.GetDB(), uint(req.GetUserID()), id)
+	if err != nil {
+		return nil, promptTemplateError(c, err)
+	}
+	return template, nil
+}
+
+// apply sets the values of body on template and validates it; sharing it
+// takes the llm.templates.share permission
+func (body *PromptTemplateRequest) apply(req *goodooHttp.Request, template *models.PromptTemplate) error {
+	if body.Name != nil {
+		template.Name = *body.Name
+	}
+	if body.Template != nil {
+		template.Template = *body.Template
+	}
+	if body.Model != nil {
+		template.Model = *body.Model
+	}
+	if body.Category != nil {
+		template.Category = *body.Category
+	}
+	if body.Scope != nil && *body.Scope != template.Scope {
+		if *body.Scope == models.PromptScopeShared && !req.HasPermission(goodooHttp.PermissionLLMTemplatesShare) {
+			return echo.NewHTTPError(http.StatusForbidden, "Sharing prompt templates requires the "+goodooHttp.PermissionLLMTemplatesShare+" permission")
+		}
+		template.Scope = *body.Scope
+	}
+	if err := template.Validate(); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return nil
+}
+
+// GetPromptTemplates returns the prompt templates the user sees: theirs
+// and the shared ones, searched with ?q= in their name, category and
+// text, filtered on ?category= and ?scope=, and sorted by ?order=name
+// (default) or recent, the ones they sent last first
+func (h *DashboardHandler) GetPromptTemplates(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	query := models.PromptTemplateQuery{
+		Search:   c.QueryParam("q"),
+		Category: c.QueryParam("category"),
+		Scope:    c.QueryParam("scope"),
+		Order:    c.QueryParam("order"),
+		Limit:    50,
+	}
+	if query.Order != "" && query.Order != "name" && query.Order != "recent" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "order must be name or recent"})
+	}
+	if value := c.QueryParam("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > 200 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "limit must be between 1 and 200"})
+		}
+		query.Limit = limit
+	}
+	if value := c.QueryParam("offset"); value != "" {
+		offset, err := strconv.Atoi(value)
+		if err != nil || offset < 0 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid offset"})
+		}
+		query.Offset = offset
+	}
+
+	entries, total, err := models.SearchPromptTemplates(req.GetDB(), uint(req.GetUserID()), query)
+	if err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to search prompt templates: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to load prompt templates"})
+	}
+	templates := make([]PromptTemplateResponse, len(entries))
+	for i, entry := range entries {
+		templates[i] = promptTemplateResponse(req, entry)
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"templates": templates, "total": total})
+}
+
+// GetPromptTemplate returns a template the user sees
+func (h *DashboardHandler) GetPromptTemplate(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	template, err := loadPromptTemplate(c, req)
+	if template == nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, promptTemplateResponse(req, models.PromptTemplateEntry{PromptTemplate: *template}))
+}
+
+// CreatePromptTemplate saves a template of the user: {"name": "...",
+// "template": "Summarize {{text}} in our house style", "model": "gpt-4",
+// "category": "writing", "scope": "personal"}. Shared templates take the
+// llm.templates.share permission.
+func (h *DashboardHandler) CreatePromptTemplate(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	var body PromptTemplateRequest
+	if err := c.Bind(&body); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request format"})
+	}
+
+	template := &models.PromptTemplate{UserID: uint(req.GetUserID()), Scope: models.PromptScopePersonal}
+	if err := body.apply(req, template); err != nil {
+		return err
+	}
+	if err := req.GetDB().Create(template).Error; err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to create the prompt template %q: %v", template.Name, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to save the prompt template"})
+	}
+	req.Logger.InfoCtx(req.Context, "Prompt template %d saved by %s (%s)", template.ID, req.GetLogin(), template.Scope)
+	return c.JSON(http.StatusCreated, promptTemplateResponse(req, models.PromptTemplateEntry{PromptTemplate: *template}))
+}
+
+// UpdatePromptTemplate changes a template the user owns; administrators
+// may change any
+func (h *DashboardHandler) UpdatePromptTemplate(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	template, err := loadPromptTemplate(c, req)
+	if template == nil {
+		return err
+	}
+	var body PromptTemplateRequest
+	if err := c.Bind(&body); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request format"})
+	}
+	if !promptTemplateEditable(req, template) {
+		return echo.NewHTTPError(http.StatusForbidden, "Only the owner of a prompt template may change it")
+	}
+	if err := body.apply(req, template); err != nil {
+		return err
+	}
+	if err := req.GetDB().Save(template).Error; err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to update the prompt template %d: %v", template.ID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to save the prompt template"})
+	}
+	return c.JSON(http.StatusOK, promptTemplateResponse(req, models.PromptTemplateEntry{PromptTemplate: *template}))
+}
+
+// DeletePromptTemplate removes a template the user owns; administrators
+// may remove any. Its uses stay counted on the messages sent from it.
+func (h *DashboardHandler) DeletePromptTemplate(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	template, err := loadPromptTemplate(c, req)
+	if template == nil {
+		return err
+	}
+	if !promptTemplateEditable(req, template) {
+		return echo.NewHTTPError(http.StatusForbidden, "Only the owner of a prompt template may delete it")
+	}
+	if err := req.GetDB().Delete(template).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	req.Logger.InfoCtx(req.Context, "Prompt template %d deleted by %s", template.ID, req.GetLogin())
+	return c.JSON(http.StatusOK, map[string]interface{}{"success": true})
+}
+
+// SharePromptTemplate shares or unshares a template the user owns
+// (llm.templates.share): {"shared": true}
+func (h *DashboardHandler) SharePromptTemplate(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	shared := true
+	var body struct {
+		Shared *bool `json:"shared"`
+	}
+	if err := c.Bind(&body); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request format"})
+	}
+	if body.Shared != nil {
+		shared = *body.Shared
+	}
+
+	template, err := loadPromptTemplate(c, req)
+	if template == nil {
+		return err
+	}
+	if !promptTemplateEditable(req, template) {
+		return echo.NewHTTPError(http.StatusForbidden, "Only the owner of a prompt template may share it")
+	}
+	template.Scope = models.PromptScopePersonal
+	if shared {
+		template.Scope = models.PromptScopeShared
+	}
+	if err := req.GetDB().Model(template).Update("scope", template.Scope).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	req.Logger.InfoCtx(req.Context, "Prompt template %d shared by %s: %t", template.ID, req.GetLogin(), shared)
+	return c.JSON(http.StatusOK, promptTemplateResponse(req, models.PromptTemplateEntry{PromptTemplate: *template}))
+}
+
+// RenderPromptTemplate previews a template rendered with {"variables":
+// {...}} for {"model": "..."}, the model of the template by default,
+// checking its size against the context window of the model
+func (h *DashboardHandler) RenderPromptTemplate(c echo.Context) error {
+	req, catalog, err := h.llmCatalog(c)
+	if err != nil {
+		return err
+	}
+	var body struct {
+		Variables map[string]string `json:"variables"`
+		Model     string            `json:"model"`
+	}
+	if err := c.Bind(&body); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request format"})
+	}
+	template, err := loadPromptTemplate(c, req)
+	if template == nil {
+		return err
+	}
+
+	rendered, err := models.RenderPrompt(template.Template, body.Variables)
+	if err != nil {
+		return promptRenderError(c, err)
+	}
+	model := strings.TrimSpace(body.Model)
+	if model == "" {
+		model = template.Model
+	}
+	if err := models.CheckPromptSize(catalog, model, rendered); err != nil {
+		return promptRenderError(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"rendered":  rendered,
+		"model":     model,
+		"max_chars": models.MaxPromptChars(catalog.ContextWindow(model)),
+	})
+}
+
+// promptRenderError answers a template that did not render: 400 with the
+// missing and unknown variables, 413 for a prompt too long for its model
+func promptRenderError(c echo.Context, err error) error {
+	var variableErr *models.PromptVariableError
+	var tooLong *models.PromptTooLongError
+	switch {
+	case errors.As(err, &variableErr):
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"error":   err.Error(),
+			"missing": variableErr.Missing,
+			"unknown": variableErr.Unknown,
+		})
+	case errors.As(err, &tooLong):
+		return c.JSON(http.StatusRequestEntityTooLarge, map[string]interface{}{
+			"error": err.Error(),
+			"size":  tooLong.Size,
+			"limit": tooLong.Limit,
+		})
+	}
+	return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+}
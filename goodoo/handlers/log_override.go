@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	goodooHttp "goodoo/http"
+)
+
+// Defaults of the log level overrides
+const (
+	DefaultLogOverrideRequests = 50
+	DefaultLogOverrideMinutes  = 15
+)
+
+// LogOverrideHandler lets operators lower the log level of the next
+// requests of sessions, e.g. to DEBUG for a user reporting a problem,
+// without raising the level of every request
+type LogOverrideHandler struct {
+	Config *goodooHttp.RequestConfig
+}
+
+// NewLogOverrideHandler creates a new log override handler
+func NewLogOverrideHandler(config *goodooHttp.RequestConfig) *LogOverrideHandler {
+	return &LogOverrideHandler{Config: config}
+}
+
+// LogOverrideRequest is the body of an override:
+// {"level": "debug", "prefixes": ["goodoo.sql_db"], "requests": 50, "minutes": 15}
+type LogOverrideRequest struct {
+	Level    string   `json:"level"`
+	Prefixes []string `json:"prefixes"`
+	Requests int      `json:"requests"`
+	Minutes  int      `json:"minutes"`
+}
+
+// SessionLogOverrideInfo is the override of a session, named by the start
+// of its ID only since the ID authenticates the session
+type SessionLogOverrideInfo struct {
+	Session  string                         `json:"session"`
+	Override *goodooHttp.SessionLogOverride `json:"override"`
+}
+
+// parseOverride reads the override of the request body
+func (h *LogOverrideHandler) parseOverride(c echo.Context, req *goodooHttp.Request) (*goodooHttp.SessionLogOverride, error) {
+	body := LogOverrideRequest{Level: "debug", Requests: DefaultLogOverrideRequests, Minutes: DefaultLogOverrideMinutes}
+	if err := c.Bind(&body); err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid request body")
+	}
+	now := req.Now()
+	override := &goodooHttp.SessionLogOverride{
+		Level:     body.Level,
+		Prefixes:  body.Prefixes,
+		Remaining: body.Requests,
+		Until:     now.Add(time.Duration(body.Minutes) * time.Minute),
+		SetBy:     req.GetLogin(),
+	}
+	if err := override.Validate(now); err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return override, nil
+}
+
+// setUserOverride sets override, nil clearing it, on the sessions of a
+// user and returns them
+func (h *LogOverrideHandler) setUserOverride(req *goodooHttp.Request, userID int, override *goodooHttp.SessionLogOverride) ([]SessionLogOverrideInfo, error) {
+	sessions := []SessionLogOverrideInfo{}
+	for _, session := range h.Config.SessionStore.UserSessions(userID) {
+		// The current session is saved at the end of the request
+		if session.SID == req.Session.SID {
+			session = req.Session
+		}
+		session.SetLogOverride(override)
+		if session != req.Session {
+			if err := h.Config.SessionStore.Save(session); err != nil {
+				return nil, err
+			}
+		}
+		sessions = append(sessions, SessionLogOverrideInfo{Session: session.SID[:8], Override: session.GetLogOverride()})
+	}
+	return sessions, nil
+}
+
+// parseUserID parses the :id route parameter
+func parseUserID(c echo.Context) (int, error) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id <= 0 {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, "Invalid user ID")
+	}
+	return id, nil
+}
+
+// GetUser returns the overrides of the sessions of a user
+func (h *LogOverrideHandler) GetUser(c echo.Context) error {
+	userID, err := parseUserID(c)
+	if err != nil {
+		return err
+	}
+	sessions := []SessionLogOverrideInfo{}
+	for _, session := range h.Config.SessionStore.UserSessions(userID) {
+		sessions = append(sessions, SessionLogOverrideInfo{Session: session.SID[:8], Override: session.GetLogOverride()})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"sessions": sessions})
+}
+
+// SetUser lowers the log level of the next requests of every session of a
+// user; the records only the override lets through are marked with
+// level_override in their metadata
+func (h *LogOverrideHandler) SetUser(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	userID, err := parseUserID(c)
+	if err != nil {
+		return err
+	}
+	override, err := h.parseOverride(c, req)
+	if err != nil {
+		return err
+	}
+	sessions, err := h.setUserOverride(req, userID, override)
+	if err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to set the log override of user %d: %v", userID, err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to set the log override")
+	}
+
+	req.Logger.WarningCtx(req.Context, "Log level %s set by %s on %d session(s) of user %d for %d request(s) until %s",
+		override.Level, req.GetLogin(), len(sessions), userID, override.Remaining, override.Until.Format(time.RFC3339))
+	return c.JSON(http.StatusOK, map[string]interface{}{"sessions": sessions})
+}
+
+// ClearUser removes the overrides of the sessions of a user
+func (h *LogOverrideHandler) ClearUser(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	userID, err := parseUserID(c)
+	if err != nil {
+		return err
+	}
+	sessions, err := h.setUserOverride(req, userID, nil)
+	if err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to clear the log override of user %d: %v", userID, err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to clear the log override")
+	}
+
+	req.Logger.InfoCtx(req.Context, "Log override of user %d cleared by %s", userID, req.GetLogin())
+	return c.JSON(http.StatusOK, map[string]interface{}{"sessions": sessions})
+}
+
+// SetSession lowers the log level of the next requests of the caller's
+// session, the current one excluded
+func (h *LogOverrideHandler) SetSession(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	override, err := h.parseOverride(c, req)
+	if err != nil {
+		return err
+	}
+	req.Session.SetLogOverride(override)
+
+	req.Logger.WarningCtx(req.Context, "Log level %s set by %s on their session for %d request(s) until %s",
+		override.Level, req.GetLogin(), override.Remaining, override.Until.Format(time.RFC3339))
+	return c.JSON(http.StatusOK, override)
+}
+
+// ClearSession removes the override of the caller's session
+func (h *LogOverrideHandler) ClearSession(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	req.Session.SetLogOverride(nil)
+	return c.JSON(http.StatusOK, map[string]interface{}{"success": true})
+}
+
+// RegisterLogOverrideRoutes mounts the log level overrides, which require
+// the logs.override permission
+func RegisterLogOverrideRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewLogOverrideHandler(config)
+	override := goodooHttp.PermissionLogsOverride
+
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		{Method: "GET", Path: "/api/log-overrides/users/:id", Handler: handler.GetUser, Auth: true, Permission: override},
+		{Method: "PUT", Path: "/api/log-overrides/users/:id", Handler: handler.SetUser, Auth: true, Permission: override, DenyImpersonation: true},
+		{Method: "DELETE", Path: "/api/log-overrides/users/:id", Handler: handler.ClearUser, Auth: true, Permission: override, DenyImpersonation: true},
+		{Method: "PUT", Path: "/api/log-overrides/session", Handler: handler.SetSession, Auth: true, Permission: override, DenyImpersonation: true},
+		{Method: "DELETE", Path: "/api/log-overrides/session", Handler: handler.ClearSession, Auth: true, Permission: override, DenyImpersonation: true},
+	})
+}
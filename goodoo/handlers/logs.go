@@ -0,0 +1,292 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"goodoo/connections"
+	goodooHttp "goodoo/http"
+	"goodoo/logging"
+	"goodoo/models"
+)
+
+// Page sizes of the log query
+const (
+	DefaultLogLimit = 80
+	MaxLogLimit     = 1000
+)
+
+// LogsHandler serves the records written by the PostgreSQL log handler and
+// the live log stream (logs.read)
+type LogsHandler struct {
+	Config *goodooHttp.RequestConfig
+}
+
+// NewLogsHandler creates a new logs handler
+func NewLogsHandler(config *goodooHttp.RequestConfig) *LogsHandler {
+	return &LogsHandler{Config: config}
+}
+
+// logRecord is an ir_logging record with its metadata as JSON
+type logRecord struct {
+	ID         uint            `json:"id"`
+	CreateDate time.Time       `json:"create_date"`
+	Type       string          `json:"type"`
+	DBName     string          `json:"dbname"`
+	Name       string          `json:"name"`
+	Level      string          `json:"level"`
+	Message    string          `json:"message"`
+	Path       string          `json:"path"`
+	Line       int             `json:"line"`
+	Func       string          `json:"func"`
+	Metadata   json.RawMessage `json:"metadata,omitempty"`
+}
+
+// parseLogFilter reads the filters of the log query
+func parseLogFilter(c echo.Context) (models.LogFilter, error) {
+	req := goodooHttp.GetGoodooRequest(c)
+	filter := models.LogFilter{
+		Logger:  c.QueryParam("logger"),
+		DBName:  c.QueryParam("dbname"),
+		Message: c.QueryParam("q"),
+		Limit:   DefaultLogLimit,
+	}
+
+	if levels := c.QueryParam("level"); levels != "" {
+		for _, level := range strings.Split(levels, ",") {
+			if !logging.IsValidLogLevel(level) {
+				return filter, echo.NewHTTPError(http.StatusBadRequest, "Invalid level: "+level)
+			}
+			filter.Levels = append(filter.Levels, logging.ParseLogLevelString(level).String())
+		}
+	}
+
+	loc := requestLocation(req)
+	var err error
+	if value := c.QueryParam("from"); value != "" {
+		if filter.From, err = parseMetricsTime(value, loc); err != nil {
+			return filter, echo.NewHTTPError(http.StatusBadRequest, "Invalid from: "+value)
+		}
+	}
+	if value := c.QueryParam("to"); value != "" {
+		if filter.To, err = parseMetricsTime(value, loc); err != nil {
+			return filter, echo.NewHTTPError(http.StatusBadRequest, "Invalid to: "+value)
+		}
+	}
+
+	if value := c.QueryParam("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			return filter, echo.NewHTTPError(http.StatusBadRequest, "Invalid limit: "+value)
+		}
+		if limit > MaxLogLimit {
+			limit = MaxLogLimit
+		}
+		filter.Limit = limit
+	}
+	if value := c.QueryParam("offset"); value != "" {
+		offset, err := strconv.Atoi(value)
+		if err != nil || offset < 0 {
+			return filter, echo.NewHTTPError(http.StatusBadRequest, "Invalid offset: "+value)
+		}
+		filter.Offset = offset
+	}
+	return filter, nil
+}
+
+// DBLogs searches the log database, newest first: GET
+// /api/logs/db?level=warning,error&logger=goodoo.http&dbname=...&from=...&to=...&q=...&limit=80&offset=0
+// The logger filter matches the logger and its children.
+func (h *LogsHandler) DBLogs(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	filter, err := parseLogFilter(c)
+	if err != nil {
+		return err
+	}
+
+	logs, total, err := models.SearchLogs(req.GetDB(), filter)
+	if err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to search logs: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to search logs")
+	}
+
+	records := make([]logRecord, len(logs))
+	for i, log := range logs {
+		records[i] = logRecord{
+			ID:         log.ID,
+			CreateDate: log.CreateDate,
+			Type:       log.Type,
+			DBName:     log.DBName,
+			Name:       log.Name,
+			Level:      log.Level,
+			Message:    log.Message,
+			Path:       log.Path,
+			Line:       log.Line,
+			Func:       log.Func,
+		}
+		if log.Metadata != nil {
+			records[i].Metadata = json.RawMessage(*log.Metadata)
+		}
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"logs":    records,
+		"total":   total,
+		"limit":   filter.Limit,
+		"offset":  filter.Offset,
+		"dropped": logging.DroppedRecords(req.GetDBName()),
+	})
+}
+
+// Live log streams
+const (
+	DefaultLogReplay = 50
+	// logStreamHeartbeat keeps proxies from closing idle streams
+	logStreamHeartbeat = 15 * time.Second
+)
+
+// streamRecord is a record pushed by the live log stream
+type streamRecord struct {
+	Time      time.Time `json:"time"`
+	Level     string    `json:"level"`
+	Logger    string    `json:"logger"`
+	DBName    string    `json:"dbname,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	Message   string    `json:"message"`
+	Path      string    `json:"path,omitempty"`
+	Line      int       `json:"line,omitempty"`
+}
+
+// newStreamRecord converts a log record for the live log stream
+func newStreamRecord(record *logging.LogRecord) streamRecord {
+	requestID, _ := record.Metadata["request_id"].(string)
+	return streamRecord{
+		Time:      record.Timestamp,
+		Level:     record.Level.String(),
+		Logger:    record.Logger,
+		DBName:    record.DBName,
+		RequestID: requestID,
+		Message:   record.Message,
+		Path:      record.Pathname,
+		Line:      record.LineNo,
+	}
+}
+
+// parseTapFilter reads the filters of the live log stream
+func parseTapFilter(c echo.Context) (logging.TapFilter, error) {
+	filter := logging.TapFilter{
+		Logger:    c.QueryParam("logger"),
+		DBName:    c.QueryParam("dbname"),
+		RequestID: c.QueryParam("request_id"),
+		Contains:  c.QueryParam("q"),
+	}
+	if level := c.QueryParam("level"); level != "" {
+		if !logging.IsValidLogLevel(level) {
+			return filter, echo.NewHTTPError(http.StatusBadRequest, "Invalid level: "+level)
+		}
+		filter.MinLevel = logging.ParseLogLevelString(level)
+	}
+	return filter, nil
+}
+
+// Stream pushes the log records of the server as they are written, as
+// server-sent "log" events: GET
+// /api/logs/stream?level=warning&logger=goodoo.http&dbname=...&request_id=...&q=...&replay=50
+// The filters apply on the server; level is the minimum level. The last
+// ?replay= matching records of the ring buffer are sent first. Records the
+// client is too slow to take are dropped and announced by a "dropped"
+// event. The stream ends with an "end" event after
+// GOODOO_LOG_STREAM_MAX_MINUTES, or with "goaway" when the server closes
+// it; at most GOODOO_LOG_STREAM_MAX_CONNECTIONS streams are attached at
+// once.
+func (h *LogsHandler) Stream(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	filter, err := parseTapFilter(c)
+	if err != nil {
+		return err
+	}
+	replay := DefaultLogReplay
+	if value := c.QueryParam("replay"); value != "" {
+		replay, err = strconv.Atoi(value)
+		if err != nil || replay < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid replay: "+value)
+		}
+		replay = min(replay, logging.RecentRecords)
+	}
+
+	stream, err := openEventStream(c, connections.TypeLogs, "logs")
+	if stream == nil {
+		return err
+	}
+	defer stream.close()
+
+	tap := logging.DefaultTap()
+	subscription, err := tap.Subscribe(filter)
+	if errors.Is(err, logging.ErrTapFull) {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "Too many log streams, try again later")
+	}
+	if err != nil {
+		return err
+	}
+	defer subscription.Close()
+	req.Logger.InfoCtx(req.Context, "User %s attached a log stream (%d attached)", req.GetLogin(), tap.Subscribers())
+
+	// Records logged between Subscribe and the replay may be sent twice
+	if replay > 0 {
+		for _, record := range tap.Recent(filter, replay) {
+			if err := stream.send("log", newStreamRecord(record)); err != nil {
+				return nil
+			}
+		}
+	}
+
+	maxDuration := time.Duration(logging.DefaultLogConfig().StreamMaxMinutes) * time.Minute
+	if maxDuration <= 0 {
+		maxDuration = 30 * time.Minute
+	}
+	deadline := time.NewTimer(maxDuration)
+	defer deadline.Stop()
+	heartbeat := time.NewTicker(logStreamHeartbeat)
+	defer heartbeat.Stop()
+	var dropped uint64
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case <-deadline.C:
+			stream.send("end", map[string]string{"reason": "max_duration"})
+			return nil
+		case <-stream.closing():
+			stream.goAway()
+			return nil
+		case record := <-subscription.C:
+			if err := stream.send("log", newStreamRecord(record)); err != nil {
+				return nil
+			}
+		case <-heartbeat.C:
+			if count := subscription.Dropped(); count != dropped {
+				dropped = count
+				if err := stream.send("dropped", map[string]uint64{"dropped": dropped}); err != nil {
+					return nil
+				}
+			}
+			if err := stream.keepAlive(); err != nil {
+				return nil
+			}
+		}
+	}
+}
+
+// RegisterLogRoutes mounts the log query endpoints under /api/logs
+func RegisterLogRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewLogsHandler(config)
+
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		{Method: "GET", Path: "/api/logs/db", Handler: handler.DBLogs, Auth: true, DB: true, Permission: goodooHttp.PermissionLogsRead},
+		{Method: "GET", Path: "/api/logs/stream", Handler: handler.Stream, Auth: true, DB: true, Permission: goodooHttp.PermissionLogsRead},
+	})
+}
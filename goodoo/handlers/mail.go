@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	goodooHttp "goodoo/http"
+	"goodoo/mail"
+)
+
+// MailHandler handles outgoing mail administration
+type MailHandler struct {
+	Config *goodooHttp.RequestConfig
+}
+
+// NewMailHandler creates a new mail handler
+func NewMailHandler(config *goodooHttp.RequestConfig) *MailHandler {
+	return &MailHandler{Config: config}
+}
+
+// TestSend sends a test email directly through the configured transport,
+// bypassing the queue so configuration errors are reported immediately
+func (h *MailHandler) TestSend(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+
+	to := req.GetStringParam("to")
+	if to == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Recipient (to) required")
+	}
+
+	// The server is named by its configured URL, never by the Host header
+	base, _ := webBaseURL(req.GetDBName())
+	msg, err := mail.RenderTemplate(c.Echo().Renderer, "mail_test", req.GetStringParam("lang"), map[string]interface{}{
+		"Login": req.GetLogin(),
+		"URL":   base,
+	})
+	if err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to render test email: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	msg.From = mail.DefaultFrom()
+	msg.To = []string{to}
+
+	if err := mail.Default().Send(req.Context, msg); err != nil {
+		req.Logger.WarningCtx(req.Context, "Test email to %s failed: %v", to, err)
+		return c.JSON(http.StatusBadGateway, map[string]interface{}{"success": false, "error": err.Error()})
+	}
+
+	req.Logger.InfoCtx(req.Context, "Test email sent to %s by %s", to, req.GetLogin())
+	return c.JSON(http.StatusOK, map[string]interface{}{"success": true})
+}
+
+// RegisterMailRoutes mounts the mail endpoints under /api/mail, which
+// require the mail.test permission
+func RegisterMailRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewMailHandler(config)
+
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		{Method: "POST", Path: "/api/mail/test", Handler: handler.TestSend, Auth: true, DB: true, Permission: goodooHttp.PermissionMailTest},
+	})
+}
@@ -0,0 +1,440 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"goodoo/crypto"
+	goodooHttp "goodoo/http"
+	"goodoo/mailgate"
+	"goodoo/models"
+	"goodoo/webhook"
+	"gorm.io/gorm"
+)
+
+// MailGatewayHandler receives the messages posted by the inbound webhooks
+// of mail providers, and lets administrators manage the mail aliases and
+// review the messages that failed
+type MailGatewayHandler struct {
+	Config *goodooHttp.RequestConfig
+}
+
+// NewMailGatewayHandler creates a new mail gateway handler
+func NewMailGatewayHandler(config *goodooHttp.RequestConfig) *MailGatewayHandler {
+	return &MailGatewayHandler{Config: config}
+}
+
+// MailAliasRequest is the body of alias creation and update requests; nil
+// fields are left unchanged
+type MailAliasRequest struct {
+	Name         *string `json:"name"`
+	Email        *string `json:"email"`
+	Handler      *string `json:"handler"`
+	Model        *string `json:"model"`
+	UserID       *uint   `json:"user_id"`
+	Active       *bool   `json:"active"`
+	IMAPEnabled  *bool   `json:"imap_enabled"`
+	IMAPHost     *string `json:"imap_host"`
+	IMAPPort     *int    `json:"imap_port"`
+	IMAPTLS      *bool   `json:"imap_tls"`
+	IMAPUser     *string `json:"imap_user"`
+	IMAPPassword *string `json:"imap_password"`
+	IMAPMailbox  *string `json:"imap_mailbox"`
+	PollMinutes  *int    `json:"poll_minutes"`
+}
+
+// apply copies the set fields onto the alias
+func (r *MailAliasRequest) apply(alias *models.MailAlias) {
+	if r.Name != nil {
+		alias.Name = strings.TrimSpace(*r.Name)
+	}
+	if r.Email != nil {
+		alias.Email = strings.TrimSpace(*r.Email)
+	}
+	if r.Handler != nil {
+		alias.Handler = *r.Handler
+	}
+	if r.Model != nil {
+		alias.Model = *r.Model
+	}
+	if r.UserID != nil {
+		alias.UserID = *r.UserID
+	}
+	if r.Active != nil {
+		alias.Active = *r.Active
+	}
+	if r.IMAPEnabled != nil {
+		alias.IMAPEnabled = *r.IMAPEnabled
+	}
+	if r.IMAPHost != nil {
+		alias.IMAPHost = strings.TrimSpace(*r.IMAPHost)
+	}
+	if r.IMAPPort != nil {
+		alias.IMAPPort = *r.IMAPPort
+	}
+	if r.IMAPTLS != nil {
+		alias.IMAPTLS = *r.IMAPTLS
+	}
+	if r.IMAPUser != nil {
+		alias.IMAPUser = *r.IMAPUser
+	}
+	if r.IMAPPassword != nil && *r.IMAPPassword != "" {
+		alias.IMAPPassword = crypto.EncryptedString(*r.IMAPPassword)
+	}
+	if r.IMAPMailbox != nil {
+		alias.IMAPMailbox = *r.IMAPMailbox
+	}
+	if r.PollMinutes != nil {
+		alias.PollMinutes = *r.PollMinutes
+	}
+}
+
+// loadMailAlias fetches the alias named by the :id route parameter
+func loadMailAlias(c echo.Context, db *gorm.DB) (*models.MailAlias, error) {
+	id, err := parseRecordID(c)
+	if err != nil {
+		return nil, err
+	}
+	var alias models.MailAlias
+	if err := db.First(&alias, id).Error; err != nil {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Mail alias not found")
+	}
+	return &alias, nil
+}
+
+// loadMailInbound fetches the inbound message named by the :id route
+// parameter, with its raw message when withRaw is set
+func loadMailInbound(c echo.Context, db *gorm.DB, withRaw bool) (*models.MailInbound, error) {
+	id, err := parseRecordID(c)
+	if err != nil {
+		return nil, err
+	}
+	query := db
+	if !withRaw {
+		query = query.Omit("raw")
+	}
+	var inbound models.MailInbound
+	if err := query.First(&inbound, id).Error; err != nil {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Inbound message not found")
+	}
+	return &inbound, nil
+}
+
+// Receive stores and processes a message posted by the inbound webhook of
+// a mail provider for the alias :alias. The raw message is the "email"
+// field of a SendGrid post, the "body-mime" field of a Mailgun one, or the
+// request body. A message the handler fails on is accepted all the same:
+// it waits in the review queue. An unknown or inactive alias is answered
+// as a wrong token, so that the endpoint does not reveal which aliases
+// exist.
+func (h *MailGatewayHandler) Receive(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+
+	var alias models.MailAlias
+	err := db.Where("name = ? AND active = ?", c.Param("alias"), true).First(&alias).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		req.Logger.ErrorCtx(req.Context, "Failed to load mail alias %s: %v", c.Param("alias"), err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to load the mail alias"})
+	}
+	token := c.Request().Header.Get(webhook.TokenHeader)
+	if token == "" {
+		token = c.QueryParam("token")
+	}
+	if alias.WebhookToken == "" || !hmac.Equal([]byte(token), []byte(alias.WebhookToken)) {
+		req.Logger.WarningCtx(req.Context, "Rejected message for mail alias %s from %s", c.Param("alias"), req.RemoteAddr)
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid token"})
+	}
+
+	raw, err := postedMessage(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	if len(raw) > mailgate.MaxMessageSize {
+		return c.JSON(http.StatusRequestEntityTooLarge, map[string]string{"error": "Message too large"})
+	}
+
+	inbound, err := mailgate.Receive(req.Context, db, req.GetDBName(), &alias, raw, models.MailSourceWebhook)
+	switch {
+	case errors.Is(err, mailgate.ErrDuplicate):
+		return c.JSON(http.StatusOK, map[string]interface{}{"duplicate": true})
+	case inbound == nil:
+		req.Logger.ErrorCtx(req.Context, "Failed to store message for mail alias %s: %v", alias.Name, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"id": inbound.ID, "state": inbound.State})
+}
+
+// postedMessage returns the raw message of a webhook post
+func postedMessage(c echo.Context) ([]byte, error) {
+	request := c.Request()
+	// Form posts carry the message besides other fields and the encoding
+	request.Body = http.MaxBytesReader(c.Response(), request.Body, 2*mailgate.MaxMessageSize)
+	if strings.HasPrefix(request.Header.Get(echo.HeaderContentType), echo.MIMEMultipartForm) ||
+		strings.HasPrefix(request.Header.Get(echo.HeaderContentType), echo.MIMEApplicationForm) {
+		for _, field := range []string{"email", "body-mime"} {
+			if value := c.FormValue(field); value != "" {
+				return []byte(value), nil
+			}
+		}
+		return nil, errors.New(`the form has no "email" or "body-mime" field`)
+	}
+	raw, err := io.ReadAll(request.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the message: %w", err)
+	}
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return nil, errors.New("empty message")
+	}
+	return raw, nil
+}
+
+// ListAliases returns the aliases and the names of the registered handlers
+func (h *MailGatewayHandler) ListAliases(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	var aliases []models.MailAlias
+	if err := req.GetDB().Order("name").Find(&aliases).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"aliases":  aliases,
+		"handlers": mailgate.Handlers(),
+	})
+}
+
+// CreateAlias adds an alias creating records as the creating admin unless
+// user_id is given. Its webhook token is generated and returned only in
+// this response.
+func (h *MailGatewayHandler) CreateAlias(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+
+	var body MailAliasRequest
+	if err := c.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request format: "+err.Error())
+	}
+	alias := &models.MailAlias{
+		Handler:     mailgate.PartnerNoteHandler,
+		UserID:      uint(req.GetUserID()),
+		Active:      true,
+		IMAPPort:    993,
+		IMAPTLS:     true,
+		IMAPMailbox: "INBOX",
+		PollMinutes: 5,
+	}
+	body.apply(alias)
+	if err := mailgate.ValidateAlias(alias); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	token, err := webhook.GenerateSecret()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	alias.WebhookToken = crypto.EncryptedString(token)
+
+	// Select all columns so false booleans are not replaced by column defaults
+	if err := db.Select("*").Omit("id").Create(alias).Error; err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to create mail alias: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	req.Logger.InfoCtx(req.Context, "Mail alias %s (%d) created by %s", alias.Name, alias.ID, req.GetLogin())
+	return c.JSON(http.StatusCreated, map[string]interface{}{
+		"alias":         alias,
+		"webhook_token": token,
+	})
+}
+
+// UpdateAlias modifies an alias; rotate_token=true replaces its webhook
+// token, returned in the response
+func (h *MailGatewayHandler) UpdateAlias(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	alias, err := loadMailAlias(c, db)
+	if err != nil {
+		return err
+	}
+
+	var body MailAliasRequest
+	if err := c.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request format: "+err.Error())
+	}
+	body.apply(alias)
+	if err := mailgate.ValidateAlias(alias); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	response := map[string]interface{}{"alias": alias}
+	if c.QueryParam("rotate_token") == "true" {
+		token, err := webhook.GenerateSecret()
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		}
+		alias.WebhookToken = crypto.EncryptedString(token)
+		response["webhook_token"] = token
+	}
+
+	if err := db.Save(alias).Error; err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to update mail alias %d: %v", alias.ID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	req.Logger.InfoCtx(req.Context, "Mail alias %s (%d) updated by %s", alias.Name, alias.ID, req.GetLogin())
+	return c.JSON(http.StatusOK, response)
+}
+
+// DeleteAlias removes an alias; its received messages are kept
+func (h *MailGatewayHandler) DeleteAlias(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	alias, err := loadMailAlias(c, db)
+	if err != nil {
+		return err
+	}
+	if err := db.Delete(alias).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	req.Logger.InfoCtx(req.Context, "Mail alias %s (%d) deleted by %s", alias.Name, alias.ID, req.GetLogin())
+	return c.NoContent(http.StatusNoContent)
+}
+
+// PollAlias polls the IMAP mailbox of an alias now, enabled or not, to
+// check its settings
+func (h *MailGatewayHandler) PollAlias(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	alias, err := loadMailAlias(c, db)
+	if err != nil {
+		return err
+	}
+	if alias.IMAPHost == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "The alias has no IMAP mailbox"})
+	}
+	received, err := mailgate.Poll(req.Context, db, req.GetDBName(), alias)
+	if err != nil {
+		req.Logger.WarningCtx(req.Context, "Polling the mailbox of mail alias %s failed: %v", alias.Name, err)
+		return c.JSON(http.StatusBadGateway, map[string]interface{}{"received": received, "error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"received": received})
+}
+
+// ListInbound returns the received messages, newest first, without their
+// raw message: the failed ones (the review queue) unless ?state= names
+// another state. ?alias_id= keeps those of one alias.
+func (h *MailGatewayHandler) ListInbound(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	state := c.QueryParam("state")
+	if state == "" {
+		state = models.MailInboundFailed
+	}
+	query := req.GetDB().Omit("raw").Where("state = ?", state)
+	if value := c.QueryParam("alias_id"); value != "" {
+		id, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid alias_id: " + value})
+		}
+		query = query.Where("alias_id = ?", id)
+	}
+	limit, _ := strconv.Atoi(c.QueryParam("limit"))
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	offset, _ := strconv.Atoi(c.QueryParam("offset"))
+	if offset < 0 {
+		offset = 0
+	}
+
+	var total int64
+	if err := query.Model(&models.MailInbound{}).Count(&total).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	var messages []models.MailInbound
+	if err := query.Order("received_at DESC, id DESC").Offset(offset).Limit(limit).Find(&messages).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"messages": messages, "total": total})
+}
+
+// RawInbound downloads the raw message of a message still holding it
+func (h *MailGatewayHandler) RawInbound(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	inbound, err := loadMailInbound(c, req.GetDB(), true)
+	if err != nil {
+		return err
+	}
+	if inbound.Raw == nil {
+		return c.JSON(http.StatusGone, map[string]string{"error": "The raw message was dropped once processed"})
+	}
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=\"message-%d.eml\"", inbound.ID))
+	return c.Blob(http.StatusOK, "message/rfc822", inbound.Raw)
+}
+
+// RetryInbound processes a failed or dismissed message again with the
+// current settings of its alias
+func (h *MailGatewayHandler) RetryInbound(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	inbound, err := loadMailInbound(c, db, true)
+	if err != nil {
+		return err
+	}
+	if inbound.State != models.MailInboundFailed && inbound.State != models.MailInboundDismissed || inbound.Raw == nil {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Only failed messages can be retried", "state": inbound.State})
+	}
+	var alias models.MailAlias
+	if err := db.First(&alias, inbound.AliasID).Error; err != nil {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "The alias of the message was deleted"})
+	}
+
+	if err := mailgate.Process(req.Context, db, req.GetDBName(), &alias, inbound); err != nil {
+		req.Logger.WarningCtx(req.Context, "Retry of inbound message %d by %s failed: %v", inbound.ID, req.GetLogin(), err)
+	} else {
+		req.Logger.InfoCtx(req.Context, "Inbound message %d retried by %s", inbound.ID, req.GetLogin())
+	}
+	return c.JSON(http.StatusOK, inbound)
+}
+
+// DismissInbound takes a failed message out of the review queue, keeping
+// its raw message
+func (h *MailGatewayHandler) DismissInbound(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	inbound, err := loadMailInbound(c, db, false)
+	if err != nil {
+		return err
+	}
+	if inbound.State != models.MailInboundFailed {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Only failed messages can be dismissed", "state": inbound.State})
+	}
+	if err := db.Model(inbound).Update("state", models.MailInboundDismissed).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	req.Logger.InfoCtx(req.Context, "Inbound message %d dismissed by %s", inbound.ID, req.GetLogin())
+	return c.JSON(http.StatusOK, inbound)
+}
+
+// RegisterMailGatewayRoutes mounts the public webhook of the mail aliases
+// and the endpoints under /api/mail, which require the mail_gateway.manage
+// permission
+func RegisterMailGatewayRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewMailGatewayHandler(config)
+	manage := goodooHttp.PermissionMailGatewayManage
+
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		{Method: "POST", Path: "/hooks/mail/:alias", Handler: handler.Receive, DB: true, RateLimit: "webhook", CSRFExempt: true},
+		{Method: "GET", Path: "/api/mail/aliases", Handler: handler.ListAliases, Auth: true, DB: true, Permission: manage},
+		{Method: "POST", Path: "/api/mail/aliases", Handler: handler.CreateAlias, Auth: true, DB: true, Permission: manage},
+		{Method: "PUT", Path: "/api/mail/aliases/:id", Handler: handler.UpdateAlias, Auth: true, DB: true, Permission: manage},
+		{Method: "DELETE", Path: "/api/mail/aliases/:id", Handler: handler.DeleteAlias, Auth: true, DB: true, Permission: manage},
+		{Method: "POST", Path: "/api/mail/aliases/:id/poll", Handler: handler.PollAlias, Auth: true, DB: true, Permission: manage},
+		{Method: "GET", Path: "/api/mail/inbound", Handler: handler.ListInbound, Auth: true, DB: true, Permission: manage},
+		{Method: "GET", Path: "/api/mail/inbound/:id/raw", Handler: handler.RawInbound, Auth: true, DB: true, Permission: manage},
+		{Method: "POST", Path: "/api/mail/inbound/:id/retry", Handler: handler.RetryInbound, Auth: true, DB: true, Permission: manage},
+		{Method: "POST", Path: "/api/mail/inbound/:id/dismiss", Handler: handler.DismissInbound, Auth: true, DB: true, Permission: manage},
+	})
+}
@@ -0,0 +1,214 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"goodoo/database"
+	goodooHttp "goodoo/http"
+	"goodoo/models"
+	"goodoo/operations"
+)
+
+// MaintenanceHandler runs maintenance actions (VACUUM, ANALYZE, REINDEX)
+// on the database of the session and reports where they are needed
+type MaintenanceHandler struct {
+	Config *goodooHttp.RequestConfig
+}
+
+// NewMaintenanceHandler creates a new maintenance handler
+func NewMaintenanceHandler(config *goodooHttp.RequestConfig) *MaintenanceHandler {
+	return &MaintenanceHandler{Config: config}
+}
+
+// maintenanceRequest is the body of POST /api/database/maintenance
+type maintenanceRequest struct {
+	Action string `json:"action"`
+	// Tables restricts the action; every table of the database by default
+	Tables []string `json:"tables"`
+	// Database, when given, must be the database of the session
+	Database string `json:"database"`
+}
+
+// vacuumFullAllowed reports whether GOODOO_MAINTENANCE_ALLOW_VACUUM_FULL
+// enables VACUUM FULL, which locks each table while it is rewritten
+func vacuumFullAllowed() bool {
+	allowed, _ := strconv.ParseBool(os.Getenv("GOODOO_MAINTENANCE_ALLOW_VACUUM_FULL"))
+	return allowed
+}
+
+// Run starts a maintenance action on tables of the session's database as
+// an operation, one table at a time, and answers with its id. A table
+// already being maintained is reported as a failure of the operation. The
+// outcome is written to the audit log.
+func (h *MaintenanceHandler) Run(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	dbName := req.GetDBName()
+
+	var body maintenanceRequest
+	if err := c.Bind(&body); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+	}
+	if body.Database != "" && body.Database != dbName {
+		req.Logger.WarningCtx(req.Context, "Refused maintenance of %s from a session bound to %s", body.Database, dbName)
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "Maintenance is only allowed on the database of the session"})
+	}
+	if !database.ValidMaintenanceAction(body.Action) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("Invalid action %q", body.Action)})
+	}
+	if body.Action == database.MaintenanceVacuumFull && !vacuumFullAllowed() {
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "VACUUM FULL is disabled on this server"})
+	}
+
+	stats, err := database.TableStats(dbName)
+	if err != nil {
+		if database.IsPermissionError(err) {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "Table statistics are not readable by the database role"})
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to list tables")
+	}
+	tables, unknown := maintenanceTables(stats, body.Tables)
+	if len(unknown) > 0 {
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"error":  "Unknown tables: " + strings.Join(unknown, ", "),
+			"tables": unknown,
+		})
+	}
+	connection, err := database.GetDatabaseConnection(dbName)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database not available")
+	}
+
+	uid := req.GetUserID()
+	op := operations.Start("maintenance", "", dbName, uid, len(tables), func(ctx context.Context, op *operations.Operation) error {
+		start := time.Now()
+		opts := database.DefaultMaintenanceOptions()
+		for i, table := range tables {
+			if op.Cancelled() {
+				break
+			}
+			op.BeginBatch(i+1, len(tables))
+			if err := connection.Maintain(ctx, body.Action, table.Schema, table.Name, opts); err != nil {
+				op.Progress(0, 1, fmt.Errorf("%s: %w", table.Name, err))
+			} else {
+				op.Progress(1, 0, nil)
+			}
+		}
+		return auditMaintenance(dbName, uint(uid), body.Action, tables, op, time.Since(start))
+	})
+
+	req.Logger.InfoCtx(req.Context, "User %d started %s of %d table(s) of %s (%s)", uid, body.Action, len(tables), dbName, op.Status().ID)
+	return c.JSON(http.StatusAccepted, map[string]interface{}{
+		"operation_id": op.Status().ID,
+		"action":       body.Action,
+		"total":        len(tables),
+	})
+}
+
+// maintenanceTables returns the tables named by names, all of them when
+// names is empty, and the names that are not tables of the database
+func maintenanceTables(stats []database.TableStat, names []string) ([]database.TableStat, []string) {
+	if len(names) == 0 {
+		return stats, nil
+	}
+	byName := make(map[string]database.TableStat, len(stats))
+	for _, table := range stats {
+		byName[table.Name] = table
+		byName[table.Schema+"."+table.Name] = table
+	}
+	var tables []database.TableStat
+	var unknown []string
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		table, ok := byName[name]
+		if !ok {
+			unknown = append(unknown, name)
+			continue
+		}
+		if key := table.Schema + "." + table.Name; !seen[key] {
+			seen[key] = true
+			tables = append(tables, table)
+		}
+	}
+	return tables, unknown
+}
+
+// auditMaintenance records who ran a maintenance action, on which tables,
+// how it ended and how long it took
+func auditMaintenance(dbName string, uid uint, action string, tables []database.TableStat, op *operations.Operation, duration time.Duration) error {
+	db, err := database.GetDatabase(dbName)
+	if err != nil {
+		return err
+	}
+	names := make([]string, len(tables))
+	for i, table := range tables {
+		names[i] = table.Name
+	}
+	status := op.Status()
+	state := operations.StateDone
+	if op.Cancelled() {
+		state = operations.StateCancelled
+	}
+	severity := models.SeveritySuccess
+	switch {
+	case state == operations.StateCancelled:
+		severity = models.SeverityWarning
+	case status.Failed > 0:
+		severity = models.SeverityError
+	}
+	return models.LogActivity(db, uid, models.Activity{
+		Type:     models.ActivityMaintenanceFinished,
+		Severity: severity,
+		Model:    "database",
+		Params: map[string]interface{}{
+			"operation_id": status.ID,
+			"action":       action,
+			"tables":       names,
+			"state":        state,
+			"processed":    status.Processed,
+			"failed":       status.Failed,
+			"errors":       status.Errors,
+			"duration_ms":  duration.Milliseconds(),
+		},
+	})
+}
+
+// Bloat returns the most bloated tables and btree indexes of the session's
+// database (?limit=, 20 by default, at most 100), estimated from the
+// planner statistics
+func (h *MaintenanceHandler) Bloat(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	limit := 20
+	if l, err := strconv.Atoi(c.QueryParam("limit")); err == nil && l > 0 && l <= 100 {
+		limit = l
+	}
+
+	tables, indexes, err := database.BloatEstimates(req.GetDBName(), limit)
+	if err != nil {
+		if database.IsPermissionError(err) {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "Planner statistics are not readable by the database role"})
+		}
+		req.Logger.ErrorCtx(req.Context, "Failed to estimate bloat: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to estimate bloat"})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"tables":  tables,
+		"indexes": indexes,
+	})
+}
+
+// RegisterMaintenanceRoutes mounts the maintenance endpoints, reserved to the holders of db.manage
+func RegisterMaintenanceRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewMaintenanceHandler(config)
+
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		{Method: "POST", Path: "/api/database/maintenance", Handler: handler.Run, Auth: true, DB: true, Permission: goodooHttp.PermissionDBManage},
+		{Method: "GET", Path: "/api/database/bloat", Handler: handler.Bloat, Auth: true, DB: true, Permission: goodooHttp.PermissionDBManage},
+	})
+}
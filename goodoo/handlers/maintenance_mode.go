@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	goodooHttp "goodoo/http"
+	"goodoo/maintenance"
+	"goodoo/models"
+)
+
+// maxDrain bounds how long entering maintenance may wait for the work in
+// flight
+const maxDrain = 10 * time.Minute
+
+// MaintenanceModeHandler switches the maintenance mode of the session's
+// database (administrators only)
+type MaintenanceModeHandler struct {
+	Config *goodooHttp.RequestConfig
+}
+
+// NewMaintenanceModeHandler creates a new maintenance mode handler
+func NewMaintenanceModeHandler(config *goodooHttp.RequestConfig) *MaintenanceModeHandler {
+	return &MaintenanceModeHandler{Config: config}
+}
+
+// maintenanceModeRequest is the body of POST /api/maintenance
+type maintenanceModeRequest struct {
+	Enabled bool   `json:"enabled"`
+	Message string `json:"message"`
+	// Until, or Duration from now ("2h"), ends maintenance by itself
+	Until    *time.Time `json:"until"`
+	Duration string     `json:"duration"`
+	// AllowReads defaults to GOODOO_MAINTENANCE_ALLOW_READS
+	AllowReads *bool `json:"allow_reads"`
+	// Drain waits up to this many seconds for the mutating requests in
+	// flight and the running operations before answering
+	Drain int `json:"drain"`
+	// CancelOperations cancels the running operations when draining
+	// instead of letting them finish
+	CancelOperations bool `json:"cancel_operations"`
+}
+
+// maintenanceResponse returns the state of a database with what still runs
+// in it
+func maintenanceResponse(now time.Time, state maintenance.State, readiness maintenance.Readiness) map[string]interface{} {
+	return map[string]interface{}{
+		"maintenance": state,
+		"active":      state.Active(now),
+		"ready":       readiness.Ready,
+		"in_flight":   readiness.InFlight,
+		"operations":  readiness.Operations,
+		"cancelled":   readiness.Cancelled,
+	}
+}
+
+// Get returns the maintenance state and whether the database is ready for
+// the work: no mutating request in flight on this instance and no running
+// operation
+func (h *MaintenanceModeHandler) Get(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	dbName := req.GetDBName()
+	return c.JSON(http.StatusOK, maintenanceResponse(req.Now(), maintenance.Get(dbName), maintenance.Check(dbName)))
+}
+
+// Set enables or disables the maintenance mode of the session's database.
+// Enabling with "drain" waits for the work in flight before answering;
+// "ready" tells whether it all finished in time. The running operations
+// are left to finish unless "cancel_operations" is set; they can also be
+// cancelled one by one with /api/operations/:id/cancel.
+func (h *MaintenanceModeHandler) Set(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	dbName := req.GetDBName()
+
+	var body maintenanceModeRequest
+	if err := c.Bind(&body); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+	}
+	now := req.Now()
+	state := maintenance.State{AllowReads: maintenance.CurrentConfig().AllowReads}
+	if body.AllowReads != nil {
+		state.AllowReads = *body.AllowReads
+	}
+	if body.Enabled {
+		if body.Drain < 0 || time.Duration(body.Drain)*time.Second > maxDrain {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "drain must be between 0 and 600 seconds"})
+		}
+		state.Enabled = true
+		state.Message = body.Message
+		state.Since = now
+		state.By = req.GetLogin()
+		state.Until = body.Until
+		if body.Duration != "" {
+			duration, err := time.ParseDuration(body.Duration)
+			if err != nil || duration <= 0 {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "duration must be a positive duration such as 2h"})
+			}
+			until := now.Add(duration)
+			state.Until = &until
+		}
+		if state.Until != nil && !state.Until.After(now) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "until must be in the future"})
+		}
+	}
+
+	db := req.GetDB()
+	uid := uint(req.GetUserID())
+	if err := maintenance.Set(db, dbName, uid, state); err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to set the maintenance mode of %s: %v", dbName, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to set the maintenance mode"})
+	}
+	activity := models.Activity{Type: models.ActivityMaintenanceDisabled, Params: map[string]interface{}{"login": req.GetLogin()}}
+	if state.Enabled {
+		activity = models.Activity{Type: models.ActivityMaintenanceEnabled, Severity: models.SeverityWarning, Params: map[string]interface{}{
+			"login":       req.GetLogin(),
+			"message":     state.Message,
+			"until":       state.Until,
+			"allow_reads": state.AllowReads,
+		}}
+	}
+	if err := models.LogActivity(db, uid, activity); err != nil {
+		req.Logger.WarningCtx(req.Context, "Failed to record the maintenance change: %v", err)
+	}
+
+	if !state.Enabled {
+		req.Logger.InfoCtx(req.Context, "Maintenance of %s disabled by %s", dbName, req.GetLogin())
+		return c.JSON(http.StatusOK, maintenanceResponse(now, state, maintenance.Check(dbName)))
+	}
+	req.Logger.InfoCtx(req.Context, "Maintenance of %s enabled by %s", dbName, req.GetLogin())
+	readiness := maintenance.Check(dbName)
+	if body.Drain > 0 || body.CancelOperations {
+		readiness = maintenance.Drain(c.Request().Context(), dbName, maintenance.DrainOptions{
+			Timeout:          time.Duration(body.Drain) * time.Second,
+			CancelOperations: body.CancelOperations,
+		})
+		req.Logger.InfoCtx(req.Context, "Maintenance of %s drained: ready %t, %d request(s) in flight, %d operation(s) running",
+			dbName, readiness.Ready, readiness.InFlight, len(readiness.Operations))
+	}
+	return c.JSON(http.StatusOK, maintenanceResponse(now, state, readiness))
+}
+
+// RegisterMaintenanceModeRoutes mounts the maintenance mode endpoints under
+// /api/maintenance, which require the maintenance.manage permission
+func RegisterMaintenanceModeRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewMaintenanceModeHandler(config)
+	manage := goodooHttp.PermissionMaintenanceManage
+
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		{Method: "GET", Path: "/api/maintenance", Handler: handler.Get, Auth: true, DB: true, Permission: manage},
+		{Method: "POST", Path: "/api/maintenance", Handler: handler.Set, Auth: true, DB: true, Permission: manage},
+	})
+}
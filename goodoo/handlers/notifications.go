@@ -0,0 +1,254 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"goodoo/connections"
+	goodooHttp "goodoo/http"
+	"goodoo/models"
+	"goodoo/notification"
+	"gorm.io/gorm"
+)
+
+// notificationKeepAlive is how often the unread stream sends a comment so
+// proxies keep the connection open
+const notificationKeepAlive = 30 * time.Second
+
+// NotificationHandler serves the notification center of the current user
+type NotificationHandler struct {
+	Config *goodooHttp.RequestConfig
+}
+
+// NewNotificationHandler creates a new notification handler
+func NewNotificationHandler(config *goodooHttp.RequestConfig) *NotificationHandler {
+	return &NotificationHandler{Config: config}
+}
+
+// NotificationResponse is a notification with its decoded payload
+type NotificationResponse struct {
+	models.Notification
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// List returns the notifications of the user, newest first: ?unread=1
+// keeps the unread ones, ?offset= and ?limit= (50, at most 200) page them
+func (h *NotificationHandler) List(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	if db == nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database not available")
+	}
+
+	unreadOnly, _ := strconv.ParseBool(c.QueryParam("unread"))
+	offset, _ := strconv.Atoi(c.QueryParam("offset"))
+	if offset < 0 {
+		offset = 0
+	}
+	limit := 50
+	if l, err := strconv.Atoi(c.QueryParam("limit")); err == nil && l > 0 && l <= 200 {
+		limit = l
+	}
+
+	uid := uint(req.GetUserID())
+	stored, total, err := notification.List(db, uid, unreadOnly, offset, limit)
+	if err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to list notifications: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to load notifications")
+	}
+	unread, err := notification.UnreadCount(db, uid)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to count notifications")
+	}
+
+	list := make([]NotificationResponse, len(stored))
+	for i, n := range stored {
+		list[i] = NotificationResponse{Notification: n}
+		if n.Payload != nil {
+			list[i].Payload = json.RawMessage(*n.Payload)
+		}
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"notifications": list,
+		"total":         total,
+		"unread":        unread,
+	})
+}
+
+// MarkRead marks one notification of the user as read
+func (h *NotificationHandler) MarkRead(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil || id == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid notification ID")
+	}
+	return h.markRead(c, req, []uint{uint(id)})
+}
+
+// MarkAllRead marks every notification of the user as read
+func (h *NotificationHandler) MarkAllRead(c echo.Context) error {
+	return h.markRead(c, goodooHttp.MustGetGoodooRequest(c), nil)
+}
+
+// markRead marks notifications of the user as read and returns the new unread count
+func (h *NotificationHandler) markRead(c echo.Context, req *goodooHttp.Request, ids []uint) error {
+	db := req.GetDB()
+	if db == nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database not available")
+	}
+	uid := uint(req.GetUserID())
+	marked, err := notification.MarkRead(db, req.GetDBName(), uid, ids)
+	if err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to mark notifications read: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to update notifications")
+	}
+	unread, err := notification.UnreadCount(db, uid)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to count notifications")
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"marked": marked,
+		"unread": unread,
+	})
+}
+
+// preferencesResponse returns the channel of every notification category
+// for the user and the hour of the digests
+func (h *NotificationHandler) preferencesResponse(c echo.Context, req *goodooHttp.Request, db *gorm.DB) error {
+	dbName := req.GetDBName()
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"categories":  notification.Preferences(db, dbName, uint(req.GetUserID())),
+		"digest_hour": notification.DigestHour(dbName),
+	})
+}
+
+// GetPreferences returns the notification channels of the user by
+// category: the one applied, the database default, whether the user chose
+// it, and the channels allowed
+func (h *NotificationHandler) GetPreferences(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	if db == nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database not available")
+	}
+	return h.preferencesResponse(c, req, db)
+}
+
+// SetPreferences updates notification channels of the user,
+// {"channels": {"mention": "digest", "report": null}}; null resets a
+// category to the database default, and mandatory categories cannot be
+// turned off
+func (h *NotificationHandler) SetPreferences(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	if db == nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database not available")
+	}
+
+	var body struct {
+		Channels map[string]*string `json:"channels"`
+	}
+	if err := c.Bind(&body); err != nil || len(body.Channels) == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "channels are required"})
+	}
+	channels := make(map[string]string, len(body.Channels))
+	for category, channel := range body.Channels {
+		if channel == nil {
+			channels[category] = ""
+		} else if *channel == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "the channel of " + category + " is empty"})
+		} else {
+			channels[category] = *channel
+		}
+	}
+
+	uid := uint(req.GetUserID())
+	if err := notification.SetChannels(db, uid, channels); err != nil {
+		var prefErr *models.PreferenceError
+		if errors.As(err, &prefErr) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error(), "key": prefErr.Key})
+		}
+		req.Logger.ErrorCtx(req.Context, "Failed to save the notification channels of user %d: %v", uid, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	return h.preferencesResponse(c, req, db)
+}
+
+// Stream pushes the unread count of the user as server-sent "unread"
+// events: the current count first, then each change, until the client
+// disconnects or the server closes the stream with a "goaway" event
+func (h *NotificationHandler) Stream(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	if db == nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database not available")
+	}
+	uid := uint(req.GetUserID())
+	count, err := notification.UnreadCount(db, uid)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to count notifications")
+	}
+
+	stream, err := openEventStream(c, connections.TypeNotifications, notification.Channel)
+	if stream == nil {
+		return err
+	}
+	defer stream.close()
+
+	// Counts are absolute: when the client lags, only the latest matters,
+	// and a reconnecting client needs no replay
+	updates := make(chan notification.Unread, 1)
+	unsubscribe := notification.Subscribe(req.GetDBName(), uid, func(unread notification.Unread) {
+		select {
+		case <-updates:
+		default:
+		}
+		select {
+		case updates <- unread:
+		default:
+		}
+	})
+	defer unsubscribe()
+
+	if err := stream.send("unread", notification.Unread{UserID: uid, Count: count}); err != nil {
+		return nil
+	}
+
+	keepAlive := time.NewTicker(notificationKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case <-stream.closing():
+			stream.goAway()
+			return nil
+		case unread := <-updates:
+			if err := stream.send("unread", unread); err != nil {
+				return nil
+			}
+		case <-keepAlive.C:
+			if err := stream.keepAlive(); err != nil {
+				return nil
+			}
+		}
+	}
+}
+
+// RegisterNotificationRoutes mounts the notification center under /api/notifications
+func RegisterNotificationRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewNotificationHandler(config)
+
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		{Method: "GET", Path: "/api/notifications", Handler: handler.List, Auth: true, DB: true},
+		{Method: "GET", Path: "/api/notifications/stream", Handler: handler.Stream, Auth: true, DB: true},
+		{Method: "GET", Path: "/api/notifications/preferences", Handler: handler.GetPreferences, Auth: true, DB: true},
+		{Method: "PUT", Path: "/api/notifications/preferences", Handler: handler.SetPreferences, Auth: true, DB: true},
+		{Method: "POST", Path: "/api/notifications/:id/read", Handler: handler.MarkRead, Auth: true, DB: true},
+		{Method: "POST", Path: "/api/notifications/read_all", Handler: handler.MarkAllRead, Auth: true, DB: true},
+	})
+}
@@ -0,0 +1,370 @@
+package handlers
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	goodooHttp "goodoo/http"
+	"goodoo/models"
+	"goodoo/upload"
+	"goodoo/version"
+)
+
+// OdooCompatVersion is the Odoo version whose web session contract the
+// /web/session routes implement; widgets compare its major version
+const OdooCompatVersion = "16.0"
+
+// odooVersionInfo is the server_version_info of OdooCompatVersion
+var odooVersionInfo = []interface{}{16, 0, 0, "final", 0, ""}
+
+// Stub values of the session info: goodoo has no companies, menus nor
+// currencies, so it reports a single company and empty caches
+const (
+	odooCompanyID   = 1
+	odooCompanyName = "My Company"
+)
+
+// OdooUserContext is the user_context of the session info
+type OdooUserContext struct {
+	Lang string `json:"lang"`
+	Tz   string `json:"tz"`
+	UID  uint   `json:"uid"`
+}
+
+// OdooCompany is an allowed company of the session info
+type OdooCompany struct {
+	ID       uint   `json:"id"`
+	Name     string `json:"name"`
+	Sequence int    `json:"sequence"`
+}
+
+// OdooUserCompanies is the user_companies of the session info
+type OdooUserCompanies struct {
+	CurrentCompany              uint                   `json:"current_company"`
+	AllowedCompanies            map[string]OdooCompany `json:"allowed_companies"`
+	DisallowedAncestorCompanies map[string]OdooCompany `json:"disallowed_ancestor_companies"`
+}
+
+// OdooSessionInfo is the payload of Odoo 16's /web/session/get_session_info.
+// Its fields and their JSON names are the contract of the web client and
+// must not change. Stubs: company_id and user_companies (one company),
+// currencies (none), home_action_id (none), cache_hashes (derived from the
+// server version and language), the profiling fields (null) and
+// web_tours (none).
+type OdooSessionInfo struct {
+	UID                      uint                   `json:"uid"`
+	IsSystem                 bool                   `json:"is_system"`
+	IsAdmin                  bool                   `json:"is_admin"`
+	UserContext              OdooUserContext        `json:"user_context"`
+	DB                       string                 `json:"db"`
+	ServerVersion            string                 `json:"server_version"`
+	ServerVersionInfo        []interface{}          `json:"server_version_info"`
+	SupportURL               string                 `json:"support_url"`
+	Name                     string                 `json:"name"`
+	Username                 string                 `json:"username"`
+	PartnerDisplayName       string                 `json:"partner_display_name"`
+	CompanyID                uint                   `json:"company_id"`
+	PartnerID                uint                   `json:"partner_id"`
+	WebBaseURL               string                 `json:"web.base.url"`
+	ActiveIDsLimit           int                    `json:"active_ids_limit"`
+	ProfileSession           interface{}            `json:"profile_session"`
+	ProfileCollectors        interface{}            `json:"profile_collectors"`
+	ProfileParams            interface{}            `json:"profile_params"`
+	MaxFileUploadSize        int64                  `json:"max_file_upload_size"`
+	HomeActionID             bool                   `json:"home_action_id"`
+	CacheHashes              map[string]string      `json:"cache_hashes"`
+	Currencies               map[string]interface{} `json:"currencies"`
+	BundleParams             map[string]string      `json:"bundle_params"`
+	UserCompanies            OdooUserCompanies      `json:"user_companies"`
+	ShowEffect               bool                   `json:"show_effect"`
+	DisplaySwitchCompanyMenu bool                   `json:"display_switch_company_menu"`
+	UserID                   []uint                 `json:"user_id"`
+	MaxTimeBetweenKeysInMs   int                    `json:"max_time_between_keys_in_ms"`
+	WebTours                 []string               `json:"web_tours"`
+	TourDisable              bool                   `json:"tour_disable"`
+	NotificationType         string                 `json:"notification_type"`
+}
+
+// odooRPCRequest is the JSON-RPC envelope of Odoo's json routes
+type odooRPCRequest struct {
+	JSONRPC string                 `json:"jsonrpc"`
+	Method  string                 `json:"method"`
+	ID      interface{}            `json:"id"`
+	Params  map[string]interface{} `json:"params"`
+}
+
+// odooRPCError is the error member of an Odoo JSON-RPC response
+type odooRPCError struct {
+	Code    int                    `json:"code"`
+	Message string                 `json:"message"`
+	Data    map[string]interface{} `json:"data"`
+}
+
+// Odoo JSON-RPC error codes
+const (
+	odooErrorServer         = 200
+	odooErrorSessionExpired = 100
+)
+
+// odooResult answers a JSON-RPC request with a result
+func odooResult(c echo.Context, id, result interface{}) error {
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      id,
+		"result":  result,
+	})
+}
+
+// odooError answers a JSON-RPC request with an Odoo exception, still with
+// HTTP 200 as Odoo does
+func odooError(c echo.Context, id interface{}, code int, exception, message string) error {
+	title := "Odoo Server Error"
+	if code == odooErrorSessionExpired {
+		title = "Odoo Session Expired"
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      id,
+		"error": odooRPCError{
+			Code:    code,
+			Message: title,
+			Data: map[string]interface{}{
+				"name":      exception,
+				"debug":     "",
+				"message":   message,
+				"arguments": []string{message},
+				"context":   map[string]interface{}{},
+			},
+		},
+	})
+}
+
+// bindOdooRPC reads the JSON-RPC envelope of a POST request; GET requests
+// have none
+func bindOdooRPC(req *goodooHttp.Request) (*odooRPCRequest, error) {
+	rpc := &odooRPCRequest{JSONRPC: "2.0"}
+	if req.HTTPRequest.Method == http.MethodGet {
+		return rpc, nil
+	}
+	if err := req.BindJSON(rpc); err != nil {
+		return nil, err
+	}
+	if rpc.Params == nil {
+		rpc.Params = make(map[string]interface{})
+	}
+	return rpc, nil
+}
+
+// OdooHandler serves the routes of the Odoo web client session, so its
+// widgets can run against goodoo
+type OdooHandler struct {
+	Config *goodooHttp.RequestConfig
+}
+
+// NewOdooHandler creates a new Odoo web session handler
+func NewOdooHandler(config *goodooHttp.RequestConfig) *OdooHandler {
+	return &OdooHandler{Config: config}
+}
+
+// GetSessionInfo returns the session info of the signed-in user, or a
+// session expired error
+func (h *OdooHandler) GetSessionInfo(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	rpc, err := bindOdooRPC(req)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if !req.IsAuthenticated() {
+		return odooError(c, rpc.ID, odooErrorSessionExpired, "odoo.http.SessionExpiredException", "Session expired")
+	}
+
+	info, err := odooSessionInfo(c, req)
+	if err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to build session info: %v", err)
+		return odooError(c, rpc.ID, odooErrorServer, "builtins.Exception", "Failed to read the session")
+	}
+	return odooResult(c, rpc.ID, info)
+}
+
+// Authenticate signs in with the db, login and password params and returns
+// the session info
+func (h *OdooHandler) Authenticate(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	rpc, err := bindOdooRPC(req)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	login, _ := rpc.Params["login"].(string)
+	password, _ := rpc.Params["password"].(string)
+	database, _ := rpc.Params["db"].(string)
+	if database == "" {
+		database = req.GetDBName()
+	}
+
+	user, method, err := checkCredentials(req, login, password)
+	if errors.Is(err, errInvalidCredentials) {
+		return odooError(c, rpc.ID, odooErrorServer, "odoo.exceptions.AccessDenied", "Access Denied")
+	}
+	if err == nil {
+		err = startSession(req, database, user, method)
+	}
+	if err != nil {
+		req.Logger.ErrorCtx(req.Context, "Authentication failed: %v", err)
+		return odooError(c, rpc.ID, odooErrorServer, "builtins.Exception", "Authentication failed")
+	}
+	req.Logger.InfoCtx(req.Context, "User %s successfully authenticated", login)
+
+	info, err := odooSessionInfo(c, req)
+	if err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to build session info: %v", err)
+		return odooError(c, rpc.ID, odooErrorServer, "builtins.Exception", "Failed to read the session")
+	}
+	return odooResult(c, rpc.ID, info)
+}
+
+// Destroy signs out, keeping no database
+func (h *OdooHandler) Destroy(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	rpc, err := bindOdooRPC(req)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if req.IsAuthenticated() {
+		req.Logger.InfoCtx(req.Context, "User %s logged out", req.GetLogin())
+		req.Logout(false)
+	}
+	return odooResult(c, rpc.ID, nil)
+}
+
+// odooSessionInfo assembles the session info of the signed-in user
+func odooSessionInfo(c echo.Context, req *goodooHttp.Request) (*OdooSessionInfo, error) {
+	db := req.GetDB()
+	if db == nil {
+		return nil, errors.New("database connection not available")
+	}
+	var user models.User
+	if err := db.First(&user, req.GetUserID()).Error; err != nil {
+		return nil, err
+	}
+
+	// Empty when unset: the web client then builds its links from its own location
+	base, _ := webBaseURL(req.GetDBName())
+	partnerName := user.DisplayName()
+	var partnerID uint
+	if user.PartnerID != nil {
+		partnerID = *user.PartnerID
+		var partner models.Partner
+		if err := db.Select("name").First(&partner, partnerID).Error; err == nil && partner.Name != "" {
+			partnerName = partner.Name
+		}
+	}
+
+	context := req.Session.GetContext()
+	lang, _ := context["lang"].(string)
+	if lang == "" {
+		lang = user.Lang
+	}
+	if lang == "" {
+		lang = models.DefaultLang
+	}
+	tz, _ := context["tz"].(string)
+	if tz == "" {
+		tz = user.Tz
+	}
+
+	env := models.NewEnvironment(db, user.ID).WithDBName(req.GetDBName())
+	isSystem := env.HasGroup("base.group_system")
+	return newOdooSessionInfo(odooSessionFacts{
+		User:        &user,
+		PartnerID:   partnerID,
+		PartnerName: partnerName,
+		DBName:      req.GetDBName(),
+		Lang:        lang,
+		Tz:          tz,
+		BaseURL:     base,
+		IsSystem:    isSystem,
+		IsAdmin:     isSystem || env.HasGroup("base.group_erp_manager"),
+		MaxUpload:   upload.CurrentConfig().MaxFileSize,
+	}), nil
+}
+
+// odooSessionFacts is what the session info is built from, read from the
+// session, the database and the config
+type odooSessionFacts struct {
+	User        *models.User
+	PartnerID   uint
+	PartnerName string
+	DBName      string
+	Lang        string
+	Tz          string
+	BaseURL     string
+	IsSystem    bool
+	IsAdmin     bool
+	MaxUpload   int64
+}
+
+// newOdooSessionInfo builds the session info of facts, filling the stubs
+func newOdooSessionInfo(facts odooSessionFacts) *OdooSessionInfo {
+	user := facts.User
+	company := OdooCompany{ID: odooCompanyID, Name: odooCompanyName, Sequence: 10}
+
+	return &OdooSessionInfo{
+		UID:                user.ID,
+		IsSystem:           facts.IsSystem,
+		IsAdmin:            facts.IsAdmin,
+		UserContext:        OdooUserContext{Lang: facts.Lang, Tz: facts.Tz, UID: user.ID},
+		DB:                 facts.DBName,
+		ServerVersion:      OdooCompatVersion,
+		ServerVersionInfo:  odooVersionInfo,
+		SupportURL:         "",
+		Name:               user.DisplayName(),
+		Username:           user.Login,
+		PartnerDisplayName: facts.PartnerName,
+		CompanyID:          odooCompanyID,
+		PartnerID:          facts.PartnerID,
+		WebBaseURL:         facts.BaseURL,
+		ActiveIDsLimit:     20000,
+		MaxFileUploadSize:  facts.MaxUpload,
+		CacheHashes: map[string]string{
+			"translations": odooCacheHash("translations", facts.Lang),
+			"load_menus":   odooCacheHash("load_menus", facts.Lang),
+		},
+		Currencies:   map[string]interface{}{},
+		BundleParams: map[string]string{"lang": facts.Lang},
+		UserCompanies: OdooUserCompanies{
+			CurrentCompany:              odooCompanyID,
+			AllowedCompanies:            map[string]OdooCompany{"1": company},
+			DisallowedAncestorCompanies: map[string]OdooCompany{},
+		},
+		ShowEffect:             true,
+		UserID:                 []uint{user.ID},
+		MaxTimeBetweenKeysInMs: 55,
+		WebTours:               []string{},
+		TourDisable:            true,
+		NotificationType:       "email",
+	}
+}
+
+// odooCacheHash is a cache key of the web client, changing with the server
+// version and the language
+func odooCacheHash(kind, lang string) string {
+	sum := sha1.Sum([]byte(kind + "\x00" + version.Version + "\x00" + lang))
+	return hex.EncodeToString(sum[:])
+}
+
+// RegisterOdooRoutes registers the Odoo web session routes: the session info
+// (GET, or POST with the JSON-RPC envelope), and the authenticate and
+// destroy aliases of the login and logout handlers
+func RegisterOdooRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewOdooHandler(config)
+
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		{Method: "GET", Path: "/web/session/get_session_info", Handler: handler.GetSessionInfo},
+		{Method: "POST", Path: "/web/session/get_session_info", Handler: handler.GetSessionInfo},
+		{Method: "POST", Path: "/web/session/authenticate", Handler: handler.Authenticate, RateLimit: "auth"},
+		{Method: "POST", Path: "/web/session/destroy", Handler: handler.Destroy},
+	})
+}
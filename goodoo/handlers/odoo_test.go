@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"goodoo/models"
+)
+
+// goldenSessionInfo returns the JSON object of the session info of facts,
+// with its cache hashes, which follow the server version, replaced
+func goldenSessionInfo(t *testing.T, facts odooSessionFacts) map[string]interface{} {
+	t.Helper()
+	info := newOdooSessionInfo(facts)
+	for kind, hash := range info.CacheHashes {
+		if _, err := hex.DecodeString(hash); err != nil || len(hash) != 40 {
+			t.Errorf("cache hash %s = %q, want a sha1", kind, hash)
+		}
+		info.CacheHashes[kind] = "<sha1>"
+	}
+	content, err := json.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal(content, &payload); err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+// TestOdooSessionInfoGolden locks the Odoo 16 session info read by the web
+// client and third-party widgets: a new, renamed or retyped key fails here
+func TestOdooSessionInfoGolden(t *testing.T) {
+	partnerID := uint(3)
+	tests := []struct {
+		golden string
+		facts  odooSessionFacts
+	}{
+		{"session_info_user.golden.json", odooSessionFacts{
+			User:        &models.User{BaseModel: models.BaseModel{ID: 7}, Login: "demo", Lang: "en_US"},
+			PartnerName: "demo",
+			DBName:      "odoo_test",
+			Lang:        "en_US",
+			MaxUpload:   128 << 20,
+		}},
+		{"session_info_admin.golden.json", odooSessionFacts{
+			User:        &models.User{BaseModel: models.BaseModel{ID: 2}, Login: "admin", Name: "Mitchell Admin", PartnerID: &partnerID},
+			PartnerID:   partnerID,
+			PartnerName: "YourCompany, Mitchell Admin",
+			DBName:      "odoo_test",
+			Lang:        "fr_FR",
+			Tz:          "Europe/Brussels",
+			BaseURL:     "https://erp.example.com",
+			IsSystem:    true,
+			IsAdmin:     true,
+			MaxUpload:   128 << 20,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.golden, func(t *testing.T) {
+			assertGolden(t, tt.golden, goldenSessionInfo(t, tt.facts))
+		})
+	}
+
+	user := goldenSessionInfo(t, tests[0].facts)
+	admin := goldenSessionInfo(t, tests[1].facts)
+	if newOdooSessionInfo(tests[0].facts).CacheHashes["translations"] == newOdooSessionInfo(tests[1].facts).CacheHashes["translations"] {
+		t.Error("the translations hash does not change with the language")
+	}
+	if len(user) != len(admin) {
+		t.Errorf("the session info has %d keys for a user and %d for an admin", len(user), len(admin))
+	}
+}
+
+// TestOdooEnvelopeGolden locks the JSON-RPC envelopes of the results and
+// of the exceptions, answered with HTTP 200 as Odoo does
+func TestOdooEnvelopeGolden(t *testing.T) {
+	tests := []struct {
+		golden  string
+		respond func(c echo.Context) error
+	}{
+		{"odoo_destroy.golden.json", func(c echo.Context) error {
+			return odooResult(c, 1, nil)
+		}},
+		{"odoo_session_expired.golden.json", func(c echo.Context) error {
+			return odooError(c, 2, odooErrorSessionExpired, "odoo.http.SessionExpiredException", "Session expired")
+		}},
+		{"odoo_access_denied.golden.json", func(c echo.Context) error {
+			return odooError(c, "3", odooErrorServer, "odoo.exceptions.AccessDenied", "Access Denied")
+		}},
+	}
+	e := echo.New()
+	for _, tt := range tests {
+		t.Run(tt.golden, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			c := e.NewContext(httptest.NewRequest(http.MethodPost, "/web/session/destroy", nil), rec)
+			if err := tt.respond(c); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != http.StatusOK {
+				t.Errorf("status = %d, want 200", rec.Code)
+			}
+			var payload map[string]interface{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &payload); err != nil {
+				t.Fatal(err)
+			}
+			assertGolden(t, tt.golden, payload)
+		})
+	}
+}
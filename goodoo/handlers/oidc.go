@@ -0,0 +1,251 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	goodooHttp "goodoo/http"
+	"goodoo/oidc"
+)
+
+// Session keys of single sign-on: the pending sign-in, and the ID token
+// of the signed-in user kept for the provider logout
+const (
+	oidcRequestKey = "oidc_auth_request"
+	oidcTokenKey   = "oidc_id_token"
+)
+
+// OIDCHandler signs users in with the OpenID Connect provider
+type OIDCHandler struct {
+	Config *goodooHttp.RequestConfig
+}
+
+// NewOIDCHandler creates a new single sign-on handler
+func NewOIDCHandler(config *goodooHttp.RequestConfig) *OIDCHandler {
+	return &OIDCHandler{Config: config}
+}
+
+// oidcRedirectURL returns the callback URL registered at the provider,
+// built from models.ParamWebBaseURL unless configured
+func oidcRedirectURL(dbName string, config *oidc.Config) (string, error) {
+	if config.RedirectURL != "" {
+		return config.RedirectURL, nil
+	}
+	base, err := webBaseURL(dbName)
+	if err != nil {
+		return "", err
+	}
+	return base + "/auth/oidc/callback", nil
+}
+
+// localRedirect keeps the page to return to after signing in when it is
+// on this server
+func localRedirect(value string) string {
+	if !strings.HasPrefix(value, "/") || strings.HasPrefix(value, "//") || strings.HasPrefix(value, "/\\") {
+		return "/"
+	}
+	return value
+}
+
+// Login sends the user to the provider: GET /auth/oidc/login?redirect=/web
+// The state, nonce and PKCE verifier are kept in the session for the callback.
+func (h *OIDCHandler) Login(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	config := oidc.ConfigForDB(req.GetDBName())
+	provider, err := oidc.Discover(req.Context, config)
+	if err != nil {
+		return h.fail(c, err)
+	}
+
+	authRequest, err := oidc.NewAuthRequest(localRedirect(c.QueryParam("redirect")))
+	if err != nil {
+		return h.fail(c, err)
+	}
+	encoded, err := json.Marshal(authRequest)
+	if err != nil {
+		return h.fail(c, err)
+	}
+	redirectURL, err := oidcRedirectURL(req.GetDBName(), config)
+	if err != nil {
+		return h.fail(c, err)
+	}
+	req.Session.Set(oidcRequestKey, string(encoded))
+
+	c.Response().Header().Set("Cache-Control", "no-store")
+	return c.Redirect(http.StatusFound, provider.AuthCodeURL(config, redirectURL, authRequest))
+}
+
+// pendingAuthRequest takes the sign-in started in this session; it can
+// only be completed once
+func pendingAuthRequest(req *goodooHttp.Request) *oidc.AuthRequest {
+	value, ok := req.Session.Get(oidcRequestKey)
+	if !ok {
+		return nil
+	}
+	req.Session.Delete(oidcRequestKey)
+	encoded, _ := value.(string)
+	var authRequest oidc.AuthRequest
+	if err := json.Unmarshal([]byte(encoded), &authRequest); err != nil {
+		return nil
+	}
+	return &authRequest
+}
+
+// Callback completes the sign-in when the provider sends the user back:
+// the state must match the pending sign-in, the code is exchanged for an
+// ID token whose signature and nonce are verified, then the identity is
+// mapped to a user and the session authenticated as with a password
+func (h *OIDCHandler) Callback(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	authRequest := pendingAuthRequest(req)
+
+	if failure := c.QueryParam("error"); failure != "" {
+		req.Logger.WarningCtx(req.Context, "Identity provider refused the sign-in: %s %s", failure, c.QueryParam("error_description"))
+		return h.fail(c, oidc.ErrProviderDenied)
+	}
+	state := c.QueryParam("state")
+	if authRequest == nil || state == "" || state != authRequest.State || authRequest.Expired(time.Now()) {
+		return h.fail(c, oidc.ErrInvalidState)
+	}
+	code := c.QueryParam("code")
+	if code == "" {
+		return h.fail(c, oidc.ErrTokenExchange)
+	}
+
+	config := oidc.ConfigForDB(req.GetDBName())
+	provider, err := oidc.Discover(req.Context, config)
+	if err != nil {
+		return h.fail(c, err)
+	}
+	redirectURL, err := oidcRedirectURL(req.GetDBName(), config)
+	if err != nil {
+		return h.fail(c, err)
+	}
+	tokens, err := provider.Exchange(req.Context, config, redirectURL, code, authRequest.Verifier)
+	if err != nil {
+		return h.fail(c, err)
+	}
+	claims, err := provider.VerifyIDToken(req.Context, config, tokens.IDToken, authRequest.Nonce, time.Now())
+	if err != nil {
+		return h.fail(c, err)
+	}
+
+	db := req.GetDB()
+	if db == nil {
+		return h.fail(c, errors.New("database connection not available"))
+	}
+	user, provisioned, err := oidc.ResolveUser(db, config, claims)
+	if err != nil {
+		return h.fail(c, err)
+	}
+	if provisioned {
+		req.Logger.InfoCtx(req.Context, "Provisioned user %s from identity %s", user.Login, claims.Subject)
+	}
+
+	if err := startSession(req, req.GetDBName(), user, "oidc"); err != nil {
+		return h.fail(c, err)
+	}
+	req.Session.Set(oidcTokenKey, tokens.IDToken)
+
+	req.Logger.InfoCtx(req.Context, "User %s successfully authenticated through single sign-on", user.Login)
+	return c.Redirect(http.StatusFound, authRequest.Redirect)
+}
+
+// oidcFailure is how a sign-in failure is shown to the user
+type oidcFailure struct {
+	err     error
+	status  int
+	title   string
+	message string
+}
+
+// oidcFailures describe the failures the user can act on; the details
+// are logged, not shown
+var oidcFailures = []oidcFailure{
+	{oidc.ErrNotConfigured, http.StatusNotFound, "Single sign-on unavailable",
+		"Single sign-on is not configured. Sign in with your password instead."},
+	{oidc.ErrDiscovery, http.StatusBadGateway, "Identity provider unreachable",
+		"The identity provider could not be reached. Try again later or sign in with your password."},
+	{oidc.ErrProviderDenied, http.StatusForbidden, "Sign-in refused",
+		"The identity provider did not allow the sign-in."},
+	{oidc.ErrInvalidState, http.StatusBadRequest, "Sign-in expired",
+		"This sign-in link has expired or was already used. Start the sign-in again."},
+	{oidc.ErrTokenExchange, http.StatusBadGateway, "Sign-in failed",
+		"The identity provider did not confirm the sign-in. Start the sign-in again."},
+	{oidc.ErrInvalidSignature, http.StatusUnauthorized, "Invalid identity",
+		"The identity sent by the provider could not be verified."},
+	{oidc.ErrInvalidToken, http.StatusUnauthorized, "Invalid identity",
+		"The identity sent by the provider is not valid for this server."},
+	{oidc.ErrTokenExpired, http.StatusUnauthorized, "Identity expired",
+		"The identity sent by the provider has expired. Check the clock of your device and sign in again."},
+	{oidc.ErrNonceMismatch, http.StatusUnauthorized, "Invalid identity",
+		"The identity sent by the provider does not belong to this sign-in. Start the sign-in again."},
+	{oidc.ErrUnknownUser, http.StatusForbidden, "No account",
+		"No active account matches your identity. Ask an administrator to create one."},
+	{oidc.ErrAccountConflict, http.StatusForbidden, "Account already linked",
+		"The matching account is already linked to another identity. Ask an administrator for help."},
+	{errNoBaseURL, http.StatusServiceUnavailable, "Single sign-on unavailable",
+		"Single sign-on is not fully configured. Sign in with your password instead."},
+}
+
+// fail logs a sign-in failure and renders its error page
+func (h *OIDCHandler) fail(c echo.Context, err error) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	failure := oidcFailure{err: err, status: http.StatusInternalServerError, title: "Sign-in failed",
+		message: "An unexpected error occurred while signing in. Try again later."}
+	for _, known := range oidcFailures {
+		if errors.Is(err, known.err) {
+			failure = known
+			break
+		}
+	}
+	req.Logger.WarningCtx(req.Context, "Single sign-on failed: %v", err)
+
+	data := pageData(c)
+	data["Title"] = failure.title
+	data["Message"] = failure.message
+	c.Response().Header().Set("Cache-Control", "no-store")
+	return c.Render(failure.status, "auth_error.html", data)
+}
+
+// oidcLogoutURL returns where to sign the user out of the provider, or ""
+// when they did not sign in through it or end-session logout is disabled.
+// The ID token is dropped from the session either way.
+func oidcLogoutURL(c echo.Context, req *goodooHttp.Request) string {
+	value, ok := req.Session.Get(oidcTokenKey)
+	if !ok {
+		return ""
+	}
+	req.Session.Delete(oidcTokenKey)
+
+	config := oidc.ConfigForDB(req.GetDBName())
+	if !config.EndSession {
+		return ""
+	}
+	provider, err := oidc.Discover(req.Context, config)
+	if err != nil {
+		req.Logger.WarningCtx(req.Context, "Cannot sign out of the identity provider: %v", err)
+		return ""
+	}
+	idToken, _ := value.(string)
+	// Without a configured URL the provider is not asked to send the user back
+	postLogout := ""
+	if base, err := webBaseURL(req.GetDBName()); err == nil {
+		postLogout = base + "/login"
+	}
+	return provider.EndSessionURL(config, idToken, postLogout)
+}
+
+// RegisterOIDCRoutes mounts the single sign-on endpoints under /auth/oidc
+func RegisterOIDCRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewOIDCHandler(config)
+
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		{Method: "GET", Path: "/auth/oidc/login", Handler: handler.Login, RateLimit: "auth"},
+		{Method: "GET", Path: "/auth/oidc/callback", Handler: handler.Callback, RateLimit: "auth"},
+	})
+}
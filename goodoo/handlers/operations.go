@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	goodooHttp "goodoo/http"
+	"goodoo/operations"
+)
+
+// OperationsHandler reports and cancels background operations
+type OperationsHandler struct {
+	Config *goodooHttp.RequestConfig
+}
+
+// NewOperationsHandler creates a new operations handler
+func NewOperationsHandler(config *goodooHttp.RequestConfig) *OperationsHandler {
+	return &OperationsHandler{Config: config}
+}
+
+// operation returns the operation of the route, if it was started by the
+// current user in the current database or the user is an administrator
+func (h *OperationsHandler) operation(c echo.Context) (*operations.Operation, error) {
+	req := goodooHttp.GetGoodooRequest(c)
+	op, ok := operations.Get(c.Param("id"))
+	if !ok {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Operation not found")
+	}
+	status := op.Status()
+	if status.DBName != req.GetDBName() || (status.UserID != req.GetUserID() && !isAdmin(req)) {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Operation not found")
+	}
+	return op, nil
+}
+
+// Get reports the progress of an operation
+func (h *OperationsHandler) Get(c echo.Context) error {
+	op, err := h.operation(c)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, op.Status())
+}
+
+// Cancel stops an operation after its current batch
+func (h *OperationsHandler) Cancel(c echo.Context) error {
+	op, err := h.operation(c)
+	if err != nil {
+		return err
+	}
+	if !op.Cancel() {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Operation already finished"})
+	}
+	req := goodooHttp.GetGoodooRequest(c)
+	req.Logger.InfoCtx(req.Context, "Operation %s cancelled by user %d", c.Param("id"), req.GetUserID())
+	return c.JSON(http.StatusOK, op.Status())
+}
+
+// RegisterOperationRoutes mounts the background operation endpoints
+func RegisterOperationRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewOperationsHandler(config)
+
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		{Method: "GET", Path: "/api/operations/:id", Handler: handler.Get, Auth: true, ServiceAuth: true, DB: true},
+		{Method: "POST", Path: "/api/operations/:id/cancel", Handler: handler.Cancel, Auth: true, ServiceAuth: true, DB: true},
+	})
+}
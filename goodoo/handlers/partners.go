@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"goodoo/database"
+	goodooHttp "goodoo/http"
+	"goodoo/models"
+	"gorm.io/gorm"
+)
+
+// defaultSimilarityThreshold is the name similarity above which partners are reported as duplicates
+const defaultSimilarityThreshold = 0.6
+
+// PartnerHandler provides the partner hierarchy and deduplication tools
+// (the latter admin only)
+type PartnerHandler struct {
+	Config *goodooHttp.RequestConfig
+}
+
+// NewPartnerHandler creates a new partner handler
+func NewPartnerHandler(config *goodooHttp.RequestConfig) *PartnerHandler {
+	return &PartnerHandler{Config: config}
+}
+
+// Duplicates returns clusters of partners sharing an email or with similar
+// names; ?threshold= sets the name similarity (0-1, default 0.6)
+func (h *PartnerHandler) Duplicates(c echo.Context) error {
+	db := goodooHttp.MustGetGoodooRequest(c).GetDB()
+
+	threshold := defaultSimilarityThreshold
+	if value := c.QueryParam("threshold"); value != "" {
+		var err error
+		threshold, err = strconv.ParseFloat(value, 64)
+		if err != nil || threshold <= 0 || threshold > 1 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "threshold must be between 0 and 1"})
+		}
+	}
+
+	clusters, err := models.FindDuplicatePartners(db, threshold)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"threshold": threshold,
+		"clusters":  clusters,
+	})
+}
+
+// MergeRequest is the body of a partner merge
+type MergeRequest struct {
+	SurvivorID uint   `json:"survivor_id"`
+	MergedIDs  []uint `json:"merged_ids"`
+}
+
+// Merge merges partners into a survivor in one transaction
+func (h *PartnerHandler) Merge(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+
+	var body MergeRequest
+	if err := c.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request format: "+err.Error())
+	}
+	if body.SurvivorID == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "survivor_id is required"})
+	}
+
+	var survivor *models.Partner
+	err := database.RetryableTransaction(req.Context, db, func(tx *gorm.DB) error {
+		var err error
+		survivor, err = models.MergePartners(tx, uint(req.GetUserID()), body.SurvivorID, body.MergedIDs)
+		return err
+	})
+	if errors.Is(err, models.ErrInvalidMerge) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+	}
+	if err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to merge partners %v into %d: %v", body.MergedIDs, body.SurvivorID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	req.Logger.InfoCtx(req.Context, "Partners %v merged into %d by %s", body.MergedIDs, body.SurvivorID, req.GetLogin())
+	return c.JSON(http.StatusOK, survivor)
+}
+
+// Tree returns a partner with its contacts and their descendants, down to
+// ?depth= levels (default 5). With ?rollup=sales each node also carries the
+// total of its confirmed sale orders and of its subtree's.
+func (h *PartnerHandler) Tree(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	db := req.GetDB()
+	if db == nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database not available")
+	}
+	id, err := parseRecordID(c)
+	if err != nil {
+		return err
+	}
+	depth, err := parseTreeDepth(c)
+	if err != nil {
+		return err
+	}
+
+	rows, err := models.LoadSubtree(db, "res_partner", "parent_id", id, depth)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	if len(rows) == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Partner not found"})
+	}
+
+	ids := treeIDs(rows)
+	var partners []models.Partner
+	if err := db.Select("id", "name").Where("id IN ?", ids).Find(&partners).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	names := make(map[uint]string, len(partners))
+	for _, partner := range partners {
+		names[partner.ID] = partner.Name
+	}
+	root := buildTree(rows, names)
+
+	if c.QueryParam("rollup") == "sales" {
+		var totals []struct {
+			PartnerID uint
+			Total     float64
+		}
+		err := db.Model(&models.SaleOrder{}).
+			Select("partner_id, SUM(amount_total) AS total").
+			Where("partner_id IN ? AND state IN ?", ids, []string{models.SaleStateSale, models.SaleStateDone}).
+			Group("partner_id").
+			Scan(&totals).Error
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		}
+		own := make(map[uint]float64, len(totals))
+		for _, total := range totals {
+			own[total.PartnerID] = total.Total
+		}
+		rollupSales(root, own)
+	}
+
+	return c.JSON(http.StatusOK, root)
+}
+
+// rollupSales sets the own and subtree sale totals of each node and returns
+// the subtree's. Records repeated through a cycle are not counted twice.
+func rollupSales(node *treeNode, own map[uint]float64) float64 {
+	if node.Cycle {
+		return 0
+	}
+	total := own[node.ID]
+	for _, child := range node.Children {
+		total += rollupSales(child, own)
+	}
+	node.Values = map[string]interface{}{
+		"sale_total":        own[node.ID],
+		"sale_total_rollup": total,
+	}
+	return total
+}
+
+// RegisterPartnerRoutes mounts the partner endpoints under /api/partners;
+// finding and merging duplicates requires the partners.merge permission
+func RegisterPartnerRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewPartnerHandler(config)
+	merge := goodooHttp.PermissionPartnersMerge
+
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		{Method: "GET", Path: "/api/partners/duplicates", Handler: handler.Duplicates, Auth: true, DB: true, Permission: merge},
+		{Method: "POST", Path: "/api/partners/merge", Handler: handler.Merge, Auth: true, DB: true, Permission: merge},
+		{Method: "GET", Path: "/api/partners/:id/tree", Handler: handler.Tree, Auth: true, DB: true},
+	})
+}
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	goodooHttp "goodoo/http"
+	"goodoo/models"
+)
+
+// PermissionHandler lists the route permissions and edits the permissions
+// granted to groups
+type PermissionHandler struct {
+	Config *goodooHttp.RequestConfig
+}
+
+// NewPermissionHandler creates a new permission handler
+func NewPermissionHandler(config *goodooHttp.RequestConfig) *PermissionHandler {
+	return &PermissionHandler{Config: config}
+}
+
+// groupPermissions is a group with the permissions granted to it
+type groupPermissions struct {
+	ID          uint     `json:"id"`
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+}
+
+// List returns the permissions required by the registered routes, with
+// the routes requiring each, and the permissions granted to every group
+func (h *PermissionHandler) List(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	if db == nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database not available"})
+	}
+
+	var groups []models.ResGroups
+	if err := db.Order("name").Find(&groups).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	granted, err := models.GroupPermissions(db)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	list := make([]groupPermissions, 0, len(groups))
+	for _, group := range groups {
+		permissions := granted[group.ID]
+		if permissions == nil {
+			permissions = []string{}
+		}
+		list = append(list, groupPermissions{ID: group.ID, Name: group.Name, Permissions: permissions})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"permissions": goodooHttp.Permissions(),
+		"groups":      list,
+	})
+}
+
+// SetGroupPermissionsRequest replaces the permissions granted to a group
+type SetGroupPermissionsRequest struct {
+	Permissions []string `json:"permissions"`
+}
+
+// SetGroup replaces the permissions granted to the group :id; they apply
+// to its members from their next request
+func (h *PermissionHandler) SetGroup(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	groupID, err := strconv.Atoi(c.Param("id"))
+	if err != nil || groupID <= 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid group id"})
+	}
+	var body SetGroupPermissionsRequest
+	if err := c.Bind(&body); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request format"})
+	}
+	var unknown []string
+	for _, permission := range body.Permissions {
+		if !goodooHttp.KnownPermission(permission) {
+			unknown = append(unknown, permission)
+		}
+	}
+	if len(unknown) > 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Unknown permissions: " + strings.Join(unknown, ", ")})
+	}
+
+	db := req.GetDB()
+	if db == nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database not available"})
+	}
+	var group models.ResGroups
+	if err := db.First(&group, groupID).Error; err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Group not found"})
+	}
+	if err := models.SetGroupPermissions(req.GetDBName(), db, uint(req.GetUserID()), &group, body.Permissions); err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to set the permissions of group %d: %v", group.ID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to save the permissions"})
+	}
+	req.Logger.InfoCtx(req.Context, "User %s set the permissions of group %s to %v", req.GetLogin(), group.Name, body.Permissions)
+
+	granted, err := models.GroupPermissions(db.Where("group_id = ?", group.ID))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	permissions := granted[group.ID]
+	if permissions == nil {
+		permissions = []string{}
+	}
+	return c.JSON(http.StatusOK, groupPermissions{ID: group.ID, Name: group.Name, Permissions: permissions})
+}
+
+// RegisterPermissionRoutes mounts the permission endpoints. Granting
+// permissions is reserved to administrators: a permission to do it would
+// let its holders grant themselves any other.
+func RegisterPermissionRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewPermissionHandler(config)
+	admins := []string{goodooHttp.GroupSystem}
+
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		{Method: "GET", Path: "/api/permissions", Handler: handler.List, Auth: true, DB: true, Groups: admins},
+		{Method: "PUT", Path: "/api/groups/:id/permissions", Handler: handler.SetGroup, Auth: true, DB: true, Groups: admins, DenyImpersonation: true},
+	})
+}
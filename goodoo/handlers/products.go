@@ -0,0 +1,212 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	goodooHttp "goodoo/http"
+	"goodoo/models"
+	"gorm.io/gorm"
+)
+
+// ProductCategoryHandler manages the product category tree
+type ProductCategoryHandler struct {
+	Config *goodooHttp.RequestConfig
+}
+
+// NewProductCategoryHandler creates a new product category handler
+func NewProductCategoryHandler(config *goodooHttp.RequestConfig) *ProductCategoryHandler {
+	return &ProductCategoryHandler{Config: config}
+}
+
+// requestDB returns the request database
+func (h *ProductCategoryHandler) requestDB(c echo.Context) (*goodooHttp.Request, *gorm.DB, error) {
+	req := goodooHttp.GetGoodooRequest(c)
+	db := req.GetDB()
+	if db == nil {
+		return nil, nil, echo.NewHTTPError(http.StatusInternalServerError, "Database not available")
+	}
+	return req, db, nil
+}
+
+// errEmptyCategoryName rejects blank category names
+var errEmptyCategoryName = errors.New("name cannot be empty")
+
+// ProductCategoryRequest is the body creating or updating a category; a
+// parent_id of 0 makes it a root
+type ProductCategoryRequest struct {
+	Name     *string `json:"name"`
+	ParentID *uint   `json:"parent_id"`
+}
+
+// categoryError answers a failed category write
+func categoryError(c echo.Context, err error) error {
+	switch {
+	case errors.Is(err, models.ErrHierarchyCycle), errors.Is(err, errEmptyCategoryName):
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return c.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+}
+
+// List returns the categories ordered by complete name, with their tags;
+// ?child_of= keeps a category and its descendants, and ?tags=a,b those
+// with one of the tags, by name
+func (h *ProductCategoryHandler) List(c echo.Context) error {
+	_, db, err := h.requestDB(c)
+	if err != nil {
+		return err
+	}
+
+	domain := models.Domain{}
+	if value := c.QueryParam("child_of"); value != "" {
+		id, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid child_of"})
+		}
+		domain = append(domain, []interface{}{"id", models.OperatorChildOf, uint(id)})
+	}
+	if tags := parseFieldsParam(c.QueryParam("tags")); len(tags) > 0 {
+		domain = append(domain, []interface{}{models.TagField, "in", tags})
+	}
+	categories, err := models.NewRecordSet(db, models.ProductCategory{}).Search(domain, 0, 0, "complete_name")
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	ids := make([]uint, len(categories.Records))
+	for i, category := range categories.Records {
+		ids[i] = category.ID
+	}
+	tags, err := models.LoadTags(db, "product.category", ids)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	for i := range categories.Records {
+		categories.Records[i].Tags = tags[categories.Records[i].ID]
+	}
+	return c.JSON(http.StatusOK, categories.Records)
+}
+
+// Create adds a category
+func (h *ProductCategoryHandler) Create(c echo.Context) error {
+	req, db, err := h.requestDB(c)
+	if err != nil {
+		return err
+	}
+
+	var body ProductCategoryRequest
+	if err := c.Bind(&body); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+	}
+	if body.Name == nil || strings.TrimSpace(*body.Name) == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": errEmptyCategoryName.Error()})
+	}
+	category := &models.ProductCategory{Name: strings.TrimSpace(*body.Name)}
+	if body.ParentID != nil && *body.ParentID != 0 {
+		category.ParentID = body.ParentID
+	}
+	uid := uint(req.GetUserID())
+	category.CreateUID, category.WriteUID = uid, uid
+	if err := db.Create(category).Error; err != nil {
+		return categoryError(c, err)
+	}
+
+	req.Logger.InfoCtx(req.Context, "Product category %q created", category.CompleteName)
+	return c.JSON(http.StatusCreated, category)
+}
+
+// Update renames or moves a category; the complete names of its
+// descendants follow
+func (h *ProductCategoryHandler) Update(c echo.Context) error {
+	req, db, err := h.requestDB(c)
+	if err != nil {
+		return err
+	}
+	id, err := parseRecordID(c)
+	if err != nil {
+		return err
+	}
+
+	var body ProductCategoryRequest
+	if err := c.Bind(&body); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+	}
+
+	var category models.ProductCategory
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&category, id).Error; err != nil {
+			return err
+		}
+		if body.Name != nil {
+			if strings.TrimSpace(*body.Name) == "" {
+				return errEmptyCategoryName
+			}
+			category.Name = strings.TrimSpace(*body.Name)
+		}
+		if body.ParentID != nil {
+			category.ParentID = body.ParentID
+			if *body.ParentID == 0 {
+				category.ParentID = nil
+			}
+		}
+		category.WriteUID = uint(req.GetUserID())
+		return tx.Select("name", "parent_id", "complete_name", "write_uid").Updates(&category).Error
+	})
+	if err != nil {
+		return categoryError(c, err)
+	}
+	return c.JSON(http.StatusOK, category)
+}
+
+// Tree returns a category with its descendants, down to ?depth= levels (default 5)
+func (h *ProductCategoryHandler) Tree(c echo.Context) error {
+	_, db, err := h.requestDB(c)
+	if err != nil {
+		return err
+	}
+	id, err := parseRecordID(c)
+	if err != nil {
+		return err
+	}
+	depth, err := parseTreeDepth(c)
+	if err != nil {
+		return err
+	}
+
+	rows, err := models.LoadSubtree(db, "product_category", "parent_id", id, depth)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	if len(rows) == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Category not found"})
+	}
+
+	var categories []models.ProductCategory
+	if err := db.Select("id", "name").Where("id IN ?", treeIDs(rows)).Find(&categories).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	names := make(map[uint]string, len(categories))
+	for _, category := range categories {
+		names[category.ID] = category.Name
+	}
+	return c.JSON(http.StatusOK, buildTree(rows, names))
+}
+
+// RegisterProductCategoryRoutes mounts the category endpoints under
+// /api/product-categories; changing the categories requires the
+// product_categories.manage permission
+func RegisterProductCategoryRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewProductCategoryHandler(config)
+	manage := goodooHttp.PermissionProductCategoriesManage
+
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		{Method: "GET", Path: "/api/product-categories", Handler: handler.List, Auth: true, DB: true},
+		{Method: "POST", Path: "/api/product-categories", Handler: handler.Create, Auth: true, DB: true, Permission: manage},
+		{Method: "PUT", Path: "/api/product-categories/:id", Handler: handler.Update, Auth: true, DB: true, Permission: manage},
+		{Method: "GET", Path: "/api/product-categories/:id/tree", Handler: handler.Tree, Auth: true, DB: true},
+	})
+}
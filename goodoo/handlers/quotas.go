@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	goodooHttp "goodoo/http"
+	"goodoo/models"
+)
+
+// maxQuotaConsumers bounds the users listed by TopConsumers
+const maxQuotaConsumers = 200
+
+// quotaExceededResponse answers 429 to a user who owns as many records of
+// a model as their quota allows, with their count and limit
+func quotaExceededResponse(c echo.Context, err *models.QuotaExceededError) error {
+	return c.JSON(http.StatusTooManyRequests, map[string]interface{}{
+		"error": err.Error(),
+		"model": err.Model,
+		"count": err.Count,
+		"limit": err.Limit,
+	})
+}
+
+// QuotaHandler shows and adjusts the per-user quotas on owned records
+// (administrators only)
+type QuotaHandler struct {
+	Config *goodooHttp.RequestConfig
+}
+
+// NewQuotaHandler creates a new quota handler
+func NewQuotaHandler(config *goodooHttp.RequestConfig) *QuotaHandler {
+	return &QuotaHandler{Config: config}
+}
+
+// quotaPolicy returns the policy of the :model route parameter
+func quotaPolicy(c echo.Context) (models.QuotaPolicy, error) {
+	policy, exists := models.FindQuota(c.Param("model"))
+	if !exists {
+		return policy, echo.NewHTTPError(http.StatusNotFound, "No quota on model "+c.Param("model"))
+	}
+	return policy, nil
+}
+
+// List returns the models under quota with their limit in the database
+func (h *QuotaHandler) List(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	quotas := []map[string]interface{}{}
+	for _, policy := range models.QuotaPolicies() {
+		quotas = append(quotas, map[string]interface{}{
+			"model":         policy.Model,
+			"table":         policy.Table,
+			"owner_column":  policy.OwnerColumn,
+			"default_limit": policy.DefaultLimit,
+			"limit":         policy.Limit(req.GetDBName()),
+			"param":         policy.Param(),
+		})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"quotas": quotas})
+}
+
+// TopConsumers returns the users owning the most records of :model,
+// ?limit=20 of them
+func (h *QuotaHandler) TopConsumers(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	policy, err := quotaPolicy(c)
+	if err != nil {
+		return err
+	}
+	limit := 20
+	if l, err := strconv.Atoi(c.QueryParam("limit")); err == nil && l > 0 && l <= maxQuotaConsumers {
+		limit = l
+	}
+	consumers, err := models.TopQuotaConsumers(req.GetDB(), req.GetDBName(), policy, limit)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"model":     policy.Model,
+		"limit":     policy.Limit(req.GetDBName()),
+		"consumers": consumers,
+	})
+}
+
+// quotaLimitRequest is the body of the limit endpoints; a null limit goes
+// back to the default
+type quotaLimitRequest struct {
+	Limit *int `json:"limit"`
+}
+
+// SetLimit changes the limit of :model for every user without an
+// override: {"limit": 100}, 0 for no limit, null for the default
+func (h *QuotaHandler) SetLimit(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	policy, err := quotaPolicy(c)
+	if err != nil {
+		return err
+	}
+	var body quotaLimitRequest
+	if err := c.Bind(&body); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+	}
+	limit := policy.DefaultLimit
+	if body.Limit != nil {
+		limit = *body.Limit
+	}
+	if limit < 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "limit must be positive, or 0 for no limit"})
+	}
+	if err := models.SetParam(req.GetDB(), req.GetDBName(), uint(req.GetUserID()), policy.Param(), limit); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	req.Logger.InfoCtx(req.Context, "Quota of %s set to %d per user by %s", policy.Model, limit, req.GetLogin())
+	return c.JSON(http.StatusOK, map[string]interface{}{"model": policy.Model, "limit": limit})
+}
+
+// SetUserLimit overrides the limit of :model for the user :uid:
+// {"limit": 5000}, 0 for no limit, null to remove the override
+func (h *QuotaHandler) SetUserLimit(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	policy, err := quotaPolicy(c)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.ParseUint(c.Param("uid"), 10, 64)
+	if err != nil || uid == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid user ID")
+	}
+	var body quotaLimitRequest
+	if err := c.Bind(&body); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+	}
+	if body.Limit != nil && *body.Limit < 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "limit must be positive, or 0 for no limit"})
+	}
+	db := req.GetDB()
+	var count int64
+	if err := db.Model(&models.User{}).Where("id = ?", uid).Count(&count).Error; err != nil || count == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "User not found")
+	}
+	if err := models.SetUserQuotaLimit(db, policy.Model, uint(uid), body.Limit); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	limit, current, err := models.UserQuotaLimit(db, req.GetDBName(), policy, uint(uid))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	req.Logger.InfoCtx(req.Context, "Quota of %s for user %d set to %d by %s", policy.Model, uid, limit, req.GetLogin())
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"model":    policy.Model,
+		"user_id":  uid,
+		"count":    current,
+		"limit":    limit,
+		"override": body.Limit,
+	})
+}
+
+// Reconcile recounts the records of the users of every model under quota
+// now, rather than at the next scheduled reconciliation
+func (h *QuotaHandler) Reconcile(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	corrected, err := models.ReconcileQuotas(req.GetDB())
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	req.Logger.InfoCtx(req.Context, "Quota counters reconciled by %s: %v", req.GetLogin(), corrected)
+	return c.JSON(http.StatusOK, map[string]interface{}{"corrected": corrected})
+}
+
+// RegisterQuotaRoutes mounts the quota endpoints under /api/quotas,
+// which require the quotas.manage permission
+func RegisterQuotaRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewQuotaHandler(config)
+	manage := goodooHttp.PermissionQuotasManage
+
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		{Method: "GET", Path: "/api/quotas", Handler: handler.List, Auth: true, DB: true, Permission: manage},
+		{Method: "GET", Path: "/api/quotas/:model/consumers", Handler: handler.TopConsumers, Auth: true, DB: true, Permission: manage},
+		{Method: "PUT", Path: "/api/quotas/:model", Handler: handler.SetLimit, Auth: true, DB: true, Permission: manage},
+		{Method: "PUT", Path: "/api/quotas/:model/users/:uid", Handler: handler.SetUserLimit, Auth: true, DB: true, Permission: manage},
+		{Method: "POST", Path: "/api/quotas/reconcile", Handler: handler.Reconcile, Auth: true, DB: true, Permission: manage},
+	})
+}
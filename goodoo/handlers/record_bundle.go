@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	goodooHttp "goodoo/http"
+	"goodoo/models"
+	"gorm.io/gorm"
+)
+
+// Bundle returns a record with the records of its model's bundle
+// relations, their attachments, its history and a manifest, as one JSON
+// document to hand over, e.g. to support. ?inline=1 adds the content of
+// the clean attachments up to ?max_size= bytes each (1 MiB by default);
+// ?download=1 serves the bundle as a file.
+func (h *RecordsHandler) Bundle(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	model, err := h.resolveModel(c)
+	if err != nil {
+		return err
+	}
+	id, err := parseRecordID(c)
+	if err != nil {
+		return err
+	}
+
+	opts := models.BundleOptions{}
+	opts.Inline, _ = strconv.ParseBool(c.QueryParam("inline"))
+	if value := c.QueryParam("max_size"); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil || size <= 0 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "max_size must be a positive number of bytes"})
+		}
+		opts.InlineMax = size
+	}
+
+	bundle, err := model.ExportBundle(req.Context, req.GetEnv(), id, opts)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, "Record not found")
+	}
+	if err != nil {
+		req.Logger.WarningCtx(req.Context, "Bundle of %s %d failed: %v", model.Name, id, err)
+		return readErrorResponse(c, err)
+	}
+	if download, _ := strconv.ParseBool(c.QueryParam("download")); download {
+		c.Response().Header().Set(echo.HeaderContentDisposition,
+			fmt.Sprintf(`attachment; filename="%s-%d.bundle.json"`, model.Name, id))
+	}
+	return c.JSON(http.StatusOK, bundle)
+}
+
+// BundleImport recreates a bundle exported from another database in this
+// one, for administrators: records are matched by external id or created,
+// relations remapped to the new ids, and what could not be imported is
+// reported under "skipped"
+func (h *RecordsHandler) BundleImport(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	model, err := h.resolveModel(c)
+	if err != nil {
+		return err
+	}
+	if !isAdmin(req) {
+		return echo.NewHTTPError(http.StatusForbidden, "Only administrators can import bundles")
+	}
+
+	var bundle models.RecordBundle
+	if err := c.Bind(&bundle); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid bundle"})
+	}
+	if bundle.Record.Model != model.Name {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("The bundle is of a %s record, not %s", bundle.Record.Model, model.Name),
+		})
+	}
+
+	result, err := models.ImportBundle(req.GetEnv(), &bundle)
+	if errors.Is(err, models.ErrInvalidBundle) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	if err != nil {
+		req.Logger.ErrorCtx(req.Context, "Import of a %s bundle failed: %v", model.Name, err)
+		return recordErrorResponse(c, err)
+	}
+	req.Logger.InfoCtx(req.Context, "User %d imported %s %d from %s as %d: %d created, %d matched, %d skipped",
+		req.GetUserID(), model.Name, bundle.Record.ID, bundle.Manifest.Database, result.ID,
+		len(result.Created), len(result.Matched), len(result.Skipped))
+	return c.JSON(http.StatusCreated, result)
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	goodooHttp "goodoo/http"
+	"goodoo/models"
+)
+
+// defaultHistoryLimit is the page size of a record history
+const defaultHistoryLimit = 50
+
+// History returns the changes of a record from the audit log, newest first:
+// ?field=amount keeps the entries changing a field, ?offset= and ?limit=
+// page them and ?window=10m sets how close the writes of a user must be to
+// collapse ("0s" keeps each one). ?compact=1 returns the last change of
+// each field instead. The history of a deleted record stays readable.
+func (h *RecordsHandler) History(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	model, err := h.resolveModel(c)
+	if err != nil {
+		return err
+	}
+	id, err := parseRecordID(c)
+	if err != nil {
+		return err
+	}
+	env := req.GetEnv()
+
+	if compact, _ := strconv.ParseBool(c.QueryParam("compact")); compact {
+		fields, err := model.LastChanges(env, id)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		}
+		if len(fields) == 0 && !recordExists(req, model, id) {
+			return echo.NewHTTPError(http.StatusNotFound, "Record not found")
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{"fields": fields})
+	}
+
+	opts := models.HistoryOptions{Field: c.QueryParam("field"), Limit: defaultHistoryLimit}
+	if value := c.QueryParam("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > 500 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "limit must be between 1 and 500"})
+		}
+		opts.Limit = limit
+	}
+	if value := c.QueryParam("offset"); value != "" {
+		offset, err := strconv.Atoi(value)
+		if err != nil || offset < 0 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "offset must be a positive integer"})
+		}
+		opts.Offset = offset
+	}
+	if value := c.QueryParam("window"); value != "" {
+		window, err := time.ParseDuration(value)
+		if err != nil || window < 0 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "window must be a duration such as 5m"})
+		}
+		if window == 0 {
+			window = -1
+		}
+		opts.Window = window
+	}
+
+	entries, total, err := model.History(env, id, opts)
+	if err != nil {
+		return readErrorResponse(c, err)
+	}
+	if total == 0 && !recordExists(req, model, id) {
+		return echo.NewHTTPError(http.StatusNotFound, "Record not found")
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"entries": entries,
+		"total":   total,
+		"offset":  opts.Offset,
+		"limit":   opts.Limit,
+	})
+}
+
+// recordExists tells whether a record of the model exists
+func recordExists(req *goodooHttp.Request, model *models.ModelDefinition, id uint) bool {
+	var count int64
+	req.GetDB().Table(model.TableName).Where("id = ?", id).Count(&count)
+	return count > 0
+}
@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"goodoo/expr"
+	goodooHttp "goodoo/http"
+	"goodoo/models"
+	"gorm.io/gorm"
+)
+
+// RecordRuleHandler manages the record rules of the field models
+type RecordRuleHandler struct {
+	Config *goodooHttp.RequestConfig
+}
+
+// NewRecordRuleHandler creates a new record rule handler
+func NewRecordRuleHandler(config *goodooHttp.RequestConfig) *RecordRuleHandler {
+	return &RecordRuleHandler{Config: config}
+}
+
+// loadRecordRule fetches the rule named by the :id route parameter
+func loadRecordRule(c echo.Context, db *gorm.DB) (*models.RecordRule, error) {
+	id, err := parseRecordID(c)
+	if err != nil {
+		return nil, err
+	}
+	var rule models.RecordRule
+	if err := db.First(&rule, id).Error; err != nil {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Record rule not found")
+	}
+	return &rule, nil
+}
+
+// saveRecordRule validates and saves a rule, then drops the cached rules
+// of the database. An invalid domain is answered with its located errors.
+func saveRecordRule(req *goodooHttp.Request, rule *models.RecordRule) error {
+	if err := models.ValidateRecordRule(req.GetEnv(), rule); err != nil {
+		var exprErrs expr.Errors
+		if errors.As(err, &exprErrs) {
+			return echo.NewHTTPError(http.StatusBadRequest, map[string]interface{}{"error": "invalid domain: " + err.Error(), "errors": exprErrs})
+		}
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	rule.WriteUID = uint(req.GetUserID())
+
+	db := req.GetDB()
+	var err error
+	if rule.ID == 0 {
+		// Select all columns so an inactive rule is not made active by a default
+		err = db.Select("*").Omit("id").Create(rule).Error
+	} else {
+		err = db.Save(rule).Error
+	}
+	if err != nil {
+		return err
+	}
+	models.InvalidateRecordRules(req.GetDBName())
+	return nil
+}
+
+// List returns the record rules, of one model with ?model=
+func (h *RecordRuleHandler) List(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	query := req.GetDB().Order("model, id")
+	if model := c.QueryParam("model"); model != "" {
+		query = query.Where("model = ?", model)
+	}
+	var rules []models.RecordRule
+	if err := query.Find(&rules).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"rules": rules})
+}
+
+// Create adds a record rule
+func (h *RecordRuleHandler) Create(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	rule := models.RecordRule{Active: true}
+	if err := c.Bind(&rule); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request format: "+err.Error())
+	}
+	rule.ID = 0
+	if err := saveRecordRule(req, &rule); err != nil {
+		return err
+	}
+	req.Logger.InfoCtx(req.Context, "Record rule %s (%d) of %s created by %s", rule.Name, rule.ID, rule.Model, req.GetLogin())
+	return c.JSON(http.StatusCreated, map[string]interface{}{"rule": rule})
+}
+
+// Update replaces the settings of a record rule; its model cannot change
+func (h *RecordRuleHandler) Update(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	rule, err := loadRecordRule(c, req.GetDB())
+	if err != nil {
+		return err
+	}
+	id, model := rule.ID, rule.Model
+	if err := c.Bind(rule); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request format: "+err.Error())
+	}
+	if rule.Model != model {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "model cannot be changed"})
+	}
+	rule.ID = id
+	if err := saveRecordRule(req, rule); err != nil {
+		return err
+	}
+	req.Logger.InfoCtx(req.Context, "Record rule %s (%d) of %s updated by %s", rule.Name, rule.ID, rule.Model, req.GetLogin())
+	return c.JSON(http.StatusOK, map[string]interface{}{"rule": rule})
+}
+
+// Delete removes a record rule
+func (h *RecordRuleHandler) Delete(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	rule, err := loadRecordRule(c, db)
+	if err != nil {
+		return err
+	}
+	if err := db.Delete(rule).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	models.InvalidateRecordRules(req.GetDBName())
+	req.Logger.InfoCtx(req.Context, "Record rule %s (%d) of %s deleted by %s", rule.Name, rule.ID, rule.Model, req.GetLogin())
+	return c.JSON(http.StatusOK, map[string]interface{}{"success": true})
+}
+
+// RegisterRecordRuleRoutes mounts the record rule endpoints under
+// /api/record-rules, which require the record_rules.manage permission
+func RegisterRecordRuleRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewRecordRuleHandler(config)
+	manage := goodooHttp.PermissionRecordRulesManage
+
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		{Method: "GET", Path: "/api/record-rules", Handler: handler.List, Auth: true, DB: true, Permission: manage},
+		{Method: "POST", Path: "/api/record-rules", Handler: handler.Create, Auth: true, DB: true, Permission: manage},
+		{Method: "PUT", Path: "/api/record-rules/:id", Handler: handler.Update, Auth: true, DB: true, Permission: manage},
+		{Method: "DELETE", Path: "/api/record-rules/:id", Handler: handler.Delete, Auth: true, DB: true, Permission: manage},
+	})
+}
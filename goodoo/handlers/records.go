@@ -0,0 +1,998 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"goodoo/database"
+	"goodoo/fields"
+	goodooHttp "goodoo/http"
+	"goodoo/models"
+	"goodoo/upload"
+	"gorm.io/gorm"
+)
+
+// RecordsHandler exposes generic CRUD over field-defined models
+type RecordsHandler struct {
+	Config *goodooHttp.RequestConfig
+}
+
+// NewRecordsHandler creates a new records handler
+func NewRecordsHandler(config *goodooHttp.RequestConfig) *RecordsHandler {
+	return &RecordsHandler{Config: config}
+}
+
+// resolveModel looks up the model named in the route in the request database's registry
+func (h *RecordsHandler) resolveModel(c echo.Context) (*models.ModelDefinition, error) {
+	name := c.Param("model")
+	model, exists := models.RegistryForDB(goodooHttp.GetGoodooRequest(c).GetDBName()).GetModel(name)
+	if !exists {
+		return nil, echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("Model %s not found", name))
+	}
+	if model.Abstract {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, (&models.AbstractModelError{Model: name}).Error())
+	}
+	return model, nil
+}
+
+// parseRecordID parses the :id route parameter
+func parseRecordID(c echo.Context) (uint, error) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil || id == 0 {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, "Invalid record ID")
+	}
+	return uint(id), nil
+}
+
+// bodyValues returns the decoded JSON body, never nil
+func bodyValues(req *goodooHttp.Request) map[string]interface{} {
+	return req.ParamsFromBody()
+}
+
+// recordErrorStatus maps an ORM error to an HTTP status
+func recordErrorStatus(err error) int {
+	var accessErr *models.AccessError
+	if errors.As(err, &accessErr) {
+		return http.StatusForbidden
+	}
+	var ruleErr *models.RuleError
+	if errors.As(err, &ruleErr) {
+		return http.StatusForbidden
+	}
+	var concurrencyErr *models.ConcurrencyError
+	if errors.As(err, &concurrencyErr) {
+		return http.StatusConflict
+	}
+	var restrictErr *models.RestrictError
+	if errors.As(err, &restrictErr) {
+		return http.StatusConflict
+	}
+	var duplicateErr *models.DuplicateError
+	if errors.As(err, &duplicateErr) {
+		return http.StatusConflict
+	}
+	var constraintErr *models.ConstraintError
+	if errors.As(err, &constraintErr) {
+		if constraintErr.Kind == models.ConstraintUnique {
+			return http.StatusConflict
+		}
+		return http.StatusUnprocessableEntity
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return http.StatusNotFound
+	}
+	var timeoutErr *database.TimeoutError
+	if errors.As(err, &timeoutErr) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadRequest
+}
+
+// recordErrorResponse answers a failed write; conflicts carry the current
+// version of the record, the relation restricting a delete under
+// "restricted_by", the records a blocking duplicate rule matched under
+// "duplicates", or the violated model constraint and the record holding
+// the same values under "constraint"
+func recordErrorResponse(c echo.Context, err error) error {
+	body := map[string]interface{}{"error": err.Error()}
+	var concurrencyErr *models.ConcurrencyError
+	if errors.As(err, &concurrencyErr) {
+		body["version"] = concurrencyErr.Version
+		c.Response().Header().Set("ETag", `"`+concurrencyErr.Version+`"`)
+	}
+	var restrictErr *models.RestrictError
+	if errors.As(err, &restrictErr) {
+		body["restricted_by"] = restrictErr
+	}
+	var duplicateErr *models.DuplicateError
+	if errors.As(err, &duplicateErr) {
+		body["duplicates"] = duplicateErr.Matches
+	}
+	var constraintErr *models.ConstraintError
+	if errors.As(err, &constraintErr) {
+		body["constraint"] = constraintErr
+	}
+	var timeoutErr *database.TimeoutError
+	if errors.As(err, &timeoutErr) {
+		body["error"] = goodooHttp.TimeoutMessage(timeoutErr)
+		body["timeout"] = timeoutErr.Kind
+	}
+	return c.JSON(recordErrorStatus(err), body)
+}
+
+// readErrorResponse answers a failed search or read; refused field names
+// are listed under "fields", and a query cut by a database timeout is
+// answered 503
+func readErrorResponse(c echo.Context, err error) error {
+	var timeoutErr *database.TimeoutError
+	if errors.As(err, &timeoutErr) {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": goodooHttp.TimeoutMessage(timeoutErr), "timeout": timeoutErr.Kind})
+	}
+	var fieldErr *models.FieldNameError
+	if errors.As(err, &fieldErr) {
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{"error": err.Error(), "fields": fieldErr.Fields})
+	}
+	var identifierErr *models.IdentifierError
+	if errors.As(err, &identifierErr) && identifierErr.Kind == "field" {
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{"error": err.Error(), "fields": []string{identifierErr.Name}})
+	}
+	return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+}
+
+// ifMatchVersion returns the record version of the If-Match header, empty
+// when the header is absent or "*"
+func ifMatchVersion(c echo.Context) string {
+	value := strings.TrimSpace(c.Request().Header.Get("If-Match"))
+	if value == "*" {
+		return ""
+	}
+	return strings.Trim(strings.TrimPrefix(value, "W/"), `"`)
+}
+
+// parseFieldMask splits the X-Field-Mask header into field names, or
+// returns nil when there is none. A path such as meta.key is masked by its
+// field.
+func parseFieldMask(c echo.Context) []string {
+	header := c.Request().Header.Get("X-Field-Mask")
+	if strings.TrimSpace(header) == "" {
+		return nil
+	}
+	names := []string{}
+	for _, path := range parseFieldsParam(header) {
+		name, _, _ := strings.Cut(path, ".")
+		names = append(names, name)
+	}
+	return names
+}
+
+// parseFieldsParam splits a comma-separated fields parameter
+func parseFieldsParam(value string) []string {
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// addDisplay adds to each record, under "display", its values formatted in
+// the user's language when the request asks for them with ?display=1
+func addDisplay(c echo.Context, env *models.Environment, model *models.ModelDefinition, records []map[string]interface{}) error {
+	if display, _ := strconv.ParseBool(c.QueryParam("display")); !display {
+		return nil
+	}
+	for _, record := range records {
+		values, err := model.Display(env, record)
+		if err != nil {
+			return err
+		}
+		record["display"] = values
+	}
+	return nil
+}
+
+// responseFormat returns the format a list is asked in: ?format=csv or
+// json, otherwise text/csv when the Accept header lists it before
+// application/json, otherwise json
+func responseFormat(c echo.Context) (string, error) {
+	switch format := strings.ToLower(c.QueryParam("format")); format {
+	case "csv", "json":
+		return format, nil
+	case "":
+	default:
+		return "", echo.NewHTTPError(http.StatusBadRequest, "format must be csv or json")
+	}
+	for _, accepted := range strings.Split(c.Request().Header.Get(echo.HeaderAccept), ",") {
+		mediaType, _, _ := strings.Cut(strings.TrimSpace(accepted), ";")
+		switch strings.ToLower(strings.TrimSpace(mediaType)) {
+		case "text/csv":
+			return "csv", nil
+		case echo.MIMEApplicationJSON:
+			return "json", nil
+		}
+	}
+	return "json", nil
+}
+
+// startCSV sets the headers of a CSV response named after the model and
+// writes its status; the paging values the JSON envelope would hold go in
+// X-Total-Count, X-Offset and X-Limit
+func startCSV(c echo.Context, model *models.ModelDefinition, total int64, offset, limit int) {
+	header := c.Response().Header()
+	header.Set(echo.HeaderContentType, "text/csv; charset=utf-8")
+	header.Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", model.Name+".csv"))
+	header.Set("X-Total-Count", strconv.FormatInt(total, 10))
+	header.Set("X-Offset", strconv.Itoa(offset))
+	header.Set("X-Limit", strconv.Itoa(limit))
+	c.Response().WriteHeader(http.StatusOK)
+}
+
+// List searches records: ?domain=[...]&fields=a,b,partner_id.name&offset=0&limit=80&order=name&display=1.
+// Without limit, pages hold the list.page_size preference of the user.
+// ?aggregates=amount_total:sum,id:count, or a JSON object with a group_by
+// field, adds under "aggregates" the totals of the whole domain, not of
+// the page (see models.ParseAggregates). On taggable models, ?facets=tags
+// adds under "facets" the number of records of the domain by tag.
+//
+// With ?format=csv or Accept: text/csv, the records are written as CSV
+// in their export representation, with the field labels as headers on
+// ?labels=1, and the total in the X-Total-Count header. CSV pages hold up
+// to the web.csv.max_rows parameter. Without limit nor offset, all the
+// records are streamed instead (see streamCSV). With aggregates, the CSV
+// holds the aggregates instead of the records.
+//
+// ?filter_id= applies a saved filter (see FiltersHandler): its domain is
+// added to the domain, and its sort and columns are used without order
+// and fields. Without domain nor filter_id, the default filter of the user
+// for the model applies, unless ?no_default=1. The applied filter is
+// described under "filter", with warnings for the parts naming fields
+// that no longer exist.
+func (h *RecordsHandler) List(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	model, err := h.resolveModel(c)
+	if err != nil {
+		return err
+	}
+	format, err := responseFormat(c)
+	if err != nil {
+		return err
+	}
+
+	var domain models.Domain
+	if raw := c.QueryParam("domain"); raw != "" {
+		if err := fields.DecodeJSON([]byte(raw), &domain); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid domain: " + err.Error()})
+		}
+	}
+
+	order, fieldNames := c.QueryParam("order"), parseFieldsParam(c.QueryParam("fields"))
+	filter, view, err := h.listFilter(c, model)
+	if err != nil {
+		return err
+	}
+	if filter != nil {
+		domain = append(view.Domain, domain...)
+		if order == "" {
+			order = view.Sort
+		}
+		if len(fieldNames) == 0 {
+			fieldNames = view.Columns
+		}
+		if len(view.Warnings) > 0 {
+			c.Response().Header().Set("X-Filter-Warnings", strings.Join(view.Warnings, "; "))
+		}
+	}
+
+	offset, _ := strconv.Atoi(c.QueryParam("offset"))
+	limit := models.GetPrefInt(req.GetDB(), uint(req.GetUserID()), models.PrefListPageSize, 80)
+	maxLimit := 1000
+	if format == "csv" {
+		maxLimit = models.GetParamInt(req.GetDBName(), models.ParamCSVMaxRows, models.DefaultCSVMaxRows)
+		limit = maxLimit
+	}
+	explicitLimit := false
+	if l, err := strconv.Atoi(c.QueryParam("limit")); err == nil && l > 0 && l <= maxLimit {
+		limit, explicitLimit = l, true
+	} else if err == nil && l > maxLimit && format == "csv" {
+		return csvTooLarge(c, maxLimit)
+	}
+
+	env := req.GetEnv()
+	total, err := model.SearchCount(env, domain)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	if format == "csv" && !explicitLimit && offset > 0 && total-int64(offset) > int64(maxLimit) {
+		return csvTooLarge(c, maxLimit)
+	}
+
+	if raw := c.QueryParam("aggregates"); raw != "" && format == "csv" {
+		specs, groupBy, warnings := models.ParseAggregates(raw)
+		aggregates, err := model.Aggregate(env, domain, specs, groupBy)
+		if err != nil {
+			return readErrorResponse(c, err)
+		}
+		if warnings = append(warnings, aggregates.Warnings...); len(warnings) > 0 {
+			c.Response().Header().Set("X-Aggregate-Warnings", strings.Join(warnings, "; "))
+		}
+		startCSV(c, model, total, offset, limit)
+		if err := aggregates.WriteCSV(c.Response(), specs); err != nil {
+			// The status is sent already; the truncated file is all we can do
+			req.Logger.ErrorCtx(req.Context, "Failed to write the aggregates of %s as CSV: %v", model.Name, err)
+		}
+		return nil
+	}
+
+	if format == "csv" && !explicitLimit && offset <= 0 {
+		return streamCSV(c, env, model, domain, fieldNames, order, total)
+	}
+
+	ids, err := model.Search(env, domain, offset, limit, order)
+	if err != nil {
+		return readErrorResponse(c, err)
+	}
+
+	records, err := model.Read(env, ids, fieldNames)
+	if err != nil {
+		return readErrorResponse(c, err)
+	}
+
+	if format == "csv" {
+		labels, _ := strconv.ParseBool(c.QueryParam("labels"))
+		startCSV(c, model, total, offset, limit)
+		if err := model.WriteCSV(req.Context, env, c.Response(), records, model.CSVColumns(env, fieldNames), labels); err != nil {
+			req.Logger.ErrorCtx(req.Context, "Failed to write %s as CSV: %v", model.Name, err)
+		}
+		return nil
+	}
+
+	if err := addDisplay(c, env, model, records); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	response := map[string]interface{}{
+		"records": records,
+		"total":   total,
+		"offset":  offset,
+		"limit":   limit,
+	}
+	if filter != nil {
+		response["filter"] = map[string]interface{}{"id": filter.ID, "name": filter.Name, "warnings": view.Warnings}
+	}
+	if raw := c.QueryParam("aggregates"); raw != "" {
+		specs, groupBy, warnings := models.ParseAggregates(raw)
+		aggregates, err := model.Aggregate(env, domain, specs, groupBy)
+		if err != nil {
+			return readErrorResponse(c, err)
+		}
+		aggregates.Warnings = append(warnings, aggregates.Warnings...)
+		response["aggregates"] = aggregates
+	}
+	if c.QueryParam("facets") == "tags" {
+		facets, err := model.TagFacets(env, domain)
+		if err != nil {
+			return readErrorResponse(c, err)
+		}
+		response["facets"] = map[string]interface{}{"tags": facets}
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// Grouped returns the records of a domain grouped for a kanban board:
+// ?group_by= a selection, many2one or tag field, with the first ?limit=
+// records of each group (10 by default) in ?order=, and the number of
+// records of each group. ?aggregates=amount_total:sum adds the aggregates
+// of each group, and ?empty_groups=1 the options of a selection field no
+// record has. The domain of each group pages through the rest of its
+// records with List.
+func (h *RecordsHandler) Grouped(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	model, err := h.resolveModel(c)
+	if err != nil {
+		return err
+	}
+
+	query := models.GroupedQuery{
+		GroupBy: strings.TrimSpace(c.QueryParam("group_by")),
+		Order:   c.QueryParam("order"),
+		Fields:  parseFieldsParam(c.QueryParam("fields")),
+	}
+	if query.GroupBy == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "group_by is required"})
+	}
+	if raw := c.QueryParam("domain"); raw != "" {
+		if err := fields.DecodeJSON([]byte(raw), &query.Domain); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid domain: " + err.Error()})
+		}
+	}
+	if raw := c.QueryParam("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit <= 0 || limit > models.MaxGroupLimit {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("limit must be between 1 and %d", models.MaxGroupLimit)})
+		}
+		query.Limit = limit
+	}
+	query.EmptyGroups, _ = strconv.ParseBool(c.QueryParam("empty_groups"))
+	var warnings []string
+	if raw := c.QueryParam("aggregates"); raw != "" {
+		query.Aggregates, _, warnings = models.ParseAggregates(raw)
+	}
+
+	env := req.GetEnv()
+	result, err := model.ReadGrouped(env, query)
+	if err != nil {
+		return readErrorResponse(c, err)
+	}
+	for _, group := range result.Groups {
+		if err := addDisplay(c, env, model, group.Records); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+	}
+	result.Warnings = append(warnings, result.Warnings...)
+	return c.JSON(http.StatusOK, result)
+}
+
+// listFilter returns the saved filter a list applies and what the user
+// may apply of it: the one of ?filter_id=, otherwise without ?domain= the
+// default filter of the user unless ?no_default=1, otherwise none
+func (h *RecordsHandler) listFilter(c echo.Context, model *models.ModelDefinition) (*models.SavedFilter, *models.FilterView, error) {
+	req := goodooHttp.GetGoodooRequest(c)
+	env := req.GetEnv()
+	var filter *models.SavedFilter
+	if raw := c.QueryParam("filter_id"); raw != "" {
+		id, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil || id == 0 {
+			return nil, nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid filter_id")
+		}
+		if filter, err = models.GetFilter(env, model.Name, uint(id)); err != nil {
+			if errors.Is(err, models.ErrFilterNotFound) {
+				return nil, nil, echo.NewHTTPError(http.StatusNotFound, err.Error())
+			}
+			return nil, nil, err
+		}
+	} else if noDefault, _ := strconv.ParseBool(c.QueryParam("no_default")); c.QueryParam("domain") == "" && !noDefault {
+		var err error
+		if filter, err = models.DefaultFilter(env, model.Name); err != nil {
+			req.Logger.WarningCtx(req.Context, "Failed to read the default filter of %s: %v", model.Name, err)
+			return nil, nil, nil
+		}
+	}
+	if filter == nil {
+		return nil, nil, nil
+	}
+	view, err := model.FilterView(env, filter)
+	if err != nil {
+		return nil, nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Filter %d cannot be applied: %v", filter.ID, err))
+	}
+	return filter, view, nil
+}
+
+// streamCSV writes every record of the domain as CSV while they are
+// read, through a server-side cursor (see models.Stream), so that exports
+// of millions of records use flat memory. Once the CSV started, an error,
+// e.g. a stream running past base.stream_max_seconds, can only cut it
+// short: it is sent in the X-Export-Error trailer.
+func streamCSV(c echo.Context, env *models.Environment, model *models.ModelDefinition, domain models.Domain, fieldNames []string, order string, total int64) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	labels, _ := strconv.ParseBool(c.QueryParam("labels"))
+	var writer *models.CSVWriter
+	start := func() error {
+		if writer != nil {
+			return nil
+		}
+		c.Response().Header().Set("Trailer", "X-Export-Error")
+		startCSV(c, model, total, 0, int(total))
+		var err error
+		writer, err = model.NewCSVWriter(env, c.Response(), model.CSVColumns(env, fieldNames), labels)
+		return err
+	}
+
+	err := model.Stream(req.Context, env, domain, fieldNames, models.StreamOptions{Order: order}, func(records []map[string]interface{}) error {
+		if err := start(); err != nil {
+			return err
+		}
+		if err := writer.Write(req.Context, records); err != nil {
+			return err
+		}
+		c.Response().Flush()
+		return nil
+	})
+	if err != nil && writer == nil {
+		return readErrorResponse(c, err)
+	}
+	if err == nil {
+		if err = start(); err == nil {
+			err = writer.Flush()
+		}
+	}
+	if err != nil {
+		// The status is sent already; the truncated file and the trailer are all we can do
+		c.Response().Header().Set("X-Export-Error", err.Error())
+		req.Logger.ErrorCtx(req.Context, "Failed to stream %s as CSV: %v", model.Name, err)
+	}
+	return nil
+}
+
+// csvTooLarge refuses a CSV response of more than maxRows records
+func csvTooLarge(c echo.Context, maxRows int) error {
+	return c.JSON(http.StatusBadRequest, map[string]interface{}{
+		"error":    fmt.Sprintf("CSV responses hold at most %d records: read them page by page with offset and limit", maxRows),
+		"max_rows": maxRows,
+	})
+}
+
+// Fields describes the fields of a model visible to the user
+func (h *RecordsHandler) Fields(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	model, err := h.resolveModel(c)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, model.GetFieldsInfo(req.GetEnv()))
+}
+
+// contextEnv returns env with the context values of the ?context= JSON
+// object, which override the session context for this call
+func contextEnv(c echo.Context, env *models.Environment) (*models.Environment, error) {
+	raw := c.QueryParam("context")
+	if raw == "" {
+		return env, nil
+	}
+	var values map[string]interface{}
+	if err := fields.DecodeJSON([]byte(raw), &values); err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "context must be a JSON object")
+	}
+	return env.WithContext(values), nil
+}
+
+// Defaults returns the values a new record would get without values:
+// static defaults and context defaults (like Odoo's default_get)
+func (h *RecordsHandler) Defaults(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	model, err := h.resolveModel(c)
+	if err != nil {
+		return err
+	}
+	env, err := contextEnv(c, req.GetEnv())
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, model.DefaultValues(env))
+}
+
+// Get reads a single record, formatted for display with ?display=1
+func (h *RecordsHandler) Get(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	model, err := h.resolveModel(c)
+	if err != nil {
+		return err
+	}
+	id, err := parseRecordID(c)
+	if err != nil {
+		return err
+	}
+
+	env := req.GetEnv()
+	records, err := model.Read(env, []uint{id}, parseFieldsParam(c.QueryParam("fields")))
+	if err != nil {
+		return readErrorResponse(c, err)
+	}
+	return recordResponse(c, env, model, records, http.StatusOK)
+}
+
+// recordResponse answers with the single record read, formatted for
+// display with ?display=1, and its version as ETag. Get and the writes
+// answering with the record written share it so both bodies are the same.
+func recordResponse(c echo.Context, env *models.Environment, model *models.ModelDefinition, records []map[string]interface{}, status int) error {
+	if len(records) == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "Record not found")
+	}
+	if err := addDisplay(c, env, model, records); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	if writeDate, ok := records[0]["write_date"].(time.Time); ok {
+		c.Response().Header().Set("ETag", `"`+models.RecordVersion(writeDate)+`"`)
+	}
+	return c.JSON(status, records[0])
+}
+
+// readWritten reads the record just written within the transaction of the
+// write, with the fields of ?fields= as Get does, unless the request
+// prefers a minimal response (see goodooHttp.ReturnPreference). A record
+// the user cannot read back, say moved out of their record rules, does not
+// fail the write: nil is returned and the response falls back to minimal.
+func readWritten(c echo.Context, env *models.Environment, model *models.ModelDefinition, id uint, minimal bool) []map[string]interface{} {
+	if minimal {
+		return nil
+	}
+	records, err := model.Read(env, []uint{id}, parseFieldsParam(c.QueryParam("fields")))
+	if err != nil || len(records) == 0 {
+		if err != nil {
+			model.Logger.Warning("Reading back %s(%d) after a write failed: %v", model.Name, id, err)
+		}
+		c.Response().Header().Set(goodooHttp.HeaderPreferenceApplied, "return="+goodooHttp.ReturnMinimal)
+		return nil
+	}
+	return records
+}
+
+// Create creates a record from the JSON body and answers with it as Get
+// would, or with its id under Prefer: return=minimal. The records matching
+// a warning duplicate rule are returned under "duplicates" in the minimal
+// response, and their ids in an X-Duplicates header otherwise.
+func (h *RecordsHandler) Create(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	model, err := h.resolveModel(c)
+	if err != nil {
+		return err
+	}
+
+	env, err := contextEnv(c, req.GetEnv())
+	if err != nil {
+		return err
+	}
+	vals := bodyValues(req)
+	model.ParseLocalized(env, vals)
+	minimal := goodooHttp.PreferMinimal(c)
+	var id uint
+	var records []map[string]interface{}
+	err = env.Transaction(func(tx *gorm.DB) error {
+		if err := upload.ResolveValues(tx, req.Session.SID, model, vals); err != nil {
+			return err
+		}
+		id, err = model.Create(env.WithDB(tx), vals)
+		if err != nil {
+			return err
+		}
+		records = readWritten(c, req.GetEnv().WithDB(tx), model, id, minimal)
+		return nil
+	})
+	if err != nil {
+		req.Logger.WarningCtx(req.Context, "Create on %s failed: %v", model.Name, err)
+		return recordErrorResponse(c, err)
+	}
+
+	// Records matching a warning duplicate rule are created, and reported
+	warnings := duplicateWarnings(env, model, vals, id)
+	if records != nil {
+		if len(warnings) > 0 {
+			ids := make([]string, len(warnings))
+			for i, warning := range warnings {
+				ids[i] = strconv.FormatUint(uint64(warning.ID), 10)
+			}
+			c.Response().Header().Set("X-Duplicates", strings.Join(ids, ","))
+		}
+		return recordResponse(c, req.GetEnv(), model, records, http.StatusCreated)
+	}
+	response := map[string]interface{}{"id": id}
+	if len(warnings) > 0 {
+		response["duplicates"] = warnings
+	}
+	return c.JSON(http.StatusCreated, response)
+}
+
+// maxNameSearchLimit bounds the suggestions of NameSearch
+const maxNameSearchLimit = 100
+
+// NameSearch suggests records for a relational field:
+// ?name=acme&domain=[...]&limit=8 returns {"results": [[id, "Acme"], ...],
+// "can_create": true}. can_create tells the client to offer "Create ..."
+// when the model allows quick create and no record is named exactly name.
+func (h *RecordsHandler) NameSearch(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	model, err := h.resolveModel(c)
+	if err != nil {
+		return err
+	}
+
+	var domain models.Domain
+	if raw := c.QueryParam("domain"); raw != "" {
+		if err := fields.DecodeJSON([]byte(raw), &domain); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid domain: " + err.Error()})
+		}
+	}
+	limit := 8
+	if l, err := strconv.Atoi(c.QueryParam("limit")); err == nil && l > 0 && l <= maxNameSearchLimit {
+		limit = l
+	}
+	env, err := contextEnv(c, req.GetEnv())
+	if err != nil {
+		return err
+	}
+
+	name := strings.TrimSpace(c.QueryParam("name"))
+	results, exact, err := model.NameSearch(env, name, domain, limit)
+	if err != nil {
+		return readErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"results":    results,
+		"can_create": model.QuickCreate && name != "" && !exact,
+	})
+}
+
+// QuickCreate creates a record from the name typed in a relational field:
+// {"name": "Jane Doe <jane@example.com>", "context": {"default_categ_id": 3}}.
+// It answers [id, display_name], or 405 on models without quick create.
+func (h *RecordsHandler) QuickCreate(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	model, err := h.resolveModel(c)
+	if err != nil {
+		return err
+	}
+	if !model.QuickCreate {
+		return echo.NewHTTPError(http.StatusMethodNotAllowed, models.ErrQuickCreateDisabled.Error())
+	}
+
+	var body struct {
+		Name    string                 `json:"name"`
+		Context map[string]interface{} `json:"context"`
+	}
+	if err := c.Bind(&body); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+	}
+	env := req.GetEnv()
+	if len(body.Context) > 0 {
+		env = env.WithContext(body.Context)
+	}
+
+	var id uint
+	var displayName string
+	err = env.Transaction(func(tx *gorm.DB) error {
+		id, displayName, err = model.NameCreate(env.WithDB(tx), body.Name)
+		return err
+	})
+	if err != nil {
+		req.Logger.WarningCtx(req.Context, "Quick create on %s failed: %v", model.Name, err)
+		return c.JSON(recordErrorStatus(err), map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusCreated, []interface{}{id, displayName})
+}
+
+// Update writes the JSON body values to a record and answers with it as
+// Get would, its new ETag included, or with a success flag under Prefer:
+// return=minimal. With an If-Match header holding the ETag of a read, the
+// write fails with 409 when the record changed since.
+func (h *RecordsHandler) Update(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	model, err := h.resolveModel(c)
+	if err != nil {
+		return err
+	}
+	id, err := parseRecordID(c)
+	if err != nil {
+		return err
+	}
+
+	env := req.GetEnv()
+	vals := bodyValues(req)
+	model.ParseLocalized(env, vals)
+	minimal := goodooHttp.PreferMinimal(c)
+	var records []map[string]interface{}
+	err = env.Transaction(func(tx *gorm.DB) error {
+		if version := ifMatchVersion(c); version != "" {
+			if err := model.CheckVersion(env.WithDB(tx), id, version); err != nil {
+				return err
+			}
+		}
+		if err := upload.ResolveValues(tx, req.Session.SID, model, vals); err != nil {
+			return err
+		}
+		if err := model.Write(env.WithDB(tx), []uint{id}, vals); err != nil {
+			return err
+		}
+		records = readWritten(c, env.WithDB(tx), model, id, minimal)
+		return nil
+	})
+	if err != nil {
+		req.Logger.WarningCtx(req.Context, "Write on %s(%d) failed: %v", model.Name, id, err)
+		return recordErrorResponse(c, err)
+	}
+
+	if records != nil {
+		return recordResponse(c, env, model, records, http.StatusOK)
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"success": true})
+}
+
+// Patch writes only the keys of the JSON body to a record: null clears a
+// field and JSON objects are merged into the stored ones unless ?replace=1.
+// An X-Field-Mask header (comma-separated fields) restricts the keys
+// written; the others are listed as ignored, in an X-Ignored-Fields header
+// when answering with the record as Update does. If-Match works as for
+// Update, and the version is checked before the merge so both see the same
+// record.
+func (h *RecordsHandler) Patch(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	model, err := h.resolveModel(c)
+	if err != nil {
+		return err
+	}
+	id, err := parseRecordID(c)
+	if err != nil {
+		return err
+	}
+	replace, _ := strconv.ParseBool(c.QueryParam("replace"))
+
+	env := req.GetEnv()
+	vals := bodyValues(req)
+	model.ParseLocalized(env, vals)
+	minimal := goodooHttp.PreferMinimal(c)
+	var ignored []string
+	var records []map[string]interface{}
+	err = env.Transaction(func(tx *gorm.DB) error {
+		if err := upload.ResolveValues(tx, req.Session.SID, model, vals); err != nil {
+			return err
+		}
+		ignored, err = model.Patch(env.WithDB(tx), id, vals, models.PatchOptions{
+			Mask:        parseFieldMask(c),
+			ReplaceJSON: replace,
+			Version:     ifMatchVersion(c),
+		})
+		if err != nil {
+			return err
+		}
+		records = readWritten(c, env.WithDB(tx), model, id, minimal)
+		return nil
+	})
+	if err != nil {
+		req.Logger.WarningCtx(req.Context, "Patch on %s(%d) failed: %v", model.Name, id, err)
+		return recordErrorResponse(c, err)
+	}
+
+	if records != nil {
+		if len(ignored) > 0 {
+			c.Response().Header().Set("X-Ignored-Fields", strings.Join(ignored, ","))
+		}
+		return recordResponse(c, env, model, records, http.StatusOK)
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"success": true, "ignored": ignored})
+}
+
+// Delete unlinks a record
+func (h *RecordsHandler) Delete(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	model, err := h.resolveModel(c)
+	if err != nil {
+		return err
+	}
+	id, err := parseRecordID(c)
+	if err != nil {
+		return err
+	}
+
+	if err := model.Unlink(req.GetEnv(), []uint{id}); err != nil {
+		req.Logger.WarningCtx(req.Context, "Unlink on %s(%d) failed: %v", model.Name, id, err)
+		var restrictErr *models.RestrictError
+		if errors.As(err, &restrictErr) {
+			return recordErrorResponse(c, err)
+		}
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{"success": true})
+}
+
+// translatableField resolves the :field route parameter to a translatable field
+func (h *RecordsHandler) translatableField(c echo.Context, model *models.ModelDefinition) (string, error) {
+	name := c.Param("field")
+	field, exists := model.GetField(name)
+	if !exists {
+		return "", echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("Field %s not found", name))
+	}
+	if !models.IsTranslatable(field) {
+		return "", echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Field %s is not translatable", name))
+	}
+	return name, nil
+}
+
+// GetTranslations returns every language's value of a translatable field
+func (h *RecordsHandler) GetTranslations(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	model, err := h.resolveModel(c)
+	if err != nil {
+		return err
+	}
+	id, err := parseRecordID(c)
+	if err != nil {
+		return err
+	}
+	field, err := h.translatableField(c, model)
+	if err != nil {
+		return err
+	}
+
+	// The base column holds the default language value
+	env := req.GetEnv().WithContext(map[string]interface{}{"lang": models.DefaultLang})
+	records, err := model.Read(env, []uint{id}, []string{field})
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	if len(records) == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "Record not found")
+	}
+
+	translations, err := models.GetFieldTranslations(req.GetDB(), model.Name, id, field)
+	if err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to read translations: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to read translations"})
+	}
+	translations[models.DefaultLang] = fmt.Sprintf("%v", records[0][field])
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"model":        model.Name,
+		"id":           id,
+		"field":        field,
+		"translations": translations,
+	})
+}
+
+// SetTranslations updates translations from a {"lang": "value"} body
+func (h *RecordsHandler) SetTranslations(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	model, err := h.resolveModel(c)
+	if err != nil {
+		return err
+	}
+	id, err := parseRecordID(c)
+	if err != nil {
+		return err
+	}
+	field, err := h.translatableField(c, model)
+	if err != nil {
+		return err
+	}
+
+	env := req.GetEnv()
+	for lang, value := range bodyValues(req) {
+		text, ok := value.(string)
+		if !ok {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": fmt.Sprintf("Translation for %s must be a string", lang),
+			})
+		}
+		// Writing through the model keeps the default language in the base column
+		langEnv := env.WithContext(map[string]interface{}{"lang": lang})
+		if err := model.Write(langEnv, []uint{id}, map[string]interface{}{field: text}); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{"success": true})
+}
+
+// RegisterRecordRoutes mounts the generic record endpoints under /api/records
+func RegisterRecordRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewRecordsHandler(config)
+
+	records := e.Group("/api/records")
+	records.Use(goodooHttp.ServiceAuthMiddleware())
+	records.Use(goodooHttp.AuthenticationMiddleware(true))
+	records.Use(goodooHttp.DatabaseMiddleware(true))
+
+	records.GET("/:model", handler.List)
+	records.POST("/:model", handler.Create)
+	records.POST("/:model/bulk_write", handler.BulkWrite, goodooHttp.IdempotencyMiddleware())
+	records.POST("/:model/bulk_unlink", handler.BulkUnlink, goodooHttp.IdempotencyMiddleware())
+	records.GET("/:model/fields", handler.Fields)
+	records.GET("/:model/defaults", handler.Defaults)
+	records.GET("/:model/name_search", handler.NameSearch)
+	records.GET("/:model/grouped", handler.Grouped)
+	records.POST("/:model/check_duplicates", handler.CheckDuplicates)
+	records.POST("/:model/quick_create", handler.QuickCreate)
+	records.POST("/:model/bundle_import", handler.BundleImport)
+	records.GET("/:model/:id", handler.Get)
+	records.PUT("/:model/:id", handler.Update)
+	records.PATCH("/:model/:id", handler.Patch)
+	records.DELETE("/:model/:id", handler.Delete)
+	records.GET("/:model/:id/history", handler.History)
+	records.GET("/:model/:id/bundle", handler.Bundle)
+	records.GET("/:model/:id/translations/:field", handler.GetTranslations)
+	records.PUT("/:model/:id/translations/:field", handler.SetTranslations)
+}
@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	goodooHttp "goodoo/http"
+	"goodoo/models"
+	"goodoo/refdata"
+)
+
+// ReferenceHandler serves the reference data to picker widgets: countries
+// with their name in the user's language, languages and timezones, each
+// searched with q and paginated with limit and offset
+type ReferenceHandler struct {
+	Config *goodooHttp.RequestConfig
+}
+
+// NewReferenceHandler creates a new reference data handler
+func NewReferenceHandler(config *goodooHttp.RequestConfig) *ReferenceHandler {
+	return &ReferenceHandler{Config: config}
+}
+
+// referencePage reads the offset and limit query parameters, 50 items by
+// default and at most 200
+func referencePage(c echo.Context) (int, int) {
+	offset, _ := strconv.Atoi(c.QueryParam("offset"))
+	if offset < 0 {
+		offset = 0
+	}
+	limit := 50
+	if l, err := strconv.Atoi(c.QueryParam("limit")); err == nil && l > 0 && l <= 200 {
+		limit = l
+	}
+	return offset, limit
+}
+
+// Countries searches the countries by code or name, e.g. ?q=ger
+func (h *ReferenceHandler) Countries(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	offset, limit := referencePage(c)
+	countries, total, err := models.SearchCountries(req.GetDB(), req.GetEnv().Lang(), c.QueryParam("q"), offset, limit)
+	if err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to search countries: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to search countries"})
+	}
+
+	items := make([]map[string]interface{}, len(countries))
+	for i := range countries {
+		country := &countries[i]
+		items[i] = map[string]interface{}{
+			"id":             country.ID,
+			"code":           country.Code,
+			"name":           country.Name,
+			"display_name":   country.DisplayName(),
+			"phone_code":     country.PhoneCode,
+			"address_format": country.AddressFormat,
+		}
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"items": items, "total": total, "limit": limit, "offset": offset})
+}
+
+// Languages searches the active languages, or all of them with all=1
+func (h *ReferenceHandler) Languages(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	offset, limit := referencePage(c)
+	all, _ := strconv.ParseBool(c.QueryParam("all"))
+	langs, total, err := models.SearchLangs(req.GetDB(), c.QueryParam("q"), all, offset, limit)
+	if err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to search languages: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to search languages"})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"items": langs, "total": total, "limit": limit, "offset": offset})
+}
+
+// SetLanguageActive activates or deactivates a language, which users may
+// then pick or not
+func (h *ReferenceHandler) SetLanguageActive(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	var body struct {
+		Active *bool `json:"active"`
+	}
+	if err := c.Bind(&body); err != nil || body.Active == nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "active is required"})
+	}
+	code := c.Param("code")
+	if code == models.DefaultLang && !*body.Active {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "The default language cannot be deactivated"})
+	}
+
+	db := req.GetDB()
+	var lang models.Lang
+	if err := db.Where("code = ?", code).First(&lang).Error; err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Language not found"})
+	}
+	if err := db.Model(&lang).Update("active", *body.Active).Error; err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to update language %s: %v", code, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	req.Logger.InfoCtx(req.Context, "Language %s set active=%t by %s", code, *body.Active, req.GetLogin())
+	return c.JSON(http.StatusOK, lang)
+}
+
+// Timezones searches the timezone catalog by name, or those of a country
+// with country=DE, with their current UTC offset
+func (h *ReferenceHandler) Timezones(c echo.Context) error {
+	offset, limit := referencePage(c)
+	query := strings.ToLower(strings.TrimSpace(c.QueryParam("q")))
+	country := strings.ToUpper(strings.TrimSpace(c.QueryParam("country")))
+
+	now := time.Now()
+	var items []map[string]interface{}
+	for _, tz := range refdata.Timezones() {
+		if country != "" && tz.CountryCode != country {
+			continue
+		}
+		if query != "" && !strings.Contains(strings.ToLower(tz.Name), query) {
+			continue
+		}
+		seconds := tz.Offset(now)
+		items = append(items, map[string]interface{}{
+			"name":           tz.Name,
+			"country_code":   tz.CountryCode,
+			"offset":         formatUTCOffset(seconds),
+			"offset_seconds": seconds,
+		})
+	}
+
+	total := len(items)
+	page := items[min(offset, total):min(offset+limit, total)]
+	if page == nil {
+		page = []map[string]interface{}{}
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"items": page, "total": total, "limit": limit, "offset": offset})
+}
+
+// formatUTCOffset formats an offset in seconds as "+01:00"
+func formatUTCOffset(seconds int) string {
+	sign := '+'
+	if seconds < 0 {
+		sign, seconds = '-', -seconds
+	}
+	return fmt.Sprintf("%c%02d:%02d", sign, seconds/3600, seconds%3600/60)
+}
+
+// RegisterReferenceRoutes mounts the reference data endpoints under
+// /api/ref; activating languages requires the languages.manage
+// permission
+func RegisterReferenceRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewReferenceHandler(config)
+	manage := goodooHttp.PermissionLanguagesManage
+
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		{Method: "GET", Path: "/api/ref/countries", Handler: handler.Countries, Auth: true, DB: true},
+		{Method: "GET", Path: "/api/ref/languages", Handler: handler.Languages, Auth: true, DB: true},
+		{Method: "PUT", Path: "/api/ref/languages/:code", Handler: handler.SetLanguageActive, Auth: true, DB: true, Permission: manage},
+		{Method: "GET", Path: "/api/ref/timezones", Handler: handler.Timezones, Auth: true, DB: true},
+	})
+}
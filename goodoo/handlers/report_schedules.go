@@ -0,0 +1,424 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	netmail "net/mail"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	goodooHttp "goodoo/http"
+	"goodoo/models"
+	"goodoo/reports"
+	"goodoo/scheduler"
+	"gorm.io/gorm"
+)
+
+// ReportScheduleHandler manages the schedules mailing reports and exports
+// on a recurrence. A schedule renders as its owner, the user who created
+// it, whoever edits or runs it afterwards.
+type ReportScheduleHandler struct {
+	Config *goodooHttp.RequestConfig
+}
+
+// NewReportScheduleHandler creates a new report schedule handler
+func NewReportScheduleHandler(config *goodooHttp.RequestConfig) *ReportScheduleHandler {
+	return &ReportScheduleHandler{Config: config}
+}
+
+// ReportScheduleRequest is the body of a schedule creation or update;
+// fields left out of an update are kept, and a filter_id of 0 removes the
+// filter
+type ReportScheduleRequest struct {
+	Name             *string          `json:"name"`
+	Kind             *string          `json:"kind"`
+	Report           *string          `json:"report"`
+	Model            *string          `json:"model"`
+	FilterID         *uint            `json:"filter_id"`
+	Domain           *json.RawMessage `json:"domain"`
+	Fields           *[]string        `json:"fields"`
+	Format           *string          `json:"format"`
+	CronExpression   *string          `json:"cron_expression"`
+	Timezone         *string          `json:"timezone"`
+	RecipientUserIDs *[]uint          `json:"recipient_user_ids"`
+	RecipientEmails  *[]string        `json:"recipient_emails"`
+	Active           *bool            `json:"active"`
+}
+
+// ReportScheduleResponse describes a schedule with its decoded domain
+type ReportScheduleResponse struct {
+	*models.ReportSchedule
+	Domain models.Domain `json:"domain"`
+}
+
+// reportScheduleResponse describes a schedule
+func reportScheduleResponse(schedule *models.ReportSchedule) ReportScheduleResponse {
+	domain, _ := schedule.DomainValue()
+	return ReportScheduleResponse{ReportSchedule: schedule, Domain: domain}
+}
+
+// apply copies the set fields of body onto the schedule
+func (body *ReportScheduleRequest) apply(schedule *models.ReportSchedule) error {
+	if body.Name != nil {
+		schedule.Name = strings.TrimSpace(*body.Name)
+	}
+	if body.Kind != nil {
+		schedule.Kind = *body.Kind
+	}
+	if body.Report != nil {
+		schedule.Report = *body.Report
+	}
+	if body.Model != nil {
+		schedule.Model = *body.Model
+	}
+	if body.FilterID != nil {
+		schedule.FilterID = body.FilterID
+		if *body.FilterID == 0 {
+			schedule.FilterID = nil
+		}
+	}
+	if body.Domain != nil {
+		var domain models.Domain
+		if err := decodeDomain(*body.Domain, &domain); err != nil {
+			return err
+		}
+		encoded, err := json.Marshal(domain)
+		if err != nil {
+			return err
+		}
+		schedule.Domain = string(encoded)
+	}
+	if body.Fields != nil {
+		schedule.Fields = models.StringList(*body.Fields)
+	}
+	if body.Format != nil {
+		schedule.Format = *body.Format
+	}
+	if body.CronExpression != nil {
+		schedule.CronExpression = strings.TrimSpace(*body.CronExpression)
+	}
+	if body.Timezone != nil {
+		schedule.Timezone = *body.Timezone
+	}
+	if body.RecipientUserIDs != nil {
+		schedule.RecipientUserIDs = models.IDList(*body.RecipientUserIDs)
+	}
+	if body.RecipientEmails != nil {
+		schedule.RecipientEmails = models.StringList(*body.RecipientEmails)
+	}
+	if body.Active != nil {
+		schedule.Active = *body.Active
+	}
+	return nil
+}
+
+// validateReportSchedule checks a schedule as its owner: the report, the
+// model, the filter, the domain and the fields must be theirs to read
+func validateReportSchedule(db *gorm.DB, dbName string, schedule *models.ReportSchedule) error {
+	if schedule.Name == "" {
+		return errors.New("name is required")
+	}
+	switch schedule.Kind {
+	case models.ReportScheduleReport:
+		report, exists := reports.Get(schedule.Report)
+		if !exists {
+			return fmt.Errorf("report %q not found", schedule.Report)
+		}
+		if schedule.Model == "" {
+			schedule.Model = report.Model
+		}
+		if schedule.Model != report.Model {
+			return fmt.Errorf("report %s prints %s records", report.Name, report.Model)
+		}
+		if schedule.Format == "" {
+			schedule.Format = models.ReportFormatPDF
+		}
+		if schedule.Format != models.ReportFormatPDF && schedule.Format != models.ReportFormatHTML {
+			return errors.New("reports are sent as pdf or html")
+		}
+	case models.ReportScheduleExport:
+		schedule.Report = ""
+		if schedule.Format == "" {
+			schedule.Format = models.ReportFormatCSV
+		}
+		if schedule.Format != models.ReportFormatCSV {
+			return errors.New("exports are sent as csv")
+		}
+	default:
+		return fmt.Errorf("kind must be %s or %s", models.ReportScheduleReport, models.ReportScheduleExport)
+	}
+
+	if !goodooHttp.ValidTimezone(schedule.Timezone) {
+		return fmt.Errorf("invalid timezone %q", schedule.Timezone)
+	}
+	if _, err := reports.NextRun(schedule.CronExpression, schedule.Timezone, schedule.CreateDate); err != nil {
+		return fmt.Errorf("invalid cron expression: %w", err)
+	}
+
+	for i, address := range schedule.RecipientEmails {
+		parsed, err := netmail.ParseAddress(strings.TrimSpace(address))
+		if err != nil {
+			return fmt.Errorf("invalid recipient email %q", address)
+		}
+		schedule.RecipientEmails[i] = parsed.Address
+	}
+	if len(schedule.RecipientUserIDs) > 0 {
+		var count int64
+		if err := db.Model(&models.User{}).Where("id IN ? AND active = ?", []uint(schedule.RecipientUserIDs), true).Count(&count).Error; err != nil {
+			return err
+		}
+		if int(count) != len(schedule.RecipientUserIDs) {
+			return errors.New("recipient users must be active users")
+		}
+	}
+	if len(schedule.RecipientUserIDs) == 0 && len(schedule.RecipientEmails) == 0 {
+		return errors.New("at least one recipient is required")
+	}
+
+	var owner models.User
+	if err := db.First(&owner, schedule.UserID).Error; err != nil {
+		return fmt.Errorf("owner %d not found", schedule.UserID)
+	}
+	env := reports.ScheduleEnvironment(db, dbName, schedule, &owner)
+	model, exists := env.GetFieldModel(schedule.Model)
+	if !exists {
+		return fmt.Errorf("model %q not found", schedule.Model)
+	}
+	domain, err := schedule.DomainValue()
+	if err != nil {
+		return err
+	}
+	if err := model.ValidateFilter(env, domain, "", schedule.Fields); err != nil {
+		return err
+	}
+	if schedule.FilterID != nil {
+		if _, err := models.GetFilter(env, schedule.Model, *schedule.FilterID); err != nil {
+			return fmt.Errorf("filter %d: %w", *schedule.FilterID, err)
+		}
+	}
+	return nil
+}
+
+// loadReportSchedule fetches the schedule named by the :id route parameter
+func loadReportSchedule(c echo.Context, db *gorm.DB) (*models.ReportSchedule, error) {
+	id, err := parseRecordID(c)
+	if err != nil {
+		return nil, err
+	}
+	var schedule models.ReportSchedule
+	if err := db.First(&schedule, id).Error; err != nil {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Report schedule not found")
+	}
+	return &schedule, nil
+}
+
+// List returns the report schedules
+func (h *ReportScheduleHandler) List(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	var schedules []models.ReportSchedule
+	if err := req.GetDB().Order("name, id").Find(&schedules).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	responses := make([]ReportScheduleResponse, len(schedules))
+	for i := range schedules {
+		responses[i] = reportScheduleResponse(&schedules[i])
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"schedules": responses})
+}
+
+// Get returns one report schedule
+func (h *ReportScheduleHandler) Get(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	schedule, err := loadReportSchedule(c, req.GetDB())
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, reportScheduleResponse(schedule))
+}
+
+// Create adds a report schedule owned by the current user, in their
+// timezone unless one is given; it first runs at the next activation
+func (h *ReportScheduleHandler) Create(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+
+	var body ReportScheduleRequest
+	if err := c.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request format: "+err.Error())
+	}
+
+	var owner models.User
+	if err := db.First(&owner, req.GetUserID()).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to read the current user")
+	}
+	schedule := &models.ReportSchedule{Domain: "[]", Timezone: owner.Tz, Active: true, UserID: owner.ID}
+	if schedule.Timezone == "" {
+		schedule.Timezone = "UTC"
+	}
+	schedule.CreateDate = req.Now()
+	if err := body.apply(schedule); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	if err := validateReportSchedule(db, req.GetDBName(), schedule); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	schedule.NextRun, _ = reports.NextRun(schedule.CronExpression, schedule.Timezone, req.Now())
+	schedule.CreateUID, schedule.WriteUID = owner.ID, owner.ID
+
+	// Select all columns so false booleans are not replaced by column defaults
+	if err := db.Select("*").Omit("id").Create(schedule).Error; err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to create report schedule: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	req.Logger.InfoCtx(req.Context, "Report schedule %s (%d) created by %s", schedule.Name, schedule.ID, req.GetLogin())
+	return c.JSON(http.StatusCreated, reportScheduleResponse(schedule))
+}
+
+// Update modifies a report schedule, which keeps its owner. A change of
+// recurrence plans the next run again.
+func (h *ReportScheduleHandler) Update(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	schedule, err := loadReportSchedule(c, db)
+	if err != nil {
+		return err
+	}
+
+	var body ReportScheduleRequest
+	if err := c.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request format: "+err.Error())
+	}
+	recurrence := schedule.CronExpression + " " + schedule.Timezone
+	if err := body.apply(schedule); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	if err := validateReportSchedule(db, req.GetDBName(), schedule); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	if schedule.CronExpression+" "+schedule.Timezone != recurrence {
+		schedule.NextRun, _ = reports.NextRun(schedule.CronExpression, schedule.Timezone, req.Now())
+	}
+	schedule.WriteUID = uint(req.GetUserID())
+
+	// The runner owns the lock and the time of the last run
+	if err := db.Omit("running_since", "last_run").Save(schedule).Error; err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to update report schedule %d: %v", schedule.ID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, reportScheduleResponse(schedule))
+}
+
+// Delete removes a report schedule, its runs and their stored output
+func (h *ReportScheduleHandler) Delete(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	schedule, err := loadReportSchedule(c, db)
+	if err != nil {
+		return err
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		runs := tx.Model(&models.ReportScheduleRun{}).Select("id").Where("schedule_id = ?", schedule.ID)
+		if err := tx.Unscoped().Where("res_model = ? AND res_id IN (?)", models.ReportRunResModel, runs).Delete(&models.IrAttachment{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("schedule_id = ?", schedule.ID).Delete(&models.ReportScheduleRun{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(schedule).Error
+	})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	req.Logger.InfoCtx(req.Context, "Report schedule %s (%d) deleted by %s", schedule.Name, schedule.ID, req.GetLogin())
+	return c.JSON(http.StatusOK, map[string]interface{}{"success": true})
+}
+
+// RunNow renders and mails a schedule immediately, as its owner, and
+// returns the run; the next planned run is kept
+func (h *ReportScheduleHandler) RunNow(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	schedule, err := loadReportSchedule(c, req.GetDB())
+	if err != nil {
+		return err
+	}
+
+	runner := reports.NewRunner(req.GetDBName(), scheduler.Default().Clock(), c.Echo().Renderer)
+	run, err := runner.RunNow(req.Context, schedule.ID)
+	if errors.Is(err, reports.ErrScheduleRunning) {
+		return c.JSON(http.StatusConflict, map[string]string{"error": err.Error()})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	req.Logger.InfoCtx(req.Context, "Report schedule %s (%d) run manually by %s", schedule.Name, schedule.ID, req.GetLogin())
+	return c.JSON(http.StatusOK, run)
+}
+
+// Runs returns the most recent runs of a report schedule
+func (h *ReportScheduleHandler) Runs(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	schedule, err := loadReportSchedule(c, db)
+	if err != nil {
+		return err
+	}
+
+	var runs []models.ReportScheduleRun
+	if err := db.Where("schedule_id = ?", schedule.ID).Order("started_at DESC").Limit(50).Find(&runs).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"runs": runs})
+}
+
+// Download sends the output of a scheduled report too large to be mailed
+// to whoever holds the link, until it expires
+func (h *ReportScheduleHandler) Download(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	db := req.GetDB()
+	if db == nil {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Database not available"})
+	}
+	run, attachment, err := models.DownloadScheduledReport(db, c.Param("token"), req.Now())
+	if errors.Is(err, models.ErrScheduledReportNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Report not found or expired"})
+	}
+	if err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to read a scheduled report: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to read the report")
+	}
+	req.Logger.InfoCtx(req.Context, "Output of report schedule run %d downloaded from %s", run.ID, req.RemoteAddr)
+
+	header := c.Response().Header()
+	header.Set("Cache-Control", "no-store")
+	header.Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", attachment.Name))
+	header.Set(echo.HeaderContentLength, strconv.Itoa(len(attachment.Datas)))
+	return c.Blob(http.StatusOK, attachment.Mimetype, attachment.Datas)
+}
+
+// RegisterReportScheduleRoutes mounts the report schedule administration
+// under /api/report-schedules, and the public download of the outputs sent
+// as links at /reports/scheduled/:token
+func RegisterReportScheduleRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewReportScheduleHandler(config)
+	permission := goodooHttp.PermissionReportsSchedule
+
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		{Method: "GET", Path: "/api/report-schedules", Handler: handler.List, Auth: true, DB: true, Permission: permission},
+		{Method: "POST", Path: "/api/report-schedules", Handler: handler.Create, Auth: true, DB: true, Permission: permission, DenyImpersonation: true},
+		{Method: "GET", Path: "/api/report-schedules/:id", Handler: handler.Get, Auth: true, DB: true, Permission: permission},
+		{Method: "PUT", Path: "/api/report-schedules/:id", Handler: handler.Update, Auth: true, DB: true, Permission: permission, DenyImpersonation: true},
+		{Method: "DELETE", Path: "/api/report-schedules/:id", Handler: handler.Delete, Auth: true, DB: true, Permission: permission, DenyImpersonation: true},
+		{Method: "POST", Path: "/api/report-schedules/:id/run", Handler: handler.RunNow, Auth: true, DB: true, Permission: permission, RateLimit: "expensive"},
+		{Method: "GET", Path: "/api/report-schedules/:id/runs", Handler: handler.Runs, Auth: true, DB: true, Permission: permission},
+
+		// Public: recipients may have no account, they hold a token
+		{Method: "GET", Path: "/reports/scheduled/:token", Handler: handler.Download, Public: true, RateLimit: "public"},
+	})
+}
@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	goodooHttp "goodoo/http"
+	"goodoo/reports"
+)
+
+// ReportHandler prints registered reports as PDF (like Odoo's /report/pdf controller)
+type ReportHandler struct {
+	Config *goodooHttp.RequestConfig
+}
+
+// NewReportHandler creates a new report handler
+func NewReportHandler(config *goodooHttp.RequestConfig) *ReportHandler {
+	return &ReportHandler{Config: config}
+}
+
+// parseIDList parses a comma-separated list of record IDs like "1,2,3"
+func parseIDList(value string) ([]uint, error) {
+	var ids []uint
+	for _, part := range strings.Split(value, ",") {
+		id, err := strconv.ParseUint(strings.TrimSpace(part), 10, 64)
+		if err != nil || id == 0 {
+			return nil, fmt.Errorf("invalid record ID '%s'", part)
+		}
+		ids = append(ids, uint(id))
+	}
+	return ids, nil
+}
+
+// Print renders GET /api/reports/:report/:ids as PDF, or as HTML with ?format=html
+func (h *ReportHandler) Print(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+
+	report, exists := reports.Get(c.Param("report"))
+	if !exists {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("Report %s not found", c.Param("report")))
+	}
+
+	ids, err := parseIDList(c.Param("ids"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	env := req.GetEnv()
+	renderer := c.Echo().Renderer
+
+	if c.QueryParam("format") == "html" {
+		content, _, err := report.RenderHTML(renderer, env, ids)
+		if err != nil {
+			req.Logger.WarningCtx(req.Context, "Failed to render report %s: %v", report.Name, err)
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		return c.HTMLBlob(http.StatusOK, content)
+	}
+
+	pdf, docs, err := report.RenderPDF(renderer, env, ids)
+	if err != nil {
+		req.Logger.WarningCtx(req.Context, "Failed to render report %s: %v", report.Name, err)
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	req.Logger.InfoCtx(req.Context, "Printed report %s for %d record(s)", report.Name, len(docs))
+
+	c.Response().Header().Set(echo.HeaderContentDisposition,
+		fmt.Sprintf("inline; filename=%q", report.DownloadName(docs)))
+	c.Response().Header().Set(echo.HeaderContentLength, strconv.Itoa(len(pdf)))
+	c.Response().Header().Set("Cache-Control", "no-store")
+	return c.Blob(http.StatusOK, "application/pdf", pdf)
+}
+
+// ListReports returns the registered reports
+func (h *ReportHandler) ListReports(c echo.Context) error {
+	var result []map[string]string
+	for _, report := range reports.List() {
+		result = append(result, map[string]string{
+			"name":  report.Name,
+			"model": report.Model,
+			"title": report.Title,
+		})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"reports": result})
+}
+
+// RegisterReportRoutes mounts the report endpoints under /api/reports
+func RegisterReportRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewReportHandler(config)
+
+	group := e.Group("/api/reports")
+	group.Use(goodooHttp.AuthenticationMiddleware(true))
+	group.Use(goodooHttp.DatabaseMiddleware(true))
+
+	group.GET("", handler.ListReports)
+	group.GET("/:report/:ids", handler.Print)
+}
@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	goodooHttp "goodoo/http"
+	"goodoo/retention"
+)
+
+// RetentionHandler reports the retention policies of the archived tables
+type RetentionHandler struct {
+	Config *goodooHttp.RequestConfig
+}
+
+// NewRetentionHandler creates a new retention handler
+func NewRetentionHandler(config *goodooHttp.RequestConfig) *RetentionHandler {
+	return &RetentionHandler{Config: config}
+}
+
+// Policies returns each retention policy with the rows older than its
+// cutoff, their estimated size and the outcome of its last run. Policies
+// are changed through their system parameters and apply from the next run.
+func (h *RetentionHandler) Policies(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	policies, err := retention.Report(req.Context, req.GetDBName())
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	config := retention.CurrentConfig()
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"policies": policies,
+		"interval": config.Interval.String(),
+	})
+}
+
+// RegisterRetentionRoutes mounts the retention report, reserved to the
+// holders of db.manage
+func RegisterRetentionRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewRetentionHandler(config)
+
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		{Method: "GET", Path: "/api/retention", Handler: handler.Policies, Auth: true, DB: true, Permission: goodooHttp.PermissionDBManage},
+	})
+}
@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	goodooHttp "goodoo/http"
+)
+
+// RouteTableHandler lists the registered routes for auditing
+type RouteTableHandler struct {
+	Config *goodooHttp.RequestConfig
+	echo   *echo.Echo
+}
+
+// NewRouteTableHandler creates a new route table handler listing the routes of e
+func NewRouteTableHandler(e *echo.Echo, config *goodooHttp.RequestConfig) *RouteTableHandler {
+	return &RouteTableHandler{Config: config, echo: e}
+}
+
+// List returns the effective route table: the checks applied to each
+// route registered from a spec, and the bare routes registered directly.
+// With ?version=v1, only the API routes of that version are listed, with
+// their versioned path.
+func (h *RouteTableHandler) List(c echo.Context) error {
+	routes := goodooHttp.RouteTable(h.echo)
+	if version := c.QueryParam("version"); version != "" {
+		routes = goodooHttp.APIRouteTable(h.echo, version)
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"routes": routes,
+		"total":  len(routes),
+	})
+}
+
+// RegisterRouteTableRoutes mounts the route table at /api/routes (settings.read)
+func RegisterRouteTableRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewRouteTableHandler(e, config)
+
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		{Method: "GET", Path: "/api/routes", Handler: handler.List, Permission: goodooHttp.PermissionSettingsRead},
+	})
+}
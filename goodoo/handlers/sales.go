@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	goodooHttp "goodoo/http"
+	"goodoo/models"
+	"goodoo/sale"
+	"gorm.io/gorm"
+)
+
+// SalesHandler serves sales statistics for the dashboard and order endpoints
+// handling lines together with their order
+type SalesHandler struct {
+	Config *goodooHttp.RequestConfig
+}
+
+// NewSalesHandler creates a new sales handler
+func NewSalesHandler(config *goodooHttp.RequestConfig) *SalesHandler {
+	return &SalesHandler{Config: config}
+}
+
+// SalesStateSummary is the number and total amount of orders in one state
+type SalesStateSummary struct {
+	State       string  `json:"state"`
+	Count       int64   `json:"count"`
+	AmountTotal float64 `json:"amount_total"`
+}
+
+// Summary returns order counts and totals by state
+func (h *SalesHandler) Summary(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	db := req.GetDB()
+	if db == nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database not available")
+	}
+
+	var states []SalesStateSummary
+	err := db.Model(&models.SaleOrder{}).
+		Select("state, COUNT(*) AS count, COALESCE(SUM(amount_total), 0) AS amount_total").
+		Group("state").
+		Order("state").
+		Scan(&states).Error
+	if err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to compute sales summary: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	// Revenue counts confirmed and locked orders, like Odoo's sales analysis
+	var count int64
+	var revenue float64
+	for _, state := range states {
+		count += state.Count
+		if state.State == models.SaleStateSale || state.State == models.SaleStateDone {
+			revenue += state.AmountTotal
+		}
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"states":  states,
+		"count":   count,
+		"revenue": revenue,
+	})
+}
+
+// orderError answers a failed order operation, pinpointing the offending
+// line of validation errors
+func orderError(c echo.Context, err error) error {
+	var validation *sale.ValidationError
+	switch {
+	case errors.As(err, &validation):
+		body := map[string]interface{}{"error": validation.Error(), "field": validation.Field}
+		if validation.Line >= 0 {
+			body["line"] = validation.Line
+		}
+		return c.JSON(http.StatusBadRequest, body)
+	case errors.Is(err, sale.ErrOrderNotFound):
+		return c.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+}
+
+// bindOrder decodes an order payload
+func bindOrder(c echo.Context) (sale.OrderInput, error) {
+	var input sale.OrderInput
+	if err := c.Bind(&input); err != nil {
+		return input, echo.NewHTTPError(http.StatusBadRequest, "Invalid request body: "+err.Error())
+	}
+	return input, nil
+}
+
+// orderResponse answers with an order and its version as ETag, as reads
+// and writes of orders do
+func orderResponse(c echo.Context, order *sale.OrderView, status int) error {
+	c.Response().Header().Set("ETag", `"`+models.RecordVersion(order.WriteDate)+`"`)
+	return c.JSON(status, order)
+}
+
+// CreateOrder creates a quotation with its nested order_line in one
+// transaction and answers with the order as GetOrder would, read back in
+// that transaction, or with its id under Prefer: return=minimal
+func (h *SalesHandler) CreateOrder(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	input, err := bindOrder(c)
+	if err != nil {
+		return err
+	}
+
+	env := req.GetEnv()
+	minimal := goodooHttp.PreferMinimal(c)
+	var id uint
+	var order *sale.OrderView
+	err = env.Transaction(func(tx *gorm.DB) error {
+		id, err = sale.CreateOrder(env.WithDB(tx), input)
+		if err != nil || minimal {
+			return err
+		}
+		order, err = sale.GetOrder(env.WithDB(tx), id)
+		return err
+	})
+	if err != nil {
+		req.Logger.WarningCtx(req.Context, "Failed to create sale order: %v", err)
+		return orderError(c, err)
+	}
+	if minimal {
+		return c.JSON(http.StatusCreated, map[string]interface{}{"id": id})
+	}
+	return orderResponse(c, order, http.StatusCreated)
+}
+
+// GetOrder returns an order with its lines, partner name and totals
+func (h *SalesHandler) GetOrder(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	id, err := parseRecordID(c)
+	if err != nil {
+		return err
+	}
+
+	order, err := sale.GetOrder(req.GetEnv(), id)
+	if err != nil {
+		return orderError(c, err)
+	}
+	return orderResponse(c, order, http.StatusOK)
+}
+
+// UpdateOrder writes an order and applies the line commands of order_line,
+// answering with the order as CreateOrder does
+func (h *SalesHandler) UpdateOrder(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	id, err := parseRecordID(c)
+	if err != nil {
+		return err
+	}
+	input, err := bindOrder(c)
+	if err != nil {
+		return err
+	}
+
+	env := req.GetEnv()
+	minimal := goodooHttp.PreferMinimal(c)
+	var order *sale.OrderView
+	err = env.Transaction(func(tx *gorm.DB) error {
+		if err := sale.UpdateOrder(env.WithDB(tx), id, input); err != nil || minimal {
+			return err
+		}
+		order, err = sale.GetOrder(env.WithDB(tx), id)
+		return err
+	})
+	if err != nil {
+		req.Logger.WarningCtx(req.Context, "Failed to update sale order %d: %v", id, err)
+		return orderError(c, err)
+	}
+	if minimal {
+		return c.JSON(http.StatusOK, map[string]interface{}{"success": true})
+	}
+	return orderResponse(c, order, http.StatusOK)
+}
+
+// RegisterSalesRoutes mounts the sales endpoints under /api/sales
+func RegisterSalesRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewSalesHandler(config)
+
+	group := e.Group("/api/sales")
+	group.Use(goodooHttp.AuthenticationMiddleware(true))
+	group.Use(goodooHttp.DatabaseMiddleware(true))
+
+	group.GET("/summary", handler.Summary)
+	group.POST("/orders", handler.CreateOrder, goodooHttp.IdempotencyMiddleware())
+	group.GET("/orders/:id", handler.GetOrder)
+	group.PUT("/orders/:id", handler.UpdateOrder)
+}
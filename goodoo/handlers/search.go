@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"goodoo/database"
+	goodooHttp "goodoo/http"
+	"goodoo/search"
+)
+
+// maxSearchLength bounds the text of an admin search
+const maxSearchLength = 100
+
+// SearchHandler serves the command palette of the administrators
+type SearchHandler struct {
+	Config *goodooHttp.RequestConfig
+	echo   *echo.Echo
+}
+
+// NewSearchHandler creates a new search handler, searching the routes of e
+func NewSearchHandler(e *echo.Echo, config *goodooHttp.RequestConfig) *SearchHandler {
+	return &SearchHandler{Config: config, echo: e}
+}
+
+// Search returns the users, models, system parameters, scheduled actions,
+// webhooks, routes and addon results matching ?q=, grouped by source and
+// ranked by relevance. Sources that do not answer in time are listed in
+// timed_out rather than delaying the response.
+func (h *SearchHandler) Search(c echo.Context) error {
+	text := strings.TrimSpace(c.QueryParam("q"))
+	if text == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "q is required"})
+	}
+	if len(text) > maxSearchLength {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "q is too long"})
+	}
+	req := goodooHttp.GetGoodooRequest(c)
+	// Sources run concurrently: they use the pool, not the request
+	// transaction
+	db, err := database.GetDatabase(req.GetDBName())
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	response := search.Run(req.Context, search.Query{
+		Text:   text,
+		DBName: req.GetDBName(),
+		DB:     db,
+		UID:    uint(req.GetUserID()),
+	})
+	return c.JSON(http.StatusOK, response)
+}
+
+// searchRoutes matches the paths and handlers of the routes of e
+func (h *SearchHandler) searchRoutes(ctx context.Context, query search.Query) ([]search.Result, error) {
+	var results []search.Result
+	for _, route := range goodooHttp.RouteTable(h.echo) {
+		score := search.Score(query.Text, route.Path, route.Handler)
+		if score == 0 {
+			continue
+		}
+		label := route.Method + " " + route.Path
+		results = append(results, search.Result{
+			Type:   search.TypeRoute,
+			Label:  label,
+			Detail: route.Handler,
+			Path:   "/dashboard#api?route=" + url.QueryEscape(label),
+			Score:  score,
+		})
+	}
+	return results, ctx.Err()
+}
+
+// RegisterSearchRoutes mounts the admin search at /api/admin/search
+// (admin.search) and registers the route source of e
+func RegisterSearchRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewSearchHandler(e, config)
+	search.Register(search.SourceFunc{SourceName: "routes", Fn: handler.searchRoutes})
+
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		{Method: "GET", Path: "/api/admin/search", Handler: handler.Search, Auth: true, DB: true, Permission: goodooHttp.PermissionAdminSearch},
+	})
+}
@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"goodoo/logging"
+)
+
+// maxCSPReportSize bounds the body read from browsers posting violation reports
+const maxCSPReportSize = 64 * 1024
+
+// cspViolation holds the fields of a violation report that are logged
+type cspViolation struct {
+	DocumentURI        string `json:"document-uri"`
+	ViolatedDirective  string `json:"violated-directive"`
+	EffectiveDirective string `json:"effective-directive"`
+	BlockedURI         string `json:"blocked-uri"`
+	SourceFile         string `json:"source-file"`
+	LineNumber         int    `json:"line-number"`
+}
+
+// reportingAPIViolation is the body of a Reporting API entry (application/reports+json)
+type reportingAPIViolation struct {
+	Type string `json:"type"`
+	Body struct {
+		DocumentURL        string `json:"documentURL"`
+		EffectiveDirective string `json:"effectiveDirective"`
+		BlockedURL         string `json:"blockedURL"`
+		SourceFile         string `json:"sourceFile"`
+		LineNumber         int    `json:"lineNumber"`
+	} `json:"body"`
+}
+
+// CSPReportHandler logs Content-Security-Policy violations posted by browsers.
+// It accepts both the report-uri format and Reporting API batches.
+func CSPReportHandler(c echo.Context) error {
+	logger := logging.GetLogger("goodoo.http.csp")
+
+	body, err := io.ReadAll(io.LimitReader(c.Request().Body, maxCSPReportSize))
+	if err != nil {
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	var violations []cspViolation
+	var single struct {
+		Report cspViolation `json:"csp-report"`
+	}
+	var batch []reportingAPIViolation
+	if err := json.Unmarshal(body, &single); err == nil && single.Report.DocumentURI != "" {
+		violations = append(violations, single.Report)
+	} else if err := json.Unmarshal(body, &batch); err == nil {
+		for _, entry := range batch {
+			if entry.Type != "csp-violation" {
+				continue
+			}
+			violations = append(violations, cspViolation{
+				DocumentURI:        entry.Body.DocumentURL,
+				EffectiveDirective: entry.Body.EffectiveDirective,
+				BlockedURI:         entry.Body.BlockedURL,
+				SourceFile:         entry.Body.SourceFile,
+				LineNumber:         entry.Body.LineNumber,
+			})
+		}
+	} else {
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	for _, v := range violations {
+		directive := v.ViolatedDirective
+		if directive == "" {
+			directive = v.EffectiveDirective
+		}
+		logger.Warning("CSP violation on %s: %s blocked %s (%s:%d)",
+			v.DocumentURI, directive, v.BlockedURI, v.SourceFile, v.LineNumber)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,306 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	goodooHttp "goodoo/http"
+	"goodoo/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// serviceLoginPattern restricts the logins of service accounts
+var serviceLoginPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]*$`)
+
+// serviceAccountEmailDomain gives service users a unique address that
+// never receives mail
+const serviceAccountEmailDomain = "service.invalid"
+
+// ServiceAccountHandler manages the service accounts of automations
+// (administrators only). Their credentials are service keys created with
+// /api/service-keys for the account's user.
+type ServiceAccountHandler struct {
+	Config *goodooHttp.RequestConfig
+}
+
+// NewServiceAccountHandler creates a new service account handler
+func NewServiceAccountHandler(config *goodooHttp.RequestConfig) *ServiceAccountHandler {
+	return &ServiceAccountHandler{Config: config}
+}
+
+// ServiceAccountRequest is the body of create and update requests; nil
+// fields are left unchanged. The login cannot change once created.
+type ServiceAccountRequest struct {
+	Login       *string   `json:"login"`
+	Name        *string   `json:"name"`
+	Description *string   `json:"description"`
+	Permissions *[]string `json:"permissions"`
+	Models      *[]string `json:"models"`
+	// ExpiresAt is cleared by an update with clear_expiry
+	ExpiresAt   *time.Time `json:"expires_at"`
+	ClearExpiry bool       `json:"clear_expiry"`
+	RateLimit   *int       `json:"rate_limit"`
+	RateBurst   *int       `json:"rate_burst"`
+	DailyQuota  *int       `json:"daily_quota"`
+	Active      *bool      `json:"active"`
+}
+
+// apply copies the set fields onto the account
+func (r *ServiceAccountRequest) apply(account *models.ServiceAccount) {
+	if r.Description != nil {
+		account.Description = *r.Description
+	}
+	if r.Permissions != nil {
+		account.Permissions = models.StringList(*r.Permissions)
+	}
+	if r.Models != nil {
+		account.Models = models.StringList(*r.Models)
+	}
+	if r.ExpiresAt != nil {
+		account.ExpiresAt = r.ExpiresAt
+	}
+	if r.ClearExpiry {
+		account.ExpiresAt = nil
+	}
+	if r.RateLimit != nil {
+		account.RateLimit = *r.RateLimit
+	}
+	if r.RateBurst != nil {
+		account.RateBurst = *r.RateBurst
+	}
+	if r.DailyQuota != nil {
+		account.DailyQuota = *r.DailyQuota
+	}
+}
+
+// validateServiceAccount checks an account before it is saved. Its
+// permissions must be held by the user saving it, so that managing
+// service accounts does not grant every other permission.
+func validateServiceAccount(req *goodooHttp.Request, account *models.ServiceAccount) error {
+	for _, permission := range account.Permissions {
+		if !goodooHttp.KnownPermission(permission) {
+			return errors.New("unknown permission " + permission)
+		}
+		if !req.HasPermission(permission) {
+			return errors.New("cannot grant permission " + permission + ", which you do not hold")
+		}
+	}
+	registry := models.RegistryForDB(req.GetDBName())
+	for _, model := range account.Models {
+		if _, exists := registry.GetModel(model); !exists {
+			return errors.New("unknown model " + model)
+		}
+	}
+	if account.RateLimit < 0 || account.RateBurst < 0 || account.DailyQuota < 0 {
+		return errors.New("rate_limit, rate_burst and daily_quota must be positive")
+	}
+	if account.RateBurst == 0 && account.RateLimit > 0 {
+		account.RateBurst = account.RateLimit
+	}
+	return nil
+}
+
+// serviceAccountView is an account as listed, with its user
+type serviceAccountView struct {
+	models.ServiceAccount
+	Login  string `json:"login"`
+	Name   string `json:"name"`
+	Active bool   `json:"active"`
+	// Keys counts the service keys of the account
+	Keys int64 `json:"keys"`
+}
+
+// viewServiceAccount loads the user and key count of an account
+func viewServiceAccount(db *gorm.DB, account models.ServiceAccount) (serviceAccountView, error) {
+	view := serviceAccountView{ServiceAccount: account}
+	var user models.User
+	if err := db.Select("id", "login", "name", "active").First(&user, account.UserID).Error; err != nil {
+		return view, err
+	}
+	view.Login, view.Name, view.Active = user.Login, user.Name, user.Active
+	err := db.Model(&models.ServiceKey{}).Where("user_id = ?", account.UserID).Count(&view.Keys).Error
+	return view, err
+}
+
+// loadServiceAccount fetches the account named by the :id route parameter
+func loadServiceAccount(c echo.Context, db *gorm.DB) (*models.ServiceAccount, error) {
+	id, err := parseRecordID(c)
+	if err != nil {
+		return nil, err
+	}
+	var account models.ServiceAccount
+	if err := db.First(&account, id).Error; err != nil {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Service account not found")
+	}
+	return &account, nil
+}
+
+// List returns the service accounts with their user and number of keys
+func (h *ServiceAccountHandler) List(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	var accounts []models.ServiceAccount
+	if err := db.Order("id").Find(&accounts).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	views := make([]serviceAccountView, 0, len(accounts))
+	for _, account := range accounts {
+		view, err := viewServiceAccount(db, account)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		}
+		views = append(views, view)
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"accounts": views})
+}
+
+// Create adds a service account and its user, which has no password and
+// no group: it can only act through service keys, with the permissions
+// given here
+func (h *ServiceAccountHandler) Create(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+
+	var body ServiceAccountRequest
+	if err := c.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request format: "+err.Error())
+	}
+	if body.Login == nil || !serviceLoginPattern.MatchString(*body.Login) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "login must be lowercase letters, digits, ., - and _"})
+	}
+	user := &models.User{
+		Login:     *body.Login,
+		Name:      *body.Login,
+		Email:     *body.Login + "@" + serviceAccountEmailDomain,
+		Active:    true,
+		IsService: true,
+	}
+	if body.Name != nil && *body.Name != "" {
+		user.Name = *body.Name
+	}
+	account := &models.ServiceAccount{Permissions: models.StringList{}, Models: models.StringList{}}
+	body.apply(account)
+	if err := validateServiceAccount(req, account); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	var count int64
+	db.Model(&models.User{}).Where("login = ?", user.Login).Count(&count)
+	if count > 0 {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "login already in use"})
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(user).Error; err != nil {
+			return err
+		}
+		account.UserID = user.ID
+		return tx.Omit(clause.Associations).Create(account).Error
+	})
+	if err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to create service account %s: %v", user.Login, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	req.Logger.InfoCtx(req.Context, "Service account %s (%d) created by %s", user.Login, account.ID, req.GetLogin())
+	view, err := viewServiceAccount(db, *account)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusCreated, view)
+}
+
+// Update changes the permissions, models, expiry, limits, name or active
+// state of a service account
+func (h *ServiceAccountHandler) Update(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	account, err := loadServiceAccount(c, db)
+	if err != nil {
+		return err
+	}
+
+	var body ServiceAccountRequest
+	if err := c.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request format: "+err.Error())
+	}
+	var user models.User
+	if err := db.First(&user, account.UserID).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	if body.Login != nil && *body.Login != user.Login {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "login cannot be changed"})
+	}
+	body.apply(account)
+	if err := validateServiceAccount(req, account); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	userValues := map[string]interface{}{}
+	if body.Name != nil && *body.Name != "" {
+		userValues["name"] = *body.Name
+	}
+	if body.Active != nil {
+		userValues["active"] = *body.Active
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit(clause.Associations).Save(account).Error; err != nil {
+			return err
+		}
+		if len(userValues) == 0 {
+			return nil
+		}
+		return tx.Model(&user).Updates(userValues).Error
+	})
+	if err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to update service account %d: %v", account.ID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	// The permissions apply to the next request rather than within the cache TTL
+	models.InvalidatePermissions(req.GetDBName())
+
+	req.Logger.InfoCtx(req.Context, "Service account %s (%d) updated by %s", user.Login, account.ID, req.GetLogin())
+	view, err := viewServiceAccount(db, *account)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, view)
+}
+
+// Delete revokes the service keys of an account and removes it in one
+// transaction; its user is archived
+func (h *ServiceAccountHandler) Delete(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	account, err := loadServiceAccount(c, db)
+	if err != nil {
+		return err
+	}
+	revoked, err := models.DeleteServiceAccount(db, account)
+	if err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to delete service account %d: %v", account.ID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	models.InvalidatePermissions(req.GetDBName())
+	req.Logger.InfoCtx(req.Context, "Service account %d of user %d deleted by %s, %d key(s) revoked",
+		account.ID, account.UserID, req.GetLogin(), revoked)
+	return c.JSON(http.StatusOK, map[string]interface{}{"success": true, "revoked_keys": revoked})
+}
+
+// RegisterServiceAccountRoutes mounts the service account endpoints under
+// /api/service-accounts. They require the service_accounts.manage
+// permission and, like the service keys, are refused to signed requests.
+func RegisterServiceAccountRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewServiceAccountHandler(config)
+	manage := goodooHttp.PermissionServiceAccountsManage
+
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		{Method: "GET", Path: "/api/service-accounts", Handler: handler.List, Auth: true, DB: true, Permission: manage},
+		{Method: "POST", Path: "/api/service-accounts", Handler: handler.Create, Auth: true, DB: true, Permission: manage, DenyImpersonation: true},
+		{Method: "PUT", Path: "/api/service-accounts/:id", Handler: handler.Update, Auth: true, DB: true, Permission: manage, DenyImpersonation: true},
+		{Method: "DELETE", Path: "/api/service-accounts/:id", Handler: handler.Delete, Auth: true, DB: true, Permission: manage, DenyImpersonation: true},
+	})
+}
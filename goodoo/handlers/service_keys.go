@@ -0,0 +1,250 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"goodoo/crypto"
+	goodooHttp "goodoo/http"
+	"goodoo/models"
+	"goodoo/webhook"
+	"gorm.io/gorm"
+)
+
+// defaultServiceKeyGrace is how long the previous secret of a rotated
+// service key stays valid when the rotation does not say
+const defaultServiceKeyGrace = 24 * time.Hour
+
+var serviceKeyIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]*$`)
+
+// ServiceKeyHandler manages the keys other services sign their requests
+// with (administrators only)
+type ServiceKeyHandler struct {
+	Config *goodooHttp.RequestConfig
+}
+
+// NewServiceKeyHandler creates a new service key handler
+func NewServiceKeyHandler(config *goodooHttp.RequestConfig) *ServiceKeyHandler {
+	return &ServiceKeyHandler{Config: config}
+}
+
+// ServiceKeyRequest is the body of create and update requests; nil fields
+// are left unchanged. The key id cannot change once created.
+type ServiceKeyRequest struct {
+	KeyID  *string `json:"key_id"`
+	Name   *string `json:"name"`
+	UserID *uint   `json:"user_id"`
+	Active *bool   `json:"active"`
+}
+
+// apply copies the set fields onto the key
+func (r *ServiceKeyRequest) apply(key *models.ServiceKey) {
+	if r.Name != nil {
+		key.Name = *r.Name
+	}
+	if r.UserID != nil {
+		key.UserID = *r.UserID
+	}
+	if r.Active != nil {
+		key.Active = *r.Active
+	}
+}
+
+// RotateServiceKeyRequest sets how long the current secret stays valid
+// after the rotation, e.g. "24h"; "0s" revokes it at once
+type RotateServiceKeyRequest struct {
+	Grace *string `json:"grace"`
+}
+
+// validateServiceKey checks a key before it is saved
+func validateServiceKey(db *gorm.DB, key *models.ServiceKey) error {
+	if !serviceKeyIDPattern.MatchString(key.KeyID) {
+		return errors.New("key_id must be lowercase letters, digits, ., - and _")
+	}
+	if key.Name == "" {
+		key.Name = key.KeyID
+	}
+	var user models.User
+	if err := db.Where("id = ? AND active = ?", key.UserID, true).First(&user).Error; err != nil {
+		return errors.New("service user not found or inactive")
+	}
+	return nil
+}
+
+// loadServiceKey fetches the key named by the :id route parameter
+func loadServiceKey(c echo.Context, db *gorm.DB) (*models.ServiceKey, error) {
+	id, err := parseRecordID(c)
+	if err != nil {
+		return nil, err
+	}
+	var key models.ServiceKey
+	if err := db.First(&key, id).Error; err != nil {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Service key not found")
+	}
+	return &key, nil
+}
+
+// List returns all service keys, without their secrets
+func (h *ServiceKeyHandler) List(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	var keys []models.ServiceKey
+	if err := req.GetDB().Order("key_id").Find(&keys).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"keys": keys})
+}
+
+// Create adds a service key running as the given service user, the
+// creating administrator by default. The secret is generated and returned
+// only in this response.
+func (h *ServiceKeyHandler) Create(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+
+	var body ServiceKeyRequest
+	if err := c.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request format: "+err.Error())
+	}
+	key := &models.ServiceKey{UserID: uint(req.GetUserID()), Active: true}
+	if body.KeyID != nil {
+		key.KeyID = *body.KeyID
+	}
+	body.apply(key)
+	if err := validateServiceKey(db, key); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	secret, err := webhook.GenerateSecret()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	key.Secret = crypto.EncryptedString(secret)
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// Select all columns so false booleans are not replaced by column defaults
+		if err := tx.Select("*").Omit("id").Create(key).Error; err != nil {
+			return err
+		}
+		return models.ReserveQuota(tx, req.GetDBName(), models.QuotaServiceKey, key.UserID)
+	})
+	var quotaErr *models.QuotaExceededError
+	if errors.As(err, &quotaErr) {
+		return quotaExceededResponse(c, quotaErr)
+	}
+	if err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to create service key: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	req.Logger.InfoCtx(req.Context, "Service key %s (%d) created by %s for user %d", key.KeyID, key.ID, req.GetLogin(), key.UserID)
+	return c.JSON(http.StatusCreated, map[string]interface{}{
+		"key":    key,
+		"secret": secret,
+	})
+}
+
+// Update renames, reassigns, disables or enables a service key
+func (h *ServiceKeyHandler) Update(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	key, err := loadServiceKey(c, db)
+	if err != nil {
+		return err
+	}
+
+	var body ServiceKeyRequest
+	if err := c.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request format: "+err.Error())
+	}
+	if body.KeyID != nil && *body.KeyID != key.KeyID {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "key_id cannot be changed"})
+	}
+	body.apply(key)
+	if err := validateServiceKey(db, key); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	if err := db.Save(key).Error; err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to update service key %d: %v", key.ID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	req.Logger.InfoCtx(req.Context, "Service key %s (%d) updated by %s", key.KeyID, key.ID, req.GetLogin())
+	return c.JSON(http.StatusOK, key)
+}
+
+// Rotate generates a new secret, returned only in this response. The
+// previous one stays valid for the grace period, 24 hours by default, so
+// the calling service can switch to the new secret without failing calls.
+func (h *ServiceKeyHandler) Rotate(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	key, err := loadServiceKey(c, db)
+	if err != nil {
+		return err
+	}
+
+	var body RotateServiceKeyRequest
+	if err := c.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request format: "+err.Error())
+	}
+	grace := defaultServiceKeyGrace
+	if body.Grace != nil {
+		if grace, err = time.ParseDuration(*body.Grace); err != nil || grace < 0 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "grace must be a duration such as 24h"})
+		}
+	}
+	secret, err := webhook.GenerateSecret()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	key.Rotate(secret, grace, req.Now())
+	if err := db.Save(key).Error; err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to rotate service key %d: %v", key.ID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	req.Logger.InfoCtx(req.Context, "Service key %s (%d) rotated by %s, previous secret valid for %v",
+		key.KeyID, key.ID, req.GetLogin(), grace)
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"key":    key,
+		"secret": secret,
+	})
+}
+
+// Delete removes a service key; requests signed with it fail at once
+func (h *ServiceKeyHandler) Delete(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	key, err := loadServiceKey(c, db)
+	if err != nil {
+		return err
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Delete(key).Error; err != nil {
+			return err
+		}
+		return models.ReleaseQuota(tx, models.QuotaServiceKey, key.UserID, 1)
+	})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	req.Logger.InfoCtx(req.Context, "Service key %s (%d) deleted by %s", key.KeyID, key.ID, req.GetLogin())
+	return c.JSON(http.StatusOK, map[string]interface{}{"success": true})
+}
+
+// RegisterServiceKeyRoutes mounts the service key endpoints under
+// /api/service-keys. They require the service_keys.manage permission, and
+// are refused to signed requests: a service cannot mint itself other keys.
+func RegisterServiceKeyRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewServiceKeyHandler(config)
+	manage := goodooHttp.PermissionServiceKeysManage
+
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		{Method: "GET", Path: "/api/service-keys", Handler: handler.List, Auth: true, DB: true, Permission: manage},
+		{Method: "POST", Path: "/api/service-keys", Handler: handler.Create, Auth: true, DB: true, Permission: manage, DenyImpersonation: true},
+		{Method: "PUT", Path: "/api/service-keys/:id", Handler: handler.Update, Auth: true, DB: true, Permission: manage, DenyImpersonation: true},
+		{Method: "POST", Path: "/api/service-keys/:id/rotate", Handler: handler.Rotate, Auth: true, DB: true, Permission: manage, DenyImpersonation: true},
+		{Method: "DELETE", Path: "/api/service-keys/:id", Handler: handler.Delete, Auth: true, DB: true, Permission: manage, DenyImpersonation: true},
+	})
+}
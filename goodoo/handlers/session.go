@@ -1,10 +1,13 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 
 	"github.com/labstack/echo/v4"
 	goodooHttp "goodoo/http"
+	"goodoo/models"
+	"goodoo/refdata"
 )
 
 // SessionHandler handles session management
@@ -79,4 +82,203 @@ func (h *SessionHandler) SetSessionData(c echo.Context) error {
 		"key":     body.Key,
 		"value":   body.Value,
 	})
-}
\ No newline at end of file
+}
+// SetLang changes the session language; for a logged-in user it is also
+// saved as their preference so it survives the next login
+func (h *SessionHandler) SetLang(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+
+	lang := req.GetStringParam("lang")
+	installed := []string{models.DefaultLang}
+	if h.Config.LangResolver != nil && req.GetDBName() != "" {
+		installed = h.Config.LangResolver(req.GetDBName())
+	}
+	supported := false
+	for _, candidate := range installed {
+		if candidate == lang {
+			supported = true
+			break
+		}
+	}
+	if !supported {
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"error":     "Unsupported language: " + lang,
+			"installed": installed,
+		})
+	}
+
+	return h.savePreference(c, req, map[string]interface{}{"lang": lang}, map[string]interface{}{"lang": lang})
+}
+
+// SetTz changes the session timezone, saved like SetLang; it must be a
+// zone of the refdata catalog
+func (h *SessionHandler) SetTz(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+
+	tz := req.GetStringParam("tz")
+	if !refdata.IsTimezone(tz) {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid timezone: " + tz,
+		})
+	}
+
+	return h.savePreference(c, req, map[string]interface{}{"tz": tz, "timezone": tz}, map[string]interface{}{"tz": tz})
+}
+
+// savePreference updates the session context and the user's stored preference
+func (h *SessionHandler) savePreference(c echo.Context, req *goodooHttp.Request, context, userValues map[string]interface{}) error {
+	req.Session.UpdateContext(context)
+
+	if req.IsAuthenticated() {
+		db := req.GetDB()
+		if db == nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Database not available")
+		}
+		if err := db.Model(&models.User{}).Where("id = ?", req.GetUserID()).Updates(userValues).Error; err != nil {
+			req.Logger.ErrorCtx(req.Context, "Failed to save preferences of user %d: %v", req.GetUserID(), err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		}
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"success": true,
+		"context": req.Session.GetContext(),
+	})
+}
+
+// GetContextDefaults returns the sticky context keys users may set and
+// their values in the session
+func (h *SessionHandler) GetContextDefaults(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+
+	context := req.Session.GetContext()
+	values := make(map[string]interface{}, len(h.Config.ContextDefaultKeys))
+	for _, key := range h.Config.ContextDefaultKeys {
+		values[key] = context[key]
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"keys":   h.Config.ContextDefaultKeys,
+		"values": values,
+	})
+}
+
+// SetContextDefaults sets sticky context keys, {"values": {"team_id": 3}};
+// a null value clears a key. For a logged-in user they are also saved on
+// the user so they follow the next logins.
+func (h *SessionHandler) SetContextDefaults(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+
+	var body struct {
+		Values map[string]interface{} `json:"values"`
+	}
+	if err := c.Bind(&body); err != nil || len(body.Values) == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "values are required"})
+	}
+	allowed := make(map[string]bool, len(h.Config.ContextDefaultKeys))
+	for _, key := range h.Config.ContextDefaultKeys {
+		allowed[key] = true
+	}
+	for key, value := range body.Values {
+		if !allowed[key] {
+			return c.JSON(http.StatusBadRequest, map[string]interface{}{
+				"error": "Context key not allowed: " + key,
+				"keys":  h.Config.ContextDefaultKeys,
+			})
+		}
+		if !models.ValidContextDefault(value) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid value for " + key})
+		}
+	}
+
+	req.Session.UpdateContext(body.Values)
+
+	if req.IsAuthenticated() {
+		db := req.GetDB()
+		if db == nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Database not available")
+		}
+		var user models.User
+		if err := db.First(&user, req.GetUserID()).Error; err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		}
+		if err := user.SetContextDefaults(body.Values); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		if err := db.Model(&user).Update("context_defaults", user.ContextDefaultValues).Error; err != nil {
+			req.Logger.ErrorCtx(req.Context, "Failed to save context defaults of user %d: %v", req.GetUserID(), err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		}
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"success": true,
+		"context": req.Session.GetContext(),
+	})
+}
+
+// Stats describes the stored sessions from the session store index: totals,
+// users active in the last 15 minutes, hour and day, sessions per user and
+// user agent families. ?db= keeps the sessions of one database.
+func (h *SessionHandler) Stats(c echo.Context) error {
+	store, ok := h.Config.SessionStore.(goodooHttp.SessionStatsSource)
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotImplemented, "The session store does not report statistics")
+	}
+	return c.JSON(http.StatusOK, store.Stats(c.QueryParam("db")))
+}
+
+// GetPreferences returns the preferences of the user, defaults included,
+// with the schema of the allowed keys; ?namespace=dashboard limits them to
+// a namespace
+func (h *SessionHandler) GetPreferences(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	db := req.GetDB()
+	if db == nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database not available")
+	}
+
+	values, err := models.GetPreferences(db, uint(req.GetUserID()), c.QueryParam("namespace"))
+	if err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to load preferences of user %d: %v", req.GetUserID(), err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"preferences": values,
+		"schema":      models.PreferenceSchema,
+	})
+}
+
+// SetPreferences updates some preferences of the user,
+// {"dashboard.collapsed_cards": ["sales"], "list.page_size": 50}; a null
+// value resets a preference to its default, and keys outside the schema
+// are refused
+func (h *SessionHandler) SetPreferences(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	db := req.GetDB()
+	if db == nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database not available")
+	}
+
+	var body map[string]interface{}
+	if err := c.Bind(&body); err != nil || len(body) == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "preferences are required"})
+	}
+	uid := uint(req.GetUserID())
+	if err := models.SetPreferences(db, uid, body); err != nil {
+		var prefErr *models.PreferenceError
+		if errors.As(err, &prefErr) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error(), "key": prefErr.Key})
+		}
+		req.Logger.ErrorCtx(req.Context, "Failed to save preferences of user %d: %v", uid, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	values, err := models.GetPreferences(db, uid, "")
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"success":     true,
+		"preferences": values,
+	})
+}
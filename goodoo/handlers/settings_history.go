@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	goodooHttp "goodoo/http"
+	"goodoo/models"
+)
+
+// Bounds of the settings history listed at once
+const (
+	DefaultSettingsHistoryLimit = 100
+	MaxSettingsHistoryLimit     = 1000
+)
+
+// GetSettingsHistory lists the changes of the system parameters, newest
+// first, sensitive values redacted (settings.read): GET
+// /api/settings/history?key=...&change=...&from=...&to=...&limit=100
+func (h *DashboardHandler) GetSettingsHistory(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	if db == nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database not available")
+	}
+
+	filter := models.ParameterHistoryFilter{Key: c.QueryParam("key"), Limit: DefaultSettingsHistoryLimit}
+	if value := c.QueryParam("change"); value != "" {
+		change, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid change: "+value)
+		}
+		filter.ChangeID = uint(change)
+	}
+	loc := requestLocation(req)
+	var err error
+	if value := c.QueryParam("from"); value != "" {
+		if filter.From, err = parseMetricsTime(value, loc); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid from: "+value)
+		}
+	}
+	if value := c.QueryParam("to"); value != "" {
+		if filter.To, err = parseMetricsTime(value, loc); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid to: "+value)
+		}
+	}
+	if value := c.QueryParam("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid limit: "+value)
+		}
+		filter.Limit = min(limit, MaxSettingsHistoryLimit)
+	}
+
+	records, err := models.ListParameterHistory(db, filter)
+	if err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to list the settings history: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to list the settings history"})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"history": records})
+}
+
+// RollbackSettings restores the values the system parameters of a change
+// had before it, validated again and recorded as a new change
+// (settings.write): POST /api/settings/history/:change/rollback
+func (h *DashboardHandler) RollbackSettings(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	if db == nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database not available")
+	}
+	change, err := strconv.ParseUint(c.Param("change"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid change")
+	}
+
+	rollback, err := models.RollbackParams(db, req.GetDBName(), uint(req.GetUserID()), uint(change))
+	if err != nil {
+		var invalid *models.ParamValidationError
+		switch {
+		case errors.Is(err, models.ErrChangeNotFound):
+			return c.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+		case errors.As(err, &invalid):
+			return c.JSON(http.StatusConflict, map[string]string{"error": invalid.Err.Error(), "key": invalid.Key})
+		}
+		req.Logger.ErrorCtx(req.Context, "Failed to roll back settings change %d: %v", change, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to roll back the settings"})
+	}
+
+	req.Logger.InfoCtx(req.Context, "Settings change %d rolled back as change %d", change, rollback)
+	return c.JSON(http.StatusOK, map[string]interface{}{"change_id": rollback, "rollback_of": change})
+}
@@ -0,0 +1,311 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	goodooHttp "goodoo/http"
+	"goodoo/models"
+	"gorm.io/gorm"
+)
+
+// ShareHandler creates share links of records and serves them on
+// /share/:token to visitors without an account
+type ShareHandler struct {
+	Config  *goodooHttp.RequestConfig
+	records *RecordsHandler
+}
+
+// NewShareHandler creates a new share handler
+func NewShareHandler(config *goodooHttp.RequestConfig) *ShareHandler {
+	return &ShareHandler{Config: config, records: NewRecordsHandler(config)}
+}
+
+// ShareLinkRequest is the body of a share link creation
+type ShareLinkRequest struct {
+	Fields    []string   `json:"fields"`
+	Password  string     `json:"password"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// ShareLinkResponse describes a share link; Token and URL are only set
+// when it is created
+type ShareLinkResponse struct {
+	*models.ShareLink
+	Fields   []string `json:"fields"`
+	Password bool     `json:"password"`
+	Token    string   `json:"token,omitempty"`
+	URL      string   `json:"url,omitempty"`
+}
+
+// shareLinkResponse describes link
+func shareLinkResponse(link *models.ShareLink) ShareLinkResponse {
+	return ShareLinkResponse{ShareLink: link, Fields: link.AllowedFields(), Password: link.HasPassword()}
+}
+
+// recordOwner reports whether the user created the record
+func recordOwner(env *models.Environment, model *models.ModelDefinition, id uint) bool {
+	var owners []uint
+	if err := env.GetDB().Table(model.TableName).Where("id = ?", id).Pluck("create_uid", &owners).Error; err != nil {
+		return false
+	}
+	return len(owners) == 1 && owners[0] == env.UserID()
+}
+
+// Create shares fields of a record:
+// {"fields": ["name", "amount_total"], "password": "...", "expires_at": "2025-01-31T00:00:00Z"}.
+// The token is returned only in this response.
+func (h *ShareHandler) Create(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	model, err := h.records.resolveModel(c)
+	if err != nil {
+		return err
+	}
+	id, err := parseRecordID(c)
+	if err != nil {
+		return err
+	}
+
+	var body ShareLinkRequest
+	if err := c.Bind(&body); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+	}
+	link, token, err := models.CreateShareLink(req.GetEnv(), model, id, models.ShareLinkOptions{
+		Fields:    body.Fields,
+		Password:  body.Password,
+		ExpiresAt: body.ExpiresAt,
+	})
+	var quotaErr *models.QuotaExceededError
+	if errors.As(err, &quotaErr) {
+		return quotaExceededResponse(c, quotaErr)
+	}
+	if err != nil {
+		return readErrorResponse(c, err)
+	}
+
+	req.Logger.InfoCtx(req.Context, "Share link %d of %s %d created by %s", link.ID, model.Name, id, req.GetLogin())
+	response := shareLinkResponse(link)
+	response.Token = token
+	response.URL = "/share/" + token
+	return c.JSON(http.StatusCreated, response)
+}
+
+// List returns the share links of a record: all of them for its owner and
+// administrators, those the user created otherwise
+func (h *ShareHandler) List(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	model, err := h.records.resolveModel(c)
+	if err != nil {
+		return err
+	}
+	id, err := parseRecordID(c)
+	if err != nil {
+		return err
+	}
+
+	env := req.GetEnv()
+	query := env.GetDB().Where("model = ? AND res_id = ?", model.Name, id)
+	if !env.IsAdmin() && !recordOwner(env, model, id) {
+		query = query.Where("created_by = ?", env.UserID())
+	}
+	var links []models.ShareLink
+	if err := query.Order("id DESC").Find(&links).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	responses := make([]ShareLinkResponse, 0, len(links))
+	for i := range links {
+		responses = append(responses, shareLinkResponse(&links[i]))
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"links": responses, "total": len(responses)})
+}
+
+// Revoke closes a share link of a record; its creator, the owner of the
+// record and administrators may revoke it
+func (h *ShareHandler) Revoke(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	model, err := h.records.resolveModel(c)
+	if err != nil {
+		return err
+	}
+	id, err := parseRecordID(c)
+	if err != nil {
+		return err
+	}
+	linkID, err := strconv.ParseUint(c.Param("link_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid share link ID")
+	}
+
+	env := req.GetEnv()
+	var link models.ShareLink
+	err = env.GetDB().Where("id = ? AND model = ? AND res_id = ?", linkID, model.Name, id).First(&link).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, "Share link not found")
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	if link.CreatedBy != env.UserID() && !env.IsAdmin() && !recordOwner(env, model, id) {
+		return echo.NewHTTPError(http.StatusForbidden, "Only the creator of the link or the owner of the record may revoke it")
+	}
+
+	if err := link.Revoke(env.GetDB(), env.UserID()); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	req.Logger.InfoCtx(req.Context, "Share link %d of %s %d revoked by %s", link.ID, model.Name, id, req.GetLogin())
+	return c.JSON(http.StatusOK, shareLinkResponse(&link))
+}
+
+// sharedField is a field shown by a share link, formatted for display
+type sharedField struct {
+	Name  string `json:"name"`
+	Label string `json:"label"`
+	Value string `json:"value"`
+}
+
+// sharePage renders a template of the public share view with data, or
+// answers body with ?format=json
+func sharePage(c echo.Context, status int, template string, body interface{}, data map[string]interface{}) error {
+	header := c.Response().Header()
+	// The token is in the URL: keep it out of caches, search engines and
+	// the Referer of links followed from the page
+	header.Set("Cache-Control", "no-store")
+	header.Set("Referrer-Policy", "no-referrer")
+	header.Set("X-Robots-Tag", "noindex")
+	if c.QueryParam("format") == "json" {
+		return c.JSON(status, body)
+	}
+	page := pageData(c)
+	for key, value := range data {
+		page[key] = value
+	}
+	return c.Render(status, template, page)
+}
+
+// shareError renders the error page of the public share view
+func shareError(c echo.Context, status int, title, message string) error {
+	return sharePage(c, status, "share_error.html", map[string]string{"error": message},
+		map[string]interface{}{"Title": title, "Message": message})
+}
+
+// View shows the shared fields of a record to anyone holding the token,
+// after asking for the password of protected links
+func (h *ShareHandler) View(c echo.Context) error {
+	return h.open(c, "")
+}
+
+// Unlock shows a protected record once the password posted, as a form
+// field or in a JSON body, matches
+func (h *ShareHandler) Unlock(c echo.Context) error {
+	var body struct {
+		Password string `json:"password" form:"password"`
+	}
+	if err := c.Bind(&body); err != nil {
+		return shareError(c, http.StatusBadRequest, "Invalid request", "The password could not be read.")
+	}
+	return h.open(c, body.Password)
+}
+
+// open checks the link of the route token and shows its record
+func (h *ShareHandler) open(c echo.Context, password string) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	db := req.GetDB()
+	if db == nil {
+		return shareError(c, http.StatusServiceUnavailable, "Unavailable", "This link cannot be opened right now. Try again later.")
+	}
+
+	link, err := models.FindShareLink(db, c.Param("token"))
+	if errors.Is(err, models.ErrShareLinkNotFound) {
+		return shareError(c, http.StatusNotFound, "Link not found", "This link does not exist. Check that it was copied entirely.")
+	}
+	if err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to look up share link: %v", err)
+		return shareError(c, http.StatusInternalServerError, "Unavailable", "This link cannot be opened right now. Try again later.")
+	}
+	if err := link.Usable(time.Now()); err != nil {
+		message := "This link has expired. Ask the sender for a new one."
+		if errors.Is(err, models.ErrShareLinkRevoked) {
+			message = "This link has been revoked by its sender."
+		}
+		return shareError(c, http.StatusGone, "Link no longer available", message)
+	}
+
+	if link.HasPassword() {
+		if password == "" {
+			return sharePage(c, http.StatusUnauthorized, "share_password.html", map[string]string{"error": "Password required"}, nil)
+		}
+		if !link.CheckPassword(password) {
+			req.Logger.WarningCtx(req.Context, "Wrong password for share link %d from %s", link.ID, req.RemoteAddr)
+			return sharePage(c, http.StatusForbidden, "share_password.html", map[string]string{"error": "Wrong password"},
+				map[string]interface{}{"Message": "Wrong password."})
+		}
+	}
+
+	model, exists := models.RegistryForDB(req.GetDBName()).GetModel(link.Model)
+	if !exists {
+		return shareError(c, http.StatusGone, "Link no longer available", "The shared record no longer exists.")
+	}
+	// Fields restricted to groups since the link was created are not shown
+	var names []string
+	for _, name := range link.AllowedFields() {
+		if models.ValidateShareFields(model, []string{name}) == nil {
+			names = append(names, name)
+		}
+	}
+	env := models.NewEnvironment(db, link.CreatedBy).WithDBName(req.GetDBName())
+	records, err := model.Read(env, []uint{link.ResID}, names)
+	if err == nil && len(records) == 0 {
+		return shareError(c, http.StatusGone, "Link no longer available", "The shared record no longer exists.")
+	}
+	var display map[string]string
+	if err == nil {
+		display, err = model.Display(env, records[0])
+	}
+	if err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to read share link %d: %v", link.ID, err)
+		return shareError(c, http.StatusInternalServerError, "Unavailable", "This link cannot be opened right now. Try again later.")
+	}
+
+	if err := link.RecordAccess(db, uint(req.GetUserID()), req.RemoteAddr); err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to record access to share link %d: %v", link.ID, err)
+	}
+
+	shared := make([]sharedField, 0, len(names))
+	for _, name := range names {
+		if _, ok := records[0][name]; !ok {
+			continue
+		}
+		label := model.Fields[name].GetAttributes().String
+		if label == "" {
+			label = name
+		}
+		shared = append(shared, sharedField{Name: name, Label: label, Value: display[name]})
+	}
+	title := model.Description
+	if title == "" {
+		title = model.Name
+	}
+	return sharePage(c, http.StatusOK, "share.html",
+		map[string]interface{}{"model": model.Name, "res_id": link.ResID, "fields": shared, "expires_at": link.ExpiresAt},
+		map[string]interface{}{"Title": title, "Fields": shared, "ExpiresAt": link.ExpiresAt})
+}
+
+// RegisterShareRoutes mounts the share link endpoints of records under
+// /api/records and the public view at /share/:token
+func RegisterShareRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewShareHandler(config)
+
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		{Method: "POST", Path: "/api/records/:model/:id/share", Handler: handler.Create, Auth: true, DB: true},
+		{Method: "GET", Path: "/api/records/:model/:id/shares", Handler: handler.List, Auth: true, DB: true},
+		{Method: "DELETE", Path: "/api/records/:model/:id/shares/:link_id", Handler: handler.Revoke, Auth: true, DB: true},
+
+		// Public: visitors hold a token, not a session
+		{Method: "GET", Path: "/share/:token", Handler: handler.View, Public: true},
+		{Method: "POST", Path: "/share/:token", Handler: handler.Unlock, Public: true, RateLimit: "auth", CSRFExempt: true},
+	})
+}
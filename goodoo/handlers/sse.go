@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"goodoo/bus"
+	"goodoo/connections"
+	goodooHttp "goodoo/http"
+)
+
+// eventStream is a server-sent events response registered with the
+// connection manager. Its headers are written with the first event, so
+// that the handler may still answer with an error until then.
+type eventStream struct {
+	response *echo.Response
+	conn     *connections.Conn
+	started  bool
+}
+
+// openEventStream registers the long-lived connection of a request
+// forwarding the bus channels. When a limit is reached, or the server
+// stops, the stream is nil and err answers the request: 429 past the
+// limit of the user, 503 with Retry-After otherwise.
+func openEventStream(c echo.Context, kind string, channels ...string) (*eventStream, error) {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	conn, err := connections.Open(connections.Info{
+		Type:       kind,
+		DB:         req.GetDBName(),
+		UserID:     uint(req.GetUserID()),
+		Login:      req.GetLogin(),
+		Channels:   channels,
+		RemoteAddr: c.RealIP(),
+	})
+	switch {
+	case errors.Is(err, connections.ErrUserLimit):
+		return nil, echo.NewHTTPError(http.StatusTooManyRequests,
+			fmt.Sprintf("Too many open connections (at most %d per user), close another tab or stream", connections.Limits().MaxPerUser))
+	case err != nil:
+		retry := max(1, int(connections.Limits().ReconnectAfter.Seconds()))
+		c.Response().Header().Set("Retry-After", strconv.Itoa(retry))
+		message := "Too many open connections, try again later"
+		if errors.Is(err, connections.ErrDraining) {
+			message = "Server is shutting down, reconnect shortly"
+		}
+		return nil, echo.NewHTTPError(http.StatusServiceUnavailable, message)
+	}
+	return &eventStream{response: c.Response(), conn: conn}, nil
+}
+
+// lastEventID returns the bus message a reconnecting client saw last, from
+// the Last-Event-ID header or the last_event_id parameter of clients that
+// cannot set headers. resuming is false when the client sent none, and
+// known false when the identifier is invalid or was issued by another
+// process, whose messages cannot be replayed.
+func lastEventID(c echo.Context) (id uint64, resuming, known bool) {
+	value := c.Request().Header.Get("Last-Event-ID")
+	if value == "" {
+		value = c.QueryParam("last_event_id")
+	}
+	if value == "" {
+		return 0, false, false
+	}
+	id, known = bus.ParseEventID(value)
+	return id, true, known
+}
+
+// write writes a raw frame and flushes it
+func (s *eventStream) write(frame string) error {
+	if !s.started {
+		s.started = true
+		s.response.Header().Set(echo.HeaderContentType, "text/event-stream")
+		s.response.Header().Set(echo.HeaderCacheControl, "no-cache")
+		s.response.Header().Set("X-Accel-Buffering", "no")
+		s.response.WriteHeader(http.StatusOK)
+	}
+	if _, err := fmt.Fprint(s.response, frame); err != nil {
+		return err
+	}
+	s.response.Flush()
+	return nil
+}
+
+// send sends an event with payload as JSON data
+func (s *eventStream) send(event string, payload interface{}) error {
+	return s.sendID(0, event, payload)
+}
+
+// sendID sends an event forwarded from the bus message id, which the
+// client sends back as Last-Event-ID when it reconnects; 0 sends no id
+func (s *eventStream) sendID(id uint64, event string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	frame := fmt.Sprintf("event: %s\ndata: %s\n\n", event, data)
+	if id != 0 {
+		frame = "id: " + bus.EventID(id) + "\n" + frame
+	}
+	if err := s.write(frame); err != nil {
+		return err
+	}
+	s.conn.Sent(len(frame))
+	return nil
+}
+
+// keepAlive sends a comment so that proxies keep the connection open; it
+// does not count as activity
+func (s *eventStream) keepAlive() error {
+	return s.write(": keep-alive\n\n")
+}
+
+// closing is closed when the server closes the connection
+func (s *eventStream) closing() <-chan struct{} {
+	return s.conn.Closing()
+}
+
+// goAway tells the client why the server closes the stream and, on
+// shutdown, when to reconnect: "retry" sets the delay of the browser's
+// EventSource, "reconnect_after" is in milliseconds too
+func (s *eventStream) goAway() {
+	payload := map[string]interface{}{"reason": s.conn.Reason()}
+	frame := ""
+	if s.conn.Reason() == connections.ReasonShutdown {
+		after := connections.Limits().ReconnectAfter.Milliseconds()
+		payload["reconnect_after"] = after
+		frame = fmt.Sprintf("retry: %d\n", after)
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return
+	}
+	s.write(frame + fmt.Sprintf("event: goaway\ndata: %s\n\n", data))
+}
+
+// close unregisters the connection
+func (s *eventStream) close() {
+	s.conn.Close()
+}
@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	goodooHttp "goodoo/http"
+	"goodoo/maintenance"
+	"goodoo/status"
+)
+
+// StatusHandler serves the status page
+type StatusHandler struct {
+	Config *goodooHttp.RequestConfig
+
+	mutex sync.Mutex
+	// pages caches the public page of each database for status.CacheTTL
+	pages map[string]*statusPage
+}
+
+// NewStatusHandler creates a new status handler
+func NewStatusHandler(config *goodooHttp.RequestConfig) *StatusHandler {
+	return &StatusHandler{Config: config, pages: make(map[string]*statusPage)}
+}
+
+// StatusComponent is a component of the public status page with its
+// uptime history
+type StatusComponent struct {
+	status.ComponentStatus
+	// Uptime is the percentage over the history, nil without samples
+	Uptime  *float64           `json:"uptime"`
+	History []status.DayUptime `json:"history"`
+}
+
+// StatusMaintenance is the maintenance announced on the status page
+type StatusMaintenance struct {
+	Message string     `json:"message,omitempty"`
+	Until   *time.Time `json:"until,omitempty"`
+}
+
+// StatusResponse is the public status page: generic states only, without
+// hosts, errors or versions
+type StatusResponse struct {
+	Status      string             `json:"status"`
+	Components  []StatusComponent  `json:"components"`
+	Maintenance *StatusMaintenance `json:"maintenance,omitempty"`
+	UpdatedAt   time.Time          `json:"updated_at"`
+}
+
+// statusPage is a cached public page
+type statusPage struct {
+	response StatusResponse
+	at       time.Time
+}
+
+// publicStatus assembles the public page of the database of the request
+// from probes
+func publicStatus(req *goodooHttp.Request, probes []status.Probe, now time.Time) StatusResponse {
+	dbName := req.GetDBName()
+	components := status.Redact(probes)
+	response := StatusResponse{
+		Status:     status.Overall(components),
+		Components: make([]StatusComponent, len(components)),
+		UpdatedAt:  now.UTC(),
+	}
+
+	histories := make(map[string]status.ComponentHistory)
+	if db := req.GetDB(); db != nil {
+		list, err := status.History(db, now)
+		if err != nil {
+			req.Logger.WarningCtx(req.Context, "Failed to load the status history: %v", err)
+		}
+		for _, history := range list {
+			histories[history.Component] = history
+		}
+	}
+	for i, component := range components {
+		history := histories[component.Component]
+		response.Components[i] = StatusComponent{ComponentStatus: component, Uptime: history.Uptime, History: history.Days}
+		if response.Components[i].History == nil {
+			response.Components[i].History = []status.DayUptime{}
+		}
+	}
+
+	if state := maintenance.Get(dbName); state.Active(now) {
+		response.Maintenance = &StatusMaintenance{Message: state.Message, Until: state.Until}
+		if response.Status == status.Operational {
+			response.Status = status.Degraded
+		}
+	}
+	return response
+}
+
+// Status is the public status page: the state of each component
+// (operational, degraded or down), its daily uptime over the last 90 days
+// and the maintenance message, if any. It is computed at most every 30
+// seconds per database and may be cached as long. Browsers get an HTML
+// page; ?format=json or ?format=html chooses.
+func (h *StatusHandler) Status(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	now := req.Now()
+
+	h.mutex.Lock()
+	page, ok := h.pages[req.GetDBName()]
+	if !ok || now.Sub(page.at) >= status.CacheTTL || now.Before(page.at) {
+		probes := status.Current(req.Context, req.GetDBName(), now)
+		page = &statusPage{response: publicStatus(req, probes, now), at: now}
+		h.pages[req.GetDBName()] = page
+	}
+	h.mutex.Unlock()
+
+	maxAge := int((status.CacheTTL - now.Sub(page.at)).Seconds())
+	c.Response().Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(max(maxAge, 0)))
+	format := c.QueryParam("format")
+	if format == "" && strings.Contains(c.Request().Header.Get(echo.HeaderAccept), echo.MIMETextHTML) {
+		format = "html"
+	}
+	if format != "html" {
+		return c.JSON(http.StatusOK, page.response)
+	}
+	data := pageData(c)
+	data["Status"] = page.response
+	return c.Render(http.StatusOK, "status.html", data)
+}
+
+// AdminStatus is the status page of the operators, with the raw output
+// of each probe; ?refresh=1 probes again instead of using the cache
+func (h *StatusHandler) AdminStatus(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	now := req.Now()
+
+	var probes []status.Probe
+	if refresh, _ := strconv.ParseBool(c.QueryParam("refresh")); refresh {
+		probes = status.Run(req.Context, req.GetDBName(), now)
+	} else {
+		probes = status.Current(req.Context, req.GetDBName(), now)
+	}
+	response := publicStatus(req, probes, now)
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"status":      response.Status,
+		"components":  response.Components,
+		"maintenance": maintenance.Get(req.GetDBName()),
+		"probes":      probes,
+		"updated_at":  response.UpdatedAt,
+	})
+}
+
+// RegisterStatusRoutes mounts the public status page and its
+// administrator variant, which requires the status.read permission
+func RegisterStatusRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewStatusHandler(config)
+
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		{Method: "GET", Path: "/status", Handler: handler.Status, Public: true, RateLimit: "public"},
+		{Method: "GET", Path: "/api/status", Handler: handler.AdminStatus, Auth: true, DB: true, Permission: goodooHttp.PermissionStatusRead},
+	})
+}
@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	goodooHttp "goodoo/http"
+	"goodoo/storage"
+)
+
+// StorageHandler reports the usage of the storage areas
+type StorageHandler struct {
+	Config *goodooHttp.RequestConfig
+}
+
+// NewStorageHandler creates a new storage handler
+func NewStorageHandler(config *goodooHttp.RequestConfig) *StorageHandler {
+	return &StorageHandler{Config: config}
+}
+
+// Usage returns the files, bytes and quota of each storage area, as
+// measured by the last housekeeping run, with the outcome of its cleanup
+func (h *StorageHandler) Usage(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"areas":      storage.Report(),
+		"thresholds": storage.Thresholds,
+	})
+}
+
+// RegisterStorageRoutes mounts the storage report, reserved to the holders
+// of db.manage
+func RegisterStorageRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewStorageHandler(config)
+
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		{Method: "GET", Path: "/api/storage", Handler: handler.Usage, Auth: true, DB: true, Permission: goodooHttp.PermissionDBManage},
+	})
+}
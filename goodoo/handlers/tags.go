@@ -0,0 +1,298 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	goodooHttp "goodoo/http"
+	"goodoo/models"
+	"gorm.io/gorm"
+)
+
+// TagHandler manages the tags of the taggable models and tags records.
+// Renaming, merging and deleting tags is reserved to administrators.
+type TagHandler struct {
+	Config *goodooHttp.RequestConfig
+}
+
+// NewTagHandler creates a new tag handler
+func NewTagHandler(config *goodooHttp.RequestConfig) *TagHandler {
+	return &TagHandler{Config: config}
+}
+
+// TagRequest is the body of tag creation and update requests; nil fields
+// are left unchanged
+type TagRequest struct {
+	Name  *string `json:"name"`
+	Color *int    `json:"color"`
+	// Model scopes a new tag to the records of one model
+	Model string `json:"model"`
+}
+
+// TagRecordsRequest adds tags to records or removes them; tags are ids or
+// names
+type TagRecordsRequest struct {
+	Model string        `json:"model"`
+	IDs   []uint        `json:"ids"`
+	Tags  []interface{} `json:"tags"`
+}
+
+// tagError answers a failed tag operation
+func tagError(c echo.Context, err error) error {
+	switch {
+	case errors.Is(err, models.ErrTagExists):
+		return c.JSON(http.StatusConflict, map[string]string{"error": err.Error()})
+	case errors.Is(err, models.ErrEmptyTagName), errors.Is(err, models.ErrTagScope),
+		errors.Is(err, models.ErrNotTaggable), errors.Is(err, models.ErrInvalidTagMerge):
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(recordErrorStatus(err), map[string]string{"error": err.Error()})
+}
+
+// loadTag fetches the tag named by the :id route parameter
+func loadTag(c echo.Context, db *gorm.DB) (*models.Tag, error) {
+	id, err := parseRecordID(c)
+	if err != nil {
+		return nil, err
+	}
+	var tag models.Tag
+	if err := db.First(&tag, id).Error; err != nil {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Tag not found")
+	}
+	return &tag, nil
+}
+
+// checkTagModel refuses a scope that is not a taggable model
+func checkTagModel(req *goodooHttp.Request, model string) error {
+	if model != "" && !models.IsTaggable(req.GetEnv(), model) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Model "+model+" is not taggable")
+	}
+	return nil
+}
+
+// List returns the tags by name; ?model= keeps those usable on the records
+// of a model, and ?search= those whose name contains the text
+func (h *TagHandler) List(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	query := req.GetDB().Model(&models.Tag{})
+	if model := c.QueryParam("model"); model != "" {
+		query = query.Where("model IN ?", []string{model, ""})
+	}
+	if search := strings.TrimSpace(c.QueryParam("search")); search != "" {
+		query = query.Where("name ILIKE ?", "%"+search+"%")
+	}
+	tags := make([]models.Tag, 0)
+	if err := query.Order("lower(name), id").Find(&tags).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"tags": tags})
+}
+
+// Create returns the tag of the name, creating it when no tag of the scope
+// has the name in any case: 201 for a new tag, 200 for an existing one
+func (h *TagHandler) Create(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	var body TagRequest
+	if err := c.Bind(&body); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+	}
+	if body.Name == nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": models.ErrEmptyTagName.Error()})
+	}
+	if err := checkTagModel(req, body.Model); err != nil {
+		return err
+	}
+
+	var tag *models.Tag
+	var created bool
+	err := req.GetDB().Transaction(func(tx *gorm.DB) error {
+		var err error
+		tag, created, err = models.FindOrCreateTag(tx, uint(req.GetUserID()), *body.Name, body.Model)
+		if err != nil || !created || body.Color == nil {
+			return err
+		}
+		tag.Color = *body.Color
+		return tx.Model(tag).Update("color", tag.Color).Error
+	})
+	if err != nil {
+		return tagError(c, err)
+	}
+	if !created {
+		return c.JSON(http.StatusOK, tag)
+	}
+	req.Logger.InfoCtx(req.Context, "Tag %q (%d) created by %s", tag.Name, tag.ID, req.GetLogin())
+	return c.JSON(http.StatusCreated, tag)
+}
+
+// QuickCreate returns the tag typed in a tag field, creating it when
+// missing, like the quick create of the records: {"name": "vip",
+// "model": "res.partner"} answers [id, name], the name being the one of
+// the existing tag when another case matched.
+func (h *TagHandler) QuickCreate(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	var body struct {
+		Name  string `json:"name"`
+		Model string `json:"model"`
+	}
+	if err := c.Bind(&body); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+	}
+	if err := checkTagModel(req, body.Model); err != nil {
+		return err
+	}
+
+	var tag *models.Tag
+	var created bool
+	err := req.GetDB().Transaction(func(tx *gorm.DB) error {
+		var err error
+		tag, created, err = models.FindOrCreateTag(tx, uint(req.GetUserID()), body.Name, body.Model)
+		return err
+	})
+	if err != nil {
+		req.Logger.WarningCtx(req.Context, "Quick create of tag %q failed: %v", body.Name, err)
+		return tagError(c, err)
+	}
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	return c.JSON(status, []interface{}{tag.ID, tag.Name})
+}
+
+// Update renames a tag or changes its color; 409 when another tag of its
+// scope has the name
+func (h *TagHandler) Update(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	tag, err := loadTag(c, db)
+	if err != nil {
+		return err
+	}
+	var body TagRequest
+	if err := c.Bind(&body); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+	}
+
+	uid := uint(req.GetUserID())
+	oldName := tag.Name
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if body.Name != nil {
+			renamed, err := models.RenameTag(tx, uid, tag.ID, *body.Name)
+			if err != nil {
+				return err
+			}
+			tag = renamed
+		}
+		if body.Color != nil {
+			tag.Color = *body.Color
+			return tx.Model(tag).Updates(map[string]interface{}{"color": tag.Color, "write_uid": uid}).Error
+		}
+		return nil
+	})
+	if err != nil {
+		return tagError(c, err)
+	}
+	if tag.Name != oldName {
+		req.Logger.InfoCtx(req.Context, "Tag %d renamed from %q to %q by %s", tag.ID, oldName, tag.Name, req.GetLogin())
+	}
+	return c.JSON(http.StatusOK, tag)
+}
+
+// Merge merges tags into the tag of the route: {"merged_ids": [4, 7]}.
+// The records of the merged tags get the tag, the merged tags are deleted
+// and the merge is recorded in the activity feed.
+func (h *TagHandler) Merge(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	target, err := loadTag(c, db)
+	if err != nil {
+		return err
+	}
+	var body struct {
+		MergedIDs []uint `json:"merged_ids"`
+	}
+	if err := c.Bind(&body); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+	}
+
+	targetID := target.ID
+	var moved int64
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		target, moved, err = models.MergeTags(tx, uint(req.GetUserID()), targetID, body.MergedIDs)
+		return err
+	})
+	if err != nil {
+		req.Logger.WarningCtx(req.Context, "Failed to merge tags %v into %d: %v", body.MergedIDs, targetID, err)
+		return tagError(c, err)
+	}
+	req.Logger.InfoCtx(req.Context, "Tags %v merged into %d by %s: %d link(s) moved", body.MergedIDs, targetID, req.GetLogin(), moved)
+	return c.JSON(http.StatusOK, map[string]interface{}{"tag": target, "moved": moved})
+}
+
+// Delete deletes a tag, untagging its records
+func (h *TagHandler) Delete(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	tag, err := loadTag(c, db)
+	if err != nil {
+		return err
+	}
+	if err := db.Transaction(func(tx *gorm.DB) error { return models.DeleteTag(tx, tag.ID) }); err != nil {
+		return tagError(c, err)
+	}
+	req.Logger.InfoCtx(req.Context, "Tag %q (%d) deleted by %s", tag.Name, tag.ID, req.GetLogin())
+	return c.JSON(http.StatusOK, map[string]string{"message": "Tag deleted"})
+}
+
+// tagRecords adds or removes the tags of the body on its records
+func (h *TagHandler) tagRecords(c echo.Context, remove bool) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	var body TagRecordsRequest
+	if err := c.Bind(&body); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+	}
+	if body.Model == "" || len(body.IDs) == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "model and ids are required"})
+	}
+	if err := models.TagRecords(req.GetEnv(), body.Model, body.IDs, body.Tags, remove); err != nil {
+		return tagError(c, err)
+	}
+	tags, err := models.LoadTags(req.GetDB(), body.Model, body.IDs)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"tags": tags})
+}
+
+// Apply tags records: {"model": "res.partner", "ids": [1, 2], "tags":
+// [3, "vip"]}; missing names are created. It answers the tags of the
+// records by id.
+func (h *TagHandler) Apply(c echo.Context) error {
+	return h.tagRecords(c, false)
+}
+
+// Remove untags records, with the body of Apply
+func (h *TagHandler) Remove(c echo.Context) error {
+	return h.tagRecords(c, true)
+}
+
+// RegisterTagRoutes registers the tag routes; renaming, merging and
+// deleting tags require the tags.manage permission
+func RegisterTagRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewTagHandler(config)
+	manage := goodooHttp.PermissionTagsManage
+
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		{Method: "GET", Path: "/api/tags", Handler: handler.List, Auth: true, DB: true},
+		{Method: "POST", Path: "/api/tags", Handler: handler.Create, Auth: true, DB: true},
+		{Method: "POST", Path: "/api/tags/quick_create", Handler: handler.QuickCreate, Auth: true, DB: true},
+		{Method: "POST", Path: "/api/tags/apply", Handler: handler.Apply, Auth: true, DB: true},
+		{Method: "POST", Path: "/api/tags/remove", Handler: handler.Remove, Auth: true, DB: true},
+		{Method: "PUT", Path: "/api/tags/:id", Handler: handler.Update, Auth: true, DB: true, Permission: manage},
+		{Method: "POST", Path: "/api/tags/:id/merge", Handler: handler.Merge, Auth: true, DB: true, Permission: manage},
+		{Method: "DELETE", Path: "/api/tags/:id", Handler: handler.Delete, Auth: true, DB: true, Permission: manage},
+	})
+}
@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	goodooHttp "goodoo/http"
+	"goodoo/models"
+	"goodoo/tasks"
+)
+
+// TaskHandler reports the background tasks
+type TaskHandler struct {
+	Config *goodooHttp.RequestConfig
+}
+
+// NewTaskHandler creates a new task handler
+func NewTaskHandler(config *goodooHttp.RequestConfig) *TaskHandler {
+	return &TaskHandler{Config: config}
+}
+
+// List returns the recent runs of the database, the latest first (those
+// of the last hour, kept in memory), and the latest failed or lost runs
+// of the durable tasks, which survive restarts. ?limit= bounds both, 50
+// by default.
+func (h *TaskHandler) List(c echo.Context) error {
+	limit := 50
+	if value := c.QueryParam("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 || parsed > 500 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "limit must be between 1 and 500"})
+		}
+		limit = parsed
+	}
+
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	if db == nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database not available"})
+	}
+	failures, err := models.RecentTaskFailures(db, limit)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	if failures == nil {
+		failures = []models.TaskRun{}
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"runs":     tasks.List(req.GetDBName(), limit),
+		"failures": failures,
+	})
+}
+
+// RegisterTaskRoutes mounts the background task endpoints, which require
+// the tasks.read permission
+func RegisterTaskRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewTaskHandler(config)
+
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		{Method: "GET", Path: "/api/tasks", Handler: handler.List, Auth: true, DB: true, Permission: goodooHttp.PermissionTasksRead},
+	})
+}
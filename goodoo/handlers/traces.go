@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	goodooHttp "goodoo/http"
+	"goodoo/tracing"
+)
+
+// TraceHandler exposes the retained slow request traces
+type TraceHandler struct {
+	Config *goodooHttp.RequestConfig
+}
+
+// NewTraceHandler creates a new trace handler
+func NewTraceHandler(config *goodooHttp.RequestConfig) *TraceHandler {
+	return &TraceHandler{Config: config}
+}
+
+// List returns the retained traces, newest first
+func (h *TraceHandler) List(c echo.Context) error {
+	traces := tracing.Recent()
+	summaries := make([]tracing.TraceSummary, len(traces))
+	for i, trace := range traces {
+		summaries[i] = trace.Summary()
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"enabled": tracing.Enabled(),
+		"traces":  summaries,
+	})
+}
+
+// Get returns the span tree of a trace; ?format=otlp returns it as OTLP/JSON
+func (h *TraceHandler) Get(c echo.Context) error {
+	trace, exists := tracing.Get(c.Param("id"))
+	if !exists {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Trace not found"})
+	}
+	if c.QueryParam("format") == "otlp" {
+		return c.JSON(http.StatusOK, tracing.ToOTLP(tracing.ServiceName(), trace))
+	}
+	return c.JSON(http.StatusOK, trace)
+}
+
+// RegisterTraceRoutes mounts the trace endpoints under /api/traces, which
+// require the traces.read permission since traces hold SQL statements
+func RegisterTraceRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewTraceHandler(config)
+	read := goodooHttp.PermissionTracesRead
+
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		{Method: "GET", Path: "/api/traces", Handler: handler.List, Auth: true, DB: true, Permission: read},
+		{Method: "GET", Path: "/api/traces/:id", Handler: handler.Get, Auth: true, DB: true, Permission: read},
+	})
+}
@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"goodoo/models"
+)
+
+// Depth limits of the tree endpoints
+const (
+	defaultTreeDepth = 5
+	maxTreeDepth     = 20
+)
+
+// treeNode is a record of a hierarchy with its children. Cycle marks a
+// record reached again through a cycle in the data; its children are not
+// repeated.
+type treeNode struct {
+	ID          uint                   `json:"id"`
+	Name        string                 `json:"name"`
+	ParentID    *uint                  `json:"parent_id"`
+	Depth       int                    `json:"depth"`
+	Cycle       bool                   `json:"cycle,omitempty"`
+	Descendants int                    `json:"descendant_count"`
+	Values      map[string]interface{} `json:"values,omitempty"`
+	Children    []*treeNode            `json:"children"`
+}
+
+// parseTreeDepth reads the ?depth= query parameter
+func parseTreeDepth(c echo.Context) (int, error) {
+	value := c.QueryParam("depth")
+	if value == "" {
+		return defaultTreeDepth, nil
+	}
+	depth, err := strconv.Atoi(value)
+	if err != nil || depth < 0 || depth > maxTreeDepth {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, "depth must be between 0 and 20")
+	}
+	return depth, nil
+}
+
+// buildTree nests the rows of models.LoadSubtree under their root, naming
+// them with names
+func buildTree(rows []models.TreeRow, names map[uint]string) *treeNode {
+	if len(rows) == 0 {
+		return nil
+	}
+	nodes := make([]*treeNode, len(rows))
+	byID := make(map[uint]*treeNode, len(rows))
+	for i, row := range rows {
+		node := &treeNode{
+			ID:       row.ID,
+			Name:     names[row.ID],
+			ParentID: row.ParentID,
+			Depth:    row.Depth,
+			Cycle:    row.Cycle,
+			Children: []*treeNode{},
+		}
+		nodes[i] = node
+		// Rows are ordered by depth: parents come first, and a record
+		// repeated through a cycle keeps its first position
+		if i > 0 && row.ParentID != nil {
+			if parent, ok := byID[*row.ParentID]; ok {
+				parent.Children = append(parent.Children, node)
+			}
+		}
+		if _, ok := byID[row.ID]; !ok {
+			byID[row.ID] = node
+		}
+	}
+	countDescendants(nodes[0])
+	return nodes[0]
+}
+
+// countDescendants fills the descendant counts of a tree and returns its size
+func countDescendants(node *treeNode) int {
+	count := 0
+	for _, child := range node.Children {
+		count += countDescendants(child)
+	}
+	node.Descendants = count
+	return count + 1
+}
+
+// treeIDs returns the distinct record ids of a subtree
+func treeIDs(rows []models.TreeRow) []uint {
+	seen := make(map[uint]bool, len(rows))
+	var ids []uint
+	for _, row := range rows {
+		if !seen[row.ID] {
+			seen[row.ID] = true
+			ids = append(ids, row.ID)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	goodooHttp "goodoo/http"
+	"goodoo/upload"
+)
+
+// UploadHandler stages files referenced by token in later requests
+type UploadHandler struct {
+	Config *goodooHttp.RequestConfig
+}
+
+// NewUploadHandler creates a new upload handler
+func NewUploadHandler(config *goodooHttp.RequestConfig) *UploadHandler {
+	return &UploadHandler{Config: config}
+}
+
+// Stage stores the "file" form file for the session and returns its
+// upload token, to be passed as {"upload_token": token} in place of base64
+func (h *UploadHandler) Stage(c echo.Context) error {
+	req := goodooHttp.GetGoodooRequest(c)
+	db := req.GetDB()
+	if db == nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database not available")
+	}
+
+	header, err := c.FormFile("file")
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "A file is required"})
+	}
+	maxSize := upload.CurrentConfig().MaxFileSize
+	if header.Size > maxSize {
+		return c.JSON(http.StatusRequestEntityTooLarge, map[string]string{"error": upload.ErrTooLarge.Error()})
+	}
+	file, err := header.Open()
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	defer file.Close()
+	content, err := io.ReadAll(io.LimitReader(file, maxSize+1))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	mimetype := header.Header.Get("Content-Type")
+	if mimetype == "" {
+		mimetype = http.DetectContentType(content)
+	}
+	staged, err := upload.Stage(db, req.Session.SID, uint(req.GetUserID()), header.Filename, mimetype, content)
+	switch {
+	case errors.Is(err, upload.ErrTooLarge), errors.Is(err, upload.ErrQuotaExceeded):
+		return c.JSON(http.StatusRequestEntityTooLarge, map[string]string{"error": err.Error()})
+	case err != nil:
+		req.Logger.ErrorCtx(req.Context, "Failed to stage upload %s: %v", header.Filename, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to store upload"})
+	}
+
+	return c.JSON(http.StatusCreated, staged)
+}
+
+// RegisterUploadRoutes mounts the upload staging endpoint under /api/uploads
+func RegisterUploadRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewUploadHandler(config)
+
+	group := e.Group("/api/uploads")
+	group.Use(goodooHttp.AuthenticationMiddleware(true))
+	group.Use(goodooHttp.DatabaseMiddleware(true))
+
+	group.POST("", handler.Stage)
+}
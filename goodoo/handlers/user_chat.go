@@ -0,0 +1,205 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"goodoo/connections"
+	goodooHttp "goodoo/http"
+	"goodoo/models"
+	"goodoo/userchat"
+)
+
+// userChatEvents is the room events a stream may lag behind; older ones
+// are dropped, receipts stay readable from the messages
+const userChatEvents = 64
+
+// UserTypingRequest is posted while the user types in a room, and with
+// Typing false once they stop
+type UserTypingRequest struct {
+	Typing bool `json:"typing"`
+}
+
+// UserTyping signals that the user types in a room, or stopped. The
+// indicator expires on its own after a few seconds unless renewed, and
+// renewals are rate limited: a signal too soon after the previous one is
+// answered with 429 and the indicator left as is.
+func (h *DashboardHandler) UserTyping(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	roomID := c.Param("id")
+	userID := uint(req.GetUserID())
+	if !userchat.CanJoin(roomID, userID) {
+		return echo.NewHTTPError(403, "Not a participant of this room")
+	}
+	request := UserTypingRequest{Typing: true}
+	if err := c.Bind(&request); err != nil {
+		return echo.NewHTTPError(400, "Invalid request format")
+	}
+
+	if !request.Typing {
+		userchat.StopTyping(req.GetDBName(), roomID, userID, req.Now())
+		return c.JSON(http.StatusOK, map[string]interface{}{"room": roomID, "typing": false})
+	}
+	event, err := userchat.StartTyping(req.GetDBName(), roomID, userID, req.Now())
+	if errors.Is(err, userchat.ErrTooFrequent) {
+		return c.JSON(http.StatusTooManyRequests, map[string]interface{}{
+			"error":      err.Error(),
+			"expires_at": event.ExpiresAt,
+		})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"room": roomID, "typing": true, "expires_at": event.ExpiresAt})
+}
+
+// StreamUserChatRoom sends the users typing in a room, then its events as
+// server-sent events: "message", "receipt" and "typing". Pushing a message
+// of another participant delivers it to the user, which the sender sees
+// as a receipt event. Events carry the id a reconnecting client sends back
+// as Last-Event-ID to get those it missed; when they are no longer
+// retained, a "reset" event tells it to reload the room. The server closes
+// the stream with a "goaway" event.
+func (h *DashboardHandler) StreamUserChatRoom(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	roomID := c.Param("id")
+	userID := uint(req.GetUserID())
+	if !userchat.CanJoin(roomID, userID) {
+		return echo.NewHTTPError(403, "Not a participant of this room")
+	}
+	dbName := req.GetDBName()
+	stream, err := openEventStream(c, connections.TypeUserChat, userchat.Channel)
+	if stream == nil {
+		return err
+	}
+	defer stream.close()
+
+	events := make(chan userchat.Resumed, userChatEvents)
+	after, resuming, known := lastEventID(c)
+	missed, unsubscribe, complete := userchat.SubscribeFrom(dbName, roomID, after, func(id uint64, event userchat.Event) {
+		select {
+		case events <- userchat.Resumed{ID: id, Event: event}:
+		default:
+		}
+	})
+	defer unsubscribe()
+
+	// send forwards an event of the room; users do not see their own
+	// typing indicator
+	send := func(item userchat.Resumed) error {
+		event := item.Event
+		if event.Type == userchat.EventTyping && event.UserID == userID {
+			return nil
+		}
+		if err := stream.sendID(item.ID, event.Type, event); err != nil {
+			return err
+		}
+		if event.Type == userchat.EventMessage && event.UserID != userID {
+			publishDelivered(req, roomID, []string{event.MessageID})
+		}
+		return nil
+	}
+	if resuming && (!known || !complete) {
+		// Too late to replay: the client reloads the messages of the room
+		if err := stream.send("reset", map[string]interface{}{"room": roomID}); err != nil {
+			return nil
+		}
+	}
+	typists := userchat.Typists(dbName, roomID, req.Now())
+	if err := stream.send("typists", map[string]interface{}{"room": roomID, "typists": typists}); err != nil {
+		return nil
+	}
+	// A reconnecting client first gets the events it missed
+	for _, item := range missed {
+		if err := send(item); err != nil {
+			return nil
+		}
+	}
+
+	keepAlive := time.NewTicker(notificationKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case <-stream.closing():
+			stream.goAway()
+			return nil
+		case item := <-events:
+			if err := send(item); err != nil {
+				return nil
+			}
+		case <-keepAlive.C:
+			if err := stream.keepAlive(); err != nil {
+				return nil
+			}
+		}
+	}
+}
+
+// publishDelivered records that messages of a room reached the user and
+// publishes a receipt event for each one delivered for the first time
+func publishDelivered(req *goodooHttp.Request, roomID string, messageIDs []string) {
+	userID := uint(req.GetUserID())
+	delivered, err := models.MarkDelivered(req.GetDB(), roomID, messageIDs, userID, req.Now())
+	if err != nil {
+		req.Logger.WarningCtx(req.Context, "Failed to record the delivery of messages of %s: %v", roomID, err)
+		return
+	}
+	for _, messageID := range delivered {
+		userchat.Publish(req.GetDBName(), userchat.Event{Type: userchat.EventReceipt, Room: roomID,
+			UserID: userID, MessageID: messageID, State: models.ReceiptDelivered})
+	}
+}
+
+// deliverUserMessages delivers the fetched messages the other participants
+// sent to the user, then attaches their delivery to every message
+func deliverUserMessages(req *goodooHttp.Request, roomID string, messages []UserChatMessage) {
+	userID := req.GetUserID()
+	var received, all []string
+	for _, message := range messages {
+		all = append(all, message.ID)
+		if message.FromUserID != userID {
+			received = append(received, message.ID)
+		}
+	}
+	publishDelivered(req, roomID, received)
+
+	summaries, err := models.MessageReceipts(req.GetDB(), all)
+	if err != nil {
+		req.Logger.WarningCtx(req.Context, "Failed to read the receipts of messages of %s: %v", roomID, err)
+		return
+	}
+	for i := range messages {
+		summary := summaries[messages[i].ID]
+		messages[i].Delivery = &summary
+	}
+}
+
+// publishUserMessage sends a message to its room: the recipient of a
+// direct message gets a receipt, the sender stops typing and the message
+// is published to the connections of the room
+func publishUserMessage(req *goodooHttp.Request, message *UserChatMessage, roomID string) error {
+	userID := uint(message.FromUserID)
+	var recipients []uint
+	if message.ToUserID != 0 {
+		roomID = userchat.DirectRoom(userID, uint(message.ToUserID))
+		recipients = []uint{uint(message.ToUserID)}
+	}
+	if roomID == "" {
+		return nil
+	}
+	if !userchat.CanJoin(roomID, userID) {
+		return echo.NewHTTPError(403, "Not a participant of this room")
+	}
+	message.Room = roomID
+	message.Delivery = &models.ReceiptSummary{State: models.ReceiptSent, Recipients: len(recipients)}
+	if err := models.RecordSent(req.GetDB(), roomID, message.ID, recipients); err != nil {
+		req.Logger.WarningCtx(req.Context, "Failed to record the receipt of message %s: %v", message.ID, err)
+	}
+
+	dbName := req.GetDBName()
+	userchat.StopTyping(dbName, roomID, userID, req.Now())
+	userchat.Publish(dbName, userchat.Event{Type: userchat.EventMessage, Room: roomID,
+		UserID: userID, MessageID: message.ID, Message: *message})
+	return nil
+}
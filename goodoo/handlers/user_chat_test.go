@@ -0,0 +1,270 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"goodoo/bus"
+	"goodoo/connections"
+	goodooHttp "goodoo/http"
+	"goodoo/logging"
+	"goodoo/userchat"
+)
+
+// streamTestServer serves the event stream of the chat rooms, the user
+// of each request being the X-Test-User header
+type streamTestServer struct {
+	t      *testing.T
+	dbName string
+	url    string
+}
+
+func newStreamTestServer(t *testing.T, dbName string, limits *connections.Config) *streamTestServer {
+	connections.Setup(limits)
+	t.Cleanup(func() { connections.Setup(connections.DefaultConfig()) })
+
+	store, err := goodooHttp.NewFilesystemSessionStore(t.TempDir(), false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &goodooHttp.RequestConfig{
+		SessionStore:  store,
+		DefaultDBName: dbName,
+		Logger:        logging.GetLogger("goodoo.handlers.test"),
+	}
+	e := echo.New()
+	goodooHttp.UseRequestMiddleware(e, config)
+	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := goodooHttp.MustGetGoodooRequest(c)
+			req.Session.UserID, _ = strconv.Atoi(c.Request().Header.Get("X-Test-User"))
+			req.Session.Login = "user" + c.Request().Header.Get("X-Test-User")
+			return next(c)
+		}
+	})
+	h := &DashboardHandler{config: config}
+	e.GET("/rooms/:id/stream", h.StreamUserChatRoom)
+
+	server := httptest.NewServer(e)
+	t.Cleanup(func() {
+		server.CloseClientConnections()
+		server.Close()
+		// The handlers close their connections once their client is gone
+		for deadline := time.Now().Add(5 * time.Second); connections.Count(dbName) > 0 && time.Now().Before(deadline); {
+			time.Sleep(time.Millisecond)
+		}
+	})
+	return &streamTestServer{t: t, dbName: dbName, url: server.URL}
+}
+
+// sseEvent is an event read from a stream
+type sseEvent struct {
+	ID, Event, Data, Retry string
+}
+
+// eventStreamClient is a client of a stream
+type eventStreamClient struct {
+	t        *testing.T
+	response *http.Response
+	reader   *bufio.Reader
+	cancel   context.CancelFunc
+}
+
+// open requests the stream of a room as uid, resuming after lastEventID
+// when not empty
+func (s *streamTestServer) open(uid int, room, lastEventID string) *eventStreamClient {
+	s.t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url+"/rooms/"+room+"/stream", nil)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	r.Header.Set("X-Test-User", strconv.Itoa(uid))
+	if lastEventID != "" {
+		r.Header.Set("Last-Event-ID", lastEventID)
+	}
+	response, err := http.DefaultClient.Do(r)
+	if err != nil {
+		cancel()
+		s.t.Fatal(err)
+	}
+	client := &eventStreamClient{t: s.t, response: response, reader: bufio.NewReader(response.Body), cancel: cancel}
+	s.t.Cleanup(client.close)
+	return client
+}
+
+// close disconnects the client
+func (c *eventStreamClient) close() {
+	c.cancel()
+	c.response.Body.Close()
+}
+
+// next reads the next event, skipping comments
+func (c *eventStreamClient) next() sseEvent {
+	c.t.Helper()
+	var event sseEvent
+	for {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("reading the stream: %v (event so far %+v)", err, event)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			if event != (sseEvent{}) {
+				return event
+			}
+			continue
+		}
+		name, value, _ := strings.Cut(line, ": ")
+		switch name {
+		case "id":
+			event.ID = value
+		case "event":
+			event.Event = value
+		case "data":
+			event.Data = value
+		case "retry":
+			event.Retry = value
+		}
+	}
+}
+
+// expect reads the next event and checks its type
+func (c *eventStreamClient) expect(name string) sseEvent {
+	c.t.Helper()
+	event := c.next()
+	if event.Event != name {
+		c.t.Fatalf("event %+v, want %s", event, name)
+	}
+	return event
+}
+
+// streamLimits are the limits of the tests, which they adjust
+func streamLimits() *connections.Config {
+	return &connections.Config{
+		MaxPerUser:     10,
+		MaxTotal:       10,
+		IdleTimeout:    time.Minute,
+		DrainTimeout:   5 * time.Second,
+		ReconnectAfter: 3 * time.Second,
+	}
+}
+
+func TestStreamUserChatRoomLimits(t *testing.T) {
+	limits := streamLimits()
+	limits.MaxPerUser, limits.MaxTotal = 1, 2
+	s := newStreamTestServer(t, "stream_limits_test", limits)
+
+	s.open(7, "lobby", "").expect("typists")
+	if status := s.open(7, "lobby", "").response.StatusCode; status != http.StatusTooManyRequests {
+		t.Errorf("second stream of the user answered %d, want 429", status)
+	}
+	s.open(8, "lobby", "").expect("typists")
+	full := s.open(9, "lobby", "").response
+	if full.StatusCode != http.StatusServiceUnavailable || full.Header.Get("Retry-After") != "3" {
+		t.Errorf("stream past the total answered %d, Retry-After %q; want 503 after 3 seconds",
+			full.StatusCode, full.Header.Get("Retry-After"))
+	}
+	if counts := connections.Counts(s.dbName); counts[connections.TypeUserChat] != 2 {
+		t.Errorf("Counts = %v, want the 2 streams open", counts)
+	}
+}
+
+// TestStreamUserChatRoomDrain stops the server: the streams end with a
+// goaway event telling when to reconnect, and new ones are refused until
+// the connections are set up again
+func TestStreamUserChatRoomDrain(t *testing.T) {
+	s := newStreamTestServer(t, "stream_drain_test", streamLimits())
+	clients := []*eventStreamClient{s.open(7, "lobby", ""), s.open(8, "lobby", "")}
+	for _, client := range clients {
+		client.expect("typists")
+	}
+
+	if open := connections.Drain(context.Background()); open != 0 {
+		t.Fatalf("Drain left %d streams open", open)
+	}
+	for _, client := range clients {
+		event := client.expect("goaway")
+		var payload struct {
+			Reason         string `json:"reason"`
+			ReconnectAfter int64  `json:"reconnect_after"`
+		}
+		if err := json.Unmarshal([]byte(event.Data), &payload); err != nil {
+			t.Fatal(err)
+		}
+		if event.Retry != "3000" || payload.Reason != connections.ReasonShutdown || payload.ReconnectAfter != 3000 {
+			t.Errorf("goaway = %+v, want a shutdown telling to reconnect after 3000 ms", event)
+		}
+		if _, err := client.reader.ReadString('\n'); err == nil {
+			t.Error("the stream goes on after the goaway event")
+		}
+	}
+
+	refused := s.open(7, "lobby", "").response
+	if refused.StatusCode != http.StatusServiceUnavailable || refused.Header.Get("Retry-After") != "3" {
+		t.Errorf("stream while draining answered %d, Retry-After %q; want 503 after 3 seconds",
+			refused.StatusCode, refused.Header.Get("Retry-After"))
+	}
+	connections.Setup(streamLimits())
+	s.open(7, "lobby", "").expect("typists")
+}
+
+// TestStreamUserChatRoomResume reconnects to a room with the id of the
+// last event seen: the events published meanwhile come first, then the
+// new ones; an id of another process asks the client to reload the room
+func TestStreamUserChatRoomResume(t *testing.T) {
+	s := newStreamTestServer(t, "stream_resume_test", streamLimits())
+	receipt := func(messageID string) userchat.Event {
+		return userchat.Event{Type: userchat.EventReceipt, Room: "lobby", UserID: 8, MessageID: messageID, State: "delivered"}
+	}
+	messageID := func(event sseEvent) string {
+		var payload userchat.Event
+		if err := json.Unmarshal([]byte(event.Data), &payload); err != nil {
+			t.Fatal(err)
+		}
+		return payload.MessageID
+	}
+
+	client := s.open(7, "lobby", "")
+	client.expect("typists")
+	userchat.Publish(s.dbName, receipt("m1"))
+	seen := client.expect(userchat.EventReceipt)
+	if id, ok := bus.ParseEventID(seen.ID); !ok || id == 0 {
+		t.Fatalf("event id %q is not a bus event id", seen.ID)
+	}
+	client.close()
+
+	userchat.Publish(s.dbName, receipt("m2"))
+	// Users do not see their own typing indicator, nor other rooms
+	userchat.Publish(s.dbName, userchat.Event{Type: userchat.EventTyping, Room: "lobby", UserID: 7, Typing: true})
+	userchat.Publish(s.dbName, userchat.Event{Type: userchat.EventReceipt, Room: "other", UserID: 8, MessageID: "x"})
+	userchat.Publish(s.dbName, receipt("m3"))
+
+	resumed := s.open(7, "lobby", seen.ID)
+	resumed.expect("typists")
+	var ids []string
+	for _, want := range []string{"m2", "m3"} {
+		event := resumed.expect(userchat.EventReceipt)
+		if got := messageID(event); got != want || event.ID == "" {
+			t.Errorf("resumed event %+v is %s, want %s with an id", event, got, want)
+		}
+		ids = append(ids, event.ID)
+	}
+	userchat.Publish(s.dbName, receipt("m4"))
+	if event := resumed.expect(userchat.EventReceipt); messageID(event) != "m4" || event.ID == ids[1] {
+		t.Errorf("live event %+v, want m4", event)
+	}
+
+	_, number, _ := strings.Cut(seen.ID, "-")
+	reset := s.open(7, "lobby", "0-"+number)
+	reset.expect("reset")
+	reset.expect("typists")
+}
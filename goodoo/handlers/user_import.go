@@ -0,0 +1,336 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"goodoo/database"
+	goodooHttp "goodoo/http"
+	"goodoo/logging"
+	"goodoo/models"
+	"goodoo/notification"
+	"goodoo/operations"
+	"gorm.io/gorm"
+)
+
+// maxUserImportFile bounds the size of an imported CSV file
+const maxUserImportFile = 5 << 20
+
+var userImportLogger = logging.GetLogger("goodoo.handlers.user_import")
+
+// UserImportHandler creates users in bulk from a CSV file: a dry run
+// reports what each row would do, and the import itself runs as a
+// background operation whose per-row report can be downloaded
+type UserImportHandler struct {
+	Config *goodooHttp.RequestConfig
+}
+
+// NewUserImportHandler creates a new user import handler
+func NewUserImportHandler(config *goodooHttp.RequestConfig) *UserImportHandler {
+	return &UserImportHandler{Config: config}
+}
+
+// importFile returns the name and content of the imported file: the
+// "file" part of a multipart form, or the body of a text/csv request
+func importFile(c echo.Context) (string, []byte, error) {
+	var reader io.Reader
+	name := "users.csv"
+	if header, err := c.FormFile("file"); err == nil {
+		if header.Size > maxUserImportFile {
+			return "", nil, echo.NewHTTPError(http.StatusRequestEntityTooLarge, "The file is too large")
+		}
+		file, err := header.Open()
+		if err != nil {
+			return "", nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		defer file.Close()
+		reader, name = file, header.Filename
+	} else if c.Request().Header.Get(echo.HeaderContentType) == "text/csv" {
+		reader = c.Request().Body
+	} else {
+		return "", nil, echo.NewHTTPError(http.StatusBadRequest, "A CSV file is required")
+	}
+	content, err := io.ReadAll(io.LimitReader(reader, maxUserImportFile+1))
+	if err != nil {
+		return "", nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if len(content) > maxUserImportFile {
+		return "", nil, echo.NewHTTPError(http.StatusRequestEntityTooLarge, "The file is too large")
+	}
+	return name, content, nil
+}
+
+// Import checks a CSV file of users and, unless dry_run=1, imports its
+// valid rows in the background; invalid rows are skipped and reported.
+// With invite=1 the users are mailed an invitation to choose their
+// password. The dry run returns the report of every row; the import
+// returns its id and operation to poll.
+func (h *UserImportHandler) Import(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	name, content, err := importFile(c)
+	if err != nil {
+		return err
+	}
+	dryRun, _ := strconv.ParseBool(c.FormValue("dry_run"))
+	invite, _ := strconv.ParseBool(c.FormValue("invite"))
+
+	rows, err := models.ParseUserImport(content)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	db := req.GetDB()
+	valid, err := models.CheckUserImport(db, rows)
+	if err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to check user import %s: %v", name, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to check the file"})
+	}
+	if dryRun {
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"rows":    rows,
+			"total":   len(rows),
+			"valid":   valid,
+			"invalid": len(rows) - valid,
+		})
+	}
+	if valid == 0 {
+		return c.JSON(http.StatusUnprocessableEntity, map[string]interface{}{"error": "No row can be imported", "rows": rows})
+	}
+	base := ""
+	if invite {
+		if base, err = linkBase(req); err != nil {
+			return err
+		}
+	}
+
+	dbName := req.GetDBName()
+	mainDB, err := database.GetDatabase(dbName)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database not available"})
+	}
+	uid := uint(req.GetUserID())
+	userImport := &models.UserImport{FileName: name, Invite: invite, State: models.UserImportRunning, Total: len(rows), CreateUID: uid}
+	if err := mainDB.Create(userImport).Error; err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to record user import %s: %v", name, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to start the import"})
+	}
+	inviter := &invitationSender{
+		db:       mainDB,
+		dbName:   dbName,
+		renderer: c.Echo().Renderer,
+		baseURL:  base,
+		uid:      uid,
+		login:    req.GetLogin(),
+	}
+
+	// The request context ends with the response: rows are imported detached
+	op := operations.Start("user_import", "res.users", dbName, req.GetUserID(), len(rows), func(ctx context.Context, op *operations.Operation) error {
+		runUserImport(mainDB, inviter, userImport, rows, op)
+		return finishUserImport(mainDB, dbName, userImport, rows, op)
+	})
+	userImport.OperationID = op.Status().ID
+	if err := mainDB.Model(userImport).Update("operation_id", userImport.OperationID).Error; err != nil {
+		req.Logger.WarningCtx(req.Context, "Failed to record the operation of user import %d: %v", userImport.ID, err)
+	}
+
+	req.Logger.InfoCtx(req.Context, "User import %d (%s, %d rows) started by %s", userImport.ID, name, len(rows), req.GetLogin())
+	return c.JSON(http.StatusAccepted, map[string]interface{}{
+		"import":       userImport,
+		"operation_id": userImport.OperationID,
+		"total":        len(rows),
+		"valid":        valid,
+	})
+}
+
+// runUserImport creates the users of the valid rows in batches; the
+// invalid ones were reported by the check. A row that fails, e.g. on a
+// login taken since the check, is reported without stopping the others.
+func runUserImport(db *gorm.DB, inviter *invitationSender, userImport *models.UserImport, rows []models.UserImportRow, op *operations.Operation) {
+	batches := (len(rows) + models.UserImportBatchSize - 1) / models.UserImportBatchSize
+	for batch := 0; batch < batches; batch++ {
+		start := batch * models.UserImportBatchSize
+		end := min(start+models.UserImportBatchSize, len(rows))
+		if op.Cancelled() {
+			for i := start; i < len(rows); i++ {
+				if rows[i].Status == models.UserImportRowValid {
+					rows[i].Status = models.UserImportRowSkipped
+				}
+			}
+			return
+		}
+		op.BeginBatch(batch+1, batches)
+		for i := start; i < end; i++ {
+			row := &rows[i]
+			if row.Status != models.UserImportRowValid {
+				op.Progress(0, 1, fmt.Errorf("row %d: %s", row.Row, strings.Join(row.Errors, "; ")))
+				continue
+			}
+			user, err := models.ImportUser(db, inviter.uid, userImport, row)
+			if err != nil {
+				row.Status = models.UserImportRowFailed
+				row.Errors = append(row.Errors, err.Error())
+				op.Progress(0, 1, fmt.Errorf("row %d: %w", row.Row, err))
+				continue
+			}
+			row.UserID, row.Status = user.ID, models.UserImportRowCreated
+			if userImport.Invite && row.Active {
+				sent, err := inviter.send(user, time.Now(), false)
+				if err != nil {
+					row.Errors = append(row.Errors, "created, but the invitation could not be sent: "+err.Error())
+				} else {
+					row.Status = models.UserImportRowInvited
+					if sent.activityErr != nil {
+						userImportLogger.Warning("Failed to record the invitation of %s: %v", user.Login, sent.activityErr)
+					}
+				}
+			}
+			op.Progress(1, 0, nil)
+		}
+	}
+}
+
+// finishUserImport stores the outcome and report of an import, records
+// it in the activity feed and notifies the user who started it with a
+// link to the report
+func finishUserImport(db *gorm.DB, dbName string, userImport *models.UserImport, rows []models.UserImportRow, op *operations.Operation) error {
+	status := op.Status()
+	now := time.Now()
+	userImport.State = models.UserImportDone
+	if op.Cancelled() {
+		userImport.State = models.UserImportCancelled
+	}
+	userImport.Created, userImport.Failed = status.Processed, status.Failed
+	userImport.Report = models.UserImportReport(rows)
+	userImport.FinishDate = &now
+	err := db.Model(userImport).Select("state", "created", "failed", "report", "finish_date").Updates(userImport).Error
+	if err != nil {
+		return err
+	}
+
+	severity, level := models.SeveritySuccess, models.NotificationSuccess
+	if userImport.Failed > 0 || userImport.State == models.UserImportCancelled {
+		severity, level = models.SeverityWarning, models.NotificationWarning
+	}
+	params := map[string]interface{}{
+		"import_id":    userImport.ID,
+		"operation_id": status.ID,
+		"file_name":    userImport.FileName,
+		"state":        userImport.State,
+		"total":        userImport.Total,
+		"created":      userImport.Created,
+		"failed":       userImport.Failed,
+		"invite":       userImport.Invite,
+		"report_url":   fmt.Sprintf("/api/users/imports/%d/report", userImport.ID),
+	}
+	activity := models.Activity{Type: models.ActivityUserImported, Severity: severity, Model: models.UserImportModel, ResID: userImport.ID, Params: params}
+	if err := models.LogActivity(db, userImport.CreateUID, activity); err != nil {
+		userImportLogger.Warning("Failed to record user import %d: %v", userImport.ID, err)
+	}
+
+	title := fmt.Sprintf("Import of %s %s", userImport.FileName, userImport.State)
+	body := fmt.Sprintf("%d of %d users created, %d failed. Download the report for the details of each row.",
+		userImport.Created, userImport.Total, userImport.Failed)
+	if _, err := notification.Notify(dbName, userImport.CreateUID, models.NotificationCategoryBulk, level, title, body, params); err != nil {
+		userImportLogger.Warning("Failed to notify user import %d: %v", userImport.ID, err)
+	}
+	userImportLogger.Info("User import %d of %s: %d of %d users created, %d failed", userImport.ID, dbName, userImport.Created, userImport.Total, userImport.Failed)
+	return nil
+}
+
+// loadUserImport fetches the import of the :id route parameter
+func loadUserImport(c echo.Context, req *goodooHttp.Request) (*models.UserImport, error) {
+	id, err := parseRecordID(c)
+	if err != nil {
+		return nil, err
+	}
+	var userImport models.UserImport
+	if err := req.GetDB().Omit("report").First(&userImport, id).Error; err != nil {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Import not found")
+	}
+	return &userImport, nil
+}
+
+// List returns the user imports, the latest first
+func (h *UserImportHandler) List(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	var imports []models.UserImport
+	if err := req.GetDB().Omit("report").Order("id DESC").Find(&imports).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"imports": imports, "total": len(imports)})
+}
+
+// Get returns a user import, with the progress of its operation while it
+// runs and the number of its users still active
+func (h *UserImportHandler) Get(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	userImport, err := loadUserImport(c, req)
+	if err != nil {
+		return err
+	}
+	var active int64
+	if err := req.GetDB().Model(&models.User{}).Where("import_id = ? AND active = ?", userImport.ID, true).Count(&active).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	response := map[string]interface{}{"import": userImport, "active_users": active}
+	if op, ok := operations.Get(userImport.OperationID); ok {
+		response["operation"] = op.Status()
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// Report downloads the per-row CSV report of a finished import
+func (h *UserImportHandler) Report(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	userImport, err := loadUserImport(c, req)
+	if err != nil {
+		return err
+	}
+	var reports [][]byte
+	if err := req.GetDB().Model(userImport).Where("id = ?", userImport.ID).Pluck("report", &reports).Error; err != nil || len(reports) != 1 || reports[0] == nil {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "The import has no report yet", "state": userImport.State})
+	}
+	name := strings.TrimSuffix(userImport.FileName, ".csv") + "-report.csv"
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", name))
+	return c.Blob(http.StatusOK, "text/csv; charset=utf-8", reports[0])
+}
+
+// Deactivate deactivates the users an import created and revokes their
+// pending invitations, to undo a bad import
+func (h *UserImportHandler) Deactivate(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	userImport, err := loadUserImport(c, req)
+	if err != nil {
+		return err
+	}
+	if userImport.State == models.UserImportRunning {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "The import is still running; cancel its operation first"})
+	}
+	count, err := models.DeactivateUserImport(req.GetDB(), uint(req.GetUserID()), userImport, req.Now())
+	if err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to deactivate the users of import %d: %v", userImport.ID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	req.Logger.WarningCtx(req.Context, "%d user(s) of import %d (%s) deactivated by %s", count, userImport.ID, userImport.FileName, req.GetLogin())
+	return c.JSON(http.StatusOK, map[string]interface{}{"success": true, "deactivated": count})
+}
+
+// RegisterUserImportRoutes mounts the user import endpoints under
+// /api/users, reserved to the holders of users.manage
+func RegisterUserImportRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewUserImportHandler(config)
+	manage := goodooHttp.PermissionUsersManage
+
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		{Method: "POST", Path: "/api/users/import", Handler: handler.Import, Auth: true, DB: true, Permission: manage},
+		{Method: "GET", Path: "/api/users/imports", Handler: handler.List, Auth: true, DB: true, Permission: manage},
+		{Method: "GET", Path: "/api/users/imports/:id", Handler: handler.Get, Auth: true, DB: true, Permission: manage},
+		{Method: "GET", Path: "/api/users/imports/:id/report", Handler: handler.Report, Auth: true, DB: true, Permission: manage},
+		{Method: "POST", Path: "/api/users/imports/:id/deactivate", Handler: handler.Deactivate, Auth: true, DB: true, Permission: manage},
+	})
+}
@@ -0,0 +1,281 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"goodoo/crypto"
+	goodooHttp "goodoo/http"
+	"goodoo/models"
+	"goodoo/webhook"
+	"gorm.io/gorm"
+)
+
+// WebhookHandler manages webhooks and their deliveries (admin only)
+type WebhookHandler struct {
+	Config *goodooHttp.RequestConfig
+}
+
+// NewWebhookHandler creates a new webhook handler
+func NewWebhookHandler(config *goodooHttp.RequestConfig) *WebhookHandler {
+	return &WebhookHandler{Config: config}
+}
+
+// WebhookRequest is the body of create and update requests; nil fields are left unchanged
+type WebhookRequest struct {
+	Name        *string `json:"name"`
+	URL         *string `json:"url"`
+	Model       *string `json:"model"`
+	Events      *string `json:"events"`
+	Domain      *string `json:"domain"`
+	Secret      *string `json:"secret"`
+	MaxAttempts *int    `json:"max_attempts"`
+	Active      *bool   `json:"active"`
+}
+
+// apply copies the set fields onto the webhook
+func (r *WebhookRequest) apply(hook *models.Webhook) {
+	if r.Name != nil {
+		hook.Name = *r.Name
+	}
+	if r.URL != nil {
+		hook.URL = *r.URL
+	}
+	if r.Model != nil {
+		hook.Model = *r.Model
+	}
+	if r.Events != nil {
+		hook.Events = *r.Events
+	}
+	if r.Domain != nil {
+		hook.Domain = *r.Domain
+	}
+	if r.Secret != nil && *r.Secret != "" {
+		hook.Secret = crypto.EncryptedString(*r.Secret)
+	}
+	if r.MaxAttempts != nil {
+		hook.MaxAttempts = *r.MaxAttempts
+	}
+	if r.Active != nil {
+		hook.Active = *r.Active
+	}
+}
+
+// loadWebhook fetches the webhook named by the :id route parameter
+func loadWebhook(c echo.Context, db *gorm.DB) (*models.Webhook, error) {
+	id, err := parseRecordID(c)
+	if err != nil {
+		return nil, err
+	}
+	var hook models.Webhook
+	if err := db.First(&hook, id).Error; err != nil {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Webhook not found")
+	}
+	return &hook, nil
+}
+
+// List returns all webhooks
+func (h *WebhookHandler) List(c echo.Context) error {
+	db := goodooHttp.MustGetGoodooRequest(c).GetDB()
+
+	var hooks []models.Webhook
+	if err := db.Order("id").Find(&hooks).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"webhooks": hooks,
+		"events":   webhook.Events,
+	})
+}
+
+// Get returns one webhook
+func (h *WebhookHandler) Get(c echo.Context) error {
+	db := goodooHttp.MustGetGoodooRequest(c).GetDB()
+	hook, err := loadWebhook(c, db)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, hook)
+}
+
+// Create adds a webhook; a secret is generated unless one is given, and is
+// returned only in this response
+func (h *WebhookHandler) Create(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+
+	var body WebhookRequest
+	if err := c.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request format: "+err.Error())
+	}
+
+	hook := &models.Webhook{
+		Events:      "create,write,unlink",
+		MaxAttempts: webhook.DefaultMaxAttempts,
+		Active:      true,
+	}
+	body.apply(hook)
+	if err := webhook.Validate(req.GetEnv(), hook); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	if hook.Secret == "" {
+		secret, err := webhook.GenerateSecret()
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		}
+		hook.Secret = crypto.EncryptedString(secret)
+	}
+
+	hook.CreateUID = uint(req.GetUserID())
+	hook.WriteUID = hook.CreateUID
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// Select all columns so false booleans are not replaced by column defaults
+		if err := tx.Select("*").Omit("id").Create(hook).Error; err != nil {
+			return err
+		}
+		return models.ReserveQuota(tx, req.GetDBName(), models.QuotaWebhook, hook.CreateUID)
+	})
+	var quotaErr *models.QuotaExceededError
+	if errors.As(err, &quotaErr) {
+		return quotaExceededResponse(c, quotaErr)
+	}
+	if err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to create webhook: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	req.Logger.InfoCtx(req.Context, "Webhook %s (%d) on %s created by %s", hook.Name, hook.ID, hook.Model, req.GetLogin())
+	return c.JSON(http.StatusCreated, map[string]interface{}{
+		"webhook": hook,
+		"secret":  string(hook.Secret),
+	})
+}
+
+// Update modifies a webhook
+func (h *WebhookHandler) Update(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	hook, err := loadWebhook(c, db)
+	if err != nil {
+		return err
+	}
+
+	var body WebhookRequest
+	if err := c.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request format: "+err.Error())
+	}
+	body.apply(hook)
+	if err := webhook.Validate(req.GetEnv(), hook); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	if err := db.Save(hook).Error; err != nil {
+		req.Logger.ErrorCtx(req.Context, "Failed to update webhook %d: %v", hook.ID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, hook)
+}
+
+// Delete removes a webhook with its deliveries and their attempts
+func (h *WebhookHandler) Delete(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	hook, err := loadWebhook(c, db)
+	if err != nil {
+		return err
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		deliveries := tx.Model(&models.WebhookDelivery{}).Select("id").Where("webhook_id = ?", hook.ID)
+		if err := tx.Where("delivery_id IN (?)", deliveries).Delete(&models.WebhookDeliveryAttempt{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("webhook_id = ?", hook.ID).Delete(&models.WebhookDelivery{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Delete(hook).Error; err != nil {
+			return err
+		}
+		return models.ReleaseQuota(tx, models.QuotaWebhook, hook.CreateUID, 1)
+	})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	req.Logger.InfoCtx(req.Context, "Webhook %s (%d) deleted by %s", hook.Name, hook.ID, req.GetLogin())
+	return c.JSON(http.StatusOK, map[string]interface{}{"success": true})
+}
+
+// Deliveries returns the most recent deliveries of a webhook with their
+// attempts; ?state= filters on pending, sent or dead
+func (h *WebhookHandler) Deliveries(c echo.Context) error {
+	db := goodooHttp.MustGetGoodooRequest(c).GetDB()
+	hook, err := loadWebhook(c, db)
+	if err != nil {
+		return err
+	}
+
+	limit := 50
+	if l, err := strconv.Atoi(c.QueryParam("limit")); err == nil && l > 0 && l <= 500 {
+		limit = l
+	}
+	query := db.Where("webhook_id = ?", hook.ID)
+	if state := c.QueryParam("state"); state != "" {
+		query = query.Where("state = ?", state)
+	}
+
+	var deliveries []models.WebhookDelivery
+	err = query.Preload("Log", func(db *gorm.DB) *gorm.DB {
+		return db.Order("attempted_at")
+	}).Order("id DESC").Limit(limit).Find(&deliveries).Error
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"deliveries": deliveries})
+}
+
+// Redeliver queues a delivery of the webhook to be sent again
+func (h *WebhookHandler) Redeliver(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	db := req.GetDB()
+	hook, err := loadWebhook(c, db)
+	if err != nil {
+		return err
+	}
+	deliveryID, err := strconv.ParseUint(c.Param("delivery_id"), 10, 64)
+	if err != nil || deliveryID == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid delivery ID")
+	}
+
+	var original models.WebhookDelivery
+	if err := db.Where("id = ? AND webhook_id = ?", deliveryID, hook.ID).First(&original).Error; err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Delivery not found")
+	}
+
+	delivery, err := webhook.Redeliver(db, &original)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	req.Logger.InfoCtx(req.Context, "Webhook delivery %d redelivered as %d by %s", original.ID, delivery.ID, req.GetLogin())
+	return c.JSON(http.StatusAccepted, delivery)
+}
+
+// RegisterWebhookRoutes mounts the webhook endpoints under /api/webhooks,
+// which require the webhooks.manage permission
+func RegisterWebhookRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewWebhookHandler(config)
+	manage := goodooHttp.PermissionWebhooksManage
+
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		{Method: "GET", Path: "/api/webhooks", Handler: handler.List, Auth: true, DB: true, Permission: manage},
+		{Method: "POST", Path: "/api/webhooks", Handler: handler.Create, Auth: true, DB: true, Permission: manage},
+		{Method: "GET", Path: "/api/webhooks/:id", Handler: handler.Get, Auth: true, DB: true, Permission: manage},
+		{Method: "PUT", Path: "/api/webhooks/:id", Handler: handler.Update, Auth: true, DB: true, Permission: manage},
+		{Method: "DELETE", Path: "/api/webhooks/:id", Handler: handler.Delete, Auth: true, DB: true, Permission: manage},
+		{Method: "GET", Path: "/api/webhooks/:id/deliveries", Handler: handler.Deliveries, Auth: true, DB: true, Permission: manage},
+		{Method: "POST", Path: "/api/webhooks/:id/deliveries/:delivery_id/redeliver", Handler: handler.Redeliver, Auth: true, DB: true, Permission: manage},
+	})
+}
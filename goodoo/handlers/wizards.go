@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	goodooHttp "goodoo/http"
+	"goodoo/wizard"
+)
+
+// WizardsHandler runs multi-step wizards; the state of each running wizard
+// is a transient record, so a client resumes it with its ID
+type WizardsHandler struct {
+	Config *goodooHttp.RequestConfig
+}
+
+// NewWizardsHandler creates a new wizards handler
+func NewWizardsHandler(config *goodooHttp.RequestConfig) *WizardsHandler {
+	return &WizardsHandler{Config: config}
+}
+
+// WizardStartRequest holds the initial values of the first step
+type WizardStartRequest struct {
+	Values map[string]interface{} `json:"values"`
+}
+
+// WizardStepRequest submits the values of the current step. Step is the
+// step the client shows, checked against the current one; To goes to one
+// of the next steps without validation, e.g. back.
+type WizardStepRequest struct {
+	Step   string                 `json:"step"`
+	To     string                 `json:"to"`
+	Values map[string]interface{} `json:"values"`
+}
+
+// wizardError answers a failed start or submission
+func wizardError(c echo.Context, s *wizard.Session, err error) error {
+	var validation *wizard.ValidationError
+	switch {
+	case errors.As(err, &validation):
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{"error": validation.Message, "fields": validation.Fields})
+	case errors.Is(err, wizard.ErrNotFound):
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Wizard not found"})
+	case errors.Is(err, wizard.ErrStaleStep):
+		return c.JSON(http.StatusConflict, map[string]interface{}{"error": err.Error(), "wizard": s.Status()})
+	case errors.Is(err, wizard.ErrFinished):
+		return c.JSON(http.StatusConflict, map[string]string{"error": err.Error()})
+	}
+	req := goodooHttp.GetGoodooRequest(c)
+	req.Logger.WarningCtx(req.Context, "Wizard failed: %v", err)
+	return c.JSON(recordErrorStatus(err), map[string]string{"error": err.Error()})
+}
+
+// session loads the running wizard of the route
+func (h *WizardsHandler) session(c echo.Context) (*wizard.Session, error) {
+	req := goodooHttp.GetGoodooRequest(c)
+	w, resID, err := wizard.ParseID(c.Param("id"))
+	if err != nil {
+		return nil, err
+	}
+	return wizard.Load(req.GetEnv(), w, resID, req.Session.SID)
+}
+
+// List returns the registered wizards with their steps
+func (h *WizardsHandler) List(c echo.Context) error {
+	all := wizard.All()
+	result := make([]map[string]interface{}, len(all))
+	for i, w := range all {
+		steps := make([]wizard.StepInfo, len(w.Steps))
+		for j, step := range w.Steps {
+			steps[j] = wizard.StepInfo{Name: step.Name, Title: step.Title, Next: step.Next}
+		}
+		result[i] = map[string]interface{}{"name": w.Name, "title": w.Title, "steps": steps}
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"wizards": result})
+}
+
+// Start starts a wizard and returns its ID with the schema of the first
+// step
+func (h *WizardsHandler) Start(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	w, ok := wizard.Get(c.Param("name"))
+	if !ok {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Wizard not found"})
+	}
+	var body WizardStartRequest
+	if err := c.Bind(&body); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request format"})
+	}
+	s, err := wizard.Start(req.GetEnv(), w, req.Session.SID, body.Values)
+	if err != nil {
+		return wizardError(c, nil, err)
+	}
+	req.Logger.InfoCtx(req.Context, "Wizard %s started by user %d", s.ID(), req.GetUserID())
+	return c.JSON(http.StatusCreated, s.Status())
+}
+
+// Get returns the current step of a running wizard, to resume it
+func (h *WizardsHandler) Get(c echo.Context) error {
+	s, err := h.session(c)
+	if err != nil {
+		return wizardError(c, nil, err)
+	}
+	return c.JSON(http.StatusOK, s.Status())
+}
+
+// Step submits the values of the current step and returns the next step,
+// or the result once the wizard is finished
+func (h *WizardsHandler) Step(c echo.Context) error {
+	req := goodooHttp.MustGetGoodooRequest(c)
+	s, err := h.session(c)
+	if err != nil {
+		return wizardError(c, nil, err)
+	}
+	var body WizardStepRequest
+	if err := c.Bind(&body); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request format"})
+	}
+	if err := s.Submit(body.Step, body.To, body.Values); err != nil {
+		return wizardError(c, s, err)
+	}
+	if s.Step() == wizard.Done {
+		req.Logger.InfoCtx(req.Context, "Wizard %s finished by user %d", s.ID(), req.GetUserID())
+	}
+	return c.JSON(http.StatusOK, s.Status())
+}
+
+// RegisterWizardRoutes mounts the wizard endpoints; running wizards are
+// identified as <wizard>.<record id>
+func RegisterWizardRoutes(e *echo.Echo, config *goodooHttp.RequestConfig) {
+	handler := NewWizardsHandler(config)
+
+	goodooHttp.MustRegisterRoutes(e, []goodooHttp.RouteSpec{
+		{Method: "GET", Path: "/api/wizards", Handler: handler.List, Auth: true, DB: true},
+		{Method: "POST", Path: "/api/wizards/:name/start", Handler: handler.Start, Auth: true, DB: true},
+		{Method: "GET", Path: "/api/wizards/:id", Handler: handler.Get, Auth: true, DB: true},
+		{Method: "POST", Path: "/api/wizards/:id/step", Handler: handler.Step, Auth: true, DB: true},
+	})
+}
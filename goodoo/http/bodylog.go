@@ -0,0 +1,97 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"goodoo/logging"
+)
+
+// BodyLoggingMiddleware logs the headers, query and body of the requests
+// to routes, for debugging: each entry is a route path ("/auth/login",
+// "/api/records/:model") or a URL path prefix ending with "*". Sensitive
+// values are always redacted, and at most maxBytes of each body are
+// logged, logging.MaxLogBodyBytes at most. Bodies other than JSON and
+// forms are not logged.
+func BodyLoggingMiddleware(routes []string, maxBytes int) echo.MiddlewareFunc {
+	if maxBytes <= 0 || maxBytes > logging.MaxLogBodyBytes {
+		maxBytes = logging.MaxLogBodyBytes
+	}
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := GetGoodooRequest(c)
+			if req == nil || !bodyLogged(routes, c.Path(), c.Request().URL.Path) {
+				return next(c)
+			}
+			req.Logger.InfoCtx(req.Context, "Request dump: %s %s headers=%v query=%v body=%s",
+				c.Request().Method, c.Request().URL.Path,
+				logging.RedactHeader(c.Request().Header), logging.Redact(c.Request().URL.Query()), dumpBody(c, req, maxBytes))
+			return next(c)
+		}
+	}
+}
+
+// bodyLogged reports whether the body of a request to a route or path is
+// logged
+func bodyLogged(routes []string, route, path string) bool {
+	for _, entry := range routes {
+		entry = strings.TrimSpace(entry)
+		switch {
+		case entry == "":
+		case strings.HasSuffix(entry, "*"):
+			if strings.HasPrefix(path, strings.TrimSuffix(entry, "*")) {
+				return true
+			}
+		case entry == route || entry == path:
+			return true
+		}
+	}
+	return false
+}
+
+// dumpBody returns the redacted body of a request, truncated to maxBytes,
+// leaving the body readable by the handler
+func dumpBody(c echo.Context, req *Request, maxBytes int) string {
+	httpRequest := c.Request()
+	contentType := httpRequest.Header.Get(echo.HeaderContentType)
+	var dump []byte
+	switch {
+	case req.body != nil:
+		// JSON is read whole, as the handler would, so that it is
+		// redacted before it is cut
+		data, err := req.jsonBody()
+		httpRequest.Body = io.NopCloser(bytes.NewReader(data))
+		if err != nil {
+			return "[unreadable body]"
+		}
+		var decoded interface{}
+		if json.Unmarshal(data, &decoded) != nil {
+			return "[invalid JSON body]"
+		}
+		dump, _ = json.Marshal(logging.Redact(decoded))
+	case strings.HasPrefix(contentType, echo.MIMEApplicationForm) && httpRequest.Body != nil:
+		prefix, err := io.ReadAll(io.LimitReader(httpRequest.Body, int64(maxBytes)+1))
+		httpRequest.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(prefix), httpRequest.Body), httpRequest.Body}
+		if err != nil {
+			return "[unreadable body]"
+		}
+		// A value cut by the limit keeps its key, so it is still redacted
+		values, _ := url.ParseQuery(string(prefix))
+		dump = []byte(logging.Redact(values).(url.Values).Encode())
+	case httpRequest.ContentLength == 0:
+		return "[empty]"
+	default:
+		return "[" + contentType + " body not logged]"
+	}
+	if len(dump) > maxBytes {
+		return string(dump[:maxBytes]) + "...[truncated]"
+	}
+	return string(dump)
+}
@@ -0,0 +1,86 @@
+package http
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestBodyLogged(t *testing.T) {
+	routes := []string{"/auth/login", " /api/records/:model ", "/api/llm/*", ""}
+	tests := []struct {
+		route, path string
+		want        bool
+	}{
+		{"/auth/login", "/auth/login", true},
+		{"/api/records/:model", "/api/records/res.partner", true},
+		{"", "/api/llm/config", true},
+		{"/api/llm/:id", "/api/llm/3/test", true},
+		{"/auth/logout", "/auth/logout", false},
+		{"/api/records/:model/:id", "/api/records/res.partner/1", false},
+		{"/api/llmx", "/api/llmx", false},
+	}
+	for _, tt := range tests {
+		if got := bodyLogged(routes, tt.route, tt.path); got != tt.want {
+			t.Errorf("bodyLogged(%s, %s) = %v, want %v", tt.route, tt.path, got, tt.want)
+		}
+	}
+	if bodyLogged(nil, "/auth/login", "/auth/login") {
+		t.Error("a body is logged without routes")
+	}
+}
+
+// TestDumpBody dumps request bodies redacted and cut to the size cap,
+// leaving them whole to the handler
+func TestDumpBody(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		maxBytes    int
+		want        string
+	}{
+		{"json", echo.MIMEApplicationJSON, `{"login":"admin","password":"hunter2"}`, 1000,
+			`{"login":"admin","password":"[REDACTED]"}`},
+		{"nested json", echo.MIMEApplicationJSON, `{"config":[{"api_key":"sk-1","model":"gpt"}]}`, 1000,
+			`{"config":[{"api_key":"[REDACTED]","model":"gpt"}]}`},
+		// The secret is redacted before the dump is cut
+		{"json cut", echo.MIMEApplicationJSON, `{"token":"` + strings.Repeat("t", 100) + `"}`, 12,
+			`{"token":"[R...[truncated]`},
+		{"invalid json", echo.MIMEApplicationJSON, `{"password":`, 1000, "[invalid JSON body]"},
+		{"form", echo.MIMEApplicationForm, "login=admin&password=hunter2", 1000,
+			"login=admin&password=%5BREDACTED%5D"},
+		// A value cut by the limit is still redacted
+		{"form cut", echo.MIMEApplicationForm, "password=" + strings.Repeat("p", 100), 20,
+			"password=%5BREDACTED...[truncated]"},
+		{"empty", "", "", 1000, "[empty]"},
+		{"other", "application/pdf", "%PDF", 1000, "[application/pdf body not logged]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newPublicTestServer(t, "")
+			var dump, received string
+			MustRegisterRoutes(s.e, []RouteSpec{{Method: "POST", Path: "/bodylog-test", Handler: func(c echo.Context) error {
+				dump = dumpBody(c, MustGetGoodooRequest(c), tt.maxBytes)
+				body, _ := io.ReadAll(c.Request().Body)
+				received = string(body)
+				return c.NoContent(http.StatusOK)
+			}}})
+			r := httptest.NewRequest(http.MethodPost, "/bodylog-test", strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				r.Header.Set(echo.HeaderContentType, tt.contentType)
+			}
+			s.do(r, nil)
+			if dump != tt.want {
+				t.Errorf("dumpBody = %s, want %s", dump, tt.want)
+			}
+			if received != tt.body {
+				t.Errorf("the handler read %q, want %q", received, tt.body)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package http
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultCookieName names the session cookie when RequestConfig does not
+const defaultCookieName = "goodoo_session"
+
+// defaultCookieMaxAge is the lifetime of the session cookie by default
+const defaultCookieMaxAge = 24 * time.Hour
+
+// hostPrefix is the cookie name prefix browsers reserve for cookies bound
+// to the host: Secure, Path=/ and without Domain
+const hostPrefix = "__Host-"
+
+// CookieConfig sets the attributes of the session cookie. The zero value
+// is a Lax cookie on / kept 24 hours, Secure on TLS connections.
+type CookieConfig struct {
+	// Path restricts the cookie, e.g. to the prefix goodoo is mounted under
+	Path   string
+	Domain string
+	// SameSite defaults to Lax
+	SameSite http.SameSite
+	// MaxAge is how long the browser keeps the cookie: 0 means 24 hours, a
+	// negative value makes a browser-session cookie
+	MaxAge time.Duration
+	// Secure forces the Secure flag on or off; nil sets it on TLS
+	// connections (and behind a TLS proxy in proxy mode)
+	Secure *bool
+	// HostPrefix names the cookie __Host-<name>, locking it to the host
+	HostPrefix bool
+}
+
+// LoadFromEnv overrides the attributes with GOODOO_SESSION_COOKIE_PATH,
+// _DOMAIN, _SAMESITE (lax, strict or none), _MAX_AGE (a duration, or
+// "session"), _SECURE and _HOST_PREFIX
+func (c *CookieConfig) LoadFromEnv() {
+	if value := os.Getenv("GOODOO_SESSION_COOKIE_PATH"); value != "" {
+		c.Path = value
+	}
+	if value := os.Getenv("GOODOO_SESSION_COOKIE_DOMAIN"); value != "" {
+		c.Domain = value
+	}
+	switch strings.ToLower(os.Getenv("GOODOO_SESSION_COOKIE_SAMESITE")) {
+	case "lax":
+		c.SameSite = http.SameSiteLaxMode
+	case "strict":
+		c.SameSite = http.SameSiteStrictMode
+	case "none":
+		c.SameSite = http.SameSiteNoneMode
+	}
+	if value := os.Getenv("GOODOO_SESSION_COOKIE_MAX_AGE"); value == "session" {
+		c.MaxAge = -1
+	} else if maxAge, err := time.ParseDuration(value); err == nil && maxAge > 0 {
+		c.MaxAge = maxAge
+	}
+	if value := os.Getenv("GOODOO_SESSION_COOKIE_SECURE"); value != "" {
+		if secure, err := strconv.ParseBool(value); err == nil {
+			c.Secure = &secure
+		}
+	}
+	if value := os.Getenv("GOODOO_SESSION_COOKIE_HOST_PREFIX"); value != "" {
+		c.HostPrefix, _ = strconv.ParseBool(value)
+	}
+}
+
+// Validate rejects the combinations browsers would refuse or that would
+// leak the cookie
+func (c CookieConfig) Validate() error {
+	if c.Path != "" && !strings.HasPrefix(c.Path, "/") {
+		return errors.New("session cookie path must start with /")
+	}
+	if strings.ContainsAny(c.Path+c.Domain, ";, \t") {
+		return errors.New("session cookie path and domain cannot contain separators")
+	}
+	secureOff := c.Secure != nil && !*c.Secure
+	if c.HostPrefix {
+		switch {
+		case c.Path != "" && c.Path != "/":
+			return errors.New("a __Host- session cookie must use path /")
+		case c.Domain != "":
+			return errors.New("a __Host- session cookie cannot set a domain")
+		case secureOff:
+			return errors.New("a __Host- session cookie must be secure")
+		}
+	}
+	if c.SameSite == http.SameSiteNoneMode && secureOff {
+		return errors.New("a SameSite=None session cookie must be secure")
+	}
+	return nil
+}
+
+// name returns the cookie name for a base name
+func (c CookieConfig) name(base string) string {
+	if base == "" {
+		base = defaultCookieName
+	}
+	if c.HostPrefix {
+		return hostPrefix + base
+	}
+	return base
+}
+
+// cookie returns the session cookie holding value, or with expire the
+// cookie deleting it
+func (c CookieConfig) cookie(name, value string, tls, expire bool) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     c.Path,
+		Domain:   c.Domain,
+		HttpOnly: true,
+		Secure:   tls,
+		SameSite: c.SameSite,
+	}
+	if cookie.Path == "" {
+		cookie.Path = "/"
+	}
+	if cookie.SameSite == 0 {
+		cookie.SameSite = http.SameSiteLaxMode
+	}
+	// Browsers drop __Host- and SameSite=None cookies that are not Secure
+	if c.Secure != nil {
+		cookie.Secure = *c.Secure
+	} else if c.HostPrefix || cookie.SameSite == http.SameSiteNoneMode {
+		cookie.Secure = true
+	}
+
+	switch {
+	case expire:
+		cookie.Value = ""
+		cookie.MaxAge = -1
+		cookie.Expires = time.Unix(0, 0)
+	case c.MaxAge == 0:
+		cookie.MaxAge = int(defaultCookieMaxAge.Seconds())
+	case c.MaxAge > 0:
+		cookie.MaxAge = int(c.MaxAge.Seconds())
+	}
+	return cookie
+}
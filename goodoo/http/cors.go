@@ -0,0 +1,276 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"goodoo/models"
+)
+
+func init() {
+	// The origins stored in the settings are refused when the resolver
+	// would ignore them, and the wildcard since API calls carry the
+	// session cookie
+	models.RegisterParamValidator(models.ParamCORSAllowedOrigins, func(value string) error {
+		origins := SplitList(value)
+		if err := ValidateOrigins(origins); err != nil {
+			return err
+		}
+		for _, origin := range origins {
+			if origin == "*" {
+				return errors.New("the * origin cannot be allowed for credentialed API calls")
+			}
+		}
+		return nil
+	})
+}
+
+// CORSPolicy is the cross-origin policy of a set of routes. Without
+// allowed origins, cross-origin requests get no CORS headers and browsers
+// keep them same-origin.
+type CORSPolicy struct {
+	// AllowOrigins lists exact origins ("https://app.example.com"),
+	// wildcard subdomain patterns ("https://*.example.com") or "*" for any
+	AllowOrigins []string
+	AllowMethods []string
+	AllowHeaders []string
+	// ExposeHeaders lists the response headers scripts may read
+	ExposeHeaders []string
+	// AllowCredentials lets requests carry the session cookie; it cannot
+	// be combined with the "*" origin
+	AllowCredentials bool
+	// MaxAge is how long browsers cache a preflight response
+	MaxAge time.Duration
+}
+
+// CORSConfig configures CORSMiddleware
+type CORSConfig struct {
+	CORSPolicy
+
+	// Routes maps path prefixes to their own policy; the longest prefix wins
+	Routes map[string]CORSPolicy
+
+	// OriginsResolver returns the allowed origins stored in the database
+	// (see models.ParamCORSAllowedOrigins), replacing AllowOrigins of the
+	// default policy when not nil and valid. It is called on every request
+	// to a route without its own policy, so changes apply without restart.
+	OriginsResolver func() []string
+}
+
+// DefaultCORSConfig returns a policy allowing no other origin, with
+// /health open to any origin without credentials
+func DefaultCORSConfig() *CORSConfig {
+	return &CORSConfig{
+		CORSPolicy: CORSPolicy{
+			AllowMethods:     []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete},
+			AllowHeaders:     []string{echo.HeaderContentType, echo.HeaderAuthorization, "X-Field-Mask", HeaderIdempotencyKey, HeaderAPIVersion, HeaderPrefer},
+			ExposeHeaders:    []string{"X-Operation-Id", HeaderIdempotentReplayed, "Deprecation", "Sunset", "Link", "ETag", HeaderPreferenceApplied, "X-Ignored-Fields", "X-Duplicates"},
+			AllowCredentials: true,
+			MaxAge:           10 * time.Minute,
+		},
+		Routes: map[string]CORSPolicy{
+			"/health": {
+				AllowOrigins: []string{"*"},
+				AllowMethods: []string{http.MethodGet, http.MethodHead},
+				MaxAge:       time.Hour,
+			},
+		},
+	}
+}
+
+// LoadFromEnv overrides the default policy with GOODOO_CORS_ALLOW_ORIGINS,
+// _ALLOW_METHODS, _ALLOW_HEADERS, _EXPOSE_HEADERS (comma-separated lists),
+// _ALLOW_CREDENTIALS and _MAX_AGE (a duration)
+func (c *CORSConfig) LoadFromEnv() {
+	if value := os.Getenv("GOODOO_CORS_ALLOW_ORIGINS"); value != "" {
+		c.AllowOrigins = SplitList(value)
+	}
+	if value := os.Getenv("GOODOO_CORS_ALLOW_METHODS"); value != "" {
+		c.AllowMethods = SplitList(strings.ToUpper(value))
+	}
+	if value := os.Getenv("GOODOO_CORS_ALLOW_HEADERS"); value != "" {
+		c.AllowHeaders = SplitList(value)
+	}
+	if value := os.Getenv("GOODOO_CORS_EXPOSE_HEADERS"); value != "" {
+		c.ExposeHeaders = SplitList(value)
+	}
+	if value := os.Getenv("GOODOO_CORS_ALLOW_CREDENTIALS"); value != "" {
+		if allow, err := strconv.ParseBool(value); err == nil {
+			c.AllowCredentials = allow
+		}
+	}
+	if value := os.Getenv("GOODOO_CORS_MAX_AGE"); value != "" {
+		if maxAge, err := time.ParseDuration(value); err == nil && maxAge >= 0 {
+			c.MaxAge = maxAge
+		}
+	}
+}
+
+// SplitList splits a comma or space separated list, dropping empty items
+func SplitList(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' || r == '\n' })
+}
+
+// Validate checks the origin patterns of the policies and refuses the "*"
+// origin with credentials, which would expose the session to any site
+func (c *CORSConfig) Validate() error {
+	if err := c.CORSPolicy.Validate(); err != nil {
+		return err
+	}
+	for prefix, policy := range c.Routes {
+		if err := policy.Validate(); err != nil {
+			return fmt.Errorf("CORS policy of %s: %w", prefix, err)
+		}
+	}
+	return nil
+}
+
+// Validate checks the origin patterns of the policy
+func (p CORSPolicy) Validate() error {
+	if err := ValidateOrigins(p.AllowOrigins); err != nil {
+		return err
+	}
+	if p.AllowCredentials && p.allowsAny() {
+		return errors.New("the * origin cannot be allowed with credentials")
+	}
+	return nil
+}
+
+// ValidateOrigins checks origin patterns: "*", or scheme://host[:port]
+// where the host may start with "*." to match its subdomains
+func ValidateOrigins(origins []string) error {
+	for _, origin := range origins {
+		if origin == "*" {
+			continue
+		}
+		parsed, err := url.Parse(strings.Replace(origin, "://*.", "://", 1))
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" ||
+			parsed.Path != "" || parsed.RawQuery != "" || parsed.Fragment != "" || parsed.User != nil {
+			return fmt.Errorf("invalid CORS origin %q: expected scheme://host[:port]", origin)
+		}
+	}
+	return nil
+}
+
+// allowsAny reports whether the policy allows every origin
+func (p CORSPolicy) allowsAny() bool {
+	for _, origin := range p.AllowOrigins {
+		if origin == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// allows reports whether the policy allows an origin
+func (p CORSPolicy) allows(origin string) bool {
+	for _, allowed := range p.AllowOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+		// https://*.example.com matches https://a.example.com, not https://example.com
+		if scheme, domain, ok := strings.Cut(allowed, "://*."); ok {
+			rest, found := strings.CutPrefix(strings.ToLower(origin), strings.ToLower(scheme)+"://")
+			if found && strings.HasSuffix(rest, "."+strings.ToLower(domain)) && !strings.ContainsAny(rest, "/@") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// policyFor returns the policy of a path: the longest matching route
+// prefix, or the default policy with the resolved origins
+func (c *CORSConfig) policyFor(path string) CORSPolicy {
+	longest := -1
+	var match CORSPolicy
+	for prefix, policy := range c.Routes {
+		if strings.HasPrefix(path, prefix) && len(prefix) > longest {
+			match, longest = policy, len(prefix)
+		}
+	}
+	if longest >= 0 {
+		return match
+	}
+
+	policy := c.CORSPolicy
+	if c.OriginsResolver != nil {
+		resolved := policy
+		resolved.AllowOrigins = c.OriginsResolver()
+		// An invalid stored list keeps the configured origins
+		if resolved.AllowOrigins != nil && resolved.Validate() == nil {
+			policy = resolved
+		}
+	}
+	return policy
+}
+
+// CORSMiddleware applies the CORS policy of config.CORS (DefaultCORSConfig
+// when nil). An allowed origin is echoed back, never "*" with credentials;
+// other origins get no CORS header. Preflight requests are answered
+// without reaching the handler.
+func CORSMiddleware(config *RequestConfig) echo.MiddlewareFunc {
+	cors := config.CORS
+	if cors == nil {
+		cors = DefaultCORSConfig()
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			request := c.Request()
+			header := c.Response().Header()
+			origin := request.Header.Get(echo.HeaderOrigin)
+			preflight := request.Method == http.MethodOptions &&
+				request.Header.Get(echo.HeaderAccessControlRequestMethod) != ""
+
+			policy := cors.policyFor(request.URL.Path)
+			// Caches must not serve the answer for one origin to another
+			if !policy.allowsAny() || policy.AllowCredentials {
+				header.Add(echo.HeaderVary, echo.HeaderOrigin)
+			}
+			if preflight {
+				header.Add(echo.HeaderVary, echo.HeaderAccessControlRequestMethod)
+				header.Add(echo.HeaderVary, echo.HeaderAccessControlRequestHeaders)
+			}
+
+			if origin == "" || !policy.allows(origin) {
+				if preflight {
+					return c.NoContent(http.StatusNoContent)
+				}
+				return next(c)
+			}
+
+			if policy.allowsAny() && !policy.AllowCredentials {
+				header.Set(echo.HeaderAccessControlAllowOrigin, "*")
+			} else {
+				header.Set(echo.HeaderAccessControlAllowOrigin, origin)
+			}
+			if policy.AllowCredentials {
+				header.Set(echo.HeaderAccessControlAllowCredentials, "true")
+			}
+
+			if !preflight {
+				if len(policy.ExposeHeaders) > 0 {
+					header.Set(echo.HeaderAccessControlExposeHeaders, strings.Join(policy.ExposeHeaders, ", "))
+				}
+				return next(c)
+			}
+
+			header.Set(echo.HeaderAccessControlAllowMethods, strings.Join(policy.AllowMethods, ", "))
+			if len(policy.AllowHeaders) > 0 {
+				header.Set(echo.HeaderAccessControlAllowHeaders, strings.Join(policy.AllowHeaders, ", "))
+			}
+			if policy.MaxAge > 0 {
+				header.Set(echo.HeaderAccessControlMaxAge, strconv.Itoa(int(policy.MaxAge.Seconds())))
+			}
+			return c.NoContent(http.StatusNoContent)
+		}
+	}
+}
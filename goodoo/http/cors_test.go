@@ -0,0 +1,186 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+// newCORSServer returns an Echo instance applying the CORS policy of
+// config to a handler answering 200
+func newCORSServer(config *CORSConfig) *echo.Echo {
+	e := echo.New()
+	e.Use(CORSMiddleware(&RequestConfig{CORS: config}))
+	ok := func(c echo.Context) error { return c.NoContent(http.StatusOK) }
+	e.Any("/*", ok)
+	return e
+}
+
+func TestCORSMiddleware(t *testing.T) {
+	config := DefaultCORSConfig()
+	config.AllowOrigins = []string{"https://app.example.com", "https://*.partners.example.com"}
+
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		origin    string
+		preflight bool
+		// wantStatus is 200 when the handler answered
+		wantStatus int
+		// wantOrigin is the Access-Control-Allow-Origin answered, if any
+		wantOrigin      string
+		wantCredentials bool
+		wantVary        []string
+	}{
+		{name: "same origin", method: "GET", path: "/api/records", wantStatus: http.StatusOK, wantVary: []string{"Origin"}},
+		{name: "allowed origin", method: "GET", path: "/api/records", origin: "https://app.example.com",
+			wantStatus: http.StatusOK, wantOrigin: "https://app.example.com", wantCredentials: true, wantVary: []string{"Origin"}},
+		{name: "disallowed origin", method: "GET", path: "/api/records", origin: "https://evil.example.net",
+			wantStatus: http.StatusOK, wantVary: []string{"Origin"}},
+		{name: "other scheme", method: "GET", path: "/api/records", origin: "http://app.example.com",
+			wantStatus: http.StatusOK, wantVary: []string{"Origin"}},
+		{name: "subdomain pattern", method: "GET", path: "/api/records", origin: "https://acme.partners.example.com",
+			wantStatus: http.StatusOK, wantOrigin: "https://acme.partners.example.com", wantCredentials: true, wantVary: []string{"Origin"}},
+		{name: "domain of the pattern", method: "GET", path: "/api/records", origin: "https://partners.example.com",
+			wantStatus: http.StatusOK, wantVary: []string{"Origin"}},
+		{name: "suffix lookalike", method: "GET", path: "/api/records", origin: "https://evilpartners.example.com",
+			wantStatus: http.StatusOK, wantVary: []string{"Origin"}},
+		{name: "preflight", method: "OPTIONS", path: "/api/records", origin: "https://app.example.com", preflight: true,
+			wantStatus: http.StatusNoContent, wantOrigin: "https://app.example.com", wantCredentials: true,
+			wantVary: []string{"Origin", "Access-Control-Request-Method", "Access-Control-Request-Headers"}},
+		{name: "preflight of a disallowed origin", method: "OPTIONS", path: "/api/records", origin: "https://evil.example.net", preflight: true,
+			wantStatus: http.StatusNoContent, wantVary: []string{"Origin", "Access-Control-Request-Method", "Access-Control-Request-Headers"}},
+		// /health is open to any origin, without credentials nor Vary
+		{name: "open route", method: "GET", path: "/health", origin: "https://evil.example.net",
+			wantStatus: http.StatusOK, wantOrigin: "*"},
+		{name: "open route preflight", method: "OPTIONS", path: "/health/ready", origin: "https://evil.example.net", preflight: true,
+			wantStatus: http.StatusNoContent, wantOrigin: "*", wantVary: []string{"Access-Control-Request-Method", "Access-Control-Request-Headers"}},
+	}
+	e := newCORSServer(config)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.origin != "" {
+				r.Header.Set(echo.HeaderOrigin, tt.origin)
+			}
+			if tt.preflight {
+				r.Header.Set(echo.HeaderAccessControlRequestMethod, "POST")
+				r.Header.Set(echo.HeaderAccessControlRequestHeaders, "Content-Type")
+			}
+			w := httptest.NewRecorder()
+			e.ServeHTTP(w, r)
+			header := w.Header()
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := header.Get(echo.HeaderAccessControlAllowOrigin); got != tt.wantOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.wantOrigin)
+			}
+			if got := header.Get(echo.HeaderAccessControlAllowCredentials) == "true"; got != tt.wantCredentials {
+				t.Errorf("credentials allowed: %v, want %v", got, tt.wantCredentials)
+			}
+			if got := header.Values(echo.HeaderVary); !slices.Equal(got, tt.wantVary) {
+				t.Errorf("Vary = %v, want %v", got, tt.wantVary)
+			}
+
+			allowed := tt.preflight && tt.wantOrigin != ""
+			if got := header.Get(echo.HeaderAccessControlAllowMethods) != ""; got != allowed {
+				t.Errorf("Access-Control-Allow-Methods = %q", header.Get(echo.HeaderAccessControlAllowMethods))
+			}
+			if got := header.Get(echo.HeaderAccessControlMaxAge) != ""; got != allowed {
+				t.Errorf("Access-Control-Max-Age = %q", header.Get(echo.HeaderAccessControlMaxAge))
+			}
+			exposed := !tt.preflight && tt.wantCredentials
+			if got := header.Get(echo.HeaderAccessControlExposeHeaders) != ""; got != exposed {
+				t.Errorf("Access-Control-Expose-Headers = %q", header.Get(echo.HeaderAccessControlExposeHeaders))
+			}
+		})
+	}
+}
+
+// TestCORSOriginsResolver applies the origins stored in the settings on
+// the next request, ignoring an invalid list
+func TestCORSOriginsResolver(t *testing.T) {
+	stored := []string{"https://app.example.com"}
+	config := DefaultCORSConfig()
+	config.AllowOrigins = []string{"https://static.example.com"}
+	config.OriginsResolver = func() []string { return stored }
+	e := newCORSServer(config)
+
+	allowed := func(origin string) bool {
+		r := httptest.NewRequest(http.MethodGet, "/api/records", nil)
+		r.Header.Set(echo.HeaderOrigin, origin)
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, r)
+		return w.Header().Get(echo.HeaderAccessControlAllowOrigin) == origin
+	}
+
+	if !allowed("https://app.example.com") || allowed("https://static.example.com") {
+		t.Error("the stored origins do not replace the configured ones")
+	}
+	stored = []string{"https://new.example.com"}
+	if !allowed("https://new.example.com") || allowed("https://app.example.com") {
+		t.Error("a change of the stored origins does not apply at once")
+	}
+	// The wildcard would expose the session: the configured origins stay
+	stored = []string{"*"}
+	if allowed("https://evil.example.net") || !allowed("https://static.example.com") {
+		t.Error("an invalid stored list is applied")
+	}
+	stored = nil
+	if !allowed("https://static.example.com") {
+		t.Error("the configured origins are not used without stored ones")
+	}
+}
+
+func TestCORSValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  CORSPolicy
+		wantErr bool
+	}{
+		{"none", CORSPolicy{}, false},
+		{"origins", CORSPolicy{AllowOrigins: []string{"https://app.example.com", "http://localhost:8069", "https://*.example.com"}, AllowCredentials: true}, false},
+		{"any without credentials", CORSPolicy{AllowOrigins: []string{"*"}}, false},
+		{"any with credentials", CORSPolicy{AllowOrigins: []string{"https://app.example.com", "*"}, AllowCredentials: true}, true},
+		{"no scheme", CORSPolicy{AllowOrigins: []string{"app.example.com"}}, true},
+		{"other scheme", CORSPolicy{AllowOrigins: []string{"ftp://app.example.com"}}, true},
+		{"path", CORSPolicy{AllowOrigins: []string{"https://app.example.com/"}}, true},
+		{"query", CORSPolicy{AllowOrigins: []string{"https://app.example.com?x=1"}}, true},
+		{"credentials in the origin", CORSPolicy{AllowOrigins: []string{"https://user@app.example.com"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.policy.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate = %v, want an error: %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	config := DefaultCORSConfig()
+	if err := config.Validate(); err != nil {
+		t.Errorf("default config: %v", err)
+	}
+	config.Routes["/api/public"] = CORSPolicy{AllowOrigins: []string{"*"}, AllowCredentials: true}
+	if err := config.Validate(); err == nil {
+		t.Error("a route allowing any origin with credentials is accepted")
+	}
+}
+
+func TestCORSFromEnv(t *testing.T) {
+	t.Setenv("GOODOO_CORS_ALLOW_ORIGINS", "https://a.example.com, https://b.example.com")
+	t.Setenv("GOODOO_CORS_ALLOW_METHODS", "get,post")
+	t.Setenv("GOODOO_CORS_ALLOW_CREDENTIALS", "false")
+	t.Setenv("GOODOO_CORS_MAX_AGE", "-1s")
+	config := DefaultCORSConfig()
+	config.LoadFromEnv()
+	if !slices.Equal(config.AllowOrigins, []string{"https://a.example.com", "https://b.example.com"}) ||
+		!slices.Equal(config.AllowMethods, []string{"GET", "POST"}) || config.AllowCredentials || config.MaxAge != DefaultCORSConfig().MaxAge {
+		t.Errorf("LoadFromEnv = %+v", config.CORSPolicy)
+	}
+}
@@ -0,0 +1,239 @@
+package http
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"goodoo/database"
+	"goodoo/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Idempotency headers
+const (
+	HeaderIdempotencyKey = "Idempotency-Key"
+	// HeaderIdempotentReplayed marks a response replayed from a stored one
+	HeaderIdempotentReplayed = "Idempotent-Replayed"
+)
+
+// IdempotencyConfig configures IdempotencyMiddleware
+type IdempotencyConfig struct {
+	// Window is how long a response is replayed; older records are pruned
+	Window time.Duration
+	// Wait is how long a request waits for a concurrent one with the same
+	// key to finish before getting 409 Conflict; zero waits without limit
+	Wait time.Duration
+}
+
+// DefaultIdempotencyConfig returns a window of 24 hours and a wait of 5 seconds
+func DefaultIdempotencyConfig() *IdempotencyConfig {
+	return &IdempotencyConfig{
+		Window: 24 * time.Hour,
+		Wait:   5 * time.Second,
+	}
+}
+
+// LoadFromEnv overrides the configuration with GOODOO_IDEMPOTENCY_WINDOW
+// and GOODOO_IDEMPOTENCY_WAIT (durations)
+func (c *IdempotencyConfig) LoadFromEnv() {
+	if value := os.Getenv("GOODOO_IDEMPOTENCY_WINDOW"); value != "" {
+		if d, err := time.ParseDuration(value); err == nil && d > 0 {
+			c.Window = d
+		}
+	}
+	if value := os.Getenv("GOODOO_IDEMPOTENCY_WAIT"); value != "" {
+		if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+			c.Wait = d
+		}
+	}
+}
+
+// errIdempotencyRollback rolls back the transaction of an idempotent
+// request that failed or whose key was used meanwhile
+var errIdempotencyRollback = errors.New("idempotent request rolled back")
+
+// bufferedResponse holds the response of a handler until its transaction
+// commits; headers go to the underlying writer
+type bufferedResponse struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedResponse) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *bufferedResponse) Write(p []byte) (int, error) {
+	return w.body.Write(p)
+}
+
+// requestHash returns the SHA-256 of the request body, which stays readable
+func requestHash(req *Request) (string, error) {
+	var data []byte
+	var err error
+	if req.body != nil {
+		data, err = req.jsonBody()
+	} else if req.HTTPRequest.Body != nil {
+		data, err = io.ReadAll(req.HTTPRequest.Body)
+		req.HTTPRequest.Body = io.NopCloser(bytes.NewReader(data))
+	}
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// replayIdempotent answers with a stored response, or refuses a key reused
+// with another body
+func replayIdempotent(c echo.Context, record *models.IdempotencyRecord, hash string) error {
+	if record.RequestHash != hash {
+		return c.JSON(http.StatusUnprocessableEntity, map[string]string{
+			"error": "Idempotency-Key was already used for another request",
+		})
+	}
+	c.Response().Header().Set(HeaderIdempotentReplayed, "true")
+	return c.Blob(record.Status, record.ContentType, record.Body)
+}
+
+// IdempotencyMiddleware lets clients retry an unsafe request safely: a
+// request sent with an Idempotency-Key header runs in a transaction that
+// also stores its response under the key, the user and the endpoint. A
+// retry within config.Idempotency's window gets the stored response; a
+// retry while the first request runs waits for it, then gets its response
+// or 409 Conflict after Wait. Server errors are not stored, so the request
+// can be retried. Requests without the header, a user or a database run
+// as usual. Use it after the authentication and database middleware.
+func IdempotencyMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			key := c.Request().Header.Get(HeaderIdempotencyKey)
+			if key == "" {
+				return next(c)
+			}
+			req := MustGetGoodooRequest(c)
+			uid := uint(req.GetUserID())
+			db := req.GetDB()
+			if uid == 0 || db == nil {
+				return next(c)
+			}
+			if len(key) > models.MaxIdempotencyKeyLength {
+				return c.JSON(http.StatusBadRequest, map[string]string{
+					"error": fmt.Sprintf("Idempotency-Key cannot exceed %d characters", models.MaxIdempotencyKeyLength),
+				})
+			}
+
+			config := DefaultIdempotencyConfig()
+			if req.config != nil && req.config.Idempotency != nil {
+				config = req.config.Idempotency
+			}
+			hash, err := requestHash(req)
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Failed to read request body"})
+			}
+			endpoint := c.Request().Method + " " + c.Request().URL.Path
+
+			// A record past the window no longer counts
+			var record models.IdempotencyRecord
+			err = db.Where("user_id = ? AND endpoint = ? AND key = ?", uid, endpoint, key).Take(&record).Error
+			switch {
+			case err == nil && req.Now().Sub(record.CreateDate) < config.Window:
+				return replayIdempotent(c, &record, hash)
+			case err == nil:
+				if err := db.Delete(&record).Error; err != nil {
+					return echo.NewHTTPError(http.StatusInternalServerError, "Failed to expire idempotency key")
+				}
+			case !errors.Is(err, gorm.ErrRecordNotFound):
+				req.Logger.ErrorCtx(req.Context, "Failed to look up idempotency key: %v", err)
+				return echo.NewHTTPError(http.StatusInternalServerError, "Failed to look up idempotency key")
+			}
+
+			response := c.Response()
+			writer := response.Writer
+			buffer := &bufferedResponse{ResponseWriter: writer, status: http.StatusOK}
+			var handlerErr error
+			conflict := false
+			err = db.Transaction(func(tx *gorm.DB) error {
+				// The insert waits on the unique index while a request with
+				// the same key is uncommitted
+				var lockTimeout string
+				if err := tx.Raw("SELECT current_setting('lock_timeout')").Scan(&lockTimeout).Error; err != nil {
+					return err
+				}
+				wait := fmt.Sprintf("%dms", config.Wait.Milliseconds())
+				if err := tx.Exec("SELECT set_config('lock_timeout', ?, true)", wait).Error; err != nil {
+					return err
+				}
+				record = models.IdempotencyRecord{UserID: uid, Endpoint: endpoint, Key: key, RequestHash: hash, CreateDate: req.Now()}
+				result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&record)
+				if result.Error != nil {
+					return result.Error
+				}
+				if result.RowsAffected == 0 {
+					conflict = true
+					return errIdempotencyRollback
+				}
+				if err := tx.Exec("SELECT set_config('lock_timeout', ?, true)", lockTimeout).Error; err != nil {
+					return err
+				}
+
+				// The handler works in the transaction of the record
+				parent := req.Tx
+				req.Tx, req.env = tx, nil
+				response.Writer = buffer
+				defer func() {
+					response.Writer = writer
+					req.Tx, req.env = parent, nil
+				}()
+				handlerErr = next(c)
+
+				if handlerErr != nil || buffer.status >= http.StatusInternalServerError {
+					return errIdempotencyRollback
+				}
+				return tx.Model(&record).Updates(map[string]interface{}{
+					"status":       buffer.status,
+					"content_type": buffer.Header().Get(echo.HeaderContentType),
+					"body":         buffer.body.Bytes(),
+				}).Error
+			})
+
+			switch {
+			case database.IsLockNotAvailableError(err):
+				return c.JSON(http.StatusConflict, map[string]string{
+					"error": "A request with this Idempotency-Key is in progress",
+				})
+			case conflict:
+				// Another request with the key committed while this one waited
+				if err := db.Where("user_id = ? AND endpoint = ? AND key = ?", uid, endpoint, key).Take(&record).Error; err != nil {
+					return echo.NewHTTPError(http.StatusInternalServerError, "Failed to look up idempotency key")
+				}
+				return replayIdempotent(c, &record, hash)
+			case err != nil && !errors.Is(err, errIdempotencyRollback):
+				req.Logger.ErrorCtx(req.Context, "Idempotent request failed to commit: %v", err)
+				response.Committed = false
+				return echo.NewHTTPError(http.StatusInternalServerError, "Failed to commit the request")
+			}
+			if !response.Committed {
+				return handlerErr
+			}
+			// Send the buffered answer now that its work is committed, or
+			// rolled back for a server error
+			response.Committed, response.Size = false, 0
+			response.WriteHeader(buffer.status)
+			if _, err := response.Write(buffer.body.Bytes()); err != nil {
+				return err
+			}
+			return handlerErr
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package http
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // validate timezones without relying on the system zoneinfo
+)
+
+// TZCookieName is the cookie the frontend sets with the browser's IANA timezone
+const TZCookieName = "tz"
+
+// langPreference is one entry of an Accept-Language header
+type langPreference struct {
+	tag     string
+	quality float64
+}
+
+// ParseAcceptLanguage returns the languages of an Accept-Language header by
+// decreasing quality, converted to Odoo codes ("fr-ch" becomes "fr_CH").
+// Malformed entries and entries with q=0 are skipped; "*" is kept as is.
+func ParseAcceptLanguage(header string) []string {
+	var prefs []langPreference
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		tag := strings.TrimSpace(fields[0])
+		if tag == "" {
+			continue
+		}
+
+		quality := 1.0
+		valid := true
+		for _, param := range fields[1:] {
+			name, value, found := strings.Cut(strings.TrimSpace(param), "=")
+			if !found || strings.TrimSpace(name) != "q" {
+				continue
+			}
+			q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil || q < 0 || q > 1 {
+				valid = false
+				break
+			}
+			quality = q
+		}
+		if !valid || quality == 0 {
+			continue
+		}
+
+		code, ok := langCode(tag)
+		if !ok {
+			continue
+		}
+		prefs = append(prefs, langPreference{tag: code, quality: quality})
+	}
+
+	sort.SliceStable(prefs, func(i, j int) bool {
+		return prefs[i].quality > prefs[j].quality
+	})
+	langs := make([]string, len(prefs))
+	for i, pref := range prefs {
+		langs[i] = pref.tag
+	}
+	return langs
+}
+
+// langCode converts a BCP 47 tag to an Odoo language code
+func langCode(tag string) (string, bool) {
+	if tag == "*" {
+		return tag, true
+	}
+	parts := strings.Split(strings.ReplaceAll(tag, "_", "-"), "-")
+	for _, part := range parts {
+		if part == "" || len(part) > 8 {
+			return "", false
+		}
+		for _, r := range part {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+				return "", false
+			}
+		}
+	}
+	if len(parts[0]) < 2 || len(parts[0]) > 3 {
+		return "", false
+	}
+
+	code := strings.ToLower(parts[0])
+	if len(parts) > 1 && len(parts[1]) == 2 {
+		code += "_" + strings.ToUpper(parts[1])
+	}
+	return code, true
+}
+
+// NegotiateLang returns the installed language best matching an
+// Accept-Language header, or "" when none matches. An exact code wins,
+// then a regional variant of the same language ("fr" matches "fr_FR").
+// A wildcard leaves the choice to the default language.
+func NegotiateLang(header string, installed []string) string {
+	for _, lang := range ParseAcceptLanguage(header) {
+		if lang == "*" {
+			return ""
+		}
+		for _, candidate := range installed {
+			if strings.EqualFold(candidate, lang) {
+				return candidate
+			}
+		}
+		base, _, _ := strings.Cut(lang, "_")
+		for _, candidate := range installed {
+			candidateBase, _, _ := strings.Cut(candidate, "_")
+			if strings.EqualFold(candidateBase, base) {
+				return candidate
+			}
+		}
+	}
+	return ""
+}
+
+// ValidTimezone reports whether name is an IANA timezone
+func ValidTimezone(name string) bool {
+	if name == "" || name == "Local" {
+		return false
+	}
+	_, err := time.LoadLocation(name)
+	return err == nil
+}
+
+// negotiateLocale seeds the context of a new session from the browser's
+// Accept-Language header and timezone cookie
+func (r *Request) negotiateLocale(config *RequestConfig) {
+	updates := make(map[string]interface{})
+
+	if header := r.HTTPRequest.Header.Get("Accept-Language"); header != "" && config.LangResolver != nil && r.DB != "" {
+		if lang := NegotiateLang(header, config.LangResolver(r.DB)); lang != "" {
+			updates["lang"] = lang
+		}
+	}
+
+	if cookie, err := r.HTTPRequest.Cookie(TZCookieName); err == nil && ValidTimezone(cookie.Value) {
+		updates["tz"] = cookie.Value
+		updates["timezone"] = cookie.Value
+	}
+
+	if len(updates) > 0 {
+		r.Session.UpdateContext(updates)
+	}
+}
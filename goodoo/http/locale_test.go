@@ -0,0 +1,139 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestParseAcceptLanguage(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []string
+	}{
+		{"", []string{}},
+		{"fr-CH", []string{"fr_CH"}},
+		{"fr-ch, fr;q=0.9, en;q=0.8, de;q=0.7, *;q=0.5", []string{"fr_CH", "fr", "en", "de", "*"}},
+		// Sorted by quality, equal qualities keeping their order
+		{"en;q=0.5, nl-BE, pt_br;q=0.5", []string{"nl_BE", "en", "pt_BR"}},
+		{"zh-Hant-TW", []string{"zh"}},
+		{"sr-Latn-RS;q=0.9, es-419", []string{"es", "sr"}},
+		{"*", []string{"*"}},
+		{"fr;q=0, en", []string{"en"}},
+		// Malformed entries are skipped, the others kept
+		{"fr;q=abc, en", []string{"en"}},
+		{"fr;q=1.5, en", []string{"en"}},
+		{"fr;q=-1, en", []string{"en"}},
+		{"f, en", []string{"en"}},
+		{"français, en", []string{"en"}},
+		{"en--US, de", []string{"de"}},
+		{"x-averyveryverylongsubtag, de", []string{"de"}},
+		{"<script>, de", []string{"de"}},
+		{" , ;q=0.5, ,de", []string{"de"}},
+		{"de;level=1;q=0.4, it", []string{"it", "de"}},
+	}
+	for _, tt := range tests {
+		if got := ParseAcceptLanguage(tt.header); !slices.Equal(got, tt.want) {
+			t.Errorf("ParseAcceptLanguage(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestNegotiateLang(t *testing.T) {
+	installed := []string{"en_US", "fr_FR", "fr_BE", "nl_BE", "pt_BR"}
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"fr-BE", "fr_BE"},
+		{"fr-be", "fr_BE"},
+		// A language matches its first installed variant
+		{"fr", "fr_FR"},
+		{"fr-CA", "fr_FR"},
+		{"de, nl;q=0.5", "nl_BE"},
+		{"pt-PT, en;q=0.1", "pt_BR"},
+		// Unsupported languages fall back to the default
+		{"de, ja", ""},
+		{"*", ""},
+		{"de, *;q=0.5, fr;q=0.1", ""},
+		{"", ""},
+		{"garbage;;;q=", ""},
+	}
+	for _, tt := range tests {
+		if got := NegotiateLang(tt.header, installed); got != tt.want {
+			t.Errorf("NegotiateLang(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+	if got := NegotiateLang("fr", nil); got != "" {
+		t.Errorf("NegotiateLang without languages = %q", got)
+	}
+}
+
+func TestValidTimezone(t *testing.T) {
+	for name, want := range map[string]bool{
+		"Europe/Brussels":         true,
+		"America/Argentina/Salta": true,
+		"UTC":                     true,
+		"":                        false,
+		"Local":                   false,
+		"Mars/Olympus":            false,
+		"../../etc/passwd":        false,
+		"Europe/Brussels\x00":     false,
+	} {
+		if got := ValidTimezone(name); got != want {
+			t.Errorf("ValidTimezone(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+// TestNegotiateLocale seeds the context of new sessions from the browser,
+// while existing sessions keep theirs
+func TestNegotiateLocale(t *testing.T) {
+	s := newPublicTestServer(t, "locale_test")
+	s.config.LangResolver = func(dbName string) []string { return []string{"en_US", "fr_FR"} }
+	var context map[string]interface{}
+	MustRegisterRoutes(s.e, []RouteSpec{{Method: "GET", Path: "/locale-test", Handler: func(c echo.Context) error {
+		context = MustGetGoodooRequest(c).Session.GetContext()
+		return c.NoContent(http.StatusOK)
+	}}})
+
+	tests := []struct {
+		name           string
+		acceptLanguage string
+		tz             string
+		session        bool
+		wantLang       string
+		wantTZ         string
+	}{
+		{"browser language and timezone", "fr-BE, en;q=0.5", "Europe/Brussels", false, "fr_FR", "Europe/Brussels"},
+		{"unsupported language", "de, ja", "", false, "en_US", "UTC"},
+		{"wildcard", "*", "", false, "en_US", "UTC"},
+		{"malformed header", ";;q=x", "", false, "en_US", "UTC"},
+		{"invalid timezone", "", "Mars/Olympus", false, "en_US", "UTC"},
+		{"existing session", "fr", "Europe/Paris", true, "en_US", "UTC"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/locale-test", nil)
+			if tt.acceptLanguage != "" {
+				r.Header.Set("Accept-Language", tt.acceptLanguage)
+			}
+			if tt.tz != "" {
+				r.AddCookie(&http.Cookie{Name: TZCookieName, Value: tt.tz})
+			}
+			var cookie *http.Cookie
+			if tt.session {
+				cookie = s.login("locale_test", 7)
+			}
+			if status := s.do(r, cookie); status != http.StatusOK {
+				t.Fatalf("GET answered %d", status)
+			}
+			if context["lang"] != tt.wantLang || context["tz"] != tt.wantTZ || context["timezone"] != tt.wantTZ {
+				t.Errorf("session context = %v, want lang %s and timezone %s", context, tt.wantLang, tt.wantTZ)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package http
+
+import (
+	"fmt"
+	"time"
+
+	"goodoo/logging"
+)
+
+// Bounds of the log level overrides of sessions
+const (
+	MaxLogOverrideRequests = 1000
+	MaxLogOverrideDuration = 24 * time.Hour
+)
+
+// SessionLogOverride lowers the log level of the next requests of a
+// session, to trace them in the logs without raising the level of every
+// request. Administrators set it through the API only: it is a field of
+// the session, not of its context, which users may change.
+type SessionLogOverride struct {
+	Level string `json:"level"`
+	// Prefixes restricts the override to these loggers and their children,
+	// all loggers when empty
+	Prefixes []string `json:"prefixes,omitempty"`
+	// Remaining is the number of requests the override still applies to
+	Remaining int       `json:"remaining"`
+	Until     time.Time `json:"until"`
+	SetBy     string    `json:"set_by"`
+}
+
+// Validate checks the level and bounds of an override
+func (o *SessionLogOverride) Validate(now time.Time) error {
+	if !logging.IsValidLogLevel(o.Level) {
+		return fmt.Errorf("invalid log level %q", o.Level)
+	}
+	if o.Remaining <= 0 || o.Remaining > MaxLogOverrideRequests {
+		return fmt.Errorf("requests must be between 1 and %d", MaxLogOverrideRequests)
+	}
+	if !o.Until.After(now) || o.Until.Sub(now) > MaxLogOverrideDuration {
+		return fmt.Errorf("the override must expire within %v", MaxLogOverrideDuration)
+	}
+	return nil
+}
+
+// SetLogOverride sets the log level override of the session, nil clearing it
+func (s *Session) SetLogOverride(override *SessionLogOverride) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.LogOverride = override
+	s.IsDirty = true
+}
+
+// GetLogOverride returns a copy of the log level override of the session,
+// nil when there is none
+func (s *Session) GetLogOverride() *SessionLogOverride {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.LogOverride == nil {
+		return nil
+	}
+	override := *s.LogOverride
+	return &override
+}
+
+// consumeLogOverride counts a request against the log level override of
+// the session and returns it as a logging override, nil when there is
+// none; an expired or used up override is cleared. Concurrent requests of
+// the session may each count the same remaining request.
+func (s *Session) consumeLogOverride(now time.Time) *logging.LevelOverride {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	override := s.LogOverride
+	if override == nil {
+		return nil
+	}
+	if override.Remaining <= 0 || !now.Before(override.Until) {
+		s.LogOverride = nil
+		s.IsDirty = true
+		return nil
+	}
+	override.Remaining--
+	if override.Remaining == 0 {
+		s.LogOverride = nil
+	}
+	s.IsDirty = true
+	return &logging.LevelOverride{
+		Level:    logging.ParseLogLevelString(override.Level),
+		Prefixes: override.Prefixes,
+		Reason:   "session override set by " + override.SetBy,
+	}
+}
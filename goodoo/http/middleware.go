@@ -1,22 +1,43 @@
 package http
 
 import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
 	"time"
 
 	"github.com/labstack/echo/v4"
+	"goodoo/clock"
+	"goodoo/database"
 	"goodoo/logging"
+	"goodoo/tracing"
 )
 
 // RequestMiddleware creates middleware for handling Goodoo requests with session support
 func RequestMiddleware(config *RequestConfig) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
+			// Routes registered from specs run the middleware again when e
+			// already does
+			if GetGoodooRequest(c) != nil {
+				return next(c)
+			}
+
 			// Create Goodoo request wrapper
 			req := NewRequest(c, config)
 			
 			// Add request to Echo context
 			c.Set("goodoo_request", req)
 			
+			// Open the root span of the request trace; the HTTP request
+			// context carries it too so renderers can attach spans
+			if tracing.Enabled() {
+				req.Context, req.Span = tracing.StartTrace(req.Context, req.HTTPRequest.Method+" "+c.Path())
+				req.Span.SetAttribute("http.target", req.HTTPRequest.URL.Path)
+				c.SetRequest(c.Request().WithContext(tracing.ContextWithSpan(c.Request().Context(), req.Span)))
+			}
+			
 			// Log request start
 			req.Logger.DebugCtx(req.Context, "Request started: %s %s", 
 				req.HTTPRequest.Method, req.HTTPRequest.URL.Path)
@@ -32,6 +53,12 @@ func RequestMiddleware(config *RequestConfig) echo.MiddlewareFunc {
 			// Log request completion
 			req.LogRequest()
 			
+			if req.Span != nil {
+				req.Span.SetAttribute("http.status_code", strconv.Itoa(c.Response().Status))
+				req.Span.SetAttribute("request_id", req.GetRequestID())
+				req.Span.End()
+			}
+			
 			return err
 		}
 	}
@@ -41,10 +68,7 @@ func RequestMiddleware(config *RequestConfig) echo.MiddlewareFunc {
 func AuthenticationMiddleware(required bool) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
-			req := GetGoodooRequest(c)
-			if req == nil {
-				return echo.NewHTTPError(500, "Goodoo request not found")
-			}
+			req := MustGetGoodooRequest(c)
 			
 			if required && !req.IsAuthenticated() {
 				req.Logger.WarningCtx(req.Context, "Unauthenticated access attempt to %s", 
@@ -66,10 +90,7 @@ func AuthenticationMiddleware(required bool) echo.MiddlewareFunc {
 func DatabaseMiddleware(required bool) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
-			req := GetGoodooRequest(c)
-			if req == nil {
-				return echo.NewHTTPError(500, "Goodoo request not found")
-			}
+			req := MustGetGoodooRequest(c)
 			
 			if required && req.GetDBName() == "" {
 				req.Logger.WarningCtx(req.Context, "Database required but not set for %s", 
@@ -79,6 +100,10 @@ func DatabaseMiddleware(required bool) echo.MiddlewareFunc {
 			
 			if req.GetDBName() != "" {
 				req.Logger.DebugCtx(req.Context, "Request using database: %s", req.GetDBName())
+				// Fail fast while the database is known to be unreachable
+				if err := database.CheckAvailable(req.GetDBName()); err != nil {
+					return err
+				}
 			}
 			
 			return next(c)
@@ -86,16 +111,33 @@ func DatabaseMiddleware(required bool) echo.MiddlewareFunc {
 	}
 }
 
-// SessionCleanupMiddleware periodically cleans up expired sessions
-func SessionCleanupMiddleware(store SessionStore, interval time.Duration) echo.MiddlewareFunc {
-	ticker := time.NewTicker(interval)
+// SessionCleanupMiddleware periodically cleans up expired sessions. When
+// set, onCleanup is told of each run: the number of sessions removed, when
+// the store counts them, and the error. The runs follow the clock of the
+// store when it has one.
+func SessionCleanupMiddleware(store SessionStore, interval time.Duration, onCleanup func(removed int, err error)) echo.MiddlewareFunc {
+	clk := clock.Real
+	if clocked, ok := store.(interface{ Clock() clock.Clock }); ok {
+		clk = clocked.Clock()
+	}
+	ticker := clk.NewTicker(interval)
 	
 	go func() {
-		for range ticker.C {
-			if err := store.Cleanup(); err != nil {
+		for range ticker.C() {
+			removed := 0
+			var err error
+			if counter, ok := store.(interface{ CleanupExpired() (int, error) }); ok {
+				removed, err = counter.CleanupExpired()
+			} else {
+				err = store.Cleanup()
+			}
+			if err != nil {
 				logging.Error("Session cleanup failed: %v", err)
 			} else {
-				logging.Debug("Session cleanup completed")
+				logging.Debug("Session cleanup completed: %d session(s) removed", removed)
+			}
+			if onCleanup != nil {
+				onCleanup(removed, err)
 			}
 		}
 	}()
@@ -113,6 +155,17 @@ func GetGoodooRequest(c echo.Context) *Request {
 	return nil
 }
 
+// MustGetGoodooRequest retrieves the Goodoo request of a route handler. It
+// panics when the route runs without RequestMiddleware, which AuditRoutes
+// rules out at startup, so handlers need not check for nil.
+func MustGetGoodooRequest(c echo.Context) *Request {
+	if req := GetGoodooRequest(c); req != nil {
+		return req
+	}
+	panic(fmt.Sprintf("goodoo: no Goodoo request for %s %s: register the route with RegisterRoutes or on an Echo set up with UseRequestMiddleware",
+		c.Request().Method, c.Path()))
+}
+
 // RequestLoggingMiddleware provides detailed request logging
 func RequestLoggingMiddleware() echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
@@ -161,17 +214,55 @@ func RequestLoggingMiddleware() echo.MiddlewareFunc {
 	}
 }
 
-// SecurityMiddleware adds security headers and checks
-func SecurityMiddleware() echo.MiddlewareFunc {
+// SecurityMiddleware adds security headers: CSP with a per-request nonce,
+// HSTS over TLS, and frame protection that routes can relax (see SecurityConfig)
+func SecurityMiddleware(config *RequestConfig) echo.MiddlewareFunc {
+	security := config.Security
+	if security == nil {
+		security = DefaultSecurityConfig()
+	}
+	
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
 			req := GetGoodooRequest(c)
+			header := c.Response().Header()
 			
 			// Add security headers
-			c.Response().Header().Set("X-Content-Type-Options", "nosniff")
-			c.Response().Header().Set("X-Frame-Options", "DENY")
-			c.Response().Header().Set("X-XSS-Protection", "1; mode=block")
-			c.Response().Header().Set("Referrer-Policy", "strict-origin-when-cross-origin")
+			header.Set("X-Content-Type-Options", "nosniff")
+			header.Set("X-XSS-Protection", "1; mode=block")
+			header.Set("Referrer-Policy", "strict-origin-when-cross-origin")
+			
+			route, overridden := security.routeFor(c.Request().URL.Path)
+			if !overridden || len(route.FrameAncestors) == 0 {
+				header.Set("X-Frame-Options", "DENY")
+			}
+			
+			if security.CSP != nil {
+				nonce := newNonce()
+				c.Set(CSPNonceKey, nonce)
+				
+				policy := security.CSP
+				if overridden && len(route.FrameAncestors) > 0 {
+					policy = policy.Clone().Set("frame-ancestors", route.FrameAncestors...)
+				}
+				if security.CSPReportURI != "" {
+					policy = policy.Clone().Set("report-uri", security.CSPReportURI)
+				}
+				
+				name := "Content-Security-Policy"
+				if security.CSPReportOnly {
+					name = "Content-Security-Policy-Report-Only"
+				}
+				header.Set(name, policy.String(nonce))
+			}
+			
+			if security.HSTSMaxAge > 0 && security.isSecure(c) {
+				hsts := fmt.Sprintf("max-age=%d", security.HSTSMaxAge)
+				if security.HSTSIncludeSubDomains {
+					hsts += "; includeSubDomains"
+				}
+				header.Set("Strict-Transport-Security", hsts)
+			}
 			
 			// Log security-related information
 			if req != nil {
@@ -183,6 +274,17 @@ func SecurityMiddleware() echo.MiddlewareFunc {
 	}
 }
 
+// TimeoutMessage explains a database timeout to the client
+func TimeoutMessage(err *database.TimeoutError) string {
+	switch err.Kind {
+	case database.TimeoutLock:
+		return "The records are locked by another operation, try again"
+	case database.TimeoutIdleInTransaction:
+		return "The database transaction was idle for too long"
+	}
+	return "The database query took too long: narrow the search"
+}
+
 // ErrorHandlingMiddleware provides enhanced error handling with logging
 func ErrorHandlingMiddleware() echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
@@ -190,11 +292,27 @@ func ErrorHandlingMiddleware() echo.MiddlewareFunc {
 			err := next(c)
 			
 			if err != nil {
+				// An unreachable database is logged once by its breaker,
+				// not by each request it turns away
+				var unavailable *database.UnavailableError
+				if errors.As(err, &unavailable) {
+					retryAfter := math.Ceil(time.Until(unavailable.RetryAt).Seconds())
+					c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Max(retryAfter, 1))))
+					return echo.NewHTTPError(503, "Database unavailable")
+				}
+				
 				req := GetGoodooRequest(c)
 				if req != nil {
 					req.Logger.ErrorCtx(req.Context, "Request error: %v", err)
 				}
 				
+				// A statement cut by a session timeout is the query's
+				// fault, not the server's
+				var timeout *database.TimeoutError
+				if errors.As(err, &timeout) {
+					return echo.NewHTTPError(503, TimeoutMessage(timeout))
+				}
+				
 				// Handle different error types
 				if he, ok := err.(*echo.HTTPError); ok {
 					return he
@@ -0,0 +1,44 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"goodoo/database"
+)
+
+// TestUnavailableDatabase answers 503 with a Retry-After while the breaker
+// of the database is open
+func TestUnavailableDatabase(t *testing.T) {
+	tests := []struct {
+		name           string
+		retryIn        time.Duration
+		wantRetryAfter string
+	}{
+		{"probe ahead", 2500 * time.Millisecond, "3"},
+		{"probe due", -time.Second, "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := echo.New()
+			e.Use(ErrorHandlingMiddleware())
+			e.GET("/", func(c echo.Context) error {
+				err := &database.UnavailableError{DB: "middleware_test", RetryAt: time.Now().Add(tt.retryIn), Cause: errors.New("connection refused")}
+				return fmt.Errorf("failed to get connection: %w", err)
+			})
+			w := httptest.NewRecorder()
+			e.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			if w.Code != http.StatusServiceUnavailable {
+				t.Errorf("status = %d, want 503", w.Code)
+			}
+			if got := w.Header().Get("Retry-After"); got != tt.wantRetryAfter {
+				t.Errorf("Retry-After = %q, want %q", got, tt.wantRetryAfter)
+			}
+		})
+	}
+}
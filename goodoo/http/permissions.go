@@ -0,0 +1,196 @@
+package http
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Permissions of the dashboard and administration routes. A route declares
+// the one it needs in RouteSpec.Permission; groups are granted permissions,
+// so a support group can read metrics, logs and sessions without managing
+// users or settings. Addons may declare their own.
+const (
+	PermissionMetricsRead      = "metrics.read"
+	PermissionLogsRead         = "logs.read"
+	PermissionSessionsRead     = "sessions.read"
+	PermissionUsersManage      = "users.manage"
+	PermissionUsersImpersonate = "users.impersonate"
+	PermissionSettingsRead     = "settings.read"
+	PermissionSettingsWrite    = "settings.write"
+	PermissionLLMConfigure     = "llm.configure"
+	PermissionDBManage         = "db.manage"
+	PermissionAdminSearch      = "admin.search"
+	PermissionModelsManage     = "models.manage"
+	// PermissionFiltersShare lets users share the list filters they save
+	PermissionFiltersShare = "filters.share"
+	// PermissionLLMTemplatesShare lets users share their prompt templates
+	PermissionLLMTemplatesShare = "llm.templates.share"
+	// PermissionReportsSchedule lets users manage the report schedules
+	PermissionReportsSchedule = "reports.schedule"
+	// PermissionMaintenanceManage lets users put a database in maintenance
+	// and bring it back
+	PermissionMaintenanceManage = "maintenance.manage"
+	// PermissionServiceAccountsManage lets users manage the service
+	// accounts, granting them only the permissions they hold themselves
+	PermissionServiceAccountsManage = "service_accounts.manage"
+	// PermissionDevManage lets users call the developer mode endpoints,
+	// which only exist in developer mode
+	PermissionDevManage = "dev.manage"
+	// PermissionServiceKeysManage lets users mint, rotate and revoke the
+	// keys signing service-to-service requests
+	PermissionServiceKeysManage = "service_keys.manage"
+	// PermissionRecordRulesManage lets users manage the record rules
+	// restricting the records of the field models
+	PermissionRecordRulesManage = "record_rules.manage"
+	// PermissionStatusRead lets users read the status page with the raw
+	// output of the probes
+	PermissionStatusRead = "status.read"
+	// PermissionLogsOverride lets users lower the log level of the
+	// requests of a user or of their own session
+	PermissionLogsOverride = "logs.override"
+	// PermissionLanguagesManage lets users activate and deactivate the
+	// languages
+	PermissionLanguagesManage = "languages.manage"
+	// PermissionAttachmentsQuarantine lets users list the quarantined
+	// attachments, release, rescan and purge them
+	PermissionAttachmentsQuarantine = "attachments.quarantine"
+	// PermissionCapabilitiesRead lets users list the capabilities of the
+	// server and check the database schema against the models
+	PermissionCapabilitiesRead = "capabilities.read"
+	// PermissionQuotasManage lets users read the record quotas, set their
+	// limits and reconcile their counters
+	PermissionQuotasManage = "quotas.manage"
+	// PermissionDuplicateRulesManage lets users manage the rules detecting
+	// duplicate records
+	PermissionDuplicateRulesManage = "duplicate_rules.manage"
+	// PermissionTasksRead lets users read the runs and failures of the
+	// background tasks
+	PermissionTasksRead = "tasks.read"
+	// PermissionTagsManage lets users rename, merge and delete the tags
+	PermissionTagsManage = "tags.manage"
+	// PermissionConnectionsRead lets users list the long-lived connections
+	// and their counts
+	PermissionConnectionsRead = "connections.read"
+	// PermissionMailGatewayManage lets users manage the mail aliases and
+	// review the inbound messages
+	PermissionMailGatewayManage = "mail_gateway.manage"
+	// PermissionCronManage lets users manage the scheduled actions and run
+	// them
+	PermissionCronManage = "cron.manage"
+	// PermissionPartnersMerge lets users find the duplicate partners and
+	// merge them
+	PermissionPartnersMerge = "partners.merge"
+	// PermissionKnowledgeManage lets users add, reindex and delete the
+	// documents of the knowledge base
+	PermissionKnowledgeManage = "knowledge.manage"
+	// PermissionProductCategoriesManage lets users create and edit the
+	// product categories
+	PermissionProductCategoriesManage = "product_categories.manage"
+	// PermissionWebhooksManage lets users manage the outgoing webhooks and
+	// redeliver their deliveries
+	PermissionWebhooksManage = "webhooks.manage"
+	// PermissionInboundHooksManage lets users manage the inbound hooks
+	// other services call
+	PermissionInboundHooksManage = "inbound_hooks.manage"
+	// PermissionMailTest lets users send test emails through the
+	// configured transport
+	PermissionMailTest = "mail.test"
+	// PermissionTracesRead lets users read the slow request traces, which
+	// hold SQL statements
+	PermissionTracesRead = "traces.read"
+)
+
+// PermissionInfo is a permission declared by the registered routes
+type PermissionInfo struct {
+	Name string `json:"name"`
+	// Routes are the routes requiring the permission, as "METHOD path"
+	Routes []string `json:"routes"`
+}
+
+// Permissions returns the permissions required by the routes registered
+// from specs, sorted by name
+func Permissions() []PermissionInfo {
+	routeMutex.RLock()
+	defer routeMutex.RUnlock()
+
+	routes := make(map[string][]string)
+	for _, info := range routeTable {
+		if info.Permission != "" {
+			routes[info.Permission] = append(routes[info.Permission], info.Method+" "+info.Path)
+		}
+	}
+	permissions := make([]PermissionInfo, 0, len(routes))
+	for name, list := range routes {
+		sort.Strings(list)
+		permissions = append(permissions, PermissionInfo{Name: name, Routes: list})
+	}
+	sort.Slice(permissions, func(i, j int) bool { return permissions[i].Name < permissions[j].Name })
+	return permissions
+}
+
+// KnownPermission reports whether a registered route requires permission
+func KnownPermission(permission string) bool {
+	routeMutex.RLock()
+	defer routeMutex.RUnlock()
+	for _, info := range routeTable {
+		if info.Permission == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// EffectivePermissions returns the permissions of the request user,
+// resolved with RequestConfig.PermissionsResolver: every known permission
+// for an administrator
+func (req *Request) EffectivePermissions() (permissions []string, admin bool) {
+	if req.config == nil || req.config.PermissionsResolver == nil {
+		return nil, false
+	}
+	permissions, admin = req.config.PermissionsResolver(req)
+	if admin {
+		permissions = nil
+		for _, info := range Permissions() {
+			permissions = append(permissions, info.Name)
+		}
+	}
+	sort.Strings(permissions)
+	return permissions, admin
+}
+
+// HasPermission reports whether the request user is granted permission;
+// administrators are granted every permission
+func (req *Request) HasPermission(permission string) bool {
+	if req.config == nil || req.config.PermissionsResolver == nil {
+		return false
+	}
+	permissions, admin := req.config.PermissionsResolver(req)
+	if admin {
+		return true
+	}
+	for _, granted := range permissions {
+		if granted == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// PermissionMiddleware restricts a route to the users granted permission,
+// resolved with RequestConfig.PermissionsResolver on every request, so
+// changed assignments apply without logging in again
+func PermissionMiddleware(permission string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := MustGetGoodooRequest(c)
+			if req.HasPermission(permission) {
+				return next(c)
+			}
+			req.Logger.WarningCtx(req.Context, "User %s denied access to %s (permission %s)",
+				req.GetLogin(), req.HTTPRequest.URL.Path, permission)
+			return echo.NewHTTPError(http.StatusForbidden, "Access denied")
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package http
+
+import (
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Preference headers (RFC 7240)
+const (
+	HeaderPrefer = "Prefer"
+	// HeaderPreferenceApplied tells the client which preference was honored
+	HeaderPreferenceApplied = "Preference-Applied"
+)
+
+// Return preferences of write requests
+const (
+	// ReturnMinimal answers writes with a short status body
+	ReturnMinimal = "minimal"
+	// ReturnRepresentation answers writes with the record as written, as a
+	// read of it would return it
+	ReturnRepresentation = "representation"
+)
+
+// ReturnPreference returns the return preference of the Prefer header of
+// the request, ReturnRepresentation when it names none, and marks the
+// response with the one applied
+func ReturnPreference(c echo.Context) string {
+	preference := ReturnRepresentation
+	for _, header := range c.Request().Header.Values(HeaderPrefer) {
+		for _, token := range strings.Split(header, ",") {
+			name, value, found := strings.Cut(strings.TrimSpace(token), "=")
+			if !found || !strings.EqualFold(strings.TrimSpace(name), "return") {
+				continue
+			}
+			value = strings.ToLower(strings.Trim(strings.TrimSpace(value), `"`))
+			if value == ReturnMinimal || value == ReturnRepresentation {
+				preference = value
+			}
+		}
+	}
+	c.Response().Header().Set(HeaderPreferenceApplied, "return="+preference)
+	return preference
+}
+
+// PreferMinimal reports whether the request asks for a minimal response
+// to a write, see ReturnPreference
+func PreferMinimal(c echo.Context) bool {
+	return ReturnPreference(c) == ReturnMinimal
+}
@@ -0,0 +1,40 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"goodoo/models"
+)
+
+// PublicAccessMiddleware runs the anonymous visitors of a public route as
+// the public user of the request database (see models.PublicUserXMLID),
+// so audit entries, create_uid stamping, quotas and record rules have a
+// principal. Logged-in visitors keep their own user. The request stays
+// unauthenticated: the public user never passes AuthenticationMiddleware,
+// and rate limits key on the client address.
+func PublicAccessMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := MustGetGoodooRequest(c)
+			if req.IsAuthenticated() {
+				return next(c)
+			}
+			db := req.GetDB()
+			if db == nil {
+				return echo.NewHTTPError(http.StatusServiceUnavailable, "Database not available")
+			}
+			id, err := models.PublicUserID(req.GetDBName(), db)
+			if err != nil {
+				req.Logger.ErrorCtx(req.Context, "Failed to find the public user of %s: %v", req.GetDBName(), err)
+				return echo.NewHTTPError(http.StatusServiceUnavailable, "Public access unavailable")
+			}
+			if id == 0 {
+				req.Logger.ErrorCtx(req.Context, "Database %s has no public user", req.GetDBName())
+				return echo.NewHTTPError(http.StatusServiceUnavailable, "Public access unavailable")
+			}
+			req.PublicUserID = int(id)
+			return next(c)
+		}
+	}
+}
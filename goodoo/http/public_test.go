@@ -0,0 +1,233 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"goodoo/logging"
+	"goodoo/models"
+	"goodoo/models/testutil"
+)
+
+// publicTestServer is an Echo instance set up as the server does, with a
+// filesystem session store
+type publicTestServer struct {
+	t      *testing.T
+	e      *echo.Echo
+	config *RequestConfig
+	store  *FilesystemSessionStore
+}
+
+func newPublicTestServer(t *testing.T, dbName string) *publicTestServer {
+	store, err := NewFilesystemSessionStore(t.TempDir(), false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &RequestConfig{
+		SessionStore:  store,
+		DefaultDBName: dbName,
+		Logger:        logging.GetLogger("goodoo.http.test"),
+		// Whatever the public user were granted, it must stay out
+		GroupsResolver:      func(req *Request) ([]string, bool) { return nil, true },
+		PermissionsResolver: func(req *Request) ([]string, bool) { return nil, true },
+	}
+	e := echo.New()
+	e.IPExtractor = echo.ExtractIPDirect()
+	UseRequestMiddleware(e, config)
+	return &publicTestServer{t: t, e: e, config: config, store: store}
+}
+
+// carryPublicUser runs every request as the public user publicID, as
+// PublicAccessMiddleware does on public routes
+func (s *publicTestServer) carryPublicUser(publicID int) {
+	s.e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			MustGetGoodooRequest(c).PublicUserID = publicID
+			return next(c)
+		}
+	})
+}
+
+// login returns the cookie of a session authenticated as userID
+func (s *publicTestServer) login(dbName string, userID int) *http.Cookie {
+	session := s.store.New()
+	session.Authenticate(dbName, "user", userID)
+	if err := s.store.Save(session); err != nil {
+		s.t.Fatal(err)
+	}
+	return &http.Cookie{Name: s.config.SessionCookie.name(s.config.SessionCookieName), Value: session.SID}
+}
+
+// get requests path from the address remoteAddr with the cookie, if any,
+// and returns the status
+func (s *publicTestServer) get(path, remoteAddr string, cookie *http.Cookie) int {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	r.RemoteAddr = remoteAddr
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	s.e.ServeHTTP(w, r)
+	return w.Code
+}
+
+// TestPublicUserIsNotAuthenticated checks that a request carrying the
+// public user reaches none of the routes needing a session, whatever
+// else they declare
+func TestPublicUserIsNotAuthenticated(t *testing.T) {
+	s := newPublicTestServer(t, "public_test")
+	s.carryPublicUser(42)
+
+	reached := false
+	handler := func(c echo.Context) error {
+		reached = true
+		return c.NoContent(http.StatusOK)
+	}
+	specs := []RouteSpec{
+		{Method: "GET", Path: "/public-test/auth", Handler: handler, Auth: true},
+		{Method: "GET", Path: "/public-test/auth-db", Handler: handler, Auth: true, DB: true},
+		{Method: "GET", Path: "/public-test/groups", Handler: handler, Groups: []string{GroupSystem}},
+		{Method: "GET", Path: "/public-test/permission", Handler: handler, Permission: PermissionUsersManage},
+		{Method: "GET", Path: "/public-test/service", Handler: handler, Auth: true, ServiceAuth: true},
+		{Method: "GET", Path: "/public-test/impersonation", Handler: handler, Auth: true, DenyImpersonation: true},
+		{Method: "GET", Path: "/public-test/public-auth", Handler: handler, Auth: true, Public: true},
+		{Method: "GET", Path: "/public-test/rate-limited", Handler: handler, Auth: true, RateLimit: "public"},
+	}
+	MustRegisterRoutes(s.e, specs)
+
+	for _, spec := range specs {
+		t.Run(spec.Path, func(t *testing.T) {
+			reached = false
+			if status := s.get(spec.Path, "192.0.2.1:1000", nil); status != http.StatusUnauthorized {
+				t.Errorf("GET %s as the public user answered %d, want 401", spec.Path, status)
+			}
+			if reached {
+				t.Errorf("GET %s as the public user reached its handler", spec.Path)
+			}
+		})
+	}
+}
+
+func TestPublicRequest(t *testing.T) {
+	s := newPublicTestServer(t, "public_test")
+	s.carryPublicUser(42)
+
+	var seen struct {
+		public, authenticated bool
+		uid                   int
+		login                 string
+	}
+	MustRegisterRoutes(s.e, []RouteSpec{{Method: "GET", Path: "/public-test/page", Handler: func(c echo.Context) error {
+		req := MustGetGoodooRequest(c)
+		seen.public, seen.authenticated = req.IsPublic(), req.IsAuthenticated()
+		seen.uid, seen.login = req.GetUserID(), req.GetLogin()
+		return c.NoContent(http.StatusOK)
+	}}})
+
+	if status := s.get("/public-test/page", "192.0.2.1:1000", nil); status != http.StatusOK {
+		t.Fatalf("GET answered %d", status)
+	}
+	if !seen.public || seen.authenticated || seen.uid != 42 || seen.login != models.PublicUserLogin {
+		t.Errorf("anonymous request: public %v, authenticated %v, user %d %s; want the public user 42, unauthenticated",
+			seen.public, seen.authenticated, seen.uid, seen.login)
+	}
+
+	// A logged-in visitor keeps their user
+	if status := s.get("/public-test/page", "192.0.2.1:1000", s.login("public_test", 7)); status != http.StatusOK {
+		t.Fatalf("GET answered %d", status)
+	}
+	if seen.public || !seen.authenticated || seen.uid != 7 || seen.login != "user" {
+		t.Errorf("logged-in request: public %v, authenticated %v, user %d %s; want user 7",
+			seen.public, seen.authenticated, seen.uid, seen.login)
+	}
+}
+
+func TestPublicAccessWithoutDatabase(t *testing.T) {
+	s := newPublicTestServer(t, "public_test_missing")
+	MustRegisterRoutes(s.e, []RouteSpec{{Method: "GET", Path: "/public-test/missing", Public: true, Handler: func(c echo.Context) error {
+		t.Error("the handler ran without a public user")
+		return nil
+	}}})
+	if status := s.get("/public-test/missing", "192.0.2.1:1000", nil); status != http.StatusServiceUnavailable {
+		t.Errorf("GET answered %d, want 503", status)
+	}
+}
+
+// TestPublicRateLimit checks that the visitors running as the public
+// user are limited by address, not by the user id they share, while
+// logged-in users are limited by user whatever their address
+func TestPublicRateLimit(t *testing.T) {
+	RegisterRateLimitClass("public_test", 1, 2)
+	s := newPublicTestServer(t, "public_test")
+	s.carryPublicUser(42)
+	ok := func(c echo.Context) error { return c.NoContent(http.StatusOK) }
+	MustRegisterRoutes(s.e, []RouteSpec{{Method: "GET", Path: "/public-test/limited", Handler: ok, RateLimit: "public_test"}})
+
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		if status := s.get("/public-test/limited", "198.51.100.1:1000", nil); status != want {
+			t.Errorf("request %d from the first address answered %d, want %d", i+1, status, want)
+		}
+	}
+	if status := s.get("/public-test/limited", "198.51.100.2:1000", nil); status != http.StatusOK {
+		t.Errorf("request from another address answered %d, want 200: the public user is not the key", status)
+	}
+
+	cookie := s.login("public_test", 7)
+	for i, address := range []string{"203.0.113.1:1000", "203.0.113.2:1000"} {
+		if status := s.get("/public-test/limited", address, cookie); status != http.StatusOK {
+			t.Errorf("request %d of the user answered %d", i+1, status)
+		}
+	}
+	if status := s.get("/public-test/limited", "203.0.113.3:1000", cookie); status != http.StatusTooManyRequests {
+		t.Errorf("third request of the user from a new address answered %d, want 429", status)
+	}
+}
+
+// TestPublicAccessMiddleware runs a public route on the test database,
+// where PublicAccessMiddleware resolves the public user itself
+func TestPublicAccessMiddleware(t *testing.T) {
+	env := testutil.NewTestEnvironment(t)
+	dbName := testutil.Unique("public_test")
+	user, err := models.EnsurePublicUser(dbName, env.Tx)
+	if err != nil {
+		t.Fatalf("EnsurePublicUser: %v", err)
+	}
+
+	RegisterRateLimitClass("public_test_db", 1, 1)
+	s := newPublicTestServer(t, dbName)
+	s.e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			MustGetGoodooRequest(c).Tx = env.Tx
+			return next(c)
+		}
+	})
+	uid := 0
+	MustRegisterRoutes(s.e, []RouteSpec{
+		{Method: "GET", Path: "/public-test/share", Public: true, RateLimit: "public_test_db", Handler: func(c echo.Context) error {
+			uid = MustGetGoodooRequest(c).GetUserID()
+			return c.NoContent(http.StatusOK)
+		}},
+		{Method: "GET", Path: "/public-test/private", Public: true, Auth: true, Handler: func(c echo.Context) error {
+			t.Error("the public user reached an authenticated route")
+			return nil
+		}},
+	})
+
+	if status := s.get("/public-test/share", "198.51.100.1:1000", nil); status != http.StatusOK {
+		t.Fatalf("GET answered %d", status)
+	}
+	if uid != int(user.ID) {
+		t.Errorf("the handler ran as user %d, want the public user %d", uid, user.ID)
+	}
+	if status := s.get("/public-test/share", "198.51.100.1:1000", nil); status != http.StatusTooManyRequests {
+		t.Errorf("second request from the address answered %d, want 429", status)
+	}
+	if status := s.get("/public-test/share", "198.51.100.2:1000", nil); status != http.StatusOK {
+		t.Errorf("request from another address answered %d, want 200", status)
+	}
+	if status := s.get("/public-test/private", "198.51.100.3:1000", nil); status != http.StatusUnauthorized {
+		t.Errorf("authenticated public route answered %d, want 401", status)
+	}
+}
@@ -1,18 +1,24 @@
 package http
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"strconv"
+	"os"
 	"strings"
 	"time"
 
 	"github.com/labstack/echo/v4"
+	"goodoo/clock"
 	"goodoo/database"
+	"goodoo/fields"
 	"goodoo/logging"
+	"goodoo/models"
+	"goodoo/tracing"
 	"gorm.io/gorm"
 )
 
@@ -30,9 +36,16 @@ type Request struct {
 	// Database name
 	DB string
 	
-	// Request parameters
+	// Query parameters; the body is only read on demand, see ParamsFromBody
 	Params map[string]interface{}
 	
+	// body records a JSON body as it is read, so that it can be decoded
+	// again after c.Bind consumed it (nil for other bodies)
+	body *recordedBody
+	
+	// bodyParams caches the parameters decoded by ParamsFromBody
+	bodyParams map[string]interface{}
+	
 	// Request context
 	Context context.Context
 	
@@ -42,15 +55,39 @@ type Request struct {
 	// Start time for performance tracking
 	StartTime time.Time
 	
+	// Span is the root span of the request trace, nil when tracing is disabled
+	Span *tracing.Span
+	
 	// User agent info
 	UserAgent string
 	
 	// Remote address
 	RemoteAddr string
 	
-	// Registry/Environment (placeholder for future ORM integration)
+	// Registry is the model registry of the request database (see RequestConfig.RegistryResolver)
 	Registry interface{}
-	Env      interface{}
+	
+	// env is the environment built by GetEnv
+	env *models.Environment
+	
+	// Tx, when set, is returned by GetDB instead of a new database session,
+	// so that sub-requests of an atomic batch share one transaction
+	Tx *gorm.DB
+	
+	// ServiceKeyID is the service key a signed request was authenticated
+	// with (see ServiceAuthMiddleware), empty for session requests
+	ServiceKeyID string
+	
+	// ServiceAccount is the account of the service user a signed request
+	// runs as, nil for other users
+	ServiceAccount *models.ServiceAccount
+	
+	// PublicUserID is the public user an anonymous request of a public
+	// route runs as (see PublicAccessMiddleware), 0 otherwise
+	PublicUserID int
+	
+	// config is the configuration the request was created with
+	config *RequestConfig
 }
 
 // RequestConfig holds configuration for request handling
@@ -58,7 +95,53 @@ type RequestConfig struct {
 	SessionStore     SessionStore
 	DefaultDBName    string
 	SessionCookieName string
+	// SessionCookie sets the path, domain, SameSite, lifetime and security
+	// of the session cookie
+	SessionCookie CookieConfig
 	Logger           *logging.Logger
+	
+	// RegistryResolver returns the model registry of a database, stored in Request.Registry
+	RegistryResolver func(dbName string) interface{}
+	
+	// LangResolver returns the languages installed in a database, used to
+	// pick the language of new sessions from Accept-Language
+	LangResolver func(dbName string) []string
+	
+	// Security configures SecurityMiddleware; nil uses DefaultSecurityConfig
+	Security *SecurityConfig
+	
+	// CORS configures CORSMiddleware; nil uses DefaultCORSConfig
+	CORS *CORSConfig
+	
+	// Idempotency configures IdempotencyMiddleware; nil uses DefaultIdempotencyConfig
+	Idempotency *IdempotencyConfig
+	
+	// APIVersion configures the API version negotiation; nil uses DefaultAPIVersionConfig
+	APIVersion *APIVersionConfig
+	
+	// ServiceAuth configures ServiceAuthMiddleware; nil uses DefaultServiceAuthConfig
+	ServiceAuth *ServiceAuthConfig
+	
+	// ContextDefaultKeys are the sticky context keys users may set (e.g.
+	// team_id), read by the fields declaring them as ContextDefault
+	ContextDefaultKeys []string
+	
+	// SessionTimeoutResolver returns how long an authenticated session of a
+	// database may stay idle; zero disables the timeout
+	SessionTimeoutResolver func(dbName string) time.Duration
+	
+	// GroupsResolver returns the groups (external ids) of the request user
+	// and whether they are an administrator, for RouteSpec.Groups
+	GroupsResolver func(req *Request) (groups []string, admin bool)
+	
+	// PermissionsResolver returns the permissions granted to the request
+	// user by their groups and whether they are an administrator, who holds
+	// every permission, for RouteSpec.Permission
+	PermissionsResolver func(req *Request) (permissions []string, admin bool)
+	
+	// Clock dates idempotency records and signup tokens; nil uses the
+	// system clock
+	Clock clock.Clock
 }
 
 // NewRequest creates a new Request wrapper from Echo context
@@ -72,46 +155,95 @@ func NewRequest(c echo.Context, config *RequestConfig) *Request {
 		StartTime:   time.Now(),
 		UserAgent:   c.Request().UserAgent(),
 		RemoteAddr:  c.RealIP(),
+		config:      config,
 	}
 	
 	// Initialize session
 	req.initSession(config)
 	
-	// Parse request parameters
+	// Parse query parameters, the body is read on demand
 	req.parseParams()
 	
+	// Resolve the per-database registry
+	if config.RegistryResolver != nil && req.DB != "" {
+		req.Registry = config.RegistryResolver(req.DB)
+	}
+	
 	// Add request context
 	req.Context = req.addRequestContext(req.Context)
 	
+	// An administrator may have lowered the log level of this session
+	if override := req.Session.consumeLogOverride(req.Now()); override != nil {
+		req.Context = logging.WithLevelOverride(req.Context, override)
+	}
+	
 	return req
 }
 
+// Derive creates the request of an internal sub-request (see the batch
+// endpoint) served by c. It shares the session, database, registry and
+// transaction of r, and parses its own parameters; ctx carries the batch
+// deadline.
+func (r *Request) Derive(ctx context.Context, c echo.Context) *Request {
+	sub := &Request{
+		Echo:        c,
+		HTTPRequest: c.Request(),
+		Session:     r.Session,
+		DB:          r.DB,
+		Params:      make(map[string]interface{}),
+		Context:     ctx,
+		Logger:      r.Logger,
+		StartTime:   time.Now(),
+		Span:        r.Span,
+		UserAgent:   r.UserAgent,
+		RemoteAddr:  r.RemoteAddr,
+		Registry:    r.Registry,
+		Tx:          r.Tx,
+		config:      r.config,
+	}
+	sub.parseParams()
+	return sub
+}
+
 // initSession initializes the session for this request
 func (r *Request) initSession(config *RequestConfig) {
-	cookieName := config.SessionCookieName
-	if cookieName == "" {
-		cookieName = "goodoo_session"
-	}
-	
 	// Get session ID from cookie
-	cookie, err := r.HTTPRequest.Cookie(cookieName)
+	cookie, err := r.HTTPRequest.Cookie(config.SessionCookie.name(config.SessionCookieName))
 	var sid string
 	if err == nil && cookie != nil {
 		sid = cookie.Value
 	}
 	
 	// Get or create session
+	isNew := false
 	if sid != "" && config.SessionStore.IsValidKey(sid) {
 		r.Session = config.SessionStore.Get(sid)
 	} else {
 		r.Session = config.SessionStore.New()
+		isNew = true
 		// Set session cookie
-		r.setSessionCookie(cookieName, r.Session.SID)
+		r.setSessionCookie()
 	}
 	
 	// Determine database name
 	r.DB = r.determineDatabase(config.DefaultDBName)
 	
+	// New sessions follow the browser's language and timezone
+	if isNew {
+		r.negotiateLocale(config)
+	}
+	
+	// Idle authenticated sessions are logged out; an impersonation ends
+	// with them, the impersonator is not signed back in
+	if !isNew && config.SessionTimeoutResolver != nil && r.Session.IsAuthenticated() && r.DB != "" {
+		if timeout := config.SessionTimeoutResolver(r.DB); timeout > 0 && r.Session.idle() > timeout {
+			if r.Session.IsImpersonated() {
+				r.Logger.Info("Impersonation of %s by %s ended by the session timeout", r.Session.Login, r.Session.ImpersonatorLogin)
+			}
+			r.Session.Logout(true)
+		}
+	}
+	
 	// Update session context
 	r.Session.UpdateContext(map[string]interface{}{
 		"request_id":  r.generateRequestID(),
@@ -124,82 +256,133 @@ func (r *Request) initSession(config *RequestConfig) {
 	r.Session.Touch()
 }
 
-// parseParams extracts and parses request parameters
+// parseParams extracts the query parameters and prepares the body to be
+// read on demand
 func (r *Request) parseParams() {
-	// Parse query parameters
 	for key, values := range r.HTTPRequest.URL.Query() {
-		if len(values) == 1 {
-			r.Params[key] = values[0]
-		} else {
-			r.Params[key] = values
-		}
+		r.Params[key] = paramValue(values)
 	}
 	
-	// Parse form data for POST requests
-	if r.HTTPRequest.Method == "POST" {
-		contentType := r.HTTPRequest.Header.Get("Content-Type")
-		
-		if strings.Contains(contentType, "application/json") {
-			r.parseJSONParams()
-		} else if strings.Contains(contentType, "application/x-www-form-urlencoded") {
-			r.parseFormParams()
-		} else if strings.Contains(contentType, "multipart/form-data") {
-			r.parseMultipartParams()
-		}
+	if r.hasJSONBody() && r.HTTPRequest.Body != nil {
+		r.body = &recordedBody{ReadCloser: r.HTTPRequest.Body}
+		r.HTTPRequest.Body = r.body
 	}
 }
 
-// parseJSONParams parses JSON request body
-func (r *Request) parseJSONParams() {
-	body, err := io.ReadAll(r.HTTPRequest.Body)
-	if err != nil {
-		r.Logger.ErrorCtx(r.Context, "Failed to read JSON body: %v", err)
-		return
+// paramValue returns a single value as a string and several as a slice
+func paramValue(values []string) interface{} {
+	if len(values) == 1 {
+		return values[0]
 	}
-	
-	var jsonData map[string]interface{}
-	if err := json.Unmarshal(body, &jsonData); err != nil {
-		r.Logger.ErrorCtx(r.Context, "Failed to parse JSON body: %v", err)
-		return
+	return values
+}
+
+// hasJSONBody reports whether the request carries a JSON body
+func (r *Request) hasJSONBody() bool {
+	switch r.HTTPRequest.Method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch:
+		return strings.Contains(r.HTTPRequest.Header.Get("Content-Type"), "application/json")
 	}
-	
-	for key, value := range jsonData {
-		r.Params[key] = value
+	return false
+}
+
+// recordedBody keeps the bytes read from a request body
+type recordedBody struct {
+	io.ReadCloser
+	data []byte
+}
+
+// Read reads from the body and records what was read
+func (b *recordedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.data = append(b.data, p[:n]...)
+	return n, err
+}
+
+// jsonBody reads the rest of a JSON body and returns all of it. The
+// request body is reset to the full content, so c.Bind keeps working
+// whether it runs before or after.
+func (r *Request) jsonBody() ([]byte, error) {
+	if r.body == nil {
+		return nil, nil
+	}
+	if _, err := io.Copy(io.Discard, r.body); err != nil {
+		return nil, err
 	}
+	r.HTTPRequest.Body = io.NopCloser(bytes.NewReader(r.body.data))
+	return r.body.data, nil
 }
 
-// parseFormParams parses form-encoded parameters
-func (r *Request) parseFormParams() {
-	if err := r.HTTPRequest.ParseForm(); err != nil {
-		r.Logger.ErrorCtx(r.Context, "Failed to parse form: %v", err)
-		return
+// rawBody reads the whole body and returns it; the request body is reset
+// to the full content for the handler
+func (r *Request) rawBody() ([]byte, error) {
+	if r.body != nil {
+		return r.jsonBody()
 	}
-	
-	for key, values := range r.HTTPRequest.PostForm {
-		if len(values) == 1 {
-			r.Params[key] = values[0]
-		} else {
-			r.Params[key] = values
-		}
+	if r.HTTPRequest.Body == nil || r.HTTPRequest.Body == http.NoBody {
+		return nil, nil
 	}
+	data, err := io.ReadAll(r.HTTPRequest.Body)
+	r.HTTPRequest.Body.Close()
+	r.HTTPRequest.Body = io.NopCloser(bytes.NewReader(data))
+	return data, err
 }
 
-// parseMultipartParams parses multipart form data
-func (r *Request) parseMultipartParams() {
-	if err := r.HTTPRequest.ParseMultipartForm(32 << 20); err != nil { // 32 MB max
-		r.Logger.ErrorCtx(r.Context, "Failed to parse multipart form: %v", err)
-		return
+// BindJSON decodes the JSON body into v, the numbers of interface{} values
+// as json.Number (see fields.DecodeJSON). It can be called several times
+// and along with c.Bind.
+func (r *Request) BindJSON(v interface{}) error {
+	if r.body == nil {
+		return fmt.Errorf("request has no JSON body")
 	}
+	data, err := r.jsonBody()
+	if err != nil {
+		return fmt.Errorf("failed to read JSON body: %w", err)
+	}
+	if err := fields.DecodeJSON(data, v); err != nil {
+		return fmt.Errorf("failed to parse JSON body: %w", err)
+	}
+	return nil
+}
+
+// ParamsFromBody returns the parameters of the body: the members of a JSON
+// object, or the fields of a POST form. The body is read on the first call
+// and the result cached; it is never nil.
+func (r *Request) ParamsFromBody() map[string]interface{} {
+	if r.bodyParams != nil {
+		return r.bodyParams
+	}
+	r.bodyParams = make(map[string]interface{})
 	
-	if r.HTTPRequest.MultipartForm != nil {
-		for key, values := range r.HTTPRequest.MultipartForm.Value {
-			if len(values) == 1 {
-				r.Params[key] = values[0]
-			} else {
-				r.Params[key] = values
+	contentType := r.HTTPRequest.Header.Get("Content-Type")
+	switch {
+	case r.body != nil:
+		if err := r.BindJSON(&r.bodyParams); err != nil {
+			r.Logger.ErrorCtx(r.Context, "%v", err)
+		}
+		if r.bodyParams == nil {
+			// A JSON null body
+			r.bodyParams = make(map[string]interface{})
+		}
+	case r.HTTPRequest.Method != http.MethodPost:
+	case strings.Contains(contentType, "application/x-www-form-urlencoded"):
+		if err := r.HTTPRequest.ParseForm(); err != nil {
+			r.Logger.ErrorCtx(r.Context, "Failed to parse form: %v", err)
+		}
+		for key, values := range r.HTTPRequest.PostForm {
+			r.bodyParams[key] = paramValue(values)
+		}
+	case strings.Contains(contentType, "multipart/form-data"):
+		if err := r.HTTPRequest.ParseMultipartForm(32 << 20); err != nil { // 32 MB in memory
+			r.Logger.ErrorCtx(r.Context, "Failed to parse multipart form: %v", err)
+		}
+		if r.HTTPRequest.MultipartForm != nil {
+			for key, values := range r.HTTPRequest.MultipartForm.Value {
+				r.bodyParams[key] = paramValue(values)
 			}
 		}
 	}
+	return r.bodyParams
 }
 
 // addRequestContext adds request-specific information to context
@@ -208,6 +391,15 @@ func (r *Request) addRequestContext(ctx context.Context) context.Context {
 	ctx = context.WithValue(ctx, "session_id", r.Session.SID)
 	ctx = context.WithValue(ctx, "dbname", r.DB)
 	ctx = context.WithValue(ctx, "user_id", r.Session.UserID)
+	if lang, ok := r.Session.GetContext()["lang"].(string); ok && lang != "" {
+		ctx = context.WithValue(ctx, "lang", lang)
+	}
+	if r.Session.ImpersonatorID != 0 {
+		ctx = context.WithValue(ctx, "impersonator_id", r.Session.ImpersonatorID)
+	}
+	if r.ServiceKeyID != "" {
+		ctx = context.WithValue(ctx, "service_key_id", r.ServiceKeyID)
+	}
 	ctx = context.WithValue(ctx, "remote_addr", r.RemoteAddr)
 	ctx = context.WithValue(ctx, "user_agent", r.UserAgent)
 	ctx = context.WithValue(ctx, "start_time", r.StartTime)
@@ -231,19 +423,44 @@ func (r *Request) determineDatabase(defaultDB string) string {
 	return defaultDB
 }
 
-// setSessionCookie sets the session cookie
-func (r *Request) setSessionCookie(name, value string) {
-	cookie := &http.Cookie{
-		Name:     name,
-		Value:    value,
-		Path:     "/",
-		HttpOnly: true,
-		Secure:   r.HTTPRequest.TLS != nil,
-		SameSite: http.SameSiteLaxMode,
-		MaxAge:   int((24 * time.Hour).Seconds()), // 24 hours
+// setSessionCookie sends the session cookie, with the attributes of
+// RequestConfig.SessionCookie
+func (r *Request) setSessionCookie() {
+	r.Echo.SetCookie(r.sessionCookie(false))
+}
+
+// clearSessionCookie sends an expired session cookie, for the browser to
+// forget the session ID
+func (r *Request) clearSessionCookie() {
+	r.Echo.SetCookie(r.sessionCookie(true))
+}
+
+// sessionCookie returns the session cookie, or with expire the cookie
+// deleting it
+func (r *Request) sessionCookie(expire bool) *http.Cookie {
+	tls := r.HTTPRequest.TLS != nil
+	if r.config.Security != nil {
+		tls = r.config.Security.isSecure(r.Echo)
 	}
-	
-	r.Echo.SetCookie(cookie)
+	name := r.config.SessionCookie.name(r.config.SessionCookieName)
+	return r.config.SessionCookie.cookie(name, r.Session.SID, tls, expire)
+}
+
+// RotateSession moves the session to a new ID and sends it in the cookie,
+// so that an ID known before login is useless afterwards. A session
+// created by this request already has an ID nobody else knows.
+func (r *Request) RotateSession() {
+	if r.Session.IsNew {
+		return
+	}
+	store := r.config.SessionStore
+	oldSID := r.Session.SID
+	r.Session.SID = store.New().SID
+	r.Session.IsDirty = true
+	if err := store.Delete(oldSID); err != nil && !os.IsNotExist(err) {
+		r.Logger.WarningCtx(r.Context, "Failed to delete rotated session: %v", err)
+	}
+	r.setSessionCookie()
 }
 
 // generateRequestID generates a unique request ID
@@ -251,15 +468,19 @@ func (r *Request) generateRequestID() string {
 	return fmt.Sprintf("%d-%s", time.Now().UnixNano(), r.Session.SID[:8])
 }
 
-// GetParam retrieves a parameter value with type conversion
+// GetParam retrieves a parameter: a body parameter (JSON member or form
+// field, see ParamsFromBody) takes precedence over a query parameter
 func (r *Request) GetParam(key string) (interface{}, bool) {
+	if value, exists := r.ParamsFromBody()[key]; exists {
+		return value, true
+	}
 	value, exists := r.Params[key]
 	return value, exists
 }
 
 // GetStringParam retrieves a string parameter
 func (r *Request) GetStringParam(key string, defaultValue ...string) string {
-	if value, exists := r.Params[key]; exists {
+	if value, exists := r.GetParam(key); exists {
 		if str, ok := value.(string); ok {
 			return str
 		}
@@ -274,16 +495,9 @@ func (r *Request) GetStringParam(key string, defaultValue ...string) string {
 
 // GetIntParam retrieves an integer parameter
 func (r *Request) GetIntParam(key string, defaultValue ...int) int {
-	if value, exists := r.Params[key]; exists {
-		switch v := value.(type) {
-		case int:
-			return v
-		case float64:
-			return int(v)
-		case string:
-			if i, err := strconv.Atoi(v); err == nil {
-				return i
-			}
+	if value, exists := r.GetParam(key); exists {
+		if i, err := fields.ConvertToInt(value); err == nil && value != nil {
+			return i
 		}
 	}
 	
@@ -295,7 +509,7 @@ func (r *Request) GetIntParam(key string, defaultValue ...int) int {
 
 // GetBoolParam retrieves a boolean parameter
 func (r *Request) GetBoolParam(key string, defaultValue ...bool) bool {
-	if value, exists := r.Params[key]; exists {
+	if value, exists := r.GetParam(key); exists {
 		switch v := value.(type) {
 		case bool:
 			return v
@@ -305,6 +519,9 @@ func (r *Request) GetBoolParam(key string, defaultValue ...bool) bool {
 			return v != 0
 		case float64:
 			return v != 0
+		case json.Number:
+			f, err := fields.ConvertToFloat(v)
+			return err == nil && f != 0
 		}
 	}
 	
@@ -333,6 +550,7 @@ func (r *Request) UpdateEnvironment(userID int, context map[string]interface{})
 
 // Authenticate authenticates the user and updates the session
 func (r *Request) Authenticate(dbname, login string, userID int) error {
+	r.RotateSession()
 	r.Session.Authenticate(dbname, login, userID)
 	r.DB = dbname
 	
@@ -343,7 +561,8 @@ func (r *Request) Authenticate(dbname, login string, userID int) error {
 	return nil
 }
 
-// Logout logs out the current user
+// Logout logs out the current user. Without keepDB the session ends: it
+// is deleted and the browser told to forget its cookie.
 func (r *Request) Logout(keepDB bool) {
 	oldUserID := r.Session.UserID
 	oldLogin := r.Session.Login
@@ -352,6 +571,11 @@ func (r *Request) Logout(keepDB bool) {
 	
 	if !keepDB {
 		r.DB = ""
+		if err := r.config.SessionStore.Delete(r.Session.SID); err != nil && !os.IsNotExist(err) {
+			r.Logger.WarningCtx(r.Context, "Failed to delete session: %v", err)
+		}
+		r.Session.CanSave = false
+		r.clearSessionCookie()
 	}
 	
 	// Update request context
@@ -360,21 +584,75 @@ func (r *Request) Logout(keepDB bool) {
 	r.Logger.InfoCtx(r.Context, "User logged out: %s (ID: %d)", oldLogin, oldUserID)
 }
 
+// Impersonate switches the session to act as another user, keeping the
+// current user as the impersonator until StopImpersonation. The session
+// moves to a new ID.
+func (r *Request) Impersonate(login string, userID int) {
+	r.RotateSession()
+	r.Session.Impersonate(login, userID)
+	
+	// Update request context
+	r.Context = r.addRequestContext(r.Context)
+	
+	r.Logger.InfoCtx(r.Context, "User %s (ID: %d) impersonating %s (ID: %d)",
+		r.Session.ImpersonatorLogin, r.Session.ImpersonatorID, login, userID)
+}
+
+// StopImpersonation restores the identity of the impersonator; it returns
+// false when the session is not impersonated
+func (r *Request) StopImpersonation() bool {
+	login, userID := r.Session.Login, r.Session.UserID
+	if !r.Session.StopImpersonation() {
+		return false
+	}
+	r.RotateSession()
+	
+	// Update request context, without the impersonator
+	r.Context = context.WithValue(r.addRequestContext(r.Context), "impersonator_id", nil)
+	
+	r.Logger.InfoCtx(r.Context, "User %s (ID: %d) stopped impersonating %s (ID: %d)",
+		r.Session.Login, r.Session.UserID, login, userID)
+	return true
+}
+
+// IsImpersonated reports whether an administrator acts as the request user
+func (r *Request) IsImpersonated() bool {
+	return r.Session.IsImpersonated()
+}
+
+// GetImpersonatorID returns the administrator acting as the request user,
+// 0 when the session is not impersonated
+func (r *Request) GetImpersonatorID() int {
+	return r.Session.ImpersonatorID
+}
+
 // IsAuthenticated checks if the current request is authenticated
 func (r *Request) IsAuthenticated() bool {
 	return r.Session.IsAuthenticated()
 }
 
-// GetUserID returns the current user ID
+// GetUserID returns the current user ID, the public user for the
+// anonymous visitors of public routes
 func (r *Request) GetUserID() int {
+	if r.IsPublic() {
+		return r.PublicUserID
+	}
 	return r.Session.UserID
 }
 
 // GetLogin returns the current user login
 func (r *Request) GetLogin() string {
+	if r.IsPublic() {
+		return models.PublicUserLogin
+	}
 	return r.Session.Login
 }
 
+// IsPublic reports whether the request runs as the public user
+func (r *Request) IsPublic() bool {
+	return r.Session.UserID == 0 && r.PublicUserID != 0
+}
+
 // GetDBName returns the current database name
 func (r *Request) GetDBName() string {
 	return r.DB
@@ -396,11 +674,41 @@ func (r *Request) SaveSession(store SessionStore) error {
 	return nil
 }
 
+// RevokeOtherSessions removes every other session of the current user, e.g. after a password change
+func (r *Request) RevokeOtherSessions(store SessionStore) (int, error) {
+	userID := r.Session.UserID
+	if userID == 0 {
+		return 0, nil
+	}
+	
+	removed, err := store.DeleteUserSessions(userID, r.Session.SID)
+	if err != nil {
+		return removed, err
+	}
+	
+	r.Logger.InfoCtx(r.Context, "Revoked %d other sessions for user %s (ID: %d)", removed, r.GetLogin(), userID)
+	return removed, nil
+}
+
+// Now returns the time of the configured clock
+func (r *Request) Now() time.Time {
+	if r.config == nil {
+		return time.Now()
+	}
+	return clock.OrReal(r.config.Clock).Now()
+}
+
 // GetElapsedTime returns the time elapsed since request start
 func (r *Request) GetElapsedTime() time.Duration {
 	return time.Since(r.StartTime)
 }
 
+// StartSpan opens a child span of the request trace; the returned context
+// carries it so nested spans attach below it. End the span when done.
+func (r *Request) StartSpan(name string) (context.Context, *tracing.Span) {
+	return tracing.Start(r.Context, name)
+}
+
 // AddToContext adds a value to the request context
 func (r *Request) AddToContext(key string, value interface{}) {
 	r.Context = context.WithValue(r.Context, key, value)
@@ -416,18 +724,64 @@ func (r *Request) GetDB() *gorm.DB {
 	if r.DB == "" {
 		return nil
 	}
+	if r.Tx != nil {
+		return r.Tx.WithContext(r.Context)
+	}
 	
 	db, err := database.GetDatabase(r.DB)
+	if errors.Is(err, database.ErrDatabaseUnavailable) {
+		// Logged once by the breaker of the database
+		r.Logger.DebugCtx(r.Context, "Database %s is unavailable: %v", r.DB, err)
+		return nil
+	}
 	if err != nil {
 		r.Logger.ErrorCtx(r.Context, "Failed to get database connection for %s: %v", r.DB, err)
 		return nil
 	}
 	
-	return db
+	// Carry the request context so queries and transaction retries log the request ID
+	return db.WithContext(r.Context)
+}
+
+// GetEnv returns the environment of the request: its database, with the
+// transaction of an atomic batch, its user, the session context (lang, tz)
+// and the model registry of the database when the request started. It is
+// built on first use and cached; it is nil without a database. Handlers
+// should use it rather than GetDB. Its queries end with the request: pass
+// env.Detach() to goroutines.
+func (r *Request) GetEnv() *models.Environment {
+	// A login or logout during the request changes the user
+	if r.env != nil && r.env.GetUser() == uint(r.GetUserID()) {
+		return r.env
+	}
+	db := r.GetDB()
+	if db == nil {
+		return nil
+	}
+	
+	env := models.NewEnvironment(db, uint(r.GetUserID())).WithDBName(r.DB).WithContext(r.Session.GetContext())
+	if registry, ok := r.Registry.(*models.FieldModelRegistry); ok {
+		env = env.WithRegistry(registry)
+	}
+	r.env = env
+	return env
 }
 
 // LogRequest logs request information
 func (r *Request) LogRequest() {
+	if r.IsImpersonated() {
+		r.Logger.InfoCtx(r.Context, "%s %s - User: %s (ID: %d) impersonated by %s (ID: %d) - DB: %s - Duration: %v",
+			r.HTTPRequest.Method,
+			r.HTTPRequest.URL.Path,
+			r.GetLogin(),
+			r.GetUserID(),
+			r.Session.ImpersonatorLogin,
+			r.Session.ImpersonatorID,
+			r.GetDBName(),
+			r.GetElapsedTime(),
+		)
+		return
+	}
 	r.Logger.InfoCtx(r.Context, "%s %s - User: %s (ID: %d) - DB: %s - Duration: %v",
 		r.HTTPRequest.Method,
 		r.HTTPRequest.URL.Path,
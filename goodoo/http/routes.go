@@ -0,0 +1,474 @@
+package http
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/time/rate"
+	"goodoo/clock"
+)
+
+// GroupSystem is the group of administrators (like Odoo's base.group_system)
+const GroupSystem = "base.group_system"
+
+// MethodAny registers a route spec for every HTTP method
+const MethodAny = "ANY"
+
+// anyMethods are the methods of a MethodAny route
+var anyMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+	http.MethodDelete, http.MethodOptions, http.MethodConnect, http.MethodTrace,
+}
+
+// specMethods returns the methods a spec registers
+func specMethods(spec RouteSpec) []string {
+	if strings.ToUpper(spec.Method) == MethodAny {
+		return anyMethods
+	}
+	return []string{strings.ToUpper(spec.Method)}
+}
+
+// RouteSpec declares a route with the checks it needs; RegisterRoutes
+// composes the matching middleware so a route cannot forget one
+type RouteSpec struct {
+	Method  string
+	Path    string
+	Handler echo.HandlerFunc
+	// Auth requires an authenticated session
+	Auth bool
+	// ServiceAuth accepts requests signed with a service key (see
+	// ServiceAuthMiddleware) in place of a session
+	ServiceAuth bool
+	// DB requires a database to be selected
+	DB bool
+	// Public runs the anonymous visitors of the route as the public user
+	// (see PublicAccessMiddleware). Implies DB.
+	Public bool
+	// Groups restricts the route to members of any of these groups (external
+	// ids); administrators belong to every group. Implies Auth.
+	Groups []string
+	// Permission restricts the route to users whose groups grant it (see
+	// PermissionMiddleware); administrators hold every permission. Implies
+	// Auth and DB.
+	Permission string
+	// RateLimit names a rate limit class (see RegisterRateLimitClass)
+	RateLimit string
+	// CSRFExempt marks routes called by other sites or without a session
+	// cookie, for CSRF protection to skip
+	CSRFExempt bool
+	// Idempotent honors the Idempotency-Key header (see IdempotencyMiddleware)
+	Idempotent bool
+	// DenyImpersonation refuses the route to impersonated sessions, for
+	// changes an administrator must not make on behalf of a user (passwords,
+	// API keys)
+	DenyImpersonation bool
+	// Versions are the API versions an /api route is available in, v1 when
+	// empty; the route must be mounted on one of them (see APIVersionMiddleware)
+	Versions []string
+}
+
+// RouteInfo is the effective registration of a route, as listed by the
+// route table. Declared is false for routes registered directly on echo or
+// a group, whose checks are not known.
+type RouteInfo struct {
+	Method     string   `json:"method"`
+	Path       string   `json:"path"`
+	Handler    string   `json:"handler"`
+	Declared   bool     `json:"declared"`
+	Auth       bool     `json:"auth"`
+	DB         bool     `json:"db"`
+	Public     bool     `json:"public"`
+	Groups     []string `json:"groups,omitempty"`
+	Permission string   `json:"permission,omitempty"`
+	RateLimit  string   `json:"rate_limit,omitempty"`
+	CSRFExempt bool     `json:"csrf_exempt"`
+	Idempotent bool     `json:"idempotent"`
+	// DenyImpersonation is the route refused to impersonated sessions
+	DenyImpersonation bool     `json:"deny_impersonation"`
+	Versions          []string `json:"versions,omitempty"`
+	// ServiceAuth is the route accepting requests signed with a service key
+	ServiceAuth bool `json:"service_auth"`
+}
+
+var (
+	routeTable = make(map[string]RouteInfo)
+	routeMutex sync.RWMutex
+
+	// requestConfigs are the configurations of the Echo instances set up
+	// with UseRequestMiddleware
+	requestConfigs = make(map[*echo.Echo]*RequestConfig)
+	// requestFree are the undeclared routes that do not use the Goodoo
+	// request, such as static files
+	requestFree = make(map[string]bool)
+)
+
+// UseRequestMiddleware installs RequestMiddleware on every route of e and
+// hands its configuration to RegisterRoutes; call it before registering
+// routes
+func UseRequestMiddleware(e *echo.Echo, config *RequestConfig) {
+	routeMutex.Lock()
+	requestConfigs[e] = config
+	routeMutex.Unlock()
+	e.Use(RequestMiddleware(config))
+}
+
+// markRequestFree declares an undeclared route that does not use the
+// Goodoo request, for AuditRoutes
+func markRequestFree(method, path string) {
+	routeMutex.Lock()
+	defer routeMutex.Unlock()
+	requestFree[routeKey(method, path)] = true
+}
+
+// routeKey identifies a route by method and path, ignoring parameter names
+// since /a/:id and /a/:name are the same route for the router
+func routeKey(method, path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") {
+			segments[i] = ":"
+		}
+	}
+	return strings.ToUpper(method) + " " + strings.Join(segments, "/")
+}
+
+// handlerName returns the function name of a handler
+func handlerName(handler echo.HandlerFunc) string {
+	if fn := runtime.FuncForPC(reflect.ValueOf(handler).Pointer()); fn != nil {
+		return strings.TrimSuffix(fn.Name(), "-fm")
+	}
+	return ""
+}
+
+// RegisterRoutes adds routes to e with the middleware their specs call for:
+// the Goodoo request, service authentication, authentication, the
+// impersonation guard, database, public access, groups, permission, rate
+// limit then idempotency.
+// e must be set up with UseRequestMiddleware. A route already registered
+// with the same method and path is an error, and no route of the batch is
+// added then.
+func RegisterRoutes(e *echo.Echo, specs []RouteSpec) error {
+	routeMutex.Lock()
+	defer routeMutex.Unlock()
+
+	config := requestConfigs[e]
+	if config == nil {
+		return fmt.Errorf("routes registered before UseRequestMiddleware: their handlers would have no Goodoo request")
+	}
+
+	existing := make(map[string]bool)
+	for _, route := range e.Routes() {
+		existing[routeKey(route.Method, route.Path)] = true
+	}
+	for _, spec := range specs {
+		if err := checkRouteVersion(spec); err != nil {
+			return err
+		}
+		for _, method := range specMethods(spec) {
+			key := routeKey(method, spec.Path)
+			if existing[key] {
+				return fmt.Errorf("route %s %s is registered twice", method, spec.Path)
+			}
+			existing[key] = true
+		}
+	}
+
+	for _, spec := range specs {
+		auth := spec.Auth || len(spec.Groups) > 0 || spec.Permission != ""
+		needsDB := spec.DB || spec.Public || len(spec.Groups) > 0 || spec.Permission != ""
+		// The request is already set when e runs RequestMiddleware itself;
+		// repeating it here keeps the route working if it is mounted elsewhere
+		middleware := []echo.MiddlewareFunc{RequestMiddleware(config)}
+		if spec.ServiceAuth {
+			middleware = append(middleware, ServiceAuthMiddleware())
+		}
+		if auth {
+			middleware = append(middleware, AuthenticationMiddleware(true))
+		}
+		if spec.DenyImpersonation {
+			middleware = append(middleware, DenyImpersonationMiddleware())
+		}
+		if needsDB {
+			middleware = append(middleware, DatabaseMiddleware(true))
+		}
+		if spec.Public {
+			middleware = append(middleware, PublicAccessMiddleware())
+		}
+		if len(spec.Groups) > 0 {
+			middleware = append(middleware, GroupMiddleware(spec.Groups...))
+		}
+		if spec.Permission != "" {
+			middleware = append(middleware, PermissionMiddleware(spec.Permission))
+		}
+		if spec.RateLimit != "" {
+			middleware = append(middleware, RateLimitMiddleware(spec.RateLimit))
+		}
+		if spec.Idempotent {
+			middleware = append(middleware, IdempotencyMiddleware())
+		}
+		for _, method := range specMethods(spec) {
+			e.Add(method, spec.Path, spec.Handler, middleware...)
+			routeTable[routeKey(method, spec.Path)] = RouteInfo{
+				Method:            method,
+				Path:              spec.Path,
+				Handler:           handlerName(spec.Handler),
+				Declared:          true,
+				Auth:              auth,
+				ServiceAuth:       spec.ServiceAuth,
+				DB:                needsDB,
+				Public:            spec.Public,
+				Groups:            spec.Groups,
+				Permission:        spec.Permission,
+				RateLimit:         spec.RateLimit,
+				CSRFExempt:        spec.CSRFExempt,
+				Idempotent:        spec.Idempotent,
+				DenyImpersonation: spec.DenyImpersonation,
+				Versions:          routeVersions(spec),
+			}
+		}
+	}
+	return nil
+}
+
+// MustRegisterRoutes registers routes and panics on a conflict, so a
+// shadowed route stops the server at startup
+func MustRegisterRoutes(e *echo.Echo, specs []RouteSpec) {
+	if err := RegisterRoutes(e, specs); err != nil {
+		panic(err)
+	}
+}
+
+// AuditRoutes checks that the handler of every route of e gets the Goodoo
+// request: routes registered from specs do, other routes need e to be set
+// up with UseRequestMiddleware unless they do not use the request. main
+// refuses to start on an error, which lists the routes at fault.
+func AuditRoutes(e *echo.Echo) error {
+	routeMutex.RLock()
+	defer routeMutex.RUnlock()
+
+	if requestConfigs[e] != nil {
+		return nil
+	}
+	var missing []string
+	for _, route := range e.Routes() {
+		if route.Method == echo.RouteNotFound {
+			continue
+		}
+		key := routeKey(route.Method, route.Path)
+		if info, ok := routeTable[key]; (ok && info.Declared) || requestFree[key] {
+			continue
+		}
+		missing = append(missing, route.Method+" "+route.Path)
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("routes without the Goodoo request middleware: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// LookupRoute returns the declaration of a route registered from a spec,
+// e.g. LookupRoute(c.Request().Method, c.Path()) in a middleware
+func LookupRoute(method, path string) (RouteInfo, bool) {
+	routeMutex.RLock()
+	defer routeMutex.RUnlock()
+	info, ok := routeTable[routeKey(method, path)]
+	return info, ok
+}
+
+// RouteTable returns the routes of e sorted by path and method, with the
+// declaration of those registered from specs
+func RouteTable(e *echo.Echo) []RouteInfo {
+	routeMutex.RLock()
+	defer routeMutex.RUnlock()
+
+	var routes []RouteInfo
+	for _, route := range e.Routes() {
+		if route.Method == echo.RouteNotFound {
+			continue
+		}
+		info, ok := routeTable[routeKey(route.Method, route.Path)]
+		if !ok {
+			info = RouteInfo{Method: route.Method, Path: route.Path, Handler: strings.TrimSuffix(route.Name, "-fm")}
+		}
+		routes = append(routes, info)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Path != routes[j].Path {
+			return routes[i].Path < routes[j].Path
+		}
+		return routes[i].Method < routes[j].Method
+	})
+	return routes
+}
+
+// GroupMiddleware restricts a route to the members of any of the groups,
+// resolved with RequestConfig.GroupsResolver
+func GroupMiddleware(groups ...string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := MustGetGoodooRequest(c)
+			if req.config == nil || req.config.GroupsResolver == nil {
+				return echo.NewHTTPError(http.StatusForbidden, "Access denied")
+			}
+
+			userGroups, admin := req.config.GroupsResolver(req)
+			if admin {
+				return next(c)
+			}
+			for _, group := range groups {
+				for _, userGroup := range userGroups {
+					if group == userGroup {
+						return next(c)
+					}
+				}
+			}
+			req.Logger.WarningCtx(req.Context, "User %s denied access to %s (groups %v)",
+				req.GetLogin(), req.HTTPRequest.URL.Path, groups)
+			return echo.NewHTTPError(http.StatusForbidden, "Access denied")
+		}
+	}
+}
+
+// DenyImpersonationMiddleware refuses the route to impersonated sessions
+func DenyImpersonationMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := MustGetGoodooRequest(c)
+			if req.IsImpersonated() {
+				req.Logger.WarningCtx(req.Context, "User %s impersonating %s denied access to %s",
+					req.Session.ImpersonatorLogin, req.GetLogin(), req.HTTPRequest.URL.Path)
+				return echo.NewHTTPError(http.StatusForbidden, "Not allowed while impersonating a user")
+			}
+			return next(c)
+		}
+	}
+}
+
+// rateLimitClass is the request rate allowed to one client on the routes of a class
+type rateLimitClass struct {
+	limit rate.Limit
+	burst int
+}
+
+// rateLimitEntry is the limiter of a client for a class
+type rateLimitEntry struct {
+	limiter  *rate.Limiter
+	lastUsed time.Time
+}
+
+var (
+	rateLimitClasses = map[string]rateLimitClass{
+		// Credential checks and password resets
+		"auth": {limit: rate.Limit(10.0 / 60), burst: 5},
+		// Calls doing heavy work, such as report rendering or LLM requests
+		"expensive": {limit: rate.Limit(30.0 / 60), burst: 10},
+		// Pages anyone may read without logging in, such as the status page
+		"public": {limit: rate.Limit(60.0 / 60), burst: 20},
+		// Posts of the webhooks of other services, such as inbound mail,
+		// which come in batches from a few addresses
+		"webhook": {limit: rate.Limit(300.0 / 60), burst: 60},
+	}
+	rateLimitClassLock sync.RWMutex
+)
+
+// RegisterRateLimitClass defines or replaces a rate limit class allowing
+// perMinute requests per client, in bursts of up to burst
+func RegisterRateLimitClass(name string, perMinute, burst int) {
+	rateLimitClassLock.Lock()
+	defer rateLimitClassLock.Unlock()
+	rateLimitClasses[name] = rateLimitClass{limit: rate.Limit(float64(perMinute) / 60), burst: burst}
+}
+
+// RateLimiter counts the requests of each client per rate limit class
+type RateLimiter struct {
+	clock    clock.Clock
+	limiters map[string]*rateLimitEntry
+	mutex    sync.Mutex
+}
+
+// NewRateLimiter creates a rate limiter whose windows follow clk, the
+// system clock when nil
+func NewRateLimiter(clk clock.Clock) *RateLimiter {
+	return &RateLimiter{clock: clock.OrReal(clk), limiters: make(map[string]*rateLimitEntry)}
+}
+
+// defaultRateLimiter serves RateLimitMiddleware
+var defaultRateLimiter = NewRateLimiter(clock.Real)
+
+// Allow reports whether a client may make another request of a class
+func (l *RateLimiter) Allow(class, client string) bool {
+	rateLimitClassLock.RLock()
+	settings, ok := rateLimitClasses[class]
+	rateLimitClassLock.RUnlock()
+	if !ok {
+		return true
+	}
+	return l.allow(class+"|"+client, settings)
+}
+
+// AllowRate reports whether a client may make another request under a
+// limit of its own, perMinute requests in bursts of up to burst, outside
+// the rate limit classes
+func (l *RateLimiter) AllowRate(client string, perMinute, burst int) bool {
+	if burst <= 0 {
+		burst = 1
+	}
+	// The key holds the limit so that a changed limit starts a new limiter
+	key := fmt.Sprintf("rate:%d/%d|%s", perMinute, burst, client)
+	return l.allow(key, rateLimitClass{limit: rate.Limit(float64(perMinute) / 60), burst: burst})
+}
+
+// allow takes a request from the limiter of key, created with settings
+func (l *RateLimiter) allow(key string, settings rateLimitClass) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.clock.Now()
+	entry := l.limiters[key]
+	if entry == nil {
+		// Forget clients idle for a while before the table grows large
+		if len(l.limiters) >= 10000 {
+			for k, e := range l.limiters {
+				if now.Sub(e.lastUsed) > 10*time.Minute {
+					delete(l.limiters, k)
+				}
+			}
+		}
+		entry = &rateLimitEntry{limiter: rate.NewLimiter(settings.limit, settings.burst)}
+		l.limiters[key] = entry
+	}
+	entry.lastUsed = now
+	return entry.limiter.AllowN(now, 1)
+}
+
+// RateLimitMiddleware limits the requests of each client (the user, or the
+// remote address before login) on the routes of a class; service accounts
+// with a rate limit of their own are exempt
+func RateLimitMiddleware(class string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			// Anonymous visitors, the public user included, are keyed by
+			// address: they all share the public user id
+			client := "ip:" + c.RealIP()
+			if req := GetGoodooRequest(c); req != nil && req.IsAuthenticated() {
+				// Service accounts with a rate limit of their own are only
+				// held to it (see ServiceAuthMiddleware)
+				if req.ServiceAccount != nil && req.ServiceAccount.RateLimit > 0 {
+					return next(c)
+				}
+				client = fmt.Sprintf("uid:%s:%d", req.GetDBName(), req.GetUserID())
+			}
+			if !defaultRateLimiter.Allow(class, client) {
+				return echo.NewHTTPError(http.StatusTooManyRequests, "Too many requests")
+			}
+			return next(c)
+		}
+	}
+}
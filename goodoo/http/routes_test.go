@@ -0,0 +1,51 @@
+package http
+
+import (
+	"testing"
+	"time"
+
+	"goodoo/clock"
+)
+
+// TestRateLimiterWindow refills the allowance of a client as the clock
+// advances, without waiting
+func TestRateLimiterWindow(t *testing.T) {
+	fake := clock.NewFake(time.Date(2026, 10, 15, 9, 0, 0, 0, time.UTC))
+	limiter := NewRateLimiter(fake)
+	RegisterRateLimitClass("routes_test", 2, 2)
+
+	for i, want := range []bool{true, true, false} {
+		if got := limiter.Allow("routes_test", "ip:192.0.2.1"); got != want {
+			t.Errorf("request %d allowed: %v, want %v", i+1, got, want)
+		}
+	}
+	if !limiter.Allow("routes_test", "ip:192.0.2.2") {
+		t.Error("another client shares the allowance")
+	}
+
+	// Two per minute: one request more every 30 seconds
+	fake.Advance(29 * time.Second)
+	if limiter.Allow("routes_test", "ip:192.0.2.1") {
+		t.Error("allowed before the window reset")
+	}
+	fake.Advance(time.Second)
+	if !limiter.Allow("routes_test", "ip:192.0.2.1") {
+		t.Error("not allowed once the window reset")
+	}
+	fake.Advance(time.Hour)
+	for i := 0; i < 2; i++ {
+		if !limiter.Allow("routes_test", "ip:192.0.2.1") {
+			t.Errorf("request %d after an hour not allowed: the burst is not refilled", i+1)
+		}
+	}
+
+	for i, want := range []bool{true, false} {
+		if got := limiter.AllowRate("svc:1", 60, 1); got != want {
+			t.Errorf("service request %d allowed: %v, want %v", i+1, got, want)
+		}
+	}
+	fake.Advance(time.Second)
+	if !limiter.AllowRate("svc:1", 60, 1) {
+		t.Error("service request not allowed a second later")
+	}
+}
@@ -0,0 +1,206 @@
+package http
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// CSPNonceKey is the echo context key holding the per-request CSP nonce
+const CSPNonceKey = "csp_nonce"
+
+// CSPPolicy builds a Content-Security-Policy header value, keeping directive order
+type CSPPolicy struct {
+	names   []string
+	sources map[string][]string
+}
+
+// NewCSPPolicy creates an empty policy
+func NewCSPPolicy() *CSPPolicy {
+	return &CSPPolicy{sources: make(map[string][]string)}
+}
+
+// Add appends sources to a directive, e.g. Add("script-src", "'self'", "https://cdn.example.com")
+func (p *CSPPolicy) Add(directive string, sources ...string) *CSPPolicy {
+	if _, exists := p.sources[directive]; !exists {
+		p.names = append(p.names, directive)
+	}
+	p.sources[directive] = append(p.sources[directive], sources...)
+	return p
+}
+
+// Set replaces the sources of a directive
+func (p *CSPPolicy) Set(directive string, sources ...string) *CSPPolicy {
+	if _, exists := p.sources[directive]; !exists {
+		p.names = append(p.names, directive)
+	}
+	p.sources[directive] = append([]string(nil), sources...)
+	return p
+}
+
+// Clone returns an independent copy of the policy
+func (p *CSPPolicy) Clone() *CSPPolicy {
+	clone := NewCSPPolicy()
+	for _, name := range p.names {
+		clone.Set(name, p.sources[name]...)
+	}
+	return clone
+}
+
+// String renders the policy; a non-empty nonce is allowed for scripts
+func (p *CSPPolicy) String(nonce string) string {
+	parts := make([]string, 0, len(p.names))
+	for _, name := range p.names {
+		sources := p.sources[name]
+		if name == "script-src" && nonce != "" {
+			sources = append(append([]string(nil), sources...), fmt.Sprintf("'nonce-%s'", nonce))
+		}
+		if len(sources) == 0 {
+			parts = append(parts, name)
+		} else {
+			parts = append(parts, name+" "+strings.Join(sources, " "))
+		}
+	}
+	return strings.Join(parts, "; ")
+}
+
+// RouteSecurity overrides security headers for requests under a path prefix
+type RouteSecurity struct {
+	// FrameAncestors lists the origins allowed to embed the route, e.g. "'self'", "https://partner.example.com"
+	FrameAncestors []string
+}
+
+// SecurityConfig configures SecurityMiddleware
+type SecurityConfig struct {
+	CSP *CSPPolicy
+	// CSPReportOnly sends Content-Security-Policy-Report-Only to stage policy changes
+	CSPReportOnly bool
+	CSPReportURI  string
+
+	HSTSMaxAge            int
+	HSTSIncludeSubDomains bool
+	// ProxyMode trusts X-Forwarded-Proto from a reverse proxy (like Odoo's proxy_mode)
+	ProxyMode bool
+	// TrustedProxies are the networks of the reverse proxies whose
+	// X-Forwarded-For is trusted in proxy mode; without them the client
+	// address is the one of the connection
+	TrustedProxies []*net.IPNet
+	// TerminatesTLS is set when the server serves TLS itself: a request is
+	// then secure only when its connection is, X-Forwarded-Proto is ignored
+	TerminatesTLS bool
+
+	// Routes maps path prefixes to header overrides; the longest prefix wins
+	Routes map[string]RouteSecurity
+}
+
+// DefaultSecurityConfig returns a strict policy allowing the CDNs used by the dashboard
+func DefaultSecurityConfig() *SecurityConfig {
+	csp := NewCSPPolicy().
+		Add("default-src", "'self'").
+		Add("script-src", "'self'", "https://cdn.jsdelivr.net").
+		Add("style-src", "'self'", "'unsafe-inline'").
+		Add("img-src", "'self'", "data:").
+		Add("font-src", "'self'", "data:").
+		Add("connect-src", "'self'").
+		Add("object-src", "'none'").
+		Add("base-uri", "'self'").
+		Add("form-action", "'self'").
+		Add("frame-ancestors", "'none'")
+
+	return &SecurityConfig{
+		CSP:                   csp,
+		CSPReportURI:          "/api/csp-report",
+		HSTSMaxAge:            31536000,
+		HSTSIncludeSubDomains: true,
+		Routes:                make(map[string]RouteSecurity),
+	}
+}
+
+// LoadFromEnv loads GOODOO_CSP_REPORT_ONLY, GOODOO_HSTS_MAX_AGE,
+// GOODOO_PROXY_MODE and GOODOO_TRUSTED_PROXIES, a comma-separated list of
+// addresses or CIDR ranges; invalid entries are skipped
+func (s *SecurityConfig) LoadFromEnv() {
+	if value := os.Getenv("GOODOO_CSP_REPORT_ONLY"); value != "" {
+		s.CSPReportOnly, _ = strconv.ParseBool(value)
+	}
+	if value := os.Getenv("GOODOO_HSTS_MAX_AGE"); value != "" {
+		if maxAge, err := strconv.Atoi(value); err == nil {
+			s.HSTSMaxAge = maxAge
+		}
+	}
+	if value := os.Getenv("GOODOO_PROXY_MODE"); value != "" {
+		s.ProxyMode, _ = strconv.ParseBool(value)
+	}
+	if value := os.Getenv("GOODOO_TRUSTED_PROXIES"); value != "" {
+		for _, entry := range strings.Split(value, ",") {
+			entry = strings.TrimSpace(entry)
+			if !strings.Contains(entry, "/") {
+				if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+					entry += "/32"
+				} else {
+					entry += "/128"
+				}
+			}
+			if _, network, err := net.ParseCIDR(entry); err == nil {
+				s.TrustedProxies = append(s.TrustedProxies, network)
+			}
+		}
+	}
+}
+
+// IPExtractor returns how Echo finds the client address, which keys the
+// rate limits: the address of the connection, or in proxy mode the first
+// address of X-Forwarded-For not added by a trusted proxy. Forwarded
+// addresses are never trusted from other peers, who could otherwise pick
+// a new address for each request.
+func (s *SecurityConfig) IPExtractor() echo.IPExtractor {
+	if !s.ProxyMode || len(s.TrustedProxies) == 0 {
+		return echo.ExtractIPDirect()
+	}
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, network := range s.TrustedProxies {
+		options = append(options, echo.TrustIPRange(network))
+	}
+	return echo.ExtractIPFromXFFHeader(options...)
+}
+
+// routeFor returns the override of the longest matching path prefix
+func (s *SecurityConfig) routeFor(path string) (RouteSecurity, bool) {
+	var match RouteSecurity
+	longest := -1
+	for prefix, route := range s.Routes {
+		if strings.HasPrefix(path, prefix) && len(prefix) > longest {
+			match, longest = route, len(prefix)
+		}
+	}
+	return match, longest >= 0
+}
+
+// isSecure reports whether the client connection uses TLS
+func (s *SecurityConfig) isSecure(c echo.Context) bool {
+	if c.Request().TLS != nil {
+		return true
+	}
+	return s.ProxyMode && !s.TerminatesTLS && strings.EqualFold(c.Request().Header.Get(echo.HeaderXForwardedProto), "https")
+}
+
+// newNonce returns a random base64 nonce
+func newNonce() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return base64.StdEncoding.EncodeToString(buf)
+}
+
+// CSPNonce returns the nonce of the current request, for inline <script nonce="..."> tags
+func CSPNonce(c echo.Context) string {
+	if nonce, ok := c.Get(CSPNonceKey).(string); ok {
+		return nonce
+	}
+	return ""
+}
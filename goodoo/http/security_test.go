@@ -0,0 +1,60 @@
+package http
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIPExtractor(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/24")
+	tests := []struct {
+		name       string
+		proxyMode  bool
+		trusted    bool
+		remoteAddr string
+		xff        string
+		want       string
+	}{
+		{"direct ignores forwarded", false, false, "203.0.113.7:4000", "198.51.100.1", "203.0.113.7"},
+		{"proxy mode without trusted proxies", true, false, "10.0.0.2:4000", "198.51.100.1", "10.0.0.2"},
+		{"trusted proxy", true, true, "10.0.0.2:4000", "198.51.100.1", "198.51.100.1"},
+		{"spoofed through trusted proxy", true, true, "10.0.0.2:4000", "192.0.2.9, 198.51.100.1", "198.51.100.1"},
+		{"untrusted peer", true, true, "203.0.113.7:4000", "198.51.100.1", "203.0.113.7"},
+		{"private peer not listed", true, true, "192.168.1.2:4000", "198.51.100.1", "192.168.1.2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultSecurityConfig()
+			config.ProxyMode = tt.proxyMode
+			if tt.trusted {
+				config.TrustedProxies = []*net.IPNet{proxies}
+			}
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			r.Header.Set("X-Forwarded-For", tt.xff)
+			if got := config.IPExtractor()(r); got != tt.want {
+				t.Errorf("IPExtractor = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrustedProxiesFromEnv(t *testing.T) {
+	t.Setenv("GOODOO_TRUSTED_PROXIES", "10.0.0.0/24, 192.0.2.1,::1,invalid")
+	config := DefaultSecurityConfig()
+	config.LoadFromEnv()
+	var got []string
+	for _, network := range config.TrustedProxies {
+		got = append(got, network.String())
+	}
+	want := []string{"10.0.0.0/24", "192.0.2.1/32", "::1/128"}
+	if len(got) != len(want) {
+		t.Fatalf("TrustedProxies = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("TrustedProxies = %v, want %v", got, want)
+		}
+	}
+}
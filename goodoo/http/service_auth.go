@@ -0,0 +1,203 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"goodoo/models"
+	"goodoo/svcauth"
+)
+
+// serviceKeyTouch is how often the last use of a service key is stored
+const serviceKeyTouch = time.Minute
+
+// ServiceAuthConfig configures ServiceAuthMiddleware
+type ServiceAuthConfig struct {
+	// Window is how far the timestamp of a signed request may be from the
+	// server clock; nonces are remembered for twice as long
+	Window time.Duration
+
+	nonces     *svcauth.NonceCache
+	noncesOnce sync.Once
+}
+
+// DefaultServiceAuthConfig returns a window of 5 minutes
+func DefaultServiceAuthConfig() *ServiceAuthConfig {
+	return &ServiceAuthConfig{Window: svcauth.DefaultWindow}
+}
+
+// LoadFromEnv overrides the configuration with GOODOO_SERVICE_AUTH_WINDOW
+// (a duration)
+func (c *ServiceAuthConfig) LoadFromEnv() {
+	if value := os.Getenv("GOODOO_SERVICE_AUTH_WINDOW"); value != "" {
+		if d, err := time.ParseDuration(value); err == nil && d > 0 {
+			c.Window = d
+		}
+	}
+}
+
+// nonceCache returns the nonces seen by the server
+func (c *ServiceAuthConfig) nonceCache() *svcauth.NonceCache {
+	c.noncesOnce.Do(func() {
+		c.nonces = svcauth.NewNonceCache(c.Window)
+	})
+	return c.nonces
+}
+
+// defaultServiceAuthConfig serves requests whose configuration has none
+var defaultServiceAuthConfig = DefaultServiceAuthConfig()
+
+// errServiceKey rejects a signed request without telling why, which is
+// only logged
+var errServiceKey = errors.New("unknown or inactive service key")
+
+// ServiceAuthMiddleware authenticates requests signed with a service key
+// (see package svcauth) as the service user of the key. The authentication
+// lasts for the request only: no session is stored and no cookie sent.
+// The requests of service accounts are held to the model allow-list, rate
+// limit and daily quota of the account, and refused once it expired.
+// Unsigned requests go on with their session.
+func ServiceAuthMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := MustGetGoodooRequest(c)
+			keyID := req.HTTPRequest.Header.Get(svcauth.KeyIDHeader)
+			if keyID == "" {
+				return next(c)
+			}
+			if err := req.authenticateService(keyID); err != nil {
+				req.Logger.WarningCtx(req.Context, "Signed request with service key %s to %s rejected: %v",
+					keyID, req.HTTPRequest.URL.Path, err)
+				return echo.NewHTTPError(http.StatusUnauthorized, "Invalid service signature")
+			}
+			if req.ServiceAccount != nil {
+				if err := req.checkServiceAccount(c); err != nil {
+					return err
+				}
+			}
+			return next(c)
+		}
+	}
+}
+
+// checkServiceAccount applies the model allow-list, rate limit and daily
+// quota of the service account of a signed request
+func (r *Request) checkServiceAccount(c echo.Context) error {
+	account := r.ServiceAccount
+	if model := c.Param("model"); model != "" && !account.AllowsModel(model) {
+		r.Logger.WarningCtx(r.Context, "Service account %s denied access to model %s", r.GetLogin(), model)
+		return echo.NewHTTPError(http.StatusForbidden, "Model not allowed for this service account")
+	}
+	if account.RateLimit > 0 {
+		client := fmt.Sprintf("service:%s:%d", r.GetDBName(), account.ID)
+		if !defaultRateLimiter.AllowRate(client, account.RateLimit, account.RateBurst) {
+			return echo.NewHTTPError(http.StatusTooManyRequests, "Too many requests")
+		}
+	}
+	now := r.Now()
+	allowed, err := account.ConsumeQuota(r.GetDB(), now)
+	if err != nil {
+		r.Logger.ErrorCtx(r.Context, "Failed to count the quota of service account %s: %v", r.GetLogin(), err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to check the quota")
+	}
+	if !allowed {
+		tomorrow := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+		r.Echo.Response().Header().Set("Retry-After", strconv.Itoa(int(tomorrow.Sub(now).Seconds())+1))
+		return echo.NewHTTPError(http.StatusTooManyRequests, "Daily quota exceeded")
+	}
+	return nil
+}
+
+// ModelAllowed reports whether the request may use a model: always, except
+// for service accounts restricted to other models
+func (r *Request) ModelAllowed(model string) bool {
+	return r.ServiceAccount == nil || r.ServiceAccount.AllowsModel(model)
+}
+
+// authenticateService verifies the signature of the request with the
+// secrets of a service key and authenticates it as the key's service user
+func (r *Request) authenticateService(keyID string) error {
+	config := defaultServiceAuthConfig
+	if r.config.ServiceAuth != nil {
+		config = r.config.ServiceAuth
+	}
+	dbName := r.GetDBName()
+	if dbName == "" {
+		return errors.New("no database selected")
+	}
+	db := r.GetDB()
+	if db == nil {
+		return errors.New("database not available")
+	}
+
+	var key models.ServiceKey
+	if err := db.Where("key_id = ? AND active = ?", keyID, true).First(&key).Error; err != nil {
+		return errServiceKey
+	}
+	body, err := r.rawBody()
+	if err != nil {
+		return fmt.Errorf("failed to read body: %w", err)
+	}
+	now := r.Now()
+	if err := svcauth.Verify(r.HTTPRequest, body, key.Secrets(now), now, config.Window); err != nil {
+		return err
+	}
+	nonce := r.HTTPRequest.Header.Get(svcauth.NonceHeader)
+	if err := config.nonceCache().Claim(dbName+"/"+keyID, nonce, now); err != nil {
+		return err
+	}
+
+	var user models.User
+	if err := db.Where("id = ? AND active = ?", key.UserID, true).First(&user).Error; err != nil {
+		return fmt.Errorf("service user %d not found or inactive", key.UserID)
+	}
+	var account *models.ServiceAccount
+	if user.IsService {
+		account, err = models.FindServiceAccount(db, user.ID)
+		if err != nil {
+			return fmt.Errorf("service account of user %d not found", user.ID)
+		}
+		if account.Expired(now) {
+			return models.ErrServiceAccountExpired
+		}
+	}
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) > serviceKeyTouch {
+		if err := db.Model(&key).UpdateColumn("last_used_at", now).Error; err != nil {
+			r.Logger.WarningCtx(r.Context, "Failed to record the use of service key %s: %v", keyID, err)
+		}
+	}
+
+	// A session of its own, never stored, so that a cookie sent along
+	// cannot carry the service identity over
+	session := r.config.SessionStore.New()
+	session.CanSave = false
+	session.Authenticate(dbName, user.Login, int(user.ID))
+	r.Session = session
+	r.ServiceKeyID = keyID
+	r.ServiceAccount = account
+	r.dropSessionCookie()
+	r.Context = r.addRequestContext(r.Context)
+	r.Logger.DebugCtx(r.Context, "Request signed with service key %s runs as %s (ID: %d)", keyID, user.Login, user.ID)
+	return nil
+}
+
+// dropSessionCookie withdraws the session cookie of a new session from the
+// response
+func (r *Request) dropSessionCookie() {
+	header := r.Echo.Response().Header()
+	prefix := r.config.SessionCookie.name(r.config.SessionCookieName) + "="
+	cookies := header.Values(echo.HeaderSetCookie)
+	header.Del(echo.HeaderSetCookie)
+	for _, cookie := range cookies {
+		if !strings.HasPrefix(cookie, prefix) {
+			header.Add(echo.HeaderSetCookie, cookie)
+		}
+	}
+}
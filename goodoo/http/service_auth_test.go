@@ -0,0 +1,264 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"goodoo/clock"
+	"goodoo/crypto"
+	"goodoo/models"
+	"goodoo/models/testutil"
+	"goodoo/svcauth"
+)
+
+// grantsByUser resolves the permissions of the users of a map, the user
+// 1 being the administrator
+func grantsByUser(grants map[int][]string) func(req *Request) ([]string, bool) {
+	return func(req *Request) ([]string, bool) {
+		if req.GetUserID() == 1 {
+			return nil, true
+		}
+		return grants[req.GetUserID()], false
+	}
+}
+
+// do sends a request with the cookie, if any, and returns the status
+func (s *publicTestServer) do(r *http.Request, cookie *http.Cookie) int {
+	r.RemoteAddr = "192.0.2.1:1000"
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	s.e.ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestPermissionResolution(t *testing.T) {
+	s := newPublicTestServer(t, "service_auth_test")
+	MustRegisterRoutes(s.e, []RouteSpec{{Method: "GET", Path: "/service-auth-test/resolution", Permission: PermissionServiceKeysManage,
+		Handler: func(c echo.Context) error { return c.NoContent(http.StatusOK) }}})
+
+	tests := []struct {
+		name     string
+		resolver func(req *Request) ([]string, bool)
+		want     bool
+		// wantEffective are some of the effective permissions
+		wantEffective []string
+		wantAdmin     bool
+	}{
+		{"no resolver", nil, false, nil, false},
+		{"nothing granted", func(*Request) ([]string, bool) { return nil, false }, false, nil, false},
+		{"other permissions", func(*Request) ([]string, bool) { return []string{PermissionUsersManage}, false }, false,
+			[]string{PermissionUsersManage}, false},
+		{"granted", func(*Request) ([]string, bool) {
+			return []string{PermissionUsersManage, PermissionServiceKeysManage}, false
+		}, true,
+			[]string{PermissionServiceKeysManage, PermissionUsersManage}, false},
+		// Administrators hold every permission a route declares
+		{"administrator", func(*Request) ([]string, bool) { return nil, true }, true,
+			[]string{PermissionServiceKeysManage}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &Request{config: &RequestConfig{PermissionsResolver: tt.resolver}}
+			if got := req.HasPermission(PermissionServiceKeysManage); got != tt.want {
+				t.Errorf("HasPermission = %v, want %v", got, tt.want)
+			}
+			effective, admin := req.EffectivePermissions()
+			if admin != tt.wantAdmin {
+				t.Errorf("EffectivePermissions admin = %v, want %v", admin, tt.wantAdmin)
+			}
+			if !slices.IsSorted(effective) {
+				t.Errorf("EffectivePermissions = %v, not sorted", effective)
+			}
+			for _, permission := range tt.wantEffective {
+				if !slices.Contains(effective, permission) {
+					t.Errorf("EffectivePermissions = %v, want %s among them", effective, permission)
+				}
+			}
+		})
+	}
+}
+
+// TestPermissionMiddleware resolves the permissions of the user on every
+// request: users without the permission of a route are refused with 403
+func TestPermissionMiddleware(t *testing.T) {
+	s := newPublicTestServer(t, "service_auth_test")
+	grants := map[int][]string{7: {PermissionServiceKeysManage}, 8: {PermissionUsersManage}}
+	s.config.PermissionsResolver = grantsByUser(grants)
+	reached := false
+	MustRegisterRoutes(s.e, []RouteSpec{{Method: "GET", Path: "/service-auth-test/keys", Permission: PermissionServiceKeysManage,
+		Handler: func(c echo.Context) error {
+			reached = true
+			return c.NoContent(http.StatusOK)
+		}}})
+
+	tests := []struct {
+		name   string
+		userID int
+		want   int
+	}{
+		{"anonymous", 0, http.StatusUnauthorized},
+		{"administrator", 1, http.StatusOK},
+		{"granted", 7, http.StatusOK},
+		{"other permission", 8, http.StatusForbidden},
+		{"nothing granted", 9, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reached = false
+			var cookie *http.Cookie
+			if tt.userID != 0 {
+				cookie = s.login("service_auth_test", tt.userID)
+			}
+			if status := s.do(httptest.NewRequest(http.MethodGet, "/service-auth-test/keys", nil), cookie); status != tt.want {
+				t.Errorf("GET answered %d, want %d", status, tt.want)
+			}
+			if reached != (tt.want == http.StatusOK) {
+				t.Errorf("the handler ran: %v", reached)
+			}
+		})
+	}
+
+	// A revoked permission applies at once, without logging in again
+	cookie := s.login("service_auth_test", 7)
+	grants[7] = nil
+	if status := s.do(httptest.NewRequest(http.MethodGet, "/service-auth-test/keys", nil), cookie); status != http.StatusForbidden {
+		t.Errorf("GET once the permission was revoked answered %d, want 403", status)
+	}
+}
+
+// TestServiceAuthMiddlewareUnsigned lets the unsigned requests go on with
+// their session, and refuses a signed request it cannot check
+func TestServiceAuthMiddlewareUnsigned(t *testing.T) {
+	s := newPublicTestServer(t, "")
+	uid := 0
+	MustRegisterRoutes(s.e, []RouteSpec{{Method: "GET", Path: "/service-auth-test/unsigned", Auth: true, ServiceAuth: true,
+		Handler: func(c echo.Context) error {
+			uid = MustGetGoodooRequest(c).GetUserID()
+			return c.NoContent(http.StatusOK)
+		}}})
+
+	if status := s.do(httptest.NewRequest(http.MethodGet, "/service-auth-test/unsigned", nil), nil); status != http.StatusUnauthorized {
+		t.Errorf("anonymous GET answered %d, want 401", status)
+	}
+	if status := s.do(httptest.NewRequest(http.MethodGet, "/service-auth-test/unsigned", nil), s.login("", 7)); status != http.StatusOK || uid != 7 {
+		t.Errorf("GET with a session answered %d as user %d, want 200 as user 7", status, uid)
+	}
+
+	uid = 0
+	r := httptest.NewRequest(http.MethodGet, "/service-auth-test/unsigned", nil)
+	if err := (&svcauth.Signer{KeyID: "billing", Secret: "s3cret"}).Sign(r); err != nil {
+		t.Fatal(err)
+	}
+	if status := s.do(r, s.login("", 7)); status != http.StatusUnauthorized || uid != 0 {
+		t.Errorf("signed GET without a database answered %d as user %d, want 401", status, uid)
+	}
+}
+
+// TestServiceAuthMiddleware signs requests with a key of the test
+// database: valid ones run as the service user of the key, the others
+// are refused whatever session they carry
+func TestServiceAuthMiddleware(t *testing.T) {
+	env := testutil.NewTestEnvironment(t)
+	dbName := testutil.Unique("service_auth_test")
+	user := env.CreateUser()
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	key := &models.ServiceKey{KeyID: testutil.Unique("billing"), Name: "Billing", Secret: crypto.EncryptedString("0ld"), UserID: user.ID, Active: true}
+	key.Rotate("n3w", time.Hour, now.Add(-time.Hour+time.Minute))
+	if err := env.Tx.Create(key).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	s := newPublicTestServer(t, dbName)
+	clk := clock.NewFake(now)
+	s.config.Clock = clk
+	s.config.ServiceAuth = DefaultServiceAuthConfig()
+	s.config.PermissionsResolver = grantsByUser(map[int][]string{int(user.ID): {PermissionServiceKeysManage}})
+	s.e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			MustGetGoodooRequest(c).Tx = env.Tx
+			return next(c)
+		}
+	})
+	var seen struct {
+		uid   int
+		keyID string
+	}
+	MustRegisterRoutes(s.e, []RouteSpec{{Method: "POST", Path: "/service-auth-test/call", Auth: true, DB: true, ServiceAuth: true,
+		Permission: PermissionServiceKeysManage, Handler: func(c echo.Context) error {
+			req := MustGetGoodooRequest(c)
+			seen.uid, seen.keyID = req.GetUserID(), req.ServiceKeyID
+			return c.NoContent(http.StatusOK)
+		}}})
+
+	tests := []struct {
+		name          string
+		keyID, secret string
+		body          string
+		// sent, when set, replaces the signed body
+		sent string
+		// skew is how far the clock of the client is from the server's
+		skew time.Duration
+		// advance moves the clock of the server before the request
+		advance time.Duration
+		// replay sends the signature of the previous request again
+		replay bool
+		want   int
+	}{
+		{name: "current secret", secret: "n3w", body: `{}`, want: http.StatusOK},
+		{name: "replay", replay: true, body: `{}`, want: http.StatusUnauthorized},
+		{name: "previous secret during the grace period", secret: "0ld", body: `{}`, want: http.StatusOK},
+		{name: "wrong secret", secret: "other", body: `{}`, want: http.StatusUnauthorized},
+		{name: "unknown key", keyID: "unknown", secret: "n3w", body: `{}`, want: http.StatusUnauthorized},
+		{name: "body tampered", secret: "n3w", body: `{"amount": 100}`, sent: `{"amount": 900}`, want: http.StatusUnauthorized},
+		{name: "client ahead within the window", secret: "n3w", skew: svcauth.DefaultWindow - time.Second, want: http.StatusOK},
+		{name: "client behind within the window", secret: "n3w", skew: -svcauth.DefaultWindow + time.Second, want: http.StatusOK},
+		{name: "client too far ahead", secret: "n3w", skew: svcauth.DefaultWindow + time.Second, want: http.StatusUnauthorized},
+		{name: "client too far behind", secret: "n3w", skew: -svcauth.DefaultWindow - time.Second, want: http.StatusUnauthorized},
+		// The grace period of the previous secret ends a minute after now
+		{name: "previous secret once the rotation is over", secret: "0ld", advance: 2 * time.Minute, want: http.StatusUnauthorized},
+		{name: "current secret once the rotation is over", secret: "n3w", want: http.StatusOK},
+	}
+	var previous http.Header
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clk.Advance(tt.advance)
+			sent := tt.body
+			if tt.sent != "" {
+				sent = tt.sent
+			}
+			r := httptest.NewRequest(http.MethodPost, "/service-auth-test/call", strings.NewReader(sent))
+			if tt.replay {
+				r.Header = previous.Clone()
+			} else {
+				keyID := key.KeyID
+				if tt.keyID != "" {
+					keyID = tt.keyID
+				}
+				signed := httptest.NewRequest(http.MethodPost, "/service-auth-test/call", strings.NewReader(tt.body))
+				signer := &svcauth.Signer{KeyID: keyID, Secret: tt.secret, Now: func() time.Time { return clk.Now().Add(tt.skew) }}
+				if err := signer.Sign(signed); err != nil {
+					t.Fatal(err)
+				}
+				r.Header = signed.Header.Clone()
+				previous = signed.Header
+			}
+
+			seen.uid, seen.keyID = 0, ""
+			// The session cookie sent along is ignored
+			if status := s.do(r, s.login(dbName, 99)); status != tt.want {
+				t.Fatalf("POST answered %d, want %d", status, tt.want)
+			}
+			if tt.want == http.StatusOK && (seen.uid != int(user.ID) || seen.keyID != key.KeyID) {
+				t.Errorf("the handler ran as user %d with key %q, want the service user %d with key %s",
+					seen.uid, seen.keyID, user.ID, key.KeyID)
+			}
+		})
+	}
+}
@@ -7,8 +7,12 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
+
+	"goodoo/clock"
 )
 
 // SessionStore interface for session storage backends
@@ -19,6 +23,11 @@ type SessionStore interface {
 	Delete(sid string) error
 	IsValidKey(sid string) bool
 	Cleanup() error
+
+	// UserSessions returns the stored sessions belonging to a user
+	UserSessions(userID int) []*Session
+	// DeleteUserSessions removes every session of a user except exceptSID and returns how many were removed
+	DeleteUserSessions(userID int, exceptSID string) (int, error)
 }
 
 // Session represents a user session with persistent data (like Odoo's Session)
@@ -37,9 +46,21 @@ type Session struct {
 	UserID   int    `json:"user_id,omitempty"`
 	Login    string `json:"login,omitempty"`
 	
+	// ImpersonatorID and ImpersonatorLogin are the administrator acting as
+	// UserID, set while the session is impersonated (see Impersonate)
+	ImpersonatorID    int    `json:"impersonator_id,omitempty"`
+	ImpersonatorLogin string `json:"impersonator_login,omitempty"`
+	
+	// LogOverride lowers the log level of the next requests of the
+	// session, set by an administrator (see SessionLogOverride)
+	LogOverride *SessionLogOverride `json:"log_override,omitempty"`
+	
 	// Context data
 	Context map[string]interface{} `json:"context"`
 	
+	// clock is the clock of the store, nil for the system clock
+	clock clock.Clock
+	
 	mu sync.RWMutex
 }
 
@@ -161,6 +182,8 @@ func (s *Session) Authenticate(dbname, login string, userID int) {
 	s.DBName = dbname
 	s.Login = login
 	s.UserID = userID
+	s.ImpersonatorID = 0
+	s.ImpersonatorLogin = ""
 	s.IsDirty = true
 	
 	// Store in context as well
@@ -181,12 +204,58 @@ func (s *Session) Logout(keepDB bool) {
 	
 	s.UserID = 0
 	s.Login = ""
+	s.ImpersonatorID = 0
+	s.ImpersonatorLogin = ""
 	s.IsDirty = true
 	
 	delete(s.Context, "user_id")
 	delete(s.Context, "login")
 }
 
+// Impersonate switches the session to act as another user, remembering
+// the current user as the impersonator. The database is kept.
+func (s *Session) Impersonate(login string, userID int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	
+	s.ImpersonatorID = s.UserID
+	s.ImpersonatorLogin = s.Login
+	s.UserID = userID
+	s.Login = login
+	s.IsDirty = true
+	
+	s.Context["user_id"] = userID
+	s.Context["login"] = login
+}
+
+// StopImpersonation restores the identity of the impersonator; it returns
+// false when the session is not impersonated
+func (s *Session) StopImpersonation() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	
+	if s.ImpersonatorID == 0 {
+		return false
+	}
+	s.UserID = s.ImpersonatorID
+	s.Login = s.ImpersonatorLogin
+	s.ImpersonatorID = 0
+	s.ImpersonatorLogin = ""
+	s.IsDirty = true
+	
+	s.Context["user_id"] = s.UserID
+	s.Context["login"] = s.Login
+	return true
+}
+
+// IsImpersonated reports whether an administrator acts as the session user
+func (s *Session) IsImpersonated() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	
+	return s.ImpersonatorID != 0
+}
+
 // IsAuthenticated checks if the session has valid authentication
 func (s *Session) IsAuthenticated() bool {
 	s.mu.RLock()
@@ -200,10 +269,18 @@ func (s *Session) Touch() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	
-	s.LastAccessed = time.Now()
+	s.LastAccessed = clock.OrReal(s.clock).Now()
 	s.IsDirty = true
 }
 
+// idle returns how long the session has not been used
+func (s *Session) idle() time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	
+	return clock.OrReal(s.clock).Now().Sub(s.LastAccessed)
+}
+
 // UpdateContext updates the session context
 func (s *Session) UpdateContext(updates map[string]interface{}) {
 	s.mu.Lock()
@@ -227,30 +304,196 @@ func (s *Session) GetContext() map[string]interface{} {
 	return context
 }
 
+// RemoteAddr returns the address of the last request made with this session
+func (s *Session) RemoteAddr() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	
+	addr, _ := s.Context["remote_addr"].(string)
+	return addr
+}
+
+// UserAgent returns the user agent of the last request made with this session
+func (s *Session) UserAgent() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	
+	ua, _ := s.Context["user_agent"].(string)
+	return ua
+}
+
 // FilesystemSessionStore implements SessionStore using filesystem (like Odoo's FilesystemSessionStore)
 type FilesystemSessionStore struct {
 	path         string
 	renewMissing bool
+	clock        clock.Clock
 	mu           sync.RWMutex
+	
+	// In-memory index of user ID to session IDs, rebuilt from disk at startup
+	// and by ReconcileIndex, last at reconciledAt
+	index        *sessionIndex
+	reconciledAt time.Time
+}
+
+// sessionIndex maps users to their session IDs so per-user lookups don't scan every file
+type sessionIndex struct {
+	byUser map[int]map[string]struct{}
+	bySID  map[string]int
+	// entries describe every stored session, anonymous ones included, for
+	// Stats
+	entries map[string]sessionEntry
+	mu      sync.RWMutex
+}
+
+func newSessionIndex() *sessionIndex {
+	return &sessionIndex{
+		byUser:  make(map[int]map[string]struct{}),
+		bySID:   make(map[string]int),
+		entries: make(map[string]sessionEntry),
+	}
 }
 
-// NewFilesystemSessionStore creates a new filesystem session store
-func NewFilesystemSessionStore(path string, renewMissing bool) (*FilesystemSessionStore, error) {
+// set records a stored session, removing any previous owner of its SID
+func (idx *sessionIndex) set(sid string, entry sessionEntry) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	
+	idx.entries[sid] = entry
+	userID := entry.UserID
+	if old, ok := idx.bySID[sid]; ok {
+		if old == userID {
+			return
+		}
+		idx.removeLocked(sid, old)
+	}
+	
+	if userID == 0 {
+		return
+	}
+	
+	if idx.byUser[userID] == nil {
+		idx.byUser[userID] = make(map[string]struct{})
+	}
+	idx.byUser[userID][sid] = struct{}{}
+	idx.bySID[sid] = userID
+}
+
+// remove drops sid from the index
+func (idx *sessionIndex) remove(sid string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	
+	delete(idx.entries, sid)
+	if userID, ok := idx.bySID[sid]; ok {
+		idx.removeLocked(sid, userID)
+	}
+}
+
+func (idx *sessionIndex) removeLocked(sid string, userID int) {
+	delete(idx.bySID, sid)
+	if sids, ok := idx.byUser[userID]; ok {
+		delete(sids, sid)
+		if len(sids) == 0 {
+			delete(idx.byUser, userID)
+		}
+	}
+}
+
+// sessions returns the session IDs of a user
+func (idx *sessionIndex) sessions(userID int) []string {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	
+	sids := make([]string, 0, len(idx.byUser[userID]))
+	for sid := range idx.byUser[userID] {
+		sids = append(sids, sid)
+	}
+	return sids
+}
+
+// NewFilesystemSessionStore creates a new filesystem session store; the ages
+// of sessions are measured with clk, the system clock when nil
+func NewFilesystemSessionStore(path string, renewMissing bool, clk clock.Clock) (*FilesystemSessionStore, error) {
 	// Create directory if it doesn't exist
 	if err := os.MkdirAll(path, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create session directory: %w", err)
 	}
 	
-	return &FilesystemSessionStore{
+	store := &FilesystemSessionStore{
 		path:         path,
 		renewMissing: renewMissing,
-	}, nil
+		clock:        clock.OrReal(clk),
+		index:        newSessionIndex(),
+	}
+	
+	if err := store.rebuildIndex(); err != nil {
+		return nil, fmt.Errorf("failed to build session index: %w", err)
+	}
+	
+	return store, nil
+}
+
+// rebuildIndex scans the session directory once to populate the user index
+func (fs *FilesystemSessionStore) rebuildIndex() error {
+	index, err := fs.scanIndex()
+	if err != nil {
+		return err
+	}
+	fs.index.replace(index)
+	fs.reconciledAt = fs.clock.Now()
+	return nil
+}
+
+// scanIndex reads the index of the session files
+func (fs *FilesystemSessionStore) scanIndex() (*sessionIndex, error) {
+	files, err := filepath.Glob(filepath.Join(fs.path, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	
+	index := newSessionIndex()
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		
+		var stored struct {
+			SID          string    `json:"sid"`
+			UserID       int       `json:"user_id"`
+			DBName       string    `json:"db_name"`
+			LastAccessed time.Time `json:"last_accessed"`
+			Context      struct {
+				UserAgent string `json:"user_agent"`
+			} `json:"context"`
+		}
+		if err := json.Unmarshal(data, &stored); err != nil || stored.SID == "" {
+			continue
+		}
+		index.set(stored.SID, sessionEntry{
+			UserID:       stored.UserID,
+			DBName:       stored.DBName,
+			LastAccessed: stored.LastAccessed,
+			Agent:        UserAgentFamily(stored.Context.UserAgent),
+		})
+	}
+	
+	return index, nil
 }
 
 // New creates a new session with a generated SID
 func (fs *FilesystemSessionStore) New() *Session {
 	sid := generateSessionID()
-	return NewSession(sid)
+	session := NewSession(sid)
+	session.clock = fs.clock
+	session.CreatedAt = fs.clock.Now()
+	session.LastAccessed = session.CreatedAt
+	return session
+}
+
+// Clock returns the clock measuring the ages of sessions
+func (fs *FilesystemSessionStore) Clock() clock.Clock {
+	return fs.clock
 }
 
 // Get retrieves a session by SID
@@ -282,10 +525,11 @@ func (fs *FilesystemSessionStore) Get(sid string) *Session {
 		return nil
 	}
 	
+	// The request touches the session once its idle timeout is checked
 	session.IsNew = false
 	session.IsDirty = false
 	session.CanSave = true
-	session.Touch()
+	session.clock = fs.clock
 	
 	return &session
 }
@@ -308,10 +552,18 @@ func (fs *FilesystemSessionStore) Save(session *Session) error {
 	if err := os.WriteFile(sessionFile, data, 0644); err != nil {
 		return fmt.Errorf("failed to write session file: %w", err)
 	}
+	// The modification time is the last use of the session for
+	// CleanupExpired and EvictSessions
+	now := fs.clock.Now()
+	if err := os.Chtimes(sessionFile, now, now); err != nil {
+		return fmt.Errorf("failed to write session file: %w", err)
+	}
 	
 	session.IsDirty = false
 	session.IsNew = false
 	
+	fs.index.set(session.SID, session.entry())
+	
 	return nil
 }
 
@@ -320,15 +572,81 @@ func (fs *FilesystemSessionStore) Delete(sid string) error {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 	
+	fs.index.remove(sid)
+	
 	sessionFile := filepath.Join(fs.path, sid+".json")
 	return os.Remove(sessionFile)
 }
 
+// AuthenticatedCount returns the number of stored sessions holding a login
+func (fs *FilesystemSessionStore) AuthenticatedCount() int {
+	fs.index.mu.RLock()
+	defer fs.index.mu.RUnlock()
+	return len(fs.index.bySID)
+}
+
+// UserSessions returns the stored sessions belonging to a user
+func (fs *FilesystemSessionStore) UserSessions(userID int) []*Session {
+	var sessions []*Session
+	
+	for _, sid := range fs.index.sessions(userID) {
+		session := fs.load(sid)
+		if session == nil || session.UserID != userID {
+			// Stale index entry, the file was removed or changed hands
+			fs.index.remove(sid)
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+	
+	return sessions
+}
+
+// DeleteUserSessions removes every session of a user except exceptSID
+func (fs *FilesystemSessionStore) DeleteUserSessions(userID int, exceptSID string) (int, error) {
+	removed := 0
+	
+	for _, sid := range fs.index.sessions(userID) {
+		if sid == exceptSID {
+			continue
+		}
+		if err := fs.Delete(sid); err != nil && !os.IsNotExist(err) {
+			return removed, fmt.Errorf("failed to delete session %s: %w", sid[:8], err)
+		}
+		removed++
+	}
+	
+	return removed, nil
+}
+
+// load reads a session file without touching it
+func (fs *FilesystemSessionStore) load(sid string) *Session {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	
+	data, err := os.ReadFile(filepath.Join(fs.path, sid+".json"))
+	if err != nil {
+		return nil
+	}
+	
+	var session Session
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil
+	}
+	session.IsNew = false
+	session.CanSave = true
+	
+	return &session
+}
+
 // IsValidKey checks if a session ID is valid
 func (fs *FilesystemSessionStore) IsValidKey(sid string) bool {
 	if len(sid) != 64 { // 32 bytes = 64 hex chars
 		return false
 	}
+	if _, err := hex.DecodeString(sid); err != nil {
+		return false
+	}
 	
 	// Check if file exists
 	sessionFile := filepath.Join(fs.path, sid+".json")
@@ -338,13 +656,24 @@ func (fs *FilesystemSessionStore) IsValidKey(sid string) bool {
 
 // Cleanup removes expired sessions
 func (fs *FilesystemSessionStore) Cleanup() error {
+	_, err := fs.CleanupExpired()
+	return err
+}
+
+// CleanupExpired removes expired sessions and returns how many were removed
+func (fs *FilesystemSessionStore) CleanupExpired() (int, error) {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 	
 	maxAge := 24 * time.Hour // Sessions expire after 24 hours
-	cutoff := time.Now().Add(-maxAge)
+	cutoff := fs.clock.Now().Add(-maxAge)
+	removed := 0
 	
-	return filepath.Walk(fs.path, func(path string, info os.FileInfo, err error) error {
+	err := filepath.Walk(fs.path, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			// Deleted meanwhile, e.g. by a logout
+			return nil
+		}
 		if err != nil {
 			return err
 		}
@@ -354,11 +683,84 @@ func (fs *FilesystemSessionStore) Cleanup() error {
 		}
 		
 		if info.ModTime().Before(cutoff) {
-			return os.Remove(path)
+			fs.index.remove(strings.TrimSuffix(filepath.Base(path), ".json"))
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			removed++
 		}
 		
 		return nil
 	})
+	return removed, err
+}
+
+// Path returns the directory of the session files
+func (fs *FilesystemSessionStore) Path() string {
+	return fs.path
+}
+
+// EvictSessions removes the least recently used sessions until at most
+// maxFiles remain: anonymous sessions first, then authenticated sessions
+// idle for longer than idleTimeout. Authenticated sessions used within
+// idleTimeout are never removed, so fewer may remain removable than asked.
+// The modification time of a file is its last use, since every request
+// saves its session.
+func (fs *FilesystemSessionStore) EvictSessions(maxFiles int, idleTimeout time.Duration) (int, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	
+	entries, err := os.ReadDir(fs.path)
+	if err != nil {
+		return 0, err
+	}
+	type candidate struct {
+		sid           string
+		modTime       time.Time
+		authenticated bool
+	}
+	var candidates []candidate
+	count := 0
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		count++
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		sid := strings.TrimSuffix(entry.Name(), ".json")
+		fs.index.mu.RLock()
+		_, authenticated := fs.index.bySID[sid]
+		fs.index.mu.RUnlock()
+		if authenticated && fs.clock.Now().Sub(info.ModTime()) < idleTimeout {
+			continue
+		}
+		candidates = append(candidates, candidate{sid: sid, modTime: info.ModTime(), authenticated: authenticated})
+	}
+	if count <= maxFiles {
+		return 0, nil
+	}
+	
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].authenticated != candidates[j].authenticated {
+			return !candidates[i].authenticated
+		}
+		return candidates[i].modTime.Before(candidates[j].modTime)
+	})
+	removed := 0
+	for _, candidate := range candidates {
+		if count-removed <= maxFiles {
+			break
+		}
+		fs.index.remove(candidate.sid)
+		if err := os.Remove(filepath.Join(fs.path, candidate.sid+".json")); err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
 }
 
 // Helper functions
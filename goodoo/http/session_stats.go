@@ -0,0 +1,209 @@
+package http
+
+import (
+	"strings"
+	"time"
+)
+
+// sessionEntry is what the session index knows of a stored session
+type sessionEntry struct {
+	UserID       int
+	DBName       string
+	LastAccessed time.Time
+	// Agent is the user agent family of the last request
+	Agent string
+}
+
+// entry describes the session for the index
+func (s *Session) entry() sessionEntry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ua, _ := s.Context["user_agent"].(string)
+	return sessionEntry{
+		UserID:       s.UserID,
+		DBName:       s.DBName,
+		LastAccessed: s.LastAccessed,
+		Agent:        UserAgentFamily(ua),
+	}
+}
+
+// replace swaps the content of the index with other's and returns how many
+// sessions differed: missing from one side, or owned by another user
+func (idx *sessionIndex) replace(other *sessionIndex) int {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	drift := 0
+	for sid, entry := range other.entries {
+		if current, ok := idx.entries[sid]; !ok || current.UserID != entry.UserID {
+			drift++
+		}
+	}
+	for sid := range idx.entries {
+		if _, ok := other.entries[sid]; !ok {
+			drift++
+		}
+	}
+	idx.byUser, idx.bySID, idx.entries = other.byUser, other.bySID, other.entries
+	return drift
+}
+
+// userAgentFamilies map a marker of the User-Agent header to its family,
+// the first match winning: Edge and Opera also announce Chrome, which also
+// announces Safari
+var userAgentFamilies = []struct{ marker, family string }{
+	{"bot", "Bot"}, {"spider", "Bot"}, {"crawl", "Bot"},
+	{"edg/", "Edge"}, {"edga/", "Edge"}, {"edgios/", "Edge"},
+	{"opr/", "Opera"}, {"opera", "Opera"},
+	{"chrome/", "Chrome"}, {"crios/", "Chrome"}, {"chromium/", "Chrome"},
+	{"firefox/", "Firefox"}, {"fxios/", "Firefox"},
+	{"safari/", "Safari"},
+	{"curl/", "curl"}, {"go-http-client", "Go"}, {"python", "Python"},
+	{"postmanruntime", "Postman"},
+}
+
+// UserAgentFamily returns the browser or client family of a User-Agent
+// header: Chrome, Firefox, Safari, Edge, Opera, Bot, curl, Go, Python,
+// Postman, Other, or Unknown when it is empty
+func UserAgentFamily(userAgent string) string {
+	ua := strings.ToLower(strings.TrimSpace(userAgent))
+	if ua == "" {
+		return "Unknown"
+	}
+	for _, f := range userAgentFamilies {
+		if strings.Contains(ua, f.marker) {
+			return f.family
+		}
+	}
+	return "Other"
+}
+
+// SessionActivityWindows are the periods unique active users are counted
+// over, by label
+var SessionActivityWindows = []struct {
+	Label    string
+	Duration time.Duration
+}{
+	{"15m", 15 * time.Minute},
+	{"1h", time.Hour},
+	{"24h", 24 * time.Hour},
+}
+
+// SessionStats describes the stored sessions
+type SessionStats struct {
+	// Database is the database the sessions were filtered on, empty for
+	// every session
+	Database      string `json:"database,omitempty"`
+	Total         int    `json:"total"`
+	Authenticated int    `json:"authenticated"`
+	Anonymous     int    `json:"anonymous"`
+	// ActiveUsers counts the distinct users with a session used within each
+	// of SessionActivityWindows
+	ActiveUsers map[string]int `json:"active_users"`
+	// SessionsPerUser counts the users by number of sessions: "1", "2",
+	// "3-5" and "6+"
+	SessionsPerUser map[string]int `json:"sessions_per_user"`
+	MaxUserSessions int            `json:"max_user_sessions"`
+	// UserAgents counts the sessions by user agent family
+	UserAgents map[string]int `json:"user_agents"`
+	// ReconciledAt is the last time the index was checked against the
+	// session files
+	ReconciledAt time.Time `json:"reconciled_at"`
+	ComputedAt   time.Time `json:"computed_at"`
+}
+
+// SessionStatsSource is a session store able to describe its sessions
+type SessionStatsSource interface {
+	Stats(dbName string) SessionStats
+}
+
+// sessionsPerUserBucket names the bucket of a number of sessions
+func sessionsPerUserBucket(count int) string {
+	switch {
+	case count <= 1:
+		return "1"
+	case count == 2:
+		return "2"
+	case count <= 5:
+		return "3-5"
+	}
+	return "6+"
+}
+
+// Stats describes the stored sessions of dbName, or of every database when
+// empty, from the index: no session file is read
+func (fs *FilesystemSessionStore) Stats(dbName string) SessionStats {
+	now := fs.clock.Now()
+	stats := SessionStats{
+		Database:        dbName,
+		ActiveUsers:     make(map[string]int, len(SessionActivityWindows)),
+		SessionsPerUser: map[string]int{"1": 0, "2": 0, "3-5": 0, "6+": 0},
+		UserAgents:      make(map[string]int),
+		ComputedAt:      now,
+	}
+	// Users are told apart by database, since IDs are per database
+	type user struct {
+		db string
+		id int
+	}
+	lastSeen := make(map[user]time.Time)
+	sessions := make(map[user]int)
+
+	fs.index.mu.RLock()
+	for _, entry := range fs.index.entries {
+		if dbName != "" && entry.DBName != dbName {
+			continue
+		}
+		stats.Total++
+		stats.UserAgents[entry.Agent]++
+		if entry.UserID == 0 {
+			stats.Anonymous++
+			continue
+		}
+		stats.Authenticated++
+		u := user{entry.DBName, entry.UserID}
+		sessions[u]++
+		if entry.LastAccessed.After(lastSeen[u]) {
+			lastSeen[u] = entry.LastAccessed
+		}
+	}
+	fs.index.mu.RUnlock()
+
+	for _, window := range SessionActivityWindows {
+		stats.ActiveUsers[window.Label] = 0
+	}
+	for _, seen := range lastSeen {
+		for _, window := range SessionActivityWindows {
+			if now.Sub(seen) <= window.Duration {
+				stats.ActiveUsers[window.Label]++
+			}
+		}
+	}
+	for _, count := range sessions {
+		stats.SessionsPerUser[sessionsPerUserBucket(count)]++
+		if count > stats.MaxUserSessions {
+			stats.MaxUserSessions = count
+		}
+	}
+
+	fs.mu.RLock()
+	stats.ReconciledAt = fs.reconciledAt
+	fs.mu.RUnlock()
+	return stats
+}
+
+// ReconcileIndex rebuilds the index from the session files, catching the
+// files changed or removed behind the store, e.g. by another process, and
+// returns how many sessions were out of date
+func (fs *FilesystemSessionStore) ReconcileIndex() (int, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	index, err := fs.scanIndex()
+	if err != nil {
+		return 0, err
+	}
+	fs.reconciledAt = fs.clock.Now()
+	return fs.index.replace(index), nil
+}
@@ -0,0 +1,121 @@
+package http
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"goodoo/clock"
+)
+
+// useClock moves the server to a session store, and a config, following
+// clk
+func (s *publicTestServer) useClock(clk clock.Clock) {
+	store, err := NewFilesystemSessionStore(s.t.TempDir(), false, clk)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	s.store = store
+	s.config.SessionStore = store
+	s.config.Clock = clk
+}
+
+// TestSessionIdleTimeout logs out a session left idle longer than the
+// timeout of its database, while each request keeps an active one alive
+func TestSessionIdleTimeout(t *testing.T) {
+	fake := clock.NewFake(time.Date(2026, 10, 15, 9, 0, 0, 0, time.UTC))
+	s := newPublicTestServer(t, "session_test")
+	s.useClock(fake)
+	s.config.SessionTimeoutResolver = func(dbName string) time.Duration { return 30 * time.Minute }
+	var authenticated bool
+	MustRegisterRoutes(s.e, []RouteSpec{{Method: "GET", Path: "/session-test", Handler: func(c echo.Context) error {
+		authenticated = MustGetGoodooRequest(c).IsAuthenticated()
+		return c.NoContent(http.StatusOK)
+	}}})
+	cookie := s.login("session_test", 7)
+
+	for _, step := range []struct {
+		idle time.Duration
+		want bool
+	}{
+		{20 * time.Minute, true},
+		// An hour after login, but 20 minutes after the last request
+		{20 * time.Minute, true},
+		{30 * time.Minute, true},
+		{30*time.Minute + time.Second, false},
+		// Logged out for good, not only for one request
+		{0, false},
+	} {
+		fake.Advance(step.idle)
+		if status := s.get("/session-test", "192.0.2.1:1000", cookie); status != http.StatusOK {
+			t.Fatalf("GET answered %d", status)
+		}
+		if authenticated != step.want {
+			t.Errorf("authenticated after %v idle: %v, want %v", step.idle, authenticated, step.want)
+		}
+	}
+}
+
+// TestCleanupExpired removes the sessions unused for a day by the clock of
+// the store
+func TestCleanupExpired(t *testing.T) {
+	fake := clock.NewFake(time.Date(2026, 10, 15, 9, 0, 0, 0, time.UTC))
+	store, err := NewFilesystemSessionStore(t.TempDir(), false, fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := store.New()
+	old.Authenticate("session_test", "old", 7)
+	if err := store.Save(old); err != nil {
+		t.Fatal(err)
+	}
+	fake.Advance(12 * time.Hour)
+	recent := store.New()
+	recent.Authenticate("session_test", "recent", 8)
+	if err := store.Save(recent); err != nil {
+		t.Fatal(err)
+	}
+
+	fake.Advance(12*time.Hour + time.Second)
+	if removed, err := store.CleanupExpired(); err != nil || removed != 1 {
+		t.Fatalf("CleanupExpired = %d, %v; want 1", removed, err)
+	}
+	if store.Get(old.SID) != nil {
+		t.Error("the session unused for a day is kept")
+	}
+	if store.Get(recent.SID) == nil {
+		t.Error("the session used 12 hours ago is removed")
+	}
+}
+
+// TestSessionCleanupMiddleware runs the cleanup on each tick of the clock
+// of the store
+func TestSessionCleanupMiddleware(t *testing.T) {
+	fake := clock.NewFake(time.Date(2026, 10, 15, 9, 0, 0, 0, time.UTC))
+	store, err := NewFilesystemSessionStore(t.TempDir(), false, fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := store.New()
+	session.Authenticate("session_test", "user", 7)
+	if err := store.Save(session); err != nil {
+		t.Fatal(err)
+	}
+	runs := make(chan int, 1)
+	SessionCleanupMiddleware(store, time.Hour, func(removed int, err error) {
+		if err != nil {
+			t.Error(err)
+		}
+		runs <- removed
+	})
+
+	fake.Advance(time.Hour)
+	if removed := <-runs; removed != 0 {
+		t.Errorf("the first run removed %d session(s), want 0", removed)
+	}
+	fake.Advance(24 * time.Hour)
+	if removed := <-runs; removed != 1 {
+		t.Errorf("the run a day later removed %d session(s), want 1", removed)
+	}
+}
@@ -0,0 +1,215 @@
+package http
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// fingerprintLength is the number of hex characters of the content hash kept in URLs
+	fingerprintLength = 10
+
+	immutableCacheControl = "public, max-age=31536000, immutable"
+	plainCacheControl     = "public, max-age=300"
+	devCacheControl       = "no-cache"
+)
+
+// fingerprintPattern matches the hash segment inserted before the extension, e.g. app.3fa9c2e1b0.js
+var fingerprintPattern = regexp.MustCompile(`^(.*)\.([0-9a-f]{10})(\.[^./]+)$`)
+
+// assetInfo caches the content hash of a single static file
+type assetInfo struct {
+	hash string
+}
+
+// StaticAssets serves files from a directory with content fingerprinting and cache headers
+type StaticAssets struct {
+	root    string
+	prefix  string
+	devMode bool
+
+	mu     sync.RWMutex
+	assets map[string]*assetInfo
+}
+
+// NewStaticAssets creates a static asset handler serving root under the URL prefix.
+// In dev mode fingerprints are not cached and every response is revalidated.
+func NewStaticAssets(root, prefix string, devMode bool) *StaticAssets {
+	return &StaticAssets{
+		root:    root,
+		prefix:  "/" + strings.Trim(prefix, "/"),
+		devMode: devMode,
+		assets:  make(map[string]*assetInfo),
+	}
+}
+
+// Register mounts the asset handler on the Echo instance
+func (s *StaticAssets) Register(e *echo.Echo) {
+	e.GET(s.prefix+"/*", s.Handler)
+	e.HEAD(s.prefix+"/*", s.Handler)
+	// Assets are served without the Goodoo request
+	markRequestFree(http.MethodGet, s.prefix+"/*")
+	markRequestFree(http.MethodHead, s.prefix+"/*")
+}
+
+// Precompute hashes every file under the root so the first requests don't pay for it
+func (s *StaticAssets) Precompute() error {
+	if s.devMode {
+		return nil
+	}
+
+	return filepath.Walk(s.root, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+		_, err = s.lookup(filepath.ToSlash(rel))
+		return err
+	})
+}
+
+// Asset returns the fingerprinted URL for a static path, or the plain URL if it cannot be hashed
+func (s *StaticAssets) Asset(name string) string {
+	rel := strings.TrimPrefix(strings.TrimPrefix(name, s.prefix), "/")
+	plain := s.prefix + "/" + rel
+
+	if s.devMode {
+		return plain
+	}
+
+	info, err := s.lookup(rel)
+	if err != nil {
+		return plain
+	}
+
+	ext := path.Ext(rel)
+	return fmt.Sprintf("%s/%s.%s%s", s.prefix, strings.TrimSuffix(rel, ext), info.hash, ext)
+}
+
+// FuncMap exposes the asset() function to html templates
+func (s *StaticAssets) FuncMap() template.FuncMap {
+	return template.FuncMap{
+		"asset": s.Asset,
+	}
+}
+
+// Handler serves plain and fingerprinted asset URLs
+func (s *StaticAssets) Handler(c echo.Context) error {
+	rel := strings.TrimPrefix(path.Clean("/"+c.Param("*")), "/")
+	if rel == "" || rel == "." {
+		return echo.ErrNotFound
+	}
+
+	requestedHash := ""
+	if _, err := os.Stat(s.filePath(rel)); err != nil {
+		// Not a real file, try to strip a fingerprint
+		m := fingerprintPattern.FindStringSubmatch(rel)
+		if m == nil {
+			return echo.ErrNotFound
+		}
+		rel = m[1] + m[3]
+		requestedHash = m[2]
+	}
+
+	file, err := os.Open(s.filePath(rel))
+	if err != nil {
+		return echo.ErrNotFound
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil || stat.IsDir() {
+		return echo.ErrNotFound
+	}
+
+	info, err := s.lookup(rel)
+	if err != nil {
+		return echo.ErrNotFound
+	}
+
+	header := c.Response().Header()
+	switch {
+	case s.devMode:
+		header.Set("Cache-Control", devCacheControl)
+	case requestedHash != "" && requestedHash == info.hash:
+		header.Set("Cache-Control", immutableCacheControl)
+	default:
+		// Plain URL or stale fingerprint: serve current content but keep it revalidating
+		header.Set("Cache-Control", plainCacheControl)
+	}
+	header.Set("ETag", `"`+info.hash+`"`)
+
+	http.ServeContent(c.Response(), c.Request(), stat.Name(), stat.ModTime(), file)
+	return nil
+}
+
+// lookup returns the cached hash for a file, computing it on first use
+func (s *StaticAssets) lookup(rel string) (*assetInfo, error) {
+	stat, err := os.Stat(s.filePath(rel))
+	if err != nil {
+		return nil, err
+	}
+	if stat.IsDir() {
+		return nil, fmt.Errorf("%s is a directory", rel)
+	}
+
+	if !s.devMode {
+		s.mu.RLock()
+		info, ok := s.assets[rel]
+		s.mu.RUnlock()
+		if ok {
+			return info, nil
+		}
+	}
+
+	hash, err := hashFile(s.filePath(rel))
+	if err != nil {
+		return nil, err
+	}
+
+	info := &assetInfo{hash: hash}
+
+	if !s.devMode {
+		s.mu.Lock()
+		s.assets[rel] = info
+		s.mu.Unlock()
+	}
+
+	return info, nil
+}
+
+// filePath maps a cleaned relative URL path to a file below the root
+func (s *StaticAssets) filePath(rel string) string {
+	return filepath.Join(s.root, filepath.FromSlash(path.Clean("/"+rel)))
+}
+
+// hashFile returns the truncated sha256 of a file's contents
+func hashFile(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil))[:fingerprintLength], nil
+}
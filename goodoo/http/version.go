@@ -0,0 +1,234 @@
+package http
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// API versions. The unversioned /api paths are deprecated aliases of v1.
+const (
+	APIVersion1 = "v1"
+	APIVersion2 = "v2"
+)
+
+// HeaderAPIVersion selects the API version of a request to an unversioned path
+const HeaderAPIVersion = "X-API-Version"
+
+// apiVersionKey is the echo context key of the version named in the path
+const apiVersionKey = "goodoo.api_version"
+
+// APIVersionConfig configures APIVersionMiddleware
+type APIVersionConfig struct {
+	// Versions are the versions served; the path and header name them
+	Versions []string
+	// Default is the version of requests naming none
+	Default string
+	// Sunset is when the unversioned /api paths stop being served
+	Sunset time.Time
+}
+
+// DefaultAPIVersionConfig returns v1 and v2, v1 by default, with the
+// unversioned paths sunset on 2027-06-30
+func DefaultAPIVersionConfig() *APIVersionConfig {
+	return &APIVersionConfig{
+		Versions: []string{APIVersion1, APIVersion2},
+		Default:  APIVersion1,
+		Sunset:   time.Date(2027, time.June, 30, 0, 0, 0, 0, time.UTC),
+	}
+}
+
+// LoadFromEnv overrides the sunset with GOODOO_API_SUNSET (YYYY-MM-DD)
+func (c *APIVersionConfig) LoadFromEnv() {
+	if value := os.Getenv("GOODOO_API_SUNSET"); value != "" {
+		if sunset, err := time.Parse("2006-01-02", value); err == nil {
+			c.Sunset = sunset
+		}
+	}
+}
+
+// supports reports whether version is served
+func (c *APIVersionConfig) supports(version string) bool {
+	for _, candidate := range c.Versions {
+		if candidate == version {
+			return true
+		}
+	}
+	return false
+}
+
+// splitAPIVersion returns the version of a /api/vN/... path and the path
+// without it, or "" when the path names no version
+func splitAPIVersion(path string) (string, string) {
+	rest, ok := strings.CutPrefix(path, "/api/v")
+	if !ok {
+		return "", path
+	}
+	number, tail, _ := strings.Cut(rest, "/")
+	if number == "" || strings.Trim(number, "0123456789") != "" {
+		return "", path
+	}
+	return "v" + number, "/api/" + tail
+}
+
+// APIVersionMiddleware serves the versioned API. /api/v1/... paths are
+// routed to the v1 handlers, mounted on the unversioned paths; other
+// versions are routed to the routes registered under their own prefix.
+// Unversioned /api paths answer with Deprecation, Sunset and a Link to
+// their v1 successor. Use it with echo's Pre so it runs before routing.
+func APIVersionMiddleware(config *APIVersionConfig) echo.MiddlewareFunc {
+	if config == nil {
+		config = DefaultAPIVersionConfig()
+	}
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			request := c.Request()
+			path := request.URL.Path
+			if !strings.HasPrefix(path, "/api/") {
+				return next(c)
+			}
+
+			version, unversioned := splitAPIVersion(path)
+			switch {
+			case version == "":
+				header := c.Response().Header()
+				header.Set("Deprecation", "true")
+				if !config.Sunset.IsZero() {
+					header.Set("Sunset", config.Sunset.UTC().Format(http.TimeFormat))
+				}
+				header.Add("Link", fmt.Sprintf(`<%s>; rel="successor-version"`, "/api/"+APIVersion1+strings.TrimPrefix(path, "/api")))
+			case !config.supports(version):
+				return c.JSON(http.StatusNotFound, map[string]string{"error": "Unknown API version " + version})
+			case version == APIVersion1:
+				request.URL.Path = unversioned
+				if request.URL.RawPath != "" {
+					_, request.URL.RawPath = splitAPIVersion(request.URL.RawPath)
+				}
+			}
+			if version != "" {
+				c.Set(apiVersionKey, version)
+			}
+			return next(c)
+		}
+	}
+}
+
+// APIVersion negotiates the API version of the request: the version of
+// the path, else a supported X-API-Version header, else the default one
+func (r *Request) APIVersion() string {
+	if version, ok := r.Echo.Get(apiVersionKey).(string); ok && version != "" {
+		return version
+	}
+	config := DefaultAPIVersionConfig()
+	if r.config != nil && r.config.APIVersion != nil {
+		config = r.config.APIVersion
+	}
+	if version := strings.ToLower(strings.TrimSpace(r.HTTPRequest.Header.Get(HeaderAPIVersion))); config.supports(version) {
+		return version
+	}
+	return config.Default
+}
+
+// routeVersions returns the API versions a spec is available in, nil for
+// routes outside /api; an unversioned /api route is a v1 route
+func routeVersions(spec RouteSpec) []string {
+	if !strings.HasPrefix(spec.Path, "/api/") {
+		return nil
+	}
+	if len(spec.Versions) > 0 {
+		return spec.Versions
+	}
+	return []string{APIVersion1}
+}
+
+// checkRouteVersion fails when a route is mounted on a version it is not
+// available in: an unversioned /api route is mounted on v1, a /api/vN
+// route on vN
+func checkRouteVersion(spec RouteSpec) error {
+	versions := routeVersions(spec)
+	if versions == nil {
+		return nil
+	}
+	mounted, _ := splitAPIVersion(spec.Path)
+	if mounted == "" {
+		mounted = APIVersion1
+	}
+	for _, version := range versions {
+		if version == mounted {
+			return nil
+		}
+	}
+	return fmt.Errorf("route %s %s is mounted on %s but only available in %s",
+		spec.Method, spec.Path, mounted, strings.Join(versions, ", "))
+}
+
+// APIRouteTable returns the /api routes of e served in an API version,
+// with their versioned path: the unversioned routes are those of v1. It is
+// the source of the API description of each version.
+func APIRouteTable(e *echo.Echo, version string) []RouteInfo {
+	var routes []RouteInfo
+	for _, route := range RouteTable(e) {
+		if !strings.HasPrefix(route.Path, "/api/") {
+			continue
+		}
+		mounted, unversioned := splitAPIVersion(route.Path)
+		switch {
+		case mounted == "" && version == APIVersion1:
+			route.Path = "/api/" + APIVersion1 + strings.TrimPrefix(unversioned, "/api")
+		case mounted == "" || mounted != version:
+			continue
+		}
+		routes = append(routes, route)
+	}
+	return routes
+}
+
+// VersionShim adapts a newer handler to an older API version, so the older
+// version does not fork the business logic. Request rewrites the request
+// before the handler runs; Response rewrites the status and body the
+// handler answered. Either may be nil.
+type VersionShim struct {
+	Request  func(c echo.Context) error
+	Response func(c echo.Context, status int, body []byte) (int, []byte, error)
+}
+
+// ShimHandler serves an older API version with handler, transforming the
+// request and response shapes with shim
+func ShimHandler(handler echo.HandlerFunc, shim VersionShim) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if shim.Request != nil {
+			if err := shim.Request(c); err != nil {
+				return err
+			}
+		}
+		if shim.Response == nil {
+			return handler(c)
+		}
+
+		response := c.Response()
+		writer := response.Writer
+		buffer := &bufferedResponse{ResponseWriter: writer, status: http.StatusOK}
+		response.Writer = buffer
+		err := handler(c)
+		response.Writer = writer
+		if err != nil {
+			response.Committed = false
+			return err
+		}
+
+		status, body, err := shim.Response(c, buffer.status, buffer.body.Bytes())
+		if err != nil {
+			response.Committed = false
+			return err
+		}
+		response.Header().Del(echo.HeaderContentLength)
+		response.Committed, response.Size = false, 0
+		response.WriteHeader(status)
+		_, err = response.Write(body)
+		return err
+	}
+}
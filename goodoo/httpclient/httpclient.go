@@ -0,0 +1,299 @@
+// Package httpclient builds the HTTP clients goodoo uses to call other
+// systems: LLM providers, webhook receivers, identity providers and health
+// probes. Every client shares one transport that honors HTTP_PROXY,
+// HTTPS_PROXY and NO_PROXY, pins the CA bundle and presents the client
+// certificate configured for internal hosts, retries idempotent requests,
+// opens a circuit per host after consecutive failures, forwards the
+// request ID and counts the calls of each host.
+package httpclient
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"goodoo/logging"
+)
+
+// Purposes of outbound calls, each with its own timeout
+const (
+	PurposeLLM     = "llm"
+	PurposeWebhook = "webhook"
+	PurposeOIDC    = "oidc"
+	PurposeHealth  = "health"
+)
+
+// RequestIDHeader carries the ID of the request that caused a call, so the
+// logs of both systems can be matched
+const RequestIDHeader = "X-Request-ID"
+
+// Config holds the outbound HTTP settings
+type Config struct {
+	// Timeout bounds a call, retries included, for purposes without their
+	// own timeout in Timeouts
+	Timeout  time.Duration
+	Timeouts map[string]time.Duration
+	// InternalHosts are the hosts of internal services, e.g. "llm.corp" or
+	// ".corp" for its subdomains; calls to them trust CAFile only and
+	// present the certificate of CertFile and KeyFile when set
+	InternalHosts []string
+	CAFile        string
+	CertFile      string
+	KeyFile       string
+	// MaxIdleConns and MaxIdleConnsPerHost bound the idle connections
+	// kept; MaxConnsPerHost bounds the connections to a host, 0 for no limit
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+	// MaxRetries is how many times an idempotent request is retried after
+	// a network error or a 429, 502, 503 or 504 answer. RetryBackoff is the
+	// first delay, doubled on each retry with jitter; a Retry-After longer
+	// than MaxRetryWait is not waited for.
+	MaxRetries   int
+	RetryBackoff time.Duration
+	MaxRetryWait time.Duration
+	// BreakerThreshold consecutive failures of a host open its circuit:
+	// calls fail at once for BreakerCooldown, then one trial call decides
+	// whether it closes again
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+}
+
+// DefaultConfig returns calls bounded by 30 seconds (10 for webhooks and
+// identity providers, 5 for health probes), 2 retries from 500ms, and
+// circuits opened for 30 seconds after 5 consecutive failures
+func DefaultConfig() *Config {
+	return &Config{
+		Timeout: 30 * time.Second,
+		Timeouts: map[string]time.Duration{
+			PurposeLLM:     30 * time.Second,
+			PurposeWebhook: 10 * time.Second,
+			PurposeOIDC:    10 * time.Second,
+			PurposeHealth:  5 * time.Second,
+		},
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 10,
+		MaxConnsPerHost:     32,
+		MaxRetries:          2,
+		RetryBackoff:        500 * time.Millisecond,
+		MaxRetryWait:        10 * time.Second,
+		BreakerThreshold:    5,
+		BreakerCooldown:     30 * time.Second,
+	}
+}
+
+// LoadFromEnv overrides the configuration with GOODOO_OUTBOUND_* variables;
+// GOODOO_OUTBOUND_TIMEOUT_<PURPOSE> sets the timeout of a purpose
+func (c *Config) LoadFromEnv() {
+	durations := map[string]*time.Duration{
+		"GOODOO_OUTBOUND_TIMEOUT":          &c.Timeout,
+		"GOODOO_OUTBOUND_RETRY_BACKOFF":    &c.RetryBackoff,
+		"GOODOO_OUTBOUND_MAX_RETRY_WAIT":   &c.MaxRetryWait,
+		"GOODOO_OUTBOUND_BREAKER_COOLDOWN": &c.BreakerCooldown,
+	}
+	for name, target := range durations {
+		if value := os.Getenv(name); value != "" {
+			if d, err := time.ParseDuration(value); err == nil && d > 0 {
+				*target = d
+			}
+		}
+	}
+	for _, purpose := range []string{PurposeLLM, PurposeWebhook, PurposeOIDC, PurposeHealth} {
+		if value := os.Getenv("GOODOO_OUTBOUND_TIMEOUT_" + strings.ToUpper(purpose)); value != "" {
+			if d, err := time.ParseDuration(value); err == nil && d > 0 {
+				if c.Timeouts == nil {
+					c.Timeouts = make(map[string]time.Duration)
+				}
+				c.Timeouts[purpose] = d
+			}
+		}
+	}
+
+	counts := map[string]*int{
+		"GOODOO_OUTBOUND_MAX_CONNS_PER_HOST": &c.MaxConnsPerHost,
+		"GOODOO_OUTBOUND_MAX_RETRIES":        &c.MaxRetries,
+		"GOODOO_OUTBOUND_BREAKER_THRESHOLD":  &c.BreakerThreshold,
+	}
+	for name, target := range counts {
+		if value := os.Getenv(name); value != "" {
+			if count, err := strconv.Atoi(value); err == nil && count >= 0 {
+				*target = count
+			}
+		}
+	}
+
+	if value := os.Getenv("GOODOO_OUTBOUND_INTERNAL_HOSTS"); value != "" {
+		c.InternalHosts = nil
+		for _, host := range strings.Split(value, ",") {
+			if host = strings.TrimSpace(host); host != "" {
+				c.InternalHosts = append(c.InternalHosts, strings.ToLower(host))
+			}
+		}
+	}
+	if value := os.Getenv("GOODOO_OUTBOUND_CA_FILE"); value != "" {
+		c.CAFile = value
+	}
+	if value := os.Getenv("GOODOO_OUTBOUND_CERT_FILE"); value != "" {
+		c.CertFile = value
+	}
+	if value := os.Getenv("GOODOO_OUTBOUND_KEY_FILE"); value != "" {
+		c.KeyFile = value
+	}
+}
+
+// timeout returns the timeout of a purpose
+func (c *Config) timeout(purpose string) time.Duration {
+	if timeout, ok := c.Timeouts[purpose]; ok && timeout > 0 {
+		return timeout
+	}
+	return c.Timeout
+}
+
+// internal reports whether host is one of the InternalHosts
+func (c *Config) internal(host string) bool {
+	host = strings.ToLower(host)
+	for _, internal := range c.InternalHosts {
+		if strings.HasPrefix(internal, ".") {
+			if strings.HasSuffix(host, internal) || host == internal[1:] {
+				return true
+			}
+		} else if host == internal {
+			return true
+		}
+	}
+	return false
+}
+
+// newTransport returns a pooled transport using the proxy of the
+// environment, with the TLS settings of tlsConfig
+func (c *Config) newTransport(tlsConfig *tls.Config) *http.Transport {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          c.MaxIdleConns,
+		MaxIdleConnsPerHost:   c.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       c.MaxConnsPerHost,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
+// internalTLS returns the TLS settings of the internal hosts, or nil when
+// neither a CA bundle nor a client certificate is configured
+func (c *Config) internalTLS() (*tls.Config, error) {
+	if c.CAFile == "" && c.CertFile == "" && c.KeyFile == "" {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in CA bundle %s", c.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		if c.CertFile == "" || c.KeyFile == "" {
+			return nil, fmt.Errorf("client certificate needs both a certificate and a key file")
+		}
+		certificate, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return tlsConfig, nil
+}
+
+var (
+	config  = DefaultConfig()
+	current *transport
+	mutex   sync.Mutex
+	logger  = logging.GetLogger("goodoo.httpclient")
+)
+
+// Setup installs the process-wide outbound configuration. It fails when
+// the CA bundle or the client certificate cannot be loaded.
+func Setup(c *Config) error {
+	internalTLS, err := c.internalTLS()
+	if err != nil {
+		return err
+	}
+	t := &transport{config: c, public: c.newTransport(nil)}
+	if internalTLS != nil {
+		t.internal = c.newTransport(internalTLS)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	config = c
+	if current != nil {
+		current.public.CloseIdleConnections()
+		if current.internal != nil {
+			current.internal.CloseIdleConnections()
+		}
+	}
+	current = t
+	return nil
+}
+
+// sharedTransport returns the transport of the current configuration
+func sharedTransport() *transport {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if current == nil {
+		current = &transport{config: config, public: config.newTransport(nil)}
+	}
+	return current
+}
+
+// Client returns a client for the calls of a purpose, bounded by its
+// timeout. Clients are cheap and share their connections; get one when
+// calling rather than keeping it, so that it follows the configuration.
+func Client(purpose string) *http.Client {
+	t := sharedTransport()
+	return &http.Client{Timeout: t.config.timeout(purpose), Transport: t}
+}
+
+// idempotentKey marks the context of requests that may be retried
+type idempotentKey struct{}
+
+// WithIdempotent returns a context whose requests may be retried whatever
+// their method, for POSTs without side effects such as LLM completions.
+// GET, HEAD, OPTIONS and requests with an Idempotency-Key header are
+// retried without it.
+func WithIdempotent(ctx context.Context) context.Context {
+	return context.WithValue(ctx, idempotentKey{}, true)
+}
+
+// idempotent reports whether a request may be sent again
+func idempotent(request *http.Request) bool {
+	if request.Body != nil && request.Body != http.NoBody && request.GetBody == nil {
+		return false
+	}
+	switch request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	if request.Header.Get("Idempotency-Key") != "" {
+		return true
+	}
+	marked, _ := request.Context().Value(idempotentKey{}).(bool)
+	return marked
+}
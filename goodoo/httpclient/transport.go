@@ -0,0 +1,323 @@
+package httpclient
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"goodoo/tracing"
+)
+
+// ErrCircuitOpen is returned without calling a host whose circuit is open
+var ErrCircuitOpen = errors.New("circuit open")
+
+// Circuit states of a host
+const (
+	StateClosed   = "closed"
+	StateOpen     = "open"
+	StateHalfOpen = "half_open"
+)
+
+// HostStats are the counters and circuit of a host since the start
+type HostStats struct {
+	Host         string     `json:"host"`
+	Requests     int64      `json:"requests"`
+	Errors       int64      `json:"errors"`
+	Rejected     int64      `json:"rejected"`
+	AvgLatencyMs float64    `json:"avg_latency_ms"`
+	MaxLatencyMs float64    `json:"max_latency_ms"`
+	State        string     `json:"state"`
+	Failures     int        `json:"consecutive_failures"`
+	OpenedAt     *time.Time `json:"opened_at,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
+}
+
+// host holds the counters and circuit of a host
+type host struct {
+	mutex    sync.Mutex
+	requests int64
+	errors   int64
+	rejected int64
+	latency  time.Duration
+	slowest  time.Duration
+	state    string
+	failures int
+	openedAt time.Time
+	// probing is set while the trial call of a half-open circuit runs
+	probing   bool
+	lastError string
+}
+
+var (
+	hosts      = make(map[string]*host)
+	hostsMutex sync.Mutex
+)
+
+// hostOf returns the state of a host, creating it
+func hostOf(name string) *host {
+	hostsMutex.Lock()
+	defer hostsMutex.Unlock()
+	h := hosts[name]
+	if h == nil {
+		h = &host{state: StateClosed}
+		hosts[name] = h
+	}
+	return h
+}
+
+// allow reports whether a call may be made: always when the circuit is
+// closed, once the cooldown elapsed for a single trial call when it is open
+func (h *host) allow(cooldown time.Duration) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	switch h.state {
+	case StateOpen:
+		if time.Since(h.openedAt) < cooldown {
+			h.rejected++
+			return false
+		}
+		h.state = StateHalfOpen
+		h.probing = true
+	case StateHalfOpen:
+		if h.probing {
+			h.rejected++
+			return false
+		}
+		h.probing = true
+	}
+	return true
+}
+
+// done records a call and moves the circuit; failed calls are network
+// errors and 5xx answers. It returns the new state when it changed.
+func (h *host) done(duration time.Duration, failure error, threshold int) (string, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.requests++
+	h.latency += duration
+	if duration > h.slowest {
+		h.slowest = duration
+	}
+
+	previous := h.state
+	h.probing = false
+	if failure == nil {
+		h.failures = 0
+		h.state = StateClosed
+	} else {
+		h.errors++
+		h.failures++
+		h.lastError = failure.Error()
+		if h.state == StateHalfOpen || (threshold > 0 && h.failures >= threshold) {
+			h.state = StateOpen
+			h.openedAt = time.Now()
+		}
+	}
+	return h.state, h.state != previous
+}
+
+// stats returns a copy of the counters of the host
+func (h *host) stats(name string) HostStats {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	stats := HostStats{
+		Host:         name,
+		Requests:     h.requests,
+		Errors:       h.errors,
+		Rejected:     h.rejected,
+		MaxLatencyMs: float64(h.slowest.Microseconds()) / 1000,
+		State:        h.state,
+		Failures:     h.failures,
+		LastError:    h.lastError,
+	}
+	if h.requests > 0 {
+		stats.AvgLatencyMs = float64(h.latency.Microseconds()) / 1000 / float64(h.requests)
+	}
+	if h.state != StateClosed {
+		openedAt := h.openedAt
+		stats.OpenedAt = &openedAt
+	}
+	return stats
+}
+
+// Stats returns the counters and circuit of every host called, by host
+func Stats() []HostStats {
+	hostsMutex.Lock()
+	names := make([]string, 0, len(hosts))
+	for name := range hosts {
+		names = append(names, name)
+	}
+	hostsMutex.Unlock()
+	sort.Strings(names)
+
+	stats := make([]HostStats, 0, len(names))
+	for _, name := range names {
+		stats = append(stats, hostOf(name).stats(name))
+	}
+	return stats
+}
+
+// transport sends the calls of every client: it checks the circuit of the
+// host, forwards the request ID, retries and counts each attempt
+type transport struct {
+	config *Config
+	public *http.Transport
+	// internal is the transport of the InternalHosts, nil without CA
+	// bundle nor client certificate
+	internal *http.Transport
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *transport) RoundTrip(request *http.Request) (*http.Response, error) {
+	base := t.public
+	if t.internal != nil && t.config.internal(request.URL.Hostname()) {
+		base = t.internal
+	}
+	name := request.URL.Host
+	h := hostOf(name)
+
+	request = withRequestID(request)
+	retryable := idempotent(request)
+	for attempt := 0; ; attempt++ {
+		if !h.allow(t.config.BreakerCooldown) {
+			return nil, fmt.Errorf("%w for %s", ErrCircuitOpen, name)
+		}
+		if attempt > 0 {
+			retry, err := rewind(request)
+			if err != nil {
+				return nil, err
+			}
+			request = retry
+		}
+
+		start := time.Now()
+		response, err := base.RoundTrip(request)
+		duration := time.Since(start)
+		failure := err
+		if err == nil && response.StatusCode >= http.StatusInternalServerError {
+			failure = fmt.Errorf("%s answered %d", name, response.StatusCode)
+		}
+		t.observe(request, h, start, duration, response, failure)
+
+		if !retryable || attempt >= t.config.MaxRetries || !retryStatus(response, err) {
+			return response, err
+		}
+		wait := t.backoff(attempt)
+		if response != nil {
+			if after, ok := retryAfter(response); ok {
+				if after > t.config.MaxRetryWait {
+					return response, nil
+				}
+				wait = after
+			}
+			io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10))
+			response.Body.Close()
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-request.Context().Done():
+			timer.Stop()
+			return nil, request.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// observe counts an attempt, logs circuit changes and adds it to the trace
+// of the request
+func (t *transport) observe(request *http.Request, h *host, start time.Time, duration time.Duration, response *http.Response, failure error) {
+	name := request.URL.Host
+	state, changed := h.done(duration, failure, t.config.BreakerThreshold)
+	if changed {
+		switch state {
+		case StateOpen:
+			logger.Warning("Circuit of %s opened for %v: %v", name, t.config.BreakerCooldown, failure)
+		case StateClosed:
+			logger.Info("Circuit of %s closed", name)
+		}
+	}
+
+	if tracing.Active(request.Context()) {
+		attributes := map[string]string{"method": request.Method, "host": name, "path": request.URL.Path}
+		if response != nil {
+			attributes["status"] = strconv.Itoa(response.StatusCode)
+		}
+		if failure != nil {
+			attributes["error"] = failure.Error()
+		}
+		tracing.Record(request.Context(), "http.client", start, duration, attributes)
+	}
+}
+
+// withRequestID returns the request with the ID of the server request
+// that caused it, when its context has one
+func withRequestID(request *http.Request) *http.Request {
+	requestID, _ := request.Context().Value("request_id").(string)
+	if requestID == "" || request.Header.Get(RequestIDHeader) != "" {
+		return request
+	}
+	request = request.Clone(request.Context())
+	request.Header.Set(RequestIDHeader, requestID)
+	return request
+}
+
+// rewind returns a copy of the request with a fresh body
+func rewind(request *http.Request) (*http.Request, error) {
+	retry := request.Clone(request.Context())
+	if request.GetBody != nil {
+		body, err := request.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		retry.Body = body
+	}
+	return retry, nil
+}
+
+// retryStatus reports whether an attempt may succeed when repeated
+func retryStatus(response *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch response.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// backoff returns the delay before a retry: RetryBackoff doubled on each
+// attempt, with jitter, and at most MaxRetryWait
+func (t *transport) backoff(attempt int) time.Duration {
+	delay := t.config.RetryBackoff << uint(attempt)
+	if delay <= 0 || delay > t.config.MaxRetryWait {
+		delay = t.config.MaxRetryWait
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// retryAfter returns the delay of the Retry-After header, in seconds or as
+// an HTTP date
+func retryAfter(response *http.Response) (time.Duration, bool) {
+	value := response.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(at); wait > 0 {
+			return wait, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
@@ -0,0 +1,217 @@
+// Package images resizes uploaded images into cached square variants
+// (like Odoo's image_128/image_256 fields) and generates identicons.
+package images
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"net/http"
+	"sync"
+)
+
+// Sizes are the available variant sizes in pixels
+var Sizes = []int{64, 128, 256, 512, 1024}
+
+// MaxSize is the size images are reduced to when stored
+const MaxSize = 1024
+
+// Bounds of the images decoded: a few kilobytes of compressed data may
+// declare dimensions that take gigabytes once decoded
+const (
+	MaxDimension = 8192
+	MaxPixels    = 40_000_000
+)
+
+// ErrUnsupportedFormat is returned for content that is not a PNG, JPEG or GIF image
+var ErrUnsupportedFormat = errors.New("unsupported image format")
+
+// ErrTooLarge is returned for images above MaxDimension or MaxPixels
+var ErrTooLarge = fmt.Errorf("image larger than %d pixels or %d pixels wide or high", MaxPixels, MaxDimension)
+
+// SupportedMimetypes are the image types accepted for upload
+var SupportedMimetypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+}
+
+// VariantSize returns the smallest variant covering the requested size; 0 means 128
+func VariantSize(requested int) int {
+	if requested <= 0 {
+		return 128
+	}
+	for _, size := range Sizes {
+		if size >= requested {
+			return size
+		}
+	}
+	return Sizes[len(Sizes)-1]
+}
+
+// Normalize validates an uploaded image and returns it as a square PNG no
+// larger than MaxSize, cropped around its center
+func Normalize(data []byte) ([]byte, error) {
+	if !SupportedMimetypes[http.DetectContentType(data)] {
+		return nil, ErrUnsupportedFormat
+	}
+	img, err := decode(data)
+	if err != nil {
+		return nil, err
+	}
+	return encode(resize(cropSquare(img), MaxSize))
+}
+
+// decode decodes data after checking from its header that the image is
+// within MaxDimension and MaxPixels
+func decode(data []byte) (image.Image, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedFormat, err)
+	}
+	if config.Width > MaxDimension || config.Height > MaxDimension || config.Width*config.Height > MaxPixels {
+		return nil, fmt.Errorf("%w: %dx%d", ErrTooLarge, config.Width, config.Height)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedFormat, err)
+	}
+	return img, nil
+}
+
+const maxCachedVariants = 512
+
+var (
+	variants     = make(map[string][]byte)
+	variantMutex sync.Mutex
+)
+
+// Variant returns data resized to size, cached by content checksum
+func Variant(checksum string, data []byte, size int) ([]byte, error) {
+	key := fmt.Sprintf("%s-%d", checksum, size)
+
+	variantMutex.Lock()
+	cached, ok := variants[key]
+	variantMutex.Unlock()
+	if ok {
+		return cached, nil
+	}
+
+	img, err := decode(data)
+	if err != nil {
+		return nil, err
+	}
+	out, err := encode(resize(cropSquare(img), size))
+	if err != nil {
+		return nil, err
+	}
+
+	variantMutex.Lock()
+	if len(variants) >= maxCachedVariants {
+		// Drop an arbitrary entry; variants are cheap to rebuild
+		for k := range variants {
+			delete(variants, k)
+			break
+		}
+	}
+	variants[key] = out
+	variantMutex.Unlock()
+	return out, nil
+}
+
+// Identicon draws a symmetric 5x5 pattern derived from seed, used as the
+// avatar of users without an upload
+func Identicon(seed string, size int) ([]byte, error) {
+	sum := sha1.Sum([]byte(seed))
+	fg := color.RGBA{R: sum[0]/2 + 64, G: sum[1]/2 + 64, B: sum[2]/2 + 64, A: 255}
+	bg := color.RGBA{R: 240, G: 242, B: 245, A: 255}
+
+	const grid = 5
+	margin := size / 10
+	cell := (size - 2*margin) / grid
+	margin = (size - cell*grid) / 2
+
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			img.SetRGBA(x, y, bg)
+		}
+	}
+	for row := 0; row < grid; row++ {
+		for col := 0; col < (grid+1)/2; col++ {
+			if sum[3+row*3+col]%2 == 0 {
+				continue
+			}
+			for _, c := range []int{col, grid - 1 - col} {
+				x0, y0 := margin+c*cell, margin+row*cell
+				for y := y0; y < y0+cell; y++ {
+					for x := x0; x < x0+cell; x++ {
+						img.SetRGBA(x, y, fg)
+					}
+				}
+			}
+		}
+	}
+	return encode(img)
+}
+
+func encode(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// cropSquare returns the centered square of img
+func cropSquare(img image.Image) image.Image {
+	b := img.Bounds()
+	side := min(b.Dx(), b.Dy())
+	x0 := b.Min.X + (b.Dx()-side)/2
+	y0 := b.Min.Y + (b.Dy()-side)/2
+	square := image.NewRGBA(image.Rect(0, 0, side, side))
+	for y := 0; y < side; y++ {
+		for x := 0; x < side; x++ {
+			square.Set(x, y, img.At(x0+x, y0+y))
+		}
+	}
+	return square
+}
+
+// resize scales a square image down to size by averaging source pixels;
+// smaller images are kept as is
+func resize(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	if b.Dx() <= size {
+		return img
+	}
+
+	out := image.NewRGBA(image.Rect(0, 0, size, size))
+	scale := float64(b.Dx()) / float64(size)
+	for y := 0; y < size; y++ {
+		sy0, sy1 := int(float64(y)*scale), int(float64(y+1)*scale)
+		for x := 0; x < size; x++ {
+			sx0, sx1 := int(float64(x)*scale), int(float64(x+1)*scale)
+			var r, g, bl, a, n uint32
+			for sy := sy0; sy < max(sy1, sy0+1); sy++ {
+				for sx := sx0; sx < max(sx1, sx0+1); sx++ {
+					pr, pg, pb, pa := img.At(b.Min.X+sx, b.Min.Y+sy).RGBA()
+					r, g, bl, a, n = r+pr, g+pg, bl+pb, a+pa, n+1
+				}
+			}
+			out.SetRGBA(x, y, color.RGBA{
+				R: uint8(r / n >> 8),
+				G: uint8(g / n >> 8),
+				B: uint8(bl / n >> 8),
+				A: uint8(a / n >> 8),
+			})
+		}
+	}
+	return out
+}
@@ -0,0 +1,69 @@
+package images_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"testing"
+
+	"goodoo/images"
+)
+
+// pngDeclaring returns a 1x1 PNG whose header declares width x height
+func pngDeclaring(t *testing.T, width, height uint32) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	// The IHDR chunk follows the 8-byte signature: length, type, data, CRC
+	binary.BigEndian.PutUint32(data[16:], width)
+	binary.BigEndian.PutUint32(data[20:], height)
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+	return data
+}
+
+func TestNormalizeTooLarge(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height uint32
+	}{
+		{"wide", images.MaxDimension + 1, 1},
+		{"high", 1, images.MaxDimension + 1},
+		{"pixels", 8000, 8000},
+		{"bomb", 100000, 100000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := pngDeclaring(t, tt.width, tt.height)
+			if _, err := images.Normalize(data); !errors.Is(err, images.ErrTooLarge) {
+				t.Errorf("Normalize error = %v, want ErrTooLarge", err)
+			}
+			if _, err := images.Variant(tt.name, data, 128); !errors.Is(err, images.ErrTooLarge) {
+				t.Errorf("Variant error = %v, want ErrTooLarge", err)
+			}
+		})
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 300, 200))); err != nil {
+		t.Fatal(err)
+	}
+	out, err := images.Normalize(buf.Bytes())
+	if err != nil {
+		t.Fatalf("Normalize: %v", err)
+	}
+	config, err := png.DecodeConfig(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Width != 200 || config.Height != 200 {
+		t.Errorf("Normalize gave %dx%d, want 200x200", config.Width, config.Height)
+	}
+}
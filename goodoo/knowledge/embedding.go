@@ -0,0 +1,172 @@
+package knowledge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"goodoo/httpclient"
+	"goodoo/models"
+)
+
+// System parameters configuring the embedding provider. Without an API
+// base, the built-in hashing embedder is used.
+const (
+	ParamEmbeddingAPIBase = "llm.embedding_api_base"
+	ParamEmbeddingAPIKey  = "llm.embedding_api_key"
+	ParamEmbeddingModel   = "llm.embedding_model"
+)
+
+// Embedder turns texts into vectors of a fixed dimension
+type Embedder interface {
+	// Model names the embedding model; vectors of different models are not comparable
+	Model() string
+	Embed(ctx context.Context, texts []string) ([][]float64, error)
+}
+
+// EmbedderForDB returns the embedder configured in a database's system parameters
+func EmbedderForDB(dbName string) Embedder {
+	base := models.GetParamString(dbName, ParamEmbeddingAPIBase, "")
+	if base == "" {
+		return NewHashEmbedder(256)
+	}
+	return &OpenAIEmbedder{
+		APIBase: base,
+		APIKey:  models.GetParamString(dbName, ParamEmbeddingAPIKey, ""),
+		Name:    models.GetParamString(dbName, ParamEmbeddingModel, "text-embedding-ada-002"),
+		Client:  httpclient.Client(httpclient.PurposeLLM),
+	}
+}
+
+// OpenAIEmbedder calls an OpenAI-compatible /embeddings endpoint (OpenAI,
+// Ollama, LiteLLM, ...)
+type OpenAIEmbedder struct {
+	APIBase string
+	APIKey  string
+	Name    string
+	Client  *http.Client
+}
+
+func (e *OpenAIEmbedder) Model() string {
+	return e.Name
+}
+
+func (e *OpenAIEmbedder) Embed(ctx context.Context, texts []string) ([][]float64, error) {
+	body, err := json.Marshal(map[string]interface{}{"model": e.Name, "input": texts})
+	if err != nil {
+		return nil, err
+	}
+	// Embedding has no side effect, so failed calls are retried
+	request, err := http.NewRequestWithContext(httpclient.WithIdempotent(ctx), http.MethodPost, strings.TrimRight(e.APIBase, "/")+"/embeddings", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if e.APIKey != "" {
+		request.Header.Set("Authorization", "Bearer "+e.APIKey)
+	}
+
+	response, err := e.Client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		return nil, fmt.Errorf("embedding provider answered %d", response.StatusCode)
+	}
+
+	var decoded struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float64 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&decoded); err != nil {
+		return nil, fmt.Errorf("invalid embedding response: %w", err)
+	}
+	vectors := make([][]float64, len(texts))
+	for _, item := range decoded.Data {
+		if item.Index < 0 || item.Index >= len(texts) {
+			return nil, fmt.Errorf("embedding response index %d out of range", item.Index)
+		}
+		vectors[item.Index] = item.Embedding
+	}
+	for i, vector := range vectors {
+		if vector == nil {
+			return nil, fmt.Errorf("embedding response misses input %d", i)
+		}
+	}
+	return vectors, nil
+}
+
+// HashEmbedder is a provider-free embedder hashing lowercased words into a
+// fixed number of buckets. It only captures word overlap, but lets the
+// knowledge base work without an embedding provider.
+type HashEmbedder struct {
+	Dimensions int
+}
+
+// NewHashEmbedder creates a hashing embedder
+func NewHashEmbedder(dimensions int) *HashEmbedder {
+	return &HashEmbedder{Dimensions: dimensions}
+}
+
+func (e *HashEmbedder) Model() string {
+	return fmt.Sprintf("local-hash-%d", e.Dimensions)
+}
+
+func (e *HashEmbedder) Embed(ctx context.Context, texts []string) ([][]float64, error) {
+	vectors := make([][]float64, len(texts))
+	for i, text := range texts {
+		vector := make([]float64, e.Dimensions)
+		words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		for _, word := range words {
+			hash := fnv.New32a()
+			hash.Write([]byte(word))
+			vector[hash.Sum32()%uint32(e.Dimensions)]++
+		}
+		vectors[i] = normalize(vector)
+	}
+	return vectors, nil
+}
+
+// normalize scales a vector to unit length
+func normalize(vector []float64) []float64 {
+	var norm float64
+	for _, x := range vector {
+		norm += x * x
+	}
+	if norm == 0 {
+		return vector
+	}
+	norm = math.Sqrt(norm)
+	for i := range vector {
+		vector[i] /= norm
+	}
+	return vector
+}
+
+// Cosine returns the cosine similarity of two vectors of the same dimension
+func Cosine(a, b []float64) float64 {
+	if len(a) != len(b) {
+		return 0
+	}
+	var dot, normA, normB float64
+	for i := range a {
+		dot += a[i] * b[i]
+		normA += a[i] * a[i]
+		normB += b[i] * b[i]
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
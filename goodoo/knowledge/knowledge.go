@@ -0,0 +1,251 @@
+// Package knowledge implements the LLM knowledge base: documents are split
+// into overlapping chunks, embedded with the configured provider and
+// retrieved by similarity to augment chat prompts.
+//
+// Vectors are stored in a float8[] column and compared in Go; when the
+// pgvector extension is installed they are also copied to a vector column
+// and ranked by PostgreSQL.
+package knowledge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"goodoo/models"
+	"goodoo/scan"
+	"gorm.io/gorm"
+)
+
+// DefaultLimit is the number of chunks retrieved by default
+const DefaultLimit = 5
+
+// Split cuts text into chunks of size words, each repeating the last
+// overlap words of the previous one
+func Split(text string, size, overlap int) []string {
+	words := strings.Fields(text)
+	if len(words) == 0 {
+		return nil
+	}
+	if size <= 0 {
+		size = 200
+	}
+	if overlap < 0 || overlap >= size {
+		overlap = 0
+	}
+
+	var chunks []string
+	for start := 0; ; start += size - overlap {
+		end := start + size
+		if end > len(words) {
+			end = len(words)
+		}
+		chunks = append(chunks, strings.Join(words[start:end], " "))
+		if end == len(words) {
+			return chunks
+		}
+	}
+}
+
+// vectorSupport remembers per database whether knowledge_chunk has a pgvector column
+var vectorSupport sync.Map
+
+// EnsureVectorColumn adds the pgvector column to knowledge_chunk when the
+// extension is installed, and reports whether it exists
+func EnsureVectorColumn(db *gorm.DB) (bool, error) {
+	var installed int64
+	if err := db.Raw("SELECT COUNT(*) FROM pg_extension WHERE extname = 'vector'").Scan(&installed).Error; err != nil {
+		return false, err
+	}
+	if installed == 0 {
+		return false, nil
+	}
+	if err := db.Exec("ALTER TABLE knowledge_chunk ADD COLUMN IF NOT EXISTS embedding_vec vector").Error; err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// hasVectorColumn reports whether pgvector can be used, checking once per database
+func hasVectorColumn(db *gorm.DB, dbName string) bool {
+	if cached, ok := vectorSupport.Load(dbName); ok {
+		return cached.(bool)
+	}
+	supported, err := EnsureVectorColumn(db)
+	if err != nil {
+		return false
+	}
+	vectorSupport.Store(dbName, supported)
+	return supported
+}
+
+// documentText returns the text of a document, from its attachment if any
+func documentText(db *gorm.DB, document *models.KnowledgeDocument) (string, error) {
+	if document.AttachmentID == nil {
+		return document.Content, nil
+	}
+	var attachment models.IrAttachment
+	if err := db.First(&attachment, *document.AttachmentID).Error; err != nil {
+		return "", fmt.Errorf("attachment %d: %w", *document.AttachmentID, err)
+	}
+	if err := scan.CheckDownload(&attachment); err != nil {
+		return "", fmt.Errorf("attachment %s: %w", attachment.Name, err)
+	}
+	if attachment.Mimetype != "" && !strings.HasPrefix(attachment.Mimetype, "text/") {
+		return "", fmt.Errorf("attachment %s is %s, only text attachments can be ingested", attachment.Name, attachment.Mimetype)
+	}
+	return string(attachment.Datas), nil
+}
+
+// Ingest splits and embeds a document, replacing its previous chunks. A
+// document whose text and embedding model did not change is left as is
+// unless force is set. Failures are recorded on the document.
+func Ingest(ctx context.Context, db *gorm.DB, dbName string, embedder Embedder, document *models.KnowledgeDocument, force bool) error {
+	err := ingest(ctx, db, dbName, embedder, document, force)
+	if err != nil {
+		document.State = models.KnowledgeStateError
+		document.Error = err.Error()
+		db.Model(document).Updates(map[string]interface{}{"state": document.State, "error": document.Error})
+	}
+	return err
+}
+
+func ingest(ctx context.Context, db *gorm.DB, dbName string, embedder Embedder, document *models.KnowledgeDocument, force bool) error {
+	text, err := documentText(db, document)
+	if err != nil {
+		return err
+	}
+	checksum := models.Checksum([]byte(text))
+	if !force && document.State == models.KnowledgeStateIndexed &&
+		document.Checksum == checksum && document.EmbeddingModel == embedder.Model() {
+		return nil
+	}
+
+	passages := Split(text, document.ChunkSize, document.ChunkOverlap)
+	if len(passages) == 0 {
+		return errors.New("document has no text")
+	}
+	// Embed before opening the transaction, which must not wait on the provider
+	vectors, err := embedder.Embed(ctx, passages)
+	if err != nil {
+		return fmt.Errorf("embedding failed: %w", err)
+	}
+
+	chunks := make([]models.KnowledgeChunk, len(passages))
+	for i, passage := range passages {
+		chunks[i] = models.KnowledgeChunk{
+			DocumentID:     document.ID,
+			Sequence:       i,
+			Content:        passage,
+			EmbeddingModel: embedder.Model(),
+			Embedding:      vectors[i],
+		}
+	}
+
+	useVector := hasVectorColumn(db, dbName)
+	now := time.Now()
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("document_id = ?", document.ID).Delete(&models.KnowledgeChunk{}).Error; err != nil {
+			return err
+		}
+		if err := tx.CreateInBatches(&chunks, 100).Error; err != nil {
+			return err
+		}
+		if useVector {
+			if err := tx.Exec("UPDATE knowledge_chunk SET embedding_vec = embedding::vector WHERE document_id = ?", document.ID).Error; err != nil {
+				return err
+			}
+		}
+		document.ChunkCount = len(chunks)
+		document.Checksum = checksum
+		document.EmbeddingModel = embedder.Model()
+		document.State = models.KnowledgeStateIndexed
+		document.Error = ""
+		document.IndexedAt = &now
+		return tx.Model(document).Updates(map[string]interface{}{
+			"chunk_count":     document.ChunkCount,
+			"checksum":        document.Checksum,
+			"embedding_model": document.EmbeddingModel,
+			"state":           document.State,
+			"error":           "",
+			"indexed_at":      now,
+		}).Error
+	})
+}
+
+// Result is a chunk retrieved for a query
+type Result struct {
+	ChunkID    uint    `json:"chunk_id"`
+	DocumentID uint    `json:"document_id"`
+	Title      string  `json:"title"`
+	Sequence   int     `json:"sequence"`
+	Content    string  `json:"content"`
+	Score      float64 `json:"score"`
+}
+
+// Search returns the limit chunks most similar to the query, among those
+// embedded with the same model
+func Search(ctx context.Context, db *gorm.DB, dbName string, embedder Embedder, query string, limit int) ([]Result, error) {
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+	vectors, err := embedder.Embed(ctx, []string{query})
+	if err != nil {
+		return nil, fmt.Errorf("embedding failed: %w", err)
+	}
+	queryVector := models.Vector(vectors[0])
+
+	var results []Result
+	base := db.Table("knowledge_chunk AS c").
+		Joins("JOIN knowledge_document AS d ON d.id = c.document_id AND d.deleted_at IS NULL").
+		Where("c.embedding_model = ?", embedder.Model())
+
+	if hasVectorColumn(db, dbName) {
+		literal, _ := queryVector.Value()
+		err = base.Select("c.id AS chunk_id, c.document_id, d.title, c.sequence, c.content, 1 - (c.embedding_vec <=> ?::float8[]::vector) AS score", literal).
+			Order("score DESC").
+			Limit(limit).
+			Scan(&results).Error
+		return results, err
+	}
+
+	// Brute force: rank every chunk of the model in Go
+	var rows []struct {
+		Result
+		Embedding models.Vector
+	}
+	err = base.Select("c.id AS chunk_id, c.document_id, d.title, c.sequence, c.content, c.embedding").Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	results = make([]Result, len(rows))
+	for i, row := range rows {
+		results[i] = row.Result
+		results[i].Score = Cosine(queryVector, row.Embedding)
+	}
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// AugmentPrompt prepends the retrieved chunks to a user message, numbered
+// so the answer can cite them
+func AugmentPrompt(message string, results []Result) string {
+	if len(results) == 0 {
+		return message
+	}
+	var b strings.Builder
+	b.WriteString("Answer using the following knowledge base excerpts and cite them as [n].\n\n")
+	for i, result := range results {
+		fmt.Fprintf(&b, "[%d] %s:\n%s\n\n", i+1, result.Title, result.Content)
+	}
+	b.WriteString("Question: ")
+	b.WriteString(message)
+	return b.String()
+}
@@ -0,0 +1,74 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"goodoo/models"
+)
+
+// Error is a failure of a provider, with its class (models.LLMError*)
+type Error struct {
+	Class  string
+	Status int
+	Err    error
+}
+
+func (e *Error) Error() string {
+	if e.Status != 0 {
+		return fmt.Sprintf("%s (%d): %v", e.Class, e.Status, e.Err)
+	}
+	return fmt.Sprintf("%s: %v", e.Class, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// contentPolicyCodes are the error codes of providers refusing a prompt
+var contentPolicyCodes = map[string]bool{
+	"content_filter":           true,
+	"content_policy_violation": true,
+}
+
+// statusError returns the error of a provider answering an HTTP error
+// status, with the code of its error body
+func statusError(status int, code, message string) *Error {
+	err := &Error{Status: status, Err: fmt.Errorf("provider answered %d", status)}
+	if message != "" {
+		err.Err = errors.New(message)
+	}
+	switch {
+	case contentPolicyCodes[code]:
+		err.Class = models.LLMErrorContentPolicy
+	case status == http.StatusTooManyRequests:
+		err.Class = models.LLMErrorRateLimit
+	case status == http.StatusRequestTimeout || status == http.StatusGatewayTimeout:
+		err.Class = models.LLMErrorTimeout
+	case status >= http.StatusInternalServerError:
+		err.Class = models.LLMErrorUnavailable
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		err.Class = models.LLMErrorAuth
+	default:
+		err.Class = models.LLMErrorInvalid
+	}
+	return err
+}
+
+// Classify returns the class of an error of a provider: the class of an
+// Error, timeout for deadlines, unavailable for the rest, such as refused
+// connections or open circuits
+func Classify(err error) string {
+	var llmErr *Error
+	if errors.As(err, &llmErr) {
+		return llmErr.Class
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, errMaxLatency) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return models.LLMErrorTimeout
+	}
+	return models.LLMErrorUnavailable
+}
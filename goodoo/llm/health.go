@@ -0,0 +1,228 @@
+package llm
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"goodoo/database"
+	"goodoo/models"
+	"goodoo/notification"
+)
+
+// now is the clock of the cooldowns and statistics
+var now = time.Now
+
+// healthKey identifies a provider of a database
+type healthKey struct {
+	dbName     string
+	providerID uint
+}
+
+// health tracks a provider failing over
+type health struct {
+	provider string
+	failures int
+	// since is the first failure since the provider last answered, until
+	// the end of its cooldown
+	since time.Time
+	until time.Time
+	// alerted is set once the administrators were notified of the failures
+	alerted bool
+}
+
+// routeStats counts the chats of a route
+type routeStats struct {
+	requests     int64
+	failovers    int64
+	failures     int64
+	served       map[string]int64
+	lastFailover time.Time
+}
+
+var (
+	healths = make(map[healthKey]*health)
+	stats   = make(map[string]map[string]*routeStats)
+	lock    sync.Mutex
+)
+
+// coolingDown reports whether a provider of a database failed over lately
+func coolingDown(dbName string, providerID uint) bool {
+	lock.Lock()
+	defer lock.Unlock()
+	h := healths[healthKey{dbName, providerID}]
+	return h != nil && now().Before(h.until)
+}
+
+// recordSuccess ends the cooldown of a provider which answered
+func recordSuccess(dbName string, providerID uint) {
+	lock.Lock()
+	defer lock.Unlock()
+	delete(healths, healthKey{dbName, providerID})
+}
+
+// recordFailure puts a provider which failed over into cooldown, and
+// notifies the administrators once it has been failing for longer than
+// ParamLLMCooldownAlertMinutes
+func recordFailure(dbName string, provider *models.LLMProvider) {
+	cooldown := time.Duration(models.GetParamInt(dbName, models.ParamLLMCooldownSeconds, models.DefaultLLMCooldownSeconds)) * time.Second
+	threshold := time.Duration(models.GetParamInt(dbName, models.ParamLLMCooldownAlertMinutes, models.DefaultLLMCooldownAlertMinutes)) * time.Minute
+
+	lock.Lock()
+	key := healthKey{dbName, provider.ID}
+	h := healths[key]
+	if h == nil {
+		h = &health{since: now()}
+		healths[key] = h
+	}
+	h.provider = provider.Name
+	h.failures++
+	h.until = now().Add(cooldown)
+	alert := !h.alerted && now().Sub(h.since) >= threshold
+	if alert {
+		h.alerted = true
+	}
+	state := *h
+	lock.Unlock()
+
+	if alert {
+		go func() {
+			if err := notifyCooldown(dbName, provider.ID, state); err != nil {
+				logger.Error("Failed to notify the administrators of %s that %s keeps failing: %v", dbName, state.provider, err)
+			}
+		}()
+	}
+}
+
+// notifyCooldown tells the administrators of a database that a provider
+// keeps failing
+func notifyCooldown(dbName string, providerID uint, state health) error {
+	db, err := database.GetDatabase(dbName)
+	if err != nil {
+		return err
+	}
+	admins, err := models.AdminUserIDs(db)
+	if err != nil {
+		return err
+	}
+	title := fmt.Sprintf("The LLM provider %s keeps failing", state.provider)
+	body := fmt.Sprintf("%s has failed %d time(s) since %s; chats go to the fallbacks of its routes meanwhile. Check its status and configuration.",
+		state.provider, state.failures, state.since.Format(time.RFC1123))
+	payload := map[string]interface{}{
+		"provider_id": providerID,
+		"provider":    state.provider,
+		"failures":    state.failures,
+		"since":       state.since.Format(time.RFC3339),
+	}
+	var errs []error
+	for _, uid := range admins {
+		if _, err := notification.Notify(dbName, uid, models.NotificationCategoryLLM, models.NotificationWarning, title, body, payload); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// statsOf returns the statistics of a route; lock must be held
+func statsOf(dbName, model string) *routeStats {
+	routes := stats[dbName]
+	if routes == nil {
+		routes = make(map[string]*routeStats)
+		stats[dbName] = routes
+	}
+	s := routes[model]
+	if s == nil {
+		s = &routeStats{served: make(map[string]int64)}
+		routes[model] = s
+	}
+	return s
+}
+
+// count records the outcome of a chat sent along a route: the target which
+// served it, "" when none did, and how many times it failed over
+func count(dbName, model, served string, failovers int) {
+	lock.Lock()
+	defer lock.Unlock()
+	s := statsOf(dbName, model)
+	s.requests++
+	s.failovers += int64(failovers)
+	if failovers > 0 {
+		s.lastFailover = now()
+	}
+	if served == "" {
+		s.failures++
+	} else {
+		s.served[served]++
+	}
+}
+
+// Cooldown is a provider of a database failing over
+type Cooldown struct {
+	ProviderID uint      `json:"provider_id"`
+	Provider   string    `json:"provider"`
+	Failures   int       `json:"failures"`
+	Since      time.Time `json:"since"`
+	Until      time.Time `json:"until"`
+	// Active is false once the cooldown ended, the provider being tried
+	// first again but not having answered yet
+	Active  bool `json:"active"`
+	Alerted bool `json:"alerted"`
+}
+
+// Cooldowns returns the providers of a database which failed over since
+// they last answered
+func Cooldowns(dbName string) []Cooldown {
+	lock.Lock()
+	defer lock.Unlock()
+	cooldowns := make([]Cooldown, 0)
+	for key, h := range healths {
+		if key.dbName != dbName {
+			continue
+		}
+		cooldowns = append(cooldowns, Cooldown{
+			ProviderID: key.providerID,
+			Provider:   h.provider,
+			Failures:   h.failures,
+			Since:      h.since,
+			Until:      h.until,
+			Active:     now().Before(h.until),
+			Alerted:    h.alerted,
+		})
+	}
+	sort.Slice(cooldowns, func(i, j int) bool { return cooldowns[i].ProviderID < cooldowns[j].ProviderID })
+	return cooldowns
+}
+
+// RouteStats counts the chats of a route since the server started
+type RouteStats struct {
+	Model string `json:"model"`
+	// Requests were sent along the route; Failures got no answer
+	Requests  int64 `json:"requests"`
+	Failovers int64 `json:"failovers"`
+	Failures  int64 `json:"failures"`
+	// Served counts the answers by "provider/model"
+	Served       map[string]int64 `json:"served"`
+	LastFailover *time.Time       `json:"last_failover,omitempty"`
+}
+
+// Stats returns the statistics of the routes of a database, by model
+func Stats(dbName string) []RouteStats {
+	lock.Lock()
+	defer lock.Unlock()
+	result := make([]RouteStats, 0, len(stats[dbName]))
+	for model, s := range stats[dbName] {
+		entry := RouteStats{Model: model, Requests: s.requests, Failovers: s.failovers, Failures: s.failures, Served: make(map[string]int64, len(s.served))}
+		for target, n := range s.served {
+			entry.Served[target] = n
+		}
+		if !s.lastFailover.IsZero() {
+			last := s.lastFailover
+			entry.LastFailover = &last
+		}
+		result = append(result, entry)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Model < result[j].Model })
+	return result
+}
@@ -0,0 +1,88 @@
+// Package llm sends chats to the LLM providers of a database. The routes
+// of the catalog tell which providers answer a model: the preferred one,
+// then ordered fallbacks taking over when a provider is too slow or fails
+// with a transient error. Providers failing that way cool down, tried last
+// until they answer again, and the administrators are notified when one
+// keeps failing.
+package llm
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"goodoo/httpclient"
+	"goodoo/logging"
+	"goodoo/models"
+)
+
+var logger = logging.GetLogger("goodoo.llm")
+
+// Message is a message of a chat sent to a provider
+type Message struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// Request is a chat sent to a provider
+type Request struct {
+	// Model is the model name at the provider
+	Model     string
+	Messages  []Message
+	MaxTokens int
+}
+
+// Response is the answer of a provider
+type Response struct {
+	Content      string
+	TokensUsed   int
+	FinishReason string
+	// Provider and Model are the provider and the model that answered,
+	// filled in by routes
+	Provider string
+	Model    string
+}
+
+// Provider answers chats
+type Provider interface {
+	// Complete returns the whole answer
+	Complete(ctx context.Context, req Request) (*Response, error)
+	// Stream calls onDelta with the parts of the answer as they come, then
+	// returns the answer; an error of onDelta stops the stream
+	Stream(ctx context.Context, req Request, onDelta func(delta string) error) (*Response, error)
+}
+
+// Factory returns the client of a configured provider
+type Factory func(provider *models.LLMProvider) (Provider, error)
+
+var (
+	factories     = make(map[string]Factory)
+	factoriesLock sync.RWMutex
+)
+
+// RegisterService installs the factory of the providers of a service
+// (LLMProvider.Service); services without one are called as
+// OpenAI-compatible APIs
+func RegisterService(service string, factory Factory) {
+	factoriesLock.Lock()
+	defer factoriesLock.Unlock()
+	factories[service] = factory
+}
+
+// NewProvider returns the client of a configured provider
+func NewProvider(provider *models.LLMProvider) (Provider, error) {
+	factoriesLock.RLock()
+	factory := factories[provider.Service]
+	factoriesLock.RUnlock()
+	if factory != nil {
+		return factory(provider)
+	}
+	if provider.APIBase == "" {
+		return nil, fmt.Errorf("provider %s has no API base", provider.Name)
+	}
+	return &OpenAIProvider{
+		APIBase: provider.APIBase,
+		APIKey:  string(provider.APIKey),
+		Client:  httpclient.Client(httpclient.PurposeLLM),
+	}, nil
+}
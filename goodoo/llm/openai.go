@@ -0,0 +1,164 @@
+package llm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"goodoo/models"
+)
+
+// OpenAIProvider calls an OpenAI-compatible /chat/completions endpoint.
+// Chats are not retried by the client: a route fails over instead.
+type OpenAIProvider struct {
+	APIBase string
+	APIKey  string
+	Client  *http.Client
+}
+
+// openAIChoice is a choice of a completion, or of a chunk of a stream
+type openAIChoice struct {
+	Message struct {
+		Content string `json:"content"`
+	} `json:"message"`
+	Delta struct {
+		Content string `json:"content"`
+	} `json:"delta"`
+	FinishReason string `json:"finish_reason"`
+}
+
+// openAICompletion is a completion, or a chunk of a stream
+type openAICompletion struct {
+	Choices []openAIChoice `json:"choices"`
+	Usage   *struct {
+		TotalTokens int `json:"total_tokens"`
+	} `json:"usage"`
+}
+
+func (p *OpenAIProvider) post(ctx context.Context, req Request, stream bool) (*http.Response, error) {
+	payload := map[string]interface{}{
+		"model":    req.Model,
+		"messages": req.Messages,
+	}
+	if req.MaxTokens > 0 {
+		payload["max_tokens"] = req.MaxTokens
+	}
+	if stream {
+		payload["stream"] = true
+		payload["stream_options"] = map[string]bool{"include_usage": true}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(p.APIBase, "/")+"/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if p.APIKey != "" {
+		request.Header.Set("Authorization", "Bearer "+p.APIKey)
+	}
+	response, err := p.Client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode >= 300 {
+		defer response.Body.Close()
+		var decoded struct {
+			Error struct {
+				Message string `json:"message"`
+				Code    string `json:"code"`
+			} `json:"error"`
+		}
+		data, _ := io.ReadAll(io.LimitReader(response.Body, 64<<10))
+		json.Unmarshal(data, &decoded)
+		return nil, statusError(response.StatusCode, decoded.Error.Code, decoded.Error.Message)
+	}
+	return response, nil
+}
+
+// finish checks the finish reason of an answer: a content filter stopping
+// it is a refusal
+func finish(answer *Response) (*Response, error) {
+	if answer.FinishReason == "content_filter" {
+		return nil, &Error{Class: models.LLMErrorContentPolicy, Err: errors.New("the answer was filtered by the provider")}
+	}
+	return answer, nil
+}
+
+func (p *OpenAIProvider) Complete(ctx context.Context, req Request) (*Response, error) {
+	response, err := p.post(ctx, req, false)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	var decoded openAICompletion
+	if err := json.NewDecoder(response.Body).Decode(&decoded); err != nil {
+		return nil, fmt.Errorf("invalid completion response: %w", err)
+	}
+	if len(decoded.Choices) == 0 {
+		return nil, errors.New("completion response has no choices")
+	}
+	answer := &Response{Content: decoded.Choices[0].Message.Content, FinishReason: decoded.Choices[0].FinishReason}
+	if decoded.Usage != nil {
+		answer.TokensUsed = decoded.Usage.TotalTokens
+	}
+	return finish(answer)
+}
+
+// Stream reads the server-sent events of the completion, one chunk per
+// "data:" line until "data: [DONE]"
+func (p *OpenAIProvider) Stream(ctx context.Context, req Request, onDelta func(delta string) error) (*Response, error) {
+	response, err := p.post(ctx, req, true)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	answer := &Response{}
+	var content strings.Builder
+	scanner := bufio.NewScanner(response.Body)
+	scanner.Buffer(make([]byte, 0, 64<<10), 1<<20)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			break
+		}
+		var chunk openAICompletion
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return nil, fmt.Errorf("invalid completion chunk: %w", err)
+		}
+		if chunk.Usage != nil {
+			answer.TokensUsed = chunk.Usage.TotalTokens
+		}
+		if len(chunk.Choices) == 0 {
+			continue
+		}
+		if reason := chunk.Choices[0].FinishReason; reason != "" {
+			answer.FinishReason = reason
+		}
+		if delta := chunk.Choices[0].Delta.Content; delta != "" {
+			content.WriteString(delta)
+			if err := onDelta(delta); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	answer.Content = content.String()
+	return finish(answer)
+}
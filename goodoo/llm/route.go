@@ -0,0 +1,166 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"goodoo/models"
+)
+
+// errMaxLatency cancels the call of a target slower than the max latency
+// of its route
+var errMaxLatency = errors.New("max latency exceeded")
+
+// Attempt is a call of a route to one of its targets
+type Attempt struct {
+	ProviderID uint   `json:"provider_id"`
+	Provider   string `json:"provider"`
+	Model      string `json:"model"`
+	// Class and Error describe the failure of the call, empty when it
+	// answered
+	Class      string `json:"class,omitempty"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// target is a model of a provider of a route
+type target struct {
+	provider *models.LLMProvider
+	model    string
+	client   Provider
+}
+
+// Route sends the chats of a model to the targets of its route
+type Route struct {
+	dbName  string
+	route   *models.LLMRoute
+	targets []target
+}
+
+// RouteFor returns the route of a model of a catalog, nil when the model
+// has no active route. Targets whose provider or model is inactive are
+// left out.
+func RouteFor(catalog *models.LLMCatalog, dbName, model string) *Route {
+	route := catalog.Route(model)
+	if route == nil {
+		return nil
+	}
+	r := &Route{dbName: dbName, route: route}
+	for _, t := range route.Targets() {
+		provider := catalog.Provider(t.ProviderID)
+		if provider == nil || !provider.Active {
+			continue
+		}
+		if chatModel := provider.ChatModel(t.Model); chatModel == nil || !chatModel.Active {
+			continue
+		}
+		client, err := NewProvider(provider)
+		if err != nil {
+			logger.Warning("Route of %s of %s skips %s: %v", model, dbName, provider.Name, err)
+			continue
+		}
+		r.targets = append(r.targets, target{provider: provider, model: t.Model, client: client})
+	}
+	return r
+}
+
+// order returns the targets to try: those in cooldown come last
+func (r *Route) order() []target {
+	ready := make([]target, 0, len(r.targets))
+	var cooling []target
+	for _, t := range r.targets {
+		if coolingDown(r.dbName, t.provider.ID) {
+			cooling = append(cooling, t)
+		} else {
+			ready = append(ready, t)
+		}
+	}
+	return append(ready, cooling...)
+}
+
+// call calls a target; it calls started when the answer starts reaching
+// the client, past which it cannot fail over
+type call func(ctx context.Context, client Provider, req Request, started func()) (*Response, error)
+
+// run tries the targets in order until one answers. A target slower than
+// the max latency, or failing with an error the route fails over on,
+// cools down and hands the chat to the next one; other errors, and errors
+// once the answer started reaching the client, are returned at once.
+func (r *Route) run(ctx context.Context, req Request, fn call) (*Response, []Attempt, error) {
+	attempts := make([]Attempt, 0, 1)
+	failovers := 0
+	maxLatency := time.Duration(r.route.MaxLatencyMs) * time.Millisecond
+	err := error(&Error{Class: models.LLMErrorUnavailable, Err: fmt.Errorf("no active provider serves %s", r.route.Model)})
+
+	for i, t := range r.order() {
+		req.Model = t.model
+		attemptCtx, cancel := context.WithCancelCause(ctx)
+		var timer *time.Timer
+		if maxLatency > 0 {
+			timer = time.AfterFunc(maxLatency, func() { cancel(errMaxLatency) })
+		}
+		started := false
+		begin := now()
+		var answer *Response
+		answer, err = fn(attemptCtx, t.client, req, func() {
+			if !started && timer != nil {
+				timer.Stop()
+			}
+			started = true
+		})
+		if timer != nil {
+			timer.Stop()
+		}
+		slow := errors.Is(context.Cause(attemptCtx), errMaxLatency)
+		cancel(nil)
+
+		attempt := Attempt{ProviderID: t.provider.ID, Provider: t.provider.Name, Model: t.model, DurationMs: now().Sub(begin).Milliseconds()}
+		if err == nil {
+			attempts = append(attempts, attempt)
+			recordSuccess(r.dbName, t.provider.ID)
+			count(r.dbName, r.route.Model, t.provider.Name+"/"+t.model, failovers)
+			answer.Provider, answer.Model = t.provider.Name, t.model
+			return answer, attempts, nil
+		}
+		if ctx.Err() != nil {
+			return nil, attempts, ctx.Err()
+		}
+		if slow {
+			err = &Error{Class: models.LLMErrorTimeout, Err: fmt.Errorf("no answer within %s", maxLatency)}
+		}
+		attempt.Class, attempt.Error = Classify(err), err.Error()
+		attempts = append(attempts, attempt)
+		if started || !(slow || r.route.FailsOverOn(attempt.Class)) {
+			break
+		}
+		recordFailure(r.dbName, t.provider)
+		if i < len(r.targets)-1 {
+			failovers++
+			logger.Warning("Route of %s of %s fails over from %s/%s: %v", r.route.Model, r.dbName, t.provider.Name, t.model, err)
+		}
+	}
+	count(r.dbName, r.route.Model, "", failovers)
+	return nil, attempts, err
+}
+
+// Complete sends a chat along the route; the returned attempts tell which
+// targets were called, the last one answering unless there is an error
+func (r *Route) Complete(ctx context.Context, req Request) (*Response, []Attempt, error) {
+	return r.run(ctx, req, func(ctx context.Context, client Provider, req Request, started func()) (*Response, error) {
+		return client.Complete(ctx, req)
+	})
+}
+
+// Stream sends a chat along the route, calling onDelta with the parts of
+// the answer. The route fails over until the first part reaches onDelta,
+// and its max latency bounds the wait for that part only.
+func (r *Route) Stream(ctx context.Context, req Request, onDelta func(delta string) error) (*Response, []Attempt, error) {
+	return r.run(ctx, req, func(ctx context.Context, client Provider, req Request, started func()) (*Response, error) {
+		return client.Stream(ctx, req, func(delta string) error {
+			started()
+			return onDelta(delta)
+		})
+	})
+}
@@ -0,0 +1,491 @@
+// Package loaddata fills a database with random records of its field
+// models for load testing, such as sizing the connection pool or
+// checking the index advice and pagination on large tables. Records are
+// generated from the fields of the model: values of the right type, size
+// and precision, picked among the options of selections, with relations
+// pointing at existing records, or at records created for the purpose,
+// with a skew so that some of them are referenced far more than others.
+// The same seed generates the same values.
+//
+// Generating data is refused unless the database is flagged as not a
+// production one with the base.non_production system parameter.
+package loaddata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"goodoo/fields"
+	"goodoo/logging"
+	"goodoo/models"
+	"goodoo/operations"
+	"goodoo/workpool"
+	"gorm.io/gorm"
+)
+
+// Limits of a generation
+const (
+	// DefaultBatchSize is the records created per transaction
+	DefaultBatchSize = 500
+	// MaxBatchSize bounds BatchSize
+	MaxBatchSize = 5000
+	// MaxCount bounds the records of one generation
+	MaxCount = 10000000
+	// MaxSamplePool bounds the existing records a relation samples from
+	MaxSamplePool = 100000
+)
+
+// ErrProduction is returned for the databases not flagged as non-production
+var ErrProduction = fmt.Errorf("the database is not flagged as non-production (set the %s system parameter to true)", models.ParamNonProduction)
+
+// ErrNotFieldModel is returned for the models without field definitions,
+// such as the Go models sale.order or res.partner: their records are
+// structs whose fields cannot be introspected
+var ErrNotFieldModel = errors.New("only field models can be generated")
+
+var logger = logging.GetLogger("goodoo.loaddata")
+
+// Relation sets how a relational field picks the records it references
+type Relation struct {
+	// Create creates that many records of the referenced model, generated
+	// the same way, instead of sampling the existing ones
+	Create int `json:"create,omitempty"`
+	// Pool bounds the existing records sampled, the first ones by id;
+	// MaxSamplePool when zero
+	Pool int `json:"pool,omitempty"`
+	// Skew concentrates the references on the first records of the pool:
+	// 0 spreads them evenly, and with a skew s the first 10% of the pool
+	// gets about 0.1^(1/(1+s)) of them, 32% with 1 and 56% with 3
+	Skew float64 `json:"skew,omitempty"`
+}
+
+// Options describe a generation
+type Options struct {
+	Model string `json:"model"`
+	Count int    `json:"count"`
+	// Seed makes the generated values reproducible; 0 is a seed like any other
+	Seed      int64 `json:"seed"`
+	BatchSize int   `json:"batch_size,omitempty"`
+	// Skew is the skew of the relations not listed in Relations
+	Skew float64 `json:"skew,omitempty"`
+	// Relations set the relational fields by name
+	Relations map[string]Relation `json:"relations,omitempty"`
+}
+
+// ParseArgs parses options written as key=value arguments, as the
+// --generate flag takes them: model=, count=, seed=, batch= and skew=,
+// and for a relational field <field>=sample[:skew[:pool]] or
+// <field>=create:<count>[:skew]
+func ParseArgs(args []string) (Options, error) {
+	opts := Options{Relations: make(map[string]Relation)}
+	for _, arg := range args {
+		for _, item := range strings.Fields(arg) {
+			key, value, found := strings.Cut(item, "=")
+			if !found || key == "" {
+				return opts, fmt.Errorf("invalid argument %q: expected key=value", item)
+			}
+			var err error
+			switch key {
+			case "model":
+				opts.Model = value
+			case "count":
+				opts.Count, err = strconv.Atoi(value)
+			case "seed":
+				opts.Seed, err = strconv.ParseInt(value, 10, 64)
+			case "batch":
+				opts.BatchSize, err = strconv.Atoi(value)
+			case "skew":
+				opts.Skew, err = strconv.ParseFloat(value, 64)
+			default:
+				opts.Relations[key], err = parseRelation(value)
+			}
+			if err != nil {
+				return opts, fmt.Errorf("invalid %s %q: %w", key, value, err)
+			}
+		}
+	}
+	return opts, nil
+}
+
+// parseRelation parses sample[:skew[:pool]] or create:<count>[:skew]
+func parseRelation(value string) (Relation, error) {
+	parts := strings.Split(value, ":")
+	var relation Relation
+	var err error
+	switch parts[0] {
+	case "sample":
+		if len(parts) > 3 {
+			return relation, errors.New("expected sample[:skew[:pool]]")
+		}
+		if len(parts) > 1 {
+			relation.Skew, err = strconv.ParseFloat(parts[1], 64)
+		}
+		if err == nil && len(parts) > 2 {
+			relation.Pool, err = strconv.Atoi(parts[2])
+		}
+	case "create":
+		if len(parts) < 2 || len(parts) > 3 {
+			return relation, errors.New("expected create:<count>[:skew]")
+		}
+		relation.Create, err = strconv.Atoi(parts[1])
+		if err == nil && relation.Create <= 0 {
+			err = errors.New("the count must be positive")
+		}
+		if err == nil && len(parts) > 2 {
+			relation.Skew, err = strconv.ParseFloat(parts[2], 64)
+		}
+	default:
+		return relation, errors.New("expected sample or create")
+	}
+	return relation, err
+}
+
+// CheckAllowed fails with ErrProduction unless the database is flagged as
+// non-production
+func CheckAllowed(dbName string) error {
+	if !models.GetParamBool(dbName, models.ParamNonProduction, false) {
+		return ErrProduction
+	}
+	return nil
+}
+
+// relationPlan is how a relational field of the generated model is filled
+type relationPlan struct {
+	field    string
+	comodel  string
+	table    string
+	required bool
+	relation Relation
+	// create generates the records of Relation.Create
+	create *Generator
+	// pool holds the ids referenced, filled by prepare
+	pool []uint
+}
+
+// Generator generates the records of one model
+type Generator struct {
+	env       *models.Environment
+	model     *models.ModelDefinition
+	opts      Options
+	now       time.Time
+	fields    []string
+	unique    map[string]bool
+	relations []*relationPlan
+}
+
+// New prepares the generation of records of a field model of the database
+// of env, failing with ErrNotFieldModel for the other models. Relations of
+// Options must name relational fields of the model, and the models they
+// create records of must be field models.
+func New(env *models.Environment, opts Options) (*Generator, error) {
+	return newGenerator(env, opts, time.Now().UTC(), map[string]bool{})
+}
+
+func newGenerator(env *models.Environment, opts Options, now time.Time, creating map[string]bool) (*Generator, error) {
+	model, ok := env.GetFieldModel(opts.Model)
+	if !ok {
+		return nil, fmt.Errorf("%w: %q is not a field model of the database; Go models such as sale.order have no field definitions to generate records from",
+			ErrNotFieldModel, opts.Model)
+	}
+	if model.Abstract || model.Transient || !model.AutoCreate {
+		return nil, fmt.Errorf("model %s has no records to generate", model.Name)
+	}
+	if opts.Count <= 0 || opts.Count > MaxCount {
+		return nil, fmt.Errorf("the count must be between 1 and %d", MaxCount)
+	}
+	if opts.BatchSize == 0 {
+		opts.BatchSize = DefaultBatchSize
+	}
+	if opts.BatchSize < 0 || opts.BatchSize > MaxBatchSize {
+		return nil, fmt.Errorf("the batch size must be between 1 and %d", MaxBatchSize)
+	}
+	if opts.Skew < 0 {
+		return nil, errors.New("the skew cannot be negative")
+	}
+
+	g := &Generator{env: env, model: model, opts: opts, now: now, unique: make(map[string]bool)}
+	for _, constraint := range model.Constraints {
+		if constraint.Kind == models.ConstraintUnique {
+			for _, name := range constraint.Fields {
+				g.unique[name] = true
+			}
+		}
+	}
+	registry := models.RegistryForDB(env.GetDBName())
+	for _, name := range model.GetFieldNames() {
+		field := model.Fields[name]
+		attrs := field.GetAttributes()
+		if models.IsMagicColumn(name) || !field.IsStored() || (!field.IsRequired() && (attrs.Readonly || len(attrs.Depends) > 0)) {
+			continue
+		}
+		if attrs.Relation == "" {
+			// Files are only generated where the model requires them
+			if field.GetType() == fields.BinaryType && !field.IsRequired() {
+				continue
+			}
+			g.fields = append(g.fields, name)
+			if attrs.Unique {
+				g.unique[name] = true
+			}
+			continue
+		}
+		plan := &relationPlan{field: name, comodel: attrs.Relation, required: field.IsRequired(), relation: Relation{Skew: opts.Skew}}
+		if relation, ok := opts.Relations[name]; ok {
+			plan.relation = relation
+		}
+		if plan.relation.Skew < 0 {
+			return nil, fmt.Errorf("the skew of %s cannot be negative", name)
+		}
+		if comodel, ok := registry.GetModel(attrs.Relation); ok {
+			plan.table = comodel.TableName
+		} else {
+			plan.table = strings.ReplaceAll(attrs.Relation, ".", "_")
+		}
+		if plan.relation.Create > 0 {
+			if creating[attrs.Relation] || attrs.Relation == model.Name {
+				return nil, fmt.Errorf("%s cannot create %s records: the relations create records in a cycle", name, attrs.Relation)
+			}
+			creating[model.Name] = true
+			sub, err := newGenerator(env, Options{
+				Model: attrs.Relation, Count: plan.relation.Create, Seed: derivedSeed(opts.Seed, name),
+				BatchSize: opts.BatchSize, Skew: opts.Skew,
+			}, now, creating)
+			delete(creating, model.Name)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			plan.create = sub
+		}
+		g.relations = append(g.relations, plan)
+	}
+	for name := range opts.Relations {
+		if !slices.ContainsFunc(g.relations, func(plan *relationPlan) bool { return plan.field == name }) {
+			return nil, fmt.Errorf("%s is not a relational field of %s", name, model.Name)
+		}
+	}
+	sort.Strings(g.fields)
+	sort.Slice(g.relations, func(i, j int) bool { return g.relations[i].field < g.relations[j].field })
+	return g, nil
+}
+
+// derivedSeed returns the seed of the records a relation creates
+func derivedSeed(seed int64, field string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(field))
+	return seed ^ int64(h.Sum64())
+}
+
+// Total returns the records the generation creates, those of the
+// relations included
+func (g *Generator) Total() int {
+	total := g.opts.Count
+	for _, plan := range g.relations {
+		if plan.create != nil {
+			total += plan.create.Total()
+		}
+	}
+	return total
+}
+
+// Model returns the model generated
+func (g *Generator) Model() *models.ModelDefinition {
+	return g.model
+}
+
+// Record returns the values of the record of index i, without its
+// relations: the same seed and index always give the same values
+func (g *Generator) Record(i int) map[string]interface{} {
+	rng := g.rng(i)
+	record := make(map[string]interface{}, len(g.fields)+len(g.relations))
+	for _, name := range g.fields {
+		if value := fieldValue(rng, g.model.Fields[name], g.unique[name], i, g.now); value != nil {
+			record[name] = value
+		}
+	}
+	return record
+}
+
+// rng returns the random source of the record of index i
+func (g *Generator) rng(i int) *rand.Rand {
+	return rand.New(rand.NewPCG(uint64(g.opts.Seed), uint64(i)))
+}
+
+// reference returns the record of a relation the record of index i
+// references, 0 for none
+func (g *Generator) reference(plan *relationPlan, i int) uint {
+	if len(plan.pool) == 0 {
+		return 0
+	}
+	// A stream of its own per relation keeps the values of the other
+	// fields when relations are added
+	rng := rand.New(rand.NewPCG(uint64(derivedSeed(g.opts.Seed, plan.field)), uint64(i)))
+	if !plan.required && rng.Float64() < nullRate {
+		return 0
+	}
+	return plan.pool[pick(rng, len(plan.pool), plan.relation.Skew)]
+}
+
+// prepare fills the pools of the relations, creating their records first
+func (g *Generator) prepare(ctx context.Context, op *operations.Operation) error {
+	for _, plan := range g.relations {
+		if plan.create != nil {
+			ids, err := plan.create.run(ctx, op)
+			if err != nil {
+				return fmt.Errorf("%s: %w", plan.field, err)
+			}
+			plan.pool = ids
+			continue
+		}
+		limit := plan.relation.Pool
+		if limit <= 0 || limit > MaxSamplePool {
+			limit = MaxSamplePool
+		}
+		query := g.env.GetDB().WithContext(ctx).Table(plan.table).Order("id").Limit(limit)
+		if g.env.GetDB().Migrator().HasColumn(plan.table, "active") {
+			query = query.Where("active IS NOT FALSE")
+		}
+		if err := query.Pluck("id", &plan.pool).Error; err != nil {
+			return fmt.Errorf("%s: failed to read the %s records: %w", plan.field, plan.comodel, err)
+		}
+		if len(plan.pool) == 0 && plan.required {
+			return fmt.Errorf("%s is required and there is no %s record to reference: create some with %s=create:<count>",
+				plan.field, plan.comodel, plan.field)
+		}
+	}
+	return nil
+}
+
+// Validate generates the record of index i and checks it against the
+// model, as the records created are
+func (g *Generator) Validate(i int) error {
+	return g.model.ValidateData(g.complete(i))
+}
+
+// complete returns the record of index i with its relations
+func (g *Generator) complete(i int) map[string]interface{} {
+	record := g.Record(i)
+	for _, plan := range g.relations {
+		if id := g.reference(plan, i); id != 0 {
+			record[plan.field] = id
+		}
+	}
+	return record
+}
+
+// Run creates the records, reporting progress on op, and returns the ids
+// of those created. Records the model refuses are counted as failed on
+// op rather than stopping the generation.
+func (g *Generator) Run(ctx context.Context, op *operations.Operation) ([]uint, error) {
+	started := time.Now()
+	ids, err := g.run(ctx, op)
+	status := op.Status()
+	logger.Info("Generated %d %s record(s) of %s in %s, %d failed", status.Processed, g.model.Name,
+		g.env.GetDBName(), time.Since(started).Round(time.Millisecond), status.Failed)
+	return ids, err
+}
+
+// run creates the records of the relations, then those of the model in
+// batches: the batches of a round run in parallel on the worker pool,
+// each generating its records and creating them in one transaction
+func (g *Generator) run(ctx context.Context, op *operations.Operation) ([]uint, error) {
+	if err := g.prepare(ctx, op); err != nil {
+		return nil, err
+	}
+
+	batchSize := g.opts.BatchSize
+	batches := (g.opts.Count + batchSize - 1) / batchSize
+	parallel := max(1, workpool.CurrentConfig().Size)
+	ids := make([]uint, g.opts.Count)
+	for first := 0; first < batches; first += parallel {
+		if op.Cancelled() || ctx.Err() != nil {
+			break
+		}
+		round := min(parallel, batches-first)
+		op.BeginBatch(first+round, batches)
+		err := workpool.Map(ctx, round, func(ctx context.Context, i int) error {
+			batch := first + i
+			start, end := batch*batchSize, min((batch+1)*batchSize, g.opts.Count)
+			g.createBatch(ctx, op, start, end, ids)
+			return nil
+		})
+		if err != nil && !errors.Is(err, context.Canceled) {
+			return nil, err
+		}
+	}
+
+	created := ids[:0]
+	for _, id := range ids {
+		if id != 0 {
+			created = append(created, id)
+		}
+	}
+	return created, nil
+}
+
+// createBatch creates the records [start, end) in one transaction, storing
+// their ids. When the transaction fails, the records are created one by
+// one so that only those the model refuses fail.
+func (g *Generator) createBatch(ctx context.Context, op *operations.Operation, start, end int, ids []uint) {
+	records := make([]map[string]interface{}, end-start)
+	for i := range records {
+		records[i] = g.complete(start + i)
+	}
+	env := g.env.WithDB(g.env.GetDB().WithContext(ctx))
+	err := env.Transaction(func(tx *gorm.DB) error {
+		batchEnv := env.WithDB(tx)
+		for i, record := range records {
+			id, err := g.model.Create(batchEnv, record)
+			if err != nil {
+				return err
+			}
+			ids[start+i] = id
+		}
+		return nil
+	})
+	if err == nil {
+		op.Progress(len(records), 0, nil)
+		return
+	}
+
+	for i, record := range records {
+		ids[start+i] = 0
+		if ctx.Err() != nil {
+			return
+		}
+		id, err := g.model.Create(env, record)
+		if err != nil {
+			op.Progress(0, 1, fmt.Errorf("%s record %d: %w", g.model.Name, start+i, err))
+			continue
+		}
+		ids[start+i] = id
+		op.Progress(1, 0, nil)
+	}
+}
+
+// detach makes the generation outlive the request that prepared it
+func (g *Generator) detach() {
+	g.env = g.env.Detach()
+	for _, plan := range g.relations {
+		if plan.create != nil {
+			plan.create.detach()
+		}
+	}
+}
+
+// Start runs a generation in the background as an operation of a user;
+// the caller checks CheckAllowed first
+func Start(g *Generator, userID int) *operations.Operation {
+	g.detach()
+	return operations.Start("load_data", g.model.Name, g.env.GetDBName(), userID, g.Total(), func(ctx context.Context, op *operations.Operation) error {
+		_, err := g.Run(ctx, op)
+		return err
+	})
+}
@@ -0,0 +1,279 @@
+package loaddata
+
+import (
+	"errors"
+	"math"
+	"math/rand/v2"
+	"reflect"
+	"testing"
+	"time"
+
+	"goodoo/fields"
+	"goodoo/models"
+	"goodoo/models/testutil"
+)
+
+// orderModel returns x_order, a model with a field of each type the
+// generator fills and a required relation to res.partner
+func orderModel(t *testing.T) *models.ModelDefinition {
+	model := models.NewModelDefinition("x_order", "x_order")
+	add := func(name string, fieldType fields.FieldType, attrs fields.FieldAttribute, configure func(fields.Field)) {
+		attrs.Store = true
+		field, err := fields.CreateField(fieldType, attrs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if configure != nil {
+			configure(field)
+		}
+		model.AddField(name, field)
+	}
+	add("name", fields.StringType, fields.FieldAttribute{Required: true}, func(f fields.Field) { f.(*fields.StringField).Size = 12 })
+	add("code", fields.StringType, fields.FieldAttribute{Required: true, Unique: true}, func(f fields.Field) { f.(*fields.StringField).Size = 10 })
+	add("email", fields.StringType, fields.FieldAttribute{Nullable: true}, nil)
+	add("note", fields.TextType, fields.FieldAttribute{}, nil)
+	add("body", fields.HtmlType, fields.FieldAttribute{}, nil)
+	add("done", fields.BooleanType, fields.FieldAttribute{}, nil)
+	add("qty", fields.IntegerType, fields.FieldAttribute{Required: true}, nil)
+	add("amount", fields.FloatType, fields.FieldAttribute{}, func(f fields.Field) {
+		f.(*fields.FloatField).Digits = &fields.FloatDigits{Total: 6, Decimal: 2}
+	})
+	add("state", fields.SelectionType, fields.FieldAttribute{Required: true}, func(f fields.Field) {
+		f.(*fields.SelectionField).Selection = []fields.SelectionOption{{Value: "draft", Label: "Draft"}, {Value: "done", Label: "Done"}}
+	})
+	add("date_order", fields.DateType, fields.FieldAttribute{Required: true}, nil)
+	add("confirmed_at", fields.DatetimeType, fields.FieldAttribute{Nullable: true}, nil)
+	add("data", fields.JsonType, fields.FieldAttribute{}, nil)
+	add("partner_id", fields.IntegerType, fields.FieldAttribute{Required: true, Relation: "res.partner"}, nil)
+	add("user_id", fields.IntegerType, fields.FieldAttribute{Nullable: true, Relation: "res.users"}, nil)
+	return model
+}
+
+// newTestGenerator prepares the generation of count x_order records with
+// the relations sampling the given pools, without a database
+func newTestGenerator(t *testing.T, opts Options, pools map[string][]uint) *Generator {
+	t.Helper()
+	registry := models.NewFieldModelRegistry()
+	if err := registry.RegisterModel(orderModel(t)); err != nil {
+		t.Fatal(err)
+	}
+	db, _ := testutil.DryRunDB(t)
+	env := models.NewEnvironment(db, 1).WithRegistry(registry)
+	if opts.Model == "" {
+		opts.Model = "x_order"
+	}
+	g, err := newGenerator(env, opts, time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC), map[string]bool{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, plan := range g.relations {
+		plan.pool = pools[plan.field]
+	}
+	return g
+}
+
+// partnerPool is the pool of partner ids of the tests
+func partnerPool(n int) []uint {
+	pool := make([]uint, n)
+	for i := range pool {
+		pool[i] = uint(i + 1)
+	}
+	return pool
+}
+
+func TestParseArgs(t *testing.T) {
+	opts, err := ParseArgs([]string{"model=x_order count=1000 seed=7", "batch=200", "skew=0.5", "partner_id=sample:2:50", "user_id=create:10:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Options{
+		Model: "x_order", Count: 1000, Seed: 7, BatchSize: 200, Skew: 0.5,
+		Relations: map[string]Relation{"partner_id": {Skew: 2, Pool: 50}, "user_id": {Create: 10, Skew: 1}},
+	}
+	if !reflect.DeepEqual(opts, want) {
+		t.Errorf("ParseArgs = %+v, want %+v", opts, want)
+	}
+
+	for _, args := range []string{"count", "count=many", "seed=1.5", "partner_id=all", "partner_id=sample:1:2:3", "partner_id=create", "partner_id=create:0", "partner_id=create:x"} {
+		if _, err := ParseArgs([]string{args}); err == nil {
+			t.Errorf("ParseArgs(%q) succeeded, want an error", args)
+		}
+	}
+}
+
+func TestNewRejects(t *testing.T) {
+	g := newTestGenerator(t, Options{Count: 1}, nil)
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{"go model", Options{Model: "sale.order", Count: 10}},
+		{"go model created by a relation", Options{Model: "x_order", Count: 10, Relations: map[string]Relation{"partner_id": {Create: 5}}}},
+		{"no count", Options{Model: "x_order"}},
+		{"too many", Options{Model: "x_order", Count: MaxCount + 1}},
+		{"batch too large", Options{Model: "x_order", Count: 10, BatchSize: MaxBatchSize + 1}},
+		{"negative skew", Options{Model: "x_order", Count: 10, Skew: -1}},
+		{"negative relation skew", Options{Model: "x_order", Count: 10, Relations: map[string]Relation{"partner_id": {Skew: -1}}}},
+		{"not a relation", Options{Model: "x_order", Count: 10, Relations: map[string]Relation{"name": {}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(g.env, tt.opts); err == nil {
+				t.Errorf("New(%+v) succeeded, want an error", tt.opts)
+			}
+		})
+	}
+
+	// The Go models are rejected as such, directly or through a relation
+	for _, opts := range []Options{tests[0].opts, tests[1].opts} {
+		if _, err := New(g.env, opts); !errors.Is(err, ErrNotFieldModel) {
+			t.Errorf("New(%+v) = %v, want ErrNotFieldModel", opts, err)
+		}
+	}
+}
+
+// TestValidate checks the generated records against the model's own
+// ValidateData
+func TestValidate(t *testing.T) {
+	g := newTestGenerator(t, Options{Count: 2000, Seed: 42}, map[string][]uint{"partner_id": partnerPool(20), "user_id": partnerPool(3)})
+	codes := make(map[interface{}]int)
+	for i := 0; i < g.opts.Count; i++ {
+		if err := g.Validate(i); err != nil {
+			t.Fatalf("record %d %v: %v", i, g.complete(i), err)
+		}
+		record := g.complete(i)
+		if previous, ok := codes[record["code"]]; ok {
+			t.Fatalf("records %d and %d share the unique code %v", previous, i, record["code"])
+		}
+		codes[record["code"]] = i
+		if name := record["name"].(string); len(name) > 12 {
+			t.Errorf("record %d has a name of %d bytes, longer than the size of 12", i, len(name))
+		}
+		if amount, ok := record["amount"].(float64); ok && (amount >= 10000 || amount != math.Round(amount*100)/100) {
+			t.Errorf("record %d has an amount %v not fitting 6 digits with 2 decimals", i, amount)
+		}
+	}
+}
+
+// TestRecordSeed generates the same values from the same seed, whatever
+// the order of the records
+func TestRecordSeed(t *testing.T) {
+	pools := map[string][]uint{"partner_id": partnerPool(20)}
+	g := newTestGenerator(t, Options{Count: 100, Seed: 1}, pools)
+	same := newTestGenerator(t, Options{Count: 100, Seed: 1}, pools)
+	other := newTestGenerator(t, Options{Count: 100, Seed: 2}, pools)
+
+	differ := 0
+	for i := 99; i >= 0; i-- {
+		if !reflect.DeepEqual(g.complete(i), same.complete(i)) {
+			t.Fatalf("record %d differs with the same seed: %v and %v", i, g.complete(i), same.complete(i))
+		}
+		if !reflect.DeepEqual(g.complete(i), other.complete(i)) {
+			differ++
+		}
+	}
+	if differ < 90 {
+		t.Errorf("only %d of 100 records differ with another seed", differ)
+	}
+}
+
+// TestDates generates dates in the past, spread over dateSpan before the
+// time the generation started
+func TestDates(t *testing.T) {
+	g := newTestGenerator(t, Options{Count: 1000, Seed: 3}, map[string][]uint{"partner_id": partnerPool(1)})
+	oldest, newest := g.now, g.now.Add(-dateSpan)
+	empty := 0
+	for i := 0; i < g.opts.Count; i++ {
+		record := g.Record(i)
+		date, err := time.Parse("2006-01-02", record["date_order"].(string))
+		if err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+		if date.After(g.now) || date.Before(g.now.Add(-dateSpan-24*time.Hour)) {
+			t.Errorf("record %d is dated %v, not within %v before %v", i, date, dateSpan, g.now)
+		}
+		if date.After(newest) {
+			newest = date
+		}
+		if date.Before(oldest) {
+			oldest = date
+		}
+
+		confirmed, ok := record["confirmed_at"]
+		if !ok {
+			empty++
+			continue
+		}
+		at, err := time.Parse("2006-01-02 15:04:05", confirmed.(string))
+		if err != nil || at.After(g.now) || at.Before(g.now.Add(-dateSpan)) {
+			t.Errorf("record %d was confirmed at %v (%v), not within %v before %v", i, confirmed, err, dateSpan, g.now)
+		}
+	}
+	if span := newest.Sub(oldest); span < dateSpan*9/10 {
+		t.Errorf("the dates span %v, want about %v", span, dateSpan)
+	}
+	// The nullable datetime is left empty for about nullRate of the records
+	if rate := float64(empty) / float64(g.opts.Count); math.Abs(rate-nullRate) > 0.03 {
+		t.Errorf("%.1f%% of the records have no confirmation date, want about %.0f%%", rate*100, nullRate*100)
+	}
+}
+
+// TestPickSkew draws indexes with a skew: the first 10% of them are drawn
+// with a probability of about 0.1^(1/(1+skew)), as documented on Relation
+func TestPickSkew(t *testing.T) {
+	const n, draws = 1000, 200000
+	for _, tt := range []struct {
+		skew, share float64
+	}{{0, 0.10}, {1, 0.32}, {3, 0.56}} {
+		rng := rand.New(rand.NewPCG(1, 2))
+		head := 0
+		for i := 0; i < draws; i++ {
+			index := pick(rng, n, tt.skew)
+			if index < 0 || index >= n {
+				t.Fatalf("pick = %d, out of [0, %d)", index, n)
+			}
+			if index < n/10 {
+				head++
+			}
+		}
+		if share := float64(head) / draws; math.Abs(share-tt.share) > 0.01 {
+			t.Errorf("skew %v: the first 10%% are drawn %.3f of the time, want %.2f", tt.skew, share, tt.share)
+		}
+	}
+}
+
+// TestReferenceSkew references the partners of a pool: the skew of the
+// relation concentrates the orders on the first partners, the optional
+// relation is left empty for some records and the required one never
+func TestReferenceSkew(t *testing.T) {
+	const count = 20000
+	pools := map[string][]uint{"partner_id": partnerPool(100), "user_id": partnerPool(100)}
+	for _, tt := range []struct {
+		skew, share float64
+	}{{0, 0.10}, {3, 0.56}} {
+		g := newTestGenerator(t, Options{Count: count, Seed: 5, Relations: map[string]Relation{"partner_id": {Skew: tt.skew}}}, pools)
+		orders := make(map[uint]int)
+		unassigned := 0
+		for i := 0; i < count; i++ {
+			record := g.complete(i)
+			partner, ok := record["partner_id"].(uint)
+			if !ok {
+				t.Fatalf("record %d has no partner", i)
+			}
+			orders[partner]++
+			if _, ok := record["user_id"]; !ok {
+				unassigned++
+			}
+		}
+		head := 0
+		for id := uint(1); id <= 10; id++ {
+			head += orders[id]
+		}
+		if share := float64(head) / count; math.Abs(share-tt.share) > 0.02 {
+			t.Errorf("skew %v: the first 10 partners have %.3f of the orders, want %.2f", tt.skew, share, tt.share)
+		}
+		if rate := float64(unassigned) / count; math.Abs(rate-nullRate) > 0.02 {
+			t.Errorf("skew %v: %.3f of the orders have no user, want about %.2f", tt.skew, rate, nullRate)
+		}
+	}
+}
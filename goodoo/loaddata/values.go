@@ -0,0 +1,156 @@
+package loaddata
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"time"
+
+	"goodoo/fields"
+)
+
+// words are the vocabulary of the generated strings
+var words = []string{
+	"alpha", "amber", "anchor", "apex", "atlas", "aurora", "basil", "beacon", "birch", "bolt",
+	"cedar", "cobalt", "comet", "coral", "crest", "delta", "drift", "ember", "falcon", "fern",
+	"flint", "garnet", "glacier", "harbor", "hazel", "indigo", "iris", "jade", "juniper", "lark",
+	"linen", "maple", "meadow", "nova", "oak", "onyx", "orbit", "pearl", "pine", "quartz",
+	"raven", "ridge", "sable", "sage", "slate", "spruce", "summit", "tide", "umber", "willow",
+}
+
+// nullRate is the share of nullable optional fields left empty
+const nullRate = 0.1
+
+// dateSpan is how far in the past generated dates go
+const dateSpan = 3 * 365 * 24 * time.Hour
+
+// phrase returns n random words
+func phrase(rng *rand.Rand, n int) string {
+	parts := make([]string, n)
+	for i := range parts {
+		parts[i] = words[rng.IntN(len(words))]
+	}
+	return strings.Join(parts, " ")
+}
+
+// title capitalizes the words of s
+func title(s string) string {
+	parts := strings.Fields(s)
+	for i, part := range parts {
+		parts[i] = strings.ToUpper(part[:1]) + part[1:]
+	}
+	return strings.Join(parts, " ")
+}
+
+// fit shortens s so that it and suffix hold in size bytes, 0 meaning
+// unbounded, and appends suffix
+func fit(s, suffix string, size int) string {
+	if size > 0 && len(s)+len(suffix) > size {
+		s = strings.TrimSpace(s[:max(0, size-len(suffix))])
+	}
+	return s + suffix
+}
+
+// stringValue returns a string for a char field, shaped after its name:
+// emails, phones, URLs, codes or a few words. unique appends the index of
+// the record so that no two records share it.
+func stringValue(rng *rand.Rand, name string, size int, unique bool, index int) string {
+	suffix := ""
+	if unique {
+		suffix = "-" + strconv.Itoa(index)
+	}
+	switch {
+	case strings.Contains(name, "email"):
+		local := strings.ReplaceAll(phrase(rng, 2), " ", ".")
+		return fit(local, suffix+"@example.com", size)
+	case strings.Contains(name, "phone") || strings.Contains(name, "mobile"):
+		return fit(fmt.Sprintf("+1 555 %03d %04d", rng.IntN(1000), rng.IntN(10000)), suffix, size)
+	case strings.Contains(name, "url") || strings.Contains(name, "website"):
+		return fit("https://example.com/"+strings.ReplaceAll(phrase(rng, 2), " ", "-"), suffix, size)
+	case strings.Contains(name, "code") || strings.Contains(name, "ref"):
+		return fit(strings.ToUpper(words[rng.IntN(len(words))][:3])+fmt.Sprintf("%05d", rng.IntN(100000)), suffix, size)
+	case strings.Contains(name, "name"):
+		return fit(title(phrase(rng, 2+rng.IntN(2))), suffix, size)
+	}
+	return fit(phrase(rng, 1+rng.IntN(4)), suffix, size)
+}
+
+// floatValue returns a float fitting the precision of digits, below
+// 100000 without one
+func floatValue(rng *rand.Rand, digits *fields.FloatDigits) float64 {
+	limit, decimals := 100000.0, 2
+	if digits != nil {
+		decimals = digits.Decimal
+		if whole := digits.Total - digits.Decimal; whole < 5 {
+			limit = math.Pow10(whole)
+		}
+	}
+	scale := math.Pow10(decimals)
+	// Rounding down keeps the value below limit at the precision
+	return math.Floor(rng.Float64()*limit*scale) / scale
+}
+
+// fieldValue returns a random valid value of a field that is not
+// relational, nil when the field is left empty. now anchors the dates.
+func fieldValue(rng *rand.Rand, field fields.Field, unique bool, index int, now time.Time) interface{} {
+	attrs := field.GetAttributes()
+	if !field.IsRequired() && attrs.Nullable && rng.Float64() < nullRate {
+		return nil
+	}
+	name := field.GetName()
+	past := func() time.Time {
+		return now.Add(-time.Duration(rng.Int64N(int64(dateSpan))))
+	}
+
+	switch f := field.(type) {
+	case *fields.BooleanField:
+		return rng.IntN(2) == 0
+	case *fields.IntegerField:
+		if unique {
+			return index
+		}
+		return rng.IntN(1000)
+	case *fields.MonetaryField:
+		return floatValue(rng, f.Digits)
+	case *fields.FloatField:
+		return floatValue(rng, f.Digits)
+	case *fields.StringField:
+		return stringValue(rng, name, f.Size, unique, index)
+	case *fields.HtmlField:
+		return "<p>" + title(phrase(rng, 1)) + " " + phrase(rng, 8+rng.IntN(12)) + ".</p>"
+	case *fields.TextField:
+		return title(phrase(rng, 1)) + " " + phrase(rng, 8+rng.IntN(24)) + "."
+	case *fields.DateField:
+		return past().Format("2006-01-02")
+	case *fields.DatetimeField:
+		return past().UTC().Format("2006-01-02 15:04:05")
+	case *fields.SelectionField:
+		if len(f.Selection) == 0 {
+			return nil
+		}
+		return f.Selection[rng.IntN(len(f.Selection))].Value
+	case *fields.BinaryField:
+		data := make([]byte, 16+rng.IntN(48))
+		for i := range data {
+			data[i] = byte(rng.IntN(256))
+		}
+		return base64.StdEncoding.EncodeToString(data)
+	case *fields.JsonField:
+		return map[string]interface{}{"tag": words[rng.IntN(len(words))], "score": rng.IntN(100)}
+	}
+	return nil
+}
+
+// pick returns an index in [0, n) drawn with skew: 0 draws uniformly, and
+// higher skews favor the first indexes, the first fraction f of them
+// being drawn with probability f^(1/(1+skew))
+func pick(rng *rand.Rand, n int, skew float64) int {
+	u := rng.Float64()
+	if skew > 0 {
+		u = math.Pow(u, 1+skew)
+	}
+	return min(int(u*float64(n)), n-1)
+}
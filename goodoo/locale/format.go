@@ -0,0 +1,245 @@
+package locale
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// currencySymbols maps ISO codes to their symbol and whether it is placed
+// before the amount
+var currencySymbols = map[string]struct {
+	symbol string
+	before bool
+}{
+	"USD": {"$", true},
+	"EUR": {"€", false},
+	"GBP": {"£", true},
+	"JPY": {"¥", true},
+	"CHF": {"CHF", true},
+	"INR": {"₹", true},
+	"BRL": {"R$", true},
+}
+
+// group inserts the thousands separator in a string of digits
+func (l *Locale) group(digits string) string {
+	var groups []string
+	sizes := l.Grouping
+	for len(digits) > 0 {
+		size := sizes[0]
+		if len(sizes) > 1 {
+			sizes = sizes[1:]
+		}
+		if size <= 0 || size >= len(digits) {
+			groups = append(groups, digits)
+			break
+		}
+		groups = append(groups, digits[len(digits)-size:])
+		digits = digits[:len(digits)-size]
+	}
+	for i, j := 0, len(groups)-1; i < j; i, j = i+1, j-1 {
+		groups[i], groups[j] = groups[j], groups[i]
+	}
+	return strings.Join(groups, l.ThousandsSep)
+}
+
+// FormatNumber formats a number with digits decimals and grouped thousands
+func (l *Locale) FormatNumber(value float64, digits int) string {
+	if digits < 0 {
+		digits = 0
+	}
+	formatted := strconv.FormatFloat(math.Abs(value), 'f', digits, 64)
+	whole, fraction, _ := strings.Cut(formatted, ".")
+	result := l.group(whole)
+	if fraction != "" {
+		result += l.DecimalSep + fraction
+	}
+	if value < 0 && strings.Trim(formatted, "0.") != "" {
+		result = "-" + result
+	}
+	return result
+}
+
+// FormatInteger formats an integer with grouped thousands
+func (l *Locale) FormatInteger(value int64) string {
+	if value < 0 {
+		return "-" + l.group(strconv.FormatUint(uint64(-value), 10))
+	}
+	return l.group(strconv.FormatInt(value, 10))
+}
+
+// FormatMonetary formats an amount with two decimals and the symbol of
+// an ISO currency, or its code when the symbol is unknown
+func (l *Locale) FormatMonetary(amount float64, currency string) string {
+	value := l.FormatNumber(amount, 2)
+	if info, ok := currencySymbols[currency]; ok {
+		if info.before {
+			return info.symbol + " " + value
+		}
+		return value + " " + info.symbol
+	}
+	if currency == "" {
+		return value
+	}
+	return value + " " + currency
+}
+
+// FormatDate formats the date of t
+func (l *Locale) FormatDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(l.DateFormat)
+}
+
+// FormatTime formats the time of day of t
+func (l *Locale) FormatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(l.TimeFormat)
+}
+
+// DatetimeFormat returns the layout of dates with a time
+func (l *Locale) DatetimeFormat() string {
+	return l.DateFormat + " " + l.TimeFormat
+}
+
+// FormatDatetime formats t in its location
+func (l *Locale) FormatDatetime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(l.DatetimeFormat())
+}
+
+// isSpace reports whether r is a space the user may type in place of a
+// no-break thousands separator
+func isSpace(r rune) bool {
+	return r == ' ' || r == '\u00a0' || r == '\u202f'
+}
+
+// localizedNumber converts a number written with the locale separators to
+// the canonical notation, or reports false when the digit groups do not
+// follow the locale grouping
+func (l *Locale) localizedNumber(s string) (string, bool) {
+	sign := ""
+	if strings.HasPrefix(s, "-") || strings.HasPrefix(s, "+") {
+		sign, s = s[:1], s[1:]
+	}
+	whole, fraction, hasFraction := strings.Cut(s, l.DecimalSep)
+	if hasFraction && (fraction == "" || !allDigits(fraction)) {
+		return "", false
+	}
+
+	var groups []string
+	if strings.TrimFunc(l.ThousandsSep, isSpace) == "" {
+		groups = strings.FieldsFunc(whole, isSpace)
+		if strings.IndexFunc(whole, isSpace) >= 0 && len(groups) < 2 {
+			return "", false
+		}
+	} else {
+		groups = strings.Split(whole, l.ThousandsSep)
+	}
+	if len(groups) == 0 {
+		return "", false
+	}
+
+	// Check the group sizes from the right
+	sizes := l.Grouping
+	for i := len(groups) - 1; i >= 0; i-- {
+		group := groups[i]
+		if group == "" || !allDigits(group) {
+			return "", false
+		}
+		if i == 0 {
+			if len(groups) > 1 && len(group) > sizes[0] {
+				return "", false
+			}
+			break
+		}
+		if len(group) != sizes[0] {
+			return "", false
+		}
+		if len(sizes) > 1 {
+			sizes = sizes[1:]
+		}
+	}
+
+	canonical := sign + strings.Join(groups, "")
+	if hasFraction {
+		canonical += "." + fraction
+	}
+	return canonical, true
+}
+
+// allDigits reports whether s only has ASCII digits
+func allDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// ParseNumber parses a number written by a user of the locale, such as
+// "1.234,56" in de_DE. Digit groups must follow the locale grouping; other
+// inputs are read in the canonical notation, so "1.5" stays 1.5.
+func (l *Locale) ParseNumber(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	if canonical, ok := l.localizedNumber(s); ok {
+		return strconv.ParseFloat(canonical, 64)
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+	return value, nil
+}
+
+// ParseInteger parses an integer like ParseNumber
+func (l *Locale) ParseInteger(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if canonical, ok := l.localizedNumber(s); ok && !strings.Contains(canonical, ".") {
+		return strconv.ParseInt(canonical, 10, 64)
+	}
+	value, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid integer %q", s)
+	}
+	return value, nil
+}
+
+// ParseDate parses a date in the locale format, or in the canonical
+// YYYY-MM-DD format
+func (l *Locale) ParseDate(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range []string{l.DateFormat, "2006-01-02"} {
+		if parsed, err := time.Parse(layout, s); err == nil {
+			return parsed, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q", s)
+}
+
+// ParseDatetime parses a date and time in the locale format, with or
+// without seconds, as a time in loc; the result is in UTC
+func (l *Locale) ParseDatetime(s string, loc *time.Location) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if loc == nil {
+		loc = time.UTC
+	}
+	layouts := []string{
+		l.DatetimeFormat(),
+		l.DateFormat + " " + strings.Replace(l.TimeFormat, ":05", "", 1),
+	}
+	for _, layout := range layouts {
+		if parsed, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return parsed.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid datetime %q", s)
+}
@@ -0,0 +1,103 @@
+// Package locale formats and parses numbers, amounts and dates for display
+// in a user's language (like the res.lang records of Odoo). Values stored
+// and exported keep their canonical, locale-independent formats.
+package locale
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultLang is the language used for unknown codes
+const DefaultLang = "en_US"
+
+// nbsp is the no-break space separating thousands in many languages
+const nbsp = "\u00a0"
+
+// Locale holds the display conventions of a language
+type Locale struct {
+	Code         string `json:"code"`
+	DecimalSep   string `json:"decimal_point"`
+	ThousandsSep string `json:"thousands_sep"`
+	// Grouping gives the sizes of the digit groups from the right; the last
+	// size repeats, e.g. [3, 2] groups 12,34,56,789
+	Grouping []int `json:"grouping"`
+	// DateFormat and TimeFormat are Go layouts
+	DateFormat   string       `json:"date_format"`
+	TimeFormat   string       `json:"time_format"`
+	FirstWeekday time.Weekday `json:"week_start"`
+}
+
+// locales are the known languages, by code
+var locales = map[string]*Locale{}
+
+func init() {
+	for _, l := range []*Locale{
+		{Code: "en_US", DecimalSep: ".", ThousandsSep: ",", DateFormat: "01/02/2006", TimeFormat: "03:04:05 PM", FirstWeekday: time.Sunday},
+		{Code: "en_GB", DecimalSep: ".", ThousandsSep: ",", DateFormat: "02/01/2006", TimeFormat: "15:04:05", FirstWeekday: time.Monday},
+		{Code: "en_IN", DecimalSep: ".", ThousandsSep: ",", Grouping: []int{3, 2}, DateFormat: "02/01/2006", TimeFormat: "15:04:05", FirstWeekday: time.Sunday},
+		{Code: "de_DE", DecimalSep: ",", ThousandsSep: ".", DateFormat: "02.01.2006", TimeFormat: "15:04:05", FirstWeekday: time.Monday},
+		{Code: "de_CH", DecimalSep: ".", ThousandsSep: "'", DateFormat: "02.01.2006", TimeFormat: "15:04:05", FirstWeekday: time.Monday},
+		{Code: "fr_FR", DecimalSep: ",", ThousandsSep: nbsp, DateFormat: "02/01/2006", TimeFormat: "15:04:05", FirstWeekday: time.Monday},
+		{Code: "fr_BE", DecimalSep: ",", ThousandsSep: ".", DateFormat: "02/01/2006", TimeFormat: "15:04:05", FirstWeekday: time.Monday},
+		{Code: "fr_CH", DecimalSep: ".", ThousandsSep: "'", DateFormat: "02.01.2006", TimeFormat: "15:04:05", FirstWeekday: time.Monday},
+		{Code: "es_ES", DecimalSep: ",", ThousandsSep: ".", DateFormat: "02/01/2006", TimeFormat: "15:04:05", FirstWeekday: time.Monday},
+		{Code: "it_IT", DecimalSep: ",", ThousandsSep: ".", DateFormat: "02/01/2006", TimeFormat: "15:04:05", FirstWeekday: time.Monday},
+		{Code: "nl_NL", DecimalSep: ",", ThousandsSep: ".", DateFormat: "02-01-2006", TimeFormat: "15:04:05", FirstWeekday: time.Monday},
+		{Code: "pt_PT", DecimalSep: ",", ThousandsSep: nbsp, DateFormat: "02/01/2006", TimeFormat: "15:04:05", FirstWeekday: time.Monday},
+		{Code: "pt_BR", DecimalSep: ",", ThousandsSep: ".", DateFormat: "02/01/2006", TimeFormat: "15:04:05", FirstWeekday: time.Sunday},
+		{Code: "pl_PL", DecimalSep: ",", ThousandsSep: nbsp, DateFormat: "02.01.2006", TimeFormat: "15:04:05", FirstWeekday: time.Monday},
+		{Code: "ru_RU", DecimalSep: ",", ThousandsSep: nbsp, DateFormat: "02.01.2006", TimeFormat: "15:04:05", FirstWeekday: time.Monday},
+		{Code: "sv_SE", DecimalSep: ",", ThousandsSep: nbsp, DateFormat: "2006-01-02", TimeFormat: "15:04:05", FirstWeekday: time.Monday},
+		{Code: "ja_JP", DecimalSep: ".", ThousandsSep: ",", DateFormat: "2006/01/02", TimeFormat: "15:04:05", FirstWeekday: time.Sunday},
+		{Code: "zh_CN", DecimalSep: ".", ThousandsSep: ",", DateFormat: "2006-01-02", TimeFormat: "15:04:05", FirstWeekday: time.Monday},
+	} {
+		if l.Grouping == nil {
+			l.Grouping = []int{3}
+		}
+		locales[l.Code] = l
+	}
+}
+
+// Get returns the locale of a language code such as "de_DE" or "de-de",
+// falling back to another country of the same language, then to
+// DefaultLang. Locales are shared and must not be modified.
+func Get(lang string) *Locale {
+	lang = strings.ReplaceAll(lang, "-", "_")
+	if language, country, found := strings.Cut(lang, "_"); found {
+		lang = strings.ToLower(language) + "_" + strings.ToUpper(country)
+	} else {
+		lang = strings.ToLower(lang)
+	}
+	if l, ok := locales[lang]; ok {
+		return l
+	}
+
+	// Prefer the default language's country, then the country named like
+	// the language (de_DE for de), then the first one
+	language, _, _ := strings.Cut(lang, "_")
+	if strings.HasPrefix(DefaultLang, language+"_") {
+		return locales[DefaultLang]
+	}
+	if l, ok := locales[language+"_"+strings.ToUpper(language)]; ok {
+		return l
+	}
+	codes := Codes()
+	for _, code := range codes {
+		if strings.HasPrefix(code, language+"_") {
+			return locales[code]
+		}
+	}
+	return locales[DefaultLang]
+}
+
+// Codes returns the sorted codes of the known locales
+func Codes() []string {
+	codes := make([]string, 0, len(locales))
+	for code := range locales {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
@@ -13,10 +13,27 @@ type LogConfig struct {
 	LogFile     string
 	LogDB       string
 	LogDBLevel  string
+	// LogDBRetentionDays is how long records of the log database are kept;
+	// 0 keeps them forever
+	LogDBRetentionDays int
 	SysLog      bool
 	LogHandler  []string
+	// RedactKeys are sensitive keys redacted in addition to
+	// DefaultSensitiveKeys
+	RedactKeys []string
+	// LogBodyRoutes are the route paths whose request bodies are logged,
+	// redacted, for debugging; LogBodyMaxBytes caps each body logged
+	LogBodyRoutes   []string
+	LogBodyMaxBytes int
+	// StreamMaxConnections caps the live log streams attached at once;
+	// StreamMaxMinutes closes each stream after that long
+	StreamMaxConnections int
+	StreamMaxMinutes     int
 }
 
+// MaxLogBodyBytes is the hard cap of LogBodyMaxBytes
+const MaxLogBodyBytes = 64 * 1024
+
 // DefaultLogConfig returns the default logging configuration
 func DefaultLogConfig() *LogConfig {
 	return &LogConfig{
@@ -24,8 +41,14 @@ func DefaultLogConfig() *LogConfig {
 		LogFile:    getEnv("GOODOO_LOG_FILE", ""),
 		LogDB:      getEnv("GOODOO_LOG_DB", ""),
 		LogDBLevel: getEnv("GOODOO_LOG_DB_LEVEL", "warning"),
+		LogDBRetentionDays: getEnvInt("GOODOO_LOG_DB_RETENTION_DAYS", 30),
 		SysLog:     getEnvBool("GOODOO_SYSLOG", false),
 		LogHandler: getEnvSlice("GOODOO_LOG_HANDLER", []string{}),
+		RedactKeys: getEnvSlice("GOODOO_LOG_REDACT_KEYS", []string{}),
+		LogBodyRoutes:   getEnvSlice("GOODOO_LOG_BODY_ROUTES", []string{}),
+		LogBodyMaxBytes: min(getEnvInt("GOODOO_LOG_BODY_MAX_BYTES", 4096), MaxLogBodyBytes),
+		StreamMaxConnections: getEnvInt("GOODOO_LOG_STREAM_MAX_CONNECTIONS", 5),
+		StreamMaxMinutes:     getEnvInt("GOODOO_LOG_STREAM_MAX_MINUTES", 30),
 	}
 }
 
@@ -47,6 +70,16 @@ func getEnvBool(key string, defaultValue bool) bool {
 	return defaultValue
 }
 
+// getEnvInt gets integer environment variable
+func getEnvInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil {
+			return parsed
+		}
+	}
+	return defaultValue
+}
+
 // getEnvSlice gets slice from environment variable (comma-separated)
 func getEnvSlice(key string, defaultValue []string) []string {
 	if value := os.Getenv(key); value != "" {
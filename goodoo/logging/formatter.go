@@ -158,6 +158,10 @@ func ContextHelper(ctx context.Context) (dbname string, metadata map[string]inte
 		metadata["user_id"] = userID
 	}
 
+	if impersonatorID := ctx.Value("impersonator_id"); impersonatorID != nil {
+		metadata["impersonator_id"] = impersonatorID
+	}
+
 	return dbname, metadata
 }
 
@@ -176,6 +180,6 @@ func CreateLogRecord(level LogLevel, logger, message, pathname string, lineno in
 		PID:       os.Getpid(),
 		DBName:    dbname,
 		PerfInfo:  "", // Will be filled by performance filter
-		Metadata:  metadata,
+		Metadata:  defaultRedactor.RedactMap(metadata),
 	}
 }
@@ -6,10 +6,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log/slog"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib" // registers the pgx database/sql driver
 )
 
 // Handler interface for log handlers
@@ -91,13 +93,59 @@ func (h *FileHandler) Close() error {
 type PostgreSQLHandler struct {
 	db              *sql.DB
 	dbName          string
+	level           LogLevel
 	supportMetadata bool
+	tableReady      bool
+	lastAttempt     time.Time
 	mu              sync.Mutex
 }
 
-// NewPostgreSQLHandler creates a new PostgreSQL handler
+// irLoggingSchema creates the ir_logging table like the IrLogging model
+// migration does, for log databases the server does not migrate
+var irLoggingSchema = []string{
+	`CREATE TABLE IF NOT EXISTS ir_logging (
+		id bigserial PRIMARY KEY,
+		create_date timestamp,
+		type varchar NOT NULL,
+		dbname varchar,
+		name varchar NOT NULL,
+		level varchar,
+		message text NOT NULL,
+		path varchar,
+		line integer,
+		func varchar,
+		metadata jsonb
+	)`,
+	`ALTER TABLE ir_logging ADD COLUMN IF NOT EXISTS metadata jsonb`,
+	`CREATE INDEX IF NOT EXISTS idx_ir_logging_create_date ON ir_logging (create_date)`,
+}
+
+// tableRetryInterval spaces the attempts to create a missing table
+const tableRetryInterval = time.Minute
+
+// droppedRecords counts per database the records the handler failed to
+// write, e.g. on its statement timeout
+var droppedRecords sync.Map // dbName -> *atomic.Uint64
+
+// DroppedRecords returns the number of log records of a database that
+// could not be written to ir_logging
+func DroppedRecords(dbName string) uint64 {
+	if counter, ok := droppedRecords.Load(dbName); ok {
+		return counter.(*atomic.Uint64).Load()
+	}
+	return 0
+}
+
+// countDropped counts a record that could not be written
+func countDropped(dbName string) {
+	counter, _ := droppedRecords.LoadOrStore(dbName, new(atomic.Uint64))
+	counter.(*atomic.Uint64).Add(1)
+}
+
+// NewPostgreSQLHandler creates a new PostgreSQL handler. The ir_logging
+// table is created on the first record if it is missing.
 func NewPostgreSQLHandler(dbConnStr, dbName string) (*PostgreSQLHandler, error) {
-	db, err := sql.Open("postgres", dbConnStr)
+	db, err := sql.Open("pgx", dbConnStr)
 	if err != nil {
 		return nil, err
 	}
@@ -105,52 +153,77 @@ func NewPostgreSQLHandler(dbConnStr, dbName string) (*PostgreSQLHandler, error)
 	handler := &PostgreSQLHandler{
 		db:     db,
 		dbName: dbName,
-	}
-
-	// Check if metadata column exists
-	err = handler.checkMetadataSupport()
-	if err != nil {
-		// Log error but continue without metadata support
-		slog.Warn("Failed to check metadata support", "error", err)
+		level:  DEBUG,
 	}
 
 	return handler, nil
 }
 
-// checkMetadataSupport checks if the ir_logging table supports metadata
-func (h *PostgreSQLHandler) checkMetadataSupport() error {
-	query := `SELECT 1 FROM information_schema.columns 
-			  WHERE table_name='ir_logging' AND column_name='metadata'`
+// SetLevel sets the minimum level of the records written
+func (h *PostgreSQLHandler) SetLevel(level LogLevel) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.level = level
+}
 
-	var exists int
-	err := h.db.QueryRow(query).Scan(&exists)
-	if err == nil {
-		h.supportMetadata = true
-	} else if err == sql.ErrNoRows {
-		h.supportMetadata = false
-		err = nil
+// ensureTable creates ir_logging if it is missing, at most once per
+// tableRetryInterval while it fails; h.mu must be held
+func (h *PostgreSQLHandler) ensureTable(ctx context.Context) error {
+	if h.tableReady {
+		return nil
 	}
-
-	return err
+	if time.Since(h.lastAttempt) < tableRetryInterval {
+		return fmt.Errorf("ir_logging table unavailable")
+	}
+	h.lastAttempt = time.Now()
+	for _, statement := range irLoggingSchema {
+		if _, err := h.db.ExecContext(ctx, statement); err != nil {
+			return fmt.Errorf("failed to create ir_logging: %w", err)
+		}
+	}
+	h.tableReady = true
+	h.supportMetadata = true
+	return nil
 }
 
-// Emit writes a log record to PostgreSQL
+// Emit writes a log record to PostgreSQL. Records the handler cannot write
+// in time are dropped and counted (see DroppedRecords).
 func (h *PostgreSQLHandler) Emit(record *LogRecord) error {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
+	if record.Level < h.level {
+		return nil
+	}
+
+	dbname := h.dbName
+	if record.DBName != "" {
+		dbname = record.DBName
+	}
+	if err := h.emit(record, dbname); err != nil {
+		countDropped(dbname)
+		return err
+	}
+	return nil
+}
+
+// emit inserts a record; h.mu must be held
+func (h *PostgreSQLHandler) emit(record *LogRecord, dbname string) error {
 	// Set statement timeout to prevent deadlocks
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	defer cancel()
 
-	_, err := h.db.ExecContext(ctx, "SET LOCAL statement_timeout = 1000")
-	if err != nil {
+	if err := h.ensureTable(ctx); err != nil {
 		return err
 	}
 
-	dbname := h.dbName
-	if record.DBName != "" {
-		dbname = record.DBName
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "SET LOCAL statement_timeout = 1000"); err != nil {
+		return err
 	}
 
 	if h.supportMetadata && len(record.Metadata) > 0 {
@@ -162,22 +235,27 @@ func (h *PostgreSQLHandler) Emit(record *LogRecord) error {
 		query := `INSERT INTO ir_logging(create_date, type, dbname, name, level, message, path, line, func, metadata)
 				  VALUES (NOW() at time zone 'UTC', $1, $2, $3, $4, $5, $6, $7, $8, $9)`
 
-		_, err = h.db.ExecContext(ctx, query,
+		_, err = tx.ExecContext(ctx, query,
 			"server", dbname, record.Logger, record.Level.String(),
 			record.Message, record.Pathname, record.LineNo, record.FuncName,
 			string(metadataJSON))
-		return err
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
 	}
 
 	// Insert without metadata
 	query := `INSERT INTO ir_logging(create_date, type, dbname, name, level, message, path, line, func)
 			  VALUES (NOW() at time zone 'UTC', $1, $2, $3, $4, $5, $6, $7, $8)`
 
-	_, err = h.db.ExecContext(ctx, query,
+	_, err = tx.ExecContext(ctx, query,
 		"server", dbname, record.Logger, record.Level.String(),
 		record.Message, record.Pathname, record.LineNo, record.FuncName)
-
-	return err
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 // Close closes the PostgreSQL handler
@@ -66,6 +66,8 @@ func InitLogger() error {
 	initialized = true
 	
 	config := DefaultLogConfig()
+	defaultRedactor.SetKeys(append(append([]string{}, DefaultSensitiveKeys...), config.RedactKeys...))
+	defaultTap.SetMaxSubscribers(config.StreamMaxConnections)
 	
 	// Create root logger
 	rootLogger = &Logger{
@@ -102,6 +104,7 @@ func InitLogger() error {
 			// Log error but continue
 			rootLogger.Error("Failed to create PostgreSQL handler: %v", err)
 		} else {
+			pgHandler.SetLevel(ParseLogLevel(config.LogDBLevel))
 			rootLogger.AddHandler(pgHandler)
 		}
 	}
@@ -142,14 +145,27 @@ func (l *Logger) SetLevel(level LogLevel) {
 	l.levels[l.name] = level
 }
 
+// EnabledFor reports whether a record of level logged with ctx would be
+// emitted, so that callers can skip building costly messages
+func (l *Logger) EnabledFor(ctx context.Context, level LogLevel) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.levels.ShouldLog(l.name, level) || LevelOverrideFrom(ctx).Allows(l.name, level)
+}
+
 // log is the internal logging method
 func (l *Logger) log(level LogLevel, ctx context.Context, format string, args ...interface{}) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 	
-	// Check if we should log this message
+	// Check if we should log this message; a record the configured levels
+	// drop may still pass the level override of its context, and is marked
+	var override *LevelOverride
 	if !l.levels.ShouldLog(l.name, level) {
-		return
+		override = LevelOverrideFrom(ctx)
+		if !override.Allows(l.name, level) {
+			return
+		}
 	}
 	
 	// Get caller information
@@ -166,11 +182,24 @@ func (l *Logger) log(level LogLevel, ctx context.Context, format string, args ..
 		line = 0
 	}
 	
-	// Format message
-	message := fmt.Sprintf(format, args...)
+	// Format message; maps and slices of arguments are redacted
+	redacted := make([]interface{}, len(args))
+	for i, arg := range args {
+		redacted[i] = defaultRedactor.Redact(arg)
+	}
+	message := fmt.Sprintf(format, redacted...)
 	
 	// Create log record
 	record := CreateLogRecord(level, l.name, message, file, line, funcName, ctx)
+	if override != nil {
+		if record.Metadata == nil {
+			record.Metadata = make(map[string]interface{})
+		}
+		record.Metadata[MetadataLevelOverride] = override.Level.String()
+		if override.Reason != "" {
+			record.Metadata["level_override_reason"] = override.Reason
+		}
+	}
 	
 	// Add performance info if available
 	if ctx != nil {
@@ -178,6 +207,9 @@ func (l *Logger) log(level LogLevel, ctx context.Context, format string, args ..
 		filter.Filter(record, ctx)
 	}
 	
+	// The tap sees the records of loggers without handlers too
+	defaultTap.Emit(record)
+	
 	// Emit to all handlers
 	for _, handler := range l.handlers {
 		if err := handler.Emit(record); err != nil {
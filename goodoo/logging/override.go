@@ -0,0 +1,60 @@
+package logging
+
+import (
+	"context"
+	"strings"
+)
+
+// LevelOverride lowers the level of the loggers for the records logged
+// with one context, e.g. to DEBUG for a single request, whatever the
+// configured levels. It travels in the context, never in the loggers, so
+// concurrent requests sharing a logger are not affected.
+type LevelOverride struct {
+	Level LogLevel
+	// Prefixes restricts the override to these loggers and their children
+	// ("goodoo.sql_db" covers goodoo.sql_db.pool), all loggers when empty
+	Prefixes []string
+	// Reason is recorded in the metadata of the records the override lets
+	// through, e.g. who set it
+	Reason string
+}
+
+// levelOverrideKey is the context key of the override: unexported, so it
+// cannot be set from outside the program, e.g. through request parameters
+type levelOverrideKey struct{}
+
+// MetadataLevelOverride marks in the metadata of a record that only a
+// level override let it through; its value is the override level
+const MetadataLevelOverride = "level_override"
+
+// WithLevelOverride returns a context whose records follow override
+func WithLevelOverride(ctx context.Context, override *LevelOverride) context.Context {
+	return context.WithValue(ctx, levelOverrideKey{}, override)
+}
+
+// LevelOverrideFrom returns the override of a context, nil when none
+func LevelOverrideFrom(ctx context.Context) *LevelOverride {
+	if ctx == nil {
+		return nil
+	}
+	override, _ := ctx.Value(levelOverrideKey{}).(*LevelOverride)
+	return override
+}
+
+// Covers reports whether the override applies to a logger
+func (o *LevelOverride) Covers(loggerName string) bool {
+	if len(o.Prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range o.Prefixes {
+		if loggerName == prefix || strings.HasPrefix(loggerName, prefix+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows reports whether the override lets a record of a logger through
+func (o *LevelOverride) Allows(loggerName string, level LogLevel) bool {
+	return o != nil && o.Covers(loggerName) && CompareLogLevels(level, o.Level)
+}
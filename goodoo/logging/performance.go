@@ -94,8 +94,18 @@ func (pf *PerfFilter) Filter(record *LogRecord, ctx context.Context) {
 
 // PerformanceMiddleware is an Echo middleware that tracks performance metrics
 func PerformanceMiddleware() echo.MiddlewareFunc {
+	return PerformanceMiddlewareWithToggle(nil)
+}
+
+// PerformanceMiddlewareWithToggle tracks performance metrics of the requests
+// for which enabled returns true; a nil enabled tracks every request
+func PerformanceMiddlewareWithToggle(enabled func(c echo.Context) bool) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
+			if enabled != nil && !enabled(c) {
+				return next(c)
+			}
+
 			// Create performance context
 			perfCtx := NewPerfContext()
 
@@ -0,0 +1,184 @@
+package logging
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// RedactedValue replaces the sensitive values in logs
+const RedactedValue = "[REDACTED]"
+
+// DefaultSensitiveKeys name the values never logged. A key matches when it
+// is one of them or has one of them as a word, ignoring case: "password",
+// "new_password", "X-Api-Key" and "accessToken" do, "max_tokens" does not.
+var DefaultSensitiveKeys = []string{
+	"password", "passwd", "api_key", "apikey", "token", "secret",
+	"authorization", "cookie", "session_id", "master_pwd",
+}
+
+// Redactor replaces the values of sensitive keys in maps, slices and
+// headers before they are logged
+type Redactor struct {
+	mutex sync.RWMutex
+	keys  []string
+}
+
+// NewRedactor creates a redactor of keys
+func NewRedactor(keys []string) *Redactor {
+	r := &Redactor{}
+	r.SetKeys(keys)
+	return r
+}
+
+var defaultRedactor = NewRedactor(DefaultSensitiveKeys)
+
+// DefaultRedactor returns the redactor applied to log records
+func DefaultRedactor() *Redactor {
+	return defaultRedactor
+}
+
+// SetKeys replaces the sensitive keys
+func (r *Redactor) SetKeys(keys []string) {
+	normalized := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if key = normalizeKey(key); key != "" {
+			normalized = append(normalized, key)
+		}
+	}
+	r.mutex.Lock()
+	r.keys = normalized
+	r.mutex.Unlock()
+}
+
+// Keys returns the sensitive keys, normalized
+func (r *Redactor) Keys() []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return append([]string(nil), r.keys...)
+}
+
+// normalizeKey lowercases a key and separates its words with underscores:
+// "X-Api-Key" and "apiKey" become "x_api_key" and "api_key"
+func normalizeKey(key string) string {
+	var b strings.Builder
+	runes := []rune(strings.TrimSpace(key))
+	for i, c := range runes {
+		switch {
+		case c == '-' || c == ' ' || c == '.':
+			b.WriteByte('_')
+		case unicode.IsUpper(c):
+			if i > 0 && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1])) {
+				b.WriteByte('_')
+			}
+			b.WriteRune(unicode.ToLower(c))
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// IsSensitive reports whether the value of key must be redacted
+func (r *Redactor) IsSensitive(key string) bool {
+	name := "_" + normalizeKey(key) + "_"
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, sensitive := range r.keys {
+		if strings.Contains(name, "_"+sensitive+"_") {
+			return true
+		}
+	}
+	return false
+}
+
+// Redact returns a copy of value with the values of sensitive keys
+// replaced, at any depth of maps and slices; other values are returned as
+// they are
+func (r *Redactor) Redact(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		redacted := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			if r.IsSensitive(key) && item != nil {
+				redacted[key] = RedactedValue
+			} else {
+				redacted[key] = r.Redact(item)
+			}
+		}
+		return redacted
+	case map[string]string:
+		redacted := make(map[string]string, len(v))
+		for key, item := range v {
+			if r.IsSensitive(key) && item != "" {
+				item = RedactedValue
+			}
+			redacted[key] = item
+		}
+		return redacted
+	case []interface{}:
+		redacted := make([]interface{}, len(v))
+		for i, item := range v {
+			redacted[i] = r.Redact(item)
+		}
+		return redacted
+	case []map[string]interface{}:
+		redacted := make([]map[string]interface{}, len(v))
+		for i, item := range v {
+			redacted[i] = r.Redact(item).(map[string]interface{})
+		}
+		return redacted
+	case http.Header:
+		return r.RedactHeader(v)
+	case url.Values:
+		return url.Values(r.redactValues(v))
+	case map[string][]string:
+		return r.redactValues(v)
+	}
+	return value
+}
+
+// RedactMap is Redact for maps, nil staying nil
+func (r *Redactor) RedactMap(values map[string]interface{}) map[string]interface{} {
+	if values == nil {
+		return nil
+	}
+	return r.Redact(values).(map[string]interface{})
+}
+
+// RedactHeader returns a copy of header with the sensitive headers
+// (Authorization, Cookie, API keys...) replaced
+func (r *Redactor) RedactHeader(header http.Header) http.Header {
+	return http.Header(r.redactValues(header))
+}
+
+func (r *Redactor) redactValues(values map[string][]string) map[string][]string {
+	if values == nil {
+		return nil
+	}
+	redacted := make(map[string][]string, len(values))
+	for key, items := range values {
+		if r.IsSensitive(key) {
+			items = []string{RedactedValue}
+		}
+		redacted[key] = append([]string(nil), items...)
+	}
+	return redacted
+}
+
+// Redact redacts value with the default redactor
+func Redact(value interface{}) interface{} {
+	return defaultRedactor.Redact(value)
+}
+
+// RedactMap redacts a map with the default redactor
+func RedactMap(values map[string]interface{}) map[string]interface{} {
+	return defaultRedactor.RedactMap(values)
+}
+
+// RedactHeader redacts headers with the default redactor
+func RedactHeader(header http.Header) http.Header {
+	return defaultRedactor.RedactHeader(header)
+}
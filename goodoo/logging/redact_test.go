@@ -0,0 +1,120 @@
+package logging_test
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"goodoo/logging"
+)
+
+func TestIsSensitive(t *testing.T) {
+	redactor := logging.NewRedactor(logging.DefaultSensitiveKeys)
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"password", true},
+		{"Password", true},
+		{"PASSWORD", true},
+		{"new_password", true},
+		{"newPassword", true},
+		{"Authorization", true},
+		{"X-Api-Key", true},
+		{"apiKey", true},
+		{"api_key", true},
+		{"accessToken", true},
+		{"refresh-token", true},
+		{"client.secret", true},
+		{"Cookie", true},
+		{"session_id", true},
+		{" token ", true},
+		{"login", false},
+		{"max_tokens", false},
+		{"passwords_policy", false},
+		{"secretary", false},
+		{"tokenizer", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := redactor.IsSensitive(tt.key); got != tt.want {
+			t.Errorf("IsSensitive(%q) = %v, want %v", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestRedact(t *testing.T) {
+	redactor := logging.NewRedactor(logging.DefaultSensitiveKeys)
+	tests := []struct {
+		name  string
+		value interface{}
+		want  interface{}
+	}{
+		{"flat map",
+			map[string]interface{}{"login": "admin", "password": "hunter2"},
+			map[string]interface{}{"login": "admin", "password": logging.RedactedValue}},
+		{"case insensitive keys",
+			map[string]interface{}{"Password": "hunter2", "API_KEY": "sk-1", "Token": 42},
+			map[string]interface{}{"Password": logging.RedactedValue, "API_KEY": logging.RedactedValue, "Token": logging.RedactedValue}},
+		{"nested maps",
+			map[string]interface{}{"config": map[string]interface{}{"provider": "openai", "llm": map[string]interface{}{"apiKey": "sk-1"}}},
+			map[string]interface{}{"config": map[string]interface{}{"provider": "openai", "llm": map[string]interface{}{"apiKey": logging.RedactedValue}}}},
+		{"arrays of objects",
+			[]interface{}{map[string]interface{}{"name": "a", "secret": "s1"}, "plain", map[string]interface{}{"secret": "s2"}},
+			[]interface{}{map[string]interface{}{"name": "a", "secret": logging.RedactedValue}, "plain", map[string]interface{}{"secret": logging.RedactedValue}}},
+		{"typed slice of maps",
+			[]map[string]interface{}{{"token": "t", "id": 1}},
+			[]map[string]interface{}{{"token": logging.RedactedValue, "id": 1}}},
+		// A sensitive key holding a structure hides it whole
+		{"sensitive structure",
+			map[string]interface{}{"secret": map[string]interface{}{"id": 1}},
+			map[string]interface{}{"secret": logging.RedactedValue}},
+		// Empty values show that nothing was sent
+		{"empty values",
+			map[string]interface{}{"password": nil, "params": map[string]string{"password": "", "token": "t"}},
+			map[string]interface{}{"password": nil, "params": map[string]string{"password": "", "token": logging.RedactedValue}}},
+		{"form values",
+			url.Values{"login": {"admin"}, "password": {"a", "b"}},
+			url.Values{"login": {"admin"}, "password": {logging.RedactedValue}}},
+		{"headers",
+			http.Header{"Authorization": {"Bearer t"}, "Cookie": {"session_id=s"}, "Accept": {"*/*"}},
+			http.Header{"Authorization": {logging.RedactedValue}, "Cookie": {logging.RedactedValue}, "Accept": {"*/*"}}},
+		{"other values", "password=hunter2", "password=hunter2"},
+		{"nil", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := redactor.Redact(tt.value); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Redact = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestRedactCopies leaves the value redacted unchanged
+func TestRedactCopies(t *testing.T) {
+	params := map[string]interface{}{"password": "hunter2", "lines": []interface{}{map[string]interface{}{"token": "t"}}}
+	header := http.Header{"Authorization": {"Bearer t"}}
+	logging.RedactMap(params)
+	logging.RedactHeader(header)
+	if params["password"] != "hunter2" || params["lines"].([]interface{})[0].(map[string]interface{})["token"] != "t" {
+		t.Errorf("RedactMap changed its argument: %v", params)
+	}
+	if header.Get("Authorization") != "Bearer t" {
+		t.Errorf("RedactHeader changed its argument: %v", header)
+	}
+	if logging.RedactMap(nil) != nil {
+		t.Error("RedactMap(nil) is not nil")
+	}
+}
+
+func TestSetKeys(t *testing.T) {
+	redactor := logging.NewRedactor([]string{"IBAN", " ", "X-Custom-Key"})
+	if want := []string{"iban", "x_custom_key"}; !reflect.DeepEqual(redactor.Keys(), want) {
+		t.Errorf("Keys = %v, want %v", redactor.Keys(), want)
+	}
+	if !redactor.IsSensitive("partner_iban") || !redactor.IsSensitive("x-custom-key") || redactor.IsSensitive("password") {
+		t.Error("the keys set do not replace the sensitive keys")
+	}
+}
@@ -0,0 +1,195 @@
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// RecentRecords is the size of the ring buffer of the latest records
+const RecentRecords = 1000
+
+// tapBuffer is the records a subscriber may lag behind before records are
+// dropped for it
+const tapBuffer = 256
+
+// ErrTapFull is returned by Subscribe when the maximum number of
+// subscribers is attached
+var ErrTapFull = errors.New("too many log streams")
+
+// TapFilter selects the records of a subscriber; empty fields match all
+type TapFilter struct {
+	MinLevel LogLevel
+	// Logger matches the logger and the loggers named after it
+	Logger    string
+	DBName    string
+	RequestID string
+	// Contains matches a substring of the message, ignoring case
+	Contains string
+}
+
+// Match reports whether a record passes the filter
+func (f *TapFilter) Match(record *LogRecord) bool {
+	if record.Level < f.MinLevel {
+		return false
+	}
+	if f.Logger != "" && !strings.HasPrefix(record.Logger, f.Logger) {
+		return false
+	}
+	if f.DBName != "" && record.DBName != f.DBName {
+		return false
+	}
+	if f.RequestID != "" && fmt.Sprint(record.Metadata["request_id"]) != f.RequestID {
+		return false
+	}
+	if f.Contains != "" && !strings.Contains(strings.ToLower(record.Message), strings.ToLower(f.Contains)) {
+		return false
+	}
+	return true
+}
+
+// Subscription receives the records matching its filter from the moment it
+// subscribes; records it cannot take in time are dropped and counted
+type Subscription struct {
+	C       <-chan *LogRecord
+	records chan *LogRecord
+	filter  TapFilter
+	dropped atomic.Uint64
+	tap     *Tap
+	once    sync.Once
+}
+
+// Dropped returns the records dropped because the subscriber lagged
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Close detaches the subscription from the tap
+func (s *Subscription) Close() {
+	s.once.Do(func() { s.tap.unsubscribe(s) })
+}
+
+// Tap sees every record logged, whatever the handlers of its logger: it
+// keeps the latest in a ring buffer and fans them out to subscribers such
+// as live log streams. Emit never blocks: a subscriber that lags loses
+// records rather than slowing down logging, and without subscribers it only
+// stores the record in the ring.
+type Tap struct {
+	ring [RecentRecords]atomic.Pointer[LogRecord]
+	next atomic.Uint64
+
+	// active mirrors len(subscribers) for Emit to skip the lock
+	active         atomic.Int32
+	mu             sync.RWMutex
+	subscribers    map[*Subscription]struct{}
+	maxSubscribers int
+}
+
+// NewTap creates a tap accepting at most maxSubscribers subscribers, no
+// limit when 0
+func NewTap(maxSubscribers int) *Tap {
+	return &Tap{subscribers: make(map[*Subscription]struct{}), maxSubscribers: maxSubscribers}
+}
+
+// defaultTap is the tap of every logger
+var defaultTap = NewTap(5)
+
+// DefaultTap returns the tap of every logger
+func DefaultTap() *Tap {
+	return defaultTap
+}
+
+// SetMaxSubscribers changes the maximum number of subscribers; existing
+// subscriptions are kept
+func (t *Tap) SetMaxSubscribers(max int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.maxSubscribers = max
+}
+
+// Emit stores a record in the ring buffer and hands it to the subscribers
+// whose filter it matches
+func (t *Tap) Emit(record *LogRecord) error {
+	t.ring[(t.next.Add(1)-1)%RecentRecords].Store(record)
+	if t.active.Load() == 0 {
+		return nil
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for subscriber := range t.subscribers {
+		if !subscriber.filter.Match(record) {
+			continue
+		}
+		select {
+		case subscriber.records <- record:
+		default:
+			subscriber.dropped.Add(1)
+		}
+	}
+	return nil
+}
+
+// Close detaches every subscriber
+func (t *Tap) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for subscriber := range t.subscribers {
+		delete(t.subscribers, subscriber)
+	}
+	t.active.Store(0)
+	return nil
+}
+
+// Subscribe attaches a subscriber receiving the records matching filter
+func (t *Tap) Subscribe(filter TapFilter) (*Subscription, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.maxSubscribers > 0 && len(t.subscribers) >= t.maxSubscribers {
+		return nil, ErrTapFull
+	}
+	records := make(chan *LogRecord, tapBuffer)
+	subscription := &Subscription{C: records, records: records, filter: filter, tap: t}
+	t.subscribers[subscription] = struct{}{}
+	t.active.Store(int32(len(t.subscribers)))
+	return subscription, nil
+}
+
+// unsubscribe detaches a subscriber
+func (t *Tap) unsubscribe(subscription *Subscription) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.subscribers, subscription)
+	t.active.Store(int32(len(t.subscribers)))
+}
+
+// Subscribers returns the number of attached subscribers
+func (t *Tap) Subscribers() int {
+	return int(t.active.Load())
+}
+
+// Recent returns the last limit records of the ring buffer matching
+// filter, oldest first
+func (t *Tap) Recent(filter TapFilter, limit int) []*LogRecord {
+	if limit <= 0 || limit > RecentRecords {
+		limit = RecentRecords
+	}
+	end := t.next.Load()
+	var start uint64
+	if end > RecentRecords {
+		start = end - RecentRecords
+	}
+	var records []*LogRecord
+	for i := end; i > start && len(records) < limit; i-- {
+		record := t.ring[(i-1)%RecentRecords].Load()
+		if record != nil && filter.Match(record) {
+			records = append(records, record)
+		}
+	}
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+	return records
+}
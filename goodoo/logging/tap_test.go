@@ -0,0 +1,149 @@
+package logging_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"goodoo/logging"
+)
+
+// tapRecord returns a record of a logger
+func tapRecord(level logging.LogLevel, logger, message string) *logging.LogRecord {
+	return &logging.LogRecord{Level: level, Logger: logger, Message: message, DBName: "tap_test",
+		Metadata: map[string]interface{}{"request_id": "req-1"}}
+}
+
+func TestTapFilter(t *testing.T) {
+	record := tapRecord(logging.WARNING, "goodoo.http.request", "Slow Request on /web")
+	tests := []struct {
+		name   string
+		filter logging.TapFilter
+		want   bool
+	}{
+		{"empty", logging.TapFilter{}, true},
+		{"level below", logging.TapFilter{MinLevel: logging.INFO}, true},
+		{"level above", logging.TapFilter{MinLevel: logging.ERROR}, false},
+		{"logger prefix", logging.TapFilter{Logger: "goodoo.http"}, true},
+		{"other logger", logging.TapFilter{Logger: "goodoo.models"}, false},
+		{"database", logging.TapFilter{DBName: "tap_test"}, true},
+		{"other database", logging.TapFilter{DBName: "other"}, false},
+		{"request", logging.TapFilter{RequestID: "req-1"}, true},
+		{"other request", logging.TapFilter{RequestID: "req-2"}, false},
+		{"substring ignoring case", logging.TapFilter{Contains: "slow request"}, true},
+		{"missing substring", logging.TapFilter{Contains: "fast"}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.filter.Match(record); got != tt.want {
+			t.Errorf("%s: Match = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestTapSubscribe fans the records out to the matching subscribers,
+// dropping those a lagging subscriber has no room for, up to the cap
+func TestTapSubscribe(t *testing.T) {
+	tap := logging.NewTap(2)
+	errorsOnly, err := tap.Subscribe(logging.TapFilter{MinLevel: logging.ERROR})
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := tap.Subscribe(logging.TapFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tap.Subscribe(logging.TapFilter{}); !errors.Is(err, logging.ErrTapFull) {
+		t.Fatalf("third Subscribe = %v, want ErrTapFull", err)
+	}
+
+	tap.Emit(tapRecord(logging.INFO, "goodoo", "info"))
+	tap.Emit(tapRecord(logging.ERROR, "goodoo", "error"))
+	if record := <-errorsOnly.C; record.Message != "error" {
+		t.Errorf("the error subscriber received %q", record.Message)
+	}
+	if got := (<-all.C).Message + "," + (<-all.C).Message; got != "info,error" {
+		t.Errorf("the subscriber of all records received %s", got)
+	}
+
+	// The subscriber stops reading: Emit goes on and counts the drops
+	for i := 0; i < 300; i++ {
+		tap.Emit(tapRecord(logging.INFO, "goodoo", fmt.Sprint(i)))
+	}
+	if all.Dropped() == 0 || errorsOnly.Dropped() != 0 {
+		t.Errorf("dropped %d and %d records", all.Dropped(), errorsOnly.Dropped())
+	}
+
+	all.Close()
+	all.Close()
+	if tap.Subscribers() != 1 {
+		t.Errorf("%d subscribers after Close, want 1", tap.Subscribers())
+	}
+	if _, err := tap.Subscribe(logging.TapFilter{}); err != nil {
+		t.Errorf("Subscribe after Close = %v", err)
+	}
+}
+
+// TestTapRecent replays the latest matching records, oldest first, from
+// the ring buffer
+func TestTapRecent(t *testing.T) {
+	tap := logging.NewTap(0)
+	for i := 0; i < logging.RecentRecords+10; i++ {
+		level := logging.INFO
+		if i%2 == 1 {
+			level = logging.ERROR
+		}
+		tap.Emit(tapRecord(level, "goodoo", fmt.Sprint(i)))
+	}
+
+	var messages []string
+	for _, record := range tap.Recent(logging.TapFilter{MinLevel: logging.ERROR}, 3) {
+		messages = append(messages, record.Message)
+	}
+	if got := fmt.Sprint(messages); got != "[1005 1007 1009]" {
+		t.Errorf("Recent = %s", got)
+	}
+	if got := len(tap.Recent(logging.TapFilter{}, 0)); got != logging.RecentRecords {
+		t.Errorf("Recent kept %d records, want %d", got, logging.RecentRecords)
+	}
+}
+
+// BenchmarkTapEmit measures what the tap adds to each record logged: the
+// ring buffer alone without streams, and the filters and fan-out with them
+func BenchmarkTapEmit(b *testing.B) {
+	record := tapRecord(logging.INFO, "goodoo.http.request", "GET /web 200")
+	b.Run("no stream", func(b *testing.B) {
+		tap := logging.NewTap(0)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			tap.Emit(record)
+		}
+	})
+	b.Run("filtered out", func(b *testing.B) {
+		tap := logging.NewTap(0)
+		subscription, _ := tap.Subscribe(logging.TapFilter{Logger: "goodoo.models"})
+		defer subscription.Close()
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			tap.Emit(record)
+		}
+	})
+	b.Run("lagging stream", func(b *testing.B) {
+		tap := logging.NewTap(0)
+		subscription, _ := tap.Subscribe(logging.TapFilter{})
+		defer subscription.Close()
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			tap.Emit(record)
+		}
+	})
+}
+
+// BenchmarkLoggerInfo measures the hot logging path through the default
+// tap of a logger without handlers, with no stream attached
+func BenchmarkLoggerInfo(b *testing.B) {
+	logger := logging.GetLogger("goodoo.tap_test")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		logger.Info("request %d served", i)
+	}
+}
@@ -0,0 +1,79 @@
+package mail
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"goodoo/database"
+	"goodoo/logging"
+	"goodoo/scheduler"
+	"gorm.io/gorm"
+)
+
+var (
+	defaultConfig = DefaultConfig()
+	defaultMailer Mailer
+	mutex         sync.RWMutex
+)
+
+// Setup installs the process-wide mail configuration and mailer
+func Setup(config *Config) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	defaultConfig = config
+	defaultMailer = NewMailer(config)
+}
+
+// Default returns the process-wide mailer, logging messages when none is configured
+func Default() Mailer {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	if defaultMailer == nil {
+		return NewLogMailer()
+	}
+	return defaultMailer
+}
+
+// DefaultFrom returns the configured sender address
+func DefaultFrom() string {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return defaultConfig.From
+}
+
+// LogOnly reports whether messages are logged instead of sent, as with
+// the log transport of development setups
+func LogOnly() bool {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return defaultConfig.Transport == "log"
+}
+
+// QueueTemplate renders a mail template in the recipient's language and queues it
+func QueueTemplate(db *gorm.DB, renderer Renderer, name, lang string, to []string, data interface{}) error {
+	msg, err := RenderTemplate(renderer, name, lang, data)
+	if err != nil {
+		return err
+	}
+	msg.From = DefaultFrom()
+	msg.To = to
+	_, err = Enqueue(db, msg)
+	return err
+}
+
+// ScheduleQueue registers the job sending queued mail of a database every interval
+func ScheduleQueue(s *scheduler.Scheduler, dbName string, interval time.Duration) {
+	logger := logging.GetLogger("goodoo.mail")
+	s.Every("mail.queue."+dbName, interval, func(ctx context.Context) error {
+		db, err := database.GetDatabase(dbName)
+		if err != nil {
+			return err
+		}
+		sent, err := ProcessQueue(ctx, db.WithContext(ctx), Default())
+		if sent > 0 {
+			logger.Info("Sent %d queued mail(s) for %s", sent, dbName)
+		}
+		return err
+	})
+}
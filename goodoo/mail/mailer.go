@@ -0,0 +1,309 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"goodoo/logging"
+)
+
+// Message is an email ready to be sent
+type Message struct {
+	From     string
+	To       []string
+	Cc       []string
+	ReplyTo  string
+	Subject  string
+	BodyHTML string
+	// Attachments are sent after the body, in order
+	Attachments []Attachment
+}
+
+// Attachment is a file attached to a message
+type Attachment struct {
+	Name        string
+	ContentType string
+	Data        []byte
+}
+
+// Recipients returns every envelope recipient
+func (m *Message) Recipients() []string {
+	return append(append([]string{}, m.To...), m.Cc...)
+}
+
+// Mailer sends email messages
+type Mailer interface {
+	Send(ctx context.Context, msg *Message) error
+}
+
+// Encryption modes of the SMTP connection
+const (
+	EncryptionNone     = "none"
+	EncryptionStartTLS = "starttls"
+	EncryptionSSL      = "ssl"
+)
+
+// Config holds outgoing mail configuration (like Odoo's smtp_* options)
+type Config struct {
+	Transport  string // "smtp" or "log"
+	Host       string
+	Port       int
+	Encryption string
+	User       string
+	Password   string
+	From       string
+	Timeout    time.Duration
+}
+
+// DefaultConfig returns the configuration used when nothing is set
+func DefaultConfig() *Config {
+	return &Config{
+		Transport:  "smtp",
+		Host:       "localhost",
+		Port:       25,
+		Encryption: EncryptionNone,
+		From:       "noreply@localhost",
+		Timeout:    30 * time.Second,
+	}
+}
+
+// LoadFromEnv loads configuration from GOODOO_SMTP_* environment variables
+func (c *Config) LoadFromEnv() {
+	if transport := os.Getenv("GOODOO_MAIL_TRANSPORT"); transport != "" {
+		c.Transport = strings.ToLower(transport)
+	}
+	if host := os.Getenv("GOODOO_SMTP_HOST"); host != "" {
+		c.Host = host
+	}
+	if port := os.Getenv("GOODOO_SMTP_PORT"); port != "" {
+		if p, err := strconv.Atoi(port); err == nil {
+			c.Port = p
+		}
+	}
+	if encryption := os.Getenv("GOODOO_SMTP_ENCRYPTION"); encryption != "" {
+		c.Encryption = strings.ToLower(encryption)
+	}
+	if user := os.Getenv("GOODOO_SMTP_USER"); user != "" {
+		c.User = user
+	}
+	if password := os.Getenv("GOODOO_SMTP_PASSWORD"); password != "" {
+		c.Password = password
+	}
+	if from := os.Getenv("GOODOO_MAIL_FROM"); from != "" {
+		c.From = from
+	}
+}
+
+// NewMailer creates the mailer selected by the configuration
+func NewMailer(config *Config) Mailer {
+	if config.Transport == "log" {
+		return NewLogMailer()
+	}
+	return NewSMTPMailer(config)
+}
+
+// LogMailer writes messages to the log instead of sending them, for development
+type LogMailer struct {
+	logger *logging.Logger
+}
+
+// NewLogMailer creates a log-only mailer
+func NewLogMailer() *LogMailer {
+	return &LogMailer{logger: logging.GetLogger("goodoo.mail")}
+}
+
+// Send logs the message
+func (m *LogMailer) Send(ctx context.Context, msg *Message) error {
+	var attachments []string
+	for _, attachment := range msg.Attachments {
+		attachments = append(attachments, fmt.Sprintf("%s (%d bytes)", attachment.Name, len(attachment.Data)))
+	}
+	m.logger.InfoCtx(ctx, "Mail (not sent) from=%s to=%s subject=%q attachments=[%s]\n%s",
+		msg.From, strings.Join(msg.Recipients(), ", "), msg.Subject, strings.Join(attachments, ", "), msg.BodyHTML)
+	return nil
+}
+
+// SMTPMailer sends messages through an SMTP server
+type SMTPMailer struct {
+	config *Config
+}
+
+// NewSMTPMailer creates an SMTP mailer
+func NewSMTPMailer(config *Config) *SMTPMailer {
+	return &SMTPMailer{config: config}
+}
+
+// Send delivers the message, using implicit TLS or STARTTLS as configured
+func (m *SMTPMailer) Send(ctx context.Context, msg *Message) error {
+	if len(msg.Recipients()) == 0 {
+		return fmt.Errorf("message has no recipients")
+	}
+	from := msg.From
+	if from == "" {
+		from = m.config.From
+	}
+
+	addr := net.JoinHostPort(m.config.Host, strconv.Itoa(m.config.Port))
+	tlsConfig := &tls.Config{ServerName: m.config.Host}
+	dialer := &net.Dialer{Timeout: m.config.Timeout}
+
+	var conn net.Conn
+	var err error
+	if m.config.Encryption == EncryptionSSL {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to connect to SMTP server %s: %w", addr, err)
+	}
+	if m.config.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(m.config.Timeout))
+	}
+
+	client, err := smtp.NewClient(conn, m.config.Host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("SMTP handshake failed: %w", err)
+	}
+	defer client.Close()
+
+	if m.config.Encryption == EncryptionStartTLS {
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("STARTTLS failed: %w", err)
+		}
+	}
+	if m.config.User != "" {
+		auth := smtp.PlainAuth("", m.config.User, m.config.Password, m.config.Host)
+		if err := client.Auth(auth); err != nil {
+			return fmt.Errorf("SMTP authentication failed: %w", err)
+		}
+	}
+
+	if err := client.Mail(extractAddress(from)); err != nil {
+		return err
+	}
+	for _, rcpt := range msg.Recipients() {
+		if err := client.Rcpt(extractAddress(rcpt)); err != nil {
+			return fmt.Errorf("recipient %s rejected: %w", rcpt, err)
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(buildMIME(from, msg)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+var addressPattern = regexp.MustCompile(`<([^>]+)>`)
+
+// extractAddress returns the bare address of `"Name" <addr>`
+func extractAddress(value string) string {
+	if match := addressPattern.FindStringSubmatch(value); match != nil {
+		return match[1]
+	}
+	return strings.TrimSpace(value)
+}
+
+// buildMIME encodes the message as a multipart/alternative email with text
+// and HTML parts, within a multipart/mixed email when it has attachments
+func buildMIME(from string, msg *Message) []byte {
+	boundary := randomBoundary()
+
+	var b bytes.Buffer
+	header := func(name, value string) {
+		fmt.Fprintf(&b, "%s: %s\r\n", name, value)
+	}
+	header("From", from)
+	header("To", strings.Join(msg.To, ", "))
+	if len(msg.Cc) > 0 {
+		header("Cc", strings.Join(msg.Cc, ", "))
+	}
+	if msg.ReplyTo != "" {
+		header("Reply-To", msg.ReplyTo)
+	}
+	header("Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("Message-ID", fmt.Sprintf("<%s@goodoo>", randomBoundary()))
+	header("MIME-Version", "1.0")
+	mixed := ""
+	if len(msg.Attachments) > 0 {
+		mixed = randomBoundary()
+		header("Content-Type", fmt.Sprintf("multipart/mixed; boundary=%q", mixed))
+		fmt.Fprintf(&b, "\r\n--%s\r\n", mixed)
+	}
+	header("Content-Type", fmt.Sprintf("multipart/alternative; boundary=%q", boundary))
+	b.WriteString("\r\n")
+
+	fmt.Fprintf(&b, "--%s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n", boundary, HTMLToText(msg.BodyHTML))
+	fmt.Fprintf(&b, "--%s\r\nContent-Type: text/html; charset=utf-8\r\n\r\n%s\r\n", boundary, msg.BodyHTML)
+	fmt.Fprintf(&b, "--%s--\r\n", boundary)
+	if mixed == "" {
+		return b.Bytes()
+	}
+
+	for _, attachment := range msg.Attachments {
+		contentType := attachment.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		fmt.Fprintf(&b, "--%s\r\n", mixed)
+		header("Content-Type", contentType)
+		header("Content-Transfer-Encoding", "base64")
+		header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Name}))
+		b.WriteString("\r\n")
+		encoded := base64.StdEncoding.EncodeToString(attachment.Data)
+		for len(encoded) > 76 {
+			b.WriteString(encoded[:76] + "\r\n")
+			encoded = encoded[76:]
+		}
+		b.WriteString(encoded + "\r\n")
+	}
+	fmt.Fprintf(&b, "--%s--\r\n", mixed)
+	return b.Bytes()
+}
+
+func randomBoundary() string {
+	buf := make([]byte, 12)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+var (
+	breakPattern = regexp.MustCompile(`(?i)<br\s*/?>|</p>|</div>|</h[1-6]>|</li>`)
+	tagPattern   = regexp.MustCompile(`<[^>]*>`)
+	blankLines   = regexp.MustCompile(`\n\s*\n\s*\n+`)
+)
+
+// HTMLToText converts an HTML body to a plain text alternative (like Odoo's html2plaintext)
+func HTMLToText(body string) string {
+	text := breakPattern.ReplaceAllString(body, "\n")
+	text = tagPattern.ReplaceAllString(text, "")
+	text = strings.NewReplacer("&nbsp;", " ", "&amp;", "&", "&lt;", "<", "&gt;", ">", "&quot;", "\"", "&#39;", "'").Replace(text)
+
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+	return strings.TrimSpace(blankLines.ReplaceAllString(strings.Join(lines, "\n"), "\n\n"))
+}
@@ -0,0 +1,170 @@
+package mail
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"goodoo/logging"
+	"goodoo/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Queue processing settings: a failed message is retried with exponential
+// backoff (1, 2, 4, ... minutes) and marked failed after MaxAttempts.
+const (
+	MaxAttempts  = 5
+	RetryBackoff = time.Minute
+	BatchSize    = 50
+)
+
+// AttachmentResModel is the res_model of the attachments of queued messages
+const AttachmentResModel = "mail.mail"
+
+// Enqueue stores a message in the outgoing queue, its attachments as
+// attachments of the queued message; it is sent by ProcessQueue
+func Enqueue(db *gorm.DB, msg *Message) (*models.MailMessage, error) {
+	record := &models.MailMessage{
+		EmailFrom:   msg.From,
+		EmailTo:     strings.Join(msg.To, ", "),
+		EmailCc:     strings.Join(msg.Cc, ", "),
+		ReplyTo:     msg.ReplyTo,
+		Subject:     msg.Subject,
+		BodyHTML:    msg.BodyHTML,
+		State:       models.MailStateOutgoing,
+		NextAttempt: time.Now(),
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(record).Error; err != nil {
+			return err
+		}
+		for _, attachment := range msg.Attachments {
+			stored := models.IrAttachment{
+				Name:     attachment.Name,
+				ResModel: AttachmentResModel,
+				ResID:    record.ID,
+				Mimetype: attachment.ContentType,
+				FileSize: len(attachment.Data),
+				Checksum: models.Checksum(attachment.Data),
+				Datas:    attachment.Data,
+				// Generated by the server, nothing to scan
+				ScanState: models.AttachmentScanClean,
+			}
+			if err := tx.Create(&stored).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// queuedAttachments returns the attachments of a queued message, in the
+// order they were added
+func queuedAttachments(tx *gorm.DB, message *models.MailMessage) ([]Attachment, error) {
+	var stored []models.IrAttachment
+	err := tx.Where("res_model = ? AND res_id = ?", AttachmentResModel, message.ID).Order("id").Find(&stored).Error
+	if err != nil {
+		return nil, err
+	}
+	attachments := make([]Attachment, len(stored))
+	for i, attachment := range stored {
+		attachments[i] = Attachment{Name: attachment.Name, ContentType: attachment.Mimetype, Data: attachment.Datas}
+	}
+	return attachments, nil
+}
+
+// splitAddresses parses a comma-separated address list
+func splitAddresses(value string) []string {
+	var addresses []string
+	for _, address := range strings.Split(value, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+// ProcessQueue sends due outgoing messages and returns how many were sent.
+// Rows are locked with SKIP LOCKED so several workers never send the same message.
+func ProcessQueue(ctx context.Context, db *gorm.DB, mailer Mailer) (int, error) {
+	logger := logging.GetLogger("goodoo.mail")
+
+	var messages []models.MailMessage
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("state = ? AND next_attempt <= ?", models.MailStateOutgoing, time.Now()).
+			Order("next_attempt, id").
+			Limit(BatchSize).
+			Find(&messages).Error
+		if err != nil {
+			return err
+		}
+
+		for i := range messages {
+			if ctx.Err() != nil {
+				messages = messages[:i]
+				break
+			}
+			sendQueued(ctx, tx, mailer, &messages[i], logger)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, message := range messages {
+		if message.State == models.MailStateSent {
+			sent++
+		}
+	}
+	return sent, nil
+}
+
+// sendQueued sends one queued message and records the outcome
+func sendQueued(ctx context.Context, tx *gorm.DB, mailer Mailer, message *models.MailMessage, logger *logging.Logger) {
+	attachments, err := queuedAttachments(tx, message)
+	if err == nil {
+		err = mailer.Send(ctx, &Message{
+			From:        message.EmailFrom,
+			To:          splitAddresses(message.EmailTo),
+			Cc:          splitAddresses(message.EmailCc),
+			ReplyTo:     message.ReplyTo,
+			Subject:     message.Subject,
+			BodyHTML:    message.BodyHTML,
+			Attachments: attachments,
+		})
+	}
+
+	message.Attempts++
+	updates := map[string]interface{}{"attempts": message.Attempts}
+	if err == nil {
+		now := time.Now()
+		message.State = models.MailStateSent
+		updates["state"] = models.MailStateSent
+		updates["sent_at"] = now
+		updates["failure_reason"] = ""
+		logger.Info("Mail %d sent to %s", message.ID, message.EmailTo)
+	} else if message.Attempts >= MaxAttempts {
+		message.State = models.MailStateFailed
+		updates["state"] = models.MailStateFailed
+		updates["failure_reason"] = err.Error()
+		logger.Error("Mail %d to %s failed after %d attempts: %v", message.ID, message.EmailTo, message.Attempts, err)
+	} else {
+		delay := RetryBackoff << uint(message.Attempts-1)
+		updates["next_attempt"] = time.Now().Add(delay)
+		updates["failure_reason"] = err.Error()
+		logger.Warning("Mail %d to %s failed (attempt %d), retrying in %v: %v",
+			message.ID, message.EmailTo, message.Attempts, delay, err)
+	}
+
+	if err := tx.Model(message).Updates(updates).Error; err != nil {
+		logger.Error("Failed to update mail %d: %v", message.ID, err)
+	}
+}
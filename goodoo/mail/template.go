@@ -0,0 +1,43 @@
+package mail
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Renderer renders a named template, satisfied by the application's echo renderer
+type Renderer interface {
+	Render(w io.Writer, name string, data interface{}, c echo.Context) error
+}
+
+var titlePattern = regexp.MustCompile(`(?is)<title>(.*?)</title>`)
+
+// RenderTemplate renders templates/mail/<name>.html into a message for one
+// language. A <name>.<lang>.html variant (e.g. mail_invite.fr_FR.html) is
+// preferred when it exists; the <title> of the template is the subject.
+func RenderTemplate(renderer Renderer, name, lang string, data interface{}) (*Message, error) {
+	var buf bytes.Buffer
+	err := fmt.Errorf("no template")
+	if lang != "" {
+		err = renderer.Render(&buf, fmt.Sprintf("%s.%s.html", name, lang), data, nil)
+	}
+	if err != nil {
+		buf.Reset()
+		if err := renderer.Render(&buf, name+".html", data, nil); err != nil {
+			return nil, fmt.Errorf("failed to render mail template %s: %w", name, err)
+		}
+	}
+
+	body := buf.String()
+	msg := &Message{BodyHTML: body}
+	if match := titlePattern.FindStringSubmatch(body); match != nil {
+		msg.Subject = html.UnescapeString(strings.TrimSpace(match[1]))
+	}
+	return msg, nil
+}
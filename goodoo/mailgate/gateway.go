@@ -0,0 +1,296 @@
+// Package mailgate turns inbound email into records: messages sent to a
+// mail alias are fetched from its IMAP mailbox or posted by the inbound
+// webhook of a mail provider, deduplicated by Message-ID for each alias,
+// parsed, and handed to the gateway handler of the alias. Messages that
+// fail wait in a review queue with their raw message.
+package mailgate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"goodoo/database"
+	"goodoo/logging"
+	"goodoo/models"
+	"goodoo/scheduler"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var logger = logging.GetLogger("goodoo.mailgate")
+
+// ErrDuplicate is returned for a message whose Message-ID was received
+// already for the same alias
+var ErrDuplicate = errors.New("message already received")
+
+// Handler creates or updates the record of an inbound message, in the
+// environment of the user of its alias. sender is the partner of the
+// sender, matched by email or created. It returns the record, which
+// the attachments of the message are attached to.
+type Handler func(env *models.Environment, alias *models.MailAlias, msg *Message, sender *models.Partner) (resModel string, resID uint, err error)
+
+var (
+	handlers     = make(map[string]Handler)
+	handlerMutex sync.RWMutex
+)
+
+// RegisterHandler makes a handler available to the aliases under name
+func RegisterHandler(name string, fn Handler) {
+	handlerMutex.Lock()
+	defer handlerMutex.Unlock()
+	handlers[name] = fn
+}
+
+// Handlers returns the names of the registered handlers
+func Handlers() []string {
+	handlerMutex.RLock()
+	defer handlerMutex.RUnlock()
+	names := make([]string, 0, len(handlers))
+	for name := range handlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookupHandler(name string) Handler {
+	handlerMutex.RLock()
+	defer handlerMutex.RUnlock()
+	return handlers[name]
+}
+
+// ValidateAlias checks the configuration of an alias
+func ValidateAlias(alias *models.MailAlias) error {
+	if strings.TrimSpace(alias.Name) == "" {
+		return errors.New("the alias needs a name")
+	}
+	if lookupHandler(alias.Handler) == nil {
+		return fmt.Errorf("unknown handler %q, expected one of %s", alias.Handler, strings.Join(Handlers(), ", "))
+	}
+	if alias.UserID == 0 {
+		return errors.New("the alias needs a user to create the records as")
+	}
+	if alias.IMAPEnabled && (alias.IMAPHost == "" || alias.IMAPUser == "" || alias.IMAPPort <= 0) {
+		return errors.New("polling needs the IMAP host, port and user")
+	}
+	if alias.PollMinutes < 1 {
+		return errors.New("the poll interval is at least one minute")
+	}
+	return nil
+}
+
+// Receive stores a raw message received for an alias, then processes it
+// (see Process). A message the alias received already fails with ErrDuplicate; the
+// returned message is nil only when the message was not stored.
+func Receive(ctx context.Context, db *gorm.DB, dbName string, alias *models.MailAlias, raw []byte, source string) (*models.MailInbound, error) {
+	inbound := &models.MailInbound{
+		AliasID:    alias.ID,
+		MessageID:  MessageIDOf(raw),
+		Source:     source,
+		State:      models.MailInboundReceived,
+		ReceivedAt: time.Now().UTC(),
+		Size:       len(raw),
+		Raw:        raw,
+	}
+	result := db.Clauses(clause.OnConflict{Columns: []clause.Column{{Name: "alias_id"}, {Name: "message_id"}}, DoNothing: true}).Create(inbound)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrDuplicate, inbound.MessageID)
+	}
+	return inbound, Process(ctx, db, dbName, alias, inbound)
+}
+
+// Process parses a stored message and runs the handler of its alias in a
+// transaction. A message that fails stays in the review queue with its
+// raw message and the error; one that succeeds drops its raw message.
+func Process(ctx context.Context, db *gorm.DB, dbName string, alias *models.MailAlias, inbound *models.MailInbound) error {
+	inbound.Attempts++
+	msg, err := Parse(inbound.Raw)
+	if msg != nil {
+		inbound.Subject = msg.Subject
+		inbound.InReplyTo = msg.InReplyTo
+		if msg.From != nil {
+			inbound.EmailFrom = msg.From.Address
+		}
+	}
+	if err == nil {
+		err = db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			var err error
+			inbound.ResModel, inbound.ResID, err = handle(tx, dbName, alias, msg)
+			return err
+		})
+	}
+
+	columns := []string{"state", "error", "attempts", "email_from", "subject", "in_reply_to", "res_model", "res_id"}
+	if err != nil {
+		inbound.State, inbound.Error = models.MailInboundFailed, err.Error()
+		inbound.ResModel, inbound.ResID = "", 0
+		logger.Warning("Inbound message %s of alias %s of %s failed: %v", inbound.MessageID, alias.Name, dbName, err)
+	} else {
+		inbound.State, inbound.Error, inbound.Raw = models.MailInboundDone, "", nil
+		columns = append(columns, "raw")
+		logger.Info("Inbound message %s of alias %s of %s processed: %s,%d", inbound.MessageID, alias.Name, dbName, inbound.ResModel, inbound.ResID)
+	}
+	if saveErr := db.Model(inbound).Select(columns).Updates(inbound).Error; saveErr != nil {
+		return errors.Join(err, saveErr)
+	}
+	return err
+}
+
+// handle matches the sender, runs the handler of the alias and stores the
+// attachments on the record it returns
+func handle(tx *gorm.DB, dbName string, alias *models.MailAlias, msg *Message) (string, uint, error) {
+	fn := lookupHandler(alias.Handler)
+	if fn == nil {
+		return "", 0, fmt.Errorf("handler %s is not registered", alias.Handler)
+	}
+	sender, err := MatchPartner(tx, alias.UserID, msg.From)
+	if err != nil {
+		return "", 0, fmt.Errorf("sender %s: %w", msg.From.Address, err)
+	}
+	env := models.NewEnvironment(tx, alias.UserID).WithDBName(dbName)
+	resModel, resID, err := fn(env, alias, msg, sender)
+	if err != nil {
+		return "", 0, err
+	}
+
+	for _, attachment := range msg.Attachments {
+		record := &models.IrAttachment{
+			Name:     attachment.Name,
+			ResModel: resModel,
+			ResID:    resID,
+			Mimetype: attachment.Mimetype,
+			FileSize: len(attachment.Data),
+			Checksum: models.Checksum(attachment.Data),
+			Datas:    attachment.Data,
+			// Files from outside are scanned like uploads
+			ScanState: models.AttachmentScanPending,
+		}
+		record.CreateUID, record.WriteUID = alias.UserID, alias.UserID
+		if err := tx.Create(record).Error; err != nil {
+			return "", 0, fmt.Errorf("attachment %s: %w", attachment.Name, err)
+		}
+	}
+	return resModel, resID, nil
+}
+
+// MatchPartner returns the partner of an address, the oldest one with the
+// email in any case, creating it when there is none
+func MatchPartner(tx *gorm.DB, uid uint, address *mail.Address) (*models.Partner, error) {
+	email := strings.TrimSpace(address.Address)
+	var partners []models.Partner
+	if err := tx.Where("lower(email) = lower(?)", email).Order("id").Limit(1).Find(&partners).Error; err != nil {
+		return nil, err
+	}
+	if len(partners) > 0 {
+		return &partners[0], nil
+	}
+	partner := &models.Partner{Name: strings.TrimSpace(address.Name), Email: email}
+	if partner.Name == "" {
+		partner.Name = email
+	}
+	partner.CreateUID, partner.WriteUID = uid, uid
+	if err := tx.Create(partner).Error; err != nil {
+		return nil, err
+	}
+	return partner, nil
+}
+
+// Poll receives the unseen messages of the IMAP mailbox of an alias and
+// returns how many were new. Messages stored, even failed or duplicate
+// ones, are flagged seen; those that could not be stored are fetched
+// again by the next poll.
+func Poll(ctx context.Context, db *gorm.DB, dbName string, alias *models.MailAlias) (int, error) {
+	client, err := dialIMAP(ctx, alias.IMAPHost, alias.IMAPPort, alias.IMAPTLS)
+	if err != nil {
+		return 0, err
+	}
+	defer client.close()
+	if err := client.login(alias.IMAPUser, string(alias.IMAPPassword)); err != nil {
+		return 0, err
+	}
+	mailbox := alias.IMAPMailbox
+	if mailbox == "" {
+		mailbox = "INBOX"
+	}
+	if err := client.selectMailbox(mailbox); err != nil {
+		return 0, err
+	}
+	uids, err := client.unseen()
+	if err != nil {
+		return 0, err
+	}
+
+	received := 0
+	for _, uid := range uids {
+		if ctx.Err() != nil {
+			return received, ctx.Err()
+		}
+		raw, err := client.fetch(uid)
+		if err != nil {
+			return received, err
+		}
+		inbound, err := Receive(ctx, db, dbName, alias, raw, models.MailSourceIMAP)
+		if inbound == nil && !errors.Is(err, ErrDuplicate) {
+			return received, err
+		}
+		if inbound != nil {
+			received++
+		}
+		if err := client.markSeen(uid); err != nil {
+			return received, err
+		}
+	}
+	return received, nil
+}
+
+// pollDue polls the mailboxes of the active aliases of a database whose
+// poll interval elapsed, recording the outcome on each alias
+func pollDue(ctx context.Context, dbName string) error {
+	db, err := database.GetDatabase(dbName)
+	if err != nil {
+		return err
+	}
+	db = db.WithContext(ctx)
+	var aliases []models.MailAlias
+	if err := db.Where("active = ? AND imap_enabled = ?", true, true).Order("id").Find(&aliases).Error; err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for i := range aliases {
+		alias := &aliases[i]
+		interval := time.Duration(max(alias.PollMinutes, 1)) * time.Minute
+		if alias.LastPoll != nil && now.Sub(*alias.LastPoll) < interval {
+			continue
+		}
+		received, err := Poll(ctx, db, dbName, alias)
+		updates := map[string]interface{}{"last_poll": now, "last_error": ""}
+		if err != nil {
+			updates["last_error"] = err.Error()
+			logger.Warning("Polling the mailbox of alias %s of %s failed: %v", alias.Name, dbName, err)
+		} else if received > 0 {
+			logger.Info("Received %d message(s) for alias %s of %s", received, alias.Name, dbName)
+		}
+		if err := db.Model(alias).UpdateColumns(updates).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Schedule registers the job polling the IMAP mailboxes of the aliases of
+// a database; each alias is polled every PollMinutes
+func Schedule(s *scheduler.Scheduler, dbName string, interval time.Duration) {
+	s.Every("mailgate.poll."+dbName, interval, func(ctx context.Context) error {
+		return pollDue(ctx, dbName)
+	})
+}
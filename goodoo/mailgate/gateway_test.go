@@ -0,0 +1,33 @@
+package mailgate_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"goodoo/mailgate"
+	"goodoo/models"
+	"goodoo/models/testutil"
+	"gorm.io/gorm"
+)
+
+// TestReceiveDeduplicatesPerAlias checks the statement storing a message:
+// a Message-ID already received by the same alias is skipped, the one of
+// another alias is not
+func TestReceiveDeduplicatesPerAlias(t *testing.T) {
+	db, last := testutil.DryRunDB(t)
+	// Without the transaction of the create, which would connect
+	db = db.Session(&gorm.Session{SkipDefaultTransaction: true})
+	alias := &models.MailAlias{}
+	alias.ID = 3
+
+	inbound, err := mailgate.Receive(context.Background(), db, "mailgate_test", alias, readFixture(t, "base64.eml"), "webhook")
+	// A dry run affects no rows, as a duplicate does
+	if inbound != nil || !errors.Is(err, mailgate.ErrDuplicate) {
+		t.Fatalf("Receive = %+v, %v; want ErrDuplicate", inbound, err)
+	}
+	if sql := last(); !strings.Contains(sql, `ON CONFLICT ("alias_id","message_id") DO NOTHING`) {
+		t.Errorf("Receive stored the message with %s, want a conflict on the alias and Message-ID", sql)
+	}
+}
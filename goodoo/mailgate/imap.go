@@ -0,0 +1,177 @@
+package mailgate
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// imapTimeout bounds each exchange with the IMAP server
+const imapTimeout = time.Minute
+
+// imapClient speaks the few IMAP4rev1 commands the poller needs: LOGIN,
+// SELECT, UID SEARCH, UID FETCH, UID STORE and LOGOUT
+type imapClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	tag    int
+}
+
+// dialIMAP connects to an IMAP server and reads its greeting
+func dialIMAP(ctx context.Context, host string, port int, useTLS bool) (*imapClient, error) {
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	var conn net.Conn
+	var err error
+	if useTLS {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: host}}).DialContext(ctx, "tcp", address)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &imapClient{conn: conn, reader: bufio.NewReader(conn)}
+	conn.SetDeadline(time.Now().Add(imapTimeout))
+	greeting, err := c.readLine()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !strings.HasPrefix(greeting, "* OK") && !strings.HasPrefix(greeting, "* PREAUTH") {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected IMAP greeting: %s", greeting)
+	}
+	return c, nil
+}
+
+// readLine reads a line without its CRLF
+func (c *imapClient) readLine() (string, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// imapResponse is the untagged lines answering a command, with the
+// literals they announced
+type imapResponse struct {
+	lines    []string
+	literals [][]byte
+}
+
+// command sends a command and reads the response up to its tagged status,
+// failing unless it is OK
+func (c *imapClient) command(format string, args ...interface{}) (*imapResponse, error) {
+	c.tag++
+	tag := fmt.Sprintf("g%d", c.tag)
+	c.conn.SetDeadline(time.Now().Add(imapTimeout))
+	if _, err := fmt.Fprintf(c.conn, "%s %s\r\n", tag, fmt.Sprintf(format, args...)); err != nil {
+		return nil, err
+	}
+
+	response := &imapResponse{}
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		// A line ending with {n} is followed by n bytes of literal, then
+		// by the rest of the line
+		for strings.HasSuffix(line, "}") {
+			open := strings.LastIndexByte(line, '{')
+			if open < 0 {
+				break
+			}
+			size, err := strconv.Atoi(line[open+1 : len(line)-1])
+			if err != nil || size < 0 || size > MaxMessageSize {
+				break
+			}
+			literal := make([]byte, size)
+			if _, err := io.ReadFull(c.reader, literal); err != nil {
+				return nil, err
+			}
+			response.literals = append(response.literals, literal)
+			rest, err := c.readLine()
+			if err != nil {
+				return nil, err
+			}
+			line = line[:open] + rest
+		}
+
+		if status, ok := strings.CutPrefix(line, tag+" "); ok {
+			if !strings.HasPrefix(status, "OK") {
+				return nil, fmt.Errorf("IMAP %s: %s", strings.Fields(format)[0], status)
+			}
+			return response, nil
+		}
+		response.lines = append(response.lines, line)
+	}
+}
+
+// quote returns an IMAP quoted string
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+func (c *imapClient) login(user, password string) error {
+	_, err := c.command("LOGIN %s %s", quote(user), quote(password))
+	return err
+}
+
+func (c *imapClient) selectMailbox(mailbox string) error {
+	_, err := c.command("SELECT %s", quote(mailbox))
+	return err
+}
+
+// unseen returns the UIDs of the messages not seen yet
+func (c *imapClient) unseen() ([]uint32, error) {
+	response, err := c.command("UID SEARCH UNSEEN")
+	if err != nil {
+		return nil, err
+	}
+	var uids []uint32
+	for _, line := range response.lines {
+		found, ok := strings.CutPrefix(line, "* SEARCH")
+		if !ok {
+			continue
+		}
+		for _, field := range strings.Fields(found) {
+			if uid, err := strconv.ParseUint(field, 10, 32); err == nil {
+				uids = append(uids, uint32(uid))
+			}
+		}
+	}
+	return uids, nil
+}
+
+// fetch returns the raw message of a UID, leaving it unseen
+func (c *imapClient) fetch(uid uint32) ([]byte, error) {
+	response, err := c.command("UID FETCH %d (BODY.PEEK[])", uid)
+	if err != nil {
+		return nil, err
+	}
+	if len(response.literals) == 0 {
+		return nil, fmt.Errorf("message %d not found", uid)
+	}
+	return response.literals[0], nil
+}
+
+// markSeen flags a message as seen, so that it is not fetched again
+func (c *imapClient) markSeen(uid uint32) error {
+	_, err := c.command(`UID STORE %d +FLAGS.SILENT (\Seen)`, uid)
+	return err
+}
+
+// close logs out and closes the connection
+func (c *imapClient) close() {
+	c.command("LOGOUT")
+	c.conn.Close()
+}
@@ -0,0 +1,66 @@
+package mailgate
+
+import (
+	"goodoo/markup"
+	"goodoo/models"
+)
+
+// PartnerNoteHandler is the name of the reference handler, posting each
+// message as a note (see NotePartner)
+const PartnerNoteHandler = "partner_note"
+
+func init() {
+	RegisterHandler(PartnerNoteHandler, NotePartner)
+}
+
+// NotePartner posts a message as a note on the partner of its sender. A
+// reply to a message noted before is posted on the record of that message
+// instead, as its child.
+func NotePartner(env *models.Environment, alias *models.MailAlias, msg *Message, sender *models.Partner) (string, uint, error) {
+	db := env.GetDB()
+	note := &models.MailThreadMessage{
+		Model:       "res.partner",
+		ResID:       sender.ID,
+		MessageType: "email",
+		AuthorID:    &sender.ID,
+		EmailFrom:   msg.From.String(),
+		Subject:     msg.Subject,
+		MessageID:   msg.MessageID,
+	}
+
+	if parents := threadParents(msg); len(parents) > 0 {
+		var previous []models.MailThreadMessage
+		if err := db.Where("message_id IN ?", parents).Order("id DESC").Limit(1).Find(&previous).Error; err != nil {
+			return "", 0, err
+		}
+		if len(previous) > 0 {
+			note.Model, note.ResID, note.ParentID = previous[0].Model, previous[0].ResID, &previous[0].ID
+		}
+	}
+
+	if msg.HTML != "" {
+		note.Body = markup.Sanitize(msg.HTML)
+	} else {
+		note.Body = markup.PlainText(msg.Text)
+	}
+	note.CreateUID, note.WriteUID = env.UserID(), env.UserID()
+	if err := db.Create(note).Error; err != nil {
+		return "", 0, err
+	}
+	return note.Model, note.ResID, nil
+}
+
+// threadParents returns the ids of the messages a message replies to, the
+// direct parent first
+func threadParents(msg *Message) []string {
+	var ids []string
+	if msg.InReplyTo != "" {
+		ids = append(ids, msg.InReplyTo)
+	}
+	for i := len(msg.References) - 1; i >= 0; i-- {
+		if msg.References[i] != msg.InReplyTo {
+			ids = append(ids, msg.References[i])
+		}
+	}
+	return ids
+}
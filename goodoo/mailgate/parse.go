@@ -0,0 +1,240 @@
+package mailgate
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// MaxMessageSize bounds the raw messages the gateway accepts
+const MaxMessageSize = 25 << 20
+
+// maxPartDepth bounds the nesting of multipart bodies
+const maxPartDepth = 10
+
+// ErrMalformed wraps the errors of messages that cannot be parsed
+var ErrMalformed = errors.New("malformed message")
+
+// Attachment is a file attached to a message
+type Attachment struct {
+	Name     string
+	Mimetype string
+	Data     []byte
+}
+
+// Message is a parsed inbound email
+type Message struct {
+	// MessageID, InReplyTo and References are without angle brackets
+	MessageID  string
+	InReplyTo  string
+	References []string
+	From       *mail.Address
+	To         []*mail.Address
+	Subject    string
+	Date       time.Time
+	// Text and HTML are the first text/plain and text/html bodies, in UTF-8
+	Text        string
+	HTML        string
+	Attachments []Attachment
+}
+
+// wordDecoder decodes the RFC 2047 encoded words of the headers in any
+// charset known to the WHATWG encoding index
+var wordDecoder = &mime.WordDecoder{CharsetReader: charsetReader}
+
+// charsetReader converts a charset to UTF-8
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	encoding, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, fmt.Errorf("unknown charset %s", charset)
+	}
+	return encoding.NewDecoder().Reader(input), nil
+}
+
+// MessageIDOf returns the Message-ID of a raw message, without angle
+// brackets, or one derived from the content when it has none, so that
+// the messages are deduplicated even when they cannot be parsed
+func MessageIDOf(raw []byte) string {
+	if msg, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+		if id := trimID(msg.Header.Get("Message-Id")); id != "" {
+			return id
+		}
+	}
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:]) + "@goodoo.invalid"
+}
+
+// trimID removes the angle brackets and spaces of a message id
+func trimID(id string) string {
+	return strings.Trim(strings.TrimSpace(id), "<>")
+}
+
+// Parse parses a raw MIME message: its headers, its text and HTML bodies
+// converted to UTF-8 from their charset, and its attachments. Unknown
+// charsets are kept as is; broken transfer encodings and structures fail
+// with ErrMalformed.
+func Parse(raw []byte) (*Message, error) {
+	if len(raw) > MaxMessageSize {
+		return nil, fmt.Errorf("%w: larger than %d bytes", ErrMalformed, MaxMessageSize)
+	}
+	parsed, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	header := parsed.Header
+
+	msg := &Message{
+		MessageID: trimID(header.Get("Message-Id")),
+		InReplyTo: trimID(header.Get("In-Reply-To")),
+	}
+	for _, id := range strings.Fields(header.Get("References")) {
+		if id = trimID(id); id != "" {
+			msg.References = append(msg.References, id)
+		}
+	}
+	if msg.Subject, err = wordDecoder.DecodeHeader(header.Get("Subject")); err != nil {
+		msg.Subject = header.Get("Subject")
+	}
+	msg.Subject = validUTF8(msg.Subject)
+	addresses := &mail.AddressParser{WordDecoder: wordDecoder}
+	if msg.From, err = addresses.Parse(header.Get("From")); err != nil {
+		return nil, fmt.Errorf("%w: invalid From: %v", ErrMalformed, err)
+	}
+	if to := header.Get("To"); to != "" {
+		// Undisclosed or broken recipients do not prevent the processing
+		msg.To, _ = addresses.ParseList(to)
+	}
+	if date, err := header.Date(); err == nil {
+		msg.Date = date
+	}
+
+	if err := msg.walk(textproto.MIMEHeader(header), parsed.Body, 0); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// walk reads a part of the body and those it contains
+func (msg *Message) walk(header textproto.MIMEHeader, body io.Reader, depth int) error {
+	if depth > maxPartDepth {
+		return fmt.Errorf("%w: parts nested deeper than %d", ErrMalformed, maxPartDepth)
+	}
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		// RFC 2045: without a valid type, the part is plain ASCII text
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		boundary := params["boundary"]
+		if boundary == "" {
+			return fmt.Errorf("%w: %s without boundary", ErrMalformed, mediaType)
+		}
+		reader := multipart.NewReader(body, boundary)
+		for {
+			part, err := reader.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("%w: %v", ErrMalformed, err)
+			}
+			if err := msg.walk(part.Header, part, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+
+	data, err := decodeTransfer(header.Get("Content-Transfer-Encoding"), body)
+	if err != nil {
+		return fmt.Errorf("%w: %s part: %v", ErrMalformed, mediaType, err)
+	}
+
+	disposition, dispositionParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	name := dispositionParams["filename"]
+	if name == "" {
+		name = params["name"]
+	}
+	if decoded, err := wordDecoder.DecodeHeader(name); err == nil {
+		name = decoded
+	}
+	inlineText := disposition != "attachment" && name == ""
+
+	switch {
+	case inlineText && mediaType == "text/plain" && msg.Text == "":
+		msg.Text = decodeCharset(params["charset"], data)
+	case inlineText && mediaType == "text/html" && msg.HTML == "":
+		msg.HTML = decodeCharset(params["charset"], data)
+	case inlineText && strings.HasPrefix(mediaType, "text/"):
+		// Further inline bodies, e.g. the alternatives of a forwarded part
+	default:
+		if name == "" {
+			name = "attachment"
+			if extensions, _ := mime.ExtensionsByType(mediaType); len(extensions) > 0 {
+				name += extensions[0]
+			}
+		}
+		msg.Attachments = append(msg.Attachments, Attachment{Name: validUTF8(name), Mimetype: mediaType, Data: data})
+	}
+	return nil
+}
+
+// decodeTransfer decodes the content transfer encoding of a part
+func decodeTransfer(encoding string, body io.Reader) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		// The decoder skips line breaks but not the other spaces some
+		// mailers leave
+		raw, err := io.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		cleaned := strings.Map(func(r rune) rune {
+			if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+				return -1
+			}
+			return r
+		}, string(raw))
+		cleaned = strings.TrimRight(cleaned, "=")
+		return base64.RawStdEncoding.DecodeString(cleaned)
+	case "quoted-printable":
+		return io.ReadAll(quotedprintable.NewReader(body))
+	}
+	return io.ReadAll(body)
+}
+
+// decodeCharset converts text from its charset to UTF-8. Text of an
+// unknown charset is kept, with the invalid UTF-8 sequences replaced.
+func decodeCharset(charset string, data []byte) string {
+	charset = strings.ToLower(strings.TrimSpace(charset))
+	if charset != "" && charset != "utf-8" && charset != "us-ascii" {
+		if encoding, err := htmlindex.Get(charset); err == nil {
+			if decoded, err := encoding.NewDecoder().Bytes(data); err == nil {
+				return string(decoded)
+			}
+		}
+	}
+	return validUTF8(string(data))
+}
+
+// validUTF8 replaces the invalid UTF-8 sequences of s
+func validUTF8(s string) string {
+	if utf8.ValidString(s) {
+		return s
+	}
+	return strings.ToValidUTF8(s, "�")
+}
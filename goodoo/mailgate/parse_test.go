@@ -0,0 +1,156 @@
+package mailgate_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"goodoo/mailgate"
+)
+
+// readFixture reads a raw message of testdata
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	raw, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+// parseFixture parses a raw message of testdata
+func parseFixture(t *testing.T, name string) *mailgate.Message {
+	t.Helper()
+	msg, err := mailgate.Parse(readFixture(t, name))
+	if err != nil {
+		t.Fatalf("Parse(%s): %v", name, err)
+	}
+	return msg
+}
+
+// TestParseMultipart parses a mixed message: the first plain text and
+// HTML alternatives are the bodies, the other parts the attachments
+func TestParseMultipart(t *testing.T) {
+	msg := parseFixture(t, "multipart.eml")
+
+	if msg.MessageID != "quote-42@example.com" || msg.InReplyTo != "request-41@example.com" ||
+		!slices.Equal(msg.References, []string{"request-40@example.com", "request-41@example.com"}) {
+		t.Errorf("ids = %q, in reply to %q, references %v", msg.MessageID, msg.InReplyTo, msg.References)
+	}
+	if msg.Subject != "Devis n°42" {
+		t.Errorf("Subject = %q", msg.Subject)
+	}
+	if msg.From.Name != "Renée Dupont" || msg.From.Address != "renee@example.com" {
+		t.Errorf("From = %+v", msg.From)
+	}
+	if len(msg.To) != 2 || msg.To[0].Address != "sales@goodoo.test" || msg.To[1].Address != "support@goodoo.test" {
+		t.Errorf("To = %v", msg.To)
+	}
+	if msg.Date.IsZero() || msg.Date.UTC().Hour() != 7 {
+		t.Errorf("Date = %v, want 07:30 UTC", msg.Date)
+	}
+	if msg.Text != "Please find the quote attached.\n— Renée" {
+		t.Errorf("Text = %q", msg.Text)
+	}
+	if msg.HTML != "<p>Please find the quote attached.</p>" {
+		t.Errorf("HTML = %q", msg.HTML)
+	}
+
+	if len(msg.Attachments) != 2 {
+		t.Fatalf("%d attachments, want 2", len(msg.Attachments))
+	}
+	pdf := msg.Attachments[0]
+	if pdf.Name != "devis n°42.pdf" || pdf.Mimetype != "application/pdf" || string(pdf.Data) != "%PDF-1.4 quote" {
+		t.Errorf("first attachment = %s %s %q", pdf.Name, pdf.Mimetype, pdf.Data)
+	}
+	// A part without a name is named after its type
+	if image := msg.Attachments[1]; image.Name != "attachment.png" || len(image.Data) != 4 {
+		t.Errorf("unnamed attachment = %s, %d bytes", image.Name, len(image.Data))
+	}
+}
+
+func TestParseTransferEncodings(t *testing.T) {
+	tests := []struct {
+		fixture string
+		subject string
+		text    string
+	}{
+		// Spaces inside the base64 lines are skipped
+		{"base64.eml", "Base64 body", "Héllo from the base64 body.\nSecond line ✓\n"},
+		// Soft line breaks are joined and the charset converted
+		{"quoted_printable.eml", "Résumé", "Café crème, a line long enough to be wrapped by a soft line break.\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			msg := parseFixture(t, tt.fixture)
+			if msg.Subject != tt.subject || msg.Text != tt.text {
+				t.Errorf("Parse = subject %q, text %q; want %q, %q", msg.Subject, msg.Text, tt.subject, tt.text)
+			}
+			if len(msg.Attachments) != 0 || msg.HTML != "" {
+				t.Errorf("Parse = %d attachments, HTML %q; want the text only", len(msg.Attachments), msg.HTML)
+			}
+		})
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	tests := []struct {
+		fixture string
+		reason  string
+	}{
+		{"no_header.eml", "malformed header line"},
+		{"invalid_from.eml", "invalid From"},
+		{"missing_boundary.eml", "multipart/mixed without boundary"},
+		{"bad_base64.eml", "text/plain part"},
+		{"truncated_multipart.eml", "EOF"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			msg, err := mailgate.Parse(readFixture(t, tt.fixture))
+			if !errors.Is(err, mailgate.ErrMalformed) || !strings.Contains(err.Error(), tt.reason) {
+				t.Errorf("Parse = %+v, %v; want ErrMalformed for %s", msg, err, tt.reason)
+			}
+		})
+	}
+
+	t.Run("nesting", func(t *testing.T) {
+		var raw strings.Builder
+		raw.WriteString("From: sender@example.com\n")
+		for depth := 0; depth < 12; depth++ {
+			raw.WriteString("Content-Type: multipart/mixed; boundary=b" + strings.Repeat("x", depth) + "\n\n")
+			raw.WriteString("--b" + strings.Repeat("x", depth) + "\n")
+		}
+		raw.WriteString("Content-Type: text/plain\n\nDeep\n")
+		if _, err := mailgate.Parse([]byte(raw.String())); !errors.Is(err, mailgate.ErrMalformed) || !strings.Contains(err.Error(), "nested") {
+			t.Errorf("Parse of parts nested 12 deep: %v, want ErrMalformed", err)
+		}
+	})
+
+	t.Run("size", func(t *testing.T) {
+		raw := make([]byte, mailgate.MaxMessageSize+1)
+		if _, err := mailgate.Parse(raw); !errors.Is(err, mailgate.ErrMalformed) {
+			t.Errorf("Parse of a message too large: %v, want ErrMalformed", err)
+		}
+	})
+}
+
+// TestMessageIDOf derives an id from the content of the messages without
+// one, so that they are deduplicated all the same
+func TestMessageIDOf(t *testing.T) {
+	if id := mailgate.MessageIDOf(readFixture(t, "multipart.eml")); id != "quote-42@example.com" {
+		t.Errorf("MessageIDOf = %q, want the Message-ID header", id)
+	}
+	for _, fixture := range []string{"invalid_from.eml", "no_header.eml"} {
+		raw := readFixture(t, fixture)
+		id := mailgate.MessageIDOf(raw)
+		if !strings.HasSuffix(id, "@goodoo.invalid") || len(id) != 64+len("@goodoo.invalid") || id != mailgate.MessageIDOf(raw) {
+			t.Errorf("MessageIDOf(%s) = %q, want a stable id derived from the content", fixture, id)
+		}
+	}
+	if mailgate.MessageIDOf(readFixture(t, "invalid_from.eml")) == mailgate.MessageIDOf(readFixture(t, "no_header.eml")) {
+		t.Error("two messages without Message-ID have the same id")
+	}
+}
@@ -1,163 +1,256 @@
 package main
 
 import (
-	"io"
+	"context"
+	"flag"
+	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"goodoo/crypto"
 	"goodoo/database"
-	"goodoo/handlers"
-	"goodoo/http"
+	"goodoo/httpclient"
+	"goodoo/loaddata"
 	"goodoo/logging"
 	"goodoo/models"
-	"goodoo/templates"
-
-	"github.com/labstack/echo/v4"
-	"github.com/labstack/echo/v4/middleware"
+	"goodoo/operations"
+	"goodoo/retention"
+	_ "goodoo/sale" // registers the sale.order API methods
+	"goodoo/server"
+	"goodoo/tracing"
+	"goodoo/workpool"
 )
 
 func main() {
+	// "goodoo --check" validates the deployment and exits; "goodoo --migrate"
+	// applies the pending schema changes and exits; "goodoo --generate
+	// model=x_order count=100000" fills a non-production database with
+	// random records and exits
+	checkOnly := flag.Bool("check", false, "validate the configuration, database and files, then exit")
+	migrateOnly := flag.Bool("migrate", false, "apply the pending schema changes, then exit")
+	checkLLM := flag.Bool("check-llm", false, "also check that the active LLM providers are reachable")
+	generate := flag.String("generate", "", "generate random records of a field model for load testing, e.g. model=x_order count=100000 seed=1 partner_id=sample:2, then exit")
+	flag.Parse()
+
 	// Initialize logging system
 	if err := logging.InitLogger(); err != nil {
-		panic(err)
+		fmt.Fprintf(os.Stderr, "Failed to initialize logging: %v\n", err)
+		os.Exit(1)
 	}
 
 	logger := logging.GetLogger("goodoo.main")
 	logger.Info("Starting Goodoo application")
 
-	// Initialize database
-	dbName := os.Getenv("GOODOO_DEFAULT_DB")
-	if dbName == "" {
-		dbName = "apexive-hackaton"
+	// API keys and secrets are encrypted at rest with GOODOO_ENCRYPTION_KEYS
+	encryptionConfig := crypto.DefaultConfig()
+	if err := encryptionConfig.LoadFromEnv(); err != nil {
+		exitStartup(logger, "Invalid encryption keys", err)
+	}
+	if err := crypto.Setup(encryptionConfig); err != nil {
+		exitStartup(logger, "Invalid encryption keys", err)
+	}
+	if !crypto.Enabled() {
+		logger.Warning("GOODOO_ENCRYPTION_KEYS is not set: API keys and secrets are stored unencrypted")
+	}
+
+	// Request tracing (GOODOO_TRACE_*), disabled by default
+	traceConfig := tracing.DefaultConfig()
+	traceConfig.LoadFromEnv()
+	tracing.Setup(traceConfig)
+
+	// Outbound HTTP (GOODOO_OUTBOUND_*): timeouts, retries, circuit
+	// breaking and the TLS settings of internal services; proxies come
+	// from HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+	outboundConfig := httpclient.DefaultConfig()
+	outboundConfig.LoadFromEnv()
+	if err := httpclient.Setup(outboundConfig); err != nil {
+		exitStartup(logger, "Invalid outbound HTTP configuration", err)
+	}
+
+	// Server configuration: default database (GOODOO_DEFAULT_DB), session
+	// directory (GOODOO_SESSION_DIR) and port (PORT)
+	serverConfig := server.DefaultConfig()
+	serverConfig.LoadFromEnv()
+	dbName := serverConfig.DBName
+
+	// The ondelete actions of the GORM relations, enforced on soft deletes
+	// and emitted in their foreign keys by the schema sync
+	if err := models.RegisterGORMReferences(server.SchemaModels...); err != nil {
+		exitStartup(logger, "Invalid model relations", err)
+	}
+
+	if *migrateOnly {
+		os.Exit(migrate(dbName, logger))
 	}
-	
-	logger.Info("Setting up database: %s", dbName)
-	if err := database.QuickSetup(dbName, &models.User{}); err != nil {
-		logger.Critical("Failed to setup database: %v", err)
-		panic(err)
+	if *generate != "" {
+		os.Exit(generateLoadData(dbName, append([]string{*generate}, flag.Args()...), logger))
 	}
 
-	// Create default admin user if not exists
-	initDefaultUser(dbName, logger)
+	// Every check runs before anything is started, so a misconfigured
+	// deployment reports all its problems at once and exits non-zero
+	report := validateStartup(startupOptions{
+		dbName:          dbName,
+		sessionDir:      serverConfig.SessionDir,
+		requireMigrated: *checkOnly,
+		checkLLM:        *checkLLM,
+	})
+	report.log(logger)
+	failed := len(report.failures()) > 0
+	if *checkOnly && !failed {
+		os.Exit(0)
+	}
+	if failed {
+		os.Exit(1)
+	}
 
-	// Initialize session store
-	sessionDir := os.Getenv("GOODOO_SESSION_DIR")
-	if sessionDir == "" {
-		sessionDir = "./sessions"
+	// "goodoo rotate-encryption-keys" re-encrypts the encrypted columns
+	// with the current key, then exits
+	if flag.Arg(0) == "rotate-encryption-keys" {
+		if err := database.GetRegistry().AutoMigrate(dbName, server.SchemaModels...); err != nil {
+			exitStartup(logger, "Failed to setup database", err)
+		}
+		os.Exit(rotateEncryptionKeys(dbName, logger))
 	}
 
-	sessionStore, err := http.NewFilesystemSessionStore(sessionDir, true)
+	s, err := server.New(serverConfig)
 	if err != nil {
-		logger.Critical("Failed to create session store: %v", err)
-		panic(err)
-	}
-
-	// Create request configuration
-	requestConfig := &http.RequestConfig{
-		SessionStore:      sessionStore,
-		DefaultDBName:     dbName,
-		SessionCookieName: "goodoo_session",
-		Logger:            logger,
-	}
-
-	e := echo.New()
-
-	// Set up template renderer
-	e.Renderer = templates.NewTemplateRenderer()
-
-	// Disable Echo's default logger since we have our own
-	e.Logger.SetOutput(io.Discard)
-
-	// Core middleware
-	e.Use(middleware.Recover())
-	e.Use(middleware.CORS())
-
-	// Goodoo middleware
-	e.Use(http.RequestMiddleware(requestConfig))
-	e.Use(logging.PerformanceMiddleware())
-	e.Use(http.SecurityMiddleware())
-	e.Use(http.ErrorHandlingMiddleware())
-	e.Use(http.RequestLoggingMiddleware())
-
-	// Session cleanup (every hour)
-	e.Use(http.SessionCleanupMiddleware(sessionStore, 1*time.Hour))
-
-	// Static files
-	e.Static("/static", "static")
-
-	// Create handlers
-	authHandler := handlers.NewAuthHandler(requestConfig)
-	dbHandler := handlers.NewDatabaseHandler(requestConfig)
-	healthHandler := handlers.NewHealthHandler(requestConfig)
-	sessionHandler := handlers.NewSessionHandler(requestConfig)
-
-	// Public routes (no authentication required)
-	public := e.Group("")
-	public.GET("/", handlers.IndexHandler)
-	public.GET("/login", handlers.LoginPageHandler)
-	public.GET("/health", healthHandler.Health)
-	public.POST("/auth/login", authHandler.Login)
-	public.GET("/db/list", dbHandler.ListDatabases)
-
-	// Protected routes (authentication required)
-	protected := e.Group("")
-	protected.Use(http.AuthenticationMiddleware(true))
-	protected.GET("/health/detailed", healthHandler.DetailedHealth)
-	protected.POST("/auth/logout", authHandler.Logout)
-	protected.GET("/auth/logout", authHandler.Logout)
-	protected.GET("/auth/session", authHandler.SessionInfo)
-	protected.POST("/db/set", dbHandler.SetDatabase)
-	protected.GET("/session", sessionHandler.GetSession)
-	protected.POST("/session/clear", sessionHandler.ClearSession)
-	protected.POST("/session/set", sessionHandler.SetSessionData)
-
-	// Database-dependent routes
-	withDB := e.Group("")
-	withDB.Use(http.AuthenticationMiddleware(true))
-	withDB.Use(http.DatabaseMiddleware(true))
-	// Add database-dependent routes here
-
-	// API routes
-	handlers.RegisterAPIRoutes(e)
-	
-	// Dashboard routes
-	handlers.RegisterDashboardRoutes(e, requestConfig)
-
-	// Start server
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
-	}
-
-	logger.Info("Starting server on port %s", port)
-	logger.Info("Session store: %s", sessionDir)
-	logger.Info("Default database: %s", requestConfig.DefaultDBName)
-
-	if err := e.Start(":" + port); err != nil {
+		exitStartup(logger, "Failed to build the server", err)
+	}
+
+	// SIGINT and SIGTERM stop the server once the requests in progress
+	// are served
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := s.Start(ctx); err != nil {
 		logger.Critical("Server failed to start: %v", err)
+		os.Exit(1)
 	}
+	logger.Info("Server stopped")
 }
 
-func initDefaultUser(dbName string, logger *logging.Logger) {
-	db, err := database.GetDatabase(dbName)
+// migrate applies the pending schema changes of the GORM and field models
+// and returns the exit status
+func migrate(dbName string, logger *logging.Logger) int {
+	if err := database.QuickRegister(dbName); err != nil {
+		logger.Critical("Failed to register database %s: %v", dbName, err)
+		return 1
+	}
+	retentionConfig := retention.DefaultConfig()
+	retentionConfig.LoadFromEnv()
+	retention.Setup(retentionConfig)
+	if db, err := database.GetDatabase(dbName); err == nil {
+		if err := retention.CreatePartitionedTables(db); err != nil {
+			logger.Critical("Failed to create the partitioned tables of %s: %v", dbName, err)
+			return 1
+		}
+	}
+	if err := database.GetRegistry().AutoMigrate(dbName, server.SchemaModels...); err != nil {
+		logger.Critical("Failed to migrate database %s: %v", dbName, err)
+		return 1
+	}
+	if err := server.SyncSchemas(dbName, logger); err != nil {
+		logger.Critical("Failed to sync model schemas of %s: %v", dbName, err)
+		return 1
+	}
+	logger.Info("Database %s is migrated", dbName)
+	return 0
+}
+
+// loadDataProgressInterval is how often --generate logs its progress
+const loadDataProgressInterval = 10 * time.Second
+
+// generateLoadData creates the random records described by args as the
+// administrator (uid 1) and returns the exit status; SIGINT stops it
+// after the batches in progress
+func generateLoadData(dbName string, args []string, logger *logging.Logger) int {
+	opts, err := loaddata.ParseArgs(args)
+	if err != nil {
+		logger.Critical("Invalid --generate arguments: %v", err)
+		return 2
+	}
+	if err := database.QuickRegister(dbName); err != nil {
+		logger.Critical("Failed to register database %s: %v", dbName, err)
+		return 1
+	}
+	if err := loaddata.CheckAllowed(dbName); err != nil {
+		logger.Critical("Refusing to generate records in %s: %v", dbName, err)
+		return 1
+	}
+	workpoolConfig := workpool.DefaultConfig()
+	workpoolConfig.LoadFromEnv()
+	workpool.Setup(workpoolConfig)
+
+	env, err := models.NewEnvironmentForDB(dbName, 1)
+	if err != nil {
+		logger.Critical("%v", err)
+		return 1
+	}
+	generator, err := loaddata.New(env, opts)
 	if err != nil {
-		logger.Error("Failed to get database for user initialization: %v", err)
-		return
-	}
-
-	// Check if admin user exists
-	var count int64
-	db.Model(&models.User{}).Where("login = ?", "admin").Count(&count)
-	
-	if count == 0 {
-		logger.Info("Creating default admin user")
-		_, err := models.CreateUser(db, "admin", "Administrator", "admin@example.com", "admin")
-		if err != nil {
-			logger.Error("Failed to create default admin user: %v", err)
-		} else {
-			logger.Info("Default admin user created successfully (login: admin, password: admin)")
+		logger.Critical("Cannot generate %s records: %v", opts.Model, err)
+		return 2
+	}
+
+	op := loaddata.Start(generator, 1)
+	finished := make(chan struct{})
+	go func() {
+		op.Wait()
+		close(finished)
+	}()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ticker := time.NewTicker(loadDataProgressInterval)
+	defer ticker.Stop()
+	for waiting := true; waiting; {
+		select {
+		case <-finished:
+			waiting = false
+		case <-ctx.Done():
+			logger.Warning("Interrupted: stopping after the batches in progress")
+			op.Cancel()
+			<-finished
+			waiting = false
+		case <-ticker.C:
+			status := op.Status()
+			logger.Info("Generated %d of %d record(s), %d failed", status.Processed, status.Total, status.Failed)
 		}
-	} else {
-		logger.Info("Admin user already exists")
 	}
+
+	status := op.Status()
+	for _, message := range status.Errors {
+		logger.Warning("%s", message)
+	}
+	if status.State == operations.StateFailed {
+		logger.Error("Generation of %s records failed after %d record(s)", opts.Model, status.Processed)
+		return 1
+	}
+	return 0
+}
+
+// exitStartup logs a startup failure at CRITICAL and exits non-zero
+func exitStartup(logger *logging.Logger, message string, err error) {
+	logger.Critical("%s: %v", message, err)
+	os.Exit(1)
+}
+
+// rotateEncryptionKeys re-encrypts the encrypted columns of a database
+// with the current key and returns the exit status. Values sealed by the
+// previous keys are only readable while those keys remain configured.
+func rotateEncryptionKeys(dbName string, logger *logging.Logger) int {
+	db, err := database.GetDatabase(dbName)
+	if err != nil {
+		logger.Error("Failed to get database for key rotation: %v", err)
+		return 1
+	}
+	counts, err := crypto.Rotate(db)
+	for column, count := range counts {
+		logger.Info("Re-encrypted %d value(s) of %s with key %s", count, column, crypto.CurrentKeyID())
+	}
+	if err != nil {
+		logger.Error("Key rotation failed: %v", err)
+		return 1
+	}
+	return 0
 }
@@ -0,0 +1,260 @@
+// Package maintenance stops the mutating traffic of a database without
+// stopping the process, during migrations or backups. The state is a system
+// parameter, so every instance reads the same one: writing it notifies the
+// other processes, which reload it and publish the change on their bus. A
+// deadline ends maintenance by itself.
+//
+// Mutating requests in flight are counted, per process, so that entering
+// maintenance can drain them, and the running operations, before the work
+// starts.
+package maintenance
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"goodoo/bus"
+	"goodoo/database"
+	"goodoo/logging"
+	"goodoo/models"
+	"goodoo/operations"
+	"goodoo/scheduler"
+	"gorm.io/gorm"
+)
+
+// Channel is the bus channel of maintenance changes; payloads are State values
+const Channel = "maintenance"
+
+var logger = logging.GetLogger("goodoo.maintenance")
+
+// Config holds the defaults of maintenance mode
+type Config struct {
+	// AllowReads lets GET requests through when enabling does not say
+	AllowReads bool
+	// RetryAfter is announced to blocked clients when maintenance has no
+	// deadline
+	RetryAfter time.Duration
+}
+
+// DefaultConfig allows reads and asks clients to retry after 5 minutes
+func DefaultConfig() *Config {
+	return &Config{
+		AllowReads: true,
+		RetryAfter: 5 * time.Minute,
+	}
+}
+
+// LoadFromEnv overrides the configuration with GOODOO_MAINTENANCE_* variables
+func (c *Config) LoadFromEnv() {
+	if value := os.Getenv("GOODOO_MAINTENANCE_ALLOW_READS"); value != "" {
+		if allow, err := strconv.ParseBool(value); err == nil {
+			c.AllowReads = allow
+		}
+	}
+	if value := os.Getenv("GOODOO_MAINTENANCE_RETRY_AFTER"); value != "" {
+		if d, err := time.ParseDuration(value); err == nil && d > 0 {
+			c.RetryAfter = d
+		}
+	}
+}
+
+var (
+	config      = DefaultConfig()
+	configMutex sync.RWMutex
+)
+
+// Setup replaces the maintenance configuration
+func Setup(c *Config) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config = c
+}
+
+// CurrentConfig returns the maintenance configuration
+func CurrentConfig() *Config {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return config
+}
+
+// State is the maintenance mode of a database
+type State struct {
+	Enabled bool   `json:"enabled"`
+	Message string `json:"message,omitempty"`
+	// Until ends maintenance by itself; it lasts until disabled when nil
+	Until *time.Time `json:"until,omitempty"`
+	// AllowReads lets GET requests through
+	AllowReads bool      `json:"allow_reads"`
+	Since      time.Time `json:"since,omitempty"`
+	// By is the login of the administrator who enabled it
+	By string `json:"by,omitempty"`
+}
+
+// Active reports whether maintenance is on at now
+func (s State) Active(now time.Time) bool {
+	return s.Enabled && (s.Until == nil || now.Before(*s.Until))
+}
+
+// RetryAfter returns how long blocked clients should wait: until the
+// deadline, or the configured delay without one
+func (s State) RetryAfter(now time.Time) time.Duration {
+	if s.Until != nil && s.Until.After(now) {
+		return s.Until.Sub(now)
+	}
+	return CurrentConfig().RetryAfter
+}
+
+// Get returns the maintenance state of a database, disabled when unset
+func Get(dbName string) State {
+	var state State
+	models.GetParamJSON(dbName, models.ParamMaintenance, &state)
+	return state
+}
+
+// Active reports whether a database is in maintenance at now
+func Active(dbName string, now time.Time) bool {
+	return Get(dbName).Active(now)
+}
+
+// Set stores the maintenance state of a database and publishes it; the
+// other processes publish it too once notified
+func Set(db *gorm.DB, dbName string, uid uint, state State) error {
+	if err := models.SetParam(db, dbName, uid, models.ParamMaintenance, state); err != nil {
+		return err
+	}
+	if err := database.Notify(db, Channel, dbName); err != nil {
+		logger.Warning("Failed to notify the maintenance change of %s: %v", dbName, err)
+	}
+	bus.Publish(dbName, Channel, state)
+	return nil
+}
+
+// Listen publishes on the bus the maintenance changes another process
+// makes to a database, until ctx is done
+func Listen(ctx context.Context, dbName string) {
+	database.Listen(ctx, dbName, Channel, func(payload string) {
+		if payload == "" {
+			return
+		}
+		// The parameter cache may not have heard of the change yet
+		models.InvalidateParams(dbName)
+		bus.Publish(dbName, Channel, Get(dbName))
+	})
+}
+
+// Schedule registers the job disabling the maintenance of a database whose
+// deadline passed, so that the stored state and the bus follow it
+func Schedule(s *scheduler.Scheduler, dbName string, interval time.Duration) {
+	s.Every("maintenance.expire."+dbName, interval, func(ctx context.Context) error {
+		state := Get(dbName)
+		now := time.Now()
+		if !state.Enabled || state.Active(now) {
+			return nil
+		}
+		db, err := database.GetDatabase(dbName)
+		if err != nil {
+			return err
+		}
+		logger.Info("Maintenance of %s ended at its deadline %s", dbName, state.Until.Format(time.RFC3339))
+		return Set(db.WithContext(ctx), dbName, 0, State{AllowReads: state.AllowReads})
+	})
+}
+
+var (
+	inFlight      = make(map[string]int)
+	inFlightMutex sync.Mutex
+)
+
+// Begin counts a mutating request of a database as in flight until the
+// returned function is called
+func Begin(dbName string) (end func()) {
+	inFlightMutex.Lock()
+	inFlight[dbName]++
+	inFlightMutex.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			inFlightMutex.Lock()
+			defer inFlightMutex.Unlock()
+			if inFlight[dbName]--; inFlight[dbName] <= 0 {
+				delete(inFlight, dbName)
+			}
+		})
+	}
+}
+
+// InFlight returns the number of mutating requests of a database this
+// process is serving
+func InFlight(dbName string) int {
+	inFlightMutex.Lock()
+	defer inFlightMutex.Unlock()
+	return inFlight[dbName]
+}
+
+// DrainOptions select what entering maintenance waits for
+type DrainOptions struct {
+	// Timeout bounds the wait
+	Timeout time.Duration
+	// CancelOperations cancels the running operations instead of letting
+	// them finish
+	CancelOperations bool
+}
+
+// Readiness is what still runs in a database, reported by Drain
+type Readiness struct {
+	Ready bool `json:"ready"`
+	// InFlight counts the mutating requests of this process
+	InFlight   int                 `json:"in_flight"`
+	Operations []operations.Status `json:"operations"`
+	// Cancelled lists the operations Drain cancelled
+	Cancelled []string `json:"cancelled,omitempty"`
+}
+
+// Check reports what still runs in a database
+func Check(dbName string) Readiness {
+	readiness := Readiness{InFlight: InFlight(dbName), Operations: []operations.Status{}}
+	for _, op := range operations.Running(dbName) {
+		readiness.Operations = append(readiness.Operations, op.Status())
+	}
+	readiness.Ready = readiness.InFlight == 0 && len(readiness.Operations) == 0
+	return readiness
+}
+
+// drainPoll is how often Drain looks at what still runs
+const drainPoll = 50 * time.Millisecond
+
+// Drain waits, up to the timeout, for the mutating requests in flight and
+// the running operations of a database to finish, after cancelling the
+// operations if asked. Operations stop between batches, so cancelled ones
+// may still run for a while; they count until they return.
+func Drain(ctx context.Context, dbName string, opts DrainOptions) Readiness {
+	var cancelled []string
+	if opts.CancelOperations {
+		for _, op := range operations.Running(dbName) {
+			if op.Cancel() {
+				cancelled = append(cancelled, op.Status().ID)
+			}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+	ticker := time.NewTicker(drainPoll)
+	defer ticker.Stop()
+	for {
+		readiness := Check(dbName)
+		readiness.Cancelled = cancelled
+		if readiness.Ready {
+			return readiness
+		}
+		select {
+		case <-ctx.Done():
+			return readiness
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package maintenance
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	goodooHttp "goodoo/http"
+)
+
+// exemptRoutes stay open during maintenance and are not counted in flight:
+// health checks, the status page announcing it, logging in and out so
+// administrators can work, the database manager doing backups and
+// maintenance itself. Entries ending
+// with / match the routes below them.
+var exemptRoutes = []string{
+	"/health",
+	"/health/",
+	"/status",
+	"/auth/login",
+	"/auth/logout",
+	"/db/",
+	"/api/maintenance",
+}
+
+// exempt reports whether a route stays open during maintenance
+func exempt(path string) bool {
+	for _, route := range exemptRoutes {
+		if path == route || (strings.HasSuffix(route, "/") && strings.HasPrefix(path, route)) {
+			return true
+		}
+	}
+	return false
+}
+
+// mutating reports whether a method may change data
+func mutating(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+// Middleware answers 503 to the requests of other users than administrators
+// while their database is in maintenance, with the message and a
+// Retry-After header; GET requests go through when the state allows reads.
+// Mutating requests that do go through are counted in flight for Drain.
+func Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := goodooHttp.GetGoodooRequest(c)
+			if req == nil || req.GetDBName() == "" || exempt(c.Path()) {
+				return next(c)
+			}
+			dbName := req.GetDBName()
+			method := c.Request().Method
+
+			now := req.Now()
+			if state := Get(dbName); state.Active(now) && (mutating(method) || !state.AllowReads) {
+				admin := false
+				if req.IsAuthenticated() {
+					_, admin = req.EffectivePermissions()
+				}
+				if !admin {
+					retryAfter := int(math.Ceil(state.RetryAfter(now).Seconds()))
+					c.Response().Header().Set("Retry-After", strconv.Itoa(retryAfter))
+					message := state.Message
+					if message == "" {
+						message = "The service is under maintenance"
+					}
+					body := map[string]interface{}{"error": message, "maintenance": true, "retry_after": retryAfter}
+					if state.Until != nil {
+						body["until"] = state.Until
+					}
+					return c.JSON(http.StatusServiceUnavailable, body)
+				}
+			}
+
+			if mutating(method) {
+				defer Begin(dbName)()
+			}
+			return next(c)
+		}
+	}
+}
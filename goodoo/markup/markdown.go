@@ -0,0 +1,537 @@
+// Package markup renders the Markdown of chat messages as HTML: paragraphs,
+// headings, quotes, lists, fenced code blocks with their language class,
+// emphasis, inline code, links and @login mentions. The renderer escapes
+// every text it copies and its output still goes through Sanitize, which
+// only keeps an allowlist of elements and makes links safe.
+//
+// Inputs are bounded: content over MaxMarkdownBytes, lines over
+// MaxLineBytes and blocks nested deeper than MaxDepth are rendered as
+// plain text, and so is the whole message when rendering takes longer
+// than RenderTimeout.
+package markup
+
+import (
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Rendering limits
+const (
+	MaxMarkdownBytes = 64 << 10
+	MaxLineBytes     = 8 << 10
+	MaxDepth         = 8
+	RenderTimeout    = 50 * time.Millisecond
+	// MaxMentions bounds the logins returned by Mentions
+	MaxMentions = 20
+)
+
+// Options tunes the rendering
+type Options struct {
+	// Mentions maps the logins mentioned with @login to user IDs; the
+	// mentions of other logins stay plain text
+	Mentions map[string]uint
+}
+
+// renderer writes the HTML of one message
+type renderer struct {
+	options  Options
+	out      strings.Builder
+	deadline time.Time
+	steps    int
+	expired  bool
+}
+
+// Render returns the sanitized HTML of Markdown content
+func Render(markdown string, options Options) string {
+	markdown = normalize(markdown)
+	if len(markdown) > MaxMarkdownBytes {
+		return PlainText(markdown)
+	}
+	r := &renderer{options: options, deadline: time.Now().Add(RenderTimeout)}
+	r.blocks(strings.Split(markdown, "\n"), 0, false)
+	if r.expired {
+		return PlainText(markdown)
+	}
+	return Sanitize(r.out.String())
+}
+
+// PlainText returns the HTML of text without Markdown: paragraphs split on
+// blank lines, with line breaks
+func PlainText(text string) string {
+	var b strings.Builder
+	for _, paragraph := range strings.Split(normalize(text), "\n\n") {
+		if strings.TrimSpace(paragraph) == "" {
+			continue
+		}
+		lines := strings.Split(strings.Trim(paragraph, "\n"), "\n")
+		for i := range lines {
+			lines[i] = html.EscapeString(lines[i])
+		}
+		b.WriteString("<p>" + strings.Join(lines, "<br>\n") + "</p>\n")
+	}
+	return b.String()
+}
+
+// normalize unifies line endings and drops NUL characters
+func normalize(text string) string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+	return strings.ReplaceAll(text, "\x00", "")
+}
+
+// tick reports whether the rendering is out of time; the clock is only
+// read every few hundred steps
+func (r *renderer) tick() bool {
+	r.steps++
+	if !r.expired && r.steps%256 == 0 && time.Now().After(r.deadline) {
+		r.expired = true
+	}
+	return r.expired
+}
+
+// blocks renders lines as block elements. In a tight list item,
+// paragraphs are written without <p>.
+func (r *renderer) blocks(lines []string, depth int, tight bool) {
+	for i := 0; i < len(lines); {
+		if r.tick() {
+			return
+		}
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+			i++
+		case len(line) > MaxLineBytes:
+			r.out.WriteString("<p>" + html.EscapeString(line) + "</p>\n")
+			i++
+		case fence(trimmed) != "":
+			i = r.codeBlock(lines, i)
+		case heading(trimmed) > 0:
+			level := heading(trimmed)
+			text := strings.TrimSpace(strings.TrimRight(strings.TrimSpace(trimmed[level:]), "#"))
+			fmt.Fprintf(&r.out, "<h%d>", level)
+			r.inline(text, 0, false)
+			fmt.Fprintf(&r.out, "</h%d>\n", level)
+			i++
+		case rule(trimmed):
+			r.out.WriteString("<hr>\n")
+			i++
+		case strings.HasPrefix(trimmed, ">"):
+			i = r.quote(lines, i, depth)
+		case listMarkerOf(line).ok:
+			i = r.list(lines, i, depth)
+		default:
+			i = r.paragraph(lines, i, tight)
+		}
+	}
+}
+
+// fence returns the fence opening a code block, ``` or ~~~, or ""
+func fence(trimmed string) string {
+	for _, marker := range []string{"```", "~~~"} {
+		if strings.HasPrefix(trimmed, marker) {
+			return marker
+		}
+	}
+	return ""
+}
+
+// heading returns the level of an ATX heading, or 0
+func heading(trimmed string) int {
+	level := 0
+	for level < len(trimmed) && trimmed[level] == '#' {
+		level++
+	}
+	if level == 0 || level > 6 || (level < len(trimmed) && trimmed[level] != ' ') {
+		return 0
+	}
+	return level
+}
+
+// rule reports whether a line is a thematic break: three or more -, * or _
+func rule(trimmed string) bool {
+	if len(trimmed) < 3 || strings.Trim(trimmed, string(trimmed[0])+" ") != "" {
+		return false
+	}
+	switch trimmed[0] {
+	case '-', '*', '_':
+		return strings.Count(trimmed, string(trimmed[0])) >= 3
+	}
+	return false
+}
+
+// codeBlock renders the fenced code block starting at lines[start] and
+// returns the index of the line after it; an unclosed block runs to the end
+func (r *renderer) codeBlock(lines []string, start int) int {
+	opening := strings.TrimSpace(lines[start])
+	marker := fence(opening)
+	language := languageClass(strings.TrimSpace(strings.TrimLeft(opening, marker[:1])))
+
+	end := start + 1
+	for end < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[end]), marker) {
+		end++
+	}
+	if language != "" {
+		r.out.WriteString(`<pre><code class="language-` + language + `">`)
+	} else {
+		r.out.WriteString("<pre><code>")
+	}
+	for _, line := range lines[start+1 : end] {
+		r.out.WriteString(html.EscapeString(line) + "\n")
+	}
+	r.out.WriteString("</code></pre>\n")
+	if end < len(lines) {
+		end++
+	}
+	return end
+}
+
+// languageClass returns the language of a fence info string as it can
+// appear in a class name, or ""
+func languageClass(info string) string {
+	if fields := strings.Fields(info); len(fields) > 0 {
+		info = fields[0]
+	}
+	if len(info) > 32 || !validLanguage(info) {
+		return ""
+	}
+	return info
+}
+
+// validLanguage reports whether a language name only has letters, digits
+// and _+#- characters
+func validLanguage(name string) bool {
+	for _, c := range name {
+		if !isWordChar(c) && c != '+' && c != '#' && c != '-' {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// quote renders the block quote starting at lines[start]; quotes nested
+// deeper than MaxDepth are rendered as paragraphs
+func (r *renderer) quote(lines []string, start, depth int) int {
+	end := start
+	var inner []string
+	for end < len(lines) {
+		trimmed := strings.TrimSpace(lines[end])
+		if !strings.HasPrefix(trimmed, ">") {
+			break
+		}
+		content := strings.TrimPrefix(trimmed, ">")
+		inner = append(inner, strings.TrimPrefix(content, " "))
+		end++
+	}
+	if depth+1 >= MaxDepth {
+		r.out.WriteString(PlainText(strings.Join(lines[start:end], "\n")))
+		return end
+	}
+	r.out.WriteString("<blockquote>\n")
+	r.blocks(inner, depth+1, false)
+	r.out.WriteString("</blockquote>\n")
+	return end
+}
+
+// listMarker describes the marker of a list item
+type listMarker struct {
+	ok      bool
+	ordered bool
+	start   int
+	// indent is the column of the marker, offset the column of the content
+	indent int
+	offset int
+}
+
+// listMarkerOf returns the list marker starting a line: -, * or + or a
+// number followed by . or ), indented by at most 3 spaces
+func listMarkerOf(line string) listMarker {
+	indent := len(line) - len(strings.TrimLeft(line, " "))
+	if indent > 3 {
+		return listMarker{}
+	}
+	rest := line[indent:]
+	if len(rest) >= 2 && strings.ContainsRune("-*+", rune(rest[0])) && rest[1] == ' ' {
+		if rule(strings.TrimSpace(rest)) {
+			return listMarker{}
+		}
+		return listMarker{ok: true, indent: indent, offset: indent + 2}
+	}
+	digits := 0
+	for digits < len(rest) && digits < 9 && rest[digits] >= '0' && rest[digits] <= '9' {
+		digits++
+	}
+	if digits > 0 && digits+1 < len(rest) && (rest[digits] == '.' || rest[digits] == ')') && rest[digits+1] == ' ' {
+		start, _ := strconv.Atoi(rest[:digits])
+		return listMarker{ok: true, ordered: true, start: start, indent: indent, offset: indent + digits + 2}
+	}
+	return listMarker{}
+}
+
+// list renders the list starting at lines[start] and returns the index of
+// the line after it. Lines indented past the marker continue an item and
+// may hold nested blocks; lists nested deeper than MaxDepth are rendered
+// as paragraphs.
+func (r *renderer) list(lines []string, start, depth int) int {
+	first := listMarkerOf(lines[start])
+	if depth+1 >= MaxDepth {
+		return r.paragraph(lines, start, false)
+	}
+	switch {
+	case !first.ordered:
+		r.out.WriteString("<ul>\n")
+	case first.start != 1:
+		fmt.Fprintf(&r.out, "<ol start=\"%d\">\n", first.start)
+	default:
+		r.out.WriteString("<ol>\n")
+	}
+
+	i := start
+	for i < len(lines) && !r.tick() {
+		marker := listMarkerOf(lines[i])
+		if !marker.ok || marker.ordered != first.ordered {
+			break
+		}
+		item := []string{lines[i][marker.offset:]}
+		i++
+		for i < len(lines) {
+			line := lines[i]
+			indent := len(line) - len(strings.TrimLeft(line, " "))
+			if strings.TrimSpace(line) == "" {
+				// A blank line ends the item unless the next line is indented
+				if i+1 < len(lines) && indentOf(lines[i+1]) >= marker.offset && strings.TrimSpace(lines[i+1]) != "" {
+					item = append(item, "")
+					i++
+					continue
+				}
+				break
+			}
+			if indent >= marker.offset {
+				item = append(item, line[marker.offset:])
+			} else if next := listMarkerOf(line); !next.ok && !startsBlock(line) {
+				item = append(item, strings.TrimSpace(line))
+			} else {
+				break
+			}
+			i++
+		}
+
+		r.out.WriteString("<li>")
+		r.blocks(item, depth+1, true)
+		r.out.WriteString("</li>\n")
+
+		// Blank lines between items keep the list going
+		next := i
+		for next < len(lines) && strings.TrimSpace(lines[next]) == "" {
+			next++
+		}
+		if next > i && next < len(lines) && listMarkerOf(lines[next]).ok {
+			i = next
+		}
+	}
+
+	if first.ordered {
+		r.out.WriteString("</ol>\n")
+	} else {
+		r.out.WriteString("</ul>\n")
+	}
+	return i
+}
+
+// indentOf returns the leading spaces of a line
+func indentOf(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+// startsBlock reports whether a line starts a block other than a paragraph
+func startsBlock(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	return fence(trimmed) != "" || heading(trimmed) > 0 || rule(trimmed) ||
+		strings.HasPrefix(trimmed, ">") || listMarkerOf(line).ok
+}
+
+// paragraph renders the lines from start up to a blank line or another
+// block as one paragraph, its lines separated by line breaks
+func (r *renderer) paragraph(lines []string, start int, tight bool) int {
+	end := start + 1
+	for end < len(lines) && strings.TrimSpace(lines[end]) != "" && !startsBlock(lines[end]) && len(lines[end]) <= MaxLineBytes {
+		end++
+	}
+	if !tight {
+		r.out.WriteString("<p>")
+	}
+	for i, line := range lines[start:end] {
+		if i > 0 {
+			r.out.WriteString("<br>\n")
+		}
+		r.inline(strings.TrimSpace(line), 0, false)
+	}
+	if !tight {
+		r.out.WriteString("</p>\n")
+	}
+	return end
+}
+
+// inline renders the spans of a text: code, emphasis, strikethrough,
+// links, autolinks and mentions; inLink disables links inside link texts
+func (r *renderer) inline(text string, depth int, inLink bool) {
+	for i := 0; i < len(text); {
+		if r.tick() {
+			return
+		}
+		c := text[i]
+		switch {
+		case c == '\\' && i+1 < len(text) && strings.IndexByte(punctuation, text[i+1]) >= 0:
+			r.out.WriteString(html.EscapeString(text[i+1 : i+2]))
+			i += 2
+			continue
+		case c == '`':
+			if end := r.codeSpan(text, i); end > i {
+				i = end
+				continue
+			}
+		case c == '*' || c == '_' || (c == '~' && strings.HasPrefix(text[i:], "~~")):
+			if end := r.emphasis(text, i, depth, inLink); end > i {
+				i = end
+				continue
+			}
+		case c == '[' && !inLink:
+			if end := r.link(text, i, depth); end > i {
+				i = end
+				continue
+			}
+		case c == 'h' && !inLink && (i == 0 || !isWordChar(rune(text[i-1]))):
+			if end := r.autolink(text, i); end > i {
+				i = end
+				continue
+			}
+		case c == '@':
+			if login, end := mentionAt(text, i); login != "" {
+				if id, ok := r.options.Mentions[login]; ok {
+					fmt.Fprintf(&r.out, `<span class="mention" data-user-id="%d">@%s</span>`, id, html.EscapeString(login))
+					i = end
+					continue
+				}
+			}
+		}
+		r.out.WriteString(html.EscapeString(text[i : i+1]))
+		i++
+	}
+}
+
+// punctuation are the characters a backslash escapes
+const punctuation = "!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~"
+
+// codeSpan renders the code span opened by the backticks at text[start]
+// and returns the index after it, or start when it is not closed
+func (r *renderer) codeSpan(text string, start int) int {
+	n := 0
+	for start+n < len(text) && text[start+n] == '`' {
+		n++
+	}
+	delimiter := text[start : start+n]
+	end := strings.Index(text[start+n:], delimiter)
+	if end < 0 {
+		return start
+	}
+	code := text[start+n : start+n+end]
+	if len(code) > 1 && code[0] == ' ' && code[len(code)-1] == ' ' {
+		code = code[1 : len(code)-1]
+	}
+	r.out.WriteString("<code>" + html.EscapeString(code) + "</code>")
+	return start + n + end + n
+}
+
+// emphasis renders the emphasis (* or _), strong emphasis (** or __) or
+// strikethrough (~~) opened at text[start] and returns the index after
+// it, or start when it is not closed or nested deeper than MaxDepth
+func (r *renderer) emphasis(text string, start, depth int, inLink bool) int {
+	c := text[start]
+	delimiter := string(c)
+	tag := "em"
+	switch {
+	case c == '~':
+		delimiter, tag = "~~", "del"
+	case strings.HasPrefix(text[start:], strings.Repeat(delimiter, 2)):
+		delimiter, tag = strings.Repeat(delimiter, 2), "strong"
+	}
+	open := start + len(delimiter)
+	if depth+1 >= MaxDepth || open >= len(text) || text[open] == ' ' {
+		return start
+	}
+	// Intraword underscores, as in snake_case, are not emphasis
+	if c == '_' && start > 0 && isWordChar(rune(text[start-1])) {
+		return start
+	}
+	end := strings.Index(text[open:], delimiter)
+	for end >= 0 {
+		at := open + end
+		after := at + len(delimiter)
+		if end > 0 && text[at-1] != ' ' && (c != '_' || after >= len(text) || !isWordChar(rune(text[after]))) {
+			r.out.WriteString("<" + tag + ">")
+			r.inline(text[open:at], depth+1, inLink)
+			r.out.WriteString("</" + tag + ">")
+			return after
+		}
+		next := strings.Index(text[after:], delimiter)
+		if next < 0 {
+			break
+		}
+		end = after - open + next
+	}
+	return start
+}
+
+// link renders the [text](url) link at text[start] and returns the index
+// after it, or start when it is not a link or its URL is not safe
+func (r *renderer) link(text string, start, depth int) int {
+	closeText := strings.Index(text[start:], "](")
+	if closeText < 0 {
+		return start
+	}
+	closeText += start
+	closeURL := strings.IndexByte(text[closeText+2:], ')')
+	if closeURL < 0 {
+		return start
+	}
+	closeURL += closeText + 2
+	href := strings.TrimSpace(text[closeText+2 : closeURL])
+	if href == "" || strings.ContainsAny(href, " \t") || !SafeURL(href) || depth+1 >= MaxDepth {
+		return start
+	}
+	r.out.WriteString(`<a href="` + html.EscapeString(href) + `">`)
+	r.inline(text[start+1:closeText], depth+1, true)
+	r.out.WriteString("</a>")
+	return closeURL + 1
+}
+
+// autolink renders the http(s) URL at text[start] as a link and returns
+// the index after it, or start
+func (r *renderer) autolink(text string, start int) int {
+	rest := text[start:]
+	if !strings.HasPrefix(rest, "https://") && !strings.HasPrefix(rest, "http://") {
+		return start
+	}
+	end := strings.IndexAny(rest, " \t<>\"")
+	if end < 0 {
+		end = len(rest)
+	}
+	href := strings.TrimRight(rest[:end], ".,;:!?'*_~")
+	if strings.HasSuffix(href, ")") && !strings.Contains(href, "(") {
+		href = strings.TrimRight(href, ")")
+	}
+	if !strings.Contains(strings.SplitN(href, "://", 2)[1], ".") || !SafeURL(href) {
+		return start
+	}
+	escaped := html.EscapeString(href)
+	r.out.WriteString(`<a href="` + escaped + `">` + escaped + "</a>")
+	return start + len(href)
+}
+
+// isWordChar reports whether c is an ASCII letter, digit or underscore
+func isWordChar(c rune) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
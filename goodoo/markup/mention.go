@@ -0,0 +1,88 @@
+package markup
+
+import "strings"
+
+// isLoginChar reports whether c may appear in a mentioned login
+func isLoginChar(c byte) bool {
+	return isWordChar(rune(c)) || c == '.' || c == '-' || c == '+'
+}
+
+// mentionAt returns the login mentioned by the @ at text[start] and the
+// index after it, or "" when the @ does not start a mention, e.g. in an
+// email address. Logins may themselves be email addresses
+// (@jane@example.com); trailing dots and dashes end the sentence, not
+// the login.
+func mentionAt(text string, start int) (string, int) {
+	if start > 0 && (isLoginChar(text[start-1]) || text[start-1] == '@') {
+		return "", start
+	}
+	end := start + 1
+	for end < len(text) && isLoginChar(text[end]) {
+		end++
+	}
+	if end < len(text) && text[end] == '@' {
+		domain := end + 1
+		for domain < len(text) && isLoginChar(text[domain]) {
+			domain++
+		}
+		if strings.Contains(strings.Trim(text[end+1:domain], ".-"), ".") {
+			end = domain
+		}
+	}
+	login := strings.TrimRight(text[start+1:end], ".-")
+	if login == "" {
+		return "", start
+	}
+	return login, start + 1 + len(login)
+}
+
+// Mentions returns the distinct logins mentioned with @login in Markdown
+// content, in order and at most MaxMentions; mentions in code blocks and
+// code spans do not count
+func Mentions(markdown string) []string {
+	var logins []string
+	seen := make(map[string]bool)
+	fenced := ""
+	for _, line := range strings.Split(normalize(markdown), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if fenced != "" {
+			if strings.HasPrefix(trimmed, fenced) {
+				fenced = ""
+			}
+			continue
+		}
+		if marker := fence(trimmed); marker != "" {
+			fenced = marker
+			continue
+		}
+
+		for i := 0; i < len(line); i++ {
+			switch line[i] {
+			case '`':
+				n := 1
+				for i+n < len(line) && line[i+n] == '`' {
+					n++
+				}
+				if end := strings.Index(line[i+n:], line[i:i+n]); end >= 0 {
+					i += n + end + n - 1
+				} else {
+					i += n - 1
+				}
+			case '@':
+				login, end := mentionAt(line, i)
+				if login == "" {
+					continue
+				}
+				if !seen[login] {
+					if len(logins) == MaxMentions {
+						return logins
+					}
+					seen[login] = true
+					logins = append(logins, login)
+				}
+				i = end - 1
+			}
+		}
+	}
+	return logins
+}
@@ -0,0 +1,132 @@
+package markup
+
+import (
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+
+	htmlparse "golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// LinkRel is the rel attribute of the links of messages
+const LinkRel = "nofollow noopener noreferrer"
+
+// allowedElements maps the elements Sanitize keeps to their allowed
+// attributes and the check of each attribute value
+var allowedElements = map[atom.Atom]map[string]func(string) bool{
+	atom.P: nil, atom.Br: nil, atom.Hr: nil, atom.Strong: nil, atom.Em: nil, atom.Del: nil,
+	atom.Pre: nil, atom.Blockquote: nil, atom.Ul: nil, atom.Li: nil,
+	atom.H1: nil, atom.H2: nil, atom.H3: nil, atom.H4: nil, atom.H5: nil, atom.H6: nil,
+	atom.Code: {"class": languageClassPattern.MatchString},
+	atom.Ol:   {"start": digitsPattern.MatchString},
+	atom.A:    {"href": SafeURL},
+	atom.Span: {"class": func(value string) bool { return value == "mention" }, "data-user-id": digitsPattern.MatchString},
+}
+
+var (
+	languageClassPattern = regexp.MustCompile(`^language-[A-Za-z0-9_+#-]{1,32}$`)
+	digitsPattern        = regexp.MustCompile(`^[0-9]{1,10}$`)
+)
+
+// droppedElements are removed with their content; other unknown elements
+// are removed but their text is kept
+var droppedElements = map[atom.Atom]bool{
+	atom.Script: true, atom.Style: true, atom.Iframe: true, atom.Object: true, atom.Embed: true,
+	atom.Noscript: true, atom.Template: true, atom.Textarea: true, atom.Title: true, atom.Svg: true, atom.Math: true,
+}
+
+// voidElements have no end tag
+var voidElements = map[atom.Atom]bool{atom.Br: true, atom.Hr: true}
+
+// SafeURL reports whether a link target may be followed from a message:
+// http, https and mailto URLs, and relative URLs
+func SafeURL(href string) bool {
+	for _, c := range href {
+		if c < ' ' || c == 0x7f || c == ' ' {
+			return false
+		}
+	}
+	parsed, err := url.Parse(href)
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(parsed.Scheme) {
+	case "", "http", "https", "mailto":
+		return true
+	}
+	return false
+}
+
+// Sanitize keeps the allowed elements and attributes of an HTML fragment,
+// drops scripts and other active content with their text, escapes every
+// text and balances the tags. Links get rel="nofollow noopener noreferrer"
+// and open in a new tab.
+func Sanitize(fragment string) string {
+	var b strings.Builder
+	var open []atom.Atom
+	skip := 0
+	tokenizer := htmlparse.NewTokenizer(strings.NewReader(fragment))
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == htmlparse.ErrorToken {
+			break
+		}
+		token := tokenizer.Token()
+		switch tokenType {
+		case htmlparse.TextToken:
+			if skip == 0 {
+				b.WriteString(html.EscapeString(token.Data))
+			}
+		case htmlparse.StartTagToken, htmlparse.SelfClosingTagToken:
+			if droppedElements[token.DataAtom] {
+				if tokenType == htmlparse.StartTagToken {
+					skip++
+				}
+				continue
+			}
+			attributes, allowed := allowedElements[token.DataAtom]
+			if !allowed || skip > 0 {
+				continue
+			}
+			b.WriteString("<" + token.DataAtom.String())
+			for _, attribute := range token.Attr {
+				check, ok := attributes[attribute.Key]
+				if attribute.Namespace != "" || !ok || !check(attribute.Val) {
+					continue
+				}
+				b.WriteString(" " + attribute.Key + `="` + html.EscapeString(attribute.Val) + `"`)
+			}
+			if token.DataAtom == atom.A {
+				b.WriteString(` rel="` + LinkRel + `" target="_blank"`)
+			}
+			b.WriteString(">")
+			if !voidElements[token.DataAtom] && tokenType == htmlparse.StartTagToken {
+				open = append(open, token.DataAtom)
+			}
+		case htmlparse.EndTagToken:
+			if droppedElements[token.DataAtom] {
+				if skip > 0 {
+					skip--
+				}
+				continue
+			}
+			// Close the elements opened since the matching start tag; an end
+			// tag without one is dropped
+			for i := len(open) - 1; i >= 0; i-- {
+				if open[i] == token.DataAtom {
+					for j := len(open) - 1; j >= i; j-- {
+						b.WriteString("</" + open[j].String() + ">")
+					}
+					open = open[:i]
+					break
+				}
+			}
+		}
+	}
+	for i := len(open) - 1; i >= 0; i-- {
+		b.WriteString("</" + open[i].String() + ">")
+	}
+	return b.String()
+}
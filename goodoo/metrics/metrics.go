@@ -0,0 +1,397 @@
+// Package metrics keeps the history of the server activity. A middleware
+// counts the requests and their latency; every minute a snapshot of these
+// counters, the authenticated sessions and the connection pool is taken
+// and buffered, and the buffer is written in one batch every few minutes.
+// Minute samples are rolled up into hour samples after two days, hour
+// samples into day samples after a month, and day samples are pruned
+// after a year.
+package metrics
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"goodoo/connections"
+	"goodoo/database"
+	goodooHttp "goodoo/http"
+	"goodoo/logging"
+	"goodoo/models"
+	"goodoo/scheduler"
+	"goodoo/workpool"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Config holds the sampling and retention settings
+type Config struct {
+	// Enabled turns sampling on
+	Enabled bool
+	// FlushInterval is how often buffered samples are written
+	FlushInterval time.Duration
+	// MinuteRetention and HourRetention are how long minute and hour samples
+	// are kept before being rolled up
+	MinuteRetention time.Duration
+	HourRetention   time.Duration
+	// DayRetention is how long day samples are kept
+	DayRetention time.Duration
+}
+
+// DefaultConfig returns sampling written every 5 minutes, minutes kept 48
+// hours, hours 30 days and days a year
+func DefaultConfig() *Config {
+	return &Config{
+		Enabled:         true,
+		FlushInterval:   5 * time.Minute,
+		MinuteRetention: 48 * time.Hour,
+		HourRetention:   30 * 24 * time.Hour,
+		DayRetention:    365 * 24 * time.Hour,
+	}
+}
+
+// LoadFromEnv overrides the configuration with GOODOO_METRICS_* variables
+func (c *Config) LoadFromEnv() {
+	if value := os.Getenv("GOODOO_METRICS_ENABLED"); value != "" {
+		if enabled, err := strconv.ParseBool(value); err == nil {
+			c.Enabled = enabled
+		}
+	}
+	durations := map[string]*time.Duration{
+		"GOODOO_METRICS_FLUSH_INTERVAL":   &c.FlushInterval,
+		"GOODOO_METRICS_MINUTE_RETENTION": &c.MinuteRetention,
+		"GOODOO_METRICS_HOUR_RETENTION":   &c.HourRetention,
+		"GOODOO_METRICS_DAY_RETENTION":    &c.DayRetention,
+	}
+	for name, target := range durations {
+		if value := os.Getenv(name); value != "" {
+			if d, err := time.ParseDuration(value); err == nil && d > 0 {
+				*target = d
+			}
+		}
+	}
+}
+
+// maxLatencies bounds the latencies kept per minute to compute percentiles;
+// beyond it they are reservoir sampled
+const maxLatencies = 2048
+
+// counters accumulates the requests of a database since the last snapshot
+type counters struct {
+	requests  int64
+	errors    int64
+	crashes   int64
+	service   int64
+	latencies []float64
+	// lastWaitCount is the pool wait count at the last snapshot
+	lastWaitCount int64
+	// lastLogsDropped is the dropped log record count at the last snapshot
+	lastLogsDropped uint64
+}
+
+var (
+	config = DefaultConfig()
+	// collected maps database names to their counters
+	collected = make(map[string]*counters)
+	// pending maps database names to the samples waiting to be written
+	pending = make(map[string][]models.MetricsSample)
+	mutex   sync.Mutex
+	logger  = logging.GetLogger("goodoo.metrics")
+)
+
+// Setup installs the process-wide metrics configuration
+func Setup(c *Config) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	config = c
+}
+
+// countersOf returns the counters of a database, creating them; mutex must be held
+func countersOf(dbName string) *counters {
+	c := collected[dbName]
+	if c == nil {
+		c = &counters{}
+		collected[dbName] = c
+	}
+	return c
+}
+
+// Observe records a request served for a database
+func Observe(dbName string, duration time.Duration, status int) {
+	latency := float64(duration.Microseconds()) / 1000
+	mutex.Lock()
+	defer mutex.Unlock()
+	c := countersOf(dbName)
+	c.requests++
+	if status >= http.StatusInternalServerError {
+		c.errors++
+	}
+	if len(c.latencies) < maxLatencies {
+		c.latencies = append(c.latencies, latency)
+	} else if i := rand.Int63n(c.requests); i < maxLatencies {
+		c.latencies[i] = latency
+	}
+}
+
+// ObserveService records a request of a service account for a database,
+// besides Observe
+func ObserveService(dbName string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	countersOf(dbName).service++
+}
+
+// ObserveCrash records a panic recovered for a database
+func ObserveCrash(dbName string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	countersOf(dbName).crashes++
+}
+
+// Middleware counts the requests and their latency. Requests made without
+// a database, such as the login page, count for defaultDB.
+func Middleware(defaultDB string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			err := next(c)
+
+			status := c.Response().Status
+			if err != nil {
+				status = http.StatusInternalServerError
+				var httpErr *echo.HTTPError
+				if errors.As(err, &httpErr) {
+					status = httpErr.Code
+				}
+			}
+			dbName := defaultDB
+			if req := goodooHttp.GetGoodooRequest(c); req != nil && req.DB != "" {
+				dbName = req.DB
+			}
+			Observe(dbName, time.Since(start), status)
+			if req := goodooHttp.GetGoodooRequest(c); req != nil && req.ServiceAccount != nil {
+				ObserveService(dbName)
+			}
+			return err
+		}
+	}
+}
+
+// percentile returns the p-th percentile of sorted values
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(p * float64(len(sorted)-1))
+	return sorted[i]
+}
+
+// Snapshot takes the sample of a database for the minute starting at
+// timestamp and resets its counters; sessions describes the stored
+// sessions of the database
+func Snapshot(dbName string, timestamp time.Time, sessions goodooHttp.SessionStats) models.MetricsSample {
+	sample := models.MetricsSample{
+		Resolution:     models.MetricsMinute,
+		Timestamp:      timestamp.Truncate(time.Minute),
+		ActiveSessions: sessions.Authenticated,
+		ActiveUsers:    sessions.ActiveUsers["15m"],
+	}
+
+	var stats *sql.DBStats
+	if db, err := database.GetDatabase(dbName); err == nil {
+		if sqlDB, err := db.DB(); err == nil {
+			s := sqlDB.Stats()
+			stats = &s
+		}
+	}
+
+	mutex.Lock()
+	c := countersOf(dbName)
+	latencies := c.latencies
+	sample.RequestCount, sample.ErrorCount, sample.CrashCount = c.requests, c.errors, c.crashes
+	sample.ServiceRequestCount = c.service
+	c.requests, c.errors, c.crashes, c.service, c.latencies = 0, 0, 0, 0, nil
+	if stats != nil {
+		sample.PoolOpen, sample.PoolInUse, sample.PoolIdle = stats.OpenConnections, stats.InUse, stats.Idle
+		if stats.WaitCount >= c.lastWaitCount {
+			sample.PoolWaitCount = stats.WaitCount - c.lastWaitCount
+		}
+		c.lastWaitCount = stats.WaitCount
+	}
+	// The worker pool is shared by the databases of the process
+	workers := workpool.CurrentStats()
+	sample.WorkersBusy, sample.WorkersQueue = workers.Busy, workers.Queued
+	sample.Connections = connections.Count(dbName)
+	dropped := logging.DroppedRecords(dbName)
+	sample.LogsDropped = int64(dropped - c.lastLogsDropped)
+	c.lastLogsDropped = dropped
+	mutex.Unlock()
+
+	sort.Float64s(latencies)
+	sample.LatencyP50 = percentile(latencies, 0.50)
+	sample.LatencyP95 = percentile(latencies, 0.95)
+	sample.LatencyP99 = percentile(latencies, 0.99)
+	return sample
+}
+
+// Buffer adds a sample to those waiting to be written
+func Buffer(dbName string, sample models.MetricsSample) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	pending[dbName] = append(pending[dbName], sample)
+}
+
+// Pending returns the samples of a database not written yet
+func Pending(dbName string) []models.MetricsSample {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return append([]models.MetricsSample(nil), pending[dbName]...)
+}
+
+// mergeColumns combines a sample with the stored one of the same period,
+// when several processes write samples or a rollup is run again
+var mergeColumns = clause.Set{
+	{Column: clause.Column{Name: "latency_p50"}, Value: gorm.Expr(`CASE WHEN metrics_sample.request_count + EXCLUDED.request_count > 0
+		THEN (metrics_sample.latency_p50 * metrics_sample.request_count + EXCLUDED.latency_p50 * EXCLUDED.request_count)
+			/ (metrics_sample.request_count + EXCLUDED.request_count)
+		ELSE 0 END`)},
+	{Column: clause.Column{Name: "request_count"}, Value: gorm.Expr("metrics_sample.request_count + EXCLUDED.request_count")},
+	{Column: clause.Column{Name: "error_count"}, Value: gorm.Expr("metrics_sample.error_count + EXCLUDED.error_count")},
+	{Column: clause.Column{Name: "latency_p95"}, Value: gorm.Expr("GREATEST(metrics_sample.latency_p95, EXCLUDED.latency_p95)")},
+	{Column: clause.Column{Name: "latency_p99"}, Value: gorm.Expr("GREATEST(metrics_sample.latency_p99, EXCLUDED.latency_p99)")},
+	{Column: clause.Column{Name: "active_sessions"}, Value: gorm.Expr("GREATEST(metrics_sample.active_sessions, EXCLUDED.active_sessions)")},
+	{Column: clause.Column{Name: "active_users"}, Value: gorm.Expr("GREATEST(metrics_sample.active_users, EXCLUDED.active_users)")},
+	{Column: clause.Column{Name: "pool_open"}, Value: gorm.Expr("metrics_sample.pool_open + EXCLUDED.pool_open")},
+	{Column: clause.Column{Name: "pool_in_use"}, Value: gorm.Expr("metrics_sample.pool_in_use + EXCLUDED.pool_in_use")},
+	{Column: clause.Column{Name: "pool_idle"}, Value: gorm.Expr("metrics_sample.pool_idle + EXCLUDED.pool_idle")},
+	{Column: clause.Column{Name: "pool_wait_count"}, Value: gorm.Expr("metrics_sample.pool_wait_count + EXCLUDED.pool_wait_count")},
+	{Column: clause.Column{Name: "logs_dropped"}, Value: gorm.Expr("metrics_sample.logs_dropped + EXCLUDED.logs_dropped")},
+	{Column: clause.Column{Name: "crash_count"}, Value: gorm.Expr("metrics_sample.crash_count + EXCLUDED.crash_count")},
+	{Column: clause.Column{Name: "service_request_count"}, Value: gorm.Expr("metrics_sample.service_request_count + EXCLUDED.service_request_count")},
+	{Column: clause.Column{Name: "workers_busy"}, Value: gorm.Expr("metrics_sample.workers_busy + EXCLUDED.workers_busy")},
+	{Column: clause.Column{Name: "workers_queue"}, Value: gorm.Expr("metrics_sample.workers_queue + EXCLUDED.workers_queue")},
+	{Column: clause.Column{Name: "connections"}, Value: gorm.Expr("metrics_sample.connections + EXCLUDED.connections")},
+}
+
+// onPeriodConflict merges samples of a period already stored
+var onPeriodConflict = clause.OnConflict{
+	Columns:   []clause.Column{{Name: "resolution"}, {Name: "period_start"}},
+	DoUpdates: mergeColumns,
+}
+
+// Flush writes the buffered samples of a database in one statement
+func Flush(db *gorm.DB, dbName string) error {
+	mutex.Lock()
+	samples := pending[dbName]
+	delete(pending, dbName)
+	mutex.Unlock()
+	if len(samples) == 0 {
+		return nil
+	}
+
+	if err := db.Clauses(onPeriodConflict).Create(&samples).Error; err != nil {
+		// Keep them for the next flush
+		mutex.Lock()
+		pending[dbName] = append(samples, pending[dbName]...)
+		mutex.Unlock()
+		return err
+	}
+	return nil
+}
+
+// rollup replaces the samples of a resolution older than before with
+// samples of the coarser resolution
+func rollup(tx *gorm.DB, from, to string, before time.Time) error {
+	err := tx.Exec(`INSERT INTO metrics_sample (resolution, period_start, request_count, error_count,
+	latency_p50, latency_p95, latency_p99, active_sessions, active_users, pool_open, pool_in_use, pool_idle, pool_wait_count, logs_dropped,
+	crash_count, workers_busy, workers_queue, service_request_count, connections)
+SELECT ?, date_trunc(?, period_start), SUM(request_count), SUM(error_count),
+	CASE WHEN SUM(request_count) > 0 THEN SUM(latency_p50 * request_count) / SUM(request_count) ELSE 0 END,
+	MAX(latency_p95), MAX(latency_p99), ROUND(AVG(active_sessions)), ROUND(AVG(active_users)),
+	ROUND(AVG(pool_open)), ROUND(AVG(pool_in_use)), ROUND(AVG(pool_idle)), SUM(pool_wait_count), SUM(logs_dropped),
+	SUM(crash_count), ROUND(AVG(workers_busy)), ROUND(AVG(workers_queue)), SUM(service_request_count), ROUND(AVG(connections))
+FROM metrics_sample WHERE resolution = ? AND period_start < ?
+GROUP BY 2
+ON CONFLICT (resolution, period_start) DO UPDATE SET `+conflictAssignments(), to, to, from, before).Error
+	if err != nil {
+		return err
+	}
+	return tx.Where("resolution = ? AND period_start < ?", from, before).Delete(&models.MetricsSample{}).Error
+}
+
+// conflictAssignments renders mergeColumns for a raw statement
+func conflictAssignments() string {
+	var sql string
+	for i, assignment := range mergeColumns {
+		if i > 0 {
+			sql += ", "
+		}
+		sql += assignment.Column.Name + " = " + assignment.Value.(clause.Expr).SQL
+	}
+	return sql
+}
+
+// Downsample rolls up aged minute and hour samples and prunes day samples
+// past retention
+func Downsample(db *gorm.DB, now time.Time) error {
+	mutex.Lock()
+	c := *config
+	mutex.Unlock()
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		// Whole hours and days only, so a period is rolled up once
+		if err := rollup(tx, models.MetricsMinute, models.MetricsHour, now.Add(-c.MinuteRetention).Truncate(time.Hour)); err != nil {
+			return err
+		}
+		dayCutoff := now.Add(-c.HourRetention)
+		dayCutoff = time.Date(dayCutoff.Year(), dayCutoff.Month(), dayCutoff.Day(), 0, 0, 0, 0, dayCutoff.Location())
+		if err := rollup(tx, models.MetricsHour, models.MetricsDay, dayCutoff); err != nil {
+			return err
+		}
+		return tx.Where("resolution = ? AND period_start < ?", models.MetricsDay, now.Add(-c.DayRetention)).
+			Delete(&models.MetricsSample{}).Error
+	})
+}
+
+// Schedule registers the jobs sampling a database every minute, writing
+// the samples and downsampling them hourly; sessions describes the stored
+// sessions of the database
+func Schedule(s *scheduler.Scheduler, dbName string, sessions func() goodooHttp.SessionStats) {
+	mutex.Lock()
+	c := *config
+	mutex.Unlock()
+	if !c.Enabled {
+		return
+	}
+
+	s.Every("metrics.sample."+dbName, time.Minute, func(ctx context.Context) error {
+		// The sample covers the minute that just ended
+		Buffer(dbName, Snapshot(dbName, time.Now().Add(-time.Minute), sessions()))
+		return nil
+	})
+	s.Every("metrics.flush."+dbName, c.FlushInterval, func(ctx context.Context) error {
+		db, err := database.GetDatabase(dbName)
+		if err != nil {
+			return err
+		}
+		if err := Flush(db.WithContext(ctx), dbName); err != nil {
+			logger.Warning("Failed to write the metrics of %s: %v", dbName, err)
+			return err
+		}
+		return nil
+	})
+	s.Every("metrics.downsample."+dbName, time.Hour, func(ctx context.Context) error {
+		db, err := database.GetDatabase(dbName)
+		if err != nil {
+			return err
+		}
+		return Downsample(db.WithContext(ctx), time.Now())
+	})
+}
@@ -0,0 +1,199 @@
+package metrics
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"goodoo/models"
+	"gorm.io/gorm"
+)
+
+// MaxPoints bounds the periods of a series
+const MaxPoints = 2000
+
+// Truncate returns the start of the period of a resolution containing t;
+// days start at midnight in t's location
+func Truncate(t time.Time, resolution string) time.Time {
+	switch resolution {
+	case models.MetricsMinute:
+		return t.Truncate(time.Minute)
+	case models.MetricsHour:
+		return t.Truncate(time.Hour)
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// next returns the start of the period following start
+func next(start time.Time, resolution string) time.Time {
+	switch resolution {
+	case models.MetricsMinute:
+		return start.Add(time.Minute)
+	case models.MetricsHour:
+		return start.Add(time.Hour)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+// ValidResolution reports whether resolution names a sample resolution
+func ValidResolution(resolution string) bool {
+	return resolution == models.MetricsMinute || resolution == models.MetricsHour || resolution == models.MetricsDay
+}
+
+// period accumulates the samples of a period of a series
+type period struct {
+	sample  models.MetricsSample
+	gauges  int
+	latency float64
+}
+
+// add merges a sample into the period: counts add up, the median is
+// weighted by requests, the tail percentiles keep their maximum and the
+// gauges are averaged
+func (p *period) add(s models.MetricsSample) {
+	p.sample.RequestCount += s.RequestCount
+	p.sample.ErrorCount += s.ErrorCount
+	p.sample.PoolWaitCount += s.PoolWaitCount
+	p.sample.LogsDropped += s.LogsDropped
+	p.sample.CrashCount += s.CrashCount
+	p.sample.ServiceRequestCount += s.ServiceRequestCount
+	p.latency += s.LatencyP50 * float64(s.RequestCount)
+	if s.LatencyP95 > p.sample.LatencyP95 {
+		p.sample.LatencyP95 = s.LatencyP95
+	}
+	if s.LatencyP99 > p.sample.LatencyP99 {
+		p.sample.LatencyP99 = s.LatencyP99
+	}
+	p.gauges++
+	avg := func(current, value int) int {
+		return current + (value-current)/p.gauges
+	}
+	p.sample.ActiveSessions = avg(p.sample.ActiveSessions, s.ActiveSessions)
+	p.sample.ActiveUsers = avg(p.sample.ActiveUsers, s.ActiveUsers)
+	p.sample.PoolOpen = avg(p.sample.PoolOpen, s.PoolOpen)
+	p.sample.PoolInUse = avg(p.sample.PoolInUse, s.PoolInUse)
+	p.sample.PoolIdle = avg(p.sample.PoolIdle, s.PoolIdle)
+	p.sample.WorkersBusy = avg(p.sample.WorkersBusy, s.WorkersBusy)
+	p.sample.WorkersQueue = avg(p.sample.WorkersQueue, s.WorkersQueue)
+	p.sample.Connections = avg(p.sample.Connections, s.Connections)
+	if p.sample.RequestCount > 0 {
+		p.sample.LatencyP50 = p.latency / float64(p.sample.RequestCount)
+	}
+}
+
+// Series returns one sample per period of resolution in [from, to),
+// combining the stored samples, whatever their resolution, with those of
+// dbName not written yet. Periods without samples are zero.
+func Series(db *gorm.DB, dbName string, from, to time.Time, resolution string) ([]models.MetricsSample, error) {
+	if !ValidResolution(resolution) {
+		return nil, fmt.Errorf("invalid resolution %q", resolution)
+	}
+	from = Truncate(from, resolution)
+	if !from.Before(to) {
+		return nil, fmt.Errorf("empty range")
+	}
+
+	var periods []*period
+	index := make(map[int64]*period)
+	for start := from; start.Before(to); start = next(start, resolution) {
+		if len(periods) == MaxPoints {
+			return nil, fmt.Errorf("range has more than %d periods of a %s", MaxPoints, resolution)
+		}
+		p := &period{sample: models.MetricsSample{Resolution: resolution, Timestamp: start}}
+		periods = append(periods, p)
+		index[start.Unix()] = p
+	}
+
+	var stored []models.MetricsSample
+	if err := db.Where("period_start >= ? AND period_start < ?", from, to).Order("period_start").Find(&stored).Error; err != nil {
+		return nil, err
+	}
+	for _, s := range append(stored, Pending(dbName)...) {
+		if s.Timestamp.Before(from) || !s.Timestamp.Before(to) {
+			continue
+		}
+		if p := index[Truncate(s.Timestamp.In(from.Location()), resolution).Unix()]; p != nil {
+			p.add(s)
+		}
+	}
+
+	series := make([]models.MetricsSample, len(periods))
+	for i, p := range periods {
+		series[i] = p.sample
+	}
+	return series, nil
+}
+
+// csvHeader names the columns of an export
+var csvHeader = []string{
+	"resolution", "timestamp", "request_count", "error_count",
+	"latency_p50", "latency_p95", "latency_p99", "active_sessions", "active_users",
+	"pool_open", "pool_in_use", "pool_idle", "pool_wait_count",
+	"logs_dropped", "crash_count", "workers_busy", "workers_queue",
+	"service_request_count", "connections",
+}
+
+// csvRecord formats a sample as a row of an export
+func csvRecord(s models.MetricsSample) []string {
+	formatFloat := func(f float64) string { return strconv.FormatFloat(f, 'f', 3, 64) }
+	return []string{
+		s.Resolution, s.Timestamp.UTC().Format(time.RFC3339),
+		strconv.FormatInt(s.RequestCount, 10), strconv.FormatInt(s.ErrorCount, 10),
+		formatFloat(s.LatencyP50), formatFloat(s.LatencyP95), formatFloat(s.LatencyP99),
+		strconv.Itoa(s.ActiveSessions), strconv.Itoa(s.ActiveUsers),
+		strconv.Itoa(s.PoolOpen), strconv.Itoa(s.PoolInUse), strconv.Itoa(s.PoolIdle),
+		strconv.FormatInt(s.PoolWaitCount, 10),
+		strconv.FormatInt(s.LogsDropped, 10), strconv.FormatInt(s.CrashCount, 10),
+		strconv.Itoa(s.WorkersBusy), strconv.Itoa(s.WorkersQueue),
+		strconv.FormatInt(s.ServiceRequestCount, 10), strconv.Itoa(s.Connections),
+	}
+}
+
+// WriteCSV streams the raw samples in [from, to) as CSV, the stored ones
+// row by row then those of dbName not written yet. An empty resolution
+// exports every resolution.
+func WriteCSV(w io.Writer, db *gorm.DB, dbName string, from, to time.Time, resolution string) error {
+	out := csv.NewWriter(w)
+	if err := out.Write(csvHeader); err != nil {
+		return err
+	}
+
+	query := db.Model(&models.MetricsSample{}).Where("period_start >= ? AND period_start < ?", from, to)
+	if resolution != "" {
+		query = query.Where("resolution = ?", resolution)
+	}
+	rows, err := query.Order("period_start, resolution").Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var sample models.MetricsSample
+		if err := db.ScanRows(rows, &sample); err != nil {
+			return err
+		}
+		if err := out.Write(csvRecord(sample)); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, sample := range Pending(dbName) {
+		if sample.Timestamp.Before(from) || !sample.Timestamp.Before(to) {
+			continue
+		}
+		if resolution != "" && sample.Resolution != resolution {
+			continue
+		}
+		if err := out.Write(csvRecord(sample)); err != nil {
+			return err
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
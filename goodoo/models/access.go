@@ -0,0 +1,141 @@
+package models
+
+import (
+	"fmt"
+	"sync"
+
+	"goodoo/fields"
+)
+
+// AccessError is returned when the user may not access a field
+type AccessError struct {
+	Model     string
+	Field     string
+	Operation string
+}
+
+func (e *AccessError) Error() string {
+	return fmt.Sprintf("access denied: you are not allowed to %s field '%s' of %s", e.Operation, e.Field, e.Model)
+}
+
+// accessRights is the lazily loaded admin and public flags and groups of
+// a user
+type accessRights struct {
+	once   sync.Once
+	admin  bool
+	public bool
+	groups map[string]bool
+}
+
+// rights loads the access rights of the environment user on first use.
+// User 0 is the system and bypasses field groups like the administrator.
+func (env *Environment) rights() *accessRights {
+	access := env.access
+	if access == nil {
+		access = &accessRights{}
+		env.access = access
+	}
+	access.once.Do(func() {
+		access.groups = make(map[string]bool)
+		if env.user == 0 {
+			access.admin = true
+			return
+		}
+		var user User
+		if err := env.db.First(&user, env.user).Error; err == nil {
+			access.admin = user.IsAdmin()
+			access.public = user.IsPublic()
+		}
+		if access.admin {
+			return
+		}
+		xmlids, err := UserGroupXMLIDs(env.db, env.user)
+		if err != nil {
+			return
+		}
+		for _, xmlid := range xmlids {
+			access.groups[xmlid] = true
+		}
+	})
+	return access
+}
+
+// Sudo returns a copy of the environment running as the system user, which
+// bypasses access groups
+func (env *Environment) Sudo() *Environment {
+	copied := *env
+	copied.user = 0
+	copied.access = &accessRights{}
+	return &copied
+}
+
+// IsAdmin reports whether the environment user bypasses access groups
+func (env *Environment) IsAdmin() bool {
+	return env.rights().admin
+}
+
+// HasGroup reports whether the environment user belongs to a group, given
+// by external id; the administrator belongs to every group
+func (env *Environment) HasGroup(xmlid string) bool {
+	rights := env.rights()
+	return rights.admin || rights.groups[xmlid]
+}
+
+// fieldAccess tells whether the user may read and write a field. A field
+// with Groups is reserved to members of any of them; outside them it is
+// hidden, or readonly when GroupsReadonly is set. The public user only
+// accesses the fields reserved to groups it belongs to.
+func (env *Environment) fieldAccess(field fields.Field) (readable, writable bool) {
+	if env == nil {
+		return true, true
+	}
+	attrs := field.GetAttributes()
+	if len(attrs.Groups) == 0 {
+		if env.IsPublic() {
+			return false, false
+		}
+		return true, true
+	}
+	for _, group := range attrs.Groups {
+		if env.HasGroup(group) {
+			return true, true
+		}
+	}
+	return attrs.GroupsReadonly, false
+}
+
+// readableField tells whether the user may read a field of the model
+func (m *ModelDefinition) readableField(env *Environment, name string) bool {
+	field, exists := m.Fields[name]
+	if !exists || m.unavailableField(env, name) {
+		return false
+	}
+	readable, _ := env.fieldAccess(field)
+	return readable
+}
+
+// readableFields drops the fields the user may not read
+func (m *ModelDefinition) readableFields(env *Environment, names []string) []string {
+	readable := make([]string, 0, len(names))
+	for _, name := range names {
+		if m.readableField(env, name) {
+			readable = append(readable, name)
+		}
+	}
+	return readable
+}
+
+// checkWriteAccess fails with an AccessError on the first field of vals the
+// user may not write
+func (m *ModelDefinition) checkWriteAccess(env *Environment, vals map[string]interface{}) error {
+	for _, name := range fieldNames(vals) {
+		field, exists := m.Fields[name]
+		if !exists {
+			continue
+		}
+		if _, writable := env.fieldAccess(field); !writable {
+			return &AccessError{Model: m.Name, Field: name, Operation: "write"}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,336 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"goodoo/logging"
+	"gorm.io/gorm"
+)
+
+// Activity types, the taxonomy of the activity feed. A type is
+// "<category>.<event>"; the feed filters on either.
+const (
+	ActivityUserLogin             = "user.login"
+	ActivityUserCreated           = "user.created"
+	ActivityUserInvited           = "user.invited"
+	ActivityUserImported          = "user.imported"
+	ActivityUserImportDeactivated = "user.import_deactivated"
+	ActivityInvitationRevoked     = "user.invitation_revoked"
+	ActivityInvitationAccepted    = "user.invitation_accepted"
+	ActivityImpersonationStart    = "user.impersonation_started"
+	ActivityProfileUpdated        = "user.profile_updated"
+	ActivityEmailChangeRequested  = "user.email_change_requested"
+	ActivityEmailChangeCancelled  = "user.email_change_cancelled"
+	ActivityEmailChanged          = "user.email_changed"
+	ActivityDataExported          = "user.data_exported"
+	ActivityDataDownloaded        = "user.data_downloaded"
+	ActivityImpersonationStop     = "user.impersonation_stopped"
+	ActivityRecordCreated         = "record.created"
+	ActivityRecordUpdated         = "record.updated"
+	ActivityRecordDeleted         = "record.deleted"
+	ActivityRecordArchived        = "record.archived"
+	ActivityRecordRestored        = "record.restored"
+	ActivityRecordStateChanged    = "record.state_changed"
+	ActivityRecordsMerged         = "record.merged"
+	ActivityBulkCompleted         = "bulk.completed"
+	ActivityMaintenanceFinished   = "database.maintenance"
+	ActivityIndexCreated          = "database.index_created"
+	ActivityMaintenanceEnabled    = "maintenance.enabled"
+	ActivityMaintenanceDisabled   = "maintenance.disabled"
+	ActivitySessionCleanup        = "session.cleanup"
+	ActivityLLMTest               = "llm.test"
+	ActivityImportCompleted       = "import.completed"
+	ActivityStorageQuota          = "storage.quota"
+	ActivityShareCreated          = "share.created"
+	ActivityShareAccessed         = "share.accessed"
+	ActivityShareRevoked          = "share.revoked"
+	ActivityTLSExpiring           = "tls.expiring"
+	ActivityCrash                 = "server.crash"
+	ActivityPermissionsChanged    = "group.permissions_changed"
+	ActivityAttachmentQuarantined = "attachment.quarantined"
+	ActivityAttachmentReleased    = "attachment.released"
+	ActivityAttachmentPurged      = "attachment.purged"
+	ActivityTagsMerged            = "tag.merged"
+	// ActivityOther is the catch-all of unclassified events, and of the
+	// audit records written before the taxonomy; its message is the
+	// "message" param, untranslated
+	ActivityOther = "other"
+)
+
+// Activity severities
+const (
+	SeverityInfo    = "info"
+	SeveritySuccess = "success"
+	SeverityWarning = "warning"
+	SeverityError   = "error"
+)
+
+// ActivityTranslationModel is the ir_translation model of the message
+// templates: the field is the template key (the type, or "<type>:<severity>")
+// and res_id is 0
+const ActivityTranslationModel = "activity.type"
+
+// activityTemplates are the English message templates, by type or by
+// "<type>:<severity>" for the messages of one severity. {name} is
+// replaced by the param name, and {model} by the model of the event.
+var activityTemplates = map[string]string{
+	ActivityUserLogin:                    "{login} signed in",
+	ActivityUserCreated:                  "User {login} created",
+	ActivityUserInvited:                  "{inviter} invited {login} ({email})",
+	ActivityUserImported:                 "{created} user(s) imported from {file_name}",
+	ActivityUserImported + ":warning":    "{created} of {total} user(s) imported from {file_name}, {failed} failed",
+	ActivityUserImportDeactivated:        "{count} user(s) imported from {file_name} deactivated",
+	ActivityInvitationRevoked:            "{revoker} revoked the invitation of {login}",
+	ActivityInvitationAccepted:           "{login} accepted the invitation of {inviter}",
+	ActivityImpersonationStart:           "{impersonator} started acting as {login}",
+	ActivityImpersonationStop:            "{impersonator} stopped acting as {login}",
+	ActivityProfileUpdated:               "{login} updated their profile: {fields}",
+	ActivityEmailChangeRequested:         "{login} asked to change their email to {new_email}",
+	ActivityEmailChangeCancelled:         "{login} cancelled the change of their email",
+	ActivityEmailChanged:                 "{login} changed their email from {old_email} to {new_email}",
+	ActivityDataExported:                 "{login} exported their personal data",
+	ActivityDataExported + ":error":      "Export of the personal data of {login} failed: {error}",
+	ActivityDataDownloaded:               "{login} downloaded their personal data",
+	ActivityRecordCreated:                "{name} ({model}) created",
+	ActivityRecordUpdated:                "{name} ({model}) updated",
+	ActivityRecordDeleted:                "{name} ({model}) deleted",
+	ActivityRecordArchived:               "{name} ({model}) archived",
+	ActivityRecordRestored:               "{name} ({model}) restored",
+	ActivityRecordStateChanged:           "{name} ({model}): {from} → {to}",
+	ActivityRecordsMerged:                "{count} {model} record(s) merged into {name}",
+	ActivityBulkCompleted:                "Bulk {operation} of {model} {state}: {processed} of {total} record(s) processed, {failed} failed",
+	ActivityMaintenanceFinished:          "Database {action} {state}: {processed} table(s) processed, {failed} failed",
+	ActivityIndexCreated:                 "Index {index} created on {table}",
+	ActivityIndexCreated + ":error":      "Index {index} could not be created on {table}: {error}",
+	ActivityMaintenanceEnabled:           "{login} enabled maintenance mode",
+	ActivityMaintenanceDisabled:          "{login} disabled maintenance mode",
+	ActivitySessionCleanup:               "Session cleanup removed {count} expired session(s)",
+	ActivitySessionCleanup + ":error":    "Session cleanup failed: {error}",
+	ActivityLLMTest:                      "LLM provider {provider} answered in {response_ms} ms",
+	ActivityLLMTest + ":error":           "LLM provider {provider} test failed: {error}",
+	ActivityImportCompleted:              "{count} {model} record(s) imported",
+	ActivityImportCompleted + ":warning": "{count} {model} record(s) imported, {failed} failed",
+	ActivityStorageQuota:                 "Storage area {area} uses {percent}% of its quota",
+	ActivityShareCreated:                 "Share link {link_id} of a {model} record created",
+	ActivityShareAccessed:                "Share link {link_id} of a {model} record opened from {ip}",
+	ActivityShareRevoked:                 "Share link {link_id} of a {model} record revoked",
+	ActivityTLSExpiring:                  "TLS certificate of {subject} expires in {days} day(s)",
+	ActivityTLSExpiring + ":error":       "TLS certificate of {subject} expired on {not_after}",
+	ActivityCrash:                        "New crash {fingerprint} in {route}: {message}",
+	ActivityPermissionsChanged:           "Permissions of group {group} set to {permissions}",
+	ActivityAttachmentQuarantined:        "File {name} uploaded by {uploader} quarantined: {signature}",
+	ActivityAttachmentReleased:           "{login} released file {name} ({state})",
+	ActivityAttachmentPurged:             "{login} purged file {name} ({state})",
+	ActivityTagsMerged:                   "{count} tag(s) merged into {name}: {merged}",
+	ActivityOther:                        "{message}",
+}
+
+// Activity is an event of the activity feed
+type Activity struct {
+	Type     string
+	Severity string
+	// Model and ResID name the record involved, if any
+	Model  string
+	ResID  uint
+	Params map[string]interface{}
+}
+
+// LogActivity records an event in the audit log, normally inside the
+// transaction performing it. The English message is stored along for
+// readers of the raw table; the feed renders it again at read time.
+func LogActivity(db *gorm.DB, uid uint, activity Activity) error {
+	if activity.Severity == "" {
+		activity.Severity = SeverityInfo
+	}
+	var params *string
+	if len(activity.Params) > 0 {
+		// Parameters copied from requests must not store secrets
+		activity.Params = logging.RedactMap(activity.Params)
+		data, err := json.Marshal(activity.Params)
+		if err != nil {
+			return err
+		}
+		encoded := string(data)
+		params = &encoded
+	}
+	template := activityTemplate(activity.Type, activity.Severity, nil)
+	return db.Create(&AuditLog{
+		Model:          activity.Model,
+		ResID:          activity.ResID,
+		Action:         activity.Type,
+		Description:    renderActivity(template, activity.Model, activity.Params),
+		UserID:         uid,
+		EventType:      activity.Type,
+		Severity:       activity.Severity,
+		Params:         params,
+		ImpersonatorID: impersonatorID(db),
+		ServiceKeyID:   serviceKeyID(db),
+	}).Error
+}
+
+// ActivityEntry is an event read from the activity feed
+type ActivityEntry struct {
+	ID        uint      `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	Type      string    `json:"type"`
+	Severity  string    `json:"severity"`
+	Model     string    `json:"model,omitempty"`
+	ResID     uint      `json:"res_id,omitempty"`
+	UserID    uint      `json:"user_id"`
+	// ImpersonatorID is the administrator who acted as UserID, if any
+	ImpersonatorID uint `json:"impersonator_id,omitempty"`
+	// ServiceKeyID is the service key the event was signed with, if any
+	ServiceKeyID string                 `json:"service_key_id,omitempty"`
+	Params       map[string]interface{} `json:"params"`
+	// Message is rendered in the reader's language by RenderActivities
+	Message string `json:"message"`
+}
+
+// ActivityFilter selects the events of the feed
+type ActivityFilter struct {
+	// Types are types or categories ("user" matches "user.login")
+	Types      []string
+	Severities []string
+	// UserID restricts the feed to the events of a user when not 0
+	UserID uint
+	Limit  int
+}
+
+// ListActivities returns the most recent events matching filter, newest
+// first
+func ListActivities(db *gorm.DB, filter ActivityFilter) ([]ActivityEntry, error) {
+	query := db.Model(&AuditLog{})
+	if len(filter.Types) > 0 {
+		var conditions []string
+		var args []interface{}
+		for _, eventType := range filter.Types {
+			switch {
+			case eventType == ActivityOther:
+				conditions = append(conditions, "event_type IN ('', ?)")
+				args = append(args, ActivityOther)
+			case strings.Contains(eventType, "."):
+				conditions = append(conditions, "event_type = ?")
+				args = append(args, eventType)
+			default:
+				conditions = append(conditions, "event_type LIKE ?")
+				args = append(args, eventType+".%")
+			}
+		}
+		query = query.Where(strings.Join(conditions, " OR "), args...)
+	}
+	if len(filter.Severities) > 0 {
+		query = query.Where("COALESCE(NULLIF(severity, ''), ?) IN ?", SeverityInfo, filter.Severities)
+	}
+	if filter.UserID != 0 {
+		query = query.Where("user_id = ?", filter.UserID)
+	}
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit)
+	}
+
+	var rows []AuditLog
+	if err := query.Order("create_date DESC, id DESC").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	entries := make([]ActivityEntry, len(rows))
+	for i, row := range rows {
+		entries[i] = row.activityEntry()
+	}
+	return entries, nil
+}
+
+// activityEntry converts an audit record; the records written before the
+// taxonomy are ActivityOther events of their description
+func (a *AuditLog) activityEntry() ActivityEntry {
+	entry := ActivityEntry{
+		ID:             a.ID,
+		Timestamp:      a.CreateDate,
+		Type:           a.EventType,
+		Severity:       a.Severity,
+		Model:          a.Model,
+		ResID:          a.ResID,
+		UserID:         a.UserID,
+		ImpersonatorID: a.ImpersonatorID,
+		ServiceKeyID:   a.ServiceKeyID,
+		Params:         make(map[string]interface{}),
+	}
+	if a.Params != nil {
+		_ = json.Unmarshal([]byte(*a.Params), &entry.Params)
+	}
+	if entry.Type == "" {
+		entry.Type = ActivityOther
+		entry.Params["message"] = a.Description
+		entry.Params["action"] = a.Action
+	}
+	if entry.Severity == "" {
+		entry.Severity = SeverityInfo
+	}
+	return entry
+}
+
+// RenderActivities sets the message of entries in lang, from the
+// translations of the templates in ir_translation, else in English
+func RenderActivities(db *gorm.DB, entries []ActivityEntry, lang string) error {
+	var translated map[string]string
+	if lang != DefaultLang && len(entries) > 0 {
+		keys := make([]string, 0, len(activityTemplates))
+		for key := range activityTemplates {
+			keys = append(keys, key)
+		}
+		translations, err := GetTranslations(db, ActivityTranslationModel, []uint{0}, keys, lang)
+		if err != nil {
+			return err
+		}
+		translated = translations[0]
+	}
+	for i := range entries {
+		template := activityTemplate(entries[i].Type, entries[i].Severity, translated)
+		entries[i].Message = renderActivity(template, entries[i].Model, entries[i].Params)
+	}
+	return nil
+}
+
+// activityTemplate returns the template of a type and severity, preferring
+// translated ones; unknown types render as ActivityOther
+func activityTemplate(eventType, severity string, translated map[string]string) string {
+	for _, key := range []string{eventType + ":" + severity, eventType} {
+		if template, ok := translated[key]; ok && template != "" {
+			return template
+		}
+		if template, ok := activityTemplates[key]; ok {
+			return template
+		}
+	}
+	if template, ok := translated[ActivityOther]; ok && template != "" {
+		return template
+	}
+	return activityTemplates[ActivityOther]
+}
+
+// activityPlaceholder matches the {name} placeholders of a template
+var activityPlaceholder = regexp.MustCompile(`\{(\w+)\}`)
+
+// renderActivity replaces the placeholders of template by the params;
+// whole numbers decoded from JSON print without decimals
+func renderActivity(template, model string, params map[string]interface{}) string {
+	return activityPlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		name := placeholder[1 : len(placeholder)-1]
+		value, ok := params[name]
+		if !ok && name == "model" {
+			return model
+		}
+		switch v := value.(type) {
+		case nil:
+			return ""
+		case float64:
+			if v == float64(int64(v)) {
+				return fmt.Sprintf("%d", int64(v))
+			}
+		}
+		return fmt.Sprintf("%v", value)
+	})
+}
@@ -0,0 +1,202 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"goodoo/fields"
+)
+
+// Aggregates computed over a domain, for the totals of list views (like a
+// one-level read_group of Odoo)
+
+// maxAggregateGroups bounds the groups of a breakdown; the remaining groups
+// are dropped with a warning
+const maxAggregateGroups = 200
+
+// AggregateSpec asks for a function of a field: sum, avg, min, max, count or
+// count_distinct
+type AggregateSpec struct {
+	Field    string `json:"field"`
+	Function string `json:"function"`
+}
+
+// Key names the value of the spec in the results, e.g. amount_total:sum
+func (s AggregateSpec) Key() string {
+	return s.Field + ":" + s.Function
+}
+
+// aggregateFunctions are the functions specs may ask for
+var aggregateFunctions = map[string]bool{
+	"sum": true, "avg": true, "min": true, "max": true, "count": true, "count_distinct": true,
+}
+
+// ParseAggregates parses an aggregates parameter: either a list like
+// "amount_total:sum,id:count", or a JSON object like
+// {"aggregates": ["amount_total:sum"], "group_by": "state"}. A field alone
+// is summed. A JSON object that does not parse is returned as a warning.
+func ParseAggregates(raw string) (specs []AggregateSpec, groupBy string, warnings []string) {
+	raw = strings.TrimSpace(raw)
+	entries := strings.Split(raw, ",")
+	if strings.HasPrefix(raw, "{") {
+		var spec struct {
+			Aggregates []string `json:"aggregates"`
+			GroupBy    string   `json:"group_by"`
+		}
+		if err := json.Unmarshal([]byte(raw), &spec); err != nil {
+			return nil, "", []string{"invalid aggregates: " + err.Error()}
+		}
+		entries, groupBy = spec.Aggregates, strings.TrimSpace(spec.GroupBy)
+	}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		field, function, found := strings.Cut(entry, ":")
+		if !found {
+			function = "sum"
+		}
+		specs = append(specs, AggregateSpec{Field: strings.TrimSpace(field), Function: strings.TrimSpace(function)})
+	}
+	return specs, groupBy, warnings
+}
+
+// AggregateGroup is one group of a breakdown: the value of the group_by
+// field, its number of records and its aggregates by spec key
+type AggregateGroup struct {
+	Value  interface{}            `json:"value"`
+	Count  int64                  `json:"count"`
+	Values map[string]interface{} `json:"values"`
+}
+
+// AggregateResult holds the aggregates of a domain by spec key, the groups
+// of the breakdown when one was asked for, and a warning for each spec that
+// was skipped
+type AggregateResult struct {
+	Values   map[string]interface{} `json:"values"`
+	GroupBy  string                 `json:"group_by,omitempty"`
+	Groups   []AggregateGroup       `json:"groups,omitempty"`
+	Warnings []string               `json:"warnings,omitempty"`
+}
+
+// aggregateExpression returns the SQL computing a spec, or why it cannot
+// be computed: the field must be stored, readable by the user and of a
+// type the function applies to
+func (m *ModelDefinition) aggregateExpression(env *Environment, spec AggregateSpec) (string, error) {
+	if !aggregateFunctions[spec.Function] {
+		return "", fmt.Errorf("unknown aggregate function '%s'", spec.Function)
+	}
+	field, exists := m.Fields[spec.Field]
+	if !isIdentifier(spec.Field) || !exists || !field.IsStored() || !m.readableField(env, spec.Field) {
+		return "", fmt.Errorf("unknown or not readable field '%s'", spec.Field)
+	}
+	column := QuoteIdentifier(spec.Field)
+	fieldType := field.GetType()
+	switch spec.Function {
+	case "count":
+		if spec.Field == "id" {
+			return "COUNT(*)", nil
+		}
+		return "COUNT(" + column + ")", nil
+	case "count_distinct":
+		if fieldType == fields.BinaryType || fieldType == fields.JsonType {
+			break
+		}
+		return "COUNT(DISTINCT " + column + ")", nil
+	case "sum", "avg":
+		switch fieldType {
+		case fields.IntegerType:
+			if spec.Function == "sum" {
+				return "SUM(" + column + ")::bigint", nil
+			}
+			return "AVG(" + column + ")::float8", nil
+		case fields.FloatType, fields.MonetaryType:
+			return strings.ToUpper(spec.Function) + "(" + column + ")::float8", nil
+		}
+	case "min", "max":
+		if fieldType == fields.BooleanType || !m.sortable(env, spec.Field) {
+			break
+		}
+		return strings.ToUpper(spec.Function) + "(" + column + ")", nil
+	}
+	return "", fmt.Errorf("cannot compute %s of field '%s' of type %s", spec.Function, spec.Field, fieldType)
+}
+
+// Aggregate computes the specs over all the records matching the domain,
+// regardless of any page, and, with groupBy, over each value of that
+// field. Specs that cannot be computed are skipped with a warning, like an
+// invalid groupBy; only a domain the user may not search fails.
+func (m *ModelDefinition) Aggregate(env *Environment, domain Domain, specs []AggregateSpec, groupBy string) (*AggregateResult, error) {
+	result := &AggregateResult{Values: map[string]interface{}{}}
+
+	var selects, keys []string
+	seen := make(map[string]bool, len(specs))
+	for _, spec := range specs {
+		key := spec.Key()
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		expression, err := m.aggregateExpression(env, spec)
+		if err != nil {
+			result.Warnings = append(result.Warnings, key+": "+err.Error())
+			continue
+		}
+		selects = append(selects, fmt.Sprintf("%s AS a%d", expression, len(keys)))
+		keys = append(keys, key)
+	}
+
+	if groupBy != "" {
+		field, exists := m.Fields[groupBy]
+		if !isIdentifier(groupBy) || !exists || !m.sortable(env, groupBy) || field.GetType() == fields.Many2manyType {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("group_by: cannot group by field '%s'", groupBy))
+			groupBy = ""
+		}
+	}
+
+	if len(selects) > 0 {
+		query, err := m.domainQuery(env, domain)
+		if err != nil {
+			return nil, err
+		}
+		var row map[string]interface{}
+		if err := query.Select(strings.Join(selects, ", ")).Take(&row).Error; err != nil {
+			return nil, err
+		}
+		for i, key := range keys {
+			result.Values[key] = row[fmt.Sprintf("a%d", i)]
+		}
+	}
+	if groupBy == "" {
+		return result, nil
+	}
+
+	query, err := m.domainQuery(env, domain)
+	if err != nil {
+		return nil, err
+	}
+	column := QuoteIdentifier(groupBy)
+	groupSelects := append([]string{column + " AS group_value", "COUNT(*) AS group_count"}, selects...)
+	var rows []map[string]interface{}
+	err = query.Select(strings.Join(groupSelects, ", ")).Group(column).
+		Order(column + " NULLS FIRST").Limit(maxAggregateGroups + 1).Find(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) > maxAggregateGroups {
+		rows = rows[:maxAggregateGroups]
+		result.Warnings = append(result.Warnings, fmt.Sprintf("group_by: only the first %d groups are returned", maxAggregateGroups))
+	}
+	result.GroupBy = groupBy
+	result.Groups = make([]AggregateGroup, 0, len(rows))
+	for _, row := range rows {
+		group := AggregateGroup{Value: row["group_value"], Count: int64(toUint(row["group_count"])), Values: map[string]interface{}{}}
+		for i, key := range keys {
+			group.Values[key] = row[fmt.Sprintf("a%d", i)]
+		}
+		result.Groups = append(result.Groups, group)
+	}
+	return result, nil
+}
@@ -0,0 +1,109 @@
+package models
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Scan states of an attachment: uploads are pending until the scanner
+// (see package scan) finds them clean or quarantines them, or gives up
+// after its retries
+const (
+	AttachmentScanPending     = "pending"
+	AttachmentScanClean       = "clean"
+	AttachmentScanQuarantined = "quarantined"
+	AttachmentScanFailed      = "scan_failed"
+)
+
+// IrAttachment stores the binary content of a record field (like Odoo's
+// ir.attachment with res_field set), so large blobs stay out of the record table
+type IrAttachment struct {
+	BaseModel
+	Name     string `gorm:"not null" json:"name"`
+	ResModel string `gorm:"column:res_model;index:idx_ir_attachment_res" json:"res_model"`
+	ResField string `gorm:"column:res_field;index:idx_ir_attachment_res" json:"res_field"`
+	ResID    uint   `gorm:"column:res_id;index:idx_ir_attachment_res" json:"res_id"`
+	Mimetype string `gorm:"" json:"mimetype"`
+	FileSize int    `gorm:"column:file_size" json:"file_size"`
+	// Checksum is the SHA-1 of the content, used for ETags and cache busting
+	Checksum string `gorm:"index" json:"checksum"`
+	Datas    []byte `gorm:"type:bytea" json:"-"`
+	// ScanState is one of the AttachmentScan* states; attachments stored
+	// before scanning existed, and those the server generates, are clean
+	ScanState string `gorm:"column:scan_state;size:16;not null;default:clean;index" json:"scan_state"`
+	// ScanAttempts counts the failed scans of a pending attachment
+	ScanAttempts int `gorm:"column:scan_attempts;not null;default:0" json:"scan_attempts"`
+	// ScanResult is the detection name of a quarantined attachment, or the
+	// last error of one the scanner failed on
+	ScanResult string     `gorm:"column:scan_result" json:"scan_result,omitempty"`
+	ScanDate   *time.Time `gorm:"column:scan_date" json:"scan_date,omitempty"`
+}
+
+func (IrAttachment) TableName() string {
+	return "ir_attachment"
+}
+
+// Checksum returns the hex SHA-1 of data
+func Checksum(data []byte) string {
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// FindFieldAttachment returns the attachment holding a record field, or gorm.ErrRecordNotFound
+func FindFieldAttachment(db *gorm.DB, resModel, resField string, resID uint) (*IrAttachment, error) {
+	var attachment IrAttachment
+	err := db.Where("res_model = ? AND res_field = ? AND res_id = ?", resModel, resField, resID).
+		First(&attachment).Error
+	if err != nil {
+		return nil, err
+	}
+	return &attachment, nil
+}
+
+// SetFieldAttachment replaces the content of a record field with a file
+// uploaded by uid, pending its scan
+func SetFieldAttachment(db *gorm.DB, uid uint, resModel, resField string, resID uint, name, mimetype string, data []byte) (*IrAttachment, error) {
+	attachment := &IrAttachment{
+		Name:      name,
+		ResModel:  resModel,
+		ResField:  resField,
+		ResID:     resID,
+		Mimetype:  mimetype,
+		FileSize:  len(data),
+		Checksum:  Checksum(data),
+		Datas:     data,
+		ScanState: AttachmentScanPending,
+	}
+	attachment.stampCreate(uid)
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().
+			Where("res_model = ? AND res_field = ? AND res_id = ?", resModel, resField, resID).
+			Delete(&IrAttachment{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(attachment).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return attachment, nil
+}
+
+// FieldAttachmentScanState returns the scan state of the attachment holding
+// a record field without loading its content, or gorm.ErrRecordNotFound
+func FieldAttachmentScanState(db *gorm.DB, resModel, resField string, resID uint) (string, error) {
+	var states []string
+	err := db.Model(&IrAttachment{}).
+		Where("res_model = ? AND res_field = ? AND res_id = ?", resModel, resField, resID).
+		Limit(1).Pluck("scan_state", &states).Error
+	if err != nil {
+		return "", err
+	}
+	if len(states) == 0 {
+		return "", gorm.ErrRecordNotFound
+	}
+	return states[0], nil
+}
@@ -1,8 +1,10 @@
 package models
 
 import (
+	"reflect"
 	"time"
 	"gorm.io/gorm"
+	"goodoo/database"
 )
 
 // BaseModel represents the common fields that all Odoo models have
@@ -15,14 +17,47 @@ type BaseModel struct {
 	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
 }
 
+// stampCreate sets the creator and last writer of a new record
+func (b *BaseModel) stampCreate(uid uint) {
+	b.CreateUID = uid
+	b.WriteUID = uid
+}
+
+// creationStamper is implemented by the models embedding BaseModel
+type creationStamper interface {
+	stampCreate(uid uint)
+}
+
+// Create inserts a GORM model, setting its create_uid and write_uid to
+// the environment user when it embeds BaseModel
+func (env *Environment) Create(value interface{}) error {
+	if record, ok := value.(creationStamper); ok {
+		record.stampCreate(env.user)
+	}
+	return env.db.Create(value).Error
+}
+
 // Domain represents a search domain (filter conditions)
 type Domain []interface{}
 
+// Domainer is implemented by the forms of a search domain: Domain itself
+// and the Query built with Q
+type Domainer interface {
+	ToDomain() Domain
+}
+
+// ToDomain returns the domain itself
+func (d Domain) ToDomain() Domain {
+	return d
+}
+
 // RecordSet represents a collection of records with common operations
 type RecordSet[T any] struct {
 	db      *gorm.DB
 	Records []T
 	model   T
+	// env, set by Model, provides the context defaults of Create
+	env *Environment
 }
 
 // NewRecordSet creates a new RecordSet
@@ -34,20 +69,25 @@ func NewRecordSet[T any](db *gorm.DB, model T) *RecordSet[T] {
 	}
 }
 
-// Search finds records matching the given domain
-func (rs *RecordSet[T]) Search(domain Domain, offset, limit int, order string) (*RecordSet[T], error) {
+// Search finds records matching the given domain, either a Domain or a
+// Query built with Q
+func (rs *RecordSet[T]) Search(domain Domainer, offset, limit int, order string) (*RecordSet[T], error) {
 	var records []T
 	query := rs.db.Model(&rs.model)
 	
 	// Apply domain conditions
 	query = rs.applyDomain(query, domain)
 	
-	// Apply ordering
+	// Apply ordering, checked against the columns of the model
+	orderBy := "id"
 	if order != "" {
-		query = query.Order(order)
-	} else {
-		query = query.Order("id")
+		compiled, err := rs.compileOrder(order)
+		if err != nil {
+			return nil, err
+		}
+		orderBy = compiled
 	}
+	query = query.Order(orderBy)
 	
 	// Apply pagination
 	if offset > 0 {
@@ -66,11 +106,19 @@ func (rs *RecordSet[T]) Search(domain Domain, offset, limit int, order string) (
 		db:      rs.db,
 		Records: records,
 		model:   rs.model,
+		env:     rs.env,
 	}, nil
 }
 
-// Create creates one or more records
+// Create creates one or more records. With an environment (see Model),
+// zero fields tagged with ContextDefaultTag first get the value of their
+// context key; the column defaults of GORM apply to the fields left zero.
 func (rs *RecordSet[T]) Create(vals []T) (*RecordSet[T], error) {
+	if rs.env != nil {
+		for i := range vals {
+			applyContextDefaults(rs.env, reflect.ValueOf(&vals[i]))
+		}
+	}
 	err := rs.db.Create(&vals).Error
 	if err != nil {
 		return nil, err
@@ -80,6 +128,7 @@ func (rs *RecordSet[T]) Create(vals []T) (*RecordSet[T], error) {
 		db:      rs.db,
 		Records: vals,
 		model:   rs.model,
+		env:     rs.env,
 	}, nil
 }
 
@@ -93,17 +142,8 @@ func (rs *RecordSet[T]) Read(fields []string) ([]T, error) {
 	}
 	
 	// If we have specific records, read those
-	if len(rs.Records) > 0 {
-		var ids []uint
-		for _, record := range rs.Records {
-			// Use reflection to get ID field
-			if idField, ok := any(record).(interface{ GetID() uint }); ok {
-				ids = append(ids, idField.GetID())
-			}
-		}
-		if len(ids) > 0 {
-			query = query.Where("id IN ?", ids)
-		}
+	if ids := rs.Ids(); len(ids) > 0 {
+		query = query.Where("id IN ?", ids)
 	}
 	
 	err := query.Find(&records).Error
@@ -112,19 +152,11 @@ func (rs *RecordSet[T]) Read(fields []string) ([]T, error) {
 
 // Write updates records with given values
 func (rs *RecordSet[T]) Write(vals map[string]interface{}) error {
-	if len(rs.Records) == 0 {
-		return nil
-	}
-	
-	var ids []uint
-	for _, record := range rs.Records {
-		if idField, ok := any(record).(interface{ GetID() uint }); ok {
-			ids = append(ids, idField.GetID())
-		}
-	}
-	
+	ids := rs.Ids()
 	if len(ids) > 0 {
-		return rs.db.Model(&rs.model).Where("id IN ?", ids).Updates(vals).Error
+		return database.RetryableTransaction(rs.db.Statement.Context, rs.db, func(tx *gorm.DB) error {
+			return tx.Model(&rs.model).Where("id IN ?", ids).Updates(vals).Error
+		})
 	}
 	
 	return nil
@@ -132,26 +164,18 @@ func (rs *RecordSet[T]) Write(vals map[string]interface{}) error {
 
 // Unlink deletes records
 func (rs *RecordSet[T]) Unlink() error {
-	if len(rs.Records) == 0 {
-		return nil
-	}
-	
-	var ids []uint
-	for _, record := range rs.Records {
-		if idField, ok := any(record).(interface{ GetID() uint }); ok {
-			ids = append(ids, idField.GetID())
-		}
-	}
-	
+	ids := rs.Ids()
 	if len(ids) > 0 {
-		return rs.db.Where("id IN ?", ids).Delete(&rs.model).Error
+		return database.RetryableTransaction(rs.db.Statement.Context, rs.db, func(tx *gorm.DB) error {
+			return tx.Where("id IN ?", ids).Delete(&rs.model).Error
+		})
 	}
 	
 	return nil
 }
 
 // Count returns the number of records matching the domain
-func (rs *RecordSet[T]) Count(domain Domain) (int64, error) {
+func (rs *RecordSet[T]) Count(domain Domainer) (int64, error) {
 	query := rs.db.Model(&rs.model)
 	query = rs.applyDomain(query, domain)
 	
@@ -160,41 +184,47 @@ func (rs *RecordSet[T]) Count(domain Domain) (int64, error) {
 	return count, err
 }
 
-// applyDomain applies domain conditions to a GORM query
-func (rs *RecordSet[T]) applyDomain(query *gorm.DB, domain Domain) *gorm.DB {
-	// Simple domain implementation - in real Odoo this is much more complex
-	// Domain format: [['field', 'operator', 'value'], ...]
-	for _, condition := range domain {
-		if condSlice, ok := condition.([]interface{}); ok && len(condSlice) == 3 {
-			field := condSlice[0].(string)
-			operator := condSlice[1].(string)
-			value := condSlice[2]
-			
-			switch operator {
-			case "=":
-				query = query.Where(field+" = ?", value)
-			case "!=":
-				query = query.Where(field+" != ?", value)
-			case ">":
-				query = query.Where(field+" > ?", value)
-			case ">=":
-				query = query.Where(field+" >= ?", value)
-			case "<":
-				query = query.Where(field+" < ?", value)
-			case "<=":
-				query = query.Where(field+" <= ?", value)
-			case "like":
-				query = query.Where(field+" LIKE ?", value)
-			case "ilike":
-				query = query.Where(field+" ILIKE ?", value)
-			case "in":
-				query = query.Where(field+" IN ?", value)
-			case "not in":
-				query = query.Where(field+" NOT IN ?", value)
-			}
+// applyDomain applies domain conditions to a GORM query, on the columns of
+// the model; models declaring a table walk their parent_id column for
+// child_of and parent_of, and filter on tag_ids when they are taggable
+func (rs *RecordSet[T]) applyDomain(query *gorm.DB, domain Domainer) *gorm.DB {
+	modelSchema, err := rs.schema()
+	if err != nil {
+		query.AddError(err)
+		return query
+	}
+	var tree *hierarchy
+	var tags *tagScope
+	if tabler, ok := any(rs.model).(interface{ TableName() string }); ok {
+		tree = &hierarchy{table: tabler.TableName(), parentColumn: "parent_id"}
+		if model := TaggableModel(tabler.TableName()); model != "" {
+			tags = &tagScope{model: model, table: tabler.TableName()}
 		}
 	}
-	return query
+	filtered, err := applyDomain(query, domain.ToDomain(), func(name string) bool {
+		_, ok := modelSchema.FieldsByDBName[name]
+		return ok
+	}, tree, tags)
+	if err != nil {
+		query.AddError(err)
+		return query
+	}
+	return filtered
+}
+
+// compileOrder checks an order specification such as "name desc" against
+// the columns of the model and returns its ORDER BY clause
+func (rs *RecordSet[T]) compileOrder(order string) (string, error) {
+	modelSchema, err := rs.schema()
+	if err != nil {
+		return "", err
+	}
+	return compileOrder(order, func(name string) (string, error) {
+		if _, ok := modelSchema.FieldsByDBName[name]; !ok {
+			return "", &IdentifierError{Kind: "field", Name: name, Model: modelSchema.Table}
+		}
+		return QuoteIdentifier(name), nil
+	})
 }
 
 // GetID returns the ID of the base model
@@ -0,0 +1,587 @@
+package models
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"goodoo/fields"
+	"gorm.io/gorm"
+)
+
+// BundleFormat is the version of the format of record bundles; bundles of
+// another format are refused
+const BundleFormat = 1
+
+// Bundle limits
+const (
+	// DefaultBundleInlineMax bounds the size of an attachment inlined in a
+	// bundle unless BundleOptions says otherwise
+	DefaultBundleInlineMax = 1 << 20
+	// BundleMaxRelated bounds the records of a relation in a bundle
+	BundleMaxRelated = 1000
+)
+
+// ErrInvalidBundle wraps the errors of bundles that cannot be imported
+var ErrInvalidBundle = errors.New("invalid bundle")
+
+// BundleRelation is a relation the bundle of a record follows, one level
+// deep. Field is a relational field of the model itself when Model is
+// empty, like the partner of an order; otherwise it is a field of Model
+// pointing to the record, like the lines of an order.
+type BundleRelation struct {
+	Field string `json:"field"`
+	Model string `json:"model,omitempty"`
+}
+
+// String names the relation in reports, e.g. "partner_id" or
+// "sale.order.line/order_id"
+func (r BundleRelation) String() string {
+	if r.Model == "" {
+		return r.Field
+	}
+	return r.Model + "/" + r.Field
+}
+
+// BundleRecord is a record of a bundle, its values in their export
+// representation
+type BundleRecord struct {
+	Model string `json:"model"`
+	ID    uint   `json:"id"`
+	// XMLID is the external id of the record, used to find it again on
+	// import
+	XMLID string `json:"xmlid,omitempty"`
+	// Via is the relation of the root record the record was reached by,
+	// nil for the root
+	Via    *BundleRelation        `json:"via,omitempty"`
+	Values map[string]interface{} `json:"values"`
+}
+
+// BundleAttachment is an attachment of a record of a bundle. Datas holds
+// its base64 content when inlining was asked and it is small enough and
+// clean; Omitted tells why it does not otherwise.
+type BundleAttachment struct {
+	ResModel  string `json:"res_model"`
+	ResID     uint   `json:"res_id"`
+	ResField  string `json:"res_field,omitempty"`
+	Name      string `json:"name"`
+	Mimetype  string `json:"mimetype"`
+	FileSize  int    `json:"file_size"`
+	Checksum  string `json:"checksum"`
+	ScanState string `json:"scan_state"`
+	Datas     string `json:"datas,omitempty"`
+	Omitted   string `json:"omitted,omitempty"`
+}
+
+// BundleManifest describes a bundle
+type BundleManifest struct {
+	Format     int       `json:"format"`
+	Database   string    `json:"database"`
+	Model      string    `json:"model"`
+	ID         uint      `json:"id"`
+	ExportDate time.Time `json:"export_date"`
+	ExportUID  uint      `json:"export_uid"`
+	// Models are the definition versions of the models of the bundle (see
+	// DefinitionVersion)
+	Models map[string]int `json:"models"`
+}
+
+// BundleSkip is something left out of a bundle or of its import
+type BundleSkip struct {
+	Model  string `json:"model"`
+	ID     uint   `json:"id,omitempty"`
+	Field  string `json:"field,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// RecordBundle is a record with its related records, attachments and
+// history, as one portable document
+type RecordBundle struct {
+	Manifest BundleManifest `json:"manifest"`
+	Record   BundleRecord   `json:"record"`
+	// Related are the records of the Bundle relations of the model
+	Related     []BundleRecord     `json:"related"`
+	Attachments []BundleAttachment `json:"attachments"`
+	History     []HistoryEntry     `json:"history"`
+	Skipped     []BundleSkip       `json:"skipped,omitempty"`
+}
+
+// BundleOptions tunes ExportBundle
+type BundleOptions struct {
+	// Inline adds the content of the attachments
+	Inline bool
+	// InlineMax bounds the size of an inlined attachment,
+	// DefaultBundleInlineMax when zero
+	InlineMax int
+}
+
+// bundleExport assembles a bundle
+type bundleExport struct {
+	ctx    context.Context
+	env    *Environment
+	bundle *RecordBundle
+}
+
+// skip records something left out of the bundle
+func (b *bundleExport) skip(model string, id uint, field, reason string) {
+	b.bundle.Skipped = append(b.bundle.Skipped, BundleSkip{Model: model, ID: id, Field: field, Reason: reason})
+}
+
+// records reads records of a model as the user sees them and converts
+// them to their export representation
+func (b *bundleExport) records(model *ModelDefinition, ids []uint, via *BundleRelation) ([]BundleRecord, error) {
+	read, err := model.Read(b.env, ids, nil)
+	if err != nil {
+		return nil, err
+	}
+	exported, err := model.ExportRows(b.ctx, read)
+	if err != nil {
+		return nil, err
+	}
+	xmlids, err := recordXMLIDs(b.env.db, model.Name, ids)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]BundleRecord, len(read))
+	for i, record := range read {
+		id := toUint(record["id"])
+		records[i] = BundleRecord{Model: model.Name, ID: id, XMLID: xmlids[id], Via: via, Values: exported[i]}
+	}
+	return records, nil
+}
+
+// recordXMLIDs returns the external ids of records of a model
+func recordXMLIDs(db *gorm.DB, model string, ids []uint) (map[uint]string, error) {
+	var data []IrModelData
+	if err := db.Where("model = ? AND res_id IN ?", model, ids).Order("id").Find(&data).Error; err != nil {
+		return nil, err
+	}
+	xmlids := make(map[uint]string, len(data))
+	for _, item := range data {
+		if _, ok := xmlids[item.ResID]; !ok {
+			xmlids[item.ResID] = item.Module + "." + item.Name
+		}
+	}
+	return xmlids, nil
+}
+
+// related adds the records of a relation of the root record
+func (b *bundleExport) related(model *ModelDefinition, root map[string]interface{}, relation BundleRelation) error {
+	registry := b.env.FieldModels()
+	via := relation
+	if relation.Model == "" {
+		field, ok := model.Fields[relation.Field]
+		if !ok || field.GetAttributes().Relation == "" {
+			b.skip(model.Name, 0, relation.Field, "not a relational field of the model")
+			return nil
+		}
+		value, readable := root[relation.Field]
+		if !readable {
+			b.skip(model.Name, 0, relation.Field, "field not readable")
+			return nil
+		}
+		id := toUint(value)
+		if id == 0 {
+			return nil
+		}
+		comodel, ok := registry.GetModel(field.GetAttributes().Relation)
+		if !ok || comodel.Abstract {
+			b.skip(field.GetAttributes().Relation, id, "", "not a field-defined model")
+			return nil
+		}
+		records, err := b.records(comodel, []uint{id}, &via)
+		if err != nil {
+			return err
+		}
+		if len(records) == 0 {
+			b.skip(comodel.Name, id, "", "record not readable")
+		}
+		b.bundle.Related = append(b.bundle.Related, records...)
+		return nil
+	}
+
+	comodel, ok := registry.GetModel(relation.Model)
+	if !ok || comodel.Abstract {
+		b.skip(relation.Model, 0, "", "not a field-defined model")
+		return nil
+	}
+	if field, ok := comodel.Fields[relation.Field]; !ok || field.GetAttributes().Relation != model.Name {
+		b.skip(relation.Model, 0, relation.Field, "not a relational field pointing to "+model.Name)
+		return nil
+	}
+	if !comodel.readableField(b.env, relation.Field) {
+		b.skip(relation.Model, 0, relation.Field, "field not readable")
+		return nil
+	}
+	ids, err := comodel.Search(b.env, Domain{[]interface{}{relation.Field, "=", b.bundle.Record.ID}}, 0, BundleMaxRelated+1, "id")
+	if err != nil {
+		return err
+	}
+	if len(ids) > BundleMaxRelated {
+		ids = ids[:BundleMaxRelated]
+		b.skip(relation.Model, 0, relation.Field, fmt.Sprintf("only the first %d records are bundled", BundleMaxRelated))
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	records, err := b.records(comodel, ids, &via)
+	if err != nil {
+		return err
+	}
+	b.bundle.Related = append(b.bundle.Related, records...)
+	return nil
+}
+
+// attachments adds the attachments of the bundled records, those of
+// fields the user may not read left out
+func (b *bundleExport) attachments(opts BundleOptions) error {
+	registry := b.env.FieldModels()
+	byModel := map[string][]uint{b.bundle.Record.Model: {b.bundle.Record.ID}}
+	for _, record := range b.bundle.Related {
+		byModel[record.Model] = append(byModel[record.Model], record.ID)
+	}
+	names := make([]string, 0, len(byModel))
+	for name := range byModel {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	inlineMax := opts.InlineMax
+	if inlineMax <= 0 {
+		inlineMax = DefaultBundleInlineMax
+	}
+	for _, name := range names {
+		model, _ := registry.GetModel(name)
+		var attachments []IrAttachment
+		err := b.env.db.Omit("datas").Where("res_model = ? AND res_id IN ?", name, byModel[name]).
+			Order("res_id, id").Find(&attachments).Error
+		if err != nil {
+			return err
+		}
+		for _, attachment := range attachments {
+			if attachment.ResField != "" && model != nil && !model.readableField(b.env, attachment.ResField) {
+				continue
+			}
+			item := BundleAttachment{
+				ResModel:  attachment.ResModel,
+				ResID:     attachment.ResID,
+				ResField:  attachment.ResField,
+				Name:      attachment.Name,
+				Mimetype:  attachment.Mimetype,
+				FileSize:  attachment.FileSize,
+				Checksum:  attachment.Checksum,
+				ScanState: attachment.ScanState,
+			}
+			switch {
+			case !opts.Inline:
+			case attachment.ScanState != AttachmentScanClean:
+				item.Omitted = "not scanned clean"
+			case attachment.FileSize > inlineMax:
+				item.Omitted = fmt.Sprintf("larger than %d bytes", inlineMax)
+			default:
+				var datas []byte
+				err := b.env.db.Model(&IrAttachment{}).Where("id = ?", attachment.ID).Pluck("datas", &datas).Error
+				if err != nil {
+					return err
+				}
+				item.Datas = base64.StdEncoding.EncodeToString(datas)
+			}
+			b.bundle.Attachments = append(b.bundle.Attachments, item)
+		}
+	}
+	return nil
+}
+
+// ExportBundle returns the bundle of a record: the record, the records of
+// the model's Bundle relations, the attachments of all of them, the
+// history of the record and a manifest. Everything goes through the field
+// access and record rules of the environment user; what they hide is left
+// out, and the relations that cannot be followed are listed in Skipped.
+// It fails with gorm.ErrRecordNotFound when the user cannot read the
+// record.
+func (m *ModelDefinition) ExportBundle(ctx context.Context, env *Environment, id uint, opts BundleOptions) (*RecordBundle, error) {
+	if err := m.checkConcrete(); err != nil {
+		return nil, err
+	}
+	read, err := m.Read(env, []uint{id}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(read) == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	b := &bundleExport{ctx: ctx, env: env, bundle: &RecordBundle{
+		Manifest: BundleManifest{
+			Format:     BundleFormat,
+			Database:   env.dbName,
+			Model:      m.Name,
+			ID:         id,
+			ExportDate: time.Now().UTC(),
+			ExportUID:  env.user,
+			Models:     make(map[string]int),
+		},
+		Related:     []BundleRecord{},
+		Attachments: []BundleAttachment{},
+	}}
+	records, err := b.records(m, []uint{id}, nil)
+	if err != nil {
+		return nil, err
+	}
+	b.bundle.Record = records[0]
+
+	for _, relation := range m.Bundle {
+		if err := b.related(m, read[0], relation); err != nil {
+			return nil, fmt.Errorf("relation %s: %w", relation, err)
+		}
+	}
+	if err := b.attachments(opts); err != nil {
+		return nil, err
+	}
+	history, _, err := m.History(env, id, HistoryOptions{})
+	if err != nil {
+		return nil, err
+	}
+	b.bundle.History = history
+
+	b.bundle.Manifest.Models[m.Name] = DefinitionVersion(env.db, m.Name)
+	for _, record := range b.bundle.Related {
+		if _, ok := b.bundle.Manifest.Models[record.Model]; !ok {
+			b.bundle.Manifest.Models[record.Model] = DefinitionVersion(env.db, record.Model)
+		}
+	}
+	return b.bundle, nil
+}
+
+// BundleImported is a record of an imported bundle
+type BundleImported struct {
+	Model string `json:"model"`
+	// OldID is the id of the record in the exporting database
+	OldID uint   `json:"old_id"`
+	ID    uint   `json:"id"`
+	XMLID string `json:"xmlid,omitempty"`
+}
+
+// BundleImportResult reports the import of a bundle. Matched are the
+// records found by external id, kept as they are; Created are the new
+// ones. The history of the bundle is not imported.
+type BundleImportResult struct {
+	ID          uint             `json:"id"`
+	Created     []BundleImported `json:"created"`
+	Matched     []BundleImported `json:"matched"`
+	Attachments int              `json:"attachments"`
+	Skipped     []BundleSkip     `json:"skipped"`
+}
+
+// bundleImport recreates the records of a bundle, remembering the new id
+// of each old one
+type bundleImport struct {
+	env    *Environment
+	ids    map[string]map[uint]uint
+	result *BundleImportResult
+}
+
+// skip records something the import left out
+func (b *bundleImport) skip(model string, id uint, field, reason string) {
+	b.result.Skipped = append(b.result.Skipped, BundleSkip{Model: model, ID: id, Field: field, Reason: reason})
+}
+
+// mapped returns the new id of a record of the bundle, 0 when it was not
+// imported
+func (b *bundleImport) mapped(model string, id uint) uint {
+	return b.ids[model][id]
+}
+
+// remember records the new id of a record of the bundle
+func (b *bundleImport) remember(model string, oldID, id uint) {
+	if b.ids[model] == nil {
+		b.ids[model] = make(map[uint]uint)
+	}
+	b.ids[model][oldID] = id
+}
+
+// values converts the exported values of a record for Create: relations
+// are remapped to the imported records, and those pointing outside the
+// bundle are left out
+func (b *bundleImport) values(model *ModelDefinition, record BundleRecord) map[string]interface{} {
+	vals := make(map[string]interface{}, len(record.Values))
+	for name, value := range record.Values {
+		if IsMagicColumn(name) {
+			continue
+		}
+		field, ok := model.Fields[name]
+		if !ok || !field.IsStored() {
+			b.skip(record.Model, record.ID, name, "field unknown to this database")
+			continue
+		}
+		if value == "" {
+			switch field.GetType() {
+			case fields.StringType, fields.TextType, fields.HtmlType:
+			default:
+				value = nil
+			}
+		}
+		if relation := field.GetAttributes().Relation; relation != "" && value != nil {
+			id := b.mapped(relation, toUint(value))
+			if id == 0 {
+				b.skip(record.Model, record.ID, name, fmt.Sprintf("%s record %v is not in the bundle", relation, value))
+				continue
+			}
+			value = id
+		}
+		if value != nil {
+			converted, err := field.ConvertToCache(value, nil)
+			if err != nil {
+				b.skip(record.Model, record.ID, name, err.Error())
+				continue
+			}
+			value = converted
+		}
+		vals[name] = value
+	}
+	return vals
+}
+
+// record finds a record of the bundle by its external id or creates it
+func (b *bundleImport) record(tx *gorm.DB, record BundleRecord) error {
+	model, ok := b.env.FieldModels().GetModel(record.Model)
+	if !ok || model.Abstract {
+		b.skip(record.Model, record.ID, "", "model unknown to this database")
+		return nil
+	}
+	if record.XMLID != "" {
+		resModel, id, err := ResolveXMLID(tx, record.XMLID)
+		if err == nil && resModel == record.Model {
+			b.remember(record.Model, record.ID, id)
+			b.result.Matched = append(b.result.Matched, BundleImported{Model: record.Model, OldID: record.ID, ID: id, XMLID: record.XMLID})
+			return nil
+		}
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+	}
+
+	vals := b.values(model, record)
+	var id uint
+	// A failed record rolls back to its savepoint, the others are kept
+	err := tx.Transaction(func(tx *gorm.DB) error {
+		var err error
+		id, err = model.Create(b.env.WithDB(tx), vals)
+		if err != nil {
+			return err
+		}
+		if module, name, found := strings.Cut(record.XMLID, "."); found {
+			return ensureXMLID(tx, module, name, record.Model, id)
+		}
+		return nil
+	})
+	if err != nil {
+		b.skip(record.Model, record.ID, "", err.Error())
+		return nil
+	}
+	b.remember(record.Model, record.ID, id)
+	b.result.Created = append(b.result.Created, BundleImported{Model: record.Model, OldID: record.ID, ID: id, XMLID: record.XMLID})
+	return nil
+}
+
+// ImportBundle recreates a bundle exported from another database in the
+// environment's. Records with an external id already known here are
+// matched rather than created; the others are created and get the
+// external id. The records a relation of the root record points to are
+// imported first, then the root, then the records pointing to it, and
+// relational values are remapped to the new ids. Values, records and
+// attachments that cannot be imported are reported in Skipped, and the
+// inlined attachments are created pending a scan. It fails with
+// ErrInvalidBundle when the bundle is unusable or the root record cannot
+// be imported.
+func ImportBundle(env *Environment, bundle *RecordBundle) (*BundleImportResult, error) {
+	if bundle.Manifest.Format != BundleFormat {
+		return nil, fmt.Errorf("%w: unsupported format %d (this server reads format %d)", ErrInvalidBundle, bundle.Manifest.Format, BundleFormat)
+	}
+	if bundle.Record.Model == "" || bundle.Record.ID == 0 {
+		return nil, fmt.Errorf("%w: no record", ErrInvalidBundle)
+	}
+
+	var result *BundleImportResult
+	err := env.Transaction(func(tx *gorm.DB) error {
+		b := &bundleImport{
+			env:    env.WithDB(tx),
+			ids:    make(map[string]map[uint]uint),
+			result: &BundleImportResult{Created: []BundleImported{}, Matched: []BundleImported{}, Skipped: []BundleSkip{}},
+		}
+		for _, record := range bundle.Related {
+			if record.Via == nil || record.Via.Model == "" {
+				if err := b.record(tx, record); err != nil {
+					return err
+				}
+			}
+		}
+		if err := b.record(tx, bundle.Record); err != nil {
+			return err
+		}
+		b.result.ID = b.mapped(bundle.Record.Model, bundle.Record.ID)
+		if b.result.ID == 0 {
+			reasons := make([]string, 0, len(b.result.Skipped))
+			for _, skipped := range b.result.Skipped {
+				if skipped.Model == bundle.Record.Model && skipped.ID == bundle.Record.ID {
+					reasons = append(reasons, strings.TrimSpace(skipped.Field+" "+skipped.Reason))
+				}
+			}
+			return fmt.Errorf("%w: the record cannot be imported: %s", ErrInvalidBundle, strings.Join(reasons, "; "))
+		}
+		for _, record := range bundle.Related {
+			if record.Via != nil && record.Via.Model != "" {
+				if err := b.record(tx, record); err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, attachment := range bundle.Attachments {
+			resID := b.mapped(attachment.ResModel, attachment.ResID)
+			switch {
+			case resID == 0:
+				b.skip(attachment.ResModel, attachment.ResID, attachment.ResField, "attachment "+attachment.Name+" of a record not imported")
+				continue
+			case attachment.Datas == "":
+				b.skip(attachment.ResModel, attachment.ResID, attachment.ResField, "content of attachment "+attachment.Name+" not in the bundle")
+				continue
+			}
+			data, err := base64.StdEncoding.DecodeString(attachment.Datas)
+			if err != nil {
+				b.skip(attachment.ResModel, attachment.ResID, attachment.ResField, "invalid content of attachment "+attachment.Name)
+				continue
+			}
+			if attachment.ResField != "" {
+				_, err = SetFieldAttachment(tx, env.user, attachment.ResModel, attachment.ResField, resID, attachment.Name, attachment.Mimetype, data)
+			} else {
+				created := &IrAttachment{
+					Name:      attachment.Name,
+					ResModel:  attachment.ResModel,
+					ResID:     resID,
+					Mimetype:  attachment.Mimetype,
+					FileSize:  len(data),
+					Checksum:  Checksum(data),
+					Datas:     data,
+					ScanState: AttachmentScanPending,
+				}
+				created.stampCreate(env.user)
+				err = tx.Create(created).Error
+			}
+			if err != nil {
+				return err
+			}
+			b.result.Attachments++
+		}
+		result = b.result
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
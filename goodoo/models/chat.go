@@ -0,0 +1,136 @@
+package models
+
+import (
+	"time"
+
+	"goodoo/markup"
+	"gorm.io/gorm"
+)
+
+// ChatSession is a conversation of a user with an LLM assistant
+type ChatSession struct {
+	ID     string `gorm:"primaryKey;size:64" json:"id"`
+	UserID uint   `gorm:"column:user_id;not null;index" json:"user_id"`
+	Title  string `gorm:"not null;default:''" json:"title"`
+	// TitleManual is set when the user chose the title, which is then never
+	// generated; TitlePending queues the session for title generation
+	TitleManual  bool      `gorm:"column:title_manual;not null;default:false" json:"title_manual"`
+	TitlePending bool      `gorm:"column:title_pending;not null;default:false;index" json:"-"`
+	Model        string    `json:"model"`
+	UseKnowledge bool      `gorm:"column:use_knowledge;not null;default:false" json:"use_knowledge"`
+	Archived     bool      `gorm:"not null;default:false" json:"archived"`
+	CreateDate   time.Time `gorm:"column:create_date;autoCreateTime" json:"create_date"`
+	WriteDate    time.Time `gorm:"column:write_date;autoUpdateTime" json:"write_date"`
+}
+
+func (ChatSession) TableName() string {
+	return "chat_session"
+}
+
+// Chat message roles
+const (
+	ChatRoleUser      = "user"
+	ChatRoleAssistant = "assistant"
+)
+
+// Chat message content types
+const (
+	ChatContentText     = "text"
+	ChatContentMarkdown = "markdown"
+)
+
+// ValidChatContentType reports whether a message content type is known
+func ValidChatContentType(contentType string) bool {
+	return contentType == ChatContentText || contentType == ChatContentMarkdown
+}
+
+// ChatMessage is a message of a chat session
+type ChatMessage struct {
+	ID        uint   `gorm:"primaryKey;autoIncrement" json:"id"`
+	SessionID string `gorm:"column:session_id;size:64;not null;index:chat_message_session,priority:1" json:"session_id"`
+	Role      string `gorm:"not null" json:"role"`
+	Content   string `gorm:"type:text;not null" json:"content"`
+	// ContentType is how Content is written; RenderedHTML is its sanitized
+	// HTML, rendered when the message is saved
+	ContentType  string `gorm:"column:content_type;size:16;not null;default:markdown" json:"content_type"`
+	RenderedHTML string `gorm:"column:rendered_html;type:text;not null;default:''" json:"rendered_html"`
+	Model        string `json:"model,omitempty"`
+	// Provider names the LLM provider of a routed answer, Model being the
+	// model it actually used; TokensUsed is what the answer cost
+	Provider   string `json:"provider,omitempty"`
+	TokensUsed int    `gorm:"column:tokens_used;not null;default:0" json:"tokens_used,omitempty"`
+	// TemplateID is the prompt template a user message was rendered from
+	TemplateID *uint     `gorm:"column:template_id;index" json:"template_id,omitempty"`
+	CreateDate time.Time `gorm:"column:create_date;autoCreateTime;index:chat_message_session,priority:2" json:"create_date"`
+}
+
+func (ChatMessage) TableName() string {
+	return "chat_message"
+}
+
+// BeforeSave renders the content, so reading a message never renders it
+func (m *ChatMessage) BeforeSave(tx *gorm.DB) error {
+	if m.ContentType == "" {
+		m.ContentType = ChatContentMarkdown
+	}
+	m.RenderedHTML = RenderChatContent(m.ContentType, m.Content, nil)
+	return nil
+}
+
+// Rendered returns the HTML of the message; messages stored before
+// rendering existed are rendered now
+func (m *ChatMessage) Rendered() string {
+	if m.RenderedHTML == "" && m.Content != "" {
+		return RenderChatContent(m.ContentType, m.Content, nil)
+	}
+	return m.RenderedHTML
+}
+
+// RenderChatContent returns the sanitized HTML of a message content;
+// mentions maps the logins mentioned in it to user IDs
+func RenderChatContent(contentType, content string, mentions map[string]uint) string {
+	if contentType == ChatContentText {
+		return markup.PlainText(content)
+	}
+	return markup.Render(content, markup.Options{Mentions: mentions})
+}
+
+// ChatMention is a user mentioned in a message
+type ChatMention struct {
+	UserID uint   `json:"user_id"`
+	Login  string `json:"login"`
+}
+
+// ResolveMentions returns the active users of the logins mentioned in a
+// message content, in the order they are mentioned
+func ResolveMentions(db *gorm.DB, content string) ([]ChatMention, error) {
+	logins := markup.Mentions(content)
+	if len(logins) == 0 {
+		return nil, nil
+	}
+	var users []User
+	if err := db.Select("id", "login").Where("login IN ? AND active = ?", logins, true).Find(&users).Error; err != nil {
+		return nil, err
+	}
+	byLogin := make(map[string]uint, len(users))
+	for _, user := range users {
+		byLogin[user.Login] = user.ID
+	}
+	var mentions []ChatMention
+	for _, login := range logins {
+		if id, ok := byLogin[login]; ok {
+			mentions = append(mentions, ChatMention{UserID: id, Login: login})
+		}
+	}
+	return mentions, nil
+}
+
+// MentionMap maps the logins of mentions to their user IDs, as
+// RenderChatContent takes them
+func MentionMap(mentions []ChatMention) map[string]uint {
+	byLogin := make(map[string]uint, len(mentions))
+	for _, mention := range mentions {
+		byLogin[mention.Login] = mention.UserID
+	}
+	return byLogin
+}
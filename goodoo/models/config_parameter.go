@@ -0,0 +1,428 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"goodoo/database"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// IrConfigParameter is a runtime-tunable system parameter (like Odoo's
+// ir.config_parameter). Values are stored as text; JSON values are encoded.
+type IrConfigParameter struct {
+	ID    uint   `gorm:"primaryKey;autoIncrement" json:"id"`
+	Key   string `gorm:"not null;uniqueIndex" json:"key"`
+	Value string `gorm:"type:text" json:"value"`
+	// Sensitive parameters (API keys, secrets) are redacted when listed
+	Sensitive bool      `gorm:"not null;default:false" json:"sensitive"`
+	WriteUID  uint      `gorm:"column:write_uid" json:"write_uid"`
+	WriteDate time.Time `gorm:"column:write_date;autoUpdateTime" json:"write_date"`
+}
+
+func (IrConfigParameter) TableName() string {
+	return "ir_config_parameter"
+}
+
+// Keys of the parameters read by the server
+const (
+	ParamLogLevel              = "base.log_level"
+	ParamSessionTimeout        = "base.session_timeout"
+	ParamPerformanceMonitoring = "base.performance_monitoring"
+	// ParamCORSAllowedOrigins lists the origins allowed to call the API,
+	// comma-separated; unset keeps GOODOO_CORS_ALLOW_ORIGINS
+	ParamCORSAllowedOrigins = "web.cors.allowed_origins"
+	// ParamMaintenance holds the maintenance mode of the database, as JSON
+	// (see the maintenance package)
+	ParamMaintenance = "base.maintenance"
+	// ParamCSVMaxRows bounds the rows of the CSV responses of the record
+	// lists, DefaultCSVMaxRows when unset
+	ParamCSVMaxRows = "web.csv.max_rows"
+	// ParamStreamMaxSeconds bounds the duration of the streamed reads,
+	// such as full CSV exports, DefaultStreamMaxSeconds when unset
+	ParamStreamMaxSeconds = "base.stream_max_seconds"
+	// ParamPasswordMinLength is the minimum length of the passwords users
+	// choose, DefaultPasswordMinLength when unset
+	ParamPasswordMinLength = "auth_policy.minlength"
+	// ParamInvitationHours is how long invitation links stay valid,
+	// DefaultInvitationHours when unset
+	ParamInvitationHours = "auth.invitation_hours"
+	// ParamEmailChangeHours is how long the confirmation links of email
+	// changes stay valid, DefaultEmailChangeHours when unset
+	ParamEmailChangeHours = "auth.email_change_hours"
+	// ParamLLMCooldownSeconds is how long a failing LLM provider is tried
+	// last, DefaultLLMCooldownSeconds when unset
+	ParamLLMCooldownSeconds = "llm.cooldown_seconds"
+	// ParamLLMCooldownAlertMinutes is how long a provider may keep failing
+	// before the administrators are notified, DefaultLLMCooldownAlertMinutes
+	// when unset
+	ParamLLMCooldownAlertMinutes = "llm.cooldown_alert_minutes"
+	// ParamWebBaseURL is the URL of the server in every link it mails or
+	// redirects to; links are refused while it is unset
+	ParamWebBaseURL = "web.base.url"
+	// ParamReportMaxAttachmentBytes bounds the output of the scheduled
+	// reports mailed as attachments, DefaultReportMaxAttachmentBytes when
+	// unset; larger outputs are sent as download links
+	ParamReportMaxAttachmentBytes = "report.schedule.max_attachment_bytes"
+	// ParamReportLinkDays is how long the download links of scheduled
+	// reports work, DefaultReportLinkDays when unset
+	ParamReportLinkDays = "report.schedule.link_days"
+	// ParamNonProduction flags a development or test database; the
+	// generation of load data refuses to run without it
+	ParamNonProduction = "base.non_production"
+)
+
+// DefaultConfigParameters are seeded in new databases. The session timeout,
+// in minutes, matches the lifetime of session cookies.
+var DefaultConfigParameters = []IrConfigParameter{
+	{Key: ParamLogLevel, Value: "info"},
+	{Key: ParamSessionTimeout, Value: "1440"},
+	{Key: ParamPerformanceMonitoring, Value: "true"},
+}
+
+// LogLevels are the values of ParamLogLevel
+var LogLevels = []string{"debug", "info", "warn", "error", "critical"}
+
+func init() {
+	RegisterParamValidator(ParamLogLevel, func(value string) error {
+		for _, level := range LogLevels {
+			if value == level {
+				return nil
+			}
+		}
+		return errors.New("invalid log level")
+	})
+	RegisterParamValidator(ParamSessionTimeout, func(value string) error {
+		minutes, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || minutes < 5 || minutes > 1440 {
+			return errors.New("session timeout must be between 5 and 1440 minutes")
+		}
+		return nil
+	})
+	RegisterParamValidator(ParamPerformanceMonitoring, func(value string) error {
+		if _, err := strconv.ParseBool(strings.TrimSpace(value)); err != nil {
+			return errors.New("performance monitoring must be true or false")
+		}
+		return nil
+	})
+	RegisterParamValidator(ParamNonProduction, func(value string) error {
+		if _, err := strconv.ParseBool(strings.TrimSpace(value)); err != nil {
+			return errors.New("the non-production flag must be true or false")
+		}
+		return nil
+	})
+}
+
+// RedactedValue replaces the value of sensitive parameters in responses
+const RedactedValue = "********"
+
+// sensitiveKeyParts mark parameters as sensitive by name, whatever their flag
+var sensitiveKeyParts = []string{"secret", "password", "api_key", "apikey", "token"}
+
+// IsSensitive reports whether the parameter must be redacted
+func (p IrConfigParameter) IsSensitive() bool {
+	if p.Sensitive {
+		return true
+	}
+	key := strings.ToLower(p.Key)
+	for _, part := range sensitiveKeyParts {
+		if strings.Contains(key, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// Redacted returns the parameter with its value hidden when sensitive
+func (p IrConfigParameter) Redacted() IrConfigParameter {
+	if p.IsSensitive() && p.Value != "" {
+		p.Value = RedactedValue
+	}
+	return p
+}
+
+// SeedConfigParameters creates the missing default parameters
+func SeedConfigParameters(db *gorm.DB) error {
+	defaults := make([]IrConfigParameter, len(DefaultConfigParameters))
+	copy(defaults, DefaultConfigParameters)
+	return db.Clauses(clause.OnConflict{DoNothing: true}).Create(&defaults).Error
+}
+
+// configParameterChannel is the NOTIFY channel announcing parameter changes
+const configParameterChannel = "ir_config_parameter"
+
+// paramCache holds the parameters of each database, loaded on first use
+// and dropped when a parameter is written
+var paramCache sync.Map // dbName -> map[string]string
+
+// loadParams returns the cached parameters of a database
+func loadParams(dbName string) (map[string]string, error) {
+	if cached, ok := paramCache.Load(dbName); ok {
+		return cached.(map[string]string), nil
+	}
+	db, err := database.GetDatabase(dbName)
+	if err != nil {
+		return nil, err
+	}
+	var params []IrConfigParameter
+	if err := db.Find(&params).Error; err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(params))
+	for _, param := range params {
+		values[param.Key] = param.Value
+	}
+	paramCache.Store(dbName, values)
+	return values, nil
+}
+
+// InvalidateParams drops the cached parameters of a database
+func InvalidateParams(dbName string) {
+	paramCache.Delete(dbName)
+}
+
+// lookupParam returns a parameter value; unreadable parameters count as unset
+func lookupParam(dbName, key string) (string, bool) {
+	values, err := loadParams(dbName)
+	if err != nil {
+		return "", false
+	}
+	value, ok := values[key]
+	return value, ok
+}
+
+// GetParamString returns a parameter, or def when it is not set
+func GetParamString(dbName, key, def string) string {
+	if value, ok := lookupParam(dbName, key); ok {
+		return value
+	}
+	return def
+}
+
+// GetParamInt returns an integer parameter, or def when it is not set or invalid
+func GetParamInt(dbName, key string, def int) int {
+	if value, ok := lookupParam(dbName, key); ok {
+		if parsed, err := strconv.Atoi(strings.TrimSpace(value)); err == nil {
+			return parsed
+		}
+	}
+	return def
+}
+
+// GetParamBool returns a boolean parameter, or def when it is not set or invalid
+func GetParamBool(dbName, key string, def bool) bool {
+	if value, ok := lookupParam(dbName, key); ok {
+		if parsed, err := strconv.ParseBool(strings.TrimSpace(value)); err == nil {
+			return parsed
+		}
+	}
+	return def
+}
+
+// GetParamJSON decodes a JSON parameter into dest and reports whether it was
+// set and valid; dest is left untouched otherwise, so it can hold the default
+func GetParamJSON(dbName, key string, dest interface{}) bool {
+	value, ok := lookupParam(dbName, key)
+	if !ok {
+		return false
+	}
+	return json.Unmarshal([]byte(value), dest) == nil
+}
+
+// ParamValidator checks the text value of a parameter before it is written
+type ParamValidator func(value string) error
+
+var (
+	paramValidators     = make(map[string]ParamValidator)
+	paramValidatorsLock sync.RWMutex
+)
+
+// RegisterParamValidator sets the validator of a parameter, registered by
+// the subsystem reading it; SetParams refuses values it rejects
+func RegisterParamValidator(key string, validator ParamValidator) {
+	paramValidatorsLock.Lock()
+	defer paramValidatorsLock.Unlock()
+	paramValidators[key] = validator
+}
+
+// ParamValidationError is returned by SetParams when a value is refused
+type ParamValidationError struct {
+	Key string
+	Err error
+}
+
+func (e *ParamValidationError) Error() string {
+	return fmt.Sprintf("invalid value for %s: %v", e.Key, e.Err)
+}
+
+func (e *ParamValidationError) Unwrap() error {
+	return e.Err
+}
+
+// ValidateParam runs the validator of a parameter, if any
+func ValidateParam(key, value string) error {
+	paramValidatorsLock.RLock()
+	validator := paramValidators[key]
+	paramValidatorsLock.RUnlock()
+	if validator == nil {
+		return nil
+	}
+	if err := validator(value); err != nil {
+		return &ParamValidationError{Key: key, Err: err}
+	}
+	return nil
+}
+
+// encodeParam returns the text stored for a value: strings as they are,
+// other values as JSON
+func encodeParam(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded), nil
+}
+
+// SetParam creates or updates a parameter. Values other than strings are
+// stored as JSON. Other processes are told to reload through NOTIFY.
+func SetParam(db *gorm.DB, dbName string, uid uint, key string, value interface{}) error {
+	_, err := SetParams(db, dbName, uid, map[string]interface{}{key: value})
+	return err
+}
+
+// SetParams writes parameters together: a nil value deletes its parameter,
+// other values are stored as by SetParam. Every value is validated first
+// and all keys are written in one transaction, recorded in the parameter
+// history as one change, whose id is returned; on any error no key is
+// changed. The cache is invalidated, and other processes notified, only
+// once the transaction is committed; when db is already a transaction
+// that is when it commits, so callers must not keep it open long.
+func SetParams(db *gorm.DB, dbName string, uid uint, values map[string]interface{}) (uint, error) {
+	texts := make(map[string]*string, len(values))
+	for key, value := range values {
+		if value == nil {
+			texts[key] = nil
+			continue
+		}
+		text, err := encodeParam(value)
+		if err != nil {
+			return 0, fmt.Errorf("cannot encode %s: %w", key, err)
+		}
+		texts[key] = &text
+	}
+	return writeParams(db, dbName, uid, texts, 0)
+}
+
+// writeParams validates and writes text values, nil deleting, as a change
+// of the parameter history rolling back rollbackOf when not 0
+func writeParams(db *gorm.DB, dbName string, uid uint, texts map[string]*string, rollbackOf uint) (uint, error) {
+	keys := make([]string, 0, len(texts))
+	for key, text := range texts {
+		if text != nil {
+			if err := ValidateParam(key, *text); err != nil {
+				return 0, err
+			}
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	sort.Strings(keys)
+
+	var changeID uint
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var existing []IrConfigParameter
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("key IN ?", keys).Find(&existing).Error
+		if err != nil {
+			return err
+		}
+		old := make(map[string]IrConfigParameter, len(existing))
+		for _, param := range existing {
+			old[param.Key] = param
+		}
+
+		now := time.Now()
+		history := make([]ParameterHistory, 0, len(keys))
+		for _, key := range keys {
+			text := texts[key]
+			previous, existed := old[key]
+			if text == nil {
+				if !existed {
+					continue
+				}
+				if err := tx.Delete(&previous).Error; err != nil {
+					return err
+				}
+			} else {
+				if existed && previous.Value == *text {
+					continue
+				}
+				param := IrConfigParameter{Key: key, Value: *text, WriteUID: uid}
+				err := tx.Clauses(clause.OnConflict{
+					Columns:   []clause.Column{{Name: "key"}},
+					DoUpdates: clause.AssignmentColumns([]string{"value", "write_uid", "write_date"}),
+				}).Create(&param).Error
+				if err != nil {
+					return err
+				}
+			}
+			var oldValue *string
+			if existed {
+				oldValue = &previous.Value
+			}
+			sensitive := IrConfigParameter{Key: key, Sensitive: previous.Sensitive}.IsSensitive()
+			history = append(history, newParameterHistory(key, oldValue, text, sensitive, uid, rollbackOf, now))
+		}
+		if len(history) == 0 {
+			return nil
+		}
+
+		if err := recordParameterChange(tx, history); err != nil {
+			return err
+		}
+		changeID = history[0].ChangeID
+		return database.Notify(tx, configParameterChannel, dbName)
+	})
+	if err != nil {
+		return 0, err
+	}
+	InvalidateParams(dbName)
+	return changeID, nil
+}
+
+// ListConfigParameters returns the stored parameters, sensitive values redacted
+func ListConfigParameters(db *gorm.DB) ([]IrConfigParameter, error) {
+	var params []IrConfigParameter
+	if err := db.Order("key").Find(&params).Error; err != nil {
+		return nil, err
+	}
+	for i := range params {
+		params[i] = params[i].Redacted()
+	}
+	return params, nil
+}
+
+// ListenConfigParameters invalidates the cached parameters of a database
+// when another process writes them, until ctx is done
+func ListenConfigParameters(ctx context.Context, dbName string) {
+	database.Listen(ctx, dbName, configParameterChannel, func(string) {
+		InvalidateParams(dbName)
+	})
+}
@@ -0,0 +1,138 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"goodoo/crypto"
+	"gorm.io/gorm"
+)
+
+// ParameterHistory records a change of a system parameter. The keys
+// written together by SetParams share a ChangeID, the id of the first of
+// their records, which identifies the change for rollbacks.
+type ParameterHistory struct {
+	ID       uint   `gorm:"primaryKey;autoIncrement" json:"id"`
+	ChangeID uint   `gorm:"not null;index" json:"change_id"`
+	Key      string `gorm:"not null;index" json:"key"`
+	// OldValue is nil when the parameter was not set, NewValue when it was
+	// deleted; both are RedactedValue for sensitive parameters
+	OldValue  *string `gorm:"type:text" json:"old_value"`
+	NewValue  *string `gorm:"type:text" json:"new_value"`
+	Sensitive bool    `gorm:"not null;default:false" json:"sensitive"`
+	// OldSecret keeps the previous value of a sensitive parameter,
+	// encrypted, so that a rollback can restore it
+	OldSecret crypto.EncryptedString `gorm:"column:old_secret" json:"-"`
+	// RollbackOf is the change this one rolled back, 0 for edits
+	RollbackOf uint      `gorm:"not null;default:0" json:"rollback_of,omitempty"`
+	UserID     uint      `gorm:"not null;default:0" json:"user_id"`
+	CreateDate time.Time `gorm:"not null;index" json:"create_date"`
+}
+
+func (ParameterHistory) TableName() string {
+	return "ir_config_parameter_history"
+}
+
+// ErrChangeNotFound is returned when rolling back an unknown change
+var ErrChangeNotFound = errors.New("parameter change not found")
+
+// newParameterHistory returns the record of a change of key from oldValue
+// to newValue, redacted when the parameter is sensitive
+func newParameterHistory(key string, oldValue, newValue *string, sensitive bool, uid, rollbackOf uint, now time.Time) ParameterHistory {
+	record := ParameterHistory{Key: key, OldValue: oldValue, NewValue: newValue, Sensitive: sensitive, RollbackOf: rollbackOf, UserID: uid, CreateDate: now}
+	if sensitive {
+		if oldValue != nil {
+			record.OldSecret = crypto.EncryptedString(*oldValue)
+			record.OldValue = redactedValue()
+		}
+		if newValue != nil {
+			record.NewValue = redactedValue()
+		}
+	}
+	return record
+}
+
+// redactedValue returns a pointer to a new RedactedValue
+func redactedValue() *string {
+	value := RedactedValue
+	return &value
+}
+
+// recordParameterChange creates the records of a change, the first one
+// giving its id to the others
+func recordParameterChange(tx *gorm.DB, records []ParameterHistory) error {
+	if err := tx.Create(&records[0]).Error; err != nil {
+		return err
+	}
+	records[0].ChangeID = records[0].ID
+	if err := tx.Model(&records[0]).Update("change_id", records[0].ChangeID).Error; err != nil {
+		return err
+	}
+	if len(records) == 1 {
+		return nil
+	}
+	for i := range records[1:] {
+		records[i+1].ChangeID = records[0].ChangeID
+	}
+	return tx.Create(records[1:]).Error
+}
+
+// ParameterHistoryFilter selects parameter history records; zero fields
+// do not filter
+type ParameterHistoryFilter struct {
+	Key      string
+	ChangeID uint
+	From     time.Time
+	To       time.Time
+	Limit    int
+}
+
+// ListParameterHistory returns the parameter history records matching a
+// filter, newest first
+func ListParameterHistory(db *gorm.DB, filter ParameterHistoryFilter) ([]ParameterHistory, error) {
+	query := db.Order("id DESC")
+	if filter.Key != "" {
+		query = query.Where("key = ?", filter.Key)
+	}
+	if filter.ChangeID != 0 {
+		query = query.Where("change_id = ?", filter.ChangeID)
+	}
+	if !filter.From.IsZero() {
+		query = query.Where("create_date >= ?", filter.From)
+	}
+	if !filter.To.IsZero() {
+		query = query.Where("create_date < ?", filter.To)
+	}
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit)
+	}
+	var records []ParameterHistory
+	err := query.Find(&records).Error
+	return records, err
+}
+
+// RollbackParams restores the values the parameters of a change had
+// before it, deleting those it created. The values are validated and
+// written as by SetParams, as a new change whose id is returned.
+func RollbackParams(db *gorm.DB, dbName string, uid, changeID uint) (uint, error) {
+	records, err := ListParameterHistory(db, ParameterHistoryFilter{ChangeID: changeID})
+	if err != nil {
+		return 0, err
+	}
+	if len(records) == 0 {
+		return 0, ErrChangeNotFound
+	}
+	texts := make(map[string]*string, len(records))
+	for _, record := range records {
+		switch {
+		case record.OldValue == nil:
+			texts[record.Key] = nil
+		case record.Sensitive:
+			secret := string(record.OldSecret)
+			texts[record.Key] = &secret
+		default:
+			texts[record.Key] = record.OldValue
+		}
+	}
+	return writeParams(db, dbName, uid, texts, changeID)
+}
@@ -0,0 +1,436 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"goodoo/fields"
+	"gorm.io/gorm"
+)
+
+// Kinds of model constraints
+const (
+	ConstraintUnique = "unique"
+	ConstraintCheck  = "check"
+)
+
+// Constraint is a table constraint of a model (like Odoo's
+// _sql_constraints): a unique over several fields or a CHECK expression
+// over the fields of a record. Its name, prefixed with the table, names it
+// in the database, where its definition is kept as a comment so that
+// SyncSchemas replaces it when it changes.
+type Constraint struct {
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+	// Fields are the fields of a unique constraint, together unique; a
+	// record with one of them empty is never a duplicate
+	Fields []string `json:"fields,omitempty"`
+	// Check is the SQL expression of a check constraint, over the stored
+	// fields of the model
+	Check string `json:"check,omitempty"`
+	// Message explains a violation to users
+	Message string `json:"message,omitempty"`
+}
+
+// ConstraintError refuses values violating a constraint of a model. For a
+// unique constraint, ConflictID is the record already holding the values.
+type ConstraintError struct {
+	Model        string   `json:"model"`
+	Constraint   string   `json:"constraint"`
+	Kind         string   `json:"kind"`
+	Message      string   `json:"message,omitempty"`
+	Fields       []string `json:"fields,omitempty"`
+	ConflictID   uint     `json:"conflict_id,omitempty"`
+	ConflictName string   `json:"conflict_name,omitempty"`
+}
+
+func (e *ConstraintError) Error() string {
+	message := e.Message
+	if message == "" {
+		message = fmt.Sprintf("%s constraint %s violated", e.Kind, e.Constraint)
+	}
+	if e.ConflictID != 0 {
+		return fmt.Sprintf("%s: %s (%d) has the same %s", message, e.ConflictName, e.ConflictID, strings.Join(e.Fields, ", "))
+	}
+	return message
+}
+
+// AddUniqueConstraint declares that the values of fieldNames are together
+// unique among the records of the model
+func (m *ModelDefinition) AddUniqueConstraint(name string, fieldNames []string, message string) {
+	m.Constraints = append(m.Constraints, Constraint{Name: name, Kind: ConstraintUnique, Fields: fieldNames, Message: message})
+}
+
+// AddCheckConstraint declares an SQL expression every record of the model
+// must satisfy, e.g. "quantity > 0"
+func (m *ModelDefinition) AddCheckConstraint(name, check, message string) {
+	m.Constraints = append(m.Constraints, Constraint{Name: name, Kind: ConstraintCheck, Check: check, Message: message})
+}
+
+// fieldConstraints returns the names of the constraints over a field
+func (m *ModelDefinition) fieldConstraints(field string) []string {
+	var names []string
+	for _, c := range m.Constraints {
+		if slices.Contains(c.Fields, field) || c.Kind == ConstraintCheck && checkUsesField(c.Check, field) {
+			names = append(names, c.Name)
+		}
+	}
+	return names
+}
+
+// checkUsesField reports whether a check expression names a field
+func checkUsesField(check, field string) bool {
+	words := strings.FieldsFunc(check, func(r rune) bool {
+		return r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	return slices.Contains(words, field)
+}
+
+// constraintName returns the database name of a constraint of a table
+func constraintName(table, name string) string {
+	return table + "__" + name
+}
+
+// Definition returns the SQL definition of the constraint, as in ADD
+// CONSTRAINT
+func (c Constraint) Definition() string {
+	if c.Kind == ConstraintUnique {
+		quoted := make([]string, len(c.Fields))
+		for i, name := range c.Fields {
+			quoted[i] = QuoteIdentifier(name)
+		}
+		return "UNIQUE (" + strings.Join(quoted, ", ") + ")"
+	}
+	return "CHECK (" + c.Check + ")"
+}
+
+// validateConstraints checks the constraints of the model against its
+// stored fields
+func (m *ModelDefinition) validateConstraints() error {
+	stored := m.GetStoredFields()
+	seen := make(map[string]bool, len(m.Constraints))
+	for _, c := range m.Constraints {
+		if !isIdentifier(c.Name) || !isName(constraintName(m.TableName, c.Name)) {
+			return fmt.Errorf("model %s: invalid constraint name %q", m.Name, c.Name)
+		}
+		if seen[c.Name] {
+			return fmt.Errorf("model %s: constraint %s is declared twice", m.Name, c.Name)
+		}
+		seen[c.Name] = true
+		switch c.Kind {
+		case ConstraintUnique:
+			if len(c.Fields) == 0 {
+				return fmt.Errorf("model %s: unique constraint %s has no fields", m.Name, c.Name)
+			}
+			for _, name := range c.Fields {
+				if _, ok := stored[name]; !ok {
+					return fmt.Errorf("model %s: unique constraint %s: no stored field %s", m.Name, c.Name, name)
+				}
+			}
+		case ConstraintCheck:
+			if err := checkExpressionFields(c.Check, stored); err != nil {
+				return fmt.Errorf("model %s: check constraint %s: %w", m.Name, c.Name, err)
+			}
+		default:
+			return fmt.Errorf("model %s: constraint %s has unknown kind %q", m.Name, c.Name, c.Kind)
+		}
+	}
+	return nil
+}
+
+// checkKeywords are the words a check expression may use besides field
+// names
+var checkKeywords = map[string]bool{
+	"and": true, "or": true, "not": true, "is": true, "null": true, "true": true, "false": true,
+	"in": true, "between": true, "like": true, "ilike": true, "similar": true, "to": true,
+	"case": true, "when": true, "then": true, "else": true, "end": true, "distinct": true, "from": true,
+}
+
+// checkFunctions are the functions a check expression may call
+var checkFunctions = map[string]bool{
+	"coalesce": true, "nullif": true, "length": true, "char_length": true, "lower": true,
+	"upper": true, "trim": true, "btrim": true, "abs": true, "round": true, "greatest": true,
+	"least": true, "date_trunc": true, "num_nonnulls": true, "num_nulls": true,
+}
+
+// checkExpressionFields checks that an expression only uses the fields of
+// stored, literals, operators and a few keywords and functions: no
+// subquery, statement separator or comment
+func checkExpressionFields(check string, stored map[string]fields.Field) error {
+	if strings.TrimSpace(check) == "" {
+		return errors.New("empty expression")
+	}
+	if strings.Contains(check, ";") || strings.Contains(check, "--") || strings.Contains(check, "/*") || strings.Contains(check, `"`) {
+		return errors.New("the expression cannot contain ;, \", or comments")
+	}
+	depth := 0
+	for i := 0; i < len(check); {
+		r := check[i]
+		switch {
+		case r == '\'':
+			end := strings.IndexByte(check[i+1:], '\'')
+			if end < 0 {
+				return errors.New("unterminated string")
+			}
+			i += end + 2
+		case r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z':
+			start := i
+			for i < len(check) && (check[i] == '_' || check[i] >= 'a' && check[i] <= 'z' || check[i] >= 'A' && check[i] <= 'Z' || check[i] >= '0' && check[i] <= '9') {
+				i++
+			}
+			word := check[start:i]
+			lower := strings.ToLower(word)
+			rest := strings.TrimLeft(check[i:], " \t\n")
+			switch {
+			case strings.HasSuffix(strings.TrimRight(check[:start], " \t\n"), "::"):
+				// A cast: the word is a type
+			case strings.HasPrefix(rest, "("):
+				if !checkFunctions[lower] {
+					return fmt.Errorf("function %s is not allowed", word)
+				}
+			case checkKeywords[lower]:
+			default:
+				if _, ok := stored[word]; !ok {
+					return fmt.Errorf("no stored field %s", word)
+				}
+			}
+		case r >= '0' && r <= '9':
+			// A number, exponent included
+			for i < len(check) && (check[i] == '.' || check[i] == '_' || check[i] >= '0' && check[i] <= '9' || check[i] >= 'a' && check[i] <= 'z' || check[i] >= 'A' && check[i] <= 'Z') {
+				i++
+			}
+		case r == '(':
+			depth++
+			i++
+		case r == ')':
+			if depth--; depth < 0 {
+				return errors.New("unbalanced parentheses")
+			}
+			i++
+		default:
+			i++
+		}
+	}
+	if depth != 0 {
+		return errors.New("unbalanced parentheses")
+	}
+	return nil
+}
+
+// constraintSchema returns the constraint clauses of CREATE TABLE
+func (m *ModelDefinition) constraintSchema() []string {
+	clauses := make([]string, 0, len(m.Constraints))
+	for _, c := range m.Constraints {
+		clauses = append(clauses, fmt.Sprintf("CONSTRAINT %s %s", constraintName(m.TableName, c.Name), c.Definition()))
+	}
+	return clauses
+}
+
+// constraintCommentSQL records the definition of a constraint on it
+func constraintCommentSQL(table, name, definition string) string {
+	return fmt.Sprintf("COMMENT ON CONSTRAINT %s ON %s IS '%s'", name, table, strings.ReplaceAll(definition, "'", "''"))
+}
+
+// existingConstraint is a unique or check constraint of a live table and
+// the definition commented on it
+type existingConstraint struct {
+	Kind       string
+	Definition string
+}
+
+// existingConstraints returns constraint name -> constraint for the unique
+// and check constraints of a table
+func existingConstraints(db *gorm.DB, table string) (map[string]existingConstraint, error) {
+	var rows []struct {
+		Name       string
+		Kind       string
+		Definition string
+	}
+	query := `
+		SELECT con.conname AS name, con.contype::text AS kind,
+		       COALESCE(obj_description(con.oid, 'pg_constraint'), '') AS definition
+		FROM pg_constraint con
+		JOIN pg_class c ON c.oid = con.conrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE con.contype IN ('u', 'c') AND c.relname = ? AND n.nspname = current_schema()`
+	if err := db.Raw(query, table).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	constraints := make(map[string]existingConstraint, len(rows))
+	for _, row := range rows {
+		constraints[row.Name] = existingConstraint{Kind: row.Kind, Definition: row.Definition}
+	}
+	return constraints, nil
+}
+
+// constraintChanges compares the constraints of the model against the live
+// table: missing ones are added, changed ones replaced in one statement,
+// so a definition the rows violate leaves the former one in place, and
+// the constraints SyncSchemas created that are no longer declared are
+// dropped
+func (m *ModelDefinition) constraintChanges(db *gorm.DB, created bool) ([]SchemaChange, error) {
+	existing := map[string]existingConstraint{}
+	if !created {
+		var err error
+		if existing, err = existingConstraints(db, m.TableName); err != nil {
+			return nil, err
+		}
+	}
+
+	var changes []SchemaChange
+	declared := make(map[string]bool, len(m.Constraints))
+	for _, c := range m.Constraints {
+		name := constraintName(m.TableName, c.Name)
+		definition := c.Definition()
+		declared[name] = true
+		comment := SchemaChange{
+			Model: m.Name, Kind: "comment_constraint", Table: m.TableName, Name: name,
+			SQL: constraintCommentSQL(m.TableName, name, definition),
+		}
+		current, exists := existing[name]
+		switch {
+		case created:
+			// CREATE TABLE declared it
+			changes = append(changes, comment)
+		case !exists:
+			changes = append(changes, SchemaChange{
+				Model: m.Name, Kind: "add_constraint", Table: m.TableName, Name: name,
+				SQL: fmt.Sprintf("ALTER TABLE %s ADD CONSTRAINT %s %s", m.TableName, name, definition),
+			}, comment)
+		case current.Definition != definition:
+			changes = append(changes, SchemaChange{
+				Model: m.Name, Kind: "alter_constraint", Table: m.TableName, Name: name,
+				SQL: fmt.Sprintf("ALTER TABLE %s DROP CONSTRAINT %s, ADD CONSTRAINT %s %s", m.TableName, name, name, definition),
+			}, comment)
+		}
+	}
+
+	var stale []string
+	for name, current := range existing {
+		if !declared[name] && current.Definition != "" && strings.HasPrefix(name, m.TableName+"__") {
+			stale = append(stale, name)
+		}
+	}
+	sort.Strings(stale)
+	for _, name := range stale {
+		changes = append(changes, SchemaChange{
+			Model: m.Name, Kind: "drop_constraint", Table: m.TableName, Name: name,
+			SQL: fmt.Sprintf("ALTER TABLE %s DROP CONSTRAINT IF EXISTS %s", m.TableName, name),
+		})
+	}
+	return changes, nil
+}
+
+// checkUniqueConstraints fails with a ConstraintError naming the record
+// already holding the values a create (ids empty) or a write of ids would
+// give to the fields of a unique constraint. columns are the converted
+// values written.
+func (m *ModelDefinition) checkUniqueConstraints(tx *gorm.DB, ids []uint, columns map[string]interface{}) error {
+	for _, c := range m.Constraints {
+		if c.Kind != ConstraintUnique {
+			continue
+		}
+		touched := len(ids) == 0
+		for _, name := range c.Fields {
+			_, written := columns[name]
+			touched = touched || written
+		}
+		if !touched {
+			continue
+		}
+
+		// The values of each record after the write
+		var records []map[string]interface{}
+		if len(ids) == 0 {
+			records = []map[string]interface{}{columns}
+		} else {
+			if err := tx.Table(m.TableName).Select(append([]string{"id"}, c.Fields...)).Where("id IN ?", ids).Find(&records).Error; err != nil {
+				return err
+			}
+			for _, record := range records {
+				for name, value := range columns {
+					if _, ok := record[name]; ok {
+						record[name] = value
+					}
+				}
+			}
+		}
+
+		seen := make(map[string]uint, len(records))
+		for _, record := range records {
+			query := tx.Table(m.TableName).Select("id")
+			key := make([]string, 0, len(c.Fields))
+			complete := true
+			for _, name := range c.Fields {
+				value := record[name]
+				if value == nil {
+					complete = false
+					break
+				}
+				query = query.Where(QuoteIdentifier(name)+" = ?", value)
+				key = append(key, fmt.Sprint(value))
+			}
+			if !complete {
+				continue
+			}
+			id := toUint(record["id"])
+			// Records of the write given the same values
+			if other, ok := seen[strings.Join(key, "\x00")]; ok {
+				return m.constraintError(tx, c, other)
+			}
+			seen[strings.Join(key, "\x00")] = id
+
+			if len(ids) > 0 {
+				query = query.Where("id NOT IN ?", ids)
+			}
+			var conflicts []uint
+			if err := query.Limit(1).Pluck("id", &conflicts).Error; err != nil {
+				return err
+			}
+			if len(conflicts) > 0 {
+				return m.constraintError(tx, c, conflicts[0])
+			}
+		}
+	}
+	return nil
+}
+
+// constraintError returns the error of a violation of a constraint, with
+// the conflicting record when known
+func (m *ModelDefinition) constraintError(tx *gorm.DB, c Constraint, conflictID uint) *ConstraintError {
+	e := &ConstraintError{Model: m.Name, Constraint: c.Name, Kind: c.Kind, Message: c.Message, Fields: c.Fields, ConflictID: conflictID}
+	if conflictID != 0 {
+		if recName := m.RecNameField(); recName != "" {
+			var names []string
+			if tx.Table(m.TableName).Where("id = ?", conflictID).Pluck(QuoteIdentifier(recName), &names).Error == nil && len(names) > 0 {
+				e.ConflictName = names[0]
+			}
+		}
+		if e.ConflictName == "" {
+			e.ConflictName = fmt.Sprintf("%s,%d", m.Name, conflictID)
+		}
+	}
+	return e
+}
+
+// translateConstraintError turns a violation of a declared constraint
+// reported by the database, such as a check constraint or a unique one
+// lost to a concurrent write, into a ConstraintError
+func (m *ModelDefinition) translateConstraintError(err error) error {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) || (pgErr.Code != "23505" && pgErr.Code != "23514") {
+		return err
+	}
+	for _, c := range m.Constraints {
+		if constraintName(m.TableName, c.Name) == pgErr.ConstraintName {
+			return &ConstraintError{Model: m.Name, Constraint: c.Name, Kind: c.Kind, Message: c.Message, Fields: c.Fields}
+		}
+	}
+	return err
+}
@@ -0,0 +1,172 @@
+package models
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// ContextUID is the context key of the environment user, usable as the
+// context default of a field holding a user id
+const ContextUID = "uid"
+
+// ContextDefaultTag is the struct tag naming the context key whose value
+// RecordSet.Create assigns to a zero field, e.g. `context_default:"team_id"`
+const ContextDefaultTag = "context_default"
+
+// ContextValue returns the value of a context key, false when it is absent
+// or null. "uid" is the environment user unless the context sets it.
+func (env *Environment) ContextValue(key string) (interface{}, bool) {
+	if value, ok := env.context[key]; ok && value != nil {
+		return value, true
+	}
+	if key == ContextUID && env.user != 0 {
+		return env.user, true
+	}
+	return nil, false
+}
+
+// DefaultValues returns the defaults of a new record: the static default of
+// each field, replaced by the value of its DefaultExpr expression, itself
+// replaced by the value of the context key the field names in its
+// ContextDefault attribute when the environment has one. Values given on
+// create take precedence over all. An expression that fails or a context
+// value the field cannot convert is ignored.
+func (m *ModelDefinition) DefaultValues(env *Environment) map[string]interface{} {
+	defaults := m.GetDefaultValues()
+	if env == nil {
+		return defaults
+	}
+	for name, field := range m.Fields {
+		if field.GetAttributes().DefaultExpr == "" {
+			continue
+		}
+		value, err := m.evalDefault(env, field)
+		if err != nil {
+			m.Logger.Warning("Ignored default expression of %s.%s: %v", m.Name, name, err)
+			continue
+		}
+		defaults[name] = value
+	}
+	for name, field := range m.Fields {
+		key := field.GetAttributes().ContextDefault
+		if key == "" {
+			continue
+		}
+		value, ok := env.ContextValue(key)
+		if !ok {
+			continue
+		}
+		converted, err := field.ConvertToCache(value, nil)
+		if err != nil {
+			m.Logger.Warning("Ignored context default %s=%v of %s.%s: %v", key, value, m.Name, name, err)
+			continue
+		}
+		defaults[name] = converted
+	}
+	return defaults
+}
+
+// applyContextDefaults sets the zero fields of record tagged with
+// ContextDefaultTag to the value of their context key, converted to the
+// type of the field; record must be a pointer to a struct
+func applyContextDefaults(env *Environment, record reflect.Value) {
+	record = reflect.Indirect(record)
+	if record.Kind() != reflect.Struct {
+		return
+	}
+	recordType := record.Type()
+	for i := 0; i < recordType.NumField(); i++ {
+		structField := recordType.Field(i)
+		key := structField.Tag.Get(ContextDefaultTag)
+		if key == "" || !structField.IsExported() || !record.Field(i).IsZero() {
+			continue
+		}
+		value, ok := env.ContextValue(key)
+		if !ok {
+			continue
+		}
+		if converted, ok := convertContextValue(value, structField.Type); ok {
+			record.Field(i).Set(converted)
+		}
+	}
+}
+
+// convertContextValue converts a context value, e.g. a float64 decoded from
+// the JSON session, to a field type, allocating pointer fields
+func convertContextValue(value interface{}, target reflect.Type) (reflect.Value, bool) {
+	if target.Kind() == reflect.Ptr {
+		converted, ok := convertContextValue(value, target.Elem())
+		if !ok {
+			return reflect.Value{}, false
+		}
+		pointer := reflect.New(target.Elem())
+		pointer.Elem().Set(converted)
+		return pointer, true
+	}
+	source := reflect.ValueOf(value)
+	switch {
+	case source.Kind() == reflect.String && target.Kind() != reflect.String:
+		// Only numbers and strings convert; "3" is not an id
+		return reflect.Value{}, false
+	case source.Kind() == reflect.Float64 && source.Float() != float64(int64(source.Float())) &&
+		target.Kind() != reflect.Float32 && target.Kind() != reflect.Float64:
+		return reflect.Value{}, false
+	case !source.Type().ConvertibleTo(target):
+		return reflect.Value{}, false
+	}
+	return source.Convert(target), true
+}
+
+// ValidContextDefault reports whether a value may be stored as a sticky
+// context default: a string, a number, a boolean, or null to clear it
+func ValidContextDefault(value interface{}) bool {
+	switch value.(type) {
+	case nil, string, float64, bool, int, int64, uint:
+		return true
+	}
+	return false
+}
+
+// ContextDefaults returns the sticky context defaults saved on the user
+func (u *User) ContextDefaults() map[string]interface{} {
+	defaults := make(map[string]interface{})
+	if u.ContextDefaultValues != nil {
+		_ = json.Unmarshal([]byte(*u.ContextDefaultValues), &defaults)
+	}
+	return defaults
+}
+
+// SetContextDefaults merges values into the sticky context defaults of the
+// user; null values remove their key
+func (u *User) SetContextDefaults(values map[string]interface{}) error {
+	defaults := u.ContextDefaults()
+	for key, value := range values {
+		if value == nil {
+			delete(defaults, key)
+		} else {
+			defaults[key] = value
+		}
+	}
+	data, err := json.Marshal(defaults)
+	if err != nil {
+		return err
+	}
+	encoded := string(data)
+	u.ContextDefaultValues = &encoded
+	return nil
+}
+
+// ParseContextDefaultKeys splits a comma-separated list of context keys,
+// dropping the reserved "lang", "tz", "timezone" and "uid"
+func ParseContextDefaultKeys(value string) []string {
+	var keys []string
+	for _, key := range strings.Split(value, ",") {
+		switch key = strings.TrimSpace(key); key {
+		case "", "lang", "tz", "timezone", ContextUID:
+		default:
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
@@ -0,0 +1,85 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// CrashReport is a panic recovered while serving a request or running a
+// background goroutine. Reports with the same Fingerprint, computed from
+// the top frames of the stack, are repeats of one crash.
+type CrashReport struct {
+	ID          uint   `gorm:"primaryKey;autoIncrement" json:"id"`
+	Fingerprint string `gorm:"size:40;not null;index:crash_report_fingerprint,priority:1" json:"fingerprint"`
+	// Message is the panic value
+	Message string `gorm:"type:text;not null" json:"message"`
+	Stack   string `gorm:"type:text;not null" json:"stack"`
+	// Method and Route are empty for goroutines, whose Route is their name
+	RequestID string `gorm:"column:request_id;size:64" json:"request_id,omitempty"`
+	Method    string `gorm:"size:16" json:"method,omitempty"`
+	Route     string `gorm:"type:varchar" json:"route"`
+	Path      string `gorm:"type:varchar" json:"path,omitempty"`
+	UserID    uint   `gorm:"column:user_id" json:"user_id,omitempty"`
+	// Params are the query and path parameters, sensitive values redacted
+	Params     *string   `gorm:"type:jsonb" json:"params,omitempty"`
+	CreateDate time.Time `gorm:"column:create_date;autoCreateTime;index:crash_report_fingerprint,priority:2" json:"create_date"`
+}
+
+func (CrashReport) TableName() string {
+	return "crash_report"
+}
+
+// CrashGroup is the reports of one fingerprint
+type CrashGroup struct {
+	Fingerprint string    `json:"fingerprint"`
+	Count       int64     `json:"count"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+	// Example is the latest report of the group
+	Example CrashReport `json:"example"`
+}
+
+// CrashGroups returns the fingerprints seen since a date, the most recent
+// first, each with its latest report
+func CrashGroups(db *gorm.DB, since time.Time, limit int) ([]CrashGroup, error) {
+	var rows []struct {
+		Fingerprint string
+		Count       int64
+		FirstSeen   time.Time
+		LastSeen    time.Time
+		LatestID    uint
+	}
+	err := db.Model(&CrashReport{}).
+		Select("fingerprint, COUNT(*) AS count, MIN(create_date) AS first_seen, MAX(create_date) AS last_seen, MAX(id) AS latest_id").
+		Where("create_date >= ?", since).Group("fingerprint").
+		Order("last_seen DESC").Limit(limit).Scan(&rows).Error
+	if err != nil || len(rows) == 0 {
+		return nil, err
+	}
+
+	ids := make([]uint, len(rows))
+	for i, row := range rows {
+		ids[i] = row.LatestID
+	}
+	var examples []CrashReport
+	if err := db.Where("id IN ?", ids).Find(&examples).Error; err != nil {
+		return nil, err
+	}
+	byID := make(map[uint]CrashReport, len(examples))
+	for _, example := range examples {
+		byID[example.ID] = example
+	}
+
+	groups := make([]CrashGroup, len(rows))
+	for i, row := range rows {
+		groups[i] = CrashGroup{
+			Fingerprint: row.Fingerprint,
+			Count:       row.Count,
+			FirstSeen:   row.FirstSeen,
+			LastSeen:    row.LastSeen,
+			Example:     byID[row.LatestID],
+		}
+	}
+	return groups, nil
+}
@@ -0,0 +1,52 @@
+package models
+
+import "time"
+
+// Cron run states
+const (
+	CronRunRunning = "running"
+	CronRunDone    = "done"
+	CronRunFailed  = "failed"
+	CronRunSkipped = "skipped"
+)
+
+// IrCron is a scheduled action stored in the database (like Odoo's ir.cron).
+// It calls a function registered in the cron package, looked up as
+// "<model>.<function>" when Model is set, on an interval or a cron expression.
+type IrCron struct {
+	BaseModel
+	Name           string     `gorm:"not null" json:"name"`
+	Model          string     `gorm:"" json:"model"`
+	Function       string     `gorm:"not null" json:"function"`
+	IntervalNumber int        `gorm:"column:interval_number;default:1" json:"interval_number"`
+	IntervalType   string     `gorm:"column:interval_type;default:days" json:"interval_type"`
+	CronExpression string     `gorm:"column:cron_expression" json:"cron_expression"`
+	NextCall       time.Time  `gorm:"column:nextcall;index" json:"nextcall"`
+	LastCall       *time.Time `gorm:"column:lastcall" json:"lastcall"`
+	Active         bool       `gorm:"default:true;index" json:"active"`
+	UserID         uint       `gorm:"column:user_id" json:"user_id"`
+	// CatchUp runs a job once after downtime instead of skipping the missed runs (Odoo's doall)
+	CatchUp bool `gorm:"column:catch_up;default:false" json:"catch_up"`
+	// RunningSince is set while a run is in progress and prevents overlapping runs
+	RunningSince *time.Time `gorm:"column:running_since" json:"running_since"`
+}
+
+func (IrCron) TableName() string {
+	return "ir_cron"
+}
+
+// IrCronRun records one execution of a scheduled action
+type IrCronRun struct {
+	ID         uint       `gorm:"primaryKey;autoIncrement" json:"id"`
+	CronID     uint       `gorm:"column:cron_id;not null;index" json:"cron_id"`
+	State      string     `gorm:"not null" json:"state"`
+	Manual     bool       `gorm:"default:false" json:"manual"`
+	StartedAt  time.Time  `gorm:"column:started_at;index" json:"started_at"`
+	FinishedAt *time.Time `gorm:"column:finished_at" json:"finished_at"`
+	DurationMs int64      `gorm:"column:duration_ms" json:"duration_ms"`
+	Error      string     `gorm:"type:text" json:"error,omitempty"`
+}
+
+func (IrCronRun) TableName() string {
+	return "ir_cron_run"
+}
@@ -0,0 +1,607 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"goodoo/database"
+	"goodoo/fields"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// DefinitionFormat is the version of the format of definition documents;
+// documents of another format are refused
+const DefinitionFormat = 1
+
+// modelDefinitionChannel is the NOTIFY channel announcing imported
+// definitions
+const modelDefinitionChannel = "ir_model_definition"
+
+// ErrInvalidDefinition wraps the errors of documents that cannot be imported
+var ErrInvalidDefinition = errors.New("invalid definition")
+
+// DefinitionDocument is a model definition as a JSON document, to promote
+// field-defined models from one database to another. Fields are keyed by
+// name, so the document of a definition is always the same, and Checksum
+// covers everything else.
+type DefinitionDocument struct {
+	Format      int      `json:"format"`
+	Name        string   `json:"name"`
+	TableName   string   `json:"table_name"`
+	Description string   `json:"description,omitempty"`
+	AutoCreate  bool     `json:"auto_create"`
+	Transient   bool     `json:"transient,omitempty"`
+	Abstract    bool     `json:"abstract,omitempty"`
+	Inherits    []string `json:"inherits,omitempty"`
+	RecName     string   `json:"rec_name,omitempty"`
+	QuickCreate bool     `json:"quick_create"`
+	Taggable    bool     `json:"taggable,omitempty"`
+
+	Bundle []BundleRelation `json:"bundle,omitempty"`
+
+	TransientMaxAge   time.Duration `json:"transient_max_age,omitempty"`
+	TransientMaxCount int           `json:"transient_max_count,omitempty"`
+
+	Fields map[string]FieldDocument `json:"fields"`
+	// Indexes are the indexes the fields declare, for information: they
+	// follow from the index and unique attributes
+	Indexes     []IndexDefinition `json:"indexes,omitempty"`
+	Constraints []Constraint      `json:"constraints,omitempty"`
+
+	// Version counts the imports that changed the definition in the
+	// exporting database, 0 for a definition never imported there
+	Version  int    `json:"version"`
+	Checksum string `json:"checksum"`
+}
+
+// FieldDocument is a field of a definition document, with the settings of
+// its type
+type FieldDocument struct {
+	Type       fields.FieldType         `json:"type"`
+	Attributes fields.FieldAttribute    `json:"attributes"`
+	Size       int                      `json:"size,omitempty"`
+	Digits     *fields.FloatDigits      `json:"digits,omitempty"`
+	Currency   string                   `json:"currency,omitempty"`
+	Selection  []fields.SelectionOption `json:"selection,omitempty"`
+}
+
+// ExportDefinition returns the document of a model definition, its
+// checksum computed
+func ExportDefinition(model *ModelDefinition) *DefinitionDocument {
+	doc := &DefinitionDocument{
+		Format:            DefinitionFormat,
+		Name:              model.Name,
+		TableName:         model.TableName,
+		Description:       model.Description,
+		AutoCreate:        model.AutoCreate,
+		Transient:         model.Transient,
+		Abstract:          model.Abstract,
+		Inherits:          append([]string(nil), model.Inherits...),
+		RecName:           model.RecName,
+		QuickCreate:       model.QuickCreate,
+		Taggable:          model.Taggable,
+		Bundle:            append([]BundleRelation(nil), model.Bundle...),
+		TransientMaxAge:   model.TransientMaxAge,
+		TransientMaxCount: model.TransientMaxCount,
+		Fields:            make(map[string]FieldDocument, len(model.Fields)),
+		Constraints:       append([]Constraint(nil), model.Constraints...),
+	}
+	for name, field := range model.Fields {
+		doc.Fields[name] = fieldDocument(field)
+	}
+	if !model.Abstract {
+		doc.Indexes = model.GetIndexes()
+	}
+	doc.Checksum = doc.ComputeChecksum()
+	return doc
+}
+
+// fieldDocument returns the document of a field
+func fieldDocument(field fields.Field) FieldDocument {
+	doc := FieldDocument{Type: field.GetType(), Attributes: field.GetAttributes()}
+	switch f := field.(type) {
+	case *fields.StringField:
+		doc.Size = f.Size
+	case *fields.FloatField:
+		doc.Digits = f.Digits
+	case *fields.MonetaryField:
+		doc.Digits = f.Digits
+		doc.Currency = f.Currency
+	case *fields.SelectionField:
+		doc.Selection = f.Selection
+	}
+	return doc
+}
+
+// ComputeChecksum returns the SHA-256 of the document without its version
+// and checksum, as JSON with the attributes normalized the way a JSON
+// round trip leaves them
+func (d *DefinitionDocument) ComputeChecksum() string {
+	copied := *d
+	copied.Version = 0
+	copied.Checksum = ""
+	data, _ := json.Marshal(&copied)
+	var normalized interface{}
+	if err := json.Unmarshal(data, &normalized); err == nil {
+		data, _ = json.Marshal(normalized)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Validate checks a document before its import into registry: its format,
+// its checksum when set, field types known to this server and inherited
+// models registered in registry or among pending, the names of the other
+// documents of the import
+func (d *DefinitionDocument) Validate(registry *FieldModelRegistry, pending map[string]bool) error {
+	if d.Format != DefinitionFormat {
+		return fmt.Errorf("model %s: unsupported definition format %d (this server reads format %d)", d.Name, d.Format, DefinitionFormat)
+	}
+	if strings.TrimSpace(d.Name) == "" {
+		return errors.New("definition without a model name")
+	}
+	if !d.Abstract && !isName(d.TableName) {
+		return fmt.Errorf("model %s: invalid table name %q", d.Name, d.TableName)
+	}
+	if d.Checksum != "" && d.Checksum != d.ComputeChecksum() {
+		return fmt.Errorf("model %s: checksum mismatch, the document was modified after its export", d.Name)
+	}
+
+	known := make(map[fields.FieldType]bool)
+	for _, fieldType := range fields.DefaultFieldRegistry.GetAvailableTypes() {
+		known[fieldType] = true
+	}
+	var unknown []string
+	for name, field := range d.Fields {
+		if !isName(name) {
+			return fmt.Errorf("model %s: invalid field name %q", d.Name, name)
+		}
+		if !known[field.Type] {
+			unknown = append(unknown, fmt.Sprintf("%s (%s)", name, field.Type))
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		types := make([]string, 0, len(known))
+		for fieldType := range known {
+			types = append(types, string(fieldType))
+		}
+		sort.Strings(types)
+		return fmt.Errorf("model %s: field types unknown to this server: %s; known types are %s",
+			d.Name, strings.Join(unknown, ", "), strings.Join(types, ", "))
+	}
+	for name, field := range d.Fields {
+		if source := field.Attributes.DefaultExpr; source != "" {
+			if _, err := CompileDefault(field.Type, source); err != nil {
+				return fmt.Errorf("model %s, field %s: invalid default expression: %v", d.Name, name, err)
+			}
+		}
+	}
+	for _, name := range d.Inherits {
+		if _, exists := registry.GetModel(name); !exists && !pending[name] {
+			return fmt.Errorf("model %s inherits unknown model %s", d.Name, name)
+		}
+	}
+	return nil
+}
+
+// Build returns the model definition of a validated document
+func (d *DefinitionDocument) Build() (*ModelDefinition, error) {
+	model := NewModelDefinition(d.Name, d.TableName)
+	model.Description = d.Description
+	model.AutoCreate = d.AutoCreate
+	model.Transient = d.Transient
+	model.Abstract = d.Abstract
+	model.Inherits = append([]string{}, d.Inherits...)
+	model.RecName = d.RecName
+	model.QuickCreate = d.QuickCreate
+	model.Taggable = d.Taggable
+	model.Bundle = append([]BundleRelation(nil), d.Bundle...)
+	model.TransientMaxAge = d.TransientMaxAge
+	model.TransientMaxCount = d.TransientMaxCount
+	model.Constraints = append([]Constraint(nil), d.Constraints...)
+
+	model.Fields = make(map[string]fields.Field, len(d.Fields))
+	for name, doc := range d.Fields {
+		field, err := fields.CreateField(doc.Type, doc.Attributes)
+		if err != nil {
+			return nil, fmt.Errorf("model %s, field %s: %w", d.Name, name, err)
+		}
+		switch f := field.(type) {
+		case *fields.StringField:
+			if doc.Size > 0 {
+				f.Size = doc.Size
+			}
+		case *fields.FloatField:
+			f.Digits = doc.Digits
+		case *fields.MonetaryField:
+			if doc.Digits != nil {
+				f.Digits = doc.Digits
+			}
+			f.Currency = doc.Currency
+		case *fields.SelectionField:
+			f.Selection = append([]fields.SelectionOption{}, doc.Selection...)
+		}
+		field.SetName(name)
+		model.Fields[name] = field
+	}
+	return model, nil
+}
+
+// IrModelDefinition is a definition imported into a database, registered
+// in its model registry whenever the registry is built
+type IrModelDefinition struct {
+	ID       uint   `gorm:"primarykey" json:"id"`
+	Name     string `gorm:"size:128;not null;uniqueIndex" json:"name"`
+	Checksum string `gorm:"size:64;not null" json:"checksum"`
+	Version  int    `gorm:"not null;default:1" json:"version"`
+	// Document is the JSON definition document
+	Document   string    `gorm:"type:text;not null" json:"-"`
+	WriteUID   uint      `json:"write_uid"`
+	CreateDate time.Time `gorm:"autoCreateTime" json:"create_date"`
+	WriteDate  time.Time `gorm:"autoUpdateTime" json:"write_date"`
+}
+
+func (IrModelDefinition) TableName() string {
+	return "ir_model_definition"
+}
+
+// DefinitionVersion returns the version of the definition of a model
+// imported into a database, 0 when it was never imported
+func DefinitionVersion(db *gorm.DB, name string) int {
+	var version int
+	db.Model(&IrModelDefinition{}).Where("name = ?", name).Select("version").Scan(&version)
+	return version
+}
+
+// Kinds of DefinitionChange
+const (
+	DefinitionAddField    = "add_field"
+	DefinitionRemoveField = "remove_field"
+	DefinitionChangeField = "change_field"
+	DefinitionChangeModel = "change_model"
+)
+
+// DefinitionChange is a difference between a registered definition and an
+// imported document
+type DefinitionChange struct {
+	Kind  string `json:"kind"`
+	Field string `json:"field,omitempty"`
+	// Attributes are the attributes that changed, e.g. "required", "size",
+	// "type" or, for the model, "table_name"
+	Attributes  []string `json:"attributes,omitempty"`
+	Destructive bool     `json:"destructive"`
+}
+
+// Statuses of an imported definition
+const (
+	DefinitionNew       = "new"
+	DefinitionChanged   = "changed"
+	DefinitionUnchanged = "unchanged"
+)
+
+// DefinitionDiff is the outcome of the import of a document: the changes
+// to the definition and the schema changes they call for
+type DefinitionDiff struct {
+	Model       string             `json:"model"`
+	Status      string             `json:"status"`
+	Checksum    string             `json:"checksum"`
+	Version     int                `json:"version"`
+	Changes     []DefinitionChange `json:"changes"`
+	Schema      []SchemaChange     `json:"schema"`
+	Destructive bool               `json:"destructive"`
+	Applied     bool               `json:"applied"`
+}
+
+// DiffDefinitions compares the document of the registered definition of a
+// model with an imported one. Removed fields, type changes, shorter char
+// fields and fewer selection values are destructive.
+func DiffDefinitions(current, imported *DefinitionDocument) []DefinitionChange {
+	var changes []DefinitionChange
+	var modelAttributes []string
+	if current.TableName != imported.TableName {
+		modelAttributes = append(modelAttributes, "table_name")
+	}
+	if current.Description != imported.Description {
+		modelAttributes = append(modelAttributes, "description")
+	}
+	if current.AutoCreate != imported.AutoCreate || current.Transient != imported.Transient || current.Abstract != imported.Abstract {
+		modelAttributes = append(modelAttributes, "kind")
+	}
+	if !reflect.DeepEqual(current.Inherits, imported.Inherits) && (len(current.Inherits) > 0 || len(imported.Inherits) > 0) {
+		modelAttributes = append(modelAttributes, "inherits")
+	}
+	if current.RecName != imported.RecName || current.QuickCreate != imported.QuickCreate {
+		modelAttributes = append(modelAttributes, "rec_name")
+	}
+	if current.TransientMaxAge != imported.TransientMaxAge || current.TransientMaxCount != imported.TransientMaxCount {
+		modelAttributes = append(modelAttributes, "transient_limits")
+	}
+	if !reflect.DeepEqual(current.Constraints, imported.Constraints) && (len(current.Constraints) > 0 || len(imported.Constraints) > 0) {
+		modelAttributes = append(modelAttributes, "constraints")
+	}
+	if len(modelAttributes) > 0 {
+		changes = append(changes, DefinitionChange{
+			Kind:        DefinitionChangeModel,
+			Attributes:  modelAttributes,
+			Destructive: current.TableName != imported.TableName,
+		})
+	}
+
+	names := make(map[string]bool)
+	for name := range current.Fields {
+		names[name] = true
+	}
+	for name := range imported.Fields {
+		names[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	for _, name := range sorted {
+		before, existed := current.Fields[name]
+		after, exists := imported.Fields[name]
+		switch {
+		case !existed:
+			changes = append(changes, DefinitionChange{Kind: DefinitionAddField, Field: name})
+		case !exists:
+			changes = append(changes, DefinitionChange{Kind: DefinitionRemoveField, Field: name, Destructive: before.Attributes.Store})
+		default:
+			if attributes, destructive := diffFieldDocuments(before, after); len(attributes) > 0 {
+				changes = append(changes, DefinitionChange{Kind: DefinitionChangeField, Field: name, Attributes: attributes, Destructive: destructive})
+			}
+		}
+	}
+	return changes
+}
+
+// diffFieldDocuments lists the attributes of a field that changed, compared
+// as JSON, and whether the change may lose data
+func diffFieldDocuments(before, after FieldDocument) ([]string, bool) {
+	beforeValues, afterValues := documentValues(before), documentValues(after)
+	keys := make(map[string]bool)
+	for key := range beforeValues {
+		keys[key] = true
+	}
+	for key := range afterValues {
+		keys[key] = true
+	}
+	var attributes []string
+	for key := range keys {
+		if !reflect.DeepEqual(beforeValues[key], afterValues[key]) {
+			attributes = append(attributes, key)
+		}
+	}
+	sort.Strings(attributes)
+
+	destructive := before.Type != after.Type ||
+		(after.Size > 0 && after.Size < before.Size) ||
+		(before.Attributes.Store && !after.Attributes.Store)
+	if after.Type == fields.SelectionType {
+		values := make(map[string]bool, len(after.Selection))
+		for _, option := range after.Selection {
+			values[option.Value] = true
+		}
+		for _, option := range before.Selection {
+			if !values[option.Value] {
+				destructive = true
+			}
+		}
+	}
+	return attributes, destructive
+}
+
+// documentValues flattens a field document into its attributes as JSON
+// values
+func documentValues(doc FieldDocument) map[string]interface{} {
+	data, _ := json.Marshal(doc)
+	var values map[string]interface{}
+	json.Unmarshal(data, &values)
+	if attributes, ok := values["attributes"].(map[string]interface{}); ok {
+		delete(values, "attributes")
+		for key, value := range attributes {
+			values[key] = value
+		}
+	}
+	return values
+}
+
+// ImportOptions controls ImportDefinitions
+type ImportOptions struct {
+	// DryRun only reports the changes
+	DryRun bool
+	// Force applies the destructive schema changes (see SyncOptions)
+	Force bool
+}
+
+// ImportDefinitions validates documents, reports how they change the
+// definitions registered for a database and the schema, then unless
+// dry-running stores them, registers them and syncs the schema. A document
+// identical to the registered definition is left alone. Nothing is applied
+// when a document is invalid.
+func ImportDefinitions(dbName string, db *gorm.DB, uid uint, docs []DefinitionDocument, opts ImportOptions) ([]DefinitionDiff, error) {
+	registry := RegistryForDB(dbName)
+	pending := make(map[string]bool, len(docs))
+	for _, doc := range docs {
+		if pending[doc.Name] {
+			return nil, fmt.Errorf("%w: model %s is defined twice", ErrInvalidDefinition, doc.Name)
+		}
+		pending[doc.Name] = true
+	}
+	for i := range docs {
+		if err := docs[i].Validate(registry, pending); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidDefinition, err)
+		}
+	}
+
+	// The documents are registered in a copy of the registry, in order, so
+	// that they may inherit from each other, for the schema diff
+	candidate := registry.Clone()
+	diffs := make([]DefinitionDiff, len(docs))
+	built := make([]*ModelDefinition, len(docs))
+	for i := range docs {
+		doc := &docs[i]
+		model, err := doc.Build()
+		if err == nil {
+			err = candidate.RegisterModel(model)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidDefinition, err)
+		}
+		diff := DefinitionDiff{Model: doc.Name, Checksum: doc.ComputeChecksum(), Changes: []DefinitionChange{}, Schema: []SchemaChange{}}
+		diff.Version = DefinitionVersion(db, doc.Name)
+		current, exists := registry.GetModel(doc.Name)
+		switch {
+		case !exists:
+			diff.Status = DefinitionNew
+		default:
+			currentDoc := ExportDefinition(current)
+			if currentDoc.Checksum == diff.Checksum {
+				diff.Status = DefinitionUnchanged
+				break
+			}
+			diff.Status = DefinitionChanged
+			// The registered model has the fields it inherits copied in
+			imported := ExportDefinition(model)
+			diff.Changes = DiffDefinitions(currentDoc, imported)
+		}
+		diffs[i] = diff
+		built[i] = model
+	}
+
+	schema, err := candidate.SyncSchemas(db, SyncOptions{DryRun: true})
+	if err != nil {
+		return nil, err
+	}
+	for i := range diffs {
+		collectSchemaChanges(&diffs[i], schema.Changes)
+	}
+	if opts.DryRun {
+		return diffs, nil
+	}
+
+	changed := false
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for i := range docs {
+			if diffs[i].Status == DefinitionUnchanged {
+				continue
+			}
+			changed = true
+			document, err := json.Marshal(ExportDefinition(built[i]))
+			if err != nil {
+				return err
+			}
+			row := IrModelDefinition{Name: docs[i].Name, Checksum: diffs[i].Checksum, Version: 1, Document: string(document), WriteUID: uid}
+			err = tx.Clauses(clause.OnConflict{
+				Columns: []clause.Column{{Name: "name"}},
+				DoUpdates: clause.Assignments(map[string]interface{}{
+					"checksum":   row.Checksum,
+					"document":   row.Document,
+					"write_uid":  uid,
+					"write_date": time.Now(),
+					"version":    gorm.Expr("ir_model_definition.version + 1"),
+				}),
+			}).Create(&row).Error
+			if err != nil {
+				return err
+			}
+			diffs[i].Version = DefinitionVersion(tx, docs[i].Name)
+		}
+		if !changed {
+			return nil
+		}
+		return database.Notify(tx, modelDefinitionChannel, dbName)
+	})
+	if err != nil || !changed {
+		return diffs, err
+	}
+
+	for i, model := range built {
+		if diffs[i].Status != DefinitionUnchanged {
+			if err := registry.RegisterModel(model); err != nil {
+				return diffs, err
+			}
+		}
+	}
+	applied, err := registry.SyncSchemas(db, SyncOptions{Force: opts.Force})
+	if _, checkErr := CheckSchema(dbName, db, registry); checkErr != nil {
+		registry.logger.Error("Failed to check the schema of %s: %v", dbName, checkErr)
+	}
+	for i := range diffs {
+		if diffs[i].Status != DefinitionUnchanged {
+			collectSchemaChanges(&diffs[i], applied.Changes)
+			diffs[i].Applied = true
+		}
+	}
+	return diffs, err
+}
+
+// collectSchemaChanges sets the schema changes of the model of a diff and
+// whether any change is destructive
+func collectSchemaChanges(diff *DefinitionDiff, changes []SchemaChange) {
+	diff.Schema = []SchemaChange{}
+	diff.Destructive = false
+	for _, change := range changes {
+		if change.Model == diff.Model {
+			diff.Schema = append(diff.Schema, change)
+			diff.Destructive = diff.Destructive || change.Destructive
+		}
+	}
+	for _, change := range diff.Changes {
+		diff.Destructive = diff.Destructive || change.Destructive
+	}
+}
+
+// loadDefinitions registers the definitions imported into a database in
+// its registry; a database without the table has none
+func loadDefinitions(dbName string, registry *FieldModelRegistry) {
+	db, err := database.GetDatabase(dbName)
+	if err != nil {
+		return
+	}
+	var rows []IrModelDefinition
+	if err := db.Order("id").Find(&rows).Error; err != nil {
+		registry.logger.Debug("No imported model definitions in %s: %v", dbName, err)
+		return
+	}
+	for _, row := range rows {
+		var doc DefinitionDocument
+		if err := json.Unmarshal([]byte(row.Document), &doc); err != nil {
+			registry.logger.Error("Invalid imported definition of %s in %s: %v", row.Name, dbName, err)
+			continue
+		}
+		model, err := doc.Build()
+		if err == nil {
+			err = registry.RegisterModel(model)
+		}
+		if err != nil {
+			registry.logger.Error("Failed to register the imported definition of %s in %s: %v", row.Name, dbName, err)
+		}
+	}
+}
+
+// ListenModelDefinitions rebuilds the model registry of a database when
+// another process imports definitions, and checks its schema again, until
+// ctx is done
+func ListenModelDefinitions(ctx context.Context, dbName string) {
+	database.Listen(ctx, dbName, modelDefinitionChannel, func(string) {
+		registry := DefaultFieldModelRegistry.RebuildForDatabase(dbName)
+		if db, err := database.GetDatabase(dbName); err == nil {
+			if _, err := CheckSchema(dbName, db, registry); err != nil {
+				registry.logger.Error("Failed to check the schema of %s: %v", dbName, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,175 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+
+	"goodoo/fields"
+	"gorm.io/gorm"
+)
+
+// domainOperators maps domain operators to their SQL form
+var domainOperators = map[string]string{
+	"=":         "=",
+	"!=":        "!=",
+	">":         ">",
+	">=":        ">=",
+	"<":         "<",
+	"<=":        "<=",
+	"like":      "LIKE",
+	"not like":  "NOT LIKE",
+	"ilike":     "ILIKE",
+	"not ilike": "NOT ILIKE",
+	"in":        "IN",
+	"not in":    "NOT IN",
+	// =like and =ilike take the pattern as is
+	"=like":  "LIKE",
+	"=ilike": "ILIKE",
+}
+
+// hierarchy names the table and parent column walked by the child_of and
+// parent_of operators
+type hierarchy struct {
+	table        string
+	parentColumn string
+}
+
+// Domain logical operators, prefixed to their operands like in Odoo:
+// ["|", a, b] is a OR b, ["!", a] is NOT a. Conditions not joined by an
+// operator are ANDed.
+const (
+	DomainAnd = "&"
+	DomainOr  = "|"
+	DomainNot = "!"
+)
+
+// domainCompiler turns domain conditions into SQL
+type domainCompiler struct {
+	domain Domain
+	pos    int
+	valid  func(string) bool
+	tree   *hierarchy
+	tags   *tagScope
+}
+
+// expression compiles the expression starting at the current position
+func (dc *domainCompiler) expression() (string, []interface{}, error) {
+	if dc.pos >= len(dc.domain) {
+		return "", nil, fmt.Errorf("invalid domain: missing operand")
+	}
+	term := dc.domain[dc.pos]
+	dc.pos++
+
+	switch t := term.(type) {
+	case string:
+		switch t {
+		case DomainNot:
+			sql, args, err := dc.expression()
+			if err != nil {
+				return "", nil, err
+			}
+			return "NOT (" + sql + ")", args, nil
+		case DomainAnd, DomainOr:
+			left, leftArgs, err := dc.expression()
+			if err != nil {
+				return "", nil, err
+			}
+			right, rightArgs, err := dc.expression()
+			if err != nil {
+				return "", nil, err
+			}
+			join := " AND "
+			if t == DomainOr {
+				join = " OR "
+			}
+			return "(" + left + ")" + join + "(" + right + ")", append(leftArgs, rightArgs...), nil
+		}
+	case []interface{}:
+		return dc.condition(t)
+	case Domain:
+		return dc.condition(t)
+	}
+	return "", nil, fmt.Errorf("invalid domain condition: %v", term)
+}
+
+// condition compiles a (field, operator, value) leaf
+func (dc *domainCompiler) condition(leaf []interface{}) (string, []interface{}, error) {
+	if len(leaf) != 3 {
+		return "", nil, fmt.Errorf("invalid domain condition: %v", leaf)
+	}
+
+	name, ok := leaf[0].(string)
+	if ok && name == TagField && dc.tags != nil {
+		operator, _ := leaf[1].(string)
+		return tagCondition(dc.tags, operator, leaf[2])
+	}
+	if !ok || !dc.valid(name) {
+		return "", nil, &IdentifierError{Kind: "field", Name: fmt.Sprint(leaf[0])}
+	}
+	field := QuoteIdentifier(name)
+
+	operator, ok := leaf[1].(string)
+	if ok && isHierarchyOperator(operator) {
+		if dc.tree == nil {
+			return "", nil, fmt.Errorf("operator %s requires a parent_id hierarchy", operator)
+		}
+		return hierarchyCondition(dc.tree.table, dc.tree.parentColumn, field, operator, leaf[2])
+	}
+	sqlOperator, known := domainOperators[operator]
+	if !ok || !known {
+		return "", nil, fmt.Errorf("invalid operator in domain: %v", leaf[1])
+	}
+
+	// Numbers decoded as json.Number (see fields.DecodeJSON) are bound as
+	// int64 or float64
+	value := fields.NormalizeNumbers(leaf[2])
+	switch {
+	case value == nil && operator == "=":
+		return field + " IS NULL", nil, nil
+	case value == nil && operator == "!=":
+		return field + " IS NOT NULL", nil, nil
+	case operator == "like" || operator == "ilike" || operator == "not like" || operator == "not ilike":
+		// Like Odoo, (not) like/ilike match substrings
+		return fmt.Sprintf("%s %s ?", field, sqlOperator), []interface{}{fmt.Sprintf("%%%v%%", value)}, nil
+	}
+	return fmt.Sprintf("%s %s ?", field, sqlOperator), []interface{}{value}, nil
+}
+
+// compileDomain returns the SQL condition of a domain, or "" for an empty
+// domain matching every record
+func compileDomain(domain Domain, valid func(string) bool, tree *hierarchy, tags *tagScope) (string, []interface{}, error) {
+	dc := &domainCompiler{domain: domain, valid: valid, tree: tree, tags: tags}
+	var parts []string
+	var args []interface{}
+	for dc.pos < len(domain) {
+		sql, exprArgs, err := dc.expression()
+		if err != nil {
+			return "", nil, err
+		}
+		parts = append(parts, sql)
+		args = append(args, exprArgs...)
+	}
+	switch len(parts) {
+	case 0:
+		return "", nil, nil
+	case 1:
+		return parts[0], args, nil
+	}
+	return "(" + strings.Join(parts, ") AND (") + ")", args, nil
+}
+
+// applyDomain adds the conditions of a domain to the query. Field names are
+// checked with valid, then quoted (see QuoteIdentifier), so they can be
+// safely interpolated; a refused name is an IdentifierError. The
+// hierarchical operators are only accepted when tree is set, and the
+// tag_ids filters (see tagCondition) when tags is.
+func applyDomain(query *gorm.DB, domain Domain, valid func(string) bool, tree *hierarchy, tags *tagScope) (*gorm.DB, error) {
+	sql, args, err := compileDomain(domain, valid, tree, tags)
+	if err != nil {
+		return nil, err
+	}
+	if sql == "" {
+		return query, nil
+	}
+	return query.Where(sql, args...), nil
+}
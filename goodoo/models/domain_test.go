@@ -0,0 +1,91 @@
+package models_test
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"goodoo/models"
+	"goodoo/models/testutil"
+)
+
+func TestSearchDomain(t *testing.T) {
+	env := testutil.NewTestEnvironment(t)
+	country := env.CreateCountry()
+	acme := env.CreatePartner(func(p *models.Partner) { p.Name = "Acme"; p.City = "Brussels" })
+	sales := env.CreatePartner(func(p *models.Partner) {
+		p.Name, p.City = "Acme Sales", "Ghent"
+		p.ParentID, p.CountryID = &acme.ID, &country.ID
+	})
+	desk := env.CreatePartner(func(p *models.Partner) { p.Name, p.City = "Sales Desk", "Ghent"; p.ParentID = &sales.ID })
+	globex := env.CreatePartner(func(p *models.Partner) { p.Name, p.City = "Globex", "Paris" })
+	all := []uint{acme.ID, sales.ID, desk.ID, globex.ID}
+
+	tests := []struct {
+		name   string
+		domain models.Domain
+		want   []uint
+	}{
+		{"empty", models.Domain{}, all},
+		{"equal", models.Domain{[]interface{}{"city", "=", "Ghent"}}, []uint{sales.ID, desk.ID}},
+		{"not equal", models.Domain{[]interface{}{"city", "!=", "Ghent"}}, []uint{acme.ID, globex.ID}},
+		{"ilike matches substrings", models.Domain{[]interface{}{"name", "ilike", "acme"}}, []uint{acme.ID, sales.ID}},
+		{"=ilike takes the pattern as is", models.Domain{[]interface{}{"name", "=ilike", "acme"}}, []uint{acme.ID}},
+		{"in", models.Domain{[]interface{}{"city", "in", []string{"Paris", "Brussels"}}}, []uint{acme.ID, globex.ID}},
+		{"null", models.Domain{[]interface{}{"country_id", "=", nil}}, []uint{acme.ID, desk.ID, globex.ID}},
+		{"not null", models.Domain{[]interface{}{"country_id", "!=", nil}}, []uint{sales.ID}},
+		{"implicit and", models.Domain{
+			[]interface{}{"city", "=", "Ghent"},
+			[]interface{}{"name", "ilike", "desk"},
+		}, []uint{desk.ID}},
+		{"or", models.Domain{
+			models.DomainOr,
+			[]interface{}{"city", "=", "Paris"},
+			[]interface{}{"city", "=", "Brussels"},
+		}, []uint{acme.ID, globex.ID}},
+		{"not", models.Domain{models.DomainNot, []interface{}{"city", "=", "Ghent"}}, []uint{acme.ID, globex.ID}},
+		{"child_of", models.Domain{[]interface{}{"id", models.OperatorChildOf, acme.ID}}, []uint{acme.ID, sales.ID, desk.ID}},
+		{"parent_of", models.Domain{[]interface{}{"id", models.OperatorParentOf, desk.ID}}, []uint{acme.ID, sales.ID, desk.ID}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Only the partners of the test count, whatever the database holds
+			domain := append(models.Domain{[]interface{}{"id", "in", all}}, tt.domain...)
+			found, err := models.Model(env.Environment, models.Partner{}).Search(domain, 0, 0, "id")
+			if err != nil {
+				t.Fatalf("Search(%v): %v", tt.domain, err)
+			}
+			if got := found.Ids(); !slices.Equal(got, tt.want) {
+				t.Errorf("Search(%v) = %v, want %v", tt.domain, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSearchDomainErrors(t *testing.T) {
+	env := testutil.NewTestEnvironment(t)
+
+	tests := []struct {
+		name       string
+		domain     models.Domain
+		identifier bool
+	}{
+		{"unknown field", models.Domain{[]interface{}{"nope", "=", 1}}, true},
+		{"injected field", models.Domain{[]interface{}{"name = name OR 1=1 --", "=", 1}}, true},
+		{"unknown operator", models.Domain{[]interface{}{"name", "~", "x"}}, false},
+		{"short condition", models.Domain{[]interface{}{"name", "="}}, false},
+		{"missing operand", models.Domain{models.DomainOr, []interface{}{"name", "=", "x"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := models.Model(env.Environment, models.Partner{}).Search(tt.domain, 0, 0, "")
+			if err == nil {
+				t.Fatalf("Search(%v) succeeded, want an error", tt.domain)
+			}
+			var identifierErr *models.IdentifierError
+			if got := errors.As(err, &identifierErr); got != tt.identifier {
+				t.Errorf("Search(%v) error %v: IdentifierError %v, want %v", tt.domain, err, got, tt.identifier)
+			}
+		})
+	}
+}
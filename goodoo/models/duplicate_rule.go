@@ -0,0 +1,375 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"goodoo/fields"
+	"goodoo/normalize"
+	"gorm.io/gorm"
+)
+
+// Duplicate match kinds of a rule condition
+const (
+	// MatchExact compares the stored value as is
+	MatchExact = "exact"
+	// MatchEmail compares canonical emails (see normalize.Email)
+	MatchEmail = "email"
+	// MatchText compares texts ignoring case, accents and extra spaces
+	// (see normalize.Text)
+	MatchText = "text"
+	// MatchTrigram compares the trigram similarity of the normalized texts
+	// with a threshold
+	MatchTrigram = "trigram"
+)
+
+// What creating a record matching a duplicate rule does
+const (
+	// DuplicateReport only reports matches to the checks and the import
+	DuplicateReport = "report"
+	// DuplicateWarn creates the record and returns the matches along
+	DuplicateWarn = "warn"
+	// DuplicateBlock refuses to create the record
+	DuplicateBlock = "block"
+)
+
+// Trigram thresholds of duplicate rules. pg_trgm only uses an index for
+// the similarity operator, whose threshold is 0.3 by default, so lower
+// thresholds could not be served by the index.
+const (
+	DefaultTrigramThreshold = 0.6
+	MinTrigramThreshold     = 0.3
+)
+
+// DuplicateMatchLimit is the number of matches returned per rule
+const DuplicateMatchLimit = 10
+
+// DuplicateCondition compares a field of a candidate with the stored
+// records
+type DuplicateCondition struct {
+	Field string `json:"field"`
+	Match string `json:"match"`
+	// Threshold is the minimum similarity of a trigram match, from
+	// MinTrigramThreshold to 1
+	Threshold float64 `json:"threshold,omitempty"`
+}
+
+// DuplicateConditions are the conditions of a rule, stored as JSON
+type DuplicateConditions []DuplicateCondition
+
+// Value encodes the conditions as JSON
+func (c DuplicateConditions) Value() (driver.Value, error) {
+	if c == nil {
+		c = DuplicateConditions{}
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// Scan decodes the JSON conditions
+func (c *DuplicateConditions) Scan(src interface{}) error {
+	switch s := src.(type) {
+	case nil:
+		*c = nil
+		return nil
+	case string:
+		return json.Unmarshal([]byte(s), c)
+	case []byte:
+		return json.Unmarshal(s, c)
+	default:
+		return fmt.Errorf("cannot scan %T into DuplicateConditions", src)
+	}
+}
+
+// DuplicateRule tells when a record of a field model probably duplicates
+// another: its conditions combined with Operator, "and" or "or". The
+// schema sync indexes the normalized keys the active rules compare.
+type DuplicateRule struct {
+	BaseModel
+	Model      string              `gorm:"not null;index" json:"model"`
+	Name       string              `gorm:"not null" json:"name"`
+	Sequence   int                 `gorm:"default:10" json:"sequence"`
+	Active     bool                `gorm:"default:true" json:"active"`
+	Operator   string              `gorm:"not null;default:and" json:"operator"`
+	Conditions DuplicateConditions `gorm:"type:jsonb;not null" json:"conditions"`
+	// Action is DuplicateReport, DuplicateWarn or DuplicateBlock
+	Action string `gorm:"not null;default:report" json:"action"`
+}
+
+func (DuplicateRule) TableName() string {
+	return "duplicate_rule"
+}
+
+// Validate checks the rule against the fields of its model, and fills in
+// the default operator, action and thresholds
+func (r *DuplicateRule) Validate(model *ModelDefinition) error {
+	if strings.TrimSpace(r.Name) == "" {
+		return errors.New("the rule needs a name")
+	}
+	switch r.Operator {
+	case "":
+		r.Operator = "and"
+	case "and", "or":
+	default:
+		return fmt.Errorf("operator must be and or or, not %q", r.Operator)
+	}
+	switch r.Action {
+	case "":
+		r.Action = DuplicateReport
+	case DuplicateReport, DuplicateWarn, DuplicateBlock:
+	default:
+		return fmt.Errorf("action must be %s, %s or %s, not %q", DuplicateReport, DuplicateWarn, DuplicateBlock, r.Action)
+	}
+	if len(r.Conditions) == 0 {
+		return errors.New("the rule needs at least one condition")
+	}
+	for i := range r.Conditions {
+		condition := &r.Conditions[i]
+		field, ok := model.Fields[condition.Field]
+		if !ok || !field.IsStored() || IsMagicColumn(condition.Field) || field.GetType() == fields.BinaryType {
+			return fmt.Errorf("%s has no comparable field %q", model.Name, condition.Field)
+		}
+		switch condition.Match {
+		case MatchExact:
+		case MatchEmail, MatchText, MatchTrigram:
+			if fieldType := field.GetType(); fieldType != fields.StringType && fieldType != fields.TextType {
+				return fmt.Errorf("field %q must be a char or text field for a %s match", condition.Field, condition.Match)
+			}
+		default:
+			return fmt.Errorf("unknown match %q of field %q", condition.Match, condition.Field)
+		}
+		if condition.Match == MatchTrigram {
+			if condition.Threshold == 0 {
+				condition.Threshold = DefaultTrigramThreshold
+			}
+			if condition.Threshold < MinTrigramThreshold || condition.Threshold > 1 {
+				return fmt.Errorf("the threshold of field %q must be between %v and 1", condition.Field, MinTrigramThreshold)
+			}
+		} else {
+			condition.Threshold = 0
+		}
+	}
+	return nil
+}
+
+// indexes returns the indexes serving the conditions of the rule
+func (r *DuplicateRule) indexes(model *ModelDefinition) []IndexDefinition {
+	var indexes []IndexDefinition
+	for _, condition := range r.Conditions {
+		idx := IndexDefinition{
+			Name:   fmt.Sprintf("%s__%s_%s_match", model.TableName, condition.Field, condition.Match),
+			Table:  model.TableName,
+			Column: condition.Field,
+			Type:   fields.IndexBtree,
+		}
+		switch condition.Match {
+		case MatchEmail:
+			idx.Expression = normalize.EmailSQL(condition.Field)
+		case MatchText:
+			idx.Expression = normalize.TextSQL(condition.Field)
+		case MatchTrigram:
+			idx.Expression = normalize.TextSQL(condition.Field)
+			idx.Type = fields.IndexTrigram
+		}
+		indexes = append(indexes, idx)
+	}
+	return indexes
+}
+
+// duplicateRuleIndexes returns the indexes of the active duplicate rules
+// of a database by model, none before the rule table exists
+func duplicateRuleIndexes(db *gorm.DB, registry *FieldModelRegistry) (map[string][]IndexDefinition, error) {
+	if !db.Migrator().HasTable(&DuplicateRule{}) {
+		return nil, nil
+	}
+	var rules []DuplicateRule
+	if err := db.Where("active = ?", true).Order("id").Find(&rules).Error; err != nil {
+		return nil, err
+	}
+
+	byModel := make(map[string][]IndexDefinition)
+	seen := make(map[string]bool)
+	for i := range rules {
+		model, ok := registry.GetModel(rules[i].Model)
+		if !ok || model.Abstract {
+			continue
+		}
+		for _, idx := range rules[i].indexes(model) {
+			if !seen[idx.Name] {
+				seen[idx.Name] = true
+				byModel[model.Name] = append(byModel[model.Name], idx)
+			}
+		}
+	}
+	for name := range byModel {
+		indexes := byModel[name]
+		sort.Slice(indexes, func(i, j int) bool { return indexes[i].Name < indexes[j].Name })
+	}
+	return byModel, nil
+}
+
+// DuplicateMatch is a stored record a candidate probably duplicates,
+// found by a rule. Score is 1 for equal values, else the similarity of
+// the least similar field ("and") or the most similar one ("or").
+type DuplicateMatch struct {
+	ID     uint    `json:"id"`
+	Name   string  `json:"name"`
+	Score  float64 `json:"score"`
+	RuleID uint    `json:"rule_id"`
+	Rule   string  `json:"rule"`
+	Action string  `json:"action"`
+}
+
+// DuplicateError refuses a record matching a blocking duplicate rule
+type DuplicateError struct {
+	Model   string
+	Matches []DuplicateMatch
+}
+
+func (e *DuplicateError) Error() string {
+	match := e.Matches[0]
+	return fmt.Sprintf("%s duplicates %s (%d) according to rule %s", e.Model, match.Name, match.ID, match.Rule)
+}
+
+// CheckDuplicates returns the records matching a candidate, given as
+// create values, under the active duplicate rules of the model, by rule
+// sequence then score. excludeID leaves a stored candidate out of its own
+// matches.
+func (m *ModelDefinition) CheckDuplicates(env *Environment, vals map[string]interface{}, excludeID uint) ([]DuplicateMatch, error) {
+	if err := m.checkConcrete(); err != nil {
+		return nil, err
+	}
+	var rules []DuplicateRule
+	if err := env.db.Where("model = ? AND active = ?", m.Name, true).Order("sequence, id").Find(&rules).Error; err != nil {
+		return nil, fmt.Errorf("failed to read the duplicate rules: %w", err)
+	}
+	matches := []DuplicateMatch{}
+	for i := range rules {
+		found, err := m.ruleMatches(env, &rules[i], vals, excludeID)
+		if err != nil {
+			return nil, fmt.Errorf("duplicate rule %s: %w", rules[i].Name, err)
+		}
+		matches = append(matches, found...)
+	}
+	return matches, nil
+}
+
+// checkBlockingDuplicates fails with a DuplicateError when the values of
+// a new record match a blocking rule
+func (m *ModelDefinition) checkBlockingDuplicates(env *Environment, vals map[string]interface{}) error {
+	if m.Transient {
+		return nil
+	}
+	matches, err := m.CheckDuplicates(env, vals, 0)
+	if err != nil {
+		return err
+	}
+	var blocking []DuplicateMatch
+	for _, match := range matches {
+		if match.Action == DuplicateBlock {
+			blocking = append(blocking, match)
+		}
+	}
+	if len(blocking) > 0 {
+		return &DuplicateError{Model: m.Name, Matches: blocking}
+	}
+	return nil
+}
+
+// ruleMatches runs the query of a rule. An "and" rule needs a value for
+// every condition, an "or" rule for one of them; empty values never match.
+func (m *ModelDefinition) ruleMatches(env *Environment, rule *DuplicateRule, vals map[string]interface{}, excludeID uint) ([]DuplicateMatch, error) {
+	var predicates, scores []string
+	var predicateArgs, scoreArgs []interface{}
+	for _, condition := range rule.Conditions {
+		field, ok := m.Fields[condition.Field]
+		value := vals[condition.Field]
+		if !ok || value == nil || value == "" {
+			if rule.Operator == "and" {
+				return nil, nil
+			}
+			continue
+		}
+
+		var predicate, score string
+		var args, argsOfScore []interface{}
+		switch condition.Match {
+		case MatchExact:
+			column, err := field.ConvertToColumn(value, nil)
+			if err != nil {
+				return nil, fmt.Errorf("field '%s': %w", condition.Field, err)
+			}
+			predicate, args = condition.Field+" = ?", []interface{}{column}
+		case MatchEmail:
+			key := normalize.Email(fmt.Sprintf("%v", value))
+			predicate, args = normalize.EmailSQL(condition.Field)+" = ?", []interface{}{key}
+		case MatchText:
+			key := normalize.Text(fmt.Sprintf("%v", value))
+			predicate, args = normalize.TextSQL(condition.Field)+" = ?", []interface{}{key}
+		case MatchTrigram:
+			key := normalize.Text(fmt.Sprintf("%v", value))
+			expression := normalize.TextSQL(condition.Field)
+			// % is served by the trigram index, similarity() applies the threshold
+			predicate = fmt.Sprintf("(%s %% ? AND similarity(%s, ?) >= %v)", expression, expression, condition.Threshold)
+			args = []interface{}{key, key}
+			score, argsOfScore = fmt.Sprintf("similarity(%s, ?)", expression), []interface{}{key}
+		default:
+			continue
+		}
+		if score == "" {
+			score = "1"
+		}
+		if rule.Operator == "or" {
+			score = fmt.Sprintf("CASE WHEN %s THEN %s ELSE 0 END", predicate, score)
+			argsOfScore = append(append([]interface{}{}, args...), argsOfScore...)
+		}
+		predicates = append(predicates, predicate)
+		predicateArgs = append(predicateArgs, args...)
+		scores = append(scores, score)
+		scoreArgs = append(scoreArgs, argsOfScore...)
+	}
+	if len(predicates) == 0 {
+		return nil, nil
+	}
+
+	combine, where := "LEAST", strings.Join(predicates, " AND ")
+	if rule.Operator == "or" {
+		combine, where = "GREATEST", "("+strings.Join(predicates, " OR ")+")"
+	}
+	name := "NULL"
+	if recName := m.RecNameField(); recName != "" {
+		name = recName + "::text"
+	}
+	selection := fmt.Sprintf("id, %s AS name, %s(%s)::float8 AS score", name, combine, strings.Join(scores, ", "))
+
+	var rows []struct {
+		ID    uint
+		Name  *string
+		Score float64
+	}
+	query := env.db.Table(m.TableName).Select(selection, scoreArgs...).Where(where, predicateArgs...)
+	if excludeID != 0 {
+		query = query.Where("id <> ?", excludeID)
+	}
+	if err := query.Order("score DESC, id").Limit(DuplicateMatchLimit).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	matches := make([]DuplicateMatch, len(rows))
+	for i, row := range rows {
+		matches[i] = DuplicateMatch{ID: row.ID, Score: row.Score, RuleID: rule.ID, Rule: rule.Name, Action: rule.Action}
+		if row.Name != nil {
+			matches[i].Name = *row.Name
+		} else {
+			matches[i].Name = fmt.Sprintf("%s(%d)", m.Name, row.ID)
+		}
+	}
+	return matches, nil
+}
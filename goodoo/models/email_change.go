@@ -0,0 +1,213 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Email change errors
+var (
+	ErrEmailChangeNotFound  = errors.New("email change not found")
+	ErrEmailChangeExpired   = errors.New("email change expired")
+	ErrEmailChangeCancelled = errors.New("email change cancelled")
+	ErrEmailChangeConfirmed = errors.New("email change already confirmed")
+	// ErrEmailChangeInvalid is returned when the account changed since the
+	// request: deleted, deactivated or its email changed otherwise
+	ErrEmailChangeInvalid = errors.New("email change no longer valid for this account")
+	// ErrEmailTaken is returned when another user has the new email
+	ErrEmailTaken = errors.New("email already used by another account")
+)
+
+// Email change states, see EmailChange.State
+const (
+	EmailChangePending   = "pending"
+	EmailChangeConfirmed = "confirmed"
+	EmailChangeCancelled = "cancelled"
+	EmailChangeExpired   = "expired"
+)
+
+// DefaultEmailChangeHours is how long the confirmation links of email
+// changes stay valid unless ParamEmailChangeHours says otherwise
+const DefaultEmailChangeHours = 24
+
+// EmailChange is a change of the email of a user waiting for the owner of
+// the new address to confirm it from a single-use link. A new request of
+// the user cancels the pending ones; a request never confirmed is
+// abandoned and expires, leaving the email unchanged.
+type EmailChange struct {
+	ID       uint   `gorm:"primaryKey;autoIncrement" json:"id"`
+	UserID   uint   `gorm:"column:user_id;not null;index" json:"user_id"`
+	OldEmail string `gorm:"column:old_email;not null" json:"old_email"`
+	NewEmail string `gorm:"column:new_email;not null" json:"new_email"`
+	// TokenHash is the SHA-256 of the token; the token itself is only in
+	// the link mailed to the new address
+	TokenHash   string     `gorm:"column:token_hash;not null;uniqueIndex" json:"-"`
+	ExpiresAt   time.Time  `gorm:"column:expires_at;not null" json:"expires_at"`
+	ConfirmedAt *time.Time `gorm:"column:confirmed_at" json:"confirmed_at,omitempty"`
+	CancelledAt *time.Time `gorm:"column:cancelled_at" json:"cancelled_at,omitempty"`
+	CreateDate  time.Time  `gorm:"column:create_date;autoCreateTime" json:"create_date"`
+}
+
+func (EmailChange) TableName() string {
+	return "user_email_change"
+}
+
+// State returns the state of the change at now
+func (e *EmailChange) State(now time.Time) string {
+	switch {
+	case e.ConfirmedAt != nil:
+		return EmailChangeConfirmed
+	case e.CancelledAt != nil:
+		return EmailChangeCancelled
+	case !now.Before(e.ExpiresAt):
+		return EmailChangeExpired
+	}
+	return EmailChangePending
+}
+
+// Usable returns why the change may no longer be confirmed at now, nil
+// while it is pending
+func (e *EmailChange) Usable(now time.Time) error {
+	switch e.State(now) {
+	case EmailChangeConfirmed:
+		return ErrEmailChangeConfirmed
+	case EmailChangeCancelled:
+		return ErrEmailChangeCancelled
+	case EmailChangeExpired:
+		return ErrEmailChangeExpired
+	}
+	return nil
+}
+
+// emailTaken reports whether a user other than uid has email
+func emailTaken(db *gorm.DB, uid uint, email string) (bool, error) {
+	var count int64
+	err := db.Model(&User{}).Where("id <> ? AND lower(email) = lower(?)", uid, email).Count(&count).Error
+	return count > 0, err
+}
+
+// RequestEmailChange records a change of the email of user to newEmail,
+// valid until expiresAt, and returns it with its token. The pending
+// changes of the user are cancelled, so their links stop working.
+func RequestEmailChange(db *gorm.DB, user *User, newEmail string, now, expiresAt time.Time) (*EmailChange, string, error) {
+	taken, err := emailTaken(db, user.ID, newEmail)
+	if err != nil {
+		return nil, "", err
+	}
+	if taken {
+		return nil, "", ErrEmailTaken
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+
+	change := &EmailChange{
+		UserID:    user.ID,
+		OldEmail:  user.Email,
+		NewEmail:  newEmail,
+		TokenHash: hashInvitationToken(token),
+		ExpiresAt: expiresAt,
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if _, err := CancelEmailChanges(tx, user.ID, now); err != nil {
+			return err
+		}
+		return tx.Create(change).Error
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return change, token, nil
+}
+
+// CancelEmailChanges abandons the pending email changes of a user and
+// returns how many there were
+func CancelEmailChanges(db *gorm.DB, uid uint, now time.Time) (int64, error) {
+	result := db.Model(&EmailChange{}).
+		Where("user_id = ? AND confirmed_at IS NULL AND cancelled_at IS NULL AND expires_at > ?", uid, now).
+		Update("cancelled_at", now)
+	return result.RowsAffected, result.Error
+}
+
+// PendingEmailChange returns the pending email change of a user, nil when
+// there is none
+func PendingEmailChange(db *gorm.DB, uid uint, now time.Time) (*EmailChange, error) {
+	var changes []EmailChange
+	err := db.Where("user_id = ? AND confirmed_at IS NULL AND cancelled_at IS NULL AND expires_at > ?", uid, now).
+		Order("id DESC").Limit(1).Find(&changes).Error
+	if err != nil || len(changes) == 0 {
+		return nil, err
+	}
+	return &changes[0], nil
+}
+
+// FindEmailChange returns the email change of a token, whatever its state
+func FindEmailChange(db *gorm.DB, token string) (*EmailChange, error) {
+	if token == "" {
+		return nil, ErrEmailChangeNotFound
+	}
+	var change EmailChange
+	err := db.Where("token_hash = ?", hashInvitationToken(token)).First(&change).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrEmailChangeNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &change, nil
+}
+
+// Confirm sets the new email on the account and consumes the change. The
+// change is locked, so a token is confirmed once; the account must still
+// be active with the email it had when the change was requested, and no
+// other account may have taken the new email since.
+func (e *EmailChange) Confirm(db *gorm.DB, now time.Time) (*User, error) {
+	var user User
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var current EmailChange
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&current, e.ID).Error; err != nil {
+			return err
+		}
+		if err := current.Usable(now); err != nil {
+			return err
+		}
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, current.UserID).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrEmailChangeInvalid
+		}
+		if err != nil {
+			return err
+		}
+		if !user.Active || !strings.EqualFold(user.Email, current.OldEmail) {
+			return ErrEmailChangeInvalid
+		}
+		taken, err := emailTaken(tx, user.ID, current.NewEmail)
+		if err != nil {
+			return err
+		}
+		if taken {
+			return ErrEmailTaken
+		}
+
+		user.Email = current.NewEmail
+		if err := tx.Model(&user).Update("email", user.Email).Error; err != nil {
+			return err
+		}
+		current.ConfirmedAt = &now
+		*e = current
+		return tx.Model(&current).Update("confirmed_at", now).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
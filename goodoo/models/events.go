@@ -0,0 +1,65 @@
+package models
+
+import (
+	"sort"
+	"sync"
+)
+
+// Record event types
+const (
+	EventCreate = "create"
+	EventWrite  = "write"
+	EventUnlink = "unlink"
+)
+
+// RecordEvent describes records of a field-defined model that were created,
+// written or are being deleted
+type RecordEvent struct {
+	Model string
+	Type  string
+	IDs   []uint
+	// Fields are the names of the fields given to create or write
+	Fields []string
+}
+
+// RecordListener is called inside the transaction of a record change, with
+// an environment bound to that transaction. Returning an error rolls the
+// change back, so work it queues only exists if the change is committed.
+type RecordListener func(env *Environment, event RecordEvent) error
+
+var (
+	recordListeners     []RecordListener
+	recordListenerMutex sync.RWMutex
+)
+
+// OnRecordEvent registers a listener called for every record event
+func OnRecordEvent(listener RecordListener) {
+	recordListenerMutex.Lock()
+	defer recordListenerMutex.Unlock()
+	recordListeners = append(recordListeners, listener)
+}
+
+// notify calls the registered listeners with an event of the model
+func (m *ModelDefinition) notify(env *Environment, eventType string, ids []uint, fields []string) error {
+	recordListenerMutex.RLock()
+	listeners := append([]RecordListener(nil), recordListeners...)
+	recordListenerMutex.RUnlock()
+
+	event := RecordEvent{Model: m.Name, Type: eventType, IDs: ids, Fields: fields}
+	for _, listener := range listeners {
+		if err := listener(env, event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fieldNames returns the sorted keys of a values map
+func fieldNames(vals map[string]interface{}) []string {
+	names := make([]string, 0, len(vals))
+	for name := range vals {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
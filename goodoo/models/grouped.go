@@ -0,0 +1,365 @@
+package models
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"goodoo/fields"
+	"gorm.io/gorm"
+)
+
+// Grouped listings for kanban boards: the first records of each group of
+// a domain with the size of every group, read at once instead of one
+// search per column
+
+const (
+	// DefaultGroupLimit is the number of records of each group when the
+	// query does not say
+	DefaultGroupLimit = 10
+	// MaxGroupLimit bounds the number of records of each group
+	MaxGroupLimit = 200
+	// maxRecordGroups bounds the groups of a listing; the remaining groups
+	// are dropped with a warning
+	maxRecordGroups = 100
+)
+
+// GroupedQuery asks for the records of a domain grouped by a selection,
+// many2one or tag field, Limit records per group in Order
+type GroupedQuery struct {
+	Domain     Domain
+	GroupBy    string
+	Limit      int
+	Order      string
+	Fields     []string
+	Aggregates []AggregateSpec
+	// EmptyGroups adds the options of a selection field no record has, so
+	// that the columns of a board do not come and go
+	EmptyGroups bool
+}
+
+// RecordGroup is a group of a grouped listing: its key (the selection
+// value, or the record or tag id, nil for the records without one), its
+// label, its number of records and their aggregates, and its first
+// records. Domain selects all its records, to page through the rest.
+type RecordGroup struct {
+	Key        interface{}              `json:"key"`
+	Label      string                   `json:"label"`
+	Count      int64                    `json:"count"`
+	Aggregates map[string]interface{}   `json:"aggregates,omitempty"`
+	Domain     Domain                   `json:"domain"`
+	Records    []map[string]interface{} `json:"records"`
+}
+
+// GroupedResult is a grouped listing, with a warning for each aggregate
+// that was skipped and when groups were dropped
+type GroupedResult struct {
+	GroupBy  string        `json:"group_by"`
+	Limit    int           `json:"limit"`
+	Groups   []RecordGroup `json:"groups"`
+	Warnings []string      `json:"warnings,omitempty"`
+}
+
+// NoGroupLabel is the label of the group of the records without a value
+const NoGroupLabel = "None"
+
+// checkGroupBy refuses a field records cannot be grouped by on a board:
+// one the user may not read, or not a selection, many2one or tag field
+func (m *ModelDefinition) checkGroupBy(env *Environment, name string) error {
+	if name == TagField && m.tagScope() != nil {
+		return nil
+	}
+	if !isIdentifier(name) {
+		return &IdentifierError{Kind: "field", Name: name}
+	}
+	field, exists := m.Fields[name]
+	if !exists || !m.sortable(env, name) {
+		return &FieldNameError{Model: m.Name, Reason: "unknown or not readable fields", Fields: []string{name}}
+	}
+	switch field.GetType() {
+	case fields.SelectionType, fields.Many2oneType:
+		return nil
+	}
+	return &FieldNameError{Model: m.Name, Reason: "cannot group by fields other than selection, many2one or tags", Fields: []string{name}}
+}
+
+// groupSource returns the query of the records of a domain, aliased g,
+// and the SQL of their group key. Grouped by tags, a record is in the
+// group of each of its tags, or in the one without a tag.
+func (m *ModelDefinition) groupSource(env *Environment, domain Domain, groupBy string) (*gorm.DB, string, error) {
+	query, err := m.domainQuery(env, domain)
+	if err != nil {
+		return nil, "", err
+	}
+	source := env.db.Table("(?) AS g", query.Select(QuoteIdentifier(m.TableName)+".*"))
+	if groupBy == TagField {
+		source = source.Joins("LEFT JOIN (SELECT tag_id AS group_tag, res_id AS group_res FROM res_tag_rel WHERE res_model = ?) AS tg ON tg.group_res = g.id", m.Name)
+		return source, "tg.group_tag", nil
+	}
+	return source, "g." + QuoteIdentifier(groupBy), nil
+}
+
+// ReadGrouped returns the groups of the records of a domain, each with
+// its first records in a single window query, like a list of the domain
+// of the group would. Record rules and field access apply as for Search
+// and Read; aggregates that cannot be computed are skipped with a warning.
+func (m *ModelDefinition) ReadGrouped(env *Environment, q GroupedQuery) (*GroupedResult, error) {
+	if err := m.checkConcrete(); err != nil {
+		return nil, err
+	}
+	if err := m.checkGroupBy(env, q.GroupBy); err != nil {
+		return nil, err
+	}
+	if q.Limit <= 0 {
+		q.Limit = DefaultGroupLimit
+	}
+	q.Limit = min(q.Limit, MaxGroupLimit)
+	orderBy, err := m.parseOrderOf(env, q.Order, "g")
+	if err != nil {
+		return nil, err
+	}
+	// The id breaks ties, so that the records of a group come in the same
+	// order as in its list
+	orderBy += ", g.id"
+
+	source, key, err := m.groupSource(env, q.Domain, q.GroupBy)
+	if err != nil {
+		return nil, err
+	}
+	window := source.Select(fmt.Sprintf("g.id AS id, %[1]s AS group_key, "+
+		"row_number() OVER (PARTITION BY %[1]s ORDER BY %[2]s) AS group_row, "+
+		"count(*) OVER (PARTITION BY %[1]s) AS group_count, "+
+		"dense_rank() OVER (ORDER BY %[1]s NULLS FIRST) AS group_rank", key, orderBy))
+	var rows []map[string]interface{}
+	err = env.db.Table("(?) AS w", window).
+		Where("w.group_row <= ? AND w.group_rank <= ?", q.Limit, maxRecordGroups+1).
+		Order("w.group_rank, w.group_row").Find(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	result := &GroupedResult{GroupBy: q.GroupBy, Limit: q.Limit, Groups: []RecordGroup{}}
+	members := make([][]uint, 0)
+	var ids []uint
+	for _, row := range rows {
+		rank := int(toUint(row["group_rank"]))
+		if rank > maxRecordGroups {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("only the first %d groups are returned", maxRecordGroups))
+			break
+		}
+		if rank > len(result.Groups) {
+			result.Groups = append(result.Groups, RecordGroup{
+				Key:   m.groupKey(q.GroupBy, row["group_key"]),
+				Count: int64(toUint(row["group_count"])),
+			})
+			members = append(members, nil)
+		}
+		id := toUint(row["id"])
+		members[len(members)-1] = append(members[len(members)-1], id)
+		ids = append(ids, id)
+	}
+
+	records, err := m.Read(env, uniqueIDs(ids), q.Fields)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[uint]map[string]interface{}, len(records))
+	for _, record := range records {
+		byID[toUint(record["id"])] = record
+	}
+	for i := range result.Groups {
+		group := &result.Groups[i]
+		group.Records = make([]map[string]interface{}, 0, len(members[i]))
+		for _, id := range members[i] {
+			if record, ok := byID[id]; ok {
+				group.Records = append(group.Records, record)
+			}
+		}
+	}
+
+	m.selectionGroups(q.GroupBy, result, q.EmptyGroups)
+	if len(q.Aggregates) > 0 {
+		if err := m.groupAggregates(env, q, result); err != nil {
+			return nil, err
+		}
+	}
+	for i := range result.Groups {
+		group := &result.Groups[i]
+		group.Domain = append(slices.Clone(q.Domain), m.groupCondition(q.GroupBy, group.Key))
+	}
+	if err := m.labelGroups(env, q.GroupBy, result.Groups); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// groupKey normalizes a group key read from the database: ids as uint
+func (m *ModelDefinition) groupKey(groupBy string, value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	if groupBy == TagField || m.Fields[groupBy].GetType() == fields.Many2oneType {
+		return toUint(value)
+	}
+	return fields.ConvertToString(value)
+}
+
+// groupCondition returns the domain condition of the records of a group
+func (m *ModelDefinition) groupCondition(groupBy string, key interface{}) []interface{} {
+	if groupBy == TagField && key != nil {
+		return []interface{}{TagField, "in", []uint{key.(uint)}}
+	}
+	return []interface{}{groupBy, "=", key}
+}
+
+// selectionGroups orders the groups of a selection field like its options,
+// the group without a value first, adding those of the options without
+// records when withEmpty is set
+func (m *ModelDefinition) selectionGroups(groupBy string, result *GroupedResult, withEmpty bool) {
+	selection, ok := m.Fields[groupBy].(*fields.SelectionField)
+	if !ok {
+		return
+	}
+	position := make(map[interface{}]int, len(selection.Selection))
+	for i, option := range selection.Selection {
+		position[option.Value] = i + 1
+	}
+	present := make(map[interface{}]bool, len(result.Groups))
+	for _, group := range result.Groups {
+		present[group.Key] = true
+	}
+	for _, option := range selection.Selection {
+		if withEmpty && !present[option.Value] {
+			result.Groups = append(result.Groups, RecordGroup{Key: option.Value, Records: []map[string]interface{}{}})
+		}
+	}
+	// Values that are no longer options keep their place after the options
+	slices.SortStableFunc(result.Groups, func(a, b RecordGroup) int {
+		pa, pb := position[a.Key], position[b.Key]
+		if a.Key != nil && pa == 0 {
+			pa = len(position) + 1
+		}
+		if b.Key != nil && pb == 0 {
+			pb = len(position) + 1
+		}
+		return pa - pb
+	})
+}
+
+// groupAggregates computes the aggregates of every group in one grouped
+// query
+func (m *ModelDefinition) groupAggregates(env *Environment, q GroupedQuery, result *GroupedResult) error {
+	var selects, keys []string
+	seen := make(map[string]bool, len(q.Aggregates))
+	for _, spec := range q.Aggregates {
+		key := spec.Key()
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		expression, err := m.aggregateExpression(env, spec)
+		if err != nil {
+			result.Warnings = append(result.Warnings, key+": "+err.Error())
+			continue
+		}
+		selects = append(selects, fmt.Sprintf("%s AS a%d", expression, len(keys)))
+		keys = append(keys, key)
+	}
+	if len(selects) == 0 {
+		return nil
+	}
+
+	source, column, err := m.groupSource(env, q.Domain, q.GroupBy)
+	if err != nil {
+		return err
+	}
+	var rows []map[string]interface{}
+	selects = append([]string{column + " AS group_key"}, selects...)
+	if err := source.Select(strings.Join(selects, ", ")).Group(column).Find(&rows).Error; err != nil {
+		return err
+	}
+	byKey := make(map[interface{}]map[string]interface{}, len(rows))
+	for _, row := range rows {
+		values := make(map[string]interface{}, len(keys))
+		for i, key := range keys {
+			values[key] = row[fmt.Sprintf("a%d", i)]
+		}
+		byKey[m.groupKey(q.GroupBy, row["group_key"])] = values
+	}
+	for i := range result.Groups {
+		group := &result.Groups[i]
+		if group.Aggregates = byKey[group.Key]; group.Aggregates == nil {
+			// Empty groups count nothing and sum to nothing
+			group.Aggregates = make(map[string]interface{}, len(keys))
+			for _, key := range keys {
+				group.Aggregates[key] = nil
+			}
+		}
+	}
+	return nil
+}
+
+// labelGroups sets the label of the groups: the selection label, the
+// display name of the record or the tag name
+func (m *ModelDefinition) labelGroups(env *Environment, groupBy string, groups []RecordGroup) error {
+	var ids []uint
+	for i := range groups {
+		if groups[i].Key == nil {
+			groups[i].Label = NoGroupLabel
+		} else if id, ok := groups[i].Key.(uint); ok {
+			ids = append(ids, id)
+		}
+	}
+
+	labels := make(map[uint]string, len(ids))
+	switch {
+	case groupBy == TagField:
+		var tags []Tag
+		if len(ids) > 0 {
+			if err := env.db.Where("id IN ?", ids).Find(&tags).Error; err != nil {
+				return err
+			}
+		}
+		for _, tag := range tags {
+			labels[tag.ID] = tag.Name
+		}
+	case m.Fields[groupBy].GetType() == fields.Many2oneType:
+		relation := m.Fields[groupBy].GetAttributes().Relation
+		// Records the user may not read keep their reference as label
+		if comodel, ok := env.GetFieldModel(relation); ok && len(ids) > 0 {
+			recName := comodel.RecNameField()
+			if _, exists := comodel.Fields[recName]; exists {
+				if records, err := comodel.Read(env, ids, []string{recName}); err == nil {
+					for _, record := range records {
+						labels[toUint(record["id"])], _ = record[recName].(string)
+					}
+				}
+			}
+		}
+		for _, id := range ids {
+			if labels[id] == "" {
+				labels[id] = fmt.Sprintf("%s,%d", relation, id)
+			}
+		}
+	default:
+		for i := range groups {
+			if groups[i].Key == nil {
+				continue
+			}
+			label, err := m.Fields[groupBy].ConvertToDisplay(groups[i].Key, env)
+			if err != nil || label == "" {
+				// A value that is no longer an option
+				label = fields.ConvertToString(groups[i].Key)
+			}
+			groups[i].Label = label
+		}
+		return nil
+	}
+
+	for i := range groups {
+		if id, ok := groups[i].Key.(uint); ok {
+			groups[i].Label = labels[id]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package models
+
+import "gorm.io/gorm"
+
+// ResGroups is a group of users granting access rights (like Odoo's
+// res.groups). Code refers to groups by external id ("module.name", see
+// IrModelData), e.g. the Groups of a field.
+type ResGroups struct {
+	BaseModel
+	Name    string `gorm:"not null" json:"name"`
+	Comment string `gorm:"type:text" json:"comment,omitempty"`
+}
+
+func (ResGroups) TableName() string {
+	return "res_groups"
+}
+
+// UserGroupXMLIDs returns the external ids of the groups of a user
+func UserGroupXMLIDs(db *gorm.DB, uid uint) ([]string, error) {
+	var xmlids []string
+	err := db.Table("ir_model_data").
+		Joins("JOIN res_groups_users_rel ON res_groups_users_rel.gid = ir_model_data.res_id").
+		Where("ir_model_data.model = ? AND res_groups_users_rel.uid = ?", "res.groups", uid).
+		Pluck("ir_model_data.module || '.' || ir_model_data.name", &xmlids).Error
+	return xmlids, err
+}
+
+// AdminUserIDs returns the active members of base.group_system and the
+// administrator, who belongs to every group
+func AdminUserIDs(db *gorm.DB) ([]uint, error) {
+	var ids []uint
+	err := db.Model(&User{}).
+		Where("active = ?", true).
+		Where("login = ? OR id IN (?)", "admin", db.Table("res_groups_users_rel").
+			Joins("JOIN ir_model_data ON ir_model_data.res_id = res_groups_users_rel.gid AND ir_model_data.model = ?", "res.groups").
+			Where("ir_model_data.module = ? AND ir_model_data.name = ?", "base", "group_system").
+			Select("res_groups_users_rel.uid")).
+		Order("id").
+		Pluck("id", &ids).Error
+	return ids, err
+}
+
+// HasMorePrivileges reports whether user holds a privilege other lacks:
+// being the administrator, or a group other is not a member of
+func HasMorePrivileges(db *gorm.DB, user, other *User) (bool, error) {
+	if other.IsAdmin() {
+		return false, nil
+	}
+	if user.IsAdmin() {
+		return true, nil
+	}
+	userGroups, err := UserGroupXMLIDs(db, user.ID)
+	if err != nil {
+		return false, err
+	}
+	otherGroups, err := UserGroupXMLIDs(db, other.ID)
+	if err != nil {
+		return false, err
+	}
+	held := make(map[string]bool, len(otherGroups))
+	for _, group := range otherGroups {
+		held[group] = true
+	}
+	for _, group := range userGroups {
+		if !held[group] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,183 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+
+	"goodoo/fields"
+	"gorm.io/gorm"
+)
+
+// ErrHierarchyCycle is returned when a parent assignment would make a
+// record its own ancestor
+var ErrHierarchyCycle = errors.New("recursion detected: a record cannot be its own ancestor")
+
+// Hierarchical domain operators (like Odoo's child_of and parent_of)
+const (
+	OperatorChildOf  = "child_of"
+	OperatorParentOf = "parent_of"
+)
+
+// isHierarchyOperator reports whether a domain operator walks a hierarchy
+func isHierarchyOperator(operator string) bool {
+	return operator == OperatorChildOf || operator == OperatorParentOf
+}
+
+// domainIDs converts the value of a hierarchical condition to record ids
+func domainIDs(value interface{}) ([]int64, error) {
+	toID := func(v interface{}) (int64, error) {
+		if _, isBool := v.(bool); !isBool {
+			if id, err := fields.ConvertToInt64(v); err == nil && v != nil {
+				return id, nil
+			}
+		}
+		return 0, fmt.Errorf("invalid record id %v", v)
+	}
+
+	switch values := value.(type) {
+	case []interface{}:
+		ids := make([]int64, 0, len(values))
+		for _, v := range values {
+			id, err := toID(v)
+			if err != nil {
+				return nil, err
+			}
+			ids = append(ids, id)
+		}
+		return ids, nil
+	case []int:
+		ids := make([]int64, len(values))
+		for i, v := range values {
+			ids[i] = int64(v)
+		}
+		return ids, nil
+	case []uint:
+		ids := make([]int64, len(values))
+		for i, v := range values {
+			ids[i] = int64(v)
+		}
+		return ids, nil
+	}
+	id, err := toID(value)
+	if err != nil {
+		return nil, err
+	}
+	return []int64{id}, nil
+}
+
+// hierarchyCondition returns the SQL of a child_of or parent_of condition on
+// field, walking the parent column of table with a recursive CTE. UNION
+// drops rows already found, so the walk ends even on corrupted cyclic data.
+// field must be checked and quoted; table and parentColumn are checked and
+// quoted here.
+func hierarchyCondition(table, parentColumn, field, operator string, value interface{}) (string, []interface{}, error) {
+	ids, err := domainIDs(value)
+	if err != nil {
+		return "", nil, err
+	}
+	if table, err = quoteName("table", table); err != nil {
+		return "", nil, err
+	}
+	if parentColumn, err = quoteName("column", parentColumn); err != nil {
+		return "", nil, err
+	}
+	if len(ids) == 0 {
+		return "1 = 0", nil, nil
+	}
+
+	var walk string
+	switch operator {
+	case OperatorChildOf:
+		walk = fmt.Sprintf(`WITH RECURSIVE walk(id) AS (
+	SELECT id FROM %[1]s WHERE id IN ?
+	UNION SELECT t.id FROM %[1]s t JOIN walk ON t.%[2]s = walk.id
+) SELECT id FROM walk`, table, parentColumn)
+	case OperatorParentOf:
+		walk = fmt.Sprintf(`WITH RECURSIVE walk(id, parent) AS (
+	SELECT id, %[2]s FROM %[1]s WHERE id IN ?
+	UNION SELECT t.id, t.%[2]s FROM %[1]s t JOIN walk ON t.id = walk.parent
+) SELECT id FROM walk`, table, parentColumn)
+	default:
+		return "", nil, fmt.Errorf("invalid hierarchy operator %s", operator)
+	}
+	return fmt.Sprintf("%s IN (%s)", field, walk), []interface{}{ids}, nil
+}
+
+// IsAncestor reports whether ancestorID is parentID or one of its ancestors
+// in table, i.e. whether giving a record ancestorID the parent parentID
+// would create a cycle
+func IsAncestor(db *gorm.DB, table, parentColumn string, ancestorID, parentID uint) (bool, error) {
+	if ancestorID == parentID {
+		return true, nil
+	}
+	condition, args, err := hierarchyCondition(table, parentColumn, "id", OperatorParentOf, []uint{parentID})
+	if err != nil {
+		return false, err
+	}
+	var count int64
+	err = db.Table(table).Where("id = ?", ancestorID).Where(condition, args...).Count(&count).Error
+	return count > 0, err
+}
+
+// checkParent fails with ErrHierarchyCycle when giving record id the parent
+// parentID would create a cycle
+func checkParent(db *gorm.DB, table, parentColumn string, id uint, parentID *uint) error {
+	if parentID == nil || id == 0 {
+		return nil
+	}
+	cycle, err := IsAncestor(db, table, parentColumn, id, *parentID)
+	if err != nil {
+		return err
+	}
+	if cycle {
+		return fmt.Errorf("%w (%s %d)", ErrHierarchyCycle, table, id)
+	}
+	return nil
+}
+
+// TreeRow is a record of a subtree loaded by LoadSubtree. Cycle marks a
+// record reached again through a cycle; it is not walked further.
+type TreeRow struct {
+	ID       uint  `json:"id"`
+	ParentID *uint `json:"parent_id"`
+	Depth    int   `json:"depth"`
+	Cycle    bool  `json:"cycle"`
+}
+
+// LoadSubtree returns a record and its descendants down to maxDepth levels,
+// ordered by depth. Soft-deleted records are skipped.
+func LoadSubtree(db *gorm.DB, table, parentColumn string, rootID uint, maxDepth int) ([]TreeRow, error) {
+	query := fmt.Sprintf(`WITH RECURSIVE tree(id, parent_id, depth, path, cycle) AS (
+	SELECT id, %[2]s, 0, ARRAY[id], false FROM %[1]s WHERE id = ? AND deleted_at IS NULL
+	UNION ALL
+	SELECT t.id, t.%[2]s, tree.depth + 1, tree.path || t.id, t.id = ANY(tree.path)
+	FROM %[1]s t JOIN tree ON t.%[2]s = tree.id
+	WHERE NOT tree.cycle AND tree.depth < ? AND t.deleted_at IS NULL
+) SELECT id, parent_id, depth, cycle FROM tree ORDER BY depth, id`, table, parentColumn)
+
+	var rows []TreeRow
+	if err := db.Raw(query, rootID, maxDepth).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// savedParent returns the parent a save hook is about to write: the value
+// of the parent column when the save updates a map, else the model's own
+func savedParent(tx *gorm.DB, parentColumn string, current *uint) *uint {
+	updates, ok := tx.Statement.Dest.(map[string]interface{})
+	if !ok {
+		return current
+	}
+	value, set := updates[parentColumn]
+	if !set {
+		return current
+	}
+	if v, ok := value.(*uint); ok {
+		return v
+	}
+	if id, err := fields.ConvertToID(value); err == nil {
+		return &id
+	}
+	return nil
+}
@@ -0,0 +1,331 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"goodoo/logging"
+)
+
+// DefaultHistoryWindow is how close consecutive changes of a user must be
+// to show as one history entry
+const DefaultHistoryWindow = 5 * time.Minute
+
+// HistoryOptions selects and pages the history of a record
+type HistoryOptions struct {
+	// Field keeps the entries changing this field only, when set
+	Field string
+	// Window collapses the consecutive writes of a user, DefaultHistoryWindow
+	// when zero; negative keeps every write
+	Window time.Duration
+	Offset int
+	// Limit is the page size, all entries when zero
+	Limit int
+}
+
+// FieldChange is the change of a field in a history entry; Old is nil in
+// the entry of a creation. Values are displayed in the reader's language
+// and timezone.
+type FieldChange struct {
+	Field      string      `json:"field"`
+	Label      string      `json:"label"`
+	Old        interface{} `json:"old"`
+	New        interface{} `json:"new"`
+	OldDisplay string      `json:"old_display"`
+	NewDisplay string      `json:"new_display"`
+}
+
+// HistoryEntry is an event of the history of a record: its creation,
+// writes, archiving, restoring or deletion. Collapsed writes span from
+// Start to Timestamp and list the audit entries they merge.
+type HistoryEntry struct {
+	AuditIDs  []uint    `json:"audit_ids"`
+	Type      string    `json:"type"`
+	Start     time.Time `json:"start"`
+	Timestamp time.Time `json:"timestamp"`
+	UserID    uint      `json:"user_id"`
+	UserName  string    `json:"user_name"`
+	// ImpersonatorID is the administrator who acted as UserID, if any
+	ImpersonatorID uint `json:"impersonator_id,omitempty"`
+	// ServiceKeyID is the service key of the automation that acted, if any
+	ServiceKeyID string        `json:"service_key_id,omitempty"`
+	Changes      []FieldChange `json:"changes"`
+}
+
+// LastChange is the last change of a field of a record
+type LastChange struct {
+	Value     interface{} `json:"value"`
+	Display   string      `json:"display"`
+	UserID    uint        `json:"user_id"`
+	UserName  string      `json:"user_name"`
+	Timestamp time.Time   `json:"timestamp"`
+}
+
+// recordEvents returns the tracked events of a record, oldest first, with
+// the changes of the fields the user may read; writes that only changed
+// unreadable fields are left out. The records changed before the tracking,
+// or outside the ORM, have events without changes.
+func (m *ModelDefinition) recordEvents(env *Environment, id uint) ([]HistoryEntry, error) {
+	var rows []AuditLog
+	err := env.db.Where("model = ? AND res_id = ? AND event_type LIKE ?", m.Name, id, "record.%").
+		Order("create_date, id").Find(&rows).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the history: %w", err)
+	}
+
+	events := make([]HistoryEntry, 0, len(rows))
+	for _, row := range rows {
+		activity := row.activityEntry()
+		event := HistoryEntry{
+			AuditIDs:       []uint{row.ID},
+			Type:           activity.Type,
+			Start:          activity.Timestamp,
+			Timestamp:      activity.Timestamp,
+			UserID:         activity.UserID,
+			ImpersonatorID: activity.ImpersonatorID,
+			ServiceKeyID:   activity.ServiceKeyID,
+			Changes:        []FieldChange{},
+		}
+		if changes, ok := activity.Params["changes"].(map[string]interface{}); ok {
+			for name, pair := range changes {
+				change := FieldChange{Field: name}
+				if values, ok := pair.([]interface{}); ok && len(values) == 2 {
+					change.Old, change.New = values[0], values[1]
+				} else {
+					// Redacted when the change was logged
+					change.Old, change.New = pair, pair
+				}
+				event.Changes = append(event.Changes, change)
+			}
+		}
+		if values, ok := activity.Params["values"].(map[string]interface{}); ok {
+			for name, value := range values {
+				change := FieldChange{Field: name, New: value}
+				if activity.Type == ActivityRecordDeleted {
+					change.Old, change.New = value, nil
+				}
+				event.Changes = append(event.Changes, change)
+			}
+		}
+
+		tracked := len(event.Changes)
+		readable := event.Changes[:0]
+		for _, change := range event.Changes {
+			if m.readableField(env, change.Field) {
+				readable = append(readable, change)
+			}
+		}
+		event.Changes = readable
+		if event.Type == ActivityRecordUpdated && tracked > 0 && len(readable) == 0 {
+			continue
+		}
+		sort.Slice(event.Changes, func(i, j int) bool { return event.Changes[i].Field < event.Changes[j].Field })
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// History returns the history of a record, newest first, and the number
+// of entries before paging. Consecutive writes of a user within the window
+// collapse into one entry keeping the first old and the last new value of
+// each field.
+func (m *ModelDefinition) History(env *Environment, id uint, opts HistoryOptions) ([]HistoryEntry, int, error) {
+	if err := m.checkConcrete(); err != nil {
+		return nil, 0, err
+	}
+	if opts.Field != "" {
+		if err := m.checkFieldNames([]string{opts.Field}); err != nil {
+			return nil, 0, err
+		}
+	}
+	window := opts.Window
+	if window == 0 {
+		window = DefaultHistoryWindow
+	}
+
+	events, err := m.recordEvents(env, id)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	entries := []HistoryEntry{}
+	for _, event := range events {
+		if opts.Field != "" {
+			kept := event.Changes[:0]
+			for _, change := range event.Changes {
+				if change.Field == opts.Field {
+					kept = append(kept, change)
+				}
+			}
+			event.Changes = kept
+			if len(kept) == 0 {
+				continue
+			}
+		}
+		if last := len(entries) - 1; last >= 0 && window > 0 && event.Type == ActivityRecordUpdated &&
+			entries[last].Type == ActivityRecordUpdated && entries[last].UserID == event.UserID &&
+			entries[last].ImpersonatorID == event.ImpersonatorID && event.Timestamp.Sub(entries[last].Timestamp) <= window {
+			entries[last] = collapseChanges(entries[last], event)
+			continue
+		}
+		entries = append(entries, event)
+	}
+
+	// Collapsed writes may have reverted their own changes
+	kept := entries[:0]
+	for _, entry := range entries {
+		if len(entry.AuditIDs) == 1 || len(entry.Changes) > 0 {
+			kept = append(kept, entry)
+		}
+	}
+	entries = kept
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+
+	total := len(entries)
+	if opts.Offset > 0 {
+		if opts.Offset > len(entries) {
+			opts.Offset = len(entries)
+		}
+		entries = entries[opts.Offset:]
+	}
+	if opts.Limit > 0 && opts.Limit < len(entries) {
+		entries = entries[:opts.Limit]
+	}
+
+	names, err := historyUserNames(env, entries)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := range entries {
+		entries[i].UserName = names[entries[i].UserID]
+		for j := range entries[i].Changes {
+			change := &entries[i].Changes[j]
+			change.Label = m.fieldLabel(change.Field)
+			change.OldDisplay = m.historyDisplay(env, change.Field, change.Old)
+			change.NewDisplay = m.historyDisplay(env, change.Field, change.New)
+		}
+	}
+	return entries, total, nil
+}
+
+// collapseChanges merges a write into the previous one of the same user
+func collapseChanges(previous, next HistoryEntry) HistoryEntry {
+	previous.AuditIDs = append(previous.AuditIDs, next.AuditIDs...)
+	previous.Timestamp = next.Timestamp
+
+	byField := make(map[string]int, len(previous.Changes))
+	for i, change := range previous.Changes {
+		byField[change.Field] = i
+	}
+	for _, change := range next.Changes {
+		if i, ok := byField[change.Field]; ok {
+			previous.Changes[i].New = change.New
+		} else {
+			byField[change.Field] = len(previous.Changes)
+			previous.Changes = append(previous.Changes, change)
+		}
+	}
+
+	merged := previous.Changes[:0]
+	for _, change := range previous.Changes {
+		if !sameTrackedValue(change.Old, change.New) {
+			merged = append(merged, change)
+		}
+	}
+	previous.Changes = merged
+	sort.Slice(previous.Changes, func(i, j int) bool { return previous.Changes[i].Field < previous.Changes[j].Field })
+	return previous
+}
+
+// LastChanges returns the last change of each field of a record the user
+// may read, by field name
+func (m *ModelDefinition) LastChanges(env *Environment, id uint) (map[string]LastChange, error) {
+	if err := m.checkConcrete(); err != nil {
+		return nil, err
+	}
+	events, err := m.recordEvents(env, id)
+	if err != nil {
+		return nil, err
+	}
+
+	last := make(map[string]LastChange)
+	for _, event := range events {
+		if event.Type == ActivityRecordDeleted {
+			continue
+		}
+		for _, change := range event.Changes {
+			last[change.Field] = LastChange{Value: change.New, UserID: event.UserID, Timestamp: event.Timestamp}
+		}
+	}
+
+	entries := make([]HistoryEntry, 0, len(last))
+	for _, change := range last {
+		entries = append(entries, HistoryEntry{UserID: change.UserID})
+	}
+	names, err := historyUserNames(env, entries)
+	if err != nil {
+		return nil, err
+	}
+	for field, change := range last {
+		change.UserName = names[change.UserID]
+		change.Display = m.historyDisplay(env, field, change.Value)
+		last[field] = change
+	}
+	return last, nil
+}
+
+// historyUserNames returns the names of the users of entries, their login
+// when they have none
+func historyUserNames(env *Environment, entries []HistoryEntry) (map[uint]string, error) {
+	names := make(map[uint]string)
+	var ids []uint
+	for _, entry := range entries {
+		if _, seen := names[entry.UserID]; !seen {
+			names[entry.UserID] = ""
+			ids = append(ids, entry.UserID)
+		}
+	}
+	if len(ids) == 0 {
+		return names, nil
+	}
+	var users []User
+	if err := env.db.Select("id", "name", "login").Where("id IN ?", ids).Find(&users).Error; err != nil {
+		return nil, fmt.Errorf("failed to read the users of the history: %w", err)
+	}
+	for _, user := range users {
+		names[user.ID] = user.Name
+		if strings.TrimSpace(user.Name) == "" {
+			names[user.ID] = user.Login
+		}
+	}
+	return names, nil
+}
+
+// fieldLabel returns the label of a field, its name when it has none
+func (m *ModelDefinition) fieldLabel(name string) string {
+	if field, ok := m.Fields[name]; ok && field.GetAttributes().String != "" {
+		return field.GetAttributes().String
+	}
+	return name
+}
+
+// historyDisplay formats a tracked value in the environment's language and
+// timezone; values the field no longer converts print as stored
+func (m *ModelDefinition) historyDisplay(env *Environment, name string, value interface{}) string {
+	if value == nil || value == "" {
+		return ""
+	}
+	if value == logging.RedactedValue {
+		return logging.RedactedValue
+	}
+	if field, ok := m.Fields[name]; ok {
+		if display, err := field.ConvertToDisplay(value, env); err == nil {
+			return display
+		}
+	}
+	return fmt.Sprintf("%v", value)
+}
@@ -0,0 +1,60 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"goodoo/database"
+	"goodoo/logging"
+	"goodoo/scheduler"
+	"gorm.io/gorm"
+)
+
+// MaxIdempotencyKeyLength is the longest Idempotency-Key accepted
+const MaxIdempotencyKeyLength = 255
+
+// IdempotencyRecord is the response of a request sent with an
+// Idempotency-Key, replayed when the same user retries it on the same
+// endpoint. It is written in the transaction of the request, so a stored
+// response always matches committed work.
+type IdempotencyRecord struct {
+	ID       uint   `gorm:"primaryKey;autoIncrement" json:"id"`
+	UserID   uint   `gorm:"column:user_id;not null;uniqueIndex:idempotency_record_key,priority:1" json:"user_id"`
+	Endpoint string `gorm:"type:varchar(255);not null;uniqueIndex:idempotency_record_key,priority:2" json:"endpoint"`
+	Key      string `gorm:"type:varchar(255);not null;uniqueIndex:idempotency_record_key,priority:3" json:"key"`
+	// RequestHash is the SHA-256 of the request body, so a key reused for
+	// another request is refused instead of answered with another response
+	RequestHash string    `gorm:"column:request_hash;type:varchar(64);not null" json:"request_hash"`
+	Status      int       `gorm:"not null" json:"status"`
+	ContentType string    `gorm:"column:content_type" json:"content_type"`
+	Body        []byte    `gorm:"type:bytea" json:"-"`
+	CreateDate  time.Time `gorm:"column:create_date;autoCreateTime;index" json:"create_date"`
+}
+
+func (IdempotencyRecord) TableName() string {
+	return "idempotency_record"
+}
+
+// PruneIdempotencyRecords deletes the records created before before and
+// returns how many were deleted
+func PruneIdempotencyRecords(db *gorm.DB, before time.Time) (int64, error) {
+	result := db.Where("create_date < ?", before).Delete(&IdempotencyRecord{})
+	return result.RowsAffected, result.Error
+}
+
+// ScheduleIdempotencyPrune registers a job deleting, every interval, the
+// idempotency records of a database older than window
+func ScheduleIdempotencyPrune(s *scheduler.Scheduler, dbName string, interval, window time.Duration) {
+	logger := logging.GetLogger("goodoo.models.idempotency")
+	s.Every("models.idempotency.prune."+dbName, interval, func(ctx context.Context) error {
+		db, err := database.GetDatabase(dbName)
+		if err != nil {
+			return err
+		}
+		deleted, err := PruneIdempotencyRecords(db.WithContext(ctx), s.Clock().Now().Add(-window))
+		if deleted > 0 {
+			logger.Info("Deleted %d expired idempotency record(s) of %s", deleted, dbName)
+		}
+		return err
+	})
+}
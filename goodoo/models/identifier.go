@@ -0,0 +1,137 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SQL identifiers: every name interpolated in a query (domain fields, order
+// clauses, relation columns and tables) is checked here first, then quoted
+// when it could be mistaken for something else
+
+// IdentifierError is returned when a name or an order clause is refused in
+// a query
+type IdentifierError struct {
+	// Kind is what was refused: "field", "column", "table" or "order"
+	Kind  string
+	Name  string
+	Model string
+}
+
+func (e *IdentifierError) Error() string {
+	if e.Model != "" {
+		return fmt.Sprintf("invalid %s '%s' on model %s", e.Kind, e.Name, e.Model)
+	}
+	return fmt.Sprintf("invalid %s '%s'", e.Kind, e.Name)
+}
+
+// reservedWords are the PostgreSQL keywords that cannot be used as column
+// names unquoted, or that mean something else there (user is current_user)
+var reservedWords = map[string]bool{
+	"all": true, "analyse": true, "analyze": true, "and": true, "any": true, "array": true,
+	"as": true, "asc": true, "asymmetric": true, "authorization": true, "binary": true,
+	"both": true, "case": true, "cast": true, "check": true, "collate": true, "collation": true,
+	"column": true, "concurrently": true, "constraint": true, "create": true, "cross": true,
+	"current_catalog": true, "current_date": true, "current_role": true, "current_schema": true,
+	"current_time": true, "current_timestamp": true, "current_user": true, "default": true,
+	"deferrable": true, "desc": true, "distinct": true, "do": true, "else": true, "end": true,
+	"except": true, "false": true, "fetch": true, "for": true, "foreign": true, "freeze": true,
+	"from": true, "full": true, "grant": true, "group": true, "having": true, "ilike": true,
+	"in": true, "initially": true, "inner": true, "intersect": true, "into": true, "is": true,
+	"isnull": true, "join": true, "lateral": true, "leading": true, "left": true, "like": true,
+	"limit": true, "localtime": true, "localtimestamp": true, "natural": true, "not": true,
+	"notnull": true, "null": true, "offset": true, "on": true, "only": true, "or": true,
+	"order": true, "outer": true, "overlaps": true, "placing": true, "primary": true,
+	"references": true, "returning": true, "right": true, "select": true, "session_user": true,
+	"similar": true, "some": true, "symmetric": true, "system_user": true, "table": true,
+	"tablesample": true, "then": true, "to": true, "trailing": true, "true": true, "union": true,
+	"unique": true, "user": true, "using": true, "variadic": true, "verbose": true, "when": true,
+	"where": true, "window": true, "with": true,
+}
+
+// isIdentifier reports whether name is a plain lowercase SQL identifier
+func isIdentifier(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, r := range name {
+		if r != '_' && (r < 'a' || r > 'z') && (i == 0 || r < '0' || r > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// isName reports whether name may be a column or table name: letters,
+// digits and underscores, not starting with a digit, as GORM and the
+// model definitions produce them
+func isName(name string) bool {
+	if name == "" || len(name) > 63 {
+		return false
+	}
+	for i, r := range name {
+		isLetter := r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+		if !isLetter && (i == 0 || r < '0' || r > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// QuoteIdentifier returns a checked name as it must appear in SQL: as is
+// when it is a lowercase identifier, double-quoted when it has uppercase
+// letters or is a reserved word
+func QuoteIdentifier(name string) string {
+	if isIdentifier(name) && !reservedWords[name] {
+		return name
+	}
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// quoteName checks a column or table name given by code and quotes it
+func quoteName(kind, name string) (string, error) {
+	if !isName(name) {
+		return "", &IdentifierError{Kind: kind, Name: name}
+	}
+	return QuoteIdentifier(name), nil
+}
+
+// compileOrder turns an order specification such as "name desc nulls last,
+// id" into an ORDER BY clause. column checks and quotes each field name;
+// directions are ASC or DESC, optionally followed by NULLS FIRST or NULLS
+// LAST. Nothing else is accepted.
+func compileOrder(order string, column func(name string) (string, error)) (string, error) {
+	var parts []string
+	for _, part := range strings.Split(order, ",") {
+		tokens := strings.Fields(part)
+		if len(tokens) == 0 {
+			return "", &IdentifierError{Kind: "order", Name: strings.TrimSpace(order)}
+		}
+		name, err := column(tokens[0])
+		if err != nil {
+			return "", err
+		}
+
+		clause := name
+		rest := tokens[1:]
+		if len(rest) > 0 {
+			direction := strings.ToUpper(rest[0])
+			if direction == "ASC" || direction == "DESC" {
+				clause += " " + direction
+				rest = rest[1:]
+			}
+		}
+		if len(rest) == 2 && strings.EqualFold(rest[0], "nulls") {
+			nulls := strings.ToUpper(rest[1])
+			if nulls == "FIRST" || nulls == "LAST" {
+				clause += " NULLS " + nulls
+				rest = rest[2:]
+			}
+		}
+		if len(rest) > 0 {
+			return "", &IdentifierError{Kind: "order", Name: strings.TrimSpace(part)}
+		}
+		parts = append(parts, clause)
+	}
+	return strings.Join(parts, ", "), nil
+}
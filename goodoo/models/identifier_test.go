@@ -0,0 +1,306 @@
+package models_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"goodoo/fields"
+	"goodoo/models"
+	"goodoo/models/testutil"
+)
+
+// injections are names and order clauses carrying SQL; none may reach a
+// query
+var injections = []string{
+	"id; DROP TABLE res_users",
+	"id; DROP TABLE res_users --",
+	"name = name OR 1=1 --",
+	`name" OR "1"="1`,
+	"name) OR (1=1",
+	"(SELECT password FROM res_users LIMIT 1)",
+	"CASE WHEN 1=1 THEN id END",
+	"id/**/",
+	"name\x00",
+	"res_partner.name",
+	"name::text",
+	"pg_sleep(10)",
+	"1",
+	"",
+}
+
+// orderInjections are order clauses whose field is valid but whose tail
+// carries SQL or an unknown keyword
+var orderInjections = []string{
+	"id desc; DROP TABLE res_users",
+	"id asc nulls sideways",
+	"id nulls",
+	"id asc asc",
+	"id desc, (SELECT 1)",
+	"id collate \"C\"",
+	"id desc limit 1",
+	"id,",
+	", id",
+	"id using <",
+}
+
+// dryRunPartners returns the partners of a dry-run session and the SQL of
+// its last query
+func dryRunPartners(t *testing.T) (*models.RecordSet[models.Partner], func() string) {
+	db, last := testutil.DryRunDB(t)
+	return models.NewRecordSet(db, models.Partner{}), last
+}
+
+func isIdentifierError(err error) bool {
+	var identifierErr *models.IdentifierError
+	return errors.As(err, &identifierErr)
+}
+
+func TestQuoteIdentifier(t *testing.T) {
+	tests := []struct{ name, want string }{
+		{"name", "name"},
+		{"partner_id", "partner_id"},
+		{"user", `"user"`},
+		{"order", `"order"`},
+		{"Name", `"Name"`},
+		{"x_Studio", `"x_Studio"`},
+		{`a"b`, `"a""b"`},
+	}
+	for _, tt := range tests {
+		if got := models.QuoteIdentifier(tt.name); got != tt.want {
+			t.Errorf("QuoteIdentifier(%q) = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSearchOrderInjection(t *testing.T) {
+	for _, order := range append(append([]string{}, injections...), orderInjections...) {
+		if order == "" {
+			// An empty order is the default order
+			continue
+		}
+		t.Run(order, func(t *testing.T) {
+			partners, last := dryRunPartners(t)
+			_, err := partners.Search(models.Domain{}, 0, 0, order)
+			if !isIdentifierError(err) {
+				t.Fatalf("Search(order %q) error = %v, want an IdentifierError", order, err)
+			}
+			if sql := last(); sql != "" {
+				t.Errorf("Search(order %q) built %s", order, sql)
+			}
+		})
+	}
+}
+
+func TestSearchOrder(t *testing.T) {
+	tests := []struct{ order, want string }{
+		{"", "ORDER BY id"},
+		{"name", "ORDER BY name"},
+		{"name desc", "ORDER BY name DESC"},
+		{"name DESC NULLS LAST, id", "ORDER BY name DESC NULLS LAST, id"},
+		{"city nulls first", "ORDER BY city NULLS FIRST"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.order, func(t *testing.T) {
+			partners, last := dryRunPartners(t)
+			if _, err := partners.Search(models.Domain{}, 0, 0, tt.order); err != nil {
+				t.Fatalf("Search(order %q): %v", tt.order, err)
+			}
+			if sql := last(); !strings.HasSuffix(sql, tt.want) {
+				t.Errorf("Search(order %q) built %s, want it to end with %s", tt.order, sql, tt.want)
+			}
+		})
+	}
+}
+
+func TestSearchDomainInjection(t *testing.T) {
+	for _, field := range injections {
+		t.Run(field, func(t *testing.T) {
+			partners, last := dryRunPartners(t)
+			_, err := partners.Search(models.Domain{[]interface{}{field, "=", 1}}, 0, 0, "")
+			if !isIdentifierError(err) {
+				t.Fatalf("Search(field %q) error = %v, want an IdentifierError", field, err)
+			}
+			if sql := last(); sql != "" {
+				t.Errorf("Search(field %q) built %s", field, sql)
+			}
+		})
+	}
+
+	t.Run("non-string field", func(t *testing.T) {
+		partners, _ := dryRunPartners(t)
+		if _, err := partners.Search(models.Domain{[]interface{}{42, "=", 1}}, 0, 0, ""); !isIdentifierError(err) {
+			t.Errorf("Search error = %v, want an IdentifierError", err)
+		}
+	})
+
+	t.Run("injected operator", func(t *testing.T) {
+		partners, last := dryRunPartners(t)
+		_, err := partners.Search(models.Domain{[]interface{}{"name", "= 'x' OR 1=1 --", 1}}, 0, 0, "")
+		if err == nil {
+			t.Fatalf("Search with an injected operator succeeded: %s", last())
+		}
+	})
+
+	// Values are always bound, whatever they hold
+	for _, operator := range []string{"=", "!=", "ilike", "not like", "in"} {
+		t.Run("bound value "+operator, func(t *testing.T) {
+			payload := "x' OR '1'='1"
+			var value interface{} = payload
+			if operator == "in" {
+				value = []string{payload}
+			}
+			partners, last := dryRunPartners(t)
+			if _, err := partners.Search(models.Domain{[]interface{}{"name", operator, value}}, 0, 0, ""); err != nil {
+				t.Fatalf("Search: %v", err)
+			}
+			if sql := last(); strings.Contains(sql, "OR '1'='1") || !strings.Contains(sql, "$1") {
+				t.Errorf("Search did not bind the value: %s", sql)
+			}
+		})
+	}
+}
+
+func TestRelationManagerInjection(t *testing.T) {
+	db, last := testutil.DryRunDB(t)
+	rm := models.NewRelationManager(db)
+	var partners []models.Partner
+	var partner models.Partner
+
+	for _, name := range injections {
+		t.Run(name, func(t *testing.T) {
+			calls := map[string]error{
+				"LoadMany2One":         rm.LoadMany2One(1, "res.partner", name, &partner),
+				"LoadOne2Many":         rm.LoadOne2Many(1, "res.partner", name, &partners),
+				"LoadMany2Many table":  rm.LoadMany2Many(1, name, "partner_id", "tag_id", &partners),
+				"LoadMany2Many local":  rm.LoadMany2Many(1, "res_tag_rel", name, "tag_id", &partners),
+				"LoadMany2Many remote": rm.LoadMany2Many(1, "res_tag_rel", "partner_id", name, &partners),
+				"CreateMany2ManyLink":  rm.CreateMany2ManyLink(1, 2, name, "partner_id", "tag_id"),
+				"DeleteMany2ManyLink":  rm.DeleteMany2ManyLink(1, 2, "res_tag_rel", "partner_id", name),
+				"UpdateOne2Many":       rm.UpdateOne2Many(1, []uint{2}, "res.partner", name),
+			}
+			for call, err := range calls {
+				if !isIdentifierError(err) {
+					t.Errorf("%s(%q) error = %v, want an IdentifierError", call, name, err)
+				}
+			}
+			if sql := last(); sql != "" {
+				t.Errorf("a statement was built: %s", sql)
+			}
+		})
+	}
+
+	t.Run("reserved words are quoted", func(t *testing.T) {
+		if err := rm.LoadOne2Many(1, "res.partner", "user", &partners); err != nil {
+			t.Fatalf("LoadOne2Many: %v", err)
+		}
+		if sql := last(); !strings.Contains(sql, `"user" = $1`) {
+			t.Errorf("LoadOne2Many built %s, want the column quoted", sql)
+		}
+	})
+}
+
+func TestIsAncestorInjection(t *testing.T) {
+	db, last := testutil.DryRunDB(t)
+	tests := []struct{ table, column string }{
+		{"res_partner; DROP TABLE res_users", "parent_id"},
+		{"res_partner", "parent_id = 0 OR 1=1 --"},
+		{"(SELECT 1)", "parent_id"},
+		{"res_partner", ""},
+	}
+	for _, tt := range tests {
+		if _, err := models.IsAncestor(db, tt.table, tt.column, 1, 2); !isIdentifierError(err) {
+			t.Errorf("IsAncestor(%q, %q) error = %v, want an IdentifierError", tt.table, tt.column, err)
+		}
+	}
+	if sql := last(); sql != "" {
+		t.Errorf("a statement was built: %s", sql)
+	}
+}
+
+// dryRunModel returns a model of the partner table with a char, a
+// selection and a JSON field, and an environment over a dry-run
+// session
+func dryRunModel(t *testing.T) (*models.ModelDefinition, *models.Environment, func() string) {
+	db, last := testutil.DryRunDB(t)
+	model := models.NewModelDefinition("test.identifier", "res_partner")
+	for name, fieldType := range map[string]fields.FieldType{
+		"name":  fields.StringType,
+		"state": fields.SelectionType,
+		"data":  fields.JsonType,
+	} {
+		field, err := fields.CreateField(fieldType, fields.FieldAttribute{String: name, Store: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		model.AddField(name, field)
+	}
+	return model, models.NewEnvironment(db, 0), last
+}
+
+func TestModelDefinitionInjection(t *testing.T) {
+	model, env, last := dryRunModel(t)
+
+	for _, name := range append(append([]string{}, injections...), orderInjections...) {
+		if name == "" {
+			continue
+		}
+		t.Run("order "+name, func(t *testing.T) {
+			var fieldErr *models.FieldNameError
+			if _, err := model.Search(env, models.Domain{}, 0, 0, name); !isIdentifierError(err) && !errors.As(err, &fieldErr) {
+				t.Errorf("Search(order %q) error = %v, want a refused name", name, err)
+			}
+		})
+	}
+
+	for _, name := range injections {
+		t.Run("domain "+name, func(t *testing.T) {
+			if _, err := model.Search(env, models.Domain{[]interface{}{name, "=", 1}}, 0, 0, ""); !isIdentifierError(err) {
+				t.Errorf("Search(field %q) error = %v, want an IdentifierError", name, err)
+			}
+			if _, err := model.SearchCount(env, models.Domain{[]interface{}{name, "=", 1}}); !isIdentifierError(err) {
+				t.Errorf("SearchCount(field %q) error = %v, want an IdentifierError", name, err)
+			}
+		})
+
+		if name == "" {
+			// No group by is no breakdown
+			continue
+		}
+		t.Run("group by "+name, func(t *testing.T) {
+			if _, err := model.ReadGrouped(env, models.GroupedQuery{GroupBy: name}); err == nil {
+				t.Errorf("ReadGrouped(group by %q) succeeded", name)
+			}
+			result, err := model.Aggregate(env, models.Domain{}, []models.AggregateSpec{{Field: name, Function: "sum"}}, name)
+			if err != nil {
+				t.Fatalf("Aggregate: %v", err)
+			}
+			if len(result.Warnings) != 2 || result.GroupBy != "" {
+				t.Errorf("Aggregate(%q) = %+v, want the spec and group_by skipped", name, result)
+			}
+		})
+	}
+	if sql := last(); strings.Contains(sql, "DROP") || strings.Contains(sql, "1=1") || strings.Contains(sql, "password") {
+		t.Errorf("an injected statement was built: %s", sql)
+	}
+
+	t.Run("aggregate function", func(t *testing.T) {
+		result, err := model.Aggregate(env, models.Domain{}, []models.AggregateSpec{{Field: "id", Function: "sum(id)); DROP TABLE res_users; --"}}, "")
+		if err != nil {
+			t.Fatalf("Aggregate: %v", err)
+		}
+		if len(result.Warnings) != 1 {
+			t.Errorf("Aggregate warnings = %v, want the function refused", result.Warnings)
+		}
+	})
+
+	t.Run("unsortable group by", func(t *testing.T) {
+		result, err := model.Aggregate(env, models.Domain{}, nil, "data")
+		if err != nil {
+			t.Fatalf("Aggregate: %v", err)
+		}
+		if result.GroupBy != "" || len(result.Warnings) != 1 {
+			t.Errorf("Aggregate(group by data) = %+v, want it refused", result)
+		}
+	})
+}
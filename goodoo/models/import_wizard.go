@@ -0,0 +1,52 @@
+package models
+
+import (
+	"goodoo/fields"
+)
+
+// ImportWizardModel is the transient model holding a file to import into
+// another model while the user maps its columns (like Odoo's
+// base_import.import). It is registered by the wizard running the import.
+const ImportWizardModel = "base_import.import"
+
+// NewImportWizard returns the definition of the import wizard
+func NewImportWizard() *ModelDefinition {
+	model := NewModelDefinition(ImportWizardModel, "base_import_import")
+	model.Description = "Base Import"
+	model.Transient = true
+	model.QuickCreate = false
+
+	newField := func(name string, fieldType fields.FieldType, attrs fields.FieldAttribute) fields.Field {
+		field, _ := fields.CreateField(fieldType, attrs)
+		model.AddField(name, field)
+		return field
+	}
+	attrs := func(label string, required bool, value interface{}, help string) fields.FieldAttribute {
+		a := fields.DefaultFieldAttributes()
+		a.String, a.Required, a.Default, a.Help = label, required, value, help
+		return a
+	}
+
+	newField("res_model", fields.StringType, attrs("Model", true, nil, "Model the rows are imported into"))
+	newField("file", fields.BinaryType, attrs("File", false, nil, "Content of the uploaded file"))
+	newField("file_name", fields.StringType, attrs("File Name", false, nil, ""))
+	newField("file_type", fields.StringType, attrs("File Type", false, nil, "MIME type of the file, e.g. text/csv"))
+	newField("has_headers", fields.BooleanType, attrs("Use First Row as Header", false, true, "The first row names the columns instead of holding a record"))
+	newField("encoding", fields.StringType, attrs("Encoding", false, nil, "Encoding of the file, e.g. utf-8 or windows-1252; detected when empty"))
+	newField("separator", fields.StringType, attrs("Separator", false, nil, "Column separator of CSV files; detected when empty"))
+	newField("profile", fields.JsonType, attrs("Profile", false, nil, "Encoding and separator the file was read with, and which of them were detected"))
+	newField("columns", fields.JsonType, attrs("Columns", false, nil, "Columns of the file with a sample value"))
+	newField("row_count", fields.IntegerType, attrs("Rows", false, nil, "Rows to import"))
+	newField("mapping", fields.JsonType, attrs("Mapping", false, nil, "Field each column is imported into, by column name; unmapped columns are skipped"))
+	newField("key_column", fields.StringType, attrs("Key Column", false, nil, "Column naming each row, unique in the file, for the references between its rows"))
+	newField("xmlid_column", fields.StringType, attrs("External ID Column", false, nil, "Column holding the external id of each row, \"module.name\" or a name of the __import__ module; the imported records get it"))
+	newField("references", fields.JsonType, attrs("References", false, nil, "How the cells of relational columns name their record, by column name: {\"by\": \"key\"} for a row of the file, {\"by\": \"xmlid\"} for an external id, {\"by\": \"match\", \"field\": \"email\"} for a stored record; other columns hold record ids"))
+	newField("column_formats", fields.JsonType, attrs("Column Formats", false, nil, "Decimal and thousands separators and strftime date format of the columns not written in the user's language, by column name"))
+	newField("preview", fields.JsonType, attrs("Preview", false, nil, "Converted first rows and the errors of a dry run"))
+	state := newField("state", fields.SelectionType, attrs("Status", false, "draft", ""))
+	if selection, ok := state.(*fields.SelectionField); ok {
+		selection.AddOption("draft", "Draft")
+		selection.AddOption("done", "Imported")
+	}
+	return model
+}
@@ -0,0 +1,37 @@
+package models
+
+import "goodoo/crypto"
+
+// Inbound hook authentication modes
+const (
+	InboundAuthHMAC  = "hmac"
+	InboundAuthToken = "token"
+)
+
+// InboundHook maps events POSTed to /hooks/<name> onto an API method call
+type InboundHook struct {
+	BaseModel
+	Name string `gorm:"not null;uniqueIndex" json:"name"`
+	// Auth is hmac (signed body) or token (shared secret in a header)
+	Auth string `gorm:"not null;default:hmac" json:"auth"`
+	// Secret is encrypted at rest
+	Secret crypto.EncryptedString `gorm:"not null" json:"-"`
+	Model  string                 `gorm:"not null" json:"model"`
+	Method string                 `gorm:"not null" json:"method"`
+	// Mapping is a JSON object of method kwargs to dotted payload paths,
+	// e.g. {"ids": "data.order_id", "amount": "data.amount"}
+	Mapping string `gorm:"type:text" json:"mapping"`
+	// UserID is the service user the method runs as
+	UserID uint `gorm:"column:user_id;not null" json:"user_id"`
+	// RateLimit is the number of calls allowed per minute, 0 for no limit
+	RateLimit int  `gorm:"column:rate_limit;default:60" json:"rate_limit"`
+	Active    bool `gorm:"default:true;index" json:"active"`
+}
+
+func (InboundHook) TableName() string {
+	return "inbound_hook"
+}
+
+func init() {
+	crypto.RegisterColumn("inbound_hook", "secret", false)
+}
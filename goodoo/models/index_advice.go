@@ -0,0 +1,126 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Kinds of index advice
+const (
+	AdviceAddIndex  = "add_index"
+	AdviceDropIndex = "drop_index"
+)
+
+// States of index advice
+const (
+	AdviceOpen      = "open"
+	AdviceDismissed = "dismissed"
+	AdviceApplied   = "applied"
+)
+
+// IndexAdvice is a recommendation of the index advisor: an index to add
+// on columns of a table that slow statements scan sequentially, or an
+// existing index unused for long. Advice is never applied on its own; an
+// administrator dismisses it or applies it. Key identifies the advice
+// across runs, so a dismissed one stays dismissed.
+type IndexAdvice struct {
+	ID    uint   `gorm:"primaryKey;autoIncrement" json:"id"`
+	Key   string `gorm:"size:255;not null;uniqueIndex" json:"key"`
+	Kind  string `gorm:"size:16;not null" json:"kind"`
+	State string `gorm:"size:16;not null;default:open;index" json:"state"`
+	Table string `gorm:"column:table_name;size:63;not null" json:"table"`
+	// Columns of the index to add, comma separated
+	Columns string `gorm:"type:varchar" json:"columns,omitempty"`
+	// IndexName is the index to drop, or the name of the index to add
+	IndexName string `gorm:"column:index_name;size:63" json:"index_name"`
+	// SQL is the statement applying the advice
+	SQL    string `gorm:"column:sql;type:text" json:"sql"`
+	Reason string `gorm:"type:text" json:"reason"`
+	// Statements and Calls are the slow statements scanning the table
+	// and their runs; TimeSavedMs estimates the time the index would
+	// have saved them
+	Statements  int     `json:"statements,omitempty"`
+	Calls       int64   `json:"calls,omitempty"`
+	TimeSavedMs float64 `gorm:"column:time_saved_ms" json:"time_saved_ms"`
+	// SizeBytes is the size of the index to drop
+	SizeBytes int64 `gorm:"column:size_bytes" json:"size_bytes,omitempty"`
+	// Sample is the slowest statement the index would serve
+	Sample     string     `gorm:"type:text" json:"sample,omitempty"`
+	ResolvedBy uint       `gorm:"column:resolved_by" json:"resolved_by,omitempty"`
+	ResolvedAt *time.Time `gorm:"column:resolved_at" json:"resolved_at,omitempty"`
+	CreateDate time.Time  `gorm:"column:create_date;autoCreateTime" json:"create_date"`
+	WriteDate  time.Time  `gorm:"column:write_date;autoUpdateTime" json:"write_date"`
+}
+
+func (IndexAdvice) TableName() string {
+	return "index_advice"
+}
+
+// SaveIndexAdvice stores the advice of a run of the advisor. Advice known
+// already keeps its state with the figures of the run; open advice the run
+// no longer gives is deleted.
+func SaveIndexAdvice(db *gorm.DB, advice []IndexAdvice) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var existing []IndexAdvice
+		if err := tx.Find(&existing).Error; err != nil {
+			return err
+		}
+		byKey := make(map[string]IndexAdvice, len(existing))
+		for _, stored := range existing {
+			byKey[stored.Key] = stored
+		}
+
+		given := make(map[string]bool, len(advice))
+		for _, item := range advice {
+			given[item.Key] = true
+			stored, exists := byKey[item.Key]
+			if !exists {
+				item.ID = 0
+				item.State = AdviceOpen
+				if err := tx.Create(&item).Error; err != nil {
+					return err
+				}
+				continue
+			}
+			item.ID = stored.ID
+			item.State = stored.State
+			item.ResolvedBy = stored.ResolvedBy
+			item.ResolvedAt = stored.ResolvedAt
+			item.CreateDate = stored.CreateDate
+			if err := tx.Save(&item).Error; err != nil {
+				return err
+			}
+		}
+
+		var stale []uint
+		for _, stored := range existing {
+			if stored.State == AdviceOpen && !given[stored.Key] {
+				stale = append(stale, stored.ID)
+			}
+		}
+		if len(stale) == 0 {
+			return nil
+		}
+		return tx.Delete(&IndexAdvice{}, stale).Error
+	})
+}
+
+// ListIndexAdvice returns the advice in a state, all of it when state is
+// empty, the most time saved first, then the largest unused indexes
+func ListIndexAdvice(db *gorm.DB, state string) ([]IndexAdvice, error) {
+	query := db.Order("time_saved_ms DESC, size_bytes DESC, id")
+	if state != "" {
+		query = query.Where("state = ?", state)
+	}
+	advice := []IndexAdvice{}
+	return advice, query.Find(&advice).Error
+}
+
+// ResolveIndexAdvice records that a user dismissed or applied advice
+func ResolveIndexAdvice(db *gorm.DB, advice *IndexAdvice, state string, uid uint, at time.Time) error {
+	advice.State = state
+	advice.ResolvedBy = uid
+	advice.ResolvedAt = &at
+	return db.Model(advice).Select("state", "resolved_by", "resolved_at").Updates(advice).Error
+}
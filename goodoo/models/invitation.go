@@ -0,0 +1,236 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Invitation errors
+var (
+	ErrInvitationNotFound = errors.New("invitation not found")
+	ErrInvitationExpired  = errors.New("invitation expired")
+	ErrInvitationRevoked  = errors.New("invitation revoked")
+	ErrInvitationAccepted = errors.New("invitation already accepted")
+	// ErrInvitationInvalid is returned when the invited account changed
+	// since the invitation: deleted, activated otherwise or its email
+	// changed
+	ErrInvitationInvalid = errors.New("invitation no longer valid for this account")
+)
+
+// Invitation states, see UserInvitation.State
+const (
+	InvitationPending  = "pending"
+	InvitationAccepted = "accepted"
+	InvitationRevoked  = "revoked"
+	InvitationExpired  = "expired"
+)
+
+// DefaultInvitationHours is how long invitations stay valid unless
+// ParamInvitationHours says otherwise
+const DefaultInvitationHours = 72
+
+// UserInvitation invites the owner of an email to activate an inactive
+// account, created without password, by choosing their password from a
+// single-use link. Sending a new invitation to the user revokes the
+// pending ones.
+type UserInvitation struct {
+	ID     uint   `gorm:"primaryKey;autoIncrement" json:"id"`
+	UserID uint   `gorm:"column:user_id;not null;index" json:"user_id"`
+	Email  string `gorm:"not null" json:"email"`
+	// TokenHash is the SHA-256 of the token; the token itself is only in
+	// the link mailed
+	TokenHash  string     `gorm:"column:token_hash;not null;uniqueIndex" json:"-"`
+	InvitedBy  uint       `gorm:"column:invited_by;not null" json:"invited_by"`
+	ExpiresAt  time.Time  `gorm:"column:expires_at;not null" json:"expires_at"`
+	AcceptedAt *time.Time `gorm:"column:accepted_at" json:"accepted_at,omitempty"`
+	RevokedAt  *time.Time `gorm:"column:revoked_at" json:"revoked_at,omitempty"`
+	// RevokedBy is the administrator who revoked the invitation, or
+	// re-sent it, 0 when revoked by the system
+	RevokedBy  uint      `gorm:"column:revoked_by" json:"revoked_by,omitempty"`
+	CreateDate time.Time `gorm:"column:create_date;autoCreateTime" json:"create_date"`
+}
+
+func (UserInvitation) TableName() string {
+	return "user_invitation"
+}
+
+// hashInvitationToken returns the stored form of an invitation token
+func hashInvitationToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return fmt.Sprintf("%x", sum)
+}
+
+// State returns the state of the invitation at now
+func (i *UserInvitation) State(now time.Time) string {
+	switch {
+	case i.AcceptedAt != nil:
+		return InvitationAccepted
+	case i.RevokedAt != nil:
+		return InvitationRevoked
+	case !now.Before(i.ExpiresAt):
+		return InvitationExpired
+	}
+	return InvitationPending
+}
+
+// Usable returns why the invitation may no longer be accepted at now, nil
+// while it is pending
+func (i *UserInvitation) Usable(now time.Time) error {
+	switch i.State(now) {
+	case InvitationAccepted:
+		return ErrInvitationAccepted
+	case InvitationRevoked:
+		return ErrInvitationRevoked
+	case InvitationExpired:
+		return ErrInvitationExpired
+	}
+	return nil
+}
+
+// InviteUser sends a new invitation to an invited user, valid until
+// expiresAt, and returns it with its token. The pending invitations of the
+// user are revoked by invitedBy, so their links stop working.
+func InviteUser(db *gorm.DB, user *User, invitedBy uint, now, expiresAt time.Time) (*UserInvitation, string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+
+	invitation := &UserInvitation{
+		UserID:    user.ID,
+		Email:     user.Email,
+		TokenHash: hashInvitationToken(token),
+		InvitedBy: invitedBy,
+		ExpiresAt: expiresAt,
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&UserInvitation{}).
+			Where("user_id = ? AND accepted_at IS NULL AND revoked_at IS NULL", user.ID).
+			Updates(map[string]interface{}{"revoked_at": now, "revoked_by": invitedBy}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(invitation).Error
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return invitation, token, nil
+}
+
+// FindInvitation returns the invitation of a token, whatever its state
+func FindInvitation(db *gorm.DB, token string) (*UserInvitation, error) {
+	if token == "" {
+		return nil, ErrInvitationNotFound
+	}
+	var invitation UserInvitation
+	err := db.Where("token_hash = ?", hashInvitationToken(token)).First(&invitation).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvitationNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &invitation, nil
+}
+
+// Revoke closes a pending invitation
+func (i *UserInvitation) Revoke(db *gorm.DB, by uint, at time.Time) error {
+	i.RevokedAt = &at
+	i.RevokedBy = by
+	return db.Model(i).Updates(map[string]interface{}{"revoked_at": at, "revoked_by": by}).Error
+}
+
+// InvitationAcceptance is what the invited user chooses when accepting:
+// their password and, optionally, their language and timezone
+type InvitationAcceptance struct {
+	Password string
+	Lang     string
+	Tz       string
+}
+
+// Accept activates the invited account with the chosen password and
+// preferences, and consumes the invitation. The invitation is locked, so
+// a token is accepted once; the account must still be the inactive one
+// invited, with the same email.
+func (i *UserInvitation) Accept(db *gorm.DB, acceptance InvitationAcceptance, now time.Time) (*User, error) {
+	var user User
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var current UserInvitation
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&current, i.ID).Error; err != nil {
+			return err
+		}
+		if err := current.Usable(now); err != nil {
+			return err
+		}
+		err := tx.First(&user, current.UserID).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInvitationInvalid
+		}
+		if err != nil {
+			return err
+		}
+		if user.Active || !strings.EqualFold(user.Email, current.Email) {
+			return ErrInvitationInvalid
+		}
+
+		if err := user.SetPassword(acceptance.Password); err != nil {
+			return err
+		}
+		values := map[string]interface{}{"password": user.Password, "active": true}
+		user.Active = true
+		if acceptance.Lang != "" {
+			user.Lang = acceptance.Lang
+			values["lang"] = acceptance.Lang
+		}
+		if acceptance.Tz != "" {
+			user.Tz = acceptance.Tz
+			values["tz"] = acceptance.Tz
+		}
+		if err := tx.Model(&user).Updates(values).Error; err != nil {
+			return err
+		}
+		current.AcceptedAt = &now
+		*i = current
+		return tx.Model(&current).Update("accepted_at", now).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// CreateInvitedUser creates the inactive account of an invited user,
+// without password, in groups
+func CreateInvitedUser(db *gorm.DB, login, name, email, lang string, groupIDs []uint) (*User, error) {
+	user := &User{Login: login, Name: name, Email: email, Lang: lang}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(user).Error; err != nil {
+			return err
+		}
+		// Active defaults to true in the table: clear it once created
+		user.Active = false
+		if err := tx.Model(user).Update("active", false).Error; err != nil {
+			return err
+		}
+		for _, id := range groupIDs {
+			if err := tx.Model(user).Association("Groups").Append(&ResGroups{BaseModel: BaseModel{ID: id}}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
@@ -0,0 +1,109 @@
+package models
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Knowledge document states
+const (
+	KnowledgeStateDraft   = "draft"
+	KnowledgeStateIndexed = "indexed"
+	KnowledgeStateError   = "error"
+)
+
+// KnowledgeDocument is a source of the LLM knowledge base: raw text or an
+// attachment, split into embedded chunks when ingested
+type KnowledgeDocument struct {
+	BaseModel
+	Title string `gorm:"not null" json:"title"`
+	// Content is the raw text; documents built from an attachment read it instead
+	Content      string `gorm:"type:text" json:"content,omitempty"`
+	AttachmentID *uint  `gorm:"column:attachment_id;index" json:"attachment_id"`
+	// ChunkSize and ChunkOverlap are counted in words
+	ChunkSize    int `gorm:"column:chunk_size;default:200" json:"chunk_size"`
+	ChunkOverlap int `gorm:"column:chunk_overlap;default:40" json:"chunk_overlap"`
+	ChunkCount   int `gorm:"column:chunk_count" json:"chunk_count"`
+	// Checksum and EmbeddingModel identify the indexed version, so an
+	// unchanged document is not embedded again
+	Checksum       string     `gorm:"" json:"checksum"`
+	EmbeddingModel string     `gorm:"column:embedding_model" json:"embedding_model"`
+	State          string     `gorm:"default:draft" json:"state"`
+	Error          string     `gorm:"type:text" json:"error,omitempty"`
+	IndexedAt      *time.Time `gorm:"column:indexed_at" json:"indexed_at"`
+}
+
+func (KnowledgeDocument) TableName() string {
+	return "knowledge_document"
+}
+
+// KnowledgeChunk is an embedded passage of a knowledge document. The
+// embedding is also copied to a pgvector column when the extension exists.
+type KnowledgeChunk struct {
+	ID             uint   `gorm:"primaryKey;autoIncrement" json:"id"`
+	DocumentID     uint   `gorm:"column:document_id;not null;index" json:"document_id"`
+	Sequence       int    `gorm:"not null" json:"sequence"`
+	Content        string `gorm:"type:text;not null" json:"content"`
+	EmbeddingModel string `gorm:"column:embedding_model;index" json:"embedding_model"`
+	Embedding      Vector `gorm:"type:float8[]" json:"-"`
+}
+
+func (KnowledgeChunk) TableName() string {
+	return "knowledge_chunk"
+}
+
+// Vector is an embedding stored as a PostgreSQL float8[]
+type Vector []float64
+
+// Value encodes the vector as an array literal
+func (v Vector) Value() (driver.Value, error) {
+	if v == nil {
+		return nil, nil
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, x := range v {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(strconv.FormatFloat(x, 'g', -1, 64))
+	}
+	b.WriteByte('}')
+	return b.String(), nil
+}
+
+// Scan decodes an array literal
+func (v *Vector) Scan(src interface{}) error {
+	var text string
+	switch s := src.(type) {
+	case nil:
+		*v = nil
+		return nil
+	case string:
+		text = s
+	case []byte:
+		text = string(s)
+	default:
+		return fmt.Errorf("cannot scan %T into Vector", src)
+	}
+
+	text = strings.Trim(text, "{}[]")
+	if text == "" {
+		*v = Vector{}
+		return nil
+	}
+	parts := strings.Split(text, ",")
+	vector := make(Vector, len(parts))
+	for i, part := range parts {
+		x, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return fmt.Errorf("invalid vector component %q: %w", part, err)
+		}
+		vector[i] = x
+	}
+	*v = vector
+	return nil
+}
@@ -0,0 +1,229 @@
+package models
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"goodoo/crypto"
+	"gorm.io/gorm"
+)
+
+// LLMProvider is a configured LLM service (like llm.provider of the Odoo
+// LLM addons)
+type LLMProvider struct {
+	BaseModel
+	Name    string `gorm:"not null" json:"name"`
+	Service string `gorm:"not null" json:"service"`
+	Active  bool   `gorm:"not null;default:false" json:"active"`
+	APIBase string `gorm:"column:api_base" json:"api_base"`
+	// APIKey is encrypted at rest
+	APIKey crypto.EncryptedString `gorm:"column:api_key" json:"-"`
+	Models []LLMModel             `gorm:"foreignKey:ProviderID" json:"models"`
+}
+
+func (LLMProvider) TableName() string {
+	return "llm_provider"
+}
+
+func init() {
+	crypto.RegisterColumn("llm_provider", "api_key", false)
+}
+
+// LLMModel is a model offered by a provider
+type LLMModel struct {
+	BaseModel
+	Name      string `gorm:"not null" json:"name"`
+	ModelName string `gorm:"column:model_name;not null" json:"model_name"`
+	// Type is chat, embedding, ...
+	Type       string `gorm:"default:chat" json:"type"`
+	Active     bool   `gorm:"not null;default:false" json:"active"`
+	ProviderID uint   `gorm:"column:provider_id;not null;index" json:"provider_id"`
+	// ContextWindow is how many tokens the model reads, 0 when unknown
+	// (see DefaultLLMContextWindow)
+	ContextWindow int `gorm:"column:context_window;not null;default:0" json:"context_window"`
+}
+
+func (LLMModel) TableName() string {
+	return "llm_model"
+}
+
+// LLMAddon is an LLM addon known to the server and its state
+type LLMAddon struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+	Installed   bool   `json:"installed"`
+	Active      bool   `json:"active"`
+	Version     string `json:"version"`
+	Category    string `json:"category"`
+	Description string `json:"description"`
+}
+
+// llmAddons is the addons registry, by name
+var (
+	llmAddons     = make(map[string]LLMAddon)
+	llmAddonMutex sync.RWMutex
+)
+
+func init() {
+	for _, addon := range []LLMAddon{
+		{Name: "llm", DisplayName: "LLM Integration Base", Installed: true, Active: true, Version: "16.0.1.4.0", Category: "Core", Description: "Base LLM integration module"},
+		{Name: "llm_openai", DisplayName: "OpenAI Integration", Installed: true, Active: true, Version: "16.0.1.1.3", Category: "Provider", Description: "OpenAI provider integration"},
+		{Name: "llm_anthropic", DisplayName: "Anthropic Integration", Installed: true, Active: false, Version: "16.0.1.1.0", Category: "Provider", Description: "Anthropic Claude integration"},
+		{Name: "llm_ollama", DisplayName: "Ollama Integration", Installed: true, Active: true, Version: "16.0.1.0.0", Category: "Provider", Description: "Local Ollama integration"},
+		{Name: "llm_mistral", DisplayName: "Mistral Integration", Category: "Provider", Description: "Mistral AI integration"},
+		{Name: "llm_chroma", DisplayName: "Chroma Vector Store", Installed: true, Active: true, Version: "16.0.1.0.0", Category: "Vector Store", Description: "ChromaDB integration"},
+		{Name: "llm_qdrant", DisplayName: "Qdrant Vector Store", Category: "Vector Store", Description: "Qdrant integration"},
+		{Name: "llm_pgvector", DisplayName: "PostgreSQL Vector", Installed: true, Active: false, Version: "16.0.1.0.0", Category: "Vector Store", Description: "pgvector storage"},
+		{Name: "llm_knowledge", DisplayName: "Knowledge Base", Installed: true, Active: true, Version: "16.0.1.0.0", Category: "Knowledge", Description: "Knowledge management"},
+		{Name: "llm_training", DisplayName: "Model Training", Category: "Training", Description: "Fine-tuning jobs"},
+		{Name: "llm_assistant", DisplayName: "AI Assistant", Installed: true, Active: false, Version: "16.0.1.0.0", Category: "Interface", Description: "Conversational AI interface"},
+		{Name: "llm_replicate", DisplayName: "Replicate Integration", Category: "Specialized", Description: "Replicate hosted models"},
+		{Name: "llm_litellm", DisplayName: "LiteLLM Gateway", Category: "Specialized", Description: "LiteLLM proxy integration"},
+		{Name: "llm_mcp", DisplayName: "MCP Integration", Installed: true, Active: false, Version: "16.0.1.0.0", Category: "Specialized", Description: "Model Context Protocol tools"},
+	} {
+		llmAddons[addon.Name] = addon
+	}
+}
+
+// RegisterLLMAddon adds an addon to the registry or updates its state
+func RegisterLLMAddon(addon LLMAddon) {
+	llmAddonMutex.Lock()
+	llmAddons[addon.Name] = addon
+	llmAddonMutex.Unlock()
+	invalidateLLMCatalogs()
+}
+
+// LLMAddons returns the registered addons sorted by name
+func LLMAddons() []LLMAddon {
+	llmAddonMutex.RLock()
+	defer llmAddonMutex.RUnlock()
+	addons := make([]LLMAddon, 0, len(llmAddons))
+	for _, addon := range llmAddons {
+		addons = append(addons, addon)
+	}
+	sort.Slice(addons, func(i, j int) bool { return addons[i].Name < addons[j].Name })
+	return addons
+}
+
+// LLMSummary counts the providers, models and addons of a catalog
+type LLMSummary struct {
+	TotalProviders  int `json:"total_providers"`
+	ActiveProviders int `json:"active_providers"`
+	TotalModels     int `json:"total_models"`
+	ActiveModels    int `json:"active_models"`
+	InstalledAddons int `json:"installed_addons"`
+}
+
+// LLMCatalog is the LLM configuration of a database: its providers with
+// their models, the routes of the models and the addons
+type LLMCatalog struct {
+	Providers []LLMProvider
+	Routes    []LLMRoute
+	Addons    []LLMAddon
+	Summary   LLMSummary
+}
+
+// llmCatalogs caches the catalog of each database until a provider, a
+// model, a route or an addon changes; llmCatalogGeneration counts the changes so a
+// catalog loaded during one is not cached
+var (
+	llmCatalogs          sync.Map // dbName -> *LLMCatalog
+	llmCatalogGeneration atomic.Uint64
+)
+
+// invalidateLLMCatalogs drops the cached catalogs; the hooks of providers,
+// models and routes do not know their database, so every catalog is dropped
+func invalidateLLMCatalogs() {
+	llmCatalogGeneration.Add(1)
+	llmCatalogs.Clear()
+}
+
+// LoadLLMCatalog returns the catalog of a database, loading the providers
+// and their models in one preloaded query, then the routes. A model
+// counts as active when it and its provider are. The catalog is shared and must not be modified.
+func LoadLLMCatalog(db *gorm.DB, dbName string) (*LLMCatalog, error) {
+	if cached, ok := llmCatalogs.Load(dbName); ok {
+		return cached.(*LLMCatalog), nil
+	}
+	generation := llmCatalogGeneration.Load()
+
+	var providers []LLMProvider
+	err := db.Preload("Models", func(tx *gorm.DB) *gorm.DB { return tx.Order("id") }).Order("id").Find(&providers).Error
+	if err != nil {
+		return nil, err
+	}
+	var routes []LLMRoute
+	if err := db.Order("model").Find(&routes).Error; err != nil {
+		return nil, err
+	}
+	catalog := &LLMCatalog{Providers: providers, Routes: routes, Addons: LLMAddons()}
+	catalog.Summary.TotalProviders = len(providers)
+	for _, provider := range providers {
+		if provider.Active {
+			catalog.Summary.ActiveProviders++
+		}
+		catalog.Summary.TotalModels += len(provider.Models)
+		for _, model := range provider.Models {
+			if model.Active && provider.Active {
+				catalog.Summary.ActiveModels++
+			}
+		}
+	}
+	for _, addon := range catalog.Addons {
+		if addon.Installed {
+			catalog.Summary.InstalledAddons++
+		}
+	}
+
+	if llmCatalogGeneration.Load() == generation {
+		llmCatalogs.Store(dbName, catalog)
+	}
+	return catalog, nil
+}
+
+// AfterSave drops the cached catalogs
+func (p *LLMProvider) AfterSave(tx *gorm.DB) error {
+	invalidateLLMCatalogs()
+	return nil
+}
+
+// AfterDelete drops the cached catalogs
+func (p *LLMProvider) AfterDelete(tx *gorm.DB) error {
+	invalidateLLMCatalogs()
+	return nil
+}
+
+// AfterSave drops the cached catalogs
+func (m *LLMModel) AfterSave(tx *gorm.DB) error {
+	invalidateLLMCatalogs()
+	return nil
+}
+
+// AfterDelete drops the cached catalogs
+func (m *LLMModel) AfterDelete(tx *gorm.DB) error {
+	invalidateLLMCatalogs()
+	return nil
+}
+
+// SeedLLMProviders creates the default providers and models in a database
+// without any
+func SeedLLMProviders(db *gorm.DB) error {
+	var count int64
+	if err := db.Model(&LLMProvider{}).Count(&count).Error; err != nil || count > 0 {
+		return err
+	}
+	providers := []LLMProvider{
+		{Name: "OpenAI Production", Service: "openai", Active: true, APIBase: "https://api.openai.com/v1", Models: []LLMModel{
+			{Name: "GPT-4", ModelName: "gpt-4", Type: "chat", Active: true, ContextWindow: 8192},
+			{Name: "GPT-3.5 Turbo", ModelName: "gpt-3.5-turbo", Type: "chat", Active: true, ContextWindow: 16385},
+			{Name: "Text Embedding Ada", ModelName: "text-embedding-ada-002", Type: "embedding", Active: true},
+		}},
+		{Name: "Local Ollama", Service: "ollama", Active: true, APIBase: "http://localhost:11434", Models: []LLMModel{
+			{Name: "Llama 2", ModelName: "llama2", Type: "chat", Active: true, ContextWindow: 4096},
+			{Name: "Code Llama", ModelName: "codellama", Type: "chat", Active: false},
+		}},
+		{Name: "Anthropic Claude", Service: "anthropic", Active: false},
+	}
+	return db.Create(&providers).Error
+}
@@ -0,0 +1,195 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Classes of the errors of LLM providers, telling a route whether to fail
+// over to its next provider
+const (
+	LLMErrorTimeout     = "timeout"
+	LLMErrorRateLimit   = "rate_limit"
+	LLMErrorUnavailable = "unavailable"
+	LLMErrorAuth        = "auth"
+	LLMErrorInvalid     = "invalid_request"
+	// LLMErrorContentPolicy is a refusal of the prompt; it always surfaces,
+	// asking another provider would only sidestep the refusal
+	LLMErrorContentPolicy = "content_policy"
+)
+
+// LLMErrorClasses are the error classes a route may fail over on
+var LLMErrorClasses = []string{LLMErrorTimeout, LLMErrorRateLimit, LLMErrorUnavailable, LLMErrorAuth, LLMErrorInvalid}
+
+// DefaultLLMFailoverOn are the error classes routes fail over on unless
+// they say otherwise: the transient ones
+var DefaultLLMFailoverOn = []string{LLMErrorTimeout, LLMErrorRateLimit, LLMErrorUnavailable}
+
+// MaxLLMRouteLatency bounds the max latency of a route
+const MaxLLMRouteLatency = 10 * time.Minute
+
+// Cooldown of the failing LLM providers, see the llm package
+const (
+	DefaultLLMCooldownSeconds      = 60
+	DefaultLLMCooldownAlertMinutes = 15
+)
+
+// LLMRouteTarget is a model of a provider a route may send chats to
+type LLMRouteTarget struct {
+	ProviderID uint   `json:"provider_id"`
+	Model      string `json:"model"`
+}
+
+// LLMRouteTargets are the fallbacks of a route, stored as JSON
+type LLMRouteTargets []LLMRouteTarget
+
+// Value encodes the targets as JSON
+func (t LLMRouteTargets) Value() (driver.Value, error) {
+	if t == nil {
+		t = LLMRouteTargets{}
+	}
+	data, err := json.Marshal(t)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// Scan decodes the JSON targets
+func (t *LLMRouteTargets) Scan(src interface{}) error {
+	switch s := src.(type) {
+	case nil:
+		*t = nil
+		return nil
+	case string:
+		return json.Unmarshal([]byte(s), t)
+	case []byte:
+		return json.Unmarshal(s, t)
+	default:
+		return fmt.Errorf("cannot scan %T into LLMRouteTargets", src)
+	}
+}
+
+// LLMRoute tells which providers answer the chats asking for a model: the
+// preferred one, then the fallbacks in order. A provider slower than
+// MaxLatencyMs, or failing with an error of a FailoverOn class, hands the
+// chat to the next one; other errors surface immediately.
+type LLMRoute struct {
+	BaseModel
+	// Model is the model chats ask for
+	Model      string `gorm:"not null;uniqueIndex" json:"model"`
+	ProviderID uint   `gorm:"column:provider_id;not null" json:"provider_id"`
+	// ProviderModel is the model name at the preferred provider, Model
+	// when empty
+	ProviderModel string          `gorm:"column:provider_model" json:"provider_model,omitempty"`
+	Fallbacks     LLMRouteTargets `gorm:"type:jsonb;not null;default:'[]'" json:"fallbacks"`
+	// MaxLatencyMs is how long a provider may take to answer, or to send
+	// the first delta of a stream, 0 for no bound
+	MaxLatencyMs int        `gorm:"column:max_latency_ms;not null;default:0" json:"max_latency_ms"`
+	FailoverOn   StringList `gorm:"column:failover_on;type:jsonb;not null;default:'[]'" json:"failover_on"`
+	Active       bool       `gorm:"not null;default:true" json:"active"`
+}
+
+func (LLMRoute) TableName() string {
+	return "llm_route"
+}
+
+// Targets returns the preferred target of the route, then its fallbacks
+func (r *LLMRoute) Targets() []LLMRouteTarget {
+	preferred := LLMRouteTarget{ProviderID: r.ProviderID, Model: r.ProviderModel}
+	if preferred.Model == "" {
+		preferred.Model = r.Model
+	}
+	return append([]LLMRouteTarget{preferred}, r.Fallbacks...)
+}
+
+// FailsOverOn reports whether errors of a class hand the chat to the next
+// target
+func (r *LLMRoute) FailsOverOn(class string) bool {
+	return class != LLMErrorContentPolicy && slices.Contains(r.FailoverOn, class)
+}
+
+// Validate checks the route against the providers and chat models of a
+// catalog, and fills in the default error classes
+func (r *LLMRoute) Validate(catalog *LLMCatalog) error {
+	r.Model = strings.TrimSpace(r.Model)
+	if r.Model == "" {
+		return errors.New("the route needs a model")
+	}
+	if r.MaxLatencyMs < 0 || time.Duration(r.MaxLatencyMs)*time.Millisecond > MaxLLMRouteLatency {
+		return fmt.Errorf("max_latency_ms must be between 0 and %d", MaxLLMRouteLatency.Milliseconds())
+	}
+	if r.FailoverOn == nil {
+		r.FailoverOn = slices.Clone(DefaultLLMFailoverOn)
+	}
+	for _, class := range r.FailoverOn {
+		if !slices.Contains(LLMErrorClasses, class) {
+			return fmt.Errorf("cannot fail over on %q: use %s", class, strings.Join(LLMErrorClasses, ", "))
+		}
+	}
+	seen := make(map[LLMRouteTarget]bool)
+	for i, target := range r.Targets() {
+		provider := catalog.Provider(target.ProviderID)
+		if provider == nil {
+			return fmt.Errorf("target %d: unknown provider %d", i, target.ProviderID)
+		}
+		if provider.ChatModel(target.Model) == nil {
+			return fmt.Errorf("target %d: %s has no chat model %q", i, provider.Name, target.Model)
+		}
+		if seen[target] {
+			return fmt.Errorf("target %d: %s/%s is already a target of the route", i, provider.Name, target.Model)
+		}
+		seen[target] = true
+	}
+	return nil
+}
+
+// Provider returns the provider of an ID, nil when unknown
+func (c *LLMCatalog) Provider(id uint) *LLMProvider {
+	for i := range c.Providers {
+		if c.Providers[i].ID == id {
+			return &c.Providers[i]
+		}
+	}
+	return nil
+}
+
+// Route returns the active route of a model, nil when none
+func (c *LLMCatalog) Route(model string) *LLMRoute {
+	for i := range c.Routes {
+		if c.Routes[i].Active && c.Routes[i].Model == model {
+			return &c.Routes[i]
+		}
+	}
+	return nil
+}
+
+// ChatModel returns the chat model of a name offered by the provider, nil
+// when none
+func (p *LLMProvider) ChatModel(name string) *LLMModel {
+	for i := range p.Models {
+		if p.Models[i].ModelName == name && p.Models[i].Type == "chat" {
+			return &p.Models[i]
+		}
+	}
+	return nil
+}
+
+// AfterSave drops the cached catalogs
+func (r *LLMRoute) AfterSave(tx *gorm.DB) error {
+	invalidateLLMCatalogs()
+	return nil
+}
+
+// AfterDelete drops the cached catalogs
+func (r *LLMRoute) AfterDelete(tx *gorm.DB) error {
+	invalidateLLMCatalogs()
+	return nil
+}
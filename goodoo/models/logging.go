@@ -0,0 +1,89 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// IrLogging is a log record written by the PostgreSQL log handler (like
+// Odoo's ir.logging). The column types match the table the handler creates
+// in log databases the server does not migrate.
+type IrLogging struct {
+	ID         uint      `gorm:"primaryKey;autoIncrement" json:"id"`
+	CreateDate time.Time `gorm:"column:create_date;type:timestamp;index" json:"create_date"`
+	// Type is server or client
+	Type     string  `gorm:"type:varchar;not null" json:"type"`
+	DBName   string  `gorm:"column:dbname;type:varchar" json:"dbname"`
+	Name     string  `gorm:"type:varchar;not null" json:"name"`
+	Level    string  `gorm:"type:varchar" json:"level"`
+	Message  string  `gorm:"type:text;not null" json:"message"`
+	Path     string  `gorm:"type:varchar" json:"path"`
+	Line     int     `gorm:"type:integer" json:"line"`
+	Func     string  `gorm:"column:func;type:varchar" json:"func"`
+	Metadata *string `gorm:"type:jsonb" json:"metadata,omitempty"`
+}
+
+func (IrLogging) TableName() string {
+	return "ir_logging"
+}
+
+// PruneLogs deletes the log records older than before and returns how
+// many were deleted
+func PruneLogs(db *gorm.DB, before time.Time) (int64, error) {
+	result := db.Where("create_date < ?", before.UTC()).Delete(&IrLogging{})
+	return result.RowsAffected, result.Error
+}
+
+// LogFilter selects log records; zero fields do not filter
+type LogFilter struct {
+	// Levels are level names such as WARNING
+	Levels []string
+	// Logger matches a logger and its children: goodoo.http matches
+	// goodoo.http.rpc
+	Logger  string
+	DBName  string
+	From    time.Time
+	To      time.Time
+	Message string
+	Offset  int
+	Limit   int
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
+}
+
+// SearchLogs returns the log records matching a filter, newest first, and
+// how many match in total
+func SearchLogs(db *gorm.DB, filter LogFilter) ([]IrLogging, int64, error) {
+	query := db.Model(&IrLogging{})
+	if len(filter.Levels) > 0 {
+		query = query.Where("level IN ?", filter.Levels)
+	}
+	if filter.Logger != "" {
+		query = query.Where("name = ? OR name LIKE ?", filter.Logger, escapeLike(filter.Logger)+".%")
+	}
+	if filter.DBName != "" {
+		query = query.Where("dbname = ?", filter.DBName)
+	}
+	if !filter.From.IsZero() {
+		query = query.Where("create_date >= ?", filter.From.UTC())
+	}
+	if !filter.To.IsZero() {
+		query = query.Where("create_date < ?", filter.To.UTC())
+	}
+	if filter.Message != "" {
+		query = query.Where("message ILIKE ?", "%"+escapeLike(filter.Message)+"%")
+	}
+
+	var total int64
+	if err := query.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	var logs []IrLogging
+	err := query.Order("create_date DESC, id DESC").Offset(filter.Offset).Limit(filter.Limit).Find(&logs).Error
+	return logs, total, err
+}
@@ -0,0 +1,30 @@
+package models
+
+import "time"
+
+// Outgoing mail states
+const (
+	MailStateOutgoing = "outgoing"
+	MailStateSent     = "sent"
+	MailStateFailed   = "failed"
+)
+
+// MailMessage is a queued outgoing email (like Odoo's mail.mail)
+type MailMessage struct {
+	BaseModel
+	EmailFrom     string     `gorm:"column:email_from" json:"email_from"`
+	EmailTo       string     `gorm:"column:email_to;not null" json:"email_to"`
+	EmailCc       string     `gorm:"column:email_cc" json:"email_cc"`
+	ReplyTo       string     `gorm:"column:reply_to" json:"reply_to"`
+	Subject       string     `gorm:"" json:"subject"`
+	BodyHTML      string     `gorm:"column:body_html;type:text" json:"body_html"`
+	State         string     `gorm:"default:outgoing;index" json:"state"`
+	FailureReason string     `gorm:"column:failure_reason;type:text" json:"failure_reason,omitempty"`
+	Attempts      int        `gorm:"default:0" json:"attempts"`
+	NextAttempt   time.Time  `gorm:"column:next_attempt;index" json:"next_attempt"`
+	SentAt        *time.Time `gorm:"column:sent_at" json:"sent_at,omitempty"`
+}
+
+func (MailMessage) TableName() string {
+	return "mail_mail"
+}
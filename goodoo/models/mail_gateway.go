@@ -0,0 +1,116 @@
+package models
+
+import (
+	"time"
+
+	"goodoo/crypto"
+)
+
+// States of the inbound messages: received until processed, then done,
+// or failed and kept for review with their raw message
+const (
+	MailInboundReceived = "received"
+	MailInboundDone     = "done"
+	MailInboundFailed   = "failed"
+	// MailInboundDismissed are failed messages an administrator dismissed
+	MailInboundDismissed = "dismissed"
+)
+
+// Sources of the inbound messages
+const (
+	MailSourceIMAP    = "imap"
+	MailSourceWebhook = "webhook"
+)
+
+// MailAlias routes the messages sent to an address to a gateway handler
+// (like Odoo's mail.alias with a fetchmail server). Messages come from its
+// IMAP mailbox, polled when IMAPEnabled, or are posted by the inbound
+// webhook of a mail provider to /hooks/mail/<name>.
+type MailAlias struct {
+	BaseModel
+	Name string `gorm:"not null;uniqueIndex" json:"name"`
+	// Email is the address of the alias, for information
+	Email string `json:"email"`
+	// Handler names the registered gateway handler creating the records
+	// (see mailgate.RegisterHandler), and Model the model it creates
+	Handler string `gorm:"not null" json:"handler"`
+	Model   string `json:"model"`
+	// UserID is the user the records are created as
+	UserID uint `gorm:"column:user_id;not null" json:"user_id"`
+	Active bool `gorm:"default:true;index" json:"active"`
+
+	IMAPEnabled  bool                   `gorm:"column:imap_enabled;default:false" json:"imap_enabled"`
+	IMAPHost     string                 `gorm:"column:imap_host" json:"imap_host"`
+	IMAPPort     int                    `gorm:"column:imap_port;default:993" json:"imap_port"`
+	IMAPTLS      bool                   `gorm:"column:imap_tls;default:true" json:"imap_tls"`
+	IMAPUser     string                 `gorm:"column:imap_user" json:"imap_user"`
+	IMAPPassword crypto.EncryptedString `gorm:"column:imap_password" json:"-"`
+	IMAPMailbox  string                 `gorm:"column:imap_mailbox;default:INBOX" json:"imap_mailbox"`
+	// PollMinutes is the interval between two polls of the mailbox
+	PollMinutes int        `gorm:"column:poll_minutes;default:5" json:"poll_minutes"`
+	LastPoll    *time.Time `gorm:"column:last_poll" json:"last_poll,omitempty"`
+	LastError   string     `gorm:"column:last_error;type:text" json:"last_error,omitempty"`
+
+	// WebhookToken authenticates the posts of the inbound webhook, in the
+	// X-Goodoo-Token header or the token query parameter; the webhook is
+	// refused while it is empty
+	WebhookToken crypto.EncryptedString `gorm:"column:webhook_token" json:"-"`
+}
+
+func (MailAlias) TableName() string {
+	return "mail_alias"
+}
+
+// MailInbound is a message received by the gateway. The Message-ID
+// deduplicates the messages of each alias, a message sent to two aliases
+// being received by both, and the failed ones keep their raw message
+// for the review queue.
+type MailInbound struct {
+	ID         uint      `gorm:"primarykey" json:"id"`
+	AliasID    uint      `gorm:"column:alias_id;not null;uniqueIndex:idx_mail_inbound_alias_message,priority:1" json:"alias_id"`
+	MessageID  string    `gorm:"column:message_id;not null;uniqueIndex:idx_mail_inbound_alias_message,priority:2" json:"message_id"`
+	Source     string    `gorm:"not null" json:"source"`
+	State      string    `gorm:"not null;default:received;index" json:"state"`
+	EmailFrom  string    `gorm:"column:email_from" json:"email_from"`
+	Subject    string    `json:"subject"`
+	InReplyTo  string    `gorm:"column:in_reply_to" json:"in_reply_to,omitempty"`
+	ReceivedAt time.Time `gorm:"column:received_at;not null;index" json:"received_at"`
+	// ResModel and ResID name the record the handler created or updated
+	ResModel string `gorm:"column:res_model" json:"res_model,omitempty"`
+	ResID    uint   `gorm:"column:res_id" json:"res_id,omitempty"`
+	Error    string `gorm:"type:text" json:"error,omitempty"`
+	Attempts int    `gorm:"not null;default:0" json:"attempts"`
+	Size     int    `gorm:"not null;default:0" json:"size"`
+	// Raw is the message as received, dropped once processed
+	Raw []byte `gorm:"type:bytea" json:"-"`
+}
+
+func (MailInbound) TableName() string {
+	return "mail_inbound"
+}
+
+// MailThreadMessage is a message posted on a record, such as a note
+// created from an inbound email (like Odoo's mail.message)
+type MailThreadMessage struct {
+	BaseModel
+	Model string `gorm:"not null;index:idx_mail_message_res" json:"model"`
+	ResID uint   `gorm:"column:res_id;not null;index:idx_mail_message_res" json:"res_id"`
+	// MessageType is email for the messages received by the gateway
+	MessageType string `gorm:"column:message_type;not null;default:note" json:"message_type"`
+	AuthorID    *uint  `gorm:"column:author_id;index" json:"author_id"`
+	EmailFrom   string `gorm:"column:email_from" json:"email_from"`
+	Subject     string `json:"subject"`
+	Body        string `gorm:"type:text" json:"body"`
+	MessageID   string `gorm:"column:message_id;index" json:"message_id,omitempty"`
+	// ParentID is the message this one replies to
+	ParentID *uint `gorm:"column:parent_id;index" json:"parent_id,omitempty"`
+}
+
+func (MailThreadMessage) TableName() string {
+	return "mail_message"
+}
+
+func init() {
+	crypto.RegisterColumn("mail_alias", "imap_password", false)
+	crypto.RegisterColumn("mail_alias", "webhook_token", false)
+}
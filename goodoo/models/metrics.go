@@ -0,0 +1,56 @@
+package models
+
+import (
+	"time"
+)
+
+// Metrics sample resolutions, from the finest to the coarsest
+const (
+	MetricsMinute = "minute"
+	MetricsHour   = "hour"
+	MetricsDay    = "day"
+)
+
+// MetricsSample is a snapshot of the server activity over the period
+// starting at Timestamp (column period_start). Minute samples are rolled
+// up into hour samples, and hour samples into day samples, as they age.
+type MetricsSample struct {
+	ID         uint      `gorm:"primaryKey;autoIncrement" json:"-"`
+	Resolution string    `gorm:"size:8;not null;uniqueIndex:metrics_sample_period" json:"resolution"`
+	Timestamp  time.Time `gorm:"column:period_start;not null;uniqueIndex:metrics_sample_period" json:"timestamp"`
+
+	RequestCount int64 `gorm:"not null;default:0" json:"request_count"`
+	ErrorCount   int64 `gorm:"not null;default:0" json:"error_count"`
+	// Latency percentiles of the requests, in milliseconds
+	LatencyP50 float64 `gorm:"column:latency_p50;not null;default:0" json:"latency_p50"`
+	LatencyP95 float64 `gorm:"column:latency_p95;not null;default:0" json:"latency_p95"`
+	LatencyP99 float64 `gorm:"column:latency_p99;not null;default:0" json:"latency_p99"`
+
+	ActiveSessions int `gorm:"not null;default:0" json:"active_sessions"`
+	// ActiveUsers counts the distinct users with a session used in the last
+	// 15 minutes
+	ActiveUsers int `gorm:"not null;default:0" json:"active_users"`
+	// Connection pool gauges, and the waits for a connection over the period
+	PoolOpen      int   `gorm:"not null;default:0" json:"pool_open"`
+	PoolInUse     int   `gorm:"not null;default:0" json:"pool_in_use"`
+	PoolIdle      int   `gorm:"not null;default:0" json:"pool_idle"`
+	PoolWaitCount int64 `gorm:"not null;default:0" json:"pool_wait_count"`
+	// LogsDropped counts the log records that could not be written to
+	// ir_logging over the period
+	LogsDropped int64 `gorm:"not null;default:0" json:"logs_dropped"`
+	// CrashCount counts the panics recovered over the period
+	CrashCount int64 `gorm:"not null;default:0" json:"crash_count"`
+	// ServiceRequestCount counts the requests of service accounts, also
+	// counted in RequestCount
+	ServiceRequestCount int64 `gorm:"not null;default:0" json:"service_request_count"`
+	// Worker pool gauges: the busy workers and the tasks waiting for one
+	WorkersBusy  int `gorm:"not null;default:0" json:"workers_busy"`
+	WorkersQueue int `gorm:"not null;default:0" json:"workers_queue"`
+	// Connections is the gauge of the long-lived connections (event
+	// streams) open on the database
+	Connections int `gorm:"not null;default:0" json:"connections"`
+}
+
+func (MetricsSample) TableName() string {
+	return "metrics_sample"
+}
@@ -1,10 +1,16 @@
 package models
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"reflect"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
+	"goodoo/database"
 	"goodoo/fields"
 	"goodoo/logging"
 	"gorm.io/gorm"
@@ -21,9 +27,30 @@ type ModelDefinition struct {
 	
 	// Model configuration
 	AutoCreate  bool                       `json:"auto_create"`  // Auto-create table
-	Transient   bool                       `json:"transient"`    // Don't persist to DB
-	Abstract    bool                       `json:"abstract"`     // Abstract model
-	Inherits    []string                   `json:"inherits"`     // Inherited models
+	Transient   bool                       `json:"transient"`    // Records are vacuumed (wizards)
+	Abstract    bool                       `json:"abstract"`     // Field mixin without table or records
+	Inherits    []string                   `json:"inherits"`     // Models whose fields are copied in
+
+	// Transient records not written for TransientMaxAge (DefaultTransientMaxAge
+	// when zero) are vacuumed, as are the oldest beyond TransientMaxCount
+	// when it is positive
+	TransientMaxAge   time.Duration `json:"transient_max_age,omitempty"`
+	TransientMaxCount int           `json:"transient_max_count,omitempty"`
+
+	// RecName is the field naming the records, "name" when empty
+	RecName string `json:"rec_name,omitempty"`
+	// QuickCreate lets relational fields create a record from a typed
+	// name (see NameCreate); on by default
+	QuickCreate bool `json:"quick_create"`
+	// Bundle lists the relations whose records the bundle of a record
+	// includes (see ExportBundle)
+	Bundle []BundleRelation `json:"bundle,omitempty"`
+	// Constraints are the composite unique and check constraints of the
+	// table (see AddUniqueConstraint and AddCheckConstraint)
+	Constraints []Constraint `json:"constraints,omitempty"`
+	// Taggable gives the records tags, in the virtual tag_ids field (see
+	// TagField)
+	Taggable bool `json:"taggable,omitempty"`
 }
 
 // NewModelDefinition creates a new model definition
@@ -39,6 +66,7 @@ func NewModelDefinition(name, tableName string) *ModelDefinition {
 		Fields:     make(map[string]fields.Field),
 		Logger:     logging.GetLogger(fmt.Sprintf("goodoo.models.%s", name)),
 		AutoCreate: true,
+		QuickCreate: true,
 		Transient:  false,
 		Abstract:   false,
 		Inherits:   []string{},
@@ -199,7 +227,7 @@ func (m *ModelDefinition) ConvertData(data map[string]interface{}, conversionTyp
 
 // GetCreateSchema returns SQL DDL for creating the table
 func (m *ModelDefinition) GetCreateSchema() string {
-	if m.Transient || m.Abstract {
+	if m.Abstract {
 		return ""
 	}
 	
@@ -208,6 +236,9 @@ func (m *ModelDefinition) GetCreateSchema() string {
 	// Add stored fields
 	for name, field := range m.GetStoredFields() {
 		pgType, _ := field.GetColumnType()
+		if name == "id" {
+			pgType = "SERIAL"
+		}
 		column := fmt.Sprintf("%s %s", name, pgType)
 		
 		// Add constraints
@@ -221,6 +252,7 @@ func (m *ModelDefinition) GetCreateSchema() string {
 	
 	// Add primary key
 	columns = append(columns, "PRIMARY KEY (id)")
+	columns = append(columns, m.constraintSchema()...)
 	
 	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (\n  %s\n);",
 		m.TableName,
@@ -240,19 +272,25 @@ func (m *ModelDefinition) GetDefaultValues() map[string]interface{} {
 	return defaults
 }
 
-// GetFieldsInfo returns field information for API responses
-func (m *ModelDefinition) GetFieldsInfo() map[string]interface{} {
+// GetFieldsInfo returns field information for API responses. With an
+// environment, fields the user may not read are left out and fields the
+// user may not write are reported readonly.
+func (m *ModelDefinition) GetFieldsInfo(env *Environment) map[string]interface{} {
 	fieldsInfo := make(map[string]interface{})
 	
 	for name, field := range m.Fields {
 		attrs := field.GetAttributes()
+		readable, writable := env.fieldAccess(field)
+		if !readable {
+			continue
+		}
 		
 		fieldInfo := map[string]interface{}{
 			"type":        field.GetType(),
 			"string":      attrs.String,
 			"help":        attrs.Help,
 			"required":    attrs.Required,
-			"readonly":    attrs.Readonly,
+			"readonly":    attrs.Readonly || !writable,
 			"store":       attrs.Store,
 			"copy":        attrs.Copy,
 			"default":     attrs.Default,
@@ -261,6 +299,17 @@ func (m *ModelDefinition) GetFieldsInfo() map[string]interface{} {
 			"domain":      attrs.Domain,
 			"context":     attrs.Context,
 			"translate":   attrs.Translate,
+			"index":       attrs.IndexType(),
+			"unique":      attrs.Unique,
+		}
+		if attrs.ContextDefault != "" {
+			fieldInfo["context_default"] = attrs.ContextDefault
+		}
+		if attrs.DefaultExpr != "" {
+			fieldInfo["default_expr"] = attrs.DefaultExpr
+		}
+		if names := m.fieldConstraints(name); len(names) > 0 {
+			fieldInfo["constraints"] = names
 		}
 		
 		// Add field-specific information
@@ -271,6 +320,9 @@ func (m *ModelDefinition) GetFieldsInfo() map[string]interface{} {
 			if f.Digits != nil {
 				fieldInfo["digits"] = []int{f.Digits.Total, f.Digits.Decimal}
 			}
+		case *fields.MonetaryField:
+			fieldInfo["digits"] = []int{f.Digits.Total, f.Digits.Decimal}
+			fieldInfo["currency"] = f.Currency
 		case *fields.SelectionField:
 			fieldInfo["selection"] = f.Selection
 		}
@@ -281,10 +333,13 @@ func (m *ModelDefinition) GetFieldsInfo() map[string]interface{} {
 	return fieldsInfo
 }
 
-// FieldModelRegistry manages model registration and creation
+// FieldModelRegistry manages model registration and creation. It is safe
+// for concurrent use; walks over its models work on a snapshot taken
+// under the read lock.
 type FieldModelRegistry struct {
 	models map[string]*ModelDefinition
 	logger *logging.Logger
+	mutex  sync.RWMutex
 }
 
 // NewFieldModelRegistry creates a new field model registry
@@ -295,47 +350,199 @@ func NewFieldModelRegistry() *FieldModelRegistry {
 	}
 }
 
-// RegisterModel registers a model in the registry
-func (r *FieldModelRegistry) RegisterModel(model *ModelDefinition) {
+// RegisterModel registers a model in the registry. The fields of the
+// models it inherits, which must be registered first, are copied into it
+// unless it defines them itself.
+func (r *FieldModelRegistry) RegisterModel(model *ModelDefinition) error {
+	if model.Abstract && model.Transient {
+		return fmt.Errorf("model %s cannot be both abstract and transient", model.Name)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, name := range model.Inherits {
+		if _, exists := r.models[name]; !exists {
+			return fmt.Errorf("model %s inherits unknown model %s", model.Name, name)
+		}
+	}
+	for _, name := range model.Inherits {
+		for fieldName, field := range r.models[name].Fields {
+			if _, defined := model.Fields[fieldName]; !defined {
+				model.Fields[fieldName] = field
+			}
+		}
+	}
+	if err := model.validateConstraints(); err != nil {
+		return err
+	}
+
 	r.models[model.Name] = model
 	r.logger.Info("Registered model: %s", model.Name)
+	return nil
 }
 
 // GetModel retrieves a model by name
 func (r *FieldModelRegistry) GetModel(name string) (*ModelDefinition, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
 	model, exists := r.models[name]
 	return model, exists
 }
 
-// GetAllModels returns all registered models
+// GetAllModels returns a copy of the registered models by name
 func (r *FieldModelRegistry) GetAllModels() map[string]*ModelDefinition {
-	return r.models
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	all := make(map[string]*ModelDefinition, len(r.models))
+	for name, model := range r.models {
+		all[name] = model
+	}
+	return all
 }
 
 // CreateTables creates database tables for all models
 func (r *FieldModelRegistry) CreateTables(db *gorm.DB) error {
-	for _, model := range r.models {
-		if model.AutoCreate && !model.Transient && !model.Abstract {
+	for _, model := range r.GetAllModels() {
+		if model.AutoCreate && !model.Abstract {
 			schema := model.GetCreateSchema()
 			if schema != "" {
 				if err := db.Exec(schema).Error; err != nil {
 					r.logger.Error("Failed to create table for model %s: %v", model.Name, err)
 					return err
 				}
+				for _, c := range model.Constraints {
+					name := constraintName(model.TableName, c.Name)
+					if err := db.Exec(constraintCommentSQL(model.TableName, name, c.Definition())).Error; err != nil {
+						r.logger.Warning("Failed to record constraint %s of model %s: %v", name, model.Name, err)
+					}
+				}
 				r.logger.Info("Created table for model: %s", model.Name)
 			}
+			
+			trigramAvailable := true
+			if needsTrigram(model.GetIndexes()) {
+				if err := ensureTrigramExtension(db); err != nil {
+					trigramAvailable = false
+					r.logger.Warning("pg_trgm extension unavailable for model %s: %v", model.Name, err)
+				}
+			}
+			for _, idx := range model.GetIndexes() {
+				if idx.Type == fields.IndexTrigram && !trigramAvailable {
+					continue
+				}
+				if err := db.Exec(idx.SQL()).Error; err != nil {
+					r.logger.Error("Failed to create index for model %s: %v", model.Name, err)
+					return err
+				}
+			}
 		}
 	}
 	
 	return nil
 }
 
-// Global field model registry
+// Clone returns a copy of the model definition with its own field map
+func (m *ModelDefinition) Clone() *ModelDefinition {
+	clone := *m
+	clone.Fields = make(map[string]fields.Field, len(m.Fields))
+	for name, field := range m.Fields {
+		clone.Fields[name] = field
+	}
+	clone.Inherits = append([]string{}, m.Inherits...)
+	clone.Bundle = append([]BundleRelation(nil), m.Bundle...)
+	return &clone
+}
+
+// Clone returns an independent copy of the registry and its model definitions
+func (r *FieldModelRegistry) Clone() *FieldModelRegistry {
+	clone := NewFieldModelRegistry()
+	for name, model := range r.GetAllModels() {
+		clone.models[name] = model.Clone()
+	}
+	return clone
+}
+
+// Hash returns a digest of the stored models and their columns; it
+// changes when the schema the registry expects changes
+func (r *FieldModelRegistry) Hash() string {
+	all := r.GetAllModels()
+	names := make([]string, 0, len(all))
+	for name := range all {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	hash := sha256.New()
+	for _, name := range names {
+		model := all[name]
+		if model.Abstract {
+			continue
+		}
+		fmt.Fprintf(hash, "%s %s\n", name, model.TableName)
+		fieldNames := make([]string, 0, len(model.Fields))
+		for fieldName := range model.Fields {
+			fieldNames = append(fieldNames, fieldName)
+		}
+		sort.Strings(fieldNames)
+		for _, fieldName := range fieldNames {
+			field := model.Fields[fieldName]
+			if !field.IsStored() {
+				continue
+			}
+			columnType, _ := field.GetColumnType()
+			fmt.Fprintf(hash, "\t%s %s %t\n", fieldName, columnType, field.IsRequired())
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// scopedRegistryKind is the key of model registries stored on database.DatabaseInfo
+const scopedRegistryKind = "models"
+
+// ForDatabase returns the database's own registry, seeding it from r on first use.
+// Unregistered databases (or "") share r itself.
+func (r *FieldModelRegistry) ForDatabase(dbName string) *FieldModelRegistry {
+	if dbName == "" {
+		return r
+	}
+	
+	dbRegistry := database.GetRegistry()
+	if scoped, ok := dbRegistry.GetScopedRegistry(dbName, scopedRegistryKind); ok {
+		return scoped.(*FieldModelRegistry)
+	}
+	
+	return r.buildForDatabase(dbName, false)
+}
+
+// RebuildForDatabase replaces the database's registry with a fresh copy of r
+// and the definitions imported into the database, e.g. after installing an
+// addon in that database only
+func (r *FieldModelRegistry) RebuildForDatabase(dbName string) *FieldModelRegistry {
+	return r.buildForDatabase(dbName, true)
+}
+
+// buildForDatabase builds the registry of a database once, or again when
+// rebuild is set; concurrent callers wait for the build in progress
+func (r *FieldModelRegistry) buildForDatabase(dbName string, rebuild bool) *FieldModelRegistry {
+	built, err := database.GetRegistry().BuildScopedRegistry(dbName, scopedRegistryKind, rebuild, func() interface{} {
+		scoped := r.Clone()
+		loadDefinitions(dbName, scoped)
+		r.logger.Info("Built model registry for database %s (%d models)", dbName, len(scoped.GetAllModels()))
+		return scoped
+	})
+	if err != nil {
+		r.logger.Warning("Using the shared model registry for database %s, without its imported definitions: %v", dbName, err)
+		return r
+	}
+	return built.(*FieldModelRegistry)
+}
+
+// Global field model registry, the template for per-database registries
 var DefaultFieldModelRegistry = NewFieldModelRegistry()
 
 // RegisterFieldModel registers a model in the default registry
-func RegisterFieldModel(model *ModelDefinition) {
-	DefaultFieldModelRegistry.RegisterModel(model)
+func RegisterFieldModel(model *ModelDefinition) error {
+	return DefaultFieldModelRegistry.RegisterModel(model)
 }
 
 // GetFieldModel retrieves a model from the default registry
@@ -343,6 +550,11 @@ func GetFieldModel(name string) (*ModelDefinition, bool) {
 	return DefaultFieldModelRegistry.GetModel(name)
 }
 
+// RegistryForDB returns the model registry of a database
+func RegistryForDB(dbName string) *FieldModelRegistry {
+	return DefaultFieldModelRegistry.ForDatabase(dbName)
+}
+
 // Utility functions
 
 // toSnakeCase converts CamelCase to snake_case
@@ -455,9 +667,14 @@ func createFieldFromGoType(structField reflect.StructField) fields.Field {
 	return nil
 }
 
-// CreateModelFromStruct creates a model definition from a Go struct
+// CreateModelFromStruct creates a model definition from a Go struct. Field
+// labels and help come from the label and help tags; the description of
+// the model from its ModelDescription method (see ModelDescriber).
 func CreateModelFromStruct(name string, structType reflect.Type) *ModelDefinition {
 	model := NewModelDefinition(name, "")
+	if describer, ok := reflect.New(structType).Interface().(ModelDescriber); ok {
+		model.Description = describer.ModelDescription()
+	}
 	
 	// Extract fields from struct
 	structFields := getStructFields(structType)
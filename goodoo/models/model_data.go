@@ -0,0 +1,70 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// IrModelData maps external identifiers ("module.name") to records (like Odoo's ir.model.data)
+type IrModelData struct {
+	ID     uint   `gorm:"primaryKey;autoIncrement" json:"id"`
+	Module string `gorm:"not null;uniqueIndex:ir_model_data_xmlid" json:"module"`
+	Name   string `gorm:"not null;uniqueIndex:ir_model_data_xmlid" json:"name"`
+	Model  string `gorm:"not null;index:idx_ir_model_data_record" json:"model"`
+	ResID  uint   `gorm:"column:res_id;index:idx_ir_model_data_record" json:"res_id"`
+}
+
+func (IrModelData) TableName() string {
+	return "ir_model_data"
+}
+
+// ResolveXMLID returns the model and id of the record named by "module.name"
+func ResolveXMLID(db *gorm.DB, xmlid string) (string, uint, error) {
+	module, name, found := strings.Cut(xmlid, ".")
+	if !found {
+		return "", 0, fmt.Errorf("invalid external id %q", xmlid)
+	}
+	var data IrModelData
+	if err := db.Where("module = ? AND name = ?", module, name).First(&data).Error; err != nil {
+		return "", 0, fmt.Errorf("external id %s: %w", xmlid, err)
+	}
+	return data.Model, data.ResID, nil
+}
+
+// ImportXMLIDModule is the module of the external ids given without one
+// to imported records
+const ImportXMLIDModule = "__import__"
+
+// SetXMLID points the external id "module.name" at a record, creating it
+// when missing
+func SetXMLID(tx *gorm.DB, xmlid, model string, resID uint) error {
+	module, name, found := strings.Cut(xmlid, ".")
+	if !found {
+		return fmt.Errorf("invalid external id %q", xmlid)
+	}
+	return ensureXMLID(tx, module, name, model, resID)
+}
+
+// ResolveXMLIDs returns the records named by external ids, by external
+// id; the unknown ones are left out
+func ResolveXMLIDs(db *gorm.DB, xmlids []string) (map[string]IrModelData, error) {
+	pairs := make([][]interface{}, 0, len(xmlids))
+	for _, xmlid := range xmlids {
+		if module, name, found := strings.Cut(xmlid, "."); found {
+			pairs = append(pairs, []interface{}{module, name})
+		}
+	}
+	found := make(map[string]IrModelData, len(pairs))
+	for start := 0; start < len(pairs); start += 1000 {
+		var data []IrModelData
+		if err := db.Where("(module, name) IN ?", pairs[start:min(start+1000, len(pairs))]).Find(&data).Error; err != nil {
+			return nil, err
+		}
+		for _, record := range data {
+			found[record.Module+"."+record.Name] = record
+		}
+	}
+	return found, nil
+}
@@ -0,0 +1,179 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"goodoo/fields"
+)
+
+// ModelTranslationModel is the ir_translation model of the descriptions of
+// models and fields: res_id is 0 and the field is the key of the text,
+// "<model>" for the description of a model, "<model>.<field>" for the label
+// of a field, "<model>.<field>:help" for its help and
+// "<model>.<field>:<value>" for the label of a selection option
+const ModelTranslationModel = "ir.model"
+
+// ModelDescriber is implemented by the structs of CreateModelFromStruct
+// that describe the model they define
+type ModelDescriber interface {
+	ModelDescription() string
+}
+
+// ModelHelp is the documentation of a model for developers: its
+// description and the fields the user may read, sorted by name
+type ModelHelp struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Table       string      `json:"table,omitempty"`
+	Transient   bool        `json:"transient"`
+	Abstract    bool        `json:"abstract"`
+	Fields      []FieldHelp `json:"fields"`
+}
+
+// FieldHelp is the documentation of a field
+type FieldHelp struct {
+	Name      string                   `json:"name"`
+	Type      fields.FieldType         `json:"type"`
+	String    string                   `json:"string"`
+	Help      string                   `json:"help,omitempty"`
+	Required  bool                     `json:"required"`
+	Readonly  bool                     `json:"readonly"`
+	Relation  string                   `json:"relation,omitempty"`
+	OnDelete  string                   `json:"ondelete,omitempty"`
+	Selection []fields.SelectionOption `json:"selection,omitempty"`
+}
+
+// Help returns the documentation of the model for the user of env, in the
+// language of env when translations exist
+func (m *ModelDefinition) Help(env *Environment) (*ModelHelp, error) {
+	help := &ModelHelp{
+		Name:        m.Name,
+		Description: m.Description,
+		Table:       m.TableName,
+		Transient:   m.Transient,
+		Abstract:    m.Abstract,
+		Fields:      []FieldHelp{},
+	}
+	for name, field := range m.Fields {
+		readable, writable := env.fieldAccess(field)
+		if !readable {
+			continue
+		}
+		attrs := field.GetAttributes()
+		fieldHelp := FieldHelp{
+			Name:     name,
+			Type:     field.GetType(),
+			String:   attrs.String,
+			Help:     attrs.Help,
+			Required: attrs.Required,
+			Readonly: attrs.Readonly || !writable,
+			Relation: attrs.Relation,
+			OnDelete: attrs.OnDeleteAction(),
+		}
+		if selection, ok := field.(*fields.SelectionField); ok {
+			fieldHelp.Selection = append([]fields.SelectionOption{}, selection.Selection...)
+		}
+		help.Fields = append(help.Fields, fieldHelp)
+	}
+	sort.Slice(help.Fields, func(i, j int) bool { return help.Fields[i].Name < help.Fields[j].Name })
+
+	if err := help.translate(env); err != nil {
+		return nil, err
+	}
+	return help, nil
+}
+
+// translate replaces the texts of the help by their translations in the
+// language of env; missing translations keep the English text
+func (h *ModelHelp) translate(env *Environment) error {
+	if env == nil || env.db == nil || env.Lang() == DefaultLang {
+		return nil
+	}
+	keys := []string{h.Name}
+	for _, field := range h.Fields {
+		prefix := h.Name + "." + field.Name
+		keys = append(keys, prefix, prefix+":help")
+		for _, option := range field.Selection {
+			keys = append(keys, prefix+":"+option.Value)
+		}
+	}
+	translations, err := GetTranslations(env.db, ModelTranslationModel, []uint{0}, keys, env.Lang())
+	if err != nil {
+		return fmt.Errorf("failed to read translations: %w", err)
+	}
+	translated := translations[0]
+	overlay := func(text *string, key string) {
+		if value := translated[key]; value != "" {
+			*text = value
+		}
+	}
+
+	overlay(&h.Description, h.Name)
+	for i := range h.Fields {
+		field := &h.Fields[i]
+		prefix := h.Name + "." + field.Name
+		overlay(&field.String, prefix)
+		overlay(&field.Help, prefix+":help")
+		for j := range field.Selection {
+			overlay(&field.Selection[j].Label, prefix+":"+field.Selection[j].Value)
+		}
+	}
+	return nil
+}
+
+// Markdown renders the documentation as Markdown: the description, then a
+// table of the fields with their type, whether they are required, their
+// help and their selection options. The output only depends on the
+// documentation, so it changes exactly when the schema does.
+func (h *ModelHelp) Markdown() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n", h.Name)
+	if h.Description != "" {
+		fmt.Fprintf(&b, "%s\n\n", h.Description)
+	}
+	switch {
+	case h.Abstract:
+		b.WriteString("Abstract model: its fields are inherited by other models.\n\n")
+	case h.Transient:
+		fmt.Fprintf(&b, "Transient model stored in `%s`; its records are vacuumed.\n\n", h.Table)
+	default:
+		fmt.Fprintf(&b, "Stored in `%s`.\n\n", h.Table)
+	}
+
+	b.WriteString("| Field | Label | Type | Required | Help |\n")
+	b.WriteString("|-------|-------|------|----------|------|\n")
+	for _, field := range h.Fields {
+		fieldType := string(field.Type)
+		if field.Relation != "" {
+			fieldType += " → " + field.Relation
+		}
+		if field.Readonly {
+			fieldType += ", readonly"
+		}
+		required := ""
+		if field.Required {
+			required = "yes"
+		}
+		help := markdownCell(field.Help)
+		if len(field.Selection) > 0 {
+			options := make([]string, len(field.Selection))
+			for i, option := range field.Selection {
+				options[i] = fmt.Sprintf("`%s` %s", option.Value, markdownCell(option.Label))
+			}
+			if help != "" {
+				help += "<br>"
+			}
+			help += "Options: " + strings.Join(options, ", ")
+		}
+		fmt.Fprintf(&b, "| `%s` | %s | %s | %s | %s |\n", field.Name, markdownCell(field.String), fieldType, required, help)
+	}
+	return b.String()
+}
+
+// markdownCell escapes a text for a Markdown table cell
+func markdownCell(text string) string {
+	text = strings.ReplaceAll(text, "|", `\|`)
+	return strings.Join(strings.Fields(text), " ")
+}
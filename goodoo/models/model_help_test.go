@@ -0,0 +1,99 @@
+package models_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"goodoo/fields"
+	"goodoo/models"
+)
+
+// update rewrites the golden files of testdata instead of comparing to them:
+// go test ./models -run Golden -update, then review the diff
+var update = flag.Bool("update", false, "rewrite the golden files of testdata")
+
+// assertGolden compares content to the golden file name of testdata
+func assertGolden(t *testing.T, name string, content []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v; run go test -update to create it", err)
+	}
+	if !bytes.Equal(content, want) {
+		t.Errorf("%s changed; if on purpose, run go test -update and review the diff\ngot:\n%s", path, content)
+	}
+}
+
+// helpModel returns a documented model with the cells the Markdown
+// rendering escapes: a relation, a selection, a readonly field, and help
+// spanning lines or holding a pipe
+func helpModel(t *testing.T) *models.ModelDefinition {
+	model := models.NewModelDefinition("x.help_test", "x_help_test")
+	model.Description = "Deliveries of the help test"
+	newField := func(name string, fieldType fields.FieldType, attrs fields.FieldAttribute) fields.Field {
+		field, err := fields.CreateField(fieldType, attrs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		model.AddField(name, field)
+		return field
+	}
+	newField("name", fields.StringType, fields.FieldAttribute{String: "Reference", Required: true, Store: true,
+		Help: "Unique reference,\n  printed on the delivery slip"})
+	newField("partner_id", fields.IntegerType, fields.FieldAttribute{String: "Customer", Relation: "res.partner",
+		OnDelete: "set null", Store: true, Help: "Who | where the goods go"})
+	newField("weight", fields.FloatType, fields.FieldAttribute{String: "Weight", Readonly: true, Store: true})
+	state := newField("state", fields.SelectionType, fields.FieldAttribute{String: "Status", Store: true,
+		Help: "Progress of the delivery"})
+	state.(*fields.SelectionField).AddOption("draft", "Draft")
+	state.(*fields.SelectionField).AddOption("done", "Delivered | Signed")
+	return model
+}
+
+// TestModelHelpGolden locks the schema doc of GET /api/models/:model/help,
+// in Markdown and JSON: a changed field, label or help of the import wizard
+// shows up as a diff of testdata in review
+func TestModelHelpGolden(t *testing.T) {
+	wizard := models.NewImportWizard()
+	transient := helpModel(t)
+	transient.Name, transient.Transient = "x.help_test_wizard", true
+	abstract := helpModel(t)
+	abstract.Name, abstract.Abstract = "x.help_test_mixin", true
+
+	tests := []struct {
+		golden string
+		model  *models.ModelDefinition
+	}{
+		{"help_import_wizard", wizard},
+		{"help_model", helpModel(t)},
+		{"help_transient", transient},
+		{"help_abstract", abstract},
+	}
+	for _, tt := range tests {
+		t.Run(tt.golden, func(t *testing.T) {
+			// Without an environment every field is readable and untranslated
+			help, err := tt.model.Help(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertGolden(t, tt.golden+".golden.md", []byte(help.Markdown()))
+
+			content, err := json.MarshalIndent(help, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertGolden(t, tt.golden+".golden.json", append(content, '\n'))
+		})
+	}
+}
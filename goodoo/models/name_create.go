@@ -0,0 +1,216 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"sync"
+)
+
+// ErrQuickCreateDisabled is returned by NameCreate on models whose
+// QuickCreate is off
+var ErrQuickCreateDisabled = errors.New("quick create is disabled on this model")
+
+// NameCreator returns the values of a record created from the name typed
+// in a relational field; the values of the context defaults are added by
+// Create
+type NameCreator func(env *Environment, model *ModelDefinition, name string) (map[string]interface{}, error)
+
+var (
+	nameCreators     = make(map[string]NameCreator)
+	nameCreatorMutex sync.RWMutex
+)
+
+func init() {
+	RegisterNameCreator("res.partner", partnerNameCreator)
+	RegisterNameCreator("product.product", productNameCreator)
+	RegisterNameCreator("product.template", productNameCreator)
+}
+
+// RegisterNameCreator makes NameCreate of a model build its values with fn
+// instead of only setting the name
+func RegisterNameCreator(model string, fn NameCreator) {
+	nameCreatorMutex.Lock()
+	defer nameCreatorMutex.Unlock()
+	nameCreators[model] = fn
+}
+
+func lookupNameCreator(model string) NameCreator {
+	nameCreatorMutex.RLock()
+	defer nameCreatorMutex.RUnlock()
+	return nameCreators[model]
+}
+
+// RecNameField returns the field naming the records, empty when the model
+// has none
+func (m *ModelDefinition) RecNameField() string {
+	name := m.RecName
+	if name == "" {
+		name = "name"
+	}
+	if _, exists := m.Fields[name]; !exists {
+		return ""
+	}
+	return name
+}
+
+// NameCreate creates a record from a name alone (like Odoo's name_create)
+// and returns its ID and display name. The values come from the registered
+// NameCreator of the model, or set the rec name field; context defaults and
+// required fields are applied by Create.
+func (m *ModelDefinition) NameCreate(env *Environment, name string) (uint, string, error) {
+	if !m.QuickCreate {
+		return 0, "", ErrQuickCreateDisabled
+	}
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return 0, "", errors.New("a name is required")
+	}
+
+	var vals map[string]interface{}
+	if creator := lookupNameCreator(m.Name); creator != nil {
+		var err error
+		if vals, err = creator(env, m, name); err != nil {
+			return 0, "", err
+		}
+	} else {
+		recName := m.RecNameField()
+		if recName == "" {
+			return 0, "", fmt.Errorf("model %s has no name field", m.Name)
+		}
+		vals = map[string]interface{}{recName: name}
+	}
+
+	id, err := m.Create(env, vals)
+	if err != nil {
+		return 0, "", err
+	}
+	return id, m.displayName(env, id, name), nil
+}
+
+// displayName returns the rec name of a record, or fallback when it cannot
+// be read
+func (m *ModelDefinition) displayName(env *Environment, id uint, fallback string) string {
+	recName := m.RecNameField()
+	if recName == "" {
+		return fallback
+	}
+	records, err := m.Read(env, []uint{id}, []string{recName})
+	if err != nil || len(records) == 0 {
+		return fallback
+	}
+	if value, ok := records[0][recName].(string); ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+// NameSearch returns the [id, display name] pairs of the records whose
+// name contains name, within domain (like Odoo's name_search), and whether
+// one of them is named exactly name, ignoring case
+func (m *ModelDefinition) NameSearch(env *Environment, name string, domain Domain, limit int) ([][]interface{}, bool, error) {
+	recName := m.RecNameField()
+	if recName == "" {
+		return nil, false, fmt.Errorf("model %s has no name field", m.Name)
+	}
+	name = strings.TrimSpace(name)
+	search := append(Domain{}, domain...)
+	if name != "" {
+		search = append(search, []interface{}{recName, "ilike", name})
+	}
+	ids, err := m.Search(env, search, 0, limit, recName)
+	if err != nil {
+		return nil, false, err
+	}
+	records, err := m.Read(env, ids, []string{recName})
+	if err != nil {
+		return nil, false, err
+	}
+
+	pairs := make([][]interface{}, 0, len(records))
+	exact := false
+	for _, record := range records {
+		display, _ := record[recName].(string)
+		if name != "" && strings.EqualFold(display, name) {
+			exact = true
+		}
+		pairs = append(pairs, []interface{}{record["id"], display})
+	}
+	if !exact && name != "" && len(ids) == limit {
+		// The exact match may be beyond the limit
+		exactDomain := append(append(Domain{}, domain...), []interface{}{recName, "=ilike", escapeLike(name)})
+		count, err := m.SearchCount(env, exactDomain)
+		if err != nil {
+			return nil, false, err
+		}
+		exact = count > 0
+	}
+	return pairs, exact, nil
+}
+
+// ParsePartnerName splits a typed contact such as "Jane Doe <jane@example.com>"
+// or "Jane Doe jane@example.com" into a name and an email. A bare email is
+// also the name; text without an email is the name alone.
+func ParsePartnerName(text string) (name, email string) {
+	text = strings.TrimSpace(text)
+	if address, err := mail.ParseAddress(text); err == nil {
+		name = strings.TrimSpace(address.Name)
+		if name == "" {
+			name = address.Address
+		}
+		return name, address.Address
+	}
+
+	// An address among the words, e.g. "Jane Doe jane@example.com"
+	words := strings.Fields(text)
+	for i := len(words) - 1; i >= 0; i-- {
+		candidate := strings.Trim(words[i], "<>(),;")
+		if !strings.Contains(candidate, "@") {
+			continue
+		}
+		address, err := mail.ParseAddress(candidate)
+		if err != nil {
+			continue
+		}
+		rest := append(append([]string{}, words[:i]...), words[i+1:]...)
+		name = strings.Trim(strings.Join(rest, " "), ` "'-,`)
+		if name == "" {
+			name = address.Address
+		}
+		return name, address.Address
+	}
+	return text, ""
+}
+
+// partnerNameCreator reads the email of "Name <email>"
+func partnerNameCreator(env *Environment, model *ModelDefinition, text string) (map[string]interface{}, error) {
+	name, email := ParsePartnerName(text)
+	vals := map[string]interface{}{"name": name}
+	if _, exists := model.Fields["email"]; exists && email != "" {
+		vals["email"] = email
+	}
+	return vals, nil
+}
+
+// Product type quick-created products get without a default_type in the
+// context
+const defaultQuickCreateProductType = "consu"
+
+// productNameCreator takes the type and category of the product from the
+// default_type and default_categ_id context keys
+func productNameCreator(env *Environment, model *ModelDefinition, name string) (map[string]interface{}, error) {
+	vals := map[string]interface{}{"name": name}
+	if _, exists := model.Fields["type"]; exists {
+		vals["type"] = defaultQuickCreateProductType
+		if value, ok := env.ContextValue("default_type"); ok {
+			vals["type"] = value
+		}
+	}
+	if _, exists := model.Fields["categ_id"]; exists {
+		if value, ok := env.ContextValue("default_categ_id"); ok {
+			vals["categ_id"] = value
+		}
+	}
+	return vals, nil
+}
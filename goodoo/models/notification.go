@@ -0,0 +1,126 @@
+package models
+
+import (
+	"slices"
+	"time"
+)
+
+// Notification types, telling clients how to present a notification
+const (
+	NotificationInfo    = "info"
+	NotificationSuccess = "success"
+	NotificationWarning = "warning"
+	NotificationError   = "error"
+)
+
+// Notification categories, telling what a notification is about; users
+// choose the channel of each (see PrefNotificationChannel), except that
+// the mandatory ones cannot be turned off
+const (
+	NotificationCategoryAccount  = "account"
+	NotificationCategoryBulk     = "bulk"
+	NotificationCategoryCrash    = "crash"
+	NotificationCategoryLLM      = "llm"
+	NotificationCategoryMention  = "mention"
+	NotificationCategoryReport   = "report"
+	NotificationCategorySecurity = "security"
+	NotificationCategoryStorage  = "storage"
+	NotificationCategoryTLS      = "tls"
+	NotificationCategoryWebhook  = "webhook"
+)
+
+// NotificationCategories are the categories users may opt out of
+var NotificationCategories = []string{
+	NotificationCategoryBulk, NotificationCategoryCrash, NotificationCategoryLLM, NotificationCategoryMention, NotificationCategoryReport,
+	NotificationCategorySecurity, NotificationCategoryStorage, NotificationCategoryTLS, NotificationCategoryWebhook,
+}
+
+// AllNotificationCategories are all the categories, account ones included
+var AllNotificationCategories = append([]string{NotificationCategoryAccount}, NotificationCategories...)
+
+// MandatoryNotificationCategories are the categories no user or
+// administrator may turn off
+var MandatoryNotificationCategories = []string{NotificationCategoryAccount, NotificationCategorySecurity}
+
+// Notification delivery channels
+const (
+	// NotificationChannelInApp only shows notifications in the application
+	NotificationChannelInApp = "in_app"
+	// NotificationChannelEmail also mails each notification right away
+	NotificationChannelEmail = "email"
+	// NotificationChannelDigest also mails the notifications still unread
+	// in a daily digest
+	NotificationChannelDigest = "digest"
+	// NotificationChannelOff records nothing
+	NotificationChannelOff = "off"
+)
+
+// NotificationChannels are the delivery channels, in the order clients
+// list them
+var NotificationChannels = []string{
+	NotificationChannelInApp, NotificationChannelEmail, NotificationChannelDigest, NotificationChannelOff,
+}
+
+// Email states of notifications
+const (
+	// NotificationEmailImmediate notifications are waiting to be mailed
+	NotificationEmailImmediate = "immediate"
+	// NotificationEmailDigest notifications are waiting for the next digest
+	NotificationEmailDigest = "digest"
+	// NotificationEmailSent notifications were mailed
+	NotificationEmailSent = "sent"
+	// NotificationEmailSuppressed notifications were not mailed, e.g.
+	// because they were read before the digest
+	NotificationEmailSuppressed = "suppressed"
+)
+
+// PrefNotificationChannel returns the key of the preference holding the
+// channel a user chose for a category of notifications
+func PrefNotificationChannel(category string) string {
+	return "notification.channel." + category
+}
+
+// NotificationChannelChoices returns the channels allowed for a category:
+// all but NotificationChannelOff for the mandatory ones
+func NotificationChannelChoices(category string) []string {
+	if slices.Contains(MandatoryNotificationCategories, category) {
+		return []string{NotificationChannelInApp, NotificationChannelEmail, NotificationChannelDigest}
+	}
+	return NotificationChannels
+}
+
+func init() {
+	for _, category := range AllNotificationCategories {
+		// An empty default leaves the channel to the database default
+		PreferenceSchema[PrefNotificationChannel(category)] = PreferenceSpec{
+			Type: PrefTypeString, Default: "", Choices: NotificationChannelChoices(category),
+		}
+	}
+}
+
+// Notification is a system event addressed to a user, e.g. the end of a
+// background operation or a change to their account (like Odoo's
+// mail.notification, without a message)
+type Notification struct {
+	ID     uint   `gorm:"primaryKey;autoIncrement" json:"id"`
+	UserID uint   `gorm:"column:user_id;not null;index:notification_user_unread,priority:1" json:"user_id"`
+	Type   string `gorm:"not null;default:info" json:"type"`
+	Title  string `gorm:"not null" json:"title"`
+	Body   string `gorm:"type:text" json:"body"`
+	// Payload is a JSON object for the client, e.g. the id of the operation
+	Payload *string `gorm:"type:jsonb" json:"-"`
+	// ReadAt is set once the user read the notification
+	ReadAt *time.Time `gorm:"column:read_at;index:notification_user_unread,priority:2" json:"read_at"`
+	// Category is one of the notification categories
+	Category string `gorm:"index" json:"category"`
+	// Email is the email state, e.g. NotificationEmailDigest; empty when
+	// the notification is not to be mailed
+	Email string `gorm:"index" json:"-"`
+	// EmailedAt is set once the notification was mailed or suppressed
+	EmailedAt  *time.Time `gorm:"column:emailed_at" json:"-"`
+	CreateDate time.Time  `gorm:"column:create_date;autoCreateTime;index" json:"create_date"`
+}
+
+func (Notification) TableName() string {
+	return "notification"
+}
@@ -0,0 +1,346 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"goodoo/database"
+	"goodoo/fields"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// Reference is a column holding the id of a record of another table, with
+// what deleting that record does to the rows referencing it
+type Reference struct {
+	// Model is the registry model of the column, empty for GORM models
+	Model  string
+	Table  string
+	Column string
+	// Constraint names the foreign key of GORM models, generated for
+	// registry models
+	Constraint  string
+	ParentTable string
+	// OnDelete is one of the fields.OnDelete* actions
+	OnDelete string
+	// SoftDelete is set for tables with a deleted_at column
+	SoftDelete bool
+	// Stamped is set for tables with write_uid and write_date columns
+	Stamped bool
+}
+
+// ModelName returns the model of the column, named after the table for
+// GORM models
+func (r Reference) ModelName() string {
+	if r.Model != "" {
+		return r.Model
+	}
+	return strings.ReplaceAll(r.Table, "_", ".")
+}
+
+var (
+	gormReferences     []Reference
+	gormReferenceMutex sync.RWMutex
+)
+
+// RegisterGORMReferences declares the relations of GORM models whose
+// constraint tag sets OnDelete, e.g.
+// `gorm:"foreignKey:PartnerID;constraint:OnDelete:RESTRICT"`, for Unlink
+// and soft deletes to enforce them
+func RegisterGORMReferences(values ...interface{}) error {
+	cache := &sync.Map{}
+	var found []Reference
+	for _, value := range values {
+		modelSchema, err := schema.Parse(value, cache, schema.NamingStrategy{})
+		if err != nil {
+			return fmt.Errorf("failed to parse %T: %w", value, err)
+		}
+		for _, relation := range modelSchema.Relationships.Relations {
+			constraint := relation.ParseConstraint()
+			if constraint == nil || len(constraint.ForeignKeys) != 1 {
+				continue
+			}
+			action := fields.NormalizeOnDelete(constraint.OnDelete)
+			if action == "" {
+				continue
+			}
+			child := constraint.Schema
+			found = append(found, Reference{
+				Table:       child.Table,
+				Column:      constraint.ForeignKeys[0].DBName,
+				Constraint:  constraint.Name,
+				ParentTable: constraint.ReferenceSchema.Table,
+				OnDelete:    action,
+				SoftDelete:  child.LookUpField("deleted_at") != nil,
+				Stamped:     child.LookUpField("write_uid") != nil && child.LookUpField("write_date") != nil,
+			})
+		}
+	}
+
+	gormReferenceMutex.Lock()
+	defer gormReferenceMutex.Unlock()
+	for _, ref := range found {
+		replaced := false
+		for i, existing := range gormReferences {
+			if existing.Table == ref.Table && existing.Column == ref.Column {
+				gormReferences[i], replaced = ref, true
+			}
+		}
+		if !replaced {
+			gormReferences = append(gormReferences, ref)
+		}
+	}
+	return nil
+}
+
+// GORMReferences returns the relations registered by RegisterGORMReferences
+func GORMReferences() []Reference {
+	gormReferenceMutex.RLock()
+	defer gormReferenceMutex.RUnlock()
+	return append([]Reference(nil), gormReferences...)
+}
+
+// References returns the relational fields of the registry declaring
+// ondelete, sorted by table and column
+func (r *FieldModelRegistry) References() []Reference {
+	var refs []Reference
+	for _, model := range r.GetAllModels() {
+		if !model.AutoCreate || model.Abstract {
+			continue
+		}
+		for name, field := range model.GetStoredFields() {
+			attrs := field.GetAttributes()
+			action := attrs.OnDeleteAction()
+			if action == "" {
+				continue
+			}
+			refs = append(refs, Reference{
+				Model:       model.Name,
+				Table:       model.TableName,
+				Column:      name,
+				Constraint:  foreignKeyName(model.TableName, name),
+				ParentTable: r.relationTable(attrs.Relation),
+				OnDelete:    action,
+				Stamped:     true,
+			})
+		}
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		if refs[i].Table != refs[j].Table {
+			return refs[i].Table < refs[j].Table
+		}
+		return refs[i].Column < refs[j].Column
+	})
+	return refs
+}
+
+// relationTable returns the table of a comodel, derived from its name when
+// it is a GORM model
+func (r *FieldModelRegistry) relationTable(relation string) string {
+	if comodel, ok := r.GetModel(relation); ok {
+		return comodel.TableName
+	}
+	return strings.ReplaceAll(relation, ".", "_")
+}
+
+// modelOfTable names the model stored in a table
+func (r *FieldModelRegistry) modelOfTable(table string) string {
+	for _, model := range r.GetAllModels() {
+		if model.TableName == table && !model.Abstract {
+			return model.Name
+		}
+	}
+	return strings.ReplaceAll(table, "_", ".")
+}
+
+// referencesTo returns the references to the records of a table
+func referencesTo(registry *FieldModelRegistry, table string) []Reference {
+	var refs []Reference
+	for _, ref := range append(registry.References(), GORMReferences()...) {
+		if ref.ParentTable == table {
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
+// RestrictError is returned when deleting records still referenced through
+// a relation declaring ondelete restrict
+type RestrictError struct {
+	// Model and Field are the relation blocking the deletion
+	Model string `json:"model"`
+	Field string `json:"field"`
+	// Count is the number of records referencing the deleted ones
+	Count int64 `json:"count"`
+	// ParentModel is the model of the deleted records
+	ParentModel string `json:"parent_model"`
+}
+
+func (e *RestrictError) Error() string {
+	return fmt.Sprintf("cannot delete %s records: %d %s record(s) reference them through %s", e.ParentModel, e.Count, e.Model, e.Field)
+}
+
+// applyOnDelete enforces the references to the records of table about to
+// be deleted: a restrict relation still used fails with a RestrictError
+// before anything changes, then cascade relations delete the referencing
+// records (soft-deleting them when their table has deleted_at) and set
+// null relations clear the column, stamping write_uid and write_date
+func applyOnDelete(env *Environment, table string, ids []uint) error {
+	refs := referencesTo(env.FieldModels(), table)
+	if len(refs) == 0 || len(ids) == 0 {
+		return nil
+	}
+	tx := env.db
+
+	for _, ref := range refs {
+		if ref.OnDelete != fields.OnDeleteRestrict {
+			continue
+		}
+		var count int64
+		if err := referencing(tx, ref, ids).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return &RestrictError{Model: ref.ModelName(), Field: ref.Column, Count: count, ParentModel: env.FieldModels().modelOfTable(table)}
+		}
+	}
+
+	now := time.Now().UTC()
+	for _, ref := range refs {
+		switch ref.OnDelete {
+		case fields.OnDeleteCascade:
+			var childIDs []uint
+			if err := referencing(tx, ref, ids).Pluck("id", &childIDs).Error; err != nil {
+				return err
+			}
+			if len(childIDs) == 0 {
+				continue
+			}
+			if ref.Model != "" {
+				if model, ok := env.FieldModels().GetModel(ref.Model); ok {
+					if err := model.Unlink(env, childIDs); err != nil {
+						return err
+					}
+					continue
+				}
+			}
+			if err := applyOnDelete(env, ref.Table, childIDs); err != nil {
+				return err
+			}
+			query := fmt.Sprintf("DELETE FROM %s WHERE id IN ?", ref.Table)
+			args := []interface{}{childIDs}
+			if ref.SoftDelete {
+				query = fmt.Sprintf("UPDATE %s SET deleted_at = ? WHERE id IN ?", ref.Table)
+				args = []interface{}{now, childIDs}
+			}
+			if err := tx.Exec(query, args...).Error; err != nil {
+				return fmt.Errorf("cascade to %s.%s: %w", ref.Table, ref.Column, err)
+			}
+		case fields.OnDeleteSetNull:
+			updates := map[string]interface{}{ref.Column: nil}
+			if ref.Stamped {
+				updates["write_uid"] = env.user
+				updates["write_date"] = now
+			}
+			if err := referencing(tx, ref, ids).Updates(updates).Error; err != nil {
+				return fmt.Errorf("set null on %s.%s: %w", ref.Table, ref.Column, err)
+			}
+		}
+	}
+	return nil
+}
+
+// referencing selects the live rows of a reference pointing to ids; rows of
+// the deleted table itself among ids are left out, being deleted too
+func referencing(tx *gorm.DB, ref Reference, ids []uint) *gorm.DB {
+	query := tx.Session(&gorm.Session{NewDB: true}).Table(ref.Table).Where(clause.IN{Column: clause.Column{Name: ref.Column}, Values: uintValues(ids)})
+	if ref.Table == ref.ParentTable {
+		query = query.Where("id NOT IN ?", ids)
+	}
+	if ref.SoftDelete {
+		query = query.Where("deleted_at IS NULL")
+	}
+	return query
+}
+
+// uintValues converts ids to clause values
+func uintValues(ids []uint) []interface{} {
+	values := make([]interface{}, len(ids))
+	for i, id := range ids {
+		values[i] = id
+	}
+	return values
+}
+
+// deleteUIDKey is the GORM setting carrying the user deleting GORM models,
+// stamped on the rows set null
+const deleteUIDKey = "goodoo:delete_uid"
+
+// Delete deletes GORM models like gorm.DB.Delete, soft-deleting those
+// embedding BaseModel, with the ondelete relations applied as the
+// environment user
+func (env *Environment) Delete(value interface{}, conds ...interface{}) error {
+	return env.db.Set(deleteUIDKey, env.user).Delete(value, conds...).Error
+}
+
+func init() {
+	database.OnConnect(func(dbName string, db *gorm.DB) error {
+		return db.Callback().Delete().Before("gorm:delete").Register("goodoo:ondelete", onDeleteCallback(dbName))
+	})
+}
+
+// onDeleteCallback applies the ondelete relations to the GORM models about
+// to be deleted, in the transaction of the delete; the database foreign
+// keys cannot see soft deletes, which are only an UPDATE of deleted_at
+func onDeleteCallback(dbName string) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		statement := db.Statement
+		if db.Error != nil || statement.Schema == nil || statement.Table == "" {
+			return
+		}
+		env := NewEnvironment(db.Session(&gorm.Session{NewDB: true}), 0).WithDBName(dbName)
+		if uid, ok := db.Get(deleteUIDKey); ok {
+			env.user, _ = uid.(uint)
+		}
+		if len(referencesTo(env.FieldModels(), statement.Table)) == 0 {
+			return
+		}
+
+		// The conditions gorm:delete runs with: the WHERE clause and the
+		// primary keys of the deleted value
+		query := env.db.Table(statement.Table)
+		conditioned := false
+		if where, ok := statement.Clauses["WHERE"]; ok && where.Expression != nil {
+			query = query.Clauses(where.Expression)
+			conditioned = true
+		}
+		if len(statement.Schema.PrimaryFields) > 0 && statement.ReflectValue.IsValid() {
+			_, queryValues := schema.GetIdentityFieldValuesMap(statement.Context, statement.ReflectValue, statement.Schema.PrimaryFields)
+			column, values := schema.ToQueryValues(statement.Table, statement.Schema.PrimaryFieldDBNames, queryValues)
+			if len(values) > 0 {
+				query = query.Where(clause.IN{Column: column, Values: values})
+				conditioned = true
+			}
+		}
+		if !conditioned {
+			// gorm refuses deletes without conditions
+			return
+		}
+		if !statement.Unscoped && statement.Schema.LookUpField("deleted_at") != nil {
+			query = query.Where("deleted_at IS NULL")
+		}
+
+		var ids []uint
+		if err := query.Pluck("id", &ids).Error; err != nil {
+			db.AddError(err)
+			return
+		}
+		if err := applyOnDelete(env, statement.Table, ids); err != nil {
+			db.AddError(err)
+		}
+	}
+}
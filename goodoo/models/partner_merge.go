@@ -0,0 +1,312 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+// PartnerReference is a column holding a res_partner id
+type PartnerReference struct {
+	Table  string
+	Column string
+}
+
+var (
+	partnerReferences = []PartnerReference{
+		{Table: "res_users", Column: "partner_id"},
+		{Table: "sale_order", Column: "partner_id"},
+		{Table: "res_partner", Column: "parent_id"},
+	}
+	partnerRefMutex sync.RWMutex
+)
+
+// RegisterPartnerReference declares a column that MergePartners must repoint
+func RegisterPartnerReference(table, column string) {
+	partnerRefMutex.Lock()
+	defer partnerRefMutex.Unlock()
+	partnerReferences = append(partnerReferences, PartnerReference{Table: table, Column: column})
+}
+
+// ErrInvalidMerge is returned for merges that would lose or corrupt data
+var ErrInvalidMerge = errors.New("invalid partner merge")
+
+// MergePartners moves everything referencing the merged partners, and
+// their tags, to the survivor, fills the survivor's empty fields from
+// them, and soft-deletes them. Each merged partner keeps an external id
+// (__merged__.res_partner_<id>) resolving to the survivor. It must run in
+// a transaction.
+func MergePartners(tx *gorm.DB, uid uint, survivorID uint, mergedIDs []uint) (*Partner, error) {
+	if len(mergedIDs) == 0 {
+		return nil, fmt.Errorf("%w: no partner to merge", ErrInvalidMerge)
+	}
+	for _, id := range mergedIDs {
+		if id == survivorID {
+			return nil, fmt.Errorf("%w: a partner cannot be merged into itself", ErrInvalidMerge)
+		}
+	}
+
+	var survivor Partner
+	if err := tx.First(&survivor, survivorID).Error; err != nil {
+		return nil, fmt.Errorf("partner %d: %w", survivorID, err)
+	}
+	var merged []Partner
+	if err := tx.Where("id IN ?", mergedIDs).Order("id").Find(&merged).Error; err != nil {
+		return nil, err
+	}
+	if len(merged) != len(uniqueIDs(mergedIDs)) {
+		return nil, fmt.Errorf("%w: some partners do not exist", ErrInvalidMerge)
+	}
+
+	for _, partner := range merged {
+		if !sameCompany(partner.CompanyID, survivor.CompanyID) {
+			return nil, fmt.Errorf("%w: partners %d and %d belong to different companies", ErrInvalidMerge, partner.ID, survivor.ID)
+		}
+		if survivor.ParentID != nil {
+			// Repointing an ancestor's children to the survivor would close a cycle
+			ancestor, err := IsAncestor(tx, "res_partner", "parent_id", partner.ID, *survivor.ParentID)
+			if err != nil {
+				return nil, err
+			}
+			if ancestor {
+				return nil, fmt.Errorf("%w: partner %d is an ancestor of the survivor", ErrInvalidMerge, partner.ID)
+			}
+		}
+	}
+
+	ids := make([]uint, len(merged))
+	for i, partner := range merged {
+		ids[i] = partner.ID
+	}
+
+	partnerRefMutex.RLock()
+	references := append([]PartnerReference(nil), partnerReferences...)
+	partnerRefMutex.RUnlock()
+	for _, ref := range references {
+		query := fmt.Sprintf("UPDATE %s SET %s = ? WHERE %s IN ?", ref.Table, ref.Column, ref.Column)
+		if err := tx.Exec(query, survivorID, ids).Error; err != nil {
+			return nil, fmt.Errorf("repoint %s.%s: %w", ref.Table, ref.Column, err)
+		}
+	}
+	if err := moveTagLinks(tx, uid, "res.partner", survivorID, ids); err != nil {
+		return nil, fmt.Errorf("repoint tags: %w", err)
+	}
+	// The survivor may have been a child of a merged partner
+	if err := tx.Model(&Partner{}).Where("id = ? AND parent_id = ?", survivorID, survivorID).Update("parent_id", nil).Error; err != nil {
+		return nil, err
+	}
+
+	updates := unionPartnerFields(&survivor, merged)
+	if len(updates) > 0 {
+		if err := tx.Model(&survivor).Updates(updates).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	for _, partner := range merged {
+		name := fmt.Sprintf("res_partner_%d", partner.ID)
+		alias := IrModelData{Module: "__merged__", Name: name, Model: "res.partner", ResID: survivorID}
+		if err := tx.Create(&alias).Error; err != nil {
+			return nil, err
+		}
+	}
+	// Existing external ids of the merged partners now name the survivor
+	if err := tx.Model(&IrModelData{}).Where("model = ? AND res_id IN ?", "res.partner", ids).Update("res_id", survivorID).Error; err != nil {
+		return nil, err
+	}
+
+	if err := tx.Delete(&Partner{}, ids).Error; err != nil {
+		return nil, err
+	}
+
+	activity := Activity{
+		Type:   ActivityRecordsMerged,
+		Model:  "res.partner",
+		ResID:  survivorID,
+		Params: map[string]interface{}{"name": survivor.Name, "ids": ids, "count": len(ids)},
+	}
+	if err := LogActivity(tx, uid, activity); err != nil {
+		return nil, err
+	}
+
+	if err := tx.First(&survivor, survivorID).Error; err != nil {
+		return nil, err
+	}
+	return &survivor, nil
+}
+
+// unionPartnerFields returns the empty fields of the survivor that a merged
+// partner can fill, taking the first value in id order
+func unionPartnerFields(survivor *Partner, merged []Partner) map[string]interface{} {
+	updates := make(map[string]interface{})
+	fill := func(column, current string, value func(p *Partner) string) {
+		if current != "" {
+			return
+		}
+		for i := range merged {
+			if v := value(&merged[i]); v != "" {
+				updates[column] = v
+				return
+			}
+		}
+	}
+	fill("email", survivor.Email, func(p *Partner) string { return p.Email })
+	fill("phone", survivor.Phone, func(p *Partner) string { return p.Phone })
+	fill("street", survivor.Street, func(p *Partner) string { return p.Street })
+	fill("zip", survivor.Zip, func(p *Partner) string { return p.Zip })
+	fill("city", survivor.City, func(p *Partner) string { return p.City })
+	if survivor.CountryID == nil {
+		for _, partner := range merged {
+			if partner.CountryID != nil {
+				updates["country_id"] = *partner.CountryID
+				break
+			}
+		}
+	}
+
+	if survivor.ParentID == nil {
+		mergedIDs := make(map[uint]bool, len(merged))
+		for _, partner := range merged {
+			mergedIDs[partner.ID] = true
+		}
+		for _, partner := range merged {
+			if partner.ParentID != nil && *partner.ParentID != survivor.ID && !mergedIDs[*partner.ParentID] {
+				updates["parent_id"] = *partner.ParentID
+				break
+			}
+		}
+	}
+	return updates
+}
+
+func sameCompany(a, b *uint) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func uniqueIDs(ids []uint) []uint {
+	seen := make(map[uint]bool, len(ids))
+	unique := make([]uint, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
+
+// DuplicateCluster is a group of partners that probably are the same contact
+type DuplicateCluster struct {
+	// Reason is "email" or "name"
+	Reason   string    `json:"reason"`
+	Key      string    `json:"key"`
+	Partners []Partner `json:"partners"`
+}
+
+// NormalizeEmail lowercases an email and strips spaces
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// trigrams returns the trigrams of a text the way pg_trgm does: each word
+// is lowercased and padded with two spaces before and one after
+func trigrams(text string) map[string]bool {
+	set := make(map[string]bool)
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r > 127)
+	})
+	for _, word := range words {
+		padded := []rune("  " + word + " ")
+		for i := 0; i+3 <= len(padded); i++ {
+			set[string(padded[i:i+3])] = true
+		}
+	}
+	return set
+}
+
+// TrigramSimilarity returns the pg_trgm similarity of two texts, from 0 to 1
+func TrigramSimilarity(a, b string) float64 {
+	ta, tb := trigrams(a), trigrams(b)
+	if len(ta) == 0 || len(tb) == 0 {
+		return 0
+	}
+	shared := 0
+	for t := range ta {
+		if tb[t] {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(ta)+len(tb)-shared)
+}
+
+// FindDuplicatePartners groups partners sharing a normalized email, then
+// partners of the same company whose names are similar above threshold.
+// A partner appears in at most one cluster of each reason.
+func FindDuplicatePartners(db *gorm.DB, threshold float64) ([]DuplicateCluster, error) {
+	var partners []Partner
+	if err := db.Order("id").Find(&partners).Error; err != nil {
+		return nil, err
+	}
+
+	var clusters []DuplicateCluster
+
+	byEmail := make(map[string][]Partner)
+	for _, partner := range partners {
+		if email := NormalizeEmail(partner.Email); email != "" {
+			byEmail[email] = append(byEmail[email], partner)
+		}
+	}
+	for email, group := range byEmail {
+		if len(group) > 1 {
+			clusters = append(clusters, DuplicateCluster{Reason: "email", Key: email, Partners: group})
+		}
+	}
+
+	// Union-find over similar names within a company
+	parent := make([]int, len(partners))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	for i := range partners {
+		for j := i + 1; j < len(partners); j++ {
+			if !sameCompany(partners[i].CompanyID, partners[j].CompanyID) {
+				continue
+			}
+			if TrigramSimilarity(partners[i].Name, partners[j].Name) >= threshold {
+				parent[find(j)] = find(i)
+			}
+		}
+	}
+	byRoot := make(map[int][]Partner)
+	for i, partner := range partners {
+		root := find(i)
+		byRoot[root] = append(byRoot[root], partner)
+	}
+	for root, group := range byRoot {
+		if len(group) > 1 {
+			clusters = append(clusters, DuplicateCluster{Reason: "name", Key: partners[root].Name, Partners: group})
+		}
+	}
+
+	sort.Slice(clusters, func(i, j int) bool {
+		if clusters[i].Reason != clusters[j].Reason {
+			return clusters[i].Reason < clusters[j].Reason
+		}
+		return clusters[i].Partners[0].ID < clusters[j].Partners[0].ID
+	})
+	return clusters, nil
+}
@@ -0,0 +1,159 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// GroupPermission grants a permission of the dashboard and administration
+// routes (see RouteSpec.Permission) to the members of a group
+type GroupPermission struct {
+	ID         uint      `gorm:"primarykey" json:"id"`
+	GroupID    uint      `gorm:"not null;uniqueIndex:group_permission_unique" json:"group_id"`
+	Group      ResGroups `gorm:"foreignKey:GroupID;constraint:OnDelete:CASCADE" json:"-"`
+	Permission string    `gorm:"size:64;not null;uniqueIndex:group_permission_unique" json:"permission"`
+	CreateDate time.Time `gorm:"autoCreateTime" json:"create_date"`
+}
+
+func (GroupPermission) TableName() string {
+	return "res_groups_permission"
+}
+
+// PermissionCacheTTL is how long the resolved permissions of a user are
+// reused; assignments changed by another process apply within it
+var PermissionCacheTTL = 30 * time.Second
+
+// resolvedPermissions are the cached permissions of a user
+type resolvedPermissions struct {
+	permissions []string
+	admin       bool
+	expires     time.Time
+}
+
+// permissionCache holds the resolved permissions per database and user,
+// dropped when the assignments of the database are written
+var permissionCache sync.Map // "dbName/uid" -> resolvedPermissions
+
+// ResolvePermissions returns the permissions granted to a user by their
+// groups and whether they are an administrator, i.e. the administrator or a
+// member of base.group_system, who holds every permission
+func ResolvePermissions(dbName string, db *gorm.DB, uid uint) ([]string, bool, error) {
+	key := fmt.Sprintf("%s/%d", dbName, uid)
+	if cached, ok := permissionCache.Load(key); ok {
+		resolved := cached.(resolvedPermissions)
+		if time.Now().Before(resolved.expires) {
+			return resolved.permissions, resolved.admin, nil
+		}
+	}
+
+	var user User
+	if err := db.Select("id", "login", "is_service").First(&user, uid).Error; err != nil {
+		return nil, false, err
+	}
+	// Service accounts hold their explicit permission set, whatever their
+	// groups
+	if user.IsService {
+		account, err := FindServiceAccount(db, uid)
+		if err != nil {
+			return nil, false, err
+		}
+		permissions := append([]string(nil), account.Permissions...)
+		permissionCache.Store(key, resolvedPermissions{permissions: permissions, expires: time.Now().Add(PermissionCacheTTL)})
+		return permissions, false, nil
+	}
+	groups, err := UserGroupXMLIDs(db, uid)
+	if err != nil {
+		return nil, false, err
+	}
+	admin := user.IsAdmin()
+	for _, group := range groups {
+		if group == "base.group_system" {
+			admin = true
+		}
+	}
+	var permissions []string
+	if !admin {
+		err = db.Model(&GroupPermission{}).Distinct("permission").
+			Where("group_id IN (?)", db.Table("res_groups_users_rel").Where("uid = ?", uid).Select("gid")).
+			Order("permission").Pluck("permission", &permissions).Error
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	permissionCache.Store(key, resolvedPermissions{permissions: permissions, admin: admin, expires: time.Now().Add(PermissionCacheTTL)})
+	return permissions, admin, nil
+}
+
+// InvalidatePermissions drops the resolved permissions of the users of a
+// database
+func InvalidatePermissions(dbName string) {
+	prefix := dbName + "/"
+	permissionCache.Range(func(key, _ interface{}) bool {
+		if strings.HasPrefix(key.(string), prefix) {
+			permissionCache.Delete(key)
+		}
+		return true
+	})
+}
+
+// GroupPermissions returns the permissions granted to each group, by group
+// id
+func GroupPermissions(db *gorm.DB) (map[uint][]string, error) {
+	var rows []GroupPermission
+	if err := db.Order("group_id, permission").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	granted := make(map[uint][]string)
+	for _, row := range rows {
+		granted[row.GroupID] = append(granted[row.GroupID], row.Permission)
+	}
+	return granted, nil
+}
+
+// SetGroupPermissions replaces the permissions granted to a group, records
+// the change in the activity feed as uid and drops the resolved permissions
+// of the database
+func SetGroupPermissions(dbName string, db *gorm.DB, uid uint, group *ResGroups, permissions []string) error {
+	unique := make(map[string]bool, len(permissions))
+	rows := make([]GroupPermission, 0, len(permissions))
+	names := make([]string, 0, len(permissions))
+	for _, permission := range permissions {
+		if unique[permission] {
+			continue
+		}
+		unique[permission] = true
+		rows = append(rows, GroupPermission{GroupID: group.ID, Permission: permission})
+		names = append(names, permission)
+	}
+	sort.Strings(names)
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("group_id = ?", group.ID).Delete(&GroupPermission{}).Error; err != nil {
+			return err
+		}
+		if len(rows) > 0 {
+			if err := tx.Create(&rows).Error; err != nil {
+				return err
+			}
+		}
+		granted := strings.Join(names, ", ")
+		if granted == "" {
+			granted = "none"
+		}
+		return LogActivity(tx, uid, Activity{
+			Type:   ActivityPermissionsChanged,
+			Model:  "res.groups",
+			ResID:  group.ID,
+			Params: map[string]interface{}{"group": group.Name, "permissions": granted},
+		})
+	})
+	if err == nil {
+		InvalidatePermissions(dbName)
+	}
+	return err
+}
@@ -0,0 +1,250 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"goodoo/database"
+	"goodoo/logging"
+	"goodoo/scheduler"
+	"gorm.io/gorm"
+)
+
+// ErrDataExportNotFound is returned for an export that does not exist,
+// belongs to another user or whose download expired
+var ErrDataExportNotFound = errors.New("data export not found")
+
+// Data export states
+const (
+	DataExportRunning = "running"
+	DataExportDone    = "done"
+	DataExportFailed  = "failed"
+)
+
+// DataExportTTL is how long the download link of a personal data export
+// works once it is ready; the data is deleted afterwards
+const DataExportTTL = 24 * time.Hour
+
+// PersonalDataFormat names the format of the personal data bundles
+const PersonalDataFormat = "goodoo.personal_data"
+
+// UserDataExport is a download of the personal data of a user, for data
+// portability requests. It is generated in the background; its link works
+// for its owner only, until ExpiresAt.
+type UserDataExport struct {
+	ID          uint   `gorm:"primaryKey;autoIncrement" json:"id"`
+	UserID      uint   `gorm:"column:user_id;not null;index" json:"user_id"`
+	OperationID string `gorm:"column:operation_id" json:"operation_id"`
+	State       string `gorm:"not null;default:running" json:"state"`
+	Error       string `gorm:"type:text" json:"error,omitempty"`
+	// TokenHash is the SHA-256 of the token of the download link; the
+	// token itself is only returned when the export is started
+	TokenHash string `gorm:"column:token_hash;not null;uniqueIndex" json:"-"`
+	// Data is the JSON bundle, see PersonalData
+	Data          string     `gorm:"type:text" json:"-"`
+	Size          int        `gorm:"not null;default:0" json:"size"`
+	ExpiresAt     *time.Time `gorm:"column:expires_at;index" json:"expires_at,omitempty"`
+	DownloadCount int        `gorm:"column:download_count;not null;default:0" json:"download_count"`
+	CreateDate    time.Time  `gorm:"column:create_date;autoCreateTime" json:"create_date"`
+	DoneDate      *time.Time `gorm:"column:done_date" json:"done_date,omitempty"`
+}
+
+func (UserDataExport) TableName() string {
+	return "user_data_export"
+}
+
+// PersonalChatSession is a chat session of a personal data bundle, with
+// its messages
+type PersonalChatSession struct {
+	ChatSession
+	Messages []ChatMessage `json:"messages"`
+}
+
+// PersonalData is the personal data bundle of a user: their profile and
+// preferences, their chat sessions, their notifications and the audit
+// entries of what they did
+type PersonalData struct {
+	Format       string                 `json:"format"`
+	Version      int                    `json:"version"`
+	GeneratedAt  time.Time              `json:"generated_at"`
+	Profile      map[string]interface{} `json:"profile"`
+	Preferences  map[string]interface{} `json:"preferences"`
+	ChatSessions []PersonalChatSession  `json:"chat_sessions"`
+	// Notifications and Audit are oldest first
+	Notifications []Notification `json:"notifications"`
+	Audit         []AuditLog     `json:"audit"`
+}
+
+// PersonalDataSections are the steps of BuildPersonalData, for progress
+const PersonalDataSections = 5
+
+// BuildPersonalData collects the personal data of a user, calling
+// progress after each of the PersonalDataSections sections
+func BuildPersonalData(ctx context.Context, db *gorm.DB, uid uint, now time.Time, progress func()) (*PersonalData, error) {
+	db = db.WithContext(ctx)
+	data := &PersonalData{Format: PersonalDataFormat, Version: 1, GeneratedAt: now}
+
+	var user User
+	if err := db.First(&user, uid).Error; err != nil {
+		return nil, err
+	}
+	data.Profile = map[string]interface{}{
+		"id":          user.ID,
+		"login":       user.Login,
+		"name":        user.Name,
+		"email":       user.Email,
+		"lang":        user.Lang,
+		"tz":          user.Tz,
+		"active":      user.Active,
+		"login_date":  user.LastLogin,
+		"create_date": user.CreateDate,
+		"context":     user.ContextDefaults(),
+	}
+	progress()
+
+	var err error
+	if data.Preferences, err = GetPreferences(db, uid, ""); err != nil {
+		return nil, err
+	}
+	progress()
+
+	var sessions []ChatSession
+	if err := db.Where("user_id = ?", uid).Order("create_date, id").Find(&sessions).Error; err != nil {
+		return nil, err
+	}
+	data.ChatSessions = make([]PersonalChatSession, 0, len(sessions))
+	for _, session := range sessions {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		var messages []ChatMessage
+		if err := db.Where("session_id = ?", session.ID).Order("create_date, id").Find(&messages).Error; err != nil {
+			return nil, err
+		}
+		data.ChatSessions = append(data.ChatSessions, PersonalChatSession{ChatSession: session, Messages: messages})
+	}
+	progress()
+
+	data.Notifications = []Notification{}
+	if err := db.Where("user_id = ?", uid).Order("id").Find(&data.Notifications).Error; err != nil {
+		return nil, err
+	}
+	progress()
+
+	data.Audit = []AuditLog{}
+	if err := db.Where("user_id = ?", uid).Order("id").Find(&data.Audit).Error; err != nil {
+		return nil, err
+	}
+	progress()
+	return data, nil
+}
+
+// StartDataExport records a new running export of the personal data of a
+// user and returns it with the token of its download link
+func StartDataExport(db *gorm.DB, uid uint) (*UserDataExport, string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+	export := &UserDataExport{UserID: uid, State: DataExportRunning, TokenHash: hashInvitationToken(token)}
+	if err := db.Create(export).Error; err != nil {
+		return nil, "", err
+	}
+	return export, token, nil
+}
+
+// Finish stores the outcome of the export: the bundle, downloadable until
+// now+DataExportTTL, or the error
+func (e *UserDataExport) Finish(db *gorm.DB, data *PersonalData, exportErr error, now time.Time) error {
+	values := map[string]interface{}{"done_date": now}
+	if exportErr != nil {
+		values["state"] = DataExportFailed
+		values["error"] = exportErr.Error()
+	} else {
+		encoded, err := json.MarshalIndent(data, "", "  ")
+		if err != nil {
+			return err
+		}
+		expiresAt := now.Add(DataExportTTL)
+		values["state"] = DataExportDone
+		values["data"] = string(encoded)
+		values["size"] = len(encoded)
+		values["expires_at"] = expiresAt
+	}
+	return db.Model(e).Updates(values).Error
+}
+
+// RunningDataExport returns the running export of a user, nil when none
+func RunningDataExport(db *gorm.DB, uid uint) (*UserDataExport, error) {
+	var exports []UserDataExport
+	err := db.Omit("data").Where("user_id = ? AND state = ?", uid, DataExportRunning).Limit(1).Find(&exports).Error
+	if err != nil || len(exports) == 0 {
+		return nil, err
+	}
+	return &exports[0], nil
+}
+
+// ListDataExports returns the exports of a user, newest first, without
+// their data
+func ListDataExports(db *gorm.DB, uid uint) ([]UserDataExport, error) {
+	var exports []UserDataExport
+	err := db.Omit("data").Where("user_id = ?", uid).Order("id DESC").Find(&exports).Error
+	return exports, err
+}
+
+// DownloadDataExport returns the ready export of a token, which must
+// belong to uid and not have expired, and counts the download
+func DownloadDataExport(db *gorm.DB, uid uint, token string, now time.Time) (*UserDataExport, error) {
+	if token == "" {
+		return nil, ErrDataExportNotFound
+	}
+	var export UserDataExport
+	err := db.Where("token_hash = ? AND user_id = ? AND state = ? AND expires_at > ?", hashInvitationToken(token), uid, DataExportDone, now).
+		First(&export).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrDataExportNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = db.Model(&export).UpdateColumn("download_count", gorm.Expr("download_count + 1")).Error
+	return &export, err
+}
+
+// PruneDataExports deletes the data of the exports expired before now,
+// keeping their record for the history of the user, and the exports left
+// running by a restart a day ago
+func PruneDataExports(db *gorm.DB, now time.Time) (int64, error) {
+	result := db.Model(&UserDataExport{}).
+		Where("state = ? AND expires_at <= ? AND data <> ''", DataExportDone, now).
+		Updates(map[string]interface{}{"data": "", "size": 0})
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	err := db.Model(&UserDataExport{}).
+		Where("state = ? AND create_date < ?", DataExportRunning, now.Add(-DataExportTTL)).
+		Updates(map[string]interface{}{"state": DataExportFailed, "error": "interrupted"}).Error
+	return result.RowsAffected, err
+}
+
+// ScheduleDataExportPrune registers a job deleting, every interval, the
+// data of the expired personal data exports of a database
+func ScheduleDataExportPrune(s *scheduler.Scheduler, dbName string, interval time.Duration) {
+	logger := logging.GetLogger("goodoo.models.personal_data")
+	s.Every("models.data_export.prune."+dbName, interval, func(ctx context.Context) error {
+		db, err := database.GetDatabase(dbName)
+		if err != nil {
+			return err
+		}
+		pruned, err := PruneDataExports(db.WithContext(ctx), s.Clock().Now())
+		if pruned > 0 {
+			logger.Info("Deleted the data of %d expired personal data export(s) of %s", pruned, dbName)
+		}
+		return err
+	})
+}
@@ -0,0 +1,27 @@
+package models
+
+import (
+	"time"
+)
+
+// Presence states, from the most to the least present
+const (
+	PresenceOnline  = "online"
+	PresenceAway    = "away"
+	PresenceOffline = "offline"
+)
+
+// UserPresence is the last known presence of a user, saved periodically so
+// a restart does not lose it (like Odoo's bus.presence)
+type UserPresence struct {
+	UserID uint   `gorm:"column:user_id;primaryKey;autoIncrement:false" json:"user_id"`
+	State  string `gorm:"not null;default:offline" json:"state"`
+	// LastSeen is the last user activity, LastHeartbeat the last sign of an open client
+	LastSeen      time.Time `gorm:"column:last_seen" json:"last_seen"`
+	LastHeartbeat time.Time `gorm:"column:last_heartbeat" json:"-"`
+	WriteDate     time.Time `gorm:"column:write_date;autoUpdateTime" json:"-"`
+}
+
+func (UserPresence) TableName() string {
+	return "user_presence"
+}
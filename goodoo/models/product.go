@@ -0,0 +1,90 @@
+package models
+
+import (
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// completeNameSeparator joins the names of a category's ancestors
+const completeNameSeparator = " / "
+
+// ProductCategory is a node of the product category tree (like Odoo's
+// product.category). CompleteName is the full path, e.g.
+// "All / Electronics / Laptops".
+type ProductCategory struct {
+	BaseModel
+	Name         string            `gorm:"not null" json:"name"`
+	ParentID     *uint             `gorm:"column:parent_id;index" json:"parent_id"`
+	Children     []ProductCategory `gorm:"foreignKey:ParentID;constraint:OnDelete:SET NULL" json:"-"`
+	CompleteName string            `gorm:"column:complete_name;index" json:"complete_name"`
+	// Tags are loaded with LoadTags, not by GORM (see TagLink)
+	Tags []TagRef `gorm:"-" json:"tags,omitempty"`
+}
+
+func (ProductCategory) TableName() string {
+	return "product_category"
+}
+
+// BeforeSave rejects cyclic parents and computes the complete name
+func (c *ProductCategory) BeforeSave(tx *gorm.DB) error {
+	db := tx.Session(&gorm.Session{NewDB: true})
+	parentID := savedParent(tx, "parent_id", c.ParentID)
+	if err := checkParent(db, "product_category", "parent_id", c.ID, parentID); err != nil {
+		return err
+	}
+
+	name := c.Name
+	if updates, ok := tx.Statement.Dest.(map[string]interface{}); ok {
+		if value, set := updates["name"].(string); set {
+			name = value
+		}
+	}
+	completeName := name
+	if parentID != nil {
+		var parent ProductCategory
+		if err := db.Select("id", "complete_name").First(&parent, *parentID).Error; err != nil {
+			return fmt.Errorf("parent category %d: %w", *parentID, err)
+		}
+		completeName = parent.CompleteName + completeNameSeparator + name
+	}
+	c.CompleteName = completeName
+	tx.Statement.SetColumn("complete_name", completeName)
+	return nil
+}
+
+// AfterSave recomputes the complete names of the descendants
+func (c *ProductCategory) AfterSave(tx *gorm.DB) error {
+	if c.ID == 0 {
+		return nil
+	}
+	return PropagateCompleteName(tx.Session(&gorm.Session{NewDB: true}), c.ID)
+}
+
+// PropagateCompleteName recomputes the complete names below a category,
+// with one UPDATE per level of the tree
+func PropagateCompleteName(db *gorm.DB, categoryID uint) error {
+	seen := map[uint]bool{categoryID: true}
+	level := []uint{categoryID}
+	for len(level) > 0 {
+		var updated []uint
+		err := db.Raw(`UPDATE product_category AS child
+SET complete_name = parent.complete_name || ? || child.name
+FROM product_category AS parent
+WHERE child.parent_id = parent.id AND child.parent_id IN ? AND child.deleted_at IS NULL
+RETURNING child.id`, completeNameSeparator, level).Scan(&updated).Error
+		if err != nil {
+			return err
+		}
+
+		// Stop at records already renamed, should the data hold a cycle
+		level = level[:0]
+		for _, id := range updated {
+			if !seen[id] {
+				seen[id] = true
+				level = append(level, id)
+			}
+		}
+	}
+	return nil
+}
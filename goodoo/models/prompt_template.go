@@ -0,0 +1,361 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrPromptTemplateNotFound is returned for a template that does not
+// exist or that the user may not see
+var ErrPromptTemplateNotFound = errors.New("prompt template not found")
+
+// Scopes of the prompt templates: personal ones are seen by their owner
+// only, shared ones by every user
+const (
+	PromptScopePersonal = "personal"
+	PromptScopeShared   = "shared"
+)
+
+// Size of the rendered prompts: a model without a known context window is
+// assumed to take DefaultLLMContextWindow tokens, a token being about
+// PromptCharsPerToken characters. A rendered template may fill
+// PromptWindowShare percent of the window, the rest being left to the
+// knowledge base excerpts and the answer.
+const (
+	DefaultLLMContextWindow = 8192
+	PromptCharsPerToken     = 4
+	PromptWindowShare       = 75
+)
+
+// PromptTemplate is a prompt users send to the chat again and again, with
+// {{variable}} placeholders filled in when it is sent
+type PromptTemplate struct {
+	ID       uint   `gorm:"primaryKey;autoIncrement" json:"id"`
+	Name     string `gorm:"size:128;not null" json:"name"`
+	Scope    string `gorm:"size:16;not null;default:personal;index" json:"scope"`
+	UserID   uint   `gorm:"column:user_id;not null;index" json:"user_id"`
+	Template string `gorm:"type:text;not null" json:"template"`
+	// Model is the chat model of the messages sent from the template when
+	// they name none
+	Model      string    `json:"model"`
+	Category   string    `gorm:"size:64;not null;default:'';index" json:"category"`
+	CreateDate time.Time `gorm:"column:create_date;autoCreateTime" json:"create_date"`
+	WriteDate  time.Time `gorm:"column:write_date;autoUpdateTime" json:"write_date"`
+}
+
+func (PromptTemplate) TableName() string {
+	return "llm_prompt_template"
+}
+
+// PromptTemplateUse records a chat message sent from a template, with the
+// tokens its answer cost
+type PromptTemplateUse struct {
+	ID         uint      `gorm:"primaryKey;autoIncrement" json:"id"`
+	TemplateID uint      `gorm:"column:template_id;not null;index:llm_prompt_template_use_user,priority:2" json:"template_id"`
+	UserID     uint      `gorm:"column:user_id;not null;index:llm_prompt_template_use_user,priority:1" json:"user_id"`
+	SessionID  string    `gorm:"column:session_id;size:64" json:"session_id"`
+	Model      string    `json:"model"`
+	TokensUsed int       `gorm:"column:tokens_used;not null;default:0" json:"tokens_used"`
+	CreateDate time.Time `gorm:"column:create_date;autoCreateTime" json:"create_date"`
+}
+
+func (PromptTemplateUse) TableName() string {
+	return "llm_prompt_template_use"
+}
+
+// PromptVariableError is a template rendered with variables it does not
+// have, or without some it has
+type PromptVariableError struct {
+	Missing []string
+	Unknown []string
+}
+
+func (e *PromptVariableError) Error() string {
+	var parts []string
+	if len(e.Missing) > 0 {
+		parts = append(parts, "missing variables: "+strings.Join(e.Missing, ", "))
+	}
+	if len(e.Unknown) > 0 {
+		parts = append(parts, "unknown variables: "+strings.Join(e.Unknown, ", "))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// PromptTooLongError is a rendered prompt larger than the context window
+// of its model allows
+type PromptTooLongError struct {
+	Model string
+	Size  int
+	Limit int
+}
+
+func (e *PromptTooLongError) Error() string {
+	return fmt.Sprintf("the rendered prompt has %d characters, %s takes at most %d", e.Size, e.Model, e.Limit)
+}
+
+// promptSegment is a part of a template: text, or the placeholder of a
+// variable
+type promptSegment struct {
+	text     string
+	variable string
+}
+
+// validPromptVariable reports whether name is a variable name: a letter or
+// an underscore, then letters, digits and underscores
+func validPromptVariable(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, r := range name {
+		switch {
+		case r == '_', r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+		case r >= '0' && r <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// parsePrompt splits a template into text and placeholders. A {{ without
+// its }}, or around anything but a variable name, is malformed; a }}
+// alone is text.
+func parsePrompt(template string) ([]promptSegment, error) {
+	var segments []promptSegment
+	rest := template
+	for {
+		start := strings.Index(rest, "{{")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(rest[start+2:], "}}")
+		if end < 0 {
+			return nil, fmt.Errorf("placeholder at character %d is not closed with }}", len(template)-len(rest)+start)
+		}
+		name := strings.TrimSpace(rest[start+2 : start+2+end])
+		if !validPromptVariable(name) {
+			return nil, fmt.Errorf("invalid placeholder {{%s}}: variables are letters, digits and underscores", rest[start+2:start+2+end])
+		}
+		if start > 0 {
+			segments = append(segments, promptSegment{text: rest[:start]})
+		}
+		segments = append(segments, promptSegment{variable: name})
+		rest = rest[start+2+end+2:]
+	}
+	if rest != "" {
+		segments = append(segments, promptSegment{text: rest})
+	}
+	return segments, nil
+}
+
+// PromptVariables returns the variables of a template, sorted, or the
+// error of its first malformed placeholder
+func PromptVariables(template string) ([]string, error) {
+	segments, err := parsePrompt(template)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var names []string
+	for _, segment := range segments {
+		if segment.variable != "" && !seen[segment.variable] {
+			seen[segment.variable] = true
+			names = append(names, segment.variable)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// RenderPrompt fills in the placeholders of a template with variables,
+// strictly: a variable missing or given in excess fails with a
+// PromptVariableError listing them all. Values are inserted as they are,
+// the prompt being plain text, and are not searched for placeholders.
+func RenderPrompt(template string, variables map[string]string) (string, error) {
+	segments, err := parsePrompt(template)
+	if err != nil {
+		return "", err
+	}
+	used := make(map[string]bool)
+	var missing []string
+	var rendered strings.Builder
+	for _, segment := range segments {
+		if segment.variable == "" {
+			rendered.WriteString(segment.text)
+			continue
+		}
+		value, exists := variables[segment.variable]
+		if !exists {
+			if !used[segment.variable] {
+				missing = append(missing, segment.variable)
+			}
+		} else {
+			rendered.WriteString(value)
+		}
+		used[segment.variable] = true
+	}
+	var unknown []string
+	for name := range variables {
+		if !used[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(missing) > 0 || len(unknown) > 0 {
+		sort.Strings(missing)
+		sort.Strings(unknown)
+		return "", &PromptVariableError{Missing: missing, Unknown: unknown}
+	}
+	return rendered.String(), nil
+}
+
+// MaxPromptChars returns how many characters a prompt sent to a model
+// with a context window of tokens may have
+func MaxPromptChars(window int) int {
+	if window <= 0 {
+		window = DefaultLLMContextWindow
+	}
+	return window * PromptCharsPerToken * PromptWindowShare / 100
+}
+
+// CheckPromptSize fails with a PromptTooLongError when a prompt does not
+// fit the context window of model
+func CheckPromptSize(catalog *LLMCatalog, model, prompt string) error {
+	limit := MaxPromptChars(catalog.ContextWindow(model))
+	if size := len([]rune(prompt)); size > limit {
+		return &PromptTooLongError{Model: model, Size: size, Limit: limit}
+	}
+	return nil
+}
+
+// Validate checks a template before it is saved: a name, a known scope
+// and well-formed placeholders
+func (t *PromptTemplate) Validate() error {
+	t.Name = strings.TrimSpace(t.Name)
+	t.Category = strings.TrimSpace(t.Category)
+	t.Model = strings.TrimSpace(t.Model)
+	switch {
+	case t.Name == "":
+		return errors.New("name is required")
+	case len(t.Name) > 128:
+		return errors.New("name is longer than 128 characters")
+	case len(t.Category) > 64:
+		return errors.New("category is longer than 64 characters")
+	case t.Scope != PromptScopePersonal && t.Scope != PromptScopeShared:
+		return fmt.Errorf("scope must be %s or %s", PromptScopePersonal, PromptScopeShared)
+	case strings.TrimSpace(t.Template) == "":
+		return errors.New("template is required")
+	}
+	_, err := PromptVariables(t.Template)
+	return err
+}
+
+// PromptTemplateQuery searches the templates a user sees: Search in their
+// name, category and text, Category and Scope exactly. Order is "name",
+// by default, or "recent": the templates the user sent last first, then
+// the others by name.
+type PromptTemplateQuery struct {
+	Search   string
+	Category string
+	Scope    string
+	Order    string
+	Limit    int
+	Offset   int
+}
+
+// PromptTemplateEntry is a template found, with when the user last sent a
+// message from it
+type PromptTemplateEntry struct {
+	PromptTemplate
+	LastUsedAt *time.Time `gorm:"column:last_used_at" json:"last_used_at"`
+}
+
+// visiblePromptTemplates restricts a query to the templates a user sees:
+// theirs and the shared ones
+func visiblePromptTemplates(db *gorm.DB, userID uint) *gorm.DB {
+	return db.Where("llm_prompt_template.user_id = ? OR llm_prompt_template.scope = ?", userID, PromptScopeShared)
+}
+
+// SearchPromptTemplates returns the templates a user sees matching a
+// query, and how many match
+func SearchPromptTemplates(db *gorm.DB, userID uint, query PromptTemplateQuery) ([]PromptTemplateEntry, int64, error) {
+	base := visiblePromptTemplates(db.Model(&PromptTemplate{}), userID)
+	if search := strings.TrimSpace(query.Search); search != "" {
+		pattern := "%" + escapeLike(search) + "%"
+		base = base.Where("(llm_prompt_template.name ILIKE ? OR llm_prompt_template.category ILIKE ? OR llm_prompt_template.template ILIKE ?)",
+			pattern, pattern, pattern)
+	}
+	if query.Category != "" {
+		base = base.Where("llm_prompt_template.category = ?", query.Category)
+	}
+	if query.Scope != "" {
+		base = base.Where("llm_prompt_template.scope = ?", query.Scope)
+	}
+	var total int64
+	if err := base.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	uses := db.Model(&PromptTemplateUse{}).
+		Select("template_id, MAX(create_date) AS last_used_at").
+		Where("user_id = ?", userID).Group("template_id")
+	find := base.Select("llm_prompt_template.*, u.last_used_at").
+		Joins("LEFT JOIN (?) u ON u.template_id = llm_prompt_template.id", uses)
+	if query.Order == "recent" {
+		find = find.Order("u.last_used_at DESC NULLS LAST")
+	}
+	find = find.Order("llm_prompt_template.name, llm_prompt_template.id")
+	if query.Limit > 0 {
+		find = find.Limit(query.Limit).Offset(query.Offset)
+	}
+	var entries []PromptTemplateEntry
+	if err := find.Scan(&entries).Error; err != nil {
+		return nil, 0, err
+	}
+	return entries, total, nil
+}
+
+// GetPromptTemplate returns a template a user sees
+func GetPromptTemplate(db *gorm.DB, userID, id uint) (*PromptTemplate, error) {
+	var template PromptTemplate
+	err := visiblePromptTemplates(db, userID).Where("id = ?", id).First(&template).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrPromptTemplateNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &template, nil
+}
+
+// ContextWindow returns the context window of a model, in tokens: the
+// smallest of the targets of its route, any of which may answer, or the
+// one of the chat model of the name, DefaultLLMContextWindow when none
+// is known
+func (c *LLMCatalog) ContextWindow(model string) int {
+	window := 0
+	smallest := func(candidate *LLMModel) {
+		if candidate != nil && candidate.ContextWindow > 0 && (window == 0 || candidate.ContextWindow < window) {
+			window = candidate.ContextWindow
+		}
+	}
+	if route := c.Route(model); route != nil {
+		for _, target := range route.Targets() {
+			if provider := c.Provider(target.ProviderID); provider != nil {
+				smallest(provider.ChatModel(target.Model))
+			}
+		}
+	} else {
+		for i := range c.Providers {
+			smallest(c.Providers[i].ChatModel(model))
+		}
+	}
+	if window == 0 {
+		return DefaultLLMContextWindow
+	}
+	return window
+}
@@ -0,0 +1,109 @@
+package models
+
+import (
+	"errors"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+// The public user is the reserved user the anonymous visitors of public
+// routes (share links, invitation pages) run as, like Odoo's
+// base.public_user: audit entries, create_uid stamping, quotas and record
+// rules see it rather than user 0, the system. It is inactive, has no
+// password and cannot log in. It belongs to base.group_public, and
+// accesses only the records and fields the rules and field groups naming
+// that group open to it: nothing by default.
+const (
+	PublicUserXMLID  = "base.public_user"
+	PublicGroupXMLID = "base.group_public"
+	PublicUserLogin  = "__public__"
+)
+
+// publicUsers caches the public user id of each database, 0 while it is
+// not created
+var publicUsers sync.Map // dbName -> uint
+
+// IsPublic reports whether the user is the public user
+func (u *User) IsPublic() bool {
+	return u.Login == PublicUserLogin
+}
+
+// ensureXMLID points module.name at a record, creating the external id
+// when missing
+func ensureXMLID(tx *gorm.DB, module, name, model string, resID uint) error {
+	data := IrModelData{Module: module, Name: name}
+	return tx.Where(data).Assign(IrModelData{Model: model, ResID: resID}).FirstOrCreate(&data).Error
+}
+
+// EnsurePublicUser creates the public user of a database, its group and
+// their external ids when missing
+func EnsurePublicUser(dbName string, db *gorm.DB) (*User, error) {
+	var user User
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var group ResGroups
+		_, groupID, err := ResolveXMLID(tx, PublicGroupXMLID)
+		if err == nil {
+			err = tx.First(&group, groupID).Error
+		}
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			group = ResGroups{Name: "Public", Comment: "Anonymous visitors of the public pages"}
+			if err = tx.Create(&group).Error; err == nil {
+				err = ensureXMLID(tx, "base", "group_public", "res.groups", group.ID)
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		err = tx.Where("login = ?", PublicUserLogin).First(&user).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			user = User{Login: PublicUserLogin, Name: "Public user", Email: PublicUserLogin + "@localhost", Share: true}
+			if err = tx.Create(&user).Error; err == nil {
+				// Created active by the column default, then deactivated
+				err = tx.Model(&user).Update("active", false).Error
+			}
+			if err == nil {
+				err = tx.Model(&user).Association("Groups").Append(&group)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		return ensureXMLID(tx, "base", "public_user", "res.users", user.ID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	publicUsers.Store(dbName, user.ID)
+	return &user, nil
+}
+
+// PublicUserID returns the id of the public user of a database, 0 when
+// it is not created
+func PublicUserID(dbName string, db *gorm.DB) (uint, error) {
+	if id, ok := publicUsers.Load(dbName); ok {
+		return id.(uint), nil
+	}
+	_, id, err := ResolveXMLID(db, PublicUserXMLID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		id, err = 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	publicUsers.Store(dbName, id)
+	return id, nil
+}
+
+// IsPublic reports whether the environment user is the public user
+func (env *Environment) IsPublic() bool {
+	if env.user == 0 {
+		return false
+	}
+	if env.dbName == "" {
+		return env.rights().public
+	}
+	id, err := PublicUserID(env.dbName, env.db)
+	return err == nil && id == env.user
+}
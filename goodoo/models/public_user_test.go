@@ -0,0 +1,135 @@
+package models_test
+
+import (
+	"slices"
+	"testing"
+
+	"goodoo/fields"
+	"goodoo/models"
+	"goodoo/models/testutil"
+)
+
+func TestUserIsPublic(t *testing.T) {
+	if !(&models.User{Login: models.PublicUserLogin}).IsPublic() {
+		t.Error("the public user is not public")
+	}
+	for _, login := range []string{"admin", "public", "__public__ ", ""} {
+		if (&models.User{Login: login}).IsPublic() {
+			t.Errorf("user %q is public", login)
+		}
+	}
+	if models.NewEnvironment(nil, 0).IsPublic() {
+		t.Error("the system environment is public")
+	}
+}
+
+func TestEnsurePublicUser(t *testing.T) {
+	env := testutil.NewTestEnvironment(t)
+	// The id is cached by database name, and rolled back with the test
+	dbName := testutil.Unique("public_db")
+
+	if id, err := models.PublicUserID(dbName, env.Tx); err != nil || id != 0 {
+		t.Fatalf("PublicUserID before creation = %d, %v; want 0", id, err)
+	}
+
+	user, err := models.EnsurePublicUser(dbName, env.Tx)
+	if err != nil {
+		t.Fatalf("EnsurePublicUser: %v", err)
+	}
+	again, err := models.EnsurePublicUser(dbName, env.Tx)
+	if err != nil || again.ID != user.ID {
+		t.Fatalf("EnsurePublicUser again = %v, %v; want user %d", again, err, user.ID)
+	}
+
+	var stored models.User
+	if err := env.Tx.First(&stored, user.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if stored.Active || stored.Password != "" || !stored.IsPublic() || stored.IsAdmin() {
+		t.Errorf("public user = %+v, want inactive, without password, not admin", stored)
+	}
+	if stored.CheckPassword("") {
+		t.Error("the public user signs in with an empty password")
+	}
+
+	if id, err := models.PublicUserID(dbName, env.Tx); err != nil || id != user.ID {
+		t.Errorf("PublicUserID = %d, %v; want %d", id, err, user.ID)
+	}
+	if _, id, err := models.ResolveXMLID(env.Tx, models.PublicUserXMLID); err != nil || id != user.ID {
+		t.Errorf("%s = %d, %v; want %d", models.PublicUserXMLID, id, err, user.ID)
+	}
+	groups, err := models.UserGroupXMLIDs(env.Tx, user.ID)
+	if err != nil || !slices.Equal(groups, []string{models.PublicGroupXMLID}) {
+		t.Errorf("groups of the public user = %v, %v; want only %s", groups, err, models.PublicGroupXMLID)
+	}
+	if admins, err := models.AdminUserIDs(env.Tx); err != nil || slices.Contains(admins, user.ID) {
+		t.Errorf("AdminUserIDs = %v, %v; the public user is not an administrator", admins, err)
+	}
+
+	publicEnv := models.NewEnvironment(env.Tx, user.ID).WithDBName(dbName)
+	if !publicEnv.IsPublic() || publicEnv.IsAdmin() {
+		t.Error("the environment of the public user is not public")
+	}
+	if models.NewEnvironment(env.Tx, env.CreateUser().ID).WithDBName(dbName).IsPublic() {
+		t.Error("the environment of a user is public")
+	}
+}
+
+// publicModel returns a model of the partner table with a name field, and
+// a field reserved to the public group
+func publicModel(t *testing.T) *models.ModelDefinition {
+	model := models.NewModelDefinition(testutil.Unique("test.public"), "res_partner")
+	for name, groups := range map[string][]string{"name": nil, "email": {models.PublicGroupXMLID}} {
+		field, err := fields.CreateField(fields.StringType, fields.FieldAttribute{String: name, Store: true, Groups: groups})
+		if err != nil {
+			t.Fatal(err)
+		}
+		model.AddField(name, field)
+	}
+	return model
+}
+
+// TestPublicUserAccess checks that the public user accesses no record and
+// no field but those a rule or the field groups grant its group
+func TestPublicUserAccess(t *testing.T) {
+	env := testutil.NewTestEnvironment(t)
+	user, err := models.EnsurePublicUser(testutil.Unique("public_db"), env.Tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	model := publicModel(t)
+	shared := env.CreatePartner(func(p *models.Partner) { p.Name = testutil.Unique("Shared") })
+	private := env.CreatePartner(func(p *models.Partner) { p.Name = testutil.Unique("Private") })
+	domain := models.Domain{[]interface{}{"id", "in", []uint{shared.ID, private.ID}}}
+
+	member := models.NewEnvironment(env.Tx, env.CreateUser().ID)
+	if ids, err := model.Search(member, domain, 0, 0, ""); err != nil || len(ids) != 2 {
+		t.Fatalf("Search as a user = %v, %v; want both partners", ids, err)
+	}
+
+	public := models.NewEnvironment(env.Tx, user.ID)
+	if ids, err := model.Search(public, domain, 0, 0, ""); err != nil || len(ids) != 0 {
+		t.Errorf("Search as the public user without rules = %v, %v; want nothing", ids, err)
+	}
+	if columns := model.CSVColumns(public, nil); !slices.Equal(columns, []string{"id", "email"}) {
+		t.Errorf("columns readable by the public user = %v, want id and the field of its group", columns)
+	}
+
+	// A rule of another group grants nothing to the public user
+	rules := []models.RecordRule{
+		{Name: "users", Model: model.Name, Group: "base.group_user", Domain: "name != ''", Active: true},
+		{Name: "share", Model: model.Name, Group: models.PublicGroupXMLID, Domain: "name = '" + shared.Name + "'", Active: true},
+	}
+	if err := env.Tx.Create(&rules[0]).Error; err != nil {
+		t.Fatal(err)
+	}
+	if ids, err := model.Search(public, domain, 0, 0, ""); err != nil || len(ids) != 0 {
+		t.Errorf("Search as the public user with a rule of users = %v, %v; want nothing", ids, err)
+	}
+	if err := env.Tx.Create(&rules[1]).Error; err != nil {
+		t.Fatal(err)
+	}
+	if ids, err := model.Search(public, domain, 0, 0, ""); err != nil || !slices.Equal(ids, []uint{shared.ID}) {
+		t.Errorf("Search as the public user with a rule of its group = %v, %v; want %d", ids, err, shared.ID)
+	}
+}
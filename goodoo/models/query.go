@@ -0,0 +1,162 @@
+package models
+
+import (
+	"time"
+)
+
+// Field names a field in a Query, created with Q. Its methods build the
+// conditions on the field, one per domain operator.
+type Field string
+
+// Query is a search condition built in Go code, e.g.
+//
+//	models.Q("active").Eq(true).And(models.Q("email").ILike("@example.com"))
+//
+// It compiles to a normalized domain in prefix notation, so it can be used
+// wherever a Domain is accepted. The zero Query matches every record.
+type Query struct {
+	domain Domain
+}
+
+// Q starts a condition on a field
+func Q(field string) Field {
+	return Field(field)
+}
+
+// condition returns the query of a single (field, operator, value) condition
+func (f Field) condition(operator string, value interface{}) Query {
+	return Query{domain: Domain{[]interface{}{string(f), operator, value}}}
+}
+
+// Eq matches records whose field equals value; a nil value matches unset fields
+func (f Field) Eq(value interface{}) Query { return f.condition("=", value) }
+
+// Ne matches records whose field differs from value; a nil value matches set fields
+func (f Field) Ne(value interface{}) Query { return f.condition("!=", value) }
+
+// Gt matches records whose field is greater than value
+func (f Field) Gt(value interface{}) Query { return f.condition(">", value) }
+
+// Ge matches records whose field is greater than or equal to value
+func (f Field) Ge(value interface{}) Query { return f.condition(">=", value) }
+
+// Lt matches records whose field is less than value
+func (f Field) Lt(value interface{}) Query { return f.condition("<", value) }
+
+// Le matches records whose field is less than or equal to value
+func (f Field) Le(value interface{}) Query { return f.condition("<=", value) }
+
+// Like matches records whose field contains s, case-sensitively
+func (f Field) Like(s string) Query { return f.condition("like", s) }
+
+// NotLike matches records whose field does not contain s, case-sensitively
+func (f Field) NotLike(s string) Query { return f.condition("not like", s) }
+
+// ILike matches records whose field contains s, ignoring case
+func (f Field) ILike(s string) Query { return f.condition("ilike", s) }
+
+// NotILike matches records whose field does not contain s, ignoring case
+func (f Field) NotILike(s string) Query { return f.condition("not ilike", s) }
+
+// EqLike matches records whose field matches the LIKE pattern, e.g. "%@example.com"
+func (f Field) EqLike(pattern string) Query { return f.condition("=like", pattern) }
+
+// EqILike matches records whose field matches the ILIKE pattern
+func (f Field) EqILike(pattern string) Query { return f.condition("=ilike", pattern) }
+
+// IsNull matches records whose field is unset
+func (f Field) IsNull() Query { return f.condition("=", nil) }
+
+// IsSet matches records whose field is set
+func (f Field) IsSet() Query { return f.condition("!=", nil) }
+
+// ChildOf matches the records ids and their descendants
+func (f Field) ChildOf(ids ...uint) Query { return f.condition(OperatorChildOf, ids) }
+
+// ParentOf matches the records ids and their ancestors
+func (f Field) ParentOf(ids ...uint) Query { return f.condition(OperatorParentOf, ids) }
+
+// Between matches records whose field is in [from, to)
+func (f Field) Between(from, to time.Time) Query {
+	return f.Ge(from).And(f.Lt(to))
+}
+
+// Since matches records whose field is at or after t
+func (f Field) Since(t time.Time) Query { return f.Ge(t) }
+
+// Before matches records whose field is before t
+func (f Field) Before(t time.Time) Query { return f.Lt(t) }
+
+// OnDay matches records whose field falls on the day of t, in t's location
+func (f Field) OnDay(t time.Time) Query {
+	start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	return f.Between(start, start.AddDate(0, 0, 1))
+}
+
+// In matches records whose field is one of values
+func In[T any](f Field, values []T) Query {
+	return f.condition("in", values)
+}
+
+// NotIn matches records whose field is none of values
+func NotIn[T any](f Field, values []T) Query {
+	return f.condition("not in", values)
+}
+
+// join combines queries with a binary domain operator, skipping empty ones
+func join(operator string, queries []Query) Query {
+	var operands []Query
+	for _, q := range queries {
+		if len(q.domain) > 0 {
+			operands = append(operands, q)
+		}
+	}
+	if len(operands) == 0 {
+		return Query{}
+	}
+
+	domain := make(Domain, 0, len(operands)-1)
+	for i := 1; i < len(operands); i++ {
+		domain = append(domain, operator)
+	}
+	for _, q := range operands {
+		domain = append(domain, q.domain...)
+	}
+	return Query{domain: domain}
+}
+
+// And matches records matching q and all of others
+func (q Query) And(others ...Query) Query {
+	return join(DomainAnd, append([]Query{q}, others...))
+}
+
+// Or matches records matching q or any of others. An empty query matches
+// every record, and so does its disjunction.
+func (q Query) Or(others ...Query) Query {
+	for _, other := range append([]Query{q}, others...) {
+		if len(other.domain) == 0 {
+			return Query{}
+		}
+	}
+	return join(DomainOr, append([]Query{q}, others...))
+}
+
+// Not matches records not matching q; the negation of the empty query
+// matches no record
+func (q Query) Not() Query {
+	if len(q.domain) == 0 {
+		return In(Q("id"), []uint{})
+	}
+	return Query{domain: append(Domain{DomainNot}, q.domain...)}
+}
+
+// All matches records matching every query
+func All(queries ...Query) Query {
+	return join(DomainAnd, queries)
+}
+
+// ToDomain returns the query as a domain in prefix notation, as accepted by
+// the JSON API
+func (q Query) ToDomain() Domain {
+	return append(Domain{}, q.domain...)
+}
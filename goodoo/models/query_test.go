@@ -0,0 +1,185 @@
+package models_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"goodoo/models"
+	"goodoo/models/testutil"
+
+	"gorm.io/gorm"
+)
+
+// explainPartners returns the partners of a dry-run session and the SQL of
+// its last query with the values bound
+func explainPartners(t *testing.T) (*models.RecordSet[models.Partner], func() string) {
+	db, _ := testutil.DryRunDB(t)
+	var last string
+	err := db.Callback().Query().After("gorm:query").Register("query_test:explain", func(tx *gorm.DB) {
+		last = tx.Dialector.Explain(tx.Statement.SQL.String(), tx.Statement.Vars...)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return models.NewRecordSet(db, models.Partner{}), func() string { return last }
+}
+
+var (
+	monday  = time.Date(2026, 10, 12, 15, 30, 0, 0, time.UTC)
+	tuesday = time.Date(2026, 10, 13, 0, 0, 0, 0, time.UTC)
+)
+
+// queryTests pair the queries built with Q with the domains written by hand
+var queryTests = []struct {
+	name   string
+	query  models.Query
+	domain models.Domain
+}{
+	{"empty", models.Query{}, models.Domain{}},
+	{"eq", models.Q("zip").Eq("1000"), models.Domain{[]interface{}{"zip", "=", "1000"}}},
+	{"ne", models.Q("city").Ne("Ghent"), models.Domain{[]interface{}{"city", "!=", "Ghent"}}},
+	{"gt", models.Q("id").Gt(5), models.Domain{[]interface{}{"id", ">", 5}}},
+	{"ge", models.Q("id").Ge(5), models.Domain{[]interface{}{"id", ">=", 5}}},
+	{"lt", models.Q("id").Lt(5), models.Domain{[]interface{}{"id", "<", 5}}},
+	{"le", models.Q("id").Le(5), models.Domain{[]interface{}{"id", "<=", 5}}},
+	{"like", models.Q("name").Like("Acme"), models.Domain{[]interface{}{"name", "like", "Acme"}}},
+	{"not like", models.Q("name").NotLike("Acme"), models.Domain{[]interface{}{"name", "not like", "Acme"}}},
+	{"ilike", models.Q("email").ILike("@example.com"), models.Domain{[]interface{}{"email", "ilike", "@example.com"}}},
+	{"not ilike", models.Q("email").NotILike("@example.com"), models.Domain{[]interface{}{"email", "not ilike", "@example.com"}}},
+	{"=like", models.Q("email").EqLike("%@example.com"), models.Domain{[]interface{}{"email", "=like", "%@example.com"}}},
+	{"=ilike", models.Q("email").EqILike("%@EXAMPLE.com"), models.Domain{[]interface{}{"email", "=ilike", "%@EXAMPLE.com"}}},
+	{"is null", models.Q("country_id").IsNull(), models.Domain{[]interface{}{"country_id", "=", nil}}},
+	{"eq nil", models.Q("country_id").Eq(nil), models.Domain{[]interface{}{"country_id", "=", nil}}},
+	{"is set", models.Q("country_id").IsSet(), models.Domain{[]interface{}{"country_id", "!=", nil}}},
+	{"in", models.In(models.Q("city"), []string{"Paris", "Ghent"}), models.Domain{[]interface{}{"city", "in", []string{"Paris", "Ghent"}}}},
+	{"not in", models.NotIn(models.Q("id"), []uint{1, 2}), models.Domain{[]interface{}{"id", "not in", []uint{1, 2}}}},
+	{"child_of", models.Q("id").ChildOf(3), models.Domain{[]interface{}{"id", models.OperatorChildOf, []uint{3}}}},
+	{"parent_of", models.Q("id").ParentOf(3, 4), models.Domain{[]interface{}{"id", models.OperatorParentOf, []uint{3, 4}}}},
+	{"and", models.Q("zip").Eq("1000").And(models.Q("email").ILike("@example.com")),
+		models.Domain{models.DomainAnd, []interface{}{"zip", "=", "1000"}, []interface{}{"email", "ilike", "@example.com"}}},
+	{"and of three", models.Q("name").Eq(1).And(models.Q("city").Eq(2), models.Q("zip").Eq(3)),
+		models.Domain{models.DomainAnd, models.DomainAnd, []interface{}{"name", "=", 1}, []interface{}{"city", "=", 2}, []interface{}{"zip", "=", 3}}},
+	{"or", models.Q("city").Eq("Paris").Or(models.Q("city").Eq("Ghent")),
+		models.Domain{models.DomainOr, []interface{}{"city", "=", "Paris"}, []interface{}{"city", "=", "Ghent"}}},
+	{"and of or", models.Q("zip").Eq("1000").And(models.Q("city").Eq("Paris").Or(models.Q("city").Eq("Ghent"))),
+		models.Domain{models.DomainAnd, []interface{}{"zip", "=", "1000"},
+			models.DomainOr, []interface{}{"city", "=", "Paris"}, []interface{}{"city", "=", "Ghent"}}},
+	{"or of and", models.Q("zip").Eq("1000").And(models.Q("city").Eq("Paris")).Or(models.Q("id").Eq(1)),
+		models.Domain{models.DomainOr, models.DomainAnd, []interface{}{"zip", "=", "1000"}, []interface{}{"city", "=", "Paris"},
+			[]interface{}{"id", "=", 1}}},
+	{"not", models.Q("city").Eq("Ghent").Not(), models.Domain{models.DomainNot, []interface{}{"city", "=", "Ghent"}}},
+	{"not of or", models.Q("name").Eq(1).Or(models.Q("city").Eq(2)).Not(),
+		models.Domain{models.DomainNot, models.DomainOr, []interface{}{"name", "=", 1}, []interface{}{"city", "=", 2}}},
+	// Empty queries are left out of a conjunction
+	{"and with empty", models.Query{}.And(models.Q("name").Eq(1), models.Query{}), models.Domain{[]interface{}{"name", "=", 1}}},
+	{"all", models.All(models.Q("name").Eq(1), models.Q("city").Eq(2)),
+		models.Domain{models.DomainAnd, []interface{}{"name", "=", 1}, []interface{}{"city", "=", 2}}},
+	{"all of nothing", models.All(), models.Domain{}},
+	// A disjunction with the empty query matches every record
+	{"or with empty", models.Q("name").Eq(1).Or(models.Query{}), models.Domain{}},
+	// The negation of the empty query matches none
+	{"not empty", models.Query{}.Not(), models.Domain{[]interface{}{"id", "in", []uint{}}}},
+	{"between", models.Q("create_date").Between(monday, tuesday),
+		models.Domain{models.DomainAnd, []interface{}{"create_date", ">=", monday}, []interface{}{"create_date", "<", tuesday}}},
+	{"since", models.Q("create_date").Since(monday), models.Domain{[]interface{}{"create_date", ">=", monday}}},
+	{"before", models.Q("create_date").Before(monday), models.Domain{[]interface{}{"create_date", "<", monday}}},
+	{"on day", models.Q("create_date").OnDay(monday),
+		models.Domain{models.DomainAnd, []interface{}{"create_date", ">=", monday.Truncate(24 * time.Hour)}, []interface{}{"create_date", "<", tuesday}}},
+}
+
+func TestQueryToDomain(t *testing.T) {
+	for _, tt := range queryTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.query.ToDomain(); !reflect.DeepEqual(got, tt.domain) {
+				t.Errorf("ToDomain = %#v, want %#v", got, tt.domain)
+			}
+		})
+	}
+}
+
+// TestQuerySQL searches with each query and with the domain written by
+// hand: both build the same SQL, values included
+func TestQuerySQL(t *testing.T) {
+	for _, tt := range queryTests {
+		t.Run(tt.name, func(t *testing.T) {
+			partners, last := explainPartners(t)
+			if _, err := partners.Search(tt.query, 0, 0, "id"); err != nil {
+				t.Fatalf("Search(query): %v", err)
+			}
+			built := last()
+			if _, err := partners.Search(tt.domain, 0, 0, "id"); err != nil {
+				t.Fatalf("Search(domain): %v", err)
+			}
+			if built != last() {
+				t.Errorf("the query built\n%s\nthe domain\n%s", built, last())
+			}
+		})
+	}
+}
+
+// TestQueryIsolation checks that combining queries leaves them unchanged
+func TestQueryIsolation(t *testing.T) {
+	base := models.Q("zip").Eq("1000")
+	wide := base.Or(models.Q("id").Eq(1))
+	narrow := base.And(models.Q("id").Eq(2))
+	base.Not()
+	domain := base.ToDomain()
+	domain[0] = "tampered"
+
+	if want := (models.Domain{[]interface{}{"zip", "=", "1000"}}); !reflect.DeepEqual(base.ToDomain(), want) {
+		t.Errorf("base = %v, want %v", base.ToDomain(), want)
+	}
+	if len(wide.ToDomain()) != 3 || len(narrow.ToDomain()) != 3 || wide.ToDomain()[0] != models.DomainOr || narrow.ToDomain()[0] != models.DomainAnd {
+		t.Errorf("wide = %v, narrow = %v", wide.ToDomain(), narrow.ToDomain())
+	}
+}
+
+// TestDomainParsing compiles hand-written domains in prefix notation, and
+// refuses malformed ones before building any SQL
+func TestDomainParsing(t *testing.T) {
+	tests := []struct {
+		name   string
+		domain models.Domain
+		// where is the condition built, empty for a malformed domain
+		where string
+	}{
+		{"implicit and", models.Domain{[]interface{}{"name", "=", 1}, []interface{}{"city", "=", 2}},
+			"WHERE ((name = 1) AND (city = 2))"},
+		{"prefix or then implicit and", models.Domain{models.DomainOr, []interface{}{"name", "=", 1}, []interface{}{"city", "=", 2}, []interface{}{"zip", "=", 3}},
+			"WHERE (((name = 1) OR (city = 2)) AND (zip = 3))"},
+		{"nested not", models.Domain{models.DomainNot, models.DomainNot, []interface{}{"name", "=", 1}},
+			"WHERE NOT (NOT (name = 1))"},
+		{"domain leaf", models.Domain{models.Domain{"name", "=", 1}}, "WHERE name = 1"},
+		{"null", models.Domain{[]interface{}{"name", "!=", nil}}, "WHERE name IS NOT NULL"},
+		{"substring", models.Domain{[]interface{}{"name", "ilike", "acme"}}, "WHERE name ILIKE '%acme%'"},
+		{"pattern", models.Domain{[]interface{}{"name", "=ilike", "acme%"}}, "WHERE name ILIKE 'acme%'"},
+		{"missing operand of or", models.Domain{models.DomainOr, []interface{}{"name", "=", 1}}, ""},
+		{"missing operand of not", models.Domain{models.DomainNot}, ""},
+		{"unknown logical operator", models.Domain{"^", []interface{}{"name", "=", 1}, []interface{}{"city", "=", 2}}, ""},
+		{"unknown operator", models.Domain{[]interface{}{"name", "==", 1}}, ""},
+		{"non-string operator", models.Domain{[]interface{}{"name", 1, 1}}, ""},
+		{"long condition", models.Domain{[]interface{}{"name", "=", 1, 2}}, ""},
+		{"not a condition", models.Domain{42}, ""},
+		{"invalid field", models.Domain{[]interface{}{"name city", "=", 1}}, ""},
+		{"invalid field in query", models.Q("name; --").Eq(1).ToDomain(), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			partners, last := explainPartners(t)
+			_, err := partners.Search(tt.domain, 0, 0, "id")
+			if tt.where == "" {
+				if err == nil || last() != "" {
+					t.Errorf("Search(%v) = %v, built %q; want an error and no SQL", tt.domain, err, last())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Search(%v): %v", tt.domain, err)
+			}
+			if want := "SELECT * FROM \"res_partner\" " + tt.where + ` AND "res_partner"."deleted_at" IS NULL ORDER BY id`; last() != want {
+				t.Errorf("Search(%v) built\n%s\nwant\n%s", tt.domain, last(), want)
+			}
+		})
+	}
+}
@@ -0,0 +1,307 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"goodoo/database"
+	"goodoo/logging"
+	"goodoo/scheduler"
+	"gorm.io/gorm"
+)
+
+// Per-user quotas on the records of self-service features (chat sessions,
+// share links, webhooks, service keys), against runaway scripts. Each
+// record created counts against its owner in quota_counter, in the
+// transaction creating it, so the check needs no COUNT(*); deletions give
+// the count back, and a periodic reconciliation corrects the counters the
+// records deleted or inserted behind the ORM left wrong.
+
+// Models under quota
+const (
+	QuotaChatSession = "chat.session"
+	QuotaShareLink   = "share.link"
+	QuotaWebhook     = "webhook"
+	QuotaServiceKey  = "service.key"
+)
+
+// QuotaPolicy declares the quota of a model: the table of its records, the
+// column of their owner and the records each user may own by default, 0
+// for no limit
+type QuotaPolicy struct {
+	Model        string `json:"model"`
+	Table        string `json:"table"`
+	OwnerColumn  string `json:"owner_column"`
+	DefaultLimit int    `json:"default_limit"`
+	// Filter restricts the records counted, e.g. "deleted_at IS NULL"
+	Filter string `json:"-"`
+}
+
+// Param returns the system parameter replacing the default limit
+func (p QuotaPolicy) Param() string {
+	return "quota." + p.Model + ".max_per_user"
+}
+
+// Limit returns the limit of the model in a database: the system parameter
+// when set, the default limit otherwise
+func (p QuotaPolicy) Limit(dbName string) int {
+	return GetParamInt(dbName, p.Param(), p.DefaultLimit)
+}
+
+var (
+	quotaPolicies = map[string]QuotaPolicy{
+		QuotaChatSession: {Model: QuotaChatSession, Table: "chat_session", OwnerColumn: "user_id", DefaultLimit: 1000},
+		QuotaShareLink:   {Model: QuotaShareLink, Table: "share_link", OwnerColumn: "created_by", DefaultLimit: 500, Filter: "revoked_at IS NULL"},
+		QuotaWebhook:     {Model: QuotaWebhook, Table: "webhook", OwnerColumn: "create_uid", DefaultLimit: 50, Filter: "deleted_at IS NULL"},
+		QuotaServiceKey:  {Model: QuotaServiceKey, Table: "service_key", OwnerColumn: "user_id", DefaultLimit: 50, Filter: "deleted_at IS NULL"},
+	}
+	quotaMutex sync.RWMutex
+)
+
+// RegisterQuota puts a model under quota, or replaces its policy
+func RegisterQuota(policy QuotaPolicy) error {
+	if _, err := quoteName("table", policy.Table); err != nil {
+		return err
+	}
+	if _, err := quoteName("column", policy.OwnerColumn); err != nil {
+		return err
+	}
+	quotaMutex.Lock()
+	defer quotaMutex.Unlock()
+	quotaPolicies[policy.Model] = policy
+	return nil
+}
+
+// FindQuota returns the quota policy of a model
+func FindQuota(model string) (QuotaPolicy, bool) {
+	quotaMutex.RLock()
+	defer quotaMutex.RUnlock()
+	policy, exists := quotaPolicies[model]
+	return policy, exists
+}
+
+// QuotaPolicies returns the quota policies by model name
+func QuotaPolicies() []QuotaPolicy {
+	quotaMutex.RLock()
+	defer quotaMutex.RUnlock()
+	policies := make([]QuotaPolicy, 0, len(quotaPolicies))
+	for _, policy := range quotaPolicies {
+		policies = append(policies, policy)
+	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].Model < policies[j].Model })
+	return policies
+}
+
+// QuotaCounter counts the records of a model a user owns
+type QuotaCounter struct {
+	ID     uint   `gorm:"primaryKey;autoIncrement" json:"id"`
+	Model  string `gorm:"not null;uniqueIndex:idx_quota_counter_owner" json:"model"`
+	UserID uint   `gorm:"column:user_id;not null;uniqueIndex:idx_quota_counter_owner" json:"user_id"`
+	Count  int    `gorm:"not null;default:0" json:"count"`
+	// MaxRecords overrides the limit of the model for the user; nil keeps it
+	MaxRecords *int      `gorm:"column:max_records" json:"max_records,omitempty"`
+	WriteDate  time.Time `gorm:"column:write_date;autoUpdateTime" json:"write_date"`
+}
+
+func (QuotaCounter) TableName() string {
+	return "quota_counter"
+}
+
+// QuotaExceededError is returned when a user creates more records of a
+// model than their limit allows
+type QuotaExceededError struct {
+	Model string `json:"model"`
+	Count int    `json:"count"`
+	Limit int    `json:"limit"`
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("quota exceeded: %d of %d %s records per user", e.Count, e.Limit, e.Model)
+}
+
+// UserQuotaLimit returns the limit of a user on a model: their override,
+// or the limit of the model; 0 means no limit
+func UserQuotaLimit(db *gorm.DB, dbName string, policy QuotaPolicy, uid uint) (limit, count int, err error) {
+	var counter QuotaCounter
+	err = db.Where("model = ? AND user_id = ?", policy.Model, uid).Limit(1).Find(&counter).Error
+	if err != nil {
+		return 0, 0, err
+	}
+	if counter.MaxRecords != nil {
+		return *counter.MaxRecords, counter.Count, nil
+	}
+	return policy.Limit(dbName), counter.Count, nil
+}
+
+// CheckQuota fails with a QuotaExceededError when a user owns their limit
+// of records of a model already, without counting anything; ReserveQuota
+// still decides when the record is created
+func CheckQuota(db *gorm.DB, dbName, model string, uid uint) error {
+	policy, exists := FindQuota(model)
+	if !exists || uid == 0 {
+		return nil
+	}
+	limit, count, err := UserQuotaLimit(db, dbName, policy, uid)
+	if err != nil {
+		return err
+	}
+	if limit > 0 && count >= limit {
+		return &QuotaExceededError{Model: policy.Model, Count: count, Limit: limit}
+	}
+	return nil
+}
+
+// ReserveQuota counts a record of a model created by a user, or fails with
+// a QuotaExceededError when they own their limit already. Call it in the
+// transaction creating the record so that a failed creation gives the
+// count back. The system user (0) and models without policy are not
+// counted.
+func ReserveQuota(db *gorm.DB, dbName, model string, uid uint) error {
+	policy, exists := FindQuota(model)
+	if !exists || uid == 0 {
+		return nil
+	}
+	limit, count, err := UserQuotaLimit(db, dbName, policy, uid)
+	if err != nil {
+		return err
+	}
+	var counts []int
+	err = db.Raw(`INSERT INTO quota_counter (model, user_id, count, write_date) VALUES (?, ?, 1, now())
+		ON CONFLICT (model, user_id) DO UPDATE SET count = quota_counter.count + 1, write_date = now()
+		WHERE ? <= 0 OR quota_counter.count < ?
+		RETURNING count`, policy.Model, uid, limit, limit).Scan(&counts).Error
+	if err != nil {
+		return err
+	}
+	if len(counts) == 0 {
+		return &QuotaExceededError{Model: policy.Model, Count: count, Limit: limit}
+	}
+	return nil
+}
+
+// ReleaseQuota gives back the count of records of a model a user deleted
+func ReleaseQuota(db *gorm.DB, model string, uid uint, n int) error {
+	if _, exists := FindQuota(model); !exists || uid == 0 || n <= 0 {
+		return nil
+	}
+	return db.Exec(`UPDATE quota_counter SET count = GREATEST(count - ?, 0), write_date = now()
+		WHERE model = ? AND user_id = ?`, n, model, uid).Error
+}
+
+// SetUserQuotaLimit overrides the limit of a user on a model; nil removes
+// the override
+func SetUserQuotaLimit(db *gorm.DB, model string, uid uint, limit *int) error {
+	return db.Exec(`INSERT INTO quota_counter (model, user_id, count, max_records, write_date) VALUES (?, ?, 0, ?, now())
+		ON CONFLICT (model, user_id) DO UPDATE SET max_records = EXCLUDED.max_records, write_date = now()`,
+		model, uid, limit).Error
+}
+
+// QuotaUsage is the consumption of a user on a model
+type QuotaUsage struct {
+	UserID uint   `json:"user_id"`
+	Login  string `json:"login"`
+	Count  int    `json:"count"`
+	// Limit is the effective limit of the user, 0 for none; Override is set
+	// when it is theirs
+	Limit    int  `json:"limit"`
+	Override *int `json:"override,omitempty"`
+}
+
+// TopQuotaConsumers returns the users owning the most records of a model,
+// from the counters
+func TopQuotaConsumers(db *gorm.DB, dbName string, policy QuotaPolicy, limit int) ([]QuotaUsage, error) {
+	var rows []struct {
+		UserID     uint
+		Login      string
+		Count      int
+		MaxRecords *int
+	}
+	err := db.Table("quota_counter").
+		Select("quota_counter.user_id, res_users.login, quota_counter.count, quota_counter.max_records").
+		Joins("LEFT JOIN res_users ON res_users.id = quota_counter.user_id").
+		Where("quota_counter.model = ?", policy.Model).
+		Order("quota_counter.count DESC, quota_counter.user_id").
+		Limit(limit).Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	defaultLimit := policy.Limit(dbName)
+	usage := make([]QuotaUsage, 0, len(rows))
+	for _, row := range rows {
+		entry := QuotaUsage{UserID: row.UserID, Login: row.Login, Count: row.Count, Limit: defaultLimit, Override: row.MaxRecords}
+		if row.MaxRecords != nil {
+			entry.Limit = *row.MaxRecords
+		}
+		usage = append(usage, entry)
+	}
+	return usage, nil
+}
+
+// ReconcileQuota sets the counters of a model to the records their users
+// own, and returns how many were wrong
+func ReconcileQuota(db *gorm.DB, policy QuotaPolicy) (int64, error) {
+	table, err := quoteName("table", policy.Table)
+	if err != nil {
+		return 0, err
+	}
+	owner, err := quoteName("column", policy.OwnerColumn)
+	if err != nil {
+		return 0, err
+	}
+	where := owner + " IS NOT NULL AND " + owner + " <> 0"
+	if policy.Filter != "" {
+		where += " AND " + policy.Filter
+	}
+
+	var corrected int64
+	err = db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Exec(`INSERT INTO quota_counter (model, user_id, count, write_date)
+			SELECT ?, `+owner+`, COUNT(*), now() FROM `+table+` WHERE `+where+` GROUP BY `+owner+`
+			ON CONFLICT (model, user_id) DO UPDATE SET count = EXCLUDED.count, write_date = now()
+			WHERE quota_counter.count <> EXCLUDED.count`, policy.Model)
+		if result.Error != nil {
+			return result.Error
+		}
+		corrected = result.RowsAffected
+		result = tx.Exec(`UPDATE quota_counter SET count = 0, write_date = now()
+			WHERE model = ? AND count <> 0 AND user_id NOT IN (SELECT `+owner+` FROM `+table+` WHERE `+where+`)`, policy.Model)
+		corrected += result.RowsAffected
+		return result.Error
+	})
+	return corrected, err
+}
+
+// ReconcileQuotas reconciles the counters of every model under quota
+func ReconcileQuotas(db *gorm.DB) (map[string]int64, error) {
+	corrected := make(map[string]int64)
+	for _, policy := range QuotaPolicies() {
+		n, err := ReconcileQuota(db, policy)
+		if err != nil {
+			return corrected, fmt.Errorf("failed to reconcile the quota of %s: %w", policy.Model, err)
+		}
+		if n > 0 {
+			corrected[policy.Model] = n
+		}
+	}
+	return corrected, nil
+}
+
+// ScheduleQuotaReconcile registers the job reconciling the quota counters
+// of a database every interval
+func ScheduleQuotaReconcile(s *scheduler.Scheduler, dbName string, interval time.Duration) {
+	logger := logging.GetLogger("goodoo.models.quota")
+	s.Every("models.quota.reconcile."+dbName, interval, func(ctx context.Context) error {
+		db, err := database.GetDatabase(dbName)
+		if err != nil {
+			return err
+		}
+		corrected, err := ReconcileQuotas(db.WithContext(ctx))
+		for model, n := range corrected {
+			logger.Info("Reconciled %d quota counter(s) of %s in %s", n, model, dbName)
+		}
+		return err
+	})
+}
@@ -0,0 +1,241 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"goodoo/expr"
+	"gorm.io/gorm"
+)
+
+// RecordRule restricts the records of a field-defined model that users
+// may search, read, write and delete to those matching its domain, an
+// expression like "create_uid = user.id" (see expr.CompileDomain). Global
+// rules, without group, all apply to every user; the members of the groups
+// of group rules may access the records matching any of their rules. The
+// administrator and the system bypass the rules.
+type RecordRule struct {
+	ID    uint   `gorm:"primarykey" json:"id"`
+	Name  string `gorm:"not null" json:"name"`
+	Model string `gorm:"size:128;not null;index" json:"model"`
+	// Group is the external id of the group the rule applies to, "" for a
+	// global rule
+	Group string `gorm:"column:group_xmlid;size:128" json:"group,omitempty"`
+	// Domain is the expression the records must satisfy, stored as typed
+	Domain     string    `gorm:"type:text;not null" json:"domain"`
+	Active     bool      `gorm:"not null" json:"active"`
+	WriteUID   uint      `json:"write_uid"`
+	CreateDate time.Time `gorm:"autoCreateTime" json:"create_date"`
+	WriteDate  time.Time `gorm:"autoUpdateTime" json:"write_date"`
+}
+
+func (RecordRule) TableName() string {
+	return "ir_rule"
+}
+
+// RuleError is returned when the record rules forbid an operation on
+// records to the user
+type RuleError struct {
+	Model     string
+	Operation string
+	IDs       []uint
+}
+
+func (e *RuleError) Error() string {
+	return fmt.Sprintf("access denied: the record rules of %s do not allow you to %s records %v", e.Model, e.Operation, e.IDs)
+}
+
+// RecordRuleCacheTTL is how long the rules of a model are reused; rules
+// changed by another process apply within it
+var RecordRuleCacheTTL = 30 * time.Second
+
+// cachedRules are the active rules of a model
+type cachedRules struct {
+	rules   []RecordRule
+	expires time.Time
+}
+
+// recordRuleCache holds the active rules per database and model, dropped
+// when the rules of the database are written
+var recordRuleCache sync.Map // "dbName/model" -> cachedRules
+
+// activeRecordRules returns the active rules of a model, none while the
+// rule table does not exist
+func activeRecordRules(env *Environment, model string) ([]RecordRule, error) {
+	key := env.dbName + "/" + model
+	if cached, ok := recordRuleCache.Load(key); ok && env.dbName != "" {
+		entry := cached.(cachedRules)
+		if time.Now().Before(entry.expires) {
+			return entry.rules, nil
+		}
+	}
+	var rules []RecordRule
+	if env.db.Migrator().HasTable(&RecordRule{}) {
+		if err := env.db.Where("model = ? AND active = ?", model, true).Order("id").Find(&rules).Error; err != nil {
+			return nil, err
+		}
+	}
+	if env.dbName != "" {
+		recordRuleCache.Store(key, cachedRules{rules: rules, expires: time.Now().Add(RecordRuleCacheTTL)})
+	}
+	return rules, nil
+}
+
+// InvalidateRecordRules drops the cached rules of a database
+func InvalidateRecordRules(dbName string) {
+	prefix := dbName + "/"
+	recordRuleCache.Range(func(key, _ interface{}) bool {
+		if strings.HasPrefix(key.(string), prefix) {
+			recordRuleCache.Delete(key)
+		}
+		return true
+	})
+}
+
+// ValidateRecordRule checks the model, group and domain of a rule; the
+// domain error is an expr.Errors locating its mistakes
+func ValidateRecordRule(env *Environment, rule *RecordRule) error {
+	if strings.TrimSpace(rule.Name) == "" {
+		return fmt.Errorf("a rule needs a name")
+	}
+	model, exists := env.GetFieldModel(rule.Model)
+	if !exists || model.Abstract {
+		return fmt.Errorf("model %s not found", rule.Model)
+	}
+	if rule.Group != "" {
+		resModel, _, err := ResolveXMLID(env.db, rule.Group)
+		if err != nil || resModel != "res.groups" {
+			return fmt.Errorf("group %s not found", rule.Group)
+		}
+	}
+	_, err := CompileRecordRule(model, rule.Domain)
+	return err
+}
+
+// ruleDomain returns the domain the record rules of the model impose on
+// the environment user, nil when none applies. A rule that cannot be
+// evaluated fails the operation rather than being skipped. The public
+// user only accesses the records a rule of one of its groups grants.
+func (m *ModelDefinition) ruleDomain(env *Environment) (Domain, error) {
+	if env.user == 0 || env.IsAdmin() {
+		return nil, nil
+	}
+	public := env.IsPublic()
+	rules, err := activeRecordRules(env, m.Name)
+	if err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 {
+		if public {
+			return denyAllDomain(), nil
+		}
+		return nil, nil
+	}
+
+	var applicable []RecordRule
+	var programs []*expr.Program
+	for _, rule := range rules {
+		if rule.Group != "" && !env.HasGroup(rule.Group) {
+			continue
+		}
+		program, err := CompileRecordRule(m, rule.Domain)
+		if err != nil {
+			return nil, fmt.Errorf("record rule %q of %s: %w", rule.Name, m.Name, err)
+		}
+		applicable = append(applicable, rule)
+		programs = append(programs, program)
+	}
+	vars := env.ExpressionVars(programs...)
+
+	var domain Domain
+	var grouped []interface{}
+	for i, rule := range applicable {
+		ruleDomain, err := programs[i].Domain(vars, expr.DefaultLimits)
+		if err != nil {
+			return nil, fmt.Errorf("record rule %q of %s: %w", rule.Name, m.Name, err)
+		}
+		if rule.Group == "" {
+			domain = append(domain, ruleDomain...)
+			continue
+		}
+		if len(grouped) > 0 {
+			grouped = append([]interface{}{DomainOr}, grouped...)
+		}
+		grouped = append(grouped, ruleDomain...)
+	}
+	if public && len(grouped) == 0 {
+		return denyAllDomain(), nil
+	}
+	return append(domain, grouped...), nil
+}
+
+// denyAllDomain matches no record
+func denyAllDomain() Domain {
+	return Domain{[]interface{}{"id", "=", 0}}
+}
+
+// applyRules restricts a query on the table of the model to the records
+// the rules allow the environment user. The rule domains may use any
+// stored field, even those the user cannot read.
+func (m *ModelDefinition) applyRules(env *Environment, query *gorm.DB) (*gorm.DB, error) {
+	domain, err := m.ruleDomain(env)
+	if err != nil {
+		return nil, err
+	}
+	return m.applyRuleDomain(query, domain)
+}
+
+// applyRuleDomain restricts a query with the domain of the rules
+func (m *ModelDefinition) applyRuleDomain(query *gorm.DB, domain Domain) (*gorm.DB, error) {
+	if len(domain) == 0 {
+		return query, nil
+	}
+	sql, args, err := compileDomain(domain, func(name string) bool {
+		field, exists := m.Fields[name]
+		return magicColumns[name] || (exists && field.IsStored())
+	}, nil, m.tagScope())
+	if err != nil {
+		return nil, err
+	}
+	return query.Where("("+sql+")", args...), nil
+}
+
+// checkRules fails with a RuleError when the rules hide records of ids
+// from the environment user
+func (m *ModelDefinition) checkRules(env *Environment, operation string, ids []uint) error {
+	domain, err := m.ruleDomain(env)
+	if err != nil || len(domain) == 0 {
+		return err
+	}
+	allowedQuery, err := m.applyRuleDomain(env.db.Table(m.TableName).Where("id IN ?", ids), domain)
+	if err != nil {
+		return err
+	}
+	var allowed []uint
+	if err := allowedQuery.Pluck("id", &allowed).Error; err != nil {
+		return err
+	}
+	if len(allowed) == len(ids) {
+		return nil
+	}
+	var existing []uint
+	if err := env.db.Table(m.TableName).Where("id IN ?", ids).Order("id").Pluck("id", &existing).Error; err != nil {
+		return err
+	}
+	permitted := make(map[uint]bool, len(allowed))
+	for _, id := range allowed {
+		permitted[id] = true
+	}
+	var denied []uint
+	for _, id := range existing {
+		if !permitted[id] {
+			denied = append(denied, id)
+		}
+	}
+	if len(denied) > 0 {
+		return &RuleError{Model: m.Name, Operation: operation, IDs: denied}
+	}
+	return nil
+}
@@ -0,0 +1,823 @@
+package models
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"goodoo/fields"
+	"gorm.io/gorm"
+)
+
+// Generic record operations for field-defined models, working on map records
+// (like Odoo's BaseModel create/read/write/unlink/search)
+
+// magicColumns are maintained by the ORM and cannot be written by callers
+var magicColumns = map[string]bool{
+	"id":          true,
+	"create_uid":  true,
+	"create_date": true,
+	"write_uid":   true,
+	"write_date":  true,
+}
+
+// IsMagicColumn reports whether the ORM maintains a column
+func IsMagicColumn(name string) bool {
+	return magicColumns[name]
+}
+
+// AbstractModelError is returned by record operations on abstract models,
+// which only lend their fields to the models inheriting them
+type AbstractModelError struct {
+	Model string
+}
+
+func (e *AbstractModelError) Error() string {
+	return fmt.Sprintf("model %s is abstract and has no records", e.Model)
+}
+
+// FieldNameError is returned when a request names fields it cannot use,
+// listing all of them
+type FieldNameError struct {
+	Model string
+	// Reason says why the fields were refused, e.g. "unknown or not stored fields"
+	Reason string
+	Fields []string
+}
+
+func (e *FieldNameError) Error() string {
+	quoted := make([]string, len(e.Fields))
+	for i, name := range e.Fields {
+		quoted[i] = "'" + name + "'"
+	}
+	return fmt.Sprintf("%s on model %s: %s", e.Reason, e.Model, strings.Join(quoted, ", "))
+}
+
+// checkConcrete rejects record operations on abstract models
+func (m *ModelDefinition) checkConcrete() error {
+	if m.Abstract {
+		return &AbstractModelError{Model: m.Name}
+	}
+	return nil
+}
+
+// checkFieldNames ensures every name is a stored field of the model,
+// reporting all the names that are not
+func (m *ModelDefinition) checkFieldNames(names []string) error {
+	var invalid []string
+	for _, name := range names {
+		if field, exists := m.Fields[name]; !exists || !field.IsStored() {
+			invalid = append(invalid, name)
+		}
+	}
+	if len(invalid) > 0 {
+		return &FieldNameError{Model: m.Name, Reason: "unknown or not stored fields", Fields: invalid}
+	}
+	return nil
+}
+
+// sortable reports whether records can be ordered by a field the user may read
+func (m *ModelDefinition) sortable(env *Environment, name string) bool {
+	field, exists := m.Fields[name]
+	if !exists || !field.IsStored() || !m.readableField(env, name) {
+		return false
+	}
+	switch field.GetType() {
+	case fields.BinaryType, fields.JsonType:
+		return false
+	}
+	return true
+}
+
+// readPaths splits the fields requested from Read into the model's own
+// fields, without id which is always read, and the dotted paths through
+// a relation field, like partner_id.name, grouped by relation field. Paths
+// go one level deep; all the names that cannot be read are reported at
+// once.
+func (m *ModelDefinition) readPaths(env *Environment, names []string) ([]string, map[string][]string, error) {
+	var own []string
+	var paths map[string][]string
+	var invalid []string
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		if seen[name] || name == "id" {
+			continue
+		}
+		seen[name] = true
+
+		relation, target, dotted := strings.Cut(name, ".")
+		if !dotted {
+			if err := m.checkFieldNames([]string{name}); err != nil {
+				invalid = append(invalid, name)
+			} else {
+				own = append(own, name)
+			}
+			continue
+		}
+
+		field, exists := m.Fields[relation]
+		comodelName := ""
+		if exists && field.IsStored() {
+			comodelName = field.GetAttributes().Relation
+		}
+		comodel, found := env.GetFieldModel(comodelName)
+		if comodelName == "" || !found || comodel.Abstract || strings.Contains(target, ".") ||
+			comodel.checkFieldNames([]string{target}) != nil {
+			invalid = append(invalid, name)
+			continue
+		}
+		if paths == nil {
+			paths = make(map[string][]string)
+		}
+		paths[relation] = append(paths[relation], target)
+	}
+	if len(invalid) > 0 {
+		return nil, nil, &FieldNameError{Model: m.Name, Reason: "unknown or not readable fields", Fields: invalid}
+	}
+	return own, paths, nil
+}
+
+// readRelated sets the dotted paths of the records from the related
+// records, read in one batch per relation field. Paths through a relation
+// field or to a field the user may not read are left out.
+func (m *ModelDefinition) readRelated(env *Environment, records []map[string]interface{}, paths map[string][]string) error {
+	for relation, targets := range paths {
+		if !m.readableField(env, relation) {
+			continue
+		}
+		comodel, _ := env.GetFieldModel(m.Fields[relation].GetAttributes().Relation)
+
+		var ids []uint
+		seen := make(map[uint]bool)
+		for _, record := range records {
+			if id := toUint(record[relation]); id != 0 && !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+		related, err := comodel.Read(env, ids, targets)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", relation, err)
+		}
+		byID := make(map[uint]map[string]interface{}, len(related))
+		for _, values := range related {
+			byID[toUint(values["id"])] = values
+		}
+
+		for _, record := range records {
+			values := byID[toUint(record[relation])]
+			for _, target := range targets {
+				if !comodel.readableField(env, target) {
+					continue
+				}
+				var value interface{}
+				if values != nil {
+					value = values[target]
+				}
+				record[relation+"."+target] = value
+			}
+		}
+	}
+	return nil
+}
+
+// Search returns the IDs of records matching the domain
+func (m *ModelDefinition) Search(env *Environment, domain Domain, offset, limit int, order string) ([]uint, error) {
+	query, err := m.domainQuery(env, domain)
+	if err != nil {
+		return nil, err
+	}
+
+	orderBy, err := m.parseOrder(env, order)
+	if err != nil {
+		return nil, err
+	}
+	query = query.Order(orderBy)
+
+	if offset > 0 {
+		query = query.Offset(offset)
+	}
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+
+	var ids []uint
+	if err := query.Pluck("id", &ids).Error; err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// SearchCount returns the number of records matching the domain
+func (m *ModelDefinition) SearchCount(env *Environment, domain Domain) (int64, error) {
+	query, err := m.domainQuery(env, domain)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int64
+	err = query.Count(&count).Error
+	return count, err
+}
+
+// domainQuery builds the base query for a domain, restricted to the
+// records the record rules allow the user
+func (m *ModelDefinition) domainQuery(env *Environment, domain Domain) (*gorm.DB, error) {
+	if err := m.checkConcrete(); err != nil {
+		return nil, err
+	}
+	query, err := m.applyRules(env, env.db.Table(m.TableName))
+	if err != nil {
+		return nil, err
+	}
+	var tree *hierarchy
+	if field, exists := m.Fields["parent_id"]; exists && field.IsStored() {
+		tree = &hierarchy{table: m.TableName, parentColumn: "parent_id"}
+	}
+	return applyDomain(query, domain, func(name string) bool {
+		field, exists := m.Fields[name]
+		return exists && field.IsStored() && m.readableField(env, name)
+	}, tree, m.tagScope())
+}
+
+// parseOrder validates an order specification like "name asc, id desc
+// nulls last" against the fields the user may sort on
+func (m *ModelDefinition) parseOrder(env *Environment, order string) (string, error) {
+	return m.parseOrderOf(env, order, "")
+}
+
+// parseOrderOf is parseOrder with the columns qualified by a table alias,
+// unless it is empty
+func (m *ModelDefinition) parseOrderOf(env *Environment, order, alias string) (string, error) {
+	prefix := ""
+	if alias != "" {
+		prefix = alias + "."
+	}
+	if strings.TrimSpace(order) == "" {
+		return prefix + "id", nil
+	}
+
+	var invalid []string
+	orderBy, err := compileOrder(order, func(name string) (string, error) {
+		if !m.sortable(env, name) {
+			invalid = append(invalid, name)
+		}
+		return prefix + QuoteIdentifier(name), nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(invalid) > 0 {
+		return "", &FieldNameError{Model: m.Name, Reason: "unknown or not sortable fields", Fields: invalid}
+	}
+	return orderBy, nil
+}
+
+// Read returns the requested fields of the records, in the order of ids,
+// always with their id. A name like partner_id.name reads the name of the
+// record a relation field points to. Translatable fields are resolved in
+// the environment's language, and fields the user may not read are
+// omitted, like the records the record rules hide from them.
+func (m *ModelDefinition) Read(env *Environment, ids []uint, fieldNames []string) ([]map[string]interface{}, error) {
+	if err := m.checkConcrete(); err != nil {
+		return nil, err
+	}
+
+	// The tags are read with all the fields, or when requested
+	withTags := m.tagScope() != nil && (len(fieldNames) == 0 || slices.Contains(fieldNames, TagField))
+	if len(fieldNames) == 0 {
+		for name := range m.GetStoredFields() {
+			fieldNames = append(fieldNames, name)
+		}
+		sort.Strings(fieldNames)
+	} else if withTags {
+		fieldNames = slices.DeleteFunc(slices.Clone(fieldNames), func(name string) bool { return name == TagField })
+	}
+	fieldNames, paths, err := m.readPaths(env, fieldNames)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return []map[string]interface{}{}, nil
+	}
+	fieldNames = m.readableFields(env, fieldNames)
+
+	// Relation fields of the paths are read too, then dropped unless requested
+	var hidden []string
+	for relation := range paths {
+		if !slices.Contains(fieldNames, relation) {
+			hidden = append(hidden, relation)
+		}
+	}
+	columns := append(append([]string{"id"}, fieldNames...), hidden...)
+
+	query, err := m.applyRules(env, env.db.Table(m.TableName).Select(columns).Where("id IN ?", ids))
+	if err != nil {
+		return nil, err
+	}
+	var rows []map[string]interface{}
+	if err := query.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	byID := make(map[uint]map[string]interface{}, len(rows))
+	for _, row := range rows {
+		record := make(map[string]interface{}, len(columns))
+		for _, name := range columns {
+			value := row[name]
+			if field, ok := m.Fields[name]; ok && value != nil {
+				if converted, err := field.ConvertToRecord(value, row); err == nil {
+					value = converted
+				}
+			}
+			record[name] = value
+		}
+		byID[toUint(row["id"])] = record
+	}
+
+	if err := m.applyTranslations(env, byID, fieldNames); err != nil {
+		return nil, err
+	}
+
+	records := make([]map[string]interface{}, 0, len(byID))
+	for _, id := range ids {
+		if record, ok := byID[id]; ok {
+			records = append(records, record)
+		}
+	}
+
+	if err := m.readRelated(env, records, paths); err != nil {
+		return nil, err
+	}
+	if withTags {
+		if err := m.readTags(env, records); err != nil {
+			return nil, err
+		}
+	}
+	for _, record := range records {
+		for _, relation := range hidden {
+			delete(record, relation)
+		}
+	}
+	return records, nil
+}
+
+// applyTranslations overlays translated values for the environment language
+func (m *ModelDefinition) applyTranslations(env *Environment, records map[uint]map[string]interface{}, fieldNames []string) error {
+	lang := env.Lang()
+	if lang == DefaultLang {
+		return nil
+	}
+
+	var translatable []string
+	for _, name := range fieldNames {
+		if IsTranslatable(m.Fields[name]) {
+			translatable = append(translatable, name)
+		}
+	}
+	if len(translatable) == 0 {
+		return nil
+	}
+
+	ids := make([]uint, 0, len(records))
+	for id := range records {
+		ids = append(ids, id)
+	}
+
+	translations, err := GetTranslations(env.db, m.Name, ids, translatable, lang)
+	if err != nil {
+		return fmt.Errorf("failed to read translations: %w", err)
+	}
+
+	// Missing translations fall back to the base column value
+	for id, values := range translations {
+		for name, value := range values {
+			records[id][name] = value
+		}
+	}
+	return nil
+}
+
+// prepareValues validates and converts caller values to column values
+func (m *ModelDefinition) prepareValues(vals map[string]interface{}) (map[string]interface{}, error) {
+	names := make([]string, 0, len(vals))
+	for name := range vals {
+		if magicColumns[name] {
+			return nil, fmt.Errorf("field '%s' is managed by the ORM and cannot be written", name)
+		}
+		names = append(names, name)
+	}
+	if err := m.checkFieldNames(names); err != nil {
+		return nil, err
+	}
+
+	for name, value := range vals {
+		if value == nil {
+			continue
+		}
+		if err := m.Fields[name].Validate(value, nil); err != nil {
+			return nil, fmt.Errorf("validation error for field '%s': %w", name, err)
+		}
+	}
+
+	return m.ConvertData(vals, "column")
+}
+
+// ParseLocalized converts the strings typed in the environment's language,
+// such as "1.234,56" or "31.12.2024" in de_DE, to canonical values. Values
+// that do not parse are left for validation to report.
+func (m *ModelDefinition) ParseLocalized(env *Environment, vals map[string]interface{}) {
+	l, loc := fields.DisplayLocale(env)
+	for name, value := range vals {
+		text, ok := value.(string)
+		if !ok || text == "" {
+			continue
+		}
+		if parser, ok := m.Fields[name].(fields.LocalizedParser); ok {
+			if parsed, err := parser.ParseLocalized(text, l, loc); err == nil {
+				vals[name] = parsed
+			}
+		}
+	}
+}
+
+// Display formats the values of a read record in the environment's
+// language and timezone
+func (m *ModelDefinition) Display(env *Environment, record map[string]interface{}) (map[string]string, error) {
+	display := make(map[string]string, len(record))
+	for name, value := range record {
+		field, ok := m.Fields[name]
+		if !ok {
+			continue
+		}
+		formatted, err := field.ConvertToDisplay(value, env)
+		if err != nil {
+			return nil, fmt.Errorf("field '%s': %w", name, err)
+		}
+		display[name] = formatted
+	}
+	return display, nil
+}
+
+// Create inserts a record and returns its ID
+func (m *ModelDefinition) Create(env *Environment, vals map[string]interface{}) (uint, error) {
+	if err := m.checkConcrete(); err != nil {
+		return 0, err
+	}
+	if err := m.checkWriteAccess(env, vals); err != nil {
+		return 0, err
+	}
+	vals, tags, withTags := m.splitTags(vals)
+
+	merged := m.DefaultValues(env)
+	for name := range magicColumns {
+		delete(merged, name)
+	}
+	for name, value := range vals {
+		merged[name] = value
+	}
+
+	// Required fields must be present on create
+	for name, field := range m.GetStoredFields() {
+		if magicColumns[name] || !field.IsRequired() {
+			continue
+		}
+		if err := field.Validate(merged[name], nil); err != nil {
+			return 0, fmt.Errorf("validation error for field '%s': %w", name, err)
+		}
+	}
+
+	columns, err := m.prepareValues(merged)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now().UTC()
+	columns["create_uid"] = env.user
+	columns["write_uid"] = env.user
+	columns["create_date"] = now
+	columns["write_date"] = now
+	m.dropUnavailable(env, columns)
+
+	names := make([]string, 0, len(columns))
+	for name := range columns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	placeholders := make([]string, len(names))
+	args := make([]interface{}, len(names))
+	for i, name := range names {
+		placeholders[i] = "?"
+		args[i] = columns[name]
+	}
+
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) RETURNING id",
+		m.TableName, strings.Join(names, ", "), strings.Join(placeholders, ", "))
+
+	var id uint
+	err = env.Transaction(func(tx *gorm.DB) error {
+		if err := m.checkBlockingDuplicates(env.WithDB(tx), merged); err != nil {
+			return err
+		}
+		if err := m.checkUniqueConstraints(tx, nil, columns); err != nil {
+			return err
+		}
+		if err := tx.Raw(query, args...).Scan(&id).Error; err != nil {
+			return m.translateConstraintError(err)
+		}
+		if withTags {
+			if err := SetTags(tx, env.user, m.Name, []uint{id}, tags); err != nil {
+				return err
+			}
+		}
+		if err := m.trackCreate(env.WithDB(tx), id, columns); err != nil {
+			return err
+		}
+		return m.notify(env.WithDB(tx), EventCreate, []uint{id}, fieldNames(vals))
+	})
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// Write updates records. In a non-default language, translatable fields are
+// stored as translations instead of overwriting the base column.
+func (m *ModelDefinition) Write(env *Environment, ids []uint, vals map[string]interface{}) error {
+	if err := m.checkConcrete(); err != nil {
+		return err
+	}
+	if len(ids) == 0 || len(vals) == 0 {
+		return nil
+	}
+	if err := m.checkWriteAccess(env, vals); err != nil {
+		return err
+	}
+	if err := m.checkRules(env, "write", ids); err != nil {
+		return err
+	}
+	changed := fieldNames(vals)
+	vals, tags, withTags := m.splitTags(vals)
+
+	columns, err := m.prepareValues(vals)
+	if err != nil {
+		return err
+	}
+	m.dropUnavailable(env, columns)
+
+	return env.Transaction(func(tx *gorm.DB) error {
+		if lang := env.Lang(); lang != DefaultLang {
+			for name, value := range columns {
+				if !IsTranslatable(m.Fields[name]) {
+					continue
+				}
+				for _, id := range ids {
+					if err := SetTranslation(tx, m.Name, id, name, lang, fmt.Sprintf("%v", value), env.user); err != nil {
+						return fmt.Errorf("failed to store translation for '%s': %w", name, err)
+					}
+				}
+				delete(columns, name)
+			}
+		}
+
+		// The values before the write are read for the change tracking
+		var before map[uint]map[string]interface{}
+		if m.tracksChanges() {
+			tracked := m.trackedFields(fieldNames(columns))
+			if len(tracked) > 0 {
+				if before, err = m.trackingSnapshot(env.WithDB(tx), ids, tracked); err != nil {
+					return err
+				}
+			}
+		}
+
+		if err := m.checkUniqueConstraints(tx, ids, columns); err != nil {
+			return err
+		}
+		columns["write_uid"] = env.user
+		columns["write_date"] = time.Now().UTC()
+		m.dropUnavailable(env, columns)
+
+		if err := tx.Table(m.TableName).Where("id IN ?", ids).Updates(columns).Error; err != nil {
+			return m.translateConstraintError(err)
+		}
+		if withTags {
+			if err := SetTags(tx, env.user, m.Name, ids, tags); err != nil {
+				return err
+			}
+		}
+		if err := m.trackWrite(env.WithDB(tx), before, columns); err != nil {
+			return err
+		}
+		return m.notify(env.WithDB(tx), EventWrite, ids, changed)
+	})
+}
+
+// ConcurrencyError is returned when a record changed since the version the
+// caller read
+type ConcurrencyError struct {
+	Model string
+	ID    uint
+	// Version is the current version of the record
+	Version string
+}
+
+func (e *ConcurrencyError) Error() string {
+	return fmt.Sprintf("%s(%d) was modified since it was read", e.Model, e.ID)
+}
+
+// RecordVersion returns the version of a record last written at
+// writeDate, compared by CheckVersion and used as ETag by the record API
+func RecordVersion(writeDate time.Time) string {
+	return strconv.FormatInt(writeDate.UnixMicro(), 10)
+}
+
+// lockRecord locks a record until the end of the transaction and returns
+// its version, or gorm.ErrRecordNotFound
+func (m *ModelDefinition) lockRecord(env *Environment, id uint) (string, error) {
+	var row struct {
+		WriteDate *time.Time
+	}
+	result := env.db.Raw(fmt.Sprintf("SELECT write_date FROM %s WHERE id = ? FOR UPDATE", m.TableName), id).Scan(&row)
+	if result.Error != nil {
+		return "", result.Error
+	}
+	if result.RowsAffected == 0 {
+		return "", gorm.ErrRecordNotFound
+	}
+	if row.WriteDate == nil {
+		return "", nil
+	}
+	return RecordVersion(*row.WriteDate), nil
+}
+
+// CheckVersion locks a record until the end of the transaction and
+// returns a ConcurrencyError when it is no longer at version, so that a
+// write in the same transaction only applies to the version read
+func (m *ModelDefinition) CheckVersion(env *Environment, id uint, version string) error {
+	if err := m.checkConcrete(); err != nil {
+		return err
+	}
+	current, err := m.lockRecord(env, id)
+	if err != nil {
+		return err
+	}
+	if current != version {
+		return &ConcurrencyError{Model: m.Name, ID: id, Version: current}
+	}
+	return nil
+}
+
+// PatchOptions control Patch
+type PatchOptions struct {
+	// Mask lists the fields that may be written; other keys are ignored.
+	// Nil writes every key.
+	Mask []string
+	// ReplaceJSON replaces JSON values instead of merging them
+	ReplaceJSON bool
+	// Version, when set, is the version the caller read (see CheckVersion)
+	Version string
+}
+
+// Patch writes only the keys of vals to a record: null clears the column,
+// except for required fields, and JSON objects are merged into the stored
+// values (see fields.JsonField.Merge). It returns the keys ignored because
+// they are outside the mask, sorted. Validation only applies to the
+// written fields.
+func (m *ModelDefinition) Patch(env *Environment, id uint, vals map[string]interface{}, opts PatchOptions) ([]string, error) {
+	if err := m.checkConcrete(); err != nil {
+		return nil, err
+	}
+
+	written := make(map[string]interface{}, len(vals))
+	ignored := []string{}
+	var mask map[string]bool
+	if opts.Mask != nil {
+		if err := m.checkFieldNames(opts.Mask); err != nil {
+			return nil, fmt.Errorf("invalid field mask: %w", err)
+		}
+		mask = make(map[string]bool, len(opts.Mask))
+		for _, name := range opts.Mask {
+			mask[name] = true
+		}
+	}
+	for name, value := range vals {
+		if mask != nil && !mask[name] {
+			ignored = append(ignored, name)
+			continue
+		}
+		if field, exists := m.Fields[name]; exists && value == nil && field.IsRequired() {
+			return nil, fmt.Errorf("field '%s' is required and cannot be cleared", name)
+		}
+		written[name] = value
+	}
+	sort.Strings(ignored)
+
+	err := env.Transaction(func(tx *gorm.DB) error {
+		txEnv := env.WithDB(tx)
+		if opts.Version != "" {
+			if err := m.CheckVersion(txEnv, id, opts.Version); err != nil {
+				return err
+			}
+		} else if _, err := m.lockRecord(txEnv, id); err != nil {
+			return err
+		}
+		if !opts.ReplaceJSON {
+			if err := m.mergeJSON(txEnv, id, written); err != nil {
+				return err
+			}
+		}
+		return m.Write(txEnv, []uint{id}, written)
+	})
+	return ignored, err
+}
+
+// mergeJSON replaces the JSON objects of vals by their merge into the
+// values stored on a record
+func (m *ModelDefinition) mergeJSON(env *Environment, id uint, vals map[string]interface{}) error {
+	for name, value := range vals {
+		field, ok := m.Fields[name].(*fields.JsonField)
+		if !ok {
+			continue
+		}
+		if _, isObject := value.(map[string]interface{}); !isObject {
+			continue
+		}
+
+		var row struct {
+			Value *string
+		}
+		query := fmt.Sprintf("SELECT %s::text AS value FROM %s WHERE id = ?", name, m.TableName)
+		if err := env.db.Raw(query, id).Scan(&row).Error; err != nil {
+			return err
+		}
+		var stored interface{}
+		if row.Value != nil {
+			stored = *row.Value
+		}
+		merged, err := field.Merge(stored, value)
+		if err != nil {
+			return err
+		}
+		vals[name] = merged
+	}
+	return nil
+}
+
+// Unlink deletes records together with their translations and tags.
+// Listeners are notified before the delete so they can still read the
+// records. The relations to the model declaring ondelete are applied
+// first: a restrict one still used fails with a RestrictError.
+func (m *ModelDefinition) Unlink(env *Environment, ids []uint) error {
+	if err := m.checkConcrete(); err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	if err := m.checkRules(env, "delete", ids); err != nil {
+		return err
+	}
+
+	return env.Transaction(func(tx *gorm.DB) error {
+		if err := m.notify(env.WithDB(tx), EventUnlink, ids, nil); err != nil {
+			return err
+		}
+		if err := m.trackUnlink(env.WithDB(tx), ids); err != nil {
+			return err
+		}
+		if err := applyOnDelete(env.WithDB(tx), m.TableName, ids); err != nil {
+			return err
+		}
+		if err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE id IN ?", m.TableName), ids).Error; err != nil {
+			return err
+		}
+		if err := DeleteTagLinks(tx, m.Name, ids); err != nil {
+			return err
+		}
+		return DeleteTranslations(tx, m.Name, ids)
+	})
+}
+
+// toUint converts a scanned integer column to uint
+func toUint(value interface{}) uint {
+	switch v := value.(type) {
+	case int64:
+		return uint(v)
+	case int32:
+		return uint(v)
+	case int:
+		return uint(v)
+	case uint:
+		return v
+	case uint64:
+		return uint(v)
+	case float64:
+		return uint(v)
+	}
+	return 0
+}
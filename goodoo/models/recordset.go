@@ -0,0 +1,320 @@
+package models
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// ErrNotSingleton is returned by EnsureOne for recordsets not holding
+// exactly one record
+var ErrNotSingleton = errors.New("expected singleton")
+
+// withRecords returns a recordset of records sharing the database handle,
+// model and environment of rs
+func (rs *RecordSet[T]) withRecords(records []T) *RecordSet[T] {
+	return &RecordSet[T]{
+		db:      rs.db,
+		Records: records,
+		model:   rs.model,
+		env:     rs.env,
+	}
+}
+
+// recordID returns the id of a record, whether T is a model or a pointer
+// to one
+func recordID[T any](record T) (uint, bool) {
+	if identified, ok := any(record).(interface{ GetID() uint }); ok {
+		return identified.GetID(), true
+	}
+	if identified, ok := any(&record).(interface{ GetID() uint }); ok {
+		return identified.GetID(), true
+	}
+	return 0, false
+}
+
+// Len returns the number of records
+func (rs *RecordSet[T]) Len() int {
+	return len(rs.Records)
+}
+
+// Ids returns the ids of the records, in order
+func (rs *RecordSet[T]) Ids() []uint {
+	ids := make([]uint, 0, len(rs.Records))
+	for _, record := range rs.Records {
+		if id, ok := recordID(record); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// EnsureOne returns the record of a singleton recordset, ErrNotSingleton
+// for an empty recordset or one of several records
+func (rs *RecordSet[T]) EnsureOne() (T, error) {
+	if len(rs.Records) != 1 {
+		var zero T
+		return zero, fmt.Errorf("%w: %d records", ErrNotSingleton, len(rs.Records))
+	}
+	return rs.Records[0], nil
+}
+
+// Filtered returns the records for which keep returns true
+func (rs *RecordSet[T]) Filtered(keep func(T) bool) *RecordSet[T] {
+	records := make([]T, 0, len(rs.Records))
+	for _, record := range rs.Records {
+		if keep(record) {
+			records = append(records, record)
+		}
+	}
+	return rs.withRecords(records)
+}
+
+// FilteredDomain returns the records matching a domain in the database,
+// in their order in rs; records are not reloaded
+func (rs *RecordSet[T]) FilteredDomain(domain Domainer) (*RecordSet[T], error) {
+	ids := rs.Ids()
+	if len(ids) == 0 {
+		return rs.withRecords(make([]T, 0)), nil
+	}
+	query := rs.applyDomain(rs.db.Model(&rs.model).Where("id IN ?", ids), domain)
+	return rs.keepIDs(query)
+}
+
+// Exists returns the records still present in the database, in their
+// order in rs
+func (rs *RecordSet[T]) Exists() (*RecordSet[T], error) {
+	ids := rs.Ids()
+	if len(ids) == 0 {
+		return rs.withRecords(make([]T, 0)), nil
+	}
+	return rs.keepIDs(rs.db.Model(&rs.model).Where("id IN ?", ids))
+}
+
+// keepIDs returns the records whose id query selects
+func (rs *RecordSet[T]) keepIDs(query *gorm.DB) (*RecordSet[T], error) {
+	var found []uint
+	if err := query.Pluck("id", &found).Error; err != nil {
+		return nil, err
+	}
+	kept := make(map[uint]bool, len(found))
+	for _, id := range found {
+		kept[id] = true
+	}
+	return rs.Filtered(func(record T) bool {
+		id, _ := recordID(record)
+		return kept[id]
+	}), nil
+}
+
+// Sorted returns the records sorted by less; records comparing equal keep
+// their order
+func (rs *RecordSet[T]) Sorted(less func(a, b T) bool) *RecordSet[T] {
+	records := append(make([]T, 0, len(rs.Records)), rs.Records...)
+	sort.SliceStable(records, func(i, j int) bool {
+		return less(records[i], records[j])
+	})
+	return rs.withRecords(records)
+}
+
+// SortedBy returns the records sorted by a field, named by its column or
+// Go name; "name desc" sorts in descending order. Null values sort first.
+func (rs *RecordSet[T]) SortedBy(order string) (*RecordSet[T], error) {
+	name, direction, _ := strings.Cut(strings.TrimSpace(order), " ")
+	descending := strings.EqualFold(strings.TrimSpace(direction), "desc")
+
+	modelSchema, err := rs.schema()
+	if err != nil {
+		return nil, err
+	}
+	field := modelSchema.LookUpField(name)
+	if field == nil {
+		return nil, fmt.Errorf("unknown field %s of %s", name, modelSchema.Table)
+	}
+
+	if !sortable(field.FieldType) {
+		return nil, fmt.Errorf("field %s of %s is not sortable", name, modelSchema.Table)
+	}
+
+	values := make([]reflect.Value, len(rs.Records))
+	positions := make([]int, len(rs.Records))
+	for i := range rs.Records {
+		values[i] = field.ReflectValueOf(context.Background(), recordValue(&rs.Records[i]))
+		positions[i] = i
+	}
+	sort.SliceStable(positions, func(i, j int) bool {
+		c := compareValues(values[positions[i]], values[positions[j]])
+		if descending {
+			return c > 0
+		}
+		return c < 0
+	})
+	records := make([]T, len(rs.Records))
+	for i, position := range positions {
+		records[i] = rs.Records[position]
+	}
+	return rs.withRecords(records), nil
+}
+
+// Mapped returns the value of a field for each record, in order. The field
+// is named by its column or Go name; "partner_id.name" or "Partner.Name"
+// follows one relation, loaded for all records in a single query, and
+// flattens the values of to-many relations.
+func (rs *RecordSet[T]) Mapped(path string) ([]interface{}, error) {
+	modelSchema, err := rs.schema()
+	if err != nil {
+		return nil, err
+	}
+	values := make([]interface{}, 0, len(rs.Records))
+	name, related, traverse := strings.Cut(path, ".")
+
+	if !traverse {
+		field := modelSchema.LookUpField(name)
+		if field == nil {
+			return nil, fmt.Errorf("unknown field %s of %s", name, modelSchema.Table)
+		}
+		for i := range rs.Records {
+			values = append(values, field.ReflectValueOf(context.Background(), recordValue(&rs.Records[i])).Interface())
+		}
+		return values, nil
+	}
+
+	relation := lookUpRelation(modelSchema, name)
+	if relation == nil {
+		return nil, fmt.Errorf("unknown relation %s of %s", name, modelSchema.Table)
+	}
+	field := relation.FieldSchema.LookUpField(related)
+	if field == nil {
+		return nil, fmt.Errorf("unknown field %s of %s", related, relation.FieldSchema.Table)
+	}
+	if len(rs.Records) == 0 {
+		return values, nil
+	}
+
+	// Prefetch the relation of every record at once
+	var loaded []T
+	if err := rs.db.Model(&rs.model).Preload(relation.Name).Where("id IN ?", rs.Ids()).Find(&loaded).Error; err != nil {
+		return nil, err
+	}
+	byID := make(map[uint]int, len(loaded))
+	for i, record := range loaded {
+		if id, ok := recordID(record); ok {
+			byID[id] = i
+		}
+	}
+
+	for _, record := range rs.Records {
+		id, _ := recordID(record)
+		index, ok := byID[id]
+		if !ok {
+			continue
+		}
+		target := reflect.Indirect(relation.Field.ReflectValueOf(context.Background(), recordValue(&loaded[index])))
+		switch target.Kind() {
+		case reflect.Slice:
+			for i := 0; i < target.Len(); i++ {
+				if element := reflect.Indirect(target.Index(i)); element.IsValid() {
+					values = append(values, field.ReflectValueOf(context.Background(), element).Interface())
+				}
+			}
+		case reflect.Struct:
+			values = append(values, field.ReflectValueOf(context.Background(), target).Interface())
+		}
+	}
+	return values, nil
+}
+
+// schema parses the GORM schema of the model
+func (rs *RecordSet[T]) schema() (*schema.Schema, error) {
+	statement := &gorm.Statement{DB: rs.db}
+	if err := statement.Parse(&rs.model); err != nil {
+		return nil, err
+	}
+	return statement.Schema, nil
+}
+
+// recordValue returns the addressable struct of a record, T being a model
+// or a pointer to one
+func recordValue[T any](record *T) reflect.Value {
+	return reflect.Indirect(reflect.ValueOf(record).Elem())
+}
+
+// lookUpRelation finds a relation by its Go name, or a belongs-to relation
+// by its foreign key column, e.g. "partner_id" for Partner
+func lookUpRelation(modelSchema *schema.Schema, name string) *schema.Relationship {
+	if relation, ok := modelSchema.Relationships.Relations[name]; ok {
+		return relation
+	}
+	for _, relation := range modelSchema.Relationships.Relations {
+		if relation.Type != schema.BelongsTo {
+			continue
+		}
+		for _, reference := range relation.References {
+			if reference.ForeignKey.DBName == name {
+				return relation
+			}
+		}
+	}
+	return nil
+}
+
+// sortable reports whether SortedBy can order the values of a field type:
+// numbers, strings, booleans and times, or pointers to them
+func sortable(fieldType reflect.Type) bool {
+	if fieldType.Kind() == reflect.Ptr {
+		fieldType = fieldType.Elem()
+	}
+	switch fieldType.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64, reflect.String, reflect.Bool:
+		return true
+	}
+	return fieldType == reflect.TypeOf(time.Time{})
+}
+
+// compareValues orders two values of a sortable field type, nil pointers
+// first
+func compareValues(a, b reflect.Value) int {
+	if a.Kind() == reflect.Ptr {
+		switch {
+		case a.IsNil() && b.IsNil():
+			return 0
+		case a.IsNil():
+			return -1
+		case b.IsNil():
+			return 1
+		}
+		return compareValues(a.Elem(), b.Elem())
+	}
+	switch a.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return cmp.Compare(a.Int(), b.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return cmp.Compare(a.Uint(), b.Uint())
+	case reflect.Float32, reflect.Float64:
+		return cmp.Compare(a.Float(), b.Float())
+	case reflect.String:
+		return cmp.Compare(a.String(), b.String())
+	case reflect.Bool:
+		// false sorts before true
+		return cmp.Compare(boolRank(a.Bool()), boolRank(b.Bool()))
+	}
+	return a.Interface().(time.Time).Compare(b.Interface().(time.Time))
+}
+
+// boolRank is 0 for false and 1 for true
+func boolRank(value bool) int {
+	if value {
+		return 1
+	}
+	return 0
+}
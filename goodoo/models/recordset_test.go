@@ -0,0 +1,102 @@
+package models_test
+
+import (
+	"slices"
+	"testing"
+
+	"goodoo/models"
+	"goodoo/models/testutil"
+)
+
+func TestRecordSetIds(t *testing.T) {
+	tests := []struct {
+		name    string
+		records []models.Partner
+		want    []uint
+	}{
+		{"empty", nil, []uint{}},
+		{"in order", []models.Partner{
+			{BaseModel: models.BaseModel{ID: 7}},
+			{BaseModel: models.BaseModel{ID: 3}},
+		}, []uint{7, 3}},
+		{"unsaved records have id 0", []models.Partner{{}, {BaseModel: models.BaseModel{ID: 4}}}, []uint{0, 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := models.NewRecordSet(nil, models.Partner{})
+			rs.Records = tt.records
+			if got := rs.Ids(); !slices.Equal(got, tt.want) {
+				t.Errorf("Ids() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("pointer records", func(t *testing.T) {
+		rs := models.NewRecordSet(nil, &models.Partner{})
+		rs.Records = []*models.Partner{{BaseModel: models.BaseModel{ID: 5}}, {BaseModel: models.BaseModel{ID: 9}}}
+		if got := rs.Ids(); !slices.Equal(got, []uint{5, 9}) {
+			t.Errorf("Ids() = %v, want [5 9]", got)
+		}
+	})
+}
+
+func TestRecordSetWrite(t *testing.T) {
+	env := testutil.NewTestEnvironment(t)
+
+	tests := []struct {
+		name string
+		// pick selects the records written among three new partners
+		pick    func(partners []models.Partner) []models.Partner
+		written []bool
+	}{
+		{"all", func(p []models.Partner) []models.Partner { return p }, []bool{true, true, true}},
+		{"some", func(p []models.Partner) []models.Partner { return []models.Partner{p[0], p[2]} }, []bool{true, false, true}},
+		{"none", func(p []models.Partner) []models.Partner { return nil }, []bool{false, false, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := env.Savepoint(t)
+			partners := []models.Partner{*env.CreatePartner(), *env.CreatePartner(), *env.CreatePartner()}
+
+			rs := models.Model(env.Environment, models.Partner{})
+			rs.Records = tt.pick(partners)
+			if err := rs.Write(map[string]interface{}{"city": "Written"}); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+
+			for i, partner := range partners {
+				var city string
+				if err := env.Tx.Model(&models.Partner{}).Where("id = ?", partner.ID).Pluck("city", &city).Error; err != nil {
+					t.Fatal(err)
+				}
+				if got := city == "Written"; got != tt.written[i] {
+					t.Errorf("partner %d written = %v, want %v", i, got, tt.written[i])
+				}
+			}
+		})
+	}
+
+	t.Run("searched records", func(t *testing.T) {
+		env := env.Savepoint(t)
+		lyon := env.CreatePartner(func(p *models.Partner) { p.City = "Lyon" })
+		other := env.CreatePartner(func(p *models.Partner) { p.City = "Nice" })
+
+		found, err := models.Model(env.Environment, models.Partner{}).Search(models.Domain{
+			[]interface{}{"id", "in", []uint{lyon.ID, other.ID}},
+			[]interface{}{"city", "=", "Lyon"},
+		}, 0, 0, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := found.Write(map[string]interface{}{"zip": "69000"}); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		count, err := models.Model(env.Environment, models.Partner{}).Count(models.Domain{[]interface{}{"zip", "=", "69000"}, []interface{}{"id", "in", []uint{lyon.ID, other.ID}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 1 {
+			t.Errorf("%d partners written, want 1", count)
+		}
+	})
+}
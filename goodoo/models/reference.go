@@ -0,0 +1,233 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"goodoo/refdata"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// CountryModel is the ir_translation model of the country names
+const CountryModel = "res.country"
+
+// Country is a country of the reference data (like Odoo's res.country),
+// seeded from package refdata; its name is translated in ir_translation
+type Country struct {
+	ID   uint   `gorm:"primaryKey;autoIncrement" json:"id"`
+	Code string `gorm:"size:2;not null;uniqueIndex" json:"code"`
+	Name string `gorm:"not null" json:"name"`
+	// PhoneCode is the international calling code, without "+"
+	PhoneCode string `gorm:"column:phone_code;size:8" json:"phone_code"`
+	// AddressFormat lays out the addresses of the country (see
+	// refdata.FormatAddress), empty for the default layout
+	AddressFormat string    `gorm:"column:address_format;type:text" json:"address_format"`
+	WriteDate     time.Time `gorm:"column:write_date;autoUpdateTime" json:"write_date"`
+}
+
+func (Country) TableName() string {
+	return "res_country"
+}
+
+// DisplayName is the name of the country with its code, e.g. "Germany (DE)"
+// (its name_get)
+func (c *Country) DisplayName() string {
+	return fmt.Sprintf("%s (%s)", c.Name, c.Code)
+}
+
+// Lang is a language of the reference data (like Odoo's res.lang); the
+// active ones are those users may pick
+type Lang struct {
+	ID     uint   `gorm:"primaryKey;autoIncrement" json:"id"`
+	Code   string `gorm:"size:16;not null;uniqueIndex" json:"code"`
+	Name   string `gorm:"not null" json:"name"`
+	Active bool   `gorm:"not null;default:false;index" json:"active"`
+	// Direction is "ltr" or "rtl"
+	Direction string    `gorm:"size:3;not null;default:ltr" json:"direction"`
+	WriteDate time.Time `gorm:"column:write_date;autoUpdateTime" json:"write_date"`
+}
+
+func (Lang) TableName() string {
+	return "res_lang"
+}
+
+// SeedReferenceData merges the countries and languages of package refdata
+// into a database, keyed by code: new ones are created and the others
+// updated, so upgrades never duplicate them. Whether a language is active
+// is left to the administrators, except for new languages, active when
+// they are the default one or have translations. Partners with a free
+// text country naming a known country get its country_id.
+func SeedReferenceData(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var countries []Country
+		for _, country := range refdata.Countries() {
+			countries = append(countries, Country{Code: country.Code, Name: country.Name,
+				PhoneCode: country.PhoneCode, AddressFormat: country.AddressFormat})
+		}
+		err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "code"}},
+			DoUpdates: clause.AssignmentColumns([]string{"name", "phone_code", "address_format", "write_date"}),
+		}).CreateInBatches(&countries, 100).Error
+		if err != nil {
+			return err
+		}
+
+		ids := make(map[string]uint, len(countries))
+		if err := tx.Model(&Country{}).Select("id", "code").Find(&countries).Error; err != nil {
+			return err
+		}
+		for _, country := range countries {
+			ids[country.Code] = country.ID
+		}
+		var translations []IrTranslation
+		for _, name := range refdata.CountryNames() {
+			if id, ok := ids[name.Code]; ok {
+				translations = append(translations, IrTranslation{Model: CountryModel, ResID: id, Field: "name", Lang: name.Lang, Value: name.Name})
+			}
+		}
+		err = tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "model"}, {Name: "res_id"}, {Name: "field"}, {Name: "lang"}},
+			DoUpdates: clause.AssignmentColumns([]string{"value", "write_date"}),
+		}).CreateInBatches(&translations, 500).Error
+		if err != nil {
+			return err
+		}
+
+		var translated []string
+		err = tx.Model(&IrTranslation{}).Distinct("lang").Where("model <> ?", CountryModel).Pluck("lang", &translated).Error
+		if err != nil {
+			return err
+		}
+		active := map[string]bool{DefaultLang: true}
+		for _, lang := range translated {
+			active[lang] = true
+		}
+		var langs []Lang
+		for _, lang := range refdata.Languages() {
+			langs = append(langs, Lang{Code: lang.Code, Name: lang.Name, Direction: lang.Direction, Active: active[lang.Code]})
+		}
+		err = tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "code"}},
+			DoUpdates: clause.AssignmentColumns([]string{"name", "direction", "write_date"}),
+		}).Create(&langs).Error
+		if err != nil {
+			return err
+		}
+
+		// Partners stored before country_id named their country in text
+		if tx.Migrator().HasColumn(&Partner{}, "country") {
+			return tx.Exec(`UPDATE res_partner p SET country_id = c.id FROM res_country c
+				WHERE p.country_id IS NULL AND p.country <> ''
+				AND (upper(trim(p.country)) = c.code OR lower(trim(p.country)) = lower(c.name))`).Error
+		}
+		return nil
+	})
+}
+
+// countryNameColumn is the name of the countries in the language bound
+// to the query, from the join of translatedCountries
+const countryNameColumn = "COALESCE(t.value, res_country.name)"
+
+// translatedCountries queries the countries joined with their name in a
+// language
+func translatedCountries(db *gorm.DB, lang string) *gorm.DB {
+	return db.Model(&Country{}).
+		Joins("LEFT JOIN ir_translation t ON t.model = ? AND t.res_id = res_country.id AND t.field = 'name' AND t.lang = ?", CountryModel, lang)
+}
+
+// SearchCountries returns a page of the countries whose code is query or
+// whose name in lang or in English contains it, ordered by name in lang
+// with the exact code first, and how many match. The names are given in
+// lang.
+func SearchCountries(db *gorm.DB, lang, query string, offset, limit int) ([]Country, int64, error) {
+	search := translatedCountries(db, lang)
+	code := strings.ToUpper(strings.TrimSpace(query))
+	if query = strings.TrimSpace(query); query != "" {
+		pattern := "%" + escapeLike(query) + "%"
+		search = search.Where("res_country.code = ? OR res_country.name ILIKE ? OR t.value ILIKE ?", code, pattern, pattern)
+	}
+	var total int64
+	if err := search.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	var countries []Country
+	order := clause.OrderBy{Expression: clause.Expr{
+		SQL:                "res_country.code = ? DESC, " + countryNameColumn + ", res_country.id",
+		Vars:               []interface{}{code},
+		WithoutParentheses: true,
+	}}
+	err := search.Select("res_country.id, res_country.code, " + countryNameColumn + " AS name, res_country.phone_code, res_country.address_format, res_country.write_date").
+		Order(order).Offset(offset).Limit(limit).Find(&countries).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	return countries, total, nil
+}
+
+// TranslateCountries replaces the names of countries by their name in lang
+func TranslateCountries(db *gorm.DB, lang string, countries ...*Country) error {
+	if lang == DefaultLang || len(countries) == 0 {
+		return nil
+	}
+	ids := make([]uint, 0, len(countries))
+	for _, country := range countries {
+		ids = append(ids, country.ID)
+	}
+	translations, err := GetTranslations(db, CountryModel, ids, []string{"name"}, lang)
+	if err != nil {
+		return err
+	}
+	for _, country := range countries {
+		if name, ok := translations[country.ID]["name"]; ok && name != "" {
+			country.Name = name
+		}
+	}
+	return nil
+}
+
+// SearchLangs returns a page of the languages whose code or name contains
+// query, the active ones only unless all, by name, and how many match
+func SearchLangs(db *gorm.DB, query string, all bool, offset, limit int) ([]Lang, int64, error) {
+	search := db.Model(&Lang{})
+	if !all {
+		search = search.Where("active = ?", true)
+	}
+	if query = strings.TrimSpace(query); query != "" {
+		pattern := "%" + escapeLike(query) + "%"
+		search = search.Where("code ILIKE ? OR name ILIKE ?", pattern, pattern)
+	}
+	var total int64
+	if err := search.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	var langs []Lang
+	if err := search.Order("name, id").Offset(offset).Limit(limit).Find(&langs).Error; err != nil {
+		return nil, 0, err
+	}
+	return langs, total, nil
+}
+
+// Address lays out the postal address of the partner with the format of
+// its country, which must be loaded, e.g. by LoadSaleOrders
+func (p Partner) Address() string {
+	format, country := "", ""
+	if p.Country != nil {
+		format, country = p.Country.AddressFormat, p.Country.Name
+	}
+	return refdata.FormatAddress(format, map[string]string{
+		"street":  p.Street,
+		"zip":     p.Zip,
+		"city":    p.City,
+		"country": country,
+	})
+}
+
+// AddressLines returns the lines of Address, for templates
+func (p Partner) AddressLines() []string {
+	if address := p.Address(); address != "" {
+		return strings.Split(address, "\n")
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"context"
 	"fmt"
 	"reflect"
 	"sync"
@@ -14,6 +15,12 @@ type Environment struct {
 	user     uint
 	dbName   string
 	registry *ModelRegistry
+	context  map[string]interface{}
+	// fieldModels is the model registry snapshot of the environment, nil
+	// to follow the database's current registry
+	fieldModels *FieldModelRegistry
+	// access caches the user's admin flag and groups; copies share it
+	access *accessRights
 }
 
 // NewEnvironment creates a new environment
@@ -22,6 +29,7 @@ func NewEnvironment(db *gorm.DB, user uint) *Environment {
 		db:       db,
 		user:     user,
 		registry: GetRegistry(),
+		access:   &accessRights{},
 	}
 }
 
@@ -37,6 +45,7 @@ func NewEnvironmentForDB(dbName string, user uint) (*Environment, error) {
 		user:     user,
 		dbName:   dbName,
 		registry: GetRegistry(),
+		access:   &accessRights{},
 	}, nil
 }
 
@@ -50,6 +59,114 @@ func (env *Environment) GetUser() uint {
 	return env.user
 }
 
+// UserID returns the current user ID
+func (env *Environment) UserID() uint {
+	return env.user
+}
+
+// Context returns the context the environment's queries run with, which
+// ends with the request that built the environment
+func (env *Environment) Context() context.Context {
+	if env.db != nil && env.db.Statement.Context != nil {
+		return env.db.Statement.Context
+	}
+	return context.Background()
+}
+
+// Detach returns a copy of the environment whose queries run with a
+// background context, to be used by goroutines outliving the request
+func (env *Environment) Detach() *Environment {
+	detached := env.WithContext(nil)
+	if env.db != nil {
+		detached.db = env.db.WithContext(context.Background())
+	}
+	return detached
+}
+
+// GetContext returns the environment context (lang, tz, ...)
+func (env *Environment) GetContext() map[string]interface{} {
+	if env.context == nil {
+		return map[string]interface{}{}
+	}
+	return env.context
+}
+
+// WithContext returns a copy of the environment with the given keys merged into its context
+func (env *Environment) WithContext(values map[string]interface{}) *Environment {
+	context := make(map[string]interface{}, len(env.context)+len(values))
+	for key, value := range env.context {
+		context[key] = value
+	}
+	for key, value := range values {
+		context[key] = value
+	}
+	
+	copied := *env
+	copied.context = context
+	return &copied
+}
+
+// WithDBName returns a copy of the environment for a named database,
+// which selects that database's model registry
+func (env *Environment) WithDBName(dbName string) *Environment {
+	copied := *env
+	copied.dbName = dbName
+	return &copied
+}
+
+// GetDBName returns the database name of the environment
+func (env *Environment) GetDBName() string {
+	return env.dbName
+}
+
+// FieldModels returns the model registry of the environment's database
+func (env *Environment) FieldModels() *FieldModelRegistry {
+	if env.fieldModels != nil {
+		return env.fieldModels
+	}
+	return RegistryForDB(env.dbName)
+}
+
+// Registry returns the model registry snapshot of the environment, which
+// does not change when the database's registry is rebuilt
+func (env *Environment) Registry() *FieldModelRegistry {
+	return env.FieldModels()
+}
+
+// WithRegistry returns a copy of the environment bound to a model
+// registry snapshot
+func (env *Environment) WithRegistry(registry *FieldModelRegistry) *Environment {
+	copied := *env
+	copied.fieldModels = registry
+	return &copied
+}
+
+// GetFieldModel looks up a model in the environment's registry
+func (env *Environment) GetFieldModel(name string) (*ModelDefinition, bool) {
+	return env.FieldModels().GetModel(name)
+}
+
+// WithDB returns a copy of the environment bound to another connection, e.g. a transaction
+func (env *Environment) WithDB(db *gorm.DB) *Environment {
+	copied := *env
+	copied.db = db
+	return &copied
+}
+
+// Transaction runs fn in a transaction that is retried on serialization
+// failures; pass database.NonIdempotent() to opt out
+func (env *Environment) Transaction(fn func(tx *gorm.DB) error, opts ...database.RetryOptions) error {
+	return database.RetryableTransaction(env.db.Statement.Context, env.db, fn, opts...)
+}
+
+// Lang returns the context language, falling back to DefaultLang
+func (env *Environment) Lang() string {
+	if lang, ok := env.GetContext()["lang"].(string); ok && lang != "" {
+		return lang
+	}
+	return DefaultLang
+}
+
 // ModelRegistry manages all registered models
 type ModelRegistry struct {
 	models map[string]reflect.Type
@@ -131,7 +248,10 @@ func (r *ModelRegistry) ListModels() []string {
 	return names
 }
 
-// Model is a helper function to get a RecordSet for a model
+// Model is a helper function to get a RecordSet for a model; its Create
+// applies the context defaults of env
 func Model[T any](env *Environment, model T) *RecordSet[T] {
-	return NewRecordSet(env.db, model)
+	rs := NewRecordSet(env.db, model)
+	rs.env = env
+	return rs
 }
\ No newline at end of file
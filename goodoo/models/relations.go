@@ -17,21 +17,33 @@ func NewRelationManager(db *gorm.DB) *RelationManager {
 
 // LoadMany2One loads a many-to-one relationship
 func (rm *RelationManager) LoadMany2One(recordID uint, modelName string, foreignKey string, targetModel interface{}) error {
-	return rm.db.Where(foreignKey+" = ?", recordID).First(targetModel).Error
+	column, err := quoteName("column", foreignKey)
+	if err != nil {
+		return err
+	}
+	return rm.db.Where(column+" = ?", recordID).First(targetModel).Error
 }
 
 // LoadOne2Many loads a one-to-many relationship
 func (rm *RelationManager) LoadOne2Many(recordID uint, modelName string, foreignKey string, targetSlice interface{}) error {
-	return rm.db.Where(foreignKey+" = ?", recordID).Find(targetSlice).Error
+	column, err := quoteName("column", foreignKey)
+	if err != nil {
+		return err
+	}
+	return rm.db.Where(column+" = ?", recordID).Find(targetSlice).Error
 }
 
 // LoadMany2Many loads a many-to-many relationship
 func (rm *RelationManager) LoadMany2Many(recordID uint, joinTable string, localKey string, foreignKey string, targetSlice interface{}) error {
+	local, _, err := quoteLink(joinTable, localKey, foreignKey)
+	if err != nil {
+		return err
+	}
+	
 	// First get the related IDs from the join table
 	var relatedIDs []uint
-	err := rm.db.Table(joinTable).
-		Select(foreignKey).
-		Where(localKey+" = ?", recordID).
+	err = rm.db.Table(joinTable).
+		Where(local+" = ?", recordID).
 		Pluck(foreignKey, &relatedIDs).Error
 	
 	if err != nil {
@@ -48,6 +60,9 @@ func (rm *RelationManager) LoadMany2Many(recordID uint, joinTable string, localK
 
 // CreateMany2ManyLink creates a many-to-many relationship link
 func (rm *RelationManager) CreateMany2ManyLink(recordID uint, relatedID uint, joinTable string, localKey string, foreignKey string) error {
+	if _, _, err := quoteLink(joinTable, localKey, foreignKey); err != nil {
+		return err
+	}
 	data := map[string]interface{}{
 		localKey:   recordID,
 		foreignKey: relatedID,
@@ -57,16 +72,39 @@ func (rm *RelationManager) CreateMany2ManyLink(recordID uint, relatedID uint, jo
 
 // DeleteMany2ManyLink removes a many-to-many relationship link
 func (rm *RelationManager) DeleteMany2ManyLink(recordID uint, relatedID uint, joinTable string, localKey string, foreignKey string) error {
+	local, foreign, err := quoteLink(joinTable, localKey, foreignKey)
+	if err != nil {
+		return err
+	}
 	return rm.db.Table(joinTable).
-		Where(localKey+" = ? AND "+foreignKey+" = ?", recordID, relatedID).
+		Where(local+" = ? AND "+foreign+" = ?", recordID, relatedID).
 		Delete(nil).Error
 }
 
+// quoteLink checks the join table and columns of a many-to-many
+// relationship and returns the columns quoted for raw conditions; GORM
+// quotes the names passed to Table, Pluck and Create itself
+func quoteLink(joinTable, localKey, foreignKey string) (local, foreign string, err error) {
+	if _, err = quoteName("table", joinTable); err != nil {
+		return
+	}
+	if local, err = quoteName("column", localKey); err != nil {
+		return
+	}
+	foreign, err = quoteName("column", foreignKey)
+	return
+}
+
 // UpdateOne2Many updates one-to-many relationships
 func (rm *RelationManager) UpdateOne2Many(recordID uint, relatedIDs []uint, modelName string, foreignKey string) error {
+	column, err := quoteName("column", foreignKey)
+	if err != nil {
+		return err
+	}
+	
 	// First, unlink existing relationships
-	err := rm.db.Model(&BaseModel{}).
-		Where(foreignKey+" = ?", recordID).
+	err = rm.db.Model(&BaseModel{}).
+		Where(column+" = ?", recordID).
 		Update(foreignKey, nil).Error
 	
 	if err != nil {
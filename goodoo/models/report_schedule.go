@@ -0,0 +1,254 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"goodoo/database"
+	"goodoo/fields"
+	"goodoo/logging"
+	"goodoo/scheduler"
+	"gorm.io/gorm"
+)
+
+// ErrScheduledReportNotFound is returned for a download link that does
+// not exist or expired
+var ErrScheduledReportNotFound = errors.New("scheduled report not found")
+
+// Kinds of report schedules
+const (
+	// ReportScheduleReport prints a registered report (see the reports
+	// package) for the records of the domain
+	ReportScheduleReport = "report"
+	// ReportScheduleExport exports the records of the domain as CSV, as
+	// the record lists do
+	ReportScheduleExport = "export"
+)
+
+// Formats of the output of report schedules
+const (
+	ReportFormatPDF  = "pdf"
+	ReportFormatHTML = "html"
+	ReportFormatCSV  = "csv"
+)
+
+// Report schedule run states
+const (
+	ReportRunRunning = "running"
+	ReportRunDone    = "done"
+	ReportRunFailed  = "failed"
+)
+
+// ReportRunResModel is the res_model of the attachments holding the output
+// of the runs too large to be mailed
+const ReportRunResModel = "report.schedule.run"
+
+// DefaultReportMaxAttachmentBytes is the largest output mailed as an
+// attachment unless ParamReportMaxAttachmentBytes says otherwise; larger
+// ones are sent as a download link
+const DefaultReportMaxAttachmentBytes = 10 << 20
+
+// DefaultReportLinkDays is how long the download links of scheduled
+// reports work unless ParamReportLinkDays says otherwise
+const DefaultReportLinkDays = 7
+
+// ReportSchedule mails a report or an export of the records of a domain
+// on a cron recurrence. The output is rendered as the owner, in their
+// language and in the schedule timezone, whoever edits the schedule.
+type ReportSchedule struct {
+	BaseModel
+	Name string `gorm:"not null" json:"name"`
+	// Kind is ReportScheduleReport or ReportScheduleExport
+	Kind string `gorm:"size:16;not null" json:"kind"`
+	// Report is the registered report printed, for the report kind
+	Report string `gorm:"" json:"report,omitempty"`
+	Model  string `gorm:"not null" json:"model"`
+	// FilterID is a saved filter of the model, visible to the owner, whose
+	// domain is applied before Domain; its sort and columns are used too
+	FilterID *uint `gorm:"column:filter_id" json:"filter_id,omitempty"`
+	// Domain is the JSON domain of the records, see DomainValue
+	Domain string `gorm:"type:text;not null;default:'[]'" json:"-"`
+	// Fields are the exported columns, the filter's or all the readable
+	// fields when empty
+	Fields StringList `gorm:"type:jsonb;not null;default:'[]'" json:"fields"`
+	Format string     `gorm:"size:8;not null" json:"format"`
+	// CronExpression is the recurrence, in Timezone
+	CronExpression string `gorm:"column:cron_expression;not null" json:"cron_expression"`
+	// Timezone is the IANA timezone of the recurrence and of the dates of
+	// the output, the owner's when empty
+	Timezone string `gorm:"" json:"timezone"`
+	// RecipientUserIDs and RecipientEmails are who the output is mailed to
+	RecipientUserIDs IDList     `gorm:"column:recipient_user_ids;type:jsonb;not null;default:'[]'" json:"recipient_user_ids"`
+	RecipientEmails  StringList `gorm:"column:recipient_emails;type:jsonb;not null;default:'[]'" json:"recipient_emails"`
+	Active           bool       `gorm:"not null;default:true;index" json:"active"`
+	// UserID is the owner the output is rendered as, notified of failures
+	UserID  uint       `gorm:"column:user_id;not null;index" json:"user_id"`
+	NextRun time.Time  `gorm:"column:next_run;index" json:"next_run"`
+	LastRun *time.Time `gorm:"column:last_run" json:"last_run,omitempty"`
+	// RunningSince is set while a run is in progress and prevents
+	// overlapping runs
+	RunningSince *time.Time `gorm:"column:running_since" json:"running_since,omitempty"`
+}
+
+func (ReportSchedule) TableName() string {
+	return "report_schedule"
+}
+
+// DomainValue decodes the domain of the schedule
+func (s *ReportSchedule) DomainValue() (Domain, error) {
+	var domain Domain
+	if strings.TrimSpace(s.Domain) == "" {
+		return domain, nil
+	}
+	if err := fields.DecodeJSON([]byte(s.Domain), &domain); err != nil {
+		return nil, fmt.Errorf("invalid domain: %w", err)
+	}
+	return domain, nil
+}
+
+// ReportScheduleRun records one run of a report schedule. The output of
+// the runs too large to be mailed is an attachment of the run, downloaded
+// with the token of the link sent until ExpiresAt.
+type ReportScheduleRun struct {
+	ID         uint       `gorm:"primaryKey;autoIncrement" json:"id"`
+	ScheduleID uint       `gorm:"column:schedule_id;not null;index" json:"schedule_id"`
+	State      string     `gorm:"not null" json:"state"`
+	Manual     bool       `gorm:"not null;default:false" json:"manual"`
+	StartedAt  time.Time  `gorm:"column:started_at;index" json:"started_at"`
+	FinishedAt *time.Time `gorm:"column:finished_at" json:"finished_at,omitempty"`
+	DurationMs int64      `gorm:"column:duration_ms" json:"duration_ms"`
+	// Records is the number of records rendered, OutputSize the size of
+	// the output in bytes
+	Records    int `gorm:"not null;default:0" json:"records"`
+	OutputSize int `gorm:"column:output_size;not null;default:0" json:"output_size"`
+	// MailID is the queued mail message of the output
+	MailID       *uint `gorm:"column:mail_id" json:"mail_id,omitempty"`
+	AttachmentID *uint `gorm:"column:attachment_id" json:"attachment_id,omitempty"`
+	// TokenHash is the SHA-256 of the token of the download link
+	TokenHash     *string    `gorm:"column:token_hash;uniqueIndex" json:"-"`
+	ExpiresAt     *time.Time `gorm:"column:expires_at;index" json:"expires_at,omitempty"`
+	DownloadCount int        `gorm:"column:download_count;not null;default:0" json:"download_count"`
+	Error         string     `gorm:"type:text" json:"error,omitempty"`
+}
+
+func (ReportScheduleRun) TableName() string {
+	return "report_schedule_run"
+}
+
+// NewDownloadToken returns the token of a download link for the run, and
+// stores its hash on the run
+func (r *ReportScheduleRun) NewDownloadToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+	hash := hashInvitationToken(token)
+	r.TokenHash = &hash
+	return token, nil
+}
+
+// DownloadScheduledReport returns the output of the link of a token, not
+// expired at now, and counts the download
+func DownloadScheduledReport(db *gorm.DB, token string, now time.Time) (*ReportScheduleRun, *IrAttachment, error) {
+	if token == "" {
+		return nil, nil, ErrScheduledReportNotFound
+	}
+	var run ReportScheduleRun
+	err := db.Where("token_hash = ? AND expires_at > ? AND attachment_id IS NOT NULL", hashInvitationToken(token), now).
+		First(&run).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil, ErrScheduledReportNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var attachment IrAttachment
+	err = db.Where("id = ? AND res_model = ?", *run.AttachmentID, ReportRunResModel).First(&attachment).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil, ErrScheduledReportNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	err = db.Model(&run).UpdateColumn("download_count", gorm.Expr("download_count + 1")).Error
+	return &run, &attachment, err
+}
+
+// PruneReportOutputs deletes the output of the runs whose link expired
+// before now, keeping the runs for the history of their schedule
+func PruneReportOutputs(db *gorm.DB, now time.Time) (int64, error) {
+	var runs []ReportScheduleRun
+	err := db.Where("expires_at <= ? AND attachment_id IS NOT NULL", now).Find(&runs).Error
+	if err != nil || len(runs) == 0 {
+		return 0, err
+	}
+	ids := make([]uint, len(runs))
+	for i, run := range runs {
+		ids[i] = run.ID
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("res_model = ? AND res_id IN ?", ReportRunResModel, ids).Delete(&IrAttachment{}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&ReportScheduleRun{}).Where("id IN ?", ids).Update("attachment_id", nil).Error
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(runs)), nil
+}
+
+// ScheduleReportOutputPrune registers a job deleting, every interval, the
+// output of the expired download links of scheduled reports of a database
+func ScheduleReportOutputPrune(s *scheduler.Scheduler, dbName string, interval time.Duration) {
+	logger := logging.GetLogger("goodoo.models.report_schedule")
+	s.Every("models.report_output.prune."+dbName, interval, func(ctx context.Context) error {
+		db, err := database.GetDatabase(dbName)
+		if err != nil {
+			return err
+		}
+		pruned, err := PruneReportOutputs(db.WithContext(ctx), s.Clock().Now())
+		if pruned > 0 {
+			logger.Info("Deleted the output of %d expired scheduled report link(s) of %s", pruned, dbName)
+		}
+		return err
+	})
+}
+
+// IDList is a list of record ids stored as a JSON array
+type IDList []uint
+
+// Value encodes the list as JSON
+func (l IDList) Value() (driver.Value, error) {
+	if l == nil {
+		l = IDList{}
+	}
+	data, err := json.Marshal(l)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// Scan decodes the JSON list
+func (l *IDList) Scan(src interface{}) error {
+	switch s := src.(type) {
+	case nil:
+		*l = nil
+		return nil
+	case string:
+		return json.Unmarshal([]byte(s), l)
+	case []byte:
+		return json.Unmarshal(s, l)
+	default:
+		return fmt.Errorf("cannot scan %T into IDList", src)
+	}
+}
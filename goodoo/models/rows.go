@@ -0,0 +1,65 @@
+package models
+
+import (
+	"context"
+
+	"goodoo/workpool"
+)
+
+// RowError reports a row of an import that could not be converted or
+// validated
+type RowError struct {
+	// Row is the 1-based position of the row in the converted rows; callers
+	// add the header lines of their file
+	Row     int    `json:"row"`
+	Message string `json:"message"`
+}
+
+// ConvertImportRows converts the values of imported rows, as parsed from a
+// file, to their cache representation and validates them, spreading the
+// rows over the worker pool. Converted rows keep the order of rows; a row
+// that fails is nil and reported in the errors, ordered by row. The error
+// is only set when ctx is cancelled.
+func (m *ModelDefinition) ConvertImportRows(ctx context.Context, rows []map[string]interface{}) ([]map[string]interface{}, []RowError, error) {
+	converted := make([]map[string]interface{}, len(rows))
+	messages := make([]string, len(rows))
+
+	err := workpool.Map(ctx, len(rows), func(ctx context.Context, i int) error {
+		values, err := m.ConvertData(rows[i], "cache")
+		if err == nil {
+			err = m.ValidateData(values)
+		}
+		if err != nil {
+			messages[i] = err.Error()
+			return nil
+		}
+		converted[i] = values
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var rowErrors []RowError
+	for i, message := range messages {
+		if message != "" {
+			rowErrors = append(rowErrors, RowError{Row: i + 1, Message: message})
+		}
+	}
+	return converted, rowErrors, nil
+}
+
+// ExportRows converts records read from the model to their export
+// representation on the worker pool, keeping their order
+func (m *ModelDefinition) ExportRows(ctx context.Context, records []map[string]interface{}) ([]map[string]interface{}, error) {
+	exported := make([]map[string]interface{}, len(records))
+	err := workpool.Map(ctx, len(records), func(ctx context.Context, i int) error {
+		values, err := m.ConvertData(records[i], "export")
+		exported[i] = values
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return exported, nil
+}
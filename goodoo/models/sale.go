@@ -0,0 +1,241 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Sale order states
+const (
+	SaleStateDraft  = "draft"
+	SaleStateSent   = "sent"
+	SaleStateSale   = "sale"
+	SaleStateDone   = "done"
+	SaleStateCancel = "cancel"
+)
+
+// SaleOrderSequence is the code of the sequence naming confirmed orders
+const SaleOrderSequence = "sale.order"
+
+// NewSaleOrderName is the placeholder name of quotations, replaced at confirmation
+const NewSaleOrderName = "New"
+
+// Partner is a contact or company (like Odoo's res.partner)
+type Partner struct {
+	BaseModel
+	Name      string   `gorm:"not null" json:"name"`
+	Email     string   `gorm:"" json:"email"`
+	Phone     string   `gorm:"" json:"phone"`
+	Street    string   `gorm:"" json:"street"`
+	Zip       string   `gorm:"" json:"zip"`
+	City      string   `gorm:"" json:"city"`
+	CountryID *uint    `gorm:"column:country_id;index" json:"country_id"`
+	Country   *Country `gorm:"foreignKey:CountryID;constraint:OnDelete:RESTRICT" json:"country,omitempty"`
+	// ParentID is the company a contact belongs to
+	ParentID *uint     `gorm:"column:parent_id;index" json:"parent_id"`
+	Children []Partner `gorm:"foreignKey:ParentID;constraint:OnDelete:SET NULL" json:"-"`
+	// CompanyID is the company owning the record in multi-company setups
+	CompanyID *uint `gorm:"column:company_id;index" json:"company_id"`
+	// Tags are loaded with LoadTags, not by GORM (see TagLink)
+	Tags []TagRef `gorm:"-" json:"tags,omitempty"`
+}
+
+func (Partner) TableName() string {
+	return "res_partner"
+}
+
+// BeforeSave rejects parent assignments that would make the partner its own ancestor
+func (p *Partner) BeforeSave(tx *gorm.DB) error {
+	parentID := savedParent(tx, "parent_id", p.ParentID)
+	return checkParent(tx.Session(&gorm.Session{NewDB: true}), "res_partner", "parent_id", p.ID, parentID)
+}
+
+// SaleOrder is a quotation or confirmed sales order (like Odoo's sale.order)
+type SaleOrder struct {
+	BaseModel
+	Name          string          `gorm:"not null;index" json:"name"`
+	PartnerID     uint            `gorm:"column:partner_id;not null;index" json:"partner_id"`
+	Partner       Partner         `gorm:"foreignKey:PartnerID;constraint:OnDelete:RESTRICT" json:"partner"`
+	UserID        *uint           `gorm:"column:user_id;index" json:"user_id" context_default:"uid"` // Salesperson, the creating user by default
+	DateOrder     time.Time       `gorm:"column:date_order" json:"date_order"`
+	State         string          `gorm:"default:draft" json:"state"`
+	CurrencyCode  string          `gorm:"column:currency_code;default:USD" json:"currency_code"`
+	Note          string          `gorm:"type:text" json:"note"`
+	AmountUntaxed float64         `gorm:"column:amount_untaxed" json:"amount_untaxed"`
+	AmountTax     float64         `gorm:"column:amount_tax" json:"amount_tax"`
+	AmountTotal   float64         `gorm:"column:amount_total" json:"amount_total"`
+	Lines         []SaleOrderLine `gorm:"foreignKey:OrderID;constraint:OnDelete:CASCADE" json:"order_line"`
+	// Tags are loaded with LoadTags, not by GORM (see TagLink)
+	Tags []TagRef `gorm:"-" json:"tags,omitempty"`
+}
+
+func (SaleOrder) TableName() string {
+	return "sale_order"
+}
+
+// ComputeAmounts recomputes the order totals from its lines
+func (o *SaleOrder) ComputeAmounts() {
+	o.AmountUntaxed, o.AmountTax = 0, 0
+	for _, line := range o.Lines {
+		o.AmountUntaxed += line.Subtotal()
+		o.AmountTax += line.Tax()
+	}
+	o.AmountTotal = o.AmountUntaxed + o.AmountTax
+}
+
+// saleTransitions lists the states each action may start from
+var saleTransitions = map[string][]string{
+	"confirm": {SaleStateDraft, SaleStateSent},
+	"cancel":  {SaleStateDraft, SaleStateSent, SaleStateSale},
+	"done":    {SaleStateSale},
+}
+
+// transition moves the order to a new state if the action is allowed in the
+// current one, and records it in the audit log
+func (o *SaleOrder) transition(db *gorm.DB, uid uint, action, state string, updates map[string]interface{}) error {
+	allowed := false
+	for _, from := range saleTransitions[action] {
+		if o.State == from {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return fmt.Errorf("cannot %s order %s in state %s", action, o.Name, o.State)
+	}
+
+	previous := o.State
+	updates["state"] = state
+	if err := db.Model(o).Updates(updates).Error; err != nil {
+		return err
+	}
+	o.State = state
+	return LogActivity(db, uid, Activity{
+		Type:   ActivityRecordStateChanged,
+		Model:  "sale.order",
+		ResID:  o.ID,
+		Params: map[string]interface{}{"name": o.Name, "action": action, "from": previous, "to": state},
+	})
+}
+
+// ActionConfirm turns a quotation into a sales order, naming it from the
+// sale.order sequence if it has no name yet
+func (o *SaleOrder) ActionConfirm(db *gorm.DB, uid uint) error {
+	updates := map[string]interface{}{"date_order": time.Now()}
+	if o.Name == "" || o.Name == NewSaleOrderName || o.Name == "/" {
+		name, err := NextByCode(db, SaleOrderSequence)
+		if err != nil {
+			return err
+		}
+		updates["name"] = name
+		o.Name = name
+	}
+	return o.transition(db, uid, "confirm", SaleStateSale, updates)
+}
+
+// ActionCancel cancels a quotation or a confirmed order
+func (o *SaleOrder) ActionCancel(db *gorm.DB, uid uint) error {
+	return o.transition(db, uid, "cancel", SaleStateCancel, map[string]interface{}{})
+}
+
+// ActionSetDone locks a confirmed order
+func (o *SaleOrder) ActionSetDone(db *gorm.DB, uid uint) error {
+	return o.transition(db, uid, "done", SaleStateDone, map[string]interface{}{})
+}
+
+// RecomputeSaleOrderAmounts stores the totals of an order from its lines
+func RecomputeSaleOrderAmounts(db *gorm.DB, orderID uint) error {
+	order := SaleOrder{}
+	if err := db.Where("order_id = ?", orderID).Find(&order.Lines).Error; err != nil {
+		return err
+	}
+	order.ComputeAmounts()
+	return db.Model(&SaleOrder{}).Where("id = ?", orderID).Updates(map[string]interface{}{
+		"amount_untaxed": order.AmountUntaxed,
+		"amount_tax":     order.AmountTax,
+		"amount_total":   order.AmountTotal,
+	}).Error
+}
+
+// SaleOrderLine is a product line of a sales order (like Odoo's sale.order.line)
+type SaleOrderLine struct {
+	BaseModel
+	OrderID   uint    `gorm:"column:order_id;not null;index" json:"order_id"`
+	Sequence  int     `gorm:"default:10" json:"sequence"`
+	Name      string  `gorm:"not null" json:"name"`
+	Quantity  float64 `gorm:"column:product_uom_qty;default:1" json:"product_uom_qty"`
+	PriceUnit float64 `gorm:"column:price_unit" json:"price_unit"`
+	Discount  float64 `gorm:"" json:"discount"`
+	TaxRate   float64 `gorm:"column:tax_rate" json:"tax_rate"`
+	// PriceSubtotal is stored for reporting; it is kept equal to Subtotal()
+	PriceSubtotal float64 `gorm:"column:price_subtotal" json:"price_subtotal"`
+}
+
+func (SaleOrderLine) TableName() string {
+	return "sale_order_line"
+}
+
+// Subtotal returns the line amount before taxes, after discount
+func (l SaleOrderLine) Subtotal() float64 {
+	return l.Quantity * l.PriceUnit * (1 - l.Discount/100)
+}
+
+// Tax returns the tax amount of the line
+func (l SaleOrderLine) Tax() float64 {
+	return l.Subtotal() * l.TaxRate / 100
+}
+
+// BeforeSave computes the stored subtotal
+func (l *SaleOrderLine) BeforeSave(tx *gorm.DB) error {
+	l.PriceSubtotal = l.Subtotal()
+	return nil
+}
+
+// AfterSave recomputes the totals of the order
+func (l *SaleOrderLine) AfterSave(tx *gorm.DB) error {
+	if l.OrderID == 0 {
+		return nil
+	}
+	return RecomputeSaleOrderAmounts(tx, l.OrderID)
+}
+
+// AfterDelete recomputes the totals of the order. Lines deleted by
+// condition without a loaded OrderID must be followed by an explicit
+// RecomputeSaleOrderAmounts.
+func (l *SaleOrderLine) AfterDelete(tx *gorm.DB) error {
+	if l.OrderID == 0 {
+		return nil
+	}
+	return RecomputeSaleOrderAmounts(tx, l.OrderID)
+}
+
+// LoadSaleOrders reads orders with their partner, lines and tags prefetched, in the order of ids
+func LoadSaleOrders(db *gorm.DB, ids []uint) ([]SaleOrder, error) {
+	var orders []SaleOrder
+	err := db.Preload("Partner").Preload("Partner.Country").
+		Preload("Lines", func(tx *gorm.DB) *gorm.DB { return tx.Order("sequence, id") }).
+		Where("id IN ?", ids).
+		Find(&orders).Error
+	if err != nil {
+		return nil, err
+	}
+
+	tags, err := LoadTags(db, "sale.order", ids)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[uint]SaleOrder, len(orders))
+	for _, order := range orders {
+		order.Tags = tags[order.ID]
+		byID[order.ID] = order
+	}
+	sorted := make([]SaleOrder, 0, len(orders))
+	for _, id := range ids {
+		if order, ok := byID[id]; ok {
+			sorted = append(sorted, order)
+		}
+	}
+	return sorted, nil
+}
@@ -0,0 +1,319 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"goodoo/fields"
+	"gorm.io/gorm"
+)
+
+// ErrFilterNotFound is returned for a filter that does not exist or that
+// the user may not see
+var ErrFilterNotFound = errors.New("filter not found")
+
+// SavedFilter is a list view a user saved for a model (like Odoo's
+// ir.filters): a domain, a sort and the columns shown. Shared filters are
+// visible to every user; only their owner edits them.
+type SavedFilter struct {
+	ID     uint   `gorm:"primaryKey;autoIncrement" json:"id"`
+	Name   string `gorm:"size:128;not null" json:"name"`
+	Model  string `gorm:"not null;index:idx_ir_filters_model" json:"model"`
+	UserID uint   `gorm:"column:user_id;not null;index:idx_ir_filters_model" json:"user_id"`
+	Shared bool   `gorm:"not null;default:false" json:"shared"`
+	// Domain is the JSON domain of the filter, see DomainValue
+	Domain string `gorm:"type:text;not null;default:'[]'" json:"-"`
+	Sort   string `gorm:"size:256" json:"sort"`
+	// Columns is the JSON array of the fields shown, see ColumnNames
+	Columns string `gorm:"type:text;not null;default:'[]'" json:"-"`
+	// IsDefault filters are applied to the lists of their owner asking for
+	// no domain; a user has at most one per model
+	IsDefault  bool      `gorm:"column:is_default;not null;default:false" json:"is_default"`
+	CreateDate time.Time `gorm:"column:create_date;autoCreateTime" json:"create_date"`
+	WriteDate  time.Time `gorm:"column:write_date;autoUpdateTime" json:"write_date"`
+}
+
+func (SavedFilter) TableName() string {
+	return "ir_filters"
+}
+
+// DomainValue decodes the domain of the filter
+func (f *SavedFilter) DomainValue() (Domain, error) {
+	var domain Domain
+	if strings.TrimSpace(f.Domain) == "" {
+		return domain, nil
+	}
+	if err := fields.DecodeJSON([]byte(f.Domain), &domain); err != nil {
+		return nil, fmt.Errorf("invalid domain: %w", err)
+	}
+	return domain, nil
+}
+
+// ColumnNames returns the fields the filter shows
+func (f *SavedFilter) ColumnNames() []string {
+	var names []string
+	json.Unmarshal([]byte(f.Columns), &names)
+	return names
+}
+
+// FilterView is a filter as the user may apply it: the parts naming
+// fields that no longer exist, or that the user may not read, are dropped
+// and listed in Warnings
+type FilterView struct {
+	Domain   Domain   `json:"domain"`
+	Sort     string   `json:"sort"`
+	Columns  []string `json:"columns"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// filterField reports whether a domain or a column of a filter may name a
+// field: a stored field of the model the user may read. Paths such as
+// partner_id.name are checked on their first field.
+func (m *ModelDefinition) filterField(env *Environment, name string) bool {
+	name, _, _ = strings.Cut(name, ".")
+	field, exists := m.Fields[name]
+	return exists && field.IsStored() && m.readableField(env, name)
+}
+
+// cleanDomain returns domain without the conditions on fields the filter
+// may not name, and those fields. A dropped operand of "|" or "&" leaves
+// the other one; "!" of a dropped operand is dropped too.
+func (m *ModelDefinition) cleanDomain(env *Environment, domain Domain) (Domain, []string, error) {
+	var dropped []string
+	pos := 0
+	var expression func() (Domain, error)
+	expression = func() (Domain, error) {
+		if pos >= len(domain) {
+			return nil, errors.New("invalid domain: missing operand")
+		}
+		term := domain[pos]
+		pos++
+		switch t := term.(type) {
+		case string:
+			switch t {
+			case DomainNot:
+				operand, err := expression()
+				if err != nil || operand == nil {
+					return nil, err
+				}
+				return append(Domain{DomainNot}, operand...), nil
+			case DomainAnd, DomainOr:
+				left, err := expression()
+				if err != nil {
+					return nil, err
+				}
+				right, err := expression()
+				if err != nil {
+					return nil, err
+				}
+				switch {
+				case left == nil:
+					return right, nil
+				case right == nil:
+					return left, nil
+				}
+				return append(append(Domain{t}, left...), right...), nil
+			}
+		case []interface{}:
+			return m.cleanCondition(env, t, &dropped)
+		case Domain:
+			return m.cleanCondition(env, t, &dropped)
+		}
+		return nil, fmt.Errorf("invalid domain condition: %v", term)
+	}
+
+	cleaned := Domain{}
+	for pos < len(domain) {
+		expr, err := expression()
+		if err != nil {
+			return nil, nil, err
+		}
+		cleaned = append(cleaned, expr...)
+	}
+	return cleaned, dropped, nil
+}
+
+// cleanCondition checks a (field, operator, value) leaf, returning it as a
+// one-term domain, or nil with its field added to dropped when the filter
+// may not name the field
+func (m *ModelDefinition) cleanCondition(env *Environment, leaf []interface{}, dropped *[]string) (Domain, error) {
+	if len(leaf) != 3 {
+		return nil, fmt.Errorf("invalid domain condition: %v", leaf)
+	}
+	operator, ok := leaf[1].(string)
+	if _, known := domainOperators[operator]; !ok || !(known || isHierarchyOperator(operator)) {
+		return nil, fmt.Errorf("invalid operator in domain: %v", leaf[1])
+	}
+	name, ok := leaf[0].(string)
+	if !ok {
+		return nil, &IdentifierError{Kind: "field", Name: fmt.Sprint(leaf[0])}
+	}
+	if !m.filterField(env, name) {
+		*dropped = append(*dropped, name)
+		return nil, nil
+	}
+	return Domain{leaf}, nil
+}
+
+// cleanSort returns the terms of a sort the user may sort on, and the
+// dropped ones
+func (m *ModelDefinition) cleanSort(env *Environment, sort string) (string, []string) {
+	var kept, dropped []string
+	for _, term := range strings.Split(sort, ",") {
+		if term = strings.TrimSpace(term); term == "" {
+			continue
+		}
+		if _, err := m.parseOrder(env, term); err != nil {
+			dropped = append(dropped, term)
+			continue
+		}
+		kept = append(kept, term)
+	}
+	return strings.Join(kept, ", "), dropped
+}
+
+// cleanColumns returns the columns the user may read, and the dropped ones
+func (m *ModelDefinition) cleanColumns(env *Environment, columns []string) ([]string, []string) {
+	kept := make([]string, 0, len(columns))
+	var dropped []string
+	for _, name := range columns {
+		if m.filterField(env, name) {
+			kept = append(kept, name)
+		} else {
+			dropped = append(dropped, name)
+		}
+	}
+	return kept, dropped
+}
+
+// ValidateFilter checks a filter before it is saved: its domain, sort and
+// columns must only name fields of the model the user may read. Unknown
+// fields are reported as a FieldNameError.
+func (m *ModelDefinition) ValidateFilter(env *Environment, domain Domain, sort string, columns []string) error {
+	_, droppedFields, err := m.cleanDomain(env, domain)
+	if err != nil {
+		return err
+	}
+	_, droppedColumns := m.cleanColumns(env, columns)
+	if invalid := append(droppedFields, droppedColumns...); len(invalid) > 0 {
+		return &FieldNameError{Model: m.Name, Reason: "unknown or unreadable fields", Fields: invalid}
+	}
+	if strings.TrimSpace(sort) != "" {
+		if _, err := m.parseOrder(env, sort); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FilterView returns the filter as the environment user may apply it,
+// dropping with a warning what names fields removed since it was saved
+func (m *ModelDefinition) FilterView(env *Environment, filter *SavedFilter) (*FilterView, error) {
+	domain, err := filter.DomainValue()
+	if err != nil {
+		return nil, err
+	}
+	view := &FilterView{}
+	var dropped []string
+	if view.Domain, dropped, err = m.cleanDomain(env, domain); err != nil {
+		return nil, err
+	}
+	for _, name := range dropped {
+		view.Warnings = append(view.Warnings, fmt.Sprintf("condition on %s dropped: the field no longer exists or cannot be read", name))
+	}
+	view.Sort, dropped = m.cleanSort(env, filter.Sort)
+	for _, term := range dropped {
+		view.Warnings = append(view.Warnings, fmt.Sprintf("sort %s dropped: the field no longer exists or cannot be sorted on", term))
+	}
+	view.Columns, dropped = m.cleanColumns(env, filter.ColumnNames())
+	for _, name := range dropped {
+		view.Warnings = append(view.Warnings, fmt.Sprintf("column %s dropped: the field no longer exists or cannot be read", name))
+	}
+	return view, nil
+}
+
+// visibleFilters restricts a query to the filters of a model the
+// environment user sees: theirs and the shared ones
+func visibleFilters(env *Environment, model string) *gorm.DB {
+	return env.db.Where("model = ? AND (user_id = ? OR shared)", model, env.UserID())
+}
+
+// ListFilters returns the filters of a model the environment user sees,
+// theirs first, by name
+func ListFilters(env *Environment, model string) ([]SavedFilter, error) {
+	var filters []SavedFilter
+	err := visibleFilters(env, model).
+		Order(gorm.Expr("user_id = ? DESC", env.UserID())).Order("name, id").
+		Find(&filters).Error
+	return filters, err
+}
+
+// GetFilter returns a filter of a model the environment user sees
+func GetFilter(env *Environment, model string, id uint) (*SavedFilter, error) {
+	var filter SavedFilter
+	err := visibleFilters(env, model).Where("id = ?", id).First(&filter).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrFilterNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &filter, nil
+}
+
+// DefaultFilter returns the default filter of the environment user for a
+// model, nil when there is none
+func DefaultFilter(env *Environment, model string) (*SavedFilter, error) {
+	var filters []SavedFilter
+	err := env.db.Where("model = ? AND user_id = ? AND is_default", model, env.UserID()).Limit(1).Find(&filters).Error
+	if err != nil || len(filters) == 0 {
+		return nil, err
+	}
+	return &filters[0], nil
+}
+
+// SaveFilter creates or updates a filter, clearing the other defaults of
+// its owner for the model when it is the default
+func SaveFilter(db *gorm.DB, filter *SavedFilter) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if filter.IsDefault {
+			err := tx.Model(&SavedFilter{}).
+				Where("model = ? AND user_id = ? AND is_default AND id <> ?", filter.Model, filter.UserID, filter.ID).
+				Update("is_default", false).Error
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Save(filter).Error
+	})
+}
+
+// FilterOwnerNames returns the names of the owners of filters, their login
+// when they have none
+func FilterOwnerNames(env *Environment, filters []SavedFilter) (map[uint]string, error) {
+	names := make(map[uint]string)
+	var ids []uint
+	for _, filter := range filters {
+		if _, seen := names[filter.UserID]; !seen {
+			names[filter.UserID] = ""
+			ids = append(ids, filter.UserID)
+		}
+	}
+	if len(ids) == 0 {
+		return names, nil
+	}
+	var users []User
+	if err := env.db.Select("id", "name", "login").Where("id IN ?", ids).Find(&users).Error; err != nil {
+		return nil, fmt.Errorf("failed to read the owners of the filters: %w", err)
+	}
+	for _, user := range users {
+		names[user.ID] = user.Name
+		if strings.TrimSpace(user.Name) == "" {
+			names[user.ID] = user.Login
+		}
+	}
+	return names, nil
+}
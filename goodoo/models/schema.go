@@ -0,0 +1,621 @@
+package models
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"goodoo/fields"
+	"gorm.io/gorm"
+)
+
+// IndexDefinition describes an index generated from a field's attributes
+type IndexDefinition struct {
+	Name   string `json:"name"`
+	Table  string `json:"table"`
+	Column string `json:"column"`
+	Type   string `json:"type"` // btree, btree_not_null, trigram
+	Unique bool   `json:"unique"`
+	// Expression indexes an SQL expression of the column instead of the
+	// column itself, such as the normalized keys of duplicate rules
+	Expression string `json:"expression,omitempty"`
+}
+
+// indexNameSuffixes are the suffixes of generated index names, used to tell them apart from manual ones
+var indexNameSuffixes = []string{"_index", "_unique", "_match"}
+
+// SQL returns the CREATE INDEX statement for the index
+func (idx IndexDefinition) SQL() string {
+	unique := ""
+	if idx.Unique {
+		unique = "UNIQUE "
+	}
+	column := idx.Column
+	if idx.Expression != "" {
+		column = "(" + idx.Expression + ")"
+	}
+
+	switch idx.Type {
+	case fields.IndexTrigram:
+		return fmt.Sprintf("CREATE %sINDEX IF NOT EXISTS %s ON %s USING gin (%s gin_trgm_ops)",
+			unique, idx.Name, idx.Table, column)
+	case fields.IndexBtreeNotNull:
+		return fmt.Sprintf("CREATE %sINDEX IF NOT EXISTS %s ON %s USING btree (%s) WHERE %s IS NOT NULL",
+			unique, idx.Name, idx.Table, column, idx.Column)
+	default:
+		return fmt.Sprintf("CREATE %sINDEX IF NOT EXISTS %s ON %s USING btree (%s)",
+			unique, idx.Name, idx.Table, column)
+	}
+}
+
+// matches reports whether an existing index definition (from pg_indexes) is equivalent
+func (idx IndexDefinition) matches(indexdef string) bool {
+	def := strings.ToLower(indexdef)
+	if strings.HasPrefix(def, "create unique index") != idx.Unique {
+		return false
+	}
+
+	switch idx.Type {
+	case fields.IndexTrigram:
+		return strings.Contains(def, "using gin") && strings.Contains(def, "gin_trgm_ops")
+	case fields.IndexBtreeNotNull:
+		return strings.Contains(def, "using btree") && strings.Contains(def, "is not null")
+	default:
+		return strings.Contains(def, "using btree") && !strings.Contains(def, " where ")
+	}
+}
+
+// GetIndexes returns the indexes declared by the model's stored fields, sorted by name
+func (m *ModelDefinition) GetIndexes() []IndexDefinition {
+	var indexes []IndexDefinition
+
+	for name, field := range m.GetStoredFields() {
+		attrs := field.GetAttributes()
+
+		if attrs.Unique {
+			indexes = append(indexes, IndexDefinition{
+				Name:   fmt.Sprintf("%s__%s_unique", m.TableName, name),
+				Table:  m.TableName,
+				Column: name,
+				Type:   fields.IndexBtree,
+				Unique: true,
+			})
+			// A unique btree already serves lookups
+			if attrs.IndexType() == fields.IndexBtree {
+				continue
+			}
+		}
+
+		if indexType := attrs.IndexType(); indexType != "" && name != "id" {
+			indexes = append(indexes, IndexDefinition{
+				Name:   fmt.Sprintf("%s__%s_index", m.TableName, name),
+				Table:  m.TableName,
+				Column: name,
+				Type:   indexType,
+			})
+		}
+	}
+
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i].Name < indexes[j].Name })
+	return indexes
+}
+
+// GetIndexSchema returns the CREATE INDEX statements for the model
+func (m *ModelDefinition) GetIndexSchema() []string {
+	if m.Abstract {
+		return nil
+	}
+
+	var statements []string
+	for _, idx := range m.GetIndexes() {
+		statements = append(statements, idx.SQL())
+	}
+	return statements
+}
+
+// ConcurrentIndexSQL returns the statement building a btree index on
+// columns of a table without blocking its writes
+func ConcurrentIndexSQL(table, name string, columns []string) (string, error) {
+	quotedName, err := quoteName("index", name)
+	if err != nil {
+		return "", err
+	}
+	quotedTable, err := quoteName("table", table)
+	if err != nil {
+		return "", err
+	}
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		if quoted[i], err = quoteName("column", column); err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("CREATE INDEX CONCURRENTLY IF NOT EXISTS %s ON %s USING btree (%s)",
+		quotedName, quotedTable, strings.Join(quoted, ", ")), nil
+}
+
+// CreateIndexConcurrently builds a btree index on columns of a table
+// without blocking its writes. It cannot run in a transaction; an index
+// left invalid by a failed build is dropped.
+func CreateIndexConcurrently(db *gorm.DB, table, name string, columns []string) (SchemaChange, error) {
+	change := SchemaChange{Kind: "create_index", Table: table, Name: name}
+	statement, err := ConcurrentIndexSQL(table, name, columns)
+	if err != nil {
+		return change, err
+	}
+	change.SQL = statement
+	if err := db.Exec(change.SQL).Error; err != nil {
+		change.Error = err.Error()
+		db.Exec("DROP INDEX CONCURRENTLY IF EXISTS " + QuoteIdentifier(name))
+		return change, err
+	}
+	change.Applied = true
+	return change, nil
+}
+
+// needsTrigram reports whether any index requires the pg_trgm extension
+func needsTrigram(indexes []IndexDefinition) bool {
+	for _, idx := range indexes {
+		if idx.Type == fields.IndexTrigram {
+			return true
+		}
+	}
+	return false
+}
+
+// SchemaChange is a single DDL step computed by SyncSchemas
+type SchemaChange struct {
+	Model       string `json:"model"`
+	Kind        string `json:"kind"` // create_table, add_column, alter_column, drop_not_null, drop_column, create_index, drop_index, add_foreign_key, drop_foreign_key, add_constraint, alter_constraint, comment_constraint, drop_constraint
+	Table       string `json:"table"`
+	Name        string `json:"name"`
+	SQL         string `json:"sql"`
+	Destructive bool   `json:"destructive"`
+	Applied     bool   `json:"applied"`
+	Error       string `json:"error,omitempty"`
+}
+
+// SchemaDiff is the result of comparing model definitions against the database
+type SchemaDiff struct {
+	Changes  []SchemaChange `json:"changes"`
+	Warnings []string       `json:"warnings,omitempty"`
+}
+
+// HasDestructive reports whether the diff contains destructive changes
+func (d *SchemaDiff) HasDestructive() bool {
+	for _, change := range d.Changes {
+		if change.Destructive {
+			return true
+		}
+	}
+	return false
+}
+
+// SyncOptions controls how SyncSchemas applies changes
+type SyncOptions struct {
+	DryRun bool // Only compute the diff
+	Force  bool // Apply destructive changes (type changes, drops)
+}
+
+// SyncSchemas brings the database schema in line with the registered model definitions.
+// Additive changes are always applied; destructive ones only with Force.
+func (r *FieldModelRegistry) SyncSchemas(db *gorm.DB, opts SyncOptions) (*SchemaDiff, error) {
+	diff := &SchemaDiff{}
+
+	all := r.GetAllModels()
+	names := make([]string, 0, len(all))
+	for name := range all {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// The duplicate rules of the database index their normalized keys
+	ruleIndexes, err := duplicateRuleIndexes(db, r)
+	if err != nil {
+		return diff, fmt.Errorf("failed to read the duplicate rules: %w", err)
+	}
+
+	trigramAvailable := true
+	for _, name := range names {
+		model := all[name]
+		if !model.AutoCreate || model.Abstract {
+			continue
+		}
+		indexes := append(model.GetIndexes(), ruleIndexes[name]...)
+
+		if needsTrigram(indexes) && trigramAvailable && !opts.DryRun {
+			if err := ensureTrigramExtension(db); err != nil {
+				trigramAvailable = false
+				diff.Warnings = append(diff.Warnings, fmt.Sprintf("pg_trgm unavailable, trigram indexes skipped: %v", err))
+				r.logger.Warning("pg_trgm extension unavailable: %v", err)
+			}
+		}
+
+		changes, err := model.schemaChanges(db, trigramAvailable, indexes)
+		if err != nil {
+			return diff, fmt.Errorf("failed to diff model %s: %w", name, err)
+		}
+		r.applySchemaChanges(db, opts, diff, changes)
+	}
+
+	// Foreign keys once every table exists, their comodel's included
+	refs := r.References()
+	for _, name := range names {
+		model := all[name]
+		if !model.AutoCreate || model.Abstract {
+			continue
+		}
+		changes, warnings, err := model.foreignKeyChanges(db, refs)
+		if err != nil {
+			return diff, fmt.Errorf("failed to diff foreign keys of %s: %w", name, err)
+		}
+		diff.Warnings = append(diff.Warnings, warnings...)
+		r.applySchemaChanges(db, opts, diff, changes)
+	}
+	changes, err := gormForeignKeyChanges(db)
+	if err != nil {
+		return diff, fmt.Errorf("failed to diff foreign keys of GORM models: %w", err)
+	}
+	r.applySchemaChanges(db, opts, diff, changes)
+
+	if diff.HasDestructive() && !opts.Force && !opts.DryRun {
+		r.logger.Warning("Destructive schema changes pending, re-run with force to apply")
+	}
+
+	return diff, nil
+}
+
+// applySchemaChanges runs the changes allowed by opts and adds them to diff
+func (r *FieldModelRegistry) applySchemaChanges(db *gorm.DB, opts SyncOptions, diff *SchemaDiff, changes []SchemaChange) {
+	for i := range changes {
+		change := &changes[i]
+		if opts.DryRun || (change.Destructive && !opts.Force) {
+			continue
+		}
+		if err := db.Exec(change.SQL).Error; err != nil {
+			change.Error = err.Error()
+			r.logger.Error("Schema change failed for %s: %s: %v", change.Model, change.SQL, err)
+			continue
+		}
+		change.Applied = true
+		r.logger.Info("Applied schema change on %s: %s", change.Table, change.SQL)
+	}
+	diff.Changes = append(diff.Changes, changes...)
+}
+
+// ensureTrigramExtension creates pg_trgm when permitted
+func ensureTrigramExtension(db *gorm.DB) error {
+	return db.Exec("CREATE EXTENSION IF NOT EXISTS pg_trgm").Error
+}
+
+// schemaChanges compares one model and its indexes against the live table
+func (m *ModelDefinition) schemaChanges(db *gorm.DB, trigramAvailable bool, indexes []IndexDefinition) ([]SchemaChange, error) {
+	var changes []SchemaChange
+
+	columns, err := existingColumns(db, m.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	created := len(columns) == 0
+	if created {
+		changes = append(changes, SchemaChange{
+			Model: m.Name, Kind: "create_table", Table: m.TableName, Name: m.TableName,
+			SQL: m.GetCreateSchema(),
+		})
+	} else {
+		stored := m.GetStoredFields()
+		fieldNames := make([]string, 0, len(stored))
+		for name := range stored {
+			fieldNames = append(fieldNames, name)
+		}
+		sort.Strings(fieldNames)
+
+		for _, name := range fieldNames {
+			pgType, _ := stored[name].GetColumnType()
+			current, exists := columns[name]
+			switch {
+			case !exists:
+				changes = append(changes, SchemaChange{
+					Model: m.Name, Kind: "add_column", Table: m.TableName, Name: name,
+					SQL: fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s", m.TableName, name, pgType),
+				})
+			case normalizePGType(current.Type) != normalizePGType(pgType):
+				changes = append(changes, SchemaChange{
+					Model: m.Name, Kind: "alter_column", Table: m.TableName, Name: name,
+					SQL: fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s TYPE %s USING %s::%s",
+						m.TableName, name, pgType, name, pgType),
+					Destructive: true,
+				})
+			}
+			// A field made nullable keeps NOT NULL on tables created before
+			if exists && current.NotNull && name != "id" && !hasNotNull(stored[name]) {
+				changes = append(changes, SchemaChange{
+					Model: m.Name, Kind: "drop_not_null", Table: m.TableName, Name: name,
+					SQL: fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s DROP NOT NULL", m.TableName, name),
+				})
+			}
+		}
+
+		var extra []string
+		for name := range columns {
+			if _, declared := stored[name]; !declared {
+				extra = append(extra, name)
+			}
+		}
+		sort.Strings(extra)
+		for _, name := range extra {
+			changes = append(changes, SchemaChange{
+				Model: m.Name, Kind: "drop_column", Table: m.TableName, Name: name,
+				SQL:         fmt.Sprintf("ALTER TABLE %s DROP COLUMN IF EXISTS %s", m.TableName, name),
+				Destructive: true,
+			})
+		}
+	}
+
+	existing, err := existingIndexes(db, m.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	declared := make(map[string]bool)
+	for _, idx := range indexes {
+		declared[idx.Name] = true
+		if idx.Type == fields.IndexTrigram && !trigramAvailable {
+			continue
+		}
+
+		indexdef, exists := existing[idx.Name]
+		switch {
+		case !exists:
+			changes = append(changes, SchemaChange{
+				Model: m.Name, Kind: "create_index", Table: m.TableName, Name: idx.Name, SQL: idx.SQL(),
+			})
+		case !idx.matches(indexdef):
+			// Index type changed: drop and recreate behind the force flag
+			changes = append(changes,
+				SchemaChange{
+					Model: m.Name, Kind: "drop_index", Table: m.TableName, Name: idx.Name,
+					SQL: fmt.Sprintf("DROP INDEX IF EXISTS %s", idx.Name), Destructive: true,
+				},
+				SchemaChange{
+					Model: m.Name, Kind: "create_index", Table: m.TableName, Name: idx.Name,
+					SQL: idx.SQL(), Destructive: true,
+				})
+		}
+	}
+
+	// Generated indexes whose field or duplicate rule no longer asks for one
+	var stale []string
+	for name := range existing {
+		if !declared[name] && isGeneratedIndexName(m.TableName, name) {
+			stale = append(stale, name)
+		}
+	}
+	sort.Strings(stale)
+	for _, name := range stale {
+		changes = append(changes, SchemaChange{
+			Model: m.Name, Kind: "drop_index", Table: m.TableName, Name: name,
+			SQL: fmt.Sprintf("DROP INDEX IF EXISTS %s", name), Destructive: true,
+		})
+	}
+
+	constraints, err := m.constraintChanges(db, created)
+	if err != nil {
+		return nil, err
+	}
+	return append(changes, constraints...), nil
+}
+
+// foreignKeyActions are the pg_constraint.confdeltype codes of the
+// ondelete actions
+var foreignKeyActions = map[string]string{
+	fields.OnDeleteRestrict: "r",
+	fields.OnDeleteCascade:  "c",
+	fields.OnDeleteSetNull:  "n",
+}
+
+// foreignKeyName names the foreign key generated for a relational field
+func foreignKeyName(table, column string) string {
+	return table + "__" + column + "_fkey"
+}
+
+// foreignKeySQL adds the foreign key of a reference
+func foreignKeySQL(ref Reference) string {
+	return fmt.Sprintf("ALTER TABLE %s ADD CONSTRAINT %s FOREIGN KEY (%s) REFERENCES %s(id) ON DELETE %s",
+		ref.Table, ref.Constraint, ref.Column, ref.ParentTable, strings.ToUpper(ref.OnDelete))
+}
+
+// foreignKeyChange adds the foreign key of a reference, or replaces it when
+// its ondelete action changed
+func foreignKeyChange(ref Reference, existing map[string]string) []SchemaChange {
+	model := ref.ModelName()
+	add := SchemaChange{Model: model, Kind: "add_foreign_key", Table: ref.Table, Name: ref.Constraint, SQL: foreignKeySQL(ref)}
+	action, exists := existing[ref.Constraint]
+	switch {
+	case !exists:
+		return []SchemaChange{add}
+	case action != foreignKeyActions[ref.OnDelete]:
+		drop := SchemaChange{
+			Model: model, Kind: "drop_foreign_key", Table: ref.Table, Name: ref.Constraint,
+			SQL: fmt.Sprintf("ALTER TABLE %s DROP CONSTRAINT IF EXISTS %s", ref.Table, ref.Constraint),
+		}
+		return []SchemaChange{drop, add}
+	}
+	return nil
+}
+
+// foreignKeyChanges compares the foreign keys of the model's references
+// among refs against the live table, dropping those generated for fields
+// no longer declaring ondelete; a set null on a required field is
+// reported, as deleting the comodel's records would fail
+func (m *ModelDefinition) foreignKeyChanges(db *gorm.DB, refs []Reference) ([]SchemaChange, []string, error) {
+	existing, err := existingForeignKeys(db, m.TableName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var changes []SchemaChange
+	var warnings []string
+	declared := make(map[string]bool)
+	for _, ref := range refs {
+		if ref.Model != m.Name {
+			continue
+		}
+		declared[ref.Constraint] = true
+		if ref.OnDelete == fields.OnDeleteSetNull && m.Fields[ref.Column].GetAttributes().Required {
+			warnings = append(warnings, fmt.Sprintf("%s.%s is required but set null on delete", m.Name, ref.Column))
+		}
+		changes = append(changes, foreignKeyChange(ref, existing)...)
+	}
+
+	var stale []string
+	for name := range existing {
+		if !declared[name] && strings.HasPrefix(name, m.TableName+"__") && strings.HasSuffix(name, "_fkey") {
+			stale = append(stale, name)
+		}
+	}
+	sort.Strings(stale)
+	for _, name := range stale {
+		changes = append(changes, SchemaChange{
+			Model: m.Name, Kind: "drop_foreign_key", Table: m.TableName, Name: name,
+			SQL: fmt.Sprintf("ALTER TABLE %s DROP CONSTRAINT IF EXISTS %s", m.TableName, name),
+		})
+	}
+	return changes, warnings, nil
+}
+
+// gormForeignKeyChanges replaces the foreign keys AutoMigrate created
+// before their GORM relation declared an ondelete action, AutoMigrate
+// leaving existing constraints alone
+func gormForeignKeyChanges(db *gorm.DB) ([]SchemaChange, error) {
+	var changes []SchemaChange
+	for _, ref := range GORMReferences() {
+		existing, err := existingForeignKeys(db, ref.Table)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, foreignKeyChange(ref, existing)...)
+	}
+	return changes, nil
+}
+
+// existingForeignKeys returns constraint name -> confdeltype for the
+// foreign keys of a table
+func existingForeignKeys(db *gorm.DB, table string) (map[string]string, error) {
+	var rows []struct {
+		Name     string
+		OnDelete string
+	}
+	query := `
+		SELECT con.conname AS name, con.confdeltype::text AS on_delete
+		FROM pg_constraint con
+		JOIN pg_class c ON c.oid = con.conrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE con.contype = 'f' AND c.relname = ? AND n.nspname = current_schema()`
+	if err := db.Raw(query, table).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]string, len(rows))
+	for _, row := range rows {
+		keys[row.Name] = row.OnDelete
+	}
+	return keys, nil
+}
+
+// existingColumn is a live column's formatted type and nullability
+type existingColumn struct {
+	Type    string
+	NotNull bool
+}
+
+// existingColumns returns column name -> column for a table (empty when missing)
+func existingColumns(db *gorm.DB, table string) (map[string]existingColumn, error) {
+	var rows []struct {
+		Name    string
+		Type    string
+		NotNull bool
+	}
+	query := `
+		SELECT a.attname AS name, format_type(a.atttypid, a.atttypmod) AS type, a.attnotnull AS not_null
+		FROM pg_attribute a
+		JOIN pg_class c ON c.oid = a.attrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relname = ? AND n.nspname = current_schema()
+		  AND a.attnum > 0 AND NOT a.attisdropped`
+	if err := db.Raw(query, table).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	columns := make(map[string]existingColumn, len(rows))
+	for _, row := range rows {
+		columns[row.Name] = existingColumn{Type: row.Type, NotNull: row.NotNull}
+	}
+	return columns, nil
+}
+
+// hasNotNull reports whether a field declares its column NOT NULL
+func hasNotNull(field fields.Field) bool {
+	for _, constraint := range field.GetSQLConstraints() {
+		if constraint == "NOT NULL" {
+			return true
+		}
+	}
+	return false
+}
+
+// existingIndexes returns index name -> definition for a table
+func existingIndexes(db *gorm.DB, table string) (map[string]string, error) {
+	var rows []struct {
+		Indexname string
+		Indexdef  string
+	}
+	query := `SELECT indexname, indexdef FROM pg_indexes WHERE tablename = ? AND schemaname = current_schema()`
+	if err := db.Raw(query, table).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	indexes := make(map[string]string, len(rows))
+	for _, row := range rows {
+		indexes[row.Indexname] = row.Indexdef
+	}
+	return indexes, nil
+}
+
+// isGeneratedIndexName reports whether an index was named by GetIndexes
+func isGeneratedIndexName(table, name string) bool {
+	if !strings.HasPrefix(name, table+"__") {
+		return false
+	}
+	for _, suffix := range indexNameSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+var varcharPattern = regexp.MustCompile(`^varchar\((\d+)\)$`)
+
+// normalizePGType maps declared column types to the spelling returned by format_type
+func normalizePGType(pgType string) string {
+	t := strings.ToLower(strings.TrimSpace(pgType))
+	if m := varcharPattern.FindStringSubmatch(t); m != nil {
+		return "character varying(" + m[1] + ")"
+	}
+	switch t {
+	case "varchar":
+		return "character varying"
+	case "timestamp":
+		return "timestamp without time zone"
+	case "int", "int4", "serial":
+		return "integer"
+	case "int8", "bigserial":
+		return "bigint"
+	case "bool":
+		return "boolean"
+	}
+	return t
+}
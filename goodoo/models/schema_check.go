@@ -0,0 +1,263 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"goodoo/capability"
+	"goodoo/logging"
+	"gorm.io/gorm"
+)
+
+// Schema compatibility: the columns the field-defined models of a database
+// expect, compared with its catalog. A missing optional column makes its
+// field unavailable, left out of reads and writes, instead of failing every
+// request on the model with "column does not exist".
+
+// SchemaSeverity classifies a difference between the models and the
+// database
+type SchemaSeverity string
+
+const (
+	// SchemaFatal differences break the model: a missing table, or a
+	// missing column of the id or a required field
+	SchemaFatal SchemaSeverity = "fatal"
+	// SchemaDegraded differences make a field unavailable: a missing
+	// column of an optional field
+	SchemaDegraded SchemaSeverity = "degraded"
+	// SchemaInfo differences do not affect the requests: extra columns and
+	// column types other than declared
+	SchemaInfo SchemaSeverity = "info"
+)
+
+// SchemaOK is the status of a database whose schema has no fatal nor
+// degraded difference
+const SchemaOK = "ok"
+
+// SchemaIssue is a difference between a model and its table; Kind is
+// missing_table, missing_column, type_mismatch or extra_column
+type SchemaIssue struct {
+	Severity SchemaSeverity `json:"severity"`
+	Kind     string         `json:"kind"`
+	Model    string         `json:"model"`
+	Table    string         `json:"table"`
+	Column   string         `json:"column,omitempty"`
+	Detail   string         `json:"detail,omitempty"`
+}
+
+// SchemaReport is the outcome of the schema check of a database: its
+// status (ok, degraded or fatal), the differences found and the fields
+// made unavailable, by model
+type SchemaReport struct {
+	Database    string              `json:"database"`
+	Status      string              `json:"status"`
+	CheckedAt   time.Time           `json:"checked_at"`
+	Issues      []SchemaIssue       `json:"issues"`
+	Unavailable map[string][]string `json:"unavailable,omitempty"`
+}
+
+var (
+	schemaReports = make(map[string]*SchemaReport)
+	// unavailableFields are the fields without column, by database and model
+	unavailableFields = make(map[string]map[string]map[string]bool)
+	schemaMutex       sync.RWMutex
+	schemaLogger      = logging.GetLogger("goodoo.models.schema")
+)
+
+// SchemaCapability names the capability reporting the schema check of a
+// database
+func SchemaCapability(dbName string) string {
+	return "schema." + dbName
+}
+
+// CheckSchema compares the models of a registry with the tables of a
+// database in one catalog query, caches the report, makes the fields
+// whose optional column is missing unavailable, and reports the outcome
+// as the schema capability of the database. It runs after each schema
+// sync and definition import.
+func CheckSchema(dbName string, db *gorm.DB, registry *FieldModelRegistry) (*SchemaReport, error) {
+	all := registry.GetAllModels()
+	names := make([]string, 0, len(all))
+	tables := make([]string, 0, len(all))
+	for name, model := range all {
+		if !model.AutoCreate || model.Abstract {
+			continue
+		}
+		names = append(names, name)
+		tables = append(tables, model.TableName)
+	}
+	sort.Strings(names)
+
+	var rows []struct {
+		TableName string
+		Name      string
+		Type      string
+	}
+	if len(tables) > 0 {
+		query := `
+			SELECT c.relname AS table_name, a.attname AS name, format_type(a.atttypid, a.atttypmod) AS type
+			FROM pg_attribute a
+			JOIN pg_class c ON c.oid = a.attrelid
+			JOIN pg_namespace n ON n.oid = c.relnamespace
+			WHERE c.relname IN ? AND c.relkind IN ('r', 'p') AND n.nspname = current_schema()
+			  AND a.attnum > 0 AND NOT a.attisdropped`
+		if err := db.Raw(query, tables).Scan(&rows).Error; err != nil {
+			return nil, err
+		}
+	}
+	columns := make(map[string]map[string]string)
+	for _, row := range rows {
+		if columns[row.TableName] == nil {
+			columns[row.TableName] = make(map[string]string)
+		}
+		columns[row.TableName][row.Name] = row.Type
+	}
+
+	report := &SchemaReport{Database: dbName, Status: SchemaOK, CheckedAt: time.Now().UTC(), Issues: []SchemaIssue{}}
+	unavailable := make(map[string]map[string]bool)
+	for _, name := range names {
+		model := all[name]
+		issues, missing := model.schemaIssues(columns[model.TableName])
+		report.Issues = append(report.Issues, issues...)
+		if len(missing) > 0 {
+			unavailable[name] = missing
+		}
+	}
+	if len(unavailable) > 0 {
+		report.Unavailable = make(map[string][]string, len(unavailable))
+	}
+	for model, missing := range unavailable {
+		for field := range missing {
+			report.Unavailable[model] = append(report.Unavailable[model], field)
+		}
+		sort.Strings(report.Unavailable[model])
+	}
+
+	var fatal, degraded []string
+	for _, issue := range report.Issues {
+		switch issue.Severity {
+		case SchemaFatal:
+			missing := issue.Table
+			if issue.Column != "" {
+				missing += "." + issue.Column
+			}
+			fatal = append(fatal, missing)
+			schemaLogger.Error("Schema of %s: %s %s, model %s is unusable", dbName, issue.Kind, missing, issue.Model)
+		case SchemaDegraded:
+			degraded = append(degraded, issue.Model+"."+issue.Column)
+			schemaLogger.Warning("Schema of %s: column %s.%s is missing, field %s.%s is excluded from reads and writes",
+				dbName, issue.Table, issue.Column, issue.Model, issue.Column)
+		}
+	}
+
+	schemaMutex.Lock()
+	schemaReports[dbName] = report
+	unavailableFields[dbName] = unavailable
+	schemaMutex.Unlock()
+
+	switch {
+	case len(fatal) > 0:
+		report.Status = string(SchemaFatal)
+		capability.Disable(SchemaCapability(dbName), fmt.Sprintf("%d table(s) or required column(s) missing, run the migrations: %s",
+			len(fatal), strings.Join(fatal, ", ")))
+	case len(degraded) > 0:
+		report.Status = string(SchemaDegraded)
+		capability.Degrade(SchemaCapability(dbName), fmt.Sprintf("%d optional column(s) missing, their fields are unavailable: %s",
+			len(degraded), strings.Join(degraded, ", ")))
+	default:
+		capability.Enable(SchemaCapability(dbName), fmt.Sprintf("%d model(s) match the database", len(names)))
+	}
+	return report, nil
+}
+
+// schemaIssues compares a model with the columns of its table, none when
+// it is missing, and returns the differences and the fields to make
+// unavailable
+func (m *ModelDefinition) schemaIssues(columns map[string]string) ([]SchemaIssue, map[string]bool) {
+	if len(columns) == 0 {
+		return []SchemaIssue{{Severity: SchemaFatal, Kind: "missing_table", Model: m.Name, Table: m.TableName}}, nil
+	}
+
+	var issues []SchemaIssue
+	missing := make(map[string]bool)
+	stored := m.GetStoredFields()
+	fieldNames := make([]string, 0, len(stored))
+	for name := range stored {
+		fieldNames = append(fieldNames, name)
+	}
+	sort.Strings(fieldNames)
+	for _, name := range fieldNames {
+		field := stored[name]
+		pgType, _ := field.GetColumnType()
+		current, exists := columns[name]
+		switch {
+		case !exists && (name == "id" || field.IsRequired()):
+			issues = append(issues, SchemaIssue{Severity: SchemaFatal, Kind: "missing_column", Model: m.Name, Table: m.TableName, Column: name,
+				Detail: "required field"})
+		case !exists:
+			missing[name] = true
+			issues = append(issues, SchemaIssue{Severity: SchemaDegraded, Kind: "missing_column", Model: m.Name, Table: m.TableName, Column: name,
+				Detail: "field unavailable"})
+		case normalizePGType(current) != normalizePGType(pgType):
+			issues = append(issues, SchemaIssue{Severity: SchemaInfo, Kind: "type_mismatch", Model: m.Name, Table: m.TableName, Column: name,
+				Detail: fmt.Sprintf("declared %s, column is %s", pgType, current)})
+		}
+	}
+
+	var extra []string
+	for name := range columns {
+		if _, declared := stored[name]; !declared {
+			extra = append(extra, name)
+		}
+	}
+	sort.Strings(extra)
+	for _, name := range extra {
+		issues = append(issues, SchemaIssue{Severity: SchemaInfo, Kind: "extra_column", Model: m.Name, Table: m.TableName, Column: name})
+	}
+	return issues, missing
+}
+
+// SchemaReportOf returns the last schema report of a database
+func SchemaReportOf(dbName string) (*SchemaReport, bool) {
+	schemaMutex.RLock()
+	defer schemaMutex.RUnlock()
+	report, exists := schemaReports[dbName]
+	return report, exists
+}
+
+// SchemaStatuses returns the status of the last schema check of each
+// database checked
+func SchemaStatuses() map[string]string {
+	schemaMutex.RLock()
+	defer schemaMutex.RUnlock()
+	statuses := make(map[string]string, len(schemaReports))
+	for dbName, report := range schemaReports {
+		statuses[dbName] = report.Status
+	}
+	return statuses
+}
+
+// unavailableField reports whether the column of a field is missing in
+// the database of the environment
+func (m *ModelDefinition) unavailableField(env *Environment, name string) bool {
+	if env == nil || env.dbName == "" {
+		return false
+	}
+	schemaMutex.RLock()
+	defer schemaMutex.RUnlock()
+	return unavailableFields[env.dbName][m.Name][name]
+}
+
+// dropUnavailable leaves the values of the unavailable fields out of the
+// columns written
+func (m *ModelDefinition) dropUnavailable(env *Environment, columns map[string]interface{}) {
+	for name := range columns {
+		if m.unavailableField(env, name) {
+			delete(columns, name)
+			schemaLogger.Warning("Field %s.%s is unavailable in %s (missing column), its value is not written", m.Name, name, env.dbName)
+		}
+	}
+}
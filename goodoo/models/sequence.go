@@ -0,0 +1,51 @@
+package models
+
+import (
+	"fmt"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// IrSequence generates record names such as S00042 (like Odoo's ir.sequence)
+type IrSequence struct {
+	BaseModel
+	Code            string `gorm:"uniqueIndex;not null" json:"code"`
+	Name            string `gorm:"not null" json:"name"`
+	Prefix          string `gorm:"" json:"prefix"`
+	Padding         int    `gorm:"default:5" json:"padding"`
+	NumberNext      int    `gorm:"column:number_next;default:1" json:"number_next"`
+	NumberIncrement int    `gorm:"column:number_increment;default:1" json:"number_increment"`
+}
+
+func (IrSequence) TableName() string {
+	return "ir_sequence"
+}
+
+// EnsureSequence creates a sequence unless one with the same code exists
+func EnsureSequence(db *gorm.DB, sequence IrSequence) error {
+	if sequence.NumberNext == 0 {
+		sequence.NumberNext = 1
+	}
+	if sequence.NumberIncrement == 0 {
+		sequence.NumberIncrement = 1
+	}
+	return db.Clauses(clause.OnConflict{Columns: []clause.Column{{Name: "code"}}, DoNothing: true}).
+		Create(&sequence).Error
+}
+
+// NextByCode returns the next name of a sequence. The row is locked until
+// the transaction ends, so concurrent callers never get the same number.
+func NextByCode(db *gorm.DB, code string) (string, error) {
+	var sequence IrSequence
+	if err := db.Clauses(clause.Locking{Strength: "UPDATE"}).Where("code = ?", code).First(&sequence).Error; err != nil {
+		return "", fmt.Errorf("sequence %s: %w", code, err)
+	}
+
+	number := sequence.NumberNext
+	err := db.Model(&sequence).Update("number_next", gorm.Expr("number_next + ?", sequence.NumberIncrement)).Error
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s%0*d", sequence.Prefix, sequence.Padding, number), nil
+}
@@ -0,0 +1,146 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ServiceAccount is the automation profile of a service user (a user with
+// IsService set), for CI pipelines and integration scripts: the user cannot
+// log in and authenticates with service keys only (see ServiceKey). It
+// holds an explicit permission set in place of groups, an optional
+// allow-list of models, an expiry after which its keys stop working, and a
+// rate limit and daily quota of its own.
+type ServiceAccount struct {
+	BaseModel
+	UserID      uint   `gorm:"column:user_id;not null;uniqueIndex" json:"user_id"`
+	User        User   `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE" json:"-"`
+	Description string `gorm:"type:text" json:"description"`
+	// Permissions are the permissions granted to the account (see
+	// RouteSpec.Permission); it is never an administrator
+	Permissions StringList `gorm:"type:jsonb;not null;default:'[]'" json:"permissions"`
+	// Models restricts the model routes to these models; all of them when
+	// empty
+	Models    StringList `gorm:"type:jsonb;not null;default:'[]'" json:"models"`
+	ExpiresAt *time.Time `gorm:"column:expires_at" json:"expires_at,omitempty"`
+	// RateLimit is the requests allowed per minute, in bursts of up to
+	// RateBurst, replacing the rate limit classes of the routes; 0 keeps
+	// those
+	RateLimit int `gorm:"column:rate_limit;not null;default:0" json:"rate_limit"`
+	RateBurst int `gorm:"column:rate_burst;not null;default:0" json:"rate_burst"`
+	// DailyQuota is the requests allowed per UTC day, unlimited when 0;
+	// QuotaDay and QuotaUsed count those of the current day
+	DailyQuota int        `gorm:"column:daily_quota;not null;default:0" json:"daily_quota"`
+	QuotaDay   *time.Time `gorm:"column:quota_day;type:date" json:"-"`
+	QuotaUsed  int        `gorm:"column:quota_used;not null;default:0" json:"quota_used"`
+}
+
+func (ServiceAccount) TableName() string {
+	return "service_account"
+}
+
+// StringList is a list of strings stored as a JSON array
+type StringList []string
+
+// Value encodes the list as JSON
+func (l StringList) Value() (driver.Value, error) {
+	if l == nil {
+		l = StringList{}
+	}
+	data, err := json.Marshal(l)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// Scan decodes the JSON list
+func (l *StringList) Scan(src interface{}) error {
+	switch s := src.(type) {
+	case nil:
+		*l = nil
+		return nil
+	case string:
+		return json.Unmarshal([]byte(s), l)
+	case []byte:
+		return json.Unmarshal(s, l)
+	default:
+		return fmt.Errorf("cannot scan %T into StringList", src)
+	}
+}
+
+// ErrServiceAccountExpired is returned for the credentials of an expired
+// service account
+var ErrServiceAccountExpired = errors.New("service account expired")
+
+// Expired reports whether the account expired at now
+func (a *ServiceAccount) Expired(now time.Time) bool {
+	return a.ExpiresAt != nil && !now.Before(*a.ExpiresAt)
+}
+
+// AllowsModel reports whether the account may use a model
+func (a *ServiceAccount) AllowsModel(model string) bool {
+	if len(a.Models) == 0 {
+		return true
+	}
+	for _, allowed := range a.Models {
+		if allowed == model {
+			return true
+		}
+	}
+	return false
+}
+
+// ConsumeQuota counts a request against the daily quota of the account and
+// reports whether it was within the quota. The count is kept in the
+// database so that every instance shares it.
+func (a *ServiceAccount) ConsumeQuota(db *gorm.DB, now time.Time) (bool, error) {
+	if a.DailyQuota <= 0 {
+		return true, nil
+	}
+	day := now.UTC().Format("2006-01-02")
+	result := db.Exec(`UPDATE service_account
+		SET quota_used = CASE WHEN quota_day = ?::date THEN quota_used + 1 ELSE 1 END, quota_day = ?::date
+		WHERE id = ? AND (quota_day IS DISTINCT FROM ?::date OR quota_used < daily_quota)`,
+		day, day, a.ID, day)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// FindServiceAccount returns the account of a service user
+func FindServiceAccount(db *gorm.DB, uid uint) (*ServiceAccount, error) {
+	var account ServiceAccount
+	if err := db.Where("user_id = ?", uid).First(&account).Error; err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+// DeleteServiceAccount revokes the service keys of an account and removes
+// it in one transaction; its user is archived rather than deleted so that
+// the records it stamped still name it
+func DeleteServiceAccount(db *gorm.DB, account *ServiceAccount) (int64, error) {
+	var revoked int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Unscoped().Where("user_id = ?", account.UserID).Delete(&ServiceKey{})
+		if result.Error != nil {
+			return result.Error
+		}
+		revoked = result.RowsAffected
+		if err := ReleaseQuota(tx, QuotaServiceKey, account.UserID, int(revoked)); err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Delete(account).Error; err != nil {
+			return err
+		}
+		return tx.Model(&User{}).Where("id = ?", account.UserID).Update("active", false).Error
+	})
+	return revoked, err
+}
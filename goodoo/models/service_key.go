@@ -0,0 +1,57 @@
+package models
+
+import (
+	"time"
+
+	"goodoo/crypto"
+)
+
+// ServiceKey is a shared secret another service signs its requests with
+// (see package svcauth); signed requests run as the service user of the
+// key. Rotating a key keeps the previous secret valid until
+// PreviousExpiresAt so callers can switch without downtime.
+type ServiceKey struct {
+	BaseModel
+	// KeyID is sent by callers in the key id header
+	KeyID string `gorm:"column:key_id;not null;uniqueIndex" json:"key_id"`
+	Name  string `gorm:"not null" json:"name"`
+	// Secret and PreviousSecret are encrypted at rest
+	Secret            crypto.EncryptedString `gorm:"not null" json:"-"`
+	PreviousSecret    crypto.EncryptedString `gorm:"column:previous_secret" json:"-"`
+	PreviousExpiresAt *time.Time             `gorm:"column:previous_expires_at" json:"previous_expires_at,omitempty"`
+	// UserID is the service user signed requests run as
+	UserID     uint       `gorm:"column:user_id;not null" json:"user_id"`
+	Active     bool       `gorm:"default:true;index" json:"active"`
+	LastUsedAt *time.Time `gorm:"column:last_used_at" json:"last_used_at,omitempty"`
+}
+
+func (ServiceKey) TableName() string {
+	return "service_key"
+}
+
+func init() {
+	crypto.RegisterColumn("service_key", "secret", false)
+	crypto.RegisterColumn("service_key", "previous_secret", false)
+}
+
+// Secrets returns the secrets accepted at now: the current one, and the
+// previous one during the grace period of a rotation
+func (k *ServiceKey) Secrets(now time.Time) []string {
+	secrets := []string{string(k.Secret)}
+	if k.PreviousSecret != "" && k.PreviousExpiresAt != nil && now.Before(*k.PreviousExpiresAt) {
+		secrets = append(secrets, string(k.PreviousSecret))
+	}
+	return secrets
+}
+
+// Rotate replaces the secret, keeping the current one valid for grace;
+// a zero grace revokes it at once
+func (k *ServiceKey) Rotate(secret string, grace time.Duration, now time.Time) {
+	if grace > 0 {
+		expires := now.Add(grace)
+		k.PreviousSecret, k.PreviousExpiresAt = k.Secret, &expires
+	} else {
+		k.PreviousSecret, k.PreviousExpiresAt = "", nil
+	}
+	k.Secret = crypto.EncryptedString(secret)
+}
@@ -0,0 +1,242 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// Share link errors
+var (
+	ErrShareLinkNotFound = errors.New("share link not found")
+	ErrShareLinkExpired  = errors.New("share link expired")
+	ErrShareLinkRevoked  = errors.New("share link revoked")
+)
+
+// ShareLink gives read-only access to some fields of a record to anyone
+// holding its token, optionally with a password, without an account
+type ShareLink struct {
+	ID    uint   `gorm:"primaryKey;autoIncrement" json:"id"`
+	Model string `gorm:"not null;index:idx_share_link_record" json:"model"`
+	ResID uint   `gorm:"column:res_id;not null;index:idx_share_link_record" json:"res_id"`
+	// TokenHash is the SHA-256 of the token; the token itself is only
+	// returned when the link is created
+	TokenHash    string `gorm:"column:token_hash;not null;uniqueIndex" json:"-"`
+	PasswordHash string `gorm:"column:password_hash" json:"-"`
+	// Fields is the JSON array of the fields shown, see AllowedFields
+	Fields         string     `gorm:"type:text;not null" json:"-"`
+	ExpiresAt      *time.Time `gorm:"column:expires_at" json:"expires_at,omitempty"`
+	RevokedAt      *time.Time `gorm:"column:revoked_at" json:"revoked_at,omitempty"`
+	CreatedBy      uint       `gorm:"column:created_by;not null;index" json:"created_by"`
+	AccessCount    int        `gorm:"column:access_count;not null;default:0" json:"access_count"`
+	LastAccessDate *time.Time `gorm:"column:last_access_date" json:"last_access_date,omitempty"`
+	CreateDate     time.Time  `gorm:"column:create_date;autoCreateTime" json:"create_date"`
+}
+
+func (ShareLink) TableName() string {
+	return "share_link"
+}
+
+// hashShareToken returns the stored form of a share token
+func hashShareToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return fmt.Sprintf("%x", sum)
+}
+
+// AllowedFields returns the fields the link shows
+func (l *ShareLink) AllowedFields() []string {
+	var names []string
+	json.Unmarshal([]byte(l.Fields), &names)
+	return names
+}
+
+// HasPassword reports whether the link asks for a password
+func (l *ShareLink) HasPassword() bool {
+	return l.PasswordHash != ""
+}
+
+// CheckPassword reports whether password opens the link
+func (l *ShareLink) CheckPassword(password string) bool {
+	if !l.HasPassword() {
+		return true
+	}
+	return bcrypt.CompareHashAndPassword([]byte(l.PasswordHash), []byte(password)) == nil
+}
+
+// Usable returns ErrShareLinkRevoked or ErrShareLinkExpired when the link
+// may no longer be opened
+func (l *ShareLink) Usable(now time.Time) error {
+	if l.RevokedAt != nil {
+		return ErrShareLinkRevoked
+	}
+	if l.ExpiresAt != nil && !now.Before(*l.ExpiresAt) {
+		return ErrShareLinkExpired
+	}
+	return nil
+}
+
+// ValidateShareFields checks that fields may be shown by a link to a
+// record of model: stored fields of the model, none of them restricted
+// to groups
+func ValidateShareFields(model *ModelDefinition, names []string) error {
+	if len(names) == 0 {
+		return errors.New("at least one field must be shared")
+	}
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		field, exists := model.Fields[name]
+		if !exists || !field.IsStored() {
+			return fmt.Errorf("field '%s' does not exist on %s", name, model.Name)
+		}
+		if len(field.GetAttributes().Groups) > 0 {
+			return fmt.Errorf("field '%s' is restricted to groups and cannot be shared", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("field '%s' is listed twice", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// ShareLinkOptions are the settings of a new share link
+type ShareLinkOptions struct {
+	Fields []string
+	// Password, when set, must be entered to open the link
+	Password  string
+	ExpiresAt *time.Time
+}
+
+// CreateShareLink shares fields of a record the environment user can read,
+// returning the link and its token, which is not stored. Open links count
+// against the quota of their creator (see QuotaShareLink).
+func CreateShareLink(env *Environment, model *ModelDefinition, id uint, opts ShareLinkOptions) (*ShareLink, string, error) {
+	if err := ValidateShareFields(model, opts.Fields); err != nil {
+		return nil, "", err
+	}
+	if opts.ExpiresAt != nil && !opts.ExpiresAt.After(time.Now()) {
+		return nil, "", errors.New("expiry must be in the future")
+	}
+	records, err := model.Read(env, []uint{id}, []string{"id"})
+	if err != nil {
+		return nil, "", err
+	}
+	if len(records) == 0 {
+		return nil, "", gorm.ErrRecordNotFound
+	}
+
+	encoded, err := json.Marshal(opts.Fields)
+	if err != nil {
+		return nil, "", err
+	}
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+
+	link := &ShareLink{
+		Model:     model.Name,
+		ResID:     id,
+		TokenHash: hashShareToken(token),
+		Fields:    string(encoded),
+		ExpiresAt: opts.ExpiresAt,
+		CreatedBy: env.UserID(),
+	}
+	if opts.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(opts.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, "", err
+		}
+		link.PasswordHash = string(hash)
+	}
+
+	err = env.GetDB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(link).Error; err != nil {
+			return err
+		}
+		if err := ReserveQuota(tx, env.GetDBName(), QuotaShareLink, link.CreatedBy); err != nil {
+			return err
+		}
+		return LogActivity(tx, env.UserID(), Activity{
+			Type:   ActivityShareCreated,
+			Model:  model.Name,
+			ResID:  id,
+			Params: map[string]interface{}{"link_id": link.ID, "protected": link.HasPassword()},
+		})
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return link, token, nil
+}
+
+// FindShareLink returns the link of a token, revoked and expired ones
+// included, or ErrShareLinkNotFound
+func FindShareLink(db *gorm.DB, token string) (*ShareLink, error) {
+	if token == "" {
+		return nil, ErrShareLinkNotFound
+	}
+	var link ShareLink
+	err := db.Where("token_hash = ?", hashShareToken(token)).First(&link).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrShareLinkNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
+
+// RecordAccess counts an opening of the link and logs it as uid, the
+// public user for anonymous visitors, with the address of the visitor
+func (l *ShareLink) RecordAccess(db *gorm.DB, uid uint, ip string) error {
+	now := time.Now()
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(l).Updates(map[string]interface{}{
+			"access_count":     gorm.Expr("access_count + 1"),
+			"last_access_date": now,
+		}).Error
+		if err != nil {
+			return err
+		}
+		l.AccessCount++
+		l.LastAccessDate = &now
+		return LogActivity(tx, uid, Activity{
+			Type:   ActivityShareAccessed,
+			Model:  l.Model,
+			ResID:  l.ResID,
+			Params: map[string]interface{}{"link_id": l.ID, "ip": ip},
+		})
+	})
+}
+
+// Revoke closes the link for good, giving its quota back to its creator
+func (l *ShareLink) Revoke(db *gorm.DB, uid uint) error {
+	if l.RevokedAt != nil {
+		return nil
+	}
+	now := time.Now()
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(l).Update("revoked_at", now).Error; err != nil {
+			return err
+		}
+		if err := ReleaseQuota(tx, QuotaShareLink, l.CreatedBy, 1); err != nil {
+			return err
+		}
+		l.RevokedAt = &now
+		return LogActivity(tx, uid, Activity{
+			Type:   ActivityShareRevoked,
+			Model:  l.Model,
+			ResID:  l.ResID,
+			Params: map[string]interface{}{"link_id": l.ID},
+		})
+	})
+}
@@ -0,0 +1,54 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// StatusDaily counts the probe results of a component of the status page
+// over a UTC day (see package status)
+type StatusDaily struct {
+	ID uint `gorm:"primaryKey;autoIncrement" json:"-"`
+	// Day is the UTC midnight starting the day
+	Day         time.Time `gorm:"not null;uniqueIndex:idx_status_daily_day" json:"day"`
+	Component   string    `gorm:"size:32;not null;uniqueIndex:idx_status_daily_day" json:"component"`
+	Samples     int       `gorm:"not null;default:0" json:"samples"`
+	Operational int       `gorm:"not null;default:0" json:"operational"`
+	Degraded    int       `gorm:"not null;default:0" json:"degraded"`
+	Down        int       `gorm:"not null;default:0" json:"down"`
+}
+
+func (StatusDaily) TableName() string {
+	return "status_daily"
+}
+
+// AddStatusCounts adds counts to those of their day and component
+func AddStatusCounts(db *gorm.DB, rows []StatusDaily) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	return db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "day"}, {Name: "component"}},
+		DoUpdates: clause.Set{
+			{Column: clause.Column{Name: "samples"}, Value: gorm.Expr("status_daily.samples + excluded.samples")},
+			{Column: clause.Column{Name: "operational"}, Value: gorm.Expr("status_daily.operational + excluded.operational")},
+			{Column: clause.Column{Name: "degraded"}, Value: gorm.Expr("status_daily.degraded + excluded.degraded")},
+			{Column: clause.Column{Name: "down"}, Value: gorm.Expr("status_daily.down + excluded.down")},
+		},
+	}).Create(&rows).Error
+}
+
+// StatusDays returns the daily counts from a day on, by day
+func StatusDays(db *gorm.DB, from time.Time) ([]StatusDaily, error) {
+	var rows []StatusDaily
+	err := db.Where("day >= ?", from).Order("day, component").Find(&rows).Error
+	return rows, err
+}
+
+// PruneStatusDays deletes the daily counts of the days before a day
+func PruneStatusDays(db *gorm.DB, before time.Time) (int64, error) {
+	result := db.Where("day < ?", before).Delete(&StatusDaily{})
+	return result.RowsAffected, result.Error
+}
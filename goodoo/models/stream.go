@@ -0,0 +1,127 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"goodoo/database"
+	"gorm.io/gorm"
+)
+
+// Stream batch sizes
+const (
+	DefaultStreamBatchSize = 1000
+	MaxStreamBatchSize     = 10000
+)
+
+// DefaultStreamMaxSeconds bounds the duration of a stream unless
+// ParamStreamMaxSeconds says otherwise
+const DefaultStreamMaxSeconds = 600
+
+// StreamTimeoutError is returned when a stream runs longer than allowed;
+// the records were only partly delivered
+type StreamTimeoutError struct {
+	Model string
+	Limit time.Duration
+	Rows  int
+}
+
+func (e *StreamTimeoutError) Error() string {
+	return fmt.Sprintf("reading %s stopped after %s and %d record(s): narrow the domain", e.Model, e.Limit, e.Rows)
+}
+
+// StreamOptions tunes a stream; zero fields take the defaults
+type StreamOptions struct {
+	// Order sorts the records, "id" when empty
+	Order     string
+	BatchSize int
+	// MaxDuration bounds the stream, ParamStreamMaxSeconds when 0
+	MaxDuration time.Duration
+}
+
+// streamCursors numbers the cursors, unique within a connection
+var streamCursors atomic.Uint64
+
+// StreamIDs calls fn with the IDs of the records matching domain, in
+// batches, without ever loading them all. They are read through a
+// server-side cursor in a read-only repeatable read transaction: every
+// batch comes from the same snapshot, whatever is written meanwhile, and
+// no batch re-runs the query like OFFSET pages do. The stream stops when
+// ctx is cancelled, between batches, or with a StreamTimeoutError past
+// its maximum duration. fn receives the transaction of the stream, to
+// read more from the same snapshot; writes go through other connections.
+func (m *ModelDefinition) StreamIDs(ctx context.Context, env *Environment, domain Domain, opts StreamOptions, fn func(tx *gorm.DB, ids []uint) error) error {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultStreamBatchSize
+	}
+	if opts.BatchSize > MaxStreamBatchSize {
+		return fmt.Errorf("batch size cannot exceed %d", MaxStreamBatchSize)
+	}
+	if opts.MaxDuration <= 0 {
+		opts.MaxDuration = time.Duration(GetParamInt(env.GetDBName(), ParamStreamMaxSeconds, DefaultStreamMaxSeconds)) * time.Second
+	}
+	query, err := m.domainQuery(env, domain)
+	if err != nil {
+		return err
+	}
+	orderBy, err := m.parseOrder(env, opts.Order)
+	if err != nil {
+		return err
+	}
+	var ids []uint
+	statement := query.Session(&gorm.Session{DryRun: true}).Order(orderBy).Select("id").Find(&ids).Statement
+
+	streamCtx, cancel := context.WithTimeout(ctx, opts.MaxDuration)
+	defer cancel()
+	rows := 0
+	err = env.db.WithContext(streamCtx).Transaction(func(tx *gorm.DB) error {
+		// The batches are fetched as the consumer takes them: the session
+		// timeouts would cut a long export short
+		if err := database.RaiseTimeouts(tx, opts.MaxDuration); err != nil {
+			return err
+		}
+		cursor := fmt.Sprintf("goodoo_stream_%d", streamCursors.Add(1))
+		if err := tx.Exec("DECLARE "+cursor+" NO SCROLL CURSOR FOR "+statement.SQL.String(), statement.Vars...).Error; err != nil {
+			return err
+		}
+		fetch := fmt.Sprintf("FETCH FORWARD %d FROM %s", opts.BatchSize, cursor)
+		for {
+			if err := streamCtx.Err(); err != nil {
+				return err
+			}
+			batch := make([]uint, 0, opts.BatchSize)
+			if err := tx.Raw(fetch).Scan(&batch).Error; err != nil {
+				return err
+			}
+			if len(batch) > 0 {
+				if err := fn(tx, batch); err != nil {
+					return err
+				}
+				rows += len(batch)
+			}
+			if len(batch) < opts.BatchSize {
+				return tx.Exec("CLOSE " + cursor).Error
+			}
+		}
+	}, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil && ctx.Err() == nil && errors.Is(streamCtx.Err(), context.DeadlineExceeded) {
+		return &StreamTimeoutError{Model: m.Name, Limit: opts.MaxDuration, Rows: rows}
+	}
+	return err
+}
+
+// Stream calls fn with the records matching domain, read like Read with
+// fieldNames, in batches of opts.BatchSize: see StreamIDs
+func (m *ModelDefinition) Stream(ctx context.Context, env *Environment, domain Domain, fieldNames []string, opts StreamOptions, fn func(records []map[string]interface{}) error) error {
+	return m.StreamIDs(ctx, env, domain, opts, func(tx *gorm.DB, ids []uint) error {
+		records, err := m.Read(env.WithDB(tx), ids, fieldNames)
+		if err != nil {
+			return err
+		}
+		return fn(records)
+	})
+}
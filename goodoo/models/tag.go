@@ -0,0 +1,646 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"goodoo/fields"
+	"gorm.io/gorm"
+)
+
+// TagField is the virtual field holding the tags of the records of a
+// taggable model: read as [{id, name, color}], written as a list of tag
+// ids or names, and filtered on with in, not in, = false and != false
+const TagField = "tag_ids"
+
+// TagModel is the model name of the tags, for external ids and activities
+const TagModel = "res.tag"
+
+var (
+	// ErrEmptyTagName is returned for a tag without a name
+	ErrEmptyTagName = errors.New("tag name cannot be empty")
+	// ErrTagExists is returned when renaming a tag to the name of another
+	// one of the same scope
+	ErrTagExists = errors.New("a tag with this name already exists")
+	// ErrTagScope is returned when applying a tag scoped to a model to the
+	// records of another one
+	ErrTagScope = errors.New("tag is scoped to another model")
+	// ErrNotTaggable is returned for models without tags
+	ErrNotTaggable = errors.New("model is not taggable")
+	// ErrInvalidTagMerge is returned for merges that would break links
+	ErrInvalidTagMerge = errors.New("invalid tag merge")
+)
+
+// Tag labels records of the taggable models (like Odoo's
+// res.partner.category, but shared by the models). Names are unique per
+// scope, case-insensitively (see EnsureTagIndexes).
+type Tag struct {
+	BaseModel
+	Name  string `gorm:"not null" json:"name"`
+	Color int    `gorm:"default:0" json:"color"`
+	// Model restricts the tag to the records of one model, "" for all
+	Model string `gorm:"not null;default:''" json:"model,omitempty"`
+}
+
+func (Tag) TableName() string {
+	return "res_tag"
+}
+
+// TagLink tags a record of a taggable model
+type TagLink struct {
+	ID         uint      `gorm:"primarykey" json:"id"`
+	TagID      uint      `gorm:"not null;uniqueIndex:res_tag_rel_unique,priority:1;index" json:"tag_id"`
+	ResModel   string    `gorm:"not null;uniqueIndex:res_tag_rel_unique,priority:2;index:res_tag_rel_record,priority:1" json:"res_model"`
+	ResID      uint      `gorm:"not null;uniqueIndex:res_tag_rel_unique,priority:3;index:res_tag_rel_record,priority:2" json:"res_id"`
+	CreateUID  uint      `gorm:"column:create_uid" json:"create_uid"`
+	CreateDate time.Time `gorm:"column:create_date;autoCreateTime" json:"create_date"`
+}
+
+func (TagLink) TableName() string {
+	return "res_tag_rel"
+}
+
+// TagRef is a tag as read with the records
+type TagRef struct {
+	ID    uint   `json:"id"`
+	Name  string `json:"name"`
+	Color int    `json:"color"`
+}
+
+// EnsureTagIndexes creates the case-insensitive unique index of the tag
+// names, which AutoMigrate cannot declare
+func EnsureTagIndexes(db *gorm.DB) error {
+	return db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS res_tag_name_unique ON res_tag (lower(name), model)").Error
+}
+
+// tagScope names the model and table whose records a tag filter matches
+type tagScope struct {
+	model string
+	table string
+}
+
+var (
+	// taggableTables are the GORM models with tags, by table
+	taggableTables = map[string]string{
+		"res_partner":      "res.partner",
+		"sale_order":       "sale.order",
+		"product_category": "product.category",
+	}
+	taggableMutex sync.RWMutex
+)
+
+// RegisterTaggable gives tags to the records of a GORM model; field models
+// set Taggable on their definition instead
+func RegisterTaggable(model, table string) {
+	taggableMutex.Lock()
+	defer taggableMutex.Unlock()
+	taggableTables[table] = model
+}
+
+// TaggableModel returns the model of a table of a taggable GORM model, ""
+// when the table has no tags
+func TaggableModel(table string) string {
+	taggableMutex.RLock()
+	defer taggableMutex.RUnlock()
+	return taggableTables[table]
+}
+
+// taggableTable returns the table of a taggable GORM model, "" when the
+// model has no tags
+func taggableTable(model string) string {
+	taggableMutex.RLock()
+	defer taggableMutex.RUnlock()
+	for table, name := range taggableTables {
+		if name == model {
+			return table
+		}
+	}
+	return ""
+}
+
+// IsTaggable reports whether the records of a model have tags: a field
+// model of the environment registry with Taggable set, or a GORM model
+// registered with RegisterTaggable
+func IsTaggable(env *Environment, model string) bool {
+	if m, found := env.GetFieldModel(model); found {
+		return m.tagScope() != nil
+	}
+	return taggableTable(model) != ""
+}
+
+// TagRecords adds tags to records of a taggable model, or removes them:
+// records of a field model the record rules let the user write, or of a
+// GORM model registered with RegisterTaggable. Tags are given by id or by
+// name; missing names are created when adding.
+func TagRecords(env *Environment, model string, ids []uint, tags interface{}, remove bool) error {
+	ids = uniqueIDs(ids)
+	if len(ids) == 0 {
+		return nil
+	}
+	if m, found := env.GetFieldModel(model); found {
+		if m.tagScope() == nil {
+			return fmt.Errorf("%w: %s", ErrNotTaggable, model)
+		}
+		if err := m.checkRules(env, "write", ids); err != nil {
+			return err
+		}
+	} else if table := taggableTable(model); table != "" {
+		var found int64
+		if err := env.db.Table(table).Where("id IN ? AND deleted_at IS NULL", ids).Count(&found).Error; err != nil {
+			return err
+		}
+		if found != int64(len(ids)) {
+			return fmt.Errorf("%s records %v: %w", model, ids, gorm.ErrRecordNotFound)
+		}
+	} else {
+		return fmt.Errorf("%w: %s", ErrNotTaggable, model)
+	}
+
+	return env.Transaction(func(tx *gorm.DB) error {
+		if remove {
+			return RemoveTags(tx, model, ids, tags)
+		}
+		return AddTags(tx, env.user, model, ids, tags)
+	})
+}
+
+// tagScope returns the scope of the tag filters of the model, nil when it
+// has no tags
+func (m *ModelDefinition) tagScope() *tagScope {
+	if !m.Taggable || m.Abstract {
+		return nil
+	}
+	return &tagScope{model: m.Name, table: m.TableName}
+}
+
+// tagCondition compiles a tag_ids leaf to an EXISTS subquery on the links
+// of the record. Tags are given by id or by name, names matching
+// case-insensitively; = false matches the records without tags.
+func tagCondition(scope *tagScope, operator string, value interface{}) (string, []interface{}, error) {
+	links := fmt.Sprintf("SELECT 1 FROM res_tag_rel WHERE res_tag_rel.res_model = ? AND res_tag_rel.res_id = %s.id", QuoteIdentifier(scope.table))
+	args := []interface{}{scope.model}
+
+	if value == nil || value == false {
+		switch operator {
+		case "=":
+			return "NOT EXISTS (" + links + ")", args, nil
+		case "!=":
+			return "EXISTS (" + links + ")", args, nil
+		}
+		return "", nil, fmt.Errorf("invalid operator for %s: %s", TagField, operator)
+	}
+
+	exists := "EXISTS"
+	switch operator {
+	case "in", "=":
+	case "not in", "!=":
+		exists = "NOT EXISTS"
+	default:
+		return "", nil, fmt.Errorf("invalid operator for %s: %s", TagField, operator)
+	}
+	ids, names, err := parseTagValues(value)
+	if err != nil {
+		return "", nil, err
+	}
+	var matches []string
+	if len(ids) > 0 {
+		matches = append(matches, "res_tag_rel.tag_id IN ?")
+		args = append(args, ids)
+	}
+	if len(names) > 0 {
+		matches = append(matches, "res_tag_rel.tag_id IN (SELECT id FROM res_tag WHERE lower(name) IN ?)")
+		args = append(args, lowerAll(names))
+	}
+	if len(matches) == 0 {
+		// Like Odoo, in [] matches nothing and not in [] everything
+		if exists == "EXISTS" {
+			return "1 = 0", nil, nil
+		}
+		return "1 = 1", nil, nil
+	}
+	return fmt.Sprintf("%s (%s AND (%s))", exists, links, strings.Join(matches, " OR ")), args, nil
+}
+
+// parseTagValues splits a tag value, a tag or a list of tags, into tag ids
+// and names
+func parseTagValues(value interface{}) ([]uint, []string, error) {
+	var items []interface{}
+	switch v := fields.NormalizeNumbers(value).(type) {
+	case []interface{}:
+		items = v
+	case []uint:
+		return v, nil, nil
+	case []string:
+		items = make([]interface{}, len(v))
+		for i, name := range v {
+			items[i] = name
+		}
+	default:
+		items = []interface{}{v}
+	}
+
+	var ids []uint
+	var names []string
+	for _, item := range items {
+		switch v := item.(type) {
+		case string:
+			if name := strings.TrimSpace(v); name != "" {
+				names = append(names, name)
+			}
+		case int64:
+			ids = append(ids, uint(v))
+		case int:
+			ids = append(ids, uint(v))
+		case uint:
+			ids = append(ids, v)
+		case float64:
+			ids = append(ids, uint(v))
+		default:
+			return nil, nil, fmt.Errorf("invalid tag: %v", item)
+		}
+	}
+	return ids, names, nil
+}
+
+// FindOrCreateTag returns the tag of a name usable on the records of
+// model, scoped to it or unscoped, creating it scoped to model when there
+// is none; with model "", only unscoped tags are used. Names are compared
+// case-insensitively, and concurrent calls with the same name get the
+// same tag: the unique index settles the race. created reports whether
+// the tag is new.
+func FindOrCreateTag(tx *gorm.DB, uid uint, name, model string) (tag *Tag, created bool, err error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, false, ErrEmptyTagName
+	}
+	find := func() (*Tag, error) {
+		var tags []Tag
+		err := tx.Where("lower(name) = lower(?) AND model IN ?", name, []string{model, ""}).
+			Order("model DESC").Limit(1).Find(&tags).Error
+		if err != nil || len(tags) == 0 {
+			return nil, err
+		}
+		return &tags[0], nil
+	}
+	if tag, err = find(); err != nil || tag != nil {
+		return tag, false, err
+	}
+
+	now := time.Now().UTC()
+	var ids []uint
+	err = tx.Raw(`INSERT INTO res_tag (name, model, color, create_uid, write_uid, create_date, write_date)
+		VALUES (?, ?, 0, ?, ?, ?, ?) ON CONFLICT ((lower(name)), model) DO NOTHING RETURNING id`,
+		name, model, uid, uid, now, now).Scan(&ids).Error
+	if err != nil {
+		return nil, false, err
+	}
+	if len(ids) == 0 {
+		// Created by a concurrent call meanwhile
+		tag, err = find()
+		if err == nil && tag == nil {
+			err = fmt.Errorf("tag %q: %w", name, gorm.ErrRecordNotFound)
+		}
+		return tag, false, err
+	}
+	tag = &Tag{}
+	if err := tx.First(tag, ids[0]).Error; err != nil {
+		return nil, false, err
+	}
+	return tag, true, nil
+}
+
+// RenameTag renames a tag, failing with ErrTagExists when another tag of
+// its scope has the name
+func RenameTag(tx *gorm.DB, uid, id uint, name string) (*Tag, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, ErrEmptyTagName
+	}
+	var tag Tag
+	if err := tx.First(&tag, id).Error; err != nil {
+		return nil, err
+	}
+	var clashes int64
+	if err := tx.Model(&Tag{}).Where("lower(name) = lower(?) AND model = ? AND id <> ?", name, tag.Model, id).Count(&clashes).Error; err != nil {
+		return nil, err
+	}
+	if clashes > 0 {
+		return nil, ErrTagExists
+	}
+	if err := tx.Model(&tag).Updates(map[string]interface{}{"name": name, "write_uid": uid}).Error; err != nil {
+		return nil, err
+	}
+	return &tag, nil
+}
+
+// resolveTags returns the ids of the tags of a value, creating the tags
+// named but missing, after checking they may tag the records of model
+func resolveTags(tx *gorm.DB, uid uint, model string, value interface{}) ([]uint, error) {
+	ids, names, err := parseTagValues(value)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		tag, _, err := FindOrCreateTag(tx, uid, name, model)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, tag.ID)
+	}
+	ids = uniqueIDs(ids)
+	if len(ids) == 0 {
+		return ids, nil
+	}
+
+	var tags []Tag
+	if err := tx.Where("id IN ?", ids).Find(&tags).Error; err != nil {
+		return nil, err
+	}
+	if len(tags) != len(ids) {
+		return nil, fmt.Errorf("tags %v: %w", ids, gorm.ErrRecordNotFound)
+	}
+	for _, tag := range tags {
+		if tag.Model != "" && tag.Model != model {
+			return nil, fmt.Errorf("%w: %s is a tag of %s", ErrTagScope, tag.Name, tag.Model)
+		}
+	}
+	return ids, nil
+}
+
+// AddTags tags records of a model; tags are given by id or by name (see
+// resolveTags)
+func AddTags(tx *gorm.DB, uid uint, model string, resIDs []uint, tags interface{}) error {
+	tagIDs, err := resolveTags(tx, uid, model, tags)
+	if err != nil || len(tagIDs) == 0 || len(resIDs) == 0 {
+		return err
+	}
+	for _, resID := range resIDs {
+		for _, tagID := range tagIDs {
+			err := tx.Exec(`INSERT INTO res_tag_rel (tag_id, res_model, res_id, create_uid, create_date)
+				VALUES (?, ?, ?, ?, ?) ON CONFLICT (tag_id, res_model, res_id) DO NOTHING`,
+				tagID, model, resID, uid, time.Now().UTC()).Error
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// RemoveTags untags records of a model
+func RemoveTags(tx *gorm.DB, model string, resIDs []uint, tags interface{}) error {
+	tagIDs, names, err := parseTagValues(tags)
+	if err != nil {
+		return err
+	}
+	if len(names) > 0 {
+		var named []uint
+		if err := tx.Model(&Tag{}).Where("lower(name) IN ?", lowerAll(names)).Pluck("id", &named).Error; err != nil {
+			return err
+		}
+		tagIDs = append(tagIDs, named...)
+	}
+	if len(tagIDs) == 0 || len(resIDs) == 0 {
+		return nil
+	}
+	return tx.Where("res_model = ? AND res_id IN ? AND tag_id IN ?", model, resIDs, tagIDs).Delete(&TagLink{}).Error
+}
+
+// SetTags replaces the tags of records of a model
+func SetTags(tx *gorm.DB, uid uint, model string, resIDs []uint, tags interface{}) error {
+	tagIDs, err := resolveTags(tx, uid, model, tags)
+	if err != nil || len(resIDs) == 0 {
+		return err
+	}
+	query := tx.Where("res_model = ? AND res_id IN ?", model, resIDs)
+	if len(tagIDs) > 0 {
+		query = query.Where("tag_id NOT IN ?", tagIDs)
+	}
+	if err := query.Delete(&TagLink{}).Error; err != nil {
+		return err
+	}
+	return AddTags(tx, uid, model, resIDs, tagIDs)
+}
+
+// DeleteTagLinks removes the tags of deleted records
+func DeleteTagLinks(tx *gorm.DB, model string, resIDs []uint) error {
+	if len(resIDs) == 0 {
+		return nil
+	}
+	return tx.Where("res_model = ? AND res_id IN ?", model, resIDs).Delete(&TagLink{}).Error
+}
+
+// moveTagLinks gives a record the tags of records merged into it, and
+// removes their links
+func moveTagLinks(tx *gorm.DB, uid uint, model string, survivorID uint, mergedIDs []uint) error {
+	err := tx.Exec(`INSERT INTO res_tag_rel (tag_id, res_model, res_id, create_uid, create_date)
+		SELECT DISTINCT tag_id, res_model, ?, ?, ? FROM res_tag_rel WHERE res_model = ? AND res_id IN ?
+		ON CONFLICT (tag_id, res_model, res_id) DO NOTHING`,
+		survivorID, uid, time.Now().UTC(), model, mergedIDs).Error
+	if err != nil {
+		return err
+	}
+	return DeleteTagLinks(tx, model, mergedIDs)
+}
+
+// LoadTags returns the tags of records of a model, by record, ordered by
+// name
+func LoadTags(db *gorm.DB, model string, resIDs []uint) (map[uint][]TagRef, error) {
+	byRecord := make(map[uint][]TagRef, len(resIDs))
+	if len(resIDs) == 0 {
+		return byRecord, nil
+	}
+	var rows []struct {
+		ResID uint
+		TagRef
+	}
+	err := db.Table("res_tag_rel").
+		Select("res_tag_rel.res_id, res_tag.id, res_tag.name, res_tag.color").
+		Joins("JOIN res_tag ON res_tag.id = res_tag_rel.tag_id AND res_tag.deleted_at IS NULL").
+		Where("res_tag_rel.res_model = ? AND res_tag_rel.res_id IN ?", model, resIDs).
+		Order("lower(res_tag.name), res_tag.id").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		byRecord[row.ResID] = append(byRecord[row.ResID], row.TagRef)
+	}
+	return byRecord, nil
+}
+
+// TagFacet is a tag with the number of records it tags
+type TagFacet struct {
+	TagRef
+	Count int64 `json:"count"`
+}
+
+// TagFacets counts the records of a model by tag, among the ids the
+// records query selects, most used first
+func TagFacets(db *gorm.DB, model string, records *gorm.DB) ([]TagFacet, error) {
+	facets := make([]TagFacet, 0)
+	err := db.Table("res_tag_rel").
+		Select("res_tag.id, res_tag.name, res_tag.color, COUNT(*) AS count").
+		Joins("JOIN res_tag ON res_tag.id = res_tag_rel.tag_id AND res_tag.deleted_at IS NULL").
+		Where("res_tag_rel.res_model = ? AND res_tag_rel.res_id IN (?)", model, records).
+		Group("res_tag.id, res_tag.name, res_tag.color").
+		Order("count DESC, lower(res_tag.name), res_tag.id").
+		Scan(&facets).Error
+	return facets, err
+}
+
+// TagFacets counts the records of the domain by tag, among those the
+// record rules allow the user, so that a list can offer tag filters
+func (m *ModelDefinition) TagFacets(env *Environment, domain Domain) ([]TagFacet, error) {
+	if m.tagScope() == nil {
+		return nil, ErrNotTaggable
+	}
+	query, err := m.domainQuery(env, domain)
+	if err != nil {
+		return nil, err
+	}
+	return TagFacets(env.db, m.Name, query.Select(QuoteIdentifier(m.TableName)+".id"))
+}
+
+// readTags sets the tags of records read
+func (m *ModelDefinition) readTags(env *Environment, records []map[string]interface{}) error {
+	ids := make([]uint, len(records))
+	for i, record := range records {
+		ids[i] = toUint(record["id"])
+	}
+	tags, err := LoadTags(env.db, m.Name, ids)
+	if err != nil {
+		return err
+	}
+	for i, record := range records {
+		refs := tags[ids[i]]
+		if refs == nil {
+			refs = []TagRef{}
+		}
+		record[TagField] = refs
+	}
+	return nil
+}
+
+// splitTags takes the tags out of values written to a taggable model;
+// ok reports whether they were there
+func (m *ModelDefinition) splitTags(vals map[string]interface{}) (map[string]interface{}, interface{}, bool) {
+	tags, ok := vals[TagField]
+	if !ok || m.tagScope() == nil {
+		return vals, nil, false
+	}
+	rest := make(map[string]interface{}, len(vals)-1)
+	for name, value := range vals {
+		if name != TagField {
+			rest[name] = value
+		}
+	}
+	if tags == nil || tags == false {
+		tags = []uint{}
+	}
+	return rest, tags, true
+}
+
+// MergeTags merges tags into a target tag: their links are repointed to
+// it, those the target already has are dropped, and the merged tags are
+// deleted. A tag scoped to a model only takes the tags of that model. It
+// must run in a transaction.
+func MergeTags(tx *gorm.DB, uid, targetID uint, mergedIDs []uint) (*Tag, int64, error) {
+	mergedIDs = uniqueIDs(mergedIDs)
+	if len(mergedIDs) == 0 {
+		return nil, 0, fmt.Errorf("%w: no tag to merge", ErrInvalidTagMerge)
+	}
+	for _, id := range mergedIDs {
+		if id == targetID {
+			return nil, 0, fmt.Errorf("%w: a tag cannot be merged into itself", ErrInvalidTagMerge)
+		}
+	}
+
+	var target Tag
+	if err := tx.First(&target, targetID).Error; err != nil {
+		return nil, 0, fmt.Errorf("tag %d: %w", targetID, err)
+	}
+	var merged []Tag
+	if err := tx.Where("id IN ?", mergedIDs).Order("id").Find(&merged).Error; err != nil {
+		return nil, 0, err
+	}
+	if len(merged) != len(mergedIDs) {
+		return nil, 0, fmt.Errorf("%w: some tags do not exist", ErrInvalidTagMerge)
+	}
+	if target.Model != "" {
+		var foreign []string
+		if err := tx.Model(&TagLink{}).Where("tag_id IN ? AND res_model <> ?", mergedIDs, target.Model).
+			Distinct().Pluck("res_model", &foreign).Error; err != nil {
+			return nil, 0, err
+		}
+		if len(foreign) > 0 {
+			sort.Strings(foreign)
+			return nil, 0, fmt.Errorf("%w: %s is a tag of %s but the merged tags also tag %s",
+				ErrInvalidTagMerge, target.Name, target.Model, strings.Join(foreign, ", "))
+		}
+	}
+
+	// Links the target already has would be duplicates
+	moved := tx.Exec(`UPDATE res_tag_rel SET tag_id = ? WHERE tag_id IN ? AND NOT EXISTS (
+		SELECT 1 FROM res_tag_rel AS kept WHERE kept.tag_id = ? AND kept.res_model = res_tag_rel.res_model AND kept.res_id = res_tag_rel.res_id)`,
+		targetID, mergedIDs, targetID)
+	if moved.Error != nil {
+		return nil, 0, moved.Error
+	}
+	if err := tx.Where("tag_id IN ?", mergedIDs).Delete(&TagLink{}).Error; err != nil {
+		return nil, 0, err
+	}
+	if err := tx.Model(&IrModelData{}).Where("model = ? AND res_id IN ?", TagModel, mergedIDs).Update("res_id", targetID).Error; err != nil {
+		return nil, 0, err
+	}
+	// Deleted for good, so that their names can be taken again
+	if err := tx.Unscoped().Delete(&Tag{}, mergedIDs).Error; err != nil {
+		return nil, 0, err
+	}
+
+	names := make([]string, len(merged))
+	for i, tag := range merged {
+		names[i] = tag.Name
+	}
+	activity := Activity{
+		Type:  ActivityTagsMerged,
+		Model: TagModel,
+		ResID: targetID,
+		Params: map[string]interface{}{
+			"name":   target.Name,
+			"ids":    mergedIDs,
+			"merged": strings.Join(names, ", "),
+			"count":  len(mergedIDs),
+			"links":  moved.RowsAffected,
+		},
+	}
+	if err := LogActivity(tx, uid, activity); err != nil {
+		return nil, 0, err
+	}
+	return &target, moved.RowsAffected, nil
+}
+
+// DeleteTag deletes a tag and its links
+func DeleteTag(tx *gorm.DB, id uint) error {
+	if err := tx.Where("tag_id = ?", id).Delete(&TagLink{}).Error; err != nil {
+		return err
+	}
+	result := tx.Unscoped().Delete(&Tag{}, id)
+	if result.Error == nil && result.RowsAffected == 0 {
+		return fmt.Errorf("tag %d: %w", id, gorm.ErrRecordNotFound)
+	}
+	return result.Error
+}
+
+// lowerAll returns the names in lower case
+func lowerAll(names []string) []string {
+	lowered := make([]string, len(names))
+	for i, name := range names {
+		lowered[i] = strings.ToLower(name)
+	}
+	return lowered
+}
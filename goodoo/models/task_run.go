@@ -0,0 +1,56 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Task run states
+const (
+	TaskPending = "pending"
+	TaskRunning = "running"
+	TaskDone    = "done"
+	TaskFailed  = "failed"
+	// TaskLost marks a run interrupted by a restart that could not be
+	// resumed
+	TaskLost = "lost"
+)
+
+// TaskRun is a run of a durable background task (see package tasks). A
+// run found pending or running at startup was interrupted by a restart:
+// it is resumed when its task can be, and marked lost otherwise.
+type TaskRun struct {
+	ID    uint   `gorm:"primaryKey;autoIncrement" json:"id"`
+	Name  string `gorm:"size:128;not null;index" json:"name"`
+	Key   string `gorm:"column:dedup_key;size:255" json:"key,omitempty"`
+	State string `gorm:"size:16;not null;index" json:"state"`
+	// Payload is the JSON input of the task, given again on resume
+	Payload   *string `gorm:"type:jsonb" json:"payload,omitempty"`
+	Error     string  `gorm:"type:text" json:"error,omitempty"`
+	Retries   int     `gorm:"not null;default:0" json:"retries"`
+	RequestID string  `gorm:"column:request_id;size:64" json:"request_id,omitempty"`
+	UserID    uint    `gorm:"column:user_id" json:"user_id,omitempty"`
+	// StartDate is the start of the last attempt
+	StartDate  *time.Time `json:"start_date,omitempty"`
+	FinishDate *time.Time `json:"finish_date,omitempty"`
+	CreateDate time.Time  `gorm:"autoCreateTime;index" json:"create_date"`
+}
+
+func (TaskRun) TableName() string {
+	return "task_run"
+}
+
+// InterruptedTaskRuns returns the runs a restart interrupted, oldest first
+func InterruptedTaskRuns(db *gorm.DB) ([]TaskRun, error) {
+	var runs []TaskRun
+	err := db.Where("state IN ?", []string{TaskPending, TaskRunning}).Order("id").Find(&runs).Error
+	return runs, err
+}
+
+// RecentTaskFailures returns the latest failed or lost runs
+func RecentTaskFailures(db *gorm.DB, limit int) ([]TaskRun, error) {
+	var runs []TaskRun
+	err := db.Where("state IN ?", []string{TaskFailed, TaskLost}).Order("id DESC").Limit(limit).Find(&runs).Error
+	return runs, err
+}
@@ -0,0 +1,297 @@
+// Package testutil provides a transactional test harness for the models package.
+//
+// Every test gets its own Environment bound to a database transaction that is
+// rolled back when the test finishes, so tests never see each other's rows:
+//
+//	func TestSomething(t *testing.T) {
+//		env := testutil.NewTestEnvironment(t)
+//		user := env.CreateUser(func(u *models.User) { u.Login = "jane" })
+//		...
+//	}
+//
+// The test database is taken from GOODOO_TEST_DB (a database name or a
+// postgres:// URI); tests are skipped when it is not set.
+package testutil
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"goodoo/database"
+	"goodoo/models"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// TestDBEnv is the environment variable naming the test database
+const TestDBEnv = "GOODOO_TEST_DB"
+
+// Models lists the models migrated into the test database.
+// Packages adding models should append to it from an init function.
+var Models = []interface{}{
+	&models.User{},
+	&models.ResGroups{},
+	&models.IrModelData{},
+	&models.RecordRule{},
+	&models.Country{},
+	&models.Partner{},
+	&models.Tag{},
+	&models.TagLink{},
+}
+
+var (
+	setupOnce sync.Once
+	sharedDB  *gorm.DB
+	setupErr  error
+
+	sequence atomic.Int64
+)
+
+// setup opens the test database and runs migrations once per test binary
+func setup() (*gorm.DB, error) {
+	setupOnce.Do(func() {
+		dbOrURI := os.Getenv(TestDBEnv)
+		dbName, config, err := database.ParseConnectionInfo(dbOrURI)
+		if err != nil {
+			setupErr = err
+			return
+		}
+
+		registry := database.GetRegistry()
+		registry.SetLogger(logger.Default.LogMode(logger.Silent))
+		if err := registry.Register(dbName, config); err != nil {
+			setupErr = err
+			return
+		}
+
+		db, err := registry.GetDB(dbName)
+		if err != nil {
+			setupErr = err
+			return
+		}
+
+		if err := db.AutoMigrate(Models...); err != nil {
+			setupErr = fmt.Errorf("failed to migrate test database: %w", err)
+			return
+		}
+
+		sharedDB = db
+	})
+
+	return sharedDB, setupErr
+}
+
+// DryRunDB returns a PostgreSQL session that builds its statements
+// without running them, nor connecting, and a function returning the SQL
+// of the last query built: tests check what a query would send even
+// without GOODOO_TEST_DB
+func DryRunDB(t testing.TB) (*gorm.DB, func() string) {
+	t.Helper()
+	db, err := gorm.Open(postgres.New(postgres.Config{DSN: "host=localhost dbname=goodoo_dry_run"}), &gorm.Config{
+		DryRun:               true,
+		DisableAutomaticPing: true,
+		Logger:               logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("failed to open dry-run session: %v", err)
+	}
+	var last string
+	record := func(tx *gorm.DB) { last = tx.Statement.SQL.String() }
+	for name, processor := range map[string]interface {
+		Register(string, func(*gorm.DB)) error
+	}{
+		"query":  db.Callback().Query().After("gorm:query"),
+		"create": db.Callback().Create().After("gorm:create"),
+		"update": db.Callback().Update().After("gorm:update"),
+		"delete": db.Callback().Delete().After("gorm:delete"),
+		"raw":    db.Callback().Raw().After("gorm:raw"),
+	} {
+		if err := processor.Register("testutil:record_"+name, record); err != nil {
+			t.Fatalf("failed to record %s statements: %v", name, err)
+		}
+	}
+	return db, func() string { return last }
+}
+
+// TestEnvironment is a models.Environment bound to a per-test transaction
+type TestEnvironment struct {
+	*models.Environment
+
+	T  testing.TB
+	Tx *gorm.DB
+
+	savepoint string
+}
+
+// NewTestEnvironment opens a transaction for the test and rolls it back on cleanup.
+// Each call uses its own transaction, so t.Parallel() tests are fully isolated.
+func NewTestEnvironment(t testing.TB) *TestEnvironment {
+	t.Helper()
+
+	if os.Getenv(TestDBEnv) == "" {
+		t.Skipf("%s not set, skipping database test", TestDBEnv)
+	}
+
+	db, err := setup()
+	if err != nil {
+		t.Fatalf("failed to set up test database: %v", err)
+	}
+
+	tx := db.Begin()
+	if tx.Error != nil {
+		t.Fatalf("failed to begin test transaction: %v", tx.Error)
+	}
+
+	t.Cleanup(func() {
+		tx.Rollback()
+	})
+
+	return &TestEnvironment{
+		Environment: models.NewEnvironment(tx, 1),
+		T:           t,
+		Tx:          tx,
+	}
+}
+
+// Savepoint returns a child environment for a sequential subtest.
+// Changes made through it are rolled back to the savepoint when the subtest ends,
+// leaving the parent's fixtures intact.
+func (te *TestEnvironment) Savepoint(t testing.TB) *TestEnvironment {
+	t.Helper()
+
+	name := fmt.Sprintf("test_sp_%d", sequence.Add(1))
+	if err := te.Tx.SavePoint(name).Error; err != nil {
+		t.Fatalf("failed to create savepoint: %v", err)
+	}
+
+	t.Cleanup(func() {
+		te.Tx.RollbackTo(name)
+	})
+
+	return &TestEnvironment{
+		Environment: models.NewEnvironment(te.Tx, te.GetUser()),
+		T:           t,
+		Tx:          te.Tx,
+		savepoint:   name,
+	}
+}
+
+// WithUser returns a copy of the environment acting as another user
+func (te *TestEnvironment) WithUser(userID uint) *TestEnvironment {
+	return &TestEnvironment{
+		Environment: models.NewEnvironment(te.Tx, userID),
+		T:           te.T,
+		Tx:          te.Tx,
+		savepoint:   te.savepoint,
+	}
+}
+
+// Unique returns a value unique within the test binary, handy for unique columns
+func Unique(prefix string) string {
+	return fmt.Sprintf("%s_%d", prefix, sequence.Add(1))
+}
+
+// CreateUser creates a user with sensible defaults; overrides run before insert.
+// The plain password is "password" unless an override sets another via SetPassword.
+func (te *TestEnvironment) CreateUser(overrides ...func(*models.User)) *models.User {
+	te.T.Helper()
+
+	login := Unique("user")
+	user := &models.User{
+		Login:  login,
+		Name:   "Test " + login,
+		Email:  login + "@example.com",
+		Active: true,
+	}
+	if err := user.SetPassword("password"); err != nil {
+		te.T.Fatalf("failed to hash password: %v", err)
+	}
+
+	for _, override := range overrides {
+		override(user)
+	}
+
+	if err := te.Tx.Create(user).Error; err != nil {
+		te.T.Fatalf("failed to create user %s: %v", user.Login, err)
+	}
+
+	return user
+}
+
+// CreatePartner creates a partner with a unique name; overrides run before insert
+func (te *TestEnvironment) CreatePartner(overrides ...func(*models.Partner)) *models.Partner {
+	te.T.Helper()
+
+	name := Unique("partner")
+	partner := &models.Partner{
+		Name:  "Test " + name,
+		Email: name + "@example.com",
+		City:  "Brussels",
+	}
+	for _, override := range overrides {
+		override(partner)
+	}
+
+	if err := te.Create(partner); err != nil {
+		te.T.Fatalf("failed to create partner %s: %v", partner.Name, err)
+	}
+
+	return partner
+}
+
+// userAssignedCodes are the ISO 3166 codes no country uses (XA-XZ,
+// QM-QZ), so factory countries never clash with seeded ones
+var userAssignedCodes = func() []string {
+	var codes []string
+	for c := 'A'; c <= 'Z'; c++ {
+		codes = append(codes, "X"+string(c))
+	}
+	for c := 'M'; c <= 'Z'; c++ {
+		codes = append(codes, "Q"+string(c))
+	}
+	return codes
+}()
+
+var countrySequence atomic.Int64
+
+// CreateCountry creates a country with a user-assigned ISO code, up to 40
+// per test; overrides run before insert
+func (te *TestEnvironment) CreateCountry(overrides ...func(*models.Country)) *models.Country {
+	te.T.Helper()
+
+	n := countrySequence.Add(1)
+	country := &models.Country{
+		Code: userAssignedCodes[int(n)%len(userAssignedCodes)],
+		Name: Unique("Country"),
+	}
+	for _, override := range overrides {
+		override(country)
+	}
+
+	if err := te.Tx.Create(country).Error; err != nil {
+		te.T.Fatalf("failed to create country %s: %v", country.Code, err)
+	}
+
+	return country
+}
+
+// CreateTag creates a tag usable on every model; overrides run before insert
+func (te *TestEnvironment) CreateTag(overrides ...func(*models.Tag)) *models.Tag {
+	te.T.Helper()
+
+	tag := &models.Tag{Name: Unique("tag")}
+	for _, override := range overrides {
+		override(tag)
+	}
+
+	if err := te.Create(tag); err != nil {
+		te.T.Fatalf("failed to create tag %s: %v", tag.Name, err)
+	}
+
+	return tag
+}
@@ -0,0 +1,201 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+
+	"goodoo/fields"
+)
+
+// Changes to the records of field models are tracked in the audit log, one
+// entry per record and operation, in the transaction of the operation. The
+// params of an entry hold the name of the record and either the "values"
+// of a created or deleted record, or the "changes" of a write as
+// [old, new] pairs by field. Values are stored in their export form, which
+// reads back through the field conversions. Binary content and the magic
+// columns are not tracked, nor are transient records.
+
+// tracksChanges tells whether the changes to the records are tracked
+func (m *ModelDefinition) tracksChanges() bool {
+	return !m.Transient && !m.Abstract
+}
+
+// trackedFields returns the names of the stored fields among names whose
+// changes are tracked, sorted
+func (m *ModelDefinition) trackedFields(names []string) []string {
+	tracked := make([]string, 0, len(names))
+	for _, name := range names {
+		field, ok := m.Fields[name]
+		if !ok || IsMagicColumn(name) || !field.IsStored() || field.GetType() == fields.BinaryType {
+			continue
+		}
+		tracked = append(tracked, name)
+	}
+	sort.Strings(tracked)
+	return tracked
+}
+
+// trackedValue converts a column value to the form stored in the audit log
+func (m *ModelDefinition) trackedValue(name string, value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	field, ok := m.Fields[name]
+	if !ok {
+		return value
+	}
+	if record, err := field.ConvertToRecord(value, nil); err == nil {
+		value = record
+	}
+	exported, err := field.ConvertToExport(value, nil)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return exported
+}
+
+// sameTrackedValue compares two tracked values by their JSON encoding, so
+// that an int64 read back equals the int written
+func sameTrackedValue(a, b interface{}) bool {
+	encodedA, errA := json.Marshal(a)
+	encodedB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(encodedA) == string(encodedB)
+}
+
+// trackingSnapshot reads the tracked values of names, and the name of the
+// records, by record ID
+func (m *ModelDefinition) trackingSnapshot(env *Environment, ids []uint, names []string) (map[uint]map[string]interface{}, error) {
+	columns := append([]string{"id"}, names...)
+	if recName := m.RecNameField(); recName != "" && !slices.Contains(names, recName) {
+		columns = append(columns, recName)
+	}
+	var rows []map[string]interface{}
+	if err := env.db.Table(m.TableName).Select(columns).Where("id IN ?", ids).Find(&rows).Error; err != nil {
+		return nil, fmt.Errorf("failed to read the tracked values: %w", err)
+	}
+	snapshot := make(map[uint]map[string]interface{}, len(rows))
+	for _, row := range rows {
+		values := make(map[string]interface{}, len(columns))
+		for _, name := range columns[1:] {
+			values[name] = m.trackedValue(name, row[name])
+		}
+		snapshot[toUint(row["id"])] = values
+	}
+	return snapshot, nil
+}
+
+// trackingName returns the name of a tracked record, its ID when the
+// model has no name
+func (m *ModelDefinition) trackingName(id uint, values map[string]interface{}) string {
+	if recName := m.RecNameField(); recName != "" {
+		if name, ok := values[recName]; ok && name != nil && name != "" {
+			return fmt.Sprintf("%v", name)
+		}
+	}
+	return fmt.Sprintf("%s(%d)", m.Name, id)
+}
+
+// trackCreate logs the initial values of a created record from its column
+// values
+func (m *ModelDefinition) trackCreate(env *Environment, id uint, columns map[string]interface{}) error {
+	if !m.tracksChanges() {
+		return nil
+	}
+	values := make(map[string]interface{})
+	for _, name := range m.trackedFields(fieldNames(columns)) {
+		if value := m.trackedValue(name, columns[name]); value != nil {
+			values[name] = value
+		}
+	}
+	return LogActivity(env.db, env.user, Activity{
+		Type:   ActivityRecordCreated,
+		Model:  m.Name,
+		ResID:  id,
+		Params: map[string]interface{}{"name": m.trackingName(id, values), "values": values},
+	})
+}
+
+// trackWrite logs the changes of a write from the values read before it
+// and the column values written. Unchanged records log nothing; a write
+// changing active archives or restores the record.
+func (m *ModelDefinition) trackWrite(env *Environment, before map[uint]map[string]interface{}, columns map[string]interface{}) error {
+	names := m.trackedFields(fieldNames(columns))
+	ids := make([]uint, 0, len(before))
+	for id := range before {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, id := range ids {
+		old := before[id]
+		changes := make(map[string]interface{})
+		for _, name := range names {
+			value := m.trackedValue(name, columns[name])
+			if !sameTrackedValue(old[name], value) {
+				changes[name] = []interface{}{old[name], value}
+			}
+		}
+		if len(changes) == 0 {
+			continue
+		}
+
+		activityType := ActivityRecordUpdated
+		if change, ok := changes["active"].([]interface{}); ok {
+			if active, _ := change[1].(bool); active {
+				activityType = ActivityRecordRestored
+			} else {
+				activityType = ActivityRecordArchived
+			}
+		}
+		err := LogActivity(env.db, env.user, Activity{
+			Type:   activityType,
+			Model:  m.Name,
+			ResID:  id,
+			Params: map[string]interface{}{"name": m.trackingName(id, old), "changes": changes},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// trackUnlink logs the last values of records about to be deleted
+func (m *ModelDefinition) trackUnlink(env *Environment, ids []uint) error {
+	if !m.tracksChanges() {
+		return nil
+	}
+	stored := make([]string, 0, len(m.Fields))
+	for name := range m.GetStoredFields() {
+		stored = append(stored, name)
+	}
+	names := m.trackedFields(stored)
+	snapshot, err := m.trackingSnapshot(env, ids, names)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		last, ok := snapshot[id]
+		if !ok {
+			continue
+		}
+		values := make(map[string]interface{}, len(names))
+		for _, name := range names {
+			if last[name] != nil {
+				values[name] = last[name]
+			}
+		}
+		err := LogActivity(env.db, env.user, Activity{
+			Type:   ActivityRecordDeleted,
+			Model:  m.Name,
+			ResID:  id,
+			Params: map[string]interface{}{"name": m.trackingName(id, last), "values": values},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"goodoo/database"
+	"goodoo/logging"
+	"goodoo/scheduler"
+	"gorm.io/gorm"
+)
+
+// DefaultTransientMaxAge is how long transient records are kept after
+// their last write when their model does not say otherwise
+const DefaultTransientMaxAge = time.Hour
+
+// Vacuum deletes the records of a transient model that were not written
+// for its maximum age, then the oldest ones beyond its maximum count, and
+// returns how many were deleted
+func (m *ModelDefinition) Vacuum(db *gorm.DB, now time.Time) (int64, error) {
+	if !m.Transient {
+		return 0, fmt.Errorf("model %s is not transient", m.Name)
+	}
+	maxAge := m.TransientMaxAge
+	if maxAge <= 0 {
+		maxAge = DefaultTransientMaxAge
+	}
+
+	var deleted int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var ids []uint
+		err := tx.Raw(fmt.Sprintf("DELETE FROM %s WHERE COALESCE(write_date, create_date) < ? RETURNING id",
+			m.TableName), now.Add(-maxAge).UTC()).Scan(&ids).Error
+		if err != nil {
+			return err
+		}
+
+		if m.TransientMaxCount > 0 {
+			var extra []uint
+			err := tx.Raw(fmt.Sprintf(`DELETE FROM %[1]s WHERE id IN (
+	SELECT id FROM %[1]s ORDER BY COALESCE(write_date, create_date) DESC, id DESC OFFSET ?
+) RETURNING id`, m.TableName), m.TransientMaxCount).Scan(&extra).Error
+			if err != nil {
+				return err
+			}
+			ids = append(ids, extra...)
+		}
+
+		deleted = int64(len(ids))
+		return DeleteTranslations(tx, m.Name, ids)
+	})
+	return deleted, err
+}
+
+// VacuumTransient vacuums every transient model of the registry
+func (r *FieldModelRegistry) VacuumTransient(db *gorm.DB) (int64, error) {
+	all := r.GetAllModels()
+	names := make([]string, 0, len(all))
+	for name, model := range all {
+		if model.Transient {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var total int64
+	now := time.Now()
+	for _, name := range names {
+		deleted, err := all[name].Vacuum(db, now)
+		if err != nil {
+			return total, fmt.Errorf("failed to vacuum %s: %w", name, err)
+		}
+		total += deleted
+	}
+	return total, nil
+}
+
+// ScheduleVacuum registers a job vacuuming the transient models of a
+// database every interval
+func ScheduleVacuum(s *scheduler.Scheduler, dbName string, interval time.Duration) {
+	logger := logging.GetLogger("goodoo.models.vacuum")
+	s.Every("models.vacuum."+dbName, interval, func(ctx context.Context) error {
+		db, err := database.GetDatabase(dbName)
+		if err != nil {
+			return err
+		}
+		deleted, err := RegistryForDB(dbName).VacuumTransient(db.WithContext(ctx))
+		if deleted > 0 {
+			logger.Info("Vacuumed %d transient record(s) of %s", deleted, dbName)
+		}
+		return err
+	})
+}
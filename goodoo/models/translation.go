@@ -0,0 +1,122 @@
+package models
+
+import (
+	"time"
+
+	"goodoo/fields"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// DefaultLang is the language stored in the base columns of translatable fields
+const DefaultLang = "en_US"
+
+// IrTranslation stores the value of a translatable field in one language (like Odoo's ir.translation)
+type IrTranslation struct {
+	ID        uint      `gorm:"primaryKey;autoIncrement" json:"id"`
+	Model     string    `gorm:"not null;uniqueIndex:ir_translation_unique" json:"model"`
+	ResID     uint      `gorm:"column:res_id;not null;uniqueIndex:ir_translation_unique" json:"res_id"`
+	Field     string    `gorm:"not null;uniqueIndex:ir_translation_unique" json:"field"`
+	Lang      string    `gorm:"not null;uniqueIndex:ir_translation_unique" json:"lang"`
+	Value     string    `gorm:"type:text" json:"value"`
+	WriteUID  uint      `gorm:"column:write_uid" json:"write_uid"`
+	WriteDate time.Time `gorm:"column:write_date;autoUpdateTime" json:"write_date"`
+}
+
+func (IrTranslation) TableName() string {
+	return "ir_translation"
+}
+
+// IsTranslatable reports whether a field stores per-language values
+func IsTranslatable(field fields.Field) bool {
+	if !field.GetAttributes().Translate {
+		return false
+	}
+	switch field.GetType() {
+	case fields.StringType, fields.TextType, fields.HtmlType:
+		return true
+	}
+	return false
+}
+
+// SetTranslation creates or updates the translation of a field value
+func SetTranslation(db *gorm.DB, model string, resID uint, field, lang, value string, uid uint) error {
+	translation := IrTranslation{
+		Model:    model,
+		ResID:    resID,
+		Field:    field,
+		Lang:     lang,
+		Value:    value,
+		WriteUID: uid,
+	}
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "model"}, {Name: "res_id"}, {Name: "field"}, {Name: "lang"}},
+		DoUpdates: clause.AssignmentColumns([]string{"value", "write_uid", "write_date"}),
+	}).Create(&translation).Error
+}
+
+// GetTranslations returns res_id -> field -> value for one language
+func GetTranslations(db *gorm.DB, model string, resIDs []uint, fieldNames []string, lang string) (map[uint]map[string]string, error) {
+	result := make(map[uint]map[string]string)
+	if len(resIDs) == 0 || len(fieldNames) == 0 {
+		return result, nil
+	}
+
+	var rows []IrTranslation
+	err := db.Where("model = ? AND res_id IN ? AND field IN ? AND lang = ?", model, resIDs, fieldNames, lang).
+		Find(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		if result[row.ResID] == nil {
+			result[row.ResID] = make(map[string]string)
+		}
+		result[row.ResID][row.Field] = row.Value
+	}
+	return result, nil
+}
+
+// GetFieldTranslations returns lang -> value for a single record field
+func GetFieldTranslations(db *gorm.DB, model string, resID uint, field string) (map[string]string, error) {
+	var rows []IrTranslation
+	if err := db.Where("model = ? AND res_id = ? AND field = ?", model, resID, field).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string, len(rows))
+	for _, row := range rows {
+		values[row.Lang] = row.Value
+	}
+	return values, nil
+}
+
+// DeleteTranslations removes all translations of the given records
+func DeleteTranslations(db *gorm.DB, model string, resIDs []uint) error {
+	if len(resIDs) == 0 {
+		return nil
+	}
+	return db.Where("model = ? AND res_id IN ?", model, resIDs).Delete(&IrTranslation{}).Error
+}
+
+// InstalledLangs returns the default language followed by the active
+// languages of res_lang. Databases not seeded with the reference data yet
+// get every language having translations instead.
+func InstalledLangs(db *gorm.DB) ([]string, error) {
+	var langs []string
+	var seeded int64
+	if db.Migrator().HasTable(&Lang{}) {
+		if err := db.Model(&Lang{}).Count(&seeded).Error; err != nil {
+			return nil, err
+		}
+	}
+	if seeded > 0 {
+		if err := db.Model(&Lang{}).Where("active = ? AND code <> ?", true, DefaultLang).Order("code").Pluck("code", &langs).Error; err != nil {
+			return nil, err
+		}
+	} else if err := db.Model(&IrTranslation{}).Distinct("lang").Where("lang <> ?", DefaultLang).Order("lang").Pluck("lang", &langs).Error; err != nil {
+		return nil, err
+	}
+	return append([]string{DefaultLang}, langs...), nil
+}
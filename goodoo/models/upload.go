@@ -0,0 +1,26 @@
+package models
+
+import (
+	"time"
+)
+
+// IrUpload is a file staged by a session and referenced by token in a later
+// request, so multi-step forms do not upload it twice. The content is
+// cleared once consumed; the row is kept until expiry to report reuse.
+type IrUpload struct {
+	ID         uint       `gorm:"primaryKey;autoIncrement" json:"-"`
+	Token      string     `gorm:"not null;uniqueIndex" json:"token"`
+	SessionID  string     `gorm:"column:session_id;not null;index" json:"-"`
+	UserID     uint       `gorm:"column:user_id;index" json:"-"`
+	Name       string     `gorm:"not null" json:"name"`
+	Mimetype   string     `gorm:"" json:"mimetype"`
+	FileSize   int        `gorm:"column:file_size" json:"file_size"`
+	Datas      []byte     `gorm:"type:bytea" json:"-"`
+	ExpiresAt  time.Time  `gorm:"column:expires_at;index" json:"expires_at"`
+	ConsumedAt *time.Time `gorm:"column:consumed_at" json:"-"`
+	CreateDate time.Time  `gorm:"column:create_date;autoCreateTime" json:"create_date"`
+}
+
+func (IrUpload) TableName() string {
+	return "ir_upload"
+}
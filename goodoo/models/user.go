@@ -2,11 +2,14 @@ package models
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/sha512"
 	"encoding/base64"
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/crypto/pbkdf2"
@@ -22,12 +25,99 @@ type User struct {
 	Active    bool   `gorm:"default:true" json:"active"`
 	PartnerID *uint  `gorm:"column:partner_id" json:"partner_id,omitempty"`
 	Share     bool   `gorm:"default:false" json:"share"`
+	// IsService marks the users of service accounts, which cannot log in
+	// and authenticate with service keys only (see ServiceAccount)
+	IsService bool   `gorm:"column:is_service;not null;default:false;index" json:"is_service"`
+	// LastLogin is the time of the last successful login (Odoo's login_date)
+	LastLogin *time.Time `gorm:"column:login_date" json:"login_date"`
+	Lang      string `gorm:"default:en_US" json:"lang"`
+	// Tz is the preferred IANA timezone, empty until the user picks one
+	Tz        string `gorm:"column:tz" json:"tz"`
+	// SignupToken holds the SHA-256 of a pending password reset or invitation token
+	SignupToken      string     `gorm:"column:signup_token;index" json:"-"`
+	SignupExpiration *time.Time `gorm:"column:signup_expiration" json:"-"`
+	// AvatarChecksum is the checksum of the uploaded avatar, empty when none;
+	// the image itself is an ir_attachment on the avatar field
+	AvatarChecksum string `gorm:"column:avatar_checksum" json:"avatar_checksum,omitempty"`
+	// OAuthIssuer and OAuthUID link the user to the subject of an OpenID
+	// Connect provider once they signed in with it (Odoo's oauth_uid)
+	OAuthIssuer string `gorm:"column:oauth_issuer" json:"-"`
+	OAuthUID    string `gorm:"column:oauth_uid;index" json:"-"`
+	// LDAPDN links the user to their entry in the LDAP directory once they
+	// logged in with its password
+	LDAPDN string `gorm:"column:ldap_dn;index" json:"-"`
+	// ContextDefaultValues is a JSON object of the sticky context keys the
+	// user chose (e.g. team_id), copied into the session context at login
+	ContextDefaultValues *string `gorm:"column:context_defaults;type:jsonb" json:"-"`
+	// ImportID is the user import that created the user, if any
+	ImportID *uint `gorm:"column:import_id;index" json:"import_id,omitempty"`
+	// Groups are the access groups of the user (Odoo's groups_id)
+	Groups []ResGroups `gorm:"many2many:res_groups_users_rel;joinForeignKey:uid;joinReferences:gid" json:"-"`
 }
 
 func (User) TableName() string {
 	return "res_users"
 }
 
+// AfterDelete removes the preferences of the user
+func (u *User) AfterDelete(tx *gorm.DB) error {
+	if u.ID == 0 {
+		return nil
+	}
+	return DeleteUserPreferences(tx, u.ID)
+}
+
+// IsAdmin reports whether the user is the administrator (like Odoo's base.user_admin)
+func (u *User) IsAdmin() bool {
+	return u.Login == "admin"
+}
+
+// DisplayName returns the name shown in the UI, falling back to the login
+func (u *User) DisplayName() string {
+	if strings.TrimSpace(u.Name) != "" {
+		return u.Name
+	}
+	return u.Login
+}
+
+// SessionContext returns the preferred language and timezone of the user
+// and their sticky context defaults, copied into the session context at login
+func (u *User) SessionContext() map[string]interface{} {
+	context := u.ContextDefaults()
+	if u.Lang != "" {
+		context["lang"] = u.Lang
+	}
+	if u.Tz != "" {
+		context["tz"] = u.Tz
+		context["timezone"] = u.Tz
+	}
+	return context
+}
+
+// AvatarAttachment returns the uploaded avatar, or gorm.ErrRecordNotFound
+func (u *User) AvatarAttachment(db *gorm.DB) (*IrAttachment, error) {
+	return FindFieldAttachment(db, "res.users", "avatar", u.ID)
+}
+
+// SetAvatar stores the avatar image and updates the checksum. The image
+// is served once its attachment is scanned clean.
+func (u *User) SetAvatar(db *gorm.DB, mimetype string, data []byte) (*IrAttachment, error) {
+	var attachment *IrAttachment
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		attachment, err = SetFieldAttachment(tx, u.ID, "res.users", "avatar", u.ID, "avatar", mimetype, data)
+		if err != nil {
+			return err
+		}
+		u.AvatarChecksum = attachment.Checksum
+		return tx.Model(u).Update("avatar_checksum", u.AvatarChecksum).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return attachment, nil
+}
+
 func (u *User) SetPassword(password string) error {
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
@@ -37,6 +127,32 @@ func (u *User) SetPassword(password string) error {
 	return nil
 }
 
+// DefaultPasswordMinLength is the minimum length of passwords unless
+// ParamPasswordMinLength says otherwise
+const DefaultPasswordMinLength = 8
+
+// PasswordPolicyError tells why a password chosen by a user is refused
+type PasswordPolicyError struct {
+	Reason string
+}
+
+func (e *PasswordPolicyError) Error() string {
+	return e.Reason
+}
+
+// CheckPasswordPolicy returns a PasswordPolicyError when a password the
+// user chooses is too short for the database or is their login or email
+func (u *User) CheckPasswordPolicy(dbName, password string) error {
+	minLength := GetParamInt(dbName, ParamPasswordMinLength, DefaultPasswordMinLength)
+	if utf8.RuneCountInString(password) < minLength {
+		return &PasswordPolicyError{Reason: fmt.Sprintf("Passwords must have at least %d characters", minLength)}
+	}
+	if strings.EqualFold(password, u.Login) || strings.EqualFold(password, u.Email) {
+		return &PasswordPolicyError{Reason: "Passwords must differ from the login and email"}
+	}
+	return nil
+}
+
 // SetPasswordOdooStyle creates an Odoo-compatible PBKDF2-SHA512 password hash
 func (u *User) SetPasswordOdooStyle(password string) error {
 	const rounds = 600000 // Odoo default minimum rounds
@@ -78,13 +194,6 @@ func (u *User) CheckPassword(password string) bool {
 	return u.Password == password
 }
 
-func min(a, b int) int {
-	if a < b {
-		return a
-	}
-	return b
-}
-
 // verifyPBKDF2Password verifies Odoo-style PBKDF2-SHA512 passwords
 func (u *User) verifyPBKDF2Password(password string) bool {
 	// Odoo format: $pbkdf2-sha512$rounds$salt$hash
@@ -159,21 +268,86 @@ func FindUserByLogin(db *gorm.DB, login string) (*User, error) {
 }
 
 func CreateUser(db *gorm.DB, login, name, email, password string) (*User, error) {
+	user, err := NewUser(login, name, email, password)
+	if err != nil {
+		return nil, err
+	}
+	
+	err = db.Create(user).Error
+	if err != nil {
+		return nil, err
+	}
+	
+	return user, nil
+}
+
+// NewUser returns an active user with a hashed password, not saved yet
+func NewUser(login, name, email, password string) (*User, error) {
 	user := &User{
 		Login: login,
 		Name:  name,
 		Email: email,
 		Active: true,
 	}
-	
 	if err := user.SetPassword(password); err != nil {
 		return nil, err
 	}
-	
-	err := db.Create(user).Error
+	return user, nil
+}
+
+// hashSignupToken returns the stored form of a signup token
+func hashSignupToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return fmt.Sprintf("%x", sum)
+}
+
+// GenerateSignupToken creates a single-use token for a password reset or
+// invitation (like Odoo's signup_prepare), valid until expiration; only
+// its hash is stored
+func (u *User) GenerateSignupToken(db *gorm.DB, expiration time.Time) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+
+	u.SignupToken = hashSignupToken(token)
+	u.SignupExpiration = &expiration
+	err := db.Model(u).Updates(map[string]interface{}{
+		"signup_token":      u.SignupToken,
+		"signup_expiration": expiration,
+	}).Error
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// FindUserBySignupToken returns the user owning a valid signup token, not
+// expired at now
+func FindUserBySignupToken(db *gorm.DB, token string, now time.Time) (*User, error) {
+	if token == "" {
+		return nil, gorm.ErrRecordNotFound
+	}
+	var user User
+	err := db.Where("signup_token = ? AND signup_expiration > ?", hashSignupToken(token), now).
+		First(&user).Error
 	if err != nil {
 		return nil, err
 	}
-	
-	return user, nil
-}
\ No newline at end of file
+	return &user, nil
+}
+
+// ResetPassword sets a new password and consumes the signup token
+func (u *User) ResetPassword(db *gorm.DB, password string) error {
+	if err := u.SetPassword(password); err != nil {
+		return err
+	}
+	u.SignupToken = ""
+	u.SignupExpiration = nil
+	return db.Model(u).Updates(map[string]interface{}{
+		"password":          u.Password,
+		"signup_token":      "",
+		"signup_expiration": nil,
+	}).Error
+}
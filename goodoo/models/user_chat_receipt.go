@@ -0,0 +1,185 @@
+package models
+
+import (
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Delivery states of a user chat message
+const (
+	ReceiptSent      = "sent"
+	ReceiptDelivered = "delivered"
+	ReceiptRead      = "read"
+)
+
+// ReceiptListMax is the number of recipients above which the receipts of
+// a message are only counted, not listed
+const ReceiptListMax = 10
+
+// UserChatReceipt is the delivery of a user chat message to one of its
+// recipients: sent while both dates are empty, delivered once pushed to
+// one of their connections or fetched, read once they marked it read. The
+// recipients of direct messages get a receipt when the message is sent;
+// the members of group rooms are not stored, so theirs are created on
+// delivery.
+type UserChatReceipt struct {
+	ID          uint       `gorm:"primaryKey;autoIncrement" json:"-"`
+	MessageID   string     `gorm:"column:message_id;not null;uniqueIndex:idx_user_chat_receipt,priority:1" json:"message_id"`
+	UserID      uint       `gorm:"column:user_id;not null;uniqueIndex:idx_user_chat_receipt,priority:2" json:"user_id"`
+	Room        string     `gorm:"not null;index" json:"room"`
+	DeliveredAt *time.Time `gorm:"column:delivered_at" json:"delivered_at,omitempty"`
+	ReadAt      *time.Time `gorm:"column:read_at" json:"read_at,omitempty"`
+}
+
+func (UserChatReceipt) TableName() string {
+	return "user_chat_receipt"
+}
+
+// State returns the delivery state of the receipt
+func (r UserChatReceipt) State() string {
+	switch {
+	case r.ReadAt != nil:
+		return ReceiptRead
+	case r.DeliveredAt != nil:
+		return ReceiptDelivered
+	}
+	return ReceiptSent
+}
+
+// RecordSent creates the receipts of a message sent to recipients
+func RecordSent(db *gorm.DB, room, messageID string, recipients []uint) error {
+	if len(recipients) == 0 {
+		return nil
+	}
+	receipts := make([]UserChatReceipt, len(recipients))
+	for i, uid := range recipients {
+		receipts[i] = UserChatReceipt{MessageID: messageID, UserID: uid, Room: room}
+	}
+	return db.Clauses(clause.OnConflict{DoNothing: true}).Create(&receipts).Error
+}
+
+// markReceipts sets a date of the receipts of messages of a room for a
+// user, creating those missing, and returns the messages whose receipt
+// changed state. Delivered dates are set by reads too.
+func markReceipts(db *gorm.DB, room string, messageIDs []string, uid uint, at time.Time, read bool) ([]string, error) {
+	if len(messageIDs) == 0 {
+		return nil, nil
+	}
+	var changed []string
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var existing []UserChatReceipt
+		if err := tx.Where("message_id IN ? AND user_id = ?", messageIDs, uid).Find(&existing).Error; err != nil {
+			return err
+		}
+		byMessage := make(map[string]UserChatReceipt, len(existing))
+		for _, receipt := range existing {
+			byMessage[receipt.MessageID] = receipt
+		}
+		for _, messageID := range messageIDs {
+			receipt, exists := byMessage[messageID]
+			if !exists {
+				receipt = UserChatReceipt{MessageID: messageID, UserID: uid, Room: room}
+			}
+			before := receipt.State()
+			if receipt.DeliveredAt == nil {
+				receipt.DeliveredAt = &at
+			}
+			if read && receipt.ReadAt == nil {
+				receipt.ReadAt = &at
+			}
+			if exists && receipt.State() == before {
+				continue
+			}
+			if err := tx.Save(&receipt).Error; err != nil {
+				return err
+			}
+			changed = append(changed, messageID)
+			byMessage[messageID] = receipt
+		}
+		return nil
+	})
+	return changed, err
+}
+
+// MarkDelivered records that messages of a room reached a user and
+// returns those that were not delivered yet
+func MarkDelivered(db *gorm.DB, room string, messageIDs []string, uid uint, at time.Time) ([]string, error) {
+	return markReceipts(db, room, messageIDs, uid, at, false)
+}
+
+// MarkRead records that a user read a message of a room and returns its
+// receipt; a message read already keeps its first read date
+func MarkRead(db *gorm.DB, room, messageID string, uid uint, at time.Time) (*UserChatReceipt, error) {
+	if _, err := markReceipts(db, room, []string{messageID}, uid, at, true); err != nil {
+		return nil, err
+	}
+	var receipt UserChatReceipt
+	if err := db.Where("message_id = ? AND user_id = ?", messageID, uid).First(&receipt).Error; err != nil {
+		return nil, err
+	}
+	return &receipt, nil
+}
+
+// ReceiptSummary is the delivery of a message to its recipients: the
+// state they all reached, how many it was delivered to and read by, and
+// their receipts while there are at most ReceiptListMax of them
+type ReceiptSummary struct {
+	State      string            `json:"state"`
+	Recipients int               `json:"recipients"`
+	Delivered  int               `json:"delivered"`
+	Read       int               `json:"read"`
+	Receipts   []UserChatReceipt `json:"receipts,omitempty"`
+}
+
+// MessageReceipts summarizes the receipts of messages by message id;
+// messages without receipt are sent
+func MessageReceipts(db *gorm.DB, messageIDs []string) (map[string]ReceiptSummary, error) {
+	summaries := make(map[string]ReceiptSummary, len(messageIDs))
+	for _, messageID := range messageIDs {
+		summaries[messageID] = ReceiptSummary{State: ReceiptSent}
+	}
+	if len(messageIDs) == 0 {
+		return summaries, nil
+	}
+	var receipts []UserChatReceipt
+	if err := db.Where("message_id IN ?", messageIDs).Order("user_id").Find(&receipts).Error; err != nil {
+		return nil, err
+	}
+	byMessage := make(map[string][]UserChatReceipt)
+	for _, receipt := range receipts {
+		byMessage[receipt.MessageID] = append(byMessage[receipt.MessageID], receipt)
+	}
+	for messageID, list := range byMessage {
+		summaries[messageID] = SummarizeReceipts(list)
+	}
+	return summaries, nil
+}
+
+// SummarizeReceipts summarizes the receipts of one message: it is read
+// once every recipient read it and delivered once it reached them all
+func SummarizeReceipts(receipts []UserChatReceipt) ReceiptSummary {
+	summary := ReceiptSummary{State: ReceiptSent, Recipients: len(receipts)}
+	for _, receipt := range receipts {
+		if receipt.DeliveredAt != nil {
+			summary.Delivered++
+		}
+		if receipt.ReadAt != nil {
+			summary.Read++
+		}
+	}
+	switch {
+	case summary.Recipients == 0:
+	case summary.Read == summary.Recipients:
+		summary.State = ReceiptRead
+	case summary.Delivered == summary.Recipients:
+		summary.State = ReceiptDelivered
+	}
+	if len(receipts) <= ReceiptListMax {
+		summary.Receipts = append([]UserChatReceipt(nil), receipts...)
+		sort.Slice(summary.Receipts, func(i, j int) bool { return summary.Receipts[i].UserID < summary.Receipts[j].UserID })
+	}
+	return summary
+}
@@ -0,0 +1,426 @@
+package models
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// UserImportModel is the model of user imports in the activity feed
+const UserImportModel = "res.users.import"
+
+// Limits of user imports
+const (
+	// MaxUserImportRows bounds the rows of an imported file
+	MaxUserImportRows = 10000
+	// UserImportBatchSize is the rows created between two progress
+	// reports and cancellation checks
+	UserImportBatchSize = 50
+)
+
+// User import states
+const (
+	UserImportRunning   = "running"
+	UserImportDone      = "done"
+	UserImportCancelled = "cancelled"
+	UserImportFailed    = "failed"
+)
+
+// Outcomes of the rows of a user import, in its report
+const (
+	UserImportRowValid   = "valid"
+	UserImportRowInvalid = "invalid"
+	UserImportRowCreated = "created"
+	UserImportRowInvited = "invited"
+	UserImportRowFailed  = "failed"
+	UserImportRowSkipped = "skipped"
+)
+
+// userImportColumns are the columns of an imported file, by header; the
+// file needs a name and an email or a login
+var userImportColumns = map[string]string{
+	"login":    "login",
+	"name":     "name",
+	"email":    "email",
+	"groups":   "groups",
+	"language": "language",
+	"lang":     "language",
+	"active":   "active",
+}
+
+// UserImport is a CSV file of users imported by a background operation.
+// The users created keep its id in import_id, so that a bad import can
+// be found and deactivated.
+type UserImport struct {
+	ID          uint   `gorm:"primaryKey;autoIncrement" json:"id"`
+	OperationID string `gorm:"column:operation_id;index" json:"operation_id"`
+	FileName    string `gorm:"column:file_name" json:"file_name"`
+	// Invite mails the users an invitation instead of leaving them without
+	// password
+	Invite  bool   `gorm:"not null;default:false" json:"invite"`
+	State   string `gorm:"size:16;not null;default:running" json:"state"`
+	Total   int    `gorm:"not null;default:0" json:"total"`
+	Created int    `gorm:"not null;default:0" json:"created"`
+	Failed  int    `gorm:"not null;default:0" json:"failed"`
+	// Report is the per-row CSV report, once finished
+	Report         []byte     `gorm:"type:bytea" json:"-"`
+	CreateUID      uint       `gorm:"column:create_uid;index" json:"create_uid"`
+	CreateDate     time.Time  `gorm:"column:create_date;autoCreateTime" json:"create_date"`
+	FinishDate     *time.Time `gorm:"column:finish_date" json:"finish_date,omitempty"`
+	DeactivateDate *time.Time `gorm:"column:deactivate_date" json:"deactivate_date,omitempty"`
+}
+
+func (UserImport) TableName() string {
+	return "res_users_import"
+}
+
+// UserImportRow is a row of an imported file, checked by CheckUserImport
+// and given its outcome by ImportUser
+type UserImportRow struct {
+	// Row is the 1-based line of the row in the file, header included
+	Row      int      `json:"row"`
+	Login    string   `json:"login"`
+	Name     string   `json:"name"`
+	Email    string   `json:"email"`
+	Groups   []string `json:"groups"`
+	Language string   `json:"language"`
+	Active   bool     `json:"active"`
+	GroupIDs []uint   `json:"-"`
+	Status   string   `json:"status"`
+	Errors   []string `json:"errors,omitempty"`
+	UserID   uint     `json:"user_id,omitempty"`
+}
+
+func (r *UserImportRow) fail(format string, args ...interface{}) {
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+}
+
+// ParseUserImport reads the rows of a CSV file of users. Its header names
+// the columns: login, name, email, groups (names or external ids separated
+// by ";"), language (or lang) and active. The login defaults to the email
+// and active to true.
+func ParseUserImport(data []byte) ([]UserImportRow, error) {
+	reader := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))))
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("the file is empty")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV file: %w", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		column, ok := userImportColumns[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unknown column %q", name)
+		}
+		if _, duplicate := columns[column]; duplicate {
+			return nil, fmt.Errorf("column %s appears twice", column)
+		}
+		columns[column] = i
+	}
+	if _, ok := columns["name"]; !ok {
+		return nil, fmt.Errorf("the file has no name column")
+	}
+	_, hasLogin := columns["login"]
+	if _, hasEmail := columns["email"]; !hasEmail && !hasLogin {
+		return nil, fmt.Errorf("the file needs an email or a login column")
+	}
+
+	var rows []UserImportRow
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid CSV file: %w", err)
+		}
+		if len(rows) == MaxUserImportRows {
+			return nil, fmt.Errorf("the file has more than %d rows", MaxUserImportRows)
+		}
+		cell := func(column string) string {
+			if i, ok := columns[column]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		if strings.TrimSpace(strings.Join(record, "")) == "" {
+			continue
+		}
+
+		row := UserImportRow{Row: line, Login: cell("login"), Name: cell("name"), Email: cell("email"), Language: cell("language"), Active: true}
+		if row.Login == "" {
+			row.Login = row.Email
+		}
+		for _, group := range strings.Split(cell("groups"), ";") {
+			if group = strings.TrimSpace(group); group != "" {
+				row.Groups = append(row.Groups, group)
+			}
+		}
+		if active := strings.ToLower(cell("active")); active != "" {
+			switch active {
+			case "yes", "y", "on":
+				row.Active = true
+			case "no", "n", "off":
+				row.Active = false
+			default:
+				if row.Active, err = strconv.ParseBool(active); err != nil {
+					row.fail("active must be true or false, not %q", active)
+				}
+			}
+		}
+		rows = append(rows, row)
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("the file has no rows to import")
+	}
+	return rows, nil
+}
+
+// CheckUserImport validates the rows of a user import: required values,
+// logins and emails taken by existing users or repeated in the file,
+// unknown groups and languages. Each row is marked valid or invalid with
+// its errors; the function reports how many are valid.
+func CheckUserImport(db *gorm.DB, rows []UserImportRow) (int, error) {
+	langs, err := InstalledLangs(db)
+	if err != nil {
+		return 0, err
+	}
+	installed := make(map[string]bool, len(langs))
+	for _, lang := range langs {
+		installed[lang] = true
+	}
+	groups, err := userImportGroups(db, rows)
+	if err != nil {
+		return 0, err
+	}
+	takenLogins, takenEmails, err := takenUserKeys(db, rows)
+	if err != nil {
+		return 0, err
+	}
+
+	logins := make(map[string]int)
+	emails := make(map[string]int)
+	valid := 0
+	for i := range rows {
+		row := &rows[i]
+		if row.Name == "" {
+			row.fail("name is required")
+		}
+		email := strings.ToLower(row.Email)
+		switch {
+		case row.Email == "":
+			row.fail("email is required")
+		case !strings.Contains(row.Email, "@") || strings.ContainsAny(row.Email, " \t"):
+			row.fail("%q is not a valid email", row.Email)
+		case takenEmails[email]:
+			row.fail("email %s is used by an existing user", row.Email)
+		case emails[email] != 0:
+			row.fail("email %s is repeated from row %d", row.Email, emails[email])
+		default:
+			emails[email] = row.Row
+		}
+		switch {
+		case row.Login == "":
+			row.fail("login is required")
+		case takenLogins[row.Login]:
+			row.fail("login %s is used by an existing user", row.Login)
+		case logins[row.Login] != 0:
+			row.fail("login %s is repeated from row %d", row.Login, logins[row.Login])
+		default:
+			logins[row.Login] = row.Row
+		}
+		if row.Language == "" {
+			row.Language = DefaultLang
+		} else if !installed[row.Language] {
+			row.fail("language %s is not installed", row.Language)
+		}
+		row.GroupIDs = nil
+		for _, group := range row.Groups {
+			id, ok := groups[group]
+			if !ok {
+				row.fail("unknown group %s", group)
+				continue
+			}
+			row.GroupIDs = append(row.GroupIDs, id)
+		}
+
+		if len(row.Errors) > 0 {
+			row.Status = UserImportRowInvalid
+		} else {
+			row.Status = UserImportRowValid
+			valid++
+		}
+	}
+	return valid, nil
+}
+
+// userImportGroups resolves the groups named in rows, by external id
+// (e.g. "base.group_user") or by name, case-insensitively; unknown ones
+// are left out
+func userImportGroups(db *gorm.DB, rows []UserImportRow) (map[string]uint, error) {
+	var all []ResGroups
+	if err := db.Select("id", "name").Find(&all).Error; err != nil {
+		return nil, err
+	}
+	byName := make(map[string]uint, len(all))
+	for _, group := range all {
+		byName[strings.ToLower(group.Name)] = group.ID
+	}
+
+	resolved := make(map[string]uint)
+	for _, row := range rows {
+		for _, group := range row.Groups {
+			if _, done := resolved[group]; done {
+				continue
+			}
+			if id, ok := byName[strings.ToLower(group)]; ok {
+				resolved[group] = id
+			} else if model, id, err := ResolveXMLID(db, group); err == nil && model == "res.groups" {
+				resolved[group] = id
+			}
+		}
+	}
+	return resolved, nil
+}
+
+// takenUserKeys returns the logins and lowercased emails of rows that
+// existing users already have
+func takenUserKeys(db *gorm.DB, rows []UserImportRow) (map[string]bool, map[string]bool, error) {
+	logins := make([]string, 0, len(rows))
+	emails := make([]string, 0, len(rows))
+	for _, row := range rows {
+		if row.Login != "" {
+			logins = append(logins, row.Login)
+		}
+		if row.Email != "" {
+			emails = append(emails, strings.ToLower(row.Email))
+		}
+	}
+
+	takenLogins := make(map[string]bool)
+	takenEmails := make(map[string]bool)
+	const chunk = 1000
+	for start := 0; start < len(logins) || start < len(emails); start += chunk {
+		var users []User
+		query := db.Select("login", "email")
+		if start < len(logins) {
+			query = query.Or("login IN ?", logins[start:min(start+chunk, len(logins))])
+		}
+		if start < len(emails) {
+			query = query.Or("lower(email) IN ?", emails[start:min(start+chunk, len(emails))])
+		}
+		if err := query.Find(&users).Error; err != nil {
+			return nil, nil, err
+		}
+		for _, user := range users {
+			takenLogins[user.Login] = true
+			takenEmails[strings.ToLower(user.Email)] = true
+		}
+	}
+	return takenLogins, takenEmails, nil
+}
+
+// ImportUser creates the user of a valid row, recorded with the import in
+// the activity feed of uid. With invite the user is created inactive,
+// without password, for the caller to invite; otherwise the user has no
+// password either and signs in after a password reset.
+func ImportUser(db *gorm.DB, uid uint, userImport *UserImport, row *UserImportRow) (*User, error) {
+	user := &User{Login: row.Login, Name: row.Name, Email: row.Email, Lang: row.Language, ImportID: &userImport.ID}
+	active := row.Active && !userImport.Invite
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(user).Error; err != nil {
+			return err
+		}
+		if !active {
+			// Active defaults to true in the table: clear it once created
+			user.Active = false
+			if err := tx.Model(user).Update("active", false).Error; err != nil {
+				return err
+			}
+		}
+		for _, id := range row.GroupIDs {
+			if err := tx.Model(user).Association("Groups").Append(&ResGroups{BaseModel: BaseModel{ID: id}}); err != nil {
+				return err
+			}
+		}
+		return LogActivity(tx, uid, Activity{
+			Type:     ActivityUserCreated,
+			Severity: SeveritySuccess,
+			Model:    "res.users",
+			ResID:    user.ID,
+			Params: map[string]interface{}{
+				"login":        user.Login,
+				"name":         user.Name,
+				"invite":       userImport.Invite,
+				"import_id":    userImport.ID,
+				"operation_id": userImport.OperationID,
+			},
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// UserImportReport returns the CSV report of the rows of an import: their
+// line, login, email, status, user id and errors. The cells taken from the
+// uploaded file are neutralized with CSVText.
+func UserImportReport(rows []UserImportRow) []byte {
+	var buffer bytes.Buffer
+	writer := csv.NewWriter(&buffer)
+	writer.Write([]string{"row", "login", "email", "status", "user_id", "errors"})
+	for _, row := range rows {
+		userID := ""
+		if row.UserID != 0 {
+			userID = strconv.FormatUint(uint64(row.UserID), 10)
+		}
+		writer.Write([]string{strconv.Itoa(row.Row), CSVText(row.Login), CSVText(row.Email), row.Status, userID, CSVText(strings.Join(row.Errors, "; "))})
+	}
+	writer.Flush()
+	return buffer.Bytes()
+}
+
+// DeactivateUserImport deactivates the users an import created, recorded
+// in the activity feed of uid, and returns how many were active
+func DeactivateUserImport(db *gorm.DB, uid uint, userImport *UserImport, now time.Time) (int64, error) {
+	var deactivated int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&User{}).Where("import_id = ? AND active = ?", userImport.ID, true).Update("active", false)
+		if result.Error != nil {
+			return result.Error
+		}
+		deactivated = result.RowsAffected
+		if err := tx.Model(userImport).Update("deactivate_date", now).Error; err != nil {
+			return err
+		}
+		// Pending invitations would reactivate the users once accepted
+		err := tx.Model(&UserInvitation{}).
+			Where("user_id IN (?) AND accepted_at IS NULL AND revoked_at IS NULL", tx.Model(&User{}).Select("id").Where("import_id = ?", userImport.ID)).
+			Updates(map[string]interface{}{"revoked_at": now, "revoked_by": uid}).Error
+		if err != nil {
+			return err
+		}
+		return LogActivity(tx, uid, Activity{
+			Type:     ActivityUserImportDeactivated,
+			Severity: SeverityWarning,
+			Model:    UserImportModel,
+			ResID:    userImport.ID,
+			Params: map[string]interface{}{
+				"import_id": userImport.ID,
+				"file_name": userImport.FileName,
+				"count":     deactivated,
+			},
+		})
+	})
+	return deactivated, err
+}
@@ -0,0 +1,32 @@
+package models_test
+
+import (
+	"bytes"
+	"encoding/csv"
+	"slices"
+	"testing"
+
+	"goodoo/models"
+)
+
+// TestUserImportReportFormulas writes the report of rows whose login,
+// email and errors come from a file holding formulas: the cells are
+// neutralized, the others written as they are
+func TestUserImportReportFormulas(t *testing.T) {
+	rows := []models.UserImportRow{
+		{Row: 2, Login: formulas[0], Email: "@SUM(A1:A2)", Status: models.UserImportRowInvalid, Errors: []string{"=1+2 is not a login", "name is required"}},
+		{Row: 3, Login: "jdoe", Email: "jdoe@example.com", Status: models.UserImportRowCreated, UserID: 42},
+	}
+	records, err := csv.NewReader(bytes.NewReader(models.UserImportReport(rows))).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"row", "login", "email", "status", "user_id", "errors"},
+		{"2", "'" + formulas[0], "'@SUM(A1:A2)", "invalid", "", "'=1+2 is not a login; name is required"},
+		{"3", "jdoe", "jdoe@example.com", "created", "42", ""},
+	}
+	if !slices.EqualFunc(records, want, slices.Equal[[]string]) {
+		t.Errorf("report = %q, want %q", records, want)
+	}
+}
@@ -0,0 +1,343 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"goodoo/fields"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// UserPreference is a setting a user chose, e.g. the dashboard cards they
+// collapsed. Keys are namespaced ("<namespace>.<name>") and must be in
+// PreferenceSchema; values are stored as JSON.
+type UserPreference struct {
+	ID        uint      `gorm:"primaryKey;autoIncrement" json:"id"`
+	UserID    uint      `gorm:"column:user_id;not null;uniqueIndex:user_preference_key,priority:1" json:"user_id"`
+	Key       string    `gorm:"not null;uniqueIndex:user_preference_key,priority:2" json:"key"`
+	Value     string    `gorm:"type:jsonb;not null" json:"value"`
+	WriteDate time.Time `gorm:"column:write_date;autoUpdateTime" json:"write_date"`
+}
+
+func (UserPreference) TableName() string {
+	return "user_preference"
+}
+
+// Keys of the preferences read by the server
+const (
+	PrefDashboardCollapsedCards = "dashboard.collapsed_cards"
+	PrefDashboardCardOrder      = "dashboard.card_order"
+	PrefListPageSize            = "list.page_size"
+	PrefChatDefaultModel        = "chat.default_model"
+	// PrefNotificationOptOut lists the notification categories the user
+	// does not want, see NotificationCategories. The channels of
+	// PrefNotificationChannel supersede it; it counts for the categories
+	// without one.
+	PrefNotificationOptOut = "notification.opt_out"
+)
+
+// Preference value types
+const (
+	PrefTypeBool       = "bool"
+	PrefTypeInt        = "int"
+	PrefTypeString     = "string"
+	PrefTypeStringList = "string_list"
+)
+
+// PreferenceSpec describes the values a preference accepts
+type PreferenceSpec struct {
+	Type    string      `json:"type"`
+	Default interface{} `json:"default"`
+	// Min and Max bound integers; Max also bounds the length of strings
+	// and the size of lists
+	Min int `json:"min,omitempty"`
+	Max int `json:"max,omitempty"`
+	// Choices are the allowed strings or list items, any when empty
+	Choices []string `json:"choices,omitempty"`
+	// Session preferences are sent in the session info at login
+	Session bool `json:"session"`
+}
+
+// PreferenceSchema is the allow-list of the preferences users may store
+var PreferenceSchema = map[string]PreferenceSpec{
+	PrefDashboardCollapsedCards: {Type: PrefTypeStringList, Default: []string{}, Max: 50, Session: true},
+	PrefDashboardCardOrder:      {Type: PrefTypeStringList, Default: []string{}, Max: 50, Session: true},
+	PrefListPageSize:            {Type: PrefTypeInt, Default: 80, Min: 1, Max: 1000, Session: true},
+	PrefChatDefaultModel:        {Type: PrefTypeString, Default: "", Max: 128, Session: true},
+	PrefNotificationOptOut: {Type: PrefTypeStringList, Default: []string{}, Max: len(NotificationCategories),
+		Choices: NotificationCategories},
+}
+
+// maxPreferenceString bounds the strings of preferences without Max
+const maxPreferenceString = 256
+
+// PreferenceError reports an invalid preference value
+type PreferenceError struct {
+	Key    string
+	Reason string
+}
+
+func (e *PreferenceError) Error() string {
+	return fmt.Sprintf("preference %s: %s", e.Key, e.Reason)
+}
+
+// ValidatePreference checks a decoded JSON value against the schema and
+// returns it in the type of the preference
+func ValidatePreference(key string, value interface{}) (interface{}, error) {
+	spec, ok := PreferenceSchema[key]
+	if !ok {
+		return nil, &PreferenceError{Key: key, Reason: "unknown preference"}
+	}
+	invalid := func(reason string, args ...interface{}) error {
+		return &PreferenceError{Key: key, Reason: fmt.Sprintf(reason, args...)}
+	}
+	checkString := func(s string) error {
+		limit := spec.Max
+		if limit == 0 || spec.Type == PrefTypeStringList {
+			limit = maxPreferenceString
+		}
+		if len(s) > limit {
+			return invalid("strings are limited to %d bytes", limit)
+		}
+		if len(spec.Choices) > 0 && !slices.Contains(spec.Choices, s) {
+			return invalid("%q is not one of %s", s, strings.Join(spec.Choices, ", "))
+		}
+		return nil
+	}
+
+	switch spec.Type {
+	case PrefTypeBool:
+		if b, ok := value.(bool); ok {
+			return b, nil
+		}
+		return nil, invalid("must be a boolean")
+	case PrefTypeInt:
+		var n int
+		switch value.(type) {
+		case float64, json.Number, int:
+			converted, err := fields.ConvertToInt64(value)
+			if err != nil || converted < math.MinInt32 || converted > math.MaxInt32 {
+				return nil, invalid("must be an integer")
+			}
+			n = int(converted)
+		default:
+			return nil, invalid("must be an integer")
+		}
+		if n < spec.Min || (spec.Max > 0 && n > spec.Max) {
+			return nil, invalid("must be between %d and %d", spec.Min, spec.Max)
+		}
+		return n, nil
+	case PrefTypeString:
+		s, ok := value.(string)
+		if !ok {
+			return nil, invalid("must be a string")
+		}
+		return s, checkString(s)
+	case PrefTypeStringList:
+		var items []string
+		switch v := value.(type) {
+		case []string:
+			items = v
+		case []interface{}:
+			for _, item := range v {
+				s, ok := item.(string)
+				if !ok {
+					return nil, invalid("must be a list of strings")
+				}
+				items = append(items, s)
+			}
+		default:
+			return nil, invalid("must be a list of strings")
+		}
+		if spec.Max > 0 && len(items) > spec.Max {
+			return nil, invalid("holds at most %d items", spec.Max)
+		}
+		for _, item := range items {
+			if err := checkString(item); err != nil {
+				return nil, err
+			}
+		}
+		if items == nil {
+			items = []string{}
+		}
+		return items, nil
+	}
+	return nil, invalid("unsupported type %s", spec.Type)
+}
+
+// loadPreferences returns the stored preferences of a user in the schema,
+// decoded, by key; keys no longer in the schema and values no longer valid
+// are skipped
+func loadPreferences(db *gorm.DB, uid uint, keys ...string) (map[string]interface{}, error) {
+	var prefs []UserPreference
+	query := db.Where("user_id = ?", uid)
+	if len(keys) > 0 {
+		query = query.Where("key IN ?", keys)
+	}
+	if err := query.Find(&prefs).Error; err != nil {
+		return nil, err
+	}
+	values := make(map[string]interface{}, len(prefs))
+	for _, pref := range prefs {
+		var decoded interface{}
+		if json.Unmarshal([]byte(pref.Value), &decoded) != nil {
+			continue
+		}
+		if value, err := ValidatePreference(pref.Key, decoded); err == nil {
+			values[pref.Key] = value
+		}
+	}
+	return values, nil
+}
+
+// GetPreferences returns the preferences of a user, defaults included, by
+// key; only those of a namespace (e.g. "dashboard") when it is not empty
+func GetPreferences(db *gorm.DB, uid uint, namespace string) (map[string]interface{}, error) {
+	stored, err := loadPreferences(db, uid)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]interface{})
+	for key, spec := range PreferenceSchema {
+		if namespace != "" && !strings.HasPrefix(key, namespace+".") {
+			continue
+		}
+		if value, ok := stored[key]; ok {
+			values[key] = value
+		} else {
+			values[key] = spec.Default
+		}
+	}
+	return values, nil
+}
+
+// SessionPreferences returns the preferences sent in the session info
+func SessionPreferences(db *gorm.DB, uid uint) (map[string]interface{}, error) {
+	values, err := GetPreferences(db, uid, "")
+	if err != nil {
+		return nil, err
+	}
+	for key := range values {
+		if !PreferenceSchema[key].Session {
+			delete(values, key)
+		}
+	}
+	return values, nil
+}
+
+// lookupPref returns a stored preference; unreadable preferences count as
+// unset
+func lookupPref(db *gorm.DB, uid uint, key string) (interface{}, bool) {
+	if db == nil || uid == 0 {
+		return nil, false
+	}
+	values, err := loadPreferences(db, uid, key)
+	if err != nil {
+		return nil, false
+	}
+	value, ok := values[key]
+	return value, ok
+}
+
+// GetPrefString returns a preference of a user, or def when it is not set
+func GetPrefString(db *gorm.DB, uid uint, key, def string) string {
+	if value, ok := lookupPref(db, uid, key); ok {
+		if s, ok := value.(string); ok {
+			return s
+		}
+	}
+	return def
+}
+
+// GetPrefInt returns an integer preference, or def when it is not set
+func GetPrefInt(db *gorm.DB, uid uint, key string, def int) int {
+	if value, ok := lookupPref(db, uid, key); ok {
+		if n, ok := value.(int); ok {
+			return n
+		}
+	}
+	return def
+}
+
+// GetPrefBool returns a boolean preference, or def when it is not set
+func GetPrefBool(db *gorm.DB, uid uint, key string, def bool) bool {
+	if value, ok := lookupPref(db, uid, key); ok {
+		if b, ok := value.(bool); ok {
+			return b
+		}
+	}
+	return def
+}
+
+// GetPrefStrings returns a list preference, or def when it is not set
+func GetPrefStrings(db *gorm.DB, uid uint, key string, def []string) []string {
+	if value, ok := lookupPref(db, uid, key); ok {
+		if items, ok := value.([]string); ok {
+			return items
+		}
+	}
+	return def
+}
+
+// SetPref validates and stores a preference of a user
+func SetPref(db *gorm.DB, uid uint, key string, value interface{}) error {
+	return SetPreferences(db, uid, map[string]interface{}{key: value})
+}
+
+// SetPreferences validates and stores preferences of a user in one
+// transaction, leaving the others unchanged; a nil value resets a
+// preference to its default. Nothing is stored when a value is invalid.
+func SetPreferences(db *gorm.DB, uid uint, values map[string]interface{}) error {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var upserts []UserPreference
+	var resets []string
+	for _, key := range keys {
+		if values[key] == nil {
+			if _, ok := PreferenceSchema[key]; !ok {
+				return &PreferenceError{Key: key, Reason: "unknown preference"}
+			}
+			resets = append(resets, key)
+			continue
+		}
+		value, err := ValidatePreference(key, values[key])
+		if err != nil {
+			return err
+		}
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		upserts = append(upserts, UserPreference{UserID: uid, Key: key, Value: string(encoded)})
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if len(resets) > 0 {
+			if err := tx.Where("user_id = ? AND key IN ?", uid, resets).Delete(&UserPreference{}).Error; err != nil {
+				return err
+			}
+		}
+		if len(upserts) == 0 {
+			return nil
+		}
+		return tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "user_id"}, {Name: "key"}},
+			DoUpdates: clause.AssignmentColumns([]string{"value", "write_date"}),
+		}).Create(&upserts).Error
+	})
+}
+
+// DeleteUserPreferences removes the preferences of a user
+func DeleteUserPreferences(db *gorm.DB, uid uint) error {
+	return db.Where("user_id = ?", uid).Delete(&UserPreference{}).Error
+}
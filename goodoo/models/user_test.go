@@ -0,0 +1,203 @@
+package models_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"goodoo/models"
+	"goodoo/models/testutil"
+)
+
+func TestCheckPassword(t *testing.T) {
+	bcrypt := &models.User{}
+	if err := bcrypt.SetPassword("s3cret-pass"); err != nil {
+		t.Fatal(err)
+	}
+	odoo := &models.User{}
+	if err := odoo.SetPasswordOdooStyle("s3cret-pass"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		user     *models.User
+		password string
+		want     bool
+	}{
+		{"bcrypt", bcrypt, "s3cret-pass", true},
+		{"bcrypt wrong", bcrypt, "s3cret-Pass", false},
+		{"odoo pbkdf2", odoo, "s3cret-pass", true},
+		{"odoo pbkdf2 wrong", odoo, "other", false},
+		{"legacy plaintext", &models.User{Password: "plain"}, "plain", true},
+		{"legacy plaintext wrong", &models.User{Password: "plain"}, "Plain", false},
+		{"no password", &models.User{}, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.user.CheckPassword(tt.password); got != tt.want {
+				t.Errorf("CheckPassword(%q) = %v, want %v", tt.password, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckPasswordPolicy(t *testing.T) {
+	user := &models.User{Login: "jane", Email: "jane@example.com"}
+
+	tests := []struct {
+		name     string
+		password string
+		ok       bool
+	}{
+		{"long enough", "correct horse", true},
+		{"too short", "short", false},
+		{"counts characters, not bytes", "ééééééé", false},
+		{"login", "JANE", false},
+		{"email", "Jane@Example.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Without a database the minimum length is the default
+			err := user.CheckPasswordPolicy("no_such_database", tt.password)
+			var policyErr *models.PasswordPolicyError
+			if tt.ok && err != nil {
+				t.Errorf("CheckPasswordPolicy(%q) = %v, want nil", tt.password, err)
+			}
+			if !tt.ok && !errors.As(err, &policyErr) {
+				t.Errorf("CheckPasswordPolicy(%q) = %v, want a PasswordPolicyError", tt.password, err)
+			}
+		})
+	}
+}
+
+func TestResetPassword(t *testing.T) {
+	env := testutil.NewTestEnvironment(t)
+	now := time.Now()
+
+	tests := []struct {
+		name       string
+		expiration time.Time
+		found      bool
+	}{
+		{"valid token", now.Add(time.Hour), true},
+		{"expired token", now.Add(-time.Minute), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := env.Savepoint(t)
+			user := env.CreateUser()
+			token, err := user.GenerateSignupToken(env.Tx, tt.expiration)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			found, err := models.FindUserBySignupToken(env.Tx, token, now)
+			if !tt.found {
+				if err == nil {
+					t.Fatalf("FindUserBySignupToken found user %d, want none", found.ID)
+				}
+				return
+			}
+			if err != nil || found.ID != user.ID {
+				t.Fatalf("FindUserBySignupToken = %v, %v, want user %d", found, err, user.ID)
+			}
+
+			if err := found.ResetPassword(env.Tx, "new password"); err != nil {
+				t.Fatal(err)
+			}
+			var stored models.User
+			if err := env.Tx.First(&stored, user.ID).Error; err != nil {
+				t.Fatal(err)
+			}
+			if !stored.CheckPassword("new password") || stored.CheckPassword("password") {
+				t.Error("the new password does not replace the old one")
+			}
+			if _, err := models.FindUserBySignupToken(env.Tx, token, now); err == nil {
+				t.Error("the token still finds the user after the reset")
+			}
+		})
+	}
+
+	t.Run("unknown token", func(t *testing.T) {
+		for _, token := range []string{"", "not-a-token"} {
+			if _, err := models.FindUserBySignupToken(env.Tx, token, now); err == nil {
+				t.Errorf("FindUserBySignupToken(%q) found a user", token)
+			}
+		}
+	})
+}
+
+// TestUserSessionContext copies the language and timezone the user chose
+// into the session at login, over what the browser negotiated
+func TestUserSessionContext(t *testing.T) {
+	tests := []struct {
+		name string
+		user models.User
+		want map[string]interface{}
+	}{
+		{"no preference", models.User{}, map[string]interface{}{}},
+		{"language", models.User{Lang: "fr_FR"}, map[string]interface{}{"lang": "fr_FR"}},
+		{"language and timezone", models.User{Lang: "nl_BE", Tz: "Europe/Brussels"},
+			map[string]interface{}{"lang": "nl_BE", "tz": "Europe/Brussels", "timezone": "Europe/Brussels"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.user.SessionContext(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SessionContext = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestUserHistoricalShapes authenticates and lists the users of a
+// res_users table from before login_date, then migrates it: the column is
+// added empty and the users keep logging in
+func TestUserHistoricalShapes(t *testing.T) {
+	env := testutil.NewTestEnvironment(t)
+	bcrypt := env.CreateUser()
+	odoo := env.CreateUser(func(u *models.User) {
+		if err := u.SetPasswordOdooStyle("password"); err != nil {
+			t.Fatal(err)
+		}
+	})
+	ids := []uint{bcrypt.ID, odoo.ID}
+	if err := env.Tx.Exec("ALTER TABLE res_users DROP COLUMN login_date").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(shape string) {
+		t.Helper()
+		for _, login := range []string{bcrypt.Login, odoo.Login} {
+			user, err := models.FindUserByLogin(env.Tx, login)
+			if err != nil || !user.CheckPassword("password") {
+				t.Errorf("%s: %s does not authenticate: %v", shape, login, err)
+			}
+		}
+		var users []models.User
+		if err := env.Tx.Where("id IN ?", ids).Order("id").Find(&users).Error; err != nil {
+			t.Fatalf("%s: listing the users: %v", shape, err)
+		}
+		if len(users) != 2 || users[0].Login != bcrypt.Login || !users[1].Active || users[1].LastLogin != nil {
+			t.Errorf("%s: users = %+v", shape, users)
+		}
+	}
+	check("without login_date")
+
+	if err := env.Tx.AutoMigrate(&models.User{}); err != nil {
+		t.Fatal(err)
+	}
+	check("migrated")
+	now := time.Now().UTC().Truncate(time.Second)
+	if err := env.Tx.Model(bcrypt).Update("login_date", now).Error; err != nil {
+		t.Fatal(err)
+	}
+	var stored models.User
+	if err := env.Tx.First(&stored, bcrypt.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if stored.LastLogin == nil || !stored.LastLogin.Equal(now) {
+		t.Errorf("login_date = %v, want %v", stored.LastLogin, now)
+	}
+}
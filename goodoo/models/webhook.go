@@ -0,0 +1,78 @@
+package models
+
+import (
+	"time"
+
+	"goodoo/crypto"
+)
+
+// Webhook delivery states; a delivery still failing after the webhook's
+// MaxAttempts is dead-lettered
+const (
+	WebhookDeliveryPending = "pending"
+	WebhookDeliverySent    = "sent"
+	WebhookDeliveryDead    = "dead"
+)
+
+// Webhook posts record events of a model to an external URL
+type Webhook struct {
+	BaseModel
+	Name  string `gorm:"not null" json:"name"`
+	URL   string `gorm:"column:url;not null" json:"url"`
+	Model string `gorm:"not null;index" json:"model"`
+	// Events is a comma-separated list of create, write and unlink
+	Events string `gorm:"not null;default:create,write,unlink" json:"events"`
+	// Domain is a JSON domain the record must match, e.g. [["state","=","sale"]]
+	Domain string `gorm:"type:text" json:"domain"`
+	// Secret signs the payloads; it is only returned when the webhook is
+	// created and is encrypted at rest
+	Secret      crypto.EncryptedString `gorm:"not null" json:"-"`
+	MaxAttempts int                    `gorm:"column:max_attempts;default:5" json:"max_attempts"`
+	Active      bool                   `gorm:"default:true;index" json:"active"`
+}
+
+func (Webhook) TableName() string {
+	return "webhook"
+}
+
+func init() {
+	crypto.RegisterColumn("webhook", "secret", false)
+}
+
+// WebhookDelivery is one event queued for a webhook
+type WebhookDelivery struct {
+	BaseModel
+	WebhookID      uint       `gorm:"column:webhook_id;not null;index" json:"webhook_id"`
+	Event          string     `gorm:"not null" json:"event"`
+	ResID          uint       `gorm:"column:res_id" json:"res_id"`
+	Payload        string     `gorm:"type:text;not null" json:"payload"`
+	State          string     `gorm:"default:pending;index" json:"state"`
+	Attempts       int        `gorm:"default:0" json:"attempts"`
+	NextAttempt    time.Time  `gorm:"column:next_attempt;index" json:"next_attempt"`
+	ResponseStatus int        `gorm:"column:response_status" json:"response_status,omitempty"`
+	Error          string     `gorm:"type:text" json:"error,omitempty"`
+	DeliveredAt    *time.Time `gorm:"column:delivered_at" json:"delivered_at,omitempty"`
+	// RedeliveryOf is the delivery this one was copied from by a redelivery
+	RedeliveryOf *uint `gorm:"column:redelivery_of" json:"redelivery_of,omitempty"`
+	// Log holds the recorded attempts when preloaded
+	Log []WebhookDeliveryAttempt `gorm:"foreignKey:DeliveryID" json:"log,omitempty"`
+}
+
+func (WebhookDelivery) TableName() string {
+	return "webhook_delivery"
+}
+
+// WebhookDeliveryAttempt records the response to one POST of a delivery
+type WebhookDeliveryAttempt struct {
+	ID           uint      `gorm:"primaryKey;autoIncrement" json:"id"`
+	DeliveryID   uint      `gorm:"column:delivery_id;not null;index" json:"delivery_id"`
+	AttemptedAt  time.Time `gorm:"column:attempted_at" json:"attempted_at"`
+	DurationMs   int64     `gorm:"column:duration_ms" json:"duration_ms"`
+	Status       int       `gorm:"" json:"status,omitempty"`
+	ResponseBody string    `gorm:"column:response_body;type:text" json:"response_body,omitempty"`
+	Error        string    `gorm:"type:text" json:"error,omitempty"`
+}
+
+func (WebhookDeliveryAttempt) TableName() string {
+	return "webhook_delivery_attempt"
+}
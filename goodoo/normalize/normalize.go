@@ -0,0 +1,101 @@
+// Package normalize holds the text normalizations shared by the features
+// comparing values typed by people, such as duplicate detection: trimming,
+// case folding, diacritics stripping and email canonicalization.
+//
+// Text and Email return matching keys. Each has an SQL twin, TextSQL and
+// EmailSQL, building the same key in PostgreSQL from a column with
+// immutable functions only, so that the key can be indexed and compared
+// with the Go key of a candidate value.
+package normalize
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Trim removes the leading and trailing spaces of a text and collapses
+// its inner runs of whitespace to a single space
+func Trim(text string) string {
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// Casefold folds the case of a text for caseless comparisons, so that
+// "Straße" and "STRASSE" fold the same
+func Casefold(text string) string {
+	return cases.Fold().String(text)
+}
+
+// StripDiacritics removes the accents and other combining marks of a text:
+// "Crème brûlée" becomes "Creme brulee". Letters without a decomposition,
+// such as "ø" or "ß", are kept.
+func StripDiacritics(text string) string {
+	stripped, _, err := transform.String(transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC), text)
+	if err != nil {
+		return text
+	}
+	return stripped
+}
+
+// subAddress matches the +tag sub-address of an email
+var subAddress = regexp.MustCompile(`\+[^@]*@`)
+
+// Email canonicalizes an email address: trimmed, lowercased, without a
+// mailto: prefix nor a +tag sub-address, so that " Jane+news@Example.com"
+// and "jane@example.com" match
+func Email(email string) string {
+	email = strings.ToLower(strings.Trim(email, " \t\r\n"))
+	email = strings.TrimPrefix(email, "mailto:")
+	return subAddress.ReplaceAllString(email, "@")
+}
+
+// EmailSQL returns the SQL expression of the Email key of a column
+func EmailSQL(column string) string {
+	return fmt.Sprintf(`regexp_replace(regexp_replace(lower(btrim(%s, E' \t\r\n')), '^mailto:', ''), '\+[^@]*@', '@')`, column)
+}
+
+// foldedLetters maps the accented Latin letters to their base letter. It
+// is the subset of StripDiacritics that PostgreSQL translate() can apply
+// without an extension, and makes Text and TextSQL agree.
+var foldedLetters, foldedFrom, foldedTo = buildFoldedLetters()
+
+// buildFoldedLetters collects the letters of the Latin-1 Supplement and
+// Latin Extended blocks that strip to a single ASCII letter
+func buildFoldedLetters() (map[rune]rune, string, string) {
+	letters := make(map[rune]rune)
+	var from, to strings.Builder
+	for r := rune(0xC0); r <= 0x24F; r++ {
+		stripped := []rune(StripDiacritics(string(r)))
+		if len(stripped) != 1 || stripped[0] == r || stripped[0] > unicode.MaxASCII || !unicode.IsLetter(stripped[0]) {
+			continue
+		}
+		letters[r] = stripped[0]
+		from.WriteRune(r)
+		to.WriteRune(stripped[0])
+	}
+	return letters, from.String(), to.String()
+}
+
+// Text returns the caseless, accentless key of a text, such as a name:
+// trimmed, with its whitespace collapsed, its accented Latin letters
+// folded and lowercased
+func Text(text string) string {
+	folded := strings.Map(func(r rune) rune {
+		if base, ok := foldedLetters[r]; ok {
+			return base
+		}
+		return r
+	}, Trim(text))
+	return strings.ToLower(folded)
+}
+
+// TextSQL returns the SQL expression of the Text key of a column
+func TextSQL(column string) string {
+	return fmt.Sprintf(`lower(translate(btrim(regexp_replace(%s, '\s+', ' ', 'g')), '%s', '%s'))`, column, foldedFrom, foldedTo)
+}
@@ -0,0 +1,267 @@
+package notification
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"goodoo/clock"
+	"goodoo/database"
+	"goodoo/logging"
+	"goodoo/mail"
+	"goodoo/models"
+	"goodoo/scheduler"
+	"gorm.io/gorm"
+)
+
+// Mail templates of the notifications
+const (
+	notificationMailTemplate = "mail_notification"
+	digestMailTemplate       = "mail_notification_digest"
+)
+
+// deliveryBatch bounds the notifications mailed right away per run
+const deliveryBatch = 500
+
+// errDelivered is returned when another run mailed a notification first
+var errDelivered = errors.New("notification already delivered")
+
+// Delivery mails the notifications of the email and digest channels of one
+// database
+type Delivery struct {
+	dbName   string
+	logger   *logging.Logger
+	clock    clock.Clock
+	renderer mail.Renderer
+}
+
+// NewDelivery creates the delivery of a database rendering mails with
+// renderer, deciding which digests are due with clk, the system clock
+// when nil
+func NewDelivery(dbName string, clk clock.Clock, renderer mail.Renderer) *Delivery {
+	return &Delivery{dbName: dbName, logger: logging.GetLogger("goodoo.notification.delivery"), clock: clock.OrReal(clk), renderer: renderer}
+}
+
+// ScheduleDelivery registers the job mailing the notifications of a
+// database every interval
+func ScheduleDelivery(s *scheduler.Scheduler, dbName string, renderer mail.Renderer, interval time.Duration) {
+	s.Every("notification.delivery."+dbName, interval, NewDelivery(dbName, s.Clock(), renderer).Tick)
+}
+
+// Tick mails the notifications waiting to be mailed right away, then the
+// digests that are due
+func (d *Delivery) Tick(ctx context.Context) error {
+	db, err := database.GetDatabase(d.dbName)
+	if err != nil {
+		return err
+	}
+	db = db.WithContext(ctx)
+	if err := d.sendImmediate(ctx, db); err != nil {
+		return err
+	}
+	return d.sendDigests(ctx, db)
+}
+
+// recipient returns the user a notification is mailed to, nil when they
+// are archived or have no email address
+func (d *Delivery) recipient(db *gorm.DB, users map[uint]*models.User, userID uint) *models.User {
+	if user, ok := users[userID]; ok {
+		return user
+	}
+	var user models.User
+	if err := db.First(&user, userID).Error; err != nil || !user.Active || user.Email == "" {
+		users[userID] = nil
+		return nil
+	}
+	users[userID] = &user
+	return &user
+}
+
+// link returns the URL of the web client, empty when ParamWebBaseURL is
+// not set
+func (d *Delivery) link() string {
+	return strings.TrimRight(models.GetParamString(d.dbName, models.ParamWebBaseURL, ""), "/")
+}
+
+// markEmailed moves notifications from the email state from to state;
+// it fails with errDelivered when another run moved one of them first
+func markEmailed(tx *gorm.DB, ids []uint, from, state string, now time.Time) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	result := tx.Model(&models.Notification{}).Where("id IN ? AND email = ?", ids, from).
+		Updates(map[string]interface{}{"email": state, "emailed_at": now})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected != int64(len(ids)) {
+		return errDelivered
+	}
+	return nil
+}
+
+// sendImmediate mails each notification of the email channel
+func (d *Delivery) sendImmediate(ctx context.Context, db *gorm.DB) error {
+	var notifications []models.Notification
+	if err := db.Where("email = ?", models.NotificationEmailImmediate).Order("id").Limit(deliveryBatch).
+		Find(&notifications).Error; err != nil {
+		return err
+	}
+
+	users := make(map[uint]*models.User)
+	sent := 0
+	for i := range notifications {
+		if ctx.Err() != nil {
+			break
+		}
+		notification := &notifications[i]
+		now := d.clock.Now()
+		user := d.recipient(db, users, notification.UserID)
+		if user == nil {
+			if err := markEmailed(db, []uint{notification.ID}, models.NotificationEmailImmediate, models.NotificationEmailSuppressed, now); err != nil && !errors.Is(err, errDelivered) {
+				return err
+			}
+			continue
+		}
+		data := map[string]interface{}{
+			"User":         user,
+			"Notification": notification,
+			"Date":         notification.CreateDate.In(userLocation(user)).Format("2006-01-02 15:04"),
+			"Link":         d.link(),
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := markEmailed(tx, []uint{notification.ID}, models.NotificationEmailImmediate, models.NotificationEmailSent, now); err != nil {
+				return err
+			}
+			return mail.QueueTemplate(tx, d.renderer, notificationMailTemplate, user.Lang, []string{user.Email}, data)
+		})
+		switch {
+		case errors.Is(err, errDelivered):
+		case err != nil:
+			d.logger.Error("Failed to mail notification %d of %s: %v", notification.ID, d.dbName, err)
+		default:
+			sent++
+		}
+	}
+	if sent > 0 {
+		d.logger.Info("Mailed %d notification(s) of %s", sent, d.dbName)
+	}
+	return nil
+}
+
+// userLocation returns the timezone of a user, UTC when they have none
+func userLocation(user *models.User) *time.Location {
+	if user.Tz != "" {
+		if location, err := time.LoadLocation(user.Tz); err == nil {
+			return location
+		}
+	}
+	return time.UTC
+}
+
+// LastDigest returns the last time at or before now at which the digest
+// hour struck in location: the notifications created before it are due
+func LastDigest(now time.Time, location *time.Location, hour int) time.Time {
+	local := now.In(location)
+	digest := time.Date(local.Year(), local.Month(), local.Day(), hour, 0, 0, 0, location)
+	if digest.After(local) {
+		digest = time.Date(local.Year(), local.Month(), local.Day()-1, hour, 0, 0, 0, location)
+	}
+	return digest
+}
+
+// digestItem is a notification in a digest, dated in the user's timezone
+type digestItem struct {
+	Title    string
+	Body     string
+	Type     string
+	Category string
+	Date     string
+}
+
+// sendDigests mails every user with notifications of the digest channel
+// created before their last digest hour one summary of those still
+// unread; those read in the meantime are not mailed
+func (d *Delivery) sendDigests(ctx context.Context, db *gorm.DB) error {
+	var pending []struct {
+		UserID uint
+		Oldest time.Time
+	}
+	if err := db.Model(&models.Notification{}).Select("user_id, MIN(create_date) AS oldest").
+		Where("email = ?", models.NotificationEmailDigest).Group("user_id").Scan(&pending).Error; err != nil {
+		return err
+	}
+
+	hour := DigestHour(d.dbName)
+	users := make(map[uint]*models.User)
+	sent := 0
+	for _, entry := range pending {
+		if ctx.Err() != nil {
+			break
+		}
+		now := d.clock.Now()
+		user := d.recipient(db, users, entry.UserID)
+		location := time.UTC
+		if user != nil {
+			location = userLocation(user)
+		}
+		digest := LastDigest(now, location, hour)
+		if !entry.Oldest.Before(digest) {
+			continue
+		}
+
+		var notifications []models.Notification
+		if err := db.Where("user_id = ? AND email = ? AND create_date < ?", entry.UserID, models.NotificationEmailDigest, digest).
+			Order("create_date, id").Find(&notifications).Error; err != nil {
+			return err
+		}
+		var unread, suppressed []uint
+		var items []digestItem
+		for _, notification := range notifications {
+			if user == nil || notification.ReadAt != nil {
+				suppressed = append(suppressed, notification.ID)
+				continue
+			}
+			unread = append(unread, notification.ID)
+			items = append(items, digestItem{
+				Title:    notification.Title,
+				Body:     notification.Body,
+				Type:     notification.Type,
+				Category: notification.Category,
+				Date:     notification.CreateDate.In(location).Format("2006-01-02 15:04"),
+			})
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := markEmailed(tx, suppressed, models.NotificationEmailDigest, models.NotificationEmailSuppressed, now); err != nil {
+				return err
+			}
+			if len(unread) == 0 {
+				return nil
+			}
+			if err := markEmailed(tx, unread, models.NotificationEmailDigest, models.NotificationEmailSent, now); err != nil {
+				return err
+			}
+			data := map[string]interface{}{
+				"User":          user,
+				"Notifications": items,
+				"Count":         len(items),
+				"Date":          digest.Format("2006-01-02"),
+				"Link":          d.link(),
+			}
+			return mail.QueueTemplate(tx, d.renderer, digestMailTemplate, user.Lang, []string{user.Email}, data)
+		})
+		switch {
+		case errors.Is(err, errDelivered):
+		case err != nil:
+			d.logger.Error("Failed to mail the notification digest of user %d of %s: %v", entry.UserID, d.dbName, err)
+		case len(unread) > 0:
+			sent++
+		}
+	}
+	if sent > 0 {
+		d.logger.Info("Mailed %d notification digest(s) of %s", sent, d.dbName)
+	}
+	return nil
+}
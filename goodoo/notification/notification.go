@@ -0,0 +1,204 @@
+// Package notification records the system events addressed to a user,
+// like a background operation that finished or a change to their account,
+// and pushes the user's unread count on the bus so clients update their
+// badge without polling. Read notifications are pruned after a retention
+// period.
+package notification
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"goodoo/bus"
+	"goodoo/database"
+	"goodoo/logging"
+	"goodoo/models"
+	"goodoo/scheduler"
+	"gorm.io/gorm"
+)
+
+// Channel is the bus channel of unread counts; payloads are Unread values
+const Channel = "notification"
+
+// Config holds the retention of notifications
+type Config struct {
+	// Retention is how long read notifications are kept
+	Retention time.Duration
+}
+
+// DefaultConfig returns a retention of 30 days
+func DefaultConfig() *Config {
+	return &Config{
+		Retention: 30 * 24 * time.Hour,
+	}
+}
+
+// LoadFromEnv overrides the configuration with GOODOO_NOTIFICATION_RETENTION
+func (c *Config) LoadFromEnv() {
+	if value := os.Getenv("GOODOO_NOTIFICATION_RETENTION"); value != "" {
+		if d, err := time.ParseDuration(value); err == nil && d > 0 {
+			c.Retention = d
+		}
+	}
+}
+
+var (
+	config = DefaultConfig()
+	mutex  sync.RWMutex
+	logger = logging.GetLogger("goodoo.notification")
+)
+
+// Setup installs the process-wide notification configuration
+func Setup(c *Config) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	config = c
+}
+
+// CurrentConfig returns the notification configuration
+func CurrentConfig() *Config {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return config
+}
+
+// Unread is the unread count of a user, published on Channel when it changes
+type Unread struct {
+	UserID uint  `json:"user_id"`
+	Count  int64 `json:"unread"`
+}
+
+// Notify records a notification of a category for a user of a database
+// and publishes their new unread count; payload may be nil. It writes
+// through its own connection rather than the caller's transaction, so a
+// notification reporting a failure survives the rollback of that failure.
+// Nothing is recorded for user 0, nor for users who turned the category
+// off; the notifications of the email and digest channels are queued for
+// the delivery job (see ScheduleDelivery).
+func Notify(dbName string, userID uint, category, kind, title, body string, payload map[string]interface{}) (*models.Notification, error) {
+	if userID == 0 {
+		return nil, nil
+	}
+	db, err := database.GetDatabase(dbName)
+	if err != nil {
+		return nil, err
+	}
+	channel := ChannelOf(db, dbName, userID, category)
+	if channel == models.NotificationChannelOff {
+		return nil, nil
+	}
+
+	notification := &models.Notification{UserID: userID, Type: kind, Title: title, Body: body, Category: category}
+	switch channel {
+	case models.NotificationChannelEmail:
+		notification.Email = models.NotificationEmailImmediate
+	case models.NotificationChannelDigest:
+		notification.Email = models.NotificationEmailDigest
+	}
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		encoded := string(data)
+		notification.Payload = &encoded
+	}
+	if err := db.Create(notification).Error; err != nil {
+		logger.Error("Failed to notify user %d of %s: %v", userID, dbName, err)
+		return nil, err
+	}
+	publishUnread(db, dbName, userID)
+	return notification, nil
+}
+
+// OptedOut reports whether a user turned a category of notifications off
+// in a database; mandatory categories cannot be turned off
+func OptedOut(db *gorm.DB, dbName string, userID uint, category string) bool {
+	return ChannelOf(db, dbName, userID, category) == models.NotificationChannelOff
+}
+
+// UnreadCount returns the number of unread notifications of a user
+func UnreadCount(db *gorm.DB, userID uint) (int64, error) {
+	var count int64
+	err := db.Model(&models.Notification{}).Where("user_id = ? AND read_at IS NULL", userID).Count(&count).Error
+	return count, err
+}
+
+// publishUnread publishes the unread count of a user
+func publishUnread(db *gorm.DB, dbName string, userID uint) {
+	count, err := UnreadCount(db, userID)
+	if err != nil {
+		logger.Warning("Failed to count the notifications of user %d of %s: %v", userID, dbName, err)
+		return
+	}
+	bus.Publish(dbName, Channel, Unread{UserID: userID, Count: count})
+}
+
+// List returns a page of the notifications of a user, newest first, and
+// how many there are in total
+func List(db *gorm.DB, userID uint, unreadOnly bool, offset, limit int) ([]models.Notification, int64, error) {
+	query := db.Model(&models.Notification{}).Where("user_id = ?", userID)
+	if unreadOnly {
+		query = query.Where("read_at IS NULL")
+	}
+	var total int64
+	if err := query.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	var notifications []models.Notification
+	if err := query.Order("create_date DESC, id DESC").Offset(offset).Limit(limit).Find(&notifications).Error; err != nil {
+		return nil, 0, err
+	}
+	return notifications, total, nil
+}
+
+// MarkRead marks notifications of a user as read, all of them when ids is
+// nil, publishes the new unread count and returns how many were marked
+func MarkRead(db *gorm.DB, dbName string, userID uint, ids []uint) (int64, error) {
+	query := db.Model(&models.Notification{}).Where("user_id = ? AND read_at IS NULL", userID)
+	if ids != nil {
+		query = query.Where("id IN ?", ids)
+	}
+	result := query.Update("read_at", time.Now())
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	if result.RowsAffected > 0 {
+		publishUnread(db, dbName, userID)
+	}
+	return result.RowsAffected, nil
+}
+
+// Subscribe calls fn with the unread counts of a user of a database until
+// the returned function is called. fn must not block.
+func Subscribe(dbName string, userID uint, fn func(Unread)) (unsubscribe func()) {
+	return bus.Subscribe(Channel, func(message bus.Message) {
+		if unread, ok := message.Payload.(Unread); ok && message.DB == dbName && unread.UserID == userID {
+			fn(unread)
+		}
+	})
+}
+
+// Prune deletes the notifications read before the retention period
+func Prune(db *gorm.DB, retention time.Duration) (int64, error) {
+	result := db.Where("read_at IS NOT NULL AND read_at < ?", time.Now().Add(-retention)).Delete(&models.Notification{})
+	return result.RowsAffected, result.Error
+}
+
+// Schedule registers the job pruning the read notifications of a database every interval
+func Schedule(s *scheduler.Scheduler, dbName string, interval time.Duration) {
+	s.Every("notification.prune."+dbName, interval, func(ctx context.Context) error {
+		db, err := database.GetDatabase(dbName)
+		if err != nil {
+			return err
+		}
+		deleted, err := Prune(db.WithContext(ctx), CurrentConfig().Retention)
+		if deleted > 0 {
+			logger.Info("Deleted %d read notification(s) of %s", deleted, dbName)
+		}
+		return err
+	})
+}
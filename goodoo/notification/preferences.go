@@ -0,0 +1,174 @@
+package notification
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"goodoo/models"
+	"gorm.io/gorm"
+)
+
+// System parameters of the delivery of notifications
+const (
+	// ParamDefaultChannels overrides the channel of categories for the
+	// users who did not choose one, as in "mention=digest,report=email"
+	ParamDefaultChannels = "notification.default_channels"
+	// ParamDigestHour is the hour of the day, in the timezone of each
+	// user, at which digests are sent
+	ParamDigestHour = "notification.digest_hour"
+)
+
+// DefaultDigestHour is the digest hour when ParamDigestHour is not set
+const DefaultDigestHour = 8
+
+// builtinChannels are the channels of the categories the database does
+// not configure; the others are NotificationChannelInApp
+var builtinChannels = map[string]string{
+	models.NotificationCategorySecurity: models.NotificationChannelEmail,
+}
+
+// ParseChannels parses a list of category=channel pairs, as in
+// ParamDefaultChannels
+func ParseChannels(value string) (map[string]string, error) {
+	channels := make(map[string]string)
+	for _, item := range strings.Split(value, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		category, channel, found := strings.Cut(item, "=")
+		category, channel = strings.TrimSpace(category), strings.TrimSpace(channel)
+		if !found {
+			return nil, fmt.Errorf("invalid channel %q: expected category=channel", item)
+		}
+		if !slices.Contains(models.AllNotificationCategories, category) {
+			return nil, fmt.Errorf("unknown notification category %q", category)
+		}
+		if !slices.Contains(models.NotificationChannelChoices(category), channel) {
+			return nil, fmt.Errorf("%q is not a channel of %s notifications", channel, category)
+		}
+		channels[category] = channel
+	}
+	return channels, nil
+}
+
+func init() {
+	models.RegisterParamValidator(ParamDefaultChannels, func(value string) error {
+		_, err := ParseChannels(value)
+		return err
+	})
+	models.RegisterParamValidator(ParamDigestHour, func(value string) error {
+		if hour, err := strconv.Atoi(strings.TrimSpace(value)); err != nil || hour < 0 || hour > 23 {
+			return fmt.Errorf("invalid digest hour %q: expected 0 to 23", value)
+		}
+		return nil
+	})
+}
+
+// DefaultChannel returns the channel of a category for the users of a
+// database who did not choose one
+func DefaultChannel(dbName, category string) string {
+	if value := models.GetParamString(dbName, ParamDefaultChannels, ""); value != "" {
+		if channels, err := ParseChannels(value); err == nil {
+			if channel, ok := channels[category]; ok {
+				return channel
+			}
+		}
+	}
+	if channel, ok := builtinChannels[category]; ok {
+		return channel
+	}
+	return models.NotificationChannelInApp
+}
+
+// DigestHour returns the hour at which the digests of a database are sent
+func DigestHour(dbName string) int {
+	hour := models.GetParamInt(dbName, ParamDigestHour, DefaultDigestHour)
+	if hour < 0 || hour > 23 {
+		return DefaultDigestHour
+	}
+	return hour
+}
+
+// ChannelOf returns the channel of a category of notifications for a user:
+// the one they chose, off when they opted out of the category before
+// channels existed, or the database default. Mandatory categories are
+// never off.
+func ChannelOf(db *gorm.DB, dbName string, userID uint, category string) string {
+	choices := models.NotificationChannelChoices(category)
+	if channel := models.GetPrefString(db, userID, models.PrefNotificationChannel(category), ""); slices.Contains(choices, channel) {
+		return channel
+	}
+	if slices.Contains(choices, models.NotificationChannelOff) &&
+		slices.Contains(models.GetPrefStrings(db, userID, models.PrefNotificationOptOut, nil), category) {
+		return models.NotificationChannelOff
+	}
+	if channel := DefaultChannel(dbName, category); slices.Contains(choices, channel) {
+		return channel
+	}
+	return models.NotificationChannelInApp
+}
+
+// CategoryPreference is the channel of a category of notifications for a
+// user
+type CategoryPreference struct {
+	Category string `json:"category"`
+	Channel  string `json:"channel"`
+	// Default is the database default, used when the user chose nothing
+	Default string `json:"default"`
+	// Custom tells whether the user chose the channel
+	Custom    bool     `json:"custom"`
+	Mandatory bool     `json:"mandatory"`
+	Channels  []string `json:"channels"`
+}
+
+// Preferences returns the channel of every category for a user
+func Preferences(db *gorm.DB, dbName string, userID uint) []CategoryPreference {
+	preferences := make([]CategoryPreference, 0, len(models.AllNotificationCategories))
+	for _, category := range models.AllNotificationCategories {
+		choices := models.NotificationChannelChoices(category)
+		chosen := models.GetPrefString(db, userID, models.PrefNotificationChannel(category), "")
+		defaultChannel := DefaultChannel(dbName, category)
+		if !slices.Contains(choices, defaultChannel) {
+			defaultChannel = models.NotificationChannelInApp
+		}
+		preferences = append(preferences, CategoryPreference{
+			Category:  category,
+			Channel:   ChannelOf(db, dbName, userID, category),
+			Default:   defaultChannel,
+			Custom:    slices.Contains(choices, chosen),
+			Mandatory: slices.Contains(models.MandatoryNotificationCategories, category),
+			Channels:  choices,
+		})
+	}
+	return preferences
+}
+
+// SetChannels stores the channels a user chose, by category; an empty
+// channel resets a category to the database default. Nothing is stored
+// when a category or channel is invalid. Choosing channels clears the
+// categories from PrefNotificationOptOut, which they supersede.
+func SetChannels(db *gorm.DB, userID uint, channels map[string]string) error {
+	values := make(map[string]interface{}, len(channels))
+	for category, channel := range channels {
+		if !slices.Contains(models.AllNotificationCategories, category) {
+			return &models.PreferenceError{Key: models.PrefNotificationChannel(category), Reason: "unknown notification category"}
+		}
+		if channel == "" {
+			values[models.PrefNotificationChannel(category)] = nil
+		} else {
+			values[models.PrefNotificationChannel(category)] = channel
+		}
+	}
+	if optOut := models.GetPrefStrings(db, userID, models.PrefNotificationOptOut, nil); len(optOut) > 0 {
+		kept := slices.DeleteFunc(slices.Clone(optOut), func(category string) bool {
+			_, ok := channels[category]
+			return ok
+		})
+		if len(kept) != len(optOut) {
+			values[models.PrefNotificationOptOut] = kept
+		}
+	}
+	return models.SetPreferences(db, userID, values)
+}
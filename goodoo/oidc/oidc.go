@@ -0,0 +1,400 @@
+// Package oidc signs users in with an OpenID Connect provider (Keycloak,
+// Azure AD, Google...) using the authorization code flow with PKCE. The
+// provider is configured with GOODOO_OIDC_* variables, which the auth_oidc.*
+// system parameters of a database override.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"goodoo/httpclient"
+	"goodoo/models"
+)
+
+// Failures of the sign-in flow; the callback reports each with its own page
+var (
+	ErrNotConfigured    = errors.New("single sign-on is not configured")
+	ErrDiscovery        = errors.New("identity provider is unreachable or misconfigured")
+	ErrProviderDenied   = errors.New("identity provider denied the sign-in")
+	ErrInvalidState     = errors.New("sign-in request is unknown or has expired")
+	ErrTokenExchange    = errors.New("authorization code exchange failed")
+	ErrInvalidSignature = errors.New("ID token signature is invalid")
+	ErrInvalidToken     = errors.New("ID token is invalid")
+	ErrTokenExpired     = errors.New("ID token has expired or is not valid yet")
+	ErrNonceMismatch    = errors.New("ID token nonce does not match the sign-in request")
+	ErrUnknownUser      = errors.New("no user matches the identity")
+	ErrAccountConflict  = errors.New("user is already linked to another identity")
+)
+
+// Keys of the system parameters overriding the configuration
+const (
+	ParamIssuer        = "auth_oidc.issuer"
+	ParamClientID      = "auth_oidc.client_id"
+	ParamClientSecret  = "auth_oidc.client_secret"
+	ParamScopes        = "auth_oidc.scopes"
+	ParamRedirectURL   = "auth_oidc.redirect_url"
+	ParamLabel         = "auth_oidc.label"
+	ParamLoginClaim    = "auth_oidc.login_claim"
+	ParamAutoProvision = "auth_oidc.auto_provision"
+	ParamDefaultGroup  = "auth_oidc.default_group"
+	ParamEndSession    = "auth_oidc.end_session"
+)
+
+// Config describes the identity provider
+type Config struct {
+	// Issuer is the issuer URL; its discovery document gives the endpoints
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	// RedirectURL is the callback registered at the provider; empty derives
+	// it from the host of the sign-in request
+	RedirectURL string
+	// Label names the provider on the login page
+	Label string
+	// LoginClaim is the claim matched against the login or email of users
+	// not linked to their subject yet: email, preferred_username or sub
+	LoginClaim string
+	// AutoProvision creates unknown users, members of DefaultGroup (an
+	// external id such as "base.group_user") when set
+	AutoProvision bool
+	DefaultGroup  string
+	// EndSession also signs out of the provider on logout
+	EndSession bool
+	// ClockSkew is tolerated on the token timestamps
+	ClockSkew time.Duration
+	// CacheTTL is how long the discovery document and signing keys are kept
+	CacheTTL time.Duration
+}
+
+// DefaultConfig returns a disabled provider matching users by email
+func DefaultConfig() *Config {
+	return &Config{
+		Scopes:     []string{"openid", "email", "profile"},
+		Label:      "Single Sign-On",
+		LoginClaim: "email",
+		ClockSkew:  2 * time.Minute,
+		CacheTTL:   time.Hour,
+	}
+}
+
+// LoadFromEnv overrides the configuration with GOODOO_OIDC_* variables
+func (c *Config) LoadFromEnv() {
+	if value := os.Getenv("GOODOO_OIDC_ISSUER"); value != "" {
+		c.Issuer = value
+	}
+	if value := os.Getenv("GOODOO_OIDC_CLIENT_ID"); value != "" {
+		c.ClientID = value
+	}
+	if value := os.Getenv("GOODOO_OIDC_CLIENT_SECRET"); value != "" {
+		c.ClientSecret = value
+	}
+	if value := os.Getenv("GOODOO_OIDC_SCOPES"); value != "" {
+		c.Scopes = splitScopes(value)
+	}
+	if value := os.Getenv("GOODOO_OIDC_REDIRECT_URL"); value != "" {
+		c.RedirectURL = value
+	}
+	if value := os.Getenv("GOODOO_OIDC_LABEL"); value != "" {
+		c.Label = value
+	}
+	if value := os.Getenv("GOODOO_OIDC_LOGIN_CLAIM"); value != "" {
+		c.LoginClaim = value
+	}
+	if value := os.Getenv("GOODOO_OIDC_AUTO_PROVISION"); value != "" {
+		c.AutoProvision, _ = strconv.ParseBool(value)
+	}
+	if value := os.Getenv("GOODOO_OIDC_DEFAULT_GROUP"); value != "" {
+		c.DefaultGroup = value
+	}
+	if value := os.Getenv("GOODOO_OIDC_END_SESSION"); value != "" {
+		c.EndSession, _ = strconv.ParseBool(value)
+	}
+	if value := os.Getenv("GOODOO_OIDC_CLOCK_SKEW"); value != "" {
+		if skew, err := time.ParseDuration(value); err == nil && skew >= 0 {
+			c.ClockSkew = skew
+		}
+	}
+	if value := os.Getenv("GOODOO_OIDC_CACHE_TTL"); value != "" {
+		if ttl, err := time.ParseDuration(value); err == nil && ttl > 0 {
+			c.CacheTTL = ttl
+		}
+	}
+}
+
+// splitScopes splits a space or comma separated scope list
+func splitScopes(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool { return r == ' ' || r == ',' })
+}
+
+// Enabled reports whether a provider is configured
+func (c *Config) Enabled() bool {
+	return c.Issuer != "" && c.ClientID != ""
+}
+
+var (
+	config = DefaultConfig()
+	mutex  sync.RWMutex
+)
+
+// Setup installs the process-wide provider configuration
+func Setup(c *Config) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	config = c
+}
+
+// CurrentConfig returns the process-wide provider configuration
+func CurrentConfig() *Config {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return config
+}
+
+// ConfigForDB returns the configuration with the system parameters of a
+// database applied
+func ConfigForDB(dbName string) *Config {
+	c := *CurrentConfig()
+	if dbName == "" {
+		return &c
+	}
+	c.Issuer = models.GetParamString(dbName, ParamIssuer, c.Issuer)
+	c.ClientID = models.GetParamString(dbName, ParamClientID, c.ClientID)
+	c.ClientSecret = models.GetParamString(dbName, ParamClientSecret, c.ClientSecret)
+	if scopes := models.GetParamString(dbName, ParamScopes, ""); scopes != "" {
+		c.Scopes = splitScopes(scopes)
+	}
+	c.RedirectURL = models.GetParamString(dbName, ParamRedirectURL, c.RedirectURL)
+	c.Label = models.GetParamString(dbName, ParamLabel, c.Label)
+	c.LoginClaim = models.GetParamString(dbName, ParamLoginClaim, c.LoginClaim)
+	c.AutoProvision = models.GetParamBool(dbName, ParamAutoProvision, c.AutoProvision)
+	c.DefaultGroup = models.GetParamString(dbName, ParamDefaultGroup, c.DefaultGroup)
+	c.EndSession = models.GetParamBool(dbName, ParamEndSession, c.EndSession)
+	return &c
+}
+
+// Metadata is the part of the discovery document the flow uses
+type Metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+}
+
+// Provider is a discovered identity provider with its signing keys
+type Provider struct {
+	Metadata
+	fetched time.Time
+	keys    *keySet
+}
+
+// providers caches the discovered providers by issuer
+var (
+	providers   = make(map[string]*Provider)
+	providersMu sync.Mutex
+)
+
+// Discover returns the provider of the configured issuer, fetching its
+// discovery document when it is not cached or older than CacheTTL
+func Discover(ctx context.Context, c *Config) (*Provider, error) {
+	if !c.Enabled() {
+		return nil, ErrNotConfigured
+	}
+	issuer := strings.TrimSuffix(c.Issuer, "/")
+
+	providersMu.Lock()
+	cached := providers[issuer]
+	providersMu.Unlock()
+	if cached != nil && time.Since(cached.fetched) < c.CacheTTL {
+		return cached, nil
+	}
+
+	var metadata Metadata
+	if err := getJSON(ctx, issuer+"/.well-known/openid-configuration", &metadata); err != nil {
+		if cached != nil {
+			// Keep signing users in while the provider is briefly unreachable
+			return cached, nil
+		}
+		return nil, fmt.Errorf("%w: %v", ErrDiscovery, err)
+	}
+	if strings.TrimSuffix(metadata.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("%w: discovery document is for issuer %q", ErrDiscovery, metadata.Issuer)
+	}
+	if metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" || metadata.JWKSURI == "" {
+		return nil, fmt.Errorf("%w: discovery document lacks endpoints", ErrDiscovery)
+	}
+
+	provider := &Provider{Metadata: metadata, fetched: time.Now(), keys: newKeySet(metadata.JWKSURI)}
+	if cached != nil && cached.JWKSURI == metadata.JWKSURI {
+		provider.keys = cached.keys
+	}
+	providersMu.Lock()
+	providers[issuer] = provider
+	providersMu.Unlock()
+	return provider, nil
+}
+
+// getJSON fetches and decodes a JSON document
+func getJSON(ctx context.Context, url string, dest interface{}) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept", "application/json")
+	response, err := httpclient.Client(httpclient.PurposeOIDC).Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, response.Status)
+	}
+	return json.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(dest)
+}
+
+// AuthRequest is a pending sign-in, kept in the session until the callback
+type AuthRequest struct {
+	State    string    `json:"state"`
+	Nonce    string    `json:"nonce"`
+	Verifier string    `json:"verifier"`
+	Redirect string    `json:"redirect"`
+	Created  time.Time `json:"created"`
+}
+
+// AuthRequestTTL is how long the user has to sign in at the provider
+const AuthRequestTTL = 10 * time.Minute
+
+// NewAuthRequest returns a sign-in with a random state, nonce and PKCE
+// verifier, redirecting to redirect once signed in
+func NewAuthRequest(redirect string) (*AuthRequest, error) {
+	values := make([]string, 3)
+	for i := range values {
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		values[i] = base64.RawURLEncoding.EncodeToString(buf)
+	}
+	return &AuthRequest{
+		State:    values[0],
+		Nonce:    values[1],
+		Verifier: values[2],
+		Redirect: redirect,
+		Created:  time.Now(),
+	}, nil
+}
+
+// Expired reports whether the sign-in was started too long ago
+func (a *AuthRequest) Expired(now time.Time) bool {
+	return now.Sub(a.Created) > AuthRequestTTL
+}
+
+// AuthCodeURL returns the URL sending the user to the provider
+func (p *Provider) AuthCodeURL(c *Config, redirectURL string, a *AuthRequest) string {
+	challenge := sha256.Sum256([]byte(a.Verifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {c.ClientID},
+		"redirect_uri":          {redirectURL},
+		"scope":                 {strings.Join(c.Scopes, " ")},
+		"state":                 {a.State},
+		"nonce":                 {a.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	return withQuery(p.AuthorizationEndpoint, params)
+}
+
+// withQuery appends parameters to an endpoint that may have a query already
+func withQuery(endpoint string, params url.Values) string {
+	if strings.Contains(endpoint, "?") {
+		return endpoint + "&" + params.Encode()
+	}
+	return endpoint + "?" + params.Encode()
+}
+
+// TokenResponse is the answer of the token endpoint
+type TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	IDToken     string `json:"id_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// Exchange trades an authorization code and its PKCE verifier for tokens
+func (p *Provider) Exchange(ctx context.Context, c *Config, redirectURL, code, verifier string) (*TokenResponse, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURL},
+		"client_id":     {c.ClientID},
+		"code_verifier": {verifier},
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrTokenExchange, err)
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	if c.ClientSecret != "" {
+		request.SetBasicAuth(url.QueryEscape(c.ClientID), url.QueryEscape(c.ClientSecret))
+	}
+
+	response, err := httpclient.Client(httpclient.PurposeOIDC).Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrTokenExchange, err)
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrTokenExchange, err)
+	}
+	if response.StatusCode != http.StatusOK {
+		var failure struct {
+			Error       string `json:"error"`
+			Description string `json:"error_description"`
+		}
+		json.Unmarshal(body, &failure)
+		return nil, fmt.Errorf("%w: %s %s %s", ErrTokenExchange, response.Status, failure.Error, failure.Description)
+	}
+
+	var tokens TokenResponse
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrTokenExchange, err)
+	}
+	if tokens.IDToken == "" {
+		return nil, fmt.Errorf("%w: no ID token in the response", ErrTokenExchange)
+	}
+	return &tokens, nil
+}
+
+// EndSessionURL returns the URL signing the user out of the provider, or
+// "" when the provider has no end-session endpoint
+func (p *Provider) EndSessionURL(c *Config, idToken, postLogoutRedirect string) string {
+	if p.EndSessionEndpoint == "" {
+		return ""
+	}
+	params := url.Values{"client_id": {c.ClientID}}
+	if idToken != "" {
+		params.Set("id_token_hint", idToken)
+	}
+	if postLogoutRedirect != "" {
+		params.Set("post_logout_redirect_uri", postLogoutRedirect)
+	}
+	return withQuery(p.EndSessionEndpoint, params)
+}
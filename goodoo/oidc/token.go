@@ -0,0 +1,326 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // hash implementations of the signing algorithms
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keyRefreshInterval bounds how often an unknown key ID refetches the key
+// set, so forged tokens cannot hammer the provider
+const keyRefreshInterval = time.Minute
+
+// keySet caches the signing keys published at a JWKS URI. Keys are
+// refetched when a token names a key the set does not have, which is how
+// providers rotate them.
+type keySet struct {
+	uri     string
+	mu      sync.Mutex
+	keys    map[string]jsonWebKey
+	fetched time.Time
+}
+
+func newKeySet(uri string) *keySet {
+	return &keySet{uri: uri}
+}
+
+// jsonWebKey is a public key of the provider
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+
+	public crypto.PublicKey
+}
+
+// lookup returns the keys that may have signed a token: the key named kid,
+// or every key when the token names none
+func (s *keySet) lookup(ctx context.Context, kid string, ttl time.Duration) ([]jsonWebKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stale := s.keys == nil || time.Since(s.fetched) > ttl
+	_, known := s.keys[kid]
+	if stale || (kid != "" && !known && time.Since(s.fetched) > keyRefreshInterval) {
+		if err := s.fetch(ctx); err != nil && s.keys == nil {
+			return nil, err
+		}
+	}
+
+	if kid != "" {
+		if key, ok := s.keys[kid]; ok {
+			return []jsonWebKey{key}, nil
+		}
+		return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidSignature, kid)
+	}
+	keys := make([]jsonWebKey, 0, len(s.keys))
+	for _, key := range s.keys {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// fetch replaces the keys with those currently published
+func (s *keySet) fetch(ctx context.Context) error {
+	var document struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := getJSON(ctx, s.uri, &document); err != nil {
+		return fmt.Errorf("%w: %v", ErrDiscovery, err)
+	}
+	keys := make(map[string]jsonWebKey, len(document.Keys))
+	for _, key := range document.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		public, err := key.publicKey()
+		if err != nil {
+			continue
+		}
+		key.public = public
+		keys[key.Kid] = key
+	}
+	s.keys = keys
+	s.fetched = time.Now()
+	return nil
+}
+
+// publicKey decodes an RSA or EC key
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := func(value string) (*big.Int, error) {
+		raw, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil || len(raw) == 0 {
+			return nil, fmt.Errorf("invalid key parameter")
+		}
+		return new(big.Int).SetBytes(raw), nil
+	}
+
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, fmt.Errorf("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// signingAlgorithms are the accepted token algorithms with their hash;
+// symmetric algorithms and "none" are refused
+var signingAlgorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"PS256": crypto.SHA256, "PS384": crypto.SHA384, "PS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+}
+
+// verifySignature checks a signature made with alg by key
+func verifySignature(alg string, key crypto.PublicKey, signed, signature []byte) bool {
+	hash := signingAlgorithms[alg]
+	hasher := hash.New()
+	hasher.Write(signed)
+	digest := hasher.Sum(nil)
+
+	switch public := key.(type) {
+	case *rsa.PublicKey:
+		if strings.HasPrefix(alg, "RS") {
+			return rsa.VerifyPKCS1v15(public, hash, digest, signature) == nil
+		}
+		if strings.HasPrefix(alg, "PS") {
+			return rsa.VerifyPSS(public, hash, digest, signature, nil) == nil
+		}
+	case *ecdsa.PublicKey:
+		size := (public.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(public, digest, r, s)
+	}
+	return false
+}
+
+// audience is the aud claim, a string or a list of strings
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+func (a audience) contains(value string) bool {
+	for _, item := range a {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Claims are the verified claims of an ID token
+type Claims struct {
+	Issuer            string   `json:"iss"`
+	Subject           string   `json:"sub"`
+	Audience          audience `json:"aud"`
+	AuthorizedParty   string   `json:"azp"`
+	Expiry            int64    `json:"exp"`
+	IssuedAt          int64    `json:"iat"`
+	NotBefore         int64    `json:"nbf"`
+	Nonce             string   `json:"nonce"`
+	Email             string   `json:"email"`
+	EmailVerified     *bool    `json:"email_verified"`
+	Name              string   `json:"name"`
+	PreferredUsername string   `json:"preferred_username"`
+
+	// Raw holds every claim, for the configurable login claim
+	Raw map[string]interface{} `json:"-"`
+}
+
+// Claim returns a string claim, or "" when absent
+func (c *Claims) Claim(name string) string {
+	if value, ok := c.Raw[name].(string); ok {
+		return value
+	}
+	return ""
+}
+
+// VerifyIDToken checks the signature of an ID token against the provider
+// keys, then its issuer, audience, validity period (with the configured
+// clock skew) and nonce, and returns its claims
+func (p *Provider) VerifyIDToken(ctx context.Context, c *Config, raw, nonce string, now time.Time) (*Claims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed token", ErrInvalidToken)
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed header", ErrInvalidToken)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, fmt.Errorf("%w: malformed header", ErrInvalidToken)
+	}
+	if _, ok := signingAlgorithms[header.Alg]; !ok {
+		return nil, fmt.Errorf("%w: algorithm %q is not accepted", ErrInvalidSignature, header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed signature", ErrInvalidSignature)
+	}
+
+	keys, err := p.keys.lookup(ctx, header.Kid, c.CacheTTL)
+	if err != nil {
+		return nil, err
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, key := range keys {
+		if key.Alg != "" && key.Alg != header.Alg {
+			continue
+		}
+		if verifySignature(header.Alg, key.public, signed, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, ErrInvalidSignature
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed payload", ErrInvalidToken)
+	}
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if err := json.Unmarshal(payload, &claims.Raw); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	if strings.TrimSuffix(claims.Issuer, "/") != strings.TrimSuffix(p.Issuer, "/") {
+		return nil, fmt.Errorf("%w: issued by %q", ErrInvalidToken, claims.Issuer)
+	}
+	if !claims.Audience.contains(c.ClientID) {
+		return nil, fmt.Errorf("%w: not issued for this client", ErrInvalidToken)
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != "" && claims.AuthorizedParty != c.ClientID {
+		return nil, fmt.Errorf("%w: authorized party is %q", ErrInvalidToken, claims.AuthorizedParty)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("%w: no subject", ErrInvalidToken)
+	}
+
+	skew := c.ClockSkew
+	if claims.Expiry == 0 || now.After(time.Unix(claims.Expiry, 0).Add(skew)) {
+		return nil, fmt.Errorf("%w: expired at %s", ErrTokenExpired, time.Unix(claims.Expiry, 0).UTC().Format(time.RFC3339))
+	}
+	if claims.NotBefore != 0 && now.Add(skew).Before(time.Unix(claims.NotBefore, 0)) {
+		return nil, fmt.Errorf("%w: not valid before %s", ErrTokenExpired, time.Unix(claims.NotBefore, 0).UTC().Format(time.RFC3339))
+	}
+	if claims.IssuedAt != 0 && now.Add(skew).Before(time.Unix(claims.IssuedAt, 0)) {
+		return nil, fmt.Errorf("%w: issued in the future", ErrTokenExpired)
+	}
+
+	if claims.Nonce != nonce {
+		return nil, ErrNonceMismatch
+	}
+	return &claims, nil
+}
@@ -0,0 +1,100 @@
+package oidc
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"goodoo/models"
+	"gorm.io/gorm"
+)
+
+// ResolveUser returns the active user signing in with claims. Users linked
+// to the subject are found directly; otherwise the login claim is matched
+// against logins (and emails, for the email claim) and the user found is
+// linked to the subject. Unknown users are created when auto-provisioning
+// is enabled.
+func ResolveUser(db *gorm.DB, c *Config, claims *Claims) (*models.User, bool, error) {
+	issuer := strings.TrimSuffix(claims.Issuer, "/")
+
+	var user models.User
+	err := db.Where("oauth_issuer = ? AND oauth_uid = ? AND active = ? AND is_service = ?", issuer, claims.Subject, true, false).First(&user).Error
+	if err == nil {
+		return &user, false, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, false, err
+	}
+
+	login := claims.Claim(c.LoginClaim)
+	if c.LoginClaim == "email" && claims.EmailVerified != nil && !*claims.EmailVerified {
+		// An unverified address could claim somebody else's account
+		login = ""
+	}
+	if login == "" {
+		return nil, false, fmt.Errorf("%w: the identity has no usable %s claim", ErrUnknownUser, c.LoginClaim)
+	}
+
+	// Service accounts cannot sign in interactively
+	query := db.Where("login = ? AND active = ? AND is_service = ?", login, true, false)
+	if c.LoginClaim == "email" {
+		query = db.Where("(login = ? OR email = ?) AND active = ? AND is_service = ?", login, login, true, false)
+	}
+	err = query.First(&user).Error
+	switch {
+	case err == nil:
+		if user.OAuthUID != "" {
+			return nil, false, fmt.Errorf("%w: %s", ErrAccountConflict, user.Login)
+		}
+		user.OAuthIssuer, user.OAuthUID = issuer, claims.Subject
+		err := db.Model(&user).Updates(map[string]interface{}{
+			"oauth_issuer": user.OAuthIssuer,
+			"oauth_uid":    user.OAuthUID,
+		}).Error
+		return &user, false, err
+	case !errors.Is(err, gorm.ErrRecordNotFound):
+		return nil, false, err
+	case !c.AutoProvision:
+		return nil, false, fmt.Errorf("%w: %s", ErrUnknownUser, login)
+	}
+
+	provisioned, err := provisionUser(db, c, claims, issuer, login)
+	return provisioned, provisioned != nil, err
+}
+
+// provisionUser creates the user of an identity, without a password so it
+// can only sign in through the provider, in the default group if any
+func provisionUser(db *gorm.DB, c *Config, claims *Claims, issuer, login string) (*models.User, error) {
+	user := &models.User{
+		Login:       login,
+		Name:        claims.Name,
+		Email:       claims.Email,
+		Active:      true,
+		OAuthIssuer: issuer,
+		OAuthUID:    claims.Subject,
+	}
+	if user.Name == "" {
+		user.Name = login
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(user).Error; err != nil {
+			return err
+		}
+		if c.DefaultGroup == "" {
+			return nil
+		}
+		model, id, err := models.ResolveXMLID(tx, c.DefaultGroup)
+		if err != nil {
+			return err
+		}
+		if model != "res.groups" {
+			return fmt.Errorf("default group %s is a %s", c.DefaultGroup, model)
+		}
+		return tx.Model(user).Association("Groups").Append(&models.ResGroups{BaseModel: models.BaseModel{ID: id}})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to provision %s: %w", login, err)
+	}
+	return user, nil
+}
@@ -0,0 +1,242 @@
+// Package operations runs long tasks, such as bulk writes, in the
+// background and tracks their progress so clients can poll or cancel them.
+// Operations are kept in memory for an hour after they finish.
+package operations
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"goodoo/crash"
+	"goodoo/logging"
+)
+
+var logger = logging.GetLogger("goodoo.operations")
+
+// Operation states
+const (
+	StateRunning   = "running"
+	StateDone      = "done"
+	StateCancelled = "cancelled"
+	StateFailed    = "failed"
+)
+
+// MaxErrors bounds the errors kept by an operation
+const MaxErrors = 100
+
+// Retention is how long finished operations stay available
+const Retention = time.Hour
+
+// Operation is a task running in the background
+type Operation struct {
+	mutex    sync.Mutex
+	status   Status
+	cancel   context.CancelFunc
+	finished chan struct{}
+}
+
+// Status is the progress of an operation
+type Status struct {
+	ID     string `json:"id"`
+	Kind   string `json:"kind"`
+	Model  string `json:"model,omitempty"`
+	DBName string `json:"db"`
+	UserID int    `json:"user_id"`
+	State  string `json:"state"`
+
+	Total     int `json:"total"`
+	Processed int `json:"processed"`
+	Failed    int `json:"failed"`
+	// Batch is the current batch, from 1, out of Batches
+	Batch   int `json:"batch"`
+	Batches int `json:"batches"`
+	// Errors are the first MaxErrors errors; ErrorCount counts them all
+	Errors     []string `json:"errors"`
+	ErrorCount int      `json:"error_count"`
+
+	StartDate  time.Time  `json:"start_date"`
+	FinishDate *time.Time `json:"finish_date,omitempty"`
+}
+
+var (
+	operations = make(map[string]*Operation)
+	mutex      sync.Mutex
+)
+
+// newID returns a random operation ID
+func newID() string {
+	buffer := make([]byte, 12)
+	if _, err := rand.Read(buffer); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(buffer)
+}
+
+// Start runs fn in the background as an operation of a user. fn reports
+// its progress on the operation and should stop when ctx is cancelled;
+// an error it returns marks the operation failed.
+func Start(kind, model, dbName string, userID, total int, fn func(ctx context.Context, op *Operation) error) *Operation {
+	ctx, cancel := context.WithCancel(context.Background())
+	op := &Operation{
+		status: Status{
+			ID:        newID(),
+			Kind:      kind,
+			Model:     model,
+			DBName:    dbName,
+			UserID:    userID,
+			State:     StateRunning,
+			Total:     total,
+			Errors:    []string{},
+			StartDate: time.Now(),
+		},
+		cancel:   cancel,
+		finished: make(chan struct{}),
+	}
+
+	mutex.Lock()
+	prune(time.Now())
+	operations[op.status.ID] = op
+	mutex.Unlock()
+
+	go func() {
+		defer close(op.finished)
+		defer cancel()
+		defer func() {
+			if r := recover(); r != nil {
+				crash.RecordPanic(ctx, dbName, "operation:"+kind, r)
+				op.finish(fmt.Errorf("panic: %v", r))
+			}
+		}()
+		op.finish(fn(ctx, op))
+	}()
+	return op
+}
+
+// prune forgets the operations finished before the retention
+func prune(now time.Time) {
+	for id, op := range operations {
+		status := op.Status()
+		if status.FinishDate != nil && now.Sub(*status.FinishDate) > Retention {
+			delete(operations, id)
+		}
+	}
+}
+
+// finish records the outcome of the operation
+func (op *Operation) finish(err error) {
+	op.mutex.Lock()
+	defer op.mutex.Unlock()
+	if op.status.FinishDate != nil {
+		return
+	}
+	now := time.Now()
+	op.status.FinishDate = &now
+	switch {
+	case err != nil:
+		op.status.State = StateFailed
+		op.addError(err.Error())
+	case op.status.State == StateRunning:
+		op.status.State = StateDone
+	}
+}
+
+// Get returns an operation by ID
+func Get(id string) (*Operation, bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	op, ok := operations[id]
+	return op, ok
+}
+
+// Status returns a copy of the operation's progress
+func (op *Operation) Status() Status {
+	op.mutex.Lock()
+	defer op.mutex.Unlock()
+	status := op.status
+	status.Errors = append([]string(nil), op.status.Errors...)
+	return status
+}
+
+// Cancel asks the operation to stop; running operations check it between
+// batches. It reports false when the operation already finished.
+func (op *Operation) Cancel() bool {
+	op.mutex.Lock()
+	if op.status.State != StateRunning {
+		op.mutex.Unlock()
+		return false
+	}
+	op.status.State = StateCancelled
+	op.mutex.Unlock()
+	op.cancel()
+	return true
+}
+
+// Cancelled reports whether the operation was asked to stop
+func (op *Operation) Cancelled() bool {
+	op.mutex.Lock()
+	defer op.mutex.Unlock()
+	return op.status.State == StateCancelled
+}
+
+// Wait blocks until the operation finishes
+func (op *Operation) Wait() {
+	<-op.finished
+}
+
+// SetTotal sets the amount of work once it is known
+func (op *Operation) SetTotal(total int) {
+	op.mutex.Lock()
+	defer op.mutex.Unlock()
+	op.status.Total = total
+}
+
+// BeginBatch records that batch (from 1) out of batches is being processed
+func (op *Operation) BeginBatch(batch, batches int) {
+	op.mutex.Lock()
+	defer op.mutex.Unlock()
+	op.status.Batch = batch
+	op.status.Batches = batches
+}
+
+// Progress adds processed and failed records, with the error of the
+// failed ones
+func (op *Operation) Progress(processed, failed int, err error) {
+	op.mutex.Lock()
+	defer op.mutex.Unlock()
+	op.status.Processed += processed
+	op.status.Failed += failed
+	if err != nil {
+		op.addError(err.Error())
+	}
+}
+
+// addError collects an error, keeping the first MaxErrors
+func (op *Operation) addError(message string) {
+	op.status.ErrorCount++
+	if len(op.status.Errors) < MaxErrors {
+		op.status.Errors = append(op.status.Errors, message)
+	}
+}
+
+// Running returns the operations of a database that did not finish yet,
+// oldest first; cancelled operations count until they stop
+func Running(dbName string) []*Operation {
+	mutex.Lock()
+	defer mutex.Unlock()
+	var running []*Operation
+	for _, op := range operations {
+		status := op.Status()
+		if status.DBName == dbName && status.FinishDate == nil {
+			running = append(running, op)
+		}
+	}
+	sort.Slice(running, func(i, j int) bool {
+		return running[i].status.StartDate.Before(running[j].status.StartDate)
+	})
+	return running
+}
@@ -0,0 +1,312 @@
+// Package presence tracks which users are online. Clients send heartbeats
+// per device (an open socket, or the HTTP fallback keyed by session); a
+// device is away after a while without user activity and offline once its
+// heartbeats stop or it disconnects. A user takes the most present state of
+// their devices. Changes are published on the bus and the table is saved
+// periodically.
+package presence
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"goodoo/bus"
+	"goodoo/database"
+	"goodoo/logging"
+	"goodoo/models"
+	"goodoo/scheduler"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Channel is the bus channel of presence changes; payloads are Status values
+const Channel = "presence"
+
+// Config holds the presence timeouts
+type Config struct {
+	// AwayAfter is how long a device stays online without user activity
+	AwayAfter time.Duration
+	// Timeout is how long a device stays connected without heartbeat
+	Timeout time.Duration
+}
+
+// DefaultConfig returns away after 5 minutes and offline after 2 minutes without heartbeat
+func DefaultConfig() *Config {
+	return &Config{
+		AwayAfter: 5 * time.Minute,
+		Timeout:   2 * time.Minute,
+	}
+}
+
+// LoadFromEnv overrides the configuration with GOODOO_PRESENCE_* variables
+func (c *Config) LoadFromEnv() {
+	if value := os.Getenv("GOODOO_PRESENCE_AWAY_AFTER"); value != "" {
+		if d, err := time.ParseDuration(value); err == nil && d > 0 {
+			c.AwayAfter = d
+		}
+	}
+	if value := os.Getenv("GOODOO_PRESENCE_TIMEOUT"); value != "" {
+		if d, err := time.ParseDuration(value); err == nil && d > 0 {
+			c.Timeout = d
+		}
+	}
+}
+
+// Status is the presence of a user
+type Status struct {
+	UserID   uint      `json:"user_id"`
+	State    string    `json:"state"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// IsOnline reports whether the user has a connected device
+func (s Status) IsOnline() bool {
+	return s.State != models.PresenceOffline
+}
+
+// device is a client of a user
+type device struct {
+	lastActivity  time.Time
+	lastHeartbeat time.Time
+	connected     bool
+}
+
+// state returns the presence of the device at now
+func (d *device) state(c *Config, now time.Time) string {
+	switch {
+	case !d.connected || now.Sub(d.lastHeartbeat) > c.Timeout:
+		return models.PresenceOffline
+	case now.Sub(d.lastActivity) > c.AwayAfter:
+		return models.PresenceAway
+	}
+	return models.PresenceOnline
+}
+
+// entry is the presence of a user of a database
+type entry struct {
+	devices       map[string]*device
+	state         string
+	lastSeen      time.Time
+	lastHeartbeat time.Time
+	dirty         bool
+}
+
+// rank orders states by presence
+var rank = map[string]int{
+	models.PresenceOffline: 0,
+	models.PresenceAway:    1,
+	models.PresenceOnline:  2,
+}
+
+// evaluate recomputes the state of the user, forgetting offline devices,
+// and reports whether it changed
+func (e *entry) evaluate(c *Config, now time.Time) bool {
+	state := models.PresenceOffline
+	for id, d := range e.devices {
+		s := d.state(c, now)
+		if rank[s] > rank[state] {
+			state = s
+		}
+		if d.lastActivity.After(e.lastSeen) {
+			e.lastSeen = d.lastActivity
+		}
+		if d.lastHeartbeat.After(e.lastHeartbeat) {
+			e.lastHeartbeat = d.lastHeartbeat
+		}
+		if s == models.PresenceOffline {
+			delete(e.devices, id)
+		}
+	}
+	if state == e.state {
+		return false
+	}
+	e.state = state
+	e.dirty = true
+	return true
+}
+
+var (
+	config = DefaultConfig()
+	// tables maps database names to the entries of their users
+	tables = make(map[string]map[uint]*entry)
+	mutex  sync.Mutex
+	logger = logging.GetLogger("goodoo.presence")
+)
+
+// Setup installs the process-wide presence configuration
+func Setup(c *Config) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	config = c
+}
+
+// userEntry returns the entry of a user, creating it; mutex must be held
+func userEntry(dbName string, uid uint) *entry {
+	table := tables[dbName]
+	if table == nil {
+		table = make(map[uint]*entry)
+		tables[dbName] = table
+	}
+	e := table[uid]
+	if e == nil {
+		e = &entry{devices: make(map[string]*device), state: models.PresenceOffline}
+		table[uid] = e
+	}
+	return e
+}
+
+// Heartbeat records that a device of the user is connected; active tells
+// whether the user interacted since the previous heartbeat
+func Heartbeat(dbName string, uid uint, deviceID string, active bool) Status {
+	now := time.Now()
+	mutex.Lock()
+	e := userEntry(dbName, uid)
+	d := e.devices[deviceID]
+	if d == nil {
+		d = &device{lastActivity: now}
+		e.devices[deviceID] = d
+	}
+	d.connected = true
+	d.lastHeartbeat = now
+	if active {
+		d.lastActivity = now
+	}
+	e.dirty = true
+	changed := e.evaluate(config, now)
+	status := Status{UserID: uid, State: e.state, LastSeen: e.lastSeen}
+	mutex.Unlock()
+
+	if changed {
+		bus.Publish(dbName, Channel, status)
+	}
+	return status
+}
+
+// Disconnect records that a device of the user closed
+func Disconnect(dbName string, uid uint, deviceID string) Status {
+	now := time.Now()
+	mutex.Lock()
+	e := userEntry(dbName, uid)
+	if d := e.devices[deviceID]; d != nil {
+		d.connected = false
+	}
+	changed := e.evaluate(config, now)
+	status := Status{UserID: uid, State: e.state, LastSeen: e.lastSeen}
+	mutex.Unlock()
+
+	if changed {
+		bus.Publish(dbName, Channel, status)
+	}
+	return status
+}
+
+// Get returns the presence of users; unknown users are offline
+func Get(dbName string, uids []uint) map[uint]Status {
+	mutex.Lock()
+	defer mutex.Unlock()
+	statuses := make(map[uint]Status, len(uids))
+	table := tables[dbName]
+	for _, uid := range uids {
+		status := Status{UserID: uid, State: models.PresenceOffline}
+		if e := table[uid]; e != nil {
+			status.State, status.LastSeen = e.state, e.lastSeen
+		}
+		statuses[uid] = status
+	}
+	return statuses
+}
+
+// Sweep moves users whose devices went quiet to away or offline and
+// publishes the changes
+func Sweep(dbName string) {
+	now := time.Now()
+	var changes []Status
+	mutex.Lock()
+	for uid, e := range tables[dbName] {
+		if e.evaluate(config, now) {
+			changes = append(changes, Status{UserID: uid, State: e.state, LastSeen: e.lastSeen})
+		}
+	}
+	mutex.Unlock()
+
+	for _, status := range changes {
+		bus.Publish(dbName, Channel, status)
+	}
+}
+
+// Persist saves the entries changed since the previous call
+func Persist(db *gorm.DB, dbName string) error {
+	var rows []models.UserPresence
+	mutex.Lock()
+	for uid, e := range tables[dbName] {
+		if e.dirty {
+			rows = append(rows, models.UserPresence{UserID: uid, State: e.state, LastSeen: e.lastSeen, LastHeartbeat: e.lastHeartbeat})
+			e.dirty = false
+		}
+	}
+	mutex.Unlock()
+	if len(rows) == 0 {
+		return nil
+	}
+
+	err := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"state", "last_seen", "last_heartbeat", "write_date"}),
+	}).Create(&rows).Error
+	if err != nil {
+		// Save them again next time
+		mutex.Lock()
+		for _, row := range rows {
+			if e := tables[dbName][row.UserID]; e != nil {
+				e.dirty = true
+			}
+		}
+		mutex.Unlock()
+	}
+	return err
+}
+
+// Restore loads the saved presence of a database at startup. Users that
+// were connected keep a device until its heartbeat times out, giving their
+// clients time to reconnect.
+func Restore(db *gorm.DB, dbName string) error {
+	var rows []models.UserPresence
+	if err := db.Find(&rows).Error; err != nil {
+		return err
+	}
+	now := time.Now()
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, row := range rows {
+		e := userEntry(dbName, row.UserID)
+		e.lastSeen, e.lastHeartbeat = row.LastSeen, row.LastHeartbeat
+		if row.State != models.PresenceOffline {
+			e.devices["restored"] = &device{lastActivity: row.LastSeen, lastHeartbeat: row.LastHeartbeat, connected: true}
+		}
+		e.state = row.State
+		e.evaluate(config, now)
+	}
+	return nil
+}
+
+// Schedule registers the jobs sweeping the presence of a database and
+// saving it every interval
+func Schedule(s *scheduler.Scheduler, dbName string, sweep, persist time.Duration) {
+	s.Every("presence.sweep."+dbName, sweep, func(ctx context.Context) error {
+		Sweep(dbName)
+		return nil
+	})
+	s.Every("presence.persist."+dbName, persist, func(ctx context.Context) error {
+		db, err := database.GetDatabase(dbName)
+		if err != nil {
+			return err
+		}
+		if err := Persist(db.WithContext(ctx), dbName); err != nil {
+			logger.Warning("Failed to save the presence of %s: %v", dbName, err)
+			return err
+		}
+		return nil
+	})
+}
@@ -0,0 +1,163 @@
+// Package refdata holds the reference data every database is seeded with,
+// embedded from the files of data/: the countries, their names in other
+// languages, the languages, and the catalog of timezones, restricted to
+// the zones of the Go tzdata. The data is shared and must not be modified.
+package refdata
+
+import (
+	"embed"
+	"encoding/csv"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	_ "time/tzdata" // the catalog does not depend on the system zoneinfo
+)
+
+//go:embed data/*.csv
+var dataFiles embed.FS
+
+// DefaultAddressFormat lays out the addresses of the countries without a
+// format of their own
+const DefaultAddressFormat = "{street}\n{city} {zip}\n{country}"
+
+// Country is a country of data/countries.csv
+type Country struct {
+	// Code is the ISO 3166-1 alpha-2 code
+	Code      string
+	Name      string
+	PhoneCode string
+	// AddressFormat lays out an address (see FormatAddress), empty for
+	// DefaultAddressFormat
+	AddressFormat string
+}
+
+// CountryName is the name of a country in a language, from
+// data/country_names.csv
+type CountryName struct {
+	Code string
+	Lang string
+	Name string
+}
+
+// Language is a language of data/languages.csv
+type Language struct {
+	Code string
+	Name string
+	// Direction is "ltr" or "rtl"
+	Direction string
+}
+
+// Timezone is an IANA timezone of data/timezones.csv
+type Timezone struct {
+	Name string
+	// CountryCode is the country of the zone, empty for UTC
+	CountryCode string
+	location    *time.Location
+}
+
+// Offset returns the UTC offset of the zone at a time, in seconds
+func (tz Timezone) Offset(at time.Time) int {
+	_, offset := at.In(tz.location).Zone()
+	return offset
+}
+
+var (
+	countries     []Country
+	countryNames  []CountryName
+	languages     []Language
+	timezones     []Timezone
+	timezoneNames = make(map[string]bool)
+)
+
+func init() {
+	for _, row := range readCSV("countries.csv", 4) {
+		countries = append(countries, Country{Code: row[0], Name: row[1], PhoneCode: row[2],
+			AddressFormat: strings.ReplaceAll(row[3], `\n`, "\n")})
+	}
+	for _, row := range readCSV("country_names.csv", 3) {
+		countryNames = append(countryNames, CountryName{Code: row[0], Lang: row[1], Name: row[2]})
+	}
+	for _, row := range readCSV("languages.csv", 3) {
+		languages = append(languages, Language{Code: row[0], Name: row[1], Direction: row[2]})
+	}
+	for _, row := range readCSV("timezones.csv", 2) {
+		location, err := time.LoadLocation(row[0])
+		if err != nil {
+			// Zones newer than the tzdata of the Go release are left out
+			continue
+		}
+		timezones = append(timezones, Timezone{Name: row[0], CountryCode: row[1], location: location})
+		timezoneNames[row[0]] = true
+	}
+}
+
+// readCSV returns the rows of an embedded data file without its header;
+// the files are part of the build, so a malformed one is a bug
+func readCSV(name string, columns int) [][]string {
+	file, err := dataFiles.Open("data/" + name)
+	if err != nil {
+		panic(fmt.Sprintf("refdata: %v", err))
+	}
+	defer file.Close()
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = columns
+	rows, err := reader.ReadAll()
+	if err != nil {
+		panic(fmt.Sprintf("refdata: %s: %v", name, err))
+	}
+	return rows[1:]
+}
+
+// Countries returns the countries, by code
+func Countries() []Country {
+	return countries
+}
+
+// CountryNames returns the names of the countries in other languages
+func CountryNames() []CountryName {
+	return countryNames
+}
+
+// Languages returns the languages, by code
+func Languages() []Language {
+	return languages
+}
+
+// Timezones returns the timezone catalog, by name
+func Timezones() []Timezone {
+	return timezones
+}
+
+// IsTimezone reports whether a name is a timezone of the catalog
+func IsTimezone(name string) bool {
+	return timezoneNames[name]
+}
+
+// FormatAddress lays out an address with a format such as
+// "{street}\n{zip} {city}\n{country}", each placeholder replaced by its
+// value. The lines left empty are dropped and the spaces of the others
+// collapsed.
+func FormatAddress(format string, values map[string]string) string {
+	if format == "" {
+		format = DefaultAddressFormat
+	}
+	placeholders := make([]string, 0, 2*len(values))
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		placeholders = append(placeholders, "{"+key+"}", values[key])
+	}
+	text := strings.NewReplacer(placeholders...).Replace(format)
+
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.Join(strings.Fields(line), " "); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
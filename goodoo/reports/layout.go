@@ -0,0 +1,462 @@
+package reports
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// The layout engine supports the HTML subset used by report templates:
+// headings, paragraphs, div blocks, line breaks, bold text, horizontal rules
+// and tables (with "text-right" cells). An element with the "page-break"
+// class, or a page-break-before/break-before style, starts a new page.
+
+const (
+	bodySize    = 10.0
+	lineSpacing = 1.35
+	cellPadding = 4.0
+)
+
+// headingSizes maps heading elements to font sizes
+var headingSizes = map[atom.Atom]float64{
+	atom.H1: 18,
+	atom.H2: 15,
+	atom.H3: 12,
+	atom.H4: 11,
+}
+
+// blockElements start and end a paragraph
+var blockElements = map[atom.Atom]bool{
+	atom.P: true, atom.Div: true, atom.Section: true, atom.Article: true,
+	atom.Header: true, atom.Footer: true, atom.Address: true, atom.Li: true,
+	atom.Ul: true, atom.Ol: true, atom.Body: true,
+}
+
+// run is a piece of inline text with one style
+type run struct {
+	text string
+	bold bool
+}
+
+// tableCell is a laid out table cell
+type tableCell struct {
+	text  string
+	bold  bool
+	right bool
+}
+
+// tableRow is a row of cells; header rows are repeated after a page break
+type tableRow struct {
+	cells  []tableCell
+	header bool
+}
+
+// layout renders parsed HTML onto a pdfWriter
+type layout struct {
+	pdf  *pdfWriter
+	y    float64
+	runs []run
+}
+
+// renderPDF converts report HTML to a PDF document
+func renderPDF(source string) ([]byte, error) {
+	pdf, err := layoutPages(source)
+	if err != nil {
+		return nil, err
+	}
+	return pdf.Bytes(), nil
+}
+
+// layoutPages lays out report HTML on the pages of a new writer
+func layoutPages(source string) (*pdfWriter, error) {
+	doc, err := html.Parse(strings.NewReader(source))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse report HTML: %w", err)
+	}
+
+	l := &layout{pdf: newPDFWriter(), y: pageMargin}
+	l.walk(doc, false)
+	l.flush(bodySize)
+
+	return l.pdf, nil
+}
+
+func (l *layout) contentWidth() float64 {
+	return pageWidth - 2*pageMargin
+}
+
+// ensureSpace moves to a new page when height does not fit on the current one
+func (l *layout) ensureSpace(height float64) bool {
+	if l.y+height <= pageHeight-pageMargin {
+		return false
+	}
+	l.newPage()
+	return true
+}
+
+func (l *layout) newPage() {
+	l.pdf.AddPage()
+	l.y = pageMargin
+}
+
+func (l *layout) walk(n *html.Node, bold bool) {
+	switch n.Type {
+	case html.TextNode:
+		text := collapseSpace(n.Data)
+		if text != "" {
+			l.runs = append(l.runs, run{text: text, bold: bold})
+		}
+		return
+	case html.ElementNode:
+	default:
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			l.walk(child, bold)
+		}
+		return
+	}
+
+	if isPageBreak(n) {
+		l.flush(bodySize)
+		if l.y > pageMargin {
+			l.newPage()
+		}
+	}
+
+	switch n.DataAtom {
+	case atom.Head, atom.Style, atom.Script, atom.Title:
+		return
+	case atom.Br:
+		l.flush(bodySize)
+		return
+	case atom.Hr:
+		l.flush(bodySize)
+		l.ensureSpace(8)
+		l.y += 4
+		l.pdf.Line(pageMargin, l.y, pageWidth-pageMargin, l.y)
+		l.y += 4
+		return
+	case atom.Table:
+		l.flush(bodySize)
+		l.table(n)
+		return
+	case atom.Strong, atom.B, atom.Th:
+		bold = true
+	}
+
+	if size, ok := headingSizes[n.DataAtom]; ok {
+		l.flush(bodySize)
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			l.walk(child, true)
+		}
+		l.flush(size)
+		l.y += size * 0.4
+		return
+	}
+
+	block := blockElements[n.DataAtom]
+	if block {
+		l.flush(bodySize)
+	}
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		l.walk(child, bold)
+	}
+	if block {
+		l.flush(bodySize)
+		if n.DataAtom == atom.P {
+			l.y += bodySize * 0.5
+		}
+	}
+}
+
+// flush wraps and draws the pending inline runs
+func (l *layout) flush(size float64) {
+	if len(l.runs) == 0 {
+		return
+	}
+	runs := l.runs
+	l.runs = nil
+
+	lineHeight := size * lineSpacing
+	maxWidth := l.contentWidth()
+	space := textWidth(" ", size, false)
+
+	var line []run
+	width := 0.0
+	drawLine := func() {
+		if len(line) == 0 {
+			return
+		}
+		l.ensureSpace(lineHeight)
+		l.y += lineHeight
+		// Consecutive words of the same style are drawn as one string
+		x := pageMargin
+		for start := 0; start < len(line); {
+			end := start + 1
+			for end < len(line) && line[end].bold == line[start].bold {
+				end++
+			}
+			words := make([]string, 0, end-start)
+			for _, word := range line[start:end] {
+				words = append(words, word.text)
+			}
+			text := strings.Join(words, " ")
+			l.pdf.Text(x, l.y-size*0.25, size, line[start].bold, text)
+			x += textWidth(text, size, line[start].bold) + space
+			start = end
+		}
+		line, width = nil, 0
+	}
+
+	for _, r := range runs {
+		for _, word := range strings.Fields(r.text) {
+			w := textWidth(word, size, r.bold)
+			if len(line) > 0 && width+space+w > maxWidth {
+				drawLine()
+			}
+			if len(line) > 0 {
+				width += space
+			}
+			line = append(line, run{text: word, bold: r.bold})
+			width += w
+		}
+	}
+	drawLine()
+}
+
+// table lays out a table with columns sized to their content
+func (l *layout) table(n *html.Node) {
+	rows := collectRows(n, false)
+	if len(rows) == 0 {
+		return
+	}
+
+	columns := 0
+	for _, row := range rows {
+		if len(row.cells) > columns {
+			columns = len(row.cells)
+		}
+	}
+
+	// Like HTML auto layout: every column gets its minimum width (longest word,
+	// or the whole text of right-aligned cells so amounts never wrap), and the
+	// remaining space is shared in proportion to how much each column wants more.
+	// A table narrower than the page gives the slack to its first column.
+	natural := make([]float64, columns)
+	minimum := make([]float64, columns)
+	for _, row := range rows {
+		for i, cell := range row.cells {
+			natural[i] = math.Max(natural[i], textWidth(cell.text, bodySize, cell.bold)+2*cellPadding)
+			unbreakable := cell.text
+			if !cell.right {
+				unbreakable = longestWord(cell.text, bodySize, cell.bold)
+			}
+			minimum[i] = math.Max(minimum[i], textWidth(unbreakable, bodySize, cell.bold)+2*cellPadding)
+		}
+	}
+
+	available := l.contentWidth()
+	totalNatural, totalMinimum := 0.0, 0.0
+	for i := range natural {
+		totalNatural += natural[i]
+		totalMinimum += minimum[i]
+	}
+
+	widths := make([]float64, columns)
+	switch {
+	case totalNatural <= available:
+		copy(widths, natural)
+		widths[0] += available - totalNatural
+	case totalMinimum >= available:
+		for i := range widths {
+			widths[i] = minimum[i] * available / totalMinimum
+		}
+	default:
+		extra := available - totalMinimum
+		for i := range widths {
+			widths[i] = minimum[i] + extra*(natural[i]-minimum[i])/(totalNatural-totalMinimum)
+		}
+	}
+
+	var headers []tableRow
+	for _, row := range rows {
+		if row.header {
+			headers = append(headers, row)
+		}
+	}
+
+	l.y += 4
+	for _, row := range rows {
+		lines := make([][]string, len(row.cells))
+		height := 1
+		for i, cell := range row.cells {
+			lines[i] = wrapText(cell.text, widths[i]-2*cellPadding, bodySize, cell.bold)
+			if len(lines[i]) > height {
+				height = len(lines[i])
+			}
+		}
+		rowHeight := float64(height)*bodySize*lineSpacing + cellPadding
+
+		if l.ensureSpace(rowHeight) && !row.header {
+			for _, header := range headers {
+				l.drawRow(header, widths, nil)
+			}
+		}
+		l.drawRow(row, widths, lines)
+	}
+	l.y += 8
+}
+
+// drawRow draws one table row; lines holds the pre-wrapped cell text
+func (l *layout) drawRow(row tableRow, widths []float64, lines [][]string) {
+	if lines == nil {
+		lines = make([][]string, len(row.cells))
+		for i, cell := range row.cells {
+			lines[i] = wrapText(cell.text, widths[i]-2*cellPadding, bodySize, cell.bold)
+		}
+	}
+
+	height := 1
+	for _, cellLines := range lines {
+		if len(cellLines) > height {
+			height = len(cellLines)
+		}
+	}
+	lineHeight := bodySize * lineSpacing
+
+	top := l.y
+	x := pageMargin
+	for i, cell := range row.cells {
+		for j, text := range lines[i] {
+			tx := x + cellPadding
+			if cell.right {
+				tx = x + widths[i] - cellPadding - textWidth(text, bodySize, cell.bold)
+			}
+			l.pdf.Text(tx, top+float64(j+1)*lineHeight-bodySize*0.25, bodySize, cell.bold, text)
+		}
+		x += widths[i]
+	}
+
+	l.y = top + float64(height)*lineHeight + cellPadding
+	if row.header {
+		l.pdf.Line(pageMargin, l.y-cellPadding/2, pageWidth-pageMargin, l.y-cellPadding/2)
+	}
+}
+
+// collectRows gathers the rows of a table, marking thead rows as headers
+func collectRows(n *html.Node, header bool) []tableRow {
+	var rows []tableRow
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		if child.Type != html.ElementNode {
+			continue
+		}
+		switch child.DataAtom {
+		case atom.Thead:
+			rows = append(rows, collectRows(child, true)...)
+		case atom.Tbody, atom.Tfoot:
+			rows = append(rows, collectRows(child, false)...)
+		case atom.Tr:
+			row := tableRow{header: header}
+			for cell := child.FirstChild; cell != nil; cell = cell.NextSibling {
+				if cell.Type != html.ElementNode || (cell.DataAtom != atom.Td && cell.DataAtom != atom.Th) {
+					continue
+				}
+				row.cells = append(row.cells, tableCell{
+					text:  collapseSpace(textContent(cell)),
+					bold:  cell.DataAtom == atom.Th || hasBoldChild(cell),
+					right: hasClass(cell, "text-right") || strings.Contains(attr(cell, "style"), "text-align: right"),
+				})
+			}
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+// longestWord returns the widest word of text
+func longestWord(text string, size float64, bold bool) string {
+	longest, width := "", 0.0
+	for _, word := range strings.Fields(text) {
+		if w := textWidth(word, size, bold); w > width {
+			longest, width = word, w
+		}
+	}
+	return longest
+}
+
+// wrapText splits text into lines that fit in width
+func wrapText(text string, width, size float64, bold bool) []string {
+	words := strings.Fields(text)
+	if len(words) == 0 {
+		return nil
+	}
+
+	var lines []string
+	current := words[0]
+	for _, word := range words[1:] {
+		candidate := current + " " + word
+		if textWidth(candidate, size, bold) > width+0.01 {
+			lines = append(lines, current)
+			current = word
+		} else {
+			current = candidate
+		}
+	}
+	return append(lines, current)
+}
+
+func textContent(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var b strings.Builder
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		if child.Type == html.ElementNode && child.DataAtom == atom.Br {
+			b.WriteString(" ")
+			continue
+		}
+		b.WriteString(textContent(child))
+	}
+	return b.String()
+}
+
+func hasBoldChild(n *html.Node) bool {
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		if child.Type == html.ElementNode && (child.DataAtom == atom.Strong || child.DataAtom == atom.B) {
+			return true
+		}
+	}
+	return false
+}
+
+func isPageBreak(n *html.Node) bool {
+	style := strings.ReplaceAll(attr(n, "style"), " ", "")
+	return hasClass(n, "page-break") ||
+		strings.Contains(style, "page-break-before:always") ||
+		strings.Contains(style, "break-before:page")
+}
+
+func hasClass(n *html.Node, class string) bool {
+	for _, c := range strings.Fields(attr(n, "class")) {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+func attr(n *html.Node, name string) string {
+	for _, a := range n.Attr {
+		if a.Key == name {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// collapseSpace normalizes whitespace like an HTML renderer
+func collapseSpace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
@@ -0,0 +1,177 @@
+package reports
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// A4 page size and margins in PDF points
+const (
+	pageWidth    = 595.28
+	pageHeight   = 841.89
+	pageMargin   = 48.0
+	footerOffset = 24.0
+)
+
+// helveticaWidths are the glyph widths of ASCII 32..126 in 1/1000 em (from the AFM metrics)
+var helveticaWidths = [95]int{
+	278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556,
+	1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778,
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556,
+	333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556,
+	556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584,
+}
+
+var helveticaBoldWidths = [95]int{
+	278, 333, 474, 556, 556, 889, 722, 238, 333, 333, 389, 584, 278, 333, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 333, 333, 584, 584, 584, 611,
+	975, 722, 722, 722, 722, 667, 611, 778, 722, 278, 556, 722, 611, 833, 722, 778,
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 333, 278, 333, 584, 556,
+	333, 556, 611, 556, 611, 556, 333, 611, 611, 278, 278, 556, 278, 889, 611, 611,
+	611, 611, 389, 556, 333, 611, 556, 778, 556, 556, 500, 389, 280, 389, 584,
+}
+
+// textWidth returns the width of s in points for the standard Helvetica fonts
+func textWidth(s string, size float64, bold bool) float64 {
+	widths := &helveticaWidths
+	if bold {
+		widths = &helveticaBoldWidths
+	}
+
+	total := 0
+	for _, r := range s {
+		if r >= 32 && r <= 126 {
+			total += widths[r-32]
+		} else {
+			total += 556
+		}
+	}
+	return float64(total) * size / 1000
+}
+
+// pdfWriter produces a minimal PDF using the built-in Helvetica fonts, so no
+// external binary or font file is needed. Coordinates are measured from the
+// top-left corner of the page.
+type pdfWriter struct {
+	pages []*bytes.Buffer
+}
+
+// newPDFWriter creates a writer with one empty page
+func newPDFWriter() *pdfWriter {
+	w := &pdfWriter{}
+	w.AddPage()
+	return w
+}
+
+// AddPage starts a new page
+func (w *pdfWriter) AddPage() {
+	w.pages = append(w.pages, &bytes.Buffer{})
+}
+
+// PageCount returns the number of pages
+func (w *pdfWriter) PageCount() int {
+	return len(w.pages)
+}
+
+func (w *pdfWriter) current() *bytes.Buffer {
+	return w.pages[len(w.pages)-1]
+}
+
+// Text draws s with its baseline at (x, y)
+func (w *pdfWriter) Text(x, y, size float64, bold bool, s string) {
+	w.textOnPage(w.current(), x, y, size, bold, s)
+}
+
+func (w *pdfWriter) textOnPage(page *bytes.Buffer, x, y, size float64, bold bool, s string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(page, "BT /%s %.2f Tf %.2f %.2f Td (%s) Tj ET\n",
+		font, size, x, pageHeight-y, escapePDFString(s))
+}
+
+// Line draws a thin line between two points
+func (w *pdfWriter) Line(x1, y1, x2, y2 float64) {
+	fmt.Fprintf(w.current(), "0.5 w %.2f %.2f m %.2f %.2f l S\n", x1, pageHeight-y1, x2, pageHeight-y2)
+}
+
+// Bytes serializes the document, numbering pages in the footer
+func (w *pdfWriter) Bytes() []byte {
+	var out bytes.Buffer
+	var offsets []int
+
+	beginObject := func() int {
+		offsets = append(offsets, out.Len())
+		n := len(offsets)
+		fmt.Fprintf(&out, "%d 0 obj\n", n)
+		return n
+	}
+
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	// Objects 1-4: catalog, page tree, regular and bold font
+	pageCount := len(w.pages)
+	kids := make([]string, pageCount)
+	for i := range w.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+	}
+
+	beginObject()
+	out.WriteString("<< /Type /Catalog /Pages 2 0 R >>\nendobj\n")
+	beginObject()
+	fmt.Fprintf(&out, "<< /Type /Pages /Kids [%s] /Count %d >>\nendobj\n", strings.Join(kids, " "), pageCount)
+	beginObject()
+	out.WriteString("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>\nendobj\n")
+	beginObject()
+	out.WriteString("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>\nendobj\n")
+
+	for i, page := range w.pages {
+		var content bytes.Buffer
+		content.Write(page.Bytes())
+		footer := fmt.Sprintf("Page %d / %d", i+1, pageCount)
+		w.textOnPage(&content, (pageWidth-textWidth(footer, 8, false))/2, pageHeight-footerOffset, 8, false, footer)
+
+		n := beginObject()
+		fmt.Fprintf(&out, "<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] "+
+			"/Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>\nendobj\n",
+			pageWidth, pageHeight, n+1)
+
+		beginObject()
+		fmt.Fprintf(&out, "<< /Length %d >>\nstream\n", content.Len())
+		out.Write(content.Bytes())
+		out.WriteString("endstream\nendobj\n")
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	return out.Bytes()
+}
+
+// escapePDFString encodes s as a WinAnsi literal string body
+func escapePDFString(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r >= 32 && r <= 126:
+			b.WriteRune(r)
+		case r == '€':
+			b.WriteString("\\200")
+		case r >= 0xA0 && r <= 0xFF:
+			fmt.Fprintf(&b, "\\%03o", r)
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,180 @@
+package reports
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"goodoo/fields"
+	"goodoo/models"
+	"goodoo/workpool"
+)
+
+// Loader reads the records printed by a report, in the order of ids.
+// Related data should be prefetched so templates do not query the database.
+type Loader func(env *models.Environment, ids []uint) ([]interface{}, error)
+
+// Report is a printable document bound to a model (like Odoo's ir.actions.report)
+type Report struct {
+	Name     string
+	Model    string
+	Title    string
+	Template string
+	// Load is optional; field-defined models are read generically when it is nil
+	Load Loader
+	// FileName returns the download name of a single-record document
+	FileName func(doc interface{}) string
+}
+
+// Context is the data passed to report templates
+type Context struct {
+	Report *Report
+	Docs   []interface{}
+	Lang   string
+	// PrintDate is in the timezone of the environment
+	PrintDate time.Time
+}
+
+// printDate returns the current time in the timezone of the environment
+func printDate(env *models.Environment) time.Time {
+	_, location := fields.DisplayLocale(env)
+	return time.Now().In(location)
+}
+
+// Renderer renders a named template, satisfied by the application's echo renderer
+type Renderer interface {
+	Render(w io.Writer, name string, data interface{}, c echo.Context) error
+}
+
+var (
+	registry = make(map[string]*Report)
+	mutex    sync.RWMutex
+)
+
+// Register adds a report to the registry
+func Register(report *Report) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	registry[report.Name] = report
+}
+
+// Get returns a registered report by name
+func Get(name string) (*Report, bool) {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	report, exists := registry[name]
+	return report, exists
+}
+
+// List returns all registered reports sorted by name
+func List() []*Report {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	reports := make([]*Report, 0, len(registry))
+	for _, report := range registry {
+		reports = append(reports, report)
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Name < reports[j].Name })
+	return reports
+}
+
+// load reads the report records through the report loader or the generic model reader
+func (r *Report) load(env *models.Environment, ids []uint) ([]interface{}, error) {
+	if r.Load != nil {
+		return r.Load(env, ids)
+	}
+
+	model, exists := env.GetFieldModel(r.Model)
+	if !exists {
+		return nil, fmt.Errorf("model %s not found for report %s", r.Model, r.Name)
+	}
+	records, err := model.Read(env, ids, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	docs := make([]interface{}, len(records))
+	for i, record := range records {
+		docs[i] = record
+	}
+	return docs, nil
+}
+
+// RenderHTML renders the report template for the given records
+func (r *Report) RenderHTML(renderer Renderer, env *models.Environment, ids []uint) ([]byte, []interface{}, error) {
+	docs, err := r.load(env, ids)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(docs) == 0 {
+		return nil, nil, fmt.Errorf("no %s records found", r.Model)
+	}
+
+	var buf bytes.Buffer
+	data := Context{Report: r, Docs: docs, Lang: env.Lang(), PrintDate: printDate(env)}
+	if err := renderer.Render(&buf, r.Template, data, nil); err != nil {
+		return nil, nil, fmt.Errorf("failed to render template %s: %w", r.Template, err)
+	}
+	return buf.Bytes(), docs, nil
+}
+
+// RenderPDF renders the report as a PDF with one document per record
+// separated by page breaks. Several records are rendered and laid out on
+// the worker pool, one document each, and their pages joined in order.
+func (r *Report) RenderPDF(renderer Renderer, env *models.Environment, ids []uint) ([]byte, []interface{}, error) {
+	if len(ids) <= 1 || workpool.CurrentStats().Size <= 1 {
+		content, docs, err := r.RenderHTML(renderer, env, ids)
+		if err != nil {
+			return nil, nil, err
+		}
+		pdf, err := renderPDF(string(content))
+		if err != nil {
+			return nil, nil, err
+		}
+		return pdf, docs, nil
+	}
+
+	docs, err := r.load(env, ids)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(docs) == 0 {
+		return nil, nil, fmt.Errorf("no %s records found", r.Model)
+	}
+
+	printed := printDate(env)
+	writers := make([]*pdfWriter, len(docs))
+	err = workpool.Map(env.Context(), len(docs), func(ctx context.Context, i int) error {
+		var buf bytes.Buffer
+		data := Context{Report: r, Docs: docs[i : i+1], Lang: env.Lang(), PrintDate: printed}
+		if err := renderer.Render(&buf, r.Template, data, nil); err != nil {
+			return fmt.Errorf("failed to render template %s: %w", r.Template, err)
+		}
+		writer, err := layoutPages(buf.String())
+		writers[i] = writer
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pdf := &pdfWriter{}
+	for _, writer := range writers {
+		pdf.pages = append(pdf.pages, writer.pages...)
+	}
+	return pdf.Bytes(), docs, nil
+}
+
+// DownloadName returns the file name of the printed document
+func (r *Report) DownloadName(docs []interface{}) string {
+	if len(docs) == 1 && r.FileName != nil {
+		return r.FileName(docs[0]) + ".pdf"
+	}
+	return r.Title + ".pdf"
+}
@@ -0,0 +1,46 @@
+package reports
+
+import (
+	"fmt"
+
+	"goodoo/models"
+)
+
+// Sale order confirmation, the reference report (like Odoo's sale.report_saleorder)
+func init() {
+	Register(&Report{
+		Name:     "sale.report_saleorder",
+		Model:    "sale.order",
+		Title:    "Quotation - Order",
+		Template: "report_saleorder.html",
+		Load:     loadSaleOrders,
+		FileName: func(doc interface{}) string {
+			return fmt.Sprintf("Order - %s", doc.(models.SaleOrder).Name)
+		},
+	})
+}
+
+// loadSaleOrders reads the orders with partner and lines prefetched
+func loadSaleOrders(env *models.Environment, ids []uint) ([]interface{}, error) {
+	orders, err := models.LoadSaleOrders(env.GetDB(), ids)
+	if err != nil {
+		return nil, err
+	}
+
+	var countries []*models.Country
+	for i := range orders {
+		if orders[i].Partner.Country != nil {
+			countries = append(countries, orders[i].Partner.Country)
+		}
+	}
+	if err := models.TranslateCountries(env.GetDB(), env.Lang(), countries...); err != nil {
+		return nil, err
+	}
+
+	docs := make([]interface{}, len(orders))
+	for i := range orders {
+		orders[i].ComputeAmounts()
+		docs[i] = orders[i]
+	}
+	return docs, nil
+}
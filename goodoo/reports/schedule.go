@@ -0,0 +1,441 @@
+package reports
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"goodoo/clock"
+	"goodoo/cron"
+	"goodoo/database"
+	"goodoo/logging"
+	"goodoo/mail"
+	"goodoo/models"
+	"goodoo/notification"
+	"goodoo/scheduler"
+	"gorm.io/gorm"
+)
+
+// ErrScheduleRunning is returned when a schedule is run while a previous
+// run is still executing
+var ErrScheduleRunning = errors.New("report schedule is already running")
+
+// MaxScheduledDocuments bounds the records printed by a report schedule;
+// exports are not bounded, their output is sent as a link when large
+const MaxScheduledDocuments = 1000
+
+// staleScheduleTimeout releases the lock of a run whose process died
+// without finishing it
+const staleScheduleTimeout = 6 * time.Hour
+
+// scheduleMailTemplate is the mail template of the output of a schedule
+const scheduleMailTemplate = "mail_report_schedule"
+
+// NextRun returns the first activation of a cron expression after a time,
+// evaluated in a timezone
+func NextRun(expression, timezone string, after time.Time) (time.Time, error) {
+	schedule, err := cron.ParseCronExpression(expression)
+	if err != nil {
+		return time.Time{}, err
+	}
+	location := time.UTC
+	if timezone != "" {
+		if location, err = time.LoadLocation(timezone); err != nil {
+			return time.Time{}, fmt.Errorf("invalid timezone %q", timezone)
+		}
+	}
+	next := schedule.Next(after.In(location))
+	if next.IsZero() {
+		return time.Time{}, fmt.Errorf("%w: %s", cron.ErrNeverActivates, expression)
+	}
+	return next, nil
+}
+
+// output is the rendered document of a run
+type output struct {
+	Name        string
+	ContentType string
+	Data        []byte
+	Records     int
+}
+
+// Runner executes the due report schedules of one database
+type Runner struct {
+	dbName   string
+	logger   *logging.Logger
+	clock    clock.Clock
+	renderer Renderer
+}
+
+// NewRunner creates a runner for a database rendering reports with
+// renderer, deciding which schedules are due with clk, the system clock
+// when nil
+func NewRunner(dbName string, clk clock.Clock, renderer Renderer) *Runner {
+	return &Runner{dbName: dbName, logger: logging.GetLogger("goodoo.reports.schedule"), clock: clock.OrReal(clk), renderer: renderer}
+}
+
+// ScheduleRunner registers a scheduler job polling the report schedules
+// of a database, and one deleting the output of expired download links
+func ScheduleRunner(s *scheduler.Scheduler, dbName string, renderer Renderer, interval time.Duration) {
+	runner := NewRunner(dbName, s.Clock(), renderer)
+	s.Every("report.schedule."+dbName, interval, runner.Tick)
+	models.ScheduleReportOutputPrune(s, dbName, time.Hour)
+}
+
+func (r *Runner) db(ctx context.Context) (*gorm.DB, error) {
+	db, err := database.GetDatabase(r.dbName)
+	if err != nil {
+		return nil, err
+	}
+	return db.WithContext(ctx), nil
+}
+
+// Tick runs every active schedule whose next run is due. A schedule that
+// missed several activations runs once.
+func (r *Runner) Tick(ctx context.Context) error {
+	db, err := r.db(ctx)
+	if err != nil {
+		return err
+	}
+
+	var schedules []models.ReportSchedule
+	if err := db.Where("active = ? AND next_run <= ?", true, r.clock.Now()).Order("next_run").Find(&schedules).Error; err != nil {
+		return err
+	}
+
+	for i := range schedules {
+		if ctx.Err() != nil {
+			break
+		}
+		schedule := &schedules[i]
+		if _, err := r.run(ctx, db, schedule, false); err != nil && !errors.Is(err, ErrScheduleRunning) {
+			r.logger.Error("Report schedule %s (%d) failed: %v", schedule.Name, schedule.ID, err)
+		}
+	}
+	return nil
+}
+
+// RunNow runs a schedule immediately, keeping its next run
+func (r *Runner) RunNow(ctx context.Context, id uint) (*models.ReportScheduleRun, error) {
+	db, err := r.db(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var schedule models.ReportSchedule
+	if err := db.First(&schedule, id).Error; err != nil {
+		return nil, err
+	}
+	return r.run(ctx, db, &schedule, true)
+}
+
+// claim marks the schedule as running unless another run holds it, across
+// processes
+func (r *Runner) claim(db *gorm.DB, schedule *models.ReportSchedule, now time.Time) (bool, error) {
+	result := db.Model(&models.ReportSchedule{}).
+		Where("id = ? AND (running_since IS NULL OR running_since < ?)", schedule.ID, now.Add(-staleScheduleTimeout)).
+		Update("running_since", now)
+	return result.RowsAffected == 1, result.Error
+}
+
+// run renders and mails the output of a schedule and records the run; a
+// failure is recorded on the run and notified to the owner
+func (r *Runner) run(ctx context.Context, db *gorm.DB, schedule *models.ReportSchedule, manual bool) (*models.ReportScheduleRun, error) {
+	now := r.clock.Now()
+	claimed, err := r.claim(db, schedule, now)
+	if err != nil {
+		return nil, err
+	}
+	if !claimed {
+		r.logger.Warning("Skipping report schedule %s (%d): previous run still executing", schedule.Name, schedule.ID)
+		return nil, ErrScheduleRunning
+	}
+
+	run := &models.ReportScheduleRun{ScheduleID: schedule.ID, State: models.ReportRunRunning, Manual: manual, StartedAt: now}
+	if err := db.Create(run).Error; err != nil {
+		db.Model(schedule).Update("running_since", nil)
+		return nil, err
+	}
+
+	if err := r.execute(ctx, db, schedule, run); err != nil {
+		run.State = models.ReportRunFailed
+		run.Error = err.Error()
+		r.logger.Error("Report schedule %s (%d) failed: %v", schedule.Name, schedule.ID, err)
+		r.notifyFailure(schedule, run)
+	} else {
+		run.State = models.ReportRunDone
+		r.logger.Info("Report schedule %s (%d) mailed %d record(s), %d bytes", schedule.Name, schedule.ID, run.Records, run.OutputSize)
+	}
+
+	finished := r.clock.Now()
+	run.FinishedAt = &finished
+	run.DurationMs = finished.Sub(run.StartedAt).Milliseconds()
+	if err := db.Save(run).Error; err != nil {
+		r.logger.Error("Failed to record run of report schedule %s (%d): %v", schedule.Name, schedule.ID, err)
+	}
+
+	// Manual runs keep the planned next run
+	updates := map[string]interface{}{"running_since": nil, "last_run": now}
+	if !manual {
+		next, err := NextRun(schedule.CronExpression, schedule.Timezone, now)
+		if err != nil {
+			// An expression that no longer parses, or never activates,
+			// would fail every minute
+			updates["active"] = false
+			r.logger.Error("Report schedule %s (%d) deactivated: %v", schedule.Name, schedule.ID, err)
+		} else {
+			updates["next_run"] = next
+		}
+	}
+	if err := db.Model(schedule).Updates(updates).Error; err != nil {
+		return run, err
+	}
+	return run, nil
+}
+
+// execute renders the output as the owner and queues the mail, storing
+// outputs above the attachment cap behind a download link
+func (r *Runner) execute(ctx context.Context, db *gorm.DB, schedule *models.ReportSchedule, run *models.ReportScheduleRun) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+
+	var owner models.User
+	if err := db.First(&owner, schedule.UserID).Error; err != nil {
+		return fmt.Errorf("owner %d not found: %w", schedule.UserID, err)
+	}
+	if !owner.Active {
+		return fmt.Errorf("owner %s is archived", owner.Login)
+	}
+	recipients, err := r.recipients(db, schedule)
+	if err != nil {
+		return err
+	}
+
+	env := ScheduleEnvironment(db, r.dbName, schedule, &owner)
+	out, err := r.render(ctx, env, schedule)
+	if err != nil {
+		return err
+	}
+	run.Records, run.OutputSize = out.Records, len(out.Data)
+
+	data := map[string]interface{}{
+		"Schedule": schedule,
+		"Owner":    &owner,
+		"Records":  out.Records,
+		"Date":     r.clock.Now().In(scheduleLocation(schedule)).Format("2006-01-02"),
+	}
+	var attachments []mail.Attachment
+	limit := models.GetParamInt(r.dbName, models.ParamReportMaxAttachmentBytes, models.DefaultReportMaxAttachmentBytes)
+	if len(out.Data) <= limit {
+		attachments = []mail.Attachment{{Name: out.Name, ContentType: out.ContentType, Data: out.Data}}
+	} else {
+		link, days, err := r.storeOutput(db, run, out)
+		if err != nil {
+			return err
+		}
+		data["Link"], data["Days"] = link, days
+	}
+
+	msg, err := mail.RenderTemplate(r.renderer, scheduleMailTemplate, owner.Lang, data)
+	if err != nil {
+		return err
+	}
+	msg.From = mail.DefaultFrom()
+	msg.To = recipients
+	msg.Attachments = attachments
+	queued, err := mail.Enqueue(db, msg)
+	if err != nil {
+		return err
+	}
+	run.MailID = &queued.ID
+	return nil
+}
+
+// ScheduleEnvironment returns the environment the output of a schedule is
+// rendered with: the owner's, in their language and the schedule timezone
+func ScheduleEnvironment(db *gorm.DB, dbName string, schedule *models.ReportSchedule, owner *models.User) *models.Environment {
+	context := owner.SessionContext()
+	if schedule.Timezone != "" {
+		context["tz"], context["timezone"] = schedule.Timezone, schedule.Timezone
+	}
+	return models.NewEnvironment(db, owner.ID).WithDBName(dbName).WithContext(context)
+}
+
+// scheduleLocation returns the timezone of a schedule, UTC when unset or
+// unknown
+func scheduleLocation(schedule *models.ReportSchedule) *time.Location {
+	if location, err := time.LoadLocation(schedule.Timezone); err == nil && schedule.Timezone != "" {
+		return location
+	}
+	return time.UTC
+}
+
+// recipients returns the addresses of the recipients of a schedule; the
+// users archived or without an email are left out
+func (r *Runner) recipients(db *gorm.DB, schedule *models.ReportSchedule) ([]string, error) {
+	var addresses []string
+	seen := make(map[string]bool)
+	add := func(address string) {
+		if key := strings.ToLower(address); address != "" && !seen[key] {
+			seen[key] = true
+			addresses = append(addresses, address)
+		}
+	}
+	if len(schedule.RecipientUserIDs) > 0 {
+		var users []models.User
+		if err := db.Where("id IN ? AND active = ?", []uint(schedule.RecipientUserIDs), true).Order("id").Find(&users).Error; err != nil {
+			return nil, err
+		}
+		for _, user := range users {
+			if user.Email == "" {
+				r.logger.Warning("Report schedule %s (%d): user %s has no email", schedule.Name, schedule.ID, user.Login)
+			}
+			add(user.Email)
+		}
+	}
+	for _, address := range schedule.RecipientEmails {
+		add(strings.TrimSpace(address))
+	}
+	if len(addresses) == 0 {
+		return nil, errors.New("no recipient has an email")
+	}
+	return addresses, nil
+}
+
+// render renders the output of a schedule: the records of the saved
+// filter and the domain, read by the environment user
+func (r *Runner) render(ctx context.Context, env *models.Environment, schedule *models.ReportSchedule) (*output, error) {
+	model, exists := env.GetFieldModel(schedule.Model)
+	if !exists {
+		return nil, fmt.Errorf("model %s not found", schedule.Model)
+	}
+	domain, err := schedule.DomainValue()
+	if err != nil {
+		return nil, err
+	}
+	order, fieldNames := "", []string(schedule.Fields)
+	if schedule.FilterID != nil {
+		filter, err := models.GetFilter(env, schedule.Model, *schedule.FilterID)
+		if err != nil {
+			return nil, fmt.Errorf("filter %d: %w", *schedule.FilterID, err)
+		}
+		view, err := model.FilterView(env, filter)
+		if err != nil {
+			return nil, fmt.Errorf("filter %d cannot be applied: %w", filter.ID, err)
+		}
+		for _, warning := range view.Warnings {
+			r.logger.Warning("Report schedule %s (%d): filter %d: %s", schedule.Name, schedule.ID, filter.ID, warning)
+		}
+		domain = append(view.Domain, domain...)
+		order = view.Sort
+		if len(fieldNames) == 0 {
+			fieldNames = view.Columns
+		}
+	}
+
+	stamp := r.clock.Now().In(scheduleLocation(schedule)).Format("2006-01-02")
+	name := fmt.Sprintf("%s %s.%s", schedule.Name, stamp, schedule.Format)
+
+	if schedule.Kind == models.ReportScheduleExport {
+		var buf bytes.Buffer
+		writer, err := model.NewCSVWriter(env, &buf, model.CSVColumns(env, fieldNames), true)
+		if err != nil {
+			return nil, err
+		}
+		count := 0
+		err = model.Stream(ctx, env, domain, fieldNames, models.StreamOptions{Order: order}, func(records []map[string]interface{}) error {
+			count += len(records)
+			return writer.Write(ctx, records)
+		})
+		if err == nil {
+			err = writer.Flush()
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &output{Name: name, ContentType: "text/csv", Data: buf.Bytes(), Records: count}, nil
+	}
+
+	report, exists := Get(schedule.Report)
+	if !exists {
+		return nil, fmt.Errorf("report %s not found", schedule.Report)
+	}
+	ids, err := model.Search(env, domain, 0, MaxScheduledDocuments+1, order)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) > MaxScheduledDocuments {
+		return nil, fmt.Errorf("the report prints at most %d records", MaxScheduledDocuments)
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no %s records match the schedule", schedule.Model)
+	}
+	if schedule.Format == models.ReportFormatHTML {
+		content, docs, err := report.RenderHTML(r.renderer, env, ids)
+		if err != nil {
+			return nil, err
+		}
+		return &output{Name: name, ContentType: "text/html", Data: content, Records: len(docs)}, nil
+	}
+	pdf, docs, err := report.RenderPDF(r.renderer, env, ids)
+	if err != nil {
+		return nil, err
+	}
+	return &output{Name: name, ContentType: "application/pdf", Data: pdf, Records: len(docs)}, nil
+}
+
+// storeOutput stores an output too large to be mailed as an attachment
+// of the run, and returns the link downloading it and the days it works
+func (r *Runner) storeOutput(db *gorm.DB, run *models.ReportScheduleRun, out *output) (string, int, error) {
+	token, err := run.NewDownloadToken()
+	if err != nil {
+		return "", 0, err
+	}
+	days := models.GetParamInt(r.dbName, models.ParamReportLinkDays, models.DefaultReportLinkDays)
+	expiresAt := r.clock.Now().AddDate(0, 0, days)
+	run.ExpiresAt = &expiresAt
+
+	attachment := &models.IrAttachment{
+		Name:     out.Name,
+		ResModel: models.ReportRunResModel,
+		ResID:    run.ID,
+		Mimetype: out.ContentType,
+		FileSize: len(out.Data),
+		Checksum: models.Checksum(out.Data),
+		Datas:    out.Data,
+		// Generated by the server, nothing to scan
+		ScanState: models.AttachmentScanClean,
+	}
+	if err := db.Create(attachment).Error; err != nil {
+		return "", 0, err
+	}
+	run.AttachmentID = &attachment.ID
+	if err := db.Model(run).Updates(map[string]interface{}{
+		"attachment_id": attachment.ID,
+		"token_hash":    *run.TokenHash,
+		"expires_at":    expiresAt,
+	}).Error; err != nil {
+		return "", 0, err
+	}
+
+	base := strings.TrimRight(models.GetParamString(r.dbName, models.ParamWebBaseURL, ""), "/")
+	if base == "" {
+		r.logger.Warning("%s is not set: the download link of run %d is relative", models.ParamWebBaseURL, run.ID)
+	}
+	return base + "/reports/scheduled/" + token, days, nil
+}
+
+// notifyFailure tells the owner of a schedule that a run failed
+func (r *Runner) notifyFailure(schedule *models.ReportSchedule, run *models.ReportScheduleRun) {
+	title := fmt.Sprintf("Scheduled report %s failed", schedule.Name)
+	payload := map[string]interface{}{"schedule_id": schedule.ID, "run_id": run.ID}
+	if _, err := notification.Notify(r.dbName, schedule.UserID, models.NotificationCategoryReport, models.NotificationError, title, run.Error, payload); err != nil {
+		r.logger.Warning("Failed to notify the failure of report schedule %d: %v", schedule.ID, err)
+	}
+}
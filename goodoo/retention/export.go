@@ -0,0 +1,152 @@
+package retention
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"goodoo/database"
+	"goodoo/models"
+	"gorm.io/gorm"
+)
+
+// archive gzips rows as JSON lines
+type archive struct {
+	buffer bytes.Buffer
+	writer *gzip.Writer
+	rows   int64
+}
+
+func newArchive() *archive {
+	a := &archive{}
+	a.writer = gzip.NewWriter(&a.buffer)
+	return a
+}
+
+// add writes the JSON lines read from rows, each a row_to_json text
+func (a *archive) add(rows interface {
+	Next() bool
+	Scan(dest ...interface{}) error
+	Err() error
+}) error {
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return err
+		}
+		if _, err := a.writer.Write(append([]byte(line), '\n')); err != nil {
+			return err
+		}
+		a.rows++
+	}
+	return rows.Err()
+}
+
+// save stores the archive as an attachment named after the purged relation
+func (a *archive) save(tx *gorm.DB, table, relation string) (uint, error) {
+	if err := a.writer.Close(); err != nil {
+		return 0, err
+	}
+	data := a.buffer.Bytes()
+	attachment := models.IrAttachment{
+		Name:     fmt.Sprintf("%s-%s.jsonl.gz", relation, time.Now().UTC().Format("20060102T150405Z")),
+		ResModel: ArchiveResModel,
+		ResField: table,
+		Mimetype: "application/gzip",
+		FileSize: len(data),
+		Checksum: models.Checksum(data),
+		Datas:    data,
+		// Generated by the server, nothing to scan
+		ScanState: models.AttachmentScanClean,
+	}
+	if err := tx.Create(&attachment).Error; err != nil {
+		return 0, err
+	}
+	return attachment.ID, nil
+}
+
+// exportPartition archives every row of a partition and returns the id of
+// the attachment
+func exportPartition(db *gorm.DB, policy Policy, partition string) (uint, error) {
+	rows, err := db.Raw(fmt.Sprintf("SELECT row_to_json(p)::text FROM %s p", quote(partition))).Rows()
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	a := newArchive()
+	if err := a.add(rows); err != nil {
+		return 0, err
+	}
+	return a.save(db, policy.Table, partition)
+}
+
+// deleteBatches deletes the rows of relation older than cutoff, at most
+// MaxBatches batches of BatchSize rows, each in a transaction writing the
+// archive of its rows, then vacuums the relation when VacuumRows were
+// deleted
+func deleteBatches(ctx context.Context, dbName string, db *gorm.DB, policy Policy, relation string, cutoff time.Time, export bool, c *Config, result *RunResult) error {
+	statement := fmt.Sprintf(`WITH purged AS (
+		DELETE FROM %[1]s WHERE id IN (SELECT id FROM %[1]s WHERE %[2]s < ? LIMIT ?) RETURNING *
+	) SELECT row_to_json(purged)::text FROM purged`, quote(relation), quote(policy.Column))
+
+	var deleted int64
+	for batch := 0; batch < c.MaxBatches; batch++ {
+		var count int64
+		err := db.Transaction(func(tx *gorm.DB) error {
+			rows, err := tx.Raw(statement, cutoff, c.BatchSize).Rows()
+			if err != nil {
+				return err
+			}
+			a := newArchive()
+			err = a.add(rows)
+			rows.Close()
+			if err != nil {
+				return err
+			}
+			count = a.rows
+			if export && count > 0 {
+				id, err := a.save(tx, policy.Table, relation)
+				if err != nil {
+					return fmt.Errorf("export: %w", err)
+				}
+				result.Attachments = append(result.Attachments, id)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		deleted += count
+		result.Deleted += count
+		if count < int64(c.BatchSize) || ctx.Err() != nil {
+			break
+		}
+	}
+
+	if c.VacuumRows > 0 && deleted >= int64(c.VacuumRows) {
+		return vacuum(ctx, dbName, db, relation, result)
+	}
+	return nil
+}
+
+// vacuum reclaims the space of the deleted rows of a relation; a vacuum
+// already running is left to finish
+func vacuum(ctx context.Context, dbName string, db *gorm.DB, relation string, result *RunResult) error {
+	var schema string
+	if err := db.Raw("SELECT current_schema()").Scan(&schema).Error; err != nil {
+		return err
+	}
+	connection, err := database.GetDatabaseConnection(dbName)
+	if err != nil {
+		return err
+	}
+	err = connection.Maintain(ctx, database.MaintenanceVacuum, schema, relation, database.DefaultMaintenanceOptions())
+	if errors.Is(err, database.ErrMaintenanceRunning) {
+		return nil
+	}
+	result.Vacuumed = err == nil
+	return err
+}
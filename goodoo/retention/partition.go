@@ -0,0 +1,319 @@
+package retention
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"gorm.io/gorm"
+)
+
+// Partition is a partition of a table partitioned by range; From and To
+// are nil for MINVALUE and MAXVALUE
+type Partition struct {
+	Name    string     `json:"name"`
+	From    *time.Time `json:"from,omitempty"`
+	To      *time.Time `json:"to,omitempty"`
+	Default bool       `json:"default,omitempty"`
+}
+
+// droppable reports whether every row of the partition is older than limit
+func (p Partition) droppable(limit time.Time) bool {
+	return !p.Default && p.To != nil && !p.To.After(limit)
+}
+
+// overlaps reports whether the partition holds dates of [from, to)
+func (p Partition) overlaps(from, to time.Time) bool {
+	if p.Default {
+		return false
+	}
+	return (p.From == nil || p.From.Before(to)) && (p.To == nil || p.To.After(from))
+}
+
+// minPartitionVersion is the first PostgreSQL with default partitions and
+// primary keys on partitioned tables
+const minPartitionVersion = 110000
+
+// quote quotes an identifier
+func quote(name string) string {
+	return pgx.Identifier{name}.Sanitize()
+}
+
+// partitionName names the monthly partition of a table starting at month
+func partitionName(table string, month time.Time) string {
+	return fmt.Sprintf("%s_p%s", table, month.Format("200601"))
+}
+
+// boundLayout formats the bounds of the partitions created; the offset is
+// read by timestamptz columns and ignored by timestamp ones
+const boundLayout = "2006-01-02 15:04:05-07"
+
+// boundLayouts parse the bounds printed by pg_get_expr, in the time zone
+// of the session for timestamptz columns
+var boundLayouts = []string{
+	"2006-01-02 15:04:05.999999-07:00",
+	"2006-01-02 15:04:05.999999-07",
+	"2006-01-02 15:04:05.999999",
+	"2006-01-02",
+}
+
+var rangeBound = regexp.MustCompile(`^FOR VALUES FROM \((.+)\) TO \((.+)\)$`)
+
+// parseBound parses the bound of a range partition as printed by
+// pg_get_expr, e.g. FOR VALUES FROM ('2026-10-01 00:00:00+00') TO
+// (MAXVALUE)
+func parseBound(name, bound string) (Partition, error) {
+	partition := Partition{Name: name}
+	if bound == "DEFAULT" {
+		partition.Default = true
+		return partition, nil
+	}
+	match := rangeBound.FindStringSubmatch(bound)
+	if match == nil {
+		return partition, fmt.Errorf("partition %s: unsupported bound %q", name, bound)
+	}
+	var err error
+	if partition.From, err = parseBoundValue(match[1]); err != nil {
+		return partition, fmt.Errorf("partition %s: %w", name, err)
+	}
+	if partition.To, err = parseBoundValue(match[2]); err != nil {
+		return partition, fmt.Errorf("partition %s: %w", name, err)
+	}
+	return partition, nil
+}
+
+// parseBoundValue parses a bound value, nil for MINVALUE and MAXVALUE
+func parseBoundValue(value string) (*time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "MINVALUE" || value == "MAXVALUE" {
+		return nil, nil
+	}
+	value = strings.Trim(value, "'")
+	for _, layout := range boundLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			t = t.UTC()
+			return &t, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported bound value %q", value)
+}
+
+// partitionedBy reports whether the table of a policy is partitioned by
+// range on its date column. Tables partitioned otherwise, e.g. by hand on
+// another key, are purged in batches.
+func partitionedBy(db *gorm.DB, policy Policy) (bool, error) {
+	var keys []string
+	err := db.Raw(`SELECT pg_get_partkeydef(c.oid) FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relname = ? AND n.nspname = current_schema() AND c.relkind = 'p'`, policy.Table).Scan(&keys).Error
+	if err != nil || len(keys) == 0 {
+		return false, err
+	}
+	key := strings.ReplaceAll(keys[0], `"`, "")
+	return key == "RANGE ("+policy.Column+")", nil
+}
+
+// listPartitions returns the partitions of a table, however they were
+// created, sorted by name
+func listPartitions(db *gorm.DB, table string) ([]Partition, error) {
+	var rows []struct {
+		Name  string
+		Bound string
+	}
+	err := db.Raw(`SELECT c.relname AS name, pg_get_expr(c.relpartbound, c.oid) AS bound FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhrelid
+		JOIN pg_class p ON p.oid = i.inhparent
+		JOIN pg_namespace n ON n.oid = p.relnamespace
+		WHERE p.relname = ? AND n.nspname = current_schema()
+		ORDER BY c.relname`, table).Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	partitions := make([]Partition, 0, len(rows))
+	for _, row := range rows {
+		partition, err := parseBound(row.Name, row.Bound)
+		if err != nil {
+			return nil, err
+		}
+		partitions = append(partitions, partition)
+	}
+	return partitions, nil
+}
+
+// defaultPartition returns the default partition of a table, empty when it
+// has none
+func defaultPartition(db *gorm.DB, table string) (string, error) {
+	partitions, err := listPartitions(db, table)
+	if err != nil {
+		return "", err
+	}
+	for _, partition := range partitions {
+		if partition.Default {
+			return partition.Name, nil
+		}
+	}
+	return "", nil
+}
+
+// EnsurePartitions creates the monthly partitions of a policy table from
+// the month of now to monthsAhead months later, and its default partition.
+// Months already covered by a partition, whatever its name or range, are
+// skipped, so it is idempotent and respects partitions created by hand.
+func EnsurePartitions(db *gorm.DB, policy Policy, now time.Time, monthsAhead int) error {
+	partitions, err := listPartitions(db, policy.Table)
+	if err != nil {
+		return err
+	}
+	now = now.UTC()
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i <= monthsAhead; i++ {
+		from, to := month.AddDate(0, i, 0), month.AddDate(0, i+1, 0)
+		covered := false
+		for _, partition := range partitions {
+			if partition.overlaps(from, to) {
+				covered = true
+				break
+			}
+		}
+		if covered {
+			continue
+		}
+		name := partitionName(policy.Table, from)
+		statement := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES FROM ('%s') TO ('%s')",
+			quote(name), quote(policy.Table), from.Format(boundLayout), to.Format(boundLayout))
+		if err := db.Exec(statement).Error; err != nil {
+			return fmt.Errorf("partition %s: %w", name, err)
+		}
+		logger.Info("Created partition %s of %s", name, policy.Table)
+	}
+
+	for _, partition := range partitions {
+		if partition.Default {
+			return nil
+		}
+	}
+	name := policy.Table + "_default"
+	if err := db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s PARTITION OF %s DEFAULT", quote(name), quote(policy.Table))).Error; err != nil {
+		return fmt.Errorf("partition %s: %w", name, err)
+	}
+	return nil
+}
+
+// supportsPartitions reports whether the server has the partitioning the
+// policy tables need
+func supportsPartitions(db *gorm.DB) (bool, error) {
+	var version int
+	if err := db.Raw("SELECT current_setting('server_version_num')::int").Scan(&version).Error; err != nil {
+		return false, err
+	}
+	return version >= minPartitionVersion, nil
+}
+
+// CreatePartitionedTables creates the missing policy tables with a model
+// partitioned by month on their date column, before the GORM migration
+// adds their indexes. Existing tables are left as they are: they are
+// purged in batches unless a DBA partitioned them. Nothing is done when
+// GOODOO_RETENTION_PARTITION is off or the server predates PostgreSQL 11.
+func CreatePartitionedTables(db *gorm.DB) error {
+	c := CurrentConfig()
+	if !c.Partition {
+		return nil
+	}
+	supported, err := supportsPartitions(db)
+	if err != nil || !supported {
+		return err
+	}
+	for _, policy := range Policies {
+		if policy.Model == nil || db.Migrator().HasTable(policy.Table) {
+			continue
+		}
+		if err := db.Transaction(func(tx *gorm.DB) error {
+			return createPartitioned(tx, policy)
+		}); err != nil {
+			return fmt.Errorf("failed to create %s partitioned: %w", policy.Table, err)
+		}
+		if err := EnsurePartitions(db, policy, time.Now(), c.MonthsAhead); err != nil {
+			return err
+		}
+		logger.Info("Created table %s partitioned by month on %s", policy.Table, policy.Column)
+	}
+	return nil
+}
+
+// createPartitioned creates the table of a policy from its model: GORM
+// creates a template whose columns and defaults the partitioned table
+// copies, then the sequence of the id moves to the partitioned table and
+// the template is dropped. The primary key includes the partition key, as
+// PostgreSQL requires.
+func createPartitioned(tx *gorm.DB, policy Policy) error {
+	template := policy.Table + "__template"
+	if err := tx.Table(template).Migrator().CreateTable(policy.Model); err != nil {
+		return err
+	}
+	table := quote(policy.Table)
+	statements := []string{
+		fmt.Sprintf("CREATE TABLE %s (LIKE %s INCLUDING DEFAULTS) PARTITION BY RANGE (%s)", table, quote(template), quote(policy.Column)),
+		fmt.Sprintf("ALTER TABLE %s ADD PRIMARY KEY (id, %s)", table, quote(policy.Column)),
+	}
+	for _, statement := range statements {
+		if err := tx.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+
+	var sequences []string
+	if err := tx.Raw("SELECT pg_get_serial_sequence(?, 'id')", quote(template)).Scan(&sequences).Error; err != nil {
+		return err
+	}
+	if len(sequences) > 0 && sequences[0] != "" {
+		statements = []string{
+			fmt.Sprintf("ALTER SEQUENCE %s OWNED BY %s.id", sequences[0], table),
+			fmt.Sprintf("ALTER SEQUENCE %s RENAME TO %s", sequences[0], quote(policy.Table+"_id_seq")),
+		}
+		for _, statement := range statements {
+			if err := tx.Exec(statement).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Exec(fmt.Sprintf("DROP TABLE %s", quote(template))).Error
+}
+
+// dropPartitions exports, detaches and drops the partitions of a policy
+// wholly older than cutoff
+func dropPartitions(db *gorm.DB, policy Policy, cutoff time.Time, export bool, result *RunResult) error {
+	partitions, err := listPartitions(db, policy.Table)
+	if err != nil {
+		return err
+	}
+	for _, partition := range partitions {
+		if !partition.droppable(cutoff) {
+			continue
+		}
+		var rows int64
+		if err := db.Raw(fmt.Sprintf("SELECT COUNT(*) FROM %s", quote(partition.Name))).Scan(&rows).Error; err != nil {
+			return err
+		}
+		if export && rows > 0 {
+			id, err := exportPartition(db, policy, partition.Name)
+			if err != nil {
+				return fmt.Errorf("export of %s: %w", partition.Name, err)
+			}
+			result.Attachments = append(result.Attachments, id)
+		}
+		if err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Exec(fmt.Sprintf("ALTER TABLE %s DETACH PARTITION %s", quote(policy.Table), quote(partition.Name))).Error; err != nil {
+				return err
+			}
+			return tx.Exec(fmt.Sprintf("DROP TABLE %s", quote(partition.Name))).Error
+		}); err != nil {
+			return fmt.Errorf("drop of %s: %w", partition.Name, err)
+		}
+		result.Deleted += rows
+		result.DroppedPartitions = append(result.DroppedPartitions, partition.Name)
+		logger.Info("Dropped partition %s of %s (%d rows)", partition.Name, policy.Table, rows)
+	}
+	return nil
+}
@@ -0,0 +1,393 @@
+// Package retention archives the old rows of the tables that only grow:
+// the chat messages, the audit log and the server logs. Each table has a
+// policy stored as system parameters (retention.<table>.days and
+// retention.<table>.export), read at every run. A scheduled run drops the
+// monthly partitions wholly older than the policy when the table is
+// partitioned by its date column, and otherwise deletes the old rows in
+// bounded batches, vacuuming the table after large deletes. The purged rows
+// are first exported as gzipped JSON lines to an attachment, for
+// compliance.
+package retention
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"goodoo/database"
+	"goodoo/logging"
+	"goodoo/models"
+	"goodoo/scheduler"
+	"gorm.io/gorm"
+)
+
+// Policy is a table whose old rows are purged
+type Policy struct {
+	Table string
+	// Column is the date of the rows, the partition key of partitioned tables
+	Column string
+	// Model is the GORM model of the table, created partitioned in new
+	// databases when set
+	Model interface{}
+}
+
+// Policies are the tables under retention
+var Policies = []Policy{
+	{Table: "chat_message", Column: "create_date", Model: &models.ChatMessage{}},
+	{Table: "audit_log", Column: "create_date", Model: &models.AuditLog{}},
+	{Table: "ir_logging", Column: "create_date"},
+}
+
+// DaysParam is the parameter holding the days a table keeps its rows, 0 or
+// unset to keep them forever
+func DaysParam(table string) string {
+	return "retention." + table + ".days"
+}
+
+// ExportParam is the parameter disabling the export of the purged rows of
+// a table when false
+func ExportParam(table string) string {
+	return "retention." + table + ".export"
+}
+
+// ArchiveResModel is the res_model of the attachments holding the purged
+// rows; their res_field is the table
+const ArchiveResModel = "ir.retention"
+
+// Config holds the settings of the retention runs
+type Config struct {
+	// Partition creates the policy tables partitioned by month in new
+	// databases, on PostgreSQL 11 and newer
+	Partition bool
+	// BatchSize is the rows deleted per transaction on tables that are not
+	// partitioned
+	BatchSize int
+	// MaxBatches bounds the batches of a table per run; the rest waits for
+	// the next run
+	MaxBatches int
+	// VacuumRows is the rows deleted from a table by a run beyond which it
+	// is vacuumed, 0 to never vacuum
+	VacuumRows int
+	// MonthsAhead is the monthly partitions created ahead of the current one
+	MonthsAhead int
+	// Interval is the time between runs
+	Interval time.Duration
+}
+
+// DefaultConfig returns partitioned tables with two months created ahead,
+// batches of 5000 rows, at most 100 per table and run, a vacuum beyond
+// 50000 deleted rows and hourly runs
+func DefaultConfig() *Config {
+	return &Config{
+		Partition:   true,
+		BatchSize:   5000,
+		MaxBatches:  100,
+		VacuumRows:  50000,
+		MonthsAhead: 2,
+		Interval:    time.Hour,
+	}
+}
+
+// LoadFromEnv overrides the configuration with GOODOO_RETENTION_PARTITION,
+// GOODOO_RETENTION_BATCH_SIZE, GOODOO_RETENTION_MAX_BATCHES,
+// GOODOO_RETENTION_VACUUM_ROWS and GOODOO_RETENTION_INTERVAL
+func (c *Config) LoadFromEnv() {
+	if value := os.Getenv("GOODOO_RETENTION_PARTITION"); value != "" {
+		if enabled, err := strconv.ParseBool(value); err == nil {
+			c.Partition = enabled
+		}
+	}
+	if value := os.Getenv("GOODOO_RETENTION_BATCH_SIZE"); value != "" {
+		if size, err := strconv.Atoi(value); err == nil && size > 0 {
+			c.BatchSize = size
+		}
+	}
+	if value := os.Getenv("GOODOO_RETENTION_MAX_BATCHES"); value != "" {
+		if count, err := strconv.Atoi(value); err == nil && count > 0 {
+			c.MaxBatches = count
+		}
+	}
+	if value := os.Getenv("GOODOO_RETENTION_VACUUM_ROWS"); value != "" {
+		if rows, err := strconv.Atoi(value); err == nil && rows >= 0 {
+			c.VacuumRows = rows
+		}
+	}
+	if value := os.Getenv("GOODOO_RETENTION_INTERVAL"); value != "" {
+		if interval, err := time.ParseDuration(value); err == nil && interval > 0 {
+			c.Interval = interval
+		}
+	}
+}
+
+// RunResult is the outcome of the last purge of a table
+type RunResult struct {
+	At       time.Time     `json:"at"`
+	Duration time.Duration `json:"duration"`
+	// Mode is partition when monthly partitions were dropped, batch when
+	// rows were deleted
+	Mode    string    `json:"mode"`
+	Cutoff  time.Time `json:"cutoff"`
+	Deleted int64     `json:"deleted"`
+	// DroppedPartitions are the partitions detached and dropped
+	DroppedPartitions []string `json:"dropped_partitions,omitempty"`
+	// Attachments are the ids of the attachments holding the purged rows
+	Attachments []uint `json:"attachments,omitempty"`
+	Vacuumed    bool   `json:"vacuumed"`
+	Error       string `json:"error,omitempty"`
+}
+
+// Purge modes
+const (
+	ModePartition = "partition"
+	ModeBatch     = "batch"
+)
+
+// PolicyReport is a policy with the data it has pending and its last run
+type PolicyReport struct {
+	Table  string `json:"table"`
+	Column string `json:"column"`
+	// Days is 0 when the table keeps its rows
+	Days        int         `json:"days"`
+	Export      bool        `json:"export"`
+	Partitioned bool        `json:"partitioned"`
+	Partitions  []Partition `json:"partitions,omitempty"`
+	Cutoff      *time.Time  `json:"cutoff,omitempty"`
+	// PendingRows are the rows older than the cutoff; PendingBytes is an
+	// estimate of their size
+	PendingRows  int64      `json:"pending_rows"`
+	PendingBytes int64      `json:"pending_bytes"`
+	LastRun      *RunResult `json:"last_run,omitempty"`
+	Error        string     `json:"error,omitempty"`
+}
+
+var (
+	config = DefaultConfig()
+	// results are the last runs by database and table
+	results = make(map[string]map[string]*RunResult)
+	// running serializes the runs of a process
+	running sync.Mutex
+	mutex   sync.Mutex
+	logger  = logging.GetLogger("goodoo.retention")
+)
+
+// Setup installs the configuration
+func Setup(c *Config) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	config = c
+}
+
+// CurrentConfig returns the retention configuration
+func CurrentConfig() *Config {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return config
+}
+
+// policySettings reads the days and export flag of a policy
+func policySettings(dbName string, policy Policy) (int, bool) {
+	days := models.GetParamInt(dbName, DaysParam(policy.Table), 0)
+	if days < 0 {
+		days = 0
+	}
+	return days, models.GetParamBool(dbName, ExportParam(policy.Table), true)
+}
+
+// cutoff returns the date before which the rows of a policy kept days are
+// purged
+func cutoff(now time.Time, days int) time.Time {
+	return now.UTC().AddDate(0, 0, -days)
+}
+
+// Run ensures the partitions ahead of the partitioned policy tables, then
+// purges the rows older than each policy
+func Run(ctx context.Context, dbName string) error {
+	running.Lock()
+	defer running.Unlock()
+
+	db, err := database.GetDatabase(dbName)
+	if err != nil {
+		return err
+	}
+	db = db.WithContext(ctx)
+	c := CurrentConfig()
+	now := time.Now()
+
+	var failed []string
+	for _, policy := range Policies {
+		partitioned, err := partitionedBy(db, policy)
+		if err != nil {
+			failed = append(failed, policy.Table)
+			logger.Error("Failed to inspect table %s: %v", policy.Table, err)
+			continue
+		}
+		if partitioned {
+			if err := EnsurePartitions(db, policy, now, c.MonthsAhead); err != nil {
+				logger.Error("Failed to create the partitions of %s: %v", policy.Table, err)
+			}
+		}
+
+		days, export := policySettings(dbName, policy)
+		if days == 0 {
+			continue
+		}
+		result := purge(ctx, dbName, db, policy, partitioned, cutoff(now, days), export, c)
+		result.Duration = time.Since(result.At)
+		record(dbName, policy.Table, result)
+		if result.Error != "" {
+			failed = append(failed, policy.Table)
+			logger.Error("Failed to purge %s of %s: %s", policy.Table, dbName, result.Error)
+		} else if result.Deleted > 0 || len(result.DroppedPartitions) > 0 {
+			logger.Info("Purged %d row(s) of %s older than %d days from %s", result.Deleted, policy.Table, days, dbName)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("retention failed for %v", failed)
+	}
+	return nil
+}
+
+// purge removes the rows of a policy older than cutoff
+func purge(ctx context.Context, dbName string, db *gorm.DB, policy Policy, partitioned bool, cutoff time.Time, export bool, c *Config) *RunResult {
+	result := &RunResult{At: time.Now(), Cutoff: cutoff, Mode: ModeBatch}
+	var err error
+	if partitioned {
+		result.Mode = ModePartition
+		err = dropPartitions(db, policy, cutoff, export, result)
+		if err == nil {
+			// Rows outside the monthly partitions land in the default one
+			var name string
+			if name, err = defaultPartition(db, policy.Table); err == nil && name != "" {
+				err = deleteBatches(ctx, dbName, db, policy, name, cutoff, export, c, result)
+			}
+		}
+	} else {
+		err = deleteBatches(ctx, dbName, db, policy, policy.Table, cutoff, export, c, result)
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// record keeps the last run of a table
+func record(dbName, table string, result *RunResult) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if results[dbName] == nil {
+		results[dbName] = make(map[string]*RunResult)
+	}
+	results[dbName][table] = result
+}
+
+// lastRun returns the last run of a table
+func lastRun(dbName, table string) *RunResult {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return results[dbName][table]
+}
+
+// Report returns each policy of a database with the rows older than its
+// cutoff, their estimated size and its last run
+func Report(ctx context.Context, dbName string) ([]PolicyReport, error) {
+	db, err := database.GetDatabase(dbName)
+	if err != nil {
+		return nil, err
+	}
+	db = db.WithContext(ctx)
+	now := time.Now()
+
+	reports := make([]PolicyReport, 0, len(Policies))
+	for _, policy := range Policies {
+		days, export := policySettings(dbName, policy)
+		report := PolicyReport{Table: policy.Table, Column: policy.Column, Days: days, Export: export, LastRun: lastRun(dbName, policy.Table)}
+		if err := pending(db, policy, days, now, &report); err != nil {
+			report.Error = err.Error()
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// pending measures the data of a policy older than its cutoff
+func pending(db *gorm.DB, policy Policy, days int, now time.Time, report *PolicyReport) error {
+	partitioned, err := partitionedBy(db, policy)
+	if err != nil {
+		return err
+	}
+	report.Partitioned = partitioned
+	if partitioned {
+		if report.Partitions, err = listPartitions(db, policy.Table); err != nil {
+			return err
+		}
+	}
+	if days == 0 {
+		return nil
+	}
+	limit := cutoff(now, days)
+	report.Cutoff = &limit
+
+	if !partitioned {
+		report.PendingRows, report.PendingBytes, err = olderRows(db, policy.Table, policy.Column, limit)
+		return err
+	}
+	for _, partition := range report.Partitions {
+		var rows, size int64
+		switch {
+		case partition.droppable(limit):
+			if err := db.Raw(fmt.Sprintf("SELECT COUNT(*) FROM %s", quote(partition.Name))).Scan(&rows).Error; err != nil {
+				return err
+			}
+			size, _, err = relationSize(db, partition.Name)
+		case partition.Default:
+			rows, size, err = olderRows(db, partition.Name, policy.Column, limit)
+		default:
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		report.PendingRows += rows
+		report.PendingBytes += size
+	}
+	return nil
+}
+
+// olderRows counts the rows of a relation older than limit and estimates
+// their size from the average row size of the relation
+func olderRows(db *gorm.DB, relation, column string, limit time.Time) (int64, int64, error) {
+	var rows int64
+	query := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s < ?", quote(relation), quote(column))
+	if err := db.Raw(query, limit).Scan(&rows).Error; err != nil {
+		return 0, 0, err
+	}
+	if rows == 0 {
+		return 0, 0, nil
+	}
+	size, tuples, err := relationSize(db, relation)
+	if err != nil || tuples <= 0 {
+		return rows, 0, err
+	}
+	return rows, int64(float64(size) / tuples * float64(rows)), nil
+}
+
+// relationSize returns the bytes of a relation with its indexes and TOAST,
+// and its estimated row count
+func relationSize(db *gorm.DB, relation string) (int64, float64, error) {
+	var row struct {
+		Size   int64
+		Tuples float64
+	}
+	err := db.Raw("SELECT pg_total_relation_size(c.oid) AS size, c.reltuples AS tuples FROM pg_class c WHERE c.oid = to_regclass(?)", quote(relation)).Scan(&row).Error
+	return row.Size, row.Tuples, err
+}
+
+// Schedule runs the retention of a database every configured interval
+func Schedule(s *scheduler.Scheduler, dbName string) {
+	s.Every("retention."+dbName, CurrentConfig().Interval, func(ctx context.Context) error {
+		return Run(ctx, dbName)
+	})
+}
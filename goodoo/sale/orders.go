@@ -0,0 +1,357 @@
+package sale
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"goodoo/models"
+	"gorm.io/gorm"
+)
+
+// ErrOrderNotFound is returned when an order id does not exist
+var ErrOrderNotFound = errors.New("sale order not found")
+
+// Odoo x2many commands accepted in order_line
+const (
+	CommandCreate = 0
+	CommandUpdate = 1
+	CommandDelete = 2
+)
+
+// ValidationError reports an invalid order payload. Line is the index of
+// the offending entry of order_line, or -1 when the error is on the order.
+type ValidationError struct {
+	Line    int
+	Field   string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	if e.Line >= 0 {
+		return fmt.Sprintf("order_line[%d].%s: %s", e.Line, e.Field, e.Message)
+	}
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+// LineValues are the writable fields of an order line
+type LineValues struct {
+	Name      *string  `json:"name"`
+	Sequence  *int     `json:"sequence"`
+	Quantity  *float64 `json:"product_uom_qty"`
+	PriceUnit *float64 `json:"price_unit"`
+	Discount  *float64 `json:"discount"`
+	TaxRate   *float64 `json:"tax_rate"`
+}
+
+func (v LineValues) apply(line *models.SaleOrderLine) {
+	if v.Name != nil {
+		line.Name = *v.Name
+	}
+	if v.Sequence != nil {
+		line.Sequence = *v.Sequence
+	}
+	if v.Quantity != nil {
+		line.Quantity = *v.Quantity
+	}
+	if v.PriceUnit != nil {
+		line.PriceUnit = *v.PriceUnit
+	}
+	if v.Discount != nil {
+		line.Discount = *v.Discount
+	}
+	if v.TaxRate != nil {
+		line.TaxRate = *v.TaxRate
+	}
+}
+
+// LineCommand is one entry of order_line: either a plain line object, which
+// creates a line, or an Odoo command [0, 0, {...}] (create),
+// [1, id, {...}] (update) or [2, id] (delete)
+type LineCommand struct {
+	Command int
+	ID      uint
+	Values  LineValues
+}
+
+// UnmarshalJSON accepts both the object and the command forms
+func (c *LineCommand) UnmarshalJSON(data []byte) error {
+	if trimmed := strings.TrimSpace(string(data)); !strings.HasPrefix(trimmed, "[") {
+		c.Command = CommandCreate
+		return json.Unmarshal(data, &c.Values)
+	}
+
+	var parts []json.RawMessage
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return err
+	}
+	if len(parts) < 2 || len(parts) > 3 {
+		return errors.New("a line command has 2 or 3 elements")
+	}
+	if err := json.Unmarshal(parts[0], &c.Command); err != nil {
+		return fmt.Errorf("invalid command: %w", err)
+	}
+	if err := json.Unmarshal(parts[1], &c.ID); err != nil {
+		return fmt.Errorf("invalid line id: %w", err)
+	}
+	if len(parts) == 3 && string(parts[2]) != "null" {
+		if err := json.Unmarshal(parts[2], &c.Values); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OrderInput is the payload creating or updating an order
+type OrderInput struct {
+	PartnerID    *uint         `json:"partner_id"`
+	UserID       *uint         `json:"user_id"`
+	Name         *string       `json:"name"`
+	DateOrder    *time.Time    `json:"date_order"`
+	CurrencyCode *string       `json:"currency_code"`
+	Note         *string       `json:"note"`
+	OrderLine    []LineCommand `json:"order_line"`
+}
+
+func (in OrderInput) apply(order *models.SaleOrder) {
+	if in.PartnerID != nil {
+		order.PartnerID = *in.PartnerID
+	}
+	if in.UserID != nil {
+		order.UserID = in.UserID
+	}
+	if in.Name != nil {
+		order.Name = *in.Name
+	}
+	if in.DateOrder != nil {
+		order.DateOrder = *in.DateOrder
+	}
+	if in.CurrencyCode != nil {
+		order.CurrencyCode = *in.CurrencyCode
+	}
+	if in.Note != nil {
+		order.Note = *in.Note
+	}
+}
+
+// validateLine checks the amounts of a line once the payload is applied
+func validateLine(index int, line *models.SaleOrderLine) error {
+	switch {
+	case strings.TrimSpace(line.Name) == "":
+		return &ValidationError{Line: index, Field: "name", Message: "is required"}
+	case line.Quantity < 0:
+		return &ValidationError{Line: index, Field: "product_uom_qty", Message: "must not be negative"}
+	case line.PriceUnit < 0:
+		return &ValidationError{Line: index, Field: "price_unit", Message: "must not be negative"}
+	case line.Discount < 0 || line.Discount > 100:
+		return &ValidationError{Line: index, Field: "discount", Message: "must be between 0 and 100"}
+	case line.TaxRate < 0:
+		return &ValidationError{Line: index, Field: "tax_rate", Message: "must not be negative"}
+	}
+	return nil
+}
+
+// checkPartner fails when the order's partner does not exist
+func checkPartner(tx *gorm.DB, partnerID uint) error {
+	if partnerID == 0 {
+		return &ValidationError{Line: -1, Field: "partner_id", Message: "is required"}
+	}
+	var count int64
+	if err := tx.Model(&models.Partner{}).Where("id = ?", partnerID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return &ValidationError{Line: -1, Field: "partner_id", Message: fmt.Sprintf("partner %d not found", partnerID)}
+	}
+	return nil
+}
+
+// newLine builds a line from a create command, with the column defaults
+func newLine(index int, command LineCommand, uid uint) (models.SaleOrderLine, error) {
+	line := models.SaleOrderLine{Sequence: 10, Quantity: 1}
+	line.CreateUID, line.WriteUID = uid, uid
+	command.Values.apply(&line)
+	return line, validateLine(index, &line)
+}
+
+// CreateOrder creates a quotation and its lines in one transaction; line
+// subtotals and the order totals are computed server-side
+func CreateOrder(env *models.Environment, input OrderInput) (uint, error) {
+	uid := env.GetUser()
+	var orderID uint
+	err := env.Transaction(func(tx *gorm.DB) error {
+		txEnv := env.WithDB(tx)
+
+		order := models.SaleOrder{Name: models.NewSaleOrderName, DateOrder: time.Now(), State: models.SaleStateDraft, CurrencyCode: "USD"}
+		order.CreateUID, order.WriteUID = uid, uid
+		input.apply(&order)
+		if err := checkPartner(tx, order.PartnerID); err != nil {
+			return err
+		}
+
+		lines := make([]models.SaleOrderLine, 0, len(input.OrderLine))
+		for i, command := range input.OrderLine {
+			if command.Command != CommandCreate {
+				return &ValidationError{Line: i, Field: "command", Message: "only create commands are allowed on a new order"}
+			}
+			line, err := newLine(i, command, uid)
+			if err != nil {
+				return err
+			}
+			lines = append(lines, line)
+		}
+		order.Lines = lines
+		order.ComputeAmounts()
+		order.Lines = nil
+
+		created, err := models.Model(txEnv, order).Create([]models.SaleOrder{order})
+		if err != nil {
+			return err
+		}
+		orderID = created.Records[0].ID
+
+		if len(lines) > 0 {
+			for i := range lines {
+				lines[i].OrderID = orderID
+			}
+			if _, err := models.Model(txEnv, models.SaleOrderLine{}).Create(lines); err != nil {
+				return err
+			}
+		}
+		return models.LogActivity(tx, uid, models.Activity{
+			Type:     models.ActivityRecordCreated,
+			Severity: models.SeveritySuccess,
+			Model:    "sale.order",
+			ResID:    orderID,
+			Params:   map[string]interface{}{"name": order.Name, "lines": len(lines)},
+		})
+	})
+	return orderID, err
+}
+
+// UpdateOrder writes the order fields and applies the line commands in one
+// transaction. Lines of locked or cancelled orders cannot be changed.
+func UpdateOrder(env *models.Environment, id uint, input OrderInput) error {
+	uid := env.GetUser()
+	return env.Transaction(func(tx *gorm.DB) error {
+		txEnv := env.WithDB(tx)
+
+		var order models.SaleOrder
+		if err := tx.First(&order, id).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrOrderNotFound
+			}
+			return err
+		}
+		if order.State == models.SaleStateDone || order.State == models.SaleStateCancel {
+			return &ValidationError{Line: -1, Field: "state", Message: fmt.Sprintf("order %s is %s and cannot be modified", order.Name, order.State)}
+		}
+
+		input.apply(&order)
+		if input.PartnerID != nil {
+			if err := checkPartner(tx, order.PartnerID); err != nil {
+				return err
+			}
+		}
+
+		existing, err := models.Model(txEnv, models.SaleOrderLine{}).
+			Search(models.Domain{[]interface{}{"order_id", "=", id}}, 0, 0, "")
+		if err != nil {
+			return err
+		}
+		byID := make(map[uint]*models.SaleOrderLine, len(existing.Records))
+		for i := range existing.Records {
+			byID[existing.Records[i].ID] = &existing.Records[i]
+		}
+
+		var created, updated, deleted int
+		for i, command := range input.OrderLine {
+			switch command.Command {
+			case CommandCreate:
+				line, err := newLine(i, command, uid)
+				if err != nil {
+					return err
+				}
+				line.OrderID = id
+				if _, err := models.Model(txEnv, models.SaleOrderLine{}).Create([]models.SaleOrderLine{line}); err != nil {
+					return err
+				}
+				created++
+			case CommandUpdate, CommandDelete:
+				line, exists := byID[command.ID]
+				if !exists {
+					return &ValidationError{Line: i, Field: "id", Message: fmt.Sprintf("line %d does not belong to order %d", command.ID, id)}
+				}
+				if command.Command == CommandDelete {
+					if err := tx.Delete(line).Error; err != nil {
+						return err
+					}
+					delete(byID, command.ID)
+					deleted++
+					continue
+				}
+				command.Values.apply(line)
+				line.WriteUID = uid
+				if err := validateLine(i, line); err != nil {
+					return err
+				}
+				if err := tx.Save(line).Error; err != nil {
+					return err
+				}
+				updated++
+			default:
+				return &ValidationError{Line: i, Field: "command", Message: fmt.Sprintf("unsupported command %d", command.Command)}
+			}
+		}
+
+		// Line hooks keep the stored totals up to date; the order fields
+		// are written without them so the totals are not overwritten
+		err = tx.Model(&models.SaleOrder{}).Where("id = ?", id).Updates(map[string]interface{}{
+			"partner_id":    order.PartnerID,
+			"name":          order.Name,
+			"date_order":    order.DateOrder,
+			"currency_code": order.CurrencyCode,
+			"note":          order.Note,
+			"write_uid":     uid,
+		}).Error
+		if err != nil {
+			return err
+		}
+		if err := models.RecomputeSaleOrderAmounts(tx, id); err != nil {
+			return err
+		}
+		return models.LogActivity(tx, uid, models.Activity{
+			Type:  models.ActivityRecordUpdated,
+			Model: "sale.order",
+			ResID: id,
+			Params: map[string]interface{}{
+				"name":          order.Name,
+				"lines_created": created,
+				"lines_updated": updated,
+				"lines_deleted": deleted,
+			},
+		})
+	})
+}
+
+// OrderView is an order with its lines, partner name and totals embedded
+type OrderView struct {
+	models.SaleOrder
+	PartnerName string `json:"partner_name"`
+}
+
+// GetOrder reads an order with its partner and lines
+func GetOrder(env *models.Environment, id uint) (*OrderView, error) {
+	orders, err := models.LoadSaleOrders(env.GetDB(), []uint{id})
+	if err != nil {
+		return nil, err
+	}
+	if len(orders) == 0 {
+		return nil, ErrOrderNotFound
+	}
+	order := orders[0]
+	order.ComputeAmounts()
+	return &OrderView{SaleOrder: order, PartnerName: order.Partner.Name}, nil
+}
@@ -0,0 +1,141 @@
+// Package sale implements the sales order workflow and exposes it as API
+// methods of sale.order.
+package sale
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"goodoo/api"
+	"goodoo/database"
+	"goodoo/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+func init() {
+	api.NewMethod("sale.order", "action_confirm", actionConfirm).
+		Help("Confirm quotations into sales orders").
+		Register()
+	api.NewMethod("sale.order", "action_cancel", actionCancel).
+		Help("Cancel quotations or sales orders").
+		Register()
+	api.NewMethod("sale.order", "action_done", actionDone).
+		Help("Lock confirmed sales orders").
+		Register()
+}
+
+// sequences remembers the databases whose sale.order sequence exists
+var sequences sync.Map
+
+// ensureSequence creates the sale.order sequence of a database on first use
+func ensureSequence(dbName string, db *gorm.DB) error {
+	if _, ok := sequences.Load(dbName); ok {
+		return nil
+	}
+	err := models.EnsureSequence(db, models.IrSequence{
+		Code:    models.SaleOrderSequence,
+		Name:    "Sales Order",
+		Prefix:  "S",
+		Padding: 5,
+	})
+	if err == nil {
+		sequences.Store(dbName, true)
+	}
+	return err
+}
+
+// Action is a state transition applied to one order
+type Action func(order *models.SaleOrder, tx *gorm.DB, uid uint) error
+
+// Apply runs an action on orders in one transaction, nested in the ambient
+// transaction of ctx if any; if one order cannot transition, none does
+func Apply(ctx context.Context, dbName string, uid uint, ids []uint, action Action) ([]models.SaleOrder, error) {
+	var db *gorm.DB
+	if cursor := database.CursorFromContext(ctx); cursor != nil {
+		db = cursor.DB()
+	} else {
+		var err error
+		if db, err = database.GetDatabase(dbName); err != nil {
+			return nil, err
+		}
+	}
+	db = db.WithContext(ctx)
+	if err := ensureSequence(dbName, db); err != nil {
+		return nil, err
+	}
+
+	var orders []models.SaleOrder
+	err := database.RetryableTransaction(ctx, db, func(tx *gorm.DB) error {
+		orders = nil
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id IN ?", ids).Order("id").Find(&orders).Error; err != nil {
+			return err
+		}
+		if len(orders) != len(ids) {
+			return errors.New("sale order not found")
+		}
+		for i := range orders {
+			if err := action(&orders[i], tx, uid); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
+
+// callScope extracts the database and user of an API call
+func callScope(ctx context.Context, ids []int) (string, uint, []uint, error) {
+	dbName, _ := ctx.Value("dbname").(string)
+	if dbName == "" {
+		return "", 0, nil, errors.New("no database selected")
+	}
+	uid, _ := ctx.Value("user_id").(int)
+	if uid == 0 {
+		return "", 0, nil, errors.New("authentication required")
+	}
+
+	recordIDs := make([]uint, 0, len(ids))
+	for _, id := range ids {
+		if id <= 0 {
+			return "", 0, nil, fmt.Errorf("invalid id %d", id)
+		}
+		recordIDs = append(recordIDs, uint(id))
+	}
+	return dbName, uint(uid), recordIDs, nil
+}
+
+// apiAction adapts an Action to the record method signature of the API registry
+func apiAction(ctx context.Context, ids []int, action Action) (interface{}, error) {
+	dbName, uid, recordIDs, err := callScope(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	orders, err := Apply(ctx, dbName, uid, recordIDs, action)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]map[string]interface{}, len(orders))
+	for i, order := range orders {
+		result[i] = map[string]interface{}{"id": order.ID, "name": order.Name, "state": order.State}
+	}
+	return result, nil
+}
+
+func actionConfirm(ctx context.Context, ids []int) (interface{}, error) {
+	return apiAction(ctx, ids, (*models.SaleOrder).ActionConfirm)
+}
+
+func actionCancel(ctx context.Context, ids []int) (interface{}, error) {
+	return apiAction(ctx, ids, (*models.SaleOrder).ActionCancel)
+}
+
+func actionDone(ctx context.Context, ids []int) (interface{}, error) {
+	return apiAction(ctx, ids, (*models.SaleOrder).ActionSetDone)
+}
@@ -0,0 +1,74 @@
+package scan
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// clamdChunkSize is the size of the chunks streamed to clamd, below its
+// default StreamMaxLength
+const clamdChunkSize = 64 << 10
+
+// Clamd scans files with a clamd daemon over TCP, with the INSTREAM command
+type Clamd struct {
+	// Address is the host:port clamd listens on (its TCPSocket)
+	Address string
+}
+
+func (c *Clamd) Name() string {
+	return "clamd"
+}
+
+// Scan streams data to clamd and reads its verdict: "stream: OK",
+// "stream: <signature> FOUND" or "<message> ERROR". The context deadline
+// bounds the whole exchange.
+func (c *Clamd) Scan(ctx context.Context, data []byte) (*Verdict, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", c.Address)
+	if err != nil {
+		return nil, fmt.Errorf("clamd: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// The z prefix delimits the command and its reply with NUL bytes
+	writer := bufio.NewWriter(conn)
+	writer.WriteString("zINSTREAM\x00")
+	size := make([]byte, 4)
+	for offset := 0; offset < len(data); offset += clamdChunkSize {
+		chunk := data[offset:min(offset+clamdChunkSize, len(data))]
+		binary.BigEndian.PutUint32(size, uint32(len(chunk)))
+		writer.Write(size)
+		writer.Write(chunk)
+	}
+	binary.BigEndian.PutUint32(size, 0)
+	writer.Write(size)
+	if err := writer.Flush(); err != nil {
+		return nil, fmt.Errorf("clamd: %w", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadBytes(0)
+	if err != nil && len(reply) == 0 {
+		return nil, fmt.Errorf("clamd: %w", err)
+	}
+	return parseClamdReply(string(bytes.TrimRight(reply, "\x00\n")))
+}
+
+// parseClamdReply returns the verdict of a clamd reply
+func parseClamdReply(reply string) (*Verdict, error) {
+	result := strings.TrimSpace(strings.TrimPrefix(reply, "stream:"))
+	switch {
+	case result == "OK":
+		return &Verdict{}, nil
+	case strings.HasSuffix(result, " FOUND"):
+		return &Verdict{Infected: true, Signature: strings.TrimSuffix(result, " FOUND")}, nil
+	}
+	return nil, fmt.Errorf("clamd: %s", result)
+}
@@ -0,0 +1,215 @@
+package scan
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"goodoo/database"
+	"goodoo/logging"
+	"goodoo/models"
+	"goodoo/notification"
+	"goodoo/scheduler"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// BatchSize is the number of pending attachments scanned per run
+const BatchSize = 20
+
+var logger = logging.GetLogger("goodoo.scan")
+
+// ProcessQueue scans the pending attachments of a database and returns how
+// many got a verdict. Rows are locked with SKIP LOCKED so several workers
+// never scan the same attachment; those failing the most are scanned last.
+// The administrators are notified of the quarantined ones.
+func ProcessQueue(ctx context.Context, db *gorm.DB, dbName string, scanner Scanner) (int, error) {
+	var attachments []models.IrAttachment
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Omit("datas").
+			Where("scan_state = ?", models.AttachmentScanPending).
+			Order("scan_attempts, id").
+			Limit(BatchSize).
+			Find(&attachments).Error
+		if err != nil {
+			return err
+		}
+
+		for i := range attachments {
+			if ctx.Err() != nil {
+				attachments = attachments[:i]
+				break
+			}
+			scanAttachment(ctx, tx, scanner, &attachments[i])
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	scanned := 0
+	for i := range attachments {
+		attachment := &attachments[i]
+		if attachment.ScanState == models.AttachmentScanPending {
+			continue
+		}
+		scanned++
+		if attachment.ScanState == models.AttachmentScanQuarantined {
+			notifyQuarantine(db, dbName, attachment)
+		}
+	}
+	return scanned, nil
+}
+
+// scanAttachment scans one pending attachment and records the outcome
+func scanAttachment(ctx context.Context, tx *gorm.DB, scanner Scanner, attachment *models.IrAttachment) {
+	c := CurrentConfig()
+	var verdict *Verdict
+	var err error
+	if int64(attachment.FileSize) > c.MaxFileSize {
+		// Retrying cannot help
+		attachment.ScanAttempts = c.MaxRetries - 1
+		err = fmt.Errorf("file of %d bytes exceeds the scan limit of %d bytes", attachment.FileSize, c.MaxFileSize)
+	} else {
+		var contents [][]byte
+		err = tx.Model(&models.IrAttachment{}).Where("id = ?", attachment.ID).Pluck("datas", &contents).Error
+		if err == nil && len(contents) == 1 {
+			scanCtx, cancel := context.WithTimeout(ctx, c.Timeout)
+			verdict, err = scanner.Scan(scanCtx, contents[0])
+			cancel()
+		}
+	}
+
+	now := time.Now()
+	updates := map[string]interface{}{"scan_date": now}
+	switch {
+	case err == nil && verdict.Infected:
+		attachment.ScanState, attachment.ScanResult = models.AttachmentScanQuarantined, verdict.Signature
+		logger.Warning("Attachment %d (%s) quarantined by %s: %s", attachment.ID, attachment.Name, scanner.Name(), verdict.Signature)
+	case err == nil:
+		attachment.ScanState, attachment.ScanResult = models.AttachmentScanClean, ""
+	default:
+		attachment.ScanAttempts++
+		attachment.ScanResult = err.Error()
+		if attachment.ScanAttempts >= c.MaxRetries {
+			attachment.ScanState = models.AttachmentScanFailed
+			logger.Error("Attachment %d (%s) could not be scanned after %d attempt(s): %v", attachment.ID, attachment.Name, attachment.ScanAttempts, err)
+		} else {
+			logger.Warning("Scan of attachment %d (%s) failed (attempt %d), retrying: %v", attachment.ID, attachment.Name, attachment.ScanAttempts, err)
+		}
+		updates["scan_attempts"] = attachment.ScanAttempts
+	}
+	attachment.ScanDate = &now
+	updates["scan_state"] = attachment.ScanState
+	updates["scan_result"] = attachment.ScanResult
+
+	if err := tx.Model(&models.IrAttachment{}).Where("id = ?", attachment.ID).UpdateColumns(updates).Error; err != nil {
+		logger.Error("Failed to update attachment %d: %v", attachment.ID, err)
+	}
+}
+
+// notifyQuarantine records a quarantined attachment in the activity feed
+// and notifies the administrators
+func notifyQuarantine(db *gorm.DB, dbName string, attachment *models.IrAttachment) {
+	uploader := "system"
+	var user models.User
+	if attachment.CreateUID != 0 && db.Select("id", "login").First(&user, attachment.CreateUID).Error == nil {
+		uploader = user.Login
+	}
+	params := map[string]interface{}{
+		"attachment_id": attachment.ID,
+		"name":          attachment.Name,
+		"uploader":      uploader,
+		"signature":     attachment.ScanResult,
+	}
+	activity := models.Activity{Type: models.ActivityAttachmentQuarantined, Severity: models.SeverityError,
+		Model: attachment.ResModel, ResID: attachment.ResID, Params: params}
+	if err := models.LogActivity(db, 0, activity); err != nil {
+		logger.Error("Failed to record the quarantine of attachment %d: %v", attachment.ID, err)
+	}
+
+	admins, err := models.AdminUserIDs(db)
+	if err != nil {
+		logger.Error("Failed to notify the quarantine of attachment %d: %v", attachment.ID, err)
+		return
+	}
+	title := fmt.Sprintf("File %s quarantined", attachment.Name)
+	body := fmt.Sprintf("%s uploaded %s, detected as %s. Release it if this is a false positive, or purge it.",
+		uploader, attachment.Name, attachment.ScanResult)
+	for _, uid := range admins {
+		notification.Notify(dbName, uid, models.NotificationCategorySecurity, models.NotificationError, title, body, params)
+	}
+}
+
+// Release marks a quarantined or unscanned attachment clean on the word of
+// an administrator, recorded in the activity feed
+func Release(db *gorm.DB, attachment *models.IrAttachment, uid uint, login string) error {
+	previous := attachment.ScanState
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&models.IrAttachment{}).Where("id = ?", attachment.ID).
+			UpdateColumns(map[string]interface{}{"scan_state": models.AttachmentScanClean, "write_uid": uid}).Error
+		if err != nil {
+			return err
+		}
+		attachment.ScanState = models.AttachmentScanClean
+		return models.LogActivity(tx, uid, models.Activity{
+			Type: models.ActivityAttachmentReleased, Severity: models.SeverityWarning,
+			Model: attachment.ResModel, ResID: attachment.ResID,
+			Params: map[string]interface{}{
+				"attachment_id": attachment.ID, "name": attachment.Name, "login": login,
+				"state": previous, "result": attachment.ScanResult,
+			},
+		})
+	})
+}
+
+// Rescan puts an attachment back in the queue with its retries reset, e.g.
+// after a scanner outage marked it scan_failed
+func Rescan(db *gorm.DB, attachment *models.IrAttachment) error {
+	attachment.ScanState, attachment.ScanAttempts, attachment.ScanResult = models.AttachmentScanPending, 0, ""
+	return db.Model(&models.IrAttachment{}).Where("id = ?", attachment.ID).UpdateColumns(map[string]interface{}{
+		"scan_state": attachment.ScanState, "scan_attempts": 0, "scan_result": "",
+	}).Error
+}
+
+// Purge deletes an attachment for good, recorded in the activity feed. A
+// purged avatar leaves its user with the generated one.
+func Purge(db *gorm.DB, attachment *models.IrAttachment, uid uint, login string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Delete(&models.IrAttachment{}, attachment.ID).Error; err != nil {
+			return err
+		}
+		if attachment.ResModel == "res.users" && attachment.ResField == "avatar" {
+			if err := tx.Model(&models.User{}).Where("id = ?", attachment.ResID).Update("avatar_checksum", "").Error; err != nil {
+				return err
+			}
+		}
+		return models.LogActivity(tx, uid, models.Activity{
+			Type: models.ActivityAttachmentPurged, Severity: models.SeverityWarning,
+			Model: attachment.ResModel, ResID: attachment.ResID,
+			Params: map[string]interface{}{
+				"attachment_id": attachment.ID, "name": attachment.Name, "login": login,
+				"state": attachment.ScanState, "result": attachment.ScanResult,
+			},
+		})
+	})
+}
+
+// Schedule registers the job scanning the pending attachments of a
+// database every interval
+func Schedule(s *scheduler.Scheduler, dbName string, interval time.Duration) {
+	s.Every("scan.attachments."+dbName, interval, func(ctx context.Context) error {
+		db, err := database.GetDatabase(dbName)
+		if err != nil {
+			return err
+		}
+		scanner := Default()
+		scanned, err := ProcessQueue(ctx, db.WithContext(ctx), dbName, scanner)
+		if scanned > 0 {
+			logger.Info("Scanned %d attachment(s) of %s with %s", scanned, dbName, scanner.Name())
+		}
+		return err
+	})
+}
@@ -0,0 +1,151 @@
+// Package scan checks uploaded attachments for malware before anyone can
+// download them. Attachments are stored pending; a scheduled job hands
+// their content to the configured Scanner (a clamd daemon, or a
+// pass-through for deployments without one) and moves them to clean or
+// quarantined, or to scan_failed once the scanner keeps failing.
+package scan
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"goodoo/models"
+)
+
+// Verdict is the result of scanning a file
+type Verdict struct {
+	Infected bool
+	// Signature is the detection name of an infected file
+	Signature string
+}
+
+// Scanner scans the content of files
+type Scanner interface {
+	// Name identifies the scanner in logs and metadata
+	Name() string
+	// Scan returns the verdict on data, or an error when the file could
+	// not be scanned
+	Scan(ctx context.Context, data []byte) (*Verdict, error)
+}
+
+// PassThrough is the scanner of deployments without one: every file is
+// clean
+type PassThrough struct{}
+
+func (PassThrough) Name() string {
+	return "none"
+}
+
+func (PassThrough) Scan(ctx context.Context, data []byte) (*Verdict, error) {
+	return &Verdict{}, nil
+}
+
+// Errors refusing the download of an attachment
+var (
+	ErrPending     = errors.New("the file is waiting for its malware scan")
+	ErrQuarantined = errors.New("the file was quarantined by the malware scan")
+	ErrScanFailed  = errors.New("the file could not be scanned for malware")
+)
+
+// Config holds the scanner and its bounds
+type Config struct {
+	// ClamdAddress is the host:port of a clamd daemon; empty scans nothing
+	// and finds every file clean
+	ClamdAddress string
+	// MaxFileSize is the largest file scanned; larger ones are marked
+	// scan_failed without scanning
+	MaxFileSize int64
+	// Timeout bounds the scan of one file
+	Timeout time.Duration
+	// MaxRetries is the number of failed scans after which a file is
+	// marked scan_failed
+	MaxRetries int
+	// BlockFailed refuses the download of files marked scan_failed
+	BlockFailed bool
+}
+
+// DefaultConfig returns no scanner, files up to 25 MB scanned within 30
+// seconds, 3 retries, and unscanned files blocked
+func DefaultConfig() *Config {
+	return &Config{
+		MaxFileSize: 25 << 20,
+		Timeout:     30 * time.Second,
+		MaxRetries:  3,
+		BlockFailed: true,
+	}
+}
+
+// LoadFromEnv overrides the configuration with GOODOO_SCAN_* variables
+func (c *Config) LoadFromEnv() {
+	if value := os.Getenv("GOODOO_SCAN_CLAMD_ADDRESS"); value != "" {
+		c.ClamdAddress = value
+	}
+	if value := os.Getenv("GOODOO_SCAN_MAX_FILE_SIZE"); value != "" {
+		if size, err := strconv.ParseInt(value, 10, 64); err == nil && size > 0 {
+			c.MaxFileSize = size
+		}
+	}
+	if value := os.Getenv("GOODOO_SCAN_TIMEOUT"); value != "" {
+		if timeout, err := time.ParseDuration(value); err == nil && timeout > 0 {
+			c.Timeout = timeout
+		}
+	}
+	if value := os.Getenv("GOODOO_SCAN_MAX_RETRIES"); value != "" {
+		if retries, err := strconv.Atoi(value); err == nil && retries > 0 {
+			c.MaxRetries = retries
+		}
+	}
+	if value := os.Getenv("GOODOO_SCAN_BLOCK_FAILED"); value != "" {
+		if block, err := strconv.ParseBool(value); err == nil {
+			c.BlockFailed = block
+		}
+	}
+}
+
+var (
+	config = DefaultConfig()
+	mutex  sync.RWMutex
+)
+
+// Setup installs the process-wide scanning configuration
+func Setup(c *Config) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	config = c
+}
+
+// CurrentConfig returns the scanning configuration
+func CurrentConfig() *Config {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return config
+}
+
+// Default returns the scanner of the configuration
+func Default() Scanner {
+	c := CurrentConfig()
+	if c.ClamdAddress == "" {
+		return PassThrough{}
+	}
+	return &Clamd{Address: c.ClamdAddress}
+}
+
+// CheckDownload returns the error refusing the download of an attachment
+// in its scan state, nil when it may be downloaded
+func CheckDownload(attachment *models.IrAttachment) error {
+	switch attachment.ScanState {
+	case models.AttachmentScanPending:
+		return ErrPending
+	case models.AttachmentScanQuarantined:
+		return ErrQuarantined
+	case models.AttachmentScanFailed:
+		if CurrentConfig().BlockFailed {
+			return ErrScanFailed
+		}
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package scheduler
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"goodoo/clock"
+	"goodoo/logging"
+)
+
+// JobFunc is the work done by a scheduled job
+type JobFunc func(ctx context.Context) error
+
+// Job is a function run at a fixed interval in the background
+type Job struct {
+	Name     string
+	Interval time.Duration
+	Run      JobFunc
+
+	mutex    sync.Mutex
+	lastRun  time.Time
+	lastErr  error
+	running  bool
+	runCount int64
+}
+
+// JobStatus describes a job for monitoring
+type JobStatus struct {
+	Name      string    `json:"name"`
+	Interval  string    `json:"interval"`
+	LastRun   time.Time `json:"last_run,omitempty"`
+	NextRun   time.Time `json:"next_run,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+	Running   bool      `json:"running"`
+	RunCount  int64     `json:"run_count"`
+}
+
+// Scheduler runs background jobs outside of request handling (like Odoo's cron threads)
+type Scheduler struct {
+	jobs   []*Job
+	mutex  sync.RWMutex
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	logger *logging.Logger
+	clock  clock.Clock
+}
+
+// New creates a stopped scheduler ticking with clk, the system clock when nil
+func New(clk clock.Clock) *Scheduler {
+	return &Scheduler{logger: logging.GetLogger("goodoo.scheduler"), clock: clock.OrReal(clk)}
+}
+
+var defaultScheduler = New(clock.Real)
+
+// Default returns the process-wide scheduler
+func Default() *Scheduler {
+	return defaultScheduler
+}
+
+// Clock returns the clock of the scheduler, for jobs computing dates
+func (s *Scheduler) Clock() clock.Clock {
+	return s.clock
+}
+
+// Every registers a job; jobs added after Start begin immediately
+func (s *Scheduler) Every(name string, interval time.Duration, fn JobFunc) *Job {
+	job := &Job{Name: name, Interval: interval, Run: fn}
+
+	s.mutex.Lock()
+	s.jobs = append(s.jobs, job)
+	started := s.ctx != nil
+	s.mutex.Unlock()
+
+	if started {
+		s.start(job)
+	}
+	return job
+}
+
+// Start launches all registered jobs
+func (s *Scheduler) Start() {
+	s.mutex.Lock()
+	if s.ctx != nil {
+		s.mutex.Unlock()
+		return
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	jobs := append([]*Job(nil), s.jobs...)
+	s.mutex.Unlock()
+
+	for _, job := range jobs {
+		s.start(job)
+	}
+	s.logger.Info("Scheduler started with %d job(s)", len(jobs))
+}
+
+// Stop cancels running jobs and waits for them to return
+func (s *Scheduler) Stop() {
+	s.mutex.Lock()
+	cancel := s.cancel
+	s.mutex.Unlock()
+
+	if cancel != nil {
+		cancel()
+		s.wg.Wait()
+	}
+}
+
+func (s *Scheduler) start(job *Job) {
+	// The ticker exists once Start returns, so that a fake clock advanced
+	// right after fires it
+	ticker := s.clock.NewTicker(job.Interval)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-ticker.C():
+				s.runJob(job)
+			}
+		}
+	}()
+}
+
+// runJob runs a job once, recovering from panics so one job cannot stop the others
+func (s *Scheduler) runJob(job *Job) {
+	job.mutex.Lock()
+	job.running = true
+	job.mutex.Unlock()
+
+	var err error
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				s.logger.Critical("Job %s panicked: %v", job.Name, r)
+			}
+		}()
+		err = job.Run(s.ctx)
+	}()
+
+	if err != nil {
+		s.logger.Error("Job %s failed: %v", job.Name, err)
+	}
+
+	job.mutex.Lock()
+	job.running = false
+	job.lastRun = s.clock.Now()
+	job.lastErr = err
+	job.runCount++
+	job.mutex.Unlock()
+}
+
+// Jobs returns the status of all registered jobs
+func (s *Scheduler) Jobs() []JobStatus {
+	s.mutex.RLock()
+	jobs := append([]*Job(nil), s.jobs...)
+	s.mutex.RUnlock()
+
+	statuses := make([]JobStatus, 0, len(jobs))
+	for _, job := range jobs {
+		job.mutex.Lock()
+		status := JobStatus{
+			Name:     job.Name,
+			Interval: job.Interval.String(),
+			LastRun:  job.lastRun,
+			Running:  job.running,
+			RunCount: job.runCount,
+		}
+		if !job.lastRun.IsZero() {
+			status.NextRun = job.lastRun.Add(job.Interval)
+		}
+		if job.lastErr != nil {
+			status.LastError = job.lastErr.Error()
+		}
+		job.mutex.Unlock()
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
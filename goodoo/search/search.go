@@ -0,0 +1,260 @@
+// Package search finds the users, models, system parameters, scheduled
+// actions, webhooks and routes matching a text, for the command palette of
+// the administrators. Each kind of result comes from a Source; addons
+// register their own with Register. A query fans out to every source, each
+// bounded by SourceTimeout, and returns by Deadline with whatever sources
+// answered, so one slow source delays nothing.
+package search
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"goodoo/logging"
+	"gorm.io/gorm"
+)
+
+// SourceTimeout bounds each source of a query
+var SourceTimeout = 500 * time.Millisecond
+
+// Deadline bounds a whole query; sources still running are reported as
+// timed out
+var Deadline = time.Second
+
+// Limit is the results kept per source
+const Limit = 10
+
+// Query is a search run by an administrator
+type Query struct {
+	Text   string
+	DBName string
+	// DB is a session of the database pool, safe for concurrent sources
+	DB  *gorm.DB
+	UID uint
+	// Limit is the results a source returns at most
+	Limit int
+}
+
+// Result is a match of a source
+type Result struct {
+	Type  string `json:"type"`
+	Label string `json:"label"`
+	// Detail is a line of context, e.g. the email of a user or the
+	// redacted preview of a parameter
+	Detail string `json:"detail,omitempty"`
+	// Path is where the dashboard shows the result
+	Path  string `json:"path"`
+	Score int    `json:"score"`
+}
+
+// Source answers queries with results of one type
+type Source interface {
+	Name() string
+	Search(ctx context.Context, query Query) ([]Result, error)
+}
+
+// SourceFunc is a Source from a function
+type SourceFunc struct {
+	SourceName string
+	Fn         func(ctx context.Context, query Query) ([]Result, error)
+}
+
+// Name returns the name of the source
+func (s SourceFunc) Name() string {
+	return s.SourceName
+}
+
+// Search runs the function
+func (s SourceFunc) Search(ctx context.Context, query Query) ([]Result, error) {
+	return s.Fn(ctx, query)
+}
+
+var (
+	sources     = make(map[string]Source)
+	sourceMutex sync.RWMutex
+	logger      = logging.GetLogger("goodoo.search")
+)
+
+// Register adds a source, replacing the source of the same name
+func Register(source Source) {
+	sourceMutex.Lock()
+	defer sourceMutex.Unlock()
+	sources[source.Name()] = source
+}
+
+// Sources returns the registered sources sorted by name
+func Sources() []Source {
+	sourceMutex.RLock()
+	defer sourceMutex.RUnlock()
+	list := make([]Source, 0, len(sources))
+	for _, source := range sources {
+		list = append(list, source)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+	return list
+}
+
+// Group is the results of a source
+type Group struct {
+	Source  string   `json:"source"`
+	Results []Result `json:"results"`
+}
+
+// Response is the outcome of a query: the groups of the sources with
+// results, best first, and the sources that failed or ran out of time
+type Response struct {
+	Query    string            `json:"query"`
+	Groups   []Group           `json:"groups"`
+	Total    int               `json:"total"`
+	TimedOut []string          `json:"timed_out,omitempty"`
+	Errors   map[string]string `json:"errors,omitempty"`
+}
+
+// answer is what a source returned
+type answer struct {
+	source  string
+	results []Result
+	err     error
+}
+
+// Run fans query out to every source and collects the answers received by
+// Deadline. Results are ranked by score within their group, and groups by
+// their best score.
+func Run(ctx context.Context, query Query) Response {
+	if query.Limit <= 0 {
+		query.Limit = Limit
+	}
+	response := Response{Query: query.Text, Groups: []Group{}}
+	list := Sources()
+	ctx, cancel := context.WithTimeout(ctx, Deadline)
+	defer cancel()
+
+	// Buffered so that sources answering after the deadline do not block
+	answers := make(chan answer, len(list))
+	for _, source := range list {
+		go func(source Source) {
+			sourceCtx, cancel := context.WithTimeout(ctx, SourceTimeout)
+			defer cancel()
+			results, err := source.Search(sourceCtx, query)
+			if sourceCtx.Err() != nil {
+				// Whatever failed, the source ran out of time
+				err = sourceCtx.Err()
+			}
+			answers <- answer{source: source.Name(), results: results, err: err}
+		}(source)
+	}
+
+	pending := make(map[string]bool, len(list))
+	for _, source := range list {
+		pending[source.Name()] = true
+	}
+collect:
+	for len(pending) > 0 {
+		select {
+		case a := <-answers:
+			delete(pending, a.source)
+			switch {
+			case errors.Is(a.err, context.DeadlineExceeded):
+				response.TimedOut = append(response.TimedOut, a.source)
+			case a.err != nil:
+				if response.Errors == nil {
+					response.Errors = make(map[string]string)
+				}
+				response.Errors[a.source] = a.err.Error()
+				logger.Warning("Search source %s failed: %v", a.source, a.err)
+			case len(a.results) > 0:
+				response.Groups = append(response.Groups, rankGroup(a.source, a.results, query.Limit))
+			}
+		case <-ctx.Done():
+			break collect
+		}
+	}
+	for name := range pending {
+		response.TimedOut = append(response.TimedOut, name)
+	}
+	sort.Strings(response.TimedOut)
+
+	sort.SliceStable(response.Groups, func(i, j int) bool {
+		first, second := response.Groups[i].Results[0].Score, response.Groups[j].Results[0].Score
+		if first != second {
+			return first > second
+		}
+		return response.Groups[i].Source < response.Groups[j].Source
+	})
+	for _, group := range response.Groups {
+		response.Total += len(group.Results)
+	}
+	return response
+}
+
+// rankGroup sorts the results of a source by score then label, keeping limit
+func rankGroup(source string, results []Result, limit int) Group {
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Label < results[j].Label
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return Group{Source: source, Results: results}
+}
+
+// Scores of a match, the best of the candidates of a result
+const (
+	ScoreExact     = 100
+	ScorePrefix    = 60
+	ScoreWord      = 40
+	ScoreSubstring = 20
+)
+
+// Score rates how candidates match text, ignoring case: an exact match
+// first, then a prefix, the start of a word (after a dot, underscore,
+// space, slash, dash or @), then anywhere; 0 when none matches
+func Score(text string, candidates ...string) int {
+	text = strings.ToLower(strings.TrimSpace(text))
+	if text == "" {
+		return 0
+	}
+	best := 0
+	for _, candidate := range candidates {
+		candidate = strings.ToLower(candidate)
+		score := 0
+		switch {
+		case candidate == text:
+			score = ScoreExact
+		case strings.HasPrefix(candidate, text):
+			score = ScorePrefix
+		case wordPrefix(candidate, text):
+			score = ScoreWord
+		case strings.Contains(candidate, text):
+			score = ScoreSubstring
+		}
+		if score > best {
+			best = score
+		}
+	}
+	return best
+}
+
+// wordPrefix reports whether a word of candidate starts with text
+func wordPrefix(candidate, text string) bool {
+	for i := 0; i < len(candidate); i++ {
+		if strings.ContainsRune("._ /-@", rune(candidate[i])) && strings.HasPrefix(candidate[i+1:], text) {
+			return true
+		}
+	}
+	return false
+}
+
+// LikePattern returns the ILIKE pattern of a substring, its wildcards
+// escaped
+func LikePattern(text string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return "%" + replacer.Replace(text) + "%"
+}
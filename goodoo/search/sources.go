@@ -0,0 +1,170 @@
+package search
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"goodoo/models"
+)
+
+// Result types of the built-in sources
+const (
+	TypeUser      = "user"
+	TypeModel     = "model"
+	TypeParameter = "parameter"
+	TypeCron      = "cron"
+	TypeWebhook   = "webhook"
+	TypeRoute     = "route"
+)
+
+// previewLength bounds the value preview of a parameter
+const previewLength = 40
+
+func init() {
+	Register(SourceFunc{SourceName: "users", Fn: searchUsers})
+	Register(SourceFunc{SourceName: "models", Fn: searchModels})
+	Register(SourceFunc{SourceName: "parameters", Fn: searchParameters})
+	Register(SourceFunc{SourceName: "cron", Fn: searchCron})
+	Register(SourceFunc{SourceName: "webhooks", Fn: searchWebhooks})
+}
+
+// searchUsers matches the login, name and email of the users
+func searchUsers(ctx context.Context, query Query) ([]Result, error) {
+	pattern := LikePattern(query.Text)
+	var users []models.User
+	err := query.DB.WithContext(ctx).
+		Select("id", "login", "name", "email", "active").
+		Where("login ILIKE ? OR name ILIKE ? OR email ILIKE ?", pattern, pattern, pattern).
+		Order("login").Limit(query.Limit * 2).Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+	results := make([]Result, 0, len(users))
+	for _, user := range users {
+		detail := user.Email
+		if !user.Active {
+			detail = strings.TrimSpace(detail + " (archived)")
+		}
+		results = append(results, Result{
+			Type:   TypeUser,
+			Label:  fmt.Sprintf("%s (%s)", user.Name, user.Login),
+			Detail: detail,
+			Path:   fmt.Sprintf("/dashboard#settings?user=%d", user.ID),
+			Score:  Score(query.Text, user.Login, user.Name, user.Email),
+		})
+	}
+	return results, nil
+}
+
+// searchModels matches the names and descriptions of the models of the
+// database
+func searchModels(ctx context.Context, query Query) ([]Result, error) {
+	var results []Result
+	for name, model := range models.RegistryForDB(query.DBName).GetAllModels() {
+		if model.Abstract {
+			continue
+		}
+		score := Score(query.Text, name, model.Description)
+		if score == 0 {
+			continue
+		}
+		results = append(results, Result{
+			Type:   TypeModel,
+			Label:  name,
+			Detail: model.Description,
+			Path:   "/api/models/" + url.PathEscape(name) + "/help",
+			Score:  score,
+		})
+	}
+	return results, ctx.Err()
+}
+
+// searchParameters matches the keys of the system parameters only, so
+// values cannot be probed; the preview of sensitive values is redacted
+func searchParameters(ctx context.Context, query Query) ([]Result, error) {
+	var params []models.IrConfigParameter
+	err := query.DB.WithContext(ctx).Where("key ILIKE ?", LikePattern(query.Text)).
+		Order("key").Limit(query.Limit * 2).Find(&params).Error
+	if err != nil {
+		return nil, err
+	}
+	results := make([]Result, 0, len(params))
+	for _, param := range params {
+		results = append(results, Result{
+			Type:   TypeParameter,
+			Label:  param.Key,
+			Detail: preview(param.Redacted().Value),
+			Path:   "/dashboard#settings?param=" + url.QueryEscape(param.Key),
+			Score:  Score(query.Text, param.Key),
+		})
+	}
+	return results, nil
+}
+
+// preview shortens a value to previewLength characters
+func preview(value string) string {
+	runes := []rune(value)
+	if len(runes) <= previewLength {
+		return value
+	}
+	return string(runes[:previewLength]) + "…"
+}
+
+// searchCron matches the names, models and functions of the scheduled
+// actions
+func searchCron(ctx context.Context, query Query) ([]Result, error) {
+	pattern := LikePattern(query.Text)
+	var jobs []models.IrCron
+	err := query.DB.WithContext(ctx).
+		Where("name ILIKE ? OR model ILIKE ? OR function ILIKE ?", pattern, pattern, pattern).
+		Order("name").Limit(query.Limit * 2).Find(&jobs).Error
+	if err != nil {
+		return nil, err
+	}
+	results := make([]Result, 0, len(jobs))
+	for _, job := range jobs {
+		detail := strings.Trim(job.Model+"."+job.Function, ".")
+		if !job.Active {
+			detail += " (inactive)"
+		}
+		results = append(results, Result{
+			Type:   TypeCron,
+			Label:  job.Name,
+			Detail: detail,
+			Path:   fmt.Sprintf("/dashboard#jobs?id=%d", job.ID),
+			Score:  Score(query.Text, job.Name, job.Model, job.Function),
+		})
+	}
+	return results, nil
+}
+
+// searchWebhooks matches the names, URLs and models of the webhooks; the
+// secrets are never read
+func searchWebhooks(ctx context.Context, query Query) ([]Result, error) {
+	pattern := LikePattern(query.Text)
+	var hooks []models.Webhook
+	err := query.DB.WithContext(ctx).
+		Select("id", "name", "url", "model", "active").
+		Where("name ILIKE ? OR url ILIKE ? OR model ILIKE ?", pattern, pattern, pattern).
+		Order("name").Limit(query.Limit * 2).Find(&hooks).Error
+	if err != nil {
+		return nil, err
+	}
+	results := make([]Result, 0, len(hooks))
+	for _, hook := range hooks {
+		host := hook.URL
+		if parsed, err := url.Parse(hook.URL); err == nil && parsed.Host != "" {
+			host = parsed.Host
+		}
+		results = append(results, Result{
+			Type:   TypeWebhook,
+			Label:  hook.Name,
+			Detail: hook.Model + " → " + host,
+			Path:   fmt.Sprintf("/api/webhooks/%d", hook.ID),
+			Score:  Score(query.Text, hook.Name, hook.URL, hook.Model),
+		})
+	}
+	return results, nil
+}
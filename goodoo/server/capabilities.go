@@ -0,0 +1,125 @@
+package server
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"goodoo/auth"
+	"goodoo/capability"
+	"goodoo/chat"
+	"goodoo/crypto"
+	"goodoo/knowledge"
+	"goodoo/logging"
+	"goodoo/mail"
+	"goodoo/metrics"
+	"goodoo/models"
+	"goodoo/oidc"
+	"goodoo/scan"
+	"goodoo/tlsserver"
+	"goodoo/tracing"
+	"gorm.io/gorm"
+)
+
+// Capabilities reported by the server, besides database.<name>,
+// schema.<name> and addon.<name>
+const (
+	CapabilitySessions    = "sessions"
+	CapabilityTLS         = "tls"
+	CapabilitySSO         = "sso.oidc"
+	CapabilityLDAP        = "auth.ldap"
+	CapabilityMail        = "mail"
+	CapabilityMetrics     = "metrics"
+	CapabilityTracing     = "tracing"
+	CapabilityEncryption  = "encryption"
+	CapabilityLogDatabase = "log.database"
+	CapabilityDevMode     = "dev_mode"
+	CapabilityPgvector    = "search.pgvector"
+	CapabilityTrigram     = "search.trigram"
+	CapabilityScan        = "attachments.scan"
+)
+
+// enabledIf records a capability as enabled with one reason or disabled
+// with the other
+func enabledIf(name string, enabled bool, enabledReason, disabledReason string) {
+	if enabled {
+		capability.Enable(name, enabledReason)
+		return
+	}
+	capability.Disable(name, disabledReason)
+}
+
+// reportConfigCapabilities records the capabilities the configuration
+// read from the environment turns on or off
+func (s *Server) reportConfigCapabilities(mailConfig *mail.Config, metricsConfig *metrics.Config, tlsConfig *tlsserver.Config) {
+	capability.MarkPublic("database."+s.config.DBName, models.SchemaCapability(s.config.DBName),
+		CapabilitySessions, CapabilityTLS, CapabilitySSO, CapabilityMail)
+
+	// Sessions are only stored on the filesystem
+	capability.Enable(CapabilitySessions, "filesystem store in "+s.config.SessionDir)
+
+	switch {
+	case tlsConfig.ACME():
+		capability.Enable(CapabilityTLS, "ACME certificates for "+strings.Join(tlsConfig.ACMEDomains, ", "))
+	case tlsConfig.Enabled():
+		capability.Enable(CapabilityTLS, "certificate "+tlsConfig.CertFile)
+	default:
+		capability.Disable(CapabilityTLS, "GOODOO_TLS_* not set, expecting a terminating proxy")
+	}
+
+	if mailConfig.Transport == "log" {
+		capability.Degrade(CapabilityMail, "log transport: messages are logged, not sent")
+	} else {
+		capability.Enable(CapabilityMail, fmt.Sprintf("smtp via %s:%d", mailConfig.Host, mailConfig.Port))
+	}
+
+	enabledIf(CapabilityMetrics, metricsConfig.Enabled, "sampled every minute", "GOODOO_METRICS_ENABLED is off")
+	enabledIf(CapabilityTracing, tracing.Enabled(), "service "+tracing.ServiceName(), "GOODOO_TRACE_ENABLED is off")
+	enabledIf(CapabilityEncryption, crypto.Enabled(), "secrets encrypted with key "+crypto.CurrentKeyID(),
+		"GOODOO_ENCRYPTION_KEYS not set, secrets stored unencrypted")
+	logDB := logging.DefaultLogConfig().LogDB
+	enabledIf(CapabilityLogDatabase, logDB != "", "records written to "+logDB, "GOODOO_LOG_DB not set")
+	enabledIf(CapabilityDevMode, s.config.DevMode, "/api/dev is mounted", "GOODOO_DEV_MODE is off")
+	scanConfig := scan.CurrentConfig()
+	enabledIf(CapabilityScan, scanConfig.ClamdAddress != "", "clamd at "+scanConfig.ClamdAddress,
+		"GOODOO_SCAN_CLAMD_ADDRESS not set, attachments are not scanned")
+}
+
+// reportDatabaseCapabilities records the capabilities that depend on the
+// default database: its extensions and the single sign-on parameters
+// stored in it
+func (s *Server) reportDatabaseCapabilities(db *gorm.DB) {
+	dbName := s.config.DBName
+	capability.Enable("database."+dbName, "postgres")
+
+	if supported, err := knowledge.EnsureVectorColumn(db); err != nil {
+		capability.Degrade(CapabilityPgvector, "failed to add the vector column: "+err.Error())
+	} else {
+		enabledIf(CapabilityPgvector, supported, "knowledge chunks searched by vector distance",
+			"vector extension not installed, knowledge chunks scored in the server")
+	}
+
+	// Chat messages are indexed for search
+	if supported, err := chat.EnsureSearchIndex(db); err != nil {
+		s.logger.Warning("Failed to index chat messages: %v", err)
+		capability.Degrade(CapabilityTrigram, "failed to index chat messages: "+err.Error())
+	} else {
+		enabledIf(CapabilityTrigram, supported, "chat messages searched by substring",
+			"pg_trgm not available, chat messages searched by full-text words")
+	}
+
+	if oidcConfig := oidc.ConfigForDB(dbName); oidcConfig.Enabled() {
+		capability.Enable(CapabilitySSO, "issuer "+oidcConfig.Issuer)
+	} else {
+		capability.Disable(CapabilitySSO, "no issuer and client id configured")
+	}
+
+	switch ldapConfig := auth.LDAPConfigForDB(dbName); {
+	case !slices.Contains(auth.BackendsForDB(dbName), auth.BackendLDAP):
+		capability.Disable(CapabilityLDAP, "ldap is not an authentication backend")
+	case !ldapConfig.Enabled():
+		capability.Disable(CapabilityLDAP, "no valid LDAP server configured")
+	default:
+		capability.Enable(CapabilityLDAP, "directory at "+ldapConfig.URL)
+	}
+}
@@ -0,0 +1,79 @@
+// Package server assembles goodoo: the Echo instance with its middleware
+// stack and routes, the session store, the database setup and the
+// background jobs. The goodoo command is a thin wrapper around it, and
+// other Go programs embed goodoo the same way:
+//
+//	s, err := server.New(server.DefaultConfig())
+//	if err != nil { ... }
+//	s.RegisterAddon(myAddon)
+//	err = s.Start(ctx)
+//
+// Process-wide settings are left to the program: logging, the encryption
+// keys, tracing and outbound HTTP are set up before New, as main does.
+package server
+
+import (
+	"errors"
+	"os"
+
+	"goodoo/clock"
+)
+
+// Config holds what the server is started with; the rest comes from the
+// GOODOO_* variables of each package
+type Config struct {
+	// DBName is the default database
+	DBName string
+	// SessionDir is the directory of the session files
+	SessionDir string
+	// Port is the port served by Start
+	Port string
+	// StaticDir holds the static assets, served under /static
+	StaticDir string
+	// DevMode serves the static assets without fingerprints and mounts the
+	// developer endpoints under /api/dev
+	DevMode bool
+	// Clock drives session expiry, rate limits and TLS reloads, the real
+	// clock when nil
+	Clock clock.Clock
+}
+
+// DefaultConfig returns the configuration of the goodoo command: the
+// apexive-hackaton database, ./sessions and port 8080
+func DefaultConfig() *Config {
+	return &Config{
+		DBName:     "apexive-hackaton",
+		SessionDir: "./sessions",
+		Port:       "8080",
+		StaticDir:  "static",
+		Clock:      clock.Real,
+	}
+}
+
+// LoadFromEnv overrides the configuration with GOODOO_DEFAULT_DB,
+// GOODOO_SESSION_DIR, GOODOO_DEV_MODE and PORT
+func (c *Config) LoadFromEnv() {
+	if value := os.Getenv("GOODOO_DEFAULT_DB"); value != "" {
+		c.DBName = value
+	}
+	if value := os.Getenv("GOODOO_SESSION_DIR"); value != "" {
+		c.SessionDir = value
+	}
+	if value := os.Getenv("PORT"); value != "" {
+		c.Port = value
+	}
+	if os.Getenv("GOODOO_DEV_MODE") != "" {
+		c.DevMode = true
+	}
+}
+
+// Validate checks the configuration is complete
+func (c *Config) Validate() error {
+	if c.DBName == "" {
+		return errors.New("a default database is required")
+	}
+	if c.SessionDir == "" {
+		return errors.New("a session directory is required")
+	}
+	return nil
+}
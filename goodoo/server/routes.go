@@ -0,0 +1,223 @@
+package server
+
+import (
+	"goodoo/handlers"
+	goodooHttp "goodoo/http"
+)
+
+// registerDefaultRoutes registers the routes of the goodoo handlers
+func (s *Server) registerDefaultRoutes() error {
+	e, requestConfig := s.echo, s.requestConfig
+
+	// Create handlers
+	authHandler := handlers.NewAuthHandler(requestConfig)
+	dbHandler := handlers.NewDatabaseHandler(requestConfig)
+	healthHandler := handlers.NewHealthHandler(requestConfig)
+	sessionHandler := handlers.NewSessionHandler(requestConfig)
+
+	// Core routes: pages, authentication, session and database selection
+	if err := goodooHttp.RegisterRoutes(e, []goodooHttp.RouteSpec{
+		// Public routes (no authentication required)
+		{Method: "GET", Path: "/", Handler: handlers.IndexHandler},
+		{Method: "GET", Path: "/login", Handler: handlers.LoginPageHandler},
+		{Method: "GET", Path: "/health", Handler: healthHandler.Health},
+		{Method: "POST", Path: "/auth/login", Handler: authHandler.Login, RateLimit: "auth"},
+		{Method: "GET", Path: "/db/list", Handler: dbHandler.ListDatabases},
+		{Method: "POST", Path: "/auth/reset_password", Handler: authHandler.ResetPassword, RateLimit: "auth"},
+		{Method: "POST", Path: "/auth/reset_password/confirm", Handler: authHandler.ResetPasswordConfirm, RateLimit: "auth", DenyImpersonation: true},
+		{Method: "POST", Path: "/api/csp-report", Handler: handlers.CSPReportHandler, CSRFExempt: true},
+		{Method: "POST", Path: "/session/lang", Handler: sessionHandler.SetLang},
+		{Method: "POST", Path: "/session/tz", Handler: sessionHandler.SetTz},
+		{Method: "GET", Path: "/session/context_defaults", Handler: sessionHandler.GetContextDefaults},
+		{Method: "POST", Path: "/session/context_defaults", Handler: sessionHandler.SetContextDefaults},
+		{Method: "POST", Path: "/db/backup/:name", Handler: dbHandler.Backup, RateLimit: "auth", CSRFExempt: true},
+		{Method: "POST", Path: "/db/restore", Handler: dbHandler.Restore, RateLimit: "auth", CSRFExempt: true},
+
+		// Protected routes (authentication required)
+		{Method: "GET", Path: "/health/detailed", Handler: healthHandler.DetailedHealth, Auth: true},
+		{Method: "POST", Path: "/auth/logout", Handler: authHandler.Logout, Auth: true},
+		{Method: "GET", Path: "/auth/logout", Handler: authHandler.Logout, Auth: true},
+		{Method: "GET", Path: "/auth/session", Handler: authHandler.SessionInfo, Auth: true},
+		{Method: "GET", Path: "/api/users/me/preferences", Handler: sessionHandler.GetPreferences, Auth: true, DB: true},
+		{Method: "PUT", Path: "/api/users/me/preferences", Handler: sessionHandler.SetPreferences, Auth: true, DB: true},
+		{Method: "GET", Path: "/auth/sessions", Handler: authHandler.ListSessions, Auth: true},
+		{Method: "DELETE", Path: "/auth/sessions/:sid", Handler: authHandler.RevokeSession, Auth: true},
+		{Method: "POST", Path: "/auth/sessions/revoke-all", Handler: authHandler.RevokeAllSessions, Auth: true},
+		{Method: "POST", Path: "/auth/impersonate/stop", Handler: authHandler.StopImpersonation, Auth: true},
+		{Method: "POST", Path: "/db/set", Handler: dbHandler.SetDatabase, Auth: true},
+		{Method: "GET", Path: "/session", Handler: sessionHandler.GetSession, Auth: true},
+		{Method: "POST", Path: "/session/clear", Handler: sessionHandler.ClearSession, Auth: true},
+		{Method: "POST", Path: "/session/set", Handler: sessionHandler.SetSessionData, Auth: true},
+
+		// Administrators only; an impersonated session cannot impersonate further
+		{Method: "POST", Path: "/api/users/:id/impersonate", Handler: authHandler.Impersonate, Permission: goodooHttp.PermissionUsersImpersonate, DenyImpersonation: true},
+		{Method: "GET", Path: "/api/database/status", Handler: dbHandler.DatabaseStatus, Permission: goodooHttp.PermissionDBManage},
+		{Method: "POST", Path: "/api/database/status/retry", Handler: dbHandler.RetryWarmup, Permission: goodooHttp.PermissionDBManage},
+		{Method: "GET", Path: "/api/sessions/stats", Handler: sessionHandler.Stats, Permission: goodooHttp.PermissionSessionsRead},
+	}); err != nil {
+		return err
+	}
+
+	// Single sign-on routes
+	handlers.RegisterOIDCRoutes(e, requestConfig)
+
+	// Odoo web client session routes (/web/session/*), for Odoo widgets
+	handlers.RegisterOdooRoutes(e, requestConfig)
+
+	// API routes
+	handlers.RegisterAPIRoutes(e)
+
+	// Route table audit
+	handlers.RegisterRouteTableRoutes(e, requestConfig)
+
+	// Batched API calls
+	handlers.RegisterBatchRoutes(e, requestConfig)
+
+	// Generic record routes
+	handlers.RegisterRecordRoutes(e, requestConfig)
+	handlers.RegisterOperationRoutes(e, requestConfig)
+
+	// Read-only share links of records, opened without an account
+	handlers.RegisterShareRoutes(e, requestConfig)
+
+	// Who is editing a record, advisory only
+	handlers.RegisterEditingRoutes(e, requestConfig)
+
+	// Multi-step wizards, such as the CSV import
+	handlers.RegisterWizardRoutes(e, requestConfig)
+
+	// Database maintenance (VACUUM, ANALYZE, REINDEX) and bloat estimates
+	handlers.RegisterMaintenanceRoutes(e, requestConfig)
+
+	// Index advice from the slow queries, applied on request only
+	handlers.RegisterAdvisorRoutes(e, requestConfig)
+
+	// Maintenance mode, blocking mutating requests during migrations or backups
+	handlers.RegisterMaintenanceModeRoutes(e, requestConfig)
+
+	// Log database query routes
+	handlers.RegisterLogRoutes(e, requestConfig)
+
+	// Scheduled action routes
+	handlers.RegisterCronRoutes(e, requestConfig)
+
+	// Mail routes
+	handlers.RegisterMailRoutes(e, requestConfig)
+
+	// Report routes
+	handlers.RegisterReportRoutes(e, requestConfig)
+	handlers.RegisterReportScheduleRoutes(e, requestConfig)
+
+	// Sales routes
+	handlers.RegisterSalesRoutes(e, requestConfig)
+
+	// Partner hierarchy and deduplication routes
+	handlers.RegisterPartnerRoutes(e, requestConfig)
+
+	// Product category routes
+	handlers.RegisterProductCategoryRoutes(e, requestConfig)
+
+	// Webhook routes
+	handlers.RegisterWebhookRoutes(e, requestConfig)
+
+	// Inbound hook routes
+	handlers.RegisterInboundHookRoutes(e, requestConfig)
+
+	// Trace routes
+	handlers.RegisterTraceRoutes(e, requestConfig)
+
+	// Avatar routes
+	handlers.RegisterAvatarRoutes(e, requestConfig)
+
+	// Upload staging routes
+	handlers.RegisterUploadRoutes(e, requestConfig)
+
+	// Knowledge base routes
+	handlers.RegisterKnowledgeRoutes(e, requestConfig)
+
+	// Notification center routes
+	handlers.RegisterNotificationRoutes(e, requestConfig)
+
+	// Long-lived connection routes
+	handlers.RegisterConnectionRoutes(e, requestConfig)
+
+	// Storage usage routes
+	handlers.RegisterStorageRoutes(e, requestConfig)
+
+	// Retention policy routes
+	handlers.RegisterRetentionRoutes(e, requestConfig)
+
+	// Admin search (command palette) routes
+	handlers.RegisterSearchRoutes(e, requestConfig)
+
+	// Crash report routes
+	handlers.RegisterCrashRoutes(e, requestConfig)
+
+	// Recent background tasks and the failures of the durable ones
+	handlers.RegisterTaskRoutes(e, requestConfig)
+
+	// Saved list filters of users, private or shared
+	handlers.RegisterFilterRoutes(e, requestConfig)
+
+	// Public status page with the uptime history of each component
+	handlers.RegisterStatusRoutes(e, requestConfig)
+
+	// Route permission routes
+	handlers.RegisterPermissionRoutes(e, requestConfig)
+
+	// Keys other services sign their requests with
+	handlers.RegisterServiceKeyRoutes(e, requestConfig)
+
+	// Scoped service accounts of the automations
+	handlers.RegisterServiceAccountRoutes(e, requestConfig)
+
+	// Per-user quotas on owned records
+	handlers.RegisterQuotaRoutes(e, requestConfig)
+
+	// User invitations and their public acceptance page
+	handlers.RegisterInvitationRoutes(e, requestConfig)
+
+	// Account of the current user: profile, email change and data export
+	handlers.RegisterAccountRoutes(e, requestConfig)
+
+	// Bulk user import from CSV files and the undo of a bad import
+	handlers.RegisterUserImportRoutes(e, requestConfig)
+
+	// Report of the optional features enabled, disabled or degraded
+	handlers.RegisterCapabilityRoutes(e, requestConfig)
+
+	// Attachment metadata and downloads, and the malware quarantine
+	handlers.RegisterAttachmentRoutes(e, requestConfig)
+
+	// Countries, languages and timezones for the picker widgets
+	handlers.RegisterReferenceRoutes(e, requestConfig)
+
+	// Duplicate detection rules of the field models
+	handlers.RegisterDuplicateRuleRoutes(e, requestConfig)
+
+	// Tags of the taggable models and the tagging of their records
+	handlers.RegisterTagRoutes(e, requestConfig)
+
+	// Mail aliases turning inbound email into records, their provider
+	// webhook and the review queue of the messages that failed
+	handlers.RegisterMailGatewayRoutes(e, requestConfig)
+
+	// Record rules of the field models and the check of their expressions
+	handlers.RegisterRecordRuleRoutes(e, requestConfig)
+	handlers.RegisterExpressionRoutes(e, requestConfig)
+
+	// Model definition export and import routes
+	handlers.RegisterDefinitionRoutes(e, requestConfig)
+
+	// Developer mode routes, absent in production
+	if s.config.DevMode {
+		handlers.RegisterDevRoutes(e, requestConfig)
+	}
+
+	// Dashboard routes
+	handlers.RegisterDashboardRoutes(e, requestConfig)
+
+	// Per-session log level overrides for administrators
+	handlers.RegisterLogOverrideRoutes(e, requestConfig)
+	return nil
+}
@@ -0,0 +1,411 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"goodoo/capability"
+	"goodoo/clock"
+	"goodoo/connections"
+	"goodoo/database"
+	goodooHttp "goodoo/http"
+	"goodoo/logging"
+	"goodoo/maintenance"
+	"goodoo/models"
+	"goodoo/retention"
+	"goodoo/scheduler"
+	"goodoo/search"
+	"goodoo/tlsserver"
+)
+
+// ShutdownTimeout is how long Start waits for the requests in progress
+// once its context is done
+const ShutdownTimeout = 10 * time.Second
+
+// ErrStarted is returned when registering models once the server started
+// or built its handler: the schema is already synced
+var ErrStarted = errors.New("the server is already started")
+
+// Addon bundles models and routes extending the server
+type Addon struct {
+	Name string
+	// Models are field-defined models, registered in every database
+	Models []*models.ModelDefinition
+	// GORMModels are GORM structs, migrated with the built-in ones
+	GORMModels []interface{}
+	// Routes registers the routes of the addon
+	Routes func(e *echo.Echo, config *goodooHttp.RequestConfig) error
+	// SearchSources contribute results to the admin search
+	SearchSources []search.Source
+}
+
+// Server is goodoo assembled: built by New, extended by the Register
+// methods, then served by Start or handed to net/http/httptest through
+// Handler
+type Server struct {
+	config        *Config
+	logger        *logging.Logger
+	echo          *echo.Echo
+	requestConfig *goodooHttp.RequestConfig
+	sessionStore  *goodooHttp.FilesystemSessionStore
+	tls           *tlsserver.Server
+	// tlsMinVersion is logged when serving TLS
+	tlsMinVersion uint16
+
+	mutex      sync.Mutex
+	gormModels []interface{}
+	shutdown   []func(ctx context.Context) error
+
+	prepareOnce sync.Once
+	prepareErr  error
+	prepared    bool
+	closeOnce   sync.Once
+	// ctx ends the background listeners on Close
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// New builds the server of c: the package configurations from the
+// environment, the session store, the Echo instance with its middleware
+// stack and the default routes. Nothing touches the database until Start
+// or Handler.
+func New(c *Config) (*Server, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	if c.Clock == nil {
+		c.Clock = clock.Real
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Server{
+		config:     c,
+		logger:     logging.GetLogger("goodoo.server"),
+		gormModels: append([]interface{}(nil), SchemaModels...),
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+	if err := s.configure(); err != nil {
+		cancel()
+		return nil, err
+	}
+	if err := s.registerDefaultRoutes(); err != nil {
+		cancel()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Echo returns the Echo instance, for routes and middleware beyond
+// RegisterRoutes
+func (s *Server) Echo() *echo.Echo {
+	return s.echo
+}
+
+// RequestConfig returns the configuration shared by the handlers
+func (s *Server) RequestConfig() *goodooHttp.RequestConfig {
+	return s.requestConfig
+}
+
+// SessionStore returns the session store
+func (s *Server) SessionStore() *goodooHttp.FilesystemSessionStore {
+	return s.sessionStore
+}
+
+// RegisterModel adds a field-defined model to every database; it fails
+// once the server started
+func (s *Server) RegisterModel(model *models.ModelDefinition) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.prepared {
+		return ErrStarted
+	}
+	return models.RegisterFieldModel(model)
+}
+
+// RegisterGORMModels adds GORM structs migrated with the built-in ones; it
+// fails once the server started
+func (s *Server) RegisterGORMModels(values ...interface{}) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.prepared {
+		return ErrStarted
+	}
+	s.gormModels = append(s.gormModels, values...)
+	return nil
+}
+
+// RegisterRoutes adds routes after the default ones
+func (s *Server) RegisterRoutes(specs ...goodooHttp.RouteSpec) error {
+	return goodooHttp.RegisterRoutes(s.echo, specs)
+}
+
+// RegisterAddon registers the models and routes of an addon; it fails
+// once the server started
+func (s *Server) RegisterAddon(addon Addon) error {
+	for _, model := range addon.Models {
+		if err := s.RegisterModel(model); err != nil {
+			return fmt.Errorf("addon %s: %w", addon.Name, err)
+		}
+	}
+	if err := s.RegisterGORMModels(addon.GORMModels...); err != nil {
+		return fmt.Errorf("addon %s: %w", addon.Name, err)
+	}
+	for _, source := range addon.SearchSources {
+		search.Register(source)
+	}
+	if addon.Routes != nil {
+		if err := addon.Routes(s.echo, s.requestConfig); err != nil {
+			return fmt.Errorf("addon %s: %w", addon.Name, err)
+		}
+	}
+	capability.Enable("addon."+addon.Name, fmt.Sprintf("%d model(s), %d GORM model(s)", len(addon.Models), len(addon.GORMModels)))
+	s.logger.Info("Registered addon %s", addon.Name)
+	return nil
+}
+
+// OnShutdown registers fn to run when the server stops, the last
+// registered first
+func (s *Server) OnShutdown(fn func(ctx context.Context) error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.shutdown = append(s.shutdown, fn)
+}
+
+// Handler prepares the database and returns the server as an
+// http.Handler without binding a port, e.g. for httptest.NewServer; the
+// background jobs are not started. Close releases the server.
+func (s *Server) Handler() (http.Handler, error) {
+	if err := s.prepare(); err != nil {
+		return nil, err
+	}
+	return s.echo, nil
+}
+
+// Start prepares the database, starts the background jobs and serves on
+// the configured port until ctx is done, then waits up to
+// ShutdownTimeout for the requests in progress and runs the shutdown
+// hooks. It returns nil when stopped by ctx.
+func (s *Server) Start(ctx context.Context) error {
+	if err := s.prepare(); err != nil {
+		return errors.Join(err, s.Close(context.Background()))
+	}
+	scheduler.Default().Start()
+	defer scheduler.Default().Stop()
+
+	addr := ":" + s.config.Port
+	s.logger.Info("Starting server on port %s", s.config.Port)
+	s.logger.Info("Session store: %s", s.config.SessionDir)
+	s.logger.Info("Default database: %s", s.config.DBName)
+
+	served := make(chan error, 1)
+	go func() {
+		if s.tls != nil {
+			s.logger.Info("Serving %s and newer", tls.VersionName(s.tlsMinVersion))
+			served <- s.tls.Start(ctx, s.echo, addr)
+			return
+		}
+		served <- s.echo.Start(addr)
+	}()
+
+	var err error
+	select {
+	case err = <-served:
+	case <-ctx.Done():
+		s.logger.Info("Shutting down the server")
+		// Event streams never turn idle on their own: they are asked to
+		// close, telling their clients when to reconnect, before the
+		// listener waits for the requests in flight
+		if open := connections.Drain(context.Background()); open > 0 {
+			s.logger.Warning("%d connection(s) still open after the drain", open)
+		}
+		if s.tls == nil {
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+			err = s.echo.Shutdown(shutdownCtx)
+			cancel()
+		}
+		err = errors.Join(err, <-served)
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		err = nil
+	}
+	return errors.Join(err, s.Close(context.Background()))
+}
+
+// Close stops the background listeners and runs the shutdown hooks, once
+func (s *Server) Close(ctx context.Context) error {
+	var errs []error
+	s.closeOnce.Do(func() {
+		s.cancel()
+		s.mutex.Lock()
+		hooks := append([]func(context.Context) error(nil), s.shutdown...)
+		s.mutex.Unlock()
+		for i := len(hooks) - 1; i >= 0; i-- {
+			if err := hooks[i](ctx); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// prepare migrates and seeds the default database, syncs the schemas of
+// the field-defined models, schedules the background jobs and audits the
+// routes, once
+func (s *Server) prepare() error {
+	s.prepareOnce.Do(func() {
+		s.mutex.Lock()
+		s.prepared = true
+		gormModels := append([]interface{}(nil), s.gormModels...)
+		s.mutex.Unlock()
+		s.prepareErr = s.setupDatabase(gormModels)
+		if s.prepareErr != nil {
+			return
+		}
+		s.schedule()
+		// Refuse to serve a route whose handler would lack the Goodoo request
+		if err := goodooHttp.AuditRoutes(s.echo); err != nil {
+			s.prepareErr = fmt.Errorf("invalid routes: %w", err)
+			return
+		}
+		capability.LogSummary(s.logger)
+	})
+	return s.prepareErr
+}
+
+// setupDatabase migrates the GORM models, then seeds the default
+// database and syncs the schemas of the field-defined models
+func (s *Server) setupDatabase(gormModels []interface{}) error {
+	dbName := s.config.DBName
+	if err := models.RegisterGORMReferences(gormModels...); err != nil {
+		return fmt.Errorf("invalid model relations: %w", err)
+	}
+	s.logger.Info("Setting up database: %s", dbName)
+	// The tables under retention are created partitioned by month in new
+	// databases; they stay plain tables when that fails
+	if db, err := database.GetDatabase(dbName); err == nil {
+		if err := retention.CreatePartitionedTables(db); err != nil {
+			s.logger.Warning("Failed to create the partitioned tables: %v", err)
+		}
+	}
+	if err := database.GetRegistry().AutoMigrate(dbName, gormModels...); err != nil {
+		return fmt.Errorf("failed to setup database: %w", err)
+	}
+	// The tag names are unique case-insensitively, which GORM tags cannot say
+	if db, err := database.GetDatabase(dbName); err == nil {
+		if err := models.EnsureTagIndexes(db); err != nil {
+			s.logger.Warning("Failed to create the unique index of the tag names: %v", err)
+		}
+	}
+
+	// Create default admin user if not exists
+	s.initDefaultUser()
+
+	// Seed the default system parameters, LLM providers and reference data,
+	// and reload the parameters when another process changes them
+	s.initConfigParameters()
+	go models.ListenConfigParameters(s.ctx, dbName)
+	go maintenance.Listen(s.ctx, dbName)
+	// Definitions imported by another process are registered here too
+	go models.ListenModelDefinitions(s.ctx, dbName)
+
+	// Create or update tables of field-defined models
+	if err := SyncSchemas(dbName, s.logger); err != nil {
+		s.logger.Error("Failed to sync model schemas: %v", err)
+	}
+
+	// Extensions of the database and the features depending on them, e.g.
+	// pgvector for the knowledge search
+	if db, err := database.GetDatabase(dbName); err == nil {
+		s.reportDatabaseCapabilities(db)
+	}
+
+	// Warm-up (GOODOO_DB_WARMUP*): connect to the known and discovered
+	// databases before serving instead of on their first request; those
+	// that fail are retried in the background. Off by default.
+	warmupConfig := database.DefaultWarmupConfig()
+	warmupConfig.LoadFromEnv()
+	database.Warmup(s.ctx, warmupConfig, dbName)
+	return nil
+}
+
+func (s *Server) initDefaultUser() {
+	db, err := database.GetDatabase(s.config.DBName)
+	if err != nil {
+		s.logger.Error("Failed to get database for user initialization: %v", err)
+		return
+	}
+
+	// Check if admin user exists
+	var count int64
+	db.Model(&models.User{}).Where("login = ?", "admin").Count(&count)
+
+	if count == 0 {
+		s.logger.Info("Creating default admin user")
+		_, err := models.CreateUser(db, "admin", "Administrator", "admin@example.com", "admin")
+		if err != nil {
+			s.logger.Error("Failed to create default admin user: %v", err)
+		} else {
+			s.logger.Info("Default admin user created successfully (login: admin, password: admin)")
+		}
+	} else {
+		s.logger.Info("Admin user already exists")
+	}
+
+	// The principal of the anonymous visitors of share links and
+	// invitation pages
+	if _, err := models.EnsurePublicUser(s.config.DBName, db); err != nil {
+		s.logger.Error("Failed to create the public user: %v", err)
+	}
+}
+
+func (s *Server) initConfigParameters() {
+	db, err := database.GetDatabase(s.config.DBName)
+	if err != nil {
+		s.logger.Error("Failed to get database for parameter initialization: %v", err)
+		return
+	}
+	if err := models.SeedConfigParameters(db); err != nil {
+		s.logger.Error("Failed to seed system parameters: %v", err)
+	}
+	if err := models.SeedLLMProviders(db); err != nil {
+		s.logger.Error("Failed to seed LLM providers: %v", err)
+	}
+	if err := models.SeedReferenceData(db); err != nil {
+		s.logger.Error("Failed to seed the reference data: %v", err)
+	}
+}
+
+// SyncSchemas creates or updates the tables of the field-defined models
+// of a database, logging the warnings of the sync, then checks the schema
+// against the models (see models.CheckSchema)
+func SyncSchemas(dbName string, logger *logging.Logger) error {
+	db, err := database.GetDatabase(dbName)
+	if err != nil {
+		return err
+	}
+
+	registry := models.RegistryForDB(dbName)
+	diff, err := registry.SyncSchemas(db, models.SyncOptions{})
+	if err != nil {
+		return err
+	}
+	for _, warning := range diff.Warnings {
+		logger.Warning("Schema sync: %s", warning)
+	}
+
+	// What the sync could not fix makes fields unavailable or models unusable
+	report, err := models.CheckSchema(dbName, db, registry)
+	if err != nil {
+		return fmt.Errorf("failed to check the schema: %w", err)
+	}
+	if report.Status != models.SchemaOK {
+		logger.Warning("Schema of %s is %s: %d difference(s), see /api/capabilities", dbName, report.Status, len(report.Issues))
+	}
+	return nil
+}
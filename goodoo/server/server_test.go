@@ -0,0 +1,199 @@
+package server_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"goodoo/database"
+	"goodoo/models"
+	"goodoo/models/testutil"
+	"goodoo/server"
+
+	"gorm.io/gorm/logger"
+)
+
+// client is a browser session against the test server
+type client struct {
+	t    *testing.T
+	base string
+	http *http.Client
+}
+
+func newClient(t *testing.T, base string) *client {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &client{t: t, base: base, http: &http.Client{Jar: jar}}
+}
+
+// do sends body as JSON and decodes the JSON answer into out, unless nil,
+// returning the status
+func (c *client) do(method, path string, body, out interface{}) int {
+	c.t.Helper()
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+	r, err := http.NewRequest(method, c.base+path, &payload)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "application/json")
+	resp, err := c.http.Do(r)
+	if err != nil {
+		c.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode < 300 {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			c.t.Fatalf("%s %s: invalid answer: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func (c *client) login(login, password string) int {
+	c.t.Helper()
+	return c.do("POST", "/auth/login", map[string]string{"login": login, "password": password}, nil)
+}
+
+// TestHandler boots the whole server in-process on the test database, logs
+// in as the administrator, creates a user through the API and reads it
+// back, then signs in as that user
+func TestHandler(t *testing.T) {
+	dbOrURI := os.Getenv(testutil.TestDBEnv)
+	if dbOrURI == "" {
+		t.Skipf("%s not set, skipping the end-to-end test", testutil.TestDBEnv)
+	}
+	// The templates and static files are looked up from the module root
+	t.Chdir("..")
+
+	dbName, dbConfig, err := database.ParseConnectionInfo(dbOrURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := database.GetRegistry()
+	registry.SetLogger(logger.Default.LogMode(logger.Silent))
+	if _, err := registry.GetDatabaseInfo(dbName); err != nil {
+		if err := registry.Register(dbName, dbConfig); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config := server.DefaultConfig()
+	config.DBName = dbName
+	config.SessionDir = t.TempDir()
+	s, err := server.New(config)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	handler, err := s.Handler()
+	if err != nil {
+		t.Fatalf("Handler: %v", err)
+	}
+	t.Cleanup(func() { s.Close(t.Context()) })
+	ts := httptest.NewServer(handler)
+	t.Cleanup(ts.Close)
+
+	// The administrator seeded by the server signs in with a password of
+	// the test, restored afterwards
+	db, err := database.GetDatabase(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var admin models.User
+	if err := db.Where("login = ?", "admin").First(&admin).Error; err != nil {
+		t.Fatalf("no administrator: %v", err)
+	}
+	previous := admin.Password
+	adminPassword := testutil.Unique("admin-password")
+	if err := admin.SetPassword(adminPassword); err != nil {
+		t.Fatal(err)
+	}
+	db.Model(&admin).Update("password", admin.Password)
+	t.Cleanup(func() { db.Model(&admin).Update("password", previous) })
+
+	anonymous := newClient(t, ts.URL)
+	if status := anonymous.do("POST", "/api/users/create", map[string]interface{}{}, nil); status != http.StatusUnauthorized {
+		t.Errorf("creating a user without a session answered %d, want 401", status)
+	}
+	if status := anonymous.login("admin", "wrong password"); status != http.StatusUnauthorized {
+		t.Errorf("login with a wrong password answered %d, want 401", status)
+	}
+
+	browser := newClient(t, ts.URL)
+	if status := browser.login("admin", adminPassword); status != http.StatusOK {
+		t.Fatalf("admin login answered %d", status)
+	}
+
+	login := testutil.Unique("e2e_user")
+	password := testutil.Unique("password")
+	var created struct {
+		ID uint `json:"id"`
+	}
+	status := browser.do("POST", "/api/users/create", map[string]interface{}{
+		"login": login, "name": "End To End", "email": login + "@example.com", "password": password, "active": true,
+	}, &created)
+	if status != http.StatusOK && status != http.StatusCreated {
+		t.Fatalf("creating a user answered %d", status)
+	}
+	t.Cleanup(func() { db.Unscoped().Where("login = ?", login).Delete(&models.User{}) })
+
+	var users []struct {
+		ID    uint   `json:"id"`
+		Login string `json:"login"`
+		Email string `json:"email"`
+	}
+	if status := browser.do("GET", "/api/users", nil, &users); status != http.StatusOK {
+		t.Fatalf("listing the users answered %d", status)
+	}
+	found := false
+	for _, user := range users {
+		if user.Login == login {
+			found = true
+			if user.ID != created.ID || user.Email != login+"@example.com" {
+				t.Errorf("listed user = %+v, want id %d and email %s@example.com", user, created.ID, login)
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("user %s is not listed", login)
+	}
+
+	newcomer := newClient(t, ts.URL)
+	if status := newcomer.login(login, password); status != http.StatusOK {
+		t.Fatalf("login of the new user answered %d", status)
+	}
+	var profile struct {
+		Login string `json:"login"`
+	}
+	if status := newcomer.do("GET", "/api/users/me", nil, &profile); status != http.StatusOK {
+		t.Fatalf("reading the profile answered %d", status)
+	}
+	if profile.Login != login {
+		t.Errorf("profile login = %s, want %s", profile.Login, login)
+	}
+	if status := newcomer.do("POST", "/api/users/create", map[string]interface{}{}, nil); status != http.StatusForbidden {
+		t.Errorf("a user without the users.manage permission creating a user answered %d, want 403", status)
+	}
+
+	// The detailed status is restricted to the users granted status.read,
+	// which administrators hold
+	if status := anonymous.do("GET", "/api/status", nil, nil); status != http.StatusUnauthorized {
+		t.Errorf("reading the status without a session answered %d, want 401", status)
+	}
+	if status := newcomer.do("GET", "/api/status", nil, nil); status != http.StatusForbidden {
+		t.Errorf("a user without the status.read permission reading the status answered %d, want 403", status)
+	}
+	if status := browser.do("GET", "/api/status", nil, nil); status != http.StatusOK {
+		t.Errorf("the administrator reading the status answered %d, want 200", status)
+	}
+}
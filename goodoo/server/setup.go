@@ -0,0 +1,519 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"goodoo/auth"
+	"goodoo/backup"
+	"goodoo/chat"
+	"goodoo/connections"
+	"goodoo/crash"
+	"goodoo/cron"
+	"goodoo/database"
+	"goodoo/editing"
+	goodooHttp "goodoo/http"
+	"goodoo/logging"
+	"goodoo/mail"
+	"goodoo/mailgate"
+	"goodoo/maintenance"
+	"goodoo/metrics"
+	"goodoo/models"
+	"goodoo/notification"
+	"goodoo/oidc"
+	"goodoo/presence"
+	"goodoo/reports"
+	"goodoo/retention"
+	"goodoo/scan"
+	"goodoo/scheduler"
+	"goodoo/status"
+	"goodoo/storage"
+	"goodoo/tasks"
+	"goodoo/templates"
+	"goodoo/tlsserver"
+	"goodoo/upload"
+	"goodoo/userchat"
+	"goodoo/webhook"
+	"goodoo/workpool"
+)
+
+// SchemaModels are the GORM models migrated on startup
+var SchemaModels = []interface{}{
+	&models.ResGroups{}, &models.User{}, &models.IrTranslation{},
+	&models.Country{}, &models.Lang{},
+	&models.Partner{}, &models.SaleOrder{}, &models.SaleOrderLine{}, &models.MailMessage{},
+	&models.IrCron{}, &models.IrCronRun{}, &models.IrAttachment{},
+	&models.IrSequence{}, &models.AuditLog{}, &models.IrModelData{},
+	&models.Webhook{}, &models.WebhookDelivery{}, &models.WebhookDeliveryAttempt{},
+	&models.InboundHook{}, &models.IrUpload{}, &models.IrConfigParameter{},
+	&models.KnowledgeDocument{}, &models.KnowledgeChunk{}, &models.ProductCategory{},
+	&models.UserPresence{}, &models.MetricsSample{}, &models.LLMProvider{}, &models.LLMModel{},
+	&models.ChatSession{}, &models.ChatMessage{}, &models.IrLogging{}, &models.Notification{},
+	&models.IdempotencyRecord{}, &models.ShareLink{}, &models.UserPreference{}, &models.CrashReport{},
+	&models.GroupPermission{}, &models.IrModelDefinition{}, &models.ServiceKey{},
+	&models.DuplicateRule{}, &models.ServiceAccount{}, &models.QuotaCounter{}, &models.UserChatReceipt{},
+	&models.IndexAdvice{}, &models.UserInvitation{}, &models.RecordRule{}, &models.UserImport{},
+	&models.TaskRun{}, &models.StatusDaily{}, &models.ParameterHistory{},
+	&models.SavedFilter{}, &models.EmailChange{}, &models.UserDataExport{}, &models.LLMRoute{},
+	&models.Tag{}, &models.TagLink{}, &models.MailAlias{}, &models.MailInbound{},
+	&models.MailThreadMessage{}, &models.PromptTemplate{}, &models.PromptTemplateUse{},
+	&models.ReportSchedule{}, &models.ReportScheduleRun{},
+}
+
+// configure reads the package configurations from the environment and
+// builds the session store, the request configuration and the Echo
+// instance with its middleware stack
+func (s *Server) configure() error {
+	dbName := s.config.DBName
+
+	// A database that fails to connect is tripped: connections fail fast
+	// while a probe retries it (GOODOO_DB_BREAKER_*)
+	breakerConfig := database.DefaultBreakerConfig()
+	breakerConfig.LoadFromEnv()
+	database.SetupBreaker(breakerConfig)
+
+	// Outgoing mail is queued and sent in the background
+	mailConfig := mail.DefaultConfig()
+	mailConfig.LoadFromEnv()
+	mail.Setup(mailConfig)
+
+	// Staged uploads (GOODOO_UPLOAD_*) expire and are cleaned up in the background
+	uploadConfig := upload.DefaultConfig()
+	uploadConfig.LoadFromEnv()
+	upload.Setup(uploadConfig)
+
+	// User presence (GOODOO_PRESENCE_*) survives restarts and is saved every minute
+	presenceConfig := presence.DefaultConfig()
+	presenceConfig.LoadFromEnv()
+	presence.Setup(presenceConfig)
+
+	// Editors of records (GOODOO_EDITING_*) expire without heartbeat
+	editingConfig := editing.DefaultConfig()
+	editingConfig.LoadFromEnv()
+	editing.Setup(editingConfig)
+
+	// Typing indicators of the user chat (GOODOO_TYPING_*) expire after a
+	// few seconds and are rate limited
+	userchatConfig := userchat.DefaultConfig()
+	userchatConfig.LoadFromEnv()
+	userchat.Setup(userchatConfig)
+
+	// Backup and restore need the master password (GOODOO_MASTER_PASSWORD);
+	// automatic backups (GOODOO_BACKUP_*) are written to the backup directory
+	backupConfig := backup.DefaultConfig()
+	backupConfig.LoadFromEnv()
+	backup.Setup(backupConfig)
+
+	// CPU-heavy conversions (imports, exports, multi-record reports) run
+	// on GOODOO_WORKER_POOL_SIZE workers, GOMAXPROCS by default
+	workpoolConfig := workpool.DefaultConfig()
+	workpoolConfig.LoadFromEnv()
+	workpool.Setup(workpoolConfig)
+
+	// Background tasks run on GOODOO_TASK_WORKERS workers; the server waits
+	// for them when it stops
+	tasksConfig := tasks.DefaultConfig()
+	tasksConfig.LoadFromEnv()
+	tasks.Setup(tasksConfig)
+	s.OnShutdown(tasks.Shutdown)
+
+	// Maintenance mode blocks the mutating requests of other users than
+	// administrators (GOODOO_MAINTENANCE_*)
+	maintenanceConfig := maintenance.DefaultConfig()
+	maintenanceConfig.LoadFromEnv()
+	maintenance.Setup(maintenanceConfig)
+
+	// Read notifications older than GOODOO_NOTIFICATION_RETENTION are pruned every hour
+	notificationConfig := notification.DefaultConfig()
+	notificationConfig.LoadFromEnv()
+	notification.Setup(notificationConfig)
+
+	// Event streams are capped per user and in total, closed when idle and
+	// drained when the server stops (GOODOO_CONNECTIONS_*)
+	connectionsConfig := connections.DefaultConfig()
+	connectionsConfig.LoadFromEnv()
+	connections.Setup(connectionsConfig)
+
+	// Initialize session store
+	sessionStore, err := goodooHttp.NewFilesystemSessionStore(s.config.SessionDir, true, s.config.Clock)
+	if err != nil {
+		return fmt.Errorf("failed to create session store: %w", err)
+	}
+	s.sessionStore = sessionStore
+
+	// The status page checks that the session store can still be written
+	status.Register(status.ComponentSessions, "Sessions", func(ctx context.Context, dbName string) (string, string) {
+		file, err := os.CreateTemp(sessionStore.Path(), ".status-*")
+		if err != nil {
+			return status.Down, err.Error()
+		}
+		file.Close()
+		if err := os.Remove(file.Name()); err != nil {
+			return status.Down, err.Error()
+		}
+		return status.Operational, ""
+	})
+
+	// Request metrics (GOODOO_METRICS_*) are sampled every minute and kept
+	// as history for the dashboard charts
+	metricsConfig := metrics.DefaultConfig()
+	metricsConfig.LoadFromEnv()
+	metrics.Setup(metricsConfig)
+
+	// Session files, temporary files and backups are bounded by the
+	// GOODOO_STORAGE_* quotas; expired files are deleted every 15 minutes
+	storageConfig := storage.DefaultConfig()
+	storageConfig.LoadFromEnv()
+	storage.Setup(storageConfig, sessionStore, backupConfig.Dir)
+
+	// Uploaded attachments are scanned for malware by the clamd daemon of
+	// GOODOO_SCAN_CLAMD_ADDRESS before they can be downloaded
+	scanConfig := scan.DefaultConfig()
+	scanConfig.LoadFromEnv()
+	scan.Setup(scanConfig)
+
+	// Old chat messages, audit and log records are archived then purged
+	// after the days of their retention.<table>.days parameter
+	// (GOODOO_RETENTION_*)
+	retentionConfig := retention.DefaultConfig()
+	retentionConfig.LoadFromEnv()
+	retention.Setup(retentionConfig)
+
+	// Native TLS (GOODOO_TLS_*): certificate files reloaded on SIGHUP or
+	// change, or ACME certificates; administrators are notified daily of a
+	// certificate expiring within 14 days
+	tlsConfig := tlsserver.DefaultConfig()
+	if err := tlsConfig.LoadFromEnv(); err != nil {
+		return fmt.Errorf("invalid TLS configuration: %w", err)
+	}
+	if tlsConfig.Enabled() {
+		if s.tls, err = tlsserver.New(tlsConfig, s.config.Clock); err != nil {
+			return fmt.Errorf("invalid TLS certificate: %w", err)
+		}
+		s.tlsMinVersion = tlsConfig.MinVersion
+	}
+
+	// Security headers (CSP, HSTS); routes meant to be embedded can relax
+	// frame-ancestors through securityConfig.Routes. Serving TLS, the
+	// connection alone tells whether a request is secure.
+	securityConfig := goodooHttp.DefaultSecurityConfig()
+	securityConfig.LoadFromEnv()
+	securityConfig.TerminatesTLS = s.tls != nil
+	if securityConfig.ProxyMode && len(securityConfig.TrustedProxies) == 0 {
+		s.logger.Warning("GOODOO_PROXY_MODE is set without GOODOO_TRUSTED_PROXIES: X-Forwarded-For is ignored and clients are identified by the address of the proxy")
+	}
+
+	// Single sign-on (GOODOO_OIDC_*), overridden by the auth_oidc.* system
+	// parameters; disabled until an issuer and client id are set
+	oidcConfig := oidc.DefaultConfig()
+	oidcConfig.LoadFromEnv()
+	oidc.Setup(oidcConfig)
+
+	// Login backends in order (GOODOO_AUTH_BACKENDS, "local" by default)
+	// and the LDAP directory (GOODOO_LDAP_*), both overridden by system
+	// parameters
+	if err := auth.LoadFromEnv(); err != nil {
+		return fmt.Errorf("invalid authentication configuration: %w", err)
+	}
+	ldapConfig := auth.DefaultLDAPConfig()
+	if err := ldapConfig.LoadFromEnv(); err != nil {
+		return fmt.Errorf("invalid LDAP configuration: %w", err)
+	}
+	auth.SetupLDAP(ldapConfig)
+
+	// Session cookie attributes (GOODOO_SESSION_COOKIE_*), e.g. the path
+	// prefix goodoo is mounted under
+	var sessionCookie goodooHttp.CookieConfig
+	sessionCookie.LoadFromEnv()
+	if err := sessionCookie.Validate(); err != nil {
+		return fmt.Errorf("invalid session cookie configuration: %w", err)
+	}
+
+	// Cross-origin policy (GOODOO_CORS_*); the allowed origins can be
+	// changed from the settings without restart
+	corsConfig := goodooHttp.DefaultCORSConfig()
+	corsConfig.LoadFromEnv()
+	if err := corsConfig.Validate(); err != nil {
+		return fmt.Errorf("invalid CORS configuration: %w", err)
+	}
+	corsConfig.OriginsResolver = func() []string {
+		if origins := models.GetParamString(dbName, models.ParamCORSAllowedOrigins, ""); origins != "" {
+			return goodooHttp.SplitList(origins)
+		}
+		return nil
+	}
+
+	// Responses to Idempotency-Key requests are replayed for
+	// GOODOO_IDEMPOTENCY_WINDOW, then pruned every hour
+	idempotencyConfig := goodooHttp.DefaultIdempotencyConfig()
+	idempotencyConfig.LoadFromEnv()
+
+	// Sticky context keys users may set, read as field defaults on create
+	contextDefaultKeys := models.ParseContextDefaultKeys("team_id,company_id")
+	if keys := os.Getenv("GOODOO_CONTEXT_DEFAULT_KEYS"); keys != "" {
+		contextDefaultKeys = models.ParseContextDefaultKeys(keys)
+	}
+
+	// API versions, and the sunset of the unversioned /api paths (GOODOO_API_SUNSET)
+	apiVersionConfig := goodooHttp.DefaultAPIVersionConfig()
+	apiVersionConfig.LoadFromEnv()
+
+	// Requests signed with a service key are accepted within
+	// GOODOO_SERVICE_AUTH_WINDOW of the server clock
+	serviceAuthConfig := goodooHttp.DefaultServiceAuthConfig()
+	serviceAuthConfig.LoadFromEnv()
+
+	// Create request configuration
+	s.requestConfig = &goodooHttp.RequestConfig{
+		SessionStore:      sessionStore,
+		DefaultDBName:     dbName,
+		SessionCookieName: "goodoo_session",
+		SessionCookie:     sessionCookie,
+		Logger:            s.logger,
+		Clock:             s.config.Clock,
+		RegistryResolver: func(dbName string) interface{} {
+			return models.RegistryForDB(dbName)
+		},
+		LangResolver: func(dbName string) []string {
+			db, err := database.GetDatabase(dbName)
+			if err != nil {
+				return []string{models.DefaultLang}
+			}
+			langs, err := models.InstalledLangs(db)
+			if err != nil {
+				return []string{models.DefaultLang}
+			}
+			return langs
+		},
+		Security:           securityConfig,
+		CORS:               corsConfig,
+		Idempotency:        idempotencyConfig,
+		APIVersion:         apiVersionConfig,
+		ServiceAuth:        serviceAuthConfig,
+		ContextDefaultKeys: contextDefaultKeys,
+		SessionTimeoutResolver: func(dbName string) time.Duration {
+			return time.Duration(models.GetParamInt(dbName, models.ParamSessionTimeout, 0)) * time.Minute
+		},
+		GroupsResolver: func(req *goodooHttp.Request) ([]string, bool) {
+			db := req.GetDB()
+			if db == nil {
+				return nil, false
+			}
+			var user models.User
+			if err := db.First(&user, req.GetUserID()).Error; err != nil {
+				return nil, false
+			}
+			// Service accounts are granted permissions, not groups
+			if user.IsService {
+				return nil, false
+			}
+			groups, _ := models.UserGroupXMLIDs(db, user.ID)
+			return groups, user.IsAdmin()
+		},
+		// Resolved on every request, cached briefly, so changed assignments
+		// apply without logging in again
+		PermissionsResolver: func(req *goodooHttp.Request) ([]string, bool) {
+			db := req.GetDB()
+			if db == nil {
+				return nil, false
+			}
+			permissions, admin, err := models.ResolvePermissions(req.GetDBName(), db, uint(req.GetUserID()))
+			if err != nil {
+				req.Logger.WarningCtx(req.Context, "Failed to resolve the permissions of user %d: %v", req.GetUserID(), err)
+				return nil, false
+			}
+			return permissions, admin
+		},
+	}
+
+	// The features this configuration turns on or off, logged with those
+	// of the database once it is set up
+	s.reportConfigCapabilities(mailConfig, metricsConfig, tlsConfig)
+
+	s.echo = s.newEcho()
+	return nil
+}
+
+// newEcho builds the Echo instance with the middleware stack and the
+// static files
+func (s *Server) newEcho() *echo.Echo {
+	dbName := s.config.DBName
+	requestConfig := s.requestConfig
+
+	// Static assets are fingerprinted unless running in development mode
+	staticAssets := goodooHttp.NewStaticAssets(s.config.StaticDir, "/static", s.config.DevMode)
+	if err := staticAssets.Precompute(); err != nil {
+		s.logger.Warning("Failed to precompute static asset hashes: %v", err)
+	}
+
+	e := echo.New()
+
+	// Set up template renderer
+	e.Renderer = templates.NewTemplateRendererWithFuncs(staticAssets.FuncMap())
+
+	// Disable Echo's default logger since we have our own
+	e.Logger.SetOutput(io.Discard)
+
+	// The client address, which keys the rate limits, is only taken from
+	// X-Forwarded-For behind the trusted proxies
+	e.IPExtractor = requestConfig.Security.IPExtractor()
+
+	// Core middleware
+	// /api/v1 serves the unversioned /api routes, which are deprecated
+	// until GOODOO_API_SUNSET
+	e.Pre(goodooHttp.APIVersionMiddleware(requestConfig.APIVersion))
+	// Panics are logged, stored as crash reports and answered with a 500
+	e.Use(crash.Middleware(dbName))
+	e.Use(goodooHttp.CORSMiddleware(requestConfig))
+
+	// Goodoo middleware; the request middleware comes first and also
+	// configures the routes registered from specs
+	goodooHttp.UseRequestMiddleware(e, requestConfig)
+	e.Use(metrics.Middleware(dbName))
+	e.Use(logging.PerformanceMiddlewareWithToggle(func(c echo.Context) bool {
+		req := goodooHttp.GetGoodooRequest(c)
+		return req == nil || req.DB == "" || models.GetParamBool(req.DB, models.ParamPerformanceMonitoring, true)
+	}))
+	e.Use(goodooHttp.SecurityMiddleware(requestConfig))
+	e.Use(goodooHttp.ErrorHandlingMiddleware())
+	e.Use(goodooHttp.RequestLoggingMiddleware())
+	// Answers 503 to mutating requests during maintenance, after the
+	// session is known so administrators go through
+	e.Use(maintenance.Middleware())
+	// Debug dumps of the requests to GOODOO_LOG_BODY_ROUTES, redacted
+	if logConfig := logging.DefaultLogConfig(); len(logConfig.LogBodyRoutes) > 0 {
+		e.Use(goodooHttp.BodyLoggingMiddleware(logConfig.LogBodyRoutes, logConfig.LogBodyMaxBytes))
+	}
+
+	// Session cleanup (every hour), reported in the activity feed
+	e.Use(goodooHttp.SessionCleanupMiddleware(s.sessionStore, 1*time.Hour, func(removed int, err error) {
+		db, dbErr := database.GetDatabase(dbName)
+		if dbErr != nil || (removed == 0 && err == nil) {
+			return
+		}
+		activity := models.Activity{Type: models.ActivitySessionCleanup, Params: map[string]interface{}{"count": removed}}
+		if err != nil {
+			activity.Severity = models.SeverityError
+			activity.Params["error"] = err.Error()
+		}
+		if err := models.LogActivity(db, 0, activity); err != nil {
+			s.logger.Warning("Failed to record the session cleanup: %v", err)
+		}
+	}))
+
+	// Static files
+	staticAssets.Register(e)
+	return e
+}
+
+// schedule restores the state kept in the default database and registers
+// the background jobs, started by Start
+func (s *Server) schedule() {
+	dbName := s.config.DBName
+	sched := scheduler.Default()
+
+	mail.ScheduleQueue(sched, dbName, time.Minute)
+
+	// The IMAP mailboxes of the mail aliases are polled at their own interval
+	mailgate.Schedule(sched, dbName, time.Minute)
+
+	// Record events are posted to webhooks in the background
+	webhook.ScheduleQueue(sched, dbName, 30*time.Second)
+
+	upload.ScheduleCleanup(sched, dbName, 10*time.Minute)
+	scan.Schedule(sched, dbName, 15*time.Second)
+
+	if db, err := database.GetDatabase(dbName); err == nil {
+		if err := presence.Restore(db, dbName); err != nil {
+			s.logger.Warning("Failed to restore user presence: %v", err)
+		}
+	}
+	presence.Schedule(sched, dbName, 30*time.Second, time.Minute)
+	editing.Schedule(sched, dbName, 10*time.Second)
+	userchat.Schedule(sched, dbName, 2*time.Second)
+	connections.Schedule(sched, time.Minute)
+	maintenance.Schedule(sched, dbName, 10*time.Second)
+
+	// Durable tasks a restart interrupted are resumed or marked lost
+	if db, err := database.GetDatabase(dbName); err == nil {
+		if _, lost, err := tasks.Recover(dbName, db); err != nil {
+			s.logger.Warning("Failed to recover the interrupted tasks: %v", err)
+		} else if lost > 0 {
+			s.logger.Warning("%d task(s) interrupted by the last stop are lost", lost)
+		}
+	}
+
+	// Chat sessions are titled in the background after their first exchange
+	chat.ScheduleTitles(sched, dbName, 15*time.Second)
+
+	backup.Schedule(sched, dbName)
+	notification.Schedule(sched, dbName, time.Hour)
+	// Notifications of the email and digest channels are mailed in the background
+	notification.ScheduleDelivery(sched, dbName, s.echo.Renderer, time.Minute)
+
+	// Records of the log database (GOODOO_LOG_DB) older than
+	// GOODOO_LOG_DB_RETENTION_DAYS are deleted every hour
+	s.scheduleLogRetention(logging.DefaultLogConfig().LogDBRetentionDays)
+
+	// Records of transient models (wizards) are vacuumed in the background
+	models.ScheduleVacuum(sched, dbName, 5*time.Minute)
+
+	// Scheduled actions stored in the database
+	cron.ScheduleRunner(sched, dbName, time.Minute)
+
+	// Reports and exports mailed on a recurrence, rendered as their owner
+	reports.ScheduleRunner(sched, dbName, s.echo.Renderer, time.Minute)
+
+	metrics.Schedule(sched, dbName, func() goodooHttp.SessionStats { return s.sessionStore.Stats(dbName) })
+	s.scheduleSessionReconcile(15 * time.Minute)
+	storage.Schedule(sched, dbName, 15*time.Minute)
+	retention.Schedule(sched, dbName)
+	if s.tls != nil {
+		s.tls.Schedule(sched, dbName)
+	}
+	models.ScheduleIdempotencyPrune(sched, dbName, time.Hour, s.requestConfig.Idempotency.Window)
+
+	// The personal data of expired account exports is deleted
+	models.ScheduleDataExportPrune(sched, dbName, time.Hour)
+
+	// Quota counters drift when records are deleted behind the ORM
+	models.ScheduleQuotaReconcile(sched, dbName, time.Hour)
+
+	// The components of the status page are sampled for its uptime history
+	status.Schedule(sched, dbName, time.Minute)
+}
+
+// scheduleSessionReconcile checks the session index against the session
+// files every interval, so that the session statistics catch the files
+// changed behind the store
+func (s *Server) scheduleSessionReconcile(interval time.Duration) {
+	scheduler.Default().Every("sessions.reconcile", interval, func(ctx context.Context) error {
+		drift, err := s.sessionStore.ReconcileIndex()
+		if drift > 0 {
+			s.logger.Info("Reconciled %d session(s) of the session index with the session files", drift)
+		}
+		return err
+	})
+}
+
+func (s *Server) scheduleLogRetention(days int) {
+	if days <= 0 {
+		return
+	}
+	dbName := s.config.DBName
+	scheduler.Default().Every("logging.retention."+dbName, time.Hour, func(ctx context.Context) error {
+		db, err := database.GetDatabase(dbName)
+		if err != nil {
+			return err
+		}
+		deleted, err := models.PruneLogs(db.WithContext(ctx), time.Now().AddDate(0, 0, -days))
+		if deleted > 0 {
+			s.logger.Info("Deleted %d log record(s) of %s older than %d days", deleted, dbName, days)
+		}
+		return err
+	})
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	nethttp "net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"goodoo/crypto"
+	"goodoo/database"
+	"goodoo/http"
+	"goodoo/httpclient"
+	"goodoo/logging"
+	"goodoo/models"
+	"goodoo/server"
+	"goodoo/templates"
+	"goodoo/tlsserver"
+	"gorm.io/gorm"
+)
+
+// knownEnv lists the GOODOO_* environment variables the server reads;
+// others are reported as likely typos
+var knownEnv = map[string]bool{
+	"GOODOO_API_SUNSET": true, "GOODOO_BACKUP_DIR": true, "GOODOO_BACKUP_FORMAT": true,
+	"GOODOO_BACKUP_INTERVAL": true, "GOODOO_BACKUP_KEEP": true, "GOODOO_BACKUP_KEEP_DAYS": true,
+	"GOODOO_COLORS": true, "GOODOO_CONNECTIONS_DRAIN_TIMEOUT": true, "GOODOO_CONNECTIONS_IDLE_TIMEOUT": true,
+	"GOODOO_CONNECTIONS_MAX": true, "GOODOO_CONNECTIONS_MAX_PER_USER": true,
+	"GOODOO_CONNECTIONS_RECONNECT_AFTER": true, "GOODOO_CONTEXT_DEFAULT_KEYS": true,
+	"GOODOO_CORS_ALLOW_CREDENTIALS": true, "GOODOO_CORS_ALLOW_HEADERS": true, "GOODOO_CORS_ALLOW_METHODS": true,
+	"GOODOO_CORS_ALLOW_ORIGINS": true, "GOODOO_CORS_EXPOSE_HEADERS": true, "GOODOO_CORS_MAX_AGE": true,
+	"GOODOO_CSP_REPORT_ONLY": true, "GOODOO_DB_BREAKER_BACKOFF": true, "GOODOO_DB_BREAKER_MAX_BACKOFF": true,
+	"GOODOO_DB_FILTER": true, "GOODOO_DB_IDLE_TRANSACTION_TIMEOUT": true, "GOODOO_DB_LOCK_TIMEOUT": true,
+	"GOODOO_DB_STATEMENT_TIMEOUT": true, "GOODOO_DB_TIMEOUT_OVERRIDES": true, "GOODOO_DB_WARMUP": true,
+	"GOODOO_DB_WARMUP_CONCURRENCY": true, "GOODOO_DB_WARMUP_DATABASES": true, "GOODOO_DB_WARMUP_DISCOVER": true,
+	"GOODOO_DB_WARMUP_MAX_RETRY_BACKOFF": true, "GOODOO_DB_WARMUP_RETRY_BACKOFF": true,
+	"GOODOO_DB_WARMUP_TIMEOUT": true, "GOODOO_DEFAULT_DB": true, "GOODOO_DEV_MODE": true,
+	"GOODOO_EDITING_MAX_PER_RECORD": true, "GOODOO_EDITING_MAX_PER_USER": true, "GOODOO_EDITING_TIMEOUT": true,
+	"GOODOO_ENCRYPTION_KEYS": true, "GOODOO_HSTS_MAX_AGE": true,
+	"GOODOO_IDEMPOTENCY_WAIT": true, "GOODOO_INSTANCE_ID": true, "GOODOO_IDEMPOTENCY_WINDOW": true,
+	"GOODOO_LOG_BODY_MAX_BYTES": true, "GOODOO_LOG_BODY_ROUTES": true,
+	"GOODOO_LOG_DB": true, "GOODOO_LOG_DB_LEVEL": true, "GOODOO_LOG_DB_RETENTION_DAYS": true,
+	"GOODOO_LOG_FILE": true, "GOODOO_LOG_HANDLER": true, "GOODOO_LOG_LEVEL": true, "GOODOO_LOG_REDACT_KEYS": true,
+	"GOODOO_LOG_STREAM_MAX_CONNECTIONS": true, "GOODOO_LOG_STREAM_MAX_MINUTES": true,
+	"GOODOO_MAIL_FROM": true, "GOODOO_MAIL_TRANSPORT": true, "GOODOO_MAINTENANCE_ALLOW_READS": true,
+	"GOODOO_MAINTENANCE_ALLOW_VACUUM_FULL": true, "GOODOO_MAINTENANCE_RETRY_AFTER": true,
+	"GOODOO_MASTER_PASSWORD": true, "GOODOO_METRICS_DAY_RETENTION": true, "GOODOO_METRICS_ENABLED": true,
+	"GOODOO_METRICS_FLUSH_INTERVAL": true, "GOODOO_METRICS_HOUR_RETENTION": true,
+	"GOODOO_METRICS_MINUTE_RETENTION": true, "GOODOO_NOTIFICATION_RETENTION": true,
+	"GOODOO_OIDC_AUTO_PROVISION": true, "GOODOO_OIDC_CACHE_TTL": true, "GOODOO_OIDC_CLIENT_ID": true,
+	"GOODOO_OIDC_CLIENT_SECRET": true, "GOODOO_OIDC_CLOCK_SKEW": true, "GOODOO_OIDC_DEFAULT_GROUP": true,
+	"GOODOO_OIDC_END_SESSION": true, "GOODOO_OIDC_ISSUER": true, "GOODOO_OIDC_LABEL": true,
+	"GOODOO_OIDC_LOGIN_CLAIM": true, "GOODOO_OIDC_REDIRECT_URL": true, "GOODOO_OIDC_SCOPES": true,
+	"GOODOO_OUTBOUND_BREAKER_COOLDOWN": true, "GOODOO_OUTBOUND_BREAKER_THRESHOLD": true,
+	"GOODOO_OUTBOUND_CA_FILE": true, "GOODOO_OUTBOUND_CERT_FILE": true, "GOODOO_OUTBOUND_INTERNAL_HOSTS": true,
+	"GOODOO_OUTBOUND_KEY_FILE": true, "GOODOO_OUTBOUND_MAX_CONNS_PER_HOST": true,
+	"GOODOO_OUTBOUND_MAX_RETRIES": true, "GOODOO_OUTBOUND_MAX_RETRY_WAIT": true,
+	"GOODOO_OUTBOUND_RETRY_BACKOFF": true, "GOODOO_OUTBOUND_TIMEOUT": true,
+	"GOODOO_OUTBOUND_TIMEOUT_HEALTH": true, "GOODOO_OUTBOUND_TIMEOUT_LLM": true,
+	"GOODOO_OUTBOUND_TIMEOUT_OIDC": true, "GOODOO_OUTBOUND_TIMEOUT_WEBHOOK": true,
+	"GOODOO_PGAPPNAME": true, "GOODOO_PRESENCE_AWAY_AFTER": true, "GOODOO_PRESENCE_TIMEOUT": true,
+	"GOODOO_PROXY_MODE": true, "GOODOO_RETENTION_BATCH_SIZE": true,
+	"GOODOO_RETENTION_INTERVAL": true, "GOODOO_RETENTION_MAX_BATCHES": true, "GOODOO_RETENTION_PARTITION": true,
+	"GOODOO_RETENTION_VACUUM_ROWS": true, "GOODOO_SERVICE_AUTH_WINDOW": true, "GOODOO_SESSION_COOKIE_DOMAIN": true, "GOODOO_SESSION_COOKIE_HOST_PREFIX": true,
+	"GOODOO_SESSION_COOKIE_MAX_AGE": true, "GOODOO_SESSION_COOKIE_PATH": true,
+	"GOODOO_SESSION_COOKIE_SAMESITE": true, "GOODOO_SESSION_COOKIE_SECURE": true, "GOODOO_SESSION_DIR": true,
+	"GOODOO_SMTP_ENCRYPTION": true, "GOODOO_SMTP_HOST": true, "GOODOO_SMTP_PASSWORD": true,
+	"GOODOO_SMTP_PORT": true, "GOODOO_SMTP_USER": true, "GOODOO_STORAGE_BACKUP_QUOTA": true,
+	"GOODOO_STORAGE_SESSION_MAX_FILES": true, "GOODOO_STORAGE_SESSION_QUOTA": true,
+	"GOODOO_STORAGE_TEMP_QUOTA": true, "GOODOO_STORAGE_TEMP_TTL": true, "GOODOO_SYSLOG": true, "GOODOO_TEST_DB": true, "GOODOO_TRUSTED_PROXIES": true,
+	"GOODOO_TLS_ACME_CACHE_DIR": true, "GOODOO_TLS_ACME_DIRECTORY_URL": true, "GOODOO_TLS_ACME_DOMAINS": true,
+	"GOODOO_TLS_ACME_EMAIL": true, "GOODOO_TLS_CERT_FILE": true, "GOODOO_TLS_CHAIN_FILE": true,
+	"GOODOO_TLS_CIPHERS": true, "GOODOO_TLS_HTTP_PORT": true, "GOODOO_TLS_KEY_FILE": true,
+	"GOODOO_TLS_MIN_VERSION": true, "GOODOO_TLS_RELOAD_INTERVAL": true,
+	"GOODOO_TRACE_CAPACITY": true, "GOODOO_TRACE_ENABLED": true, "GOODOO_TRACE_OTLP_ENDPOINT": true,
+	"GOODOO_TRACE_THRESHOLD": true, "GOODOO_TYPING_INTERVAL": true, "GOODOO_TYPING_TTL": true,
+	"GOODOO_UPLOAD_MAX_BYTES": true, "GOODOO_UPLOAD_MAX_COUNT": true, "GOODOO_UPLOAD_MAX_FILE_SIZE": true,
+	"GOODOO_UPLOAD_TTL": true, "GOODOO_WORKER_POOL_SIZE": true,
+}
+
+// startupCheck is the outcome of one startup check
+type startupCheck struct {
+	Name     string
+	Err      error
+	Warnings []string
+}
+
+// startupReport collects the outcome of every startup check, so that a
+// deployment learns about all its problems at once
+type startupReport struct {
+	Checks []startupCheck
+}
+
+// add records the outcome of a check
+func (r *startupReport) add(name string, err error, warnings ...string) {
+	r.Checks = append(r.Checks, startupCheck{Name: name, Err: err, Warnings: warnings})
+}
+
+// failures returns the failed checks
+func (r *startupReport) failures() []startupCheck {
+	var failed []startupCheck
+	for _, check := range r.Checks {
+		if check.Err != nil {
+			failed = append(failed, check)
+		}
+	}
+	return failed
+}
+
+// log writes the outcome of each check, then a summary of the failures at
+// CRITICAL
+func (r *startupReport) log(logger *logging.Logger) {
+	for _, check := range r.Checks {
+		for _, warning := range check.Warnings {
+			logger.Warning("Startup check %s: %s", check.Name, warning)
+		}
+		if check.Err == nil {
+			logger.Info("Startup check %s: ok", check.Name)
+		}
+	}
+	failed := r.failures()
+	if len(failed) == 0 {
+		return
+	}
+	lines := make([]string, len(failed))
+	for i, check := range failed {
+		lines[i] = fmt.Sprintf("  - %s: %v", check.Name, check.Err)
+	}
+	logger.Critical("Startup validation failed, %d of %d checks:\n%s", len(failed), len(r.Checks), strings.Join(lines, "\n"))
+}
+
+// startupOptions selects the startup checks
+type startupOptions struct {
+	dbName     string
+	sessionDir string
+	// requireMigrated fails on pending schema changes instead of warning,
+	// for --check: a normal startup migrates them
+	requireMigrated bool
+	// checkLLM checks that the active LLM providers are reachable
+	checkLLM bool
+}
+
+// validateStartup runs every startup check, before the server binds its
+// port
+func validateStartup(opts startupOptions) *startupReport {
+	report := &startupReport{}
+
+	err, warnings := checkConfiguration()
+	report.add("configuration", err, warnings...)
+
+	err, warnings = checkDatabase(opts.dbName, opts.requireMigrated)
+	report.add("database "+opts.dbName, err, warnings...)
+
+	report.add("session directory", checkWritableDir(opts.sessionDir))
+	report.add("templates", templates.Validate())
+
+	if logFile := logging.DefaultLogConfig().LogFile; logFile != "" {
+		report.add("log file", checkWritableFile(logFile))
+	}
+	if opts.checkLLM {
+		report.add("LLM providers", checkLLMProviders(opts.dbName))
+	}
+	return report
+}
+
+// checkConfiguration validates the settings read from the environment and
+// warns about unknown GOODOO_* variables
+func checkConfiguration() (error, []string) {
+	var errs []error
+	if err := crypto.DefaultConfig().LoadFromEnv(); err != nil {
+		errs = append(errs, fmt.Errorf("encryption keys: %w", err))
+	}
+	var cookie http.CookieConfig
+	cookie.LoadFromEnv()
+	if err := cookie.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("session cookie: %w", err))
+	}
+	cors := http.DefaultCORSConfig()
+	cors.LoadFromEnv()
+	if err := cors.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("CORS: %w", err))
+	}
+	warmup := database.DefaultWarmupConfig()
+	warmup.LoadFromEnv()
+	if err := warmup.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("database warm-up: %w", err))
+	}
+	if value := os.Getenv("GOODOO_DB_TIMEOUT_OVERRIDES"); value != "" {
+		if _, err := database.ParseTimeoutOverrides(value, database.DefaultSessionTimeouts()); err != nil {
+			errs = append(errs, fmt.Errorf("database timeouts: %w", err))
+		}
+	}
+
+	var warnings []string
+	tlsConfig := tlsserver.DefaultConfig()
+	if err := tlsConfig.LoadFromEnv(); err != nil {
+		errs = append(errs, fmt.Errorf("TLS: %w", err))
+	} else if err := tlsConfig.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("TLS: %w", err))
+	} else {
+		for _, warning := range tlsConfig.ExpiryWarnings(time.Now()) {
+			warnings = append(warnings, "TLS "+warning)
+		}
+	}
+	for _, entry := range os.Environ() {
+		name, _, _ := strings.Cut(entry, "=")
+		if strings.HasPrefix(name, "GOODOO_") && !knownEnv[name] {
+			warnings = append(warnings, fmt.Sprintf("unknown variable %s is ignored", name))
+		}
+	}
+	sort.Strings(warnings)
+	return errors.Join(errs...), warnings
+}
+
+// checkDatabase registers the database, checks it answers and lists the
+// schema changes a migration would apply
+func checkDatabase(dbName string, requireMigrated bool) (error, []string) {
+	if err := database.QuickRegister(dbName); err != nil {
+		return err, nil
+	}
+	connection, err := database.GetDatabaseConnection(dbName)
+	if err != nil {
+		return err, nil
+	}
+	if err := connection.Ping(); err != nil {
+		return fmt.Errorf("not reachable: %w", err), nil
+	}
+	db, err := database.GetDatabase(dbName)
+	if err != nil {
+		return err, nil
+	}
+
+	pending, err := pendingMigrations(db, dbName)
+	if err != nil {
+		return fmt.Errorf("failed to read the schema: %w", err), nil
+	}
+	if len(pending) == 0 {
+		return nil, nil
+	}
+	message := fmt.Sprintf("%d pending schema change(s): %s", len(pending), strings.Join(pending, ", "))
+	if requireMigrated {
+		return fmt.Errorf("%s; run with --migrate", message), nil
+	}
+	return nil, []string{message + "; they are applied now"}
+}
+
+// pendingMigrations lists the tables and columns of the GORM models
+// missing from the database, and the changes of the field models
+func pendingMigrations(db *gorm.DB, dbName string) ([]string, error) {
+	var pending []string
+	migrator := db.Migrator()
+	for _, model := range server.SchemaModels {
+		statement := &gorm.Statement{DB: db}
+		if err := statement.Parse(model); err != nil {
+			return nil, err
+		}
+		table := statement.Schema.Table
+		if !migrator.HasTable(model) {
+			pending = append(pending, "table "+table)
+			continue
+		}
+		for _, name := range statement.Schema.DBNames {
+			if !migrator.HasColumn(model, name) {
+				pending = append(pending, "column "+table+"."+name)
+			}
+		}
+	}
+
+	diff, err := models.RegistryForDB(dbName).SyncSchemas(db, models.SyncOptions{DryRun: true})
+	if err != nil {
+		return nil, err
+	}
+	for _, change := range diff.Changes {
+		pending = append(pending, change.Kind+" "+change.Table+"."+change.Name)
+	}
+	return pending, nil
+}
+
+// checkWritableDir creates dir if needed and checks files can be written in it
+func checkWritableDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(dir, ".check-*")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+// checkWritableFile checks a file can be opened for appending, creating it
+// like the log handler would
+func checkWritableFile(path string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// checkLLMProviders checks that the API base of each active LLM provider
+// answers; any HTTP status counts as reachable
+func checkLLMProviders(dbName string) error {
+	db, err := database.GetDatabase(dbName)
+	if err != nil {
+		return err
+	}
+	var providers []models.LLMProvider
+	if err := db.Where("active = ? AND api_base <> ''", true).Find(&providers).Error; err != nil {
+		return err
+	}
+
+	client := httpclient.Client(httpclient.PurposeHealth)
+	var errs []error
+	for _, provider := range providers {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		request, err := nethttp.NewRequestWithContext(ctx, nethttp.MethodGet, provider.APIBase, nil)
+		if err == nil {
+			var response *nethttp.Response
+			if response, err = client.Do(request); err == nil {
+				response.Body.Close()
+			}
+		}
+		cancel()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", provider.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -5,6 +5,8 @@ class GoodooDashboard {
         this.charts = {};
         this.refreshInterval = null;
         this.apiBaseUrl = '/api';
+        // Responses fetched ahead by a batch call, consumed by fetchCached
+        this.prefetched = new Map();
         
         this.init();
     }
@@ -15,6 +17,45 @@ class GoodooDashboard {
         this.loadDashboardData();
         this.startAutoRefresh();
         this.setupEventListeners();
+        this.openHashSection();
+        this.applyPermissions();
+    }
+
+    // Hides the sections needing a permission the user lacks; the server
+    // enforces them regardless
+    async applyPermissions() {
+        try {
+            const response = await fetch('/auth/session');
+            if (!response.ok) return;
+            const session = await response.json();
+            const granted = new Set(session.permissions || []);
+            document.querySelectorAll('[data-permission]').forEach(element => {
+                element.style.display = session.admin || granted.has(element.dataset.permission) ? '' : 'none';
+            });
+            this.showMaintenance(session);
+        } catch (error) {
+            console.error('Failed to load the session permissions:', error);
+        }
+    }
+
+    // Shows the maintenance banner of the session; administrators keep
+    // working while other users can only read
+    showMaintenance(session) {
+        const banner = document.getElementById('maintenance-banner');
+        if (!banner) return;
+        if (!session.maintenance) {
+            banner.hidden = true;
+            return;
+        }
+        let text = session.maintenance_message || 'The system is under maintenance: changes are disabled.';
+        if (session.maintenance_until) {
+            text += ` Expected back at ${new Date(session.maintenance_until).toLocaleString()}.`;
+        }
+        if (session.admin) {
+            text += ' Administrators can still make changes.';
+        }
+        banner.textContent = text;
+        banner.hidden = false;
     }
 
     setupNavigation() {
@@ -27,6 +68,17 @@ class GoodooDashboard {
                 this.switchSection(section);
             });
         });
+
+        window.addEventListener('hashchange', () => this.openHashSection());
+    }
+
+    // Deep links such as /dashboard#jobs?id=3 (admin search results) open
+    // their section
+    openHashSection() {
+        const section = window.location.hash.slice(1).split('?')[0];
+        if (section && document.getElementById(`${section}-section`)) {
+            this.switchSection(section);
+        }
     }
 
     switchSection(sectionName) {
@@ -69,6 +121,10 @@ class GoodooDashboard {
                 title: 'API Performance',
                 description: 'Track API metrics and performance indicators'
             },
+            'jobs': {
+                title: 'Scheduled Jobs',
+                description: 'Upcoming scheduled actions and recent runs'
+            },
             'logs': {
                 title: 'System Logs',
                 description: 'View and filter system logs and events'
@@ -157,9 +213,13 @@ class GoodooDashboard {
         this.showLoadingState(true);
         
         try {
+            // Fetch the startup data in one round trip
+            await this.prefetch(['/api/metrics/charts', '/api/activity/recent', '/api/sales/summary']);
+            
             // Load dashboard data with timeout and retry logic
             const promises = [
                 this.loadToolsOverview(),
+                this.loadSalesSummary(),
                 this.loadChartData(),
                 this.loadActivityFeed()
             ];
@@ -195,6 +255,43 @@ class GoodooDashboard {
         }
     }
 
+    // Fetch several GET endpoints with one /api/batch call; the loaders pick
+    // the results up through fetchCached and fall back to fetch on failure
+    async prefetch(paths) {
+        try {
+            const response = await fetch('/api/batch', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({
+                    requests: paths.map(path => ({ method: 'GET', path })),
+                    continue_on_error: true
+                })
+            });
+            if (!response.ok) {
+                return;
+            }
+            const data = await response.json();
+            (data.results || []).forEach((result, index) => {
+                this.prefetched.set(paths[index], result);
+            });
+        } catch (error) {
+            console.log('Batch prefetch unavailable, loading endpoints one by one');
+        }
+    }
+
+    // fetch, answered from the prefetched batch results when available
+    async fetchCached(url) {
+        const result = this.prefetched.get(url);
+        if (!result) {
+            return fetch(url);
+        }
+        this.prefetched.delete(url);
+        return new Response(JSON.stringify(result.body), {
+            status: result.status,
+            headers: { 'Content-Type': 'application/json' }
+        });
+    }
+
     showLoadingState(show) {
         const metrics = document.querySelectorAll('.metric-value');
         metrics.forEach(metric => {
@@ -226,8 +323,8 @@ class GoodooDashboard {
             }
             const data = await response.json();
             
-            // Calculate percentage changes (simulated)
-            const userChange = data.active_users > 0 ? '+' + (5 + data.active_users % 10) + '%' : '0%';
+            // Calculate percentage changes (simulated, except for users)
+            const userChange = `${data.active_users_24h || 0} today`;
             const requestChange = '+' + (10 + data.request_count % 15) + '%';
             const responseChange = '-' + (5 + data.avg_response_time % 8) + '%';
             
@@ -252,9 +349,26 @@ class GoodooDashboard {
     }
 
 
+    // chartURL returns the chart data URL for the selected time range; the
+    // default last 24 hours is the prefetched URL
+    chartURL() {
+        const select = document.getElementById('timeRange');
+        const ranges = {
+            '1h': [60 * 60 * 1000, 'minute'],
+            '7d': [7 * 24 * 60 * 60 * 1000, 'hour'],
+            '30d': [30 * 24 * 60 * 60 * 1000, 'day']
+        };
+        const range = select && ranges[select.value];
+        if (!range) {
+            return '/api/metrics/charts';
+        }
+        const from = new Date(Date.now() - range[0]).toISOString();
+        return `/api/metrics/charts?from=${encodeURIComponent(from)}&resolution=${range[1]}`;
+    }
+
     async loadChartData() {
         try {
-            const response = await fetch('/api/metrics/charts');
+            const response = await this.fetchCached(this.chartURL());
             const data = await response.json();
             
             if (this.charts.requests && data.requests) {
@@ -303,16 +417,16 @@ class GoodooDashboard {
 
     async loadActivityFeed() {
         try {
-            const response = await fetch('/api/activity/recent');
+            const response = await this.fetchCached('/api/activity/recent');
             const activities = await response.json();
             
             const activityFeed = document.getElementById('activity-feed');
             if (activityFeed && activities) {
                 activityFeed.innerHTML = activities.map(activity => `
-                    <div class="activity-item">
+                    <div class="activity-item" data-type="${this.escapeHtml(activity.type || '')}">
                         <span class="activity-time">${this.formatTime(activity.timestamp)}</span>
-                        <span class="activity-text">${activity.message}</span>
-                        <span class="activity-type ${activity.level.toLowerCase()}">${activity.level}</span>
+                        <span class="activity-text">${this.escapeHtml(activity.message)}</span>
+                        <span class="activity-type ${this.escapeHtml(activity.severity || activity.level.toLowerCase())}">${this.escapeHtml(activity.level)}</span>
                     </div>
                 `).join('');
             }
@@ -333,6 +447,9 @@ class GoodooDashboard {
             case 'api':
                 await this.loadAPIMetrics();
                 break;
+            case 'jobs':
+                await this.loadJobs();
+                break;
             case 'logs':
                 await this.loadLogs();
                 break;
@@ -393,6 +510,98 @@ class GoodooDashboard {
     }
 
 
+    async loadSalesSummary() {
+        try {
+            const response = await this.fetchCached('/api/sales/summary');
+            if (!response.ok) {
+                return;
+            }
+            const data = await response.json();
+            const money = (value) => Number(value || 0).toLocaleString(undefined, { minimumFractionDigits: 2, maximumFractionDigits: 2 });
+            const labels = { draft: 'Quotations', sent: 'Sent', sale: 'Sales Orders', done: 'Locked', cancel: 'Cancelled' };
+
+            const container = document.getElementById('sales-summary');
+            if (!container) {
+                return;
+            }
+            container.innerHTML = `
+                <div class="sales-stat">
+                    <span class="count-number">${money(data.revenue)}</span>
+                    <span class="count-label">Revenue</span>
+                </div>
+                ${(data.states || []).map(state => `
+                    <div class="sales-stat">
+                        <span class="count-number">${state.count}</span>
+                        <span class="count-label">${labels[state.state] || state.state} · ${money(state.amount_total)}</span>
+                    </div>
+                `).join('')}
+            `;
+        } catch (error) {
+            console.error('Error loading sales summary:', error);
+        }
+    }
+
+    async loadJobs() {
+        try {
+            const response = await fetch('/api/cron/overview');
+            if (!response.ok) {
+                return;
+            }
+            const data = await response.json();
+            const escape = (value) => String(value ?? '').replace(/[&<>"]/g, c => ({'&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;'}[c]));
+            const when = (value) => value && !value.startsWith('0001') ? this.formatDateTime(value) : '-';
+
+            const upcoming = data.upcoming || [];
+            if (upcoming.length) {
+                document.getElementById('jobs-upcoming').innerHTML = upcoming.map(job => `
+                    <tr>
+                        <td>${escape(job.name)}</td>
+                        <td><code>${escape(job.model ? job.model + '.' + job.function : job.function)}</code></td>
+                        <td>${escape(job.cron_expression || `every ${job.interval_number} ${job.interval_type}`)}</td>
+                        <td>${when(job.nextcall)}</td>
+                        <td>${when(job.lastcall)}</td>
+                        <td><button class="btn btn-secondary btn-sm" data-run-cron="${job.id}">Run now</button></td>
+                    </tr>
+                `).join('');
+                document.querySelectorAll('[data-run-cron]').forEach(button => {
+                    button.addEventListener('click', async () => {
+                        button.disabled = true;
+                        await fetch(`/api/cron/${button.dataset.runCron}/run`, { method: 'POST' });
+                        await this.loadJobs();
+                    });
+                });
+            }
+
+            const recent = data.recent || [];
+            if (recent.length) {
+                document.getElementById('jobs-recent').innerHTML = recent.map(run => `
+                    <tr>
+                        <td>${escape(run.name)}${run.manual ? ' (manual)' : ''}</td>
+                        <td>${when(run.started_at)}</td>
+                        <td>${run.duration_ms} ms</td>
+                        <td><span class="job-state ${escape(run.state)}">${escape(run.state)}</span></td>
+                        <td>${escape(run.error)}</td>
+                    </tr>
+                `).join('');
+            }
+
+            const internal = data.internal || [];
+            if (internal.length) {
+                document.getElementById('jobs-internal').innerHTML = internal.map(job => `
+                    <tr>
+                        <td>${escape(job.name)}</td>
+                        <td>${escape(job.interval)}</td>
+                        <td>${when(job.last_run)}</td>
+                        <td>${job.run_count}</td>
+                        <td>${escape(job.last_error)}</td>
+                    </tr>
+                `).join('');
+            }
+        } catch (error) {
+            console.error('Error loading jobs:', error);
+        }
+    }
+
     async loadLogs() {
         try {
             const response = await fetch('/api/logs/recent');
@@ -454,6 +663,21 @@ class GoodooDashboard {
             });
         }
 
+        // Buttons declare their handler in data-action, since the CSP forbids inline onclick
+        document.addEventListener('click', (e) => {
+            const target = e.target.closest('[data-action]');
+            if (!target || typeof this[target.dataset.action] !== 'function') {
+                return;
+            }
+            const args = [];
+            if (target.dataset.argNumber !== undefined) {
+                args.push(Number(target.dataset.argNumber));
+            } else if (target.dataset.arg !== undefined) {
+                args.push(target.dataset.arg);
+            }
+            this[target.dataset.action](...args);
+        });
+
         // LLM Tools toggle switches
         const toolToggles = document.querySelectorAll('.tool-toggle');
         toolToggles.forEach(toggle => {
@@ -1011,7 +1235,7 @@ class GoodooDashboard {
             indicator.innerHTML = `
                 <span class="offline-icon">⚠️</span>
                 <span class="offline-text">Working Offline</span>
-                <button class="retry-btn" onclick="dashboard.retryConnection()">Retry</button>
+                <button class="retry-btn" data-action="retryConnection">Retry</button>
             `;
             indicator.style.cssText = `
                 position: fixed;
@@ -1058,6 +1282,52 @@ class GoodooDashboard {
         }, 30000); // Check every 30 seconds
     }
 
+    // Presence heartbeat: tells the server this tab is open and whether the
+    // user interacted since the previous beat (otherwise they turn away)
+    startPresenceHeartbeat() {
+        this.userActive = true;
+        ['mousemove', 'keydown', 'click', 'scroll'].forEach(type => {
+            document.addEventListener(type, () => { this.userActive = true; }, { passive: true });
+        });
+
+        const beat = async () => {
+            const active = this.userActive;
+            this.userActive = false;
+            try {
+                await fetch('/api/user-chat/presence', {
+                    method: 'POST',
+                    headers: { 'Content-Type': 'application/json' },
+                    body: JSON.stringify({ is_online: true, active })
+                });
+            } catch (error) {
+                // The connection monitor reports network failures
+            }
+        };
+        beat();
+        setInterval(beat, 60000);
+
+        window.addEventListener('pagehide', () => {
+            const body = new Blob([JSON.stringify({ is_online: false })], { type: 'application/json' });
+            navigator.sendBeacon('/api/user-chat/presence', body);
+        });
+    }
+
+    // Notification badge: the server pushes the unread count over a
+    // server-sent event stream, which the browser reconnects by itself
+    startNotificationStream() {
+        const badge = document.getElementById('notificationCount');
+        if (!badge || !window.EventSource) {
+            return;
+        }
+        const source = new EventSource('/api/notifications/stream');
+        source.addEventListener('unread', (event) => {
+            const { unread } = JSON.parse(event.data);
+            badge.textContent = unread > 99 ? '99+' : String(unread);
+            badge.hidden = unread === 0;
+        });
+        window.addEventListener('pagehide', () => source.close());
+    }
+
     // Chat functionality
     async loadChatSection() {
         try {
@@ -1500,9 +1770,11 @@ class GoodooDashboard {
 
         roomsList.innerHTML = this.userChatRooms.map(room => `
             <div class="chat-room-item ${room.id === this.currentUserChatRoom?.id ? 'active' : ''}" 
-                 data-room-id="${room.id}" onclick="dashboard.selectChatRoom('${room.id}')">
+                 data-room-id="${room.id}" data-action="selectChatRoom" data-arg="${room.id}">
                 <div class="room-avatar">
-                    ${room.type === 'group' ? '👥' : '👤'}
+                    ${room.type === 'direct' && room.participants?.[0]?.avatar_url
+                        ? `<img class="avatar-img" src="${room.participants[0].avatar_url}" alt="">`
+                        : (room.type === 'group' ? '👥' : '👤')}
                 </div>
                 <div class="room-info">
                     <div class="room-name">${room.name}</div>
@@ -1550,15 +1822,17 @@ class GoodooDashboard {
         }
 
         usersList.innerHTML = this.onlineUsers.map(user => `
-            <div class="user-item" onclick="dashboard.startDirectChat(${user.user_id})">
+            <div class="user-item" data-action="startDirectChat" data-arg-number="${user.user_id}">
                 <div class="user-avatar-small">
-                    ${user.user_name.charAt(0).toUpperCase()}
+                    ${user.avatar_url
+                        ? `<img class="avatar-img" src="${user.avatar_url}" alt="">`
+                        : this.displayName(user).charAt(0).toUpperCase()}
                     ${user.is_online ? '<div class="online-indicator"></div>' : ''}
                 </div>
                 <div class="user-info-small">
-                    <div class="user-name-small">${user.user_name}</div>
+                    <div class="user-name-small">${this.escapeHtml(this.displayName(user))}</div>
                     <div class="user-status">
-                        ${user.is_online ? 'Online' : `Last seen ${this.formatRelativeTime(new Date(user.last_seen))}`}
+                        ${user.state === 'away' ? 'Away' : user.is_online ? 'Online' : `Last seen ${this.formatRelativeTime(new Date(user.last_seen))}`}
                     </div>
                 </div>
             </div>
@@ -1617,6 +1891,11 @@ class GoodooDashboard {
         }
     }
 
+    // displayName prefers the server-computed display name of a chat participant
+    displayName(user) {
+        return user.display_name || user.user_name || '';
+    }
+
     addUserMessageToChat(message) {
         const messagesContainer = document.getElementById('chat-messages');
         if (!messagesContainer) return;
@@ -1670,7 +1949,7 @@ class GoodooDashboard {
                 const user = this.onlineUsers.find(u => u.user_id === userId);
                 room = {
                     id: directRoomId,
-                    name: user.user_name,
+                    name: this.displayName(user),
                     type: 'direct',
                     participants: [user],
                     unread_count: 0,
@@ -1849,6 +2128,8 @@ document.addEventListener('DOMContentLoaded', () => {
     window.dashboard = new GoodooDashboard();
     // Start connection monitoring
     window.dashboard.startConnectionMonitoring();
+    window.dashboard.startPresenceHeartbeat();
+    window.dashboard.startNotificationStream();
 });
 
 // Handle page visibility changes
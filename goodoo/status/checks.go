@@ -0,0 +1,159 @@
+package status
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"runtime"
+	"time"
+
+	"goodoo/database"
+	"goodoo/httpclient"
+	"goodoo/models"
+	"goodoo/version"
+)
+
+// Thresholds of the built-in checks
+const (
+	// slowDatabase is the ping latency from which the database is degraded
+	slowDatabase = time.Second
+	// mailOverdue is how late a queued mail may be before the queue is
+	// degraded
+	mailOverdue = 10 * time.Minute
+)
+
+func init() {
+	Register(ComponentApp, "Application", checkApp)
+	Register(ComponentDatabase, "Database", checkDatabase)
+	Register(ComponentSessions, "Sessions", nil)
+	Register(ComponentLLM, "AI assistant", checkLLM)
+	Register(ComponentMail, "Email", checkMail)
+}
+
+// checkApp is operational as long as the server answers
+func checkApp(ctx context.Context, dbName string) (string, string) {
+	return Operational, fmt.Sprintf("version %s, %d goroutine(s)", version.Version, runtime.NumGoroutine())
+}
+
+// checkDatabase pings the database; it is down when unreachable or its
+// breaker is open, and degraded while slow or its warm-up failed
+func checkDatabase(ctx context.Context, dbName string) (string, string) {
+	for _, breaker := range database.BreakerStatuses() {
+		if breaker.Name == dbName && breaker.State == database.BreakerOpen {
+			return Down, "breaker open: " + breaker.Error
+		}
+	}
+	db, err := database.GetDatabase(dbName)
+	if err != nil {
+		return Down, err.Error()
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return Down, err.Error()
+	}
+	start := time.Now()
+	if err := sqlDB.PingContext(ctx); err != nil {
+		return Down, err.Error()
+	}
+	latency := time.Since(start)
+	if latency >= slowDatabase {
+		return Degraded, fmt.Sprintf("ping took %v", latency.Round(time.Millisecond))
+	}
+	for _, warmup := range database.WarmupStatuses() {
+		if warmup.Name == dbName && warmup.State == database.WarmupDegraded {
+			return Degraded, "warm-up degraded"
+		}
+	}
+	return Operational, fmt.Sprintf("ping took %v", latency.Round(time.Millisecond))
+}
+
+// checkLLM follows the circuits of the hosts of the active providers: it
+// is down when all of them are open and degraded when some are not
+// closed. Without an active provider there is nothing to be down.
+func checkLLM(ctx context.Context, dbName string) (string, string) {
+	db, err := database.GetDatabase(dbName)
+	if err != nil {
+		return Down, err.Error()
+	}
+	catalog, err := models.LoadLLMCatalog(db.WithContext(ctx), dbName)
+	if err != nil {
+		return Down, err.Error()
+	}
+	circuits := make(map[string]httpclient.HostStats)
+	for _, stats := range httpclient.Stats() {
+		circuits[stats.Host] = stats
+	}
+
+	hosts, open, troubled := 0, 0, 0
+	detail := ""
+	for _, provider := range catalog.Providers {
+		if !provider.Active || provider.APIBase == "" {
+			continue
+		}
+		base, err := url.Parse(provider.APIBase)
+		if err != nil || base.Host == "" {
+			continue
+		}
+		hosts++
+		stats, called := circuits[base.Host]
+		if !called {
+			continue
+		}
+		switch stats.State {
+		case httpclient.StateOpen:
+			open++
+			troubled++
+		case httpclient.StateHalfOpen:
+			troubled++
+		default:
+			continue
+		}
+		detail += fmt.Sprintf("%s: circuit %s (%s); ", base.Host, stats.State, stats.LastError)
+	}
+	switch {
+	case hosts == 0:
+		return Operational, "no active provider"
+	case open == hosts:
+		return Down, detail
+	case troubled > 0:
+		return Degraded, detail
+	}
+	return Operational, fmt.Sprintf("%d provider host(s)", hosts)
+}
+
+// checkMail watches the outgoing queue: it is down when mails failed in
+// the last hour and none was sent, and degraded when mails failed or wait
+// longer than mailOverdue
+func checkMail(ctx context.Context, dbName string) (string, string) {
+	db, err := database.GetDatabase(dbName)
+	if err != nil {
+		return Down, err.Error()
+	}
+	db = db.WithContext(ctx)
+	now := time.Now()
+	hourAgo := now.Add(-time.Hour)
+
+	var overdue, failed, sent int64
+	err = db.Model(&models.MailMessage{}).
+		Where("state = ? AND next_attempt < ?", models.MailStateOutgoing, now.Add(-mailOverdue)).Count(&overdue).Error
+	if err == nil {
+		err = db.Model(&models.MailMessage{}).
+			Where("state = ? AND write_date >= ?", models.MailStateFailed, hourAgo).Count(&failed).Error
+	}
+	if err == nil {
+		err = db.Model(&models.MailMessage{}).
+			Where("state = ? AND sent_at >= ?", models.MailStateSent, hourAgo).Count(&sent).Error
+	}
+	if err != nil {
+		return Down, err.Error()
+	}
+
+	detail := fmt.Sprintf("%d overdue, %d failed and %d sent in the last hour", overdue, failed, sent)
+	switch {
+	case failed > 0 && sent == 0:
+		return Down, detail
+	case failed > 0 || overdue > 0:
+		return Degraded, detail
+	}
+	return Operational, detail
+}
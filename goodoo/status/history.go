@@ -0,0 +1,196 @@
+package status
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"goodoo/database"
+	"goodoo/models"
+	"goodoo/scheduler"
+	"gorm.io/gorm"
+)
+
+// HistoryDays is the length of the uptime history, today included
+const HistoryDays = 90
+
+// Day returns the UTC midnight starting the day of t
+func Day(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// DayUptime is the uptime of a component over a UTC day
+type DayUptime struct {
+	Date string `json:"date"`
+	// Uptime is the percentage of the samples the component was not down,
+	// nil for a day without samples
+	Uptime *float64 `json:"uptime"`
+	// State is the worst state sampled that day, empty without samples
+	State string `json:"state,omitempty"`
+}
+
+// ComponentHistory is the daily uptime of a component, oldest day first
+type ComponentHistory struct {
+	Component string `json:"component"`
+	// Uptime is the percentage over the days with samples, nil without
+	Uptime *float64    `json:"uptime"`
+	Days   []DayUptime `json:"days"`
+}
+
+// percentage returns part of total as a percentage rounded to two
+// decimals, nil when total is 0
+func percentage(part, total int) *float64 {
+	if total == 0 {
+		return nil
+	}
+	value := math.Round(float64(part)*10000/float64(total)) / 100
+	return &value
+}
+
+// Aggregate computes the uptime of components over the days days ending
+// with the UTC day of now, from their daily counts. Counts are attributed
+// to the UTC day they start, whatever the zone they are read in; those
+// outside the window are ignored.
+func Aggregate(rows []models.StatusDaily, components []string, now time.Time, days int) []ComponentHistory {
+	last := Day(now)
+	first := last.AddDate(0, 0, -(days - 1))
+	counts := make(map[string]map[string]models.StatusDaily, len(components))
+	for _, row := range rows {
+		day := Day(row.Day)
+		if day.Before(first) || day.After(last) {
+			continue
+		}
+		if counts[row.Component] == nil {
+			counts[row.Component] = make(map[string]models.StatusDaily)
+		}
+		date := day.Format(time.DateOnly)
+		total := counts[row.Component][date]
+		total.Samples += row.Samples
+		total.Operational += row.Operational
+		total.Degraded += row.Degraded
+		total.Down += row.Down
+		counts[row.Component][date] = total
+	}
+
+	histories := make([]ComponentHistory, len(components))
+	for i, component := range components {
+		history := ComponentHistory{Component: component, Days: make([]DayUptime, 0, days)}
+		samples, up := 0, 0
+		for day := first; !day.After(last); day = day.AddDate(0, 0, 1) {
+			date := day.Format(time.DateOnly)
+			count := counts[component][date]
+			uptime := DayUptime{Date: date, Uptime: percentage(count.Samples-count.Down, count.Samples)}
+			switch {
+			case count.Down > 0:
+				uptime.State = Down
+			case count.Degraded > 0:
+				uptime.State = Degraded
+			case count.Samples > 0:
+				uptime.State = Operational
+			}
+			history.Days = append(history.Days, uptime)
+			samples += count.Samples
+			up += count.Samples - count.Down
+		}
+		history.Uptime = percentage(up, samples)
+		histories[i] = history
+	}
+	return histories
+}
+
+// Components returns the names of the components probed
+func Components() []string {
+	list := registered()
+	names := make([]string, len(list))
+	for i, c := range list {
+		names[i] = c.name
+	}
+	return names
+}
+
+// History returns the uptime of the components of a database over the
+// HistoryDays days ending with the day of now
+func History(db *gorm.DB, now time.Time) ([]ComponentHistory, error) {
+	rows, err := models.StatusDays(db, Day(now).AddDate(0, 0, -(HistoryDays-1)))
+	if err != nil {
+		return nil, err
+	}
+	return Aggregate(rows, Components(), now, HistoryDays), nil
+}
+
+// pending are the samples not stored yet, by database then day and
+// component: those taken while the database is down are stored once it
+// is back, so that the downtime shows in the history
+var (
+	pending      = make(map[string]map[string]*models.StatusDaily)
+	pendingMutex sync.Mutex
+)
+
+// count adds the public state of a probe to the pending counts of a day
+func count(dbName string, day time.Time, probe Probe) {
+	if pending[dbName] == nil {
+		pending[dbName] = make(map[string]*models.StatusDaily)
+	}
+	key := day.Format(time.DateOnly) + "/" + probe.Component
+	row, ok := pending[dbName][key]
+	if !ok {
+		row = &models.StatusDaily{Day: day, Component: probe.Component}
+		pending[dbName][key] = row
+	}
+	row.Samples++
+	switch PublicState(probe.State) {
+	case Operational:
+		row.Operational++
+	case Degraded:
+		row.Degraded++
+	default:
+		row.Down++
+	}
+}
+
+// Sample probes the components of a database at now, caches the result
+// and counts it in the history of the day. Counts that cannot be stored
+// are kept for the next sample.
+func Sample(ctx context.Context, db *gorm.DB, dbName string, now time.Time) ([]Probe, error) {
+	probes := Run(ctx, dbName, now)
+	remember(dbName, probes, now)
+
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+	for _, probe := range probes {
+		count(dbName, Day(now), probe)
+	}
+	rows := make([]models.StatusDaily, 0, len(pending[dbName]))
+	for _, row := range pending[dbName] {
+		rows = append(rows, *row)
+	}
+	if err := models.AddStatusCounts(db, rows); err != nil {
+		return probes, err
+	}
+	delete(pending, dbName)
+	return probes, nil
+}
+
+// Schedule registers the jobs sampling the components of a database every
+// interval and pruning the days older than the history
+func Schedule(s *scheduler.Scheduler, dbName string, interval time.Duration) {
+	s.Every("status.sample."+dbName, interval, func(ctx context.Context) error {
+		db, err := database.GetDatabase(dbName)
+		if err != nil {
+			return err
+		}
+		_, err = Sample(ctx, db.WithContext(ctx), dbName, s.Clock().Now())
+		return err
+	})
+	s.Every("status.prune."+dbName, time.Hour, func(ctx context.Context) error {
+		db, err := database.GetDatabase(dbName)
+		if err != nil {
+			return err
+		}
+		before := Day(s.Clock().Now()).AddDate(0, 0, -(HistoryDays - 1))
+		_, err = models.PruneStatusDays(db.WithContext(ctx), before)
+		return err
+	})
+}
@@ -0,0 +1,234 @@
+// Package status tells whether goodoo is up, component by component, for
+// a status page anyone may read. Probes check the application, the
+// database, the session store, the LLM providers and the mail queue.
+// Their raw output (errors, hosts, versions) is for administrators only:
+// the public view maps each probe to a generic state. A scheduler job
+// samples the probes and counts the results per UTC day, from which the
+// daily uptime of the last 90 days is computed.
+package status
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"goodoo/logging"
+)
+
+var logger = logging.GetLogger("goodoo.status")
+
+// Components of the status page
+const (
+	ComponentApp      = "app"
+	ComponentDatabase = "database"
+	ComponentSessions = "sessions"
+	ComponentLLM      = "llm"
+	ComponentMail     = "mail"
+)
+
+// States of a component, from the best to the worst
+const (
+	Operational = "operational"
+	Degraded    = "degraded"
+	Down        = "down"
+)
+
+// probeTimeout bounds each probe
+const probeTimeout = 5 * time.Second
+
+// CacheTTL is how long probe results are reused, so that the status page
+// cannot be used to load the database
+const CacheTTL = 30 * time.Second
+
+// Probe is the raw result of the check of a component, for administrators
+type Probe struct {
+	Component string `json:"component"`
+	State     string `json:"state"`
+	// Detail is the raw output of the check, such as an error message
+	Detail    string    `json:"detail,omitempty"`
+	LatencyMs int64     `json:"latency_ms"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// Check probes a component of a database, returning its state and a
+// detail for administrators
+type Check func(ctx context.Context, dbName string) (state, detail string)
+
+// component is a registered check and its public name
+type component struct {
+	name  string
+	label string
+	check Check
+}
+
+var (
+	components []component
+	mutex      sync.Mutex
+)
+
+// Register adds or replaces the check of a component, shown under label
+// on the status page; components are listed in registration order
+func Register(name, label string, check Check) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	for i := range components {
+		if components[i].name == name {
+			components[i] = component{name: name, label: label, check: check}
+			return
+		}
+	}
+	components = append(components, component{name: name, label: label, check: check})
+}
+
+// registered returns the registered components; those registered without
+// a check yet, such as the sessions before the server sets its store up,
+// are left out
+func registered() []component {
+	mutex.Lock()
+	defer mutex.Unlock()
+	list := make([]component, 0, len(components))
+	for _, c := range components {
+		if c.check != nil {
+			list = append(list, c)
+		}
+	}
+	return list
+}
+
+// Label returns the public name of a component
+func Label(name string) string {
+	for _, c := range registered() {
+		if c.name == name {
+			return c.label
+		}
+	}
+	return name
+}
+
+// Run probes every component of a database at now
+func Run(ctx context.Context, dbName string, now time.Time) []Probe {
+	list := registered()
+	probes := make([]Probe, len(list))
+	var wg sync.WaitGroup
+	for i, c := range list {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			probes[i] = probe(ctx, dbName, c, now)
+		}()
+	}
+	wg.Wait()
+	return probes
+}
+
+// probe runs a check; a panic counts as down and an operational check
+// that timed out as degraded
+func probe(ctx context.Context, dbName string, c component, now time.Time) (result Probe) {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	start := time.Now()
+	result = Probe{Component: c.name, CheckedAt: now}
+	defer func() {
+		if value := recover(); value != nil {
+			result.State, result.Detail = Down, fmt.Sprintf("check panicked: %v", value)
+		}
+		result.LatencyMs = time.Since(start).Milliseconds()
+		if result.State != Operational {
+			logger.Warning("Status of %s in %s is %s: %s", c.name, dbName, result.State, result.Detail)
+		}
+	}()
+	result.State, result.Detail = c.check(ctx, dbName)
+	if ctx.Err() != nil && result.State == Operational {
+		result.State, result.Detail = Degraded, "check timed out"
+	}
+	return result
+}
+
+// ComponentStatus is the public state of a component: no detail, and a
+// state that is always one of Operational, Degraded or Down
+type ComponentStatus struct {
+	Component string `json:"component"`
+	Name      string `json:"name"`
+	State     string `json:"state"`
+}
+
+// PublicState maps the state of a probe to a public state; anything but
+// operational or degraded, including an empty or unknown state, is down
+func PublicState(state string) string {
+	switch state {
+	case Operational, Degraded:
+		return state
+	default:
+		return Down
+	}
+}
+
+// Redact returns the public view of probes, dropping their detail
+func Redact(probes []Probe) []ComponentStatus {
+	statuses := make([]ComponentStatus, len(probes))
+	for i, probe := range probes {
+		statuses[i] = ComponentStatus{Component: probe.Component, Name: Label(probe.Component), State: PublicState(probe.State)}
+	}
+	return statuses
+}
+
+// Overall returns the worst public state of components, operational when
+// there are none
+func Overall(statuses []ComponentStatus) string {
+	overall := Operational
+	for _, status := range statuses {
+		switch PublicState(status.State) {
+		case Down:
+			return Down
+		case Degraded:
+			overall = Degraded
+		}
+	}
+	return overall
+}
+
+// cached are the latest probes of a database
+type cached struct {
+	mutex  sync.Mutex
+	probes []Probe
+	at     time.Time
+}
+
+var (
+	cache      = make(map[string]*cached)
+	cacheMutex sync.Mutex
+)
+
+// entry returns the cache entry of a database
+func entry(dbName string) *cached {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+	e, ok := cache[dbName]
+	if !ok {
+		e = &cached{}
+		cache[dbName] = e
+	}
+	return e
+}
+
+// Current returns the probes of a database, run again when older than
+// CacheTTL at now; concurrent callers wait for one run, which a caller
+// going away does not cancel
+func Current(ctx context.Context, dbName string, now time.Time) []Probe {
+	e := entry(dbName)
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.probes == nil || now.Sub(e.at) >= CacheTTL || now.Before(e.at) {
+		e.probes, e.at = Run(context.WithoutCancel(ctx), dbName, now), now
+	}
+	return append([]Probe(nil), e.probes...)
+}
+
+// remember caches probes run at now
+func remember(dbName string, probes []Probe, now time.Time) {
+	e := entry(dbName)
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.probes, e.at = append([]Probe(nil), probes...), now
+}
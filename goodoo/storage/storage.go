@@ -0,0 +1,416 @@
+// Package storage keeps the directories goodoo writes to within bounds:
+// the session files, its temporary files and the automatic backups. A
+// scheduled housekeeping run deletes the expired temporary files, evicts
+// sessions beyond the file cap, measures each area and warns the
+// administrators when an area nears its quota.
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"goodoo/database"
+	"goodoo/logging"
+	"goodoo/models"
+	"goodoo/notification"
+	"goodoo/scheduler"
+)
+
+// Storage areas
+const (
+	AreaSessions = "sessions"
+	AreaTemp     = "temp"
+	AreaBackups  = "backups"
+)
+
+// TempPrefix starts the names of the temporary files of goodoo, so the
+// shared temporary directory is measured and cleaned for them only
+const TempPrefix = "goodoo-"
+
+// Thresholds are the percentages of a quota whose crossing is reported
+var Thresholds = []int{80, 95}
+
+// Config holds the quotas and retention of the storage areas
+type Config struct {
+	// SessionQuota, TempQuota and BackupQuota bound the bytes of each area,
+	// 0 for no quota; an area over quota is reported, not emptied
+	SessionQuota int64
+	TempQuota    int64
+	BackupQuota  int64
+	// SessionMaxFiles caps the session files, 0 for no cap
+	SessionMaxFiles int
+	// TempTTL is the age after which temporary files are deleted
+	TempTTL time.Duration
+	// RescanAfter is how long the measure of an unchanged directory is
+	// reused; files rewritten in place do not change their directory
+	RescanAfter time.Duration
+}
+
+// DefaultConfig returns quotas of 512 MB for sessions, 2 GB for temporary
+// files and 20 GB for backups, a cap of 100000 session files, and
+// temporary files kept for a day
+func DefaultConfig() *Config {
+	return &Config{
+		SessionQuota:    512 << 20,
+		TempQuota:       2 << 30,
+		BackupQuota:     20 << 30,
+		SessionMaxFiles: 100000,
+		TempTTL:         24 * time.Hour,
+		RescanAfter:     15 * time.Minute,
+	}
+}
+
+// LoadFromEnv overrides the configuration with GOODOO_STORAGE_* variables;
+// quotas are in bytes
+func (c *Config) LoadFromEnv() {
+	for name, quota := range map[string]*int64{
+		"GOODOO_STORAGE_SESSION_QUOTA": &c.SessionQuota,
+		"GOODOO_STORAGE_TEMP_QUOTA":    &c.TempQuota,
+		"GOODOO_STORAGE_BACKUP_QUOTA":  &c.BackupQuota,
+	} {
+		if value := os.Getenv(name); value != "" {
+			if size, err := strconv.ParseInt(value, 10, 64); err == nil && size >= 0 {
+				*quota = size
+			}
+		}
+	}
+	if value := os.Getenv("GOODOO_STORAGE_SESSION_MAX_FILES"); value != "" {
+		if count, err := strconv.Atoi(value); err == nil && count >= 0 {
+			c.SessionMaxFiles = count
+		}
+	}
+	if value := os.Getenv("GOODOO_STORAGE_TEMP_TTL"); value != "" {
+		if ttl, err := time.ParseDuration(value); err == nil && ttl > 0 {
+			c.TempTTL = ttl
+		}
+	}
+}
+
+// SessionEvictor is the session store, evicting the least recently used
+// sessions beyond a cap (see http.FilesystemSessionStore)
+type SessionEvictor interface {
+	Path() string
+	EvictSessions(maxFiles int, idleTimeout time.Duration) (int, error)
+}
+
+// CleanupResult is the outcome of the last cleanup of an area
+type CleanupResult struct {
+	At         time.Time `json:"at"`
+	Deleted    int       `json:"deleted"`
+	FreedBytes int64     `json:"freed_bytes"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// AreaReport is the usage of an area
+type AreaReport struct {
+	Name  string `json:"name"`
+	Path  string `json:"path"`
+	Files int    `json:"files"`
+	Bytes int64  `json:"bytes"`
+	// Quota is 0 without quota; Percent is the share of it used
+	Quota       int64          `json:"quota"`
+	Percent     float64        `json:"percent"`
+	MeasuredAt  time.Time      `json:"measured_at"`
+	LastCleanup *CleanupResult `json:"last_cleanup,omitempty"`
+	Error       string         `json:"error,omitempty"`
+}
+
+// Crossing is an area whose usage rose past a threshold
+type Crossing struct {
+	Area      AreaReport
+	Threshold int
+}
+
+// area is a measured directory
+type area struct {
+	name string
+	path string
+	// prefix restricts the area to the top-level entries named with it
+	prefix string
+	quota  int64
+}
+
+var (
+	config   = DefaultConfig()
+	sessions SessionEvictor
+	areas    []area
+	reports  = make(map[string]*AreaReport)
+	// levels is the highest threshold each area reached at its last measure
+	levels = make(map[string]int)
+	cache  = newUsageCache()
+	mutex  sync.Mutex
+	logger = logging.GetLogger("goodoo.storage")
+)
+
+// Setup installs the configuration and the areas: the directory of the
+// session store, the temporary files and the backup directory
+func Setup(c *Config, store SessionEvictor, backupDir string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	config = c
+	sessions = store
+	areas = []area{
+		{name: AreaSessions, path: store.Path(), quota: c.SessionQuota},
+		{name: AreaTemp, path: os.TempDir(), prefix: TempPrefix, quota: c.TempQuota},
+		{name: AreaBackups, path: backupDir, quota: c.BackupQuota},
+	}
+}
+
+// CurrentConfig returns the storage configuration
+func CurrentConfig() *Config {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return config
+}
+
+// Housekeep deletes the expired temporary files, evicts the sessions beyond
+// the cap, sparing the authenticated sessions used within idleTimeout, then
+// measures every area. It returns the areas that crossed a threshold since
+// the previous run. Files deleted meanwhile by requests are skipped.
+func Housekeep(idleTimeout time.Duration) []Crossing {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	var crossings []Crossing
+	for _, a := range areas {
+		var cleanup *CleanupResult
+		switch a.name {
+		case AreaTemp:
+			cleanup = deleteExpired(a, config.TempTTL)
+		case AreaSessions:
+			if config.SessionMaxFiles > 0 {
+				cleanup = &CleanupResult{At: time.Now()}
+				deleted, err := sessions.EvictSessions(config.SessionMaxFiles, idleTimeout)
+				cleanup.Deleted = deleted
+				if err != nil {
+					cleanup.Error = err.Error()
+				}
+			}
+		}
+		if cleanup != nil && cleanup.Error != "" {
+			logger.Error("Failed to clean up storage area %s: %s", a.name, cleanup.Error)
+		} else if cleanup != nil && cleanup.Deleted > 0 {
+			logger.Info("Deleted %d file(s) of storage area %s", cleanup.Deleted, a.name)
+		}
+
+		report := measureArea(a)
+		if cleanup != nil {
+			report.LastCleanup = cleanup
+		} else if previous, ok := reports[a.name]; ok {
+			report.LastCleanup = previous.LastCleanup
+		}
+		reports[a.name] = report
+
+		level := 0
+		for _, threshold := range Thresholds {
+			if a.quota > 0 && report.Percent >= float64(threshold) {
+				level = threshold
+			}
+		}
+		if level > levels[a.name] {
+			crossings = append(crossings, Crossing{Area: *report, Threshold: level})
+		}
+		levels[a.name] = level
+	}
+	return crossings
+}
+
+// Report returns the usage of every area, measured by the last
+// housekeeping run, or now for the areas not measured yet
+func Report() []AreaReport {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	result := make([]AreaReport, 0, len(areas))
+	for _, a := range areas {
+		report, ok := reports[a.name]
+		if !ok {
+			report = measureArea(a)
+			reports[a.name] = report
+		}
+		result = append(result, *report)
+	}
+	return result
+}
+
+// measureArea measures the files of an area
+func measureArea(a area) *AreaReport {
+	report := &AreaReport{Name: a.name, Path: a.path, Quota: a.quota, MeasuredAt: time.Now()}
+	files, bytes, err := cache.measure(a.path, a.prefix, config.RescanAfter)
+	report.Files, report.Bytes = files, bytes
+	if err != nil {
+		report.Error = err.Error()
+	}
+	if a.quota > 0 {
+		report.Percent = float64(bytes) * 100 / float64(a.quota)
+	}
+	return report
+}
+
+// deleteExpired deletes the top-level entries of an area older than ttl
+func deleteExpired(a area, ttl time.Duration) *CleanupResult {
+	result := &CleanupResult{At: time.Now()}
+	entries, err := os.ReadDir(a.path)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	cutoff := time.Now().Add(-ttl)
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), a.prefix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		path := filepath.Join(a.path, entry.Name())
+		size := info.Size()
+		if entry.IsDir() {
+			_, size, _ = cache.measure(path, "", 0)
+		}
+		if err := os.RemoveAll(path); err != nil {
+			result.Error = err.Error()
+			continue
+		}
+		result.Deleted++
+		result.FreedBytes += size
+	}
+	return result
+}
+
+// usageCache keeps the measure of each directory, reused while its
+// modification time is unchanged
+type usageCache struct {
+	dirs map[string]*dirUsage
+}
+
+// dirUsage is the measure of the files directly in a directory
+type dirUsage struct {
+	modTime time.Time
+	scanned time.Time
+	files   int
+	bytes   int64
+	subdirs []string
+}
+
+func newUsageCache() *usageCache {
+	return &usageCache{dirs: make(map[string]*dirUsage)}
+}
+
+// measure returns the files and bytes of dir and its subdirectories; with
+// a prefix, only the top-level entries named with it count. A directory
+// whose modification time is unchanged and which was scanned within
+// rescanAfter is not read again.
+func (c *usageCache) measure(dir, prefix string, rescanAfter time.Duration) (int, int64, error) {
+	info, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		delete(c.dirs, dir+"\x00"+prefix)
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	key := dir + "\x00" + prefix
+	usage, ok := c.dirs[key]
+	if !ok || !usage.modTime.Equal(info.ModTime()) || time.Since(usage.scanned) >= rescanAfter {
+		usage, err = scanDir(dir, prefix, info.ModTime())
+		if err != nil {
+			return 0, 0, err
+		}
+		c.dirs[key] = usage
+	}
+
+	files, bytes := usage.files, usage.bytes
+	for _, subdir := range usage.subdirs {
+		subFiles, subBytes, err := c.measure(subdir, "", rescanAfter)
+		if err != nil {
+			return files, bytes, err
+		}
+		files += subFiles
+		bytes += subBytes
+	}
+	return files, bytes, nil
+}
+
+// scanDir reads the entries of a directory
+func scanDir(dir, prefix string, modTime time.Time) (*dirUsage, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	usage := &dirUsage{modTime: modTime, scanned: time.Now()}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), prefix) {
+			continue
+		}
+		if entry.IsDir() {
+			usage.subdirs = append(usage.subdirs, filepath.Join(dir, entry.Name()))
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// Deleted since the directory was read
+			continue
+		}
+		usage.files++
+		usage.bytes += info.Size()
+	}
+	return usage, nil
+}
+
+// Schedule registers the housekeeping job of a database every interval.
+// Sessions idle for less than the session timeout of the database are
+// kept; threshold crossings are recorded in its activity feed and notified
+// to its administrators.
+func Schedule(s *scheduler.Scheduler, dbName string, interval time.Duration) {
+	s.Every("storage.housekeeping."+dbName, interval, func(ctx context.Context) error {
+		idleTimeout := time.Duration(models.GetParamInt(dbName, models.ParamSessionTimeout, 1440)) * time.Minute
+		crossings := Housekeep(idleTimeout)
+		if len(crossings) == 0 {
+			return nil
+		}
+		db, err := database.GetDatabase(dbName)
+		if err != nil {
+			return err
+		}
+		admins, err := models.AdminUserIDs(db.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		for _, crossing := range crossings {
+			report := crossing.Area
+			logger.Warning("Storage area %s uses %.0f%% of its quota (%d of %d bytes)", report.Name, report.Percent, report.Bytes, report.Quota)
+
+			severity, kind := models.SeverityWarning, models.NotificationWarning
+			if crossing.Threshold >= Thresholds[len(Thresholds)-1] {
+				severity, kind = models.SeverityError, models.NotificationError
+			}
+			params := map[string]interface{}{
+				"area":      report.Name,
+				"percent":   int(report.Percent),
+				"threshold": crossing.Threshold,
+				"bytes":     report.Bytes,
+				"quota":     report.Quota,
+				"files":     report.Files,
+			}
+			activity := models.Activity{Type: models.ActivityStorageQuota, Severity: severity, Params: params}
+			if err := models.LogActivity(db.WithContext(ctx), 0, activity); err != nil {
+				logger.Error("Failed to record the storage usage of %s: %v", report.Name, err)
+			}
+			title := fmt.Sprintf("Storage area %s is %d%% full", report.Name, int(report.Percent))
+			body := fmt.Sprintf("%s uses %d of %d bytes (%d files).", report.Path, report.Bytes, report.Quota, report.Files)
+			for _, uid := range admins {
+				notification.Notify(dbName, uid, models.NotificationCategoryStorage, kind, title, body, params)
+			}
+		}
+		return nil
+	})
+}
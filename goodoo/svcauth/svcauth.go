@@ -0,0 +1,252 @@
+// Package svcauth signs and verifies service-to-service HTTP requests with
+// a shared secret, so that services can call each other's APIs without
+// static keys in headers. A signature covers the method, the path with its
+// query, a unix timestamp, a unique nonce and the SHA-256 of the body; the
+// key id header names the secret. It only depends on the standard library
+// so that other Go services can import it:
+//
+//	signer := &svcauth.Signer{KeyID: "billing", Secret: secret}
+//	client := &http.Client{Transport: signer.Transport(nil)}
+//
+// Verifying services check the signature with Verify and reject replayed
+// nonces with a NonceCache.
+package svcauth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers of signed requests
+const (
+	KeyIDHeader     = "X-Goodoo-Key-Id"
+	TimestampHeader = "X-Goodoo-Timestamp"
+	NonceHeader     = "X-Goodoo-Nonce"
+	// SignatureHeader carries "sha256=<hex HMAC of the string to sign>"
+	SignatureHeader = "X-Goodoo-Signature"
+)
+
+// DefaultWindow is how far the timestamp of a request may be from the
+// clock of the verifier
+const DefaultWindow = 5 * time.Minute
+
+// Errors returned by Verify and NonceCache.Claim
+var (
+	ErrUnsigned     = errors.New("request is not signed")
+	ErrBadSignature = errors.New("invalid request signature")
+	ErrStale        = errors.New("request timestamp outside the allowed window")
+	ErrReplayed     = errors.New("request nonce already used")
+)
+
+// BodyHash returns the hex SHA-256 of a body
+func BodyHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// StringToSign returns the canonical form of a request: method, path with
+// query, timestamp, nonce and body hash, one per line
+func StringToSign(method, uri, timestamp, nonce string, body []byte) string {
+	return strings.Join([]string{strings.ToUpper(method), uri, timestamp, nonce, BodyHash(body)}, "\n")
+}
+
+// Signature returns the signature of a request with a secret
+func Signature(secret, method, uri, timestamp, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(StringToSign(method, uri, timestamp, nonce, body)))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// requestURI returns the path and query of a request as the client sent
+// them: servers keep the original request target in RequestURI, which
+// stays valid when a middleware rewrites the URL
+func requestURI(req *http.Request) string {
+	if strings.HasPrefix(req.RequestURI, "/") {
+		return req.RequestURI
+	}
+	if req.RequestURI != "" {
+		if target, err := url.ParseRequestURI(req.RequestURI); err == nil {
+			return target.RequestURI()
+		}
+	}
+	return req.URL.RequestURI()
+}
+
+// newNonce returns a random nonce
+func newNonce() (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(nonce), nil
+}
+
+// readBody returns the body of an outgoing request and leaves it readable
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		defer body.Close()
+		return io.ReadAll(body)
+	}
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	return body, nil
+}
+
+// Signer signs outgoing requests with a key
+type Signer struct {
+	KeyID  string
+	Secret string
+	// Now returns the signing time, time.Now when nil
+	Now func() time.Time
+}
+
+// Sign sets the signature headers of a request. The body is read and
+// restored, so Sign must run once the body is final.
+func (s *Signer) Sign(req *http.Request) error {
+	if s.KeyID == "" || s.Secret == "" {
+		return errors.New("svcauth: signer needs a key id and a secret")
+	}
+	body, err := readBody(req)
+	if err != nil {
+		return fmt.Errorf("svcauth: failed to read body: %w", err)
+	}
+	nonce, err := newNonce()
+	if err != nil {
+		return fmt.Errorf("svcauth: failed to generate nonce: %w", err)
+	}
+	now := time.Now
+	if s.Now != nil {
+		now = s.Now
+	}
+	timestamp := strconv.FormatInt(now().Unix(), 10)
+	req.Header.Set(KeyIDHeader, s.KeyID)
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(NonceHeader, nonce)
+	req.Header.Set(SignatureHeader, Signature(s.Secret, req.Method, req.URL.RequestURI(), timestamp, nonce, body))
+	return nil
+}
+
+// transport signs the requests it sends
+type transport struct {
+	signer *Signer
+	base   http.RoundTripper
+}
+
+// RoundTrip signs a copy of the request and sends it
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	signed := req.Clone(req.Context())
+	if err := t.signer.Sign(signed); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	return t.base.RoundTrip(signed)
+}
+
+// Transport returns a transport signing every request before sending it
+// with base, http.DefaultTransport when nil
+func (s *Signer) Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &transport{signer: s, base: base}
+}
+
+// Verify checks the signature of a request received with body against the
+// secrets of its key, any of which may match while a rotated secret is
+// still accepted, and that its timestamp is within window of now. It does
+// not check the nonce, see NonceCache.
+func Verify(req *http.Request, body []byte, secrets []string, now time.Time, window time.Duration) error {
+	timestamp := req.Header.Get(TimestampHeader)
+	nonce := req.Header.Get(NonceHeader)
+	signature := req.Header.Get(SignatureHeader)
+	if req.Header.Get(KeyIDHeader) == "" || timestamp == "" || nonce == "" || signature == "" {
+		return ErrUnsigned
+	}
+
+	valid := false
+	for _, secret := range secrets {
+		if secret == "" {
+			continue
+		}
+		expected := Signature(secret, req.Method, requestURI(req), timestamp, nonce, body)
+		if hmac.Equal([]byte(signature), []byte(expected)) {
+			valid = true
+		}
+	}
+	if !valid {
+		return ErrBadSignature
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrStale
+	}
+	if skew := now.Sub(time.Unix(seconds, 0)); skew > window || skew < -window {
+		return ErrStale
+	}
+	return nil
+}
+
+// NonceCache remembers the nonces of verified requests to reject replays.
+// A nonce is kept for twice the timestamp window, after which the request
+// is stale anyway.
+type NonceCache struct {
+	ttl       time.Duration
+	mutex     sync.Mutex
+	seen      map[string]time.Time
+	nextSweep time.Time
+}
+
+// NewNonceCache creates a cache for a timestamp window
+func NewNonceCache(window time.Duration) *NonceCache {
+	return &NonceCache{ttl: 2 * window, seen: make(map[string]time.Time)}
+}
+
+// Claim records the nonce of a key and returns ErrReplayed if it was
+// already used
+func (c *NonceCache) Claim(keyID, nonce string, now time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if now.After(c.nextSweep) {
+		for key, expiry := range c.seen {
+			if now.After(expiry) {
+				delete(c.seen, key)
+			}
+		}
+		c.nextSweep = now.Add(time.Second)
+	}
+	key := keyID + "/" + nonce
+	if expiry, used := c.seen[key]; used && !now.After(expiry) {
+		return ErrReplayed
+	}
+	c.seen[key] = now.Add(c.ttl)
+	return nil
+}
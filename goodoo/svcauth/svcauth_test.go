@@ -0,0 +1,170 @@
+package svcauth_test
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"goodoo/svcauth"
+)
+
+var signedAt = time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+
+// signedRequest returns a request signed with secret at signedAt, as a
+// server receives it
+func signedRequest(t *testing.T, secret, method, target, body string) *http.Request {
+	t.Helper()
+	signer := &svcauth.Signer{KeyID: "billing", Secret: secret, Now: func() time.Time { return signedAt }}
+	out := httptest.NewRequest(method, target, strings.NewReader(body))
+	if err := signer.Sign(out); err != nil {
+		t.Fatal(err)
+	}
+	in := httptest.NewRequest(method, target, strings.NewReader(body))
+	in.Header = out.Header.Clone()
+	return in
+}
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name    string
+		secrets []string
+		now     time.Time
+		// tamper changes the received request and body
+		tamper func(r *http.Request, body string) (*http.Request, string)
+		want   error
+	}{
+		{name: "valid", secrets: []string{"s3cret"}, now: signedAt},
+		{name: "clock ahead within the window", secrets: []string{"s3cret"}, now: signedAt.Add(svcauth.DefaultWindow)},
+		{name: "clock behind within the window", secrets: []string{"s3cret"}, now: signedAt.Add(-svcauth.DefaultWindow)},
+		{name: "stale", secrets: []string{"s3cret"}, now: signedAt.Add(svcauth.DefaultWindow + time.Second), want: svcauth.ErrStale},
+		{name: "from the future", secrets: []string{"s3cret"}, now: signedAt.Add(-svcauth.DefaultWindow - time.Second), want: svcauth.ErrStale},
+		{name: "body tampered", secrets: []string{"s3cret"}, now: signedAt, want: svcauth.ErrBadSignature,
+			tamper: func(r *http.Request, body string) (*http.Request, string) {
+				return r, strings.Replace(body, "100", "900", 1)
+			}},
+		{name: "path tampered", secrets: []string{"s3cret"}, now: signedAt, want: svcauth.ErrBadSignature,
+			tamper: func(r *http.Request, body string) (*http.Request, string) {
+				tampered := httptest.NewRequest(r.Method, "/api/records/res.partner/2", strings.NewReader(body))
+				tampered.Header = r.Header
+				return tampered, body
+			}},
+		{name: "query tampered", secrets: []string{"s3cret"}, now: signedAt, want: svcauth.ErrBadSignature,
+			tamper: func(r *http.Request, body string) (*http.Request, string) {
+				tampered := httptest.NewRequest(r.Method, "/api/records/res.partner/1?sudo=1", strings.NewReader(body))
+				tampered.Header = r.Header
+				return tampered, body
+			}},
+		{name: "method tampered", secrets: []string{"s3cret"}, now: signedAt, want: svcauth.ErrBadSignature,
+			tamper: func(r *http.Request, body string) (*http.Request, string) {
+				r.Method = http.MethodDelete
+				return r, body
+			}},
+		{name: "timestamp moved", secrets: []string{"s3cret"}, now: signedAt.Add(time.Hour), want: svcauth.ErrBadSignature,
+			tamper: func(r *http.Request, body string) (*http.Request, string) {
+				r.Header.Set(svcauth.TimestampHeader, "1791980400")
+				return r, body
+			}},
+		{name: "nonce changed", secrets: []string{"s3cret"}, now: signedAt, want: svcauth.ErrBadSignature,
+			tamper: func(r *http.Request, body string) (*http.Request, string) {
+				r.Header.Set(svcauth.NonceHeader, "another")
+				return r, body
+			}},
+		{name: "unsigned", secrets: []string{"s3cret"}, now: signedAt, want: svcauth.ErrUnsigned,
+			tamper: func(r *http.Request, body string) (*http.Request, string) {
+				r.Header.Del(svcauth.SignatureHeader)
+				return r, body
+			}},
+		{name: "wrong secret", secrets: []string{"other"}, now: signedAt, want: svcauth.ErrBadSignature},
+		// During a rotation the previous secret is accepted along the new one
+		{name: "rotation signed with the previous secret", secrets: []string{"n3w", "s3cret"}, now: signedAt},
+		{name: "rotation over", secrets: []string{"n3w"}, now: signedAt, want: svcauth.ErrBadSignature},
+		{name: "empty secrets are skipped", secrets: []string{"", "n3w"}, now: signedAt, want: svcauth.ErrBadSignature},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `{"amount": 100}`
+			r := signedRequest(t, "s3cret", http.MethodPost, "/api/records/res.partner/1", body)
+			if tt.tamper != nil {
+				r, body = tt.tamper(r, body)
+			}
+			if err := svcauth.Verify(r, []byte(body), tt.secrets, tt.now, svcauth.DefaultWindow); !errors.Is(err, tt.want) {
+				t.Errorf("Verify = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// TestVerifyRewrittenURL verifies the path the client sent, even once a
+// middleware rewrote the URL
+func TestVerifyRewrittenURL(t *testing.T) {
+	r := signedRequest(t, "s3cret", http.MethodGet, "/v1/api/models?limit=5", "")
+	r.URL.Path = "/api/models"
+	if err := svcauth.Verify(r, nil, []string{"s3cret"}, signedAt, svcauth.DefaultWindow); err != nil {
+		t.Errorf("Verify = %v", err)
+	}
+}
+
+// TestTransport signs the requests of a client, keeping their body for
+// the server
+func TestTransport(t *testing.T) {
+	var verified error
+	var received string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = string(body)
+		verified = svcauth.Verify(r, body, []string{"s3cret"}, time.Now(), svcauth.DefaultWindow)
+	}))
+	defer server.Close()
+
+	signer := &svcauth.Signer{KeyID: "billing", Secret: "s3cret"}
+	client := &http.Client{Transport: signer.Transport(nil)}
+	request, err := http.NewRequest(http.MethodPost, server.URL+"/api/call?context=1", strings.NewReader(`{"method": "read"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if verified != nil || received != `{"method": "read"}` {
+		t.Errorf("server received %q, verified: %v", received, verified)
+	}
+	if request.Header.Get(svcauth.SignatureHeader) != "" {
+		t.Error("the transport signed the request of the caller instead of a copy")
+	}
+
+	unsigned := &http.Client{Transport: (&svcauth.Signer{KeyID: "billing"}).Transport(nil)}
+	if _, err := unsigned.Get(server.URL); err == nil {
+		t.Error("a signer without secret sent the request")
+	}
+}
+
+func TestNonceCache(t *testing.T) {
+	cache := svcauth.NewNonceCache(svcauth.DefaultWindow)
+	steps := []struct {
+		name   string
+		keyID  string
+		nonce  string
+		offset time.Duration
+		want   error
+	}{
+		{"first use", "billing", "n1", 0, nil},
+		{"replay", "billing", "n1", time.Second, svcauth.ErrReplayed},
+		{"replay at the end of the window", "billing", "n1", 2 * svcauth.DefaultWindow, svcauth.ErrReplayed},
+		{"same nonce of another key", "crm", "n1", time.Second, nil},
+		{"another nonce", "billing", "n2", time.Second, nil},
+		// By then a request signed with the nonce is stale
+		{"forgotten after twice the window", "billing", "n1", 2*svcauth.DefaultWindow + time.Second, nil},
+		{"replay once claimed again", "billing", "n1", 2*svcauth.DefaultWindow + 2*time.Second, svcauth.ErrReplayed},
+	}
+	for _, step := range steps {
+		if err := cache.Claim(step.keyID, step.nonce, signedAt.Add(step.offset)); !errors.Is(err, step.want) {
+			t.Errorf("%s: Claim = %v, want %v", step.name, err, step.want)
+		}
+	}
+}
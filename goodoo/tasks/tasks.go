@@ -0,0 +1,617 @@
+// Package tasks runs the work handlers do after responding, such as
+// titling a chat session, in the background. Submit detaches a sanitized
+// copy of the request context: the request ID, database, user and
+// language are kept, its deadline and cancellation are not. Tasks run on
+// a bounded set of workers, at most Definition.Concurrency at once per
+// name, and a panic is reported to the crash pipeline and fails the run.
+// Runs are kept in memory for an hour; those of durable tasks are stored
+// as TaskRun rows too, so that a restart resumes or reports them.
+// Shutdown waits for the running tasks.
+package tasks
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"goodoo/crash"
+	"goodoo/database"
+	"goodoo/logging"
+	"goodoo/models"
+	"gorm.io/gorm"
+)
+
+var logger = logging.GetLogger("goodoo.tasks")
+
+// Retention is how long finished runs stay in memory
+const Retention = time.Hour
+
+// retryBackoff is the delay before the first retry of a failed run,
+// doubled for each next one
+const retryBackoff = time.Second
+
+// storeTimeout bounds the writes of a TaskRun row
+const storeTimeout = 5 * time.Second
+
+// propagatedKeys are the request context values Detach keeps
+var propagatedKeys = []string{"request_id", "dbname", "user_id", "impersonator_id", "service_key_id", "lang"}
+
+var (
+	// ErrDuplicate is returned with the pending or running run of the
+	// same name and key
+	ErrDuplicate = errors.New("task already pending or running")
+	// ErrShutdown is returned once Shutdown started
+	ErrShutdown = errors.New("tasks are shutting down")
+)
+
+// Config holds the limits of the task workers
+type Config struct {
+	// Workers bounds the tasks running at once, whatever their name
+	Workers int
+	// ShutdownWait is how long Shutdown waits for the running tasks
+	// before cancelling them
+	ShutdownWait time.Duration
+}
+
+// DefaultConfig returns 16 workers and a 10 second shutdown wait
+func DefaultConfig() *Config {
+	return &Config{Workers: 16, ShutdownWait: 10 * time.Second}
+}
+
+// LoadFromEnv overrides the configuration with GOODOO_TASK_WORKERS
+func (c *Config) LoadFromEnv() {
+	if value := os.Getenv("GOODOO_TASK_WORKERS"); value != "" {
+		if workers, err := strconv.Atoi(value); err == nil && workers > 0 {
+			c.Workers = workers
+		}
+	}
+}
+
+// Func is the work of a task; it should return when ctx is cancelled
+type Func func(ctx context.Context) error
+
+// Definition configures the tasks of a name
+type Definition struct {
+	// Concurrency bounds the tasks of the name running at once; 0 leaves
+	// them to the limit of the workers
+	Concurrency int
+	// Durable stores the runs as TaskRun rows
+	Durable bool
+	// Retries is how many times a failed run is tried again, with an
+	// exponential backoff; a panic is never retried
+	Retries int
+	// Resume runs a durable task a restart interrupted again, with its
+	// payload; without it the run is marked lost
+	Resume func(ctx context.Context, payload json.RawMessage) error
+}
+
+// Status describes a run
+type Status struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Key       string `json:"key,omitempty"`
+	DBName    string `json:"db"`
+	UserID    int    `json:"user_id"`
+	RequestID string `json:"request_id,omitempty"`
+	State     string `json:"state"`
+	Durable   bool   `json:"durable"`
+	// RunID is the TaskRun row of a durable run
+	RunID    uint   `json:"run_id,omitempty"`
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error,omitempty"`
+
+	SubmitDate time.Time  `json:"submit_date"`
+	StartDate  *time.Time `json:"start_date,omitempty"`
+	FinishDate *time.Time `json:"finish_date,omitempty"`
+}
+
+// Run is a submitted task
+type Run struct {
+	mutex    sync.Mutex
+	status   Status
+	ctx      context.Context
+	fn       Func
+	finished chan struct{}
+}
+
+// panicError is the failure of a run that panicked
+type panicError struct {
+	value interface{}
+}
+
+func (e *panicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.value)
+}
+
+var (
+	mutex       sync.Mutex
+	config      = DefaultConfig()
+	definitions = make(map[string]Definition)
+	runs        = make(map[string]*Run)
+	// keyed are the pending and running runs by "name/key"
+	keyed = make(map[string]*Run)
+	// workers and nameSlots are semaphores: a run holds a slot of its
+	// name, then one of the workers
+	workers   = make(chan struct{}, config.Workers)
+	nameSlots = make(map[string]chan struct{})
+	// root is cancelled when Shutdown gives up waiting
+	root, cancelRoot = context.WithCancel(context.Background())
+	closed           bool
+	running          sync.WaitGroup
+)
+
+// Setup installs the process-wide configuration; call it before the
+// first task is submitted
+func Setup(c *Config) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	config = c
+	workers = make(chan struct{}, max(c.Workers, 1))
+}
+
+// Define configures the tasks of a name, typically from an init function
+func Define(name string, definition Definition) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	definitions[name] = definition
+	delete(nameSlots, name)
+}
+
+// Detach returns a context carrying the request values of ctx that a
+// background task needs, without its deadline and cancellation
+func Detach(ctx context.Context) context.Context {
+	detached := context.Background()
+	for _, key := range propagatedKeys {
+		if value := ctx.Value(key); value != nil {
+			detached = context.WithValue(detached, key, value)
+		}
+	}
+	return detached
+}
+
+// DBName returns the database of a request context
+func DBName(ctx context.Context) string {
+	dbName, _ := ctx.Value("dbname").(string)
+	return dbName
+}
+
+// UserID returns the user of a request context
+func UserID(ctx context.Context) int {
+	uid, _ := ctx.Value("user_id").(int)
+	return uid
+}
+
+// Lang returns the language of a request context
+func Lang(ctx context.Context) string {
+	lang, _ := ctx.Value("lang").(string)
+	return lang
+}
+
+// RequestID returns the request ID of a request context
+func RequestID(ctx context.Context) string {
+	requestID, _ := ctx.Value("request_id").(string)
+	return requestID
+}
+
+// newID returns a random run ID
+func newID() string {
+	buffer := make([]byte, 12)
+	if _, err := rand.Read(buffer); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(buffer)
+}
+
+// Submit runs fn in the background as a task of name, with a detached
+// copy of ctx. payload is the input of the task, stored with the runs of
+// durable tasks.
+func Submit(ctx context.Context, name string, payload interface{}, fn Func) (*Run, error) {
+	return SubmitKeyed(ctx, name, "", payload, fn)
+}
+
+// SubmitKeyed is Submit deduplicated by key: while a run of the same name
+// and key is pending or running, it is returned with ErrDuplicate and fn
+// is dropped
+func SubmitKeyed(ctx context.Context, name, key string, payload interface{}, fn Func) (*Run, error) {
+	return submit(Detach(ctx), name, key, payload, 0, fn)
+}
+
+// submit registers a run and starts it; rowID is the TaskRun row of a
+// resumed run
+func submit(ctx context.Context, name, key string, payload interface{}, rowID uint, fn Func) (*Run, error) {
+	now := time.Now()
+	mutex.Lock()
+	if closed {
+		mutex.Unlock()
+		return nil, ErrShutdown
+	}
+	prune(now)
+	if key != "" {
+		if existing, ok := keyed[name+"/"+key]; ok {
+			mutex.Unlock()
+			return existing, ErrDuplicate
+		}
+	}
+	definition := definitions[name]
+	run := &Run{
+		status: Status{
+			ID:         newID(),
+			Name:       name,
+			Key:        key,
+			DBName:     DBName(ctx),
+			UserID:     UserID(ctx),
+			RequestID:  RequestID(ctx),
+			State:      models.TaskPending,
+			Durable:    definition.Durable,
+			RunID:      rowID,
+			SubmitDate: now,
+		},
+		ctx:      ctx,
+		fn:       fn,
+		finished: make(chan struct{}),
+	}
+	runs[run.status.ID] = run
+	if key != "" {
+		keyed[name+"/"+key] = run
+	}
+	slot := nameSlot(name, definition.Concurrency)
+	pool, stop := workers, root
+	running.Add(1)
+	mutex.Unlock()
+
+	if definition.Durable && rowID == 0 {
+		run.insert(payload)
+	}
+	go run.execute(definition, slot, pool, stop)
+	return run, nil
+}
+
+// nameSlot returns the semaphore of a name, nil when it is unbounded; the
+// caller holds mutex
+func nameSlot(name string, concurrency int) chan struct{} {
+	if concurrency <= 0 {
+		return nil
+	}
+	slot, ok := nameSlots[name]
+	if !ok {
+		slot = make(chan struct{}, concurrency)
+		nameSlots[name] = slot
+	}
+	return slot
+}
+
+// prune forgets the runs finished before the retention; the caller holds
+// mutex
+func prune(now time.Time) {
+	for id, run := range runs {
+		status := run.Status()
+		if status.FinishDate != nil && now.Sub(*status.FinishDate) > Retention {
+			delete(runs, id)
+		}
+	}
+}
+
+// execute waits for a slot of the name and of the workers, then tries
+// the run until it succeeds, panics or exhausts its retries
+func (r *Run) execute(definition Definition, slot, pool chan struct{}, stop context.Context) {
+	defer running.Done()
+	defer close(r.finished)
+
+	if slot != nil {
+		select {
+		case slot <- struct{}{}:
+			defer func() { <-slot }()
+		case <-stop.Done():
+			r.finish(stop.Err(), true)
+			return
+		}
+	}
+	select {
+	case pool <- struct{}{}:
+		defer func() { <-pool }()
+	case <-stop.Done():
+		r.finish(stop.Err(), true)
+		return
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := r.attempt(stop)
+		var panicked *panicError
+		if err == nil || errors.As(err, &panicked) || attempt >= definition.Retries || stop.Err() != nil {
+			r.finish(err, stop.Err() != nil)
+			return
+		}
+		logger.WarningCtx(r.ctx, "Task %s (%s) failed, retrying: %v", r.status.Name, r.status.ID, err)
+		select {
+		case <-time.After(retryBackoff << attempt):
+		case <-stop.Done():
+			r.finish(err, true)
+			return
+		}
+	}
+}
+
+// attempt runs the task once; its context is cancelled when stop is
+func (r *Run) attempt(stop context.Context) (err error) {
+	ctx, cancel := context.WithCancel(r.ctx)
+	defer cancel()
+	defer context.AfterFunc(stop, cancel)()
+
+	r.start()
+	defer func() {
+		if value := recover(); value != nil {
+			crash.RecordPanic(ctx, r.status.DBName, "task:"+r.status.Name, value)
+			err = &panicError{value: value}
+		}
+	}()
+	return r.fn(ctx)
+}
+
+// start records the start of an attempt
+func (r *Run) start() {
+	r.mutex.Lock()
+	now := time.Now()
+	r.status.State = models.TaskRunning
+	r.status.StartDate = &now
+	r.status.Attempts++
+	status := r.status
+	r.mutex.Unlock()
+
+	r.update(status, map[string]interface{}{
+		"state":      models.TaskRunning,
+		"start_date": now,
+		"retries":    status.Attempts - 1,
+	})
+}
+
+// finish records the outcome of the run. A run interrupted by the
+// shutdown keeps its TaskRun row running, for the next start to resume
+// or report it.
+func (r *Run) finish(err error, interrupted bool) {
+	r.mutex.Lock()
+	now := time.Now()
+	r.status.FinishDate = &now
+	r.status.State = models.TaskDone
+	switch {
+	case interrupted:
+		r.status.State = models.TaskLost
+		r.status.Error = "interrupted by the shutdown"
+		if err != nil && !errors.Is(err, context.Canceled) {
+			r.status.Error += ": " + err.Error()
+		}
+	case err != nil:
+		r.status.State = models.TaskFailed
+		r.status.Error = err.Error()
+	}
+	status := r.status
+	r.mutex.Unlock()
+
+	mutex.Lock()
+	if status.Key != "" && keyed[status.Name+"/"+status.Key] == r {
+		delete(keyed, status.Name+"/"+status.Key)
+	}
+	mutex.Unlock()
+
+	switch status.State {
+	case models.TaskLost:
+		logger.WarningCtx(r.ctx, "Task %s (%s) %s", status.Name, status.ID, status.Error)
+		return
+	case models.TaskFailed:
+		logger.ErrorCtx(r.ctx, "Task %s (%s) failed after %d attempt(s): %s", status.Name, status.ID, status.Attempts, status.Error)
+	}
+	r.update(status, map[string]interface{}{
+		"state":       status.State,
+		"error":       status.Error,
+		"finish_date": now,
+	})
+}
+
+// store returns the database of a durable run, nil for the others
+func (r *Run) store(status Status) (*gorm.DB, context.CancelFunc) {
+	if !status.Durable || status.DBName == "" {
+		return nil, nil
+	}
+	db, err := database.GetDatabase(status.DBName)
+	if err != nil {
+		logger.WarningCtx(r.ctx, "Failed to store task %s (%s): %v", status.Name, status.ID, err)
+		return nil, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	return db.WithContext(ctx), cancel
+}
+
+// insert stores the TaskRun row of a durable run
+func (r *Run) insert(payload interface{}) {
+	status := r.Status()
+	if status.Durable && status.DBName == "" {
+		logger.WarningCtx(r.ctx, "Durable task %s (%s) submitted without a database is not stored", status.Name, status.ID)
+		return
+	}
+	db, cancel := r.store(status)
+	if db == nil {
+		return
+	}
+	defer cancel()
+	row := models.TaskRun{
+		Name:      status.Name,
+		Key:       status.Key,
+		State:     models.TaskPending,
+		RequestID: status.RequestID,
+		UserID:    uint(status.UserID),
+	}
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			logger.WarningCtx(r.ctx, "Failed to encode the payload of task %s (%s): %v", status.Name, status.ID, err)
+		} else {
+			encoded := string(data)
+			row.Payload = &encoded
+		}
+	}
+	if err := db.Create(&row).Error; err != nil {
+		logger.WarningCtx(r.ctx, "Failed to store task %s (%s): %v", status.Name, status.ID, err)
+		return
+	}
+	r.mutex.Lock()
+	r.status.RunID = row.ID
+	r.mutex.Unlock()
+}
+
+// update writes values to the TaskRun row of a durable run
+func (r *Run) update(status Status, values map[string]interface{}) {
+	if status.RunID == 0 {
+		return
+	}
+	db, cancel := r.store(status)
+	if db == nil {
+		return
+	}
+	defer cancel()
+	if err := db.Model(&models.TaskRun{}).Where("id = ?", status.RunID).Updates(values).Error; err != nil {
+		logger.WarningCtx(r.ctx, "Failed to update task %s (%s): %v", status.Name, status.ID, err)
+	}
+}
+
+// Status returns a copy of the state of the run
+func (r *Run) Status() Status {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.status
+}
+
+// Wait blocks until the run finishes and returns its error
+func (r *Run) Wait() error {
+	<-r.finished
+	status := r.Status()
+	if status.Error != "" {
+		return errors.New(status.Error)
+	}
+	return nil
+}
+
+// Get returns a run by ID
+func Get(id string) (*Run, bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	run, ok := runs[id]
+	return run, ok
+}
+
+// List returns the runs of a database kept in memory, the latest first,
+// at most limit of them when positive
+func List(dbName string, limit int) []Status {
+	mutex.Lock()
+	list := make([]Status, 0, len(runs))
+	for _, run := range runs {
+		if status := run.Status(); status.DBName == dbName {
+			list = append(list, status)
+		}
+	}
+	mutex.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].SubmitDate.After(list[j].SubmitDate) })
+	if limit > 0 && len(list) > limit {
+		list = list[:limit]
+	}
+	return list
+}
+
+// Recover handles the durable runs of a database a restart interrupted:
+// those of a task with Resume are submitted again, the others are marked
+// lost. Call it once the tasks are defined.
+func Recover(dbName string, db *gorm.DB) (resumed, lost int, err error) {
+	interrupted, err := models.InterruptedTaskRuns(db)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, row := range interrupted {
+		mutex.Lock()
+		definition, ok := definitions[row.Name]
+		mutex.Unlock()
+
+		if ok && definition.Resume != nil {
+			payload := json.RawMessage("null")
+			if row.Payload != nil {
+				payload = json.RawMessage(*row.Payload)
+			}
+			ctx := context.WithValue(context.Background(), "dbname", dbName)
+			ctx = context.WithValue(ctx, "user_id", int(row.UserID))
+			if row.RequestID != "" {
+				ctx = context.WithValue(ctx, "request_id", row.RequestID)
+			}
+			resume := definition.Resume
+			_, err := submit(ctx, row.Name, row.Key, nil, row.ID, func(ctx context.Context) error {
+				return resume(ctx, payload)
+			})
+			if err == nil || errors.Is(err, ErrDuplicate) {
+				logger.Info("Resumed task %s (run %d) of %s", row.Name, row.ID, dbName)
+				resumed++
+				continue
+			}
+		}
+
+		now := time.Now()
+		err := db.Model(&models.TaskRun{}).Where("id = ?", row.ID).Updates(map[string]interface{}{
+			"state":       models.TaskLost,
+			"error":       "interrupted by a restart",
+			"finish_date": now,
+		}).Error
+		if err != nil {
+			return resumed, lost, err
+		}
+		logger.Warning("Task %s (run %d) of %s was interrupted by a restart and is lost", row.Name, row.ID, dbName)
+		lost++
+	}
+	return resumed, lost, nil
+}
+
+// Shutdown stops accepting tasks and waits for the submitted ones, up to
+// Config.ShutdownWait or until ctx is done; the tasks still running are
+// then cancelled. It fails when some were interrupted.
+func Shutdown(ctx context.Context) error {
+	mutex.Lock()
+	closed = true
+	wait := config.ShutdownWait
+	cancel := cancelRoot
+	mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		running.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+	}
+	interrupted := 0
+	mutex.Lock()
+	for _, run := range runs {
+		if state := run.Status().State; state != models.TaskDone && state != models.TaskFailed {
+			interrupted++
+		}
+	}
+	mutex.Unlock()
+	if interrupted > 0 {
+		return fmt.Errorf("%d task(s) interrupted by the shutdown", interrupted)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package templates
+
+import (
+	"strconv"
+	"time"
+
+	"goodoo/locale"
+)
+
+// FormatMonetary formats an amount with thousands separators, two decimals
+// and the currency symbol (like Odoo's monetary widget), in the default
+// language; templates use locale for the reader's language
+func FormatMonetary(amount float64, currency string) string {
+	return locale.Get(locale.DefaultLang).FormatMonetary(amount, currency)
+}
+
+// FormatDate formats a date as YYYY-MM-DD, or with the given layout
+func FormatDate(t time.Time, layout ...string) string {
+	if t.IsZero() {
+		return ""
+	}
+	if len(layout) > 0 {
+		return t.Format(layout[0])
+	}
+	return t.Format("2006-01-02")
+}
+
+// FormatPercent formats a percentage with two decimals, or returns "" for
+// nil, as the uptimes of the status page
+func FormatPercent(value *float64) string {
+	if value == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*value, 'f', 2, 64) + "%"
+}
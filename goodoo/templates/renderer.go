@@ -5,6 +5,8 @@ import (
 	"io"
 
 	"github.com/labstack/echo/v4"
+	"goodoo/locale"
+	"goodoo/tracing"
 )
 
 type TemplateRenderer struct {
@@ -12,14 +14,59 @@ type TemplateRenderer struct {
 }
 
 func NewTemplateRenderer() *TemplateRenderer {
-	// Load all HTML templates
-	templates := template.Must(template.ParseGlob("templates/*.html"))
-	
+	return NewTemplateRendererWithFuncs(nil)
+}
+
+// NewTemplateRendererWithFuncs loads all templates with extra functions such as asset()
+func NewTemplateRendererWithFuncs(funcs template.FuncMap) *TemplateRenderer {
+	funcMap := baseFuncs()
+	for name, fn := range funcs {
+		funcMap[name] = fn
+	}
+
 	return &TemplateRenderer{
-		templates: templates,
+		templates: template.Must(parse(funcMap)),
+	}
+}
+
+// baseFuncs returns the functions every template can use
+func baseFuncs() template.FuncMap {
+	// asset() falls back to the plain URL when no static handler provides one
+	return template.FuncMap{
+		"asset":      func(name string) string { return name },
+		"monetary":   FormatMonetary,
+		"formatDate": FormatDate,
+		"percent":    FormatPercent,
+		// locale returns the conventions of a language, e.g.
+		// {{ (locale .Lang).FormatNumber .Amount 2 }}
+		"locale": locale.Get,
 	}
 }
 
+// parse loads all HTML templates, including printable report and mail templates
+func parse(funcMap template.FuncMap) (*template.Template, error) {
+	templates := template.New("").Funcs(funcMap)
+	for _, pattern := range []string{"templates/*.html", "templates/reports/*.html", "templates/mail/*.html"} {
+		var err error
+		if templates, err = templates.ParseGlob(pattern); err != nil {
+			return nil, err
+		}
+	}
+	return templates, nil
+}
+
+// Validate parses the templates, reporting the first syntax error or
+// missing template directory instead of panicking like the renderer
+func Validate() error {
+	_, err := parse(baseFuncs())
+	return err
+}
+
 func (t *TemplateRenderer) Render(w io.Writer, name string, data interface{}, c echo.Context) error {
+	if c != nil {
+		_, span := tracing.Start(c.Request().Context(), "template.render")
+		span.SetAttribute("template", name)
+		defer span.End()
+	}
 	return t.templates.ExecuteTemplate(w, name, data)
-}
\ No newline at end of file
+}
@@ -0,0 +1,218 @@
+package tlsserver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"goodoo/clock"
+	"goodoo/logging"
+)
+
+var logger = logging.GetLogger("goodoo.tls")
+
+// LoadCertificate reads the certificate files: the key must match the
+// certificate, and the intermediates of ChainFile are appended to the chain
+func (c *Config) LoadCertificate() (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate or key: %w", err)
+	}
+	if c.ChainFile != "" {
+		data, err := os.ReadFile(c.ChainFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the chain: %w", err)
+		}
+		for {
+			var block *pem.Block
+			if block, data = pem.Decode(data); block == nil {
+				break
+			}
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+				return nil, fmt.Errorf("invalid certificate in the chain: %w", err)
+			}
+			cert.Certificate = append(cert.Certificate, block.Bytes)
+		}
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, fmt.Errorf("invalid certificate: %w", err)
+		}
+	}
+	return &cert, nil
+}
+
+// Subject names a certificate by its DNS names, or its common name
+func Subject(leaf *x509.Certificate) string {
+	if len(leaf.DNSNames) > 0 {
+		return strings.Join(leaf.DNSNames, ", ")
+	}
+	return leaf.Subject.CommonName
+}
+
+// ExpiryWarnings describes the certificates of the configuration expired or
+// expiring within ExpiryWarning of now; the certificates of an ACME CA are
+// renewed automatically and not checked
+func (c *Config) ExpiryWarnings(now time.Time) []string {
+	if !c.Enabled() || c.ACME() {
+		return nil
+	}
+	cert, err := c.LoadCertificate()
+	if err != nil {
+		return nil
+	}
+	if warning := expiryWarning(cert.Leaf, now); warning != "" {
+		return []string{warning}
+	}
+	return nil
+}
+
+// expiryWarning describes a certificate expired or expiring within
+// ExpiryWarning, empty otherwise
+func expiryWarning(leaf *x509.Certificate, now time.Time) string {
+	left := leaf.NotAfter.Sub(now)
+	switch {
+	case left <= 0:
+		return fmt.Sprintf("certificate of %s expired on %s", Subject(leaf), leaf.NotAfter.Format(time.RFC3339))
+	case left <= ExpiryWarning:
+		return fmt.Sprintf("certificate of %s expires in %d day(s), on %s", Subject(leaf), daysLeft(leaf, now), leaf.NotAfter.Format(time.RFC3339))
+	}
+	return ""
+}
+
+// daysLeft counts the whole days before a certificate expires
+func daysLeft(leaf *x509.Certificate, now time.Time) int {
+	return int(leaf.NotAfter.Sub(now) / (24 * time.Hour))
+}
+
+// Certificates serves the certificate files, reloading them when they
+// change; a reload failing keeps the previous certificate
+type Certificates struct {
+	config *Config
+	clock  clock.Clock
+
+	mutex    sync.RWMutex
+	cert     *tls.Certificate
+	modTimes map[string]time.Time
+}
+
+// LoadCertificates reads the certificate files of c
+func LoadCertificates(c *Config, clk clock.Clock) (*Certificates, error) {
+	certs := &Certificates{config: c, clock: clock.OrReal(clk)}
+	if err := certs.Reload(); err != nil {
+		return nil, err
+	}
+	return certs, nil
+}
+
+// GetCertificate returns the current certificate, for tls.Config
+func (s *Certificates) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.cert, nil
+}
+
+// Leaf returns the parsed current certificate
+func (s *Certificates) Leaf() *x509.Certificate {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.cert.Leaf
+}
+
+// Reload reads the certificate files again
+func (s *Certificates) Reload() error {
+	modTimes := s.readModTimes()
+	cert, err := s.config.LoadCertificate()
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	s.cert, s.modTimes = cert, modTimes
+	s.mutex.Unlock()
+	return nil
+}
+
+// readModTimes returns the modification times of the certificate files,
+// zero for the missing ones
+func (s *Certificates) readModTimes() map[string]time.Time {
+	modTimes := make(map[string]time.Time)
+	for _, path := range []string{s.config.CertFile, s.config.KeyFile, s.config.ChainFile} {
+		if path == "" {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil {
+			modTimes[path] = info.ModTime()
+		} else {
+			modTimes[path] = time.Time{}
+		}
+	}
+	return modTimes
+}
+
+// changed reports whether a certificate file changed since the last reload
+func (s *Certificates) changed() bool {
+	modTimes := s.readModTimes()
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for path, modTime := range modTimes {
+		if !modTime.Equal(s.modTimes[path]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch reloads the certificate on SIGHUP, and when the files change every
+// ReloadInterval, until ctx is done
+func (s *Certificates) Watch(ctx context.Context) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	var poll <-chan time.Time
+	if s.config.ReloadInterval > 0 {
+		ticker := s.clock.NewTicker(s.config.ReloadInterval)
+		defer ticker.Stop()
+		poll = ticker.C()
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			s.reload("SIGHUP")
+		case <-poll:
+			if s.changed() {
+				s.reload("file change")
+			}
+		}
+	}
+}
+
+// reload reloads the certificate and logs the outcome
+func (s *Certificates) reload(reason string) {
+	if err := s.Reload(); err != nil {
+		logger.Error("Failed to reload the TLS certificate on %s, keeping the previous one: %v", reason, err)
+		// Not retried until the files change again
+		s.mutex.Lock()
+		s.modTimes = s.readModTimes()
+		s.mutex.Unlock()
+		return
+	}
+	leaf := s.Leaf()
+	logger.Info("Reloaded the TLS certificate of %s on %s, valid until %s", Subject(leaf), reason, leaf.NotAfter.Format(time.RFC3339))
+	if warning := expiryWarning(leaf, s.clock.Now()); warning != "" {
+		logger.Warning("TLS %s", warning)
+	}
+}
@@ -0,0 +1,183 @@
+// Package tlsserver serves goodoo over TLS without a reverse proxy: the
+// certificate comes from files, reloaded on SIGHUP or when they change, or
+// from an ACME CA such as Let's Encrypt; a plain-HTTP listener answers the
+// ACME challenges and redirects everything else to HTTPS.
+package tlsserver
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// ExpiryWarning is how long before its expiry a certificate is reported
+const ExpiryWarning = 14 * 24 * time.Hour
+
+// Config holds the TLS listener; it is disabled until a certificate or
+// ACME domains are set
+type Config struct {
+	// CertFile and KeyFile are the PEM certificate and key; CertFile may
+	// hold the intermediate certificates after the leaf
+	CertFile string
+	KeyFile  string
+	// ChainFile holds intermediate certificates appended to those of
+	// CertFile, for CAs delivering them separately
+	ChainFile string
+	// ReloadInterval is how often the files are checked for changes, 0 to
+	// reload them on SIGHUP only
+	ReloadInterval time.Duration
+
+	// ACMEDomains are the host names certificates are requested for, with
+	// HTTP-01 challenges; they replace the certificate files
+	ACMEDomains []string
+	ACMEEmail   string
+	// ACMECacheDir keeps the account key and the certificates across
+	// restarts
+	ACMECacheDir string
+	// ACMEDirectoryURL is the directory of the CA, Let's Encrypt when empty
+	ACMEDirectoryURL string
+
+	// HTTPPort is the port of the plain-HTTP listener redirecting to HTTPS
+	// and answering the ACME challenges, empty for none
+	HTTPPort string
+
+	// MinVersion is the oldest TLS version accepted
+	MinVersion uint16
+	// CipherSuites restricts the TLS 1.2 cipher suites, Go's defaults when
+	// empty; TLS 1.3 suites are not configurable
+	CipherSuites []uint16
+}
+
+// DefaultConfig returns TLS disabled, accepting TLS 1.2 and newer and
+// checking the certificate files every minute once set
+func DefaultConfig() *Config {
+	return &Config{
+		ReloadInterval: time.Minute,
+		ACMECacheDir:   "./acme",
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// tlsVersions are the values of GOODOO_TLS_MIN_VERSION
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// LoadFromEnv overrides the configuration with the GOODOO_TLS_* variables;
+// it fails on an unknown TLS version or cipher suite
+func (c *Config) LoadFromEnv() error {
+	files := map[string]*string{
+		"GOODOO_TLS_CERT_FILE":          &c.CertFile,
+		"GOODOO_TLS_KEY_FILE":           &c.KeyFile,
+		"GOODOO_TLS_CHAIN_FILE":         &c.ChainFile,
+		"GOODOO_TLS_ACME_EMAIL":         &c.ACMEEmail,
+		"GOODOO_TLS_ACME_CACHE_DIR":     &c.ACMECacheDir,
+		"GOODOO_TLS_ACME_DIRECTORY_URL": &c.ACMEDirectoryURL,
+		"GOODOO_TLS_HTTP_PORT":          &c.HTTPPort,
+	}
+	for name, target := range files {
+		if value := os.Getenv(name); value != "" {
+			*target = strings.TrimSpace(value)
+		}
+	}
+	if value := os.Getenv("GOODOO_TLS_RELOAD_INTERVAL"); value != "" {
+		if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+			c.ReloadInterval = d
+		}
+	}
+	if value := os.Getenv("GOODOO_TLS_ACME_DOMAINS"); value != "" {
+		c.ACMEDomains = nil
+		for _, domain := range strings.Split(value, ",") {
+			if domain = strings.TrimSpace(domain); domain != "" {
+				c.ACMEDomains = append(c.ACMEDomains, domain)
+			}
+		}
+	}
+	if value := os.Getenv("GOODOO_TLS_MIN_VERSION"); value != "" {
+		version, ok := tlsVersions[strings.TrimPrefix(strings.ToLower(strings.TrimSpace(value)), "tls")]
+		if !ok {
+			return fmt.Errorf("unknown TLS version %q, expected 1.0 to 1.3", value)
+		}
+		c.MinVersion = version
+	}
+	if value := os.Getenv("GOODOO_TLS_CIPHERS"); value != "" {
+		suites, err := ParseCipherSuites(value)
+		if err != nil {
+			return err
+		}
+		c.CipherSuites = suites
+	}
+	return nil
+}
+
+// ParseCipherSuites reads a comma-separated list of cipher suite names as
+// Go spells them, e.g. "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"; insecure
+// suites are refused
+func ParseCipherSuites(list string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+	insecure := make(map[string]bool)
+	for _, suite := range tls.InsecureCipherSuites() {
+		insecure[suite.Name] = true
+	}
+
+	var suites []uint16
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if insecure[name] {
+			return nil, fmt.Errorf("cipher suite %s is insecure", name)
+		}
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %s", name)
+		}
+		suites = append(suites, id)
+	}
+	return suites, nil
+}
+
+// Enabled reports whether the server serves TLS
+func (c *Config) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != "" || c.ACME()
+}
+
+// ACME reports whether the certificates come from an ACME CA
+func (c *Config) ACME() bool {
+	return len(c.ACMEDomains) > 0
+}
+
+// Validate checks the configuration is complete and, with certificate
+// files, that they parse and that the key matches the certificate
+func (c *Config) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	if c.ACME() {
+		if c.CertFile != "" || c.KeyFile != "" {
+			return errors.New("ACME domains and certificate files are exclusive")
+		}
+		if c.HTTPPort == "" {
+			return errors.New("ACME needs GOODOO_TLS_HTTP_PORT for the HTTP-01 challenges")
+		}
+		if c.ACMECacheDir == "" {
+			return errors.New("ACME needs a cache directory")
+		}
+		return nil
+	}
+	if c.CertFile == "" || c.KeyFile == "" {
+		return errors.New("both GOODOO_TLS_CERT_FILE and GOODOO_TLS_KEY_FILE are required")
+	}
+	_, err := c.LoadCertificate()
+	return err
+}
@@ -0,0 +1,211 @@
+package tlsserver
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"goodoo/clock"
+	"goodoo/database"
+	"goodoo/models"
+	"goodoo/notification"
+	"goodoo/scheduler"
+)
+
+// ShutdownTimeout is how long Start waits for the requests in progress
+// once its context is done
+const ShutdownTimeout = 10 * time.Second
+
+// Server serves an Echo instance over TLS with the certificate files or
+// the ACME CA of a configuration
+type Server struct {
+	config *Config
+	clock  clock.Clock
+	// certificates are the certificate files, nil with ACME
+	certificates *Certificates
+	// manager obtains and renews the ACME certificates, nil with files
+	manager *autocert.Manager
+}
+
+// New prepares the TLS server of c, reading its certificate files
+func New(c *Config, clk clock.Clock) (*Server, error) {
+	s := &Server{config: c, clock: clock.OrReal(clk)}
+	if c.ACME() {
+		s.manager = &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(c.ACMEDomains...),
+			Cache:      autocert.DirCache(c.ACMECacheDir),
+			Email:      c.ACMEEmail,
+		}
+		if c.ACMEDirectoryURL != "" {
+			s.manager.Client = &acme.Client{DirectoryURL: c.ACMEDirectoryURL}
+		}
+		return s, nil
+	}
+	certificates, err := LoadCertificates(c, s.clock)
+	if err != nil {
+		return nil, err
+	}
+	s.certificates = certificates
+	return s, nil
+}
+
+// Certificates returns the certificate files served, nil with ACME
+func (s *Server) Certificates() *Certificates {
+	return s.certificates
+}
+
+// TLSConfig returns the TLS configuration of the HTTPS listener
+func (s *Server) TLSConfig() *tls.Config {
+	config := &tls.Config{
+		MinVersion:   s.config.MinVersion,
+		CipherSuites: s.config.CipherSuites,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	if s.manager != nil {
+		config.GetCertificate = s.manager.GetCertificate
+	} else {
+		config.GetCertificate = s.certificates.GetCertificate
+	}
+	return config
+}
+
+// Start serves e over TLS on addr, and starts the plain-HTTP listener when
+// a port is set for it, until ctx is done; it then returns
+// http.ErrServerClosed once the requests in progress are served, for up
+// to ShutdownTimeout. The certificate files are reloaded on SIGHUP and
+// when they change.
+func (s *Server) Start(ctx context.Context, e *echo.Echo, addr string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if s.certificates != nil {
+		go s.certificates.Watch(ctx)
+	}
+
+	if s.config.HTTPPort != "" {
+		_, httpsPort, err := net.SplitHostPort(addr)
+		if err != nil {
+			return err
+		}
+		var handler http.Handler = RedirectHandler(httpsPort)
+		if s.manager != nil {
+			// Answers /.well-known/acme-challenge/ and passes the rest on
+			handler = s.manager.HTTPHandler(handler)
+		}
+		plain := &http.Server{
+			Addr:              ":" + s.config.HTTPPort,
+			Handler:           handler,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		errs := make(chan error, 1)
+		go func() { errs <- plain.ListenAndServe() }()
+		// A port already taken fails now rather than silently
+		select {
+		case err := <-errs:
+			return fmt.Errorf("plain-HTTP listener: %w", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+		logger.Info("Redirecting plain HTTP on port %s to HTTPS", s.config.HTTPPort)
+		defer plain.Close()
+	}
+
+	server := &http.Server{Addr: addr, TLSConfig: s.TLSConfig()}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	return e.StartServer(server)
+}
+
+// RedirectHandler redirects requests to the same URL over HTTPS on
+// httpsPort; GET and HEAD are moved permanently, other methods keep their
+// method and body with a 308
+func RedirectHandler(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if host == "" {
+			http.Error(w, "Host header required", http.StatusBadRequest)
+			return
+		}
+		if httpsPort != "" && httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		} else if net.ParseIP(host) != nil && net.ParseIP(host).To4() == nil {
+			host = "[" + host + "]"
+		}
+		status := http.StatusMovedPermanently
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			status = http.StatusPermanentRedirect
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), status)
+	})
+}
+
+// Schedule registers the daily job reporting a certificate file expired or
+// expiring within ExpiryWarning in the activity feed of a database and to
+// its administrators; ACME certificates are renewed before they expire and
+// are not checked
+func (s *Server) Schedule(sched *scheduler.Scheduler, dbName string) {
+	if s.certificates == nil {
+		return
+	}
+	sched.Every("tls.expiry."+dbName, 24*time.Hour, func(ctx context.Context) error {
+		return s.checkExpiry(ctx, dbName)
+	})
+}
+
+// checkExpiry reports the current certificate when it expires soon
+func (s *Server) checkExpiry(ctx context.Context, dbName string) error {
+	leaf := s.certificates.Leaf()
+	now := s.clock.Now()
+	warning := expiryWarning(leaf, now)
+	if warning == "" {
+		return nil
+	}
+	logger.Warning("TLS %s", warning)
+
+	db, err := database.GetDatabase(dbName)
+	if err != nil {
+		return err
+	}
+	admins, err := models.AdminUserIDs(db.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	days := daysLeft(leaf, now)
+	severity, kind := models.SeverityWarning, models.NotificationWarning
+	title := fmt.Sprintf("The TLS certificate of %s expires in %d day(s)", Subject(leaf), days)
+	if !leaf.NotAfter.After(now) {
+		severity, kind = models.SeverityError, models.NotificationError
+		title = fmt.Sprintf("The TLS certificate of %s has expired", Subject(leaf))
+	}
+	params := map[string]interface{}{
+		"subject":   Subject(leaf),
+		"days":      days,
+		"not_after": leaf.NotAfter.Format(time.RFC3339),
+		"file":      s.config.CertFile,
+	}
+	activity := models.Activity{Type: models.ActivityTLSExpiring, Severity: severity, Params: params}
+	var errs []error
+	if err := models.LogActivity(db.WithContext(ctx), 0, activity); err != nil {
+		errs = append(errs, err)
+	}
+	body := fmt.Sprintf("%s is valid until %s. Replace it; the server reloads it without restart.", s.config.CertFile, leaf.NotAfter.Format(time.RFC1123))
+	for _, uid := range admins {
+		if _, err := notification.Notify(dbName, uid, models.NotificationCategoryTLS, kind, title, body, params); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
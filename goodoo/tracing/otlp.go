@@ -0,0 +1,170 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"goodoo/logging"
+)
+
+// OTLP/JSON encoding of traces, following the OpenTelemetry protocol's
+// ExportTraceServiceRequest so a collector's /v1/traces endpoint accepts it
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+// OTLPRequest is the body of an OTLP/JSON trace export
+type OTLPRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+// OTLP span kinds
+const (
+	otlpKindInternal = 1
+	otlpKindServer   = 2
+)
+
+// ToOTLP encodes traces as an OTLP/JSON export request
+func ToOTLP(serviceName string, traces ...*Trace) *OTLPRequest {
+	resource := otlpResourceSpans{}
+	resource.Resource.Attributes = []otlpAttribute{{Key: "service.name", Value: otlpValue{serviceName}}}
+	scope := otlpScopeSpans{Spans: []otlpSpan{}}
+	scope.Scope.Name = "goodoo/tracing"
+
+	for _, trace := range traces {
+		trace.mutex.Lock()
+		var walk func(span *Span)
+		walk = func(span *Span) {
+			kind := otlpKindInternal
+			if span == trace.Root {
+				kind = otlpKindServer
+			}
+			encoded := otlpSpan{
+				TraceID:           trace.ID,
+				SpanID:            span.ID,
+				ParentSpanID:      span.ParentID,
+				Name:              span.Name,
+				Kind:              kind,
+				StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+				EndTimeUnixNano:   strconv.FormatInt(span.Start.Add(span.Duration).UnixNano(), 10),
+			}
+			for key, value := range span.Attributes {
+				encoded.Attributes = append(encoded.Attributes, otlpAttribute{Key: key, Value: otlpValue{value}})
+			}
+			scope.Spans = append(scope.Spans, encoded)
+			for _, child := range span.Children {
+				walk(child)
+			}
+		}
+		walk(trace.Root)
+		trace.mutex.Unlock()
+	}
+
+	resource.ScopeSpans = []otlpScopeSpans{scope}
+	return &OTLPRequest{ResourceSpans: []otlpResourceSpans{resource}}
+}
+
+// otlpExporter posts retained traces to a collector from a background
+// goroutine; traces are dropped when the collector cannot keep up
+type otlpExporter struct {
+	endpoint    string
+	serviceName string
+	client      *http.Client
+	queue       chan *Trace
+	cancel      context.CancelFunc
+}
+
+func newOTLPExporter(endpoint, serviceName string) *otlpExporter {
+	ctx, cancel := context.WithCancel(context.Background())
+	e := &otlpExporter{
+		endpoint:    endpoint,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 5 * time.Second},
+		queue:       make(chan *Trace, 100),
+		cancel:      cancel,
+	}
+	go e.run(ctx)
+	return e
+}
+
+func (e *otlpExporter) enqueue(trace *Trace) {
+	select {
+	case e.queue <- trace:
+	default:
+	}
+}
+
+func (e *otlpExporter) stop() {
+	e.cancel()
+}
+
+func (e *otlpExporter) run(ctx context.Context) {
+	logger := logging.GetLogger("goodoo.tracing")
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case trace := <-e.queue:
+			if err := e.export(ctx, trace); err != nil {
+				logger.Warning("Failed to export trace %s to %s: %v", trace.ID, e.endpoint, err)
+			}
+		}
+	}
+}
+
+func (e *otlpExporter) export(ctx context.Context, trace *Trace) error {
+	body, err := json.Marshal(ToOTLP(e.serviceName, trace))
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := e.client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("collector answered %d", response.StatusCode)
+	}
+	return nil
+}
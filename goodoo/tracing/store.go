@@ -0,0 +1,56 @@
+package tracing
+
+import "sync"
+
+// traceStore is a ring buffer of the most recent retained traces
+type traceStore struct {
+	mutex  sync.Mutex
+	traces []*Trace
+	next   int
+	full   bool
+}
+
+func newStore(capacity int) *traceStore {
+	if capacity <= 0 {
+		capacity = 1
+	}
+	return &traceStore{traces: make([]*Trace, capacity)}
+}
+
+// add stores a trace, evicting the oldest once full
+func (s *traceStore) add(trace *Trace) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.traces[s.next] = trace
+	s.next = (s.next + 1) % len(s.traces)
+	if s.next == 0 {
+		s.full = true
+	}
+}
+
+// list returns the stored traces, newest first
+func (s *traceStore) list() []*Trace {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	count := s.next
+	if s.full {
+		count = len(s.traces)
+	}
+	traces := make([]*Trace, 0, count)
+	for i := 1; i <= count; i++ {
+		traces = append(traces, s.traces[(s.next-i+len(s.traces))%len(s.traces)])
+	}
+	return traces
+}
+
+// get returns a stored trace by id
+func (s *traceStore) get(id string) (*Trace, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, trace := range s.traces {
+		if trace != nil && trace.ID == id {
+			return trace, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,321 @@
+// Package tracing records lightweight request traces: a root span per
+// request and child spans for database queries, template rendering and
+// other timed work. Completed traces slower than a threshold are kept in a
+// bounded in-memory store and optionally exported as OTLP/JSON.
+//
+// When tracing is disabled Start and StartTrace return a nil span without
+// allocating, and every Span method is a no-op on nil.
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config holds the tracing settings
+type Config struct {
+	Enabled bool
+	// Threshold is the duration above which a completed trace is retained
+	Threshold time.Duration
+	// Capacity is the number of retained traces
+	Capacity int
+	// MaxSpans bounds the spans recorded in one trace
+	MaxSpans int
+	// OTLPEndpoint receives retained traces as OTLP/JSON when set,
+	// e.g. http://collector:4318/v1/traces
+	OTLPEndpoint string
+	ServiceName  string
+}
+
+// DefaultConfig returns tracing disabled, retaining traces over 500ms
+func DefaultConfig() *Config {
+	return &Config{
+		Threshold:   500 * time.Millisecond,
+		Capacity:    200,
+		MaxSpans:    500,
+		ServiceName: "goodoo",
+	}
+}
+
+// LoadFromEnv overrides the configuration with GOODOO_TRACE_* variables
+func (c *Config) LoadFromEnv() {
+	if value := os.Getenv("GOODOO_TRACE_ENABLED"); value != "" {
+		c.Enabled, _ = strconv.ParseBool(value)
+	}
+	if value := os.Getenv("GOODOO_TRACE_THRESHOLD"); value != "" {
+		if threshold, err := time.ParseDuration(value); err == nil {
+			c.Threshold = threshold
+		}
+	}
+	if value := os.Getenv("GOODOO_TRACE_CAPACITY"); value != "" {
+		if capacity, err := strconv.Atoi(value); err == nil && capacity > 0 {
+			c.Capacity = capacity
+		}
+	}
+	if value := os.Getenv("GOODOO_TRACE_OTLP_ENDPOINT"); value != "" {
+		c.OTLPEndpoint = value
+	}
+}
+
+var (
+	enabled  atomic.Bool
+	config   = DefaultConfig()
+	store    = newStore(config.Capacity)
+	exporter *otlpExporter
+	mutex    sync.RWMutex
+)
+
+// Setup installs the process-wide tracing configuration
+func Setup(c *Config) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	config = c
+	store = newStore(c.Capacity)
+	if exporter != nil {
+		exporter.stop()
+		exporter = nil
+	}
+	if c.OTLPEndpoint != "" {
+		exporter = newOTLPExporter(c.OTLPEndpoint, c.ServiceName)
+	}
+	enabled.Store(c.Enabled)
+}
+
+// ServiceName returns the service name reported to collectors
+func ServiceName() string {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return config.ServiceName
+}
+
+// Enabled reports whether requests are traced
+func Enabled() bool {
+	return enabled.Load()
+}
+
+// Trace is the span tree of one request
+type Trace struct {
+	ID   string `json:"id"`
+	Root *Span  `json:"root"`
+	// Dropped counts spans not recorded because of Config.MaxSpans
+	Dropped int `json:"dropped,omitempty"`
+
+	mutex    sync.Mutex
+	spans    int
+	maxSpans int
+}
+
+// Span is one timed operation of a trace
+type Span struct {
+	ID         string            `json:"id"`
+	ParentID   string            `json:"parent_id,omitempty"`
+	Name       string            `json:"name"`
+	Start      time.Time         `json:"start"`
+	Duration   time.Duration     `json:"-"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Children   []*Span           `json:"children,omitempty"`
+
+	trace *Trace
+}
+
+// MarshalJSON encodes the trace while holding its lock, since spans of
+// background work may still be added after the request completed
+func (t *Trace) MarshalJSON() ([]byte, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	type trace Trace
+	return json.Marshal((*trace)(t))
+}
+
+// MarshalJSON adds the duration in milliseconds
+func (s *Span) MarshalJSON() ([]byte, error) {
+	type span Span
+	return json.Marshal(struct {
+		*span
+		DurationMs float64 `json:"duration_ms"`
+	}{(*span)(s), float64(s.Duration.Microseconds()) / 1000})
+}
+
+// TraceSummary describes a retained trace in listings
+type TraceSummary struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	Start      time.Time `json:"start"`
+	DurationMs float64   `json:"duration_ms"`
+	Spans      int       `json:"spans"`
+	Dropped    int       `json:"dropped,omitempty"`
+}
+
+// Summary returns the root name, timing and span count of the trace
+func (t *Trace) Summary() TraceSummary {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return TraceSummary{
+		ID:         t.ID,
+		Name:       t.Root.Name,
+		Start:      t.Root.Start,
+		DurationMs: float64(t.Root.Duration.Microseconds()) / 1000,
+		Spans:      t.spans,
+		Dropped:    t.Dropped,
+	}
+}
+
+type spanKey struct{}
+
+// FromContext returns the current span of a context, or nil
+func FromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// ContextWithSpan returns a context whose current span is span
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	if span == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+func newID(bytes int) string {
+	buf := make([]byte, 16)
+	for i := 0; i < bytes; i += 8 {
+		value := rand.Uint64()
+		for j := 0; j < 8; j++ {
+			buf[i+j] = byte(value >> (8 * j))
+		}
+	}
+	return hex.EncodeToString(buf[:bytes])
+}
+
+// Active reports whether the context carries a span being traced
+func Active(ctx context.Context) bool {
+	return enabled.Load() && FromContext(ctx) != nil
+}
+
+// StartTrace starts the root span of a new trace. It returns the context
+// unchanged and a nil span when tracing is disabled.
+func StartTrace(ctx context.Context, name string) (context.Context, *Span) {
+	if !enabled.Load() {
+		return ctx, nil
+	}
+	mutex.RLock()
+	maxSpans := config.MaxSpans
+	mutex.RUnlock()
+
+	trace := &Trace{ID: newID(16), maxSpans: maxSpans, spans: 1}
+	root := &Span{ID: newID(8), Name: name, Start: time.Now(), trace: trace}
+	trace.Root = root
+	return context.WithValue(ctx, spanKey{}, root), root
+}
+
+// Start opens a child of the context's span. Without a traced parent it
+// returns the context unchanged and a nil span.
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	if !enabled.Load() {
+		return ctx, nil
+	}
+	parent := FromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	span := parent.child(name, time.Now())
+	if span == nil {
+		return ctx, nil
+	}
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// Record adds an already timed child span to the context's span, e.g. a
+// database query measured by the driver
+func Record(ctx context.Context, name string, start time.Time, duration time.Duration, attributes map[string]string) {
+	if !enabled.Load() {
+		return
+	}
+	parent := FromContext(ctx)
+	if parent == nil {
+		return
+	}
+	if span := parent.child(name, start); span != nil {
+		span.trace.mutex.Lock()
+		span.Duration = duration
+		span.Attributes = attributes
+		span.trace.mutex.Unlock()
+	}
+}
+
+// child adds a span under s, or returns nil once the trace is full
+func (s *Span) child(name string, start time.Time) *Span {
+	trace := s.trace
+	trace.mutex.Lock()
+	defer trace.mutex.Unlock()
+	if trace.maxSpans > 0 && trace.spans >= trace.maxSpans {
+		trace.Dropped++
+		return nil
+	}
+	trace.spans++
+	span := &Span{ID: newID(8), ParentID: s.ID, Name: name, Start: start, trace: trace}
+	s.Children = append(s.Children, span)
+	return span
+}
+
+// SetAttribute annotates the span
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.trace.mutex.Lock()
+	defer s.trace.mutex.Unlock()
+	if s.Attributes == nil {
+		s.Attributes = make(map[string]string)
+	}
+	s.Attributes[key] = value
+}
+
+// End closes the span; ending the root span completes the trace, which is
+// retained when slower than the configured threshold
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.trace.mutex.Lock()
+	s.Duration = time.Since(s.Start)
+	s.trace.mutex.Unlock()
+
+	if s.trace.Root != s {
+		return
+	}
+	mutex.RLock()
+	threshold, traces, export := config.Threshold, store, exporter
+	mutex.RUnlock()
+	if s.Duration < threshold {
+		return
+	}
+	traces.add(s.trace)
+	if export != nil {
+		export.enqueue(s.trace)
+	}
+}
+
+// Recent returns the retained traces, newest first
+func Recent() []*Trace {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return store.list()
+}
+
+// Get returns a retained trace by id
+func Get(id string) (*Trace, bool) {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return store.get(id)
+}
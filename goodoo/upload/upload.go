@@ -0,0 +1,248 @@
+// Package upload stages files uploaded ahead of the request using them.
+// A staged file is bound to the uploading session and referenced by an
+// upload token in place of inline base64; consuming the token hands the
+// content over exactly once.
+package upload
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"goodoo/database"
+	"goodoo/fields"
+	"goodoo/logging"
+	"goodoo/models"
+	"goodoo/scheduler"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// TokenKey is the key of the object referencing a staged file in a
+// payload, e.g. {"image": {"upload_token": "..."}}
+const TokenKey = "upload_token"
+
+var (
+	ErrNotFound      = errors.New("unknown upload token")
+	ErrOtherSession  = errors.New("upload token belongs to another session")
+	ErrConsumed      = errors.New("upload token was already used")
+	ErrExpired       = errors.New("upload token has expired")
+	ErrQuotaExceeded = errors.New("upload quota of the session exceeded")
+	ErrTooLarge      = errors.New("uploaded file is too large")
+)
+
+// Config holds the staging limits
+type Config struct {
+	// TTL is how long a staged file can be referenced
+	TTL time.Duration
+	// MaxCount and MaxBytes bound the pending uploads of one session
+	MaxCount int
+	MaxBytes int64
+	// MaxFileSize bounds a single file
+	MaxFileSize int64
+}
+
+// DefaultConfig returns staging for an hour, up to 20 files and 100 MB per session
+func DefaultConfig() *Config {
+	return &Config{
+		TTL:         time.Hour,
+		MaxCount:    20,
+		MaxBytes:    100 << 20,
+		MaxFileSize: 25 << 20,
+	}
+}
+
+// LoadFromEnv overrides the configuration with GOODOO_UPLOAD_* variables
+func (c *Config) LoadFromEnv() {
+	if value := os.Getenv("GOODOO_UPLOAD_TTL"); value != "" {
+		if ttl, err := time.ParseDuration(value); err == nil && ttl > 0 {
+			c.TTL = ttl
+		}
+	}
+	if value := os.Getenv("GOODOO_UPLOAD_MAX_COUNT"); value != "" {
+		if count, err := strconv.Atoi(value); err == nil && count > 0 {
+			c.MaxCount = count
+		}
+	}
+	if value := os.Getenv("GOODOO_UPLOAD_MAX_BYTES"); value != "" {
+		if size, err := strconv.ParseInt(value, 10, 64); err == nil && size > 0 {
+			c.MaxBytes = size
+		}
+	}
+	if value := os.Getenv("GOODOO_UPLOAD_MAX_FILE_SIZE"); value != "" {
+		if size, err := strconv.ParseInt(value, 10, 64); err == nil && size > 0 {
+			c.MaxFileSize = size
+		}
+	}
+}
+
+var (
+	config = DefaultConfig()
+	mutex  sync.RWMutex
+)
+
+// Setup installs the process-wide staging configuration
+func Setup(c *Config) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	config = c
+}
+
+// CurrentConfig returns the staging configuration
+func CurrentConfig() *Config {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return config
+}
+
+func newToken() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// Stage stores a file for the session and returns it with its token. The
+// session quota counts the uploads not yet consumed nor expired.
+func Stage(db *gorm.DB, sessionID string, uid uint, name, mimetype string, data []byte) (*models.IrUpload, error) {
+	c := CurrentConfig()
+	if int64(len(data)) > c.MaxFileSize {
+		return nil, ErrTooLarge
+	}
+	token, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+
+	staged := &models.IrUpload{
+		Token:     token,
+		SessionID: sessionID,
+		UserID:    uid,
+		Name:      name,
+		Mimetype:  mimetype,
+		FileSize:  len(data),
+		Datas:     data,
+		ExpiresAt: time.Now().Add(c.TTL),
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// Serialize the uploads of a session so concurrent ones cannot
+		// both pass the quota check
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", "ir_upload:"+sessionID).Error; err != nil {
+			return err
+		}
+		var usage struct {
+			Count int64
+			Bytes int64
+		}
+		err := tx.Model(&models.IrUpload{}).
+			Select("COUNT(*) AS count, COALESCE(SUM(file_size), 0) AS bytes").
+			Where("session_id = ? AND consumed_at IS NULL AND expires_at > ?", sessionID, time.Now()).
+			Scan(&usage).Error
+		if err != nil {
+			return err
+		}
+		if usage.Count+1 > int64(c.MaxCount) || usage.Bytes+int64(len(data)) > c.MaxBytes {
+			return ErrQuotaExceeded
+		}
+		return tx.Create(staged).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return staged, nil
+}
+
+// Consume hands over the content of a staged file to the session that
+// uploaded it. Run it in the transaction using the content so a failed
+// write leaves the token usable.
+func Consume(db *gorm.DB, sessionID, token string) (*models.IrUpload, error) {
+	var staged models.IrUpload
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("token = ?", token).First(&staged).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrNotFound
+			}
+			return err
+		}
+		switch {
+		case staged.SessionID != sessionID:
+			return ErrOtherSession
+		case staged.ConsumedAt != nil:
+			return ErrConsumed
+		case time.Now().After(staged.ExpiresAt):
+			return ErrExpired
+		}
+		return tx.Model(&models.IrUpload{}).Where("id = ?", staged.ID).
+			Updates(map[string]interface{}{"consumed_at": time.Now(), "datas": nil}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &staged, nil
+}
+
+// TokenOf returns the upload token referenced by a payload value
+func TokenOf(value interface{}) (string, bool) {
+	object, ok := value.(map[string]interface{})
+	if !ok || len(object) != 1 {
+		return "", false
+	}
+	token, ok := object[TokenKey].(string)
+	return token, ok && token != ""
+}
+
+// ResolveValues replaces the upload tokens given for binary fields of a
+// model by the staged content
+func ResolveValues(db *gorm.DB, sessionID string, model *models.ModelDefinition, vals map[string]interface{}) error {
+	for name, value := range vals {
+		token, ok := TokenOf(value)
+		if !ok {
+			continue
+		}
+		field, exists := model.Fields[name]
+		if !exists || field.GetType() != fields.BinaryType {
+			return fmt.Errorf("field '%s' does not accept uploads", name)
+		}
+		staged, err := Consume(db, sessionID, token)
+		if err != nil {
+			return fmt.Errorf("field '%s': %w", name, err)
+		}
+		vals[name] = staged.Datas
+	}
+	return nil
+}
+
+// IsTokenError reports whether err comes from an unusable upload token
+func IsTokenError(err error) bool {
+	return errors.Is(err, ErrNotFound) || errors.Is(err, ErrOtherSession) ||
+		errors.Is(err, ErrConsumed) || errors.Is(err, ErrExpired)
+}
+
+// Cleanup deletes the expired uploads, consumed or not
+func Cleanup(db *gorm.DB) (int64, error) {
+	result := db.Where("expires_at <= ?", time.Now()).Delete(&models.IrUpload{})
+	return result.RowsAffected, result.Error
+}
+
+// ScheduleCleanup registers the job deleting expired uploads of a database every interval
+func ScheduleCleanup(s *scheduler.Scheduler, dbName string, interval time.Duration) {
+	logger := logging.GetLogger("goodoo.upload")
+	s.Every("upload.cleanup."+dbName, interval, func(ctx context.Context) error {
+		db, err := database.GetDatabase(dbName)
+		if err != nil {
+			return err
+		}
+		deleted, err := Cleanup(db.WithContext(ctx))
+		if deleted > 0 {
+			logger.Info("Deleted %d expired upload(s) of %s", deleted, dbName)
+		}
+		return err
+	})
+}
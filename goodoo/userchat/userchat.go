@@ -0,0 +1,295 @@
+// Package userchat relays the live events of the user-to-user chat rooms
+// over the bus: new messages, their delivery receipts and the typing
+// indicators. Connections of a room subscribe to its events. Typing
+// indicators only live in memory: they expire after a short TTL and are
+// rate limited per user and room, so they never reach the database and
+// cannot flood the other participants.
+package userchat
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"goodoo/bus"
+	"goodoo/scheduler"
+)
+
+// Channel is the bus channel of the chat rooms; payloads are Event values
+const Channel = "user_chat"
+
+// Events published on Channel
+const (
+	EventMessage = "message"
+	EventReceipt = "receipt"
+	EventTyping  = "typing"
+)
+
+// ErrTooFrequent is returned when a user signals typing in a room again
+// before the minimum interval
+var ErrTooFrequent = errors.New("typing signalled too frequently")
+
+// Config holds the lifetime and rate of the typing indicators
+type Config struct {
+	// TypingTTL is how long a typing indicator lasts without renewal
+	TypingTTL time.Duration
+	// TypingInterval is the minimum time between the typing signals of a
+	// user in a room
+	TypingInterval time.Duration
+}
+
+// DefaultConfig returns indicators lasting 6 seconds, renewed at most
+// every 2 seconds
+func DefaultConfig() *Config {
+	return &Config{
+		TypingTTL:      6 * time.Second,
+		TypingInterval: 2 * time.Second,
+	}
+}
+
+// LoadFromEnv overrides the configuration with GOODOO_TYPING_* variables
+func (c *Config) LoadFromEnv() {
+	durations := map[string]*time.Duration{
+		"GOODOO_TYPING_TTL":      &c.TypingTTL,
+		"GOODOO_TYPING_INTERVAL": &c.TypingInterval,
+	}
+	for name, target := range durations {
+		if value := os.Getenv(name); value != "" {
+			if d, err := time.ParseDuration(value); err == nil && d > 0 {
+				*target = d
+			}
+		}
+	}
+}
+
+// Event is a change in a room: a message sent (Message), a receipt of a
+// message (MessageID, UserID and State) or a user starting or stopping to
+// type (UserID, Typing and, while typing, ExpiresAt)
+type Event struct {
+	Type      string      `json:"type"`
+	Room      string      `json:"room"`
+	UserID    uint        `json:"user_id"`
+	MessageID string      `json:"message_id,omitempty"`
+	Message   interface{} `json:"message,omitempty"`
+	State     string      `json:"state,omitempty"`
+	Typing    bool        `json:"typing,omitempty"`
+	ExpiresAt *time.Time  `json:"expires_at,omitempty"`
+}
+
+// Publish posts an event of a room of a database
+func Publish(dbName string, event Event) {
+	bus.Publish(dbName, Channel, event)
+}
+
+// Subscribe calls fn with the events of a room of a database until the
+// returned function is called. fn must not block.
+func Subscribe(dbName, room string, fn func(Event)) (unsubscribe func()) {
+	return bus.Subscribe(Channel, func(message bus.Message) {
+		if event, ok := message.Payload.(Event); ok && message.DB == dbName && event.Room == room {
+			fn(event)
+		}
+	})
+}
+
+// Resumed is an event a resuming subscriber missed, with the ID of its
+// bus message
+type Resumed struct {
+	ID    uint64
+	Event Event
+}
+
+// SubscribeFrom is Subscribe for a client resuming after the bus message
+// after: it also returns the events of the room published since, and fn
+// receives the bus message ID of each event. complete is false when
+// events may have been missed (see bus.SubscribeFrom).
+func SubscribeFrom(dbName, room string, after uint64, fn func(id uint64, event Event)) (missed []Resumed, unsubscribe func(), complete bool) {
+	match := func(message bus.Message) (Event, bool) {
+		event, ok := message.Payload.(Event)
+		return event, ok && message.DB == dbName && event.Room == room
+	}
+	messages, unsubscribe, complete := bus.SubscribeFrom(Channel, after, func(message bus.Message) {
+		if event, ok := match(message); ok {
+			fn(message.ID, event)
+		}
+	})
+	for _, message := range messages {
+		if event, ok := match(message); ok {
+			missed = append(missed, Resumed{ID: message.ID, Event: event})
+		}
+	}
+	return missed, unsubscribe, complete
+}
+
+// DirectRoom returns the room of the direct messages between two users
+func DirectRoom(a, b uint) string {
+	return "direct_" + strconv.FormatUint(uint64(min(a, b)), 10) + "_" + strconv.FormatUint(uint64(max(a, b)), 10)
+}
+
+// DirectParticipants returns the two users of a direct room, named
+// direct_<lower id>_<higher id>; ok is false for other rooms
+func DirectParticipants(room string) (first, second uint, ok bool) {
+	rest, found := strings.CutPrefix(room, "direct_")
+	if !found {
+		return 0, 0, false
+	}
+	a, b, found := strings.Cut(rest, "_")
+	if !found {
+		return 0, 0, false
+	}
+	x, errA := strconv.ParseUint(a, 10, 64)
+	y, errB := strconv.ParseUint(b, 10, 64)
+	if errA != nil || errB != nil || x == 0 || x >= y {
+		return 0, 0, false
+	}
+	return uint(x), uint(y), true
+}
+
+// CanJoin reports whether a user may follow a room: direct rooms belong to
+// their two users, the members of group rooms are not stored yet
+func CanJoin(room string, uid uint) bool {
+	if first, second, ok := DirectParticipants(room); ok {
+		return uid == first || uid == second
+	}
+	return !strings.HasPrefix(room, "direct_")
+}
+
+// typist is a user typing in a room
+type typist struct {
+	expiresAt  time.Time
+	lastSignal time.Time
+}
+
+// roomKey identifies a room of a database
+type roomKey struct {
+	db   string
+	room string
+}
+
+var (
+	config = DefaultConfig()
+	// typists are the users typing, by room and user
+	typists = make(map[roomKey]map[uint]*typist)
+	mutex   sync.Mutex
+)
+
+// Setup installs the process-wide configuration
+func Setup(c *Config) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	config = c
+}
+
+// expire forgets the typists of a room whose indicator expired at now and
+// returns their stop events; mutex must be held
+func expire(key roomKey, now time.Time) []Event {
+	var events []Event
+	for uid, t := range typists[key] {
+		if !now.Before(t.expiresAt) {
+			delete(typists[key], uid)
+			events = append(events, Event{Type: EventTyping, Room: key.room, UserID: uid})
+		}
+	}
+	if len(typists[key]) == 0 {
+		delete(typists, key)
+	}
+	return events
+}
+
+// StartTyping records that a user types in a room until the TTL, and
+// publishes it to the room. It fails with ErrTooFrequent within the
+// minimum interval of the user's previous signal in the room, which keeps
+// the indicator as it was.
+func StartTyping(dbName, room string, uid uint, now time.Time) (Event, error) {
+	key := roomKey{db: dbName, room: room}
+	mutex.Lock()
+	events := expire(key, now)
+	t := typists[key][uid]
+	if t != nil && now.Sub(t.lastSignal) < config.TypingInterval {
+		expiresAt := t.expiresAt
+		mutex.Unlock()
+		publishAll(dbName, events)
+		return Event{Type: EventTyping, Room: room, UserID: uid, Typing: true, ExpiresAt: &expiresAt}, ErrTooFrequent
+	}
+	if t == nil {
+		t = &typist{}
+		if typists[key] == nil {
+			typists[key] = make(map[uint]*typist)
+		}
+		typists[key][uid] = t
+	}
+	t.lastSignal = now
+	t.expiresAt = now.Add(config.TypingTTL)
+	expiresAt := t.expiresAt
+	mutex.Unlock()
+
+	event := Event{Type: EventTyping, Room: room, UserID: uid, Typing: true, ExpiresAt: &expiresAt}
+	publishAll(dbName, append(events, event))
+	return event, nil
+}
+
+// StopTyping records that a user stopped typing in a room, e.g. because
+// they sent their message, and publishes it when they were typing
+func StopTyping(dbName, room string, uid uint, now time.Time) {
+	key := roomKey{db: dbName, room: room}
+	mutex.Lock()
+	events := expire(key, now)
+	if _, typing := typists[key][uid]; typing {
+		delete(typists[key], uid)
+		if len(typists[key]) == 0 {
+			delete(typists, key)
+		}
+		events = append(events, Event{Type: EventTyping, Room: room, UserID: uid})
+	}
+	mutex.Unlock()
+	publishAll(dbName, events)
+}
+
+// Typists returns the users typing in a room at now, by id
+func Typists(dbName, room string, now time.Time) []uint {
+	key := roomKey{db: dbName, room: room}
+	mutex.Lock()
+	events := expire(key, now)
+	uids := make([]uint, 0, len(typists[key]))
+	for uid := range typists[key] {
+		uids = append(uids, uid)
+	}
+	mutex.Unlock()
+	publishAll(dbName, events)
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	return uids
+}
+
+// Sweep expires the typing indicators of a database at now and publishes
+// their stop
+func Sweep(dbName string, now time.Time) {
+	var events []Event
+	mutex.Lock()
+	for key := range typists {
+		if key.db == dbName {
+			events = append(events, expire(key, now)...)
+		}
+	}
+	mutex.Unlock()
+	publishAll(dbName, events)
+}
+
+// publishAll publishes events in order
+func publishAll(dbName string, events []Event) {
+	for _, event := range events {
+		Publish(dbName, event)
+	}
+}
+
+// Schedule registers the job expiring the typing indicators of a database
+// every interval
+func Schedule(s *scheduler.Scheduler, dbName string, interval time.Duration) {
+	s.Every("userchat.typing."+dbName, interval, func(ctx context.Context) error {
+		Sweep(dbName, s.Clock().Now())
+		return nil
+	})
+}
@@ -0,0 +1,122 @@
+package userchat_test
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"goodoo/bus"
+	"goodoo/userchat"
+)
+
+// publish publishes events and returns the bus message IDs of those of
+// the room lobby of userchat_test
+func publish(t *testing.T, events ...userchat.Event) []uint64 {
+	var ids []uint64
+	_, unsubscribe, _ := userchat.SubscribeFrom("userchat_test", "lobby", 0, func(id uint64, event userchat.Event) {
+		ids = append(ids, id)
+	})
+	defer unsubscribe()
+	for _, event := range events {
+		userchat.Publish("userchat_test", event)
+	}
+	return ids
+}
+
+// messageIDs returns the message ids of resumed events
+func messageIDs(resumed []userchat.Resumed) []string {
+	var ids []string
+	for _, item := range resumed {
+		ids = append(ids, item.Event.MessageID)
+	}
+	return ids
+}
+
+// TestSubscribeFrom resumes a room after an event: only the events of the
+// room in its database are replayed, with their bus message IDs, then the
+// new ones delivered
+func TestSubscribeFrom(t *testing.T) {
+	message := func(room, id string) userchat.Event {
+		return userchat.Event{Type: userchat.EventMessage, Room: room, UserID: 1, MessageID: id}
+	}
+	ids := publish(t, message("lobby", "m1"), message("lobby", "m2"), message("other", "x"), message("lobby", "m3"))
+	// The same room of another database
+	userchat.Publish("userchat_test_other", message("lobby", "y"))
+	if len(ids) != 3 {
+		t.Fatalf("%d events of the room, want 3", len(ids))
+	}
+
+	var received []userchat.Resumed
+	missed, unsubscribe, complete := userchat.SubscribeFrom("userchat_test", "lobby", ids[0], func(id uint64, event userchat.Event) {
+		received = append(received, userchat.Resumed{ID: id, Event: event})
+	})
+	defer unsubscribe()
+	if !complete || !slices.Equal(messageIDs(missed), []string{"m2", "m3"}) || missed[0].ID != ids[1] || missed[1].ID != ids[2] {
+		t.Errorf("SubscribeFrom m1 = %+v, complete %v; want m2 and m3 with their ids", missed, complete)
+	}
+	userchat.Publish("userchat_test", message("other", "z"))
+	userchat.Publish("userchat_test", message("lobby", "m4"))
+	if !slices.Equal(messageIDs(received), []string{"m4"}) || received[0].ID <= ids[2] {
+		t.Errorf("received %+v, want m4 after m3", received)
+	}
+}
+
+func TestSubscribeFromEvicted(t *testing.T) {
+	events := make([]userchat.Event, bus.RetentionSize+2)
+	for i := range events {
+		events[i] = userchat.Event{Type: userchat.EventReceipt, Room: "lobby", UserID: 2, State: "delivered"}
+	}
+	ids := publish(t, events...)
+
+	missed, unsubscribe, complete := userchat.SubscribeFrom("userchat_test", "lobby", ids[0], func(uint64, userchat.Event) {})
+	unsubscribe()
+	if complete || len(missed) != bus.RetentionSize {
+		t.Errorf("SubscribeFrom an evicted event: %d missed, complete %v; want %d, incomplete", len(missed), complete, bus.RetentionSize)
+	}
+}
+
+func TestTyping(t *testing.T) {
+	userchat.Setup(&userchat.Config{TypingTTL: 6 * time.Second, TypingInterval: 2 * time.Second})
+	t.Cleanup(func() { userchat.Setup(userchat.DefaultConfig()) })
+	now := time.Now()
+	room := "typing_" + now.Format("150405.000000000")
+
+	var events []userchat.Event
+	unsubscribe := userchat.Subscribe("userchat_test", room, func(event userchat.Event) { events = append(events, event) })
+	defer unsubscribe()
+
+	event, err := userchat.StartTyping("userchat_test", room, 1, now)
+	if err != nil || !event.Typing || !event.ExpiresAt.Equal(now.Add(6*time.Second)) {
+		t.Fatalf("StartTyping = %+v, %v", event, err)
+	}
+	if _, err := userchat.StartTyping("userchat_test", room, 1, now.Add(time.Second)); !errors.Is(err, userchat.ErrTooFrequent) {
+		t.Errorf("StartTyping a second later: %v, want ErrTooFrequent", err)
+	}
+	if _, err := userchat.StartTyping("userchat_test", room, 2, now.Add(time.Second)); err != nil {
+		t.Errorf("StartTyping of another user: %v", err)
+	}
+	if typists := userchat.Typists("userchat_test", room, now.Add(5*time.Second)); !slices.Equal(typists, []uint{1, 2}) {
+		t.Errorf("Typists = %v, want 1 and 2", typists)
+	}
+
+	// The indicator of user 1 expires, user 2 stops
+	if typists := userchat.Typists("userchat_test", room, now.Add(6*time.Second)); !slices.Equal(typists, []uint{2}) {
+		t.Errorf("Typists after the TTL of user 1 = %v, want 2", typists)
+	}
+	userchat.StopTyping("userchat_test", room, 2, now.Add(6*time.Second))
+	userchat.StopTyping("userchat_test", room, 2, now.Add(6*time.Second))
+
+	var log []string
+	for _, event := range events {
+		state := "stop"
+		if event.Typing {
+			state = "start"
+		}
+		log = append(log, fmt.Sprintf("%s %d", state, event.UserID))
+	}
+	if want := []string{"start 1", "start 2", "stop 1", "stop 2"}; !slices.Equal(log, want) {
+		t.Errorf("events = %v, want %v", log, want)
+	}
+}
@@ -0,0 +1,6 @@
+// Package version identifies the running server
+package version
+
+// Version of the server, reported by the health endpoint and recorded in
+// backups
+const Version = "1.0.0"
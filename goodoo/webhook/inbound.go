@@ -0,0 +1,277 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"goodoo/api"
+	"goodoo/fields"
+	"goodoo/models"
+	"gorm.io/gorm"
+)
+
+// Headers of inbound hook requests. HMAC hooks sign
+// "<timestamp>.<nonce>.<body>" in SignatureHeader; token hooks send the
+// secret in TokenHeader. Both send a unix timestamp and a unique nonce.
+const (
+	TimestampHeader = "X-Goodoo-Timestamp"
+	NonceHeader     = "X-Goodoo-Nonce"
+	TokenHeader     = "X-Goodoo-Token"
+)
+
+// ReplayWindow is how far a request timestamp may be from the server clock;
+// nonces are remembered for twice as long
+const ReplayWindow = 5 * time.Minute
+
+// Errors returned by VerifyInbound
+var (
+	ErrUnauthorized = errors.New("invalid signature or token")
+	ErrReplayed     = errors.New("stale or replayed request")
+)
+
+var hookNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// SignInbound returns the signature an inbound hook expects for a request
+func SignInbound(secret, timestamp, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + nonce + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// nonceCache remembers the nonces seen within the replay window
+type nonceCache struct {
+	mutex sync.Mutex
+	seen  map[string]time.Time
+}
+
+var nonces = &nonceCache{seen: make(map[string]time.Time)}
+
+// claim records a nonce and reports false if it was already used
+func (c *nonceCache) claim(key string, now time.Time) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for k, expiry := range c.seen {
+		if now.After(expiry) {
+			delete(c.seen, k)
+		}
+	}
+	if _, used := c.seen[key]; used {
+		return false
+	}
+	c.seen[key] = now.Add(2 * ReplayWindow)
+	return true
+}
+
+// VerifyInbound authenticates a request to an inbound hook of a database
+// and rejects stale timestamps and reused nonces
+func VerifyInbound(dbName string, hook *models.InboundHook, header http.Header, body []byte, now time.Time) error {
+	timestamp := header.Get(TimestampHeader)
+	nonce := header.Get(NonceHeader)
+	if timestamp == "" || nonce == "" {
+		return fmt.Errorf("%w: %s and %s are required", ErrUnauthorized, TimestampHeader, NonceHeader)
+	}
+
+	switch hook.Auth {
+	case models.InboundAuthToken:
+		if !hmac.Equal([]byte(header.Get(TokenHeader)), []byte(hook.Secret)) {
+			return ErrUnauthorized
+		}
+	default:
+		expected := SignInbound(string(hook.Secret), timestamp, nonce, body)
+		if !hmac.Equal([]byte(header.Get(SignatureHeader)), []byte(expected)) {
+			return ErrUnauthorized
+		}
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: invalid timestamp", ErrReplayed)
+	}
+	if skew := now.Sub(time.Unix(seconds, 0)); skew > ReplayWindow || skew < -ReplayWindow {
+		return ErrReplayed
+	}
+	if !nonces.claim(dbName+"/"+hook.Name+"/"+nonce, now) {
+		return ErrReplayed
+	}
+	return nil
+}
+
+// hookLimiter is the rate limiter of one hook and the limit it was built for
+type hookLimiter struct {
+	limiter   *rate.Limiter
+	perMinute int
+}
+
+var (
+	limiters     = make(map[string]*hookLimiter)
+	limiterMutex sync.Mutex
+)
+
+// Allow reports whether an inbound hook of a database is within its rate limit
+func Allow(dbName string, hook *models.InboundHook) bool {
+	if hook.RateLimit <= 0 {
+		return true
+	}
+	key := dbName + "/" + hook.Name
+
+	limiterMutex.Lock()
+	entry, exists := limiters[key]
+	if !exists || entry.perMinute != hook.RateLimit {
+		entry = &hookLimiter{
+			limiter:   rate.NewLimiter(rate.Limit(float64(hook.RateLimit)/60), hook.RateLimit),
+			perMinute: hook.RateLimit,
+		}
+		limiters[key] = entry
+	}
+	limiterMutex.Unlock()
+
+	return entry.limiter.Allow()
+}
+
+// ParseMapping decodes the kwarg to payload path mapping of a hook
+func ParseMapping(value string) (map[string]string, error) {
+	mapping := make(map[string]string)
+	if strings.TrimSpace(value) == "" {
+		return mapping, nil
+	}
+	if err := json.Unmarshal([]byte(value), &mapping); err != nil {
+		return nil, fmt.Errorf("invalid mapping: %w", err)
+	}
+	return mapping, nil
+}
+
+// lookupPath follows a dotted path ("data.lines.0.amount") into a decoded
+// JSON payload
+func lookupPath(payload interface{}, path string) (interface{}, bool) {
+	current := payload
+	for _, key := range strings.Split(path, ".") {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			value, exists := node[key]
+			if !exists {
+				return nil, false
+			}
+			current = value
+		case []interface{}:
+			index, err := strconv.Atoi(key)
+			if err != nil || index < 0 || index >= len(node) {
+				return nil, false
+			}
+			current = node[index]
+		default:
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// recordIDs converts a mapped id or list of ids
+func recordIDs(value interface{}) ([]int, error) {
+	values, isList := value.([]interface{})
+	if !isList {
+		values = []interface{}{value}
+	}
+	ids := make([]int, 0, len(values))
+	for _, v := range values {
+		if _, isBool := v.(bool); isBool {
+			return nil, fmt.Errorf("invalid id %v", v)
+		}
+		id, err := fields.ConvertToID(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid id %v", v)
+		}
+		ids = append(ids, int(id))
+	}
+	return ids, nil
+}
+
+// lookupMethod returns the public API method an inbound hook calls
+func lookupMethod(registry *api.APIRegistry, hook *models.InboundHook) (*api.APIMethod, error) {
+	method, exists := registry.GetMethods(hook.Model)[hook.Method]
+	if !exists || !method.Public {
+		return nil, fmt.Errorf("method %s.%s not found", hook.Model, hook.Method)
+	}
+	return method, nil
+}
+
+// BuildCall maps a payload onto the API call of a hook. Mapped values named
+// after fields of the target model are converted by those fields; "ids" or
+// "id" selects the records of a record method. The remaining kwargs are
+// passed as the method's single argument when there are any.
+func BuildCall(env *models.Environment, registry *api.APIRegistry, hook *models.InboundHook, payload map[string]interface{}) (*api.APICall, error) {
+	method, err := lookupMethod(registry, hook)
+	if err != nil {
+		return nil, err
+	}
+	mapping, err := ParseMapping(hook.Mapping)
+	if err != nil {
+		return nil, err
+	}
+	model, _ := env.GetFieldModel(hook.Model)
+
+	call := &api.APICall{ModelName: hook.Model, Method: hook.Method, Kwargs: make(map[string]interface{})}
+	for kwarg, path := range mapping {
+		value, found := lookupPath(payload, path)
+		if !found {
+			continue
+		}
+		if kwarg == "ids" || kwarg == "id" {
+			if call.IDs, err = recordIDs(value); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if model != nil {
+			if field, exists := model.GetField(kwarg); exists {
+				if value, err = field.ConvertToCache(value, nil); err != nil {
+					return nil, fmt.Errorf("field '%s': %w", kwarg, err)
+				}
+			}
+		}
+		call.Kwargs[kwarg] = value
+	}
+
+	if method.Type == api.RecordMethod && len(call.IDs) == 0 {
+		return nil, errors.New("the payload does not map any record id")
+	}
+	if len(call.Kwargs) > 0 {
+		call.Args = []interface{}{call.Kwargs}
+	}
+	return call, nil
+}
+
+// ValidateInbound checks an inbound hook against the registries of a database
+func ValidateInbound(db *gorm.DB, registry *api.APIRegistry, hook *models.InboundHook) error {
+	if !hookNamePattern.MatchString(hook.Name) {
+		return errors.New("name must be lowercase letters, digits, - and _")
+	}
+	if hook.Auth != models.InboundAuthHMAC && hook.Auth != models.InboundAuthToken {
+		return fmt.Errorf("auth must be %s or %s", models.InboundAuthHMAC, models.InboundAuthToken)
+	}
+	if hook.RateLimit < 0 {
+		return errors.New("rate_limit cannot be negative")
+	}
+	if _, err := lookupMethod(registry, hook); err != nil {
+		return err
+	}
+	if _, err := ParseMapping(hook.Mapping); err != nil {
+		return err
+	}
+	var user models.User
+	if err := db.Where("id = ? AND active = ?", hook.UserID, true).First(&user).Error; err != nil {
+		return fmt.Errorf("service user %d not found or inactive", hook.UserID)
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"goodoo/logging"
+	"goodoo/models"
+	"goodoo/notification"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Queue processing settings: a failed delivery is retried with exponential
+// backoff (1, 2, 4, ... minutes) and dead-lettered after the webhook's
+// MaxAttempts (DefaultMaxAttempts when unset).
+const (
+	DefaultMaxAttempts = 5
+	RetryBackoff       = time.Minute
+	BatchSize          = 50
+	// maxResponseBody is how much of a response body is kept for debugging
+	maxResponseBody = 4096
+)
+
+// ProcessQueue posts due deliveries of a database and returns how many
+// succeeded. Rows are locked with SKIP LOCKED so several workers never post
+// the same delivery. The creator of a webhook is notified of the
+// deliveries dead-lettered, once the queue transaction committed.
+func ProcessQueue(ctx context.Context, dbName string, db *gorm.DB, client *http.Client) (int, error) {
+	logger := logging.GetLogger("goodoo.webhook")
+
+	var deliveries []models.WebhookDelivery
+	var byID map[uint]*models.Webhook
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("state = ? AND next_attempt <= ?", models.WebhookDeliveryPending, time.Now()).
+			Order("next_attempt, id").
+			Limit(BatchSize).
+			Find(&deliveries).Error
+		if err != nil || len(deliveries) == 0 {
+			return err
+		}
+
+		hookIDs := make([]uint, 0, len(deliveries))
+		for _, delivery := range deliveries {
+			hookIDs = append(hookIDs, delivery.WebhookID)
+		}
+		var hooks []models.Webhook
+		if err := tx.Where("id IN ?", hookIDs).Find(&hooks).Error; err != nil {
+			return err
+		}
+		byID = make(map[uint]*models.Webhook, len(hooks))
+		for i := range hooks {
+			byID[hooks[i].ID] = &hooks[i]
+		}
+
+		for i := range deliveries {
+			if ctx.Err() != nil {
+				deliveries = deliveries[:i]
+				break
+			}
+			deliver(ctx, tx, client, byID[deliveries[i].WebhookID], &deliveries[i], logger)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for i, delivery := range deliveries {
+		switch {
+		case delivery.State == models.WebhookDeliverySent:
+			sent++
+		case delivery.State == models.WebhookDeliveryDead:
+			// Deliveries of deleted or inactive webhooks are dropped silently
+			if hook := byID[delivery.WebhookID]; hook != nil && hook.Active {
+				notifyDead(dbName, hook, &deliveries[i], logger)
+			}
+		}
+	}
+	return sent, nil
+}
+
+// notifyDead tells the creator of a webhook that a delivery was given up
+func notifyDead(dbName string, hook *models.Webhook, delivery *models.WebhookDelivery, logger *logging.Logger) {
+	title := fmt.Sprintf("Webhook %s failed", hook.Name)
+	body := fmt.Sprintf("The %s event of record %d could not be delivered to %s after %d attempts.",
+		delivery.Event, delivery.ResID, hook.URL, delivery.Attempts)
+	_, err := notification.Notify(dbName, hook.CreateUID, models.NotificationCategoryWebhook, models.NotificationError, title, body, map[string]interface{}{
+		"webhook_id":  hook.ID,
+		"delivery_id": delivery.ID,
+	})
+	if err != nil {
+		logger.Warning("Failed to notify the dead webhook delivery %d: %v", delivery.ID, err)
+	}
+}
+
+// deliver posts one delivery, logs the attempt and schedules a retry or
+// dead-letters it on failure
+func deliver(ctx context.Context, tx *gorm.DB, client *http.Client, hook *models.Webhook, delivery *models.WebhookDelivery, logger *logging.Logger) {
+	if hook == nil || !hook.Active {
+		delivery.State = models.WebhookDeliveryDead
+		err := tx.Model(delivery).Updates(map[string]interface{}{
+			"state": models.WebhookDeliveryDead,
+			"error": "webhook deleted or inactive",
+		}).Error
+		if err != nil {
+			logger.Error("Failed to update webhook delivery %d: %v", delivery.ID, err)
+		}
+		return
+	}
+
+	attempt := models.WebhookDeliveryAttempt{DeliveryID: delivery.ID, AttemptedAt: time.Now()}
+	status, body, err := post(ctx, client, hook, delivery)
+	attempt.DurationMs = time.Since(attempt.AttemptedAt).Milliseconds()
+	attempt.Status = status
+	attempt.ResponseBody = body
+	if err == nil && (status < 200 || status >= 300) {
+		err = fmt.Errorf("receiver answered %d", status)
+	}
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+	if err := tx.Create(&attempt).Error; err != nil {
+		logger.Error("Failed to log attempt of webhook delivery %d: %v", delivery.ID, err)
+	}
+
+	maxAttempts := hook.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultMaxAttempts
+	}
+
+	delivery.Attempts++
+	updates := map[string]interface{}{"attempts": delivery.Attempts, "response_status": status}
+	if err == nil {
+		now := time.Now()
+		delivery.State = models.WebhookDeliverySent
+		updates["state"] = models.WebhookDeliverySent
+		updates["delivered_at"] = now
+		updates["error"] = ""
+	} else if delivery.Attempts >= maxAttempts {
+		delivery.State = models.WebhookDeliveryDead
+		updates["state"] = models.WebhookDeliveryDead
+		updates["error"] = err.Error()
+		logger.Error("Webhook delivery %d to %s dead after %d attempts: %v", delivery.ID, hook.URL, delivery.Attempts, err)
+	} else {
+		delay := RetryBackoff << uint(delivery.Attempts-1)
+		updates["next_attempt"] = time.Now().Add(delay)
+		updates["error"] = err.Error()
+		logger.Warning("Webhook delivery %d to %s failed (attempt %d), retrying in %v: %v",
+			delivery.ID, hook.URL, delivery.Attempts, delay, err)
+	}
+
+	if err := tx.Model(delivery).Updates(updates).Error; err != nil {
+		logger.Error("Failed to update webhook delivery %d: %v", delivery.ID, err)
+	}
+}
+
+// post sends the signed payload and returns the response status and the
+// start of its body
+func post(ctx context.Context, client *http.Client, hook *models.Webhook, delivery *models.WebhookDelivery) (int, string, error) {
+	body := []byte(delivery.Payload)
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, "", err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "Goodoo-Webhook")
+	request.Header.Set("X-Goodoo-Event", delivery.Event)
+	request.Header.Set("X-Goodoo-Delivery", strconv.FormatUint(uint64(delivery.ID), 10))
+	request.Header.Set(SignatureHeader, Sign(string(hook.Secret), body))
+
+	response, err := client.Do(request)
+	if err != nil {
+		return 0, "", err
+	}
+	defer response.Body.Close()
+
+	data, _ := io.ReadAll(io.LimitReader(response.Body, maxResponseBody))
+	return response.StatusCode, string(data), nil
+}
@@ -0,0 +1,236 @@
+// Package webhook queues record events of field-defined models for the
+// webhooks subscribed to them and POSTs them, signed, with retries. It also
+// verifies and maps the events partners push to inbound hooks.
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"goodoo/database"
+	"goodoo/httpclient"
+	"goodoo/logging"
+	"goodoo/models"
+	"goodoo/scheduler"
+	"gorm.io/gorm"
+)
+
+// SignatureHeader carries "sha256=<hex HMAC of the body keyed by the webhook secret>"
+const SignatureHeader = "X-Goodoo-Signature"
+
+// Events lists the record events a webhook can subscribe to
+var Events = []string{models.EventCreate, models.EventWrite, models.EventUnlink}
+
+func init() {
+	models.OnRecordEvent(dispatch)
+}
+
+// Payload is the JSON body POSTed for one record event
+type Payload struct {
+	Event     string    `json:"event"`
+	Model     string    `json:"model"`
+	ID        uint      `json:"id"`
+	Fields    []string  `json:"fields"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Sign returns the signature header value of a body
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// GenerateSecret returns a random secret for a new webhook
+func GenerateSecret() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// SplitEvents parses a comma-separated event list
+func SplitEvents(value string) []string {
+	var events []string
+	for _, event := range strings.Split(value, ",") {
+		if event = strings.TrimSpace(event); event != "" {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// ParseDomain decodes the JSON domain filter of a webhook
+func ParseDomain(value string) (models.Domain, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	var domain models.Domain
+	if err := json.Unmarshal([]byte(value), &domain); err != nil {
+		return nil, fmt.Errorf("invalid domain: %w", err)
+	}
+	return domain, nil
+}
+
+// Validate checks the events, model and domain of a webhook against an environment
+func Validate(env *models.Environment, hook *models.Webhook) error {
+	if hook.Name == "" || hook.URL == "" || hook.Model == "" {
+		return errors.New("name, url and model are required")
+	}
+	if !strings.HasPrefix(hook.URL, "http://") && !strings.HasPrefix(hook.URL, "https://") {
+		return errors.New("url must be http or https")
+	}
+	events := SplitEvents(hook.Events)
+	if len(events) == 0 {
+		return errors.New("at least one event is required")
+	}
+	for _, event := range events {
+		if !slices.Contains(Events, event) {
+			return fmt.Errorf("unknown event %q", event)
+		}
+	}
+	model, exists := env.GetFieldModel(hook.Model)
+	if !exists || model.Abstract {
+		return fmt.Errorf("model %s not found", hook.Model)
+	}
+	domain, err := ParseDomain(hook.Domain)
+	if err != nil {
+		return err
+	}
+	// Running the domain once rejects unknown fields and operators
+	if _, err := model.SearchCount(env.Sudo(), domain); err != nil {
+		return err
+	}
+	return nil
+}
+
+// tables remembers the databases known to have the webhook tables
+var tables sync.Map
+
+// hasTables tells whether a database has been migrated with the webhook tables
+func hasTables(env *models.Environment) bool {
+	if _, ok := tables.Load(env.GetDBName()); ok {
+		return true
+	}
+	if !env.GetDB().Migrator().HasTable(&models.Webhook{}) {
+		return false
+	}
+	if env.GetDBName() != "" {
+		tables.Store(env.GetDBName(), true)
+	}
+	return true
+}
+
+// dispatch queues a delivery for each active webhook of the event's model
+// subscribed to its type, and each record matching the webhook domain. It
+// runs in the transaction of the change, so deliveries are only queued
+// for committed changes; unlink events are matched before the delete.
+func dispatch(env *models.Environment, event models.RecordEvent) error {
+	if !hasTables(env) {
+		return nil
+	}
+	db := env.GetDB()
+
+	var hooks []models.Webhook
+	if err := db.Where("model = ? AND active = ?", event.Model, true).Order("id").Find(&hooks).Error; err != nil {
+		return err
+	}
+	if len(hooks) == 0 {
+		return nil
+	}
+	model, exists := env.GetFieldModel(event.Model)
+	if !exists {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	for _, hook := range hooks {
+		if !subscribed(&hook, event.Type) {
+			continue
+		}
+		ids, err := matching(env, model, &hook, event.IDs)
+		if err != nil {
+			return fmt.Errorf("webhook %d: %w", hook.ID, err)
+		}
+		for _, id := range ids {
+			body, err := json.Marshal(Payload{Event: event.Type, Model: event.Model, ID: id, Fields: event.Fields, Timestamp: now})
+			if err != nil {
+				return err
+			}
+			delivery := &models.WebhookDelivery{
+				WebhookID:   hook.ID,
+				Event:       event.Type,
+				ResID:       id,
+				Payload:     string(body),
+				State:       models.WebhookDeliveryPending,
+				NextAttempt: now,
+			}
+			if err := db.Create(delivery).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// subscribed tells whether a webhook listens to an event type
+func subscribed(hook *models.Webhook, eventType string) bool {
+	return slices.Contains(SplitEvents(hook.Events), eventType)
+}
+
+// matching returns the records among ids that satisfy the webhook domain
+func matching(env *models.Environment, model *models.ModelDefinition, hook *models.Webhook, ids []uint) ([]uint, error) {
+	domain, err := ParseDomain(hook.Domain)
+	if err != nil || len(domain) == 0 {
+		return ids, err
+	}
+	domain = append(domain, []interface{}{"id", "in", ids})
+	// Filters may use fields the writing user cannot read
+	return model.Search(env.Sudo(), domain, 0, 0, "")
+}
+
+// Redeliver queues a copy of a delivery to be sent again; the original and
+// its attempts are kept for history
+func Redeliver(db *gorm.DB, original *models.WebhookDelivery) (*models.WebhookDelivery, error) {
+	id := original.ID
+	delivery := &models.WebhookDelivery{
+		WebhookID:    original.WebhookID,
+		Event:        original.Event,
+		ResID:        original.ResID,
+		Payload:      original.Payload,
+		State:        models.WebhookDeliveryPending,
+		NextAttempt:  time.Now(),
+		RedeliveryOf: &id,
+	}
+	if err := db.Create(delivery).Error; err != nil {
+		return nil, err
+	}
+	return delivery, nil
+}
+
+// ScheduleQueue registers the job posting queued deliveries of a database every interval
+func ScheduleQueue(s *scheduler.Scheduler, dbName string, interval time.Duration) {
+	logger := logging.GetLogger("goodoo.webhook")
+	s.Every("webhook.queue."+dbName, interval, func(ctx context.Context) error {
+		db, err := database.GetDatabase(dbName)
+		if err != nil {
+			return err
+		}
+		sent, err := ProcessQueue(ctx, dbName, db.WithContext(ctx), httpclient.Client(httpclient.PurposeWebhook))
+		if sent > 0 {
+			logger.Info("Delivered %d webhook event(s) for %s", sent, dbName)
+		}
+		return err
+	})
+}
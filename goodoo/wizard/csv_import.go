@@ -0,0 +1,615 @@
+package wizard
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"goodoo/fields"
+	"goodoo/logging"
+	"goodoo/models"
+	"goodoo/operations"
+)
+
+// Limits of the CSV import
+const (
+	// ImportBatchSize is the rows imported between two progress reports
+	// and cancellation checks
+	ImportBatchSize = 100
+	// importPreviewRows are the converted rows shown by the dry run
+	importPreviewRows = 10
+	// importPreviewErrors bounds the row errors kept by the dry run, and
+	// the duplicate rows it flags
+	importPreviewErrors = 100
+	// importDuplicateChecks bounds the rows the dry run checks against
+	// the duplicate rules of the model
+	importDuplicateChecks = 5000
+)
+
+var importLogger = logging.GetLogger("goodoo.wizard.import")
+
+func init() {
+	if err := Register(NewImportWizard()); err != nil {
+		panic(err)
+	}
+}
+
+// NewImportWizard returns the wizard importing a CSV file into a model:
+// the file is uploaded, its columns are mapped to fields, a dry run
+// previews the conversion and the rows are imported by a background
+// operation
+func NewImportWizard() *Wizard {
+	return &Wizard{
+		Name:  models.ImportWizardModel,
+		Title: "Import records",
+		Model: models.NewImportWizard(),
+		Steps: []Step{
+			{
+				Name:     "upload",
+				Title:    "Upload a file",
+				Fields:   []string{"res_model", "file", "file_name", "has_headers", "encoding", "separator"},
+				Next:     []string{"mapping"},
+				Validate: validateImportUpload,
+			},
+			{
+				Name:     "mapping",
+				Title:    "Map the columns",
+				Fields:   []string{"mapping", "column_formats", "key_column", "xmlid_column", "references"},
+				Readonly: []string{"res_model", "file_name", "profile", "columns", "row_count"},
+				Next:     []string{"upload", "preview"},
+				Validate: validateImportMapping,
+			},
+			{
+				Name:     "preview",
+				Title:    "Check the preview",
+				Readonly: []string{"res_model", "profile", "row_count", "preview"},
+				Next:     []string{"mapping", Done},
+				Validate: func(s *Session, values map[string]interface{}) (string, error) {
+					return Done, nil
+				},
+			},
+		},
+		Finish: finishImport,
+	}
+}
+
+// importTarget returns the model rows are imported into
+func importTarget(env *models.Environment, name string) (*models.ModelDefinition, error) {
+	model, ok := env.GetFieldModel(name)
+	if !ok {
+		return nil, Invalid("res_model", "unknown model %s", name)
+	}
+	if model.Abstract || model.Transient {
+		return nil, Invalid("res_model", "records cannot be imported into %s", name)
+	}
+	return model, nil
+}
+
+// importable reports whether a column can be imported into a field
+func importable(model *models.ModelDefinition, name string) bool {
+	field, ok := model.GetField(name)
+	if !ok || models.IsMagicColumn(name) || !field.GetAttributes().Store {
+		return false
+	}
+	switch field.GetType() {
+	case fields.One2manyType, fields.Many2manyType, fields.BinaryType:
+		return false
+	}
+	return true
+}
+
+// importFile is a parsed CSV file
+type importFile struct {
+	profile ImportProfile
+	header  []string
+	rows    [][]string
+}
+
+// parseImportFile reads the file of the wizard with its settings; the
+// encoding and the separator left empty are detected
+func parseImportFile(s *Session, values map[string]interface{}) (*importFile, error) {
+	data, err := s.Model.Fields["file"].ConvertToCache(s.Value(values, "file"), nil)
+	if err != nil {
+		return nil, Invalid("file", "%v", err)
+	}
+	content, _ := data.([]byte)
+	if len(content) == 0 {
+		return nil, Invalid("file", "a file is required")
+	}
+	file := &importFile{}
+	profile := &file.profile
+
+	profile.Encoding, _ = s.Value(values, "encoding").(string)
+	profile.Encoding = strings.ToLower(strings.TrimSpace(profile.Encoding))
+	if name, ok := importEncodingAliases[profile.Encoding]; ok {
+		profile.Encoding = name
+	}
+	detected, bom := detectEncoding(content)
+	profile.BOM = bom
+	if profile.Encoding == "" {
+		profile.Encoding = detected
+		profile.Detected = append(profile.Detected, "encoding")
+	}
+	text, err := decodeImport(content, profile.Encoding)
+	if err != nil {
+		return nil, err
+	}
+
+	hint, text := separatorHint(text)
+	profile.Separator, _ = s.Value(values, "separator").(string)
+	if profile.Separator == `\t` {
+		profile.Separator = "\t"
+	}
+	if profile.Separator == "" {
+		profile.Separator = hint
+		if profile.Separator == "" {
+			profile.Separator = detectSeparator(text)
+		}
+		profile.Detected = append(profile.Detected, "separator")
+	}
+	if utf8.RuneCountInString(profile.Separator) != 1 {
+		return nil, Invalid("separator", "the separator must be a single character")
+	}
+	hasHeaders, ok := s.Value(values, "has_headers").(bool)
+	if !ok {
+		hasHeaders = true
+	}
+
+	separator, _ := utf8.DecodeRuneInString(profile.Separator)
+	records, err := readImportRecords(text, separator)
+	if err != nil {
+		return nil, Invalid("file", "invalid CSV file: %v", err)
+	}
+	width := 0
+	for _, record := range records {
+		if hasHeaders && file.header == nil {
+			file.header = record
+			continue
+		}
+		// Spreadsheets pad the files with rows of empty cells
+		if strings.TrimSpace(strings.Join(record, "")) == "" {
+			continue
+		}
+		file.rows = append(file.rows, record)
+		width = max(width, len(record))
+	}
+	if len(file.rows) == 0 {
+		return nil, Invalid("file", "the file has no rows to import")
+	}
+	for i := len(file.header); i < width; i++ {
+		file.header = append(file.header, fmt.Sprintf("Column %d", i+1))
+	}
+	for i, name := range file.header {
+		file.header[i] = strings.TrimSpace(name)
+	}
+	return file, nil
+}
+
+// importColumn is a column imported into a field
+type importColumn struct {
+	index int
+	field string
+	// format normalizes the cells of the column, nil to read them in the
+	// language of the user
+	format *columnFormat
+	// reference resolves the cells of a relational column naming rows or
+	// records other than by id, see planImport
+	reference *importReference
+}
+
+// cell returns the value of the column in a row, nil when empty
+func (c importColumn) cell(row []string) interface{} {
+	if c.index >= len(row) || strings.TrimSpace(row[c.index]) == "" {
+		return nil
+	}
+	return strings.TrimSpace(row[c.index])
+}
+
+// convertRow converts the cells of a row to the values of a record: the
+// columns with a format are normalized with it, the others are read in
+// the language of the user. The columns with a reference are left to
+// planImport.
+func convertRow(env *models.Environment, model *models.ModelDefinition, columns []importColumn, row []string) (map[string]interface{}, error) {
+	vals := make(map[string]interface{}, len(columns))
+	localized := make(map[string]interface{}, len(columns))
+	_, loc := fields.DisplayLocale(env)
+	for _, column := range columns {
+		value := column.cell(row)
+		if value == nil || column.reference != nil {
+			continue
+		}
+		if column.format != nil {
+			normalized, ok, err := column.format.normalize(model.Fields[column.field], value.(string), loc)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", column.field, err)
+			}
+			if ok {
+				vals[column.field] = normalized
+				continue
+			}
+		}
+		localized[column.field] = value
+	}
+	model.ParseLocalized(env, localized)
+	for name, value := range localized {
+		vals[name] = value
+	}
+	for name, value := range vals {
+		field := model.Fields[name]
+		converted, err := field.ConvertToCache(value, nil)
+		if err == nil {
+			err = field.Validate(converted, nil)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		vals[name] = converted
+	}
+	return vals, nil
+}
+
+// validateImportUpload parses the file, proposes a mapping of the columns
+// whose name is a field name or label and the formats of the columns of
+// numbers and dates not written in the language of the user, and goes to
+// the mapping. The profile the file was read with is returned for the
+// user to confirm, or to go back and override.
+func validateImportUpload(s *Session, values map[string]interface{}) (string, error) {
+	resModel, _ := s.Value(values, "res_model").(string)
+	target, err := importTarget(s.Env, resModel)
+	if err != nil {
+		return "", err
+	}
+	file, err := parseImportFile(s, values)
+	if err != nil {
+		return "", err
+	}
+
+	byLabel := make(map[string]string)
+	for name, field := range target.Fields {
+		if importable(target, name) {
+			byLabel[strings.ToLower(field.GetAttributes().String)] = name
+		}
+	}
+	for name := range target.Fields {
+		if importable(target, name) {
+			byLabel[strings.ToLower(name)] = name
+		}
+	}
+	formats, alternatives := guessColumnFormats(s.Env, file)
+	columns := make([]map[string]interface{}, len(file.header))
+	mapping := make(map[string]interface{})
+	for i, name := range file.header {
+		sample := ""
+		if i < len(file.rows[0]) {
+			sample = file.rows[0][i]
+		}
+		columns[i] = map[string]interface{}{"name": name, "sample": sample}
+		if dates, ok := alternatives[name]; ok {
+			// The samples do not tell day from month: the user chooses
+			columns[i]["date_formats"] = append([]string{formats[name].DateFormat}, dates...)
+		}
+		if field, ok := byLabel[strings.ToLower(name)]; ok {
+			mapping[name] = field
+		}
+	}
+	// A column named like Odoo's exports holds the external ids of the rows
+	values["key_column"], values["xmlid_column"], values["references"] = nil, nil, nil
+	for _, name := range file.header {
+		if lower := strings.ToLower(name); lower == "id" || lower == "external id" {
+			values["xmlid_column"] = name
+			break
+		}
+	}
+	values["profile"] = file.profile
+	values["columns"] = columns
+	values["row_count"] = len(file.rows)
+	values["mapping"] = mapping
+	values["column_formats"] = formats
+	values["preview"] = nil
+	return "mapping", nil
+}
+
+// importColumns checks a mapping of column names to fields, and the
+// formats and references of the columns, against the file and the target
+// model
+func importColumns(s *Session, target *models.ModelDefinition, file *importFile, mapping map[string]string, formats map[string]ImportColumnFormat,
+	references map[string]ImportReference, hasKey bool) ([]importColumn, error) {
+	for name := range formats {
+		if !slices.Contains(file.header, name) {
+			return nil, Invalid("column_formats", "the file has no column %s", name)
+		}
+	}
+	for name := range references {
+		if mapping[name] == "" {
+			return nil, Invalid("references", "column %s is not mapped", name)
+		}
+	}
+
+	names := make([]string, 0, len(mapping))
+	for name := range mapping {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var columns []importColumn
+	mapped := make(map[string]string)
+	for _, name := range names {
+		field := mapping[name]
+		if field == "" {
+			continue
+		}
+		index := -1
+		for i, header := range file.header {
+			if header == name {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			return nil, Invalid("mapping", "the file has no column %s", name)
+		}
+		if !importable(target, field) {
+			return nil, Invalid("mapping", "column %s cannot be imported into %s", name, field)
+		}
+		if other, ok := mapped[field]; ok {
+			return nil, Invalid("mapping", "columns %s and %s are both imported into %s", other, name, field)
+		}
+		mapped[field] = name
+		column := importColumn{index: index, field: field}
+		if format, ok := formats[name]; ok {
+			compiled, err := format.compile(name)
+			if err != nil {
+				return nil, err
+			}
+			column.format = compiled
+		}
+		if reference, ok := references[name]; ok {
+			compiled, err := reference.compile(s.Env, target, name, field, hasKey)
+			if err != nil {
+				return nil, err
+			}
+			column.reference = compiled
+		}
+		columns = append(columns, column)
+	}
+	if len(columns) == 0 {
+		return nil, Invalid("mapping", "map at least one column")
+	}
+
+	defaults := target.DefaultValues(s.Env)
+	var missing []string
+	for name, field := range target.GetStoredFields() {
+		if _, ok := mapped[name]; ok || !field.IsRequired() || models.IsMagicColumn(name) {
+			continue
+		}
+		if _, ok := defaults[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, Invalid("mapping", "required fields are not mapped: %s", strings.Join(missing, ", "))
+	}
+	return columns, nil
+}
+
+// importKeyColumns returns the indexes of the key and external id columns
+// of the file, -1 when not chosen
+func importKeyColumns(s *Session, values map[string]interface{}, file *importFile) (keyIndex, xmlidIndex int, err error) {
+	index := func(field string) (int, error) {
+		name, _ := s.Value(values, field).(string)
+		if name == "" {
+			return -1, nil
+		}
+		if i := slices.Index(file.header, name); i >= 0 {
+			return i, nil
+		}
+		return -1, Invalid(field, "the file has no column %s", name)
+	}
+	if keyIndex, err = index("key_column"); err != nil {
+		return 0, 0, err
+	}
+	if xmlidIndex, err = index("xmlid_column"); err != nil {
+		return 0, 0, err
+	}
+	return keyIndex, xmlidIndex, nil
+}
+
+// importSetup is how the rows of a file are imported
+type importSetup struct {
+	mapping    map[string]string
+	formats    map[string]ImportColumnFormat
+	references map[string]ImportReference
+	keyIndex   int
+	xmlidIndex int
+	columns    []importColumn
+}
+
+// loadImportSetup decodes the mapping, the column formats and references,
+// and the key columns of a wizard, and checks them against the file
+func loadImportSetup(s *Session, values map[string]interface{}, target *models.ModelDefinition, file *importFile) (*importSetup, error) {
+	setup := &importSetup{
+		mapping:    make(map[string]string),
+		formats:    make(map[string]ImportColumnFormat),
+		references: make(map[string]ImportReference),
+	}
+	if err := Decode(s.Value(values, "mapping"), &setup.mapping); err != nil {
+		return nil, Invalid("mapping", "the mapping must map column names to fields")
+	}
+	if err := Decode(s.Value(values, "column_formats"), &setup.formats); err != nil {
+		return nil, Invalid("column_formats", "the formats must be given by column name")
+	}
+	if err := Decode(s.Value(values, "references"), &setup.references); err != nil {
+		return nil, Invalid("references", "the references must be given by column name")
+	}
+	var err error
+	if setup.keyIndex, setup.xmlidIndex, err = importKeyColumns(s, values, file); err != nil {
+		return nil, err
+	}
+	setup.columns, err = importColumns(s, target, file, setup.mapping, setup.formats, setup.references, setup.keyIndex >= 0)
+	if err != nil {
+		return nil, err
+	}
+	return setup, nil
+}
+
+// validateImportMapping checks the mapping and dry-runs the conversion of
+// every row for the preview, with the references between the rows and to
+// stored records; the rows that cannot be imported are reported one by
+// one
+func validateImportMapping(s *Session, values map[string]interface{}) (string, error) {
+	resModel, _ := s.State["res_model"].(string)
+	target, err := importTarget(s.Env, resModel)
+	if err != nil {
+		return "", err
+	}
+	file, err := parseImportFile(s, values)
+	if err != nil {
+		return "", err
+	}
+	setup, err := loadImportSetup(s, values, target, file)
+	if err != nil {
+		return "", err
+	}
+	plan, err := planImport(s.Env, target, file, setup.columns, setup.keyIndex, setup.xmlidIndex)
+	if err != nil {
+		return "", err
+	}
+
+	rows := []map[string]interface{}{}
+	errors := []map[string]interface{}{}
+	duplicates := []map[string]interface{}{}
+	valid, invalid := 0, 0
+	checked, duplicateRows, blockedRows := 0, 0, 0
+	for i := range file.rows {
+		if reason, failed := plan.errors[i]; failed {
+			invalid++
+			if len(errors) < importPreviewErrors {
+				errors = append(errors, map[string]interface{}{"row": i + 1, "error": reason})
+			}
+			continue
+		}
+		vals := plan.vals[i]
+		valid++
+		if len(rows) < importPreviewRows {
+			rows = append(rows, vals)
+		}
+
+		// Rows matching a blocking rule will fail to import
+		if checked == importDuplicateChecks {
+			continue
+		}
+		checked++
+		matches, err := target.CheckDuplicates(s.Env, vals, 0)
+		if err != nil {
+			return "", err
+		}
+		if len(matches) == 0 {
+			continue
+		}
+		duplicateRows++
+		blocked := false
+		for _, match := range matches {
+			blocked = blocked || match.Action == models.DuplicateBlock
+		}
+		if blocked {
+			blockedRows++
+		}
+		if len(duplicates) < importPreviewErrors {
+			duplicates = append(duplicates, map[string]interface{}{"row": i + 1, "matches": matches, "blocked": blocked})
+		}
+	}
+	values["mapping"] = setup.mapping
+	values["column_formats"] = setup.formats
+	values["references"] = setup.references
+	values["preview"] = map[string]interface{}{
+		"profile":    file.profile,
+		"rows":       rows,
+		"errors":     errors,
+		"valid":      valid,
+		"invalid":    invalid,
+		"references": plan.referencePreview(),
+		// Rows probably duplicating stored records, among the first checked
+		"duplicates":         duplicates,
+		"duplicate_rows":     duplicateRows,
+		"blocked_rows":       blockedRows,
+		"duplicates_checked": checked,
+	}
+	return "preview", nil
+}
+
+// finishImport starts the operation creating a record per row, in
+// batches and in the order of the references between rows; rows that
+// fail are counted and reported by the operation.
+// The result holds the ID of the operation to poll.
+func finishImport(s *Session) (map[string]interface{}, error) {
+	resModel, _ := s.State["res_model"].(string)
+	target, err := importTarget(s.Env, resModel)
+	if err != nil {
+		return nil, err
+	}
+	file, err := parseImportFile(s, nil)
+	if err != nil {
+		return nil, err
+	}
+	setup, err := loadImportSetup(s, nil, target, file)
+	if err != nil {
+		return nil, err
+	}
+	plan, err := planImport(s.Env, target, file, setup.columns, setup.keyIndex, setup.xmlidIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	// The request context ends with the response: rows are imported detached
+	env := s.Env.Detach()
+	id := s.ID()
+	op := operations.Start("import", target.Name, env.GetDBName(), int(env.GetUser()), len(file.rows), func(ctx context.Context, op *operations.Operation) error {
+		for i := range file.rows {
+			if reason, failed := plan.errors[i]; failed {
+				op.Progress(0, 1, fmt.Errorf("row %d: %s", i+1, reason))
+			}
+		}
+		// Rows are created parents first, then the deferred references
+		// are patched
+		ids := make([]uint, len(file.rows))
+		batches := (len(plan.order) + ImportBatchSize - 1) / ImportBatchSize
+		for batch := 0; batch < batches; batch++ {
+			if op.Cancelled() {
+				break
+			}
+			op.BeginBatch(batch+1, batches)
+			end := min((batch+1)*ImportBatchSize, len(plan.order))
+			for _, i := range plan.order[batch*ImportBatchSize : end] {
+				var err error
+				ids[i], err = plan.create(env, target, i, ids)
+				if err != nil {
+					op.Progress(0, 1, fmt.Errorf("row %d: %w", i+1, err))
+				} else {
+					op.Progress(1, 0, nil)
+				}
+			}
+		}
+		for _, i := range plan.order {
+			if err := plan.patch(env, target, i, ids); err != nil {
+				op.Progress(0, 0, fmt.Errorf("row %d: %w", i+1, err))
+			}
+		}
+		status := op.Status()
+		importLogger.Info("Wizard %s imported %d of %d rows into %s, %d failed",
+			id, status.Processed, status.Total, target.Name, status.Failed)
+		return nil
+	})
+
+	if err := s.Model.Write(s.Env, []uint{s.ResID}, map[string]interface{}{"state": "done"}); err != nil {
+		importLogger.Warning("Failed to mark wizard %s imported: %v", id, err)
+	}
+	return map[string]interface{}{
+		"operation_id": op.Status().ID,
+		"model":        target.Name,
+		"total":        len(file.rows),
+	}, nil
+}
@@ -0,0 +1,455 @@
+package wizard
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	textunicode "golang.org/x/text/encoding/unicode"
+	"goodoo/fields"
+	"goodoo/locale"
+	"goodoo/models"
+)
+
+// Encodings of imported files
+const (
+	EncodingUTF8    = "utf-8"
+	EncodingUTF16   = "utf-16"
+	EncodingCP1252  = "windows-1252"
+	EncodingLatin1  = "iso-8859-1"
+	importSniffSize = 64 << 10
+	// importGuessSamples are the cells of a column the guesser looks at
+	importGuessSamples = 50
+)
+
+// importSeparators are the separators the detection chooses from
+var importSeparators = []rune{',', ';', '\t', '|'}
+
+// importEncodings decode the files that are not UTF-8
+var importEncodings = map[string]encoding.Encoding{
+	EncodingUTF16:  textunicode.UTF16(textunicode.LittleEndian, textunicode.ExpectBOM),
+	EncodingCP1252: charmap.Windows1252,
+	EncodingLatin1: charmap.ISO8859_1,
+}
+
+// importEncodingAliases are the other names users give the encodings
+var importEncodingAliases = map[string]string{
+	"utf8": EncodingUTF8, "utf-16le": EncodingUTF16, "utf-16be": EncodingUTF16,
+	"cp1252": EncodingCP1252, "latin-1": EncodingLatin1, "latin1": EncodingLatin1,
+}
+
+// ImportProfile is how an imported file is read: its encoding and column
+// separator, detected unless the user chose them
+type ImportProfile struct {
+	Encoding  string `json:"encoding"`
+	Separator string `json:"separator"`
+	// BOM reports whether the file started with a byte order mark
+	BOM bool `json:"bom"`
+	// Detected names the settings that were detected, for the user to
+	// confirm or override
+	Detected []string `json:"detected,omitempty"`
+}
+
+// detectEncoding guesses the encoding of a file: a byte order mark wins,
+// valid UTF-8 is UTF-8, and anything else is taken for Windows-1252 when
+// it uses the bytes Latin-1 leaves to control characters, Latin-1
+// otherwise
+func detectEncoding(content []byte) (string, bool) {
+	switch {
+	case bytes.HasPrefix(content, []byte("\xef\xbb\xbf")):
+		return EncodingUTF8, true
+	case bytes.HasPrefix(content, []byte("\xff\xfe")), bytes.HasPrefix(content, []byte("\xfe\xff")):
+		return EncodingUTF16, true
+	case utf8.Valid(content):
+		return EncodingUTF8, false
+	}
+	for _, b := range content {
+		if b >= 0x80 && b <= 0x9f {
+			return EncodingCP1252, false
+		}
+	}
+	return EncodingLatin1, false
+}
+
+// decodeImport returns the text of a file in an encoding, without its
+// byte order mark
+func decodeImport(content []byte, name string) (string, error) {
+	if name == EncodingUTF8 {
+		content = bytes.TrimPrefix(content, []byte("\xef\xbb\xbf"))
+		if !utf8.Valid(content) {
+			return "", Invalid("encoding", "the file is not valid UTF-8, choose its encoding")
+		}
+		return string(content), nil
+	}
+	enc, ok := importEncodings[name]
+	if !ok {
+		return "", Invalid("encoding", "unknown encoding %s", name)
+	}
+	if name == EncodingUTF16 && bytes.HasPrefix(content, []byte("\xfe\xff")) {
+		enc = textunicode.UTF16(textunicode.BigEndian, textunicode.ExpectBOM)
+	}
+	decoded, err := enc.NewDecoder().Bytes(content)
+	if err != nil {
+		return "", Invalid("encoding", "the file cannot be read as %s: %v", name, err)
+	}
+	return string(decoded), nil
+}
+
+// separatorHint splits the "sep=;" first line spreadsheets may write off
+// the text, returning the separator it names
+func separatorHint(text string) (string, string) {
+	line, rest, _ := strings.Cut(text, "\n")
+	line = strings.TrimSuffix(line, "\r")
+	if sep, ok := strings.CutPrefix(line, "sep="); ok && utf8.RuneCountInString(sep) == 1 {
+		return sep, rest
+	}
+	return "", text
+}
+
+// detectSeparator returns the separator splitting the first records of
+// the text into the most consistent number of columns, comma when none
+// splits them
+func detectSeparator(text string) string {
+	if len(text) > importSniffSize {
+		text = text[:importSniffSize]
+		if end := strings.LastIndexByte(text, '\n'); end > 0 {
+			text = text[:end]
+		}
+	}
+	best, bestRows, bestWidth := ',', 0, 1
+	for _, separator := range importSeparators {
+		reader := csv.NewReader(strings.NewReader(text))
+		reader.Comma = separator
+		reader.FieldsPerRecord = -1
+		reader.LazyQuotes = true
+		widths := map[int]int{}
+		for records := 0; records < importGuessSamples; records++ {
+			record, err := reader.Read()
+			if err != nil {
+				break
+			}
+			widths[len(record)]++
+		}
+		// The most frequent width above one column, the widest on a tie
+		rows, width := 0, 1
+		for w, n := range widths {
+			if w > 1 && (n > rows || n == rows && w > width) {
+				rows, width = n, w
+			}
+		}
+		if rows > bestRows || rows == bestRows && width > bestWidth {
+			best, bestRows, bestWidth = separator, rows, width
+		}
+	}
+	return string(best)
+}
+
+// ImportColumnFormat tells how the cells of a column are written when
+// they do not follow the language of the user: the separators of numbers
+// and the strftime format of dates, e.g. "%d/%m/%Y"
+type ImportColumnFormat struct {
+	DecimalSep   string `json:"decimal_separator,omitempty"`
+	ThousandsSep string `json:"thousands_separator,omitempty"`
+	DateFormat   string `json:"date_format,omitempty"`
+}
+
+// strftimeLayouts map the strftime directives of date formats to Go; days
+// and months are read with or without a leading zero
+var strftimeLayouts = map[byte]string{
+	'd': "2", 'm': "1", 'Y': "2006", 'y': "06", 'b': "Jan", 'B': "January",
+	'H': "15", 'I': "03", 'M': "04", 'S': "05", 'p': "PM", '%': "%",
+}
+
+// dateLayout translates a strftime date format to a Go layout
+func dateLayout(format string) (string, error) {
+	var layout strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			layout.WriteByte(format[i])
+			continue
+		}
+		i++
+		if i == len(format) {
+			return "", fmt.Errorf("date format %q ends with %%", format)
+		}
+		directive, ok := strftimeLayouts[format[i]]
+		if !ok {
+			return "", fmt.Errorf("date format %q: unsupported directive %%%c", format, format[i])
+		}
+		layout.WriteString(directive)
+	}
+	return layout.String(), nil
+}
+
+// numberSeparators are the separators a column format may use
+var numberSeparators = []string{"", ".", ",", " ", "'"}
+
+// columnFormat is an ImportColumnFormat ready to normalize cells
+type columnFormat struct {
+	decimal, thousands string
+	layout             string
+}
+
+// compile checks a column format
+func (f ImportColumnFormat) compile(column string) (*columnFormat, error) {
+	format := &columnFormat{decimal: f.DecimalSep, thousands: f.ThousandsSep}
+	for _, sep := range []string{f.DecimalSep, f.ThousandsSep} {
+		if !slices.Contains(numberSeparators, sep) {
+			return nil, Invalid("column_formats", "column %s: %q is not a number separator", column, sep)
+		}
+	}
+	if f.DecimalSep != "" && f.DecimalSep == f.ThousandsSep {
+		return nil, Invalid("column_formats", "column %s: the decimal and thousands separators are the same", column)
+	}
+	if f.DateFormat != "" {
+		layout, err := dateLayout(f.DateFormat)
+		if err != nil {
+			return nil, Invalid("column_formats", "column %s: %v", column, err)
+		}
+		format.layout = layout
+	}
+	return format, nil
+}
+
+// normalize converts a cell to the canonical text ConvertToCache reads
+// for a field: numbers with a dot and no grouping, dates as YYYY-MM-DD and
+// datetimes as UTC YYYY-MM-DD HH:MM:SS, a datetime being read in loc.
+// ok is false when the format does not apply to the field.
+func (f *columnFormat) normalize(field fields.Field, cell string, loc *time.Location) (string, bool, error) {
+	switch field.GetType() {
+	case fields.IntegerType, fields.FloatType, fields.MonetaryType:
+		if f.decimal == "" && f.thousands == "" {
+			return "", false, nil
+		}
+		number := cell
+		if f.thousands == " " {
+			number = strings.Map(func(r rune) rune {
+				if r == ' ' || r == ' ' || r == ' ' {
+					return -1
+				}
+				return r
+			}, number)
+		} else if f.thousands != "" {
+			number = strings.ReplaceAll(number, f.thousands, "")
+		}
+		if f.decimal != "" && f.decimal != "." {
+			if strings.Contains(number, ".") {
+				return "", true, fmt.Errorf("invalid number %q", cell)
+			}
+			number = strings.Replace(number, f.decimal, ".", 1)
+		}
+		return number, true, nil
+	case fields.DateType, fields.DatetimeType:
+		if f.layout == "" {
+			return "", false, nil
+		}
+		datetime := field.GetType() == fields.DatetimeType
+		if !datetime {
+			loc = time.UTC
+		}
+		parsed, err := time.ParseInLocation(f.layout, cell, loc)
+		if err != nil {
+			// Canonical dates are accepted in every column
+			if parsed, err = time.ParseInLocation("2006-01-02", cell, loc); err != nil {
+				return "", true, fmt.Errorf("invalid date %q", cell)
+			}
+		}
+		if datetime {
+			return parsed.UTC().Format("2006-01-02 15:04:05"), true, nil
+		}
+		return parsed.Format("2006-01-02"), true, nil
+	}
+	return "", false, nil
+}
+
+// importDateFormats are the date formats the guesser tries, in order of
+// preference when several read a column
+var importDateFormats = []string{
+	"%Y-%m-%d", "%d/%m/%Y", "%m/%d/%Y", "%d.%m.%Y", "%d-%m-%Y", "%Y/%m/%d",
+	"%d/%m/%y", "%m/%d/%y", "%d.%m.%y",
+}
+
+// importTimeFormats are the time formats the guesser tries after a date
+var importTimeFormats = []string{"", " %H:%M:%S", " %H:%M"}
+
+// columnSamples returns the first non-empty cells of a column
+func columnSamples(file *importFile, index int) []string {
+	var samples []string
+	for _, row := range file.rows {
+		if index < len(row) {
+			if cell := strings.TrimSpace(row[index]); cell != "" {
+				samples = append(samples, cell)
+				if len(samples) == importGuessSamples {
+					break
+				}
+			}
+		}
+	}
+	return samples
+}
+
+// localeDate reports whether a date layout reads the dates of the locale
+func localeDate(l *locale.Locale, layout string) bool {
+	reference := time.Date(2006, time.January, 22, 0, 0, 0, 0, time.UTC)
+	parsed, err := time.Parse(layout, reference.Format(l.DateFormat))
+	return err == nil && parsed.Equal(reference)
+}
+
+// guessDateFormats returns the date formats reading every sample, those
+// that agree with the language of the user first; canonical dates are
+// read by every format and a column of canonical dates needs none
+func guessDateFormats(samples []string, l *locale.Locale) []string {
+	var preferred, others []string
+	for _, date := range importDateFormats {
+		dateOnly, _ := dateLayout(date)
+		agrees := localeDate(l, dateOnly)
+		for _, clock := range importTimeFormats {
+			format := date + clock
+			layout, _ := dateLayout(format)
+			matched, canonical := true, true
+			for _, sample := range samples {
+				if _, err := time.Parse(layout, sample); err == nil {
+					canonical = false
+					continue
+				}
+				if _, err := time.Parse("2006-01-02", sample); err != nil {
+					matched = false
+					break
+				}
+			}
+			if matched && !canonical && format != "%Y-%m-%d" {
+				if agrees {
+					preferred = append(preferred, format)
+				} else {
+					others = append(others, format)
+				}
+			}
+		}
+	}
+	return append(preferred, others...)
+}
+
+// guessNumberFormat returns the separators of a column of numbers when its
+// cells show them: a separator appearing twice, or before the other one,
+// groups thousands; one not followed by exactly three digits is decimal.
+// ok is false for columns that are not numbers or do not tell.
+func guessNumberFormat(samples []string) (ImportColumnFormat, bool) {
+	var decimal, thousands string
+	vote := func(current *string, sep string) bool {
+		if *current != "" && *current != sep {
+			return false
+		}
+		*current = sep
+		return true
+	}
+	for _, sample := range samples {
+		number := strings.TrimLeft(sample, "+-")
+		digits := 0
+		for _, r := range number {
+			switch {
+			case r >= '0' && r <= '9':
+				digits++
+			case r == '.' || r == ',' || r == '\'' || unicode.IsSpace(r):
+			default:
+				return ImportColumnFormat{}, false
+			}
+		}
+		if digits == 0 {
+			return ImportColumnFormat{}, false
+		}
+		if strings.IndexFunc(number, unicode.IsSpace) >= 0 && !vote(&thousands, " ") {
+			return ImportColumnFormat{}, false
+		}
+		if strings.Contains(number, "'") && !vote(&thousands, "'") {
+			return ImportColumnFormat{}, false
+		}
+		dot, comma := strings.LastIndex(number, "."), strings.LastIndex(number, ",")
+		for _, sep := range []struct {
+			mark        string
+			last, other int
+		}{{".", dot, comma}, {",", comma, dot}} {
+			if sep.last < 0 {
+				continue
+			}
+			var ok bool
+			switch {
+			case strings.Count(number, sep.mark) > 1, sep.last < sep.other:
+				ok = vote(&thousands, sep.mark)
+			case sep.other >= 0, len(number)-sep.last-1 != 3:
+				ok = vote(&decimal, sep.mark)
+			default:
+				// "1,234" tells nothing alone
+				ok = true
+			}
+			if !ok {
+				return ImportColumnFormat{}, false
+			}
+		}
+	}
+	if decimal == "" && thousands == "" || decimal != "" && decimal == thousands {
+		return ImportColumnFormat{}, false
+	}
+	if decimal == "" {
+		decimal = "."
+		if thousands == "." {
+			decimal = ","
+		}
+	}
+	return ImportColumnFormat{DecimalSep: decimal, ThousandsSep: thousands}, true
+}
+
+// guessColumnFormats proposes the formats of the columns whose samples
+// show numbers or dates written otherwise than in the language of the
+// user, with the other date formats reading them when they are ambiguous
+func guessColumnFormats(env *models.Environment, file *importFile) (map[string]ImportColumnFormat, map[string][]string) {
+	l, _ := fields.DisplayLocale(env)
+	formats := map[string]ImportColumnFormat{}
+	alternatives := map[string][]string{}
+	for i, name := range file.header {
+		samples := columnSamples(file, i)
+		if len(samples) == 0 {
+			continue
+		}
+		if dates := guessDateFormats(samples, l); len(dates) > 0 {
+			formats[name] = ImportColumnFormat{DateFormat: dates[0]}
+			if len(dates) > 1 {
+				alternatives[name] = dates[1:]
+			}
+			continue
+		}
+		if format, ok := guessNumberFormat(samples); ok {
+			if format.DecimalSep == l.DecimalSep && (format.ThousandsSep == "" || format.ThousandsSep == l.ThousandsSep) {
+				continue
+			}
+			formats[name] = format
+		}
+	}
+	return formats, alternatives
+}
+
+// readImportRecords splits the text of a file into records; quoted cells
+// may hold separators and line breaks
+func readImportRecords(text string, separator rune) ([][]string, error) {
+	reader := csv.NewReader(strings.NewReader(text))
+	reader.Comma = separator
+	reader.FieldsPerRecord = -1
+	var records [][]string
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+}
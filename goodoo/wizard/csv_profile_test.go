@@ -0,0 +1,273 @@
+package wizard
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+
+	"goodoo/fields"
+	"goodoo/models"
+	"goodoo/models/testutil"
+)
+
+// contactModel is the model the fixtures are imported into
+func contactModel(t *testing.T) *models.ModelDefinition {
+	model := models.NewModelDefinition("x_contact", "x_contact")
+	for name, fieldType := range map[string]fields.FieldType{
+		"name": fields.StringType, "city": fields.StringType, "amount": fields.FloatType,
+		"date": fields.DateType, "note": fields.TextType,
+	} {
+		field, err := fields.CreateField(fieldType, fields.FieldAttribute{Store: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		model.AddField(name, field)
+	}
+	return model
+}
+
+// importSession returns a session of the import wizard on a dry-run
+// database, for a user of the language lang
+func importSession(t *testing.T, lang string) *Session {
+	db, _ := testutil.DryRunDB(t)
+	env := models.NewEnvironment(db, 2).WithContext(map[string]interface{}{"lang": lang})
+	return &Session{Wizard: NewImportWizard(), Model: models.NewImportWizard(), Env: env, State: map[string]interface{}{}}
+}
+
+// TestImportFixtures reads deliberately messy files of testdata with the
+// profile and column formats detected, or chosen by the user, and
+// converts their rows to the canonical values of the fields
+func TestImportFixtures(t *testing.T) {
+	tests := []struct {
+		file string
+		// encoding and separator are chosen by the user when set
+		encoding, separator string
+		// formats override the formats guessed
+		formats          map[string]ImportColumnFormat
+		wantProfile      ImportProfile
+		wantFormats      map[string]ImportColumnFormat
+		wantAlternatives map[string][]string
+		wantRows         []map[string]interface{}
+	}{
+		{
+			file:        "excel_semicolon.csv",
+			wantProfile: ImportProfile{Encoding: EncodingCP1252, Separator: ";", Detected: []string{"encoding", "separator"}},
+			wantFormats: map[string]ImportColumnFormat{
+				"amount": {DecimalSep: ",", ThousandsSep: "."},
+				"date":   {DateFormat: "%d.%m.%Y"},
+			},
+			wantRows: []map[string]interface{}{
+				{"name": "Jürgen Müller", "city": "Köln", "amount": 1234.5, "date": "2026-10-15", "note": "Zahlung in €\nbis Freitag"},
+				{"name": "Renée Dupont", "city": "Liège", "amount": 12.3, "date": "2026-02-01"},
+				{"name": "Björn Groß", "city": "Zürich", "amount": -7.5, "date": "2025-12-31", "note": `Preis "netto"`},
+			},
+		},
+		{
+			// The encoding is known, the separator still detected
+			file: "excel_semicolon.csv", encoding: "cp1252",
+			wantProfile: ImportProfile{Encoding: EncodingCP1252, Separator: ";", Detected: []string{"separator"}},
+			wantFormats: map[string]ImportColumnFormat{
+				"amount": {DecimalSep: ",", ThousandsSep: "."},
+				"date":   {DateFormat: "%d.%m.%Y"},
+			},
+			wantRows: []map[string]interface{}{
+				{"name": "Jürgen Müller", "city": "Köln", "amount": 1234.5, "date": "2026-10-15", "note": "Zahlung in €\nbis Freitag"},
+				{"name": "Renée Dupont", "city": "Liège", "amount": 12.3, "date": "2026-02-01"},
+				{"name": "Björn Groß", "city": "Zürich", "amount": -7.5, "date": "2025-12-31", "note": `Preis "netto"`},
+			},
+		},
+		{
+			file:        "latin1_names.csv",
+			wantProfile: ImportProfile{Encoding: EncodingLatin1, Separator: ",", Detected: []string{"encoding", "separator"}},
+			wantFormats: map[string]ImportColumnFormat{},
+			wantRows: []map[string]interface{}{
+				{"name": "Jürgen Groß", "city": "Düsseldorf", "amount": 10.5, "date": "2026-10-15"},
+				{"name": "Zoë Saldaña", "city": "São Paulo", "amount": 3.0, "date": "2026-01-02"},
+			},
+		},
+		{
+			file:        "bom_tab.csv",
+			wantProfile: ImportProfile{Encoding: EncodingUTF8, Separator: "\t", BOM: true, Detected: []string{"encoding", "separator"}},
+			wantFormats: map[string]ImportColumnFormat{"date": {DateFormat: "%d/%m/%Y"}},
+			wantRows: []map[string]interface{}{
+				{"name": "Smith, John", "city": "London", "amount": 1234.5, "date": "2026-12-25"},
+				{"name": "Ana", "city": "Porto", "amount": 99.99, "date": "2026-03-04"},
+			},
+		},
+		{
+			// A tab typed in the form arrives escaped
+			file: "bom_tab.csv", separator: `\t`,
+			wantProfile: ImportProfile{Encoding: EncodingUTF8, Separator: "\t", BOM: true, Detected: []string{"encoding"}},
+			wantFormats: map[string]ImportColumnFormat{"date": {DateFormat: "%d/%m/%Y"}},
+			wantRows: []map[string]interface{}{
+				{"name": "Smith, John", "city": "London", "amount": 1234.5, "date": "2026-12-25"},
+				{"name": "Ana", "city": "Porto", "amount": 99.99, "date": "2026-03-04"},
+			},
+		},
+		{
+			// Day and month cannot be told apart: the language of the user
+			// decides, the other reading is proposed
+			file:             "mixed_dates.csv",
+			wantProfile:      ImportProfile{Encoding: EncodingUTF8, Separator: ",", Detected: []string{"encoding", "separator"}},
+			wantFormats:      map[string]ImportColumnFormat{"date": {DateFormat: "%m/%d/%Y"}},
+			wantAlternatives: map[string][]string{"date": {"%d/%m/%Y"}},
+			wantRows: []map[string]interface{}{
+				{"name": "Alice", "date": "2026-01-02"},
+				{"name": "Bob", "date": "2026-03-04"},
+				{"name": "Carol", "date": "2026-05-06"},
+			},
+		},
+		{
+			// The user chose the other reading
+			file:             "mixed_dates.csv",
+			formats:          map[string]ImportColumnFormat{"date": {DateFormat: "%d/%m/%Y"}},
+			wantProfile:      ImportProfile{Encoding: EncodingUTF8, Separator: ",", Detected: []string{"encoding", "separator"}},
+			wantFormats:      map[string]ImportColumnFormat{"date": {DateFormat: "%m/%d/%Y"}},
+			wantAlternatives: map[string][]string{"date": {"%d/%m/%Y"}},
+			wantRows: []map[string]interface{}{
+				{"name": "Alice", "date": "2026-02-01"},
+				{"name": "Bob", "date": "2026-04-03"},
+				{"name": "Carol", "date": "2026-05-06"},
+			},
+		},
+		{
+			// The first line names the separator, the commas are data
+			file:        "sep_hint.csv",
+			wantProfile: ImportProfile{Encoding: EncodingUTF8, Separator: ";", Detected: []string{"encoding", "separator"}},
+			wantFormats: map[string]ImportColumnFormat{},
+			wantRows: []map[string]interface{}{
+				{"name": "Doe, Jane", "city": "Gent"},
+				{"name": "Roe, Richard", "city": "Brugge"},
+			},
+		},
+	}
+	model := contactModel(t)
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			content, err := os.ReadFile(filepath.Join("testdata", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := importSession(t, "en_US")
+			file, err := parseImportFile(s, map[string]interface{}{"file": content, "encoding": tt.encoding, "separator": tt.separator})
+			if err != nil {
+				t.Fatalf("parseImportFile: %v", err)
+			}
+			if !reflect.DeepEqual(file.profile, tt.wantProfile) {
+				t.Errorf("profile = %+v, want %+v", file.profile, tt.wantProfile)
+			}
+
+			formats, alternatives := guessColumnFormats(s.Env, file)
+			if !reflect.DeepEqual(formats, tt.wantFormats) {
+				t.Errorf("formats = %v, want %v", formats, tt.wantFormats)
+			}
+			if len(alternatives) > 0 || len(tt.wantAlternatives) > 0 {
+				if !reflect.DeepEqual(alternatives, tt.wantAlternatives) {
+					t.Errorf("alternative formats = %v, want %v", alternatives, tt.wantAlternatives)
+				}
+			}
+			for name, format := range tt.formats {
+				formats[name] = format
+			}
+
+			mapping := map[string]string{}
+			for _, name := range file.header {
+				mapping[name] = name
+			}
+			columns, err := importColumns(s, model, file, mapping, formats, nil, false)
+			if err != nil {
+				t.Fatalf("importColumns: %v", err)
+			}
+			if len(file.rows) != len(tt.wantRows) {
+				t.Fatalf("%d rows read, want %d: %q", len(file.rows), len(tt.wantRows), file.rows)
+			}
+			for i, row := range file.rows {
+				vals, err := convertRow(s.Env, model, columns, row)
+				if err != nil {
+					t.Fatalf("row %d: %v", i+1, err)
+				}
+				for name, value := range vals {
+					if date, ok := value.(interface{ Format(string) string }); ok && name == "date" {
+						vals[name] = date.Format("2006-01-02")
+					}
+				}
+				if !reflect.DeepEqual(vals, tt.wantRows[i]) {
+					t.Errorf("row %d = %#v, want %#v", i+1, vals, tt.wantRows[i])
+				}
+			}
+		})
+	}
+}
+
+// TestImportProfileErrors refuses the settings a file cannot be read with
+func TestImportProfileErrors(t *testing.T) {
+	cp1252, err := os.ReadFile(filepath.Join("testdata", "excel_semicolon.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		values map[string]interface{}
+	}{
+		{"not UTF-8", map[string]interface{}{"file": cp1252, "encoding": "utf-8"}},
+		{"unknown encoding", map[string]interface{}{"file": cp1252, "encoding": "ebcdic"}},
+		{"long separator", map[string]interface{}{"file": cp1252, "separator": ";;"}},
+		{"empty file", map[string]interface{}{"file": []byte{}}},
+		{"header only", map[string]interface{}{"file": []byte("name;city\r\n;\r\n")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if file, err := parseImportFile(importSession(t, "en_US"), tt.values); err == nil {
+				t.Errorf("parseImportFile = %+v, want an error", file.profile)
+			}
+		})
+	}
+}
+
+func TestGuessNumberFormat(t *testing.T) {
+	tests := []struct {
+		samples []string
+		want    ImportColumnFormat
+		ok      bool
+	}{
+		{[]string{"1.234,50", "12,30"}, ImportColumnFormat{DecimalSep: ",", ThousandsSep: "."}, true},
+		{[]string{"1,234.50", "7"}, ImportColumnFormat{DecimalSep: ".", ThousandsSep: ","}, true},
+		{[]string{"1 234 567,8"}, ImportColumnFormat{DecimalSep: ",", ThousandsSep: " "}, true},
+		{[]string{"1'234.5"}, ImportColumnFormat{DecimalSep: ".", ThousandsSep: "'"}, true},
+		{[]string{"1.234.567"}, ImportColumnFormat{DecimalSep: ",", ThousandsSep: "."}, true},
+		{[]string{"0,5"}, ImportColumnFormat{DecimalSep: ","}, true},
+		// "1,234" reads as a thousand or as a decimal
+		{[]string{"1,234"}, ImportColumnFormat{}, false},
+		{[]string{"1,5", "1.5"}, ImportColumnFormat{}, false},
+		{[]string{"12", "abc"}, ImportColumnFormat{}, false},
+	}
+	for _, tt := range tests {
+		if got, ok := guessNumberFormat(tt.samples); got != tt.want || ok != tt.ok {
+			t.Errorf("guessNumberFormat(%q) = %+v, %v; want %+v, %v", tt.samples, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestGuessDateFormats(t *testing.T) {
+	tests := []struct {
+		lang    string
+		samples []string
+		want    []string
+	}{
+		{"en_US", []string{"2026-10-15"}, nil},
+		{"en_US", []string{"15/10/2026"}, []string{"%d/%m/%Y"}},
+		{"en_US", []string{"01/02/2026"}, []string{"%m/%d/%Y", "%d/%m/%Y"}},
+		{"fr_FR", []string{"01/02/2026"}, []string{"%d/%m/%Y", "%m/%d/%Y"}},
+		{"de_DE", []string{"15.10.26"}, []string{"%d.%m.%y"}},
+		{"en_US", []string{"15.10.2026 08:30"}, []string{"%d.%m.%Y %H:%M"}},
+		{"en_US", []string{"15/10/2026", "10/15/2026"}, nil},
+	}
+	for _, tt := range tests {
+		l, _ := fields.DisplayLocale(importSession(t, tt.lang).Env)
+		if got := guessDateFormats(tt.samples, l); !slices.Equal(got, tt.want) {
+			t.Errorf("guessDateFormats(%q) in %s = %q, want %q", tt.samples, tt.lang, got, tt.want)
+		}
+	}
+}
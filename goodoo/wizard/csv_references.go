@@ -0,0 +1,517 @@
+package wizard
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"goodoo/models"
+	"gorm.io/gorm"
+)
+
+// How the cells of a relational column name their record; the cells of
+// a column without a reference are record ids
+const (
+	// ReferenceByKey names a row of the file by its key column
+	ReferenceByKey = "key"
+	// ReferenceByXMLID names a row of the file by its external id column,
+	// or a stored record by its external id
+	ReferenceByXMLID = "xmlid"
+	// ReferenceByMatch names a stored record by the value of one of its
+	// fields, e.g. the email of a partner
+	ReferenceByMatch = "match"
+)
+
+// importPreviewLinks bounds the references listed by the dry run
+const importPreviewLinks = 200
+
+// ImportReference tells how the cells of a relational column name their
+// record: By is key, xmlid or match, Field the field of the related model
+// matched
+type ImportReference struct {
+	By    string `json:"by"`
+	Field string `json:"field,omitempty"`
+}
+
+// compile checks the reference of a column imported into field of target
+func (r ImportReference) compile(env *models.Environment, target *models.ModelDefinition, column, field string, hasKey bool) (*importReference, error) {
+	relation := target.Fields[field].GetAttributes().Relation
+	if relation == "" {
+		return nil, Invalid("references", "column %s is imported into %s, which is not relational", column, field)
+	}
+	comodel, ok := env.GetFieldModel(relation)
+	if !ok {
+		return nil, Invalid("references", "column %s: unknown model %s", column, relation)
+	}
+	reference := &importReference{ImportReference: r, comodel: comodel, required: target.Fields[field].IsRequired()}
+	switch r.By {
+	case ReferenceByKey:
+		if !hasKey {
+			return nil, Invalid("references", "column %s references rows by key: choose the key column", column)
+		}
+		if comodel.Name != target.Name {
+			return nil, Invalid("references", "column %s references %s records, rows of the file are %s records", column, comodel.Name, target.Name)
+		}
+	case ReferenceByXMLID:
+	case ReferenceByMatch:
+		matched, ok := comodel.GetField(r.Field)
+		if !ok || !matched.IsStored() {
+			return nil, Invalid("references", "column %s: %s has no stored field %q to match", column, comodel.Name, r.Field)
+		}
+	default:
+		return nil, Invalid("references", "column %s: references are by %s, %s or %s", column, ReferenceByKey, ReferenceByXMLID, ReferenceByMatch)
+	}
+	return reference, nil
+}
+
+// importReference is the checked reference of a column
+type importReference struct {
+	ImportReference
+	comodel  *models.ModelDefinition
+	required bool
+}
+
+// importLink is a reference of a row to another row of the file, or to a
+// stored record. Deferred links close a cycle: the row is created without
+// them and patched once their row exists.
+type importLink struct {
+	field    string
+	required bool
+	row      int
+	record   uint
+	deferred bool
+}
+
+// importPlan is what an import does with each row: its values, the
+// references resolved or to resolve, the order rows are created in, and
+// the rows that cannot be imported with the reason
+type importPlan struct {
+	vals   []map[string]interface{}
+	links  [][]importLink
+	xmlids []string
+	order  []int
+	errors map[int]string
+	cycles [][]int
+}
+
+// fail records why a row cannot be imported, keeping the first reason
+func (p *importPlan) fail(row int, format string, args ...interface{}) {
+	if _, failed := p.errors[row]; !failed {
+		p.errors[row] = fmt.Sprintf(format, args...)
+	}
+}
+
+// importXMLID returns the external id of a cell, in the import module
+// when it names none
+func importXMLID(value string) string {
+	if strings.Contains(value, ".") {
+		return value
+	}
+	return models.ImportXMLIDModule + "." + value
+}
+
+// cellAt returns the trimmed cell of a column of a row, "" without one
+func cellAt(row []string, index int) string {
+	if index < 0 || index >= len(row) {
+		return ""
+	}
+	return strings.TrimSpace(row[index])
+}
+
+// rowList names rows for the messages, from 1
+func rowList(rows []int) string {
+	names := make([]string, len(rows))
+	for i, row := range rows {
+		names[i] = strconv.Itoa(row + 1)
+	}
+	return strings.Join(names, ", ")
+}
+
+// planImport converts the rows of a file and resolves their references in
+// two passes: the references to stored records are looked up in bulk,
+// then the references between rows make a graph. Rows are created parents
+// first; in a cycle, the references of optional fields are deferred, and
+// a cycle only required fields make fails its rows. A row that cannot be
+// imported fails the rows referencing it, and nothing else.
+func planImport(env *models.Environment, target *models.ModelDefinition, file *importFile, columns []importColumn, keyIndex, xmlidIndex int) (*importPlan, error) {
+	n := len(file.rows)
+	plan := &importPlan{
+		vals:   make([]map[string]interface{}, n),
+		links:  make([][]importLink, n),
+		xmlids: make([]string, n),
+		errors: make(map[int]string),
+	}
+	for i, row := range file.rows {
+		vals, err := convertRow(env, target, columns, row)
+		if err != nil {
+			plan.fail(i, "%v", err)
+			continue
+		}
+		plan.vals[i] = vals
+	}
+
+	keys := make(map[string]int)
+	xmlids := make(map[string]int)
+	for i, row := range file.rows {
+		if key := cellAt(row, keyIndex); key != "" {
+			if first, taken := keys[key]; taken {
+				plan.fail(i, "key %s is the key of row %d already", key, first+1)
+			} else {
+				keys[key] = i
+			}
+		}
+		if value := cellAt(row, xmlidIndex); value != "" {
+			xmlid := importXMLID(value)
+			if first, taken := xmlids[xmlid]; taken {
+				plan.fail(i, "external id %s is the one of row %d already", xmlid, first+1)
+			} else {
+				xmlids[xmlid] = i
+				plan.xmlids[i] = xmlid
+			}
+		}
+	}
+
+	// The stored records named by the cells, looked up in bulk
+	var lookupXMLIDs []string
+	matchValues := make(map[int][]string)
+	for _, row := range file.rows {
+		for c, column := range columns {
+			value := cellAt(row, column.index)
+			if column.reference == nil || value == "" {
+				continue
+			}
+			switch column.reference.By {
+			case ReferenceByXMLID:
+				xmlid := importXMLID(value)
+				if _, inFile := xmlids[xmlid]; !inFile || column.reference.comodel.Name != target.Name {
+					lookupXMLIDs = append(lookupXMLIDs, xmlid)
+				}
+			case ReferenceByMatch:
+				matchValues[c] = append(matchValues[c], value)
+			}
+		}
+	}
+	stored, err := models.ResolveXMLIDs(env.GetDB(), lookupXMLIDs)
+	if err != nil {
+		return nil, err
+	}
+	matches := make(map[int]map[string][]uint, len(matchValues))
+	for c, values := range matchValues {
+		if matches[c], err = matchRecords(env, columns[c].reference, values); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, row := range file.rows {
+		for c, column := range columns {
+			value := cellAt(row, column.index)
+			if column.reference == nil || value == "" {
+				continue
+			}
+			link := importLink{field: column.field, required: column.reference.required, row: -1}
+			comodel := column.reference.comodel.Name
+			switch column.reference.By {
+			case ReferenceByKey:
+				parent, ok := keys[value]
+				if !ok {
+					plan.fail(i, "%s: no row has the key %s", column.field, value)
+					continue
+				}
+				link.row = parent
+			case ReferenceByXMLID:
+				xmlid := importXMLID(value)
+				if parent, ok := xmlids[xmlid]; ok && comodel == target.Name {
+					link.row = parent
+					break
+				}
+				data, ok := stored[xmlid]
+				switch {
+				case !ok:
+					plan.fail(i, "%s: no row nor %s record has the external id %s", column.field, comodel, xmlid)
+					continue
+				case data.Model != comodel:
+					plan.fail(i, "%s: external id %s is a %s record, not a %s one", column.field, xmlid, data.Model, comodel)
+					continue
+				}
+				link.record = data.ResID
+			case ReferenceByMatch:
+				ids := matches[c][value]
+				switch {
+				case len(ids) == 0:
+					plan.fail(i, "%s: no %s record has %s %s", column.field, comodel, column.reference.Field, value)
+					continue
+				case len(ids) > 1:
+					plan.fail(i, "%s: %d %s records have %s %s", column.field, len(ids), comodel, column.reference.Field, value)
+					continue
+				}
+				link.record = ids[0]
+			}
+			plan.links[i] = append(plan.links[i], link)
+		}
+	}
+
+	// Cycles are broken by deferring their optional references; what
+	// remains of them only required fields make
+	all := func(link importLink) bool { return true }
+	for _, cycle := range cyclicComponents(plan.links, all) {
+		plan.cycles = append(plan.cycles, cycle)
+		inCycle := make(map[int]bool, len(cycle))
+		for _, row := range cycle {
+			inCycle[row] = true
+		}
+		for _, row := range cycle {
+			for j := range plan.links[row] {
+				if link := &plan.links[row][j]; link.row >= 0 && inCycle[link.row] && !link.required {
+					link.deferred = true
+				}
+			}
+		}
+	}
+	immediate := func(link importLink) bool { return !link.deferred }
+	for _, cycle := range cyclicComponents(plan.links, immediate) {
+		for _, row := range cycle {
+			plan.fail(row, "circular reference through rows %s that required fields cannot break", rowList(cycle))
+		}
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for i, links := range plan.links {
+			if _, failed := plan.errors[i]; failed {
+				continue
+			}
+			for _, link := range links {
+				if _, failed := plan.errors[link.row]; link.row >= 0 && failed {
+					plan.fail(i, "%s: row %d cannot be imported", link.field, link.row+1)
+					changed = true
+					break
+				}
+			}
+		}
+	}
+
+	visited := make([]bool, n)
+	var visit func(row int)
+	visit = func(row int) {
+		if visited[row] {
+			return
+		}
+		visited[row] = true
+		for _, link := range plan.links[row] {
+			if link.row >= 0 && !link.deferred {
+				visit(link.row)
+			}
+		}
+		plan.order = append(plan.order, row)
+	}
+	for i := range file.rows {
+		if _, failed := plan.errors[i]; !failed {
+			visit(i)
+		}
+	}
+	return plan, nil
+}
+
+// matchRecords returns the records of the related model of a reference
+// whose matched field has one of values, by value
+func matchRecords(env *models.Environment, reference *importReference, values []string) (map[string][]uint, error) {
+	sort.Strings(values)
+	values = slices.Compact(values)
+	found := make(map[string][]uint)
+	for start := 0; start < len(values); start += 1000 {
+		chunk := make([]interface{}, 0, 1000)
+		for _, value := range values[start:min(start+1000, len(values))] {
+			chunk = append(chunk, value)
+		}
+		domain := models.Domain{[]interface{}{reference.Field, "in", chunk}}
+		ids, err := reference.comodel.Search(env, domain, 0, 0, "id")
+		if err != nil {
+			return nil, err
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		records, err := reference.comodel.Read(env, ids, []string{reference.Field})
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			id, err := strconv.ParseUint(fmt.Sprint(record["id"]), 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			value := fmt.Sprint(record[reference.Field])
+			found[value] = append(found[value], uint(id))
+		}
+	}
+	return found, nil
+}
+
+// cyclicComponents returns the cycles of the rows along the links follow
+// accepts: the strongly connected components of more than one row, or of
+// a row referencing itself, each sorted
+func cyclicComponents(links [][]importLink, follow func(importLink) bool) [][]int {
+	index := make([]int, len(links))
+	lowlink := make([]int, len(links))
+	onStack := make([]bool, len(links))
+	for i := range index {
+		index[i] = -1
+	}
+	var stack []int
+	var cycles [][]int
+	next := 0
+	var connect func(row int)
+	connect = func(row int) {
+		index[row], lowlink[row] = next, next
+		next++
+		stack = append(stack, row)
+		onStack[row] = true
+		selfLoop := false
+		for _, link := range links[row] {
+			if link.row < 0 || !follow(link) {
+				continue
+			}
+			switch {
+			case link.row == row:
+				selfLoop = true
+			case index[link.row] < 0:
+				connect(link.row)
+				lowlink[row] = min(lowlink[row], lowlink[link.row])
+			case onStack[link.row]:
+				lowlink[row] = min(lowlink[row], index[link.row])
+			}
+		}
+		if lowlink[row] != index[row] {
+			return
+		}
+		var component []int
+		for {
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[top] = false
+			component = append(component, top)
+			if top == row {
+				break
+			}
+		}
+		if len(component) > 1 || selfLoop {
+			sort.Ints(component)
+			cycles = append(cycles, component)
+		}
+	}
+	for row := range links {
+		if index[row] < 0 {
+			connect(row)
+		}
+	}
+	sort.Slice(cycles, func(i, j int) bool { return cycles[i][0] < cycles[j][0] })
+	return cycles
+}
+
+// referencePreview describes the references of a plan for the dry run:
+// the links between rows and to stored records, the deferred ones and the
+// cycles, rows numbered from 1
+func (p *importPlan) referencePreview() map[string]interface{} {
+	links := []map[string]interface{}{}
+	resolved, deferred := 0, 0
+	for i, rowLinks := range p.links {
+		if _, failed := p.errors[i]; failed {
+			continue
+		}
+		for _, link := range rowLinks {
+			resolved++
+			if link.deferred {
+				deferred++
+			}
+			if len(links) == importPreviewLinks {
+				continue
+			}
+			entry := map[string]interface{}{"row": i + 1, "field": link.field}
+			if link.row >= 0 {
+				entry["target_row"] = link.row + 1
+				entry["deferred"] = link.deferred
+			} else {
+				entry["record_id"] = link.record
+			}
+			links = append(links, entry)
+		}
+	}
+	cycles := make([][]int, 0, len(p.cycles))
+	for _, cycle := range p.cycles {
+		rows := make([]int, len(cycle))
+		for i, row := range cycle {
+			rows[i] = row + 1
+		}
+		cycles = append(cycles, rows)
+	}
+	return map[string]interface{}{
+		"links":    links,
+		"resolved": resolved,
+		"deferred": deferred,
+		"cycles":   cycles,
+	}
+}
+
+// create creates the record of a row with the references resolved so far
+// in ids, and gives it the external id of its row. A row whose referenced
+// row was not imported fails.
+func (p *importPlan) create(env *models.Environment, target *models.ModelDefinition, row int, ids []uint) (uint, error) {
+	vals := make(map[string]interface{}, len(p.vals[row])+len(p.links[row]))
+	for name, value := range p.vals[row] {
+		vals[name] = value
+	}
+	for _, link := range p.links[row] {
+		switch {
+		case link.row < 0:
+			vals[link.field] = link.record
+		case link.deferred:
+		case ids[link.row] == 0:
+			return 0, fmt.Errorf("%s: row %d was not imported", link.field, link.row+1)
+		default:
+			vals[link.field] = ids[link.row]
+		}
+	}
+	var id uint
+	err := env.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if id, err = target.Create(env.WithDB(tx), vals); err != nil {
+			return err
+		}
+		if p.xmlids[row] != "" {
+			return models.SetXMLID(tx, p.xmlids[row], target.Name, id)
+		}
+		return nil
+	})
+	return id, err
+}
+
+// patch sets the deferred references of a row created, once the rows they
+// name exist
+func (p *importPlan) patch(env *models.Environment, target *models.ModelDefinition, row int, ids []uint) error {
+	if ids[row] == 0 {
+		return nil
+	}
+	vals := make(map[string]interface{})
+	var missing []string
+	for _, link := range p.links[row] {
+		if !link.deferred {
+			continue
+		}
+		if ids[link.row] == 0 {
+			missing = append(missing, fmt.Sprintf("%s (row %d was not imported)", link.field, link.row+1))
+			continue
+		}
+		vals[link.field] = ids[link.row]
+	}
+	if len(vals) > 0 {
+		if err := target.Write(env, []uint{ids[row]}, vals); err != nil {
+			return fmt.Errorf("references not set: %w", err)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("imported without %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,478 @@
+// Package wizard runs multi-step actions (like Odoo's wizards). The state
+// of a running wizard is a record of a transient model, so a client can
+// reload the page and resume it, and abandoned wizards are removed by the
+// transient vacuum. Each step names the fields it edits, validates them
+// and picks the next step among those it allows; submitting the last step
+// finishes the wizard, e.g. by starting a background operation.
+package wizard
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"goodoo/fields"
+	"goodoo/models"
+	"goodoo/upload"
+	"gorm.io/gorm"
+)
+
+// Done is the step of a finished wizard; a step allowing it may finish
+// the wizard
+const Done = "done"
+
+// Fields the framework adds to the state model
+const (
+	StepField   = "wizard_step"
+	ResultField = "wizard_result"
+)
+
+var (
+	// ErrNotFound is returned for an unknown wizard or one of another user
+	ErrNotFound = errors.New("wizard not found")
+	// ErrFinished is returned when submitting a finished wizard
+	ErrFinished = errors.New("wizard is already finished")
+	// ErrStaleStep is returned when the submitted step is not the current
+	// one, e.g. from another tab
+	ErrStaleStep = errors.New("wizard moved to another step")
+)
+
+// ValidationError rejects the values submitted at a step; Fields maps the
+// invalid fields to their error
+type ValidationError struct {
+	Message string
+	Fields  map[string]string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+// Invalid returns a ValidationError of a field
+func Invalid(field, format string, args ...interface{}) *ValidationError {
+	message := fmt.Sprintf(format, args...)
+	return &ValidationError{Message: message, Fields: map[string]string{field: message}}
+}
+
+// Step is a page of a wizard
+type Step struct {
+	Name  string
+	Title string
+	// Fields are the fields of the state model edited at this step
+	Fields []string
+	// Readonly are the fields shown at this step but computed by the
+	// previous ones, such as a preview
+	Readonly []string
+	// Next are the steps the wizard may go to from this one, Done to
+	// finish it. Going to a step other than the one Validate returns is
+	// allowed without validation, e.g. to go back.
+	Next []string
+	// Validate checks the values submitted at this step and returns the
+	// next step. It may add computed values to values, which are saved
+	// with them.
+	Validate func(s *Session, values map[string]interface{}) (string, error)
+}
+
+// Wizard is a multi-step action on a transient state model
+type Wizard struct {
+	Name  string
+	Title string
+	// Model holds the state of the running wizards; it is made transient
+	// and registered by Register
+	Model *models.ModelDefinition
+	// Steps start with the first one
+	Steps []Step
+	// Finish runs when a step goes to Done and returns the result of the
+	// wizard, e.g. the ID of the operation it started. The wizard stays at
+	// its step when it fails.
+	Finish func(s *Session) (map[string]interface{}, error)
+}
+
+// step returns a step by name
+func (w *Wizard) step(name string) *Step {
+	for i := range w.Steps {
+		if w.Steps[i].Name == name {
+			return &w.Steps[i]
+		}
+	}
+	return nil
+}
+
+var (
+	wizards = make(map[string]*Wizard)
+	mutex   sync.RWMutex
+)
+
+// Register checks the steps of a wizard, adds the framework fields to its
+// model and registers the model as a transient field model
+func Register(w *Wizard) error {
+	if w.Name == "" || w.Model == nil || len(w.Steps) == 0 || w.Finish == nil {
+		return fmt.Errorf("wizard %q needs a model, steps and a finish", w.Name)
+	}
+	for _, step := range w.Steps {
+		if step.Name == Done || step.Validate == nil {
+			return fmt.Errorf("wizard %s: step %q needs another name and a validation", w.Name, step.Name)
+		}
+		for _, name := range append(append([]string{}, step.Fields...), step.Readonly...) {
+			if _, ok := w.Model.GetField(name); !ok {
+				return fmt.Errorf("wizard %s: step %s shows unknown field %s", w.Name, step.Name, name)
+			}
+		}
+		for _, next := range step.Next {
+			if next != Done && w.step(next) == nil {
+				return fmt.Errorf("wizard %s: step %s goes to unknown step %s", w.Name, step.Name, next)
+			}
+		}
+	}
+
+	w.Model.Transient = true
+	stepAttrs := fields.DefaultFieldAttributes()
+	stepAttrs.String, stepAttrs.Readonly, stepAttrs.Default = "Step", true, w.Steps[0].Name
+	stepField, _ := fields.CreateField(fields.StringType, stepAttrs)
+	w.Model.AddField(StepField, stepField)
+	resultAttrs := fields.DefaultFieldAttributes()
+	resultAttrs.String, resultAttrs.Readonly = "Result", true
+	resultField, _ := fields.CreateField(fields.JsonType, resultAttrs)
+	w.Model.AddField(ResultField, resultField)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if _, exists := wizards[w.Name]; exists {
+		return fmt.Errorf("wizard %s already registered", w.Name)
+	}
+	if err := models.RegisterFieldModel(w.Model); err != nil {
+		return err
+	}
+	wizards[w.Name] = w
+	return nil
+}
+
+// Get returns a registered wizard
+func Get(name string) (*Wizard, bool) {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	w, ok := wizards[name]
+	return w, ok
+}
+
+// All returns the registered wizards by name
+func All() []*Wizard {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	all := make([]*Wizard, 0, len(wizards))
+	for _, w := range wizards {
+		all = append(all, w)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Name < all[j].Name })
+	return all
+}
+
+// Session is a running wizard of a user
+type Session struct {
+	Wizard *Wizard
+	// Model is the state model in the registry of the database
+	Model *models.ModelDefinition
+	ResID uint
+	Env   *models.Environment
+	// SessionID is the HTTP session, which owns the staged uploads
+	SessionID string
+	// State holds the saved values
+	State map[string]interface{}
+}
+
+// ID returns the identifier of the running wizard, e.g. base_import.import.42
+func (s *Session) ID() string {
+	return fmt.Sprintf("%s.%d", s.Wizard.Name, s.ResID)
+}
+
+// Step returns the current step, Done once finished
+func (s *Session) Step() string {
+	step, _ := s.State[StepField].(string)
+	return step
+}
+
+// Value returns a value submitted with values, the saved one otherwise
+func (s *Session) Value(values map[string]interface{}, name string) interface{} {
+	if value, ok := values[name]; ok {
+		return value
+	}
+	return s.State[name]
+}
+
+// Decode decodes a JSON field value, as submitted or as read, into target
+func Decode(value, target interface{}) error {
+	var raw []byte
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case string:
+		raw = []byte(v)
+	case []byte:
+		raw = v
+	default:
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		raw = encoded
+	}
+	return json.Unmarshal(raw, target)
+}
+
+// ParseID splits a wizard identifier into the wizard and its record
+func ParseID(id string) (*Wizard, uint, error) {
+	dot := strings.LastIndex(id, ".")
+	if dot <= 0 {
+		return nil, 0, ErrNotFound
+	}
+	w, ok := Get(id[:dot])
+	resID, err := strconv.ParseUint(id[dot+1:], 10, 64)
+	if !ok || err != nil || resID == 0 {
+		return nil, 0, ErrNotFound
+	}
+	return w, uint(resID), nil
+}
+
+// stateModel returns the state model of a wizard in the registry of env
+func stateModel(env *models.Environment, w *Wizard) (*models.ModelDefinition, error) {
+	model, ok := env.GetFieldModel(w.Model.Name)
+	if !ok {
+		return nil, fmt.Errorf("model %s of wizard %s is not registered", w.Model.Name, w.Name)
+	}
+	return model, nil
+}
+
+// Start creates the state of a wizard of the user of env at its first
+// step, with initial values of the fields of that step
+func Start(env *models.Environment, w *Wizard, sessionID string, values map[string]interface{}) (*Session, error) {
+	model, err := stateModel(env, w)
+	if err != nil {
+		return nil, err
+	}
+	first := &w.Steps[0]
+	for name := range values {
+		if !slices.Contains(first.Fields, name) {
+			return nil, Invalid(name, "field %s is not part of step %s", name, first.Name)
+		}
+	}
+	vals := make(map[string]interface{}, len(values)+1)
+	for name, value := range values {
+		vals[name] = value
+	}
+	vals[StepField] = first.Name
+
+	var id uint
+	err = env.Transaction(func(tx *gorm.DB) error {
+		if err := upload.ResolveValues(tx, sessionID, model, vals); err != nil {
+			return &ValidationError{Message: err.Error()}
+		}
+		id, err = model.Create(env.WithDB(tx), vals)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return Load(env, w, id, sessionID)
+}
+
+// Load returns a running wizard of the user of env
+func Load(env *models.Environment, w *Wizard, resID uint, sessionID string) (*Session, error) {
+	model, err := stateModel(env, w)
+	if err != nil {
+		return nil, err
+	}
+	records, err := model.Read(env, []uint{resID}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 || toUint(records[0]["create_uid"]) != env.GetUser() {
+		return nil, ErrNotFound
+	}
+	return &Session{Wizard: w, Model: model, ResID: resID, Env: env, SessionID: sessionID, State: records[0]}, nil
+}
+
+// toUint converts a read id
+func toUint(value interface{}) uint {
+	switch v := value.(type) {
+	case int64:
+		return uint(v)
+	case int32:
+		return uint(v)
+	case int:
+		return uint(v)
+	case uint:
+		return v
+	case float64:
+		return uint(v)
+	}
+	return 0
+}
+
+// Submit submits the values of the current step, which must be step when
+// given. Without to, the values are validated and the wizard goes to the
+// step Validate returns; with to, one of the next steps, the values are
+// saved as they are and the wizard goes there. Going to Done finishes the
+// wizard.
+func (s *Session) Submit(step, to string, values map[string]interface{}) error {
+	current := s.Wizard.step(s.Step())
+	if s.Step() == Done || current == nil {
+		return ErrFinished
+	}
+	if step != "" && step != current.Name {
+		return ErrStaleStep
+	}
+	if to != "" && (to == Done || !slices.Contains(current.Next, to)) {
+		return &ValidationError{Message: fmt.Sprintf("step %s cannot go to %s", current.Name, to)}
+	}
+	for name := range values {
+		if !slices.Contains(current.Fields, name) {
+			return Invalid(name, "field %s is not part of step %s", name, current.Name)
+		}
+	}
+	vals := make(map[string]interface{}, len(values)+1)
+	for name, value := range values {
+		vals[name] = value
+	}
+
+	next := to
+	err := s.Env.Transaction(func(tx *gorm.DB) error {
+		if err := upload.ResolveValues(tx, s.SessionID, s.Model, vals); err != nil {
+			return &ValidationError{Message: err.Error()}
+		}
+		if next == "" {
+			var err error
+			if next, err = current.Validate(s, vals); err != nil {
+				return err
+			}
+			if !slices.Contains(current.Next, next) {
+				return fmt.Errorf("wizard %s: step %s cannot go to %s", s.Wizard.Name, current.Name, next)
+			}
+		}
+		if next != Done {
+			vals[StepField] = next
+		}
+		if len(vals) == 0 {
+			return nil
+		}
+		return s.Model.Write(s.Env.WithDB(tx), []uint{s.ResID}, vals)
+	})
+	if err != nil {
+		return err
+	}
+	for name, value := range vals {
+		s.State[name] = value
+	}
+	if next != Done {
+		return nil
+	}
+
+	result, err := s.Wizard.Finish(s)
+	if err != nil {
+		return err
+	}
+	if result == nil {
+		result = map[string]interface{}{}
+	}
+	done := map[string]interface{}{StepField: Done, ResultField: result}
+	if err := s.Model.Write(s.Env, []uint{s.ResID}, done); err != nil {
+		return err
+	}
+	s.State[StepField], s.State[ResultField] = Done, result
+	return nil
+}
+
+// StepInfo describes a step of a wizard
+type StepInfo struct {
+	Name  string   `json:"name"`
+	Title string   `json:"title"`
+	Next  []string `json:"next"`
+}
+
+// Status is a running wizard as shown to its client: the current step with
+// the schema and values of its fields, or the result once finished
+type Status struct {
+	ID     string                 `json:"id"`
+	Wizard string                 `json:"wizard"`
+	Title  string                 `json:"title"`
+	Step   string                 `json:"step"`
+	Steps  []StepInfo             `json:"steps"`
+	Next   []string               `json:"next"`
+	Fields map[string]interface{} `json:"fields"`
+	Values map[string]interface{} `json:"values"`
+	Result map[string]interface{} `json:"result,omitempty"`
+	// WriteDate tells when the wizard was last submitted; it is vacuumed
+	// after the maximum age of its model
+	WriteDate time.Time `json:"write_date"`
+}
+
+// Status returns the status of the wizard. Binary values are reported as
+// their size, the content being only submitted.
+func (s *Session) Status() Status {
+	w := s.Wizard
+	status := Status{
+		ID:     s.ID(),
+		Wizard: w.Name,
+		Title:  w.Title,
+		Step:   s.Step(),
+		Next:   []string{},
+		Fields: map[string]interface{}{},
+		Values: map[string]interface{}{},
+	}
+	if writeDate, ok := s.State["write_date"].(time.Time); ok {
+		status.WriteDate = writeDate
+	}
+	for _, step := range w.Steps {
+		status.Steps = append(status.Steps, StepInfo{Name: step.Name, Title: step.Title, Next: step.Next})
+	}
+	if status.Step == Done {
+		result := map[string]interface{}{}
+		if err := Decode(s.State[ResultField], &result); err == nil {
+			status.Result = result
+		}
+		return status
+	}
+
+	step := w.step(status.Step)
+	if step == nil {
+		return status
+	}
+	status.Next = step.Next
+	info := s.Model.GetFieldsInfo(s.Env)
+	for _, name := range step.Fields {
+		if fieldInfo, ok := info[name]; ok {
+			status.Fields[name] = fieldInfo
+		}
+	}
+	for _, name := range step.Readonly {
+		if fieldInfo, ok := info[name].(map[string]interface{}); ok {
+			readonly := make(map[string]interface{}, len(fieldInfo))
+			for key, value := range fieldInfo {
+				readonly[key] = value
+			}
+			readonly["readonly"] = true
+			status.Fields[name] = readonly
+		}
+	}
+	for name := range status.Fields {
+		value := s.State[name]
+		switch s.Model.Fields[name].GetType() {
+		case fields.BinaryType:
+			if data, ok := value.([]byte); ok {
+				value = map[string]interface{}{"size": len(data)}
+			}
+		case fields.JsonType:
+			var decoded interface{}
+			if err := Decode(value, &decoded); err == nil {
+				value = decoded
+			}
+		}
+		status.Values[name] = value
+	}
+	return status
+}
@@ -0,0 +1,229 @@
+// Package workpool runs CPU-heavy work, like converting the rows of an
+// import or laying out the documents of a report, on a bounded pool of
+// workers shared by the process. The goroutine starting a batch works on
+// it too, so batches complete even when every worker is busy, and nested
+// batches cannot deadlock. With a size of 0 or 1 batches run inline,
+// which keeps their execution order deterministic.
+package workpool
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Config holds the size of the pool
+type Config struct {
+	// Size is the number of workers; a batch runs on at most Size
+	// goroutines. 0 or 1 disables the pool.
+	Size int
+}
+
+// DefaultConfig returns a pool of GOMAXPROCS workers
+func DefaultConfig() *Config {
+	return &Config{Size: runtime.GOMAXPROCS(0)}
+}
+
+// LoadFromEnv overrides the configuration with GOODOO_WORKER_POOL_SIZE
+func (c *Config) LoadFromEnv() {
+	if value := os.Getenv("GOODOO_WORKER_POOL_SIZE"); value != "" {
+		if size, err := strconv.Atoi(value); err == nil && size >= 0 {
+			c.Size = size
+		}
+	}
+}
+
+// pool is a set of workers running the helper tasks of batches
+type pool struct {
+	size  int
+	tasks chan func()
+	stop  chan struct{}
+}
+
+var (
+	config  = DefaultConfig()
+	current *pool
+	mutex   sync.RWMutex
+	// busy and queued are the gauges reported by CurrentStats
+	busy   atomic.Int64
+	queued atomic.Int64
+)
+
+// Setup installs the process-wide configuration and starts its workers;
+// the workers of a previous configuration stop after their current task
+func Setup(c *Config) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	config = c
+	if current != nil {
+		close(current.stop)
+		current = nil
+	}
+	if c.Size <= 1 {
+		return
+	}
+
+	p := &pool{size: c.Size, tasks: make(chan func(), c.Size), stop: make(chan struct{})}
+	for i := 0; i < c.Size; i++ {
+		go p.run()
+	}
+	current = p
+}
+
+// CurrentConfig returns the pool configuration
+func CurrentConfig() *Config {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return config
+}
+
+// run executes helper tasks until the pool is stopped
+func (p *pool) run() {
+	for {
+		select {
+		case <-p.stop:
+			return
+		case task := <-p.tasks:
+			queued.Add(-1)
+			busy.Add(1)
+			task()
+			busy.Add(-1)
+		}
+	}
+}
+
+// Stats are the gauges of the pool
+type Stats struct {
+	Size int `json:"size"`
+	// Busy is the number of workers running a task
+	Busy int `json:"busy"`
+	// Queued is the number of tasks waiting for a worker
+	Queued int `json:"queued"`
+}
+
+// CurrentStats returns the gauges of the pool
+func CurrentStats() Stats {
+	mutex.RLock()
+	size := 0
+	if current != nil {
+		size = current.size
+	}
+	mutex.RUnlock()
+	return Stats{Size: size, Busy: int(busy.Load()), Queued: int(queued.Load())}
+}
+
+// batch is the state of a Map call shared by the goroutines working on it
+type batch struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	n      int64
+	fn     func(ctx context.Context, i int) error
+	next   atomic.Int64
+
+	mutex    sync.Mutex
+	finished bool
+	err      error
+	wg       sync.WaitGroup
+}
+
+// join registers a helper unless the batch is finished
+func (b *batch) join() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.finished {
+		return false
+	}
+	b.wg.Add(1)
+	return true
+}
+
+// fail records the first error and cancels the other items
+func (b *batch) fail(err error) {
+	b.mutex.Lock()
+	if b.err == nil {
+		b.err = err
+	}
+	b.mutex.Unlock()
+	b.cancel()
+}
+
+// work runs items until none is left or the batch is cancelled
+func (b *batch) work() {
+	for b.ctx.Err() == nil {
+		i := b.next.Add(1) - 1
+		if i >= b.n {
+			return
+		}
+		if err := b.call(int(i)); err != nil {
+			b.fail(err)
+			return
+		}
+	}
+}
+
+// call runs one item, turning a panic into an error
+func (b *batch) call(i int) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic in item %d: %v", i, r)
+		}
+	}()
+	return b.fn(b.ctx, i)
+}
+
+// Map calls fn for every index in [0, n) on the pool and waits for them.
+// Each call should store its result at its index, so results keep the
+// order of the items. The first error cancels the context passed to the
+// remaining calls and is returned, a panic being reported as an error; a
+// cancelled ctx stops the batch between items and returns ctx.Err().
+func Map(ctx context.Context, n int, fn func(ctx context.Context, i int) error) error {
+	if n <= 0 {
+		return ctx.Err()
+	}
+
+	mutex.RLock()
+	p := current
+	mutex.RUnlock()
+
+	b := &batch{n: int64(n), fn: fn}
+	b.ctx, b.cancel = context.WithCancel(ctx)
+	defer b.cancel()
+
+	helper := func() {
+		if !b.join() {
+			return
+		}
+		defer b.wg.Done()
+		b.work()
+	}
+	// Without a pool the caller runs the items in order. Helpers beyond
+	// the free queue slots are dropped: the items are shared, so the
+	// goroutines already working take them over.
+	helpers := 0
+	if p != nil {
+		helpers = min(p.size, n) - 1
+	}
+	for i := 0; i < helpers; i++ {
+		queued.Add(1)
+		select {
+		case p.tasks <- helper:
+		default:
+			queued.Add(-1)
+		}
+	}
+
+	b.work()
+	b.mutex.Lock()
+	b.finished = true
+	b.mutex.Unlock()
+	b.wg.Wait()
+
+	if b.err != nil {
+		return b.err
+	}
+	return ctx.Err()
+}